@@ -0,0 +1,433 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidari
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"golang.org/x/time/rate"
+)
+
+// Reasons of the authentication failures of an authenticator.
+const (
+	AuthFailureMissing      = "missing"
+	AuthFailureInvalidKey   = "invalid_key"
+	AuthFailureInvalidToken = "invalid_token"
+	AuthFailureRateLimited  = "rate_limited"
+)
+
+const (
+	// apiKeyHeader is the header of the API key of a request, which can also be sent as a bearer token.
+	apiKeyHeader = "X-API-Key"
+
+	// defaultJWKSRefresh is the default interval at which the keys of a JWKS URL are fetched again.
+	defaultJWKSRefresh = time.Hour
+
+	// jwksMinRefresh is the minimum interval between the fetches of a JWKS URL for tokens signed by unknown keys, so
+	// that tokens with made up key IDs can not flood the identity provider.
+	jwksMinRefresh = time.Minute
+
+	// jwksMaxBody is the maximum size of the key set of a JWKS URL.
+	jwksMaxBody = 1 << 20
+)
+
+// jwtAlgorithms are the signature algorithms accepted for the tokens validated against a JWKS URL. Tokens signed
+// with a shared secret are refused, since the keys of the URL are public.
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512, jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+var (
+	ErrInvalidAuthentication = fmt.Errorf("invalid authentication")
+	ErrUnauthenticated       = fmt.Errorf("unauthenticated")
+	ErrJWKS                  = fmt.Errorf("unable to fetch JWKS")
+)
+
+// InvalidAuthenticationError is returned when the authentication of an authenticator is not valid.
+func InvalidAuthenticationError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidAuthentication, reason)
+}
+
+// UnauthenticatedError is returned when the credentials of a request are missing or not valid.
+func UnauthenticatedError(reason string, err error) error {
+	if err == nil {
+		return fmt.Errorf("%w: %s", ErrUnauthenticated, reason)
+	}
+
+	return fmt.Errorf("%w: %s: %v", ErrUnauthenticated, reason, err)
+}
+
+// JWKSError is returned when the keys of a JWKS URL can not be fetched.
+func JWKSError(url string, err error) error {
+	return fmt.Errorf("%w from %q: %v", ErrJWKS, url, err)
+}
+
+// APIKey is a static API key of an authenticator.
+type APIKey struct {
+	// Name identifies the client of the key, in the context of its requests and in the metrics, so that the key
+	// itself is never reported.
+	Name string
+
+	// Key is the secret of the key, sent in the "X-API-Key" header or as a bearer token.
+	Key string
+
+	// RateLimit is the number of requests per second allowed with the key, in bursts of up to "Burst" requests. If
+	// zero, the requests of the key are not limited.
+	RateLimit float64
+
+	// Burst is the maximum number of requests of a burst. The default is 1.
+	Burst int
+}
+
+// JWKS is the configuration for validating the bearer JWTs of the requests against the keys of a JWKS URL, e.g. of
+// an OpenID Connect provider.
+type JWKS struct {
+	// URL is the URL of the JSON Web Key Set.
+	URL string
+
+	// Issuer is the required "iss" claim of the tokens. If empty, the issuer is not checked.
+	Issuer string
+
+	// Audience is the required "aud" claim of the tokens. If empty, the audience is not checked.
+	Audience string
+
+	// Refresh is the interval at which the keys are fetched again, so that rotated keys are picked up. Keys are also
+	// fetched again, at most once a minute, for tokens signed by a key that is not in the set. The default is an
+	// hour.
+	Refresh time.Duration
+
+	// Client is the HTTP client used to fetch the keys. The default is "http.DefaultClient".
+	Client *http.Client
+}
+
+// AuthFailure is a request that failed to authenticate.
+type AuthFailure struct {
+	// Reason is why the request failed, e.g. "invalid_token" or "rate_limited".
+	Reason string
+
+	// Name is the name of the API key of a rate limited request, and is empty otherwise.
+	Name string
+
+	// Err is the error of the failure.
+	Err error
+}
+
+// AuthMetrics is the metrics registry that the authentication failures of an authenticator are recorded in, e.g. an
+// adapter that counts the failures in a counter labeled by their reason.
+type AuthMetrics interface {
+	ObserveAuthFailure(ctx context.Context, failure *AuthFailure)
+}
+
+// Authentication is the configuration of an authenticator. A request is authenticated by an API key, or else by a JWT
+// if "JWKS" is set.
+type Authentication struct {
+	APIKeys []*APIKey
+	JWKS    *JWKS
+
+	// Metrics is the registry that the authentication failures are recorded in, if it is set.
+	Metrics AuthMetrics
+}
+
+// principalKey is the context key of the principal of an authenticated request.
+type principalKey struct{}
+
+// PrincipalFromContext will return the principal of the request authenticated by an authenticator: the name of its
+// API key, or the "sub" claim of its JWT, e.g. to choose the capabilities of a "repository.Restrict" for the client.
+func PrincipalFromContext(ctx context.Context) (string, bool) {
+	principal, ok := ctx.Value(principalKey{}).(string)
+
+	return principal, ok
+}
+
+// Authenticator authenticates the requests of the server modes of gidari, e.g. the control endpoints of a
+// "Controller" and the webhook receiver of "NewWebhookHandler", with static API keys and JWTs validated against a
+// JWKS URL. Each API key has its own rate limit.
+type Authenticator struct {
+	keys     []*authKey
+	jwks     *jwksCache
+	metrics  AuthMetrics
+	expected jwt.Expected
+}
+
+// authKey is an API key of an authenticator, with the hash of its secret, so that keys of different lengths are
+// compared in constant time.
+type authKey struct {
+	name    string
+	hash    [sha256.Size]byte
+	limiter *rate.Limiter
+}
+
+// NewAuthenticator will return the authenticator of the configuration. If "JWKS" is set, its keys are fetched, so
+// that an authenticator with an unreachable identity provider fails to start.
+func NewAuthenticator(ctx context.Context, auth Authentication) (*Authenticator, error) {
+	if len(auth.APIKeys) == 0 && auth.JWKS == nil {
+		return nil, InvalidAuthenticationError("at least one API key or a JWKS URL is required")
+	}
+
+	authn := &Authenticator{metrics: auth.Metrics}
+
+	for _, key := range auth.APIKeys {
+		switch {
+		case key.Name == "" || key.Key == "":
+			return nil, InvalidAuthenticationError("API keys require a name and a key")
+		case key.RateLimit < 0 || key.Burst < 0:
+			return nil, InvalidAuthenticationError(fmt.Sprintf("rate limit of API key %q must not be negative",
+				key.Name))
+		}
+
+		akey := &authKey{name: key.Name, hash: sha256.Sum256([]byte(key.Key))}
+
+		if key.RateLimit > 0 {
+			burst := key.Burst
+			if burst == 0 {
+				burst = 1
+			}
+
+			akey.limiter = rate.NewLimiter(rate.Limit(key.RateLimit), burst)
+		}
+
+		authn.keys = append(authn.keys, akey)
+	}
+
+	if jwks := auth.JWKS; jwks != nil {
+		if jwks.URL == "" {
+			return nil, InvalidAuthenticationError("JWKS requires a URL")
+		}
+
+		if jwks.Refresh < 0 {
+			return nil, InvalidAuthenticationError("JWKS refresh must not be negative")
+		}
+
+		authn.jwks = newJWKSCache(jwks)
+		authn.expected = jwt.Expected{Issuer: jwks.Issuer}
+
+		if jwks.Audience != "" {
+			authn.expected.AnyAudience = jwt.Audience{jwks.Audience}
+		}
+
+		if _, err := authn.jwks.keySet(ctx, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return authn, nil
+}
+
+// Handler will return the handler that serves the authenticated requests with the next handler, with the principal
+// of each request in its context, see "PrincipalFromContext". Requests that fail to authenticate are answered with
+// "401 Unauthorized", and requests over the rate limit of their API key with "429 Too Many Requests".
+func (authn *Authenticator) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		principal, failure := authn.authenticate(req)
+		if failure != nil {
+			if authn.metrics != nil {
+				authn.metrics.ObserveAuthFailure(req.Context(), failure)
+			}
+
+			if failure.Reason == AuthFailureRateLimited {
+				http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+
+				return
+			}
+
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+			return
+		}
+
+		next.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), principalKey{}, principal)))
+	})
+}
+
+// authenticate will return the principal of the request, or the failure if the request does not authenticate.
+func (authn *Authenticator) authenticate(req *http.Request) (string, *AuthFailure) {
+	credential := req.Header.Get(apiKeyHeader)
+	if bearer, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok && credential == "" {
+		credential = strings.TrimSpace(bearer)
+	}
+
+	if credential == "" {
+		return "", &AuthFailure{Reason: AuthFailureMissing, Err: UnauthenticatedError("missing credentials", nil)}
+	}
+
+	if key := authn.apiKey(credential); key != nil {
+		if key.limiter != nil && !key.limiter.Allow() {
+			return "", &AuthFailure{
+				Reason: AuthFailureRateLimited,
+				Name:   key.name,
+				Err:    UnauthenticatedError(fmt.Sprintf("rate limit of API key %q exceeded", key.name), nil),
+			}
+		}
+
+		return key.name, nil
+	}
+
+	// A credential with the three segments of a compact JWS is a token, and any other credential is an API key.
+	if authn.jwks == nil || strings.Count(credential, ".") != 2 {
+		return "", &AuthFailure{Reason: AuthFailureInvalidKey, Err: UnauthenticatedError("invalid API key", nil)}
+	}
+
+	subject, err := authn.validate(req.Context(), credential)
+	if err != nil {
+		return "", &AuthFailure{Reason: AuthFailureInvalidToken, Err: UnauthenticatedError("invalid token", err)}
+	}
+
+	return subject, nil
+}
+
+// apiKey will return the API key of the credential, or nil if it is not an API key. Every key is compared, so that
+// the time of the comparison does not depend on which key matches.
+func (authn *Authenticator) apiKey(credential string) *authKey {
+	hash := sha256.Sum256([]byte(credential))
+
+	var found *authKey
+
+	for _, key := range authn.keys {
+		if subtle.ConstantTimeCompare(hash[:], key.hash[:]) == 1 {
+			found = key
+		}
+	}
+
+	return found
+}
+
+// validate will validate the signature, expiry, issuer, and audience of the token, and return its subject.
+func (authn *Authenticator) validate(ctx context.Context, token string) (string, error) {
+	tok, err := jwt.ParseSigned(token, jwtAlgorithms)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse token: %w", err)
+	}
+
+	var kid string
+	if len(tok.Headers) > 0 {
+		kid = tok.Headers[0].KeyID
+	}
+
+	keys, err := authn.jwks.keySet(ctx, kid)
+	if err != nil {
+		return "", err
+	}
+
+	var claims jwt.Claims
+	if err := tok.Claims(keys, &claims); err != nil {
+		return "", fmt.Errorf("unable to verify token: %w", err)
+	}
+
+	if claims.Expiry == nil {
+		return "", fmt.Errorf("token does not expire")
+	}
+
+	expected := authn.expected
+	expected.Time = time.Now()
+
+	if err := claims.ValidateWithLeeway(expected, jwt.DefaultLeeway); err != nil {
+		return "", fmt.Errorf("unable to validate token: %w", err)
+	}
+
+	return claims.Subject, nil
+}
+
+// jwksCache is the key set of a JWKS URL, fetched again once it is older than the refresh interval.
+type jwksCache struct {
+	jwks *JWKS
+
+	mtx     sync.Mutex
+	keys    *jose.JSONWebKeySet
+	fetched time.Time
+}
+
+func newJWKSCache(jwks *JWKS) *jwksCache {
+	return &jwksCache{jwks: jwks}
+}
+
+// keySet will return the key set, fetching it if it is older than the refresh interval, or if it does not have the
+// key with the ID and was fetched more than a minute ago.
+func (cache *jwksCache) keySet(ctx context.Context, kid string) (*jose.JSONWebKeySet, error) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	refresh := cache.jwks.Refresh
+	if refresh == 0 {
+		refresh = defaultJWKSRefresh
+	}
+
+	age := time.Since(cache.fetched)
+
+	stale := cache.keys == nil || age > refresh
+	if !stale && kid != "" && len(cache.keys.Key(kid)) == 0 && age > jwksMinRefresh {
+		stale = true
+	}
+
+	if !stale {
+		return cache.keys, nil
+	}
+
+	keys, err := cache.fetch(ctx)
+	if err != nil {
+		// The keys that were fetched last are used until the URL can be reached again.
+		if cache.keys != nil {
+			return cache.keys, nil
+		}
+
+		return nil, err
+	}
+
+	cache.keys = keys
+	cache.fetched = time.Now()
+
+	return keys, nil
+}
+
+// fetch will fetch the key set from the URL.
+func (cache *jwksCache) fetch(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	client := cache.jwks.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cache.jwks.URL, nil)
+	if err != nil {
+		return nil, JWKSError(cache.jwks.URL, err)
+	}
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, JWKSError(cache.jwks.URL, err)
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, JWKSError(cache.jwks.URL, fmt.Errorf("unexpected status %s", rsp.Status))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, jwksMaxBody))
+	if err != nil {
+		return nil, JWKSError(cache.jwks.URL, err)
+	}
+
+	keys := new(jose.JSONWebKeySet)
+	if err := json.Unmarshal(body, keys); err != nil {
+		return nil, JWKSError(cache.jwks.URL, err)
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidari
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// authMetrics records the reasons of the authentication failures.
+type authMetrics struct {
+	mtx     sync.Mutex
+	reasons []string
+}
+
+func (metrics *authMetrics) ObserveAuthFailure(_ context.Context, failure *AuthFailure) {
+	metrics.mtx.Lock()
+	defer metrics.mtx.Unlock()
+
+	metrics.reasons = append(metrics.reasons, failure.Reason)
+}
+
+// serveAuthenticated will serve the request with the handler of the authenticator, and return the status code and
+// the principal of the request.
+func serveAuthenticated(authn *Authenticator, header http.Header) (int, string) {
+	var principal string
+
+	handler := authn.Handler(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		principal, _ = PrincipalFromContext(req.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/runs", nil)
+	req.Header = header
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	return rec.Code, principal
+}
+
+// signToken will return the JWT of the claims, signed by the key with the key ID.
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.Claims) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", kid))
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	return token
+}
+
+func TestAuthenticator(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("API keys", func(t *testing.T) {
+		t.Parallel()
+
+		metrics := new(authMetrics)
+
+		authn, err := NewAuthenticator(ctx, Authentication{
+			APIKeys: []*APIKey{
+				{Name: "airflow", Key: "key-1", RateLimit: 0.001, Burst: 1},
+				{Name: "ops", Key: "key-2"},
+			},
+			Metrics: metrics,
+		})
+		if err != nil {
+			t.Fatalf("failed to create authenticator: %v", err)
+		}
+
+		for _, tc := range []struct {
+			header    http.Header
+			code      int
+			principal string
+		}{
+			{http.Header{"X-Api-Key": {"key-1"}}, http.StatusOK, "airflow"},
+			{http.Header{"X-Api-Key": {"key-1"}}, http.StatusTooManyRequests, ""},
+			{http.Header{"Authorization": {"Bearer key-2"}}, http.StatusOK, "ops"},
+			{http.Header{"X-Api-Key": {"key-3"}}, http.StatusUnauthorized, ""},
+			{http.Header{}, http.StatusUnauthorized, ""},
+		} {
+			if code, principal := serveAuthenticated(authn, tc.header); code != tc.code || principal != tc.principal {
+				t.Fatalf("expected %d for %q with %v, got %d for %q", tc.code, tc.principal, tc.header, code,
+					principal)
+			}
+		}
+
+		exp := []string{AuthFailureRateLimited, AuthFailureInvalidKey, AuthFailureMissing}
+		if len(metrics.reasons) != len(exp) {
+			t.Fatalf("expected failures %v, got %v", exp, metrics.reasons)
+		}
+
+		for idx, reason := range exp {
+			if metrics.reasons[idx] != reason {
+				t.Fatalf("expected failures %v, got %v", exp, metrics.reasons)
+			}
+		}
+	})
+
+	t.Run("JWKS", func(t *testing.T) {
+		t.Parallel()
+
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			_ = json.NewEncoder(rw).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &key.PublicKey, KeyID: "key-1", Algorithm: string(jose.RS256), Use: "sig"},
+			}})
+		}))
+		t.Cleanup(server.Close)
+
+		metrics := new(authMetrics)
+
+		authn, err := NewAuthenticator(ctx, Authentication{
+			JWKS:    &JWKS{URL: server.URL, Issuer: "https://idp.example.com", Audience: "gidari"},
+			Metrics: metrics,
+		})
+		if err != nil {
+			t.Fatalf("failed to create authenticator: %v", err)
+		}
+
+		now := time.Now()
+		claims := jwt.Claims{
+			Issuer:   "https://idp.example.com",
+			Subject:  "airflow",
+			Audience: jwt.Audience{"gidari"},
+			Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		}
+
+		bearer := func(token string) http.Header { return http.Header{"Authorization": {"Bearer " + token}} }
+
+		if code, principal := serveAuthenticated(authn, bearer(signToken(t, key, "key-1", claims))); code != 200 ||
+			principal != "airflow" {
+			t.Fatalf("expected the token to authenticate, got %d for %q", code, principal)
+		}
+
+		expired := claims
+		expired.Expiry = jwt.NewNumericDate(now.Add(-time.Hour))
+
+		otherAudience := claims
+		otherAudience.Audience = jwt.Audience{"other"}
+
+		otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+		for _, token := range []string{
+			signToken(t, key, "key-1", expired),
+			signToken(t, key, "key-1", otherAudience),
+			signToken(t, otherKey, "key-1", claims),
+			signToken(t, key, "key-2", claims),
+		} {
+			if code, _ := serveAuthenticated(authn, bearer(token)); code != http.StatusUnauthorized {
+				t.Fatalf("expected status 401, got %d", code)
+			}
+		}
+
+		if len(metrics.reasons) != 4 || metrics.reasons[0] != AuthFailureInvalidToken {
+			t.Fatalf("expected 4 invalid tokens, got %v", metrics.reasons)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		for _, auth := range []Authentication{
+			{},
+			{APIKeys: []*APIKey{{Name: "airflow"}}},
+			{APIKeys: []*APIKey{{Name: "airflow", Key: "key-1", RateLimit: -1}}},
+			{JWKS: &JWKS{}},
+		} {
+			if _, err := NewAuthenticator(ctx, auth); !errors.Is(err, ErrInvalidAuthentication) {
+				t.Fatalf("expected error %v, got %v", ErrInvalidAuthentication, err)
+			}
+		}
+
+		server := httptest.NewServer(http.NotFoundHandler())
+		t.Cleanup(server.Close)
+
+		if _, err := NewAuthenticator(ctx, Authentication{JWKS: &JWKS{URL: server.URL}}); !errors.Is(err, ErrJWKS) {
+			t.Fatalf("expected error %v, got %v", ErrJWKS, err)
+		}
+	})
+}
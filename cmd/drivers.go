@@ -0,0 +1,17 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package main
+
+// The SQL storage devices and SQL sources that have no driver in the standard library are opened with the drivers
+// registered here. Applications that embed gidari register the drivers they need in the same way.
+import (
+	_ "github.com/go-sql-driver/mysql"  // MySQL sources.
+	_ "github.com/microsoft/go-mssqldb" // SQL Server storage.
+	_ "github.com/sijms/go-ora/v2"      // Oracle storage.
+	_ "modernc.org/sqlite"              // SQLite storage, without cgo.
+)
@@ -0,0 +1,14 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+
+//go:build cgo
+
+package main
+
+// The DuckDB driver links the DuckDB library with cgo, so DuckDB storage is only available in builds with cgo.
+import _ "github.com/marcboeker/go-duckdb" // DuckDB storage.
@@ -0,0 +1,49 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/internal/storage/storagetest"
+)
+
+func TestDuckDBDriver(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "gidari.duckdb")
+
+	db, err := sql.Open("duckdb", path)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE conformance (id TEXT PRIMARY KEY, flag BOOLEAN, count BIGINT, price DOUBLE,
+		name TEXT)`)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	db.Close()
+
+	stg, err := storage.New(context.Background(), "duckdb://"+path)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	t.Cleanup(stg.Close)
+
+	storagetest.Run(t, stg, "conformance")
+}
@@ -10,10 +10,19 @@ package main
 import (
 	"context"
 	_ "embed" // Embed external data.
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/alpine-hodler/gidari"
 	"github.com/alpine-hodler/gidari/internal/transport"
+	"github.com/alpine-hodler/gidari/tools"
 	"github.com/alpine-hodler/gidari/version"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -22,12 +31,197 @@ import (
 //go:embed bash-completion.sh
 var bashCompletion string
 
-func main() {
+// flags are the command line flags shared by the gidari commands.
+type flags struct {
 	// configFilepath is the path to the configuration file.
-	var configFilepath string
+	configFilepath string
 
 	// verbose is a flag that enables verbose logging.
-	var verbose bool
+	verbose bool
+
+	// asOf and window are the as-of time and historical window of the run.
+	asOf, window string
+
+	// from is the archive location to reprocess.
+	from string
+
+	// migrationsDir is the directory of migrations that must be applied before running.
+	migrationsDir string
+
+	// summaryPath is the path to write the JSON summary of the run to, or "-" for stdout.
+	summaryPath string
+}
+
+// register will register the flags on the command.
+func (f *flags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.configFilepath, "config", "c", "path to configuration")
+	cmd.Flags().BoolVar(&f.verbose, "verbose", false, "print log data as the binary executes")
+	cmd.Flags().StringVar(&f.asOf, "as-of", "", "evaluate the run as of a date or RFC3339 time, e.g. 2023-06-01")
+	cmd.Flags().StringVar(&f.window, "window", "", "backfill a historical window, e.g. 2023-01-01..2023-02-01")
+	cmd.Flags().StringVar(&f.migrationsDir, "migrations-dir", "", "refuse to run until the migrations in the directory "+
+		"are applied")
+	cmd.Flags().StringVar(&f.summaryPath, "summary", "", "write the JSON summary of the run, including its resource "+
+		"usage, to the path, or - for stdout")
+
+	if err := cmd.MarkFlagRequired("config"); err != nil {
+		logrus.Fatalf("error marking flag as required: %v", err)
+	}
+}
+
+// sealFlags are the command line flags for the "config seal" and "config unseal" commands.
+type sealFlags struct {
+	// configFilepath is the path to the configuration file.
+	configFilepath string
+
+	// recipients are the age recipients to seal the configuration file to.
+	recipients []string
+
+	// write is a flag that writes the result to the configuration file instead of stdout.
+	write bool
+}
+
+// register will register the flags on the command. The recipient flag is only registered for sealing.
+func (f *sealFlags) register(cmd *cobra.Command, recipients bool) {
+	cmd.Flags().StringVar(&f.configFilepath, "config", "c", "path to configuration")
+	cmd.Flags().BoolVarP(&f.write, "write", "w", false, "write the result to the configuration file instead of stdout")
+
+	if err := cmd.MarkFlagRequired("config"); err != nil {
+		logrus.Fatalf("error marking flag as required: %v", err)
+	}
+
+	if !recipients {
+		return
+	}
+
+	cmd.Flags().StringSliceVar(&f.recipients, "recipient", nil, "age recipient to seal to, e.g. age1...")
+
+	if err := cmd.MarkFlagRequired("recipient"); err != nil {
+		logrus.Fatalf("error marking flag as required: %v", err)
+	}
+}
+
+// schemaFlags are the command line flags for the "schema export" command.
+type schemaFlags struct {
+	// configFilepath is the path to the configuration file.
+	configFilepath string
+
+	// dialect is the SQL dialect to export the DDL in.
+	dialect string
+
+	// migrationsDir is the directory to write the schema changes to as the next migration, instead of stdout.
+	migrationsDir string
+
+	// name is the name of the migration.
+	name string
+
+	// accept is a flag that registers the drifted schemas as the next version.
+	accept bool
+}
+
+// register will register the flags on the command.
+func (f *schemaFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.configFilepath, "config", "c", "path to configuration")
+	cmd.Flags().StringVar(&f.dialect, "dialect", transport.DialectPostgres, "SQL dialect: postgres, mysql, "+
+		"clickhouse, sqlite, or duckdb")
+	cmd.Flags().StringVar(&f.migrationsDir, "migrations-dir", "", "write the schema changes as the next golang-migrate "+
+		"migration in the directory")
+	cmd.Flags().StringVar(&f.name, "name", "", "name of the migration, e.g. add_orders")
+
+	if err := cmd.MarkFlagRequired("config"); err != nil {
+		logrus.Fatalf("error marking flag as required: %v", err)
+	}
+}
+
+// compactFlags are the command line flags for the "compact" command.
+type compactFlags struct {
+	// location is the archive location to compact.
+	location string
+
+	// targetSize is the size in bytes of the compacted objects.
+	targetSize int64
+}
+
+// register will register the flags on the command.
+func (f *compactFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.location, "location", "", "archive location to compact, e.g. "+
+		"s3://bucket/archive?region=us-east-1")
+	cmd.Flags().Int64Var(&f.targetSize, "target-size", transport.DefaultCompactionTargetSize, "size in bytes of the "+
+		"compacted objects")
+
+	if err := cmd.MarkFlagRequired("location"); err != nil {
+		logrus.Fatalf("error marking flag as required: %v", err)
+	}
+}
+
+// exploreFlags are the command line flags for the "explore" command.
+type exploreFlags struct {
+	// headers are the "Key: Value" headers to add to every request, e.g. to authenticate.
+	headers []string
+
+	// timeout is the timeout of each request.
+	timeout time.Duration
+}
+
+// register will register the flags on the command.
+func (f *exploreFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVarP(&f.headers, "header", "H", nil, "header to add to every request, or metadata to "+
+		"add to every gRPC call, e.g. \"Authorization: Bearer <token>\"")
+	cmd.Flags().DurationVar(&f.timeout, "timeout", 30*time.Second, "timeout of each request, or of the whole "+
+		"exploration of a gRPC server")
+}
+
+// importFlags are the command line flags for the "import openapi" command.
+type importFlags struct {
+	// url is the URL of the web API, which overrides the server of the document.
+	url string
+}
+
+// register will register the flags on the command.
+func (f *importFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.url, "url", "", "URL of the web API, required if the document has no absolute server URL")
+}
+
+// tablesFlags are the command line flags for the "tables" command.
+type tablesFlags struct {
+	// configFilepath is the path to the configuration file.
+	configFilepath string
+
+	// json is a flag that writes the tables as JSON instead of one table per line.
+	json bool
+}
+
+// register will register the flags on the command.
+func (f *tablesFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.configFilepath, "config", "c", "path to configuration")
+	cmd.Flags().BoolVar(&f.json, "json", false, "write the tables of each connection string as JSON")
+
+	if err := cmd.MarkFlagRequired("config"); err != nil {
+		logrus.Fatalf("error marking flag as required: %v", err)
+	}
+}
+
+// apiKeyEnv is the environment variable of the API key or JWT that the "jobs" commands authenticate with, for the
+// control endpoints served behind a gidari.Authenticator.
+const apiKeyEnv = "GIDARI_API_KEY"
+
+// jobsFlags are the command line flags for the "jobs" commands.
+type jobsFlags struct {
+	// addr is the URL of the control endpoints of the process that runs the jobs.
+	addr string
+}
+
+// register will register the flags on the command.
+func (f *jobsFlags) register(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&f.addr, "addr", "", "URL of the control endpoints of the daemon, e.g. "+
+		"http://localhost:8080")
+
+	if err := cmd.MarkPersistentFlagRequired("addr"); err != nil {
+		logrus.Fatalf("error marking flag as required: %v", err)
+	}
+}
+
+func main() {
+	var rootFlags, backfillFlags, reprocessFlags flags
 
 	cmd := &cobra.Command{
 		Long: "Gidari is a tool for querying web APIs and persisting resultant data onto local storage\n" +
@@ -40,43 +234,513 @@ func main() {
 		Deprecated:             "",
 		Version:                version.Gidari,
 
-		Run: func(_ *cobra.Command, args []string) { run(configFilepath, verbose, args) },
+		Run: func(_ *cobra.Command, args []string) { run(rootFlags, transport.Upsert, args) },
 	}
 
-	cmd.Flags().StringVar(&configFilepath, "config", "c", "path to configuration")
-	cmd.Flags().BoolVar(&verbose, "verbose", false, "print log data as the binary executes")
+	backfillCmd := &cobra.Command{
+		Long: "Backfill reads the existing time coverage of each timeseries table from storage and only\n" +
+			"fetches the chunks of the timeseries range that have no records.",
 
-	if err := cmd.MarkFlagRequired("config"); err != nil {
+		Use:     "backfill",
+		Short:   "Fetch only the timeseries data missing from your database",
+		Example: "gidari backfill --config config.yaml",
+
+		Run: func(_ *cobra.Command, args []string) { run(backfillFlags, transport.Backfill, args) },
+	}
+
+	reprocessCmd := &cobra.Command{
+		Long: "Reprocess runs the decode, transform, and write stages against the raw payloads archived by a\n" +
+			"previous run (see archive.location), instead of calling the web API. Use it to backfill schema or\n" +
+			"transform fixes without touching a rate-limited API.",
+
+		Use:     "reprocess",
+		Short:   "Write archived web API responses to your database",
+		Example: "gidari reprocess --config config.yaml --from s3://bucket/archive/<run-id>?region=us-east-1",
+
+		Run: func(_ *cobra.Command, args []string) { run(reprocessFlags, transport.Reprocess, args) },
+	}
+
+	var compactCmdFlags compactFlags
+
+	compactCmd := &cobra.Command{
+		Long: "Compact merges the small archived objects within each partition of an archive location (see\n" +
+			"archive.location and archive.partitionBy) into fewer objects of up to the target size, so that\n" +
+			"query engines such as Athena read fewer files. Compacted objects can still be reprocessed.",
+
+		Use:     "compact",
+		Short:   "Merge small archived objects into larger ones",
+		Example: "gidari compact --location s3://bucket/archive?region=us-east-1 --target-size 134217728",
+
+		Run: func(_ *cobra.Command, _ []string) { compact(compactCmdFlags) },
+	}
+
+	var sealCmdFlags, unsealCmdFlags sealFlags
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage configuration files",
+	}
+
+	sealCmd := &cobra.Command{
+		Long: "Seal encrypts the sections of a configuration file that contain credentials (authentication,\n" +
+			"connectionStrings, and readReplica) with age, so that the file can be committed to source control.\n" +
+			"Sealed files are decrypted when they are loaded using the age key from " + transport.AgeKeyFileEnv + "\n" +
+			"or " + transport.AgeKeyEnv + ".",
+
+		Use:     "seal",
+		Short:   "Encrypt the credentials in a configuration file",
+		Example: "gidari config seal --config config.yaml --recipient age1... --write",
+
+		Run: func(_ *cobra.Command, _ []string) {
+			rewriteConfig(sealCmdFlags, func(bytes []byte) ([]byte, error) {
+				return transport.SealConfig(bytes, sealCmdFlags.recipients)
+			})
+		},
+	}
+
+	unsealCmd := &cobra.Command{
+		Long: "Unseal decrypts the sealed sections of a configuration file using the age key from\n" +
+			transport.AgeKeyFileEnv + " or " + transport.AgeKeyEnv + ".",
+
+		Use:     "unseal",
+		Short:   "Decrypt the credentials in a sealed configuration file",
+		Example: "GIDARI_AGE_KEY_FILE=key.txt gidari config unseal --config config.yaml",
+
+		Run: func(_ *cobra.Command, _ []string) { rewriteConfig(unsealCmdFlags, transport.UnsealConfig) },
+	}
+
+	var exportFlags schemaFlags
+
+	schemaCmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Manage destination schemas",
+	}
+
+	exportCmd := &cobra.Command{
+		Long: "Export writes the CREATE TABLE and CREATE INDEX statements for the tables that the configuration\n" +
+			"writes to. Passthrough and watermark tables use their declared schema, and every other table is\n" +
+			"inferred from the first response of each request. Review the output and apply it with your\n" +
+			"migration tooling, or use --migrations-dir to write the changes since the last migration in the\n" +
+			"directory as the next golang-migrate migration.",
+
+		Use:     "export",
+		Short:   "Print the DDL for your destination tables",
+		Example: "gidari schema export --config config.yaml --dialect postgres > schema.sql",
+
+		Run: func(_ *cobra.Command, _ []string) { exportSchema(exportFlags) },
+	}
+
+	var diffFlags schemaFlags
+
+	diffCmd := &cobra.Command{
+		Long: "Diff compares the shape of the first response of each request with the latest schema registered\n" +
+			"for each table in the " + transport.SchemaRegistryTable + " table of your database, and exits with a\n" +
+			"non-zero status if any table drifted. Use --accept to register the drifted schemas as the next\n" +
+			"version.",
+
+		Use:     "diff",
+		Short:   "Compare web API responses with the registered schemas",
+		Example: "gidari schema diff --config config.yaml --accept",
+
+		Run: func(_ *cobra.Command, _ []string) { diffSchemas(diffFlags) },
+	}
+
+	var exploreCmdFlags exploreFlags
+
+	exploreCmd := &cobra.Command{
+		Long: "Explore probes a web API to onboard it as a source. It lists the methods that the URL allows from\n" +
+			"an OPTIONS request, looks up the OpenAPI or Swagger document of the web API at the URL and at the\n" +
+			"paths it is commonly served from, such as /openapi.json, samples the first endpoint that can be\n" +
+			"fetched, or the URL itself if there is no document, and prints the types of the sampled fields and\n" +
+			"a suggested configuration. A grpc:// or grpcs:// URL is probed with server reflection: the services\n" +
+			"and methods of the server are listed, and the first unary method that can be called with an empty\n" +
+			"request is sampled. Headers are sent to gRPC servers as metadata.",
+
+		Use:   "explore <url>",
+		Short: "Probe a web API or gRPC server and suggest a configuration for it",
+		Example: "gidari explore https://api.example.com --header \"Authorization: Bearer <token>\"\n" +
+			"gidari explore grpcs://api.example.com:443",
+		Args: cobra.ExactArgs(1),
+
+		Run: func(_ *cobra.Command, args []string) { explore(exploreCmdFlags, args[0]) },
+	}
+
+	var openAPIFlags importFlags
+
+	importCmd := &cobra.Command{
+		Use:   "import",
+		Short: "Generate configuration from API descriptions",
+	}
+
+	openAPICmd := &cobra.Command{
+		Long: "OpenAPI reads an OpenAPI 3 or Swagger 2 document, in JSON or YAML, and prints a configuration with a\n" +
+			"request for every GET operation without path parameters. Required query parameters, the security\n" +
+			"scheme, pagination, and explodes of array fields to child tables are filled in from the document.\n" +
+			"Prune the requests that are not needed and fill in the placeholder credentials before running it.",
+
+		Use:     "openapi <document>",
+		Short:   "Generate a configuration from an OpenAPI document",
+		Example: "gidari import openapi spec.yaml > config.yaml",
+		Args:    cobra.ExactArgs(1),
+
+		Run: func(_ *cobra.Command, args []string) { importOpenAPI(openAPIFlags, args[0]) },
+	}
+
+	var tablesCmdFlags tablesFlags
+
+	tablesCmd := &cobra.Command{
+		Long: "Tables lists the tables of every connection string of the configuration, with their size in bytes\n" +
+			"where the storage device reports it, to discover what gidari has populated.",
+
+		Use:     "tables",
+		Short:   "List the tables of your databases",
+		Example: "gidari tables --config config.yaml",
+
+		Run: func(_ *cobra.Command, _ []string) { listTables(tablesCmdFlags) },
+	}
+
+	var jobsCmdFlags jobsFlags
+
+	jobsCmd := &cobra.Command{
+		Long: "Jobs controls the runs in progress of a daemon that embeds gidari and serves the control endpoints\n" +
+			"of a gidari.Controller at --addr. Pausing a run stops it from fetching its next request until it is\n" +
+			"resumed, and canceling a run rolls back its transactions that are not yet committed. If the\n" +
+			"endpoints are authenticated, set the API key or JWT in the GIDARI_API_KEY environment variable.",
+
+		Use:   "jobs",
+		Short: "Pause, resume, or cancel the runs of a daemon",
+	}
+
+	for _, action := range []string{gidari.ActionPause, gidari.ActionResume, gidari.ActionCancel} {
+		jobsCmd.AddCommand(&cobra.Command{
+			Use:     action + " <run-id>",
+			Short:   strings.ToUpper(action[:1]) + action[1:] + " a run in progress",
+			Example: "gidari jobs " + action + " 3b241101-e2bb-4255-8caf-4136c566a962 --addr http://localhost:8080",
+			Args:    cobra.ExactArgs(1),
+
+			Run: func(_ *cobra.Command, args []string) { controlRun(jobsCmdFlags, action, args[0]) },
+		})
+	}
+
+	rootFlags.register(cmd)
+	backfillFlags.register(backfillCmd)
+	reprocessFlags.register(reprocessCmd)
+	reprocessCmd.Flags().StringVar(&reprocessFlags.from, "from", "", "archive location of the payloads to reprocess")
+
+	if err := reprocessCmd.MarkFlagRequired("from"); err != nil {
 		logrus.Fatalf("error marking flag as required: %v", err)
 	}
 
+	compactCmdFlags.register(compactCmd)
+	sealCmdFlags.register(sealCmd, true)
+	unsealCmdFlags.register(unsealCmd, false)
+	configCmd.AddCommand(sealCmd, unsealCmd)
+	exportFlags.register(exportCmd)
+	diffFlags.register(diffCmd)
+	diffCmd.Flags().BoolVar(&diffFlags.accept, "accept", false, "register the drifted schemas as the next version")
+	schemaCmd.AddCommand(exportCmd, diffCmd)
+	exploreCmdFlags.register(exploreCmd)
+	openAPIFlags.register(openAPICmd)
+	importCmd.AddCommand(openAPICmd)
+	tablesCmdFlags.register(tablesCmd)
+	jobsCmdFlags.register(jobsCmd)
+	cmd.AddCommand(backfillCmd, reprocessCmd, compactCmd, configCmd, schemaCmd, exploreCmd, importCmd, tablesCmd,
+		jobsCmd)
+
 	if err := cmd.Execute(); err != nil {
 		log.Fatal(err)
 		os.Exit(1)
 	}
 }
 
-func run(configFilepath string, verboseLogging bool, _ []string) {
+func run(flags flags, upsert func(context.Context, *transport.Config) (*transport.RunSummary, error), _ []string) {
 	ctx := context.Background()
 
-	bytes, err := os.ReadFile(configFilepath)
+	bytes, err := os.ReadFile(flags.configFilepath)
 	if err != nil {
-		log.Fatalf("error reading config file  %s: %v", configFilepath, err)
+		log.Fatalf("error reading config file  %s: %v", flags.configFilepath, err)
 	}
 
 	cfg, err := transport.NewConfig(bytes)
 	if err != nil {
-		log.Fatalf("error creating config: %v", err)
+		log.Fatalf("error creating config: %v", tools.NewRedactor().RedactError(err))
 	}
 
 	cfg.Logger = logrus.New()
 
+	if flags.asOf != "" {
+		tme, err := transport.ParseRunTime(flags.asOf)
+		if err != nil {
+			log.Fatalf("error parsing as-of flag: %v", err)
+		}
+
+		cfg.AsOf = &tme
+	}
+
+	if flags.window != "" {
+		if cfg.Window, err = transport.ParseWindow(flags.window); err != nil {
+			log.Fatalf("error parsing window flag: %v", err)
+		}
+	}
+
+	cfg.ReprocessFrom = flags.from
+	cfg.MigrationsDir = flags.migrationsDir
+
+	switch flags.summaryPath {
+	case "":
+	case "-":
+		cfg.Summary = os.Stdout
+	default:
+		summary, err := os.Create(flags.summaryPath)
+		if err != nil {
+			log.Fatalf("error creating summary file %s: %v", flags.summaryPath, err)
+		}
+		defer summary.Close()
+
+		cfg.Summary = summary
+	}
+
 	// If the user has not set the verbose flag, only log fatals.
-	if !verboseLogging {
+	if !flags.verbose {
 		cfg.Logger.SetLevel(logrus.FatalLevel)
 	}
 
-	if err := transport.Upsert(ctx, cfg); err != nil {
+	if _, err := upsert(ctx, cfg); err != nil {
 		log.Fatalf("error upserting data: %v", err)
 	}
 }
+
+// controlRun will send the action for the run to the control endpoints of the daemon.
+func controlRun(flags jobsFlags, action, runID string) {
+	endpoint := strings.TrimSuffix(flags.addr, "/") + "/runs/" + url.PathEscape(runID) + "/" + action
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, endpoint, nil)
+	if err != nil {
+		log.Fatalf("error creating %s request: %v", action, err)
+	}
+
+	// The credential is read from the environment rather than a flag, so that it is not in the shell history.
+	if credential := os.Getenv(apiKeyEnv); credential != "" {
+		req.Header.Set("X-API-Key", credential)
+	}
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("error sending %s to run %s: %v", action, runID, err)
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(rsp.Body)
+		log.Fatalf("error sending %s to run %s: %s: %s", action, runID, rsp.Status, strings.TrimSpace(string(body)))
+	}
+}
+
+// compact will merge the small archived objects within each partition of the archive location.
+func compact(flags compactFlags) {
+	compactions, err := transport.Compact(context.Background(), flags.location, flags.targetSize)
+
+	for _, compaction := range compactions {
+		log.Printf("compacted %d objects into %s (%d bytes)", len(compaction.Sources), compaction.Key, compaction.Bytes)
+	}
+
+	if err != nil {
+		log.Fatalf("error compacting archive: %v", tools.NewRedactor().RedactError(err))
+	}
+}
+
+// rewriteConfig will apply the function to the configuration file, writing the result to the file or stdout.
+func rewriteConfig(flags sealFlags, rewrite func([]byte) ([]byte, error)) {
+	info, err := os.Stat(flags.configFilepath)
+	if err != nil {
+		log.Fatalf("error reading config file %s: %v", flags.configFilepath, err)
+	}
+
+	bytes, err := os.ReadFile(flags.configFilepath)
+	if err != nil {
+		log.Fatalf("error reading config file %s: %v", flags.configFilepath, err)
+	}
+
+	out, err := rewrite(bytes)
+	if err != nil {
+		log.Fatalf("error rewriting config file: %v", tools.NewRedactor().RedactError(err))
+	}
+
+	if !flags.write {
+		if _, err := os.Stdout.Write(out); err != nil {
+			log.Fatalf("error writing config: %v", err)
+		}
+
+		return
+	}
+
+	if err := os.WriteFile(flags.configFilepath, out, info.Mode().Perm()); err != nil {
+		log.Fatalf("error writing config file %s: %v", flags.configFilepath, err)
+	}
+}
+
+// exportSchema will write the DDL for the tables of the configuration file to stdout.
+func exportSchema(flags schemaFlags) {
+	bytes, err := os.ReadFile(flags.configFilepath)
+	if err != nil {
+		log.Fatalf("error reading config file %s: %v", flags.configFilepath, err)
+	}
+
+	cfg, err := transport.NewConfig(bytes)
+	if err != nil {
+		log.Fatalf("error creating config: %v", tools.NewRedactor().RedactError(err))
+	}
+
+	cfg.Logger = logrus.New()
+
+	if flags.migrationsDir != "" {
+		paths, err := transport.WriteMigration(context.Background(), cfg, flags.dialect, flags.migrationsDir, flags.name)
+		if err != nil {
+			log.Fatalf("error writing migration: %v", tools.NewRedactor().RedactError(err))
+		}
+
+		if len(paths) == 0 {
+			log.Println("no schema changes")
+		}
+
+		for _, path := range paths {
+			log.Printf("wrote %s", path)
+		}
+
+		return
+	}
+
+	if err := transport.ExportSchema(context.Background(), cfg, flags.dialect, os.Stdout); err != nil {
+		log.Fatalf("error exporting schema: %v", tools.NewRedactor().RedactError(err))
+	}
+}
+
+// diffSchemas will print the drift between the web API responses and the registered schemas of the configuration
+// file, registering the drifted schemas if the accept flag is set.
+func diffSchemas(flags schemaFlags) {
+	ctx := context.Background()
+
+	bytes, err := os.ReadFile(flags.configFilepath)
+	if err != nil {
+		log.Fatalf("error reading config file %s: %v", flags.configFilepath, err)
+	}
+
+	cfg, err := transport.NewConfig(bytes)
+	if err != nil {
+		log.Fatalf("error creating config: %v", tools.NewRedactor().RedactError(err))
+	}
+
+	cfg.Logger = logrus.New()
+
+	diffs, err := transport.DiffSchemas(ctx, cfg)
+	if err != nil {
+		log.Fatalf("error comparing schemas: %v", tools.NewRedactor().RedactError(err))
+	}
+
+	drifted := false
+
+	for _, diff := range diffs {
+		if !diff.Drifted() {
+			continue
+		}
+
+		drifted = true
+
+		if _, err := os.Stdout.WriteString(diff.String()); err != nil {
+			log.Fatalf("error writing diff: %v", err)
+		}
+	}
+
+	if !drifted {
+		return
+	}
+
+	if !flags.accept {
+		os.Exit(1)
+	}
+
+	if err := transport.AcceptSchemas(ctx, cfg, diffs); err != nil {
+		log.Fatalf("error registering schemas: %v", tools.NewRedactor().RedactError(err))
+	}
+}
+
+// listTables will write the tables of every connection string of the configuration file to stdout, one
+// "<destination> <backend> <table> <size>" line per table.
+func listTables(flags tablesFlags) {
+	bytes, err := os.ReadFile(flags.configFilepath)
+	if err != nil {
+		log.Fatalf("error reading config file %s: %v", flags.configFilepath, err)
+	}
+
+	cfg, err := transport.NewConfig(bytes)
+	if err != nil {
+		log.Fatalf("error creating config: %v", tools.NewRedactor().RedactError(err))
+	}
+
+	cfg.Logger = logrus.New()
+
+	listings, err := transport.ListTables(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("error listing tables: %v", tools.NewRedactor().RedactError(err))
+	}
+
+	if flags.json {
+		if err := json.NewEncoder(os.Stdout).Encode(listings); err != nil {
+			log.Fatalf("error writing tables: %v", err)
+		}
+
+		return
+	}
+
+	for _, listing := range listings {
+		for _, table := range listing.Tables {
+			line := fmt.Sprintf("%d\t%s\t%s\t%d\n", listing.Destination, listing.Backend, table, listing.Sizes[table])
+			if _, err := os.Stdout.WriteString(line); err != nil {
+				log.Fatalf("error writing tables: %v", err)
+			}
+		}
+	}
+}
+
+// explore will probe the web API at the URL and write what was learned, with a suggested configuration, to stdout.
+func explore(flags exploreFlags, source string) {
+	header := make(http.Header)
+
+	for _, raw := range flags.headers {
+		key, value, ok := strings.Cut(raw, ":")
+		if !ok {
+			log.Fatalf("error parsing header %q, expected \"Key: Value\"", raw)
+		}
+
+		header.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+
+	client := &http.Client{Timeout: flags.timeout}
+
+	exploration, err := transport.Explore(context.Background(), client, source, header)
+	if err != nil {
+		log.Fatalf("error exploring %s: %v", source, tools.NewRedactor().RedactError(err))
+	}
+
+	if _, err := os.Stdout.WriteString(exploration.String()); err != nil {
+		log.Fatalf("error writing exploration: %v", err)
+	}
+}
+
+// importOpenAPI will write the configuration generated from the OpenAPI document to stdout.
+func importOpenAPI(flags importFlags, path string) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("error reading document %s: %v", path, err)
+	}
+
+	out, err := transport.ImportOpenAPI(bytes, flags.url)
+	if err != nil {
+		log.Fatalf("error importing document %s: %v", path, err)
+	}
+
+	if _, err := os.Stdout.Write(out); err != nil {
+		log.Fatalf("error writing config: %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidari
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/transport"
+)
+
+// Actions of the control endpoints of a controller, i.e. "POST /runs/{id}/{action}".
+const (
+	ActionPause  = "pause"
+	ActionResume = "resume"
+	ActionCancel = "cancel"
+)
+
+var (
+	ErrRunNotFound   = fmt.Errorf("run not found")
+	ErrRunInProgress = fmt.Errorf("run already in progress")
+)
+
+// RunNotFoundError is returned when the run is not in progress on the controller.
+func RunNotFoundError(runID string) error {
+	return fmt.Errorf("%w: %q", ErrRunNotFound, runID)
+}
+
+// RunInProgressError is returned when a run is started on the controller with the ID of a run in progress.
+func RunInProgressError(runID string) error {
+	return fmt.Errorf("%w: %q", ErrRunInProgress, runID)
+}
+
+// RunStatus is the status of a run in progress on a controller.
+type RunStatus struct {
+	RunID     string    `json:"runId"`
+	StartedAt time.Time `json:"startedAt"`
+	Paused    bool      `json:"paused"`
+}
+
+// Controller pauses, resumes, and cancels the runs in progress of a process by their run ID, e.g. from the control
+// endpoints of a daemon that embeds gidari, when a destination needs maintenance in the middle of a backfill.
+//
+// Pausing a run stops its web workers from fetching their next request, while the responses that were already
+// fetched are still written. The transactions of a paused run stay open, and nothing is committed until the run is
+// resumed and completes, so a paused run that is canceled is rolled back like any other canceled run.
+type Controller struct {
+	mtx  sync.Mutex
+	runs map[string]*controlledRun
+}
+
+// controlledRun is a run in progress on a controller.
+type controlledRun struct {
+	started time.Time
+	pause   *transport.PauseGate
+	cancel  context.CancelFunc
+}
+
+// NewController will return a controller without runs.
+func NewController() *Controller {
+	return &Controller{runs: make(map[string]*controlledRun)}
+}
+
+// WithController will add the run to the controller while it is in progress, by its run ID, see "WithRunID". If the
+// run does not have an ID, a random ID is generated, which is in the report of the run.
+func WithController(ctrl *Controller) Option {
+	return func(rnr *runner) { rnr.controller = ctrl }
+}
+
+// add will add the run to the controller, and return the function that removes it once the run ends.
+func (ctrl *Controller) add(runID string, pause *transport.PauseGate, cancel context.CancelFunc) (func(), error) {
+	ctrl.mtx.Lock()
+	defer ctrl.mtx.Unlock()
+
+	if _, ok := ctrl.runs[runID]; ok {
+		return nil, RunInProgressError(runID)
+	}
+
+	ctrl.runs[runID] = &controlledRun{started: time.Now().UTC(), pause: pause, cancel: cancel}
+
+	return func() {
+		ctrl.mtx.Lock()
+		defer ctrl.mtx.Unlock()
+
+		delete(ctrl.runs, runID)
+	}, nil
+}
+
+// run will return the run in progress with the ID.
+func (ctrl *Controller) run(runID string) (*controlledRun, error) {
+	ctrl.mtx.Lock()
+	defer ctrl.mtx.Unlock()
+
+	run, ok := ctrl.runs[runID]
+	if !ok {
+		return nil, RunNotFoundError(runID)
+	}
+
+	return run, nil
+}
+
+// Pause will pause the run with the ID.
+func (ctrl *Controller) Pause(runID string) error {
+	run, err := ctrl.run(runID)
+	if err != nil {
+		return err
+	}
+
+	run.pause.Pause()
+
+	return nil
+}
+
+// Resume will resume the paused run with the ID.
+func (ctrl *Controller) Resume(runID string) error {
+	run, err := ctrl.run(runID)
+	if err != nil {
+		return err
+	}
+
+	run.pause.Resume()
+
+	return nil
+}
+
+// Cancel will cancel the run with the ID, which rolls back its transactions that are not yet committed.
+func (ctrl *Controller) Cancel(runID string) error {
+	run, err := ctrl.run(runID)
+	if err != nil {
+		return err
+	}
+
+	run.cancel()
+
+	return nil
+}
+
+// Runs will return the status of the runs in progress, ordered by the time they started.
+func (ctrl *Controller) Runs() []*RunStatus {
+	ctrl.mtx.Lock()
+	defer ctrl.mtx.Unlock()
+
+	statuses := make([]*RunStatus, 0, len(ctrl.runs))
+	for runID, run := range ctrl.runs {
+		statuses = append(statuses, &RunStatus{RunID: runID, StartedAt: run.started, Paused: run.pause.Paused()})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].StartedAt.Equal(statuses[j].StartedAt) {
+			return statuses[i].RunID < statuses[j].RunID
+		}
+
+		return statuses[i].StartedAt.Before(statuses[j].StartedAt)
+	})
+
+	return statuses
+}
+
+// Handler will return the control endpoints of the controller, for "gidari jobs":
+//
+//   - "GET /runs" responds with the JSON status of the runs in progress.
+//   - "POST /runs/{id}/pause", "POST /runs/{id}/resume", and "POST /runs/{id}/cancel" control the run with the ID,
+//     and respond with "204 No Content", or "404 Not Found" if the run is not in progress.
+//
+// The endpoints are not authenticated, so serve them behind an "Authenticator", or on an address that only operators
+// can reach.
+func (ctrl *Controller) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /runs", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+
+		_ = json.NewEncoder(rw).Encode(ctrl.Runs())
+	})
+
+	actions := map[string]func(string) error{
+		ActionPause:  ctrl.Pause,
+		ActionResume: ctrl.Resume,
+		ActionCancel: ctrl.Cancel,
+	}
+
+	mux.HandleFunc("POST /runs/{id}/{action}", func(rw http.ResponseWriter, req *http.Request) {
+		action, ok := actions[req.PathValue("action")]
+		if !ok {
+			http.NotFound(rw, req)
+
+			return
+		}
+
+		if err := action(req.PathValue("id")); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrRunNotFound) {
+				status = http.StatusNotFound
+			}
+
+			http.Error(rw, err.Error(), status)
+
+			return
+		}
+
+		rw.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
@@ -0,0 +1,176 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidari
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// controlConfig will return the configuration of a run that requests "/a" and then "/b" from the web API at the URL.
+func controlConfig(url, dir string) []byte {
+	return []byte(`
+url: ` + url + `
+connectionStrings:
+  - file://` + filepath.ToSlash(dir) + `?format=jsonl
+rateLimit:
+  burst: 5
+  period: 1
+requests:
+  - endpoint: /a
+  - endpoint: /b
+`)
+}
+
+// waitForRun will wait until the run is in progress on the controller.
+func waitForRun(t *testing.T, ctrl *Controller, runID string) {
+	t.Helper()
+
+	for {
+		if _, err := ctrl.run(runID); err == nil {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestController(t *testing.T) {
+	t.Parallel()
+
+	t.Run("pause and resume", func(t *testing.T) {
+		t.Parallel()
+
+		requested := make(chan string, 2)
+		release := make(chan struct{})
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			requested <- req.URL.Path
+
+			if req.URL.Path == "/a" {
+				<-release
+			}
+
+			_, _ = rw.Write([]byte(`[{"id": 1, "open": 1.5}]`))
+		}))
+		t.Cleanup(server.Close)
+
+		ctrl := NewController()
+		done := make(chan error, 1)
+
+		go func() {
+			_, err := RunConfig(context.Background(), controlConfig(server.URL, t.TempDir()), WithRunID("run-1"),
+				WithController(ctrl), WithQuota(Quota{MaxConcurrentRequests: 1}))
+			done <- err
+		}()
+
+		if path := <-requested; path != "/a" {
+			t.Fatalf("expected /a to be requested first, got %s", path)
+		}
+
+		if err := ctrl.Pause("run-1"); err != nil {
+			t.Fatalf("failed to pause: %v", err)
+		}
+
+		close(release)
+
+		select {
+		case path := <-requested:
+			t.Fatalf("expected the paused run not to fetch, got a request for %s", path)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if runs := ctrl.Runs(); len(runs) != 1 || runs[0].RunID != "run-1" || !runs[0].Paused {
+			t.Fatalf("expected the run to be paused, got %+v", runs)
+		}
+
+		if err := ctrl.Resume("run-1"); err != nil {
+			t.Fatalf("failed to resume: %v", err)
+		}
+
+		if path := <-requested; path != "/b" {
+			t.Fatalf("expected /b to be requested once resumed, got %s", path)
+		}
+
+		if err := <-done; err != nil {
+			t.Fatalf("failed to run configuration: %v", err)
+		}
+
+		if err := ctrl.Pause("run-1"); !errors.Is(err, ErrRunNotFound) {
+			t.Fatalf("expected error %v once the run ended, got %v", ErrRunNotFound, err)
+		}
+	})
+
+	t.Run("endpoints", func(t *testing.T) {
+		t.Parallel()
+
+		server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+			<-req.Context().Done()
+		}))
+		t.Cleanup(server.Close)
+
+		ctrl := NewController()
+
+		control := httptest.NewServer(ctrl.Handler())
+		t.Cleanup(control.Close)
+
+		done := make(chan error, 1)
+
+		go func() {
+			_, err := RunConfig(context.Background(), controlConfig(server.URL, t.TempDir()), WithRunID("run-2"),
+				WithController(ctrl))
+			done <- err
+		}()
+
+		waitForRun(t, ctrl, "run-2")
+
+		if _, err := RunConfig(context.Background(), controlConfig(server.URL, t.TempDir()), WithRunID("run-2"),
+			WithController(ctrl)); !errors.Is(err, ErrRunInProgress) {
+			t.Fatalf("expected error %v, got %v", ErrRunInProgress, err)
+		}
+
+		rsp, err := http.Get(control.URL + "/runs")
+		if err != nil {
+			t.Fatalf("failed to list runs: %v", err)
+		}
+
+		var runs []*RunStatus
+		if err := json.NewDecoder(rsp.Body).Decode(&runs); err != nil || len(runs) != 1 || runs[0].RunID != "run-2" {
+			t.Fatalf("expected the run in the listing, got %+v: %v", runs, err)
+		}
+
+		rsp.Body.Close()
+
+		for path, exp := range map[string]int{
+			"/runs/unknown/cancel": http.StatusNotFound,
+			"/runs/run-2/restart":  http.StatusNotFound,
+			"/runs/run-2/cancel":   http.StatusNoContent,
+		} {
+			rsp, err := http.Post(control.URL+path, "", nil)
+			if err != nil {
+				t.Fatalf("failed to post %s: %v", path, err)
+			}
+
+			rsp.Body.Close()
+
+			if rsp.StatusCode != exp {
+				t.Fatalf("expected status %d for %s, got %d", exp, path, rsp.StatusCode)
+			}
+		}
+
+		if err := <-done; err == nil {
+			t.Fatalf("expected the canceled run to fail")
+		}
+	})
+}
@@ -0,0 +1,264 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+
+// Package gidari is the programmatic entrypoint of gidari, for orchestrators that embed the transport pipeline in Go,
+// e.g. in an Airflow or Dagster operator, instead of running the CLI:
+//
+//	report, err := gidari.RunConfig(ctx, cfgBytes, gidari.WithLogger(logger), gidari.WithRunID(taskID))
+//
+// Each call loads its own configuration and logger and counts its own usage, so runs can be made concurrently from the
+// same process, unless their compliance modes differ.
+package gidari
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/transport"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrPipeline is returned when a worker of the pipeline fails, e.g. a web request or an upsert.
+var ErrPipeline = fmt.Errorf("pipeline failed")
+
+// PipelineError is returned when a worker of the pipeline fails with the message, which has the context of the
+// failure, e.g. "run <id> (stage: web, batch: 3, ...): <error>".
+func PipelineError(msg string) error {
+	return fmt.Errorf("%w: %s", ErrPipeline, msg)
+}
+
+// Report is the summary of a run, with its run ID, duration, error, resource usage, compliance attestation, data
+// test results, and dbt result. It is the same summary that the CLI writes with "--summary".
+type Report = transport.RunSummary
+
+// Option is an option of "RunConfig".
+type Option func(*runner)
+
+// runner is the run of a configuration.
+type runner struct {
+	logger        *logrus.Logger
+	run           func(context.Context, *transport.Config) (*Report, error)
+	runID         string
+	asOf          *time.Time
+	window        *transport.Window
+	reprocessFrom string
+	migrationsDir string
+	summary       io.Writer
+	quota         *Quota
+	scheduler     *Scheduler
+	priority      Priority
+	controller    *Controller
+}
+
+// WithLogger will log the run to the output, with the formatter, level, and hooks of the logger. The run does not
+// exit the process on fatal errors, which are returned by "RunConfig" instead. If not set, the run is not logged.
+func WithLogger(logger *logrus.Logger) Option {
+	return func(rnr *runner) {
+		rnr.logger.SetOutput(logger.Out)
+		rnr.logger.SetFormatter(logger.Formatter)
+		rnr.logger.SetLevel(logger.GetLevel())
+
+		// The redactor of the run is added for the secrets of its configuration, so the redactors of other runs are
+		// not copied.
+		for level, hooks := range logger.Hooks {
+			for _, hook := range hooks {
+				if _, ok := hook.(*tools.Redactor); !ok {
+					rnr.logger.Hooks[level] = append(rnr.logger.Hooks[level], hook)
+				}
+			}
+		}
+	}
+}
+
+// WithRunID will set the ID of the run, e.g. to the ID of the task of the orchestrator. If not set, a random ID is
+// generated.
+func WithRunID(runID string) Option {
+	return func(rnr *runner) { rnr.runID = runID }
+}
+
+// WithAsOf will evaluate the run as of the time, like the "--as-of" flag of the CLI.
+func WithAsOf(asOf time.Time) Option {
+	return func(rnr *runner) {
+		asOf = asOf.UTC()
+		rnr.asOf = &asOf
+	}
+}
+
+// WithWindow will replace the range of every timeseries request with the window, like the "--window" flag of the
+// CLI, e.g. with the data interval of the orchestrator.
+func WithWindow(start, end time.Time) Option {
+	return func(rnr *runner) { rnr.window = &transport.Window{Start: start.UTC(), End: end.UTC()} }
+}
+
+// WithBackfill will only upsert the timeseries chunks that are missing from storage, like "gidari backfill".
+func WithBackfill() Option {
+	return func(rnr *runner) { rnr.run = transport.Backfill }
+}
+
+// WithReprocess will upsert the raw payloads archived at the location instead of fetching them, like
+// "gidari reprocess --from <location>".
+func WithReprocess(location string) Option {
+	return func(rnr *runner) {
+		rnr.run = transport.Reprocess
+		rnr.reprocessFrom = location
+	}
+}
+
+// WithMigrationsDir will fail the run before writing anything unless every connection string has applied the latest
+// migration in the directory, like the "--migrations-dir" flag of the CLI.
+func WithMigrationsDir(dir string) Option {
+	return func(rnr *runner) { rnr.migrationsDir = dir }
+}
+
+// WithSummary will also write the JSON report of the run to the writer, like the "--summary" flag of the CLI.
+func WithSummary(w io.Writer) Option {
+	return func(rnr *runner) { rnr.summary = w }
+}
+
+// fatalHook records the first fatal error of a run, and cancels the run.
+type fatalHook struct {
+	mtx    sync.Mutex
+	msg    string
+	cancel context.CancelFunc
+}
+
+// Levels implements the logrus hook interface.
+func (hook *fatalHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.FatalLevel}
+}
+
+// Fire implements the logrus hook interface.
+func (hook *fatalHook) Fire(entry *logrus.Entry) error {
+	hook.mtx.Lock()
+	defer hook.mtx.Unlock()
+
+	if hook.msg == "" {
+		hook.msg = entry.Message
+		hook.cancel()
+	}
+
+	return nil
+}
+
+// err will return the first fatal error of the run, or nil if there is none. The message is recorded before the
+// hooks of the run redact it, so it is redacted with the redactor of the logger.
+func (hook *fatalHook) err(logger *logrus.Logger) error {
+	hook.mtx.Lock()
+	defer hook.mtx.Unlock()
+
+	if hook.msg == "" {
+		return nil
+	}
+
+	for _, redactor := range logger.Hooks[logrus.FatalLevel] {
+		if redactor, ok := redactor.(*tools.Redactor); ok {
+			return PipelineError(redactor.Redact(hook.msg))
+		}
+	}
+
+	return PipelineError(hook.msg)
+}
+
+// RunConfig will load the YAML configuration and run it, i.e. upsert the data of the web API to the connection
+// strings of the configuration, and return the report of the run. The report is also returned with the error of a
+// run that fails after it starts, and is nil if the configuration can not be loaded or the run is canceled before it
+// starts, e.g. while it waits for a scheduler.
+//
+// Canceling the context cancels the run, and rolls back the transactions that are not yet committed. A fatal error
+// of the pipeline cancels the run the same way, and is returned as an error wrapping "ErrPipeline" rather than
+// exiting the process. The HTTP connections of a run are closed when it ends, and its counters, e.g. of retries and
+// storage timeouts, are in its report. The compliance mode, see "compliance" in the configuration, is on for the runs
+// that turn it on, so a run is refused while runs with a different compliance mode are in progress.
+func RunConfig(ctx context.Context, cfgBytes []byte, opts ...Option) (*Report, error) {
+	rnr := &runner{logger: logrus.New(), run: transport.Upsert}
+	rnr.logger.SetOutput(io.Discard)
+
+	for _, opt := range opts {
+		opt(rnr)
+	}
+
+	if rnr.quota != nil {
+		if err := rnr.quota.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg, err := transport.NewConfig(cfgBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load configuration: %w", tools.NewRedactor().RedactError(err))
+	}
+
+	if rnr.scheduler != nil {
+		release, wait, err := rnr.scheduler.acquire(ctx, rnr.priority)
+		if err != nil {
+			return nil, err
+		}
+
+		defer release()
+
+		cfg.Priority = rnr.priority.String()
+		cfg.QueueWait = wait
+	}
+
+	parent := ctx
+
+	ctx, cancelQuota := rnr.quota.apply(parent, cfg)
+	defer cancelQuota()
+
+	quotaCtx := ctx
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fatal := &fatalHook{cancel: cancel}
+
+	// Fatal errors cancel the run instead of exiting, including those that are not logged at the level of the logger.
+	rnr.logger.AddHook(fatal)
+	rnr.logger.ExitFunc = func(int) { cancel() }
+
+	if rnr.controller != nil {
+		if rnr.runID == "" {
+			rnr.runID = uuid.New().String()
+		}
+
+		cfg.Pause = transport.NewPauseGate()
+
+		remove, err := rnr.controller.add(rnr.runID, cfg.Pause, cancel)
+		if err != nil {
+			return nil, err
+		}
+
+		defer remove()
+	}
+
+	cfg.Logger = rnr.logger
+	cfg.RunID = rnr.runID
+	cfg.AsOf = rnr.asOf
+	cfg.Window = rnr.window
+	cfg.ReprocessFrom = rnr.reprocessFrom
+	cfg.MigrationsDir = rnr.migrationsDir
+	cfg.Summary = rnr.summary
+
+	report, runErr := rnr.run(ctx, cfg)
+	if err := fatal.err(rnr.logger); err != nil {
+		runErr = err
+	}
+
+	runErr = rnr.quota.exceeded(quotaCtx, parent, runErr)
+
+	if report != nil && runErr != nil {
+		report.Error = runErr.Error()
+	}
+
+	return report, runErr
+}
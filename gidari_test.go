@@ -0,0 +1,112 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidari
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runConfig will return the configuration of a run that writes the "candles" of the web API at the URL to JSONL
+// files in the directory.
+func runConfig(url, dir string) []byte {
+	return []byte(`
+url: ` + url + `
+connectionStrings:
+  - file://` + filepath.ToSlash(dir) + `?format=jsonl
+rateLimit:
+  burst: 5
+  period: 1
+requests:
+  - endpoint: /candles
+dataTests:
+  candles:
+    minRows: 2
+`)
+}
+
+func TestRunConfig(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte(`[{"id": 1, "open": 1.5}, {"id": 2, "open": 2.5}]`))
+	}))
+	t.Cleanup(server.Close)
+
+	t.Run("report", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+
+		var summary bytes.Buffer
+
+		report, err := RunConfig(context.Background(), runConfig(server.URL, dir), WithRunID("task-1"),
+			WithSummary(&summary))
+		if err != nil {
+			t.Fatalf("failed to run configuration: %v", err)
+		}
+
+		if report.RunID != "task-1" || report.Error != "" || len(report.DataTests) != 1 ||
+			report.DataTests[0].Rows != 2 || report.Usage.BytesWritten["file"] == 0 {
+			t.Fatalf("unexpected report %+v", report)
+		}
+
+		var written Report
+		if err := json.Unmarshal(summary.Bytes(), &written); err != nil || written.RunID != "task-1" {
+			t.Fatalf("expected the report to be written as JSON, got %q: %v", summary.String(), err)
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, "candles.jsonl"))
+		if err != nil || strings.Count(string(data), "\n") != 2 {
+			t.Fatalf("expected the records to be written, got %q: %v", data, err)
+		}
+	})
+
+	t.Run("fatal", func(t *testing.T) {
+		t.Parallel()
+
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+
+		report, err := RunConfig(context.Background(), runConfig(closed.URL, t.TempDir()))
+		if !errors.Is(err, ErrPipeline) || !strings.Contains(err.Error(), "stage: web") {
+			t.Fatalf("expected the pipeline error instead of an exit, got %v", err)
+		}
+
+		if report == nil || report.Error != err.Error() {
+			t.Fatalf("expected the report of the failed run, got %+v", report)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := RunConfig(ctx, runConfig(server.URL, t.TempDir())); err == nil {
+			t.Fatalf("expected the canceled run to fail")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		if report, err := RunConfig(context.Background(), []byte("url: [")); err == nil || report != nil {
+			t.Fatalf("expected the configuration to fail to load, got %+v: %v", report, err)
+		}
+	})
+}
@@ -0,0 +1,349 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+
+// Package gidaritest is a harness for integration testing gidari configurations. It starts ephemeral MongoDB and
+// PostgreSQL containers with testcontainers, runs the transport pipeline for a fixture configuration against them,
+// and reads back the stored records to assert on, e.g.
+//
+//	pg := gidaritest.StartPostgres(t, "CREATE TABLE candles (...)")
+//	gidaritest.RunFile(t, "testdata/config.yaml", gidaritest.Options{URL: server.URL}, pg)
+//	gidaritest.AssertRecordCount(t, pg, "candles", 300)
+//
+// Tests that use the harness are skipped when docker is not available.
+package gidaritest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/transport"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/repository"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/docker/go-connections/nat"
+	"github.com/sirupsen/logrus"
+	"github.com/testcontainers/testcontainers-go"
+	tcexec "github.com/testcontainers/testcontainers-go/exec"
+)
+
+const (
+	// MongoImage and PostgresImage are the images of the containers.
+	MongoImage    = "mongo:6"
+	PostgresImage = "postgres:14"
+
+	// startTimeout is how long to wait for a container to accept connections.
+	startTimeout = 2 * time.Minute
+	pollInterval = 500 * time.Millisecond
+
+	mongoReplicaSet  = "rs0"
+	postgresPassword = "gidari"
+)
+
+// Container is an ephemeral database container, which is removed when the test that started it completes. Containers
+// that outlive their test, e.g. because the test binary was killed, are removed by the testcontainers reaper.
+type Container struct {
+	// DNS is the connection string of the database in the container.
+	DNS string
+
+	container testcontainers.Container
+}
+
+// skipWithoutDocker will skip the test if the docker daemon is not reachable, e.g. the docker CLI is installed but
+// the daemon is not running.
+func skipWithoutDocker(t testing.TB) {
+	t.Helper()
+
+	// The provider panics when no docker host can be found.
+	defer func() {
+		if r := recover(); r != nil {
+			t.Skipf("docker is not available: %v", r)
+		}
+	}()
+
+	provider, err := testcontainers.ProviderDocker.GetProvider()
+	if err != nil {
+		t.Skipf("docker is not available: %v", err)
+	}
+
+	defer provider.Close()
+
+	if err := provider.Health(context.Background()); err != nil {
+		t.Skipf("docker is not available: %v", err)
+	}
+}
+
+// start will start a container for the request, and return the container with the host and port that the container
+// port is published on.
+func start(t testing.TB, containerPort string, req testcontainers.ContainerRequest) (*Container, string) {
+	t.Helper()
+
+	skipWithoutDocker(t)
+
+	ctx := context.Background()
+
+	req.ExposedPorts = []string{containerPort + "/tcp"}
+
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	testcontainers.CleanupContainer(t, container)
+
+	if err != nil {
+		t.Fatalf("failed to start container: %v", err)
+	}
+
+	host, err := container.Host(ctx)
+	if err != nil {
+		t.Fatalf("failed to get container host: %v", err)
+	}
+
+	port, err := container.MappedPort(ctx, nat.Port(containerPort+"/tcp"))
+	if err != nil {
+		t.Fatalf("failed to get container port: %v", err)
+	}
+
+	return &Container{container: container}, net.JoinHostPort(host, port.Port())
+}
+
+// waitFor will call the function until it succeeds, failing the test if it does not succeed before the timeout.
+func waitFor(t testing.TB, what string, fn func() error) {
+	t.Helper()
+
+	deadline := time.Now().Add(startTimeout)
+
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s: %v", what, err)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// StartMongo will start a single node MongoDB replica set, which supports transactions, and return the container.
+func StartMongo(t testing.TB) *Container {
+	t.Helper()
+
+	container, addr := start(t, "27017", testcontainers.ContainerRequest{
+		Image: MongoImage,
+		Cmd:   []string{"--replSet", mongoReplicaSet, "--bind_ip_all"},
+	})
+
+	// The member is addressed from inside the container, so the client must connect directly rather than discover
+	// the replica set.
+	initiate := fmt.Sprintf("rs.initiate({_id: %q, members: [{_id: 0, host: \"localhost:27017\"}]})", mongoReplicaSet)
+
+	waitFor(t, "mongo to initiate the replica set", func() error {
+		code, out, err := container.container.Exec(context.Background(),
+			[]string{"mongosh", "--quiet", "--eval", initiate}, tcexec.Multiplexed())
+		if err != nil {
+			return fmt.Errorf("failed to run mongosh: %w", err)
+		}
+
+		if code != 0 {
+			msg, _ := io.ReadAll(out)
+
+			return fmt.Errorf("mongosh exited with %d: %s", code, strings.TrimSpace(string(msg)))
+		}
+
+		return nil
+	})
+
+	container.DNS = fmt.Sprintf("mongodb://%s/gidaritest?directConnection=true", addr)
+
+	waitFor(t, "mongo to elect a primary", func() error {
+		return ping(container.DNS)
+	})
+
+	return container
+}
+
+// StartPostgres will start a PostgreSQL database and return the container, after executing the statements, e.g. the
+// "CREATE TABLE" statements of the tables that the configuration writes to.
+func StartPostgres(t testing.TB, statements ...string) *Container {
+	t.Helper()
+
+	container, addr := start(t, "5432", testcontainers.ContainerRequest{
+		Image: PostgresImage,
+		Env:   map[string]string{"POSTGRES_PASSWORD": postgresPassword},
+	})
+	container.DNS = fmt.Sprintf("postgresql://postgres:%s@%s/postgres?sslmode=disable", postgresPassword, addr)
+
+	db, err := sql.Open("postgres", container.DNS)
+	if err != nil {
+		t.Fatalf("failed to open postgres: %v", err)
+	}
+	defer db.Close()
+
+	waitFor(t, "postgres to accept connections", db.Ping)
+
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("failed to execute statement: %v", err)
+		}
+	}
+
+	return container
+}
+
+// ping will list the tables of the storage, to check that it accepts connections and reads.
+func ping(dns string) error {
+	ctx := context.Background()
+
+	repo, err := repository.New(ctx, dns)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer repo.Close()
+
+	if _, err := repo.ListTables(ctx); err != nil {
+		return fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	return nil
+}
+
+// Options are the options for running a fixture configuration.
+type Options struct {
+	// URL replaces the URL of the configuration, e.g. with the URL of an "httptest.Server" that serves fixture
+	// responses.
+	URL string
+
+	// Verbose logs the run at the info level, instead of only logging fatal errors.
+	Verbose bool
+}
+
+// Run will run the pipeline for the configuration, writing to the containers instead of the connection strings of
+// the configuration. Wire settings of the configuration are not applied to the connection strings of the containers.
+func Run(t testing.TB, config []byte, opts Options, containers ...*Container) {
+	t.Helper()
+
+	cfg, err := transport.NewConfig(config)
+	if err != nil {
+		t.Fatalf("failed to load configuration: %v", err)
+	}
+
+	if opts.URL != "" {
+		if cfg.URL, err = url.Parse(opts.URL); err != nil {
+			t.Fatalf("failed to parse URL: %v", err)
+		}
+
+		cfg.RawURL = opts.URL
+	}
+
+	if len(containers) > 0 {
+		cfg.ConnectionStrings = make([]string, len(containers))
+		for idx, container := range containers {
+			cfg.ConnectionStrings[idx] = container.DNS
+		}
+	}
+
+	cfg.Logger = logrus.New()
+	if !opts.Verbose {
+		cfg.Logger.SetLevel(logrus.FatalLevel)
+	}
+
+	if _, err := transport.Upsert(context.Background(), cfg); err != nil {
+		t.Fatalf("failed to run configuration: %v", err)
+	}
+}
+
+// RunFile will run the pipeline for the configuration file, see "Run".
+func RunFile(t testing.TB, path string, opts Options, containers ...*Container) {
+	t.Helper()
+
+	config, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read configuration: %v", err)
+	}
+
+	Run(t, config, opts, containers...)
+}
+
+// Records will return the records of the table in the container that match the required fields, if any.
+func Records(t testing.TB, container *Container, table string,
+	required map[string]interface{},
+) []map[string]interface{} {
+	t.Helper()
+
+	ctx := context.Background()
+
+	repo, err := repository.New(ctx, container.DNS)
+	if err != nil {
+		t.Fatalf("failed to connect to container: %v", err)
+	}
+	defer repo.Close()
+
+	req := &proto.ReadRequest{Table: table}
+
+	for field, value := range required {
+		if err := tools.AssignReadRequired(req, field, value); err != nil {
+			t.Fatalf("failed to assign required field: %v", err)
+		}
+	}
+
+	rsp, err := repo.Read(ctx, req)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", table, err)
+	}
+
+	records := make([]map[string]interface{}, 0, len(rsp.GetRecords()))
+	for _, record := range rsp.GetRecords() {
+		records = append(records, record.AsMap())
+	}
+
+	return records
+}
+
+// AssertRecordCount will fail the test if the table in the container does not have the number of records.
+func AssertRecordCount(t testing.TB, container *Container, table string, count int) {
+	t.Helper()
+
+	if got := len(Records(t, container, table, nil)); got != count {
+		t.Errorf("expected %d records in %s, got %d", count, table, got)
+	}
+}
+
+// AssertRecord will fail the test if no record of the table in the container has the fields, compared after
+// formatting, e.g. the number 1 matches the stored value 1.0.
+func AssertRecord(t testing.TB, container *Container, table string, fields map[string]interface{}) {
+	t.Helper()
+
+	for _, record := range Records(t, container, table, nil) {
+		if hasFields(record, fields) {
+			return
+		}
+	}
+
+	t.Errorf("expected a record in %s with %v", table, fields)
+}
+
+func hasFields(record, fields map[string]interface{}) bool {
+	for field, want := range fields {
+		got, ok := record[field]
+		if !ok || fmt.Sprint(got) != fmt.Sprint(want) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,28 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidaritest
+
+import "testing"
+
+func TestHasFields(t *testing.T) {
+	t.Parallel()
+
+	record := map[string]interface{}{"id": "1", "price": 1.0, "side": "buy"}
+
+	if !hasFields(record, map[string]interface{}{"id": "1", "price": 1}) {
+		t.Fatalf("expected the record to have the fields")
+	}
+
+	if hasFields(record, map[string]interface{}{"side": "sell"}) {
+		t.Fatalf("expected the record not to have a different value")
+	}
+
+	if hasFields(record, map[string]interface{}{"size": nil}) {
+		t.Fatalf("expected the record not to have a missing field")
+	}
+}
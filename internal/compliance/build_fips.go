@@ -0,0 +1,16 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+
+//go:build fips
+
+package compliance
+
+// Binaries built with the "fips" tag always run in compliance mode.
+func init() {
+	source = SourceBuild
+}
@@ -0,0 +1,249 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+
+// Package compliance is the compliance mode, which restricts the cryptography used by the connections that gidari
+// opens to algorithms approved by FIPS 140, and attests to the restrictions in the report of every run. The mode is on
+// for the runs that turn it on, or for every run of a binary built with the "fips" tag.
+package compliance
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+)
+
+// ModeFIPS restricts TLS to TLS 1.2 with AES-GCM cipher suites and the P-256 and P-384 curves, and disables the
+// hash functions that FIPS 140 does not approve.
+const ModeFIPS = "fips"
+
+// Sources of the compliance mode, i.e. the build tag or the configuration of a run.
+const (
+	SourceBuild  = "build"
+	SourceConfig = "config"
+)
+
+// ErrConflict is returned when a run needs the compliance mode to be on while a run without it is in progress, or
+// the other way around.
+var ErrConflict = fmt.Errorf("compliance mode conflicts with a run in progress")
+
+var (
+	mtx    sync.RWMutex
+	source string
+
+	// runs is the number of runs in progress, i.e. that acquired the mode and have not released it.
+	runs int
+
+	// transport is the restricted clone of "http.DefaultTransport", built the first time it is used in compliance
+	// mode.
+	transport     *http.Transport
+	transportOnce sync.Once
+
+	// cryptoModules will return the validated cryptographic modules that the binary was built with, e.g.
+	// "boringcrypto", set by the files built for each module.
+	cryptoModules []func() (string, bool)
+)
+
+// fipsCipherSuites are the TLS 1.2 cipher suites approved by FIPS 140, in order of preference.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+}
+
+// fipsCurves are the key exchange curves approved by FIPS 140.
+var fipsCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+
+// disabledHashes are the hash functions that are not used in compliance mode.
+var disabledHashes = []string{"MD5"}
+
+// exceptions are the uses of non-approved algorithms that protocols require and that do not protect data.
+var exceptions = []string{
+	"SHA-1 in the WebSocket opening handshake (RFC 6455)",
+	"SHA-1 digests of Redis scripts (EVALSHA)",
+	"TLS of database drivers, which is only restricted by a validated cryptographic module",
+}
+
+// Acquire will start a run with the compliance mode turned on or off, and return the function that ends it. The mode
+// applies to the connections that gidari opens while a run that turned it on is in progress, i.e. those of TLSConfig,
+// Transport, and HTTPClient, and is turned off when the last of those runs ends. Runs that turn the mode on can not
+// be in progress at the same time as runs that do not, so a run that conflicts with those in progress is refused with
+// "ErrConflict". Binaries built with the "fips" tag are always in compliance mode. "http.DefaultTransport" and
+// "http.DefaultClient" are not changed, so other code in the process keeps its own TLS configuration.
+func Acquire(enable bool) (func(), error) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	switch {
+	case source == SourceBuild:
+	case runs > 0 && enable && source == "":
+		return nil, fmt.Errorf("%w: %d runs are in progress without the mode", ErrConflict, runs)
+	case runs > 0 && !enable && source == SourceConfig:
+		return nil, fmt.Errorf("%w: %d runs are in progress with the mode", ErrConflict, runs)
+	case enable:
+		source = SourceConfig
+	}
+
+	runs++
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			if runs--; runs == 0 && source == SourceConfig {
+				source = ""
+			}
+		})
+	}, nil
+}
+
+// Enabled will return true if the compliance mode is turned on.
+func Enabled() bool {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return source != ""
+}
+
+// TLSConfig will return the TLS configuration for connections to the server, restricted to approved algorithms in
+// compliance mode. Outside of compliance mode, it only requires TLS 1.2 or later.
+func TLSConfig(serverName string) *tls.Config {
+	cfg := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if Enabled() {
+		cfg = restrict(cfg)
+	}
+
+	return cfg
+}
+
+// Transport will return the transport for HTTP requests that do not need their own, i.e. a clone of
+// "http.DefaultTransport" restricted to approved algorithms in compliance mode, or "http.DefaultTransport" itself
+// outside of it.
+func Transport() http.RoundTripper {
+	if !Enabled() {
+		return http.DefaultTransport
+	}
+
+	transportOnce.Do(func() {
+		base, ok := http.DefaultTransport.(*http.Transport)
+		if !ok {
+			base = new(http.Transport)
+		}
+
+		transport = base.Clone()
+		transport.TLSClientConfig = restrict(transport.TLSClientConfig)
+	})
+
+	return transport
+}
+
+// HTTPClient will return the client for HTTP requests that do not need their own, i.e. a client of Transport in
+// compliance mode, or "http.DefaultClient" outside of it.
+func HTTPClient() *http.Client {
+	if !Enabled() {
+		return http.DefaultClient
+	}
+
+	return &http.Client{Transport: Transport()}
+}
+
+// Modules will return the names of the validated cryptographic modules in use, e.g. "boringcrypto".
+func Modules() []string {
+	modules := []string{}
+
+	for _, module := range cryptoModules {
+		if name, ok := module(); ok {
+			modules = append(modules, name)
+		}
+	}
+
+	return modules
+}
+
+// restrict will return a copy of the TLS configuration restricted to approved algorithms. A nil configuration is
+// restricted from the defaults.
+func restrict(cfg *tls.Config) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	cfg = cfg.Clone()
+
+	// The cipher suites of TLS 1.3 can not be configured, so the connections are held to TLS 1.2.
+	cfg.MinVersion = tls.VersionTLS12
+	cfg.MaxVersion = tls.VersionTLS12
+	cfg.CipherSuites = append([]uint16(nil), fipsCipherSuites...)
+	cfg.CurvePreferences = append([]tls.CurveID(nil), fipsCurves...)
+
+	return cfg
+}
+
+// Attestation is the record of the compliance mode of a run, for the audit of regulated deployments.
+type Attestation struct {
+	// Mode is the compliance mode, i.e. "fips".
+	Mode string `json:"mode"`
+
+	// Source is where the mode was turned on, i.e. "build" for binaries built with the "fips" tag, or "config".
+	Source string `json:"source"`
+
+	// GoVersion is the version of Go that the binary was built with.
+	GoVersion string `json:"goVersion"`
+
+	// CryptoModules are the validated cryptographic modules that the binary uses, i.e. "boringcrypto" for builds with
+	// GOEXPERIMENT=boringcrypto and "fips140" for the Go Cryptographic Module with GODEBUG=fips140=on. It is empty
+	// if the binary uses the standard library cryptography.
+	CryptoModules []string `json:"cryptoModules"`
+
+	// TLSVersions, CipherSuites, and Curves are the algorithms that TLS connections are restricted to.
+	TLSVersions  []string `json:"tlsVersions"`
+	CipherSuites []string `json:"cipherSuites"`
+	Curves       []string `json:"curves"`
+
+	// DisabledHashes are the hash functions that are not used, e.g. "MD5" for the integrity headers of object
+	// storage requests.
+	DisabledHashes []string `json:"disabledHashes"`
+
+	// Exceptions are the uses of non-approved algorithms that are outside of the restrictions.
+	Exceptions []string `json:"exceptions"`
+}
+
+// Attest will return the attestation of the compliance mode, or nil if the mode is not turned on.
+func Attest() *Attestation {
+	mtx.RLock()
+	from := source
+	mtx.RUnlock()
+
+	if from == "" {
+		return nil
+	}
+
+	attestation := &Attestation{
+		Mode:           ModeFIPS,
+		Source:         from,
+		GoVersion:      runtime.Version(),
+		CryptoModules:  Modules(),
+		TLSVersions:    []string{tls.VersionName(tls.VersionTLS12)},
+		DisabledHashes: append([]string(nil), disabledHashes...),
+		Exceptions:     append([]string(nil), exceptions...),
+	}
+
+	for _, suite := range fipsCipherSuites {
+		attestation.CipherSuites = append(attestation.CipherSuites, tls.CipherSuiteName(suite))
+	}
+
+	for _, curve := range fipsCurves {
+		attestation.Curves = append(attestation.Curves, curve.String())
+	}
+
+	return attestation
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package compliance
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// TestCompliance turns the compliance mode of the test binary on and off, so it is the only test of the package.
+func TestCompliance(t *testing.T) {
+	t.Parallel()
+
+	build := Enabled()
+
+	if !build {
+		if cfg := TLSConfig("api.example.com"); cfg.MaxVersion != 0 || cfg.CipherSuites != nil ||
+			cfg.MinVersion != tls.VersionTLS12 {
+			t.Fatalf("expected an unrestricted TLS configuration outside of compliance mode, got %+v", cfg)
+		}
+
+		if HTTPClient() != http.DefaultClient || Transport() != http.DefaultTransport {
+			t.Fatalf("expected the default client outside of compliance mode")
+		}
+
+		if att := Attest(); att != nil {
+			t.Fatalf("expected no attestation outside of compliance mode, got %+v", att)
+		}
+
+		release, err := Acquire(false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if _, err := Acquire(true); !errors.Is(err, ErrConflict) {
+			t.Fatalf("expected error %v while a run without the mode is in progress, got %v", ErrConflict, err)
+		}
+
+		release()
+	}
+
+	release, err := Acquire(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg := TLSConfig("api.example.com")
+	if cfg.ServerName != "api.example.com" || cfg.MinVersion != tls.VersionTLS12 || cfg.MaxVersion != tls.VersionTLS12 ||
+		!reflect.DeepEqual(cfg.CipherSuites, fipsCipherSuites) || !reflect.DeepEqual(cfg.CurvePreferences, fipsCurves) {
+		t.Fatalf("expected a restricted TLS configuration, got %+v", cfg)
+	}
+
+	if transport, ok := HTTPClient().Transport.(*http.Transport); !ok || transport == http.DefaultTransport ||
+		transport.TLSClientConfig == nil || transport.TLSClientConfig.MaxVersion != tls.VersionTLS12 {
+		t.Fatalf("expected the client to use a restricted transport")
+	}
+
+	if transport := http.DefaultTransport.(*http.Transport); transport.TLSClientConfig != nil &&
+		transport.TLSClientConfig.MaxVersion == tls.VersionTLS12 {
+		t.Fatalf("expected the default transport of the process to be left unchanged")
+	}
+
+	att := Attest()
+	if att == nil || att.Mode != ModeFIPS || att.GoVersion == "" || att.CryptoModules == nil {
+		t.Fatalf("unexpected attestation %+v", att)
+	}
+
+	if exp := []string{"TLS 1.2"}; !reflect.DeepEqual(att.TLSVersions, exp) {
+		t.Fatalf("expected TLS versions %v, got %v", exp, att.TLSVersions)
+	}
+
+	if exp := "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"; att.CipherSuites[0] != exp || len(att.CipherSuites) != 4 {
+		t.Fatalf("expected the approved cipher suites, got %v", att.CipherSuites)
+	}
+
+	if exp := []string{"CurveP256", "CurveP384"}; !reflect.DeepEqual(att.Curves, exp) {
+		t.Fatalf("expected curves %v, got %v", exp, att.Curves)
+	}
+
+	if exp := []string{"MD5"}; !reflect.DeepEqual(att.DisabledHashes, exp) {
+		t.Fatalf("expected disabled hashes %v, got %v", exp, att.DisabledHashes)
+	}
+
+	if _, err := Acquire(false); !build && !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected error %v while a run with the mode is in progress, got %v", ErrConflict, err)
+	}
+
+	release()
+
+	if !build && (Enabled() || Attest() != nil) {
+		t.Fatalf("expected the mode to be turned off when the last run that turned it on ends")
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+
+//go:build go1.24
+
+package compliance
+
+import "crypto/fips140"
+
+func init() {
+	cryptoModules = append(cryptoModules, func() (string, bool) { return "fips140", fips140.Enabled() })
+}
@@ -0,0 +1,757 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/arangodb/go-driver/v2/arangodb"
+	"github.com/arangodb/go-driver/v2/arangodb/shared"
+	"github.com/arangodb/go-driver/v2/connection"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	arangoDBScheme = "arangodb"
+
+	// arangoDBPort is the default port of ArangoDB.
+	arangoDBPort = "8529"
+
+	// arangoDBDefaultDatabase is the database of connection strings without a path.
+	arangoDBDefaultDatabase = "_system"
+
+	// arangoDBTLSParam is the connection string parameter that connects to the server with HTTPS, e.g. "tls=true".
+	arangoDBTLSParam = "tls"
+
+	// arangoDBPrimaryKeyParam is the connection string parameter for the field of the records that is the "_key" of
+	// their documents in every collection, e.g. "primaryKey=id". The field for a single table is set with
+	// "primaryKey.<table>", e.g. "primaryKey.candles=time".
+	arangoDBPrimaryKeyParam = "primaryKey"
+
+	// arangoDBOverwriteModeParam is the connection string parameter for how the records are written over the
+	// existing documents with the same key, see the "ArangoDBOverwrite" constants.
+	arangoDBOverwriteModeParam = "overwriteMode"
+
+	arangoDBDefaultPrimaryKey = "id"
+
+	// arangoDBBatchDocs is the number of documents written by each request, and read by each batch of a cursor.
+	arangoDBBatchDocs = 1000
+
+	// arangoDBKeyChars are the characters of document keys that are written as they are. Other bytes of primary keys
+	// are percent-encoded, including "%", so that different primary keys are different document keys.
+	arangoDBKeyChars = "_-:.@()+,=;$!*'"
+)
+
+const (
+	// ArangoDBOverwriteReplace replaces the existing documents with the records.
+	ArangoDBOverwriteReplace = "replace"
+
+	// ArangoDBOverwriteUpdate merges the fields of the records into the existing documents, keeping the fields that
+	// are not on the records.
+	ArangoDBOverwriteUpdate = "update"
+
+	// ArangoDBOverwriteIgnore keeps the existing documents, and only writes the records without a document.
+	ArangoDBOverwriteIgnore = "ignore"
+
+	// ArangoDBOverwriteConflict fails the upsert if a record has a document.
+	ArangoDBOverwriteConflict = "conflict"
+)
+
+var (
+	ErrArangoDB           = fmt.Errorf("arangodb request failed")
+	ErrArangoDBPrimaryKey = fmt.Errorf("invalid arangodb primary key")
+)
+
+// ArangoDBError is returned when a request of the ArangoDB driver fails.
+func ArangoDBError(err error) error {
+	return fmt.Errorf("%w: %v", ErrArangoDB, err)
+}
+
+// ArangoDBPrimaryKeyError is returned when the primary key of a record cannot be the key of a document.
+func ArangoDBPrimaryKeyError(table, field string) error {
+	return fmt.Errorf("%w: the %q field of records of %q must be a string, number, or boolean", ErrArangoDBPrimaryKey,
+		field, table)
+}
+
+// arangoDBTxType is the type of the context key of ArangoDB transactions.
+type arangoDBTxType uint8
+
+const (
+	basicArangoDBTxID arangoDBTxType = iota
+)
+
+// arangoDBWrite is the documents of an upsert to a collection.
+type arangoDBWrite struct {
+	collection string
+	docs       []interface{}
+}
+
+// arangoDBTx are the upserts of a transaction, written in a stream transaction when the transaction commits.
+type arangoDBTx struct {
+	mtx    sync.Mutex
+	writes []arangoDBWrite
+}
+
+// ArangoDB is a storage device that writes records as the documents of ArangoDB collections, a collection per table,
+// with the ArangoDB Go driver. Each record is a document with the primary key of the record as its "_key", inserted
+// in bulk with the overwrite mode of the connection string. Reads are translated to AQL queries.
+type ArangoDB struct {
+	db            arangodb.Database
+	overwriteMode arangodb.CollectionDocumentCreateOverwriteMode
+	primaryKey    string
+	primaryKeys   map[string]string
+
+	// collections are the collections that have been created or found to exist.
+	mtx         sync.Mutex
+	collections map[string]bool
+
+	// activeTx are the transactions that are currently active, keyed by the transaction ID that is added to the
+	// context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewArangoDB will return an ArangoDB storage device for the connection string, i.e.
+// "arangodb://[user:password@]host[:port][/<database>][?tls=true&overwriteMode=<mode>]", for the "_system" database
+// unless one is set. Requests are authorized with the user and password of the connection string. The key of each
+// document is the "primaryKey" field of its record (default "id", or "primaryKey.<table>" for a single table), and
+// the overwrite mode is "replace" by default.
+func NewArangoDB(_ context.Context, connectionURL string) (*ArangoDB, error) {
+	uri, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	database := strings.Trim(uri.Path, "/")
+	if uri.Host == "" || strings.Contains(database, "/") {
+		return nil, DNSNotSupportedError(connectionURL)
+	}
+
+	if database == "" {
+		database = arangoDBDefaultDatabase
+	}
+
+	host := uri.Host
+	if uri.Port() == "" {
+		host = net.JoinHostPort(uri.Hostname(), arangoDBPort)
+	}
+
+	scheme := "http"
+
+	stg := &ArangoDB{
+		overwriteMode: ArangoDBOverwriteReplace,
+		primaryKey:    arangoDBDefaultPrimaryKey,
+		primaryKeys:   make(map[string]string),
+		collections:   make(map[string]bool),
+	}
+
+	for key, values := range uri.Query() {
+		switch table := strings.TrimPrefix(key, arangoDBPrimaryKeyParam+"."); {
+		case key == arangoDBTLSParam:
+			if tls, err := strconv.ParseBool(values[0]); err != nil {
+				return nil, fmt.Errorf("%w: %s=%q must be a boolean", ErrDNSNotSupported, key, values[0])
+			} else if tls {
+				scheme = "https"
+			}
+		case key == arangoDBOverwriteModeParam:
+			switch values[0] {
+			case ArangoDBOverwriteReplace, ArangoDBOverwriteUpdate, ArangoDBOverwriteIgnore, ArangoDBOverwriteConflict:
+				stg.overwriteMode = arangodb.CollectionDocumentCreateOverwriteMode(values[0])
+			default:
+				return nil, fmt.Errorf("%w: %s=%q must be %q, %q, %q, or %q", ErrDNSNotSupported, key, values[0],
+					ArangoDBOverwriteReplace, ArangoDBOverwriteUpdate, ArangoDBOverwriteIgnore,
+					ArangoDBOverwriteConflict)
+			}
+		case key == arangoDBPrimaryKeyParam:
+			stg.primaryKey = values[0]
+		case table != key:
+			stg.primaryKeys[table] = values[0]
+		}
+	}
+
+	cfg := connection.HttpConfiguration{
+		Endpoint:  connection.NewRoundRobinEndpoints([]string{scheme + "://" + host}),
+		Transport: compliance.Transport(),
+	}
+
+	if uri.User != nil {
+		password, _ := uri.User.Password()
+		cfg.Authentication = connection.NewBasicAuth(uri.User.Username(), password)
+	}
+
+	client := arangodb.NewClient(connection.NewHttpConnection(cfg))
+
+	// The database is checked to exist by the first request, rather than here.
+	stg.db, err = client.GetDatabase(context.Background(), database, &arangodb.GetDatabaseOptions{SkipExistCheck: true})
+	if err != nil {
+		return nil, ArangoDBError(err)
+	}
+
+	return stg, nil
+}
+
+// Close implements the storage interface. The driver does not hold a connection open.
+func (stg *ArangoDB) Close() {}
+
+// IsNoSQL returns "true" to indicate that "ArangoDB" is a NoSQL database.
+func (stg *ArangoDB) IsNoSQL() bool { return true }
+
+// Type implements the storage interface.
+func (stg *ArangoDB) Type() uint8 { return ArangoDBType }
+
+// tablePrimaryKey will return the field of the records of the table that is the key of their documents.
+func (stg *ArangoDB) tablePrimaryKey(table string) string {
+	if field, ok := stg.primaryKeys[table]; ok {
+		return field
+	}
+
+	return stg.primaryKey
+}
+
+// arangoDBCollection will return the name of the collection of the table, with the characters that collection
+// names must not contain replaced with underscores. Collection names must start with a letter, so "c_" is added
+// before names that do not.
+func arangoDBCollection(table string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+
+		return '_'
+	}, table)
+
+	if name == "" || !((name[0] >= 'a' && name[0] <= 'z') || (name[0] >= 'A' && name[0] <= 'Z')) {
+		name = "c_" + name
+	}
+
+	return name
+}
+
+// arangoDBKey will return the document key of a primary key, with the bytes that keys must not contain
+// percent-encoded.
+func arangoDBKey(key string) string {
+	var out strings.Builder
+
+	for idx := 0; idx < len(key); idx++ {
+		b := key[idx]
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') ||
+			strings.IndexByte(arangoDBKeyChars, b) >= 0 {
+			out.WriteByte(b)
+
+			continue
+		}
+
+		fmt.Fprintf(&out, "%%%02X", b)
+	}
+
+	return out.String()
+}
+
+// ensureCollection will create the document collection if it has not been created or found to exist.
+func (stg *ArangoDB) ensureCollection(ctx context.Context, collection string) error {
+	stg.mtx.Lock()
+	defer stg.mtx.Unlock()
+
+	if stg.collections[collection] {
+		return nil
+	}
+
+	if _, err := stg.db.CreateCollectionV2(ctx, collection, nil); err != nil && !shared.IsConflict(err) {
+		return fmt.Errorf("unable to create collection %s: %w", collection, ArangoDBError(err))
+	}
+
+	stg.collections[collection] = true
+
+	return nil
+}
+
+// documents will return the documents of the records of the table, with the primary key of each record as its
+// "_key". Records without a primary key are written with a generated key.
+func (stg *ArangoDB) documents(table string, records []*structpb.Struct) ([]interface{}, error) {
+	field := stg.tablePrimaryKey(table)
+	docs := make([]interface{}, 0, len(records))
+
+	for _, record := range records {
+		doc := record.AsMap()
+
+		if value, ok := record.GetFields()[field]; ok && value.AsInterface() != nil {
+			key, ok := redisPrimaryKey(value)
+			if !ok {
+				return nil, ArangoDBPrimaryKeyError(table, field)
+			}
+
+			doc["_key"] = arangoDBKey(key)
+		}
+
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+// insert will insert the documents into the collection with the overwrite mode, in batches of "arangoDBBatchDocs"
+// documents. The error of the first document that fails is returned.
+func (stg *ArangoDB) insert(ctx context.Context, col arangodb.Collection, docs []interface{}) error {
+	opts := &arangodb.CollectionDocumentCreateOptions{OverwriteMode: stg.overwriteMode.New()}
+
+	for start := 0; start < len(docs); start += arangoDBBatchDocs {
+		batch := docs[start:min(start+arangoDBBatchDocs, len(docs))]
+
+		results, err := col.CreateDocumentsWithOptions(ctx, batch, opts)
+		if err != nil {
+			return ArangoDBError(err)
+		}
+
+		for idx := range batch {
+			if _, err := results.Read(); err != nil {
+				doc, _ := batch[idx].(map[string]interface{})
+
+				return ArangoDBError(fmt.Errorf("document %v of %s: %w", doc["_key"], col.Name(), err))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Upsert will insert each record as a document of the collection of the table, with the primary key of the record
+// as its "_key", over the existing document with the key as set by the overwrite mode. Records without a primary key
+// are added with a generated key. Within a transaction, the records are written when the transaction commits.
+func (stg *ArangoDB) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	if len(records) == 0 {
+		return &proto.UpsertResponse{}, nil
+	}
+
+	docs, err := stg.documents(req.GetTable(), records)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := arangoDBCollection(req.GetTable())
+
+	if tx := stg.tx(ctx); tx != nil {
+		tx.mtx.Lock()
+		defer tx.mtx.Unlock()
+
+		tx.writes = append(tx.writes, arangoDBWrite{collection: collection, docs: docs})
+
+		return &proto.UpsertResponse{UpsertedCount: int64(len(docs))}, nil
+	}
+
+	if err := stg.ensureCollection(ctx, collection); err != nil {
+		return nil, err
+	}
+
+	col, err := stg.db.GetCollection(ctx, collection, &arangodb.GetCollectionOptions{SkipExistCheck: true})
+	if err != nil {
+		return nil, ArangoDBError(err)
+	}
+
+	if err := stg.insert(ctx, col, docs); err != nil {
+		return nil, fmt.Errorf("unable to upsert records: %w", err)
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(docs))}, nil
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *ArangoDB) tx(ctx context.Context) *arangoDBTx {
+	txID, ok := ctx.Value(basicArangoDBTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	arangoTx, _ := tx.(*arangoDBTx)
+
+	return arangoTx
+}
+
+// arangoDBQuery is an AQL query with its bind parameters.
+type arangoDBQuery struct {
+	Query     string
+	BindVars  map[string]interface{}
+	BatchSize int
+}
+
+// cursor will run the query, and return the cursor of its results. The cursor of a query of a collection that does
+// not exist is nil.
+func (stg *ArangoDB) cursor(ctx context.Context, query *arangoDBQuery) (arangodb.Cursor, error) {
+	cursor, err := stg.db.Query(ctx, query.Query, &arangodb.QueryOptions{
+		BindVars:  query.BindVars,
+		BatchSize: query.BatchSize,
+	})
+	if shared.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, ArangoDBError(err)
+	}
+
+	return cursor, nil
+}
+
+// bind will add the value as the next bind parameter of the query, and return its name.
+func (query *arangoDBQuery) bind(value interface{}) string {
+	param := "p" + strconv.Itoa(len(query.BindVars))
+	query.BindVars[param] = value
+
+	return "@" + param
+}
+
+// equals will return the condition that the attribute equals the value. Missing attributes are null in AQL, so a
+// null value matches the documents without the attribute.
+func (query *arangoDBQuery) equals(attribute string, value interface{}) string {
+	return fmt.Sprintf("doc[%s] == %s", query.bind(attribute), query.bind(value))
+}
+
+// requiredConditions will return the conditions that the documents have the required fields.
+func (query *arangoDBQuery) requiredConditions(required map[string]*structpb.Value) []string {
+	fields := make([]string, 0, len(required))
+	for field := range required {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+
+	conditions := make([]string, 0, len(required)+1)
+
+	for _, field := range fields {
+		if list := required[field].GetListValue(); list != nil {
+			conditions = append(conditions, fmt.Sprintf("doc[%s] IN %s", query.bind(field), query.bind(list.AsSlice())))
+		} else {
+			conditions = append(conditions, query.equals(field, required[field].AsInterface()))
+		}
+	}
+
+	return conditions
+}
+
+// arangoDBReadQuery will return the AQL query of the documents of the collection with the required fields, sorted by
+// the "orderBy" attributes of the page and after its "after" values, up to its limit. Missing attributes are null,
+// which sorts first in AQL.
+func arangoDBReadQuery(collection string, required map[string]*structpb.Value, page *readPage) *arangoDBQuery {
+	query := &arangoDBQuery{
+		BindVars:  map[string]interface{}{"@collection": collection},
+		BatchSize: arangoDBBatchDocs,
+	}
+
+	conditions := query.requiredConditions(required)
+
+	var sorts []string
+
+	if page != nil {
+		after := make([]string, 0, len(page.after))
+
+		for idx, attribute := range page.orderBy {
+			sorts = append(sorts, fmt.Sprintf("doc[%s]", query.bind(attribute)))
+
+			if len(page.after) == 0 {
+				continue
+			}
+
+			conjunction := make([]string, 0, idx+1)
+			for prev := 0; prev < idx; prev++ {
+				conjunction = append(conjunction, query.equals(page.orderBy[prev], page.after[prev]))
+			}
+
+			conjunction = append(conjunction, fmt.Sprintf("doc[%s] > %s", query.bind(attribute),
+				query.bind(page.after[idx])))
+
+			after = append(after, "("+strings.Join(conjunction, " AND ")+")")
+		}
+
+		if len(after) > 0 {
+			conditions = append(conditions, "("+strings.Join(after, " OR ")+")")
+		}
+	}
+
+	query.Query = "FOR doc IN @@collection"
+	if len(conditions) > 0 {
+		query.Query += " FILTER " + strings.Join(conditions, " AND ")
+	}
+
+	if len(sorts) > 0 {
+		query.Query += " SORT " + strings.Join(sorts, ", ")
+	}
+
+	if page != nil && page.limit > 0 {
+		query.Query += " LIMIT " + strconv.Itoa(page.limit)
+	}
+
+	query.Query += ` RETURN UNSET(doc, "_key", "_id", "_rev")`
+
+	return query
+}
+
+// arangoDBCountQuery will return the AQL query that counts the documents of the collection with the required fields.
+func arangoDBCountQuery(collection string, required map[string]*structpb.Value) *arangoDBQuery {
+	query := &arangoDBQuery{BindVars: map[string]interface{}{"@collection": collection}, BatchSize: 1}
+
+	conditions := query.requiredConditions(required)
+
+	query.Query = "FOR doc IN @@collection"
+	if len(conditions) > 0 {
+		query.Query += " FILTER " + strings.Join(conditions, " AND ")
+	}
+
+	query.Query += " COLLECT WITH COUNT INTO length RETURN length"
+
+	return query
+}
+
+// Read will return the documents of the collection of the table that match the required fields on the request, in
+// the page requested by the options of the request, if any. The required fields and the page are translated to the
+// FILTER, SORT, and LIMIT of an AQL query, and the results are read in batches from its cursor.
+func (stg *ArangoDB) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	query := arangoDBReadQuery(arangoDBCollection(req.GetTable()), req.GetRequired().GetFields(), page)
+
+	cursor, err := stg.cursor(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read records: %w", err)
+	} else if cursor == nil {
+		return &proto.ReadResponse{}, nil
+	}
+
+	defer cursor.Close()
+
+	out := new(proto.ReadResponse)
+
+	for {
+		var doc map[string]interface{}
+
+		if _, err := cursor.ReadDocument(ctx, &doc); shared.IsNoMoreDocuments(err) {
+			return out, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read records: %w", ArangoDBError(err))
+		}
+
+		record, err := structpb.NewStruct(doc)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert record: %w", err)
+		}
+
+		out.Records = append(out.Records, record)
+	}
+}
+
+// Count will return the number of documents of the collection that match the required fields, with an AQL query
+// that collects them with "COLLECT WITH COUNT".
+func (stg *ArangoDB) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	query := arangoDBCountQuery(arangoDBCollection(req.GetTable()), req.GetRequired().GetFields())
+
+	cursor, err := stg.cursor(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("unable to count records: %w", err)
+	} else if cursor == nil {
+		return &proto.CountResponse{}, nil
+	}
+
+	defer cursor.Close()
+
+	rsp := new(proto.CountResponse)
+
+	if _, err := cursor.ReadDocument(ctx, &rsp.Count); err != nil && !shared.IsNoMoreDocuments(err) {
+		return nil, fmt.Errorf("unable to count records: %w", ArangoDBError(err))
+	}
+
+	return rsp, nil
+}
+
+// Truncate will remove every document of the collections of the tables. The collections are kept, with their
+// indexes.
+func (stg *ArangoDB) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	var deleted int32
+
+	for _, table := range req.GetTables() {
+		col, err := stg.db.GetCollection(ctx, arangoDBCollection(table), &arangodb.GetCollectionOptions{
+			SkipExistCheck: true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error truncating table %s: %w", table, ArangoDBError(err))
+		}
+
+		count, err := col.Count(ctx)
+		if shared.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error truncating table %s: %w", table, ArangoDBError(err))
+		}
+
+		if err := col.Truncate(ctx); err != nil {
+			return nil, fmt.Errorf("error truncating table %s: %w", table, ArangoDBError(err))
+		}
+
+		deleted += int32(count)
+	}
+
+	return &proto.TruncateResponse{DeletedCount: deleted}, nil
+}
+
+// ListTables will return the document collections of the database, with the size in bytes of their documents.
+// System collections, which start with "_", are not listed.
+func (stg *ArangoDB) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	collections, err := stg.db.Collections(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tables: %w", ArangoDBError(err))
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+
+	for _, col := range collections {
+		if strings.HasPrefix(col.Name(), "_") {
+			continue
+		}
+
+		figures, err := col.Statistics(ctx, false)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list tables: %w", ArangoDBError(err))
+		}
+
+		rsp.TableSet[col.Name()] = &proto.Table{Size: figures.Figures.DocumentsSize}
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will return the primary key field of each table.
+func (stg *ArangoDB) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	tables, err := stg.ListTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+
+	for table := range tables.GetTableSet() {
+		rsp.PKSet[table] = &proto.PrimaryKeys{List: []string{stg.tablePrimaryKey(table)}}
+	}
+
+	return rsp, nil
+}
+
+// commit will write the upserts of the transaction in a stream transaction on their collections, which is aborted
+// if any of the upserts fails. Collections can not be created in a stream transaction, so they are created first.
+func (stg *ArangoDB) commit(ctx context.Context, writes []arangoDBWrite) error {
+	if len(writes) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+
+	var collections []string
+
+	for _, write := range writes {
+		if seen[write.collection] {
+			continue
+		}
+
+		seen[write.collection] = true
+		collections = append(collections, write.collection)
+
+		if err := stg.ensureCollection(ctx, write.collection); err != nil {
+			return err
+		}
+	}
+
+	trx, err := stg.db.BeginTransaction(ctx, arangodb.TransactionCollections{Write: collections}, nil)
+	if err != nil {
+		return ArangoDBError(err)
+	}
+
+	for _, write := range writes {
+		col, err := trx.GetCollection(ctx, write.collection, &arangodb.GetCollectionOptions{SkipExistCheck: true})
+		if err == nil {
+			err = stg.insert(ctx, col, write.docs)
+		}
+
+		if err != nil {
+			_ = trx.Abort(ctx, nil)
+
+			return err
+		}
+	}
+
+	if err := trx.Commit(ctx, nil); err != nil {
+		return ArangoDBError(err)
+	}
+
+	return nil
+}
+
+// StartTx will start a transaction. The records of the functions sent to the transaction are buffered, and written
+// in an ArangoDB stream transaction when the transaction commits, so that they are written atomically. Reads in the
+// transaction do not see its buffered records.
+func (stg *ArangoDB) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+	tx := new(arangoDBTx)
+
+	stg.activeTx.Store(txnID, tx)
+
+	arangoCtx := context.WithValue(ctx, basicArangoDBTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+
+		var err error
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(arangoCtx, stg)
+		}
+
+		if err != nil {
+			<-txn.commit
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit {
+			if err = stg.commit(ctx, tx.writes); err != nil {
+				err = fmt.Errorf("unable to commit transaction: %w", err)
+			}
+		}
+
+		txn.done <- err
+	}()
+
+	return txn, nil
+}
@@ -0,0 +1,493 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// arangoDBServer is an in-memory ArangoDB server with the documents of each collection, keyed by their keys. The
+// writes of a stream transaction are applied when it commits. Cursors return every document of the collection of
+// the query, two per batch.
+type arangoDBServer struct {
+	addr        string
+	mtx         sync.Mutex
+	collections map[string]map[string]map[string]interface{}
+	pending     map[string][]func()
+	cursors     map[string][]interface{}
+	aborted     int
+}
+
+// arangoDBReply will write the status and the JSON body of a response of the server.
+func arangoDBReply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// arangoDBNotFound will write the response to a request of a collection that does not exist.
+func arangoDBNotFound(w http.ResponseWriter) {
+	arangoDBReply(w, http.StatusNotFound, map[string]interface{}{"error": true, "code": 404, "errorNum": 1203,
+		"errorMessage": "collection or view not found"})
+}
+
+func (srv *arangoDBServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	if user, password, ok := r.BasicAuth(); !ok || user != "root" || password != "secret" {
+		arangoDBReply(w, http.StatusUnauthorized, map[string]interface{}{"error": true, "code": 401, "errorNum": 11,
+			"errorMessage": "not authorized to execute this request"})
+
+		return
+	}
+
+	var body interface{}
+
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	path := strings.TrimPrefix(r.URL.Path, "/_db/shop/_api/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "collection" && r.Method == http.MethodPost:
+		name, _ := body.(map[string]interface{})["name"].(string)
+		if _, ok := srv.collections[name]; ok {
+			arangoDBReply(w, http.StatusConflict, map[string]interface{}{"error": true, "code": 409,
+				"errorNum": 1207, "errorMessage": "duplicate name"})
+
+			return
+		}
+
+		srv.collections[name] = make(map[string]map[string]interface{})
+		arangoDBReply(w, http.StatusOK, map[string]interface{}{"name": name})
+	case path == "collection":
+		result := []interface{}{map[string]interface{}{"name": "_graphs", "isSystem": true}}
+		for name := range srv.collections {
+			result = append(result, map[string]interface{}{"name": name})
+		}
+
+		arangoDBReply(w, http.StatusOK, map[string]interface{}{"result": result})
+	case parts[0] == "collection":
+		docs, ok := srv.collections[parts[1]]
+		if !ok {
+			arangoDBNotFound(w)
+
+			return
+		}
+
+		switch parts[2] {
+		case "count":
+			arangoDBReply(w, http.StatusOK, map[string]interface{}{"count": len(docs)})
+		case "truncate":
+			srv.collections[parts[1]] = make(map[string]map[string]interface{})
+			arangoDBReply(w, http.StatusOK, map[string]interface{}{"name": parts[1]})
+		case "figures":
+			arangoDBReply(w, http.StatusOK, map[string]interface{}{"figures": map[string]interface{}{
+				"documentsSize": len(docs) * 100,
+			}})
+		}
+	case parts[0] == "document":
+		srv.insert(w, r, parts[1], body.([]interface{}))
+	case path == "cursor":
+		query, _ := body.(map[string]interface{})
+		collection, _ := query["bindVars"].(map[string]interface{})["@collection"].(string)
+
+		if _, ok := srv.collections[collection]; !ok {
+			arangoDBNotFound(w)
+
+			return
+		}
+
+		keys := make([]string, 0, len(srv.collections[collection]))
+		for key := range srv.collections[collection] {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		var result []interface{}
+		for _, key := range keys {
+			doc := make(map[string]interface{})
+			for field, value := range srv.collections[collection][key] {
+				if !strings.HasPrefix(field, "_") {
+					doc[field] = value
+				}
+			}
+
+			result = append(result, doc)
+		}
+
+		// Counts are not filtered.
+		if strings.Contains(query["query"].(string), "COLLECT WITH COUNT") {
+			result = []interface{}{len(result)}
+		}
+
+		id := strconv.Itoa(len(srv.cursors) + 1)
+		srv.cursors[id] = result
+		srv.nextBatch(w, http.StatusCreated, id)
+	case parts[0] == "cursor" && r.Method == http.MethodDelete:
+		delete(srv.cursors, parts[1])
+		arangoDBReply(w, http.StatusAccepted, map[string]interface{}{"id": parts[1]})
+	case parts[0] == "cursor":
+		srv.nextBatch(w, http.StatusOK, parts[1])
+	case path == "transaction/begin":
+		id := strconv.Itoa(len(srv.pending) + 1)
+		srv.pending[id] = []func(){}
+
+		arangoDBReply(w, http.StatusCreated, map[string]interface{}{"result": map[string]interface{}{"id": id,
+			"status": "running"}})
+	case parts[0] == "transaction" && r.Method == http.MethodPut:
+		for _, apply := range srv.pending[parts[1]] {
+			apply()
+		}
+
+		arangoDBReply(w, http.StatusOK, map[string]interface{}{"result": map[string]interface{}{"id": parts[1],
+			"status": "committed"}})
+	case parts[0] == "transaction" && r.Method == http.MethodDelete:
+		srv.aborted++
+
+		arangoDBReply(w, http.StatusOK, map[string]interface{}{"result": map[string]interface{}{"id": parts[1],
+			"status": "aborted"}})
+	}
+}
+
+// nextBatch will write the next batch of the cursor, with the ID of the cursor if it has more batches.
+func (srv *arangoDBServer) nextBatch(w http.ResponseWriter, status int, id string) {
+	result := srv.cursors[id]
+
+	batch := result
+	if len(batch) > 2 {
+		batch = batch[:2]
+	}
+
+	srv.cursors[id] = result[len(batch):]
+
+	rsp := map[string]interface{}{"result": batch, "hasMore": len(result) > len(batch)}
+	if len(result) > len(batch) {
+		rsp["id"] = id
+	}
+
+	arangoDBReply(w, status, rsp)
+}
+
+func (srv *arangoDBServer) insert(w http.ResponseWriter, r *http.Request, collection string, docs []interface{}) {
+	if _, ok := srv.collections[collection]; !ok {
+		arangoDBNotFound(w)
+
+		return
+	}
+
+	mode := r.URL.Query().Get("overwriteMode")
+	results := []interface{}{}
+
+	for idx, value := range docs {
+		doc := value.(map[string]interface{})
+
+		key, ok := doc["_key"].(string)
+		if !ok {
+			key = "generated-" + strconv.Itoa(len(srv.collections[collection])+idx)
+		}
+
+		existing, exists := srv.collections[collection][key]
+		if exists && mode == ArangoDBOverwriteConflict {
+			results = append(results, map[string]interface{}{"error": true, "errorNum": 1210,
+				"errorMessage": "unique constraint violated - in index primary of type primary"})
+
+			continue
+		}
+
+		apply := func() {
+			switch {
+			case exists && mode == ArangoDBOverwriteIgnore:
+			case exists && mode == ArangoDBOverwriteUpdate:
+				for field, value := range doc {
+					existing[field] = value
+				}
+			default:
+				srv.collections[collection][key] = doc
+			}
+		}
+
+		if trx := r.Header.Get("x-arango-trx-id"); trx != "" {
+			srv.pending[trx] = append(srv.pending[trx], apply)
+		} else {
+			apply()
+		}
+
+		results = append(results, map[string]interface{}{"_key": key, "_id": collection + "/" + key})
+	}
+
+	arangoDBReply(w, http.StatusAccepted, results)
+}
+
+func newTestArangoDB(t *testing.T, params string) (*ArangoDB, *arangoDBServer) {
+	t.Helper()
+
+	srv := &arangoDBServer{
+		collections: make(map[string]map[string]map[string]interface{}),
+		pending:     make(map[string][]func()),
+		cursors:     make(map[string][]interface{}),
+	}
+
+	server := httptest.NewServer(srv)
+	t.Cleanup(server.Close)
+
+	srv.addr = server.Listener.Addr().String()
+
+	stg, err := NewArangoDB(context.Background(), "arangodb://root:secret@"+srv.addr+"/shop"+params)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	return stg, srv
+}
+
+func TestArangoDB(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	upsert := func(ctx context.Context, stg Storage, table string, records ...map[string]interface{}) error {
+		data, _ := json.Marshal(records)
+		_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: table, Data: data})
+
+		return err
+	}
+
+	t.Run("overwrite modes", func(t *testing.T) {
+		t.Parallel()
+
+		for mode, exp := range map[string]map[string]interface{}{
+			ArangoDBOverwriteReplace: {"_key": "a", "id": "a", "size": 2.0},
+			ArangoDBOverwriteUpdate:  {"_key": "a", "id": "a", "size": 2.0, "side": "buy"},
+			ArangoDBOverwriteIgnore:  {"_key": "a", "id": "a", "size": 1.0, "side": "buy"},
+		} {
+			stg, srv := newTestArangoDB(t, "?overwriteMode="+mode)
+
+			for _, record := range []map[string]interface{}{
+				{"id": "a", "size": 1, "side": "buy"}, {"id": "a", "size": 2},
+			} {
+				if err := upsert(ctx, stg, "orders", record); err != nil {
+					t.Fatalf("failed to upsert with %s: %v", mode, err)
+				}
+			}
+
+			if got := srv.collections["orders"]["a"]; !reflect.DeepEqual(got, exp) {
+				t.Fatalf("expected document %v with %s, got %v", exp, mode, got)
+			}
+		}
+
+		stg, _ := newTestArangoDB(t, "?overwriteMode=conflict")
+
+		if err := upsert(ctx, stg, "orders", map[string]interface{}{"id": "a"}); err != nil {
+			t.Fatalf("failed to upsert: %v", err)
+		}
+
+		err := upsert(ctx, stg, "orders", map[string]interface{}{"id": "a"})
+		if !errors.Is(err, ErrArangoDB) || !strings.Contains(err.Error(), "unique constraint violated") {
+			t.Fatalf("expected error %v with the conflict, got %v", ErrArangoDB, err)
+		}
+	})
+
+	t.Run("read", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestArangoDB(t, "?primaryKey.1min%20candles=time")
+
+		records := make([]map[string]interface{}, 0, 5)
+		for idx := 0; idx < 5; idx++ {
+			records = append(records, map[string]interface{}{"time": idx, "close": 1.5})
+		}
+
+		if err := upsert(ctx, stg, "1min candles", records...); err != nil {
+			t.Fatalf("failed to upsert: %v", err)
+		}
+
+		if _, ok := srv.collections["c_1min_candles"]["4"]; !ok {
+			t.Fatalf("expected the candles to be keyed by time in c_1min_candles, got %v", srv.collections)
+		}
+
+		rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "1min candles"})
+		if err != nil || len(rsp.Records) != 5 || !reflect.DeepEqual(rsp.Records[4].AsMap(),
+			map[string]interface{}{"time": 4.0, "close": 1.5}) {
+			t.Fatalf("expected every batch of the cursor, got %v: %v", rsp, err)
+		}
+
+		if rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "missing"}); err != nil || len(rsp.Records) != 0 {
+			t.Fatalf("expected no records of a missing collection, got %v: %v", rsp, err)
+		}
+
+		if rsp, err := stg.Count(ctx, &proto.CountRequest{Table: "1min candles"}); err != nil || rsp.GetCount() != 5 {
+			t.Fatalf("expected 5 candles to be counted, got %v: %v", rsp, err)
+		}
+
+		if rsp, err := stg.Count(ctx, &proto.CountRequest{Table: "missing"}); err != nil || rsp.GetCount() != 0 {
+			t.Fatalf("expected no records of a missing collection to be counted, got %v: %v", rsp, err)
+		}
+
+		required, _ := structpb.NewStruct(map[string]interface{}{"side": []interface{}{"buy"}, "product": "BTC",
+			"note": nil})
+		options, _ := structpb.NewStruct(map[string]interface{}{"orderBy": []interface{}{"time", "id"},
+			"after": []interface{}{1, "a"}, "limit": 10})
+
+		page, err := parseReadPage(&proto.ReadRequest{Options: options})
+		if err != nil {
+			t.Fatalf("failed to parse page: %v", err)
+		}
+
+		query := arangoDBReadQuery("orders", required.GetFields(), page)
+
+		exp := "FOR doc IN @@collection FILTER doc[@p1] == @p2 AND doc[@p3] == @p4 AND doc[@p5] IN @p6 AND " +
+			"((doc[@p8] > @p9) OR (doc[@p11] == @p12 AND doc[@p13] > @p14)) SORT doc[@p7], doc[@p10] LIMIT 10 " +
+			`RETURN UNSET(doc, "_key", "_id", "_rev")`
+		if query.Query != exp {
+			t.Fatalf("expected query %q, got %q", exp, query.Query)
+		}
+
+		if query.BindVars["p1"] != "note" || query.BindVars["p2"] != nil || query.BindVars["p14"] != "a" ||
+			!reflect.DeepEqual(query.BindVars["p6"], []interface{}{"buy"}) {
+			t.Fatalf("unexpected bind parameters %v", query.BindVars)
+		}
+
+		count := arangoDBCountQuery("orders", required.GetFields())
+
+		exp = "FOR doc IN @@collection FILTER doc[@p1] == @p2 AND doc[@p3] == @p4 AND doc[@p5] IN @p6 " +
+			"COLLECT WITH COUNT INTO length RETURN length"
+		if count.Query != exp {
+			t.Fatalf("expected query %q, got %q", exp, count.Query)
+		}
+	})
+
+	t.Run("truncate and list", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestArangoDB(t, "")
+
+		if err := upsert(ctx, stg, "products", map[string]interface{}{"id": "a/b"},
+			map[string]interface{}{"id": 1}); err != nil {
+			t.Fatalf("failed to upsert: %v", err)
+		}
+
+		if err := upsert(ctx, stg, "accounts", map[string]interface{}{"name": "no key"}); err != nil {
+			t.Fatalf("failed to upsert: %v", err)
+		}
+
+		if _, ok := srv.collections["products"]["a%2Fb"]; !ok {
+			t.Fatalf("expected the key to be percent-encoded, got %v", srv.collections["products"])
+		}
+
+		tables, err := stg.ListTables(ctx)
+		if err != nil || len(tables.TableSet) != 2 || tables.TableSet["products"].Size != 200 {
+			t.Fatalf("expected both tables with their sizes, got %v: %v", tables, err)
+		}
+
+		pks, err := stg.ListPrimaryKeys(ctx)
+		if err != nil || !reflect.DeepEqual(pks.PKSet["accounts"].List, []string{"id"}) {
+			t.Fatalf("expected the primary keys of the tables, got %v: %v", pks, err)
+		}
+
+		rsp, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"products", "missing"}})
+		if err != nil || rsp.DeletedCount != 2 || len(srv.collections["products"]) != 0 {
+			t.Fatalf("expected the products to be deleted, got %v: %v", rsp, err)
+		}
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		t.Parallel()
+
+		for _, commit := range []bool{true, false} {
+			stg, srv := newTestArangoDB(t, "")
+
+			txn, err := stg.StartTx(ctx)
+			if err != nil {
+				t.Fatalf("failed to start transaction: %v", err)
+			}
+
+			txn.Send(func(ctx context.Context, stg Storage) error {
+				return upsert(ctx, stg, "products", map[string]interface{}{"id": "a"},
+					map[string]interface{}{"id": "b"})
+			})
+
+			if commit {
+				err = txn.Commit()
+			} else {
+				err = txn.Rollback()
+			}
+
+			if err != nil {
+				t.Fatalf("failed to end transaction: %v", err)
+			}
+
+			if (len(srv.collections["products"]) == 2) != commit || (len(srv.pending) == 1) != commit {
+				t.Fatalf("expected the records to be written in a stream transaction on commit, got %v",
+					srv.collections)
+			}
+		}
+
+		stg, srv := newTestArangoDB(t, "?overwriteMode=conflict")
+
+		if err := upsert(ctx, stg, "products", map[string]interface{}{"id": "b"}); err != nil {
+			t.Fatalf("failed to upsert: %v", err)
+		}
+
+		txn, _ := stg.StartTx(ctx)
+		txn.Send(func(ctx context.Context, stg Storage) error {
+			return upsert(ctx, stg, "products", map[string]interface{}{"id": "a"}, map[string]interface{}{"id": "b"})
+		})
+
+		if err := txn.Commit(); !errors.Is(err, ErrArangoDB) || srv.aborted != 1 {
+			t.Fatalf("expected the stream transaction to be aborted with error %v, got %v", ErrArangoDB, err)
+		}
+
+		if _, ok := srv.collections["products"]["a"]; ok {
+			t.Fatalf("expected no writes of the aborted transaction, got %v", srv.collections["products"])
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestArangoDB(t, "")
+
+		data, _ := json.Marshal([]map[string]interface{}{{"id": []interface{}{1}}})
+		if _, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "products", Data: data}); !errors.Is(err,
+			ErrArangoDBPrimaryKey) {
+			t.Fatalf("expected error %v, got %v", ErrArangoDBPrimaryKey, err)
+		}
+
+		unauthorized, err := NewArangoDB(ctx, "arangodb://root:other@"+srv.addr+"/shop")
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+
+		if _, err := unauthorized.ListTables(ctx); !errors.Is(err, ErrArangoDB) || !strings.Contains(err.Error(),
+			"not authorized to execute this request") {
+			t.Fatalf("expected error %v with the message of the server, got %v", ErrArangoDB, err)
+		}
+
+		for _, dns := range []string{"arangodb:///shop", "arangodb://db1/a/b", "arangodb://db1?overwriteMode=merge"} {
+			if _, err := NewArangoDB(ctx, dns); !errors.Is(err, ErrDNSNotSupported) {
+				t.Fatalf("expected error %v for %s, got %v", ErrDNSNotSupported, dns, err)
+			}
+		}
+	})
+}
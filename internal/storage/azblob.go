@@ -0,0 +1,308 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/alpine-hodler/gidari/internal/compliance"
+)
+
+const (
+	azblobScheme = "azblob"
+
+	// azblobSASParam is the object storage location parameter for a shared access signature token of the container,
+	// URL encoded, e.g. "sas=sv%3D2021-08-06%26sp%3Drwdl%26sig%3D...". The default is the "AZURE_STORAGE_SAS_TOKEN"
+	// environment variable. Without a token, requests are authorized with the default Azure credential.
+	azblobSASParam = "sas"
+
+	// azblobClientIDParam is the object storage location parameter for the client ID of a user-assigned managed
+	// identity. Without it, requests are authorized with the default Azure credential.
+	azblobClientIDParam = "clientID"
+
+	// azblobEndpointParam is the object storage location parameter for the endpoint of the storage account, e.g. an
+	// Azurite emulator at "http://azurite:10000/devstoreaccount1".
+	azblobEndpointParam = "endpoint"
+
+	// azblobBlockSizeParam is the object storage location parameter for the size in bytes of the blocks of large
+	// uploads, e.g. "blockSize=16777216". Objects larger than a block are uploaded in blocks.
+	azblobBlockSizeParam = "blockSize"
+
+	// azblobConcurrencyParam is the object storage location parameter for the number of blocks of an upload that are
+	// uploaded at the same time, e.g. "concurrency=8".
+	azblobConcurrencyParam = "concurrency"
+
+	azblobSASEnv = "AZURE_STORAGE_SAS_TOKEN"
+
+	azblobDefaultBlockSize   = 8 << 20
+	azblobDefaultConcurrency = 4
+
+	// azblobMinBlockSize and azblobMaxBlockSize are the smallest block that the SDK uploads, and the largest block
+	// that the Blob service allows.
+	azblobMinBlockSize = 1 << 20
+	azblobMaxBlockSize = 4000 << 20
+)
+
+// azblobObjectStore is an object store on an Azure Blob Storage container, where each key is prefixed with the path
+// of the location and written as a block blob.
+type azblobObjectStore struct {
+	// container is the URL of the container, e.g. "https://<account>.blob.core.windows.net/<container>".
+	container string
+	prefix    string
+
+	// blockSize is the size of the blocks of large uploads, and concurrency is the number of blocks uploaded at the
+	// same time.
+	blockSize   int
+	concurrency int
+
+	// sas is the shared access signature of the container. If it is empty, requests are authorized with the
+	// credential, which is the default Azure credential or the managed identity of the "clientID" parameter.
+	sas        string
+	credential azcore.TokenCredential
+	transport  policy.Transporter
+
+	// The client of the container is created with the first request.
+	once   sync.Once
+	client *container.Client
+	err    error
+}
+
+func newAzblobObjectStore(uri *url.URL) (*azblobObjectStore, error) {
+	containerName, prefix, _ := strings.Cut(strings.Trim(uri.Path, "/"), "/")
+	if uri.Host == "" || containerName == "" {
+		return nil, UnsupportedObjectStoreError(uri.Redacted())
+	}
+
+	params := uri.Query()
+	store := &azblobObjectStore{
+		container: fmt.Sprintf("https://%s.blob.core.windows.net/%s", uri.Host, url.PathEscape(containerName)),
+		prefix:    strings.Trim(prefix, "/"),
+		transport: compliance.HTTPClient(),
+
+		blockSize:   azblobDefaultBlockSize,
+		concurrency: azblobDefaultConcurrency,
+	}
+
+	if endpoint := strings.TrimSuffix(params.Get(azblobEndpointParam), "/"); endpoint != "" {
+		store.container = endpoint + "/" + url.PathEscape(containerName)
+	}
+
+	if blockSize := params.Get(azblobBlockSizeParam); blockSize != "" {
+		size, err := strconv.Atoi(blockSize)
+		if err != nil || size < azblobMinBlockSize || size > azblobMaxBlockSize {
+			return nil, InvalidObjectStoreOptionError(azblobBlockSizeParam, blockSize,
+				fmt.Sprintf("must be an integer from %d to %d bytes", azblobMinBlockSize, azblobMaxBlockSize))
+		}
+
+		store.blockSize = size
+	}
+
+	if concurrency := params.Get(azblobConcurrencyParam); concurrency != "" {
+		count, err := parseUploadConcurrency(concurrency)
+		if err != nil {
+			return nil, err
+		}
+
+		store.concurrency = count
+	}
+
+	sas := params.Get(azblobSASParam)
+	if sas == "" {
+		sas = os.Getenv(azblobSASEnv)
+	}
+
+	if sas != "" {
+		values, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil || !values.Has("sig") {
+			// The token is a secret, so it is not in the error.
+			return nil, InvalidObjectStoreOptionError(azblobSASParam, "...", "must be a shared access signature")
+		}
+
+		store.sas = values.Encode()
+
+		return store, nil
+	}
+
+	clientOptions := azcore.ClientOptions{Transport: store.transport}
+
+	var err error
+	if clientID := params.Get(azblobClientIDParam); clientID != "" {
+		store.credential, err = azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{
+			ClientOptions: clientOptions,
+			ID:            azidentity.ClientID(clientID),
+		})
+	} else {
+		store.credential, err = azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+			ClientOptions: clientOptions,
+		})
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFetchingIAMToken, err)
+	}
+
+	return store, nil
+}
+
+// containerClient will return the client of the container, authorized with the shared access signature or the
+// credential, and created with the first request.
+func (store *azblobObjectStore) containerClient() (*container.Client, error) {
+	store.once.Do(func() {
+		options := &container.ClientOptions{ClientOptions: azcore.ClientOptions{Transport: store.transport}}
+
+		if store.sas != "" {
+			store.client, store.err = container.NewClientWithNoCredential(store.container+"?"+store.sas, options)
+		} else {
+			store.client, store.err = container.NewClient(store.container, store.credential, options)
+		}
+	})
+
+	return store.client, store.err
+}
+
+// blobName will return the name of the blob at the key.
+func (store *azblobObjectStore) blobName(key string) string {
+	return path.Join(store.prefix, key)
+}
+
+// Put will upload the object to the key, in blocks if it is larger than the block size.
+func (store *azblobObjectStore) Put(ctx context.Context, key string, data []byte) error {
+	return store.Upload(ctx, key, bytes.NewReader(data))
+}
+
+// Upload will upload the object read from the reader to the key as a block blob. An object that fits in a single
+// block is uploaded with a single request, and larger objects are uploaded in blocks by the SDK, up to "concurrency"
+// blocks at the same time, and committed with the list of their blocks. Every request is verified by the Blob service
+// against the CRC64 checksum of its body. The blocks of an upload that fails are not committed, and are discarded by
+// the Blob service.
+func (store *azblobObjectStore) Upload(ctx context.Context, key string, r io.Reader) error {
+	client, err := store.containerClient()
+	if err != nil {
+		return ObjectStoreError(http.MethodPut, key, err)
+	}
+
+	blockBlob := client.NewBlockBlobClient(store.blobName(key))
+
+	block, last, err := readPart(r, store.blockSize)
+	if err != nil {
+		return ObjectStoreError(http.MethodPut, key, err)
+	}
+
+	if last {
+		_, err = blockBlob.Upload(ctx, nopReadSeekCloser{bytes.NewReader(block)}, &blockblob.UploadOptions{
+			TransactionalValidation: blob.TransferValidationTypeComputeCRC64(),
+		})
+	} else {
+		_, err = blockBlob.UploadStream(ctx, io.MultiReader(bytes.NewReader(block), r), &blockblob.UploadStreamOptions{
+			BlockSize:               int64(store.blockSize),
+			Concurrency:             store.concurrency,
+			TransactionalValidation: blob.TransferValidationTypeComputeCRC64(),
+		})
+	}
+
+	if err != nil {
+		return ObjectStoreError(http.MethodPut, key, err)
+	}
+
+	return nil
+}
+
+// nopReadSeekCloser is a reader of a single block upload, which the SDK closes once it is sent.
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+// Close implements io.Closer.
+func (nopReadSeekCloser) Close() error { return nil }
+
+// Get will download the blob at the key.
+func (store *azblobObjectStore) Get(ctx context.Context, key string) ([]byte, error) {
+	client, err := store.containerClient()
+	if err != nil {
+		return nil, ObjectStoreError(http.MethodGet, key, err)
+	}
+
+	rsp, err := client.NewBlobClient(store.blobName(key)).DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, ObjectStoreError(http.MethodGet, key, err)
+	}
+
+	defer rsp.Body.Close()
+
+	data, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, ObjectStoreError(http.MethodGet, key, err)
+	}
+
+	return data, nil
+}
+
+// Delete will delete the blob at the key. Deleting a key without a blob is not an error.
+func (store *azblobObjectStore) Delete(ctx context.Context, key string) error {
+	client, err := store.containerClient()
+	if err != nil {
+		return ObjectStoreError(http.MethodDelete, key, err)
+	}
+
+	_, err = client.NewBlobClient(store.blobName(key)).Delete(ctx, nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return ObjectStoreError(http.MethodDelete, key, err)
+	}
+
+	return nil
+}
+
+// List will return the keys of the blobs under the prefix of the location, relative to the prefix.
+func (store *azblobObjectStore) List(ctx context.Context) ([]string, error) {
+	var keys []string
+
+	prefix := store.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	client, err := store.containerClient()
+	if err != nil {
+		return nil, ObjectStoreError(http.MethodGet, prefix, err)
+	}
+
+	pager := client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &prefix})
+
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, ObjectStoreError(http.MethodGet, prefix, err)
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			keys = append(keys, strings.TrimPrefix(*item.Name, prefix))
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
@@ -0,0 +1,320 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/alpine-hodler/gidari/proto"
+)
+
+// azblobServer is a Blob service for the "container" container, which lists a single blob on each page. Requests are
+// authorized with the "sig=secret" shared access signature or the "token" bearer token, and uploads must have a
+// CRC64 checksum.
+type azblobServer struct {
+	mtx    sync.Mutex
+	blobs  map[string][]byte
+	blocks map[string][]byte
+	puts   []string
+}
+
+// azblobListResult is the response of the Blob service "List Blobs" operation.
+type azblobListResult struct {
+	XMLName xml.Name `xml:"EnumerationResults"`
+	Blobs   struct {
+		Blob []struct {
+			Name string `xml:"Name"`
+		} `xml:"Blob"`
+	} `xml:"Blobs"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// azblobTestCredential is an Azure credential that counts the tokens that it issues.
+type azblobTestCredential struct {
+	fetched int32
+}
+
+func (cred *azblobTestCredential) GetToken(_ context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken,
+	error,
+) {
+	if !reflect.DeepEqual(opts.Scopes, []string{"https://storage.azure.com/.default"}) {
+		return azcore.AccessToken{}, errors.New("unexpected scopes")
+	}
+
+	atomic.AddInt32(&cred.fetched, 1)
+
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func newAzblobServer(t *testing.T, tls bool) (*azblobServer, *httptest.Server) {
+	t.Helper()
+
+	srv := &azblobServer{blobs: make(map[string][]byte), blocks: make(map[string][]byte)}
+
+	server := httptest.NewUnstartedServer(srv)
+	if tls {
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+
+	t.Cleanup(server.Close)
+
+	return srv, server
+}
+
+// azblobError will write the error of the Blob service with the code.
+func azblobError(w http.ResponseWriter, code string, status int) {
+	w.Header().Set("x-ms-error-code", code)
+	http.Error(w, code, status)
+}
+
+func (srv *azblobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if r.Header.Get("x-ms-version") == "" ||
+		(query.Get("sig") != "secret" && r.Header.Get("Authorization") != "Bearer token") {
+		azblobError(w, "AuthenticationFailed", http.StatusForbidden)
+
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+
+	if r.Method == http.MethodPut && query.Get("comp") != "blocklist" && r.Header.Get("x-ms-content-crc64") == "" {
+		azblobError(w, "MissingRequiredHeader", http.StatusBadRequest)
+
+		return
+	}
+
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	name, _ := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/devstoreaccount1/container/"))
+
+	switch {
+	case r.Method == http.MethodGet && query.Get("comp") == "list":
+		var names []string
+
+		for name := range srv.blobs {
+			if strings.HasPrefix(name, query.Get("prefix")) && name > query.Get("marker") {
+				names = append(names, name)
+			}
+		}
+
+		sort.Strings(names)
+
+		var result azblobListResult
+		if len(names) > 0 {
+			result.Blobs.Blob = append(result.Blobs.Blob, struct {
+				Name string `xml:"Name"`
+			}{names[0]})
+		}
+
+		if len(names) > 1 {
+			result.NextMarker = names[0]
+		}
+
+		w.Header().Set("Content-Type", "application/xml")
+		_ = xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		srv.puts = append(srv.puts, "block")
+		srv.blocks[query.Get("blockid")] = body
+
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		srv.puts = append(srv.puts, "blocklist")
+
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+
+		_ = xml.Unmarshal(body, &list)
+
+		var blob []byte
+		for _, blockID := range list.Latest {
+			blob = append(blob, srv.blocks[blockID]...)
+		}
+
+		srv.blobs[name] = blob
+
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			azblobError(w, "MissingRequiredHeader", http.StatusBadRequest)
+
+			return
+		}
+
+		srv.puts = append(srv.puts, "blob")
+		srv.blobs[name] = body
+
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet || r.Method == http.MethodDelete:
+		data, ok := srv.blobs[name]
+		if !ok {
+			azblobError(w, "BlobNotFound", http.StatusNotFound)
+
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			delete(srv.blobs, name)
+			w.WriteHeader(http.StatusAccepted)
+
+			return
+		}
+
+		_, _ = w.Write(data)
+	default:
+		azblobError(w, "UnsupportedHttpVerb", http.StatusBadRequest)
+	}
+}
+
+func TestAzblobObjectStore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("blobs", func(t *testing.T) {
+		t.Parallel()
+
+		srv, server := newAzblobServer(t, false)
+
+		store, err := NewObjectStore("azblob://devstoreaccount1/container/archive?sas=sv%3D2021-08-06%26sig%3Dsecret" +
+			"&blockSize=1048576&concurrency=2&endpoint=" + url.QueryEscape(server.URL+"/devstoreaccount1"))
+		if err != nil {
+			t.Fatalf("failed to create object store: %v", err)
+		}
+
+		large := bytes.Repeat([]byte("candles "), 5<<16)
+		if err := store.Put(ctx, "run 1/candles.json", large); err != nil {
+			t.Fatalf("failed to put object: %v", err)
+		}
+
+		if err := store.Put(ctx, "run 2/candles.json", []byte("[]")); err != nil {
+			t.Fatalf("failed to put object: %v", err)
+		}
+
+		// The object larger than a block is uploaded in blocks, committed in order even though they are uploaded
+		// concurrently, and the object of a single block with one request.
+		if !reflect.DeepEqual(srv.puts, []string{"block", "block", "block", "blocklist", "blob"}) {
+			t.Fatalf("unexpected uploads %v", srv.puts)
+		}
+
+		if data, err := store.Get(ctx, "run 1/candles.json"); err != nil || !bytes.Equal(data, large) {
+			t.Fatalf("expected the object, got %d bytes: %v", len(data), err)
+		}
+
+		keys, err := store.List(ctx)
+		if err != nil || !reflect.DeepEqual(keys, []string{"run 1/candles.json", "run 2/candles.json"}) {
+			t.Fatalf("expected every page of keys, got %v: %v", keys, err)
+		}
+
+		for idx := 0; idx < 2; idx++ {
+			if err := store.Delete(ctx, "run 2/candles.json"); err != nil {
+				t.Fatalf("failed to delete object: %v", err)
+			}
+		}
+
+		if _, err := store.Get(ctx, "run 2/candles.json"); !errors.Is(err, ErrObjectStore) ||
+			strings.Contains(err.Error(), "secret") {
+			t.Fatalf("expected error %v without the signature, got %v", ErrObjectStore, err)
+		}
+	})
+
+	t.Run("managed identity", func(t *testing.T) {
+		t.Parallel()
+
+		srv, server := newAzblobServer(t, true)
+
+		store, err := NewObjectStore("azblob://devstoreaccount1/container?clientID=client-1&endpoint=" +
+			url.QueryEscape(server.URL+"/devstoreaccount1"))
+		if err != nil {
+			t.Fatalf("failed to create object store: %v", err)
+		}
+
+		cred := new(azblobTestCredential)
+
+		azblob, _ := store.(*azblobObjectStore)
+		azblob.credential = cred
+		azblob.transport = server.Client()
+
+		for idx := 0; idx < 2; idx++ {
+			if err := store.Put(ctx, "payload", []byte("{}")); err != nil {
+				t.Fatalf("failed to put object: %v", err)
+			}
+		}
+
+		if count := atomic.LoadInt32(&cred.fetched); count != 1 || string(srv.blobs["payload"]) != "{}" {
+			t.Fatalf("expected the cached token to authorize the uploads, got %d tokens", count)
+		}
+	})
+
+	t.Run("options", func(t *testing.T) {
+		t.Parallel()
+
+		for _, location := range []string{"azblob://account", "azblob:///container"} {
+			if _, err := NewObjectStore(location); !errors.Is(err, ErrUnsupportedObjectStore) {
+				t.Fatalf("expected error %v for %q, got %v", ErrUnsupportedObjectStore, location, err)
+			}
+		}
+
+		for _, params := range []string{
+			"blockSize=0", "blockSize=4", "blockSize=abc", "concurrency=0", "sas=sv%3D2021-08-06",
+		} {
+			if _, err := NewObjectStore("azblob://account/container?" + params); !errors.Is(err,
+				ErrInvalidObjectStoreOption) {
+				t.Fatalf("expected error %v for %q, got %v", ErrInvalidObjectStoreOption, params, err)
+			}
+		}
+	})
+
+	t.Run("parquet files", func(t *testing.T) {
+		t.Parallel()
+
+		srv, server := newAzblobServer(t, false)
+
+		svc, err := New(ctx, "azblob://devstoreaccount1/container/lake?sas=sig%3Dsecret&endpoint="+
+			url.QueryEscape(server.URL+"/devstoreaccount1"))
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+
+		if _, err := svc.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(`[{"id": 1}]`)}); err != nil {
+			t.Fatalf("failed to upsert records: %v", err)
+		}
+
+		for name := range srv.blobs {
+			if !strings.HasPrefix(name, "lake/candles/part-") || !strings.HasSuffix(name, parquetExt) {
+				t.Fatalf("unexpected blob %q", name)
+			}
+		}
+
+		rsp, err := svc.Read(ctx, &proto.ReadRequest{Table: "candles"})
+		if err != nil || len(rsp.GetRecords()) != 1 {
+			t.Fatalf("expected the upserted record, got %v: %v", rsp, err)
+		}
+	})
+}
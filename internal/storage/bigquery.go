@@ -0,0 +1,1185 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/apiv1/storagepb"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	bigQueryScheme = "bigquery"
+
+	// bigQueryEndpointParam is the connection string parameter for the BigQuery API endpoint, e.g. an emulator at
+	// "http://bigquery:9050".
+	bigQueryEndpointParam = "endpoint"
+
+	// bigQueryWriteEndpointParam is the connection string parameter for the Storage Write API endpoint, e.g. an
+	// emulator at "http://bigquery:9060".
+	bigQueryWriteEndpointParam = "writeEndpoint"
+
+	// bigQueryLocationParam is the connection string parameter for the location that queries run in, e.g. "EU".
+	bigQueryLocationParam = "location"
+
+	// bigQueryAppendBytes is the size of the rows of each request to append rows to a write stream, below the 10 MB
+	// limit of the Storage Write API.
+	bigQueryAppendBytes = 8 << 20
+
+	// bigQueryMaxSafeInteger is the largest integer that a record number can hold exactly, and so be inferred as an
+	// "INTEGER" column.
+	bigQueryMaxSafeInteger = 1 << 53
+
+	// bigQueryStageExpiry is how long the staging table of a merge is kept by BigQuery if it is not deleted.
+	bigQueryStageExpiry = time.Hour
+)
+
+var ErrBigQuery = fmt.Errorf("bigquery request failed")
+
+// BigQueryError is returned when a request to the BigQuery API or the Storage Write API fails.
+func BigQueryError(op string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrBigQuery, op, err)
+}
+
+// bigQueryTxType is the type of the context key of BigQuery transactions.
+type bigQueryTxType uint8
+
+const (
+	basicBigQueryTxID bigQueryTxType = iota
+)
+
+// bigQueryTx are the records of a transaction by table, written when the transaction commits.
+type bigQueryTx struct {
+	mtx     sync.Mutex
+	tables  []string
+	records map[string][]*structpb.Struct
+}
+
+// BigQuery is a storage device that writes records to the tables of a BigQuery dataset, e.g. for analytics on the
+// web API data. The table of an upsert request is a table of the dataset of the connection string, or
+// "<dataset>.<table>" for a table of another dataset of the project. Records are written with the Storage Write API:
+// they are merged on the primary key of their table from a staging table that they are written to, and appended to
+// tables without one.
+//
+// Tables that do not exist are created with a schema inferred from the records of the first upsert, and columns are
+// added to the schema for new fields. Strings, booleans, and numbers map to "STRING", "BOOLEAN", and "INTEGER" or
+// "FLOAT" columns, and objects and lists map to "JSON" columns.
+type BigQuery struct {
+	project  string
+	dataset  string
+	location string
+	client   *bigquery.Client
+	writer   *managedwriter.Client
+
+	// schemas and keys are the schemas and the primary key columns of the tables that have been written to, keyed
+	// by "<dataset>.<table>".
+	mtx     sync.Mutex
+	schemas map[string]bigquery.Schema
+	keys    map[string][]string
+
+	// activeTx are the transactions that are currently active, keyed by the transaction ID that is added to the
+	// context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewBigQuery will return a BigQuery storage device for the connection string, i.e.
+// "bigquery://<project>/<dataset>[?location=<location>]". Requests are authorized with the application default
+// credentials, e.g. of "gcloud auth application-default login" or of the default service account. Endpoints with the
+// "http" scheme, e.g. emulators, are connected to without TLS or credentials.
+func NewBigQuery(ctx context.Context, connectionURL string) (*BigQuery, error) {
+	uri, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	stg := &BigQuery{
+		project:  uri.Host,
+		dataset:  strings.Trim(uri.Path, "/"),
+		location: uri.Query().Get(bigQueryLocationParam),
+		schemas:  make(map[string]bigquery.Schema),
+		keys:     make(map[string][]string),
+	}
+
+	if stg.project == "" || stg.dataset == "" || strings.Contains(stg.dataset, "/") {
+		return nil, DNSNotSupportedError(connectionURL)
+	}
+
+	endpoint := uri.Query().Get(bigQueryEndpointParam)
+	writeEndpoint := uri.Query().Get(bigQueryWriteEndpointParam)
+
+	var tokens oauth2.TokenSource
+
+	if !strings.HasPrefix(endpoint, "http://") || !strings.HasPrefix(writeEndpoint, "http://") {
+		tokenCtx := context.WithValue(ctx, oauth2.HTTPClient, compliance.HTTPClient())
+		if tokens, err = google.DefaultTokenSource(tokenCtx, bigquery.Scope); err != nil {
+			return nil, BigQueryError("find default credentials", err)
+		}
+	}
+
+	if stg.client, err = bigquery.NewClient(ctx, stg.project, bigQueryAPIOptions(endpoint, tokens)...); err != nil {
+		return nil, BigQueryError("create client", err)
+	}
+
+	writeOpts, err := bigQueryWriteOptions(writeEndpoint, tokens)
+	if err != nil {
+		_ = stg.client.Close()
+
+		return nil, DNSNotSupportedError(connectionURL)
+	}
+
+	// The write client keeps its context for the connections of its streams, which outlive the context of the
+	// constructor.
+	if stg.writer, err = managedwriter.NewClient(context.WithoutCancel(ctx), stg.project, writeOpts...); err != nil {
+		_ = stg.client.Close()
+
+		return nil, BigQueryError("create write client", err)
+	}
+
+	return stg, nil
+}
+
+// bigQueryAPIOptions will return the options of the BigQuery API client for the endpoint, or the default endpoint
+// if it is empty. Requests are made with the compliance transport, and authorized with the token source unless the
+// endpoint has the "http" scheme.
+func bigQueryAPIOptions(endpoint string, tokens oauth2.TokenSource) []option.ClientOption {
+	var opts []option.ClientOption
+
+	if endpoint != "" {
+		// Paths are resolved relative to the endpoint, so it must end with a slash.
+		opts = append(opts, option.WithEndpoint(strings.TrimSuffix(endpoint, "/")+"/"))
+	}
+
+	transport := compliance.Transport()
+	if !strings.HasPrefix(endpoint, "http://") {
+		transport = &oauth2.Transport{Source: tokens, Base: transport}
+	}
+
+	return append(opts, option.WithHTTPClient(&http.Client{Transport: transport}))
+}
+
+// bigQueryWriteOptions will return the options of the Storage Write API client for the endpoint, or the default
+// endpoint if it is empty. Connections use TLS with the compliance configuration, and are authorized with the token
+// source, unless the endpoint has the "http" scheme.
+func bigQueryWriteOptions(endpoint string, tokens oauth2.TokenSource) ([]option.ClientOption, error) {
+	if endpoint == "" {
+		return []option.ClientOption{
+			option.WithTokenSource(tokens),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(credentials.NewTLS(compliance.TLSConfig("")))),
+		}, nil
+	}
+
+	uri, err := url.Parse(endpoint)
+	if err != nil || uri.Host == "" {
+		return nil, fmt.Errorf("invalid write endpoint %q", endpoint)
+	}
+
+	if uri.Scheme == "http" {
+		return []option.ClientOption{
+			option.WithEndpoint(uri.Host),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		}, nil
+	}
+
+	return []option.ClientOption{
+		option.WithEndpoint(uri.Host),
+		option.WithTokenSource(tokens),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(credentials.NewTLS(compliance.TLSConfig(
+			uri.Hostname())))),
+	}, nil
+}
+
+// Close will close the clients of the BigQuery API and the Storage Write API.
+func (stg *BigQuery) Close() {
+	_ = stg.writer.Close()
+	_ = stg.client.Close()
+}
+
+// IsNoSQL returns "false" to indicate that "BigQuery" updates records by the primary key of their table.
+func (stg *BigQuery) IsNoSQL() bool { return false }
+
+// Type implements the storage interface.
+func (stg *BigQuery) Type() uint8 { return BigQueryType }
+
+// tableRef will return the dataset and table of the table of a request.
+func (stg *BigQuery) tableRef(table string) (string, string) {
+	if dataset, name, ok := strings.Cut(table, "."); ok {
+		return dataset, name
+	}
+
+	return stg.dataset, table
+}
+
+// table will return the handle of the table of the dataset.
+func (stg *BigQuery) table(dataset, table string) *bigquery.Table {
+	return stg.client.DatasetInProject(stg.project, dataset).Table(table)
+}
+
+// tableName will return the quoted name of the table in queries.
+func (stg *BigQuery) tableName(dataset, table string) string {
+	return bigQueryQuote(stg.project + "." + dataset + "." + table)
+}
+
+// bigQueryQuote will quote the identifier for a query.
+func bigQueryQuote(name string) string {
+	return "`" + strings.NewReplacer(`\`, `\\`, "`", "\\`").Replace(name) + "`"
+}
+
+// bigQueryNotFound will return true if the error is a response of the BigQuery API for a missing resource.
+func bigQueryNotFound(err error) bool {
+	var apiErr *googleapi.Error
+
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// bigQueryFieldType will return the column type for the value of a record, or an empty string for null values.
+func bigQueryFieldType(value *structpb.Value) bigquery.FieldType {
+	switch kind := value.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		return bigquery.StringFieldType
+	case *structpb.Value_BoolValue:
+		return bigquery.BooleanFieldType
+	case *structpb.Value_NumberValue:
+		if num := kind.NumberValue; num == math.Trunc(num) && math.Abs(num) <= bigQueryMaxSafeInteger {
+			return bigquery.IntegerFieldType
+		}
+
+		return bigquery.FloatFieldType
+	case *structpb.Value_StructValue, *structpb.Value_ListValue:
+		return bigquery.JSONFieldType
+	}
+
+	return ""
+}
+
+// inferBigQueryFields will return the columns for the fields of the records that are not already in the schema,
+// sorted by name. Numbers that are not all integers are "FLOAT" columns, and fields that are only null are
+// "STRING" columns.
+func inferBigQueryFields(schema bigquery.Schema, records []*structpb.Struct) bigquery.Schema {
+	known := make(map[string]bool)
+
+	for _, field := range schema {
+		known[field.Name] = true
+	}
+
+	types := make(map[string]bigquery.FieldType)
+
+	for _, record := range records {
+		for name, value := range record.GetFields() {
+			if known[name] {
+				continue
+			}
+
+			switch fieldType := bigQueryFieldType(value); {
+			case types[name] == "" || types[name] == fieldType:
+				types[name] = fieldType
+			case fieldType == "":
+			case fieldType == bigquery.FloatFieldType && types[name] == bigquery.IntegerFieldType:
+				types[name] = bigquery.FloatFieldType
+			case fieldType == bigquery.IntegerFieldType && types[name] == bigquery.FloatFieldType:
+			default:
+				// Values of different types are stored as JSON.
+				types[name] = bigquery.JSONFieldType
+			}
+		}
+	}
+
+	fields := make(bigquery.Schema, 0, len(types))
+
+	for name, fieldType := range types {
+		if fieldType == "" {
+			fieldType = bigquery.StringFieldType
+		}
+
+		fields = append(fields, &bigquery.FieldSchema{Name: name, Type: fieldType})
+	}
+
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+
+	return fields
+}
+
+// ensureSchema will return the schema and the primary key columns of the table, creating the table or adding columns
+// to it so that it has a column for every field of the records. Tables are created with "id" as the primary key if
+// every record has one.
+func (stg *BigQuery) ensureSchema(ctx context.Context, dataset, table string,
+	records []*structpb.Struct,
+) (bigquery.Schema, []string, error) {
+	stg.mtx.Lock()
+	defer stg.mtx.Unlock()
+
+	key := dataset + "." + table
+	ref := stg.table(dataset, table)
+
+	schema, ok := stg.schemas[key]
+	if !ok {
+		metadata, err := ref.Metadata(ctx)
+
+		switch {
+		case bigQueryNotFound(err):
+			metadata = &bigquery.TableMetadata{Schema: inferBigQueryFields(nil, records)}
+
+			if hasIDs(records) {
+				metadata.TableConstraints = &bigquery.TableConstraints{
+					PrimaryKey: &bigquery.PrimaryKey{Columns: []string{"id"}},
+				}
+			}
+
+			if err := ref.Create(ctx, metadata); err != nil {
+				return nil, nil, BigQueryError("create table "+key, err)
+			}
+		case err != nil:
+			return nil, nil, BigQueryError("get table "+key, err)
+		}
+
+		schema = metadata.Schema
+		stg.schemas[key] = schema
+
+		if metadata.TableConstraints != nil && metadata.TableConstraints.PrimaryKey != nil {
+			stg.keys[key] = metadata.TableConstraints.PrimaryKey.Columns
+		}
+	}
+
+	if fields := inferBigQueryFields(schema, records); len(fields) > 0 {
+		patched := append(append(bigquery.Schema(nil), schema...), fields...)
+
+		if _, err := ref.Update(ctx, bigquery.TableMetadataToUpdate{Schema: patched}, ""); err != nil {
+			return nil, nil, BigQueryError("update table "+key, err)
+		}
+
+		schema = patched
+		stg.schemas[key] = schema
+	}
+
+	return schema, stg.keys[key], nil
+}
+
+// hasIDs will return true if every record has a non-null "id".
+func hasIDs(records []*structpb.Struct) bool {
+	for _, record := range records {
+		if bigQueryFieldType(record.GetFields()["id"]) == "" {
+			return false
+		}
+	}
+
+	return len(records) > 0
+}
+
+// bigQueryDescriptor will return the descriptor of the protocol buffer messages that rows of the schema are written
+// as, and its normalized form for the Storage Write API.
+func bigQueryDescriptor(schema bigquery.Schema) (protoreflect.MessageDescriptor, *descriptorpb.DescriptorProto, error) {
+	tableSchema, err := adapt.BQSchemaToStorageTableSchema(schema)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to convert schema: %w", err)
+	}
+
+	descriptor, err := adapt.StorageSchemaToProto2Descriptor(tableSchema, "root")
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to convert schema: %w", err)
+	}
+
+	message, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, nil, fmt.Errorf("unable to convert schema: unexpected descriptor %T", descriptor)
+	}
+
+	normalized, err := adapt.NormalizeDescriptor(message)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to normalize descriptor: %w", err)
+	}
+
+	return message, normalized, nil
+}
+
+// bigQueryRows will encode the records as protocol buffer messages of the descriptor of the schema. The values of
+// "JSON" columns, and values that are not strings in "STRING" columns, are written as JSON strings.
+func bigQueryRows(schema bigquery.Schema, message protoreflect.MessageDescriptor,
+	records []*structpb.Struct,
+) ([][]byte, error) {
+	types := make(map[string]bigquery.FieldType, len(schema))
+	for _, field := range schema {
+		types[field.Name] = field.Type
+	}
+
+	// Columns that are not valid protocol buffer names have an encoded field name, with the column name as an
+	// option of the field.
+	fields := make(map[string]protoreflect.FieldDescriptor, message.Fields().Len())
+
+	for idx := 0; idx < message.Fields().Len(); idx++ {
+		field := message.Fields().Get(idx)
+
+		name := string(field.Name())
+		if column, ok := protobuf.GetExtension(field.Options(), storagepb.E_ColumnName).(string); ok && column != "" {
+			name = column
+		}
+
+		fields[name] = field
+	}
+
+	rows := make([][]byte, len(records))
+
+	for idx, record := range records {
+		row := dynamicpb.NewMessage(message)
+
+		for name, value := range record.GetFields() {
+			field, ok := fields[name]
+			if !ok || bigQueryFieldType(value) == "" {
+				continue
+			}
+
+			protoValue, err := bigQueryProtoValue(types[name], field, value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to write %s: %w", name, err)
+			}
+
+			row.Set(field, protoValue)
+		}
+
+		data, err := protobuf.Marshal(row)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode row: %w", err)
+		}
+
+		rows[idx] = data
+	}
+
+	return rows, nil
+}
+
+// bigQueryProtoValue will return the value of the field of a row for the value of a record in a column of the type.
+func bigQueryProtoValue(fieldType bigquery.FieldType, field protoreflect.FieldDescriptor,
+	value *structpb.Value,
+) (protoreflect.Value, error) {
+	switch kind := value.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		if field.Kind() == protoreflect.StringKind && fieldType != bigquery.JSONFieldType {
+			return protoreflect.ValueOfString(kind.StringValue), nil
+		}
+	case *structpb.Value_BoolValue:
+		if field.Kind() == protoreflect.BoolKind {
+			return protoreflect.ValueOfBool(kind.BoolValue), nil
+		}
+	case *structpb.Value_NumberValue:
+		switch num := kind.NumberValue; {
+		case field.Kind() == protoreflect.DoubleKind:
+			return protoreflect.ValueOfFloat64(num), nil
+		case field.Kind() == protoreflect.Int64Kind && num == math.Trunc(num):
+			return protoreflect.ValueOfInt64(int64(num)), nil
+		}
+	}
+
+	if field.Kind() != protoreflect.StringKind {
+		return protoreflect.Value{}, fmt.Errorf("unable to convert %v to a %s column", value.AsInterface(), fieldType)
+	}
+
+	data, err := json.Marshal(value.AsInterface())
+	if err != nil {
+		return protoreflect.Value{}, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+	}
+
+	return protoreflect.ValueOfString(string(data)), nil
+}
+
+// Upsert will write the records to the table, creating the table or adding columns to it as needed. The records are
+// merged on the primary key of the table, see "merge", or appended to it if it does not have one. Within a
+// transaction, the records are written when the transaction commits.
+func (stg *BigQuery) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	if len(records) == 0 {
+		return &proto.UpsertResponse{}, nil
+	}
+
+	dataset, table := stg.tableRef(req.GetTable())
+
+	if tx := stg.tx(ctx); tx != nil {
+		tx.mtx.Lock()
+		defer tx.mtx.Unlock()
+
+		key := dataset + "." + table
+		if _, ok := tx.records[key]; !ok {
+			tx.tables = append(tx.tables, key)
+		}
+
+		tx.records[key] = append(tx.records[key], records...)
+	} else if err := stg.write(ctx, dataset, table, records); err != nil {
+		return nil, err
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+}
+
+// write will write the records to the table, merging them on its primary key or appending them if it does not have
+// one.
+func (stg *BigQuery) write(ctx context.Context, dataset, table string, records []*structpb.Struct) error {
+	schema, keys, err := stg.ensureSchema(ctx, dataset, table, records)
+	if err != nil {
+		return fmt.Errorf("unable to update the schema of %s.%s: %w", dataset, table, err)
+	}
+
+	if len(keys) > 0 {
+		return stg.merge(ctx, dataset, table, schema, keys, records)
+	}
+
+	return stg.append(ctx, dataset, table, schema, records)
+}
+
+// merge will write the records to a staging table, and merge the staging table into the table on the primary key
+// columns: rows with the key of a record are updated with the fields of the records, and the other records are
+// inserted. BigQuery fails a merge that matches a row more than once, so only the last record of each key is merged.
+// The staging table is deleted after the merge, and expires after "bigQueryStageExpiry" if that fails.
+func (stg *BigQuery) merge(ctx context.Context, dataset, table string, schema bigquery.Schema, keys []string,
+	records []*structpb.Struct,
+) error {
+	records = lastByKeys(records, keys)
+
+	// The staging table only has the columns of the fields of the records, so that the other columns of the rows
+	// that are updated are kept.
+	present, isKey := make(map[string]bool), make(map[string]bool, len(keys))
+
+	for _, key := range keys {
+		isKey[key] = true
+	}
+
+	for _, record := range records {
+		for name := range record.GetFields() {
+			present[name] = true
+		}
+	}
+
+	var (
+		fields  bigquery.Schema
+		columns []string
+		updates []string
+	)
+
+	for _, field := range schema {
+		if !present[field.Name] {
+			continue
+		}
+
+		fields = append(fields, field)
+		columns = append(columns, bigQueryQuote(field.Name))
+
+		if !isKey[field.Name] {
+			updates = append(updates, bigQueryQuote(field.Name)+" = source."+bigQueryQuote(field.Name))
+		}
+	}
+
+	stage := table + "_gidari_stage_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	metadata := &bigquery.TableMetadata{Schema: fields, ExpirationTime: time.Now().Add(bigQueryStageExpiry)}
+	if err := stg.table(dataset, stage).Create(ctx, metadata); err != nil {
+		return fmt.Errorf("unable to create staging table: %w", BigQueryError("create table "+stage, err))
+	}
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+
+		// Deleting the staging table is best effort, since it expires.
+		_ = stg.table(dataset, stage).Delete(ctx)
+	}()
+
+	if err := stg.append(ctx, dataset, stage, fields, records); err != nil {
+		return fmt.Errorf("unable to stage records: %w", err)
+	}
+
+	conditions := make([]string, len(keys))
+	for idx, key := range keys {
+		conditions[idx] = "target." + bigQueryQuote(key) + " = source." + bigQueryQuote(key)
+	}
+
+	query := fmt.Sprintf("MERGE %s AS target USING %s AS source ON %s", stg.tableName(dataset, table),
+		stg.tableName(dataset, stage), strings.Join(conditions, " AND "))
+
+	if len(updates) > 0 {
+		query += " WHEN MATCHED THEN UPDATE SET " + strings.Join(updates, ", ")
+	}
+
+	query += fmt.Sprintf(" WHEN NOT MATCHED THEN INSERT (%s) VALUES (source.%s)", strings.Join(columns, ", "),
+		strings.Join(columns, ", source."))
+
+	if _, err := stg.exec(ctx, query); err != nil {
+		return fmt.Errorf("unable to merge records: %w", err)
+	}
+
+	return nil
+}
+
+// append will write the records to the table with a pending stream of the Storage Write API, which commits the rows
+// of every append at once when the stream is committed, so that a write that fails does not write any of them.
+// Committed rows can be read, and merged from, right away.
+func (stg *BigQuery) append(ctx context.Context, dataset, table string, schema bigquery.Schema,
+	records []*structpb.Struct,
+) error {
+	message, descriptor, err := bigQueryDescriptor(schema)
+	if err != nil {
+		return err
+	}
+
+	rows, err := bigQueryRows(schema, message, records)
+	if err != nil {
+		return err
+	}
+
+	parent := managedwriter.TableParentFromParts(stg.project, dataset, table)
+
+	stream, err := stg.writer.NewManagedStream(ctx, managedwriter.WithDestinationTable(parent),
+		managedwriter.WithType(managedwriter.PendingStream), managedwriter.WithSchemaDescriptor(descriptor))
+	if err != nil {
+		return BigQueryError("create write stream", err)
+	}
+
+	defer stream.Close()
+
+	var results []*managedwriter.AppendResult
+
+	for start := 0; start < len(rows); {
+		end, size := start, 0
+		for ; end < len(rows) && (end == start || size+len(rows[end]) <= bigQueryAppendBytes); end++ {
+			size += len(rows[end])
+		}
+
+		result, err := stream.AppendRows(ctx, rows[start:end])
+		if err != nil {
+			return BigQueryError("append rows", err)
+		}
+
+		results = append(results, result)
+		start = end
+	}
+
+	for _, result := range results {
+		if _, err := result.GetResult(ctx); err != nil {
+			return BigQueryError("append rows", err)
+		}
+	}
+
+	if _, err := stream.Finalize(ctx); err != nil {
+		return BigQueryError("finalize write stream", err)
+	}
+
+	rsp, err := stg.writer.BatchCommitWriteStreams(ctx, &storagepb.BatchCommitWriteStreamsRequest{
+		Parent:       parent,
+		WriteStreams: []string{stream.StreamName()},
+	})
+	if err != nil {
+		return BigQueryError("commit write stream", err)
+	}
+
+	if streamErrs := rsp.GetStreamErrors(); len(streamErrs) > 0 {
+		return BigQueryError("commit write stream", errors.New(streamErrs[0].GetErrorMessage()))
+	}
+
+	return nil
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *BigQuery) tx(ctx context.Context) *bigQueryTx {
+	txID, ok := ctx.Value(basicBigQueryTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	bigQueryTx, _ := tx.(*bigQueryTx)
+
+	return bigQueryTx
+}
+
+// bigQueryParameterFor will return the value of the query parameter for the value of a required field or page.
+func bigQueryParameterFor(value interface{}) bigquery.QueryParameterValue {
+	param := bigquery.QueryParameterValue{Type: bigquery.StandardSQLDataType{TypeKind: "STRING"}}
+
+	switch value := value.(type) {
+	case string:
+		param.Value = value
+	case bool:
+		param.Type.TypeKind, param.Value = "BOOL", strconv.FormatBool(value)
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) <= bigQueryMaxSafeInteger {
+			param.Type.TypeKind, param.Value = "INT64", strconv.FormatInt(int64(value), 10)
+		} else {
+			param.Type.TypeKind, param.Value = "FLOAT64", strconv.FormatFloat(value, 'g', -1, 64)
+		}
+	default:
+		data, _ := json.Marshal(value)
+		param.Value = string(data)
+	}
+
+	return param
+}
+
+// bigQueryParameter will return the positional query parameter for the value of a required field or page.
+func bigQueryParameter(value interface{}) bigquery.QueryParameter {
+	param := bigQueryParameterFor(value)
+
+	return bigquery.QueryParameter{Value: &param}
+}
+
+// bigQueryRequiredConditions will return the conditions and positional parameters that match the required fields.
+func bigQueryRequiredConditions(required map[string]interface{}) ([]string, []bigquery.QueryParameter) {
+	columns := make([]string, 0, len(required))
+	for column := range required {
+		columns = append(columns, column)
+	}
+
+	sort.Strings(columns)
+
+	var (
+		conditions []string
+		params     []bigquery.QueryParameter
+	)
+
+	for _, column := range columns {
+		switch values := required[column].(type) {
+		case nil:
+			conditions = append(conditions, bigQueryQuote(column)+" IS NULL")
+		case []interface{}:
+			if len(values) == 0 {
+				conditions = append(conditions, "FALSE")
+
+				continue
+			}
+
+			param := bigquery.QueryParameterValue{Type: bigquery.StandardSQLDataType{TypeKind: "ARRAY"}}
+
+			for _, value := range values {
+				elem := bigQueryParameterFor(value)
+				param.Type.ArrayElementType = &elem.Type
+				param.ArrayValue = append(param.ArrayValue, elem)
+			}
+
+			params = append(params, bigquery.QueryParameter{Value: &param})
+			conditions = append(conditions, bigQueryQuote(column)+" IN UNNEST(?)")
+		default:
+			params = append(params, bigQueryParameter(values))
+			conditions = append(conditions, bigQueryQuote(column)+" = ?")
+		}
+	}
+
+	return conditions, params
+}
+
+// selectQuery will return the query and parameters that select the records of the table that match the required
+// fields, in the page if it is not nil. The records after the "after" values of the page are selected by comparing
+// the "orderBy" columns in turn, since BigQuery does not compare row values.
+func (stg *BigQuery) selectQuery(dataset, table string, required map[string]interface{},
+	page *readPage,
+) (string, []bigquery.QueryParameter) {
+	conditions, params := bigQueryRequiredConditions(required)
+
+	var clauses string
+
+	if page != nil {
+		if len(page.after) > 0 {
+			var after []string
+
+			for idx := range page.orderBy {
+				terms := make([]string, 0, idx+1)
+
+				for prev := 0; prev < idx; prev++ {
+					params = append(params, bigQueryParameter(page.after[prev]))
+					terms = append(terms, bigQueryQuote(page.orderBy[prev])+" = ?")
+				}
+
+				params = append(params, bigQueryParameter(page.after[idx]))
+				terms = append(terms, bigQueryQuote(page.orderBy[idx])+" > ?")
+				after = append(after, "("+strings.Join(terms, " AND ")+")")
+			}
+
+			conditions = append(conditions, "("+strings.Join(after, " OR ")+")")
+		}
+
+		if len(page.orderBy) > 0 {
+			quoted := make([]string, len(page.orderBy))
+			for idx, column := range page.orderBy {
+				quoted[idx] = bigQueryQuote(column)
+			}
+
+			clauses = " ORDER BY " + strings.Join(quoted, ", ")
+		}
+
+		if page.limit > 0 {
+			clauses += fmt.Sprintf(" LIMIT %d", page.limit)
+		}
+	}
+
+	query := "SELECT * FROM " + stg.tableName(dataset, table)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	return query + clauses, params
+}
+
+// countQuery will return the query and parameters that count the records of the table that match the required fields.
+func (stg *BigQuery) countQuery(dataset, table string,
+	required map[string]interface{},
+) (string, []bigquery.QueryParameter) {
+	conditions, params := bigQueryRequiredConditions(required)
+
+	query := "SELECT COUNT(*) AS count FROM " + stg.tableName(dataset, table)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	return query, params
+}
+
+// query will return the query of the statement with the positional parameters, in the location of the connection
+// string.
+func (stg *BigQuery) query(statement string, params []bigquery.QueryParameter) *bigquery.Query {
+	query := stg.client.Query(statement)
+	query.Parameters = params
+	query.Location = stg.location
+
+	return query
+}
+
+// read will run the query and return the records of its results.
+func (stg *BigQuery) read(ctx context.Context, statement string,
+	params []bigquery.QueryParameter,
+) ([]map[string]interface{}, error) {
+	rows, err := stg.query(statement, params).Read(ctx)
+	if err != nil {
+		return nil, BigQueryError("query", err)
+	}
+
+	var records []map[string]interface{}
+
+	for {
+		var row map[string]bigquery.Value
+
+		err := rows.Next(&row)
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+
+		if err != nil {
+			return nil, BigQueryError("read query results", err)
+		}
+
+		records = append(records, bigQueryRecord(rows.Schema, row))
+	}
+
+	return records, nil
+}
+
+// exec will run the DML statement and return the number of rows that it affected.
+func (stg *BigQuery) exec(ctx context.Context, statement string) (int64, error) {
+	job, err := stg.query(statement, nil).Run(ctx)
+	if err != nil {
+		return 0, BigQueryError("query", err)
+	}
+
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return 0, BigQueryError("wait for job "+job.ID(), err)
+	}
+
+	if err := status.Err(); err != nil {
+		return 0, BigQueryError("job "+job.ID(), err)
+	}
+
+	if status.Statistics == nil {
+		return 0, nil
+	}
+
+	stats, _ := status.Statistics.Details.(*bigquery.QueryStatistics)
+	if stats == nil {
+		return 0, nil
+	}
+
+	return stats.NumDMLAffectedRows, nil
+}
+
+// bigQueryRecord will convert the row of query results with the fields of the schema to a record.
+func bigQueryRecord(schema bigquery.Schema, row map[string]bigquery.Value) map[string]interface{} {
+	record := make(map[string]interface{}, len(row))
+
+	for _, field := range schema {
+		if value, ok := row[field.Name]; ok {
+			record[field.Name] = bigQueryValue(field, value)
+		}
+	}
+
+	return record
+}
+
+// bigQueryValue will convert the value of a column of query results to the value of a record. Integers and numerics
+// are numbers, timestamps are RFC 3339 strings, and the values of "JSON" columns are decoded.
+func bigQueryValue(field *bigquery.FieldSchema, value bigquery.Value) interface{} {
+	switch value := value.(type) {
+	case nil, bool, float64:
+		return value
+	case []bigquery.Value:
+		elemField := *field
+		elemField.Repeated = false
+
+		values := make([]interface{}, len(value))
+		for idx, elem := range value {
+			values[idx] = bigQueryValue(&elemField, elem)
+		}
+
+		return values
+	case map[string]bigquery.Value:
+		return bigQueryRecord(field.Schema, value)
+	case int64:
+		return float64(value)
+	case *big.Rat:
+		num, _ := value.Float64()
+
+		return num
+	case time.Time:
+		return value.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(value)
+	case string:
+		var decoded interface{}
+		if field.Type == bigquery.JSONFieldType && json.Unmarshal([]byte(value), &decoded) == nil {
+			return decoded
+		}
+
+		return value
+	default:
+		// Dates, times, and intervals are formatted as BigQuery formats them.
+		return fmt.Sprint(value)
+	}
+}
+
+// Read will query the records of the table that match the required fields on the request, in the page requested by
+// the options of the request, if any.
+func (stg *BigQuery) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	dataset, table := stg.tableRef(req.GetTable())
+
+	query, params := stg.selectQuery(dataset, table, req.GetRequired().AsMap(), page)
+
+	records, err := stg.read(ctx, query, params)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read records: %w", err)
+	}
+
+	rsp := new(proto.ReadResponse)
+
+	for _, rec := range records {
+		record, err := structpb.NewStruct(rec)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert record: %w", err)
+		}
+
+		rsp.Records = append(rsp.Records, record)
+	}
+
+	return rsp, nil
+}
+
+// Count will return the number of rows of the table that match the required fields, with a "SELECT COUNT(*)" query.
+func (stg *BigQuery) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	dataset, table := stg.tableRef(req.GetTable())
+
+	query, params := stg.countQuery(dataset, table, req.GetRequired().AsMap())
+
+	records, err := stg.read(ctx, query, params)
+	if err != nil {
+		return nil, fmt.Errorf("unable to count records: %w", err)
+	}
+
+	rsp := new(proto.CountResponse)
+
+	if len(records) > 0 {
+		if count, ok := records[0]["count"].(float64); ok {
+			rsp.Count = int64(count)
+		}
+	}
+
+	return rsp, nil
+}
+
+// Truncate will delete every row of the tables.
+func (stg *BigQuery) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	var deleted int32
+
+	for _, name := range req.GetTables() {
+		dataset, table := stg.tableRef(name)
+
+		affected, err := stg.exec(ctx, "TRUNCATE TABLE "+stg.tableName(dataset, table))
+		if err != nil {
+			return nil, fmt.Errorf("error truncating table %s: %w", name, err)
+		}
+
+		deleted += int32(affected)
+	}
+
+	return &proto.TruncateResponse{DeletedCount: deleted}, nil
+}
+
+// tables will return the metadata of the tables of the dataset of the connection string, by table.
+func (stg *BigQuery) tables(ctx context.Context) (map[string]*bigquery.TableMetadata, error) {
+	tables := make(map[string]*bigquery.TableMetadata)
+
+	listed := stg.client.DatasetInProject(stg.project, stg.dataset).Tables(ctx)
+
+	for {
+		table, err := listed.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+
+		if err != nil {
+			return nil, BigQueryError("list tables", err)
+		}
+
+		// The size and constraints of a table are only on the table resource.
+		metadata, err := table.Metadata(ctx)
+		if err != nil {
+			return nil, BigQueryError("get table "+table.TableID, err)
+		}
+
+		tables[table.TableID] = metadata
+	}
+
+	return tables, nil
+}
+
+// ListTables will return the tables of the dataset of the connection string, with their size in bytes.
+func (stg *BigQuery) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	tables, err := stg.tables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tables: %w", err)
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+
+	for name, metadata := range tables {
+		rsp.TableSet[name] = &proto.Table{Size: metadata.NumBytes}
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will return the primary key columns of the tables of the dataset of the connection string. BigQuery
+// does not enforce primary keys.
+func (stg *BigQuery) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	tables, err := stg.tables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+
+	for name, metadata := range tables {
+		if metadata.TableConstraints != nil && metadata.TableConstraints.PrimaryKey != nil {
+			rsp.PKSet[name] = &proto.PrimaryKeys{List: metadata.TableConstraints.PrimaryKey.Columns}
+		}
+	}
+
+	return rsp, nil
+}
+
+// StartTx will start a transaction. The records of the functions sent to the transaction are buffered, and written
+// when the transaction commits, one table at a time. The tables are not written atomically, so a commit that fails
+// may have written the records of some of the tables.
+func (stg *BigQuery) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+	tx := &bigQueryTx{records: make(map[string][]*structpb.Struct)}
+
+	stg.activeTx.Store(txnID, tx)
+
+	bqCtx := context.WithValue(ctx, basicBigQueryTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+
+		var err error
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(bqCtx, stg)
+		}
+
+		if err != nil {
+			<-txn.commit
+			txn.done <- err
+
+			return
+		}
+
+		if !<-txn.commit {
+			txn.done <- nil
+
+			return
+		}
+
+		for _, key := range tx.tables {
+			dataset, table := stg.tableRef(key)
+			if err = stg.write(ctx, dataset, table, tx.records[key]); err != nil {
+				break
+			}
+		}
+
+		txn.done <- err
+	}()
+
+	return txn, nil
+}
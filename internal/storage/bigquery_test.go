@@ -0,0 +1,615 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigquery/storage/apiv1/storagepb"
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/grpc"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// bigQueryTestTable is the resource of a BigQuery table, as the BigQuery API server stores it.
+type bigQueryTestTable struct {
+	TableReference struct {
+		ProjectID string `json:"projectId"`
+		DatasetID string `json:"datasetId"`
+		TableID   string `json:"tableId"`
+	} `json:"tableReference"`
+	Schema struct {
+		Fields []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		} `json:"fields"`
+	} `json:"schema"`
+	ExpirationTime   string `json:"expirationTime,omitempty"`
+	TableConstraints *struct {
+		PrimaryKey struct {
+			Columns []string `json:"columns"`
+		} `json:"primaryKey"`
+	} `json:"tableConstraints,omitempty"`
+}
+
+// bigQueryServer is a BigQuery API and Storage Write API server that records the tables and the committed rows
+// written to them, and answers queries with "results". Query jobs report "affected" rows, and tables are deleted to
+// "deleted".
+type bigQueryServer struct {
+	storagepb.UnimplementedBigQueryWriteServer
+
+	mtx      sync.Mutex
+	tables   map[string]*bigQueryTestTable
+	deleted  map[string]*bigQueryTestTable
+	streams  map[string][]map[string]interface{}
+	rows     map[string][]map[string]interface{}
+	queries  []map[string]interface{}
+	results  string
+	affected string
+}
+
+func (srv *bigQueryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	path := strings.TrimPrefix(r.URL.Path, "/projects/project/")
+
+	switch {
+	case r.Method == http.MethodPost && path == "queries":
+		var query map[string]interface{}
+
+		_ = json.Unmarshal(body, &query)
+		srv.queries = append(srv.queries, query)
+
+		// The first response has not completed, so the results are polled.
+		_, _ = w.Write([]byte(`{"jobComplete":false,"jobReference":` +
+			`{"projectId":"project","jobId":"job-1","location":"EU"}}`))
+	case r.Method == http.MethodPost && path == "jobs":
+		var job struct {
+			Configuration struct {
+				Query map[string]interface{} `json:"query"`
+			} `json:"configuration"`
+		}
+
+		_ = json.Unmarshal(body, &job)
+		srv.queries = append(srv.queries, job.Configuration.Query)
+
+		_, _ = w.Write([]byte(`{"jobReference":{"projectId":"project","jobId":"job-2"},` +
+			`"configuration":{"query":{}},"status":{"state":"RUNNING"}}`))
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "queries/"):
+		if path == "queries/job-1" && r.URL.Query().Get("location") != "EU" {
+			http.Error(w, `{"error":{"code":400,"message":"missing location"}}`, http.StatusBadRequest)
+
+			return
+		}
+
+		_, _ = w.Write([]byte(srv.results))
+	case r.Method == http.MethodGet && path == "jobs/job-2":
+		_, _ = fmt.Fprintf(w, `{"jobReference":{"projectId":"project","jobId":"job-2"},"configuration":`+
+			`{"query":{}},"status":{"state":"DONE"},"statistics":{"query":{"numDmlAffectedRows":%q}}}`,
+			srv.affected)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/tables"):
+		var table bigQueryTestTable
+
+		_ = json.Unmarshal(body, &table)
+		srv.tables[path+"/"+table.TableReference.TableID] = &table
+
+		_, _ = w.Write(body)
+	case r.Method == http.MethodPatch && srv.tables[path] != nil:
+		var patch bigQueryTestTable
+
+		_ = json.Unmarshal(body, &patch)
+		srv.tables[path].Schema = patch.Schema
+
+		_ = json.NewEncoder(w).Encode(srv.tables[path])
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/tables"):
+		rsp := map[string][]*bigQueryTestTable{"tables": {}}
+		for _, table := range srv.tables {
+			rsp["tables"] = append(rsp["tables"], table)
+		}
+
+		_ = json.NewEncoder(w).Encode(rsp)
+	case r.Method == http.MethodGet && srv.tables[path] != nil:
+		_ = json.NewEncoder(w).Encode(srv.tables[path])
+	case r.Method == http.MethodDelete && srv.tables[path] != nil:
+		srv.deleted[path] = srv.tables[path]
+		delete(srv.tables, path)
+	default:
+		http.Error(w, `{"error":{"code":404,"message":"Not found: `+path+`"}}`, http.StatusNotFound)
+	}
+}
+
+// CreateWriteStream will create a pending stream of the table.
+func (srv *bigQueryServer) CreateWriteStream(_ context.Context,
+	req *storagepb.CreateWriteStreamRequest,
+) (*storagepb.WriteStream, error) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	if srv.tables[strings.TrimPrefix(req.GetParent(), "projects/project/")] == nil {
+		return nil, errors.New("table not found")
+	}
+
+	name := fmt.Sprintf("%s/streams/%d", req.GetParent(), len(srv.streams))
+	srv.streams[name] = []map[string]interface{}{}
+
+	return &storagepb.WriteStream{Name: name, Type: req.GetWriteStream().GetType()}, nil
+}
+
+// GetWriteStream will return a stream of the server.
+func (srv *bigQueryServer) GetWriteStream(_ context.Context,
+	req *storagepb.GetWriteStreamRequest,
+) (*storagepb.WriteStream, error) {
+	return &storagepb.WriteStream{Name: req.GetName(), Type: storagepb.WriteStream_PENDING}, nil
+}
+
+// AppendRows will decode the rows appended to a stream with the descriptor of the first request of the connection.
+func (srv *bigQueryServer) AppendRows(stream storagepb.BigQueryWrite_AppendRowsServer) error {
+	var message protoreflect.MessageDescriptor
+
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		rows := req.GetProtoRows()
+		if descriptor := rows.GetWriterSchema().GetProtoDescriptor(); descriptor != nil {
+			file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+				Name:        protobuf.String("rows.proto"),
+				Syntax:      protobuf.String("proto2"),
+				MessageType: []*descriptorpb.DescriptorProto{descriptor},
+			}, nil)
+			if err != nil {
+				return err
+			}
+
+			message = file.Messages().Get(0)
+		}
+
+		srv.mtx.Lock()
+
+		for _, data := range rows.GetRows().GetSerializedRows() {
+			row := dynamicpb.NewMessage(message)
+			if err := protobuf.Unmarshal(data, row); err != nil {
+				srv.mtx.Unlock()
+
+				return err
+			}
+
+			record := make(map[string]interface{})
+
+			row.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+				name := string(field.Name())
+				if column, ok := protobuf.GetExtension(field.Options(), storagepb.E_ColumnName).(string); ok &&
+					column != "" {
+					name = column
+				}
+
+				record[name] = value.Interface()
+
+				return true
+			})
+
+			srv.streams[req.GetWriteStream()] = append(srv.streams[req.GetWriteStream()], record)
+		}
+
+		srv.mtx.Unlock()
+
+		if err := stream.Send(&storagepb.AppendRowsResponse{
+			Response: &storagepb.AppendRowsResponse_AppendResult_{
+				AppendResult: &storagepb.AppendRowsResponse_AppendResult{},
+			},
+			WriteStream: req.GetWriteStream(),
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// FinalizeWriteStream will return the number of rows of the stream.
+func (srv *bigQueryServer) FinalizeWriteStream(_ context.Context,
+	req *storagepb.FinalizeWriteStreamRequest,
+) (*storagepb.FinalizeWriteStreamResponse, error) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	return &storagepb.FinalizeWriteStreamResponse{RowCount: int64(len(srv.streams[req.GetName()]))}, nil
+}
+
+// BatchCommitWriteStreams will commit the rows of the streams to their tables.
+func (srv *bigQueryServer) BatchCommitWriteStreams(_ context.Context,
+	req *storagepb.BatchCommitWriteStreamsRequest,
+) (*storagepb.BatchCommitWriteStreamsResponse, error) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	table := strings.TrimPrefix(req.GetParent(), "projects/project/")
+	for _, stream := range req.GetWriteStreams() {
+		srv.rows[table] = append(srv.rows[table], srv.streams[stream]...)
+		delete(srv.streams, stream)
+	}
+
+	return &storagepb.BatchCommitWriteStreamsResponse{CommitTime: timestamppb.Now()}, nil
+}
+
+func newTestBigQuery(t *testing.T) (*BigQuery, *bigQueryServer) {
+	t.Helper()
+
+	srv := &bigQueryServer{
+		tables:   make(map[string]*bigQueryTestTable),
+		deleted:  make(map[string]*bigQueryTestTable),
+		streams:  make(map[string][]map[string]interface{}),
+		rows:     make(map[string][]map[string]interface{}),
+		results:  `{"jobComplete":true}`,
+		affected: "0",
+	}
+
+	server := httptest.NewServer(srv)
+	t.Cleanup(server.Close)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	grpcServer := grpc.NewServer()
+	storagepb.RegisterBigQueryWriteServer(grpcServer, srv)
+
+	go func() { _ = grpcServer.Serve(listener) }()
+
+	t.Cleanup(grpcServer.Stop)
+
+	svc, err := New(context.Background(), "bigquery://project/raw?location=EU&endpoint="+server.URL+
+		"&writeEndpoint=http://"+listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	t.Cleanup(svc.Close)
+
+	stg, ok := svc.Storage.(*BigQuery)
+	if !ok {
+		t.Fatalf("expected bigquery storage, got %T", svc.Storage)
+	}
+
+	return stg, srv
+}
+
+func upsertBigQuery(t *testing.T, stg Storage, table string, records ...map[string]interface{}) {
+	t.Helper()
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		t.Fatalf("failed to marshal records: %v", err)
+	}
+
+	if _, err := stg.Upsert(context.Background(), &proto.UpsertRequest{Table: table, Data: data}); err != nil {
+		t.Fatalf("failed to upsert records: %v", err)
+	}
+}
+
+func TestBigQuery(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("dsn", func(t *testing.T) {
+		t.Parallel()
+
+		for _, dns := range []string{
+			"bigquery://project", "bigquery:///dataset", "bigquery://project/a/b",
+			"bigquery://project/raw?endpoint=http://localhost&writeEndpoint=http://",
+		} {
+			if _, err := New(ctx, dns); !errors.Is(err, ErrDNSNotSupported) {
+				t.Fatalf("expected error %v for %q, got %v", ErrDNSNotSupported, dns, err)
+			}
+		}
+	})
+
+	t.Run("schema", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestBigQuery(t)
+
+		upsertBigQuery(t, stg, "candles",
+			map[string]interface{}{"id": 1, "price": 1, "tags": []string{"a"}, "note": nil},
+			map[string]interface{}{"id": 2, "price": 1.5, "meta": map[string]interface{}{"a": 1}})
+
+		// A new field adds a column to the schema.
+		upsertBigQuery(t, stg, "candles", map[string]interface{}{"id": 3, "flag": true})
+
+		table := srv.tables["datasets/raw/tables/candles"]
+		if table == nil {
+			t.Fatalf("expected the table to be created, got %v", srv.tables)
+		}
+
+		fields := make([]string, len(table.Schema.Fields))
+		for idx, field := range table.Schema.Fields {
+			fields[idx] = field.Name + " " + field.Type
+		}
+
+		exp := []string{"id INTEGER", "meta JSON", "note STRING", "price FLOAT", "tags JSON", "flag BOOLEAN"}
+		if !reflect.DeepEqual(fields, exp) {
+			t.Fatalf("expected schema %v, got %v", exp, fields)
+		}
+
+		pks, err := stg.ListPrimaryKeys(ctx)
+		if err != nil {
+			t.Fatalf("failed to list primary keys: %v", err)
+		}
+
+		if got := pks.GetPKSet()["candles"].GetList(); !reflect.DeepEqual(got, []string{"id"}) {
+			t.Fatalf("expected primary key [id], got %v", got)
+		}
+
+		// A table of another dataset of the project.
+		upsertBigQuery(t, stg, "staging.candles", map[string]interface{}{"id": 1})
+
+		if srv.tables["datasets/staging/tables/candles"] == nil {
+			t.Fatalf("expected the table to be created in the staging dataset")
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestBigQuery(t)
+
+		upsertBigQuery(t, stg, "candles", map[string]interface{}{"id": 1, "price": 1, "name": "a"})
+		upsertBigQuery(t, stg, "candles",
+			map[string]interface{}{"id": 1, "price": 2},
+			map[string]interface{}{"id": 2, "meta": map[string]interface{}{"a": 1}},
+			map[string]interface{}{"id": 1, "price": 3})
+
+		if len(srv.rows["datasets/raw/tables/candles"]) != 0 || len(srv.queries) != 2 || len(srv.deleted) != 2 {
+			t.Fatalf("expected a merge of each upsert from a staging table, got %d queries", len(srv.queries))
+		}
+
+		var stage string
+
+		for path, table := range srv.deleted {
+			if table.ExpirationTime == "" {
+				t.Fatalf("expected the staging table %s to expire", path)
+			}
+
+			// The staging table of the second upsert.
+			if len(srv.rows[path]) == 1 {
+				continue
+			}
+
+			stage = table.TableReference.TableID
+
+			// The staging table has the columns of the fields of the records, in the order of the schema.
+			fields := make([]string, len(table.Schema.Fields))
+			for idx, field := range table.Schema.Fields {
+				fields[idx] = field.Name
+			}
+
+			if !reflect.DeepEqual(fields, []string{"id", "price", "meta"}) {
+				t.Fatalf("expected the staging table to have the columns of the records, got %v", fields)
+			}
+
+			// Only the last record of each key is merged, and JSON columns are written as JSON strings.
+			exp := []map[string]interface{}{
+				{"id": int64(2), "meta": `{"a":1}`},
+				{"id": int64(1), "price": int64(3)},
+			}
+
+			if !reflect.DeepEqual(srv.rows[path], exp) {
+				t.Fatalf("expected the staged rows %v, got %v", exp, srv.rows[path])
+			}
+		}
+
+		if !strings.HasPrefix(stage, "candles_gidari_stage_") {
+			t.Fatalf("expected the staging tables to be deleted, got %v", srv.deleted)
+		}
+
+		query := "MERGE `project.raw.candles` AS target USING `project.raw." + stage + "` AS source ON " +
+			"target.`id` = source.`id` WHEN MATCHED THEN UPDATE SET `price` = source.`price`, `meta` = " +
+			"source.`meta` WHEN NOT MATCHED THEN INSERT (`id`, `price`, `meta`) VALUES (source.`id`, " +
+			"source.`price`, source.`meta`)"
+		if got := srv.queries[1]["query"]; got != query {
+			t.Fatalf("expected query %q, got %q", query, got)
+		}
+	})
+
+	t.Run("appends", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestBigQuery(t)
+
+		// A table without a primary key is appended to, including the fields that are not protocol buffer names.
+		upsertBigQuery(t, stg, "trades",
+			map[string]interface{}{"price": 1, "tags": []string{"a"}, "trade-id": "x"},
+			map[string]interface{}{"price": 1, "meta": map[string]interface{}{"a": 1}})
+
+		exp := []map[string]interface{}{
+			{"price": int64(1), "tags": `["a"]`, "trade-id": "x"},
+			{"price": int64(1), "meta": `{"a":1}`},
+		}
+
+		if rows := srv.rows["datasets/raw/tables/trades"]; !reflect.DeepEqual(rows, exp) || len(srv.queries) != 0 {
+			t.Fatalf("expected rows %v with JSON columns written as strings, got %v", exp, rows)
+		}
+	})
+
+	t.Run("read", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestBigQuery(t)
+
+		srv.results = `{
+			"jobComplete": true,
+			"jobReference": {"projectId": "project", "jobId": "job-1", "location": "EU"},
+			"totalRows": "1",
+			"schema": {"fields": [
+				{"name": "id", "type": "INTEGER"},
+				{"name": "name", "type": "STRING"},
+				{"name": "flag", "type": "BOOLEAN"},
+				{"name": "meta", "type": "JSON"},
+				{"name": "tags", "type": "STRING", "mode": "REPEATED"},
+				{"name": "at", "type": "TIMESTAMP"}
+			]},
+			"rows": [{"f": [
+				{"v": "2"}, {"v": "b"}, {"v": "true"}, {"v": "{\"a\":1}"}, {"v": [{"v": "x"}]},
+				{"v": "1600000000000000"}
+			]}]
+		}`
+
+		opts, err := structpb.NewStruct(map[string]interface{}{
+			ReadOrderByOption: []interface{}{"id", "name"},
+			ReadAfterOption:   []interface{}{1, "a"},
+			ReadLimitOption:   10,
+		})
+		if err != nil {
+			t.Fatalf("failed to create read options: %v", err)
+		}
+
+		required, err := structpb.NewStruct(map[string]interface{}{"flag": true, "name": []interface{}{"a", "b"}})
+		if err != nil {
+			t.Fatalf("failed to create required fields: %v", err)
+		}
+
+		rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "candles", Required: required, Options: opts})
+		if err != nil {
+			t.Fatalf("failed to read records: %v", err)
+		}
+
+		exp := map[string]interface{}{
+			"id": 2.0, "name": "b", "flag": true, "meta": map[string]interface{}{"a": 1.0},
+			"tags": []interface{}{"x"}, "at": "2020-09-13T12:26:40Z",
+		}
+
+		if len(rsp.GetRecords()) != 1 || !reflect.DeepEqual(rsp.GetRecords()[0].AsMap(), exp) {
+			t.Fatalf("expected record %v, got %v", exp, rsp.GetRecords())
+		}
+
+		query := "SELECT * FROM `project.raw.candles` WHERE `flag` = ? AND `name` IN UNNEST(?) AND " +
+			"((`id` > ?) OR (`id` = ? AND `name` > ?)) ORDER BY `id`, `name` LIMIT 10"
+		if got := srv.queries[0]["query"]; got != query || srv.queries[0]["location"] != "EU" {
+			t.Fatalf("expected query %q in EU, got %v", query, srv.queries[0])
+		}
+
+		params, _ := json.Marshal(srv.queries[0]["queryParameters"])
+		expParams := `[{"parameterType":{"type":"BOOL"},"parameterValue":{"value":"true"}},` +
+			`{"parameterType":{"arrayType":{"type":"STRING"},"type":"ARRAY"},` +
+			`"parameterValue":{"arrayValues":[{"value":"a"},{"value":"b"}]}},` +
+			`{"parameterType":{"type":"INT64"},"parameterValue":{"value":"1"}},` +
+			`{"parameterType":{"type":"INT64"},"parameterValue":{"value":"1"}},` +
+			`{"parameterType":{"type":"STRING"},"parameterValue":{"value":"a"}}]`
+
+		if string(params) != expParams {
+			t.Fatalf("expected parameters %s, got %s", expParams, params)
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestBigQuery(t)
+
+		srv.results = `{
+			"jobComplete": true,
+			"jobReference": {"projectId": "project", "jobId": "job-1", "location": "EU"},
+			"totalRows": "1",
+			"schema": {"fields": [{"name": "count", "type": "INTEGER"}]},
+			"rows": [{"f": [{"v": "42"}]}]
+		}`
+
+		required, err := structpb.NewStruct(map[string]interface{}{"flag": true})
+		if err != nil {
+			t.Fatalf("failed to create required fields: %v", err)
+		}
+
+		rsp, err := stg.Count(ctx, &proto.CountRequest{Table: "candles", Required: required})
+		if err != nil {
+			t.Fatalf("failed to count records: %v", err)
+		}
+
+		query := "SELECT COUNT(*) AS count FROM `project.raw.candles` WHERE `flag` = ?"
+		if rsp.GetCount() != 42 || srv.queries[0]["query"] != query {
+			t.Fatalf("expected 42 from %q, got %d from %v", query, rsp.GetCount(), srv.queries)
+		}
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestBigQuery(t)
+		srv.affected = "4"
+
+		rsp, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"candles"}})
+		if err != nil {
+			t.Fatalf("failed to truncate table: %v", err)
+		}
+
+		if rsp.GetDeletedCount() != 4 || srv.queries[0]["query"] != "TRUNCATE TABLE `project.raw.candles`" {
+			t.Fatalf("unexpected truncate %d: %v", rsp.GetDeletedCount(), srv.queries)
+		}
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestBigQuery(t)
+
+		for _, commit := range []bool{false, true} {
+			txn, err := stg.StartTx(ctx)
+			if err != nil {
+				t.Fatalf("failed to start transaction: %v", err)
+			}
+
+			txn.Send(func(ctx context.Context, stg Storage) error {
+				_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(`[{"id":1}]`)})
+
+				return err
+			})
+
+			if commit {
+				err = txn.Commit()
+			} else {
+				err = txn.Rollback()
+			}
+
+			if err != nil {
+				t.Fatalf("failed to end transaction: %v", err)
+			}
+
+			srv.mtx.Lock()
+			merges := len(srv.queries)
+			srv.mtx.Unlock()
+
+			if exp := map[bool]int{false: 0, true: 1}[commit]; merges != exp {
+				t.Fatalf("expected %d merges after the transaction, got %d", exp, merges)
+			}
+		}
+	})
+}
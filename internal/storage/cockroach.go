@@ -0,0 +1,186 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/lib/pq"
+)
+
+const (
+	// cockroachScheme is the scheme of a CockroachDB connection string. CockroachDB speaks the PostgreSQL wire
+	// protocol, so the connection string is otherwise a PostgreSQL connection string.
+	cockroachScheme = "cockroachdb"
+
+	// crdbRetryLimit is the maximum number of times a CockroachDB transaction is restarted after a serialization
+	// error before the transaction fails.
+	crdbRetryLimit = 10
+
+	// crdbSavepoint is the savepoint that CockroachDB restarts a transaction from, see
+	// https://www.cockroachlabs.com/docs/stable/advanced-client-side-transaction-retries
+	crdbSavepoint = "cockroach_restart"
+
+	// crdbRetryCode is the SQLSTATE of the errors that CockroachDB returns for a transaction that must be retried.
+	crdbRetryCode = "40001"
+
+	// crdbReplayLimitParam is the connection string parameter that sets the maximum number of operations of a
+	// transaction that are kept to be replayed, e.g. "crdb_replay_limit=5000". The parameter is removed from the
+	// connection string before connecting.
+	crdbReplayLimitParam = "crdb_replay_limit"
+
+	// crdbDefaultReplayLimit is the default maximum number of operations of a transaction that are kept to be
+	// replayed. Each operation holds the records of its batch until the transaction ends.
+	crdbDefaultReplayLimit = 1000
+)
+
+var (
+	ErrCockroachRetryLimit      = fmt.Errorf("cockroachdb transaction retry limit exceeded")
+	ErrCockroachReplayLimit     = fmt.Errorf("cockroachdb transaction replay limit exceeded")
+	ErrCockroachLoadMaintenance = fmt.Errorf("load maintenance is not supported on cockroachdb")
+)
+
+// CockroachReplayLimitError is returned when a CockroachDB transaction fails with a serialization error after more
+// operations were applied to it than are kept to be replayed.
+func CockroachReplayLimitError(limit int, err error) error {
+	return fmt.Errorf("%w: more than %d operations, set %s to replay more: %v", ErrCockroachReplayLimit, limit,
+		crdbReplayLimitParam, err)
+}
+
+// CockroachRetryLimitError is returned when a CockroachDB transaction is still failing with a serialization error
+// after it was restarted "crdbRetryLimit" times.
+func CockroachRetryLimitError(err error) error {
+	return fmt.Errorf("%w: %d retries: %v", ErrCockroachRetryLimit, crdbRetryLimit, err)
+}
+
+// parseCockroach will replace the "cockroachdb" scheme of the connection URL with "postgresql", returning true if the
+// connection URL is for CockroachDB.
+func parseCockroach(connectionURL string) (string, bool) {
+	if !strings.HasPrefix(connectionURL, cockroachScheme+"://") {
+		return connectionURL, false
+	}
+
+	return Scheme(PostgresType) + strings.TrimPrefix(connectionURL, cockroachScheme), true
+}
+
+// parseCockroachReplayLimit will remove the replay limit parameter from the connection URL, returning the maximum
+// number of operations of a transaction that are kept to be replayed.
+func parseCockroachReplayLimit(connectionURL string) (string, int, error) {
+	if !strings.Contains(connectionURL, crdbReplayLimitParam+"=") {
+		return connectionURL, crdbDefaultReplayLimit, nil
+	}
+
+	dnsURL, err := url.Parse(connectionURL)
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	query := dnsURL.Query()
+
+	limit, err := strconv.Atoi(query.Get(crdbReplayLimitParam))
+	if err != nil || limit < 1 {
+		return "", 0, fmt.Errorf("invalid %s: expected a positive number of operations", crdbReplayLimitParam)
+	}
+
+	query.Del(crdbReplayLimitParam)
+	dnsURL.RawQuery = query.Encode()
+
+	return dnsURL.String(), limit, nil
+}
+
+// crdbReplay are the operations applied to a CockroachDB transaction, which are replayed if the transaction restarts.
+// At most "limit" operations are kept, so that a long transaction does not hold the records of every batch it wrote:
+// once more are applied, the operations are dropped and a restart fails the transaction instead.
+type crdbReplay struct {
+	limit    int
+	fns      []TxnChanFn
+	overflow bool
+}
+
+// record will keep the operation to be replayed, or drop every operation if the limit is exceeded.
+func (replay *crdbReplay) record(fn TxnChanFn) {
+	if replay.overflow {
+		return
+	}
+
+	if len(replay.fns) >= replay.limit {
+		replay.fns = nil
+		replay.overflow = true
+
+		return
+	}
+
+	replay.fns = append(replay.fns, fn)
+}
+
+// isCockroachRetryable will return true if the error is a CockroachDB serialization error, i.e. the transaction
+// conflicted with a concurrent transaction and must be restarted.
+func isCockroachRetryable(err error) bool {
+	var pqErr *pq.Error
+
+	return errors.As(err, &pqErr) && pqErr.Code == crdbRetryCode
+}
+
+// beginCockroachTx will set the savepoint that the transaction is restarted from.
+func beginCockroachTx(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT "+crdbSavepoint); err != nil {
+		return fmt.Errorf("unable to set savepoint: %w", err)
+	}
+
+	return nil
+}
+
+// retryCockroachTx will restart the transaction while "err" is a serialization error, rolling back to the savepoint
+// and replaying the applied functions. If "release" is set, the savepoint is released once the functions have been
+// applied, which is where CockroachDB reports most serialization errors. Every restart is also spent from the retry
+// budget of the run, if any. A transaction whose functions exceeded the replay limit can not be restarted.
+func (pg *Postgres) retryCockroachTx(ctx context.Context, tx *sql.Tx, replay *crdbReplay, release bool,
+	err error,
+) error {
+	for retries := 0; ; retries++ {
+		if err == nil && release {
+			if _, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT "+crdbSavepoint); err != nil {
+				err = fmt.Errorf("unable to release savepoint: %w", err)
+			}
+		}
+
+		if !isCockroachRetryable(err) {
+			return err
+		}
+
+		if replay.overflow {
+			return CockroachReplayLimitError(replay.limit, err)
+		}
+
+		if retries == crdbRetryLimit {
+			return CockroachRetryLimitError(err)
+		}
+
+		if budgetErr := tools.RetryBudgetFromContext(ctx).Spend(0, err); budgetErr != nil {
+			return budgetErr
+		}
+
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+crdbSavepoint); err != nil {
+			return fmt.Errorf("unable to restart transaction: %w", err)
+		}
+
+		err = nil
+		for _, fn := range replay.fns {
+			if err = fn(ctx, pg); err != nil {
+				break
+			}
+		}
+	}
+}
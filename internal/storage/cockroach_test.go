@@ -0,0 +1,189 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/lib/pq"
+)
+
+// crdbConn is a database connection that records the statements it executes, and fails to release the savepoint
+// with a serialization error until "conflicts" is zero.
+type crdbConn struct {
+	mtx        sync.Mutex
+	statements []string
+	conflicts  int
+}
+
+func (conn *crdbConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (conn *crdbConn) Close() error                        { return nil }
+func (conn *crdbConn) Begin() (driver.Tx, error)           { return conn, nil }
+func (conn *crdbConn) Commit() error                       { return nil }
+func (conn *crdbConn) Rollback() error                     { return nil }
+
+func (conn *crdbConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+
+	conn.statements = append(conn.statements, query)
+
+	if strings.HasPrefix(query, "RELEASE") && conn.conflicts > 0 {
+		conn.conflicts--
+
+		return nil, &pq.Error{Code: crdbRetryCode, Message: "restart transaction"}
+	}
+
+	return driver.ResultNoRows, nil
+}
+
+type crdbConnector struct{ conn *crdbConn }
+
+func (c crdbConnector) Connect(context.Context) (driver.Conn, error) { return c.conn, nil }
+func (c crdbConnector) Driver() driver.Driver                        { return nil }
+
+func TestCockroach(t *testing.T) {
+	t.Parallel()
+
+	t.Run("parse", func(t *testing.T) {
+		t.Parallel()
+
+		dns, ok := parseCockroach("cockroachdb://root@crdb1:26257/defaultdb?sslmode=disable")
+		if !ok || dns != "postgresql://root@crdb1:26257/defaultdb?sslmode=disable" {
+			t.Fatalf("unexpected connection string %q", dns)
+		}
+
+		if _, ok := parseCockroach("postgresql://root@postgres1:5432/defaultdb"); ok {
+			t.Fatal("expected a postgres connection string not to be cockroachdb")
+		}
+	})
+
+	t.Run("load maintenance", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := NewPostgres(context.Background(), "cockroachdb://root@crdb1:26257/defaultdb?load_maintenance=true")
+		if !errors.Is(err, ErrCockroachLoadMaintenance) {
+			t.Fatalf("expected load maintenance error, got %v", err)
+		}
+
+		_, err = NewPostgres(context.Background(), "cockroachdb://root@crdb1:26257/defaultdb?hypertable.candles=time")
+		if !errors.Is(err, ErrCockroachHypertable) {
+			t.Fatalf("expected hypertable error, got %v", err)
+		}
+	})
+
+	t.Run("replay limit", func(t *testing.T) {
+		t.Parallel()
+
+		dns, limit, err := parseCockroachReplayLimit("postgresql://root@crdb1:26257/defaultdb?crdb_replay_limit=5")
+		if err != nil || limit != 5 || dns != "postgresql://root@crdb1:26257/defaultdb" {
+			t.Fatalf("unexpected replay limit %d of %q: %v", limit, dns, err)
+		}
+
+		if _, limit, _ := parseCockroachReplayLimit("postgresql://root@crdb1:26257/defaultdb"); limit != 1000 {
+			t.Fatalf("expected the default replay limit, got %d", limit)
+		}
+
+		if _, _, err := parseCockroachReplayLimit("postgresql://crdb1/db?crdb_replay_limit=0"); err == nil {
+			t.Fatal("expected an error for a replay limit of zero")
+		}
+
+		replay := &crdbReplay{limit: 2}
+		for idx := 0; idx < 3; idx++ {
+			replay.record(func(context.Context, Storage) error { return nil })
+		}
+
+		if !replay.overflow || replay.fns != nil {
+			t.Fatalf("expected the operations to be dropped past the limit, got %d", len(replay.fns))
+		}
+
+		conn := &crdbConn{conflicts: 1}
+		pg := &Postgres{DB: sql.OpenDB(crdbConnector{conn}), cockroach: true}
+
+		tx, err := pg.DB.BeginTx(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("failed to begin: %v", err)
+		}
+
+		if err := pg.retryCockroachTx(context.Background(), tx, replay, true, nil); !errors.Is(err,
+			ErrCockroachReplayLimit) {
+			t.Fatalf("expected the replay limit error, got %v", err)
+		}
+	})
+
+	retry := func(t *testing.T, ctx context.Context, conflicts int) (int, *crdbConn, error) {
+		t.Helper()
+
+		conn := &crdbConn{conflicts: conflicts}
+		pg := &Postgres{DB: sql.OpenDB(crdbConnector{conn}), cockroach: true}
+
+		tx, err := pg.DB.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("failed to begin: %v", err)
+		}
+
+		applied := 0
+		fns := []TxnChanFn{func(context.Context, Storage) error {
+			applied++
+
+			return nil
+		}}
+
+		err = pg.retryCockroachTx(ctx, tx, &crdbReplay{limit: crdbDefaultReplayLimit, fns: fns}, true, nil)
+
+		return applied, conn, err
+	}
+
+	t.Run("restart", func(t *testing.T) {
+		t.Parallel()
+
+		applied, conn, err := retry(t, context.Background(), 2)
+		if err != nil {
+			t.Fatalf("expected the transaction to be restarted, got %v", err)
+		}
+
+		if applied != 2 {
+			t.Fatalf("expected the function to be replayed twice, got %d", applied)
+		}
+
+		exp := "RELEASE,ROLLBACK,RELEASE,ROLLBACK,RELEASE"
+		got := make([]string, 0, len(conn.statements))
+
+		for _, statement := range conn.statements {
+			got = append(got, strings.Fields(statement)[0])
+		}
+
+		if strings.Join(got, ",") != exp {
+			t.Fatalf("expected statements %s, got %v", exp, conn.statements)
+		}
+	})
+
+	t.Run("retry limit", func(t *testing.T) {
+		t.Parallel()
+
+		if _, _, err := retry(t, context.Background(), 100); !errors.Is(err, ErrCockroachRetryLimit) {
+			t.Fatalf("expected the retry limit error, got %v", err)
+		}
+	})
+
+	t.Run("retry budget", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := tools.ContextWithRetryBudget(context.Background(), tools.NewRetryBudget(1, 0))
+		if applied, _, err := retry(t, ctx, 100); !errors.Is(err, tools.ErrRetryBudgetExhausted) || applied != 1 {
+			t.Fatalf("expected the retry budget to be exhausted after 1 retry, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,144 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/alpine-hodler/gidari/record"
+	"github.com/alpine-hodler/gidari/tools"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// mdbCodecParam is the connection string parameter for the codec used to write the records to every collection,
+	// e.g. "codec=json". The codec for a single collection is set with "codec.<collection>", e.g.
+	// "codec.candles=extjson". The codec parameters are removed from the connection string before connecting.
+	mdbCodecParam = "codec"
+
+	// MongoCodecBSON writes nested objects and arrays as native BSON documents and arrays. This is the default.
+	MongoCodecBSON = "bson"
+
+	// MongoCodecJSON writes nested objects and arrays as JSON strings, so that every document has a flat shape.
+	MongoCodecJSON = "json"
+
+	// MongoCodecExtJSON decodes the records as MongoDB Extended JSON, so that values such as {"$date": ...} and
+	// {"$oid": ...} are written as the BSON types they describe.
+	MongoCodecExtJSON = "extjson"
+)
+
+var ErrUnsupportedCodec = fmt.Errorf("unsupported codec")
+
+// UnsupportedCodecError is returned when the codec on a connection string is not supported.
+func UnsupportedCodecError(codec string) error {
+	return fmt.Errorf("%w: %q, expected %q, %q, or %q", ErrUnsupportedCodec, codec, MongoCodecBSON, MongoCodecJSON,
+		MongoCodecExtJSON)
+}
+
+// mongoCodecs are the codecs used to write records to the collections of a MongoDB database.
+type mongoCodecs struct {
+	// fallback is the codec for collections without a codec of their own.
+	fallback    string
+	collections map[string]string
+}
+
+// codec will return the codec for the collection.
+func (codecs *mongoCodecs) codec(collection string) string {
+	if codecs == nil {
+		return MongoCodecBSON
+	}
+
+	if codec, ok := codecs.collections[collection]; ok {
+		return codec
+	}
+
+	return codecs.fallback
+}
+
+func validateCodec(codec string) error {
+	switch codec {
+	case MongoCodecBSON, MongoCodecJSON, MongoCodecExtJSON:
+		return nil
+	default:
+		return UnsupportedCodecError(codec)
+	}
+}
+
+// parseMongoCodecs will remove the codec parameters from the connection URI, returning the codecs they configure.
+func parseMongoCodecs(uri string) (string, *mongoCodecs, error) {
+	if !strings.Contains(uri, mdbCodecParam) {
+		return uri, nil, nil
+	}
+
+	dnsURL, err := url.Parse(uri)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to parse connection URI: %w", err)
+	}
+
+	codecs := &mongoCodecs{fallback: MongoCodecBSON, collections: make(map[string]string)}
+	query := dnsURL.Query()
+
+	for key := range query {
+		collection := strings.TrimPrefix(key, mdbCodecParam+".")
+		if key != mdbCodecParam && collection == key {
+			continue
+		}
+
+		codec := strings.ToLower(query.Get(key))
+		if err := validateCodec(codec); err != nil {
+			return "", nil, err
+		}
+
+		if key == mdbCodecParam {
+			codecs.fallback = codec
+		} else {
+			codecs.collections[collection] = codec
+		}
+
+		query.Del(key)
+	}
+
+	dnsURL.RawQuery = query.Encode()
+
+	return dnsURL.String(), codecs, nil
+}
+
+// encodeMongoDocument will encode the record as a BSON document using the codec.
+func encodeMongoDocument(codec string, rec *structpb.Struct) (bson.D, error) {
+	switch codec {
+	case MongoCodecJSON:
+		doc, err := record.ToBSON(rec, &record.Options{Nested: record.NestedJSON})
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert record to bson document: %w", err)
+		}
+
+		return doc, nil
+	case MongoCodecExtJSON:
+		data, err := rec.MarshalJSON()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", tools.ErrFailedToMarshalJSON, err)
+		}
+
+		doc := bson.D{}
+		if err := bson.UnmarshalExtJSON(data, false, &doc); err != nil {
+			return nil, fmt.Errorf("%v: %w", tools.ErrFailedToUnmarshalBSON, err)
+		}
+
+		return doc, nil
+	default:
+		doc, err := record.ToBSON(rec, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert record to bson document: %w", err)
+		}
+
+		return doc, nil
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestMongoCodecs(t *testing.T) {
+	t.Parallel()
+
+	t.Run("parse", func(t *testing.T) {
+		t.Parallel()
+
+		uri, codecs, err := parseMongoCodecs("mongodb://mongo1:27017/db?codec=json&codec.events=extjson&w=majority")
+		if err != nil {
+			t.Fatalf("failed to parse codecs: %v", err)
+		}
+
+		if uri != "mongodb://mongo1:27017/db?w=majority" {
+			t.Fatalf("expected the codec parameters to be removed, got %q", uri)
+		}
+
+		if codecs.codec("events") != MongoCodecExtJSON || codecs.codec("candles") != MongoCodecJSON {
+			t.Fatalf("unexpected codecs: %+v", codecs)
+		}
+
+		if _, _, err := parseMongoCodecs("mongodb://mongo1:27017/db?codec=xml"); !errors.Is(err, ErrUnsupportedCodec) {
+			t.Fatalf("expected unsupported codec error, got %v", err)
+		}
+
+		var none *mongoCodecs
+		if none.codec("candles") != MongoCodecBSON {
+			t.Fatal("expected bson to be the default codec")
+		}
+	})
+
+	t.Run("encode", func(t *testing.T) {
+		t.Parallel()
+
+		record, err := structpb.NewStruct(map[string]interface{}{
+			"id":      "1",
+			"product": map[string]interface{}{"base": "BTC", "quote": "USD"},
+			"time":    map[string]interface{}{"$date": "2022-05-10T00:00:00Z"},
+		})
+		if err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+
+		for _, tcase := range []struct {
+			codec string
+			check func(bson.M) bool
+		}{
+			{
+				codec: MongoCodecBSON,
+				check: func(doc bson.M) bool {
+					product, ok := doc["product"].(bson.M)
+
+					return ok && product["base"] == "BTC"
+				},
+			},
+			{
+				codec: MongoCodecJSON,
+				check: func(doc bson.M) bool {
+					return doc["product"] == `{"base":"BTC","quote":"USD"}` && doc["id"] == "1"
+				},
+			},
+			{
+				codec: MongoCodecExtJSON,
+				check: func(doc bson.M) bool {
+					date, ok := doc["time"].(primitive.DateTime)
+
+					return ok && date.Time().Equal(time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC))
+				},
+			},
+		} {
+			doc, err := encodeMongoDocument(tcase.codec, record)
+			if err != nil {
+				t.Fatalf("failed to encode document with %s: %v", tcase.codec, err)
+			}
+
+			data, err := bson.Marshal(doc)
+			if err != nil {
+				t.Fatalf("failed to marshal document: %v", err)
+			}
+
+			var decoded bson.M
+			if err := bson.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("failed to unmarshal document: %v", err)
+			}
+
+			if !tcase.check(decoded) {
+				t.Fatalf("unexpected %s document: %v", tcase.codec, decoded)
+			}
+		}
+	})
+}
+
+func FuzzEncodeMongoDocument(f *testing.F) {
+	for _, seed := range []string{
+		`{}`,
+		`{"id": "1", "price": 1.5, "buy": true, "note": null}`,
+		`{"nested": {"a": [1, "b", {"c": null}]}, "list": []}`,
+		`{"created": {"$date": "2022-08-01T00:00:00Z"}, "_id": {"$oid": "62f9b5f0c2a1b2c3d4e5f6a7"}}`,
+	} {
+		for _, codec := range []string{MongoCodecBSON, MongoCodecJSON, MongoCodecExtJSON} {
+			f.Add([]byte(seed), codec)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, codec string) {
+		if validateCodec(codec) != nil {
+			return
+		}
+
+		record := new(structpb.Struct)
+		if err := record.UnmarshalJSON(data); err != nil {
+			return
+		}
+
+		doc, err := encodeMongoDocument(codec, record)
+		if err != nil {
+			return
+		}
+
+		if codec != MongoCodecJSON {
+			return
+		}
+
+		// The JSON codec writes a flat document: nested objects and arrays are JSON strings of the same values.
+		fields := record.AsMap()
+		for _, elem := range doc {
+			want := fields[elem.Key]
+
+			switch want.(type) {
+			case map[string]interface{}, []interface{}:
+				str, ok := elem.Value.(string)
+				if !ok {
+					t.Fatalf("expected %q to be a JSON string, got %T", elem.Key, elem.Value)
+				}
+
+				var got interface{}
+				if err := json.Unmarshal([]byte(str), &got); err != nil || !reflect.DeepEqual(got, want) {
+					t.Fatalf("expected %q to encode %v, got %s", elem.Key, want, str)
+				}
+			default:
+				if !reflect.DeepEqual(elem.Value, want) {
+					t.Fatalf("expected %q to be %v, got %v", elem.Key, want, elem.Value)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,881 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	couchDBScheme = "couchdb"
+
+	// couchDBPort is the default port of CouchDB.
+	couchDBPort = "5984"
+
+	// couchDBTLSParam is the connection string parameter that connects to the server with HTTPS, e.g. "tls=true".
+	couchDBTLSParam = "tls"
+
+	// couchDBPrefixParam is the connection string parameter for the prefix of the database names of the tables, e.g.
+	// "prefix=gidari_". The database of a table is the prefix and the table, in lower case.
+	couchDBPrefixParam = "prefix"
+
+	// couchDBPrimaryKeyParam is the connection string parameter for the field of the records that is the ID of their
+	// documents in every database, e.g. "primaryKey=id". The field for a single table is set with
+	// "primaryKey.<table>", e.g. "primaryKey.candles=time".
+	couchDBPrimaryKeyParam = "primaryKey"
+
+	// couchDBConflictParam is the connection string parameter for how the records are written over the existing
+	// documents with the same ID, see the "CouchDBConflict" constants.
+	couchDBConflictParam = "conflict"
+
+	couchDBDefaultPrimaryKey = "id"
+
+	// couchDBBatchDocs is the number of documents written by each "_bulk_docs" request, and read by each page of a
+	// query.
+	couchDBBatchDocs = 1000
+
+	// couchDBConflictRetries is the number of times that the documents of a batch that conflict with a concurrent
+	// write are written again with their new revisions.
+	couchDBConflictRetries = 3
+)
+
+const (
+	// CouchDBConflictOverwrite replaces the existing documents with the records. Documents that are changed by a
+	// concurrent write are written again with their new revisions.
+	CouchDBConflictOverwrite = "overwrite"
+
+	// CouchDBConflictMerge merges the fields of the records into the existing documents, keeping the fields that are
+	// not on the records. Documents that are changed by a concurrent write are merged again.
+	CouchDBConflictMerge = "merge"
+
+	// CouchDBConflictSkip keeps the existing documents, and only writes the records without a document.
+	CouchDBConflictSkip = "skip"
+
+	// CouchDBConflictFail replaces the existing documents with the records, and fails the upsert if a document is
+	// changed by a concurrent write.
+	CouchDBConflictFail = "fail"
+)
+
+var (
+	ErrCouchDB           = fmt.Errorf("couchdb request failed")
+	ErrCouchDBPrimaryKey = fmt.Errorf("invalid couchdb primary key")
+	ErrCouchDBConflict   = fmt.Errorf("couchdb document update conflict")
+)
+
+// CouchDBError is returned when a CouchDB API request fails.
+func CouchDBError(method, path string, err error) error {
+	return fmt.Errorf("%w: %s %s: %v", ErrCouchDB, method, path, err)
+}
+
+// CouchDBPrimaryKeyError is returned when the primary key of a record cannot be the ID of a document.
+func CouchDBPrimaryKeyError(table, field string) error {
+	return fmt.Errorf("%w: the %q field of records of %q must be a string, number, or boolean", ErrCouchDBPrimaryKey,
+		field, table)
+}
+
+// CouchDBConflictError is returned when documents conflict with concurrent writes after the retries of the conflict
+// policy.
+func CouchDBConflictError(database string, ids []string) error {
+	return fmt.Errorf("%w: %d documents of %s, e.g. %q", ErrCouchDBConflict, len(ids), database, ids[0])
+}
+
+// couchDBResult is the result of writing a document with "_bulk_docs".
+type couchDBResult struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev"`
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// couchDBRow is a row of "_all_docs".
+type couchDBRow struct {
+	ID    string `json:"id"`
+	Key   string `json:"key"`
+	Error string `json:"error"`
+	Value struct {
+		Rev     string `json:"rev"`
+		Deleted bool   `json:"deleted"`
+	} `json:"value"`
+	Doc map[string]interface{} `json:"doc"`
+}
+
+// couchDBTxType is the type of the context key of CouchDB transactions.
+type couchDBTxType uint8
+
+const (
+	basicCouchDBTxID couchDBTxType = iota
+)
+
+// couchDBWrite is the records of an upsert to a table.
+type couchDBWrite struct {
+	table   string
+	records []*structpb.Struct
+}
+
+// couchDBTx are the upserts of a transaction, written when the transaction commits.
+type couchDBTx struct {
+	mtx    sync.Mutex
+	writes []couchDBWrite
+}
+
+// CouchDB is a storage device that writes records as the documents of CouchDB databases, a database per table. Each
+// record is a document with the primary key of the record as its ID, written with "_bulk_docs". How the records are
+// written over existing documents is set by the conflict policy.
+type CouchDB struct {
+	endpoint    string
+	client      *http.Client
+	user        *url.Userinfo
+	prefix      string
+	conflict    string
+	primaryKey  string
+	primaryKeys map[string]string
+
+	// databases are the databases that have been created or found to exist.
+	mtx       sync.Mutex
+	databases map[string]bool
+
+	// activeTx are the transactions that are currently active, keyed by the transaction ID that is added to the
+	// context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewCouchDB will return a CouchDB storage device for the connection string, i.e.
+// "couchdb://[user:password@]host[:port][?tls=true&prefix=<prefix>&conflict=<policy>]". Requests are authorized with
+// the user and password of the connection string. The ID of each document is the "primaryKey" field of its record
+// (default "id", or "primaryKey.<table>" for a single table), and the conflict policy is "overwrite" by default.
+func NewCouchDB(_ context.Context, connectionURL string) (*CouchDB, error) {
+	uri, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	if uri.Host == "" {
+		return nil, DNSNotSupportedError(connectionURL)
+	}
+
+	host := uri.Host
+	if uri.Port() == "" {
+		host = net.JoinHostPort(uri.Hostname(), couchDBPort)
+	}
+
+	stg := &CouchDB{
+		endpoint:    "http://" + host,
+		client:      compliance.HTTPClient(),
+		user:        uri.User,
+		conflict:    CouchDBConflictOverwrite,
+		primaryKey:  couchDBDefaultPrimaryKey,
+		primaryKeys: make(map[string]string),
+		databases:   make(map[string]bool),
+	}
+
+	for key, values := range uri.Query() {
+		switch table := strings.TrimPrefix(key, couchDBPrimaryKeyParam+"."); {
+		case key == couchDBTLSParam:
+			if tls, err := strconv.ParseBool(values[0]); err != nil {
+				return nil, fmt.Errorf("%w: %s=%q must be a boolean", ErrDNSNotSupported, key, values[0])
+			} else if tls {
+				stg.endpoint = "https://" + host
+			}
+		case key == couchDBPrefixParam:
+			stg.prefix = values[0]
+		case key == couchDBConflictParam:
+			switch values[0] {
+			case CouchDBConflictOverwrite, CouchDBConflictMerge, CouchDBConflictSkip, CouchDBConflictFail:
+				stg.conflict = values[0]
+			default:
+				return nil, fmt.Errorf("%w: %s=%q must be %q, %q, %q, or %q", ErrDNSNotSupported, key, values[0],
+					CouchDBConflictOverwrite, CouchDBConflictMerge, CouchDBConflictSkip, CouchDBConflictFail)
+			}
+		case key == couchDBPrimaryKeyParam:
+			stg.primaryKey = values[0]
+		case table != key:
+			stg.primaryKeys[table] = values[0]
+		}
+	}
+
+	return stg, nil
+}
+
+// Close implements the storage interface. The requests to the server do not hold a connection open.
+func (stg *CouchDB) Close() {}
+
+// IsNoSQL returns "true" to indicate that "CouchDB" is a NoSQL database.
+func (stg *CouchDB) IsNoSQL() bool { return true }
+
+// Type implements the storage interface.
+func (stg *CouchDB) Type() uint8 { return CouchDBType }
+
+// tablePrimaryKey will return the field of the records of the table that is the ID of their documents.
+func (stg *CouchDB) tablePrimaryKey(table string) string {
+	if field, ok := stg.primaryKeys[table]; ok {
+		return field
+	}
+
+	return stg.primaryKey
+}
+
+// database will return the name of the database of the table: the prefix and the table in lower case, with the
+// characters that database names must not contain replaced with underscores. Database names must start with a
+// letter, so "db_" is added before names that do not.
+func (stg *CouchDB) database(table string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || strings.ContainsRune("_$()+-/", r) {
+			return r
+		}
+
+		return '_'
+	}, strings.ToLower(stg.prefix+table))
+
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "db_" + name
+	}
+
+	return name
+}
+
+// call will make a request to the server, and decode the response into "out" if it is not nil. The status code of
+// the response is returned with the error of an unsuccessful request, with the error and reason in the message.
+func (stg *CouchDB) call(ctx context.Context, method, path string, query url.Values, body,
+	out interface{},
+) (int, error) {
+	var reqBody io.Reader
+
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, CouchDBError(method, path, err)
+		}
+
+		reqBody = bytes.NewReader(data)
+	}
+
+	target := stg.endpoint + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reqBody)
+	if err != nil {
+		return 0, CouchDBError(method, path, err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	if stg.user != nil {
+		password, _ := stg.user.Password()
+		req.SetBasicAuth(stg.user.Username(), password)
+	}
+
+	rsp, err := stg.client.Do(req)
+	if err != nil {
+		return 0, CouchDBError(method, path, err)
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode/100 != 2 {
+		var apiErr struct {
+			Error  string `json:"error"`
+			Reason string `json:"reason"`
+		}
+
+		msg, _ := io.ReadAll(io.LimitReader(rsp.Body, 1<<10))
+		if json.Unmarshal(msg, &apiErr) == nil && apiErr.Error != "" {
+			msg = []byte(apiErr.Error + ": " + apiErr.Reason)
+		}
+
+		return rsp.StatusCode, CouchDBError(method, path, fmt.Errorf("unexpected status %q: %s", rsp.Status,
+			bytes.TrimSpace(msg)))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(rsp.Body).Decode(out); err != nil {
+			return rsp.StatusCode, CouchDBError(method, path, fmt.Errorf("unable to decode response: %w", err))
+		}
+	}
+
+	return rsp.StatusCode, nil
+}
+
+// ensureDatabase will create the database if it has not been created or found to exist.
+func (stg *CouchDB) ensureDatabase(ctx context.Context, database string) error {
+	stg.mtx.Lock()
+	defer stg.mtx.Unlock()
+
+	if stg.databases[database] {
+		return nil
+	}
+
+	status, err := stg.call(ctx, http.MethodPut, "/"+url.PathEscape(database), nil, nil, nil)
+	if err != nil && status != http.StatusPreconditionFailed {
+		return fmt.Errorf("unable to create database %s: %w", database, err)
+	}
+
+	stg.databases[database] = true
+
+	return nil
+}
+
+// documents will return the documents of the records of the table, keyed by their IDs, and the documents without a
+// primary key, which are written with a generated ID.
+func (stg *CouchDB) documents(table string, records []*structpb.Struct) (map[string]map[string]interface{},
+	[]interface{}, error,
+) {
+	field := stg.tablePrimaryKey(table)
+	keyed := make(map[string]map[string]interface{}, len(records))
+
+	var unkeyed []interface{}
+
+	for _, record := range records {
+		doc := record.AsMap()
+
+		value, ok := record.GetFields()[field]
+		if !ok || value.AsInterface() == nil {
+			unkeyed = append(unkeyed, doc)
+
+			continue
+		}
+
+		id, ok := redisPrimaryKey(value)
+		if !ok {
+			return nil, nil, CouchDBPrimaryKeyError(table, field)
+		}
+
+		// Only the last of the records with the same ID is written, which is the last write of the ID.
+		doc["_id"] = id
+		keyed[id] = doc
+	}
+
+	return keyed, unkeyed, nil
+}
+
+// current will return the rows of "_all_docs" for the IDs, with the existing documents if they are merged.
+func (stg *CouchDB) current(ctx context.Context, database string, ids []string) (map[string]couchDBRow, error) {
+	var rsp struct {
+		Rows []couchDBRow `json:"rows"`
+	}
+
+	query := url.Values{"include_docs": {strconv.FormatBool(stg.conflict == CouchDBConflictMerge)}}
+	path := "/" + url.PathEscape(database) + "/_all_docs"
+
+	if _, err := stg.call(ctx, http.MethodPost, path, query, map[string]interface{}{"keys": ids}, &rsp); err != nil {
+		return nil, err
+	}
+
+	rows := make(map[string]couchDBRow, len(rsp.Rows))
+
+	for _, row := range rsp.Rows {
+		if row.Error == "" && !row.Value.Deleted {
+			rows[row.Key] = row
+		}
+	}
+
+	return rows, nil
+}
+
+// bulkDocs will write the documents with "_bulk_docs", and return the IDs of the documents that conflict with a
+// concurrent write. Errors other than conflicts fail the write.
+func (stg *CouchDB) bulkDocs(ctx context.Context, database string, docs []interface{}) ([]string, error) {
+	var results []couchDBResult
+
+	path := "/" + url.PathEscape(database) + "/_bulk_docs"
+	if _, err := stg.call(ctx, http.MethodPost, path, nil, map[string]interface{}{"docs": docs}, &results); err != nil {
+		return nil, err
+	}
+
+	var conflicts []string
+
+	for _, result := range results {
+		switch result.Error {
+		case "":
+		case "conflict":
+			conflicts = append(conflicts, result.ID)
+		default:
+			return nil, CouchDBError(http.MethodPost, path, fmt.Errorf("%q: %s: %s", result.ID, result.Error,
+				result.Reason))
+		}
+	}
+
+	return conflicts, nil
+}
+
+// write will write the records of the table to its database with the conflict policy, in batches of
+// "couchDBBatchDocs" documents. The documents of a batch that conflict with concurrent writes are written again with
+// their new revisions, up to "couchDBConflictRetries" times, unless the policy skips or fails them.
+func (stg *CouchDB) write(ctx context.Context, table string, records []*structpb.Struct) error {
+	database := stg.database(table)
+
+	if err := stg.ensureDatabase(ctx, database); err != nil {
+		return err
+	}
+
+	keyed, unkeyed, err := stg.documents(table, records)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(unkeyed); start += couchDBBatchDocs {
+		end := start + couchDBBatchDocs
+		if end > len(unkeyed) {
+			end = len(unkeyed)
+		}
+
+		if _, err := stg.bulkDocs(ctx, database, unkeyed[start:end]); err != nil {
+			return err
+		}
+	}
+
+	ids := make([]string, 0, len(keyed))
+	for id := range keyed {
+		ids = append(ids, id)
+	}
+
+	for start := 0; start < len(ids); start += couchDBBatchDocs {
+		end := start + couchDBBatchDocs
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		if err := stg.writeKeyed(ctx, database, ids[start:end], keyed); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeKeyed will write the documents with the IDs over the existing documents with the conflict policy.
+func (stg *CouchDB) writeKeyed(ctx context.Context, database string, ids []string,
+	keyed map[string]map[string]interface{},
+) error {
+	for attempt := 0; ; attempt++ {
+		existing, err := stg.current(ctx, database, ids)
+		if err != nil {
+			return err
+		}
+
+		docs := make([]interface{}, 0, len(ids))
+
+		for _, id := range ids {
+			row, ok := existing[id]
+
+			switch {
+			case !ok:
+				docs = append(docs, keyed[id])
+			case stg.conflict == CouchDBConflictSkip:
+			case stg.conflict == CouchDBConflictMerge:
+				merged := make(map[string]interface{}, len(row.Doc)+len(keyed[id]))
+				for key, value := range row.Doc {
+					merged[key] = value
+				}
+
+				for key, value := range keyed[id] {
+					merged[key] = value
+				}
+
+				merged["_rev"] = row.Value.Rev
+				docs = append(docs, merged)
+			default:
+				doc := make(map[string]interface{}, len(keyed[id])+1)
+				for key, value := range keyed[id] {
+					doc[key] = value
+				}
+
+				doc["_rev"] = row.Value.Rev
+				docs = append(docs, doc)
+			}
+		}
+
+		if len(docs) == 0 {
+			return nil
+		}
+
+		conflicts, err := stg.bulkDocs(ctx, database, docs)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case len(conflicts) == 0 || stg.conflict == CouchDBConflictSkip:
+			return nil
+		case stg.conflict == CouchDBConflictFail || attempt == couchDBConflictRetries:
+			return CouchDBConflictError(database, conflicts)
+		}
+
+		ids = conflicts
+	}
+}
+
+// Upsert will write each record as a document of the database of the table, with the primary key of the record as
+// its ID, over the existing document with the ID as set by the conflict policy. Records without a primary key are
+// added with a generated ID. Within a transaction, the records are written when the transaction commits.
+func (stg *CouchDB) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	if len(records) == 0 {
+		return &proto.UpsertResponse{}, nil
+	}
+
+	// The primary keys are checked before the records are buffered by a transaction.
+	if _, _, err := stg.documents(req.GetTable(), records); err != nil {
+		return nil, err
+	}
+
+	if tx := stg.tx(ctx); tx != nil {
+		tx.mtx.Lock()
+		defer tx.mtx.Unlock()
+
+		tx.writes = append(tx.writes, couchDBWrite{table: req.GetTable(), records: records})
+
+		return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+	}
+
+	if err := stg.write(ctx, req.GetTable(), records); err != nil {
+		return nil, fmt.Errorf("unable to upsert records: %w", err)
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *CouchDB) tx(ctx context.Context) *couchDBTx {
+	txID, ok := ctx.Value(basicCouchDBTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	couchTx, _ := tx.(*couchDBTx)
+
+	return couchTx
+}
+
+// couchDBSelector will return the Mango selector that matches the documents with the required fields: an "$eq" for
+// each value, an "$in" for each list, and a field that does not exist or is null for each null.
+func couchDBSelector(required map[string]*structpb.Value) map[string]interface{} {
+	conditions := make([]interface{}, 0, len(required))
+
+	for field, want := range required {
+		switch {
+		case want.GetListValue() != nil:
+			conditions = append(conditions, map[string]interface{}{
+				field: map[string]interface{}{"$in": want.GetListValue().AsSlice()},
+			})
+		case want.AsInterface() == nil:
+			conditions = append(conditions, map[string]interface{}{"$or": []interface{}{
+				map[string]interface{}{field: map[string]interface{}{"$exists": false}},
+				map[string]interface{}{field: map[string]interface{}{"$eq": nil}},
+			}})
+		default:
+			conditions = append(conditions, map[string]interface{}{
+				field: map[string]interface{}{"$eq": want.AsInterface()},
+			})
+		}
+	}
+
+	if len(conditions) == 0 {
+		return map[string]interface{}{"_id": map[string]interface{}{"$gt": nil}}
+	}
+
+	return map[string]interface{}{"$and": conditions}
+}
+
+// Read will return the documents of the database of the table that match the required fields on the request, in
+// the page requested by the options of the request, if any. The required fields are sent as a Mango selector, and
+// the matching documents are sorted and paged in memory, since sorts with Mango require an index.
+func (stg *CouchDB) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/" + url.PathEscape(stg.database(req.GetTable())) + "/_find"
+	selector := couchDBSelector(req.GetRequired().GetFields())
+
+	var (
+		records  []map[string]interface{}
+		bookmark string
+	)
+
+	for {
+		body := map[string]interface{}{"selector": selector, "limit": couchDBBatchDocs}
+		if bookmark != "" {
+			body["bookmark"] = bookmark
+		}
+
+		var rsp struct {
+			Docs     []map[string]interface{} `json:"docs"`
+			Bookmark string                   `json:"bookmark"`
+		}
+
+		status, err := stg.call(ctx, http.MethodPost, path, nil, body, &rsp)
+		if status == http.StatusNotFound {
+			return &proto.ReadResponse{}, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read records: %w", err)
+		}
+
+		for _, doc := range rsp.Docs {
+			delete(doc, "_id")
+			delete(doc, "_rev")
+
+			records = append(records, doc)
+		}
+
+		if len(rsp.Docs) < couchDBBatchDocs {
+			break
+		}
+
+		bookmark = rsp.Bookmark
+	}
+
+	return redisPage(records, page)
+}
+
+// Count will return the number of documents of the database that match the required fields. Without required fields
+// it is the "doc_count" of the database less its design documents. Mango queries can not count documents, so
+// otherwise only the IDs of the matching documents are found and counted.
+func (stg *CouchDB) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	database := "/" + url.PathEscape(stg.database(req.GetTable()))
+
+	required := req.GetRequired().GetFields()
+	if len(required) == 0 {
+		return stg.countAll(ctx, database)
+	}
+
+	selector := couchDBSelector(required)
+	rsp := new(proto.CountResponse)
+
+	for bookmark := ""; ; {
+		body := map[string]interface{}{"selector": selector, "fields": []string{"_id"}, "limit": couchDBBatchDocs}
+		if bookmark != "" {
+			body["bookmark"] = bookmark
+		}
+
+		var found struct {
+			Docs     []map[string]interface{} `json:"docs"`
+			Bookmark string                   `json:"bookmark"`
+		}
+
+		status, err := stg.call(ctx, http.MethodPost, database+"/_find", nil, body, &found)
+		if status == http.StatusNotFound {
+			return &proto.CountResponse{}, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to count records: %w", err)
+		}
+
+		rsp.Count += int64(len(found.Docs))
+
+		if len(found.Docs) < couchDBBatchDocs {
+			return rsp, nil
+		}
+
+		bookmark = found.Bookmark
+	}
+}
+
+// countAll will return the number of documents of the database at the path, less its design documents.
+func (stg *CouchDB) countAll(ctx context.Context, database string) (*proto.CountResponse, error) {
+	var info struct {
+		DocCount int64 `json:"doc_count"`
+	}
+
+	status, err := stg.call(ctx, http.MethodGet, database, nil, nil, &info)
+	if status == http.StatusNotFound {
+		return &proto.CountResponse{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to count records: %w", err)
+	}
+
+	var design struct {
+		Rows []couchDBRow `json:"rows"`
+	}
+
+	if _, err := stg.call(ctx, http.MethodGet, database+"/_design_docs", nil, nil, &design); err != nil {
+		return nil, fmt.Errorf("unable to count records: %w", err)
+	}
+
+	return &proto.CountResponse{Count: info.DocCount - int64(len(design.Rows))}, nil
+}
+
+// Truncate will delete every document of the databases of the tables, except their design documents. The databases
+// are kept, with their indexes and security.
+func (stg *CouchDB) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	var deleted int32
+
+	for _, table := range req.GetTables() {
+		database := stg.database(table)
+		path := "/" + url.PathEscape(database) + "/_all_docs"
+
+		// Deleted documents are not listed again, so the first page is read until it is empty.
+		for skip := 0; ; {
+			var rsp struct {
+				Rows []couchDBRow `json:"rows"`
+			}
+
+			query := url.Values{"limit": {strconv.Itoa(couchDBBatchDocs)}, "skip": {strconv.Itoa(skip)}}
+
+			status, err := stg.call(ctx, http.MethodGet, path, query, nil, &rsp)
+			if status == http.StatusNotFound {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("error truncating table %s: %w", table, err)
+			}
+
+			docs := make([]interface{}, 0, len(rsp.Rows))
+
+			for _, row := range rsp.Rows {
+				if strings.HasPrefix(row.ID, "_design/") {
+					skip++
+
+					continue
+				}
+
+				docs = append(docs, map[string]interface{}{"_id": row.ID, "_rev": row.Value.Rev, "_deleted": true})
+			}
+
+			if len(docs) == 0 {
+				break
+			}
+
+			if _, err := stg.bulkDocs(ctx, database, docs); err != nil {
+				return nil, fmt.Errorf("error truncating table %s: %w", table, err)
+			}
+
+			deleted += int32(len(docs))
+		}
+	}
+
+	return &proto.TruncateResponse{DeletedCount: deleted}, nil
+}
+
+// ListTables will return the tables of the databases with the prefix of the connection string, with the size in
+// bytes of their active data. System databases, which start with "_", are not listed.
+func (stg *CouchDB) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	var databases []string
+
+	if _, err := stg.call(ctx, http.MethodGet, "/_all_dbs", nil, nil, &databases); err != nil {
+		return nil, fmt.Errorf("unable to list tables: %w", err)
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+	prefix := strings.ToLower(stg.prefix)
+
+	for _, database := range databases {
+		if strings.HasPrefix(database, "_") || !strings.HasPrefix(database, prefix) {
+			continue
+		}
+
+		var info struct {
+			Sizes struct {
+				Active int64 `json:"active"`
+			} `json:"sizes"`
+		}
+
+		if _, err := stg.call(ctx, http.MethodGet, "/"+url.PathEscape(database), nil, nil, &info); err != nil {
+			return nil, fmt.Errorf("unable to list tables: %w", err)
+		}
+
+		rsp.TableSet[strings.TrimPrefix(database, prefix)] = &proto.Table{Size: info.Sizes.Active}
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will return the primary key field of each table.
+func (stg *CouchDB) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	tables, err := stg.ListTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+
+	for table := range tables.GetTableSet() {
+		rsp.PKSet[table] = &proto.PrimaryKeys{List: []string{stg.tablePrimaryKey(table)}}
+	}
+
+	return rsp, nil
+}
+
+// StartTx will start a transaction. The records of the functions sent to the transaction are buffered, and written
+// when the transaction commits. CouchDB has no transactions, so a commit that fails may have written some of the
+// documents. Reads in the transaction do not see its buffered records.
+func (stg *CouchDB) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+	tx := new(couchDBTx)
+
+	stg.activeTx.Store(txnID, tx)
+
+	couchCtx := context.WithValue(ctx, basicCouchDBTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+
+		var err error
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(couchCtx, stg)
+		}
+
+		if err != nil {
+			<-txn.commit
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit {
+			for _, write := range tx.writes {
+				if err = stg.write(ctx, write.table, write.records); err != nil {
+					err = fmt.Errorf("unable to commit transaction: %w", err)
+
+					break
+				}
+			}
+		}
+
+		txn.done <- err
+	}()
+
+	return txn, nil
+}
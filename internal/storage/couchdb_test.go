@@ -0,0 +1,415 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// couchDBServer is an in-memory CouchDB server with the documents of each database, keyed by their IDs. Writes of
+// the IDs in "conflicts" fail with a conflict as many times as the count of the ID.
+type couchDBServer struct {
+	mtx       sync.Mutex
+	dbs       map[string]map[string]map[string]interface{}
+	conflicts map[string]int
+	bulks     int
+}
+
+func (srv *couchDBServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+
+		return
+	}
+
+	var body map[string]interface{}
+
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	dbName, op, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	docs, ok := srv.dbs[dbName]
+
+	switch {
+	case dbName == "_all_dbs":
+		names := []string{"_users"}
+		for name := range srv.dbs {
+			names = append(names, name)
+		}
+
+		_ = json.NewEncoder(w).Encode(names)
+	case r.Method == http.MethodPut && op == "":
+		if ok {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_, _ = w.Write([]byte(`{"error":"file_exists","reason":"The database could not be created."}`))
+
+			return
+		}
+
+		srv.dbs[dbName] = make(map[string]map[string]interface{})
+		w.WriteHeader(http.StatusCreated)
+	case !ok:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":"not_found","reason":"Database does not exist."}`))
+	case op == "":
+		_, _ = w.Write([]byte(`{"doc_count":` + strconv.Itoa(len(docs)) + `,"sizes":{"active":` +
+			strconv.Itoa(len(docs)*100) + `}}`))
+	case op == "_design_docs":
+		rows := []interface{}{}
+
+		for id := range docs {
+			if strings.HasPrefix(id, "_design/") {
+				rows = append(rows, map[string]interface{}{"id": id, "key": id})
+			}
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"rows": rows})
+	case op == "_all_docs":
+		srv.allDocs(w, r, docs, body)
+	case op == "_bulk_docs":
+		srv.bulks++
+		srv.bulkDocs(w, docs, body)
+	case op == "_find":
+		found := []interface{}{}
+
+		for id, doc := range docs {
+			if _, ok := body["fields"]; ok {
+				doc = map[string]interface{}{"_id": id}
+			}
+
+			found = append(found, doc)
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"docs": found, "bookmark": "nil"})
+	}
+}
+
+func (srv *couchDBServer) allDocs(w http.ResponseWriter, r *http.Request, docs map[string]map[string]interface{},
+	body map[string]interface{},
+) {
+	rows := []interface{}{}
+
+	row := func(id string) interface{} {
+		doc, ok := docs[id]
+		if !ok {
+			return map[string]interface{}{"key": id, "error": "not_found"}
+		}
+
+		row := map[string]interface{}{"id": id, "key": id, "value": map[string]interface{}{"rev": doc["_rev"]}}
+		if r.URL.Query().Get("include_docs") == "true" {
+			row["doc"] = doc
+		}
+
+		return row
+	}
+
+	if keys, ok := body["keys"].([]interface{}); ok {
+		for _, key := range keys {
+			rows = append(rows, row(key.(string)))
+		}
+	} else {
+		for id := range docs {
+			rows = append(rows, row(id))
+		}
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"rows": rows})
+}
+
+func (srv *couchDBServer) bulkDocs(w http.ResponseWriter, docs map[string]map[string]interface{},
+	body map[string]interface{},
+) {
+	results := []interface{}{}
+
+	for i, value := range body["docs"].([]interface{}) {
+		doc := value.(map[string]interface{})
+
+		id, _ := doc["_id"].(string)
+		if id == "" {
+			id = "generated-" + strconv.Itoa(len(docs)+i)
+		}
+
+		current, exists := docs[id]
+		if srv.conflicts[id] > 0 || (exists && doc["_rev"] != current["_rev"]) || (!exists && doc["_rev"] != nil) {
+			srv.conflicts[id]--
+
+			results = append(results, map[string]interface{}{"id": id, "error": "conflict",
+				"reason": "Document update conflict."})
+
+			continue
+		}
+
+		if doc["_deleted"] == true {
+			delete(docs, id)
+		} else {
+			rev := 1
+			if exists {
+				rev, _ = strconv.Atoi(strings.TrimSuffix(current["_rev"].(string), "-x"))
+				rev++
+			}
+
+			doc["_id"], doc["_rev"] = id, strconv.Itoa(rev)+"-x"
+			docs[id] = doc
+		}
+
+		results = append(results, map[string]interface{}{"id": id, "rev": doc["_rev"]})
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+func TestCouchDB(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	newCouchDB := func(t *testing.T, query string) (*CouchDB, *couchDBServer) {
+		t.Helper()
+
+		srv := &couchDBServer{
+			dbs: map[string]map[string]map[string]interface{}{
+				"app_products": {"p-1": {"_id": "p-1", "_rev": "1-x", "id": "p-1", "name": "old", "color": "red"}},
+			},
+			conflicts: make(map[string]int),
+		}
+
+		server := httptest.NewServer(srv)
+		t.Cleanup(server.Close)
+
+		stg, err := NewCouchDB(ctx, "couchdb://admin:secret@"+strings.TrimPrefix(server.URL, "http://")+
+			"?prefix=app_&"+query)
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+
+		return stg, srv
+	}
+
+	upsert := func(stg *CouchDB, table string, records ...map[string]interface{}) error {
+		data, _ := json.Marshal(records)
+		_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: table, Data: data})
+
+		return err
+	}
+
+	t.Run("database", func(t *testing.T) {
+		t.Parallel()
+
+		stg, _ := newCouchDB(t, "")
+
+		for table, exp := range map[string]string{"Candles": "app_candles", "2022.rates": "app_2022_rates"} {
+			if got := stg.database(table); got != exp {
+				t.Fatalf("expected database %q for %q, got %q", exp, table, got)
+			}
+		}
+
+		stg.prefix = ""
+		if got := stg.database("2022"); got != "db_2022" {
+			t.Fatalf("expected a database that starts with a letter, got %q", got)
+		}
+	})
+
+	t.Run("conflict policies", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tc := range []struct {
+			conflict string
+			exp      map[string]interface{}
+		}{
+			{CouchDBConflictOverwrite, map[string]interface{}{"id": "p-1", "name": "new"}},
+			{CouchDBConflictMerge, map[string]interface{}{"id": "p-1", "name": "new", "color": "red"}},
+			{CouchDBConflictSkip, map[string]interface{}{"id": "p-1", "name": "old", "color": "red"}},
+		} {
+			stg, srv := newCouchDB(t, "conflict="+tc.conflict)
+
+			// A concurrent write of the document is retried with its new revision, unless it is skipped.
+			srv.conflicts["p-1"] = 1
+
+			if err := upsert(stg, "products", map[string]interface{}{"id": "p-1", "name": "new"},
+				map[string]interface{}{"id": "p-2", "name": "added"}); err != nil {
+				t.Fatalf("failed to upsert with %s: %v", tc.conflict, err)
+			}
+
+			doc := srv.dbs["app_products"]["p-1"]
+			delete(doc, "_id")
+			delete(doc, "_rev")
+
+			if !reflect.DeepEqual(doc, tc.exp) || srv.dbs["app_products"]["p-2"]["name"] != "added" {
+				t.Fatalf("expected %v with %s, got %v", tc.exp, tc.conflict, srv.dbs["app_products"])
+			}
+		}
+	})
+
+	t.Run("conflict errors", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newCouchDB(t, "conflict=fail")
+
+		srv.conflicts["p-1"] = 1
+		if err := upsert(stg, "products", map[string]interface{}{"id": "p-1"}); !errors.Is(err, ErrCouchDBConflict) {
+			t.Fatalf("expected error %v, got %v", ErrCouchDBConflict, err)
+		}
+
+		stg, srv = newCouchDB(t, "")
+
+		srv.conflicts["p-1"] = couchDBConflictRetries + 1
+		if err := upsert(stg, "products", map[string]interface{}{"id": "p-1"}); !errors.Is(err, ErrCouchDBConflict) ||
+			srv.bulks != couchDBConflictRetries+1 {
+			t.Fatalf("expected error %v after %d writes, got %v after %d", ErrCouchDBConflict, couchDBConflictRetries+1,
+				err, srv.bulks)
+		}
+
+		err := upsert(stg, "products", map[string]interface{}{"id": map[string]interface{}{"a": 1}})
+		if !errors.Is(err, ErrCouchDBPrimaryKey) {
+			t.Fatalf("expected error %v, got %v", ErrCouchDBPrimaryKey, err)
+		}
+	})
+
+	t.Run("tables", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newCouchDB(t, "primaryKey.candles=time")
+
+		if err := upsert(stg, "candles", map[string]interface{}{"time": 1, "open": 2},
+			map[string]interface{}{"open": 3}); err != nil {
+			t.Fatalf("failed to upsert: %v", err)
+		}
+
+		if _, ok := srv.dbs["app_candles"]["1"]; !ok || len(srv.dbs["app_candles"]) != 2 {
+			t.Fatalf("expected the candles to be written, got %v", srv.dbs["app_candles"])
+		}
+
+		pks, err := stg.ListPrimaryKeys(ctx)
+		if err != nil {
+			t.Fatalf("failed to list primary keys: %v", err)
+		}
+
+		if len(pks.PKSet) != 2 || !reflect.DeepEqual(pks.PKSet["candles"].List, []string{"time"}) ||
+			!reflect.DeepEqual(pks.PKSet["products"].List, []string{"id"}) {
+			t.Fatalf("expected the tables of the databases, got %v", pks.PKSet)
+		}
+
+		srv.dbs["app_candles"]["_design/views"] = map[string]interface{}{"_id": "_design/views", "_rev": "1-x"}
+
+		rsp, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"candles", "missing"}})
+		if err != nil || rsp.DeletedCount != 2 || len(srv.dbs["app_candles"]) != 1 {
+			t.Fatalf("expected the documents to be deleted, got %v: %v", rsp, err)
+		}
+	})
+
+	t.Run("read", func(t *testing.T) {
+		t.Parallel()
+
+		stg, _ := newCouchDB(t, "")
+
+		if err := upsert(stg, "products", map[string]interface{}{"id": "p-0", "name": "a"}); err != nil {
+			t.Fatalf("failed to upsert: %v", err)
+		}
+
+		options, _ := structpb.NewStruct(map[string]interface{}{ReadOrderByOption: []interface{}{"id"}})
+
+		rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "products", Options: options})
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+
+		if len(rsp.Records) != 2 || rsp.Records[0].AsMap()["id"] != "p-0" || rsp.Records[1].AsMap()["_rev"] != nil {
+			t.Fatalf("expected the documents without their metadata, got %v", rsp.Records)
+		}
+
+		rsp, err = stg.Read(ctx, &proto.ReadRequest{Table: "missing"})
+		if err != nil || len(rsp.Records) != 0 {
+			t.Fatalf("expected no records for a missing database, got %v: %v", rsp, err)
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newCouchDB(t, "")
+		srv.dbs["app_products"]["_design/views"] = map[string]interface{}{"_id": "_design/views"}
+
+		if rsp, err := stg.Count(ctx, &proto.CountRequest{Table: "products"}); err != nil || rsp.GetCount() != 1 {
+			t.Fatalf("expected the document without the design document, got %v: %v", rsp, err)
+		}
+
+		// The fake server does not match selectors, so every document is found.
+		required, _ := structpb.NewStruct(map[string]interface{}{"color": "red"})
+
+		rsp, err := stg.Count(ctx, &proto.CountRequest{Table: "products", Required: required})
+		if err != nil || rsp.GetCount() != 2 {
+			t.Fatalf("expected the found documents to be counted, got %v: %v", rsp, err)
+		}
+
+		if rsp, err := stg.Count(ctx, &proto.CountRequest{Table: "missing"}); err != nil || rsp.GetCount() != 0 {
+			t.Fatalf("expected no records for a missing database, got %v: %v", rsp, err)
+		}
+	})
+
+	t.Run("selector", func(t *testing.T) {
+		t.Parallel()
+
+		required, _ := structpb.NewStruct(map[string]interface{}{"kind": []interface{}{"x", "y"}})
+
+		exp := map[string]interface{}{"$and": []interface{}{
+			map[string]interface{}{"kind": map[string]interface{}{"$in": []interface{}{"x", "y"}}},
+		}}
+		if got := couchDBSelector(required.GetFields()); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("expected selector %v, got %v", exp, got)
+		}
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		t.Parallel()
+
+		for _, commit := range []bool{true, false} {
+			stg, srv := newCouchDB(t, "")
+
+			txn, err := stg.StartTx(ctx)
+			if err != nil {
+				t.Fatalf("failed to start transaction: %v", err)
+			}
+
+			txn.Send(func(ctx context.Context, stg Storage) error {
+				data, _ := json.Marshal([]map[string]interface{}{{"id": "p-9"}})
+				_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "products", Data: data})
+
+				return err
+			})
+
+			if commit {
+				err = txn.Commit()
+			} else {
+				err = txn.Rollback()
+			}
+
+			if err != nil {
+				t.Fatalf("failed to end transaction: %v", err)
+			}
+
+			if _, ok := srv.dbs["app_products"]["p-9"]; ok != commit {
+				t.Fatalf("expected the document to be written on commit, got %v", srv.dbs["app_products"])
+			}
+		}
+	})
+}
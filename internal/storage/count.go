@@ -0,0 +1,61 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/alpine-hodler/gidari/proto"
+)
+
+// readCount will count the records of the table that match the required fields of the request by reading them, for
+// storage devices that can not count records without reading them.
+func readCount(ctx context.Context, stg Storage, req *proto.CountRequest) (*proto.CountResponse, error) {
+	rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: req.GetTable(), Required: req.GetRequired()})
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.CountResponse{Count: int64(len(rsp.GetRecords()))}, nil
+}
+
+// scanCount will scan the single count of the rows of a "SELECT COUNT(*)" query, and close the rows.
+func scanCount(rows *sql.Rows) (*proto.CountResponse, error) {
+	defer rows.Close()
+
+	rsp := new(proto.CountResponse)
+
+	if rows.Next() {
+		if err := rows.Scan(&rsp.Count); err != nil {
+			return nil, fmt.Errorf("unable to scan count: %w", err)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to scan count: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// sqlCount will count the records of the table that match the required fields with the "SELECT COUNT(*)" query of the
+// dialect.
+func sqlCount(ctx context.Context, queryer pgQueryer, dialect *SQLDialect, table string,
+	required map[string]interface{},
+) (*proto.CountResponse, error) {
+	query, args := dialect.countQuery(table, required)
+
+	rows, err := queryer.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query: %w", err)
+	}
+
+	return scanCount(rows)
+}
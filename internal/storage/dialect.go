@@ -0,0 +1,577 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SQLDialect is the SQL syntax of a relational storage backend: how identifiers are quoted, how bind parameters are
+// written, how records are upserted, how the dialect independent column types map to the types of the backend, and
+// the limits of a single statement. A new SQL backend should mostly be a dialect plus a driver.
+//
+// The dialect independent column types are "bool", "int", "float", "timestamp", "text", and "json".
+type SQLDialect struct {
+	// quoteChar is the character that identifiers are quoted with.
+	quoteChar string
+
+	// closeQuoteChar is the character that closes a quoted identifier, if it is not "quoteChar", e.g. "]" for the
+	// bracketed identifiers of SQL Server.
+	closeQuoteChar string
+
+	// placeholder will return the bind parameter at the 1-based position in a statement.
+	placeholder func(pos int) string
+
+	// upsert will return the statement that upserts the rows of values, which have already been rendered, into the
+	// table. The columns and keys have already been quoted, and "updates" are the non-key columns.
+	upsert func(table string, columns, keys, updates []string, values string) string
+
+	// types are the column types of the backend, keyed by the dialect independent type.
+	types map[string]string
+
+	// keyText is the type of text primary key columns, for backends that can not index unbounded text.
+	keyText string
+
+	// maxParameters is the maximum number of bind parameters in a statement, or zero if there is no limit.
+	maxParameters int
+
+	// maxRows is the maximum number of rows written in a single statement.
+	maxRows int
+
+	// falseCondition is the condition that no row matches, "FALSE" unless the backend has no boolean literals.
+	falseCondition string
+
+	// top limits the rows of a read with "SELECT TOP (n)" rather than "LIMIT", and compares the "orderBy" columns of
+	// a page one at a time rather than as row values, which the backend does not support.
+	top bool
+
+	// fetchFirst limits the rows of a read with "FETCH FIRST n ROWS ONLY" rather than "LIMIT", and compares the
+	// "orderBy" columns of a page one at a time, like "top".
+	fetchFirst bool
+
+	// compareColumns compares the "orderBy" columns of a page one at a time, like "top" and "fetchFirst", for backends
+	// that limit reads with "LIMIT" but do not support row value comparisons.
+	compareColumns bool
+
+	// bindByPosition binds parameters by their position in a statement rather than their name, so a value that is
+	// referenced more than once is bound once for each reference.
+	bindByPosition bool
+
+	// selectRows renders the rows of an upsert as "SELECT ... FROM DUAL" queries joined with "UNION ALL", with the
+	// columns named by the quoted column names, for backends without multi-row "VALUES" clauses.
+	selectRows bool
+}
+
+// PostgresDialect is the dialect of PostgreSQL.
+var PostgresDialect = &SQLDialect{
+	quoteChar:   `"`,
+	placeholder: func(pos int) string { return "$" + strconv.Itoa(pos) },
+	upsert: func(table string, columns, keys, updates []string, values string) string {
+		return fmt.Sprintf("INSERT INTO %s(%s) VALUES %s ON CONFLICT (%s) %s", table, strings.Join(columns, ","),
+			values, strings.Join(keys, ","), conflictUpdate(updates, "EXCLUDED.%s"))
+	},
+	types: map[string]string{
+		"bool": "BOOLEAN", "int": "BIGINT", "float": "DOUBLE PRECISION", "timestamp": "TIMESTAMPTZ", "text": "TEXT",
+		"json": "JSONB",
+	},
+	maxParameters: 65535,
+	maxRows:       1000,
+}
+
+// MySQLDialect is the dialect of MySQL.
+var MySQLDialect = &SQLDialect{
+	quoteChar:   "`",
+	placeholder: func(int) string { return "?" },
+	upsert: func(table string, columns, keys, updates []string, values string) string {
+		if len(updates) == 0 {
+			return fmt.Sprintf("INSERT IGNORE INTO %s(%s) VALUES %s", table, strings.Join(columns, ","), values)
+		}
+
+		sets := make([]string, len(updates))
+		for idx, column := range updates {
+			sets[idx] = fmt.Sprintf("%s = VALUES(%s)", column, column)
+		}
+
+		return fmt.Sprintf("INSERT INTO %s(%s) VALUES %s ON DUPLICATE KEY UPDATE %s", table,
+			strings.Join(columns, ","), values, strings.Join(sets, ","))
+	},
+	types: map[string]string{
+		"bool": "BOOLEAN", "int": "BIGINT", "float": "DOUBLE", "timestamp": "DATETIME(6)", "text": "TEXT",
+		"json": "JSON",
+	},
+	keyText:       "VARCHAR(255)",
+	maxParameters: 65535,
+	maxRows:       1000,
+}
+
+// SQLiteDialect is the dialect of SQLite 3.24 or later, which added upserts.
+var SQLiteDialect = &SQLDialect{
+	quoteChar:   `"`,
+	placeholder: func(pos int) string { return "?" + strconv.Itoa(pos) },
+	upsert: func(table string, columns, keys, updates []string, values string) string {
+		// Tables without a primary key have no conflict target, so every row is inserted.
+		if len(keys) == 0 {
+			return fmt.Sprintf("INSERT INTO %s(%s) VALUES %s", table, strings.Join(columns, ","), values)
+		}
+
+		return fmt.Sprintf("INSERT INTO %s(%s) VALUES %s ON CONFLICT (%s) %s", table, strings.Join(columns, ","),
+			values, strings.Join(keys, ","), conflictUpdate(updates, "excluded.%s"))
+	},
+	types: map[string]string{
+		"bool": "INTEGER", "int": "INTEGER", "float": "REAL", "timestamp": "TEXT", "text": "TEXT", "json": "TEXT",
+	},
+	maxParameters: 32766,
+	maxRows:       1000,
+}
+
+// DuckDBDialect is the dialect of DuckDB 0.8 or later, which added upserts.
+var DuckDBDialect = &SQLDialect{
+	quoteChar:   `"`,
+	placeholder: func(pos int) string { return "$" + strconv.Itoa(pos) },
+	upsert: func(table string, columns, keys, updates []string, values string) string {
+		// Tables without a primary key have no conflict target, so every row is inserted.
+		if len(keys) == 0 {
+			return fmt.Sprintf("INSERT INTO %s(%s) VALUES %s", table, strings.Join(columns, ","), values)
+		}
+
+		return fmt.Sprintf("INSERT INTO %s(%s) VALUES %s ON CONFLICT (%s) %s", table, strings.Join(columns, ","),
+			values, strings.Join(keys, ","), conflictUpdate(updates, "EXCLUDED.%s"))
+	},
+	types: map[string]string{
+		"bool": "BOOLEAN", "int": "BIGINT", "float": "DOUBLE", "timestamp": "TIMESTAMPTZ", "text": "VARCHAR",
+		"json": "JSON",
+	},
+	maxRows: 1000,
+}
+
+// ClickHouseDialect is the dialect of ClickHouse. ClickHouse has no upsert statement, so rows are inserted into
+// "ReplacingMergeTree" tables, which replace the rows with the same key when parts are merged.
+var ClickHouseDialect = &SQLDialect{
+	quoteChar:   "`",
+	placeholder: func(int) string { return "?" },
+	upsert: func(table string, columns, _, _ []string, values string) string {
+		return fmt.Sprintf("INSERT INTO %s(%s) VALUES %s", table, strings.Join(columns, ","), values)
+	},
+	types: map[string]string{
+		"bool": "Bool", "int": "Int64", "float": "Float64", "timestamp": "DateTime64(6)", "text": "String",
+		"json": "String",
+	},
+	maxRows: 10000,
+}
+
+// SQLServerDialect is the dialect of SQL Server 2016 or later. SQL Server has no "INSERT ... ON CONFLICT", so rows
+// are upserted with a "MERGE" of the rows as a table value constructor, holding the key range lock for the statement
+// so that concurrent merges of the same key do not both insert it.
+var SQLServerDialect = &SQLDialect{
+	quoteChar:      "[",
+	closeQuoteChar: "]",
+	placeholder:    func(pos int) string { return "@p" + strconv.Itoa(pos) },
+	upsert: func(table string, columns, keys, updates []string, values string) string {
+		// Tables without a primary key have nothing to merge on, so every row is inserted.
+		if len(keys) == 0 {
+			return fmt.Sprintf("INSERT INTO %s(%s) VALUES %s", table, strings.Join(columns, ","), values)
+		}
+
+		on, matched, sources := mergeClauses(columns, keys, updates)
+
+		return fmt.Sprintf("MERGE INTO %s WITH (HOLDLOCK) AS target USING (VALUES %s) AS source(%s) ON %s%s "+
+			"WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s);", table, values, strings.Join(columns, ","), on, matched,
+			strings.Join(columns, ","), sources)
+	},
+	types: map[string]string{
+		"bool": "BIT", "int": "BIGINT", "float": "FLOAT", "timestamp": "DATETIMEOFFSET", "text": "NVARCHAR(MAX)",
+		"json": "NVARCHAR(MAX)",
+	},
+	// Index keys are at most 900 bytes, two for each character.
+	keyText: "NVARCHAR(450)",
+	// A request has at most 2100 parameters, two of which are the statement and the parameter definitions of
+	// "sp_executesql".
+	maxParameters:  2098,
+	maxRows:        1000,
+	falseCondition: "1 = 0",
+	top:            true,
+}
+
+// OracleDialect is the dialect of Oracle Database 12c or later. Oracle has neither "INSERT ... ON CONFLICT" nor
+// multi-row "VALUES" clauses, so rows are upserted with a "MERGE" of the rows selected from "DUAL".
+var OracleDialect = &SQLDialect{
+	quoteChar:   `"`,
+	placeholder: func(pos int) string { return ":" + strconv.Itoa(pos) },
+	upsert: func(table string, columns, keys, updates []string, values string) string {
+		// Tables without a primary key have nothing to merge on, so every row is inserted.
+		if len(keys) == 0 {
+			return fmt.Sprintf("INSERT INTO %s(%s) %s", table, strings.Join(columns, ","), values)
+		}
+
+		on, matched, sources := mergeClauses(columns, keys, updates)
+
+		return fmt.Sprintf("MERGE INTO %s target USING (%s) source ON (%s)%s WHEN NOT MATCHED THEN INSERT (%s) "+
+			"VALUES (%s)", table, values, on, matched, strings.Join(columns, ","), sources)
+	},
+	types: map[string]string{
+		"bool": "NUMBER(1)", "int": "NUMBER(19)", "float": "BINARY_DOUBLE", "timestamp": "TIMESTAMP(6)",
+		"text": "VARCHAR2(4000)", "json": "CLOB",
+	},
+	maxParameters:  65535,
+	maxRows:        1000,
+	falseCondition: "1 = 0",
+	fetchFirst:     true,
+	bindByPosition: true,
+	selectRows:     true,
+}
+
+// RedshiftDialect is the dialect of Amazon Redshift. Redshift has no "INSERT ... ON CONFLICT", and does not enforce
+// primary keys, so rows are inserted into a staging table and merged into the table from there; the upsert statement
+// of the dialect is the insert into the staging table.
+var RedshiftDialect = &SQLDialect{
+	quoteChar:   `"`,
+	placeholder: func(pos int) string { return "$" + strconv.Itoa(pos) },
+	upsert: func(table string, columns, _, _ []string, values string) string {
+		return fmt.Sprintf("INSERT INTO %s(%s) VALUES %s", table, strings.Join(columns, ","), values)
+	},
+	types: map[string]string{
+		"bool": "BOOLEAN", "int": "BIGINT", "float": "DOUBLE PRECISION", "timestamp": "TIMESTAMPTZ",
+		"text": "VARCHAR(65535)", "json": "VARCHAR(65535)",
+	},
+	keyText:        "VARCHAR(256)",
+	maxParameters:  32767,
+	maxRows:        1000,
+	compareColumns: true,
+}
+
+// mergeClauses will return the "ON" condition of a "MERGE" of the rows of "source" into "target" on the keys, the
+// "WHEN MATCHED" clause that updates the non-key columns, if there are any, and the values inserted for the columns.
+func mergeClauses(columns, keys, updates []string) (string, string, string) {
+	on := make([]string, len(keys))
+	for idx, key := range keys {
+		on[idx] = fmt.Sprintf("target.%s = source.%s", key, key)
+	}
+
+	sources := make([]string, len(columns))
+	for idx, column := range columns {
+		sources[idx] = "source." + column
+	}
+
+	var matched string
+	if len(updates) > 0 {
+		sets := make([]string, len(updates))
+		for idx, column := range updates {
+			sets[idx] = fmt.Sprintf("target.%s = source.%s", column, column)
+		}
+
+		matched = " WHEN MATCHED THEN UPDATE SET " + strings.Join(sets, ",")
+	}
+
+	return strings.Join(on, " AND "), matched, strings.Join(sources, ",")
+}
+
+// conflictUpdate will return the conflict action of an upsert that sets the columns to the values of the row that
+// was proposed for insertion, with the format of the reference to the proposed value, e.g. "EXCLUDED.%s". A table
+// that only has key columns has nothing to update.
+func conflictUpdate(updates []string, excluded string) string {
+	if len(updates) == 0 {
+		return "DO NOTHING"
+	}
+
+	sets := make([]string, len(updates))
+	for idx, column := range updates {
+		sets[idx] = fmt.Sprintf("%s = "+excluded, column, column)
+	}
+
+	return "DO UPDATE SET " + strings.Join(sets, ",")
+}
+
+// Quote will quote the identifier, doubling the closing quote character within the identifier.
+func (dialect *SQLDialect) Quote(name string) string {
+	closeQuote := dialect.quoteChar
+	if dialect.closeQuoteChar != "" {
+		closeQuote = dialect.closeQuoteChar
+	}
+
+	return dialect.quoteChar + strings.ReplaceAll(name, closeQuote, closeQuote+closeQuote) + closeQuote
+}
+
+// Placeholder will return the bind parameter at the 1-based position in a statement.
+func (dialect *SQLDialect) Placeholder(pos int) string {
+	return dialect.placeholder(pos)
+}
+
+// Type will return the column type of the backend for the dialect independent type, or an empty string if the type
+// is not known. Text key columns use a type that can be indexed.
+func (dialect *SQLDialect) Type(name string, key bool) string {
+	if key && name == "text" && dialect.keyText != "" {
+		return dialect.keyText
+	}
+
+	return dialect.types[name]
+}
+
+// BatchRows will return the maximum number of rows of a table with the number of columns that can be written in a
+// single statement, within the parameter limit of the dialect.
+func (dialect *SQLDialect) BatchRows(columns int) int {
+	rows := dialect.maxRows
+	if dialect.maxParameters > 0 && columns > 0 && rows*columns > dialect.maxParameters {
+		rows = dialect.maxParameters / columns
+	}
+
+	if rows < 1 {
+		return 1
+	}
+
+	return rows
+}
+
+// Upsert will return the statement that upserts the number of rows into the table, with a bind parameter for each
+// column of each row. Rows conflicting on the keys update the non-key columns.
+func (dialect *SQLDialect) Upsert(table string, columns, keys []string, rows int) string {
+	isKey := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		isKey[key] = true
+	}
+
+	quoted := make([]string, len(columns))
+
+	var updates []string
+
+	for idx, column := range columns {
+		quoted[idx] = dialect.Quote(column)
+
+		if !isKey[column] {
+			updates = append(updates, quoted[idx])
+		}
+	}
+
+	quotedKeys := make([]string, len(keys))
+	for idx, key := range keys {
+		quotedKeys[idx] = dialect.Quote(key)
+	}
+
+	values := dialect.values(len(columns), rows)
+	if dialect.selectRows {
+		values = dialect.selectValues(quoted, rows)
+	}
+
+	return dialect.upsert(dialect.Quote(table), quoted, quotedKeys, updates, values)
+}
+
+// values will return the rows of bind parameters of a "VALUES" clause, e.g. "($1,$2),($3,$4)".
+func (dialect *SQLDialect) values(columns, rows int) string {
+	if columns == 0 || rows == 0 {
+		return "()"
+	}
+
+	var values strings.Builder
+
+	for row := 0; row < rows; row++ {
+		if row > 0 {
+			values.WriteByte(',')
+		}
+
+		values.WriteByte('(')
+
+		for col := 0; col < columns; col++ {
+			if col > 0 {
+				values.WriteByte(',')
+			}
+
+			values.WriteString(dialect.placeholder(row*columns + col + 1))
+		}
+
+		values.WriteByte(')')
+	}
+
+	return values.String()
+}
+
+// selectValues will return the rows of bind parameters as queries of "DUAL" joined with "UNION ALL", with the quoted
+// columns as their names, e.g. `SELECT :1 "a",:2 "b" FROM DUAL UNION ALL SELECT :3 "a",:4 "b" FROM DUAL`.
+func (dialect *SQLDialect) selectValues(columns []string, rows int) string {
+	var values strings.Builder
+
+	for row := 0; row < rows; row++ {
+		if row > 0 {
+			values.WriteString(" UNION ALL ")
+		}
+
+		values.WriteString("SELECT ")
+
+		for col, column := range columns {
+			if col > 0 {
+				values.WriteByte(',')
+			}
+
+			values.WriteString(dialect.placeholder(row*len(columns)+col+1) + " " + column)
+		}
+
+		values.WriteString(" FROM DUAL")
+	}
+
+	return values.String()
+}
+
+// readConditions will return the "WHERE" conditions and arguments for the required fields on a read request. The
+// conditions are sorted by column name so that the statement is deterministic.
+func (dialect *SQLDialect) readConditions(required map[string]interface{}) ([]string, []interface{}) {
+	columns := make([]string, 0, len(required))
+	for column := range required {
+		columns = append(columns, column)
+	}
+
+	sort.Strings(columns)
+
+	var (
+		conditions []string
+		args       []interface{}
+	)
+
+	for _, column := range columns {
+		values, ok := required[column].([]interface{})
+		if !ok {
+			args = append(args, required[column])
+			conditions = append(conditions, fmt.Sprintf("%s = %s", dialect.Quote(column),
+				dialect.placeholder(len(args))))
+
+			continue
+		}
+
+		// An empty list can not match any records.
+		if len(values) == 0 {
+			falseCondition := "FALSE"
+			if dialect.falseCondition != "" {
+				falseCondition = dialect.falseCondition
+			}
+
+			conditions = append(conditions, falseCondition)
+
+			continue
+		}
+
+		placeholders := make([]string, len(values))
+		for idx, value := range values {
+			args = append(args, value)
+			placeholders[idx] = dialect.placeholder(len(args))
+		}
+
+		conditions = append(conditions, fmt.Sprintf("%s IN (%s)", dialect.Quote(column),
+			strings.Join(placeholders, ",")))
+	}
+
+	return conditions, args
+}
+
+// pageClauses will add the "WHERE" condition for the records after the "after" values of the page to the conditions,
+// and return the "ORDER BY" and "LIMIT" clauses of the page. The condition compares row values, e.g.
+// "(a, b) > ($1, $2)" on PostgreSQL, so it can use an index on the "orderBy" columns. Dialects that limit reads with
+// "TOP" or "FETCH FIRST" compare the columns one at a time instead, e.g. "([a] > @p1 OR ([a] = @p1 AND [b] > @p2))",
+// and "TOP" dialects return the limit as the "TOP" clause rather than in the clauses.
+func (dialect *SQLDialect) pageClauses(page *readPage, conditions []string, args []interface{}) ([]string,
+	[]interface{}, string,
+) {
+	if page == nil {
+		return conditions, args, ""
+	}
+
+	columns := make([]string, len(page.orderBy))
+	for idx, column := range page.orderBy {
+		columns[idx] = dialect.Quote(column)
+	}
+
+	if len(page.after) > 0 {
+		if dialect.bindByPosition {
+			// Each reference to an "after" value binds it again.
+			conditions = append(conditions, afterCondition(columns, func(col int) string {
+				args = append(args, page.after[col])
+
+				return dialect.placeholder(len(args))
+			}))
+		} else {
+			placeholders := make([]string, len(page.after))
+			for idx, value := range page.after {
+				args = append(args, value)
+				placeholders[idx] = dialect.placeholder(len(args))
+			}
+
+			if dialect.top || dialect.fetchFirst || dialect.compareColumns {
+				conditions = append(conditions, afterCondition(columns, func(col int) string {
+					return placeholders[col]
+				}))
+			} else {
+				conditions = append(conditions, fmt.Sprintf("(%s) > (%s)", strings.Join(columns, ", "),
+					strings.Join(placeholders, ", ")))
+			}
+		}
+	}
+
+	var clauses string
+	if len(columns) > 0 {
+		clauses = fmt.Sprintf(" ORDER BY %s", strings.Join(columns, ", "))
+	}
+
+	if page.limit > 0 && dialect.fetchFirst {
+		clauses = fmt.Sprintf("%s FETCH FIRST %d ROWS ONLY", clauses, page.limit)
+	} else if page.limit > 0 && !dialect.top {
+		clauses = fmt.Sprintf("%s LIMIT %d", clauses, page.limit)
+	}
+
+	return conditions, args, clauses
+}
+
+// afterCondition will return the condition for the rows after the values of the columns in their lexicographic order,
+// without comparing row values. The placeholder of the value of a column is returned by "placeholder" for each
+// reference to it, in the order of the statement.
+func afterCondition(columns []string, placeholder func(col int) string) string {
+	alternatives := make([]string, len(columns))
+
+	for idx := range columns {
+		terms := make([]string, 0, idx+1)
+		for prev := 0; prev < idx; prev++ {
+			terms = append(terms, fmt.Sprintf("%s = %s", columns[prev], placeholder(prev)))
+		}
+
+		terms = append(terms, fmt.Sprintf("%s > %s", columns[idx], placeholder(idx)))
+		alternatives[idx] = "(" + strings.Join(terms, " AND ") + ")"
+	}
+
+	return "(" + strings.Join(alternatives, " OR ") + ")"
+}
+
+// selectQuery will return the statement and arguments that select the records of the table that match the required
+// fields, in the page if it is not nil.
+func (dialect *SQLDialect) selectQuery(table string, required map[string]interface{}, page *readPage) (string,
+	[]interface{},
+) {
+	query := fmt.Sprintf("SELECT * FROM %s", dialect.Quote(table))
+	if dialect.top && page != nil && page.limit > 0 {
+		query = fmt.Sprintf("SELECT TOP (%d) * FROM %s", page.limit, dialect.Quote(table))
+	}
+
+	conditions, args := dialect.readConditions(required)
+	conditions, args, clauses := dialect.pageClauses(page, conditions, args)
+
+	if len(conditions) > 0 {
+		query = fmt.Sprintf("%s WHERE %s", query, strings.Join(conditions, " AND "))
+	}
+
+	return query + clauses, args
+}
+
+// countQuery will return the statement and arguments that count the records of the table that match the required
+// fields.
+func (dialect *SQLDialect) countQuery(table string, required map[string]interface{}) (string, []interface{}) {
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s", dialect.Quote(table))
+
+	conditions, args := dialect.readConditions(required)
+	if len(conditions) > 0 {
+		query = fmt.Sprintf("%s WHERE %s", query, strings.Join(conditions, " AND "))
+	}
+
+	return query, args
+}
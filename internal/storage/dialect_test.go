@@ -0,0 +1,165 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSQLDialect(t *testing.T) {
+	t.Parallel()
+
+	t.Run("upsert", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tcase := range []struct {
+			dialect *SQLDialect
+			columns []string
+			exp     string
+		}{
+			{
+				dialect: PostgresDialect,
+				columns: []string{"id", "price"},
+				exp: `INSERT INTO "trades"("id","price") VALUES ($1,$2),($3,$4) ` +
+					`ON CONFLICT ("id") DO UPDATE SET "price" = EXCLUDED."price"`,
+			},
+			{
+				dialect: PostgresDialect,
+				columns: []string{"id"},
+				exp:     `INSERT INTO "trades"("id") VALUES ($1),($2) ON CONFLICT ("id") DO NOTHING`,
+			},
+			{
+				dialect: MySQLDialect,
+				columns: []string{"id", "price"},
+				exp:     "INSERT INTO `trades`(`id`,`price`) VALUES (?,?),(?,?) ON DUPLICATE KEY UPDATE `price` = VALUES(`price`)",
+			},
+			{
+				dialect: MySQLDialect,
+				columns: []string{"id"},
+				exp:     "INSERT IGNORE INTO `trades`(`id`) VALUES (?),(?)",
+			},
+			{
+				dialect: SQLiteDialect,
+				columns: []string{"id", "price"},
+				exp: `INSERT INTO "trades"("id","price") VALUES (?1,?2),(?3,?4) ` +
+					`ON CONFLICT ("id") DO UPDATE SET "price" = excluded."price"`,
+			},
+			{
+				dialect: DuckDBDialect,
+				columns: []string{"id", "price"},
+				exp: `INSERT INTO "trades"("id","price") VALUES ($1,$2),($3,$4) ` +
+					`ON CONFLICT ("id") DO UPDATE SET "price" = EXCLUDED."price"`,
+			},
+			{
+				dialect: ClickHouseDialect,
+				columns: []string{"id", "price"},
+				exp:     "INSERT INTO `trades`(`id`,`price`) VALUES (?,?),(?,?)",
+			},
+			{
+				dialect: SQLServerDialect,
+				columns: []string{"id", "price"},
+				exp: "MERGE INTO [trades] WITH (HOLDLOCK) AS target USING (VALUES (@p1,@p2),(@p3,@p4)) " +
+					"AS source([id],[price]) ON target.[id] = source.[id] " +
+					"WHEN MATCHED THEN UPDATE SET target.[price] = source.[price] " +
+					"WHEN NOT MATCHED THEN INSERT ([id],[price]) VALUES (source.[id],source.[price]);",
+			},
+			{
+				dialect: SQLServerDialect,
+				columns: []string{"id"},
+				exp: "MERGE INTO [trades] WITH (HOLDLOCK) AS target USING (VALUES (@p1),(@p2)) AS source([id]) " +
+					"ON target.[id] = source.[id] WHEN NOT MATCHED THEN INSERT ([id]) VALUES (source.[id]);",
+			},
+			{
+				dialect: OracleDialect,
+				columns: []string{"id", "price"},
+				exp: `MERGE INTO "trades" target USING (SELECT :1 "id",:2 "price" FROM DUAL UNION ALL ` +
+					`SELECT :3 "id",:4 "price" FROM DUAL) source ON (target."id" = source."id") ` +
+					`WHEN MATCHED THEN UPDATE SET target."price" = source."price" ` +
+					`WHEN NOT MATCHED THEN INSERT ("id","price") VALUES (source."id",source."price")`,
+			},
+		} {
+			if got := tcase.dialect.Upsert("trades", tcase.columns, []string{"id"}, 2); got != tcase.exp {
+				t.Fatalf("expected %q, got %q", tcase.exp, got)
+			}
+		}
+	})
+
+	t.Run("quote", func(t *testing.T) {
+		t.Parallel()
+
+		if got := PostgresDialect.Quote(`a"b`); got != `"a""b"` {
+			t.Fatalf("expected the quote character to be doubled, got %s", got)
+		}
+
+		if got := MySQLDialect.Quote("a`b"); got != "`a``b`" {
+			t.Fatalf("expected the quote character to be doubled, got %s", got)
+		}
+
+		if got := SQLServerDialect.Quote("a[b]c"); got != "[a[b]]c]" {
+			t.Fatalf("expected the closing quote character to be doubled, got %s", got)
+		}
+	})
+
+	t.Run("batch rows", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tcase := range []struct {
+			dialect *SQLDialect
+			columns int
+			exp     int
+		}{
+			{PostgresDialect, 10, 1000},
+			{PostgresDialect, 100, 655},
+			{SQLiteDialect, 100, 327},
+			{ClickHouseDialect, 100, 10000},
+			{SQLServerDialect, 10, 209},
+			{OracleDialect, 100, 655},
+		} {
+			if got := tcase.dialect.BatchRows(tcase.columns); got != tcase.exp {
+				t.Fatalf("expected %d rows for %d columns, got %d", tcase.exp, tcase.columns, got)
+			}
+		}
+	})
+
+	t.Run("types", func(t *testing.T) {
+		t.Parallel()
+
+		if got := MySQLDialect.Type("text", true); got != "VARCHAR(255)" {
+			t.Fatalf("expected an indexable key type, got %q", got)
+		}
+
+		if got := PostgresDialect.Type("text", true); got != "TEXT" {
+			t.Fatalf("expected a text key type, got %q", got)
+		}
+
+		if got := ClickHouseDialect.Type("unknown", false); got != "" {
+			t.Fatalf("expected no type, got %q", got)
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		t.Parallel()
+
+		query, args := SQLServerDialect.countQuery("trades", map[string]interface{}{
+			"side": "buy", "product_id": []interface{}{"BTC-USD", "ETH-USD"},
+		})
+
+		if exp := "SELECT COUNT(*) FROM [trades] WHERE [product_id] IN (@p1,@p2) AND [side] = @p3"; query != exp {
+			t.Fatalf("expected %q, got %q", exp, query)
+		}
+
+		if exp := []interface{}{"BTC-USD", "ETH-USD", "buy"}; !reflect.DeepEqual(args, exp) {
+			t.Fatalf("expected arguments %v, got %v", exp, args)
+		}
+
+		if query, _ := PostgresDialect.countQuery("trades", nil); query != `SELECT COUNT(*) FROM "trades"` {
+			t.Fatalf("expected an unconditional count, got %q", query)
+		}
+	})
+}
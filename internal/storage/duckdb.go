@@ -0,0 +1,408 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/record"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	duckDBScheme = "duckdb"
+
+	// duckDBDriver is the name that the "database/sql" driver for DuckDB, "github.com/marcboeker/go-duckdb",
+	// registers.
+	duckDBDriver = "duckdb"
+)
+
+// ErrDuckDBDriverNotRegistered is returned when no DuckDB driver is registered with "database/sql".
+var ErrDuckDBDriverNotRegistered = fmt.Errorf("no duckdb driver is registered, import " +
+	"\"github.com/marcboeker/go-duckdb\" to register one")
+
+// duckDBTxType is the type of the context key of DuckDB transactions.
+type duckDBTxType uint8
+
+const (
+	basicDuckDBTxID duckDBTxType = iota
+)
+
+// DuckDB is an embedded analytical storage device that writes to a single DuckDB database file, for transporting web
+// API data into a local file that can be queried with SQL. DuckDB 0.8 or later is required.
+type DuckDB struct {
+	*sql.DB
+
+	writeMutex sync.Mutex
+
+	// activeTx are the transactions that are currently active on the database, keyed by the transaction ID that is
+	// added to the context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewDuckDB will return a DuckDB storage device for the database file of the connection string, e.g.
+// "duckdb://data/gidari.duckdb" for a path relative to the working directory or "duckdb:///var/lib/gidari.duckdb" for
+// an absolute path. The file is created if it does not exist. The query parameters of the connection string are
+// passed to the driver as configuration, e.g. "threads=4".
+//
+// DuckDB has no driver in the standard library. The gidari CLI registers "github.com/marcboeker/go-duckdb" when it is
+// built with cgo, and applications that embed gidari must import it.
+func NewDuckDB(_ context.Context, connectionURL string) (*DuckDB, error) {
+	if !duckDBDriverRegistered() {
+		return nil, ErrDuckDBDriverNotRegistered
+	}
+
+	dsn, err := duckDBDSN(connectionURL)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(duckDBDriver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open duckdb database: %w", err)
+	}
+
+	return &DuckDB{DB: db}, nil
+}
+
+// duckDBDriverRegistered will return true if the DuckDB driver is registered.
+func duckDBDriverRegistered() bool {
+	for _, driver := range sql.Drivers() {
+		if driver == duckDBDriver {
+			return true
+		}
+	}
+
+	return false
+}
+
+// duckDBDSN will return the data source name of the database file of the connection string, with the query
+// parameters of the connection string as the configuration of the database.
+func duckDBDSN(connectionURL string) (string, error) {
+	dsnURL, err := url.Parse(connectionURL)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	path := dsnURL.Host + dsnURL.Path
+	if path == "" {
+		return "", fmt.Errorf("%w: %s has no database file", ErrDNSNotSupported, connectionURL)
+	}
+
+	if query := dsnURL.Query(); len(query) > 0 {
+		return path + "?" + query.Encode(), nil
+	}
+
+	return path, nil
+}
+
+// Close will close the database.
+func (duck *DuckDB) Close() {
+	if duck.DB != nil {
+		duck.DB.Close()
+	}
+}
+
+// IsNoSQL returns "false" to indicate that "DuckDB" is not a NoSQL database.
+func (duck *DuckDB) IsNoSQL() bool { return false }
+
+// Type implements the storage interface.
+func (duck *DuckDB) Type() uint8 { return DuckDBType }
+
+// getQueryer will return the transaction assigned to the context, or the database if there is none.
+func (duck *DuckDB) getQueryer(ctx context.Context) (pgQueryer, error) {
+	txID, ok := ctx.Value(basicDuckDBTxID).(string)
+	if !ok {
+		return duck.DB, nil
+	}
+
+	tx, ok := duck.activeTx.Load(txID)
+	if !ok {
+		return duck.DB, nil
+	}
+
+	sqlTx, ok := tx.(*sql.Tx)
+	if !ok {
+		return nil, ErrTransactionNotFound
+	}
+
+	return sqlTx, nil
+}
+
+// ListPrimaryKeys will list the primary keys of the tables in the database.
+func (duck *DuckDB) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	meta, err := loadKeyedColumns(ctx, duck.DB, string(duckDBColumns))
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+	for table := range meta.cols {
+		rsp.PKSet[table] = &proto.PrimaryKeys{List: meta.pks[table]}
+	}
+
+	return rsp, nil
+}
+
+// ListTables will list the tables in the database, with their sizes reported as zero.
+func (duck *DuckDB) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	meta, err := loadKeyedColumns(ctx, duck.DB, string(duckDBColumns))
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+	for table := range meta.cols {
+		rsp.TableSet[table] = &proto.Table{}
+	}
+
+	return rsp, nil
+}
+
+// Read will return the records from the table that match the required fields on the request, in the page requested
+// by the options of the request, if any. The required fields and the page are pushed down to DuckDB as the "WHERE",
+// "ORDER BY", and "LIMIT" clauses of the query.
+func (duck *DuckDB) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	queryer, err := duck.getQueryer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get queryer: %w", err)
+	}
+
+	query, args := DuckDBDialect.selectQuery(req.GetTable(), req.GetRequired().AsMap(), page)
+
+	rows, err := queryer.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query: %w", err)
+	}
+
+	records, err := scanSQLRows(rows, duckDBValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.ReadResponse{Records: records}, nil
+}
+
+// Count will return the number of rows of the table that match the required fields.
+func (duck *DuckDB) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	queryer, err := duck.getQueryer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get queryer: %w", err)
+	}
+
+	return sqlCount(ctx, queryer, DuckDBDialect, req.GetTable(), req.GetRequired().AsMap())
+}
+
+// duckDBValue will convert a value scanned by the DuckDB driver to the value of a record. Timestamps are RFC 3339
+// strings, the values of lists and structs are converted, and the other types of the driver, e.g. UUIDs and decimals,
+// are their string representation, or their JSON representation if they have none.
+func duckDBValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case nil, bool, string, float32, float64, int, int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+		return value
+	case []byte:
+		return string(value)
+	case time.Time:
+		return value.UTC().Format(time.RFC3339Nano)
+	case []interface{}:
+		list := make([]interface{}, len(value))
+		for idx, item := range value {
+			list[idx] = duckDBValue(item)
+		}
+
+		return list
+	case map[string]interface{}:
+		fields := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			fields[key] = duckDBValue(item)
+		}
+
+		return fields
+	case fmt.Stringer:
+		return value.String()
+	default:
+		var decoded interface{}
+
+		data, err := json.Marshal(value)
+		if err != nil || json.Unmarshal(data, &decoded) != nil {
+			return fmt.Sprint(value)
+		}
+
+		return decoded
+	}
+}
+
+// Truncate will delete every row of the tables.
+func (duck *DuckDB) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	queryer, err := duck.getQueryer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get queryer: %w", err)
+	}
+
+	rsp := new(proto.TruncateResponse)
+
+	for _, table := range req.GetTables() {
+		result, err := queryer.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s", DuckDBDialect.Quote(table)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to truncate table %s: %w", table, err)
+		}
+
+		if deleted, err := result.RowsAffected(); err == nil {
+			rsp.DeletedCount += int32(deleted)
+		}
+	}
+
+	return rsp, nil
+}
+
+// lastByKeys will return the records without the records that are followed by a record with the same keys. DuckDB
+// can not update the same row twice in a single "INSERT ... ON CONFLICT" statement, and the last record of a key is
+// the one that an upsert of each record in turn would keep.
+func lastByKeys(records []*structpb.Struct, keys []string) []*structpb.Struct {
+	if len(keys) == 0 {
+		return records
+	}
+
+	last := make(map[string]int, len(records))
+	ids := make([]string, len(records))
+
+	for idx, rec := range records {
+		values := make([]interface{}, len(keys))
+		for pos, key := range keys {
+			values[pos] = rec.GetFields()[key].AsInterface()
+		}
+
+		id, _ := json.Marshal(values)
+		ids[idx] = string(id)
+		last[ids[idx]] = idx
+	}
+
+	if len(last) == len(records) {
+		return records
+	}
+
+	deduped := make([]*structpb.Struct, 0, len(last))
+
+	for idx, rec := range records {
+		if last[ids[idx]] == idx {
+			deduped = append(deduped, rec)
+		}
+	}
+
+	return deduped
+}
+
+// Upsert will insert the records on the request, updating the records with the same primary key. Nested objects and
+// arrays are written as JSON text, which DuckDB casts to the type of their column. Only the last of the records with
+// the same primary key on the request is written.
+func (duck *DuckDB) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	duck.writeMutex.Lock()
+	defer duck.writeMutex.Unlock()
+
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	if len(records) == 0 {
+		return &proto.UpsertResponse{}, nil
+	}
+
+	queryer, err := duck.getQueryer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get queryer: %w", err)
+	}
+
+	meta, err := loadKeyedColumns(ctx, queryer, string(duckDBColumns))
+	if err != nil {
+		return nil, err
+	}
+
+	table := req.GetTable()
+	columns := meta.cols[table]
+	records = lastByKeys(records, meta.pks[table])
+
+	opts := &record.Options{Nested: record.NestedJSON}
+
+	for _, partition := range tools.PartitionStructs(DuckDBDialect.BatchRows(len(columns)), records) {
+		query := DuckDBDialect.Upsert(table, columns, meta.pks[table], len(partition))
+
+		arguments, err := record.ToSQLArgs(columns, partition, opts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert records: %w", err)
+		}
+
+		if _, err := queryer.ExecContext(ctx, query, arguments...); err != nil {
+			return nil, fmt.Errorf("unable to execute upsert: %w", err)
+		}
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+}
+
+// StartTx will start a transaction on the database. DuckDB allows a single process to write to a database file, and
+// the writes of the process are serialized.
+func (duck *DuckDB) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+
+	sqlTx, err := duck.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return txn, fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	duck.activeTx.Store(txnID, sqlTx)
+
+	txCtx := context.WithValue(ctx, basicDuckDBTxID, txnID)
+
+	go func() {
+		defer duck.activeTx.Delete(txnID)
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(txCtx, duck)
+		}
+
+		if err != nil {
+			_ = sqlTx.Rollback()
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit {
+			txn.done <- sqlTx.Commit()
+		} else {
+			txn.done <- sqlTx.Rollback()
+		}
+	}()
+
+	return txn, nil
+}
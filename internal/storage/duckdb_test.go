@@ -0,0 +1,113 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestDuckDB(t *testing.T) {
+	t.Parallel()
+
+	t.Run("dsn", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tcase := range []struct {
+			url, exp string
+		}{
+			{"duckdb://data/gidari.duckdb", "data/gidari.duckdb"},
+			{"duckdb:///var/lib/gidari.duckdb?threads=4", "/var/lib/gidari.duckdb?threads=4"},
+		} {
+			dsn, err := duckDBDSN(tcase.url)
+			if err != nil {
+				t.Fatalf("failed to parse %s: %v", tcase.url, err)
+			}
+
+			if dsn != tcase.exp {
+				t.Fatalf("expected %q, got %q", tcase.exp, dsn)
+			}
+		}
+
+		if _, err := duckDBDSN("duckdb://"); !errors.Is(err, ErrDNSNotSupported) {
+			t.Fatalf("expected error %v, got %v", ErrDNSNotSupported, err)
+		}
+	})
+
+	t.Run("driver not registered", func(t *testing.T) {
+		t.Parallel()
+
+		// The path contains the scheme of another storage device, which must not be used.
+		_, err := New(context.Background(), "duckdb://mongodb.duckdb")
+		if !errors.Is(err, ErrDuckDBDriverNotRegistered) {
+			t.Fatalf("expected error %v, got %v", ErrDuckDBDriverNotRegistered, err)
+		}
+	})
+
+	t.Run("last by keys", func(t *testing.T) {
+		t.Parallel()
+
+		var records []*structpb.Struct
+
+		for _, fields := range []map[string]interface{}{
+			{"id": 1, "venue": "a", "price": 1},
+			{"id": 2, "venue": "a", "price": 2},
+			{"id": 1, "venue": "b", "price": 3},
+			{"id": 1, "venue": "a", "price": 4},
+		} {
+			rec, err := structpb.NewStruct(fields)
+			if err != nil {
+				t.Fatalf("failed to create record: %v", err)
+			}
+
+			records = append(records, rec)
+		}
+
+		var prices []float64
+		for _, rec := range lastByKeys(records, []string{"id", "venue"}) {
+			prices = append(prices, rec.GetFields()["price"].GetNumberValue())
+		}
+
+		if exp := []float64{2, 3, 4}; !reflect.DeepEqual(prices, exp) {
+			t.Fatalf("expected the last record of each key %v, got %v", exp, prices)
+		}
+
+		if got := lastByKeys(records, nil); len(got) != len(records) {
+			t.Fatalf("expected every record without keys, got %d", len(got))
+		}
+	})
+
+	t.Run("values", func(t *testing.T) {
+		t.Parallel()
+
+		ts := time.Date(2023, 6, 1, 0, 0, 0, 0, time.FixedZone("", 3600))
+		got := duckDBValue(map[string]interface{}{
+			"time":   ts,
+			"list":   []interface{}{[]byte("a"), int32(1)},
+			"huge":   big.NewInt(12),
+			"struct": struct{ Months int32 }{2},
+		})
+
+		exp := map[string]interface{}{
+			"time":   "2023-05-31T23:00:00Z",
+			"list":   []interface{}{"a", int32(1)},
+			"huge":   "12",
+			"struct": map[string]interface{}{"Months": 2.0},
+		}
+
+		if !reflect.DeepEqual(got, exp) {
+			t.Fatalf("expected %v, got %v", exp, got)
+		}
+	})
+}
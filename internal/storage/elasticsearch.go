@@ -0,0 +1,947 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/google/uuid"
+	"github.com/opensearch-project/opensearch-go/v4"
+	"github.com/opensearch-project/opensearch-go/v4/opensearchapi"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	elasticsearchScheme = "elasticsearch"
+	opensearchScheme    = "opensearch"
+
+	// elasticsearchTLSParam is the connection string parameter that connects to the cluster with HTTPS, e.g.
+	// "tls=true".
+	elasticsearchTLSParam = "tls"
+
+	// elasticsearchPrefixParam is the connection string parameter for the prefix of the index names of the tables,
+	// e.g. "prefix=gidari-". The index of a table is the prefix and the table, in lower case.
+	elasticsearchPrefixParam = "prefix"
+
+	// elasticsearchPrimaryKeyParam is the connection string parameter for the field of the records that is the ID of
+	// their documents in every index, e.g. "primaryKey=id". The field for a single table is set with
+	// "primaryKey.<table>", e.g. "primaryKey.candles=time".
+	elasticsearchPrimaryKeyParam = "primaryKey"
+
+	// elasticsearchRefreshParam is the connection string parameter for the "refresh" parameter of bulk requests:
+	// "wait_for" (the default) to make the records visible to reads before the upsert returns, "true", or "false".
+	elasticsearchRefreshParam = "refresh"
+
+	// elasticsearchAPIKeyEnv is the environment variable with an API key to authorize requests with, instead of the
+	// user and password of the connection string.
+	elasticsearchAPIKeyEnv = "ELASTICSEARCH_API_KEY"
+
+	elasticsearchDefaultPrimaryKey = "id"
+	elasticsearchDefaultRefresh    = "wait_for"
+
+	// elasticsearchBulkActions and elasticsearchBulkBytes are the number of actions and the size of the body of each
+	// bulk request, whichever is reached first.
+	elasticsearchBulkActions = 1000
+	elasticsearchBulkBytes   = 5 << 20
+
+	// elasticsearchScrollSize is the number of documents read in each page of a scroll, and elasticsearchScrollTTL
+	// is how long the cluster keeps the scroll open between pages.
+	elasticsearchScrollSize = 1000
+	elasticsearchScrollTTL  = time.Minute
+
+	// elasticsearchInvalidIndexChars are the characters that index names must not contain, which are replaced with
+	// underscores.
+	elasticsearchInvalidIndexChars = `\/*?"<>| ,#:`
+)
+
+var (
+	ErrElasticsearch           = fmt.Errorf("elasticsearch request failed")
+	ErrElasticsearchPrimaryKey = fmt.Errorf("invalid elasticsearch primary key")
+)
+
+// ElasticsearchError is returned when an Elasticsearch or OpenSearch API request fails.
+func ElasticsearchError(op string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrElasticsearch, op, err)
+}
+
+// ElasticsearchPrimaryKeyError is returned when the primary key of a record cannot be the ID of a document.
+func ElasticsearchPrimaryKeyError(table, field string) error {
+	return fmt.Errorf("%w: the %q field of records of %q must be a string, number, or boolean", ErrElasticsearchPrimaryKey,
+		field, table)
+}
+
+// elasticsearchHit is a document of the results of a search.
+type elasticsearchHit struct {
+	Source map[string]interface{} `json:"_source"`
+}
+
+// elasticsearchSearchResponse is the response of a search or of the next page of a scroll.
+type elasticsearchSearchResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []elasticsearchHit `json:"hits"`
+	} `json:"hits"`
+}
+
+// elasticsearchTxType is the type of the context key of Elasticsearch transactions.
+type elasticsearchTxType uint8
+
+const (
+	basicElasticsearchTxID elasticsearchTxType = iota
+)
+
+// elasticsearchTx are the bulk actions of a transaction, sent when the transaction commits.
+type elasticsearchTx struct {
+	mtx     sync.Mutex
+	actions [][]byte
+}
+
+// Elasticsearch is a storage device that writes records as the documents of Elasticsearch or OpenSearch indices,
+// e.g. to search web API data. Each table is an index, and each record is a document with the primary key of the
+// record as its ID, written with the bulk API.
+//
+// Indices are created with a dynamic template that maps strings to "keyword" fields, so that reads can match and sort
+// them exactly.
+type Elasticsearch struct {
+	endpoint    string
+	api         elasticsearchAPI
+	prefix      string
+	refresh     string
+	primaryKey  string
+	primaryKeys map[string]string
+
+	// indices are the indices that have been created or found to exist.
+	mtx     sync.Mutex
+	indices map[string]bool
+
+	// activeTx are the transactions that are currently active, keyed by the transaction ID that is added to the
+	// context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewElasticsearch will return an Elasticsearch storage device for the connection string, i.e.
+// "elasticsearch://[user:password@]host[:port][?tls=true&prefix=<prefix>]", or "opensearch://" for an OpenSearch
+// cluster. Requests are authorized with the user and password of the connection string, or with the API key in the
+// "ELASTICSEARCH_API_KEY" environment variable. The ID of each document is the "primaryKey" field of its record
+// (default "id", or "primaryKey.<table>" for a single table).
+func NewElasticsearch(_ context.Context, connectionURL string) (*Elasticsearch, error) {
+	uri, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	if uri.Host == "" {
+		return nil, DNSNotSupportedError(connectionURL)
+	}
+
+	stg := &Elasticsearch{
+		endpoint:    "http://" + uri.Host,
+		refresh:     elasticsearchDefaultRefresh,
+		primaryKey:  elasticsearchDefaultPrimaryKey,
+		primaryKeys: make(map[string]string),
+		indices:     make(map[string]bool),
+	}
+
+	for key, values := range uri.Query() {
+		switch table := strings.TrimPrefix(key, elasticsearchPrimaryKeyParam+"."); {
+		case key == elasticsearchTLSParam:
+			if tls, err := strconv.ParseBool(values[0]); err != nil {
+				return nil, fmt.Errorf("%w: %s=%q must be a boolean", ErrDNSNotSupported, key, values[0])
+			} else if tls {
+				stg.endpoint = "https://" + uri.Host
+			}
+		case key == elasticsearchPrefixParam:
+			stg.prefix = values[0]
+		case key == elasticsearchRefreshParam:
+			stg.refresh = values[0]
+		case key == elasticsearchPrimaryKeyParam:
+			stg.primaryKey = values[0]
+		case table != key:
+			stg.primaryKeys[table] = values[0]
+		}
+	}
+
+	password, _ := uri.User.Password()
+	apiKey := os.Getenv(elasticsearchAPIKeyEnv)
+
+	if uri.Scheme == opensearchScheme {
+		cfg := opensearch.Config{
+			Addresses: []string{stg.endpoint},
+			Username:  uri.User.Username(),
+			Password:  password,
+			Transport: compliance.Transport(),
+		}
+
+		if apiKey != "" {
+			cfg.Header = http.Header{"Authorization": {"ApiKey " + apiKey}}
+		}
+
+		client, err := opensearch.NewClient(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create opensearch client: %w", err)
+		}
+
+		stg.api = opensearchClient{client: client}
+
+		return stg, nil
+	}
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{stg.endpoint},
+		Username:  uri.User.Username(),
+		Password:  password,
+		APIKey:    apiKey,
+		Transport: compliance.Transport(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create elasticsearch client: %w", err)
+	}
+
+	stg.api = elasticsearchClient{client: client}
+
+	return stg, nil
+}
+
+// Close implements the storage interface. The clients of the cluster do not hold a connection open.
+func (stg *Elasticsearch) Close() {}
+
+// IsNoSQL returns "true" to indicate that "Elasticsearch" is a NoSQL database.
+func (stg *Elasticsearch) IsNoSQL() bool { return true }
+
+// Type implements the storage interface.
+func (stg *Elasticsearch) Type() uint8 { return ElasticsearchType }
+
+// tablePrimaryKey will return the field of the records of the table that is the ID of their documents.
+func (stg *Elasticsearch) tablePrimaryKey(table string) string {
+	if field, ok := stg.primaryKeys[table]; ok {
+		return field
+	}
+
+	return stg.primaryKey
+}
+
+// index will return the name of the index of the table: the prefix and the table in lower case, with the characters
+// that index names must not contain replaced with underscores.
+func (stg *Elasticsearch) index(table string) string {
+	index := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(elasticsearchInvalidIndexChars, r) {
+			return '_'
+		}
+
+		return r
+	}, strings.ToLower(stg.prefix+table))
+
+	return strings.TrimLeft(index, "-_+")
+}
+
+// elasticsearchBody will encode the body of a request as JSON.
+func elasticsearchBody(body interface{}) (io.Reader, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// elasticsearchDecode will decode the response of the request of the operation into "out" if it is not nil. The
+// status code of the response is returned with the error of an unsuccessful request, with the type and reason of the
+// error in the message.
+func elasticsearchDecode(op string, rsp *elasticsearchResponse, err error, out interface{}) (int, error) {
+	if err != nil {
+		return 0, ElasticsearchError(op, err)
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode/100 != 2 {
+		var apiErr struct {
+			Error struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		}
+
+		msg, _ := io.ReadAll(io.LimitReader(rsp.Body, 1<<10))
+		if json.Unmarshal(msg, &apiErr) == nil && apiErr.Error.Type != "" {
+			msg = []byte(apiErr.Error.Type + ": " + apiErr.Error.Reason)
+		}
+
+		return rsp.StatusCode, ElasticsearchError(op, fmt.Errorf("unexpected status %d %s: %s", rsp.StatusCode,
+			http.StatusText(rsp.StatusCode), bytes.TrimSpace(msg)))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(rsp.Body).Decode(out); err != nil {
+			return rsp.StatusCode, ElasticsearchError(op, fmt.Errorf("unable to decode response: %w", err))
+		}
+	}
+
+	return rsp.StatusCode, nil
+}
+
+// ensureIndex will create the index if it has not been created or found to exist, with a dynamic template that maps
+// strings to "keyword" fields.
+func (stg *Elasticsearch) ensureIndex(ctx context.Context, index string) error {
+	stg.mtx.Lock()
+	defer stg.mtx.Unlock()
+
+	if stg.indices[index] {
+		return nil
+	}
+
+	mappings := map[string]interface{}{
+		"mappings": map[string]interface{}{
+			"dynamic_templates": []interface{}{
+				map[string]interface{}{
+					"strings": map[string]interface{}{
+						"match_mapping_type": "string",
+						"mapping":            map[string]interface{}{"type": "keyword"},
+					},
+				},
+			},
+		},
+	}
+
+	body, err := elasticsearchBody(mappings)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := stg.api.createIndex(ctx, index, body)
+
+	status, err := elasticsearchDecode("create index "+index, rsp, err, nil)
+	if err != nil && (status != http.StatusBadRequest || !strings.Contains(err.Error(), "resource_already_exists")) {
+		return fmt.Errorf("unable to create index %s: %w", index, err)
+	}
+
+	stg.indices[index] = true
+
+	return nil
+}
+
+// bulkActions will return the bulk actions that upsert the records into the index of the table: an update with
+// "doc_as_upsert" for each record with a primary key, and an index action with a generated ID for each record
+// without one.
+func (stg *Elasticsearch) bulkActions(table string, records []*structpb.Struct) ([][]byte, error) {
+	index := stg.index(table)
+	field := stg.tablePrimaryKey(table)
+	actions := make([][]byte, 0, len(records))
+
+	for _, record := range records {
+		var meta, doc interface{}
+
+		switch value, ok := record.GetFields()[field]; {
+		case !ok || value.AsInterface() == nil:
+			meta = map[string]interface{}{"index": map[string]string{"_index": index}}
+			doc = record
+		default:
+			id, ok := redisPrimaryKey(value)
+			if !ok {
+				return nil, ElasticsearchPrimaryKeyError(table, field)
+			}
+
+			meta = map[string]interface{}{"update": map[string]string{"_index": index, "_id": id}}
+			doc = map[string]interface{}{"doc": record, "doc_as_upsert": true}
+		}
+
+		var action bytes.Buffer
+
+		for _, line := range []interface{}{meta, doc} {
+			data, err := json.Marshal(line)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+			}
+
+			action.Write(data)
+			action.WriteByte('\n')
+		}
+
+		actions = append(actions, action.Bytes())
+	}
+
+	return actions, nil
+}
+
+// bulk will send the actions in bulk requests of up to "elasticsearchBulkActions" actions and
+// "elasticsearchBulkBytes" bytes, and return the error of the first action that fails.
+func (stg *Elasticsearch) bulk(ctx context.Context, actions [][]byte) error {
+	for start := 0; start < len(actions); {
+		var body []byte
+
+		end := start
+		for end < len(actions) && end-start < elasticsearchBulkActions &&
+			(end == start || len(body)+len(actions[end]) <= elasticsearchBulkBytes) {
+			body = append(body, actions[end]...)
+			end++
+		}
+
+		var rsp struct {
+			Errors bool `json:"errors"`
+			Items  []map[string]struct {
+				ID    string `json:"_id"`
+				Error *struct {
+					Type   string `json:"type"`
+					Reason string `json:"reason"`
+				} `json:"error"`
+			} `json:"items"`
+		}
+
+		bulk, err := stg.api.bulk(ctx, bytes.NewReader(body), stg.refresh)
+		if _, err := elasticsearchDecode("bulk", bulk, err, &rsp); err != nil {
+			return err
+		}
+
+		if rsp.Errors {
+			for _, item := range rsp.Items {
+				for op, result := range item {
+					if result.Error != nil {
+						return ElasticsearchError("bulk", fmt.Errorf("%s %q: %s: %s", op, result.ID,
+							result.Error.Type, result.Error.Reason))
+					}
+				}
+			}
+		}
+
+		start = end
+	}
+
+	return nil
+}
+
+// Upsert will write each record as a document of the index of the table, merging the fields of the record into the
+// document with its primary key, or adding a document with a generated ID if the record has no primary key. Within a
+// transaction, the actions are sent when the transaction commits.
+func (stg *Elasticsearch) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	if len(records) == 0 {
+		return &proto.UpsertResponse{}, nil
+	}
+
+	if err := stg.ensureIndex(ctx, stg.index(req.GetTable())); err != nil {
+		return nil, err
+	}
+
+	actions, err := stg.bulkActions(req.GetTable(), records)
+	if err != nil {
+		return nil, err
+	}
+
+	if tx := stg.tx(ctx); tx != nil {
+		tx.mtx.Lock()
+		defer tx.mtx.Unlock()
+
+		tx.actions = append(tx.actions, actions...)
+
+		return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+	}
+
+	if err := stg.bulk(ctx, actions); err != nil {
+		return nil, fmt.Errorf("unable to upsert records: %w", err)
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *Elasticsearch) tx(ctx context.Context) *elasticsearchTx {
+	txID, ok := ctx.Value(basicElasticsearchTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	esTx, _ := tx.(*elasticsearchTx)
+
+	return esTx
+}
+
+// elasticsearchEquals will return the query that matches documents where the field has the value, or does not
+// exist if the value is null.
+func elasticsearchEquals(field string, value interface{}) map[string]interface{} {
+	if value == nil {
+		return map[string]interface{}{
+			"bool": map[string]interface{}{"must_not": map[string]interface{}{"exists": map[string]string{"field": field}}},
+		}
+	}
+
+	return map[string]interface{}{"term": map[string]interface{}{field: value}}
+}
+
+// elasticsearchAfter will return the query that matches documents that sort after the "after" values of the page,
+// i.e. with the first "orderBy" fields equal to the "after" values and the next greater. Missing values sort first.
+func elasticsearchAfter(page *readPage) map[string]interface{} {
+	should := make([]interface{}, 0, len(page.orderBy))
+
+	for idx, field := range page.orderBy {
+		must := make([]interface{}, 0, idx+1)
+		for prev := 0; prev < idx; prev++ {
+			must = append(must, elasticsearchEquals(page.orderBy[prev], page.after[prev]))
+		}
+
+		if after := page.after[idx]; after == nil {
+			must = append(must, map[string]interface{}{"exists": map[string]string{"field": field}})
+		} else {
+			must = append(must, map[string]interface{}{"range": map[string]interface{}{field: map[string]interface{}{
+				"gt": after,
+			}}})
+		}
+
+		should = append(should, map[string]interface{}{"bool": map[string]interface{}{"must": must}})
+	}
+
+	return map[string]interface{}{"bool": map[string]interface{}{"should": should, "minimum_should_match": 1}}
+}
+
+// elasticsearchSearch will return the body of the search for the records of a read request: a "bool" query with a
+// "term" filter for each required field, or a "terms" filter for a required list, a filter for the documents after
+// the "after" values of the page, and a sort by the "orderBy" fields of the page.
+func elasticsearchSearch(required map[string]*structpb.Value, page *readPage) map[string]interface{} {
+	filter := make([]interface{}, 0, len(required)+1)
+
+	for field, want := range required {
+		if list := want.GetListValue(); list != nil {
+			filter = append(filter, map[string]interface{}{"terms": map[string]interface{}{field: list.AsSlice()}})
+		} else {
+			filter = append(filter, elasticsearchEquals(field, want.AsInterface()))
+		}
+	}
+
+	sort := []interface{}{"_doc"}
+
+	if page != nil && len(page.orderBy) > 0 {
+		sort = make([]interface{}, 0, len(page.orderBy))
+
+		for _, field := range page.orderBy {
+			sort = append(sort, map[string]interface{}{field: map[string]interface{}{
+				"order":         "asc",
+				"missing":       "_first",
+				"unmapped_type": "keyword",
+			}})
+		}
+
+		if len(page.after) > 0 {
+			filter = append(filter, elasticsearchAfter(page))
+		}
+	}
+
+	size := elasticsearchScrollSize
+	if page != nil && page.limit > 0 && page.limit < size {
+		size = page.limit
+	}
+
+	query := map[string]interface{}{"match_all": map[string]interface{}{}}
+	if len(filter) > 0 {
+		query = map[string]interface{}{"bool": map[string]interface{}{"filter": filter}}
+	}
+
+	return map[string]interface{}{"query": query, "sort": sort, "size": size}
+}
+
+// Read will return the documents of the index of the table that match the required fields on the request, in the
+// page requested by the options of the request, if any. The required fields, page, and sort are sent as a query, and
+// the documents are read with a scroll.
+func (stg *Elasticsearch) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	index := stg.index(req.GetTable())
+
+	body, err := elasticsearchBody(elasticsearchSearch(req.GetRequired().GetFields(), page))
+	if err != nil {
+		return nil, err
+	}
+
+	var rsp elasticsearchSearchResponse
+
+	search, err := stg.api.search(ctx, index, body, elasticsearchScrollTTL)
+
+	status, err := elasticsearchDecode("search "+index, search, err, &rsp)
+	if status == http.StatusNotFound {
+		return &proto.ReadResponse{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read records: %w", err)
+	}
+
+	defer stg.clearScroll(rsp.ScrollID)
+
+	var records []map[string]interface{}
+
+	for len(rsp.Hits.Hits) > 0 {
+		for _, hit := range rsp.Hits.Hits {
+			if page != nil && page.limit > 0 && len(records) == page.limit {
+				break
+			}
+
+			records = append(records, hit.Source)
+		}
+
+		if page != nil && page.limit > 0 && len(records) == page.limit {
+			break
+		}
+
+		next, err := stg.api.scroll(ctx, rsp.ScrollID, elasticsearchScrollTTL)
+
+		rsp = elasticsearchSearchResponse{}
+		if _, err := elasticsearchDecode("scroll", next, err, &rsp); err != nil {
+			return nil, fmt.Errorf("unable to read records: %w", err)
+		}
+	}
+
+	return redisPage(records, nil)
+}
+
+// Count will return the number of documents of the index that match the required fields with the "_count" API, or
+// zero if the index does not exist.
+func (stg *Elasticsearch) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	index := stg.index(req.GetTable())
+	search := elasticsearchSearch(req.GetRequired().GetFields(), nil)
+
+	body, err := elasticsearchBody(map[string]interface{}{"query": search["query"]})
+	if err != nil {
+		return nil, err
+	}
+
+	var rsp struct {
+		Count int64 `json:"count"`
+	}
+
+	count, err := stg.api.count(ctx, index, body)
+
+	status, err := elasticsearchDecode("count "+index, count, err, &rsp)
+	if status == http.StatusNotFound {
+		return &proto.CountResponse{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to count records: %w", err)
+	}
+
+	return &proto.CountResponse{Count: rsp.Count}, nil
+}
+
+// clearScroll will close the scroll once it is read, even if the context of the read is done.
+func (stg *Elasticsearch) clearScroll(scrollID string) {
+	if scrollID == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	rsp, err := stg.api.clearScroll(ctx, scrollID)
+	_, _ = elasticsearchDecode("clear scroll", rsp, err, nil)
+}
+
+// Truncate will delete every document of the indices of the tables, which are kept with their mappings.
+func (stg *Elasticsearch) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	var deleted int32
+
+	for _, table := range req.GetTables() {
+		var rsp struct {
+			Deleted int32 `json:"deleted"`
+		}
+
+		index := stg.index(table)
+
+		body, err := elasticsearchBody(map[string]interface{}{
+			"query": map[string]interface{}{"match_all": map[string]interface{}{}},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		deleteRsp, err := stg.api.deleteByQuery(ctx, index, body)
+
+		status, err := elasticsearchDecode("delete by query "+index, deleteRsp, err, &rsp)
+		if err != nil && status != http.StatusNotFound {
+			return nil, fmt.Errorf("error truncating table %s: %w", table, err)
+		}
+
+		deleted += rsp.Deleted
+	}
+
+	return &proto.TruncateResponse{DeletedCount: deleted}, nil
+}
+
+// ListTables will return the tables of the indices with the prefix of the connection string, with their size in
+// bytes. Hidden and system indices, which start with ".", are not listed.
+func (stg *Elasticsearch) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	var indices []struct {
+		Index string `json:"index"`
+		Size  string `json:"store.size"`
+	}
+
+	cat, err := stg.api.catIndices(ctx, strings.ToLower(stg.prefix)+"*")
+	if _, err := elasticsearchDecode("cat indices", cat, err, &indices); err != nil {
+		return nil, fmt.Errorf("unable to list tables: %w", err)
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+
+	for _, index := range indices {
+		if strings.HasPrefix(index.Index, ".") {
+			continue
+		}
+
+		size, _ := strconv.ParseInt(index.Size, 10, 64)
+		rsp.TableSet[strings.TrimPrefix(index.Index, strings.ToLower(stg.prefix))] = &proto.Table{Size: size}
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will return the primary key field of each table.
+func (stg *Elasticsearch) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	tables, err := stg.ListTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+
+	for table := range tables.GetTableSet() {
+		rsp.PKSet[table] = &proto.PrimaryKeys{List: []string{stg.tablePrimaryKey(table)}}
+	}
+
+	return rsp, nil
+}
+
+// StartTx will start a transaction. The bulk actions of the functions sent to the transaction are buffered, and sent
+// when the transaction commits. Bulk requests are not atomic, so a commit that fails may have written some of the
+// documents. Reads in the transaction do not see its buffered actions.
+func (stg *Elasticsearch) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+	tx := new(elasticsearchTx)
+
+	stg.activeTx.Store(txnID, tx)
+
+	esCtx := context.WithValue(ctx, basicElasticsearchTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+
+		var err error
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(esCtx, stg)
+		}
+
+		if err != nil {
+			<-txn.commit
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit {
+			if err = stg.bulk(ctx, tx.actions); err != nil {
+				err = fmt.Errorf("unable to commit transaction: %w", err)
+			}
+		}
+
+		txn.done <- err
+	}()
+
+	return txn, nil
+}
+
+// elasticsearchResponse is the status code and body of a response of the cluster.
+type elasticsearchResponse struct {
+	StatusCode int
+	Body       io.ReadCloser
+}
+
+// elasticsearchAPI are the requests of the storage device to the cluster, made with the client library of the
+// cluster: go-elasticsearch for Elasticsearch, and opensearch-go for OpenSearch. Bodies are JSON, or newline
+// delimited JSON for bulk requests.
+type elasticsearchAPI interface {
+	createIndex(ctx context.Context, index string, body io.Reader) (*elasticsearchResponse, error)
+	bulk(ctx context.Context, body io.Reader, refresh string) (*elasticsearchResponse, error)
+	search(ctx context.Context, index string, body io.Reader, scroll time.Duration) (*elasticsearchResponse, error)
+	scroll(ctx context.Context, scrollID string, scroll time.Duration) (*elasticsearchResponse, error)
+	clearScroll(ctx context.Context, scrollID string) (*elasticsearchResponse, error)
+	count(ctx context.Context, index string, body io.Reader) (*elasticsearchResponse, error)
+	deleteByQuery(ctx context.Context, index string, body io.Reader) (*elasticsearchResponse, error)
+	catIndices(ctx context.Context, pattern string) (*elasticsearchResponse, error)
+}
+
+// elasticsearchScrollBody will return the body of a request for the scroll, which is sent in the body rather than
+// the path or query, since scroll IDs can be long.
+func elasticsearchScrollBody(scrollID string) io.Reader {
+	body, _ := elasticsearchBody(map[string]interface{}{"scroll_id": scrollID})
+
+	return body
+}
+
+// elasticsearchClient makes the requests to an Elasticsearch cluster with go-elasticsearch.
+type elasticsearchClient struct {
+	client *elasticsearch.Client
+}
+
+func (api elasticsearchClient) do(ctx context.Context, req esapi.Request) (*elasticsearchResponse, error) {
+	rsp, err := req.Do(ctx, api.client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &elasticsearchResponse{StatusCode: rsp.StatusCode, Body: rsp.Body}, nil
+}
+
+func (api elasticsearchClient) createIndex(ctx context.Context, index string,
+	body io.Reader,
+) (*elasticsearchResponse, error) {
+	return api.do(ctx, esapi.IndicesCreateRequest{Index: index, Body: body})
+}
+
+func (api elasticsearchClient) bulk(ctx context.Context, body io.Reader,
+	refresh string,
+) (*elasticsearchResponse, error) {
+	return api.do(ctx, esapi.BulkRequest{Body: body, Refresh: refresh})
+}
+
+func (api elasticsearchClient) search(ctx context.Context, index string, body io.Reader,
+	scroll time.Duration,
+) (*elasticsearchResponse, error) {
+	return api.do(ctx, esapi.SearchRequest{Index: []string{index}, Body: body, Scroll: scroll})
+}
+
+func (api elasticsearchClient) scroll(ctx context.Context, scrollID string,
+	scroll time.Duration,
+) (*elasticsearchResponse, error) {
+	return api.do(ctx, esapi.ScrollRequest{Body: elasticsearchScrollBody(scrollID), Scroll: scroll})
+}
+
+func (api elasticsearchClient) clearScroll(ctx context.Context, scrollID string) (*elasticsearchResponse, error) {
+	return api.do(ctx, esapi.ClearScrollRequest{Body: elasticsearchScrollBody(scrollID)})
+}
+
+func (api elasticsearchClient) count(ctx context.Context, index string,
+	body io.Reader,
+) (*elasticsearchResponse, error) {
+	return api.do(ctx, esapi.CountRequest{Index: []string{index}, Body: body})
+}
+
+func (api elasticsearchClient) deleteByQuery(ctx context.Context, index string,
+	body io.Reader,
+) (*elasticsearchResponse, error) {
+	refresh := true
+
+	return api.do(ctx, esapi.DeleteByQueryRequest{
+		Index: []string{index}, Body: body, Conflicts: "proceed", Refresh: &refresh,
+	})
+}
+
+func (api elasticsearchClient) catIndices(ctx context.Context, pattern string) (*elasticsearchResponse, error) {
+	return api.do(ctx, esapi.CatIndicesRequest{
+		Index: []string{pattern}, Format: "json", H: []string{"index", "store.size"}, Bytes: "b",
+	})
+}
+
+// opensearchClient makes the requests to an OpenSearch cluster with opensearch-go.
+type opensearchClient struct {
+	client *opensearch.Client
+}
+
+func (api opensearchClient) do(ctx context.Context, req opensearch.Request) (*elasticsearchResponse, error) {
+	rsp, err := api.client.Do(ctx, req, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &elasticsearchResponse{StatusCode: rsp.StatusCode, Body: rsp.Body}, nil
+}
+
+func (api opensearchClient) createIndex(ctx context.Context, index string,
+	body io.Reader,
+) (*elasticsearchResponse, error) {
+	return api.do(ctx, opensearchapi.IndicesCreateReq{Index: index, Body: body})
+}
+
+func (api opensearchClient) bulk(ctx context.Context, body io.Reader,
+	refresh string,
+) (*elasticsearchResponse, error) {
+	return api.do(ctx, opensearchapi.BulkReq{Body: body, Params: opensearchapi.BulkParams{Refresh: refresh}})
+}
+
+func (api opensearchClient) search(ctx context.Context, index string, body io.Reader,
+	scroll time.Duration,
+) (*elasticsearchResponse, error) {
+	return api.do(ctx, &opensearchapi.SearchReq{
+		Indices: []string{index}, Body: body, Params: opensearchapi.SearchParams{Scroll: scroll},
+	})
+}
+
+func (api opensearchClient) scroll(ctx context.Context, scrollID string,
+	scroll time.Duration,
+) (*elasticsearchResponse, error) {
+	return api.do(ctx, opensearchapi.ScrollGetReq{
+		ScrollID: scrollID, Params: opensearchapi.ScrollGetParams{Scroll: scroll},
+	})
+}
+
+func (api opensearchClient) clearScroll(ctx context.Context, scrollID string) (*elasticsearchResponse, error) {
+	return api.do(ctx, opensearchapi.ScrollDeleteReq{Body: elasticsearchScrollBody(scrollID)})
+}
+
+func (api opensearchClient) count(ctx context.Context, index string,
+	body io.Reader,
+) (*elasticsearchResponse, error) {
+	return api.do(ctx, opensearchapi.IndicesCountReq{Indices: []string{index}, Body: body})
+}
+
+func (api opensearchClient) deleteByQuery(ctx context.Context, index string,
+	body io.Reader,
+) (*elasticsearchResponse, error) {
+	refresh := true
+
+	return api.do(ctx, opensearchapi.DocumentDeleteByQueryReq{
+		Indices: []string{index}, Body: body,
+		Params: opensearchapi.DocumentDeleteByQueryParams{Conflicts: "proceed", Refresh: &refresh},
+	})
+}
+
+func (api opensearchClient) catIndices(ctx context.Context, pattern string) (*elasticsearchResponse, error) {
+	return api.do(ctx, opensearchapi.CatIndicesReq{
+		Indices: []string{pattern}, Params: opensearchapi.CatIndicesParams{H: []string{"index", "store.size"}, Bytes: "b"},
+	})
+}
@@ -0,0 +1,474 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// elasticsearchServer is an Elasticsearch server that applies bulk actions to the documents of its indices, and
+// answers every search with the documents of the index, a document per scroll page, and every count with the number
+// of documents of the index, without applying the query. Documents with a "fail" field fail to be written.
+type elasticsearchServer struct {
+	mtx      sync.Mutex
+	indices  map[string][]map[string]interface{}
+	creates  int
+	bulks    []string
+	searches []map[string]interface{}
+	cleared  int
+}
+
+func (srv *elasticsearchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	// The Elasticsearch client checks that the server is Elasticsearch.
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+
+	if user, password, ok := r.BasicAuth(); !ok || user != "elastic" || password != "secret" {
+		http.Error(w, `{"error":{"type":"security_exception","reason":"unauthorized"}}`, http.StatusUnauthorized)
+
+		return
+	}
+
+	notFound := func(index string) {
+		http.Error(w, `{"error":{"type":"index_not_found_exception","reason":"no such index [`+index+`]"}}`,
+			http.StatusNotFound)
+	}
+
+	index, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodPut && action == "":
+		if _, ok := srv.indices[index]; ok {
+			http.Error(w, `{"error":{"type":"resource_already_exists_exception","reason":"exists"}}`,
+				http.StatusBadRequest)
+
+			return
+		}
+
+		srv.creates++
+		srv.indices[index] = nil
+	case r.Method == http.MethodPost && index == "_bulk":
+		srv.bulk(w, r)
+	case r.Method == http.MethodPost && action == "_search":
+		var search map[string]interface{}
+
+		_ = json.NewDecoder(r.Body).Decode(&search)
+		srv.searches = append(srv.searches, search)
+
+		docs, ok := srv.indices[index]
+		if !ok {
+			notFound(index)
+
+			return
+		}
+
+		srv.page(w, index, docs, 0)
+	case r.Method == http.MethodPost && action == "_count":
+		var search map[string]interface{}
+
+		_ = json.NewDecoder(r.Body).Decode(&search)
+		srv.searches = append(srv.searches, search)
+
+		docs, ok := srv.indices[index]
+		if !ok {
+			notFound(index)
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]int{"count": len(docs)})
+	case r.Method == http.MethodPost && index == "_search":
+		var next struct {
+			ScrollID string `json:"scroll_id"`
+		}
+
+		_ = json.NewDecoder(r.Body).Decode(&next)
+
+		index, offset, _ := strings.Cut(next.ScrollID, ":")
+		srv.page(w, index, srv.indices[index], len(offset))
+	case r.Method == http.MethodDelete && index == "_search":
+		srv.cleared++
+	case r.Method == http.MethodPost && action == "_delete_by_query":
+		docs, ok := srv.indices[index]
+		if !ok {
+			notFound(index)
+
+			return
+		}
+
+		srv.indices[index] = nil
+		_ = json.NewEncoder(w).Encode(map[string]int{"deleted": len(docs)})
+	case r.Method == http.MethodGet && index == "_cat":
+		indices := []map[string]string{{"index": ".kibana", "store.size": "1"}}
+		for name := range srv.indices {
+			indices = append(indices, map[string]string{"index": name, "store.size": "123"})
+		}
+
+		_ = json.NewEncoder(w).Encode(indices)
+	default:
+		notFound(index)
+	}
+}
+
+// page will write a page of the scroll with the document at the offset, and the ID of the scroll with the offset of
+// the next document as the length of its suffix.
+func (srv *elasticsearchServer) page(w http.ResponseWriter, index string, docs []map[string]interface{}, offset int) {
+	var rsp elasticsearchSearchResponse
+
+	rsp.ScrollID = index + ":" + strings.Repeat("x", offset+1)
+	if offset < len(docs) {
+		source := make(map[string]interface{})
+
+		for key, value := range docs[offset] {
+			if key != "_id" {
+				source[key] = value
+			}
+		}
+
+		rsp.Hits.Hits = []elasticsearchHit{{Source: source}}
+	}
+
+	_ = json.NewEncoder(w).Encode(rsp)
+}
+
+func (srv *elasticsearchServer) bulk(w http.ResponseWriter, r *http.Request) {
+	var body bytes.Buffer
+
+	scanner := bufio.NewScanner(r.Body)
+	rsp := map[string]interface{}{"errors": false}
+
+	var items []interface{}
+
+	for scanner.Scan() {
+		var meta map[string]map[string]string
+
+		_ = json.Unmarshal(scanner.Bytes(), &meta)
+		body.WriteString(scanner.Text() + "\n")
+
+		scanner.Scan()
+		body.WriteString(scanner.Text() + "\n")
+
+		var line struct {
+			Doc    map[string]interface{} `json:"doc"`
+			Upsert bool                   `json:"doc_as_upsert"`
+		}
+
+		_ = json.Unmarshal(scanner.Bytes(), &line)
+
+		for op, target := range meta {
+			doc := line.Doc
+			if op == "index" {
+				_ = json.Unmarshal(scanner.Bytes(), &doc)
+			}
+
+			if _, ok := doc["fail"]; ok {
+				rsp["errors"] = true
+				items = append(items, map[string]interface{}{op: map[string]interface{}{
+					"_id":   target["_id"],
+					"error": map[string]string{"type": "mapper_parsing_exception", "reason": "failed to parse"},
+				}})
+
+				continue
+			}
+
+			items = append(items, map[string]interface{}{op: map[string]interface{}{"_id": target["_id"]}})
+
+			docs := srv.indices[target["_index"]]
+			merged := false
+
+			for _, existing := range docs {
+				if op == "update" && existing["_id"] == target["_id"] {
+					for key, value := range doc {
+						existing[key] = value
+					}
+
+					merged = true
+				}
+			}
+
+			if !merged {
+				doc["_id"] = target["_id"]
+				srv.indices[target["_index"]] = append(docs, doc)
+			}
+		}
+	}
+
+	srv.bulks = append(srv.bulks, r.URL.Query().Get("refresh")+"\n"+body.String())
+	rsp["items"] = items
+
+	_ = json.NewEncoder(w).Encode(rsp)
+}
+
+func newTestElasticsearch(t *testing.T, scheme, params string) (*Elasticsearch, *elasticsearchServer) {
+	t.Helper()
+
+	srv := &elasticsearchServer{indices: make(map[string][]map[string]interface{})}
+
+	server := httptest.NewServer(srv)
+	t.Cleanup(server.Close)
+
+	svc, err := New(context.Background(), scheme+"://elastic:secret@"+strings.TrimPrefix(server.URL, "http://")+params)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	stg, ok := svc.Storage.(*Elasticsearch)
+	if !ok {
+		t.Fatalf("expected elasticsearch storage, got %T", svc.Storage)
+	}
+
+	return stg, srv
+}
+
+func TestElasticsearch(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("dsn", func(t *testing.T) {
+		t.Parallel()
+
+		for _, dns := range []string{"elasticsearch:///", "opensearch://search1:9200?tls=maybe"} {
+			if _, err := New(ctx, dns); !errors.Is(err, ErrDNSNotSupported) {
+				t.Fatalf("expected error %v for %q, got %v", ErrDNSNotSupported, dns, err)
+			}
+		}
+
+		svc, err := New(ctx, "opensearch://search1:9200?tls=true&prefix=Raw-")
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+
+		stg, _ := svc.Storage.(*Elasticsearch)
+		if stg.Type() != ElasticsearchType || stg.endpoint != "https://search1:9200" ||
+			stg.index("Candles/1m") != "raw-candles_1m" {
+			t.Fatalf("unexpected storage %+v", stg)
+		}
+	})
+
+	for _, scheme := range []string{Scheme(ElasticsearchType), opensearchScheme} {
+		scheme := scheme
+
+		t.Run("upsert and read "+scheme, func(t *testing.T) {
+			t.Parallel()
+
+			stg, srv := newTestElasticsearch(t, scheme, "?prefix=gidari-&primaryKey.candles=time")
+
+			upsert := func(data string) error {
+				_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(data)})
+
+				return err
+			}
+
+			if err := upsert(`[{"time": 1, "open": 1.5}, {"open": 2}]`); err != nil {
+				t.Fatalf("failed to upsert records: %v", err)
+			}
+
+			// The fields of a record are merged into the document with its primary key.
+			if err := upsert(`[{"time": 1, "close": "2"}]`); err != nil {
+				t.Fatalf("failed to upsert records: %v", err)
+			}
+
+			exp := "wait_for\n" +
+				`{"update":{"_id":"1","_index":"gidari-candles"}}` + "\n" +
+				`{"doc":{"open":1.5,"time":1},"doc_as_upsert":true}` + "\n" +
+				`{"index":{"_index":"gidari-candles"}}` + "\n" +
+				`{"open":2}` + "\n"
+
+			if srv.creates != 1 || len(srv.bulks) != 2 || srv.bulks[0] != exp {
+				t.Fatalf("expected the index to be created once and bulk request %q, got %d and %q", exp, srv.creates,
+					srv.bulks)
+			}
+
+			rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "candles"})
+			if err != nil {
+				t.Fatalf("failed to read records: %v", err)
+			}
+
+			var records []map[string]interface{}
+			for _, record := range rsp.GetRecords() {
+				records = append(records, record.AsMap())
+			}
+
+			expRecords := []map[string]interface{}{{"time": 1.0, "open": 1.5, "close": "2"}, {"open": 2.0}}
+			if !reflect.DeepEqual(records, expRecords) || srv.cleared != 1 {
+				t.Fatalf("expected records %v from a cleared scroll, got %v", expRecords, records)
+			}
+
+			if rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "missing"}); err != nil || len(rsp.GetRecords()) != 0 {
+				t.Fatalf("expected no records from a missing index, got %v: %v", rsp, err)
+			}
+
+			tables, err := stg.ListTables(ctx)
+			if err != nil {
+				t.Fatalf("failed to list tables: %v", err)
+			}
+
+			if !reflect.DeepEqual(tables.GetTableSet(), map[string]*proto.Table{"candles": {Size: 123}}) {
+				t.Fatalf("expected table candles, got %v", tables.GetTableSet())
+			}
+
+			pks, err := stg.ListPrimaryKeys(ctx)
+			if err != nil || !reflect.DeepEqual(pks.GetPKSet()["candles"].GetList(), []string{"time"}) {
+				t.Fatalf("expected primary key [time], got %v: %v", pks, err)
+			}
+
+			truncated, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"candles", "missing"}})
+			if err != nil || truncated.GetDeletedCount() != 2 {
+				t.Fatalf("expected 2 deleted records, got %v: %v", truncated, err)
+			}
+
+		})
+	}
+
+	t.Run("query", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestElasticsearch(t, Scheme(ElasticsearchType), "")
+		srv.indices["candles"] = []map[string]interface{}{{"id": 1}, {"id": 2}, {"id": 3}}
+
+		opts, err := structpb.NewStruct(map[string]interface{}{
+			ReadOrderByOption: []interface{}{"id", "name"},
+			ReadAfterOption:   []interface{}{1, "a"},
+			ReadLimitOption:   2,
+		})
+		if err != nil {
+			t.Fatalf("failed to create read options: %v", err)
+		}
+
+		required, err := structpb.NewStruct(map[string]interface{}{"name": []interface{}{"a", "b"}})
+		if err != nil {
+			t.Fatalf("failed to create required fields: %v", err)
+		}
+
+		rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "candles", Required: required, Options: opts})
+		if err != nil {
+			t.Fatalf("failed to read records: %v", err)
+		}
+
+		if len(rsp.GetRecords()) != 2 {
+			t.Fatalf("expected the limit to stop the scroll, got %v", rsp.GetRecords())
+		}
+
+		var exp map[string]interface{}
+
+		_ = json.Unmarshal([]byte(`{
+			"query": {"bool": {"filter": [
+				{"terms": {"name": ["a", "b"]}},
+				{"bool": {"minimum_should_match": 1, "should": [
+					{"bool": {"must": [{"range": {"id": {"gt": 1}}}]}},
+					{"bool": {"must": [{"term": {"id": 1}}, {"range": {"name": {"gt": "a"}}}]}}
+				]}}
+			]}},
+			"sort": [
+				{"id": {"order": "asc", "missing": "_first", "unmapped_type": "keyword"}},
+				{"name": {"order": "asc", "missing": "_first", "unmapped_type": "keyword"}}
+			],
+			"size": 2
+		}`), &exp)
+
+		if !reflect.DeepEqual(srv.searches[0], exp) {
+			t.Fatalf("expected search %v, got %v", exp, srv.searches[0])
+		}
+
+		count, err := stg.Count(ctx, &proto.CountRequest{Table: "candles", Required: required})
+		if err != nil || count.GetCount() != 3 {
+			t.Fatalf("expected 3 records, got %v: %v", count, err)
+		}
+
+		var expCount map[string]interface{}
+
+		_ = json.Unmarshal([]byte(`{"query": {"bool": {"filter": [{"terms": {"name": ["a", "b"]}}]}}}`), &expCount)
+
+		if !reflect.DeepEqual(srv.searches[1], expCount) {
+			t.Fatalf("expected count %v, got %v", expCount, srv.searches[1])
+		}
+
+		if count, err := stg.Count(ctx, &proto.CountRequest{Table: "missing"}); err != nil || count.GetCount() != 0 {
+			t.Fatalf("expected no records in a missing index, got %v: %v", count, err)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		stg, _ := newTestElasticsearch(t, Scheme(ElasticsearchType), "")
+
+		_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(`[{"id": 1, "fail": true}]`)})
+		if !errors.Is(err, ErrElasticsearch) || !strings.Contains(err.Error(), "mapper_parsing_exception") {
+			t.Fatalf("expected the error of the bulk item, got %v", err)
+		}
+
+		_, err = stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(`[{"id": {"a": 1}}]`)})
+		if !errors.Is(err, ErrElasticsearchPrimaryKey) {
+			t.Fatalf("expected primary key error, got %v", err)
+		}
+
+		svc, err := New(ctx, "elasticsearch://elastic:wrong@"+strings.TrimPrefix(stg.endpoint, "http://"))
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+
+		if _, err := svc.ListTables(ctx); !errors.Is(err, ErrElasticsearch) ||
+			!strings.Contains(err.Error(), "security_exception") {
+			t.Fatalf("expected an unauthorized error, got %v", err)
+		}
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestElasticsearch(t, Scheme(ElasticsearchType), "?refresh=false")
+
+		for _, commit := range []bool{false, true} {
+			txn, err := stg.StartTx(ctx)
+			if err != nil {
+				t.Fatalf("failed to start transaction: %v", err)
+			}
+
+			txn.Send(func(ctx context.Context, stg Storage) error {
+				_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(`[{"id": "a"}]`)})
+
+				return err
+			})
+
+			if len(srv.bulks) != 0 {
+				t.Fatalf("expected the actions to be buffered, got %v", srv.bulks)
+			}
+
+			if commit {
+				err = txn.Commit()
+			} else {
+				err = txn.Rollback()
+			}
+
+			if err != nil {
+				t.Fatalf("failed to end transaction: %v", err)
+			}
+		}
+
+		if len(srv.bulks) != 1 || !strings.HasPrefix(srv.bulks[0], "false\n") {
+			t.Fatalf("expected a bulk request for the committed transaction, got %v", srv.bulks)
+		}
+	})
+}
@@ -0,0 +1,727 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+)
+
+const (
+	filesystemScheme = "file"
+
+	// filesystemFormatParam is the connection string parameter for the format of the files, "jsonl" or "csv". A
+	// "file://" connection string without it, or with "parquet", writes Parquet files, see "NewParquet".
+	filesystemFormatParam = "format"
+
+	// filesystemRotateSizeParam is the connection string parameter for the size in bytes after which the file of a
+	// table is rotated, e.g. "rotateSize=104857600".
+	filesystemRotateSizeParam = "rotateSize"
+
+	// filesystemRotateIntervalParam is the connection string parameter for the interval after which the file of a
+	// table is rotated, e.g. "rotateInterval=24h".
+	filesystemRotateIntervalParam = "rotateInterval"
+
+	filesystemJSONL = "jsonl"
+	filesystemCSV   = "csv"
+
+	// filesystemRotatedLayout is the layout of the time in the name of rotated files.
+	filesystemRotatedLayout = "20060102T150405Z"
+)
+
+// filesystemRotatedName matches the time, and the sequence number of rotations within the same second, at the end
+// of the name of a rotated file, before its extension.
+var filesystemRotatedName = regexp.MustCompile(`\.\d{8}T\d{6}Z(-\d+)?$`)
+
+// filesystemTxType is the type of the context key of filesystem transactions.
+type filesystemTxType uint8
+
+const (
+	basicFilesystemTxID filesystemTxType = iota
+)
+
+// filesystemTx are the records of a transaction by table, appended when the transaction commits.
+type filesystemTx struct {
+	mtx     sync.Mutex
+	tables  []string
+	records map[string][]map[string]interface{}
+}
+
+// Filesystem is a storage device that appends records to newline-delimited JSON or CSV files in a local directory,
+// e.g. to debug transports or to export data from air-gapped hosts. The records of each table are appended to
+// "<table>.jsonl" (or "<table>.csv"), which is rotated to "<table>.<time>.jsonl" once it reaches the rotation size,
+// or once its last write is in an earlier rotation interval.
+type Filesystem struct {
+	dir            string
+	format         string
+	rotateSize     int64
+	rotateInterval time.Duration
+
+	// mtx serializes the appends, so that the records of an upsert are contiguous in the file.
+	mtx sync.Mutex
+
+	// activeTx are the transactions that are currently active, keyed by the transaction ID that is added to the
+	// context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewFilesystem will return a Filesystem storage device for the connection string, i.e.
+// "file:///<directory>?format=jsonl|csv[&rotateSize=<bytes>&rotateInterval=<duration>]". The directory is created
+// on the first upsert.
+func NewFilesystem(_ context.Context, connectionURL string) (*Filesystem, error) {
+	uri, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	if uri.Scheme != filesystemScheme || uri.Host != "" || uri.Path == "" {
+		return nil, DNSNotSupportedError(connectionURL)
+	}
+
+	params := uri.Query()
+	stg := &Filesystem{dir: filepath.FromSlash(uri.Path), format: params.Get(filesystemFormatParam)}
+
+	if stg.format != filesystemJSONL && stg.format != filesystemCSV {
+		return nil, fmt.Errorf("%w: %s=%q must be %q or %q", ErrDNSNotSupported, filesystemFormatParam, stg.format,
+			filesystemJSONL, filesystemCSV)
+	}
+
+	if size := params.Get(filesystemRotateSizeParam); size != "" {
+		if stg.rotateSize, err = strconv.ParseInt(size, 10, 64); err != nil || stg.rotateSize <= 0 {
+			return nil, fmt.Errorf("%w: %s=%q must be a positive number of bytes", ErrDNSNotSupported,
+				filesystemRotateSizeParam, size)
+		}
+	}
+
+	if interval := params.Get(filesystemRotateIntervalParam); interval != "" {
+		if stg.rotateInterval, err = time.ParseDuration(interval); err != nil || stg.rotateInterval <= 0 {
+			return nil, fmt.Errorf("%w: %s=%q must be a positive duration", ErrDNSNotSupported,
+				filesystemRotateIntervalParam, interval)
+		}
+	}
+
+	return stg, nil
+}
+
+// isFilesystemDNS will return true if the connection string is a "file://" URL with a format other than "parquet",
+// which is written as JSONL or CSV files instead of Parquet files.
+func isFilesystemDNS(dns string) bool {
+	if !strings.HasPrefix(dns, filesystemScheme+"://") {
+		return false
+	}
+
+	uri, err := url.Parse(dns)
+	if err != nil || !uri.Query().Has(filesystemFormatParam) {
+		return false
+	}
+
+	return uri.Query().Get(filesystemFormatParam) != parquetFormat
+}
+
+// Close implements the storage interface. Files are only open while they are written.
+func (stg *Filesystem) Close() {}
+
+// IsNoSQL returns "true" to indicate that "Filesystem" appends records without updating them by primary key.
+func (stg *Filesystem) IsNoSQL() bool { return true }
+
+// Type implements the storage interface.
+func (stg *Filesystem) Type() uint8 { return FilesystemType }
+
+// activeFile will return the path of the file that the records of the table are appended to.
+func (stg *Filesystem) activeFile(table string) string {
+	return filepath.Join(stg.dir, url.PathEscape(table)+"."+stg.format)
+}
+
+// tableOf will return the table of a file in the directory, and false if the file is not a file of a table.
+func (stg *Filesystem) tableOf(name string) (string, bool) {
+	base := strings.TrimSuffix(name, "."+stg.format)
+	if base == name {
+		return "", false
+	}
+
+	table, err := url.PathUnescape(filesystemRotatedName.ReplaceAllString(base, ""))
+	if err != nil || table == "" {
+		return "", false
+	}
+
+	return table, true
+}
+
+// files will return the paths of the files of the tables, rotated files first in the order they were rotated and
+// the active file last. Without tables, the files of every table are returned.
+func (stg *Filesystem) files(tables ...string) (map[string][]string, error) {
+	entries, err := os.ReadDir(stg.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string][]string{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to list files: %w", err)
+	}
+
+	include := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		include[table] = true
+	}
+
+	files := make(map[string][]string)
+
+	for _, entry := range entries {
+		table, ok := stg.tableOf(entry.Name())
+		if !ok || entry.IsDir() || (len(tables) > 0 && !include[table]) {
+			continue
+		}
+
+		files[table] = append(files[table], filepath.Join(stg.dir, entry.Name()))
+	}
+
+	for table, paths := range files {
+		active := stg.activeFile(table)
+
+		sort.Slice(paths, func(i, j int) bool {
+			if (paths[i] == active) != (paths[j] == active) {
+				return paths[j] == active
+			}
+
+			timeI, seqI := stg.rotation(paths[i])
+			timeJ, seqJ := stg.rotation(paths[j])
+
+			if timeI != timeJ {
+				return timeI < timeJ
+			}
+
+			return seqI < seqJ
+		})
+	}
+
+	return files, nil
+}
+
+// rotation will return the time and the sequence number in the name of a rotated file.
+func (stg *Filesystem) rotation(path string) (string, int) {
+	match := filesystemRotatedName.FindString(strings.TrimSuffix(filepath.Base(path), "."+stg.format))
+
+	rotatedAt, seq, _ := strings.Cut(strings.TrimPrefix(match, "."), "-")
+	num, _ := strconv.Atoi(seq)
+
+	return rotatedAt, num
+}
+
+// rotate will rename the active file of the table to a rotated file if appending size bytes would exceed the
+// rotation size, or if its last write is in an earlier rotation interval, returning true if it was rotated. The
+// rotated file is named by the time of its last write.
+func (stg *Filesystem) rotate(table string, size int64, now time.Time) (bool, error) {
+	active := stg.activeFile(table)
+
+	info, err := os.Stat(active)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("unable to stat %s: %w", active, err)
+	}
+
+	if info.Size() == 0 {
+		return false, nil
+	}
+
+	bySize := stg.rotateSize > 0 && info.Size()+size > stg.rotateSize
+	byTime := stg.rotateInterval > 0 && !info.ModTime().Truncate(stg.rotateInterval).Equal(
+		now.Truncate(stg.rotateInterval))
+
+	if !bySize && !byTime {
+		return false, nil
+	}
+
+	return true, stg.rotateFile(table, info.ModTime())
+}
+
+// rotateFile will rename the active file of the table to a rotated file named by the time.
+func (stg *Filesystem) rotateFile(table string, modTime time.Time) error {
+	active := stg.activeFile(table)
+	base := strings.TrimSuffix(active, "."+stg.format) + "." + modTime.UTC().Format(filesystemRotatedLayout)
+
+	rotated := base + "." + stg.format
+	for seq := 1; ; seq++ {
+		if _, err := os.Stat(rotated); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+
+		rotated = base + "-" + strconv.Itoa(seq) + "." + stg.format
+	}
+
+	if err := os.Rename(active, rotated); err != nil {
+		return fmt.Errorf("unable to rotate %s: %w", active, err)
+	}
+
+	return nil
+}
+
+// Upsert will append the records to the file of the table. Within a transaction, the records are appended when the
+// transaction commits.
+func (stg *Filesystem) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	decoded, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	records := make([]map[string]interface{}, 0, len(decoded))
+	for _, record := range decoded {
+		records = append(records, record.AsMap())
+	}
+
+	if tx := stg.tx(ctx); tx != nil {
+		tx.mtx.Lock()
+		defer tx.mtx.Unlock()
+
+		if _, ok := tx.records[req.GetTable()]; !ok {
+			tx.tables = append(tx.tables, req.GetTable())
+		}
+
+		tx.records[req.GetTable()] = append(tx.records[req.GetTable()], records...)
+
+		return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+	}
+
+	if err := stg.append(req.GetTable(), records); err != nil {
+		return nil, err
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+}
+
+// append will append the records to the active file of the table, rotating it first if needed.
+func (stg *Filesystem) append(table string, records []map[string]interface{}) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	stg.mtx.Lock()
+	defer stg.mtx.Unlock()
+
+	if err := os.MkdirAll(stg.dir, 0o755); err != nil {
+		return fmt.Errorf("unable to create directory: %w", err)
+	}
+
+	data, err := stg.encode(table, records)
+	if err != nil {
+		return err
+	}
+
+	rotated, err := stg.rotate(table, int64(len(data)), time.Now())
+	if err != nil {
+		return err
+	}
+
+	// The header of a CSV file is written with its first records, so they are encoded again for a new file.
+	if rotated && stg.format == filesystemCSV {
+		if data, err = stg.encode(table, records); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(stg.activeFile(table), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open file: %w", err)
+	}
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to append records: %w", err)
+	}
+
+	return nil
+}
+
+// encode will encode the records in the format of the files.
+func (stg *Filesystem) encode(table string, records []map[string]interface{}) ([]byte, error) {
+	if stg.format == filesystemCSV {
+		return stg.encodeCSV(table, records)
+	}
+
+	return encodeJSONL(records)
+}
+
+// encodeJSONL will encode each record as a line of JSON.
+func encodeJSONL(records []map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encodeCSV will encode the records as rows of the columns of the active file of the table, with a header if the
+// file is empty. If a record has a field that is not a column of the file, the file is rotated and the new file has
+// the columns of the file and of the records, sorted.
+func (stg *Filesystem) encodeCSV(table string, records []map[string]interface{}) ([]byte, error) {
+	columns, err := stg.csvHeader(table)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		known[column] = true
+	}
+
+	missing := false
+
+	for _, record := range records {
+		for field := range record {
+			if !known[field] {
+				known[field], missing = true, true
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+
+	writer := csv.NewWriter(&buf)
+
+	if missing || len(columns) == 0 {
+		if len(columns) > 0 {
+			info, err := os.Stat(stg.activeFile(table))
+			if err != nil {
+				return nil, fmt.Errorf("unable to stat %s: %w", stg.activeFile(table), err)
+			}
+
+			if err := stg.rotateFile(table, info.ModTime()); err != nil {
+				return nil, err
+			}
+		}
+
+		columns = columns[:0]
+		for column := range known {
+			columns = append(columns, column)
+		}
+
+		sort.Strings(columns)
+
+		if err := writer.Write(columns); err != nil {
+			return nil, fmt.Errorf("unable to encode header: %w", err)
+		}
+	}
+
+	row := make([]string, len(columns))
+
+	for _, record := range records {
+		for idx, column := range columns {
+			if row[idx], err = csvValue(record[column]); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := writer.Write(row); err != nil {
+			return nil, fmt.Errorf("unable to encode record: %w", err)
+		}
+	}
+
+	writer.Flush()
+
+	if err := writer.Error(); err != nil {
+		return nil, fmt.Errorf("unable to encode records: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// csvHeader will return the columns of the header of the active file of the table, or nil if it is empty.
+func (stg *Filesystem) csvHeader(table string) ([]string, error) {
+	file, err := os.Open(stg.activeFile(table))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file: %w", err)
+	}
+
+	defer file.Close()
+
+	header, err := csv.NewReader(bufio.NewReader(file)).Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read header: %w", err)
+	}
+
+	return header, nil
+}
+
+// csvValue will return the cell of a value: strings as they are, null as an empty cell, and other values as JSON.
+func csvValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	default:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+		}
+
+		return string(data), nil
+	}
+}
+
+// readFile will return the records of a file. The cells of CSV files are read as strings, and empty cells are
+// omitted.
+func (stg *Filesystem) readFile(path string) ([]map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+
+	var records []map[string]interface{}
+
+	if stg.format == filesystemJSONL {
+		dec := json.NewDecoder(bytes.NewReader(data))
+
+		for dec.More() {
+			var record map[string]interface{}
+			if err := dec.Decode(&record); err != nil {
+				return nil, fmt.Errorf("unable to decode %s: %w", path, err)
+			}
+
+			records = append(records, record)
+		}
+
+		return records, nil
+	}
+
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %w", path, err)
+	}
+
+	for idx, row := range rows {
+		if idx == 0 {
+			continue
+		}
+
+		record := make(map[string]interface{}, len(row))
+
+		for col, cell := range row {
+			if cell != "" {
+				record[rows[0][col]] = cell
+			}
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *Filesystem) tx(ctx context.Context) *filesystemTx {
+	txID, ok := ctx.Value(basicFilesystemTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	fsTx, _ := tx.(*filesystemTx)
+
+	return fsTx
+}
+
+// Read will return the records of the files of the table that match the required fields on the request, in the page
+// requested by the options of the request, if any.
+func (stg *Filesystem) Read(_ context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := stg.files(req.GetTable())
+	if err != nil {
+		return nil, err
+	}
+
+	required := req.GetRequired().GetFields()
+
+	var records []map[string]interface{}
+
+	for _, path := range files[req.GetTable()] {
+		recs, err := stg.readFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rec := range recs {
+			if parquetMatches(rec, nil, required) {
+				records = append(records, rec)
+			}
+		}
+	}
+
+	return redisPage(records, page)
+}
+
+// Count will return the number of records in the files of the table that match the required fields, by reading them.
+func (stg *Filesystem) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	return readCount(ctx, stg, req)
+}
+
+// Truncate will delete the files of the tables, and count the records deleted.
+func (stg *Filesystem) Truncate(_ context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	if len(req.GetTables()) == 0 {
+		return &proto.TruncateResponse{}, nil
+	}
+
+	stg.mtx.Lock()
+	defer stg.mtx.Unlock()
+
+	files, err := stg.files(req.GetTables()...)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted int32
+
+	for _, paths := range files {
+		for _, path := range paths {
+			recs, err := stg.readFile(path)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("error truncating %s: %w", path, err)
+			}
+
+			deleted += int32(len(recs))
+		}
+	}
+
+	return &proto.TruncateResponse{DeletedCount: deleted}, nil
+}
+
+// ListTables will return the tables with at least one file, and the size of their files in bytes.
+func (stg *Filesystem) ListTables(_ context.Context) (*proto.ListTablesResponse, error) {
+	files, err := stg.files()
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+
+	for table, paths := range files {
+		var size int64
+
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil {
+				size += info.Size()
+			}
+		}
+
+		rsp.TableSet[table] = &proto.Table{Size: size}
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will return no primary keys, since the records of the files are appended without keys.
+func (stg *Filesystem) ListPrimaryKeys(_ context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	return &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}, nil
+}
+
+// StartTx will start a transaction. The records of the functions sent to the transaction are buffered, and appended
+// when the transaction commits, table by table in the order they were first written. The appends are not atomic, so
+// a commit that fails may have appended the records of some tables. Reads in the transaction do not see its buffered
+// records.
+func (stg *Filesystem) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+	tx := &filesystemTx{records: make(map[string][]map[string]interface{})}
+
+	stg.activeTx.Store(txnID, tx)
+
+	filesystemCtx := context.WithValue(ctx, basicFilesystemTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+
+		var err error
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(filesystemCtx, stg)
+		}
+
+		if err != nil {
+			<-txn.commit
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit {
+			for _, table := range tx.tables {
+				if err = stg.append(table, tx.records[table]); err != nil {
+					err = fmt.Errorf("unable to commit transaction: %w", err)
+
+					break
+				}
+			}
+		}
+
+		txn.done <- err
+	}()
+
+	return txn, nil
+}
@@ -0,0 +1,268 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func newTestFilesystem(t *testing.T, params string) (*Filesystem, string) {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "export")
+
+	svc, err := New(context.Background(), "file://"+filepath.ToSlash(dir)+params)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	stg, ok := svc.Storage.(*Filesystem)
+	if !ok {
+		t.Fatalf("expected filesystem storage, got %T", svc.Storage)
+	}
+
+	return stg, dir
+}
+
+// readDir will return the contents of the files in the directory, by name.
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+
+	files := make(map[string]string)
+
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+
+		files[entry.Name()] = string(data)
+	}
+
+	return files
+}
+
+func TestFilesystem(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	upsert := func(t *testing.T, stg Storage, table, data string) {
+		t.Helper()
+
+		if _, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: table, Data: []byte(data)}); err != nil {
+			t.Fatalf("failed to upsert records: %v", err)
+		}
+	}
+
+	t.Run("dsn", func(t *testing.T) {
+		t.Parallel()
+
+		for _, dns := range []string{
+			"file:///var/lib/gidari?format=xml",
+			"file://host/var/lib/gidari?format=jsonl",
+			"file:///var/lib/gidari?format=jsonl&rotateSize=-1",
+			"file:///var/lib/gidari?format=csv&rotateInterval=daily",
+		} {
+			if _, err := New(ctx, dns); !errors.Is(err, ErrDNSNotSupported) {
+				t.Fatalf("expected error %v for %q, got %v", ErrDNSNotSupported, dns, err)
+			}
+		}
+
+		svc, err := New(ctx, "file:///var/lib/gidari?format=csv&rotateSize=1024&rotateInterval=1h")
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+
+		stg, _ := svc.Storage.(*Filesystem)
+		if stg.Type() != FilesystemType || stg.dir != filepath.FromSlash("/var/lib/gidari") || stg.rotateSize != 1024 ||
+			stg.rotateInterval != time.Hour {
+			t.Fatalf("unexpected storage %+v", stg)
+		}
+
+		for _, dns := range []string{"file:///var/lib/gidari", "file:///var/lib/gidari?format=parquet"} {
+			if svc, err := New(ctx, dns); err != nil || svc.Type() != ParquetType {
+				t.Fatalf("expected parquet storage for %q, got %v: %v", dns, svc, err)
+			}
+		}
+	})
+
+	t.Run("jsonl", func(t *testing.T) {
+		t.Parallel()
+
+		stg, dir := newTestFilesystem(t, "?format=jsonl")
+
+		upsert(t, stg, "candles", `[{"id": 1, "note": "<a&b>"}, {"id": 2}]`)
+		upsert(t, stg, "candles", `[{"id": 3, "meta": {"a": [1]}}]`)
+		upsert(t, stg, "orders/fills", `[{"id": 4}]`)
+
+		exp := map[string]string{
+			"candles.jsonl":        "{\"id\":1,\"note\":\"<a&b>\"}\n{\"id\":2}\n{\"id\":3,\"meta\":{\"a\":[1]}}\n",
+			"orders%2Ffills.jsonl": "{\"id\":4}\n",
+		}
+		if files := readDir(t, dir); !reflect.DeepEqual(files, exp) {
+			t.Fatalf("expected files %q, got %q", exp, files)
+		}
+
+		required, err := structpb.NewStruct(map[string]interface{}{"id": []interface{}{1, 3}})
+		if err != nil {
+			t.Fatalf("failed to create required fields: %v", err)
+		}
+
+		rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "candles", Required: required})
+		if err != nil || len(rsp.GetRecords()) != 2 || rsp.GetRecords()[1].AsMap()["meta"] == nil {
+			t.Fatalf("expected the required records, got %v: %v", rsp, err)
+		}
+
+		tables, err := stg.ListTables(ctx)
+		if err != nil || len(tables.GetTableSet()) != 2 || tables.GetTableSet()["orders/fills"].GetSize() != 9 {
+			t.Fatalf("expected the tables and their sizes, got %v: %v", tables, err)
+		}
+
+		truncated, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"candles"}})
+		if err != nil || truncated.GetDeletedCount() != 3 {
+			t.Fatalf("expected 3 deleted records, got %v: %v", truncated, err)
+		}
+
+		if files := readDir(t, dir); len(files) != 1 {
+			t.Fatalf("expected the files of the table to be deleted, got %q", files)
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		t.Parallel()
+
+		stg, dir := newTestFilesystem(t, "?format=csv")
+
+		upsert(t, stg, "candles", `[{"id": 1, "note": "a, \"b\""}, {"id": 2, "note": null}]`)
+		upsert(t, stg, "candles", `[{"note": "c", "id": 3}]`)
+
+		if files := readDir(t, dir); files["candles.csv"] != "id,note\n1,\"a, \"\"b\"\"\"\n2,\n3,c\n" {
+			t.Fatalf("unexpected files %q", files)
+		}
+
+		// A new field starts a new file with a header for it.
+		upsert(t, stg, "candles", `[{"id": 4, "ok": true}]`)
+
+		files := readDir(t, dir)
+		if len(files) != 2 || files["candles.csv"] != "id,note,ok\n4,,true\n" {
+			t.Fatalf("expected the file to be rotated, got %q", files)
+		}
+
+		rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "candles"})
+		if err != nil {
+			t.Fatalf("failed to read records: %v", err)
+		}
+
+		var records []map[string]interface{}
+		for _, record := range rsp.GetRecords() {
+			records = append(records, record.AsMap())
+		}
+
+		exp := []map[string]interface{}{
+			{"id": "1", "note": `a, "b"`}, {"id": "2"}, {"id": "3", "note": "c"}, {"id": "4", "ok": "true"},
+		}
+		if !reflect.DeepEqual(records, exp) {
+			t.Fatalf("expected records %v, got %v", exp, records)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		t.Parallel()
+
+		stg, dir := newTestFilesystem(t, "?format=jsonl&rotateSize=20&rotateInterval=1h")
+
+		for idx := 0; idx < 3; idx++ {
+			upsert(t, stg, "candles", `[{"id": 1}]`)
+		}
+
+		// Each file holds at most two records of 9 bytes.
+		files := readDir(t, dir)
+		if len(files) != 2 || files["candles.jsonl"] != "{\"id\":1}\n" {
+			t.Fatalf("expected the file to be rotated by size, got %q", files)
+		}
+
+		lastWrite := time.Date(2022, 10, 15, 9, 30, 0, 0, time.UTC)
+		if err := os.Chtimes(filepath.Join(dir, "candles.jsonl"), lastWrite, lastWrite); err != nil {
+			t.Fatalf("failed to set the time of the file: %v", err)
+		}
+
+		upsert(t, stg, "candles", `[{"id": 2}]`)
+
+		files = readDir(t, dir)
+		if len(files) != 3 || files["candles.20221015T093000Z.jsonl"] != "{\"id\":1}\n" ||
+			files["candles.jsonl"] != "{\"id\":2}\n" {
+			t.Fatalf("expected the file to be rotated by interval, got %q", files)
+		}
+
+		paths, err := stg.files("candles")
+		if err != nil {
+			t.Fatalf("failed to list files: %v", err)
+		}
+
+		if len(paths["candles"]) != 3 || filepath.Base(paths["candles"][2]) != "candles.jsonl" {
+			t.Fatalf("expected the active file last, got %v", paths)
+		}
+
+		tables, err := stg.ListTables(ctx)
+		if err != nil || !reflect.DeepEqual(tables.GetTableSet(), map[string]*proto.Table{"candles": {Size: 36}}) {
+			t.Fatalf("expected a single table, got %v: %v", tables, err)
+		}
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		t.Parallel()
+
+		stg, dir := newTestFilesystem(t, "?format=jsonl")
+
+		for _, commit := range []bool{false, true} {
+			txn, err := stg.StartTx(ctx)
+			if err != nil {
+				t.Fatalf("failed to start transaction: %v", err)
+			}
+
+			txn.Send(func(ctx context.Context, stg Storage) error {
+				_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(`[{"id": 1}]`)})
+
+				return err
+			})
+
+			if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("expected the records to be buffered, got %v", err)
+			}
+
+			if commit {
+				err = txn.Commit()
+			} else {
+				err = txn.Rollback()
+			}
+
+			if err != nil {
+				t.Fatalf("failed to end transaction: %v", err)
+			}
+		}
+
+		if files := readDir(t, dir); !reflect.DeepEqual(files, map[string]string{"candles.jsonl": "{\"id\":1}\n"}) {
+			t.Fatalf("expected the committed records to be appended, got %q", files)
+		}
+	})
+}
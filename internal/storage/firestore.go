@@ -0,0 +1,711 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	firestoreScheme = "firestore"
+
+	// firestoreCredentialsParam is the connection string parameter for the path of a service account key, e.g.
+	// "credentials=/etc/gidari/key.json". Without it, Application Default Credentials are used.
+	firestoreCredentialsParam = "credentials"
+
+	// firestoreEndpointParam is the connection string parameter for the "host:port" of the Firestore emulator, e.g.
+	// "endpoint=firestore:8080". Requests to an endpoint of the connection string are made without TLS, as the owner
+	// of the emulator.
+	firestoreEndpointParam = "endpoint"
+
+	// firestorePrimaryKeyParam is the connection string parameter for the field of the records that is the ID of
+	// their documents in every collection, e.g. "primaryKey=id". The field for a single table is set with
+	// "primaryKey.<table>", e.g. "primaryKey.candles=time".
+	firestorePrimaryKeyParam = "primaryKey"
+
+	// firestoreEmulatorHostEnv is the environment variable with the "host:port" of the Firestore emulator, which the
+	// client connects to instead of the Firestore API if it is set.
+	firestoreEmulatorHostEnv = "FIRESTORE_EMULATOR_HOST"
+
+	firestoreDefaultDatabase   = "(default)"
+	firestoreDefaultPrimaryKey = "id"
+
+	// firestoreScope is the OAuth 2.0 scope of the Firestore API.
+	firestoreScope = "https://www.googleapis.com/auth/datastore"
+
+	// firestoreBatchWrites is the number of writes of each commit.
+	firestoreBatchWrites = 500
+
+	// firestoreMaxIn is the number of values that an "IN" filter can have.
+	firestoreMaxIn = 30
+
+	// firestoreMaxSafeInteger is the largest integer that a record number can hold exactly, and so be written as an
+	// integer.
+	firestoreMaxSafeInteger = 1 << 53
+)
+
+var (
+	ErrFirestore           = fmt.Errorf("firestore request failed")
+	ErrFirestorePrimaryKey = fmt.Errorf("invalid firestore primary key")
+)
+
+// FirestoreError is returned when a Firestore API request fails.
+func FirestoreError(method, path string, err error) error {
+	return fmt.Errorf("%w: %s %s: %v", ErrFirestore, method, path, err)
+}
+
+// FirestorePrimaryKeyError is returned when the primary key of a record cannot be the ID of a document.
+func FirestorePrimaryKeyError(table, field string) error {
+	return fmt.Errorf("%w: the %q field of records of %q must be a string, number, or boolean", ErrFirestorePrimaryKey,
+		field, table)
+}
+
+// firestoreWrite is a write of a commit: the fields of a document that is set, or a document that is deleted if
+// the fields are nil.
+type firestoreWrite struct {
+	doc    *firestore.DocumentRef
+	fields map[string]interface{}
+}
+
+// firestoreTxType is the type of the context key of Firestore transactions.
+type firestoreTxType uint8
+
+const (
+	basicFirestoreTxID firestoreTxType = iota
+)
+
+// firestoreTx are the writes of a transaction, committed when the transaction commits.
+type firestoreTx struct {
+	mtx    sync.Mutex
+	writes []firestoreWrite
+}
+
+// firestoreOwnerCredentials authorize the requests to the Firestore emulator as its owner, as the client does for
+// the emulator of "FIRESTORE_EMULATOR_HOST".
+type firestoreOwnerCredentials struct{}
+
+// GetRequestMetadata will return the "authorization" metadata of the owner of the emulator.
+func (firestoreOwnerCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer owner"}, nil
+}
+
+// RequireTransportSecurity returns "false", since the emulator is connected to without TLS.
+func (firestoreOwnerCredentials) RequireTransportSecurity() bool { return false }
+
+// Firestore is a storage device that writes records as the documents of Firestore collections, a collection per
+// table. Each record is a document with the primary key of the record as its ID, set with batched commits that
+// replace the documents with the same IDs.
+type Firestore struct {
+	project     string
+	database    string
+	client      *firestore.Client
+	primaryKey  string
+	primaryKeys map[string]string
+
+	// activeTx are the transactions that are currently active, keyed by the transaction ID that is added to the
+	// context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewFirestore will return a Firestore storage device for the connection string, i.e.
+// "firestore://<project>[/<database>][?credentials=<path>]", for the "(default)" database unless one is set.
+// Requests are made with the Firestore client library, authorized with the service account key at the "credentials"
+// path, or with Application Default Credentials. The ID of each document is the "primaryKey" field of its record
+// (default "id", or "primaryKey.<table>" for a single table).
+func NewFirestore(ctx context.Context, connectionURL string) (*Firestore, error) {
+	uri, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	stg := &Firestore{
+		project:     uri.Host,
+		database:    strings.Trim(uri.Path, "/"),
+		primaryKey:  firestoreDefaultPrimaryKey,
+		primaryKeys: make(map[string]string),
+	}
+
+	if stg.project == "" || strings.Contains(stg.database, "/") {
+		return nil, DNSNotSupportedError(connectionURL)
+	}
+
+	if stg.database == "" {
+		stg.database = firestoreDefaultDatabase
+	}
+
+	for key, values := range uri.Query() {
+		switch table := strings.TrimPrefix(key, firestorePrimaryKeyParam+"."); {
+		case key == firestorePrimaryKeyParam:
+			stg.primaryKey = values[0]
+		case table != key:
+			stg.primaryKeys[table] = values[0]
+		}
+	}
+
+	opts, err := firestoreOptions(ctx, uri.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	// The client keeps its context for its connections, which outlive the context of the constructor.
+	stg.client, err = firestore.NewClientWithDatabase(context.WithoutCancel(ctx), stg.project, stg.database, opts...)
+	if err != nil {
+		return nil, FirestoreError("connect", stg.root(), err)
+	}
+
+	return stg, nil
+}
+
+// firestoreOptions will return the options of the Firestore client for the connection string parameters. The
+// emulator at the "endpoint" parameter is connected to without TLS, and the client connects to the emulator of
+// "FIRESTORE_EMULATOR_HOST" itself. Otherwise, connections use TLS with the compliance configuration, and are
+// authorized with the "credentials" file or Application Default Credentials.
+func firestoreOptions(ctx context.Context, query url.Values) ([]option.ClientOption, error) {
+	if endpoint := query.Get(firestoreEndpointParam); endpoint != "" {
+		if uri, err := url.Parse(endpoint); err == nil && uri.Host != "" {
+			endpoint = uri.Host
+		}
+
+		return []option.ClientOption{
+			option.WithEndpoint(endpoint),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+			option.WithGRPCDialOption(grpc.WithPerRPCCredentials(firestoreOwnerCredentials{})),
+		}, nil
+	}
+
+	if os.Getenv(firestoreEmulatorHostEnv) != "" {
+		return nil, nil
+	}
+
+	tokens, err := gcpTokenSource(ctx, query.Get(firestoreCredentialsParam), firestoreScope)
+	if err != nil {
+		return nil, err
+	}
+
+	return []option.ClientOption{
+		option.WithTokenSource(tokens),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(credentials.NewTLS(compliance.TLSConfig("")))),
+	}, nil
+}
+
+// Close will close the connections of the client.
+func (stg *Firestore) Close() {
+	_ = stg.client.Close()
+}
+
+// IsNoSQL returns "true" to indicate that "Firestore" is a NoSQL database.
+func (stg *Firestore) IsNoSQL() bool { return true }
+
+// Type implements the storage interface.
+func (stg *Firestore) Type() uint8 { return FirestoreType }
+
+// tablePrimaryKey will return the field of the records of the table that is the ID of their documents.
+func (stg *Firestore) tablePrimaryKey(table string) string {
+	if field, ok := stg.primaryKeys[table]; ok {
+		return field
+	}
+
+	return stg.primaryKey
+}
+
+// root will return the resource name of the documents of the database.
+func (stg *Firestore) root() string {
+	return fmt.Sprintf("projects/%s/databases/%s/documents", stg.project, stg.database)
+}
+
+// collection will return the collection of the table, or an error if the table is not a collection ID, e.g. if it
+// contains "/".
+func (stg *Firestore) collection(table string) (*firestore.CollectionRef, error) {
+	collection := stg.client.Collection(table)
+	if collection == nil || strings.Contains(table, "/") {
+		return nil, FirestoreError("collection", stg.root(), fmt.Errorf("invalid collection ID %q", table))
+	}
+
+	return collection, nil
+}
+
+// firestoreDocumentID will return the document ID of a primary key. Document IDs can not contain "/", be "." or
+// "..", or start and end with "__", so "%", "/", and the dots and underscores of such IDs are percent-encoded.
+func firestoreDocumentID(key string) string {
+	id := strings.NewReplacer("%", "%25", "/", "%2F").Replace(key)
+
+	switch {
+	case id == "." || id == "..":
+		return strings.ReplaceAll(id, ".", "%2E")
+	case len(id) >= 4 && strings.HasPrefix(id, "__") && strings.HasSuffix(id, "__"):
+		return "%5F" + id[1:]
+	}
+
+	return id
+}
+
+// firestoreValue will encode a value of a record as a Firestore value. Whole numbers that a record can hold exactly
+// are integers, and other numbers doubles. Firestore arrays can not hold arrays, so the arrays of an array are
+// written as JSON strings.
+func firestoreValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) <= firestoreMaxSafeInteger {
+			return int64(value)
+		}
+
+		return value
+	case []interface{}:
+		values := make([]interface{}, 0, len(value))
+
+		for _, elem := range value {
+			if _, ok := elem.([]interface{}); ok {
+				data, _ := json.Marshal(elem)
+				values = append(values, string(data))
+
+				continue
+			}
+
+			values = append(values, firestoreValue(elem))
+		}
+
+		return values
+	case map[string]interface{}:
+		return firestoreFields(value)
+	default:
+		return value
+	}
+}
+
+// firestoreFields will encode the fields of a record as the fields of a document.
+func firestoreFields(record map[string]interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(record))
+	for name, value := range record {
+		fields[name] = firestoreValue(value)
+	}
+
+	return fields
+}
+
+// decodeFirestoreValue will decode a Firestore value to the value of a record. Integers are numbers, timestamps are
+// RFC 3339 strings, bytes are base64 strings, references are the paths of their documents, and geographical points
+// are objects with their latitude and longitude.
+func decodeFirestoreValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case int64:
+		return float64(value)
+	case time.Time:
+		return value.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(value)
+	case *firestore.DocumentRef:
+		return value.Path
+	case *latlng.LatLng:
+		return map[string]interface{}{"latitude": value.GetLatitude(), "longitude": value.GetLongitude()}
+	case []interface{}:
+		decoded := make([]interface{}, 0, len(value))
+		for _, elem := range value {
+			decoded = append(decoded, decodeFirestoreValue(elem))
+		}
+
+		return decoded
+	case map[string]interface{}:
+		decoded := make(map[string]interface{}, len(value))
+		for name, field := range value {
+			decoded[name] = decodeFirestoreValue(field)
+		}
+
+		return decoded
+	default:
+		return value
+	}
+}
+
+// writes will return the writes that set the documents of the records of the table. Records without a primary key
+// are written with a generated ID.
+func (stg *Firestore) writes(table string, records []*structpb.Struct) ([]firestoreWrite, error) {
+	collection, err := stg.collection(table)
+	if err != nil {
+		return nil, err
+	}
+
+	field := stg.tablePrimaryKey(table)
+	writes := make([]firestoreWrite, 0, len(records))
+
+	for _, record := range records {
+		key := uuid.New().String()
+
+		if value, ok := record.GetFields()[field]; ok && value.AsInterface() != nil {
+			if key, ok = redisPrimaryKey(value); !ok {
+				return nil, FirestorePrimaryKeyError(table, field)
+			}
+		}
+
+		writes = append(writes, firestoreWrite{
+			doc:    collection.Doc(firestoreDocumentID(key)),
+			fields: firestoreFields(record.AsMap()),
+		})
+	}
+
+	return writes, nil
+}
+
+// commit will commit the writes in transactions of "firestoreBatchWrites". Each batch is atomic, but the batches are
+// not.
+func (stg *Firestore) commit(ctx context.Context, writes []firestoreWrite) error {
+	for start := 0; start < len(writes); start += firestoreBatchWrites {
+		batch := writes[start:min(start+firestoreBatchWrites, len(writes))]
+
+		err := stg.client.RunTransaction(ctx, func(_ context.Context, tx *firestore.Transaction) error {
+			for _, write := range batch {
+				var err error
+				if write.fields == nil {
+					err = tx.Delete(write.doc)
+				} else {
+					err = tx.Set(write.doc, write.fields)
+				}
+
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return FirestoreError("commit", stg.root(), err)
+		}
+	}
+
+	return nil
+}
+
+// Upsert will set each record as a document of the collection of the table, with the primary key of the record as
+// its ID, replacing the document with the ID. Within a transaction, the documents are set when the transaction
+// commits.
+func (stg *Firestore) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	writes, err := stg.writes(req.GetTable(), records)
+	if err != nil {
+		return nil, err
+	}
+
+	if tx := stg.tx(ctx); tx != nil {
+		tx.mtx.Lock()
+		defer tx.mtx.Unlock()
+
+		tx.writes = append(tx.writes, writes...)
+
+		return &proto.UpsertResponse{UpsertedCount: int64(len(writes))}, nil
+	}
+
+	if err := stg.commit(ctx, writes); err != nil {
+		return nil, fmt.Errorf("unable to upsert records: %w", err)
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(writes))}, nil
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *Firestore) tx(ctx context.Context) *firestoreTx {
+	txID, ok := ctx.Value(basicFirestoreTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	fsTx, _ := tx.(*firestoreTx)
+
+	return fsTx
+}
+
+// firestoreFieldFilter will return the filter of a query on the required field, or false if the field can not be
+// filtered by Firestore, i.e. a required list that is empty or has more values than "IN" allows. A required null is
+// an "IS_NULL" filter.
+func firestoreFieldFilter(name string, want *structpb.Value) (firestore.EntityFilter, bool) {
+	path := firestore.FieldPath{name}
+
+	switch list := want.GetListValue(); {
+	case list != nil && len(list.GetValues()) > 0 && len(list.GetValues()) <= firestoreMaxIn:
+		return firestore.PropertyPathFilter{Path: path, Operator: "in", Value: firestoreValue(list.AsSlice())}, true
+	case list != nil:
+		return nil, false
+	default:
+		return firestore.PropertyPathFilter{Path: path, Operator: "==", Value: firestoreValue(want.AsInterface())},
+			true
+	}
+}
+
+// firestoreRequiredNames will return the names of the required fields, sorted.
+func firestoreRequiredNames(required map[string]*structpb.Value) []string {
+	names := make([]string, 0, len(required))
+	for name := range required {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// firestoreFilter will return the filter of a query on the first of the required fields, by name, and nil if there
+// are none. Filtering on a single field does not need a composite index, so the other required fields are matched by
+// the caller. A required list is an "IN" filter, unless it has more values than "IN" allows.
+func firestoreFilter(required map[string]*structpb.Value) firestore.EntityFilter {
+	for _, name := range firestoreRequiredNames(required) {
+		if filter, ok := firestoreFieldFilter(name, required[name]); ok {
+			return filter
+		}
+	}
+
+	return nil
+}
+
+// firestoreCountFilter will return the filter of a query on every required field, nil if there are none, or false if
+// a required field can not be filtered by Firestore.
+func firestoreCountFilter(required map[string]*structpb.Value) (firestore.EntityFilter, bool) {
+	filters := make([]firestore.EntityFilter, 0, len(required))
+
+	for _, name := range firestoreRequiredNames(required) {
+		filter, ok := firestoreFieldFilter(name, required[name])
+		if !ok {
+			return nil, false
+		}
+
+		filters = append(filters, filter)
+	}
+
+	switch len(filters) {
+	case 0:
+		return nil, true
+	case 1:
+		return filters[0], true
+	default:
+		return firestore.AndFilter{Filters: filters}, true
+	}
+}
+
+// Read will return the documents of the collection of the table that match the required fields on the request, in
+// the page requested by the options of the request, if any. The first required field is sent as the filter of the
+// query, and the other required fields, the sort, and the page are applied in memory, so that reads need no composite
+// indexes.
+func (stg *Firestore) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	collection, err := stg.collection(req.GetTable())
+	if err != nil {
+		return nil, fmt.Errorf("unable to read records: %w", err)
+	}
+
+	required := req.GetRequired().GetFields()
+
+	query := collection.Query
+	if filter := firestoreFilter(required); filter != nil {
+		query = query.WhereEntity(filter)
+	}
+
+	docs, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read records: %w", FirestoreError("runQuery", collection.Path, err))
+	}
+
+	var records []map[string]interface{}
+
+	for _, doc := range docs {
+		record, _ := decodeFirestoreValue(doc.Data()).(map[string]interface{})
+
+		if parquetMatches(record, nil, required) {
+			records = append(records, record)
+		}
+	}
+
+	return redisPage(records, page)
+}
+
+// Count will return the number of documents of the collection that match the required fields, with the "count"
+// aggregation of an aggregation query. Every required field is filtered by Firestore, which needs a composite index
+// for some combinations of fields, and required lists that "IN" can not filter are counted by reading the documents.
+func (stg *Firestore) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	filter, ok := firestoreCountFilter(req.GetRequired().GetFields())
+	if !ok {
+		return readCount(ctx, stg, req)
+	}
+
+	collection, err := stg.collection(req.GetTable())
+	if err != nil {
+		return nil, fmt.Errorf("unable to count records: %w", err)
+	}
+
+	query := collection.Query
+	if filter != nil {
+		query = query.WhereEntity(filter)
+	}
+
+	result, err := query.NewAggregationQuery().WithCount("count").Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to count records: %w", FirestoreError("runAggregationQuery", collection.Path,
+			err))
+	}
+
+	count, ok := result["count"].(*firestorepb.Value)
+	if !ok {
+		return nil, fmt.Errorf("unable to decode count: %v", result["count"])
+	}
+
+	return &proto.CountResponse{Count: count.GetIntegerValue()}, nil
+}
+
+// Truncate will delete every document of the collections of the tables. The subcollections of the documents are
+// not deleted.
+func (stg *Firestore) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	var deleted int32
+
+	for _, table := range req.GetTables() {
+		collection, err := stg.collection(table)
+		if err != nil {
+			return nil, fmt.Errorf("error truncating table %s: %w", table, err)
+		}
+
+		// The documents are queried without their fields, for their references.
+		docs, err := collection.Select().Documents(ctx).GetAll()
+		if err != nil {
+			return nil, fmt.Errorf("error truncating table %s: %w", table, FirestoreError("runQuery",
+				collection.Path, err))
+		}
+
+		writes := make([]firestoreWrite, 0, len(docs))
+		for _, doc := range docs {
+			writes = append(writes, firestoreWrite{doc: doc.Ref})
+		}
+
+		if err := stg.commit(ctx, writes); err != nil {
+			return nil, fmt.Errorf("error truncating table %s: %w", table, err)
+		}
+
+		deleted += int32(len(writes))
+	}
+
+	return &proto.TruncateResponse{DeletedCount: deleted}, nil
+}
+
+// ListTables will return the root collections of the database. Table sizes are reported as zero, since the
+// Firestore API does not report the size of collections.
+func (stg *Firestore) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+	collections := stg.client.Collections(ctx)
+
+	for {
+		collection, err := collections.Next()
+		if errors.Is(err, iterator.Done) {
+			return rsp, nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to list tables: %w", FirestoreError("listCollectionIds", stg.root(), err))
+		}
+
+		rsp.TableSet[collection.ID] = &proto.Table{}
+	}
+}
+
+// ListPrimaryKeys will return the primary key field of each table.
+func (stg *Firestore) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	tables, err := stg.ListTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+
+	for table := range tables.GetTableSet() {
+		rsp.PKSet[table] = &proto.PrimaryKeys{List: []string{stg.tablePrimaryKey(table)}}
+	}
+
+	return rsp, nil
+}
+
+// StartTx will start a transaction. The records of the functions sent to the transaction are buffered, and set in
+// batches of 500 documents when the transaction commits. Each batch is atomic, so a commit that fails may have set
+// the documents of some batches. Reads in the transaction do not see its buffered records.
+func (stg *Firestore) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+	tx := new(firestoreTx)
+
+	stg.activeTx.Store(txnID, tx)
+
+	firestoreCtx := context.WithValue(ctx, basicFirestoreTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+
+		var err error
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(firestoreCtx, stg)
+		}
+
+		if err != nil {
+			<-txn.commit
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit {
+			if err = stg.commit(ctx, tx.writes); err != nil {
+				err = fmt.Errorf("unable to commit transaction: %w", err)
+			}
+		}
+
+		txn.done <- err
+	}()
+
+	return txn, nil
+}
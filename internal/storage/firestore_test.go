@@ -0,0 +1,452 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const firestoreTestRoot = "projects/analytics/databases/(default)/documents"
+
+// firestoreServer is an in-memory Firestore gRPC server with the fields of each document, keyed by their names. It
+// records the number of writes of each commit and the filters of the queries, and matches "EQUAL", "IN", "IS_NULL",
+// and "AND" filters. Requests are denied if "denied" is set.
+type firestoreServer struct {
+	firestorepb.UnimplementedFirestoreServer
+
+	mtx     sync.Mutex
+	docs    map[string]map[string]*firestorepb.Value
+	commits []int
+	filters []*firestorepb.StructuredQuery_Filter
+	denied  bool
+}
+
+// authorize will return an error if the request is not made as the owner of the emulator, or if requests are denied.
+func (srv *firestoreServer) authorize(ctx context.Context) error {
+	if md, _ := metadata.FromIncomingContext(ctx); !reflect.DeepEqual(md.Get("authorization"),
+		[]string{"Bearer owner"}) {
+		return status.Error(codes.Unauthenticated, "missing owner credentials")
+	}
+
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	if srv.denied {
+		return status.Error(codes.PermissionDenied, "missing or insufficient permissions")
+	}
+
+	return nil
+}
+
+func (srv *firestoreServer) BeginTransaction(context.Context,
+	*firestorepb.BeginTransactionRequest,
+) (*firestorepb.BeginTransactionResponse, error) {
+	return &firestorepb.BeginTransactionResponse{Transaction: []byte("tx")}, nil
+}
+
+func (srv *firestoreServer) Rollback(context.Context, *firestorepb.RollbackRequest) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
+
+func (srv *firestoreServer) Commit(_ context.Context, req *firestorepb.CommitRequest,
+) (*firestorepb.CommitResponse, error) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	if len(req.GetWrites()) > firestoreBatchWrites {
+		return nil, status.Error(codes.InvalidArgument, "maximum 500 writes allowed per request")
+	}
+
+	srv.commits = append(srv.commits, len(req.GetWrites()))
+
+	rsp := &firestorepb.CommitResponse{CommitTime: timestamppb.Now()}
+
+	for _, write := range req.GetWrites() {
+		if name := write.GetDelete(); name != "" {
+			delete(srv.docs, name)
+		} else {
+			srv.docs[write.GetUpdate().GetName()] = write.GetUpdate().GetFields()
+		}
+
+		rsp.WriteResults = append(rsp.WriteResults, &firestorepb.WriteResult{UpdateTime: rsp.GetCommitTime()})
+	}
+
+	return rsp, nil
+}
+
+func (srv *firestoreServer) RunQuery(req *firestorepb.RunQueryRequest,
+	stream firestorepb.Firestore_RunQueryServer,
+) error {
+	for name, fields := range srv.query(req.GetStructuredQuery()) {
+		if err := stream.Send(&firestorepb.RunQueryResponse{
+			Document: &firestorepb.Document{Name: name, Fields: fields, CreateTime: timestamppb.Now(),
+				UpdateTime: timestamppb.Now()},
+			ReadTime: timestamppb.Now(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (srv *firestoreServer) RunAggregationQuery(req *firestorepb.RunAggregationQueryRequest,
+	stream firestorepb.Firestore_RunAggregationQueryServer,
+) error {
+	count := int64(len(srv.query(req.GetStructuredAggregationQuery().GetStructuredQuery())))
+
+	return stream.Send(&firestorepb.RunAggregationQueryResponse{
+		Result: &firestorepb.AggregationResult{AggregateFields: map[string]*firestorepb.Value{
+			"count": {ValueType: &firestorepb.Value_IntegerValue{IntegerValue: count}},
+		}},
+		ReadTime: timestamppb.Now(),
+	})
+}
+
+func (srv *firestoreServer) ListCollectionIds(ctx context.Context,
+	_ *firestorepb.ListCollectionIdsRequest,
+) (*firestorepb.ListCollectionIdsResponse, error) {
+	if err := srv.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	collections := map[string]bool{}
+	for name := range srv.docs {
+		collections[strings.Split(strings.TrimPrefix(name, firestoreTestRoot+"/"), "/")[0]] = true
+	}
+
+	rsp := &firestorepb.ListCollectionIdsResponse{}
+	for id := range collections {
+		rsp.CollectionIds = append(rsp.CollectionIds, id)
+	}
+
+	sort.Strings(rsp.CollectionIds)
+
+	return rsp, nil
+}
+
+// query will return the fields of the documents of the collection of the query, keyed by their names, that match its
+// filter, and record its filter.
+func (srv *firestoreServer) query(query *firestorepb.StructuredQuery) map[string]map[string]*firestorepb.Value {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	srv.filters = append(srv.filters, query.GetWhere())
+
+	prefix := firestoreTestRoot + "/" + query.GetFrom()[0].GetCollectionId() + "/"
+	docs := make(map[string]map[string]*firestorepb.Value)
+
+	for name, fields := range srv.docs {
+		if strings.HasPrefix(name, prefix) && firestoreTestMatches(fields, query.GetWhere()) {
+			docs[name] = fields
+		}
+	}
+
+	return docs
+}
+
+// firestoreTestMatches will return "true" if the fields of a document match the filter.
+func firestoreTestMatches(fields map[string]*firestorepb.Value, filter *firestorepb.StructuredQuery_Filter) bool {
+	if composite := filter.GetCompositeFilter(); composite != nil {
+		for _, filter := range composite.GetFilters() {
+			if !firestoreTestMatches(fields, filter) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if unary := filter.GetUnaryFilter(); unary != nil {
+		_, ok := fields[unary.GetField().GetFieldPath()].GetValueType().(*firestorepb.Value_NullValue)
+
+		return ok
+	}
+
+	field := filter.GetFieldFilter()
+	if field == nil {
+		return true
+	}
+
+	got := fields[field.GetField().GetFieldPath()]
+
+	switch field.GetOp() {
+	case firestorepb.StructuredQuery_FieldFilter_EQUAL:
+		return protobuf.Equal(got, field.GetValue())
+	case firestorepb.StructuredQuery_FieldFilter_IN:
+		for _, value := range field.GetValue().GetArrayValue().GetValues() {
+			if protobuf.Equal(got, value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func newTestFirestore(t *testing.T, params string) (*Firestore, *firestoreServer) {
+	t.Helper()
+
+	srv := &firestoreServer{docs: make(map[string]map[string]*firestorepb.Value)}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	server := grpc.NewServer()
+	firestorepb.RegisterFirestoreServer(server, srv)
+
+	go func() { _ = server.Serve(lis) }()
+
+	t.Cleanup(server.Stop)
+
+	stg, err := NewFirestore(context.Background(), "firestore://analytics?endpoint=http://"+lis.Addr().String()+params)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	t.Cleanup(stg.Close)
+
+	return stg, srv
+}
+
+func TestFirestore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	upsert := func(ctx context.Context, t *testing.T, stg Storage, table string, records ...map[string]interface{}) {
+		t.Helper()
+
+		data, _ := json.Marshal(records)
+		if _, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: table, Data: data}); err != nil {
+			t.Fatalf("failed to upsert records: %v", err)
+		}
+	}
+
+	t.Run("upsert", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestFirestore(t, "&primaryKey.candles=time")
+
+		records := make([]map[string]interface{}, 0, 1201)
+		for idx := 0; idx < 1201; idx++ {
+			records = append(records, map[string]interface{}{"time": idx, "close": 1.5})
+		}
+
+		upsert(ctx, t, stg, "candles", records...)
+
+		if !reflect.DeepEqual(srv.commits, []int{500, 500, 201}) {
+			t.Fatalf("expected commits of 500 writes, got %v", srv.commits)
+		}
+
+		upsert(ctx, t, stg, "candles", map[string]interface{}{"time": 7, "close": 2, "tags": []interface{}{"a",
+			[]interface{}{1}}, "book": map[string]interface{}{"bid": 1.25, "size": nil}, "final": true})
+
+		fields := srv.docs[firestoreTestRoot+"/candles/7"]
+		if exp := (&firestorepb.Value{ValueType: &firestorepb.Value_IntegerValue{IntegerValue: 2}}); !protobuf.Equal(
+			fields["close"], exp) {
+			t.Fatalf("expected a whole number to be written as an integer, got %v", fields["close"])
+		}
+
+		required, _ := structpb.NewStruct(map[string]interface{}{"time": 7})
+
+		rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "candles", Required: required})
+		if err != nil || len(rsp.Records) != 1 {
+			t.Fatalf("expected the candle, got %v: %v", rsp, err)
+		}
+
+		exp := map[string]interface{}{"time": 7.0, "close": 2.0, "tags": []interface{}{"a", "[1]"},
+			"book": map[string]interface{}{"bid": 1.25, "size": nil}, "final": true}
+		if got := rsp.Records[0].AsMap(); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("expected record %v, got %v", exp, got)
+		}
+
+		if len(srv.docs) != 1201 {
+			t.Fatalf("expected the candle to be replaced, got %d documents", len(srv.docs))
+		}
+	})
+
+	t.Run("read", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestFirestore(t, "")
+
+		upsert(ctx, t, stg, "orders", map[string]interface{}{"id": "a", "kind": "buy", "size": 1},
+			map[string]interface{}{"id": "b", "kind": "buy", "size": 2},
+			map[string]interface{}{"id": "c", "kind": "sell", "size": 1})
+
+		required, _ := structpb.NewStruct(map[string]interface{}{"size": 1, "kind": "buy"})
+
+		rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "orders", Required: required})
+		if err != nil || len(rsp.Records) != 1 || rsp.Records[0].AsMap()["id"] != "a" {
+			t.Fatalf("expected the order to match both fields, got %v: %v", rsp, err)
+		}
+
+		filter := srv.filters[0].GetFieldFilter()
+		if filter.GetField().GetFieldPath() != "kind" ||
+			filter.GetOp() != firestorepb.StructuredQuery_FieldFilter_EQUAL ||
+			filter.GetValue().GetStringValue() != "buy" {
+			t.Fatalf("expected a filter on the first required field, got %v", srv.filters[0])
+		}
+
+		required, _ = structpb.NewStruct(map[string]interface{}{"order id": []interface{}{"a", "b"}})
+		if filter := firestoreFilter(required.GetFields()); !reflect.DeepEqual(filter, firestore.PropertyPathFilter{
+			Path: firestore.FieldPath{"order id"}, Operator: "in", Value: []interface{}{"a", "b"},
+		}) {
+			t.Fatalf("expected an IN filter on the field, got %v", filter)
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestFirestore(t, "")
+
+		upsert(ctx, t, stg, "orders", map[string]interface{}{"id": "a", "kind": "buy", "size": 1},
+			map[string]interface{}{"id": "b", "kind": "buy", "size": 2},
+			map[string]interface{}{"id": "c", "kind": "sell", "size": 1})
+
+		if rsp, err := stg.Count(ctx, &proto.CountRequest{Table: "orders"}); err != nil || rsp.GetCount() != 3 {
+			t.Fatalf("expected 3 orders, got %v: %v", rsp, err)
+		}
+
+		required, _ := structpb.NewStruct(map[string]interface{}{"size": 1, "kind": "buy"})
+
+		rsp, err := stg.Count(ctx, &proto.CountRequest{Table: "orders", Required: required})
+		if err != nil || rsp.GetCount() != 1 {
+			t.Fatalf("expected the order to match both fields, got %v: %v", rsp, err)
+		}
+
+		composite := srv.filters[1].GetCompositeFilter()
+		if composite.GetOp() != firestorepb.StructuredQuery_CompositeFilter_AND || len(composite.GetFilters()) != 2 {
+			t.Fatalf("expected a filter on both required fields, got %v", srv.filters[1])
+		}
+	})
+
+	t.Run("truncate and list", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestFirestore(t, "")
+
+		records := make([]map[string]interface{}, 0, 700)
+		for idx := 0; idx < 700; idx++ {
+			records = append(records, map[string]interface{}{"id": idx})
+		}
+
+		upsert(ctx, t, stg, "products", records...)
+		upsert(ctx, t, stg, "accounts", map[string]interface{}{"name": "no key"})
+
+		pks, err := stg.ListPrimaryKeys(ctx)
+		if err != nil || len(pks.PKSet) != 2 || !reflect.DeepEqual(pks.PKSet["accounts"].List, []string{"id"}) {
+			t.Fatalf("expected the primary keys of both tables, got %v: %v", pks, err)
+		}
+
+		rsp, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"products"}})
+		if err != nil || rsp.DeletedCount != 700 {
+			t.Fatalf("expected every page of products to be deleted, got %v: %v", rsp, err)
+		}
+
+		if len(srv.docs) != 1 {
+			t.Fatalf("expected only the account to be left, got %d documents", len(srv.docs))
+		}
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		t.Parallel()
+
+		for _, commit := range []bool{true, false} {
+			stg, srv := newTestFirestore(t, "")
+
+			txn, err := stg.StartTx(ctx)
+			if err != nil {
+				t.Fatalf("failed to start transaction: %v", err)
+			}
+
+			txn.Send(func(ctx context.Context, stg Storage) error {
+				upsert(ctx, t, stg, "products", map[string]interface{}{"id": "a"}, map[string]interface{}{"id": "b"})
+
+				return nil
+			})
+
+			if commit {
+				err = txn.Commit()
+			} else {
+				err = txn.Rollback()
+			}
+
+			if err != nil {
+				t.Fatalf("failed to end transaction: %v", err)
+			}
+
+			if (len(srv.docs) == 2) != commit || (len(srv.commits) == 1) != commit {
+				t.Fatalf("expected the records to be written in a commit on commit, got %v", srv.docs)
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestFirestore(t, "")
+
+		data, _ := json.Marshal([]map[string]interface{}{{"id": []interface{}{1}}})
+		if _, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "products", Data: data}); !errors.Is(err,
+			ErrFirestorePrimaryKey) {
+			t.Fatalf("expected error %v, got %v", ErrFirestorePrimaryKey, err)
+		}
+
+		srv.mtx.Lock()
+		srv.denied = true
+		srv.mtx.Unlock()
+
+		if _, err := stg.ListTables(ctx); !errors.Is(err, ErrFirestore) {
+			t.Fatalf("expected error %v, got %v", ErrFirestore, err)
+		}
+
+		if _, err := NewFirestore(ctx, "firestore:///(default)"); !errors.Is(err, ErrDNSNotSupported) {
+			t.Fatalf("expected error %v, got %v", ErrDNSNotSupported, err)
+		}
+	})
+
+	t.Run("document ids", func(t *testing.T) {
+		t.Parallel()
+
+		for key, exp := range map[string]string{
+			"BTC-USD": "BTC-USD", "a/b": "a%2Fb", "100%": "100%25", "..": "%2E%2E", "__id__": "%5F_id__",
+		} {
+			if got := firestoreDocumentID(key); got != exp {
+				t.Fatalf("expected id %q for %q, got %q", exp, key, got)
+			}
+		}
+	})
+}
@@ -0,0 +1,452 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+const (
+	gcsScheme = "gs"
+
+	// gcsEndpointParam is the object storage location parameter for the endpoint of the GCS JSON API, e.g. an
+	// emulator at "http://gcs:4443". Endpoints with the "http" scheme are connected to without credentials, unless
+	// "GCS_ACCESS_TOKEN" is set.
+	gcsEndpointParam = "endpoint"
+
+	// gcsChunkSizeParam is the object storage location parameter for the size in bytes of the chunks of resumable
+	// uploads, e.g. "chunkSize=16777216". Objects larger than a chunk are uploaded in chunks.
+	gcsChunkSizeParam = "chunkSize"
+
+	// gcsConcurrencyParam is the object storage location parameter for the number of chunks of an upload that are
+	// uploaded at the same time, e.g. "concurrency=8". With more than one, objects larger than a chunk are uploaded
+	// with a parallel composite upload instead of a resumable upload.
+	gcsConcurrencyParam = "concurrency"
+
+	// gcsAccessTokenEnv is the environment variable with an OAuth 2.0 access token for the GCS API, e.g. from
+	// "gcloud auth print-access-token". Without it, requests are authorized with the application default
+	// credentials.
+	gcsAccessTokenEnv = "GCS_ACCESS_TOKEN"
+
+	// gcsChunkAlignment is the size that every chunk of a resumable upload but the last must be a multiple of.
+	gcsChunkAlignment = 256 << 10
+
+	gcsDefaultChunkSize = 8 << 20
+
+	// gcsMaxComposeSources is the largest number of objects that a single compose request can concatenate.
+	gcsMaxComposeSources = 32
+
+	// gcsMaxCompositeParts is the largest number of chunks of a parallel composite upload, which keeps the
+	// composition to two levels of compose requests.
+	gcsMaxCompositeParts = gcsMaxComposeSources * gcsMaxComposeSources
+)
+
+// gcsObjectStore is an object store on a GCS bucket, where each key is prefixed with the path of the location.
+type gcsObjectStore struct {
+	endpoint string
+	bucket   string
+	prefix   string
+
+	// tokens authorizes the requests. If nil, the application default credentials are used, unless the endpoint has
+	// the "http" scheme.
+	tokens oauth2.TokenSource
+
+	// chunkSize is the size of the chunks of large uploads, and concurrency is the number of chunks uploaded at the
+	// same time.
+	chunkSize   int
+	concurrency int
+
+	// The client is created on the first request, so that the credentials are only looked up when they are used.
+	once   sync.Once
+	client *gcs.Client
+	err    error
+}
+
+// crc32cTable is the table of the Castagnoli polynomial, the CRC32C checksums of GCS objects.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func newGCSObjectStore(uri *url.URL) (*gcsObjectStore, error) {
+	store := &gcsObjectStore{
+		endpoint: strings.TrimSuffix(uri.Query().Get(gcsEndpointParam), "/"),
+		bucket:   uri.Host,
+		prefix:   strings.Trim(uri.Path, "/"),
+
+		chunkSize:   gcsDefaultChunkSize,
+		concurrency: 1,
+	}
+
+	if store.bucket == "" {
+		return nil, UnsupportedObjectStoreError(uri.String())
+	}
+
+	if chunkSize := uri.Query().Get(gcsChunkSizeParam); chunkSize != "" {
+		size, err := strconv.Atoi(chunkSize)
+		if err != nil || size <= 0 || size%gcsChunkAlignment != 0 {
+			return nil, InvalidObjectStoreOptionError(gcsChunkSizeParam, chunkSize,
+				fmt.Sprintf("must be a positive multiple of %d bytes", gcsChunkAlignment))
+		}
+
+		store.chunkSize = size
+	}
+
+	if concurrency := uri.Query().Get(gcsConcurrencyParam); concurrency != "" {
+		count, err := parseUploadConcurrency(concurrency)
+		if err != nil {
+			return nil, err
+		}
+
+		store.concurrency = count
+	}
+
+	if token := os.Getenv(gcsAccessTokenEnv); token != "" {
+		store.tokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+	}
+
+	return store, nil
+}
+
+// bucketHandle will return the handle of the bucket, creating the client on the first call. Requests are made with
+// the compliance transport, and the JSON API is used for reads as well, so that an endpoint serves every request.
+func (store *gcsObjectStore) bucketHandle() (*gcs.BucketHandle, error) {
+	store.once.Do(func() {
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, compliance.HTTPClient())
+
+		tokens := store.tokens
+		if tokens == nil && !strings.HasPrefix(store.endpoint, "http://") {
+			if tokens, store.err = google.DefaultTokenSource(ctx, gcs.ScopeReadWrite); store.err != nil {
+				store.err = fmt.Errorf("unable to find default credentials: %w", store.err)
+
+				return
+			}
+		}
+
+		transport := compliance.Transport()
+		if tokens != nil {
+			transport = &oauth2.Transport{Source: tokens, Base: transport}
+		}
+
+		opts := []option.ClientOption{option.WithHTTPClient(&http.Client{Transport: transport})}
+
+		if store.endpoint != "" {
+			opts = append(opts, option.WithEndpoint(store.endpoint+"/storage/v1/"), gcs.WithJSONReads())
+		}
+
+		if store.client, store.err = gcs.NewClient(ctx, opts...); store.err != nil {
+			store.err = fmt.Errorf("unable to create client: %w", store.err)
+		}
+	})
+
+	if store.err != nil {
+		return nil, store.err
+	}
+
+	return store.client.Bucket(store.bucket), nil
+}
+
+// objectName will return the name of the object at the key in the bucket.
+func (store *gcsObjectStore) objectName(key string) string {
+	return path.Join(store.prefix, key)
+}
+
+// Put will upload the object to the key, in chunks if it is larger than the chunk size.
+func (store *gcsObjectStore) Put(ctx context.Context, key string, data []byte) error {
+	return store.Upload(ctx, key, bytes.NewReader(data))
+}
+
+// Upload will upload the object read from the reader to the key. An object that fits in a single chunk is uploaded
+// with a single request, with its CRC32C checksum, so that GCS rejects an object that is corrupted in transit. Larger
+// objects are uploaded with a resumable upload, one chunk at a time, or with a parallel composite upload if
+// "concurrency" is more than one. The CRC32C checksum of every object is verified against the checksum of the object
+// that GCS stored.
+func (store *gcsObjectStore) Upload(ctx context.Context, key string, r io.Reader) error {
+	bucket, err := store.bucketHandle()
+	if err != nil {
+		return ObjectStoreError(http.MethodPost, key, err)
+	}
+
+	first, last, err := readPart(r, store.chunkSize)
+	if err != nil {
+		return ObjectStoreError(http.MethodPost, key, err)
+	}
+
+	if last {
+		if err := store.uploadMedia(ctx, bucket, key, first); err != nil {
+			return ObjectStoreError(http.MethodPost, key, err)
+		}
+
+		return nil
+	}
+
+	checksum := crc32.New(crc32cTable)
+	_, _ = checksum.Write(first)
+
+	r = io.TeeReader(r, checksum)
+
+	if store.concurrency > 1 {
+		if err := store.uploadComposite(ctx, bucket, key, first, r, checksum); err != nil {
+			return ObjectStoreError(http.MethodPost, key, err)
+		}
+
+		return nil
+	}
+
+	if err := store.uploadChunks(ctx, bucket, key, io.MultiReader(bytes.NewReader(first), r), checksum); err != nil {
+		return ObjectStoreError(http.MethodPut, key, err)
+	}
+
+	return nil
+}
+
+// verifyUpload will return an error if the object that the upload stored does not have the CRC32C checksum.
+func verifyUpload(attrs *gcs.ObjectAttrs, checksum uint32) error {
+	if attrs == nil {
+		return fmt.Errorf("missing object attributes")
+	}
+
+	if attrs.CRC32C != checksum {
+		return fmt.Errorf("the object has the CRC32C checksum %08x, expected %08x", attrs.CRC32C, checksum)
+	}
+
+	return nil
+}
+
+// uploadMedia will upload the object to the key with a single request.
+func (store *gcsObjectStore) uploadMedia(ctx context.Context, bucket *gcs.BucketHandle, key string,
+	data []byte,
+) error {
+	checksum := crc32.Checksum(data, crc32cTable)
+
+	writer := bucket.Object(store.objectName(key)).NewWriter(ctx)
+	writer.ChunkSize = 0
+	writer.CRC32C = checksum
+	writer.SendCRC32C = true
+
+	if _, err := writer.Write(data); err != nil {
+		_ = writer.Close()
+
+		return fmt.Errorf("unable to write object: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("unable to write object: %w", err)
+	}
+
+	return verifyUpload(writer.Attrs(), checksum)
+}
+
+// uploadChunks will upload the object read from the reader to the key with a resumable upload, in chunks of the chunk
+// size. The reader writes to the checksum, which is complete once the upload is. A resumable upload that fails is
+// canceled with the context of the writer, so that its chunks are not stored.
+func (store *gcsObjectStore) uploadChunks(ctx context.Context, bucket *gcs.BucketHandle, key string, r io.Reader,
+	checksum hash.Hash32,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer := bucket.Object(store.objectName(key)).NewWriter(ctx)
+	writer.ChunkSize = store.chunkSize
+
+	if _, err := io.Copy(writer, r); err != nil {
+		cancel()
+		_ = writer.Close()
+
+		return fmt.Errorf("unable to write object: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("unable to write object: %w", err)
+	}
+
+	return verifyUpload(writer.Attrs(), checksum.Sum32())
+}
+
+// uploadComposite will upload the first chunk and the rest of the object read from the reader as temporary objects,
+// "concurrency" chunks at a time, and compose them into the object at the key, which is verified against the checksum
+// that the reader writes to. The temporary objects are deleted afterwards, even if the upload fails.
+func (store *gcsObjectStore) uploadComposite(ctx context.Context, bucket *gcs.BucketHandle, key string,
+	chunk []byte, r io.Reader, checksum hash.Hash32,
+) error {
+	temp := fmt.Sprintf("%s.gidari-%s", key, uuid.New().String())
+
+	var (
+		mtx   sync.Mutex
+		temps []string
+	)
+
+	defer func() {
+		// Deleting the temporary objects is best effort, and they are deleted even if the context is done.
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+
+		for _, name := range temps {
+			_ = bucket.Object(store.objectName(name)).Delete(ctx)
+		}
+	}()
+
+	count, err := uploadConcurrently(ctx, chunk, r, store.chunkSize, store.concurrency, gcsMaxCompositeParts,
+		gcsChunkSizeParam, func(ctx context.Context, number int, data []byte) error {
+			name := fmt.Sprintf("%s-%d", temp, number)
+
+			mtx.Lock()
+			temps = append(temps, name)
+			mtx.Unlock()
+
+			return store.uploadMedia(ctx, bucket, name, data)
+		})
+	if err != nil {
+		return err
+	}
+
+	sources := make([]string, count)
+	for idx := range sources {
+		sources[idx] = fmt.Sprintf("%s-%d", temp, idx+1)
+	}
+
+	for level := 0; len(sources) > gcsMaxComposeSources; level++ {
+		var composed []string
+
+		for idx := 0; idx < len(sources); idx += gcsMaxComposeSources {
+			name := fmt.Sprintf("%s-c%d-%d", temp, level, len(composed))
+			temps = append(temps, name)
+
+			if _, err := store.compose(ctx, bucket, name,
+				sources[idx:min(idx+gcsMaxComposeSources, len(sources))]); err != nil {
+				return err
+			}
+
+			composed = append(composed, name)
+		}
+
+		sources = composed
+	}
+
+	attrs, err := store.compose(ctx, bucket, key, sources)
+	if err != nil {
+		return err
+	}
+
+	return verifyUpload(attrs, checksum.Sum32())
+}
+
+// compose will concatenate the objects at the source keys, in order, into the object at the key.
+func (store *gcsObjectStore) compose(ctx context.Context, bucket *gcs.BucketHandle, key string,
+	sources []string,
+) (*gcs.ObjectAttrs, error) {
+	handles := make([]*gcs.ObjectHandle, len(sources))
+	for idx, source := range sources {
+		handles[idx] = bucket.Object(store.objectName(source))
+	}
+
+	composer := bucket.Object(store.objectName(key)).ComposerFrom(handles...)
+	composer.ContentType = "application/octet-stream"
+
+	attrs, err := composer.Run(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compose object: %w", err)
+	}
+
+	return attrs, nil
+}
+
+// Get will download the object at the key.
+func (store *gcsObjectStore) Get(ctx context.Context, key string) ([]byte, error) {
+	bucket, err := store.bucketHandle()
+	if err != nil {
+		return nil, ObjectStoreError(http.MethodGet, key, err)
+	}
+
+	reader, err := bucket.Object(store.objectName(key)).NewReader(ctx)
+	if err != nil {
+		return nil, ObjectStoreError(http.MethodGet, key, err)
+	}
+
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, ObjectStoreError(http.MethodGet, key, err)
+	}
+
+	return data, nil
+}
+
+// Delete will delete the object at the key. Deleting a key without an object is not an error.
+func (store *gcsObjectStore) Delete(ctx context.Context, key string) error {
+	bucket, err := store.bucketHandle()
+	if err != nil {
+		return ObjectStoreError(http.MethodDelete, key, err)
+	}
+
+	err = bucket.Object(store.objectName(key)).Delete(ctx)
+	if err != nil && !errors.Is(err, gcs.ErrObjectNotExist) {
+		return ObjectStoreError(http.MethodDelete, key, err)
+	}
+
+	return nil
+}
+
+// List will return the keys of the objects under the prefix of the location, relative to the prefix.
+func (store *gcsObjectStore) List(ctx context.Context) ([]string, error) {
+	prefix := store.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	bucket, err := store.bucketHandle()
+	if err != nil {
+		return nil, ObjectStoreError(http.MethodGet, prefix, err)
+	}
+
+	query := &gcs.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return nil, ObjectStoreError(http.MethodGet, prefix, err)
+	}
+
+	var keys []string
+
+	objects := bucket.Objects(ctx, query)
+
+	for {
+		attrs, err := objects.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+
+		if err != nil {
+			return nil, ObjectStoreError(http.MethodGet, prefix, err)
+		}
+
+		keys = append(keys, strings.TrimPrefix(attrs.Name, prefix))
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
@@ -0,0 +1,482 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"golang.org/x/oauth2"
+)
+
+// gcsServer is a GCS JSON API server for a single bucket, which lists a single object on each page. Uploads are
+// verified against the CRC32C checksum of their metadata, and respond with the CRC32C checksum of the object, or a
+// wrong one if the server corrupts objects.
+type gcsServer struct {
+	mtx      sync.Mutex
+	objects  map[string][]byte
+	sessions map[string][]byte
+	ranges   []string
+	composed [][]string
+	corrupt  bool
+}
+
+// gcsTestObject is the metadata of an object in the requests and responses of the server.
+type gcsTestObject struct {
+	Bucket string `json:"bucket,omitempty"`
+	Name   string `json:"name"`
+	CRC32C string `json:"crc32c,omitempty"`
+}
+
+func newGCSServer(t *testing.T) (*gcsServer, string) {
+	t.Helper()
+
+	srv := &gcsServer{objects: make(map[string][]byte), sessions: make(map[string][]byte)}
+
+	server := httptest.NewServer(srv)
+	t.Cleanup(server.Close)
+
+	return srv, server.URL
+}
+
+func encodeCRC32C(checksum uint32) string {
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, checksum))
+}
+
+func (srv *gcsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		http.Error(w, `{"error": {"code": 401, "message": "unauthorized"}}`, http.StatusUnauthorized)
+
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	query := r.URL.Query()
+
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	switch path := r.URL.EscapedPath(); {
+	case r.Method == http.MethodPost && path == "/upload/storage/v1/b/bucket/o":
+		switch query.Get("uploadType") {
+		case "multipart":
+			srv.storeMultipart(w, r, body)
+		case "resumable":
+			var object gcsTestObject
+
+			_ = json.Unmarshal(body, &object)
+
+			srv.sessions[object.Name] = []byte{}
+			w.Header().Set("Location", "http://"+r.Host+"/session/"+url.PathEscape(object.Name))
+		case "":
+			name, _ := url.PathUnescape(query.Get("upload_id"))
+			srv.uploadChunk(w, r, name, body)
+		default:
+			http.Error(w, "unexpected upload type", http.StatusBadRequest)
+		}
+	case strings.HasPrefix(path, "/session/"):
+		name, _ := url.PathUnescape(strings.TrimPrefix(path, "/session/"))
+		srv.uploadChunk(w, r, name, body)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/compose"):
+		name, _ := url.PathUnescape(strings.TrimSuffix(strings.TrimPrefix(path, "/storage/v1/b/bucket/o/"),
+			"/compose"))
+
+		var request struct {
+			SourceObjects []struct {
+				Name string `json:"name"`
+			} `json:"sourceObjects"`
+		}
+
+		_ = json.Unmarshal(body, &request)
+
+		var (
+			object  []byte
+			sources []string
+		)
+
+		for _, source := range request.SourceObjects {
+			data, ok := srv.objects[source.Name]
+			if !ok || len(request.SourceObjects) > gcsMaxComposeSources {
+				http.Error(w, "invalid sources", http.StatusBadRequest)
+
+				return
+			}
+
+			object = append(object, data...)
+			sources = append(sources, source.Name)
+		}
+
+		srv.composed = append(srv.composed, sources)
+		srv.store(w, name, "", object)
+	case path == "/storage/v1/b/bucket/o":
+		var names []string
+
+		for name := range srv.objects {
+			if strings.HasPrefix(name, query.Get("prefix")) && name > query.Get("pageToken") {
+				names = append(names, name)
+			}
+		}
+
+		sort.Strings(names)
+
+		var result struct {
+			Items         []gcsTestObject `json:"items"`
+			NextPageToken string          `json:"nextPageToken,omitempty"`
+		}
+
+		if len(names) > 0 {
+			result.Items = append(result.Items, gcsTestObject{Bucket: "bucket", Name: names[0]})
+		}
+
+		if len(names) > 1 {
+			result.NextPageToken = names[0]
+		}
+
+		_ = json.NewEncoder(w).Encode(result)
+	case strings.HasPrefix(path, "/storage/v1/b/bucket/o/"):
+		name, _ := url.PathUnescape(strings.TrimPrefix(path, "/storage/v1/b/bucket/o/"))
+
+		data, ok := srv.objects[name]
+		if !ok {
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			delete(srv.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+
+			return
+		}
+
+		_, _ = w.Write(data)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// storeMultipart will store the object of a multipart upload, whose first part is the metadata and second part is
+// the contents of the object.
+func (srv *gcsServer) storeMultipart(w http.ResponseWriter, r *http.Request, body []byte) {
+	_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+
+	var (
+		object gcsTestObject
+		data   []byte
+	)
+
+	for idx := 0; ; idx++ {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+
+		content, _ := io.ReadAll(part)
+		if idx == 0 {
+			_ = json.Unmarshal(content, &object)
+		} else {
+			data = content
+		}
+	}
+
+	srv.store(w, object.Name, object.CRC32C, data)
+}
+
+// uploadChunk will append the chunk to the session of the resumable upload, and store the object once the last chunk
+// is uploaded.
+func (srv *gcsServer) uploadChunk(w http.ResponseWriter, r *http.Request, name string, body []byte) {
+	if r.Method == http.MethodDelete {
+		delete(srv.sessions, name)
+
+		return
+	}
+
+	contentRange := r.Header.Get("Content-Range")
+	srv.ranges = append(srv.ranges, contentRange)
+	srv.sessions[name] = append(srv.sessions[name], body...)
+
+	if strings.HasSuffix(contentRange, "/*") {
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+
+		return
+	}
+
+	if contentRange != fmt.Sprintf("bytes */%d", len(srv.sessions[name])) &&
+		!strings.HasSuffix(contentRange, fmt.Sprintf("-%d/%d", len(srv.sessions[name])-1, len(srv.sessions[name]))) {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+
+		return
+	}
+
+	srv.store(w, name, "", srv.sessions[name])
+	delete(srv.sessions, name)
+}
+
+// store will store the object, if it matches the checksum of its metadata, and respond with its metadata.
+func (srv *gcsServer) store(w http.ResponseWriter, name, expected string, data []byte) {
+	checksum := encodeCRC32C(crc32.Checksum(data, crc32cTable))
+	if expected != "" && expected != checksum {
+		http.Error(w, `{"error": {"code": 400, "message": "checksum mismatch"}}`, http.StatusBadRequest)
+
+		return
+	}
+
+	srv.objects[name] = data
+
+	if srv.corrupt {
+		checksum = encodeCRC32C(0)
+	}
+
+	_ = json.NewEncoder(w).Encode(gcsTestObject{Bucket: "bucket", Name: name, CRC32C: checksum})
+}
+
+func newTestGCSObjectStore(t *testing.T, endpoint, params string) *gcsObjectStore {
+	t.Helper()
+
+	store, err := NewObjectStore("gs://bucket/archive?endpoint=" + url.QueryEscape(endpoint) + params)
+	if err != nil {
+		t.Fatalf("failed to create object store: %v", err)
+	}
+
+	gcs, _ := store.(*gcsObjectStore)
+	gcs.tokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "secret"})
+
+	return gcs
+}
+
+func TestGCSObjectStore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("objects", func(t *testing.T) {
+		t.Parallel()
+
+		srv, endpoint := newGCSServer(t)
+		store := newTestGCSObjectStore(t, endpoint, "")
+
+		for _, key := range []string{"run 1/candles.json.gz", "run 1/orders.json.gz", "run 2/candles.json.gz"} {
+			if err := store.Put(ctx, key, []byte(key)); err != nil {
+				t.Fatalf("failed to put object: %v", err)
+			}
+		}
+
+		if _, ok := srv.objects["archive/run 1/candles.json.gz"]; !ok {
+			t.Fatalf("expected the object to be prefixed, got %v", srv.objects)
+		}
+
+		data, err := store.Get(ctx, "run 1/orders.json.gz")
+		if err != nil || string(data) != "run 1/orders.json.gz" {
+			t.Fatalf("expected the object, got %q: %v", data, err)
+		}
+
+		if err := store.Delete(ctx, "run 1/orders.json.gz"); err != nil {
+			t.Fatalf("failed to delete object: %v", err)
+		}
+
+		if err := store.Delete(ctx, "run 1/orders.json.gz"); err != nil {
+			t.Fatalf("expected deleting a missing object to succeed, got %v", err)
+		}
+
+		keys, err := store.List(ctx)
+		if err != nil || !reflect.DeepEqual(keys, []string{"run 1/candles.json.gz", "run 2/candles.json.gz"}) {
+			t.Fatalf("expected every page of keys, got %v: %v", keys, err)
+		}
+
+		if _, err := store.Get(ctx, "run 3/candles.json.gz"); !errors.Is(err, ErrObjectStore) {
+			t.Fatalf("expected error %v, got %v", ErrObjectStore, err)
+		}
+	})
+
+	t.Run("resumable upload", func(t *testing.T) {
+		t.Parallel()
+
+		srv, endpoint := newGCSServer(t)
+		store := newTestGCSObjectStore(t, endpoint, "&chunkSize=262144")
+
+		for _, size := range []int{600 << 10, 512 << 10} {
+			data := bytes.Repeat([]byte("x"), size)
+			if err := store.Upload(ctx, "payload", bytes.NewReader(data)); err != nil {
+				t.Fatalf("failed to upload object: %v", err)
+			}
+
+			if !bytes.Equal(srv.objects["archive/payload"], data) {
+				t.Fatalf("expected the object of %d bytes, got %d bytes", size, len(srv.objects["archive/payload"]))
+			}
+		}
+
+		exp := []string{
+			"bytes 0-262143/*", "bytes 262144-524287/*", "bytes 524288-614399/614400",
+			"bytes 0-262143/*", "bytes 262144-524287/*", "bytes */524288",
+		}
+		if !reflect.DeepEqual(srv.ranges, exp) {
+			t.Fatalf("expected ranges %q, got %q", exp, srv.ranges)
+		}
+	})
+
+	t.Run("composite upload", func(t *testing.T) {
+		t.Parallel()
+
+		srv, endpoint := newGCSServer(t)
+		store := newTestGCSObjectStore(t, endpoint, "&chunkSize=262144&concurrency=3")
+
+		// The 40 chunks of the object are composed in two levels, since a request composes at most 32 objects.
+		data := make([]byte, 40*262144-10)
+		for idx := range data {
+			data[idx] = byte(idx % 251)
+		}
+
+		if err := store.Upload(ctx, "payload", bytes.NewReader(data)); err != nil {
+			t.Fatalf("failed to upload object: %v", err)
+		}
+
+		if !bytes.Equal(srv.objects["archive/payload"], data) {
+			t.Fatalf("expected the object of %d bytes, got %d bytes", len(data), len(srv.objects["archive/payload"]))
+		}
+
+		if len(srv.composed) != 3 || len(srv.composed[0]) != 32 || len(srv.composed[1]) != 8 ||
+			len(srv.composed[2]) != 2 {
+			t.Fatalf("expected two levels of compose requests, got %d", len(srv.composed))
+		}
+
+		if len(srv.objects) != 1 || len(srv.ranges) != 0 {
+			t.Fatalf("expected the temporary objects to be deleted, got %d objects", len(srv.objects))
+		}
+	})
+
+	t.Run("checksums", func(t *testing.T) {
+		t.Parallel()
+
+		srv, endpoint := newGCSServer(t)
+		srv.corrupt = true
+
+		for _, params := range []string{"", "&chunkSize=262144", "&chunkSize=262144&concurrency=2"} {
+			store := newTestGCSObjectStore(t, endpoint, params)
+
+			err := store.Upload(ctx, "payload", bytes.NewReader(bytes.Repeat([]byte("x"), 300<<10)))
+			if !errors.Is(err, ErrObjectStore) || !strings.Contains(err.Error(), "CRC32C") {
+				t.Fatalf("expected error %v for %q, got %v", ErrObjectStore, params, err)
+			}
+		}
+	})
+
+	t.Run("options", func(t *testing.T) {
+		t.Parallel()
+
+		for _, params := range []string{"chunkSize=0", "chunkSize=1000", "chunkSize=abc", "concurrency=0"} {
+			if _, err := NewObjectStore("gs://bucket?" + params); !errors.Is(err, ErrInvalidObjectStoreOption) {
+				t.Fatalf("expected error %v for %q, got %v", ErrInvalidObjectStoreOption, params, err)
+			}
+		}
+
+		_, endpoint := newGCSServer(t)
+
+		store := newTestGCSObjectStore(t, endpoint, "")
+		store.tokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "expired"})
+
+		if err := store.Put(ctx, "payload", []byte("{}")); !errors.Is(err, ErrObjectStore) {
+			t.Fatalf("expected error %v, got %v", ErrObjectStore, err)
+		}
+	})
+
+	t.Run("jsonl files", func(t *testing.T) {
+		t.Parallel()
+
+		// The files are compressed as a whole with the compression parameter.
+		for compression, ext := range map[string]string{"gzip": ".jsonl.gz", "zstd": ".jsonl.zst"} {
+			srv, endpoint := newGCSServer(t)
+
+			svc, err := New(ctx, "gs://bucket/lake?format=jsonl&partitionBy=region"+
+				"&name=dt%3D%7Bdate%7D/run-%7Brun%7D&compression="+compression+"&endpoint="+url.QueryEscape(endpoint))
+			if err != nil {
+				t.Fatalf("failed to create storage: %v", err)
+			}
+
+			stg, _ := svc.Storage.(*Parquet)
+			stg.store.(*gcsObjectStore).tokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "secret"})
+
+			txn, err := stg.StartTx(ctx)
+			if err != nil {
+				t.Fatalf("failed to start transaction: %v", err)
+			}
+
+			for _, data := range []string{
+				`[{"id": 1, "region": "eu"}, {"id": 2, "region": "us"}]`,
+				`[{"id": 3, "region": "eu"}]`,
+			} {
+				data := data
+
+				txn.Send(func(ctx context.Context, stg Storage) error {
+					_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(data)})
+
+					return err
+				})
+			}
+
+			if err := txn.Commit(); err != nil {
+				t.Fatalf("failed to commit transaction: %v", err)
+			}
+
+			// The records of the run are written to a single file for each partition.
+			key := regexp.MustCompile(`^lake/candles/region=(eu|us)/dt=\d{4}-\d{2}-\d{2}/run-` + stg.run +
+				regexp.QuoteMeta(ext) + `$`)
+
+			if len(srv.objects) != 2 {
+				t.Fatalf("expected a file for each partition, got %d", len(srv.objects))
+			}
+
+			for name := range srv.objects {
+				if !key.MatchString(name) {
+					t.Fatalf("unexpected file %q", name)
+				}
+			}
+
+			rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "candles"})
+			if err != nil || len(rsp.GetRecords()) != 3 || rsp.GetRecords()[0].AsMap()["region"] != "eu" {
+				t.Fatalf("expected the records of the run, got %v: %v", rsp, err)
+			}
+
+			truncated, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"candles"}})
+			if err != nil || truncated.GetDeletedCount() != 3 || len(srv.objects) != 0 {
+				t.Fatalf("expected 3 deleted records, got %v: %v", truncated, err)
+			}
+		}
+	})
+
+	t.Run("invalid files", func(t *testing.T) {
+		t.Parallel()
+
+		for _, params := range []string{"format=avro", "name=part", "name=%7Bhash%7D/", "name=../%7Bhash%7D",
+			"name=%7Bhash%7D-%7Bhour%7D"} {
+			if _, err := New(ctx, "gs://bucket/lake?"+params); !errors.Is(err, ErrDNSNotSupported) {
+				t.Fatalf("expected error %v for %q, got %v", ErrDNSNotSupported, params, err)
+			}
+		}
+	})
+}
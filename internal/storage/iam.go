@@ -0,0 +1,406 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
+	"github.com/lib/pq"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// pgIAMParam is the connection string parameter for the IAM provider used to authenticate with the database,
+	// either "aws" for AWS RDS/Aurora or "gcp" for GCP Cloud SQL. The parameter is removed from the connection string
+	// before connecting.
+	pgIAMParam = "iam"
+
+	// pgIAMRegionParam is the connection string parameter for the AWS region of the database. The default is the
+	// "AWS_REGION" environment variable.
+	pgIAMRegionParam = "aws_region"
+
+	// pgIAMInstanceParam is the connection string parameter for the connection name of the GCP Cloud SQL instance,
+	// e.g. "project:region:instance".
+	pgIAMInstanceParam = "instance"
+
+	iamAWS = "aws"
+	iamGCP = "gcp"
+
+	// cloudSQLAdminScope is the OAuth2 scope of the SQL Admin API, which the Cloud SQL connector calls for the
+	// certificates of the instance.
+	cloudSQLAdminScope = "https://www.googleapis.com/auth/sqlservice.admin"
+
+	// cloudSQLLoginScope is the OAuth2 scope of the tokens that log in the IAM database user.
+	cloudSQLLoginScope = "https://www.googleapis.com/auth/sqlservice.login"
+)
+
+var (
+	ErrUnsupportedIAMProvider  = fmt.Errorf("unsupported iam provider")
+	ErrMissingAWSCredentials   = fmt.Errorf("missing AWS credentials")
+	ErrMissingAWSRegion        = fmt.Errorf("missing AWS region")
+	ErrFetchingIAMToken        = fmt.Errorf("failed to fetch iam token")
+	ErrIAMRequiresTLS          = fmt.Errorf("iam authentication requires tls")
+	ErrMissingCloudSQLInstance = fmt.Errorf("missing cloud sql instance")
+)
+
+// UnsupportedIAMProviderError is returned when the IAM provider on a connection string is not supported.
+func UnsupportedIAMProviderError(provider string) error {
+	return fmt.Errorf("%w: %q, expected %q or %q", ErrUnsupportedIAMProvider, provider, iamAWS, iamGCP)
+}
+
+// iamTokenFn will return a short-lived token to use as the database password.
+type iamTokenFn func(context.Context) (string, error)
+
+// awsCredentialChain retrieves AWS credentials from the default credential chain of the AWS SDK: the environment
+// variables, the shared configuration and credentials files, web identity tokens (e.g. EKS IRSA), the ECS container
+// credentials, and the EC2 instance profile. Credentials are cached until they expire.
+type awsCredentialChain struct {
+	once     sync.Once
+	provider aws.CredentialsProvider
+	err      error
+}
+
+// loadAWSConfig will load the default AWS configuration, with the TLS configuration of the compliance mode. The
+// transport is configured on the buildable client of the SDK, which adds the certificates of "AWS_CA_BUNDLE" to it.
+func loadAWSConfig(ctx context.Context) (aws.Config, error) {
+	client := awshttp.NewBuildableClient().WithTransportOptions(func(transport *http.Transport) {
+		transport.TLSClientConfig = compliance.TLSConfig("")
+	})
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithHTTPClient(client))
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("%w: %v", ErrMissingAWSCredentials, err)
+	}
+
+	return cfg, nil
+}
+
+// load will load the credential provider of the default chain once.
+func (chain *awsCredentialChain) load(ctx context.Context) (aws.CredentialsProvider, error) {
+	chain.once.Do(func() {
+		cfg, err := loadAWSConfig(ctx)
+		if err != nil {
+			chain.err = err
+
+			return
+		}
+
+		chain.provider = cfg.Credentials
+	})
+
+	return chain.provider, chain.err
+}
+
+// awsAuthToken will return a function that generates RDS/Aurora IAM auth tokens for the database user with the
+// credentials of the chain. Tokens are generated locally, so a new token is generated for every connection. Tokens
+// are only checked when a connection is opened, so open connections outlive the token.
+func awsAuthToken(host, user, region string, chain *awsCredentialChain) iamTokenFn {
+	return func(ctx context.Context) (string, error) {
+		provider, err := chain.load(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		token, err := auth.BuildAuthToken(ctx, host, region, user, provider)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrFetchingIAMToken, err)
+		}
+
+		return token, nil
+	}
+}
+
+// gcpTokenSource will return the token source of the credentials file at the path for the scopes, e.g. a service
+// account key, or of Application Default Credentials if the path is empty. Tokens are fetched with the compliance
+// transport, with the context of the token source, which outlives the context of the caller.
+func gcpTokenSource(ctx context.Context, path string, scopes ...string) (oauth2.TokenSource, error) {
+	ctx = context.WithValue(context.WithoutCancel(ctx), oauth2.HTTPClient, compliance.HTTPClient())
+
+	if path == "" {
+		tokens, err := google.DefaultTokenSource(ctx, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrFetchingIAMToken, err)
+		}
+
+		return tokens, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to read credentials file: %v", ErrFetchingIAMToken, err)
+	}
+
+	creds, err := google.CredentialsFromJSON(ctx, data, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrFetchingIAMToken, path, err)
+	}
+
+	return creds.TokenSource, nil
+}
+
+// cloudSQLDialer is a "pq.Dialer" that connects to a Cloud SQL instance through the Cloud SQL connector, which
+// authenticates the IAM database user with the application default credentials. The connector is created on the first
+// connection, so that the credentials are only looked up when they are used.
+type cloudSQLDialer struct {
+	instance string
+
+	// dial is the dial function of the connector, e.g. an SSH tunnel. If nil, the connector dials directly.
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	once   sync.Once
+	dialer *cloudsqlconn.Dialer
+	err    error
+}
+
+// load will create the connector once, with an IAM login token source and a SQL Admin API token source of the
+// application default credentials.
+func (csd *cloudSQLDialer) load() (*cloudsqlconn.Dialer, error) {
+	csd.once.Do(func() {
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, compliance.HTTPClient())
+
+		apiTS, err := google.DefaultTokenSource(ctx, cloudSQLAdminScope)
+		if err != nil {
+			csd.err = fmt.Errorf("%w: %v", ErrFetchingIAMToken, err)
+
+			return
+		}
+
+		loginTS, err := google.DefaultTokenSource(ctx, cloudSQLLoginScope)
+		if err != nil {
+			csd.err = fmt.Errorf("%w: %v", ErrFetchingIAMToken, err)
+
+			return
+		}
+
+		opts := []cloudsqlconn.Option{
+			cloudsqlconn.WithIAMAuthN(),
+			cloudsqlconn.WithIAMAuthNTokenSources(apiTS, loginTS),
+			cloudsqlconn.WithHTTPClient(&http.Client{
+				Transport: &oauth2.Transport{Source: apiTS, Base: compliance.Transport()},
+			}),
+		}
+
+		if csd.dial != nil {
+			opts = append(opts, cloudsqlconn.WithDialFunc(csd.dial))
+		}
+
+		if csd.dialer, err = cloudsqlconn.NewDialer(ctx, opts...); err != nil {
+			csd.err = fmt.Errorf("unable to create cloud sql connector: %w", err)
+		}
+	})
+
+	return csd.dialer, csd.err
+}
+
+// DialContext will connect to the instance. The network and address of the connection string are ignored.
+func (csd *cloudSQLDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	dialer, err := csd.load()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialer.Dial(ctx, csd.instance)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial cloud sql instance %s: %w", csd.instance, err)
+	}
+
+	return conn, nil
+}
+
+// Dial will connect to the instance.
+func (csd *cloudSQLDialer) Dial(network, address string) (net.Conn, error) {
+	return csd.DialContext(context.Background(), network, address)
+}
+
+// DialTimeout will connect to the instance within the timeout.
+func (csd *cloudSQLDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return csd.DialContext(ctx, network, address)
+}
+
+// Close will close the connector, if it was created.
+func (csd *cloudSQLDialer) Close() error {
+	if csd.dialer == nil {
+		return nil
+	}
+
+	if err := csd.dialer.Close(); err != nil {
+		return fmt.Errorf("unable to close cloud sql connector: %w", err)
+	}
+
+	return nil
+}
+
+// pgIAMConnector is a "driver.Connector" that uses a fresh IAM token as the password for every new connection, so
+// that long runs keep connecting after the token that was used for the first connection expires.
+type pgIAMConnector struct {
+	dsn url.URL
+
+	// token is the token function of AWS RDS/Aurora. If nil, the connections are authenticated by the Cloud SQL
+	// connector.
+	token iamTokenFn
+
+	// cloudSQL is the Cloud SQL connector of GCP Cloud SQL instances.
+	cloudSQL *cloudSQLDialer
+
+	// dialer is the dialer for the connections, e.g. an SSH tunnel. If nil, the default dialer is used.
+	dialer pq.Dialer
+}
+
+// Connect will open a new connection using a fresh IAM token.
+func (conn *pgIAMConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	dsn := conn.dsn
+
+	if conn.token != nil {
+		token, err := conn.token(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		dsn.User = url.UserPassword(conn.dsn.User.Username(), token)
+	}
+
+	connector, err := pq.NewConnector(dsn.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create connector: %w", err)
+	}
+
+	switch {
+	case conn.cloudSQL != nil:
+		connector.Dialer(conn.cloudSQL)
+	case conn.dialer != nil:
+		connector.Dialer(conn.dialer)
+	}
+
+	driverConn, err := connector.Connect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect: %w", err)
+	}
+
+	return driverConn, nil
+}
+
+// setDialer will connect through the dialer, e.g. an SSH tunnel. The Cloud SQL connector dials the instance through
+// it.
+func (conn *pgIAMConnector) setDialer(dialer *sshTunnel) {
+	conn.dialer = dialer
+
+	if conn.cloudSQL != nil {
+		conn.cloudSQL.dial = dialer.DialContext
+	}
+}
+
+// Driver will return the postgres driver.
+func (conn *pgIAMConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// Close will close the Cloud SQL connector. It is called when the database is closed.
+func (conn *pgIAMConnector) Close() error {
+	if conn.cloudSQL == nil {
+		return nil
+	}
+
+	return conn.cloudSQL.Close()
+}
+
+// IAMRequiresTLSError is returned when a connection string that authenticates with an IAM provider does not require
+// TLS, which would send the token in plain text.
+func IAMRequiresTLSError(sslmode string) error {
+	return fmt.Errorf("%w: sslmode=%s, expected require, verify-ca, or verify-full", ErrIAMRequiresTLS, sslmode)
+}
+
+// parseIAM will remove the IAM parameters from the connection URL and return a connector that authenticates using
+// the IAM provider. If the connection URL does not have an IAM provider, the connector is nil. The connection must
+// require TLS, and "sslmode" defaults to "require".
+func parseIAM(connectionURL string) (*pgIAMConnector, error) {
+	if !strings.Contains(connectionURL, "://") || !strings.Contains(connectionURL, pgIAMParam+"=") {
+		return nil, nil
+	}
+
+	dsn, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	query := dsn.Query()
+	provider := query.Get(pgIAMParam)
+	region := query.Get(pgIAMRegionParam)
+	instance := query.Get(pgIAMInstanceParam)
+
+	query.Del(pgIAMParam)
+	query.Del(pgIAMRegionParam)
+	query.Del(pgIAMInstanceParam)
+
+	switch provider {
+	case iamAWS:
+		switch sslmode := query.Get("sslmode"); sslmode {
+		case "":
+			query.Set("sslmode", "require")
+		case "require", "verify-ca", "verify-full":
+		default:
+			return nil, IAMRequiresTLSError(sslmode)
+		}
+	case iamGCP:
+		// The Cloud SQL connector encrypts the connection with TLS of its own.
+		query.Set("sslmode", "disable")
+	}
+
+	dsn.RawQuery = query.Encode()
+
+	var user string
+	if dsn.User != nil {
+		user = dsn.User.Username()
+	}
+
+	switch provider {
+	case "":
+		return nil, nil
+	case iamAWS:
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+
+		if region == "" {
+			return nil, ErrMissingAWSRegion
+		}
+
+		host := dsn.Host
+		if dsn.Port() == "" {
+			host = net.JoinHostPort(dsn.Hostname(), "5432")
+		}
+
+		return &pgIAMConnector{dsn: *dsn, token: awsAuthToken(host, user, region, new(awsCredentialChain))}, nil
+	case iamGCP:
+		if instance == "" {
+			return nil, ErrMissingCloudSQLInstance
+		}
+
+		return &pgIAMConnector{dsn: *dsn, cloudSQL: &cloudSQLDialer{instance: instance}}, nil
+	default:
+		return nil, UnsupportedIAMProviderError(provider)
+	}
+}
@@ -0,0 +1,711 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+const (
+	influxDBScheme = "influxdb"
+
+	// influxDBTLSParam is the connection string parameter that connects to the server with HTTPS, e.g. "tls=true".
+	influxDBTLSParam = "tls"
+
+	// influxDBTagsParam is the connection string parameter for the comma separated fields of the records that are
+	// written as the tags of their points, e.g. "tags=exchange,product_id". The tags of a single table are set with
+	// "tags.<table>".
+	influxDBTagsParam = "tags"
+
+	// influxDBFieldsParam is the connection string parameter for the comma separated fields of the records that are
+	// written as the fields of their points, e.g. "fields=open,close". By default, every field of a record that is
+	// not a tag or the timestamp is written. The fields of a single table are set with "fields.<table>".
+	influxDBFieldsParam = "fields"
+
+	// influxDBTimeParam is the connection string parameter for the field of the records that is the timestamp of
+	// their points, e.g. "time=start". The timestamp of a single table is set with "time.<table>".
+	influxDBTimeParam = "time"
+
+	// influxDBPrecisionParam is the connection string parameter for the unit of numeric timestamps: "s" (the
+	// default), "ms", "us", or "ns".
+	influxDBPrecisionParam = "precision"
+
+	// influxDBTokenEnv is the environment variable with the API token to authorize requests with, if the connection
+	// string has no password.
+	influxDBTokenEnv = "INFLUXDB_TOKEN"
+
+	influxDBDefaultTime      = "time"
+	influxDBDefaultPrecision = "s"
+
+	// influxDBWriteLines is the number of points written in each write request.
+	influxDBWriteLines = 5000
+)
+
+var (
+	ErrInfluxDB      = fmt.Errorf("influxdb request failed")
+	ErrInfluxDBPoint = fmt.Errorf("invalid influxdb point")
+)
+
+// InfluxDBError is returned when an InfluxDB API request fails.
+func InfluxDBError(method, path string, err error) error {
+	return fmt.Errorf("%w: %s %s: %v", ErrInfluxDB, method, path, err)
+}
+
+// InfluxDBPointError is returned when a record cannot be written as a point of the measurement of its table.
+func InfluxDBPointError(table, reason string) error {
+	return fmt.Errorf("%w: records of %q: %s", ErrInfluxDBPoint, table, reason)
+}
+
+// influxDBPrecisions are the number of nanoseconds in each unit of numeric timestamps.
+var influxDBPrecisions = map[string]float64{"s": 1e9, "ms": 1e6, "us": 1e3, "ns": 1}
+
+// influxDBTxType is the type of the context key of InfluxDB transactions.
+type influxDBTxType uint8
+
+const (
+	basicInfluxDBTxID influxDBTxType = iota
+)
+
+// influxDBTx are the line protocol points of a transaction, written when the transaction commits.
+type influxDBTx struct {
+	mtx   sync.Mutex
+	lines []string
+}
+
+// influxDBMapping is how the records of a table are written as points: the fields of the records that are the tags,
+// the fields, and the timestamp of the points. A nil fields list writes every other field of the records.
+type influxDBMapping struct {
+	tags   []string
+	fields []string
+	time   string
+}
+
+// InfluxDB is a storage device that writes records as the points of an InfluxDB v2 bucket with the InfluxDB client,
+// e.g. for time-series web API data such as candles. Each table is a measurement, and each record is a point with the
+// tags, fields, and timestamp mapped from the fields of the record. Points with the same measurement, tags, and
+// timestamp are the same point, so upserting a record again updates its fields.
+type InfluxDB struct {
+	endpoint  string
+	token     string
+	org       string
+	bucket    string
+	precision float64
+
+	// The client of the server is created with the first request.
+	once   sync.Once
+	client influxdb2.Client
+
+	mapping  influxDBMapping
+	mappings map[string]*influxDBMapping
+
+	// activeTx are the transactions that are currently active, keyed by the transaction ID that is added to the
+	// context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewInfluxDB will return an InfluxDB storage device for the connection string, i.e.
+// "influxdb://[user:token@]host[:port]/<org>/<bucket>[?tls=true]". Requests are authorized with the password of the
+// connection string as the API token, or with the token in the "INFLUXDB_TOKEN" environment variable. The tags,
+// fields, and timestamp of the points are set with the "tags", "fields", and "time" parameters, or "tags.<table>",
+// "fields.<table>", and "time.<table>" for a single table.
+func NewInfluxDB(_ context.Context, connectionURL string) (*InfluxDB, error) {
+	uri, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	org, bucket, _ := strings.Cut(strings.Trim(uri.Path, "/"), "/")
+	if uri.Host == "" || org == "" || bucket == "" || strings.Contains(bucket, "/") {
+		return nil, DNSNotSupportedError(connectionURL)
+	}
+
+	stg := &InfluxDB{
+		endpoint:  "http://" + uri.Host,
+		token:     os.Getenv(influxDBTokenEnv),
+		org:       org,
+		bucket:    bucket,
+		precision: influxDBPrecisions[influxDBDefaultPrecision],
+		mapping:   influxDBMapping{time: influxDBDefaultTime},
+		mappings:  make(map[string]*influxDBMapping),
+	}
+
+	if password, ok := uri.User.Password(); ok {
+		stg.token = password
+	}
+
+	// The parameters of a single table override the parameters of every table, so they are set last.
+	var tableParams []string
+
+	for key, values := range uri.Query() {
+		switch key {
+		case influxDBTLSParam:
+			if tls, err := strconv.ParseBool(values[0]); err != nil {
+				return nil, fmt.Errorf("%w: %s=%q must be a boolean", ErrDNSNotSupported, key, values[0])
+			} else if tls {
+				stg.endpoint = "https://" + uri.Host
+			}
+		case influxDBPrecisionParam:
+			precision, ok := influxDBPrecisions[values[0]]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s=%q must be s, ms, us, or ns", ErrDNSNotSupported, key, values[0])
+			}
+
+			stg.precision = precision
+		case influxDBTagsParam, influxDBFieldsParam, influxDBTimeParam:
+			stg.mapping.set(key, values[0])
+		default:
+			tableParams = append(tableParams, key)
+		}
+	}
+
+	for _, key := range tableParams {
+		param, table, ok := strings.Cut(key, ".")
+		if !ok || (param != influxDBTagsParam && param != influxDBFieldsParam && param != influxDBTimeParam) {
+			continue
+		}
+
+		stg.tableMapping(table).set(param, uri.Query().Get(key))
+	}
+
+	return stg, nil
+}
+
+// set will set the tags, fields, or timestamp of the mapping from the value of a connection string parameter.
+func (mapping *influxDBMapping) set(param, value string) {
+	var list []string
+
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			list = append(list, field)
+		}
+	}
+
+	switch param {
+	case influxDBTagsParam:
+		mapping.tags = list
+	case influxDBFieldsParam:
+		mapping.fields = list
+	case influxDBTimeParam:
+		mapping.time = strings.TrimSpace(value)
+	}
+}
+
+// tableMapping will return the mapping of the table, which is a copy of the mapping of every table until it is
+// overridden by the parameters of the table.
+func (stg *InfluxDB) tableMapping(table string) *influxDBMapping {
+	if mapping, ok := stg.mappings[table]; ok {
+		return mapping
+	}
+
+	mapping := stg.mapping
+	stg.mappings[table] = &mapping
+
+	return &mapping
+}
+
+// Close will close the idle connections of the client.
+func (stg *InfluxDB) Close() {
+	if stg.client != nil {
+		stg.client.Close()
+	}
+}
+
+// IsNoSQL returns "true" to indicate that "InfluxDB" is a NoSQL database.
+func (stg *InfluxDB) IsNoSQL() bool { return true }
+
+// Type implements the storage interface.
+func (stg *InfluxDB) Type() uint8 { return InfluxDBType }
+
+// mappingOf will return the mapping of the table, without adding it to the mappings.
+func (stg *InfluxDB) mappingOf(table string) *influxDBMapping {
+	if mapping, ok := stg.mappings[table]; ok {
+		return mapping
+	}
+
+	return &stg.mapping
+}
+
+// influxClient will return the client of the server, authorized with the API token, and created with the first
+// request.
+func (stg *InfluxDB) influxClient() influxdb2.Client {
+	stg.once.Do(func() {
+		options := influxdb2.DefaultOptions().SetHTTPClient(compliance.HTTPClient()).SetPrecision(time.Nanosecond)
+		stg.client = influxdb2.NewClientWithOptions(stg.endpoint, stg.token, options)
+	})
+
+	return stg.client
+}
+
+// influxDBEscape will escape the characters of a measurement, tag key, tag value, or field key of line protocol.
+func influxDBEscape(value, chars string) string {
+	var escaped strings.Builder
+
+	for _, r := range value {
+		if r == '\n' {
+			escaped.WriteString(`\n`)
+
+			continue
+		}
+
+		if strings.ContainsRune(chars, r) {
+			escaped.WriteByte('\\')
+		}
+
+		escaped.WriteRune(r)
+	}
+
+	return escaped.String()
+}
+
+// influxDBTagValue will return the value of a tag, or false if the value is null or empty. Tag values are strings,
+// so other values are written as JSON.
+func influxDBTagValue(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return value, value != ""
+	default:
+		data, _ := json.Marshal(value)
+
+		return string(data), true
+	}
+}
+
+// influxDBFieldValue will return the value of a field in line protocol, or false if the value is null. Numbers are
+// written as floats, and objects and lists as JSON strings.
+func influxDBFieldValue(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return "", false
+	case bool:
+		return strconv.FormatBool(value), true
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64), true
+	case string:
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`, true
+	default:
+		data, _ := json.Marshal(value)
+
+		return influxDBFieldValue(string(data))
+	}
+}
+
+// lineTimestamp will return the timestamp of a point in nanoseconds, from an RFC 3339 string or a number in units of
+// "precision" nanoseconds.
+func lineTimestamp(table string, value interface{}, precision float64, pointErr func(table, reason string) error,
+) (int64, error) {
+	switch value := value.(type) {
+	case float64:
+		return int64(math.Round(value * precision)), nil
+	case string:
+		ts, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return 0, pointErr(table, fmt.Sprintf("invalid timestamp %q: %v", value, err))
+		}
+
+		return ts.UnixNano(), nil
+	default:
+		return 0, pointErr(table, fmt.Sprintf("the timestamp must be a string or number, got %T", value))
+	}
+}
+
+// lineFields will return the fields of the record that are written with the mapping, i.e. the fields of the mapping,
+// or every field that is not a tag or the timestamp, sorted by name.
+func lineFields(record map[string]interface{}, mapping *influxDBMapping) []string {
+	if mapping.fields != nil {
+		return mapping.fields
+	}
+
+	skip := map[string]bool{mapping.time: true}
+	for _, tag := range mapping.tags {
+		skip[tag] = true
+	}
+
+	fields := make([]string, 0, len(record))
+
+	for name := range record {
+		if !skip[name] {
+			fields = append(fields, name)
+		}
+	}
+
+	sort.Strings(fields)
+
+	return fields
+}
+
+// linePoint will return the record as a point of the measurement of the table in line protocol, with the tags,
+// fields, and timestamp of the mapping. A record without the timestamp field is written at the time of the server.
+// Records that can not be written as a point fail with the error of "pointErr".
+func linePoint(table string, record map[string]interface{}, mapping *influxDBMapping, precision float64,
+	pointErr func(table, reason string) error,
+) (string, error) {
+	var line strings.Builder
+
+	line.WriteString(influxDBEscape(table, ", "))
+
+	// Tags are sorted by key, which is how the server stores them.
+	tags := append([]string(nil), mapping.tags...)
+	sort.Strings(tags)
+
+	for _, tag := range tags {
+		if value, ok := influxDBTagValue(record[tag]); ok {
+			line.WriteString("," + influxDBEscape(tag, ",= ") + "=" + influxDBEscape(value, ",= "))
+		}
+	}
+
+	written := 0
+
+	for _, field := range lineFields(record, mapping) {
+		value, ok := influxDBFieldValue(record[field])
+		if !ok {
+			continue
+		}
+
+		sep := ","
+		if written == 0 {
+			sep = " "
+		}
+
+		line.WriteString(sep + influxDBEscape(field, ",= ") + "=" + value)
+
+		written++
+	}
+
+	if written == 0 {
+		return "", pointErr(table, "a point must have at least one non-null field")
+	}
+
+	if value, ok := record[mapping.time]; ok && value != nil {
+		ts, err := lineTimestamp(table, value, precision, pointErr)
+		if err != nil {
+			return "", err
+		}
+
+		line.WriteString(" " + strconv.FormatInt(ts, 10))
+	}
+
+	return line.String(), nil
+}
+
+// write will write the points to the bucket, in requests of up to "influxDBWriteLines" points.
+func (stg *InfluxDB) write(ctx context.Context, lines []string) error {
+	writer := stg.influxClient().WriteAPIBlocking(stg.org, stg.bucket)
+
+	for start := 0; start < len(lines); start += influxDBWriteLines {
+		if err := writer.WriteRecord(ctx, lines[start:min(start+influxDBWriteLines, len(lines))]...); err != nil {
+			return InfluxDBError(http.MethodPost, "/api/v2/write", err)
+		}
+	}
+
+	return nil
+}
+
+// Upsert will write each record as a point of the measurement of the table. Within a transaction, the points are
+// written when the transaction commits.
+func (stg *InfluxDB) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	lines := make([]string, 0, len(records))
+
+	for _, record := range records {
+		line, err := linePoint(req.GetTable(), record.AsMap(), stg.mappingOf(req.GetTable()), stg.precision,
+			InfluxDBPointError)
+		if err != nil {
+			return nil, err
+		}
+
+		lines = append(lines, line)
+	}
+
+	if len(lines) == 0 {
+		return &proto.UpsertResponse{}, nil
+	}
+
+	if tx := stg.tx(ctx); tx != nil {
+		tx.mtx.Lock()
+		defer tx.mtx.Unlock()
+
+		tx.lines = append(tx.lines, lines...)
+
+		return &proto.UpsertResponse{UpsertedCount: int64(len(lines))}, nil
+	}
+
+	if err := stg.write(ctx, lines); err != nil {
+		return nil, fmt.Errorf("unable to upsert records: %w", err)
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(lines))}, nil
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *InfluxDB) tx(ctx context.Context) *influxDBTx {
+	txID, ok := ctx.Value(basicInfluxDBTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	influxTx, _ := tx.(*influxDBTx)
+
+	return influxTx
+}
+
+// fluxString will return the value as a Flux string literal.
+func fluxString(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`).Replace(value) + `"`
+}
+
+// flux will run the Flux query and return the rows of its response, with integers decoded as numbers and timestamps
+// as RFC 3339 strings. Null values are not set on the rows.
+func (stg *InfluxDB) flux(ctx context.Context, query string) ([]map[string]interface{}, error) {
+	result, err := stg.influxClient().QueryAPI(stg.org).Query(ctx, query)
+	if err != nil {
+		return nil, InfluxDBError(http.MethodPost, "/api/v2/query", err)
+	}
+
+	defer result.Close()
+
+	var rows []map[string]interface{}
+
+	for result.Next() {
+		values := result.Record().Values()
+		record := make(map[string]interface{}, len(values))
+
+		for name, value := range values {
+			if value = fluxValue(value); value != nil {
+				record[name] = value
+			}
+		}
+
+		rows = append(rows, record)
+	}
+
+	if err := result.Err(); err != nil {
+		return nil, InfluxDBError(http.MethodPost, "/api/v2/query", fmt.Errorf("invalid response: %w", err))
+	}
+
+	return rows, nil
+}
+
+// fluxValue will return a value of a Flux response as a record value. Integers are decoded as numbers, and
+// timestamps are kept as RFC 3339 strings.
+func fluxValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case int64:
+		return float64(value)
+	case uint64:
+		return float64(value)
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	case time.Duration:
+		return value.String()
+	default:
+		return value
+	}
+}
+
+// Read will return the points of the measurement of the table as records, with their tags, fields, and timestamp
+// mapped back to the fields of the records, that match the required fields on the request, in the page requested by
+// the options of the request, if any. Tags are read as strings, and the timestamp as an RFC 3339 string.
+func (stg *InfluxDB) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	table := req.GetTable()
+	query := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: 0)
+  |> filter(fn: (r) => r._measurement == %s)
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> drop(columns: ["_start", "_stop", "_measurement"])
+  |> group()`, fluxString(stg.bucket), fluxString(table))
+
+	rows, err := stg.flux(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read records: %w", err)
+	}
+
+	timeField := stg.mappingOf(table).time
+	records := make([]map[string]interface{}, 0, len(rows))
+
+	for _, row := range rows {
+		delete(row, "result")
+		delete(row, "table")
+
+		if ts, ok := row["_time"]; ok {
+			delete(row, "_time")
+			row[timeField] = ts
+		}
+
+		if parquetMatches(row, nil, req.GetRequired().GetFields()) {
+			records = append(records, row)
+		}
+	}
+
+	return redisPage(records, page)
+}
+
+// Count will return the number of points of the measurement that match the required fields. Without required fields
+// the points are counted by a Flux query, and otherwise they are read and filtered like "Read".
+func (stg *InfluxDB) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	if len(req.GetRequired().GetFields()) > 0 {
+		return readCount(ctx, stg, req)
+	}
+
+	query := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: 0)
+  |> filter(fn: (r) => r._measurement == %s)
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group()
+  |> count(column: "_time")`, fluxString(stg.bucket), fluxString(req.GetTable()))
+
+	rows, err := stg.flux(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("unable to count records: %w", err)
+	}
+
+	rsp := new(proto.CountResponse)
+
+	for _, row := range rows {
+		if count, ok := row["_time"].(float64); ok {
+			rsp.Count += int64(count)
+		}
+	}
+
+	return rsp, nil
+}
+
+// Truncate will delete every point of the measurements of the tables. The server does not report the number of
+// deleted points, so the deleted count is zero.
+func (stg *InfluxDB) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	deleter := stg.influxClient().DeleteAPI()
+	start, stop := time.Unix(0, 0).UTC(), time.Unix(0, math.MaxInt64).UTC()
+
+	for _, table := range req.GetTables() {
+		err := deleter.DeleteWithName(ctx, stg.org, stg.bucket, start, stop, "_measurement="+fluxString(table))
+		if err != nil {
+			return nil, fmt.Errorf("error truncating table %s: %w", table, InfluxDBError(http.MethodPost,
+				"/api/v2/delete", err))
+		}
+	}
+
+	return &proto.TruncateResponse{}, nil
+}
+
+// ListTables will return the measurements of the bucket. Table sizes are reported as zero.
+func (stg *InfluxDB) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	rows, err := stg.flux(ctx, fmt.Sprintf(`import "influxdata/influxdb/schema"
+
+schema.measurements(bucket: %s)`, fluxString(stg.bucket)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tables: %w", err)
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+
+	for _, row := range rows {
+		if measurement, ok := row["_value"].(string); ok {
+			rsp.TableSet[measurement] = &proto.Table{}
+		}
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will return the tags and the timestamp field of each table, which identify its points.
+func (stg *InfluxDB) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	tables, err := stg.ListTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+
+	for table := range tables.GetTableSet() {
+		mapping := stg.mappingOf(table)
+		rsp.PKSet[table] = &proto.PrimaryKeys{List: append(append([]string(nil), mapping.tags...), mapping.time)}
+	}
+
+	return rsp, nil
+}
+
+// StartTx will start a transaction. The points of the functions sent to the transaction are buffered, and written
+// when the transaction commits. Write requests are not atomic, so a commit that fails may have written some of the
+// points. Reads in the transaction do not see its buffered points.
+func (stg *InfluxDB) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+	tx := new(influxDBTx)
+
+	stg.activeTx.Store(txnID, tx)
+
+	influxCtx := context.WithValue(ctx, basicInfluxDBTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+
+		var err error
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(influxCtx, stg)
+		}
+
+		if err != nil {
+			<-txn.commit
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit {
+			if err = stg.write(ctx, tx.lines); err != nil {
+				err = fmt.Errorf("unable to commit transaction: %w", err)
+			}
+		}
+
+		txn.done <- err
+	}()
+
+	return txn, nil
+}
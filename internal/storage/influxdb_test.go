@@ -0,0 +1,316 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// influxDBServer is an InfluxDB server that records the bodies of write and delete requests, and answers every query
+// with its CSV response.
+type influxDBServer struct {
+	mtx     sync.Mutex
+	csv     string
+	writes  []string
+	deletes []map[string]string
+	queries []string
+}
+
+func (srv *influxDBServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	if r.Header.Get("Authorization") != "Token secret" {
+		http.Error(w, `{"code":"unauthorized","message":"unauthorized access"}`, http.StatusUnauthorized)
+
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+
+	switch r.URL.Path {
+	case "/api/v2/write":
+		if r.URL.Query().Get("org") != "acme" || r.URL.Query().Get("bucket") != "market" {
+			http.Error(w, `{"code":"not found","message":"bucket not found"}`, http.StatusNotFound)
+
+			return
+		}
+
+		srv.writes = append(srv.writes, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	case "/api/v2/delete":
+		var req map[string]string
+
+		_ = json.Unmarshal(body, &req)
+		srv.deletes = append(srv.deletes, req)
+		w.WriteHeader(http.StatusNoContent)
+	case "/api/v2/query":
+		var req struct {
+			Query string `json:"query"`
+		}
+
+		_ = json.Unmarshal(body, &req)
+		srv.queries = append(srv.queries, req.Query)
+		_, _ = io.WriteString(w, srv.csv)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestInfluxDB(t *testing.T, params string) (*InfluxDB, *influxDBServer) {
+	t.Helper()
+
+	srv := new(influxDBServer)
+
+	server := httptest.NewServer(srv)
+	t.Cleanup(server.Close)
+
+	svc, err := New(context.Background(), "influxdb://gidari:secret@"+strings.TrimPrefix(server.URL, "http://")+
+		"/acme/market"+params)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	stg, ok := svc.Storage.(*InfluxDB)
+	if !ok {
+		t.Fatalf("expected influxdb storage, got %T", svc.Storage)
+	}
+
+	return stg, srv
+}
+
+func TestInfluxDB(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("dsn", func(t *testing.T) {
+		t.Parallel()
+
+		for _, dns := range []string{
+			"influxdb://influx1:8086/acme",
+			"influxdb://influx1:8086/acme/market/1m",
+			"influxdb://influx1:8086/acme/market?tls=maybe",
+			"influxdb://influx1:8086/acme/market?precision=m",
+		} {
+			if _, err := New(ctx, dns); !errors.Is(err, ErrDNSNotSupported) {
+				t.Fatalf("expected error %v for %q, got %v", ErrDNSNotSupported, dns, err)
+			}
+		}
+
+		svc, err := New(ctx, "influxdb://influx1:8086/acme/market?tls=true&tags=exchange&time=start"+
+			"&tags.candles=exchange,product_id&fields.candles=open,close")
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+
+		stg, _ := svc.Storage.(*InfluxDB)
+		if stg.Type() != InfluxDBType || stg.endpoint != "https://influx1:8086" || stg.org != "acme" ||
+			stg.bucket != "market" {
+			t.Fatalf("unexpected storage %+v", stg)
+		}
+
+		exp := &influxDBMapping{tags: []string{"exchange", "product_id"}, fields: []string{"open", "close"}, time: "start"}
+		if mapping := stg.mappingOf("candles"); !reflect.DeepEqual(mapping, exp) {
+			t.Fatalf("expected mapping %+v, got %+v", exp, mapping)
+		}
+
+		if mapping := stg.mappingOf("trades"); !reflect.DeepEqual(mapping.tags, []string{"exchange"}) ||
+			mapping.fields != nil || mapping.time != "start" {
+			t.Fatalf("expected the mapping of every table, got %+v", mapping)
+		}
+	})
+
+	t.Run("line protocol", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestInfluxDB(t, "?tags.candles=product_id,exchange&precision=ms")
+
+		_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(`[
+			{"time": 1500, "product_id": "BTC-USD", "exchange": "coin base", "open": 1.5, "ok": true,
+				"note": "say \"hi\"", "meta": {"a": 1}, "empty": null},
+			{"time": "2022-01-02T03:04:05.5Z", "product_id": "ETH-USD", "open": 2},
+			{"open": 3, "product_id": ""}
+		]`)})
+		if err != nil {
+			t.Fatalf("failed to upsert records: %v", err)
+		}
+
+		exp := `candles,exchange=coin\ base,product_id=BTC-USD meta="{\"a\":1}",note="say \"hi\"",ok=true,open=1.5 ` +
+			"1500000000\n" +
+			"candles,product_id=ETH-USD open=2 1641092645500000000\n" +
+			"candles open=3"
+
+		if len(srv.writes) != 1 || srv.writes[0] != exp {
+			t.Fatalf("expected write %q, got %q", exp, srv.writes)
+		}
+	})
+
+	t.Run("read", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestInfluxDB(t, "?tags=product_id&time.candles=start")
+		srv.csv = "#datatype,string,long,string,double,boolean,dateTime:RFC3339\r\n" +
+			",result,table,product_id,open,ok,_time\r\n" +
+			",_result,0,BTC-USD,1.5,true,2022-01-01T00:00:00Z\r\n" +
+			",_result,0,ETH-USD,,false,2022-01-02T00:00:00Z\r\n" +
+			"\r\n" +
+			"#datatype,string,long,string,long,dateTime:RFC3339\r\n" +
+			",result,table,product_id,volume,_time\r\n" +
+			",_result,1,BTC-USD,10,2022-01-03T00:00:00Z\r\n"
+
+		opts, err := structpb.NewStruct(map[string]interface{}{ReadOrderByOption: []interface{}{"start"}, ReadLimitOption: 1})
+		if err != nil {
+			t.Fatalf("failed to create read options: %v", err)
+		}
+
+		required, err := structpb.NewStruct(map[string]interface{}{"product_id": "BTC-USD"})
+		if err != nil {
+			t.Fatalf("failed to create required fields: %v", err)
+		}
+
+		rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "candles", Required: required, Options: opts})
+		if err != nil {
+			t.Fatalf("failed to read records: %v", err)
+		}
+
+		var records []map[string]interface{}
+		for _, record := range rsp.GetRecords() {
+			records = append(records, record.AsMap())
+		}
+
+		exp := []map[string]interface{}{{"product_id": "BTC-USD", "open": 1.5, "ok": true, "start": "2022-01-01T00:00:00Z"}}
+		if !reflect.DeepEqual(records, exp) {
+			t.Fatalf("expected records %v, got %v", exp, records)
+		}
+
+		if len(srv.queries) != 1 || !strings.Contains(srv.queries[0], `from(bucket: "market")`) ||
+			!strings.Contains(srv.queries[0], `r._measurement == "candles"`) {
+			t.Fatalf("unexpected query %q", srv.queries)
+		}
+
+		srv.csv = "#datatype,string,long,string\r\n,result,table,_value\r\n,_result,0,candles\r\n,_result,0,trades\r\n"
+
+		tables, err := stg.ListTables(ctx)
+		if err != nil {
+			t.Fatalf("failed to list tables: %v", err)
+		}
+
+		if !reflect.DeepEqual(tables.GetTableSet(), map[string]*proto.Table{"candles": {}, "trades": {}}) {
+			t.Fatalf("expected tables candles and trades, got %v", tables.GetTableSet())
+		}
+
+		pks, err := stg.ListPrimaryKeys(ctx)
+		if err != nil || !reflect.DeepEqual(pks.GetPKSet()["candles"].GetList(), []string{"product_id", "start"}) ||
+			!reflect.DeepEqual(pks.GetPKSet()["trades"].GetList(), []string{"product_id", "time"}) {
+			t.Fatalf("expected the tags and time of each table as primary keys, got %v: %v", pks, err)
+		}
+
+		if _, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"candles"}}); err != nil {
+			t.Fatalf("failed to truncate tables: %v", err)
+		}
+
+		if len(srv.deletes) != 1 || srv.deletes[0]["predicate"] != `_measurement="candles"` ||
+			srv.deletes[0]["start"] != "1970-01-01T00:00:00Z" {
+			t.Fatalf("unexpected delete %v", srv.deletes)
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestInfluxDB(t, "")
+		srv.csv = "#datatype,string,long,long\r\n,result,table,_time\r\n,_result,0,3\r\n"
+
+		rsp, err := stg.Count(ctx, &proto.CountRequest{Table: "candles"})
+		if err != nil || rsp.GetCount() != 3 {
+			t.Fatalf("expected 3 points counted by the server, got %v: %v", rsp, err)
+		}
+
+		if len(srv.queries) != 1 || !strings.Contains(srv.queries[0], `count(column: "_time")`) {
+			t.Fatalf("unexpected query %q", srv.queries)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		stg, _ := newTestInfluxDB(t, "")
+
+		for _, data := range []string{`[{"time": 1}]`, `[{"time": "yesterday", "open": 1}]`, `[{"time": true, "open": 1}]`} {
+			_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(data)})
+			if !errors.Is(err, ErrInfluxDBPoint) {
+				t.Fatalf("expected point error for %s, got %v", data, err)
+			}
+		}
+
+		stg.bucket = "missing"
+		if _, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(`[{"open": 1}]`)}); !errors.Is(err,
+			ErrInfluxDB) || !strings.Contains(err.Error(), "bucket not found") {
+			t.Fatalf("expected the error of the server, got %v", err)
+		}
+
+		// The token is set on the client of the first request, so it is cleared on a storage without requests.
+		unauthorized, _ := newTestInfluxDB(t, "")
+		unauthorized.token = ""
+
+		if _, err := unauthorized.ListTables(ctx); !errors.Is(err, ErrInfluxDB) ||
+			!strings.Contains(err.Error(), "unauthorized") {
+			t.Fatalf("expected an unauthorized error, got %v", err)
+		}
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestInfluxDB(t, "")
+
+		for _, commit := range []bool{false, true} {
+			txn, err := stg.StartTx(ctx)
+			if err != nil {
+				t.Fatalf("failed to start transaction: %v", err)
+			}
+
+			txn.Send(func(ctx context.Context, stg Storage) error {
+				_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(`[{"open": 1}]`)})
+
+				return err
+			})
+
+			if len(srv.writes) != 0 {
+				t.Fatalf("expected the points to be buffered, got %q", srv.writes)
+			}
+
+			if commit {
+				err = txn.Commit()
+			} else {
+				err = txn.Rollback()
+			}
+
+			if err != nil {
+				t.Fatalf("failed to end transaction: %v", err)
+			}
+		}
+
+		if len(srv.writes) != 1 || srv.writes[0] != "candles open=1" {
+			t.Fatalf("expected the committed points to be written, got %q", srv.writes)
+		}
+	})
+}
@@ -0,0 +1,796 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sr"
+)
+
+const (
+	kafkaScheme = "kafka"
+
+	// kafkaAcksParam is the connection string parameter for the acknowledgements the brokers send for each produce
+	// request: "0" (none, at most once delivery), "1" (the partition leader), or "all" (every in-sync replica, the
+	// default).
+	kafkaAcksParam = "acks"
+
+	// kafkaKeyParam is the connection string parameter for the comma separated fields of the records that are the key
+	// of their messages, e.g. "key=product_id". The key of a single table is set with "key.<table>".
+	kafkaKeyParam = "key"
+
+	// kafkaRetriesParam is the connection string parameter for the number of times a request that fails with a
+	// retriable error, e.g. a leader election, is retried. The default is 3.
+	kafkaRetriesParam = "retries"
+
+	// kafkaTimeoutParam is the connection string parameter for the timeout of each request to a broker, e.g.
+	// "timeout=10s". The default is 30 seconds.
+	kafkaTimeoutParam = "timeout"
+
+	// kafkaTLSParam is the connection string parameter that connects to the brokers with TLS, e.g. "tls=true".
+	kafkaTLSParam = "tls"
+
+	// kafkaClientIDParam is the connection string parameter for the client ID of the requests. The default is
+	// "gidari".
+	kafkaClientIDParam = "client_id"
+
+	// kafkaTransactionalIDParam is the connection string parameter for the transactional ID of the producer, e.g.
+	// "transactional_id=gidari-candles", which produces every upsert and transaction in a Kafka transaction. The ID
+	// must be the same for each run of a pipeline, so that the brokers fence a producer left over by a run that
+	// failed, and must not be shared by pipelines.
+	kafkaTransactionalIDParam = "transactional_id"
+
+	// kafkaOffsetsTopic is the topic of the source offsets and watermarks of incremental requests, see
+	// "transport.WatermarkTable", which is keyed by their ID unless another key is set for it. It is read as a
+	// table, so that a run starts from the watermarks committed with the messages of the last run.
+	kafkaOffsetsTopic = "gidari_watermarks"
+	kafkaOffsetsKey   = "id"
+
+	kafkaDefaultPort     = "9092"
+	kafkaDefaultClientID = "gidari"
+	kafkaDefaultRetries  = 3
+	kafkaDefaultTimeout  = 30 * time.Second
+
+	// kafkaRetryBackoff is the wait before a failed request is retried.
+	kafkaRetryBackoff = 250 * time.Millisecond
+)
+
+var (
+	ErrKafka            = fmt.Errorf("kafka request failed")
+	ErrKafkaUnsupported = fmt.Errorf("unsupported kafka operation")
+)
+
+// KafkaError is returned when a Kafka request fails.
+func KafkaError(request string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrKafka, request, err)
+}
+
+// KafkaUnsupportedError is returned for the operations of the storage interface that Kafka topics do not support.
+func KafkaUnsupportedError(operation string) error {
+	return fmt.Errorf("%w: topics can not be %s", ErrKafkaUnsupported, operation)
+}
+
+// kafkaTxType is the type of the context key of Kafka transactions.
+type kafkaTxType uint8
+
+const (
+	basicKafkaTxID kafkaTxType = iota
+)
+
+// kafkaTx are the messages of a transaction by topic, produced when the transaction commits.
+type kafkaTx struct {
+	mtx      sync.Mutex
+	topics   []string
+	messages map[string][]*kgo.Record
+}
+
+// Kafka is a storage device that publishes each upserted record as a JSON message to the topic of its table with the
+// franz-go client, e.g. to feed streaming pipelines. Messages are keyed by the configured fields of the records, and
+// are partitioned by key as by the default partitioner of the Kafka clients. Topics are created by the brokers if
+// they allow it.
+//
+// Delivery is at least once, since a produce request that fails with a retriable error is sent again, unless "acks"
+// is zero, which is at most once. With "acks=all", the producer is idempotent, so a batch that is sent again is not
+// written twice. With a transactional ID, delivery is exactly once: the messages of a transaction are committed in a
+// single Kafka transaction with the offsets and watermarks of their sources, which the next run reads back, so that
+// consumers with read committed isolation see every message of a run once, or none of them.
+//
+// With a schema registry format, messages are serialized in the Confluent wire format with the schema of their topic,
+// which is registered with the schema registry after checking its compatibility with the latest schema of the topic.
+type Kafka struct {
+	client *kgo.Client
+
+	seeds           []string
+	clientID        string
+	user            string
+	password        string
+	tls             *tls.Config
+	timeout         time.Duration
+	acks            int16
+	retries         int
+	transactionalID string
+
+	// format, registry, and compatibility are the serialization parameters of the connection string, and serializer
+	// serializes the messages of a schema registry format.
+	format        string
+	registry      string
+	compatibility *sr.CompatibilityLevel
+	serializer    *kafkaSerializer
+
+	// txMtx serializes the Kafka transactions of a transactional producer, which has a single open transaction at a
+	// time.
+	txMtx sync.Mutex
+
+	keys      []string
+	tableKeys map[string][]string
+
+	// activeTx are the transactions that are currently active, keyed by the transaction ID that is added to the
+	// context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewKafka will return a Kafka storage device for the connection string, i.e.
+// "kafka://[user:password@]host[:port][,host[:port]...][?acks=all&key=id&tls=true]". The brokers are authenticated
+// with SASL/PLAIN if the connection string has a user. The fields of the records that are the key of their messages
+// are set with the "key" parameter, or "key.<table>" for a single table. The "format=avro", "format=protobuf", and
+// "format=jsonschema" parameters require the URL of a schema registry in the "registry" parameter.
+func NewKafka(_ context.Context, connectionURL string) (*Kafka, error) {
+	authority, rawQuery, _ := strings.Cut(strings.TrimPrefix(connectionURL, kafkaScheme+"://"), "?")
+	authority = strings.TrimSuffix(authority, "/")
+
+	var userinfo string
+	if idx := strings.LastIndex(authority, "@"); idx >= 0 {
+		userinfo, authority = authority[:idx], authority[idx+1:]
+	}
+
+	var seeds []string
+
+	for _, host := range strings.Split(authority, ",") {
+		if host = strings.TrimSpace(host); host == "" || strings.Contains(host, "/") {
+			return nil, DNSNotSupportedError(connectionURL)
+		}
+
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, kafkaDefaultPort)
+		}
+
+		seeds = append(seeds, host)
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	stg := &Kafka{
+		seeds:     seeds,
+		clientID:  kafkaDefaultClientID,
+		timeout:   kafkaDefaultTimeout,
+		acks:      -1,
+		retries:   kafkaDefaultRetries,
+		tableKeys: make(map[string][]string),
+	}
+
+	if userinfo != "" {
+		user, password, _ := strings.Cut(userinfo, ":")
+		if stg.user, err = url.PathUnescape(user); err != nil {
+			return nil, DNSNotSupportedError(connectionURL)
+		}
+
+		if stg.password, err = url.PathUnescape(password); err != nil {
+			return nil, DNSNotSupportedError(connectionURL)
+		}
+	}
+
+	for key, values := range query {
+		if err := stg.setParam(key, values[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	if stg.transactionalID != "" && stg.acks != -1 {
+		return nil, fmt.Errorf("%w: %s requires %s=all", ErrDNSNotSupported, kafkaTransactionalIDParam, kafkaAcksParam)
+	}
+
+	if format, ok := kafkaFormats[stg.format]; ok {
+		if stg.serializer, err = newKafkaSerializer(format, stg.registry, stg.compatibility); err != nil {
+			return nil, err
+		}
+	} else if stg.registry != "" || stg.compatibility != nil {
+		return nil, fmt.Errorf("%w: %s and %s require a schema registry %s", ErrDNSNotSupported, kafkaRegistryParam,
+			kafkaCompatibilityParam, kafkaFormatParam)
+	}
+
+	if _, ok := stg.tableKeys[kafkaOffsetsTopic]; !ok {
+		stg.tableKeys[kafkaOffsetsTopic] = []string{kafkaOffsetsKey}
+	}
+
+	if stg.client, err = kgo.NewClient(stg.options()...); err != nil {
+		return nil, fmt.Errorf("unable to create kafka client: %w", err)
+	}
+
+	return stg, nil
+}
+
+// connOptions will return the options of the connections of a client to the brokers. The partition leaders are
+// refreshed as soon as a retry backs off, e.g. after a leader election.
+func (stg *Kafka) connOptions() []kgo.Opt {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(stg.seeds...),
+		kgo.ClientID(stg.clientID),
+		kgo.DialTimeout(stg.timeout),
+		kgo.RequestRetries(stg.retries),
+		kgo.RetryBackoffFn(func(int) time.Duration { return kafkaRetryBackoff }),
+		kgo.MetadataMinAge(kafkaRetryBackoff),
+	}
+
+	if stg.tls != nil {
+		opts = append(opts, kgo.DialTLSConfig(stg.tls))
+	}
+
+	if stg.user != "" {
+		opts = append(opts, kgo.SASL(plain.Auth{User: stg.user, Pass: stg.password}.AsMechanism()))
+	}
+
+	return opts
+}
+
+// options will return the options of the producer for the connection string. Messages with a key are partitioned by
+// the murmur2 hash of the key, and messages without one stick to a partition per batch, like the default partitioner
+// of the Java client.
+func (stg *Kafka) options() []kgo.Opt {
+	opts := append(stg.connOptions(),
+		kgo.ProduceRequestTimeout(stg.timeout),
+		kgo.RecordRetries(stg.retries),
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil)),
+	)
+
+	switch stg.acks {
+	case 0:
+		opts = append(opts, kgo.RequiredAcks(kgo.NoAck()), kgo.DisableIdempotentWrite())
+	case 1:
+		opts = append(opts, kgo.RequiredAcks(kgo.LeaderAck()), kgo.DisableIdempotentWrite())
+	default:
+		opts = append(opts, kgo.RequiredAcks(kgo.AllISRAcks()))
+	}
+
+	if stg.transactionalID != "" {
+		opts = append(opts, kgo.TransactionalID(stg.transactionalID))
+	}
+
+	return opts
+}
+
+// setParam will set the connection string parameter on the storage device.
+func (stg *Kafka) setParam(key, value string) error {
+	switch key {
+	case kafkaAcksParam:
+		switch value {
+		case "0", "1":
+			stg.acks = int16(value[0] - '0')
+		case "all", "-1":
+			stg.acks = -1
+		default:
+			return fmt.Errorf("%w: %s=%q must be 0, 1, or all", ErrDNSNotSupported, key, value)
+		}
+	case kafkaRetriesParam:
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return fmt.Errorf("%w: %s=%q must be a non-negative integer", ErrDNSNotSupported, key, value)
+		}
+
+		stg.retries = retries
+	case kafkaTimeoutParam:
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("%w: %s=%q must be a positive duration", ErrDNSNotSupported, key, value)
+		}
+
+		stg.timeout = timeout
+	case kafkaTLSParam:
+		useTLS, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%w: %s=%q must be a boolean", ErrDNSNotSupported, key, value)
+		}
+
+		if useTLS {
+			stg.tls = compliance.TLSConfig("")
+		}
+	case kafkaClientIDParam:
+		stg.clientID = value
+	case kafkaTransactionalIDParam:
+		stg.transactionalID = value
+	case kafkaFormatParam:
+		if _, ok := kafkaFormats[value]; !ok && value != kafkaFormatJSON {
+			return fmt.Errorf("%w: %s=%q must be json, avro, protobuf, or jsonschema", ErrDNSNotSupported, key, value)
+		}
+
+		stg.format = value
+	case kafkaRegistryParam:
+		stg.registry = value
+	case kafkaCompatibilityParam:
+		var level sr.CompatibilityLevel
+		if err := level.UnmarshalText([]byte(strings.ToUpper(value))); err != nil {
+			return fmt.Errorf("%w: %s=%q is not a compatibility level", ErrDNSNotSupported, key, value)
+		}
+
+		stg.compatibility = &level
+	case kafkaKeyParam:
+		stg.keys = splitKafkaKey(value)
+	default:
+		if table := strings.TrimPrefix(key, kafkaKeyParam+"."); table != key && table != "" {
+			stg.tableKeys[table] = splitKafkaKey(value)
+		}
+	}
+
+	return nil
+}
+
+// splitKafkaKey will return the fields of a comma separated key parameter.
+func splitKafkaKey(value string) []string {
+	var fields []string
+
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// Close will close the connections to the brokers.
+func (stg *Kafka) Close() {
+	stg.client.Close()
+}
+
+// IsNoSQL returns "true" to indicate that "Kafka" is not a SQL database.
+func (stg *Kafka) IsNoSQL() bool { return true }
+
+// Type implements the storage interface.
+func (stg *Kafka) Type() uint8 { return KafkaType }
+
+// keysOf will return the fields of the records of the table that are the key of their messages.
+func (stg *Kafka) keysOf(table string) []string {
+	if keys, ok := stg.tableKeys[table]; ok {
+		return keys
+	}
+
+	return stg.keys
+}
+
+// key will return the key of the message of the record. A single string field is the key as is, and other values, or
+// several fields, are JSON encoded. A record without any of the key fields has a null key.
+func (stg *Kafka) key(table string, record map[string]interface{}) ([]byte, error) {
+	fields := stg.keysOf(table)
+
+	values := make([]interface{}, 0, len(fields))
+	found := false
+
+	for _, field := range fields {
+		value, ok := record[field]
+		found = found || (ok && value != nil)
+
+		values = append(values, value)
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	if str, ok := values[0].(string); ok && len(values) == 1 {
+		return []byte(str), nil
+	}
+
+	var key interface{} = values
+	if len(values) == 1 {
+		key = values[0]
+	}
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+	}
+
+	return data, nil
+}
+
+// values will return the values of the messages of the records of the topic: JSON, or the schema registry format of
+// the connection string. The offsets topic is always JSON, so that it can be read back.
+func (stg *Kafka) values(ctx context.Context, topic string, records []map[string]interface{}) ([][]byte, error) {
+	if stg.serializer != nil && topic != kafkaOffsetsTopic {
+		return stg.serializer.encode(ctx, topic, records)
+	}
+
+	values := make([][]byte, 0, len(records))
+
+	for _, record := range records {
+		value, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// Upsert will publish each record as a message to the topic of the table. Within a transaction, the messages are
+// produced when the transaction commits.
+func (stg *Kafka) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	fields := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		fields = append(fields, record.AsMap())
+	}
+
+	values, err := stg.values(ctx, req.GetTable(), fields)
+	if err != nil {
+		return nil, fmt.Errorf("unable to upsert records: %w", err)
+	}
+
+	messages := make([]*kgo.Record, 0, len(records))
+
+	for i, value := range values {
+		key, err := stg.key(req.GetTable(), fields[i])
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, &kgo.Record{Topic: req.GetTable(), Key: key, Value: value})
+	}
+
+	if len(messages) == 0 {
+		return &proto.UpsertResponse{}, nil
+	}
+
+	if tx := stg.tx(ctx); tx != nil {
+		tx.mtx.Lock()
+		defer tx.mtx.Unlock()
+
+		if _, ok := tx.messages[req.GetTable()]; !ok {
+			tx.topics = append(tx.topics, req.GetTable())
+		}
+
+		tx.messages[req.GetTable()] = append(tx.messages[req.GetTable()], messages...)
+
+		return &proto.UpsertResponse{UpsertedCount: int64(len(messages))}, nil
+	}
+
+	topics := []string{req.GetTable()}
+	if err := stg.produce(ctx, topics, map[string][]*kgo.Record{req.GetTable(): messages}); err != nil {
+		return nil, fmt.Errorf("unable to upsert records: %w", err)
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(messages))}, nil
+}
+
+// produce will produce the messages of the topics, topic by topic, and wait for them to be acknowledged. Messages
+// that fail with a retriable error are sent again by the client, up to the retries of the connection string. A
+// transactional producer produces them in a single Kafka transaction, which is aborted if any of them fails.
+func (stg *Kafka) produce(ctx context.Context, topics []string, messages map[string][]*kgo.Record) error {
+	if stg.transactionalID == "" {
+		for _, topic := range topics {
+			if err := stg.client.ProduceSync(ctx, messages[topic]...).FirstErr(); err != nil {
+				return KafkaError("produce to "+topic, err)
+			}
+		}
+
+		return nil
+	}
+
+	stg.txMtx.Lock()
+	defer stg.txMtx.Unlock()
+
+	if err := stg.client.BeginTransaction(); err != nil {
+		return KafkaError("begin transaction", err)
+	}
+
+	var err error
+
+	for _, topic := range topics {
+		if err = stg.client.ProduceSync(ctx, messages[topic]...).FirstErr(); err != nil {
+			err = KafkaError("produce to "+topic, err)
+
+			break
+		}
+	}
+
+	commit := kgo.TryCommit
+
+	if err != nil {
+		commit = kgo.TryAbort
+
+		_ = stg.client.AbortBufferedRecords(ctx)
+	}
+
+	if endErr := stg.client.EndTransaction(ctx, commit); endErr != nil && err == nil {
+		err = KafkaError("end transaction", endErr)
+	}
+
+	return err
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *Kafka) tx(ctx context.Context) *kafkaTx {
+	txID, ok := ctx.Value(basicKafkaTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	kTx, _ := tx.(*kafkaTx)
+
+	return kTx
+}
+
+// Read will read the topic of the table as a table of the latest message of each key, e.g. the offsets and
+// watermarks of a compacted topic, returning the records that match the required fields. The topic is consumed from
+// the start of each partition to its last stable offset, with read committed isolation, so that the messages of open
+// and aborted transactions are not read. Messages without a key, and keys whose latest message is a tombstone, are
+// not read. Topics without key fields, and topics in a schema registry format, can not be read.
+func (stg *Kafka) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	if len(stg.keysOf(req.GetTable())) == 0 {
+		return nil, KafkaUnsupportedError("read without key fields")
+	}
+
+	if stg.serializer != nil && req.GetTable() != kafkaOffsetsTopic {
+		return nil, KafkaUnsupportedError("read in a schema registry format")
+	}
+
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets, ends, err := stg.offsets(ctx, req.GetTable())
+	if err != nil {
+		return nil, fmt.Errorf("unable to read records: %w", err)
+	}
+
+	latest := make(map[string][]byte)
+
+	if len(ends) > 0 {
+		consumer, err := kgo.NewClient(append(stg.connOptions(),
+			kgo.ConsumePartitions(map[string]map[int32]kgo.Offset{req.GetTable(): offsets}),
+			kgo.FetchIsolationLevel(kgo.ReadCommitted()),
+			kgo.KeepControlRecords())...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create kafka consumer: %w", err)
+		}
+
+		defer consumer.Close()
+
+		if err := kafkaConsume(ctx, consumer, ends, latest); err != nil {
+			return nil, fmt.Errorf("unable to read records: %w", KafkaError("fetch "+req.GetTable(), err))
+		}
+	}
+
+	required := req.GetRequired().GetFields()
+	records := make([]map[string]interface{}, 0, len(latest))
+
+	for _, value := range latest {
+		var record map[string]interface{}
+		if err := json.Unmarshal(value, &record); err != nil {
+			return nil, fmt.Errorf("unable to decode record of %s: %w", req.GetTable(), err)
+		}
+
+		if parquetMatches(record, nil, required) {
+			records = append(records, record)
+		}
+	}
+
+	return redisPage(records, page)
+}
+
+// offsets will return the start offsets of the partitions of the topic that are not empty, and their last stable
+// offsets. A topic that does not exist has no partitions.
+func (stg *Kafka) offsets(ctx context.Context, topic string) (map[int32]kgo.Offset, map[int32]int64, error) {
+	admin := kadm.NewClient(stg.client)
+
+	starts, err := admin.ListStartOffsets(ctx, topic)
+	if err != nil {
+		return nil, nil, KafkaError("list offsets of "+topic, err)
+	}
+
+	stable, err := admin.ListCommittedOffsets(ctx, topic)
+	if err != nil {
+		return nil, nil, KafkaError("list offsets of "+topic, err)
+	}
+
+	offsets := make(map[int32]kgo.Offset)
+	ends := make(map[int32]int64)
+
+	for partition, end := range stable[topic] {
+		start, ok := starts.Lookup(topic, partition)
+
+		switch {
+		case errors.Is(end.Err, kerr.UnknownTopicOrPartition):
+			continue
+		case end.Err != nil:
+			return nil, nil, KafkaError("list offsets of "+topic, end.Err)
+		case !ok || start.Err != nil:
+			return nil, nil, KafkaError("list offsets of "+topic, start.Err)
+		}
+
+		if end.Offset > start.Offset {
+			offsets[partition] = kgo.NewOffset().At(start.Offset)
+			ends[partition] = end.Offset
+		}
+	}
+
+	return offsets, ends, nil
+}
+
+// kafkaConsume will poll the consumer until it has fetched the partitions up to their end offsets, keeping the value
+// of the latest message of each key. The commit and abort markers of transactions are fetched, but not kept, so that
+// a partition that ends with a marker is fetched to its end.
+func kafkaConsume(ctx context.Context, consumer *kgo.Client, ends map[int32]int64, latest map[string][]byte) error {
+	for len(ends) > 0 {
+		fetches := consumer.PollFetches(ctx)
+		if err := fetches.Err0(); err != nil {
+			return err
+		}
+
+		var err error
+
+		fetches.EachError(func(_ string, _ int32, fetchErr error) { err = fetchErr })
+
+		if err != nil {
+			return err
+		}
+
+		fetches.EachRecord(func(record *kgo.Record) {
+			end, ok := ends[record.Partition]
+			if !ok || record.Offset >= end {
+				return
+			}
+
+			if record.Offset+1 >= end {
+				delete(ends, record.Partition)
+			}
+
+			switch {
+			case record.Attrs.IsControl() || record.Key == nil:
+			case record.Value == nil:
+				delete(latest, string(record.Key))
+			default:
+				latest[string(record.Key)] = record.Value
+			}
+		})
+	}
+
+	return nil
+}
+
+// Count is not supported, since counting the keys of a topic would read the whole topic.
+func (stg *Kafka) Count(_ context.Context, _ *proto.CountRequest) (*proto.CountResponse, error) {
+	return nil, KafkaUnsupportedError("counted")
+}
+
+// Truncate is not supported, since the messages of a topic can only be deleted up to an offset.
+func (stg *Kafka) Truncate(_ context.Context, _ *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	return nil, KafkaUnsupportedError("truncated")
+}
+
+// ListTables will return the topics of the cluster that are not internal. Table sizes are reported as zero.
+func (stg *Kafka) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	// A metadata request without topics is answered with every topic of the cluster.
+	metadata, err := kmsg.NewPtrMetadataRequest().RequestWith(ctx, stg.client)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tables: %w", KafkaError("metadata", err))
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+
+	for _, topic := range metadata.Topics {
+		if err := kerr.ErrorForCode(topic.ErrorCode); err != nil {
+			return nil, fmt.Errorf("unable to list tables: %w", KafkaError("metadata", err))
+		}
+
+		if topic.Topic != nil && !topic.IsInternal {
+			rsp.TableSet[*topic.Topic] = &proto.Table{}
+		}
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will return the key fields of each topic.
+func (stg *Kafka) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	tables, err := stg.ListTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+	for table := range tables.GetTableSet() {
+		rsp.PKSet[table] = &proto.PrimaryKeys{List: append([]string(nil), stg.keysOf(table)...)}
+	}
+
+	return rsp, nil
+}
+
+// StartTx will start a transaction. The messages of the functions sent to the transaction are buffered, and produced
+// when the transaction commits, topic by topic in the order they were first written. A transactional producer
+// produces them in a single Kafka transaction; otherwise they are not produced atomically, so a commit that fails may
+// have produced some of them.
+func (stg *Kafka) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+	tx := &kafkaTx{messages: make(map[string][]*kgo.Record)}
+
+	stg.activeTx.Store(txnID, tx)
+
+	kafkaCtx := context.WithValue(ctx, basicKafkaTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+
+		var err error
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(kafkaCtx, stg)
+		}
+
+		if err != nil {
+			<-txn.commit
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit && len(tx.topics) > 0 {
+			if err = stg.produce(ctx, tx.topics, tx.messages); err != nil {
+				err = fmt.Errorf("unable to commit transaction: %w", err)
+			}
+		}
+
+		txn.done <- err
+	}()
+
+	return txn, nil
+}
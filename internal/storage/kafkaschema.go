@@ -0,0 +1,720 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/hamba/avro/v2"
+	"github.com/twmb/franz-go/pkg/sr"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// kafkaFormatParam is the connection string parameter for the serialization of the messages: "json" (the
+	// default) for plain JSON, or "avro", "protobuf", or "jsonschema" for the schema registry wire format, with the
+	// schema of each topic registered with the schema registry.
+	kafkaFormatParam = "format"
+
+	// kafkaRegistryParam is the connection string parameter for the URL of the schema registry, e.g.
+	// "registry=https%3A%2F%2Fuser%3Apassword%40registry1%3A8081", which is required by the schema registry formats.
+	// The user and password of the URL authenticate with basic authentication.
+	kafkaRegistryParam = "registry"
+
+	// kafkaCompatibilityParam is the connection string parameter for the compatibility level that is set on the
+	// subject of each topic before its schema is registered, e.g. "compatibility=BACKWARD". By default, the level of
+	// the subject, or of the registry, is left as it is.
+	kafkaCompatibilityParam = "compatibility"
+
+	kafkaFormatJSON = "json"
+)
+
+// kafkaFormats are the schema types of the schema registry formats.
+var kafkaFormats = map[string]sr.SchemaType{
+	"avro":       sr.TypeAvro,
+	"protobuf":   sr.TypeProtobuf,
+	"jsonschema": sr.TypeJSON,
+}
+
+// kafkaSchemaName matches the names of Avro and Protobuf fields.
+var kafkaSchemaName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// kafkaProtobufField matches the scalar fields of a Protobuf message.
+var kafkaProtobufField = regexp.MustCompile(`(?m)^\s*(?:optional\s+)?(\w+)\s+(\w+)\s*=\s*(\d+)\s*;`)
+
+var ErrKafkaSchema = fmt.Errorf("kafka schema error")
+
+// KafkaSchemaError is returned when the schema of a topic can not be registered, or a record does not match it.
+func KafkaSchemaError(topic string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrKafkaSchema, topic, err)
+}
+
+// kafkaFieldType is the type of a field of the schema of a topic.
+type kafkaFieldType uint8
+
+const (
+	kafkaStringField kafkaFieldType = iota
+	kafkaDoubleField
+	kafkaBooleanField
+
+	// kafkaAnyField is a property of objects and lists in JSON Schema, which has no type. Objects and lists are
+	// strings of their JSON in Avro and Protobuf.
+	kafkaAnyField
+)
+
+// kafkaSchemaField is a field of the schema of a topic, with the number of its Protobuf field.
+type kafkaSchemaField struct {
+	name   string
+	typ    kafkaFieldType
+	number int
+}
+
+// kafkaSchema is the schema of the messages of a topic that is registered with the schema registry.
+type kafkaSchema struct {
+	// id is the ID of the registered schema, or zero if the fields have changed since it was registered.
+	id int
+
+	// registered is true if the subject of the topic has a schema, which a new schema must be compatible with.
+	registered bool
+
+	fields []kafkaSchemaField
+	byName map[string]kafkaSchemaField
+
+	avro  avro.Schema
+	proto protoreflect.MessageDescriptor
+}
+
+// kafkaSerializer serializes the records of each topic in a schema registry format. The schema of a topic is the
+// latest schema of its subject, extended with the fields of the records that it does not have, with the types of
+// their first values. A schema with new fields is checked for compatibility with the latest schema of the subject
+// before it is registered, so that consumers can read the messages written with it.
+type kafkaSerializer struct {
+	format   sr.SchemaType
+	registry *sr.Client
+
+	// compatibility is the compatibility level to set on the subjects, if any.
+	compatibility *sr.CompatibilityLevel
+
+	mtx     sync.Mutex
+	schemas map[string]*kafkaSchema
+}
+
+// newKafkaSerializer will return a serializer of the format that registers schemas with the schema registry at the
+// URL.
+func newKafkaSerializer(format sr.SchemaType, registryURL string,
+	compatibility *sr.CompatibilityLevel,
+) (*kafkaSerializer, error) {
+	uri, err := url.Parse(registryURL)
+	if err != nil || uri.Host == "" {
+		return nil, fmt.Errorf("%w: %s=%q must be a URL", ErrDNSNotSupported, kafkaRegistryParam, registryURL)
+	}
+
+	opts := []sr.ClientOpt{sr.HTTPClient(compliance.HTTPClient())}
+
+	if user := uri.User; user != nil {
+		password, _ := user.Password()
+		opts = append(opts, sr.BasicAuth(user.Username(), password))
+		uri.User = nil
+	}
+
+	registry, err := sr.NewClient(append(opts, sr.URLs(uri.String()))...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create schema registry client: %w", err)
+	}
+
+	return &kafkaSerializer{
+		format:        format,
+		registry:      registry,
+		compatibility: compatibility,
+		schemas:       make(map[string]*kafkaSchema),
+	}, nil
+}
+
+// kafkaSubject will return the subject of the values of the topic, by the topic name strategy.
+func kafkaSubject(topic string) string {
+	return topic + "-value"
+}
+
+// kafkaSchemaType will return the type of the field for a value, or false for null values, which do not set the
+// type of a field.
+func kafkaSchemaType(value interface{}) (kafkaFieldType, bool) {
+	switch value.(type) {
+	case nil:
+		return 0, false
+	case string:
+		return kafkaStringField, true
+	case float64:
+		return kafkaDoubleField, true
+	case bool:
+		return kafkaBooleanField, true
+	default:
+		return kafkaAnyField, true
+	}
+}
+
+// encode will return the values of the messages of the records of the topic, with the ID of the schema of the topic
+// in the header of each value.
+func (ser *kafkaSerializer) encode(ctx context.Context, topic string,
+	records []map[string]interface{},
+) ([][]byte, error) {
+	ser.mtx.Lock()
+	defer ser.mtx.Unlock()
+
+	schema, err := ser.schema(ctx, topic, records)
+	if err != nil {
+		return nil, KafkaSchemaError(topic, err)
+	}
+
+	var index []int
+	if ser.format == sr.TypeProtobuf {
+		index = []int{0}
+	}
+
+	values := make([][]byte, 0, len(records))
+
+	for _, record := range records {
+		value, err := new(sr.ConfluentHeader).AppendEncode(nil, schema.id, index)
+		if err != nil {
+			return nil, KafkaSchemaError(topic, err)
+		}
+
+		if value, err = ser.appendRecord(value, schema, record); err != nil {
+			return nil, KafkaSchemaError(topic, err)
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// schema will return the registered schema of the topic with the fields of the records, registering a schema with
+// the fields that the schema does not have.
+func (ser *kafkaSerializer) schema(ctx context.Context, topic string,
+	records []map[string]interface{},
+) (*kafkaSchema, error) {
+	schema, ok := ser.schemas[topic]
+	if !ok {
+		var err error
+		if schema, err = ser.latest(ctx, topic); err != nil {
+			return nil, err
+		}
+
+		ser.schemas[topic] = schema
+	}
+
+	var added []kafkaSchemaField
+
+	next := 1
+	for _, field := range schema.fields {
+		if field.number >= next {
+			next = field.number + 1
+		}
+	}
+
+	for _, record := range records {
+		for name, value := range record {
+			if _, ok := schema.byName[name]; ok {
+				continue
+			}
+
+			typ, ok := kafkaSchemaType(value)
+			if !ok {
+				continue
+			}
+
+			if ser.format != sr.TypeJSON {
+				if !kafkaSchemaName.MatchString(name) {
+					return nil, fmt.Errorf("field %q is not a valid %s name", name, ser.format)
+				}
+
+				if typ == kafkaAnyField {
+					typ = kafkaStringField
+				}
+			}
+
+			field := kafkaSchemaField{name: name, typ: typ}
+			schema.byName[name] = field
+			added = append(added, field)
+		}
+	}
+
+	// New fields are numbered in the order of their names, after the fields of the schema.
+	sort.Slice(added, func(i, j int) bool { return added[i].name < added[j].name })
+
+	for _, field := range added {
+		field.number = next
+		next++
+
+		schema.byName[field.name] = field
+		schema.fields = append(schema.fields, field)
+		schema.id = 0
+	}
+
+	if schema.id == 0 {
+		if err := ser.register(ctx, topic, schema); err != nil {
+			delete(ser.schemas, topic)
+
+			return nil, err
+		}
+	}
+
+	return schema, nil
+}
+
+// latest will return the latest schema of the subject of the topic, compiled for encoding, or an empty schema if the
+// subject has none. The compatibility level of the connection string is set on the subject first.
+func (ser *kafkaSerializer) latest(ctx context.Context, topic string) (*kafkaSchema, error) {
+	subject := kafkaSubject(topic)
+
+	if ser.compatibility != nil {
+		for _, result := range ser.registry.SetCompatibility(ctx, sr.SetCompatibility{Level: *ser.compatibility},
+			subject) {
+			if result.Err != nil {
+				return nil, fmt.Errorf("unable to set the compatibility of %s: %w", subject, result.Err)
+			}
+		}
+	}
+
+	schema := &kafkaSchema{byName: make(map[string]kafkaSchemaField)}
+
+	latest, err := ser.registry.SchemaByVersion(ctx, subject, -1)
+
+	var rspErr *sr.ResponseError
+	if errors.As(err, &rspErr) && rspErr.StatusCode == http.StatusNotFound {
+		return schema, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the latest schema of %s: %w", subject, err)
+	}
+
+	if latest.Type != ser.format {
+		return nil, fmt.Errorf("the latest schema of %s is %s, not %s", subject, latest.Type, ser.format)
+	}
+
+	fields, err := ser.parse(latest.Schema.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the latest schema of %s: %w", subject, err)
+	}
+
+	schema.registered = true
+	schema.fields = fields
+
+	for _, field := range fields {
+		schema.byName[field.name] = field
+	}
+
+	if err := ser.compile(topic, schema, latest.Schema.Schema); err != nil {
+		return nil, err
+	}
+
+	schema.id = latest.ID
+
+	return schema, nil
+}
+
+// compile will compile the text of the schema of the topic for encoding.
+func (ser *kafkaSerializer) compile(topic string, schema *kafkaSchema, text string) error {
+	var err error
+
+	switch ser.format {
+	case sr.TypeAvro:
+		if schema.avro, err = avro.ParseWithCache(text, "", &avro.SchemaCache{}); err != nil {
+			return fmt.Errorf("unable to parse avro schema: %w", err)
+		}
+	case sr.TypeProtobuf:
+		if schema.proto, err = kafkaProtobufDescriptor(topic, schema.fields); err != nil {
+			return err
+		}
+	case sr.TypeJSON:
+	}
+
+	return nil
+}
+
+// register will check that the schema is compatible with the latest schema of the subject of the topic, register
+// it, and compile it.
+func (ser *kafkaSerializer) register(ctx context.Context, topic string, schema *kafkaSchema) error {
+	subject := kafkaSubject(topic)
+
+	text, err := ser.render(topic, schema.fields)
+	if err != nil {
+		return err
+	}
+
+	registry := sr.Schema{Schema: text, Type: ser.format}
+
+	if schema.registered {
+		result, err := ser.registry.CheckCompatibility(ctx, subject, -1, registry)
+		if err != nil {
+			return fmt.Errorf("unable to check the compatibility of the schema of %s: %w", subject, err)
+		}
+
+		if !result.Is {
+			return fmt.Errorf("the schema is not compatible with the latest schema of %s: %s", subject,
+				strings.Join(result.Messages, "; "))
+		}
+	}
+
+	if err := ser.compile(topic, schema, text); err != nil {
+		return err
+	}
+
+	id, err := ser.registry.RegisterSchema(ctx, subject, registry, -1, -1)
+	if err != nil {
+		return fmt.Errorf("unable to register the schema of %s: %w", subject, err)
+	}
+
+	schema.id = id
+	schema.registered = true
+
+	return nil
+}
+
+// kafkaSchemaRecordName will return the name of the record or message of the schema of the topic, which is the topic
+// with the characters that are not valid in a name replaced by underscores.
+func kafkaSchemaRecordName(topic string) string {
+	name := []byte(topic)
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+
+	return string(name)
+}
+
+// render will return the text of the schema of the topic with the fields. Every field is optional, so that records
+// without some of the fields match the schema, and a schema with new fields can read the messages of the schemas
+// before it.
+func (ser *kafkaSerializer) render(topic string, fields []kafkaSchemaField) (string, error) {
+	name := kafkaSchemaRecordName(topic)
+
+	switch ser.format {
+	case sr.TypeProtobuf:
+		var text strings.Builder
+
+		fmt.Fprintf(&text, "syntax = \"proto3\";\n\npackage gidari;\n\nmessage %s {\n", name)
+
+		for _, field := range fields {
+			fmt.Fprintf(&text, "  optional %s %s = %d;\n", kafkaProtobufTypes[field.typ], field.name, field.number)
+		}
+
+		text.WriteString("}\n")
+
+		return text.String(), nil
+	case sr.TypeJSON:
+		properties := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			properties[field.name] = map[string]interface{}{}
+			if typ, ok := kafkaJSONSchemaTypes[field.typ]; ok {
+				properties[field.name] = map[string]interface{}{"type": []string{typ, "null"}}
+			}
+		}
+
+		return kafkaSchemaText(map[string]interface{}{
+			"$schema":              "http://json-schema.org/draft-07/schema#",
+			"title":                topic,
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		})
+	default:
+		avroFields := make([]interface{}, 0, len(fields))
+		for _, field := range fields {
+			avroFields = append(avroFields, map[string]interface{}{
+				"name":    field.name,
+				"type":    []string{"null", kafkaAvroTypes[field.typ]},
+				"default": nil,
+			})
+		}
+
+		return kafkaSchemaText(map[string]interface{}{
+			"type":      "record",
+			"name":      name,
+			"namespace": "gidari",
+			"fields":    avroFields,
+		})
+	}
+}
+
+// kafkaSchemaText will return the JSON text of a schema.
+func kafkaSchemaText(schema map[string]interface{}) (string, error) {
+	text, err := json.Marshal(schema)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+	}
+
+	return string(text), nil
+}
+
+var (
+	kafkaAvroTypes = map[kafkaFieldType]string{
+		kafkaStringField:  "string",
+		kafkaDoubleField:  "double",
+		kafkaBooleanField: "boolean",
+	}
+
+	kafkaProtobufTypes = map[kafkaFieldType]string{
+		kafkaStringField:  "string",
+		kafkaDoubleField:  "double",
+		kafkaBooleanField: "bool",
+	}
+
+	kafkaJSONSchemaTypes = map[kafkaFieldType]string{
+		kafkaStringField:  "string",
+		kafkaDoubleField:  "number",
+		kafkaBooleanField: "boolean",
+	}
+)
+
+// kafkaFieldTypeOf will return the type of a field with the type name of a schema, where every number is a double.
+func kafkaFieldTypeOf(name string) (kafkaFieldType, bool) {
+	switch name {
+	case "string":
+		return kafkaStringField, true
+	case "double", "float", "int", "long", "number", "integer":
+		return kafkaDoubleField, true
+	case "boolean", "bool":
+		return kafkaBooleanField, true
+	default:
+		return 0, false
+	}
+}
+
+// parse will return the fields of the text of a registered schema. The types of the fields must be strings, numbers,
+// or booleans, except for the untyped properties of JSON Schema.
+func (ser *kafkaSerializer) parse(text string) ([]kafkaSchemaField, error) {
+	var fields []kafkaSchemaField
+
+	switch ser.format {
+	case sr.TypeProtobuf:
+		for _, match := range kafkaProtobufField.FindAllStringSubmatch(text, -1) {
+			if match[1] == "syntax" || match[1] == "package" {
+				continue
+			}
+
+			typ, ok := kafkaFieldTypeOf(match[1])
+			if !ok || match[1] != kafkaProtobufTypes[typ] {
+				return nil, fmt.Errorf("field %q has unsupported type %q", match[2], match[1])
+			}
+
+			number, _ := strconv.Atoi(match[3])
+			fields = append(fields, kafkaSchemaField{name: match[2], typ: typ, number: number})
+		}
+	case sr.TypeJSON:
+		var schema struct {
+			Properties map[string]struct {
+				Type interface{} `json:"type"`
+			} `json:"properties"`
+		}
+
+		if err := json.Unmarshal([]byte(text), &schema); err != nil {
+			return nil, fmt.Errorf("unable to decode json schema: %w", err)
+		}
+
+		for name, property := range schema.Properties {
+			field := kafkaSchemaField{name: name, typ: kafkaAnyField}
+			if name, ok := kafkaSchemaTypeName(property.Type); ok {
+				if field.typ, ok = kafkaFieldTypeOf(name); !ok {
+					return nil, fmt.Errorf("property %q has unsupported type %q", field.name, name)
+				}
+			}
+
+			fields = append(fields, field)
+		}
+
+		sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+	default:
+		var schema struct {
+			Fields []struct {
+				Name string      `json:"name"`
+				Type interface{} `json:"type"`
+			} `json:"fields"`
+		}
+
+		if err := json.Unmarshal([]byte(text), &schema); err != nil {
+			return nil, fmt.Errorf("unable to decode avro schema: %w", err)
+		}
+
+		for i, field := range schema.Fields {
+			name, _ := kafkaSchemaTypeName(field.Type)
+
+			typ, ok := kafkaFieldTypeOf(name)
+			if !ok {
+				return nil, fmt.Errorf("field %q has unsupported type %v", field.Name, field.Type)
+			}
+
+			fields = append(fields, kafkaSchemaField{name: field.Name, typ: typ, number: i + 1})
+		}
+	}
+
+	return fields, nil
+}
+
+// kafkaSchemaTypeName will return the name of the type of a field of a schema that is a name, or a list of a name
+// and "null".
+func kafkaSchemaTypeName(typ interface{}) (string, bool) {
+	switch typ := typ.(type) {
+	case string:
+		return typ, true
+	case []interface{}:
+		var name string
+
+		for _, member := range typ {
+			if member, ok := member.(string); ok && member != "null" {
+				if name != "" {
+					return "", false
+				}
+
+				name = member
+			}
+		}
+
+		return name, name != ""
+	default:
+		return "", false
+	}
+}
+
+// kafkaProtobufDescriptor will return the descriptor of the Protobuf message of the topic with the fields.
+func kafkaProtobufDescriptor(topic string, fields []kafkaSchemaField) (protoreflect.MessageDescriptor, error) {
+	message := &descriptorpb.DescriptorProto{Name: protobuf.String(kafkaSchemaRecordName(topic))}
+
+	types := map[kafkaFieldType]descriptorpb.FieldDescriptorProto_Type{
+		kafkaStringField:  descriptorpb.FieldDescriptorProto_TYPE_STRING,
+		kafkaDoubleField:  descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+		kafkaBooleanField: descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	}
+
+	for i, field := range fields {
+		// Optional fields of proto3 are in a synthetic oneof of their own.
+		message.OneofDecl = append(message.OneofDecl, &descriptorpb.OneofDescriptorProto{
+			Name: protobuf.String("_" + field.name),
+		})
+
+		message.Field = append(message.Field, &descriptorpb.FieldDescriptorProto{
+			Name:           protobuf.String(field.name),
+			Number:         protobuf.Int32(int32(field.number)),
+			Label:          descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:           types[field.typ].Enum(),
+			OneofIndex:     protobuf.Int32(int32(i)),
+			Proto3Optional: protobuf.Bool(true),
+		})
+	}
+
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:        protobuf.String(topic + ".proto"),
+		Package:     protobuf.String("gidari"),
+		Syntax:      protobuf.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{message},
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build protobuf descriptor: %w", err)
+	}
+
+	return file.Messages().Get(0), nil
+}
+
+// kafkaSchemaValue will return the value of a field of the schema for a record. Values in the string fields of Avro
+// and Protobuf that are not strings are strings of their JSON.
+func kafkaSchemaValue(field kafkaSchemaField, value interface{}, jsonSchema bool) (interface{}, error) {
+	typ, ok := kafkaSchemaType(value)
+
+	switch {
+	case !ok || typ == field.typ || field.typ == kafkaAnyField:
+		return value, nil
+	case field.typ == kafkaStringField && !jsonSchema:
+		text, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+		}
+
+		return string(text), nil
+	}
+
+	return nil, fmt.Errorf("field %q does not match the type of the schema: %v", field.name, value)
+}
+
+// appendRecord will append the record, serialized with the schema, to the value.
+func (ser *kafkaSerializer) appendRecord(value []byte, schema *kafkaSchema,
+	record map[string]interface{},
+) ([]byte, error) {
+	fields := make(map[string]interface{}, len(record))
+
+	for name, raw := range record {
+		field, ok := schema.byName[name]
+		if !ok {
+			// Fields that are only null have no type, and are left out.
+			continue
+		}
+
+		converted, err := kafkaSchemaValue(field, raw, ser.format == sr.TypeJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		fields[name] = converted
+	}
+
+	switch ser.format {
+	case sr.TypeProtobuf:
+		msg := dynamicpb.NewMessage(schema.proto)
+
+		for name, raw := range fields {
+			fd := schema.proto.Fields().ByName(protoreflect.Name(name))
+			if raw != nil {
+				msg.Set(fd, protoreflect.ValueOf(raw))
+			}
+		}
+
+		data, err := protobuf.MarshalOptions{Deterministic: true}.Marshal(msg)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode protobuf message: %w", err)
+		}
+
+		return append(value, data...), nil
+	case sr.TypeJSON:
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+		}
+
+		return append(value, data...), nil
+	default:
+		for _, field := range schema.fields {
+			if _, ok := fields[field.name]; !ok {
+				fields[field.name] = nil
+			}
+		}
+
+		data, err := avro.Marshal(schema.avro, fields)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode avro record: %w", err)
+		}
+
+		return append(value, data...), nil
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	gcpkms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+const (
+	// kmsRegionParam is the key location parameter for the AWS region of a KMS key given by alias or ID. The region
+	// of a key given by ARN is the region of the ARN, and the default is the "AWS_REGION" environment variable.
+	kmsRegionParam = "region"
+
+	// kmsEndpointParam is the key location parameter for the endpoint of the key management service, e.g.
+	// "http://localhost:4566" for LocalStack.
+	kmsEndpointParam = "endpoint"
+
+	// kmsCredentialsParam is the key location parameter for the path of the GCP credentials file. The default is
+	// Application Default Credentials.
+	kmsCredentialsParam = "credentials"
+)
+
+var (
+	ErrUnsupportedKMS = fmt.Errorf("unsupported key management service")
+	ErrKMS            = fmt.Errorf("key management service request failed")
+)
+
+// UnsupportedKMSError is returned when the scheme of a key location is not supported.
+func UnsupportedKMSError(location string) error {
+	return fmt.Errorf("%w: %q, expected an \"awskms\" or \"gcpkms\" URL", ErrUnsupportedKMS, location)
+}
+
+// KMSError is returned when the key management service fails to encrypt with the key.
+func KMSError(key string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrKMS, key, err)
+}
+
+// KeyEncrypter encrypts the data keys of envelope encryption with a key encryption key that never leaves a key
+// management service.
+type KeyEncrypter interface {
+	// EncryptKey will return the data key encrypted with the key encryption key, and the ID of the version of the key
+	// encryption key that encrypted it, to decrypt it with.
+	EncryptKey(ctx context.Context, dataKey []byte) (wrapped []byte, keyID string, err error)
+}
+
+// NewKeyEncrypter will return the key encrypter for the location, either an AWS KMS key by ARN, alias, or ID (e.g.
+// "awskms://arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab" or
+// "awskms://alias/gidari?region=us-east-1") or a GCP Cloud KMS key by resource name (e.g.
+// "gcpkms://projects/p/locations/global/keyRings/r/cryptoKeys/k"). AWS requests are made with the AWS KMS client,
+// signed with the credentials of the default AWS configuration, and GCP requests are made with the Cloud KMS client,
+// authorized with the "credentials" file or Application Default Credentials.
+func NewKeyEncrypter(location string) (KeyEncrypter, error) {
+	scheme, rest, _ := strings.Cut(location, "://")
+
+	// Key ARNs contain colons, so the key is not parsed as the host and path of a URL.
+	key, rawQuery, _ := strings.Cut(rest, "?")
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse key location: %w", err)
+	}
+
+	if key == "" {
+		return nil, UnsupportedKMSError(location)
+	}
+
+	switch scheme {
+	case "awskms":
+		return newAWSKeyEncrypter(key, query)
+	case "gcpkms":
+		return newGCPKeyEncrypter(key, query)
+	}
+
+	return nil, UnsupportedKMSError(location)
+}
+
+// awsKeyEncrypter encrypts data keys with an AWS KMS key.
+type awsKeyEncrypter struct {
+	key    string
+	client *kms.Client
+}
+
+// newAWSKeyEncrypter will return the key encrypter for the AWS KMS key, with the credentials and region of the
+// default AWS configuration, see "awsCredentialChain".
+func newAWSKeyEncrypter(key string, query url.Values) (*awsKeyEncrypter, error) {
+	cfg, err := loadAWSConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return newAWSKeyEncrypterFromConfig(key, query, cfg)
+}
+
+// newAWSKeyEncrypterFromConfig will return the key encrypter for the AWS KMS key, with the AWS configuration.
+func newAWSKeyEncrypterFromConfig(key string, query url.Values, cfg aws.Config) (*awsKeyEncrypter, error) {
+	if region := query.Get(kmsRegionParam); region != "" {
+		cfg.Region = region
+	} else if parts := strings.Split(key, ":"); len(parts) > 3 && parts[0] == "arn" {
+		// The region of an ARN, i.e. "arn:partition:kms:region:account:key/id".
+		cfg.Region = parts[3]
+	}
+
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("%w: set the %q parameter or AWS_REGION", ErrMissingAWSRegion, kmsRegionParam)
+	}
+
+	endpoint := query.Get(kmsEndpointParam)
+
+	client := kms.NewFromConfig(cfg, func(opts *kms.Options) {
+		if endpoint != "" {
+			opts.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+
+	return &awsKeyEncrypter{key: key, client: client}, nil
+}
+
+// EncryptKey will encrypt the data key with the Encrypt action of AWS KMS.
+func (kek *awsKeyEncrypter) EncryptKey(ctx context.Context, dataKey []byte) ([]byte, string, error) {
+	out, err := kek.client.Encrypt(ctx, &kms.EncryptInput{KeyId: aws.String(kek.key), Plaintext: dataKey})
+	if err != nil {
+		return nil, "", KMSError(kek.key, err)
+	}
+
+	return out.CiphertextBlob, aws.ToString(out.KeyId), nil
+}
+
+// gcpKeyEncrypter encrypts data keys with a GCP Cloud KMS key. The client is created on the first request, so that
+// the credentials are only looked up when they are used.
+type gcpKeyEncrypter struct {
+	key         string
+	endpoint    string
+	credentials string
+
+	// tokens authorizes the requests. If nil, the credentials file or Application Default Credentials are used.
+	tokens oauth2.TokenSource
+
+	once   sync.Once
+	client *gcpkms.KeyManagementClient
+	err    error
+}
+
+func newGCPKeyEncrypter(key string, query url.Values) (*gcpKeyEncrypter, error) {
+	return &gcpKeyEncrypter{
+		key:         strings.Trim(key, "/"),
+		endpoint:    query.Get(kmsEndpointParam),
+		credentials: query.Get(kmsCredentialsParam),
+	}, nil
+}
+
+// load will create the REST client of Cloud KMS once, with the compliance transport.
+func (kek *gcpKeyEncrypter) load(ctx context.Context) (*gcpkms.KeyManagementClient, error) {
+	kek.once.Do(func() {
+		tokens := kek.tokens
+		if tokens == nil {
+			if tokens, kek.err = gcpTokenSource(ctx, kek.credentials, gcpkms.DefaultAuthScopes()...); kek.err != nil {
+				return
+			}
+		}
+
+		opts := []option.ClientOption{option.WithHTTPClient(&http.Client{
+			Transport: &oauth2.Transport{Source: tokens, Base: compliance.Transport()},
+		})}
+
+		if kek.endpoint != "" {
+			opts = append(opts, option.WithEndpoint(kek.endpoint))
+		}
+
+		// The client keeps its context for its requests, which outlive the context of the first request.
+		if kek.client, kek.err = gcpkms.NewKeyManagementRESTClient(context.WithoutCancel(ctx), opts...); kek.err != nil {
+			kek.err = fmt.Errorf("unable to create client: %w", kek.err)
+		}
+	})
+
+	return kek.client, kek.err
+}
+
+// EncryptKey will encrypt the data key with the primary version of the Cloud KMS key.
+func (kek *gcpKeyEncrypter) EncryptKey(ctx context.Context, dataKey []byte) ([]byte, string, error) {
+	client, err := kek.load(ctx)
+	if err != nil {
+		return nil, "", KMSError(kek.key, err)
+	}
+
+	rsp, err := client.Encrypt(ctx, &kmspb.EncryptRequest{Name: kek.key, Plaintext: dataKey})
+	if err != nil {
+		return nil, "", KMSError(kek.key, err)
+	}
+
+	return rsp.GetCiphertext(), rsp.GetName(), nil
+}
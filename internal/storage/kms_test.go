@@ -0,0 +1,129 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"golang.org/x/oauth2"
+)
+
+func TestKMS(t *testing.T) {
+	t.Parallel()
+
+	t.Run("aws", func(t *testing.T) {
+		t.Parallel()
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			var body struct {
+				KeyID     string `json:"KeyId"`
+				Plaintext []byte `json:"Plaintext"`
+			}
+
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.KeyID != "alias/gidari" ||
+				req.Header.Get("X-Amz-Target") != "TrentService.Encrypt" ||
+				!strings.Contains(req.Header.Get("Authorization"), "/eu-west-1/kms/aws4_request, "+
+					"SignedHeaders=") {
+				rw.WriteHeader(http.StatusBadRequest)
+
+				return
+			}
+
+			_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+				"CiphertextBlob": append([]byte("wrapped:"), body.Plaintext...),
+				"KeyId":          "arn:aws:kms:eu-west-1:111122223333:key/1234",
+			})
+		}))
+		t.Cleanup(server.Close)
+
+		cfg := aws.Config{
+			Region:      "us-east-1",
+			Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", ""),
+			HTTPClient:  server.Client(),
+		}
+
+		kek, err := newAWSKeyEncrypterFromConfig("alias/gidari",
+			url.Values{"region": {"eu-west-1"}, "endpoint": {server.URL}}, cfg)
+		if err != nil {
+			t.Fatalf("failed to create key encrypter: %v", err)
+		}
+
+		wrapped, keyID, err := kek.EncryptKey(context.Background(), []byte("key"))
+		if err != nil || string(wrapped) != "wrapped:key" || keyID != "arn:aws:kms:eu-west-1:111122223333:key/1234" {
+			t.Fatalf("unexpected wrapped key %q with key %q: %v", wrapped, keyID, err)
+		}
+
+		arn, err := newAWSKeyEncrypterFromConfig("arn:aws:kms:ap-south-1:111122223333:key/1234", url.Values{}, cfg)
+		if err != nil || arn.client.Options().Region != "ap-south-1" {
+			t.Fatalf("expected the region of the ARN, got %+v: %v", arn, err)
+		}
+	})
+
+	t.Run("gcp", func(t *testing.T) {
+		t.Parallel()
+
+		name := "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/v1/"+name+":encrypt" || req.Header.Get("Authorization") != "Bearer token" {
+				rw.WriteHeader(http.StatusForbidden)
+
+				return
+			}
+
+			var body struct {
+				Plaintext []byte `json:"plaintext"`
+			}
+
+			_ = json.NewDecoder(req.Body).Decode(&body)
+			_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+				"name":       name + "/cryptoKeyVersions/3",
+				"ciphertext": append([]byte("wrapped:"), body.Plaintext...),
+			})
+		}))
+		t.Cleanup(server.Close)
+
+		kek, err := NewKeyEncrypter("gcpkms://" + name + "?endpoint=" + server.URL)
+		if err != nil {
+			t.Fatalf("failed to create key encrypter: %v", err)
+		}
+
+		kek.(*gcpKeyEncrypter).tokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})
+
+		wrapped, keyID, err := kek.EncryptKey(context.Background(), []byte("key"))
+		if err != nil || string(wrapped) != "wrapped:key" || keyID != name+"/cryptoKeyVersions/3" {
+			t.Fatalf("unexpected wrapped key %q with key %q: %v", wrapped, keyID, err)
+		}
+
+		expired := &gcpKeyEncrypter{key: name, endpoint: server.URL}
+		expired.tokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "expired"})
+
+		if _, _, err := expired.EncryptKey(context.Background(), []byte("key")); !errors.Is(err, ErrKMS) {
+			t.Fatalf("expected error %v, got %v", ErrKMS, err)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		t.Parallel()
+
+		for _, location := range []string{"vault://transit/keys/gidari", "awskms://", "alias/gidari"} {
+			if _, err := NewKeyEncrypter(location); !errors.Is(err, ErrUnsupportedKMS) {
+				t.Fatalf("expected error %v for %q, got %v", ErrUnsupportedKMS, location, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,469 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	kvScheme = "kv"
+
+	// kvPrimaryKeyParam is the connection string parameter for the field of the records that is their key in every
+	// table, e.g. "primaryKey=id". The field for a single table is set with "primaryKey.<table>", e.g.
+	// "primaryKey.candles=time".
+	kvPrimaryKeyParam = "primaryKey"
+
+	// kvSyncParam is the connection string parameter that flushes every write to the disk before it returns, e.g.
+	// "sync=false" to leave it to the operating system. Writes are synced by default.
+	kvSyncParam = "sync"
+
+	kvDefaultPrimaryKey = "id"
+
+	// kvLockTimeout is how long the lock of a file that is open in another process is waited for.
+	kvLockTimeout = time.Second
+)
+
+var (
+	ErrKVPrimaryKey = fmt.Errorf("invalid kv primary key")
+	ErrKVCorrupt    = fmt.Errorf("corrupt kv file")
+	ErrKVLocked     = fmt.Errorf("kv file is locked")
+)
+
+// KVPrimaryKeyError is returned when the primary key of a record cannot be its key.
+func KVPrimaryKeyError(table, field string) error {
+	return fmt.Errorf("%w: the %q field of records of %q must be a string, number, or boolean", ErrKVPrimaryKey,
+		field, table)
+}
+
+// KVCorruptError is returned when the file is not a valid database, e.g. a file of another format.
+func KVCorruptError(path string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrKVCorrupt, path, err)
+}
+
+// KVLockedError is returned when the file is open in another process.
+func KVLockedError(path string) error {
+	return fmt.Errorf("%w: %s is open in another process", ErrKVLocked, path)
+}
+
+// kvOp is a record of a write, as JSON under its key.
+type kvOp struct {
+	table  string
+	key    string
+	record []byte
+}
+
+// kvTxType is the type of the context key of KV transactions.
+type kvTxType uint8
+
+const (
+	basicKVTxID kvTxType = iota
+)
+
+// kvTx are the operations of a transaction, written in a single write when the transaction commits.
+type kvTx struct {
+	mtx sync.Mutex
+	ops []kvOp
+}
+
+// KV is an embedded key-value storage device for local development and integration tests, which needs no database
+// server. The records are stored in a bbolt file, with a bucket for each table and the JSON of each record under its
+// primary key. The file is memory mapped rather than loaded, and is locked while it is open, so a second process
+// that opens it fails rather than corrupting it.
+type KV struct {
+	db          *bolt.DB
+	path        string
+	primaryKey  string
+	primaryKeys map[string]string
+
+	// activeTx are the transactions that are currently active, keyed by the transaction ID that is added to the
+	// context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewKV will return a KV storage device for the file of the connection string, e.g. "kv://data/gidari.kv" for a path
+// relative to the working directory or "kv:///var/lib/gidari.kv" for an absolute path. The file and its directory
+// are created if they do not exist. The key of each record is its "primaryKey" field (default "id", or
+// "primaryKey.<table>" for a single table).
+func NewKV(_ context.Context, connectionURL string) (*KV, error) {
+	uri, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	path := filepath.FromSlash(uri.Host + uri.Path)
+	if path == "" {
+		return nil, fmt.Errorf("%w: %s has no file", ErrDNSNotSupported, connectionURL)
+	}
+
+	stg := &KV{
+		path:        path,
+		primaryKey:  kvDefaultPrimaryKey,
+		primaryKeys: make(map[string]string),
+	}
+
+	opts := &bolt.Options{Timeout: kvLockTimeout}
+
+	for key, values := range uri.Query() {
+		switch table := strings.TrimPrefix(key, kvPrimaryKeyParam+"."); {
+		case key == kvSyncParam:
+			sync, err := strconv.ParseBool(values[0])
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s=%q must be a boolean", ErrDNSNotSupported, key, values[0])
+			}
+
+			opts.NoSync = !sync
+		case key == kvPrimaryKeyParam:
+			stg.primaryKey = values[0]
+		case table != key:
+			stg.primaryKeys[table] = values[0]
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create directory of %s: %w", path, err)
+	}
+
+	stg.db, err = bolt.Open(path, 0o644, opts)
+
+	switch {
+	case errors.Is(err, bolt.ErrTimeout):
+		return nil, KVLockedError(path)
+	case errors.Is(err, bolt.ErrInvalid), errors.Is(err, bolt.ErrChecksum), errors.Is(err, bolt.ErrVersionMismatch):
+		return nil, KVCorruptError(path, err)
+	case err != nil:
+		return nil, fmt.Errorf("unable to open %s: %w", path, err)
+	}
+
+	return stg, nil
+}
+
+// write will put the records in a single transaction of the file, so they are atomic.
+func (stg *KV) write(ops []kvOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	return stg.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range ops {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(op.table))
+			if err != nil {
+				return err
+			}
+
+			if err := bucket.Put([]byte(op.key), op.record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Close will close the file, releasing its lock.
+func (stg *KV) Close() {
+	stg.db.Close()
+}
+
+// IsNoSQL returns "true" to indicate that "KV" is a NoSQL database.
+func (stg *KV) IsNoSQL() bool { return true }
+
+// Type implements the storage interface.
+func (stg *KV) Type() uint8 { return KVType }
+
+// tablePrimaryKey will return the field of the records of the table that is their key.
+func (stg *KV) tablePrimaryKey(table string) string {
+	if field, ok := stg.primaryKeys[table]; ok {
+		return field
+	}
+
+	return stg.primaryKey
+}
+
+// ops will return the operations that write the records of the table under their keys. Records without a primary
+// key are written under a generated key.
+func (stg *KV) ops(table string, records []*structpb.Struct) ([]kvOp, error) {
+	field := stg.tablePrimaryKey(table)
+	ops := make([]kvOp, 0, len(records))
+
+	for _, record := range records {
+		key := uuid.New().String()
+
+		if value, ok := record.GetFields()[field]; ok && value.AsInterface() != nil {
+			if key, ok = redisPrimaryKey(value); !ok {
+				return nil, KVPrimaryKeyError(table, field)
+			}
+		}
+
+		data, err := json.Marshal(record.AsMap())
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode record: %w", err)
+		}
+
+		ops = append(ops, kvOp{table: table, key: key, record: data})
+	}
+
+	return ops, nil
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *KV) tx(ctx context.Context) *kvTx {
+	txID, ok := ctx.Value(basicKVTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	kvTx, _ := tx.(*kvTx)
+
+	return kvTx
+}
+
+// Upsert will write the records of the table under their primary keys, replacing the records with the same keys.
+// Within a transaction, the records are written when the transaction commits.
+func (stg *KV) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	ops, err := stg.ops(req.GetTable(), records)
+	if err != nil {
+		return nil, err
+	}
+
+	if tx := stg.tx(ctx); tx != nil {
+		tx.mtx.Lock()
+		defer tx.mtx.Unlock()
+
+		tx.ops = append(tx.ops, ops...)
+
+		return &proto.UpsertResponse{UpsertedCount: int64(len(ops))}, nil
+	}
+
+	if err := stg.write(ops); err != nil {
+		return nil, fmt.Errorf("unable to upsert records: %w", err)
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(ops))}, nil
+}
+
+// Read will return the records of the table that match the required fields on the request, in the page requested by
+// the options of the request, if any. A read that requires a single primary key looks the record up by its key, and
+// other reads decode the records of the table one at a time, keeping the matching records.
+func (stg *KV) Read(_ context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	required := req.GetRequired().GetFields()
+
+	var records []map[string]interface{}
+
+	match := func(data []byte) error {
+		var record map[string]interface{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("unable to decode record of %s: %w", req.GetTable(), err)
+		}
+
+		if parquetMatches(record, nil, required) {
+			records = append(records, record)
+		}
+
+		return nil
+	}
+
+	err = stg.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(req.GetTable()))
+		if bucket == nil {
+			return nil
+		}
+
+		if value, ok := required[stg.tablePrimaryKey(req.GetTable())]; ok {
+			if key, ok := redisPrimaryKey(value); ok {
+				if data := bucket.Get([]byte(key)); data != nil {
+					return match(data)
+				}
+
+				return nil
+			}
+		}
+
+		return bucket.ForEach(func(_, data []byte) error { return match(data) })
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return redisPage(records, page)
+}
+
+// Count will return the number of records of the table that match the required fields. The records of a table are
+// counted from the keys of its bucket unless fields are required.
+func (stg *KV) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	if len(req.GetRequired().GetFields()) > 0 {
+		return readCount(ctx, stg, req)
+	}
+
+	rsp := new(proto.CountResponse)
+
+	err := stg.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(req.GetTable())); bucket != nil {
+			rsp.Count = int64(bucket.Stats().KeyN)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to count records: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// Truncate will delete the records of the tables.
+func (stg *KV) Truncate(_ context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	var deleted int32
+
+	err := stg.db.Update(func(tx *bolt.Tx) error {
+		for _, table := range req.GetTables() {
+			bucket := tx.Bucket([]byte(table))
+			if bucket == nil {
+				continue
+			}
+
+			deleted += int32(bucket.Stats().KeyN)
+
+			if err := tx.DeleteBucket([]byte(table)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to truncate tables: %w", err)
+	}
+
+	return &proto.TruncateResponse{DeletedCount: deleted}, nil
+}
+
+// ListTables will return the tables with at least one record, and the size of their records as JSON in bytes.
+func (stg *KV) ListTables(_ context.Context) (*proto.ListTablesResponse, error) {
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+
+	err := stg.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			var size int64
+
+			err := bucket.ForEach(func(_, data []byte) error {
+				size += int64(len(data))
+
+				return nil
+			})
+			if err != nil || size == 0 {
+				return err
+			}
+
+			rsp.TableSet[string(name)] = &proto.Table{Size: size}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tables: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will return the primary key field of each table.
+func (stg *KV) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	tables, err := stg.ListTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+
+	for table := range tables.GetTableSet() {
+		rsp.PKSet[table] = &proto.PrimaryKeys{List: []string{stg.tablePrimaryKey(table)}}
+	}
+
+	return rsp, nil
+}
+
+// StartTx will start a transaction. The records of the functions sent to the transaction are buffered, and written
+// in a single transaction of the file when the transaction commits, so the transaction is atomic. Reads in the
+// transaction do not see its buffered records.
+func (stg *KV) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+	tx := new(kvTx)
+
+	stg.activeTx.Store(txnID, tx)
+
+	kvCtx := context.WithValue(ctx, basicKVTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+
+		var err error
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(kvCtx, stg)
+		}
+
+		if err != nil {
+			<-txn.commit
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit {
+			if err = stg.write(tx.ops); err != nil {
+				err = fmt.Errorf("unable to commit transaction: %w", err)
+			}
+		}
+
+		txn.done <- err
+	}()
+
+	return txn, nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/internal/storage/storagetest"
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func newKV(t *testing.T, path, params string) *storage.Service {
+	t.Helper()
+
+	stg, err := storage.New(context.Background(), "kv://"+filepath.ToSlash(path)+params)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	return stg
+}
+
+func upsertKV(ctx context.Context, t *testing.T, stg storage.Storage, table string,
+	records ...map[string]interface{},
+) {
+	t.Helper()
+
+	data, _ := json.Marshal(records)
+	if _, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: table, Data: data}); err != nil {
+		t.Fatalf("failed to upsert records: %v", err)
+	}
+}
+
+func TestKV(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("conformance", func(t *testing.T) {
+		t.Parallel()
+
+		stg := newKV(t, filepath.Join(t.TempDir(), "data", "gidari.kv"), "?sync=false")
+		t.Cleanup(stg.Close)
+
+		if stg.Type() != storage.KVType || !stg.IsNoSQL() {
+			t.Fatalf("expected a NoSQL kv storage, got type %d", stg.Type())
+		}
+
+		storagetest.Run(t, stg, "conformance")
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "gidari.kv")
+
+		stg := newKV(t, path, "?primaryKey.candles=time")
+		upsertKV(ctx, t, stg, "candles", map[string]interface{}{"time": 1, "open": 2},
+			map[string]interface{}{"time": 2})
+		upsertKV(ctx, t, stg, "candles", map[string]interface{}{"time": 1, "open": 3})
+		upsertKV(ctx, t, stg, "products", map[string]interface{}{"id": "a"})
+
+		if _, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"products"}}); err != nil {
+			t.Fatalf("failed to truncate: %v", err)
+		}
+
+		stg.Close()
+
+		stg = newKV(t, path, "?primaryKey.candles=time")
+		t.Cleanup(stg.Close)
+
+		required, _ := structpb.NewStruct(map[string]interface{}{"time": 1})
+
+		rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "candles", Required: required})
+		if err != nil || len(rsp.Records) != 1 || !reflect.DeepEqual(rsp.Records[0].AsMap(),
+			map[string]interface{}{"time": 1.0, "open": 3.0}) {
+			t.Fatalf("expected the last write of the candle, got %v: %v", rsp, err)
+		}
+
+		pks, err := stg.ListPrimaryKeys(ctx)
+		if err != nil || len(pks.PKSet) != 1 || !reflect.DeepEqual(pks.PKSet["candles"].List, []string{"time"}) {
+			t.Fatalf("expected the candles to be the only table, got %v: %v", pks, err)
+		}
+
+		upsertKV(ctx, t, stg, "candles", map[string]interface{}{"time": 3})
+
+		rsp, err = stg.Read(ctx, &proto.ReadRequest{Table: "candles"})
+		if err != nil || len(rsp.Records) != 3 {
+			t.Fatalf("expected the candles to be written after the file was opened again, got %v: %v", rsp, err)
+		}
+
+		count, err := stg.Count(ctx, &proto.CountRequest{Table: "candles"})
+		if err != nil || count.Count != 3 {
+			t.Fatalf("expected 3 candles to be counted, got %v: %v", count, err)
+		}
+	})
+
+	t.Run("locked", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "gidari.kv")
+
+		stg := newKV(t, path, "")
+
+		if _, err := storage.New(ctx, "kv://"+filepath.ToSlash(path)); !errors.Is(err, storage.ErrKVLocked) {
+			t.Fatalf("expected error %v, got %v", storage.ErrKVLocked, err)
+		}
+
+		stg.Close()
+
+		stg = newKV(t, path, "")
+		t.Cleanup(stg.Close)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "gidari.kv")
+
+		stg := newKV(t, path, "")
+
+		data, _ := json.Marshal([]map[string]interface{}{{"id": []interface{}{1}}})
+		if _, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "products", Data: data}); !errors.Is(err,
+			storage.ErrKVPrimaryKey) {
+			t.Fatalf("expected error %v, got %v", storage.ErrKVPrimaryKey, err)
+		}
+
+		stg.Close()
+
+		if err := os.WriteFile(path, bytes.Repeat([]byte("not a database\n"), 1000), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+
+		if _, err := storage.New(ctx, "kv://"+filepath.ToSlash(path)); !errors.Is(err, storage.ErrKVCorrupt) {
+			t.Fatalf("expected error %v, got %v", storage.ErrKVCorrupt, err)
+		}
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		t.Parallel()
+
+		for _, commit := range []bool{true, false} {
+			stg := newKV(t, filepath.Join(t.TempDir(), "gidari.kv"), "")
+			t.Cleanup(stg.Close)
+
+			txn, err := stg.StartTx(ctx)
+			if err != nil {
+				t.Fatalf("failed to start transaction: %v", err)
+			}
+
+			txn.Send(func(ctx context.Context, stg storage.Storage) error {
+				upsertKV(ctx, t, stg, "products", map[string]interface{}{"id": "a"},
+					map[string]interface{}{"id": "b"})
+
+				return nil
+			})
+
+			if commit {
+				err = txn.Commit()
+			} else {
+				err = txn.Rollback()
+			}
+
+			if err != nil {
+				t.Fatalf("failed to end transaction: %v", err)
+			}
+
+			rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "products"})
+			if err != nil || (len(rsp.Records) == 2) != commit {
+				t.Fatalf("expected the records to be written on commit, got %v: %v", rsp, err)
+			}
+		}
+	})
+}
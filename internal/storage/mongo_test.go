@@ -11,13 +11,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/alpine-hodler/gidari/proto"
 	"github.com/alpine-hodler/gidari/tools"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/x/bsonx"
 )
 
 func TestMongoDBTxn(t *testing.T) {
@@ -55,7 +56,7 @@ func TestMongoDBTxn(t *testing.T) {
 		// Add an index to the collection.
 		indexView := mdb.Client.Database(database).Collection(collection).Indexes()
 		_, err = indexView.CreateOne(context.Background(), mongo.IndexModel{
-			Keys: bsonx.Doc{{Key: "test_string", Value: bsonx.Int32(1)}},
+			Keys: bson.D{{Key: "test_string", Value: int32(1)}},
 		})
 		if err != nil {
 			t.Fatalf("failed to create index: %v", err)
@@ -92,3 +93,67 @@ func TestMongoDBTxn(t *testing.T) {
 		}
 	})
 }
+
+func TestMongoClientOptions(t *testing.T) {
+	t.Parallel()
+
+	for _, tcase := range []struct {
+		name        string
+		uri         string
+		database    string
+		appName     string
+		compressors []string
+		retryWrites bool
+	}{
+		{
+			name:        "defaults",
+			uri:         "mongodb://mongo1:27017/db1",
+			database:    "db1",
+			appName:     "gidari",
+			retryWrites: true,
+		},
+		{
+			name:        "passthrough",
+			uri:         "mongodb://mongo1:27017/db1?appName=loader&compressors=zstd,snappy&retryWrites=false",
+			database:    "db1",
+			appName:     "loader",
+			compressors: []string{"zstd", "snappy"},
+		},
+	} {
+		tcase := tcase
+
+		t.Run(tcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			clientOptions, connString, err := mongoClientOptions(tcase.uri)
+			if err != nil {
+				t.Fatalf("failed to parse client options: %v", err)
+			}
+
+			if connString.Database != tcase.database {
+				t.Fatalf("expected database %q, got %q", tcase.database, connString.Database)
+			}
+
+			if *clientOptions.AppName != tcase.appName {
+				t.Fatalf("expected app name %q, got %q", tcase.appName, *clientOptions.AppName)
+			}
+
+			if !reflect.DeepEqual(clientOptions.Compressors, tcase.compressors) {
+				t.Fatalf("expected compressors %v, got %v", tcase.compressors, clientOptions.Compressors)
+			}
+
+			retryWrites := clientOptions.RetryWrites == nil || *clientOptions.RetryWrites
+			if retryWrites != tcase.retryWrites {
+				t.Fatalf("expected retry writes %v, got %v", tcase.retryWrites, retryWrites)
+			}
+		})
+	}
+
+	t.Run("invalid options", func(t *testing.T) {
+		t.Parallel()
+
+		if _, _, err := mongoClientOptions("mongodb://mongo1:27017/db1?maxPoolSize=many"); err == nil {
+			t.Fatalf("expected an error for an invalid option")
+		}
+	})
+}
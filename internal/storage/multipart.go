@@ -0,0 +1,131 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// readPart will read the next part of the object, and whether it is the last part.
+func readPart(r io.Reader, size int) ([]byte, bool, error) {
+	part := make([]byte, size)
+
+	n, err := io.ReadFull(r, part)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return part[:n], true, nil
+	}
+
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to read object: %w", err)
+	}
+
+	return part, false, nil
+}
+
+// parseUploadConcurrency will return the number of parts of an upload that are uploaded at the same time, set with
+// the "concurrency" parameter of an object storage location.
+func parseUploadConcurrency(value string) (int, error) {
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return 0, InvalidObjectStoreOptionError(s3ConcurrencyParam, value, "must be a positive integer")
+	}
+
+	return count, nil
+}
+
+// uploadConcurrently will upload the first part and the rest of the object read from the reader, in parts of the
+// size, with the upload function. The parts are numbered from 1, and the number of parts is returned. At most
+// "concurrency" parts are uploaded, and held in memory, at the same time, and the first error cancels the parts that
+// are still being uploaded. An object with more than "maxParts" parts fails, suggesting to increase the size with the
+// "sizeParam" parameter.
+func uploadConcurrently(ctx context.Context, firstPart []byte, r io.Reader, size, concurrency, maxParts int,
+	sizeParam string, upload func(ctx context.Context, number int, data []byte) error,
+) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		count    int
+		firstErr error
+	)
+
+	fail := func(err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		cancel()
+	}
+
+	sem := make(chan struct{}, concurrency)
+	data, last := firstPart, false
+
+	for number := 1; ; number++ {
+		if number > maxParts {
+			fail(fmt.Errorf("the object has more than %d parts, increase the %q", maxParts, sizeParam))
+
+			break
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+
+		count = number
+
+		go func(number int, data []byte) {
+			defer func() { <-sem }()
+			defer wg.Done()
+
+			if err := upload(ctx, number, data); err != nil {
+				fail(fmt.Errorf("part %d: %w", number, err))
+			}
+		}(number, data)
+
+		if last {
+			break
+		}
+
+		var err error
+		if data, last, err = readPart(r, size); err != nil {
+			fail(err)
+
+			break
+		}
+
+		// An object that is a multiple of the part size ends with an empty read.
+		if len(data) == 0 {
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return 0, firstErr
+	}
+
+	return count, nil
+}
@@ -0,0 +1,722 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j/config"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	neo4jScheme    = "neo4j"
+	neo4jTLSScheme = "neo4j+s"
+
+	// neo4jBoltPort is the default port of the Bolt protocol of Neo4j.
+	neo4jBoltPort = "7687"
+
+	// neo4jDatabaseParam is the connection string parameter for the database to write to, e.g. "database=graph".
+	neo4jDatabaseParam = "database"
+
+	// neo4jKeyParam is the connection string parameter for the comma separated properties that identify the node of
+	// a record, e.g. "key=id". The properties of a single table are set with "key.<table>", e.g.
+	// "key.candles=product,time".
+	neo4jKeyParam = "key"
+
+	// neo4jLabelParam is the connection string parameter for the node label of the records of a table, e.g.
+	// "label.products=Product". The label of a table defaults to the table.
+	neo4jLabelParam = "label"
+
+	// neo4jRelParam is the connection string parameter for a relationship from the nodes of a table to the nodes
+	// referenced by one of their properties, as "<property>:<type>:<label>[:<key>]", e.g.
+	// "rel.orders=customer_id:PLACED_BY:Customer". The parameter can be repeated for a table.
+	neo4jRelParam = "rel"
+
+	neo4jDefaultDatabase = "neo4j"
+	neo4jDefaultKey      = "id"
+
+	// neo4jBatchRows is the number of records merged by each statement.
+	neo4jBatchRows = 1000
+)
+
+var (
+	ErrNeo4j    = fmt.Errorf("neo4j request failed")
+	ErrNeo4jKey = fmt.Errorf("invalid neo4j key")
+)
+
+// Neo4jError is returned when a statement, or a transaction, fails.
+func Neo4jError(err error) error {
+	return fmt.Errorf("%w: %v", ErrNeo4j, err)
+}
+
+// Neo4jKeyError is returned when a record does not have a string, number, or boolean value for a key property of its
+// node.
+func Neo4jKeyError(table, property string) error {
+	return fmt.Errorf("%w: the %q property of records of %q must be a string, number, or boolean", ErrNeo4jKey,
+		property, table)
+}
+
+// neo4jRelationship is a relationship from the node of a record to the node with the key in one of its properties.
+type neo4jRelationship struct {
+	property string
+	relType  string
+	label    string
+	key      string
+}
+
+// neo4jStatement is a Cypher statement with its parameters.
+type neo4jStatement struct {
+	Statement  string
+	Parameters map[string]interface{}
+}
+
+// neo4jTxType is the type of the context key of Neo4j transactions.
+type neo4jTxType uint8
+
+const (
+	basicNeo4jTxID neo4jTxType = iota
+)
+
+// Neo4j is a storage device that merges records into the nodes of a Neo4j graph with Cypher "MERGE" statements, run
+// with the Neo4j driver over the Bolt protocol. The records of a table are the nodes of its label, identified by their
+// key properties, and the other fields of a record are set as properties of its node. Relationships from the nodes of
+// a table to the nodes referenced by their properties can be merged with the records, so that the relationships of web
+// API data are queryable as a graph.
+//
+// Node properties can not be maps, so nested objects, and lists that are not of a single primitive type, are written
+// as JSON strings. Neo4j 4.4 or later is required.
+type Neo4j struct {
+	target        string
+	host          string
+	tls           bool
+	database      string
+	auth          neo4j.AuthToken
+	key           []string
+	keys          map[string][]string
+	labels        map[string]string
+	relationships map[string][]neo4jRelationship
+
+	// The driver is created with the first request.
+	once   sync.Once
+	driver neo4j.DriverWithContext
+	err    error
+
+	// activeTx are the transactions that are currently active, keyed by the transaction ID that is added to the
+	// context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewNeo4j will return a Neo4j storage device for the connection string, i.e.
+// "neo4j://[user:password@]host[:port][?database=<database>]", or "neo4j+s://" to connect with TLS. The port is the
+// Bolt port, 7687 by default, and statements are routed to the members of a cluster by the driver. The node label,
+// key properties, and relationships of each table are set with the "label.<table>", "key.<table>", and "rel.<table>"
+// parameters.
+func NewNeo4j(_ context.Context, connectionURL string) (*Neo4j, error) {
+	uri, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	if uri.Host == "" {
+		return nil, DNSNotSupportedError(connectionURL)
+	}
+
+	host := uri.Host
+	if uri.Port() == "" {
+		host = net.JoinHostPort(uri.Hostname(), neo4jBoltPort)
+	}
+
+	stg := &Neo4j{
+		target:        uri.Scheme + "://" + host,
+		host:          uri.Hostname(),
+		tls:           uri.Scheme == neo4jTLSScheme,
+		database:      neo4jDefaultDatabase,
+		auth:          neo4j.NoAuth(),
+		key:           []string{neo4jDefaultKey},
+		keys:          make(map[string][]string),
+		labels:        make(map[string]string),
+		relationships: make(map[string][]neo4jRelationship),
+	}
+
+	if uri.User != nil {
+		password, _ := uri.User.Password()
+		stg.auth = neo4j.BasicAuth(uri.User.Username(), password, "")
+	}
+
+	for param, values := range uri.Query() {
+		name, table, _ := strings.Cut(param, ".")
+
+		switch {
+		case param == neo4jDatabaseParam:
+			stg.database = values[0]
+		case param == neo4jKeyParam:
+			stg.key = strings.Split(values[0], ",")
+		case name == neo4jKeyParam && table != "":
+			stg.keys[table] = strings.Split(values[0], ",")
+		case name == neo4jLabelParam && table != "":
+			stg.labels[table] = values[0]
+		case name == neo4jRelParam && table != "":
+			for _, value := range values {
+				parts := strings.Split(value, ":")
+				if len(parts) < 3 || len(parts) > 4 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+					return nil, fmt.Errorf("%w: %s=%q must be <property>:<type>:<label>[:<key>]", ErrDNSNotSupported,
+						param, value)
+				}
+
+				rel := neo4jRelationship{property: parts[0], relType: parts[1], label: parts[2], key: neo4jDefaultKey}
+				if len(parts) == 4 && parts[3] != "" {
+					rel.key = parts[3]
+				}
+
+				stg.relationships[table] = append(stg.relationships[table], rel)
+			}
+		}
+	}
+
+	return stg, nil
+}
+
+// Close will close the connections of the driver.
+func (stg *Neo4j) Close() {
+	if stg.driver != nil {
+		_ = stg.driver.Close(context.Background())
+	}
+}
+
+// IsNoSQL returns "true" to indicate that "Neo4j" is a NoSQL database.
+func (stg *Neo4j) IsNoSQL() bool { return true }
+
+// Type implements the storage interface.
+func (stg *Neo4j) Type() uint8 { return Neo4jType }
+
+// tableKey will return the key properties of the nodes of the table.
+func (stg *Neo4j) tableKey(table string) []string {
+	if key, ok := stg.keys[table]; ok {
+		return key
+	}
+
+	return stg.key
+}
+
+// label will return the node label of the records of the table.
+func (stg *Neo4j) label(table string) string {
+	if label, ok := stg.labels[table]; ok {
+		return label
+	}
+
+	return table
+}
+
+// neo4jQuote will quote the name of a label, relationship type, or property as a Cypher identifier.
+func neo4jQuote(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// neo4jDriver will return the driver of the connection string, created with the first request.
+func (stg *Neo4j) neo4jDriver() (neo4j.DriverWithContext, error) {
+	stg.once.Do(func() {
+		stg.driver, stg.err = neo4j.NewDriverWithContext(stg.target, stg.auth, func(cfg *config.Config) {
+			if stg.tls {
+				cfg.TlsConfig = compliance.TLSConfig(stg.host)
+			}
+		})
+		if stg.err != nil {
+			stg.err = Neo4jError(stg.err)
+		}
+	})
+
+	return stg.driver, stg.err
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *Neo4j) tx(ctx context.Context) neo4j.ExplicitTransaction {
+	txID, ok := ctx.Value(basicNeo4jTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	neo4jTx, _ := tx.(neo4j.ExplicitTransaction)
+
+	return neo4jTx
+}
+
+// run will run the statement in the transaction of the context, or in a transaction of its own, and return its
+// records with the summary of the statement.
+func (stg *Neo4j) run(ctx context.Context, stmt neo4jStatement) ([]*neo4j.Record, neo4j.ResultSummary, error) {
+	if tx := stg.tx(ctx); tx != nil {
+		result, err := tx.Run(ctx, stmt.Statement, stmt.Parameters)
+		if err != nil {
+			return nil, nil, Neo4jError(err)
+		}
+
+		records, err := result.Collect(ctx)
+		if err != nil {
+			return nil, nil, Neo4jError(err)
+		}
+
+		summary, err := result.Consume(ctx)
+		if err != nil {
+			return nil, nil, Neo4jError(err)
+		}
+
+		return records, summary, nil
+	}
+
+	driver, err := stg.neo4jDriver()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rsp, err := neo4j.ExecuteQuery(ctx, driver, stmt.Statement, stmt.Parameters, neo4j.EagerResultTransformer,
+		neo4j.ExecuteQueryWithDatabase(stg.database))
+	if err != nil {
+		return nil, nil, Neo4jError(err)
+	}
+
+	return rsp.Records, rsp.Summary, nil
+}
+
+// mergeStatement will return the statement that merges the rows of the "rows" parameter into the nodes of the table
+// on their key properties, and then merges the relationships of the table for the rows with the referenced
+// properties.
+func (stg *Neo4j) mergeStatement(table string) string {
+	key := stg.tableKey(table)
+	match := make([]string, len(key))
+
+	for idx, property := range key {
+		match[idx] = fmt.Sprintf("%s: row.keys.%s", neo4jQuote(property), neo4jQuote(property))
+	}
+
+	var stmt strings.Builder
+
+	fmt.Fprintf(&stmt, "UNWIND $rows AS row MERGE (n:%s {%s}) SET n += row.props", neo4jQuote(stg.label(table)),
+		strings.Join(match, ", "))
+
+	for idx, rel := range stg.relationships[table] {
+		ref := "row.props." + neo4jQuote(rel.property)
+
+		fmt.Fprintf(&stmt, " FOREACH (_ IN CASE WHEN %s IS NULL THEN [] ELSE [1] END | MERGE (m%d:%s {%s: %s}) "+
+			"MERGE (n)-[:%s]->(m%d))", ref, idx, neo4jQuote(rel.label), neo4jQuote(rel.key), ref,
+			neo4jQuote(rel.relType), idx)
+	}
+
+	return stmt.String()
+}
+
+// neo4jProperty will convert the value of a record to a value that can be set as a node property: maps, and lists
+// that are not of a single primitive type, are encoded as JSON strings.
+func neo4jProperty(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+	case []interface{}:
+		if neo4jPrimitiveList(value) {
+			return value, nil
+		}
+	default:
+		return value, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+	}
+
+	return string(data), nil
+}
+
+// neo4jPrimitiveList will return true if the elements of the list are strings, numbers, or booleans, all of the same
+// type.
+func neo4jPrimitiveList(list []interface{}) bool {
+	for _, elem := range list {
+		switch elem.(type) {
+		case string, float64, bool:
+		default:
+			return false
+		}
+
+		if fmt.Sprintf("%T", elem) != fmt.Sprintf("%T", list[0]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// neo4jRows will return the rows of the "rows" parameter of the merge statement of the table: the key properties of
+// each record, and its properties.
+func (stg *Neo4j) neo4jRows(table string, records []*structpb.Struct) ([]interface{}, error) {
+	key := stg.tableKey(table)
+	rows := make([]interface{}, 0, len(records))
+
+	for _, record := range records {
+		keys := make(map[string]interface{}, len(key))
+		props := make(map[string]interface{}, len(record.GetFields()))
+
+		for _, property := range key {
+			switch value := record.GetFields()[property].AsInterface().(type) {
+			case string, float64, bool:
+				keys[property] = value
+			default:
+				return nil, Neo4jKeyError(table, property)
+			}
+		}
+
+		for field, value := range record.AsMap() {
+			prop, err := neo4jProperty(value)
+			if err != nil {
+				return nil, err
+			}
+
+			props[field] = prop
+		}
+
+		rows = append(rows, map[string]interface{}{"keys": keys, "props": props})
+	}
+
+	return rows, nil
+}
+
+// Upsert will merge each record into the node of the label of the table with its key properties, setting the fields
+// of the record as properties of the node, and merge the relationships of the table. Each batch of records is merged
+// by a single statement, which runs in the transaction of the context, if any.
+func (stg *Neo4j) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	if len(records) == 0 {
+		return &proto.UpsertResponse{}, nil
+	}
+
+	rows, err := stg.neo4jRows(req.GetTable(), records)
+	if err != nil {
+		return nil, err
+	}
+
+	statement := stg.mergeStatement(req.GetTable())
+
+	for start := 0; start < len(rows); start += neo4jBatchRows {
+		stmt := neo4jStatement{Statement: statement, Parameters: map[string]interface{}{
+			"rows": rows[start:min(start+neo4jBatchRows, len(rows))],
+		}}
+		if _, _, err := stg.run(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("unable to upsert records: %w", err)
+		}
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+}
+
+// neo4jEquals will return the condition that the property of the node equals the parameter, or that the node does
+// not have the property if the value is null.
+func neo4jEquals(property string, value interface{}, params map[string]interface{}) string {
+	if value == nil {
+		return fmt.Sprintf("n.%s IS NULL", neo4jQuote(property))
+	}
+
+	param := "p" + strconv.Itoa(len(params))
+	params[param] = value
+
+	return fmt.Sprintf("n.%s = $%s", neo4jQuote(property), param)
+}
+
+// neo4jRequiredConditions will return the conditions that match the required properties, adding their values to the
+// parameters.
+func neo4jRequiredConditions(required map[string]*structpb.Value, params map[string]interface{}) []string {
+	fields := make([]string, 0, len(required))
+	for field := range required {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+
+	conditions := make([]string, 0, len(required)+1)
+
+	for _, field := range fields {
+		if list := required[field].GetListValue(); list != nil {
+			param := "p" + strconv.Itoa(len(params))
+			params[param] = list.AsSlice()
+
+			conditions = append(conditions, fmt.Sprintf("n.%s IN $%s", neo4jQuote(field), param))
+		} else {
+			conditions = append(conditions, neo4jEquals(field, required[field].AsInterface(), params))
+		}
+	}
+
+	return conditions
+}
+
+// neo4jReadStatement will return the statement that matches the nodes of the label with the required properties, sorted
+// by the "orderBy" properties of the page and after its "after" values, up to its limit. Missing properties sort
+// first.
+func neo4jReadStatement(label string, required map[string]*structpb.Value, page *readPage) neo4jStatement {
+	params := make(map[string]interface{})
+	conditions := neo4jRequiredConditions(required, params)
+
+	var orderBy []string
+
+	if page != nil {
+		after := make([]string, 0, len(page.after))
+
+		for idx, property := range page.orderBy {
+			orderBy = append(orderBy, fmt.Sprintf("n.%s IS NOT NULL, n.%s", neo4jQuote(property),
+				neo4jQuote(property)))
+
+			if len(page.after) == 0 {
+				continue
+			}
+
+			conjunction := make([]string, 0, idx+1)
+			for prev := 0; prev < idx; prev++ {
+				conjunction = append(conjunction, neo4jEquals(page.orderBy[prev], page.after[prev], params))
+			}
+
+			if page.after[idx] == nil {
+				conjunction = append(conjunction, fmt.Sprintf("n.%s IS NOT NULL", neo4jQuote(property)))
+			} else {
+				param := "p" + strconv.Itoa(len(params))
+				params[param] = page.after[idx]
+
+				conjunction = append(conjunction, fmt.Sprintf("n.%s > $%s", neo4jQuote(property), param))
+			}
+
+			after = append(after, "("+strings.Join(conjunction, " AND ")+")")
+		}
+
+		if len(after) > 0 {
+			conditions = append(conditions, "("+strings.Join(after, " OR ")+")")
+		}
+	}
+
+	stmt := fmt.Sprintf("MATCH (n:%s)", neo4jQuote(label))
+	if len(conditions) > 0 {
+		stmt += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	stmt += " RETURN properties(n)"
+
+	if len(orderBy) > 0 {
+		stmt += " ORDER BY " + strings.Join(orderBy, ", ")
+	}
+
+	if page != nil && page.limit > 0 {
+		stmt += " LIMIT " + strconv.Itoa(page.limit)
+	}
+
+	return neo4jStatement{Statement: stmt, Parameters: params}
+}
+
+// neo4jCountStatement will return the statement that counts the nodes of the label with the required properties.
+func neo4jCountStatement(label string, required map[string]*structpb.Value) neo4jStatement {
+	params := make(map[string]interface{})
+	conditions := neo4jRequiredConditions(required, params)
+
+	stmt := fmt.Sprintf("MATCH (n:%s)", neo4jQuote(label))
+	if len(conditions) > 0 {
+		stmt += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	return neo4jStatement{Statement: stmt + " RETURN count(n)", Parameters: params}
+}
+
+// Read will return the properties of the nodes of the label of the table that match the required fields on the
+// request, in the page requested by the options of the request, if any. The required fields and the page are pushed
+// down to Neo4j as the "WHERE", "ORDER BY", and "LIMIT" clauses of the statement.
+func (stg *Neo4j) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := neo4jReadStatement(stg.label(req.GetTable()), req.GetRequired().GetFields(), page)
+
+	records, _, err := stg.run(ctx, stmt)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read records: %w", err)
+	}
+
+	out := new(proto.ReadResponse)
+
+	for _, rec := range records {
+		props, _ := rec.Values[0].(map[string]interface{})
+
+		record, err := structpb.NewStruct(props)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert record: %w", err)
+		}
+
+		out.Records = append(out.Records, record)
+	}
+
+	return out, nil
+}
+
+// Count will return the number of nodes of the label that match the required fields, with "count(n)".
+func (stg *Neo4j) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	stmt := neo4jCountStatement(stg.label(req.GetTable()), req.GetRequired().GetFields())
+
+	records, _, err := stg.run(ctx, stmt)
+	if err != nil {
+		return nil, fmt.Errorf("unable to count records: %w", err)
+	}
+
+	out := new(proto.CountResponse)
+
+	for _, rec := range records {
+		if count, ok := rec.Values[0].(int64); ok {
+			out.Count = count
+		}
+	}
+
+	return out, nil
+}
+
+// Truncate will delete the nodes of the labels of the tables, with their relationships.
+func (stg *Neo4j) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	rsp := new(proto.TruncateResponse)
+
+	for _, table := range req.GetTables() {
+		stmt := neo4jStatement{Statement: fmt.Sprintf("MATCH (n:%s) DETACH DELETE n", neo4jQuote(stg.label(table)))}
+
+		_, summary, err := stg.run(ctx, stmt)
+		if err != nil {
+			return nil, fmt.Errorf("error truncating table %s: %w", table, err)
+		}
+
+		rsp.DeletedCount += int32(summary.Counters().NodesDeleted())
+	}
+
+	return rsp, nil
+}
+
+// ListTables will return the tables of the node labels of the database, with their sizes reported as zero. Labels
+// that are not the label of a table in the connection string are listed as tables of the same name.
+func (stg *Neo4j) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	records, _, err := stg.run(ctx, neo4jStatement{Statement: "CALL db.labels() YIELD label RETURN label"})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tables: %w", err)
+	}
+
+	tables := make(map[string]string, len(stg.labels))
+	for table, label := range stg.labels {
+		tables[label] = table
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+
+	for _, rec := range records {
+		label, _ := rec.Values[0].(string)
+
+		if table, ok := tables[label]; ok {
+			label = table
+		}
+
+		rsp.TableSet[label] = &proto.Table{}
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will return the key properties of each table.
+func (stg *Neo4j) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	tables, err := stg.ListTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+
+	for table := range tables.GetTableSet() {
+		rsp.PKSet[table] = &proto.PrimaryKeys{List: stg.tableKey(table)}
+	}
+
+	return rsp, nil
+}
+
+// StartTx will begin a transaction in a session of the database, which the functions sent to the transaction run in,
+// in order. Neo4j rolls back transactions that are idle for longer than its "db.transaction.timeout" setting.
+func (stg *Neo4j) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	driver, err := stg.neo4jDriver()
+	if err != nil {
+		return txn, fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	session := driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: stg.database})
+
+	tx, err := session.BeginTransaction(ctx)
+	if err != nil {
+		_ = session.Close(ctx)
+
+		return txn, fmt.Errorf("failed to start transaction: %w", Neo4jError(err))
+	}
+
+	txnID := uuid.New().String()
+	stg.activeTx.Store(txnID, tx)
+
+	txCtx := context.WithValue(ctx, basicNeo4jTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+		defer func() { _ = session.Close(ctx) }()
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(txCtx, stg)
+		}
+
+		if err != nil {
+			_ = tx.Rollback(ctx)
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit {
+			err = tx.Commit(ctx)
+		} else {
+			err = tx.Rollback(ctx)
+		}
+
+		if err != nil {
+			err = Neo4jError(err)
+		}
+
+		txn.done <- err
+	}()
+
+	return txn, nil
+}
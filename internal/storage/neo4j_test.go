@@ -0,0 +1,595 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Signatures of the Bolt messages of the Neo4j server.
+const (
+	boltHello    = 0x01
+	boltGoodbye  = 0x02
+	boltReset    = 0x0F
+	boltRun      = 0x10
+	boltBegin    = 0x11
+	boltCommit   = 0x12
+	boltRollback = 0x13
+	boltDiscard  = 0x2F
+	boltPull     = 0x3F
+	boltRoute    = 0x66
+	boltSuccess  = 0x70
+	boltRecord   = 0x71
+	boltIgnored  = 0x7E
+	boltFailure  = 0x7F
+)
+
+// boltStruct is a PackStream structure, i.e. a Bolt message.
+type boltStruct struct {
+	signature byte
+	fields    []interface{}
+}
+
+// packBolt will append the PackStream encoding of the value.
+func packBolt(buf []byte, value interface{}) []byte {
+	switch value := value.(type) {
+	case nil:
+		return append(buf, 0xC0)
+	case bool:
+		if value {
+			return append(buf, 0xC3)
+		}
+
+		return append(buf, 0xC2)
+	case int:
+		return binary.BigEndian.AppendUint64(append(buf, 0xCB), uint64(value))
+	case int64:
+		return binary.BigEndian.AppendUint64(append(buf, 0xCB), uint64(value))
+	case float64:
+		return binary.BigEndian.AppendUint64(append(buf, 0xC1), math.Float64bits(value))
+	case string:
+		return append(binary.BigEndian.AppendUint32(append(buf, 0xD2), uint32(len(value))), value...)
+	case []string:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xD6), uint32(len(value)))
+		for _, item := range value {
+			buf = packBolt(buf, item)
+		}
+
+		return buf
+	case []interface{}:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xD6), uint32(len(value)))
+		for _, item := range value {
+			buf = packBolt(buf, item)
+		}
+
+		return buf
+	case map[string]interface{}:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xDA), uint32(len(value)))
+		for key, item := range value {
+			buf = packBolt(packBolt(buf, key), item)
+		}
+
+		return buf
+	case boltStruct:
+		buf = append(buf, 0xB0|byte(len(value.fields)), value.signature)
+		for _, field := range value.fields {
+			buf = packBolt(buf, field)
+		}
+
+		return buf
+	}
+
+	panic("unsupported packstream value")
+}
+
+// unpackBolt will return the PackStream value at the start of the buffer, and the rest of the buffer.
+func unpackBolt(buf []byte) (interface{}, []byte) {
+	marker, buf := buf[0], buf[1:]
+
+	size := func(width int) (int, []byte) {
+		switch width {
+		case 1:
+			return int(buf[0]), buf[1:]
+		case 2:
+			return int(binary.BigEndian.Uint16(buf)), buf[2:]
+		default:
+			return int(binary.BigEndian.Uint32(buf)), buf[4:]
+		}
+	}
+
+	list := func(n int, buf []byte) ([]interface{}, []byte) {
+		out := make([]interface{}, n)
+		for idx := range out {
+			out[idx], buf = unpackBolt(buf)
+		}
+
+		return out, buf
+	}
+
+	dict := func(n int, buf []byte) (map[string]interface{}, []byte) {
+		out := make(map[string]interface{}, n)
+		for ; n > 0; n-- {
+			var key, value interface{}
+
+			key, buf = unpackBolt(buf)
+			value, buf = unpackBolt(buf)
+			out[key.(string)] = value
+		}
+
+		return out, buf
+	}
+
+	switch {
+	case marker < 0x80:
+		return int64(marker), buf
+	case marker >= 0xF0:
+		return int64(int8(marker)), buf
+	case marker&0xF0 == 0x80:
+		n := int(marker & 0x0F)
+
+		return string(buf[:n]), buf[n:]
+	case marker&0xF0 == 0x90:
+		return list(int(marker&0x0F), buf)
+	case marker&0xF0 == 0xA0:
+		return dict(int(marker&0x0F), buf)
+	case marker&0xF0 == 0xB0:
+		fields, rest := list(int(marker&0x0F), buf[1:])
+
+		return boltStruct{signature: buf[0], fields: fields}, rest
+	}
+
+	switch marker {
+	case 0xC0:
+		return nil, buf
+	case 0xC1:
+		return math.Float64frombits(binary.BigEndian.Uint64(buf)), buf[8:]
+	case 0xC2, 0xC3:
+		return marker == 0xC3, buf
+	case 0xC8:
+		return int64(int8(buf[0])), buf[1:]
+	case 0xC9:
+		return int64(int16(binary.BigEndian.Uint16(buf))), buf[2:]
+	case 0xCA:
+		return int64(int32(binary.BigEndian.Uint32(buf))), buf[4:]
+	case 0xCB:
+		return int64(binary.BigEndian.Uint64(buf)), buf[8:]
+	case 0xD0, 0xD1, 0xD2:
+		n, buf := size(1 << (marker - 0xD0))
+
+		return string(buf[:n]), buf[n:]
+	case 0xD4, 0xD5, 0xD6:
+		n, buf := size(1 << (marker - 0xD4))
+
+		return list(n, buf)
+	case 0xD8, 0xD9, 0xDA:
+		n, buf := size(1 << (marker - 0xD8))
+
+		return dict(n, buf)
+	}
+
+	panic("unsupported packstream marker")
+}
+
+// neo4jResult is the result of the statements that start with a word, e.g. "MATCH".
+type neo4jResult struct {
+	records [][]interface{}
+	stats   map[string]interface{}
+
+	// failure is the code of the error of the statements.
+	failure string
+}
+
+// neo4jServer is a Neo4j server that speaks Bolt 4.4, which records the messages it receives and answers each
+// statement with the result for the first word of the statement.
+type neo4jServer struct {
+	listener net.Listener
+	results  map[string]neo4jResult
+
+	mtx      sync.Mutex
+	messages []boltStruct
+}
+
+func (srv *neo4jServer) serve() {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go srv.serveConn(conn)
+	}
+}
+
+func (srv *neo4jServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	// The handshake is the magic preamble and four versions, which the version 4.4 is chosen of.
+	if _, err := io.ReadFull(reader, make([]byte, 20)); err != nil {
+		return
+	}
+
+	if _, err := conn.Write([]byte{0x00, 0x00, 0x04, 0x04}); err != nil {
+		return
+	}
+
+	var (
+		pending neo4jResult
+		failed  bool
+	)
+
+	for {
+		var msg []byte
+
+		for {
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(reader, header); err != nil {
+				return
+			}
+
+			size := binary.BigEndian.Uint16(header)
+			if size == 0 {
+				break
+			}
+
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(reader, chunk); err != nil {
+				return
+			}
+
+			msg = append(msg, chunk...)
+		}
+
+		if len(msg) == 0 {
+			continue
+		}
+
+		value, _ := unpackBolt(msg)
+		req, _ := value.(boltStruct)
+
+		srv.mtx.Lock()
+		srv.messages = append(srv.messages, req)
+		srv.mtx.Unlock()
+
+		var rsps []boltStruct
+
+		success := func(meta map[string]interface{}) boltStruct {
+			return boltStruct{signature: boltSuccess, fields: []interface{}{meta}}
+		}
+
+		switch {
+		case req.signature == boltGoodbye:
+			return
+		case req.signature == boltReset:
+			failed = false
+			rsps = append(rsps, success(map[string]interface{}{}))
+		case failed:
+			rsps = append(rsps, boltStruct{signature: boltIgnored})
+		case req.signature == boltHello:
+			hello, _ := req.fields[0].(map[string]interface{})
+			if hello["principal"] != "neo4j" || hello["credentials"] != "secret" {
+				failed = true
+				rsps = append(rsps, boltStruct{signature: boltFailure, fields: []interface{}{map[string]interface{}{
+					"code": "Neo.ClientError.Security.Unauthorized", "message": "unauthorized",
+				}}})
+
+				break
+			}
+
+			rsps = append(rsps, success(map[string]interface{}{"server": "Neo4j/4.4.0", "connection_id": "bolt-1"}))
+		case req.signature == boltRoute:
+			addr := []interface{}{srv.listener.Addr().String()}
+			rsps = append(rsps, success(map[string]interface{}{"rt": map[string]interface{}{
+				"ttl": 300,
+				"db":  "graph",
+				"servers": []interface{}{
+					map[string]interface{}{"addresses": addr, "role": "WRITE"},
+					map[string]interface{}{"addresses": addr, "role": "READ"},
+					map[string]interface{}{"addresses": addr, "role": "ROUTE"},
+				},
+			}}))
+		case req.signature == boltRun:
+			query, _ := req.fields[0].(string)
+			word, _, _ := strings.Cut(query, " ")
+
+			if pending = srv.results[word]; pending.failure != "" {
+				failed = true
+				rsps = append(rsps, boltStruct{signature: boltFailure, fields: []interface{}{map[string]interface{}{
+					"code": pending.failure, "message": "invalid",
+				}}})
+
+				break
+			}
+
+			rsps = append(rsps, success(map[string]interface{}{"fields": []interface{}{"n"}, "t_first": 0}))
+		case req.signature == boltPull:
+			for _, record := range pending.records {
+				rsps = append(rsps, boltStruct{signature: boltRecord, fields: []interface{}{record}})
+			}
+
+			meta := map[string]interface{}{"has_more": false, "type": "rw", "db": "graph"}
+			if pending.stats != nil {
+				meta["stats"] = pending.stats
+			}
+
+			rsps = append(rsps, success(meta))
+			pending = neo4jResult{}
+		case req.signature == boltDiscard:
+			rsps = append(rsps, success(map[string]interface{}{"has_more": false}))
+		case req.signature == boltCommit:
+			rsps = append(rsps, success(map[string]interface{}{"bookmark": "bookmark-1"}))
+		default:
+			rsps = append(rsps, success(map[string]interface{}{}))
+		}
+
+		for _, rsp := range rsps {
+			buf := packBolt(nil, rsp)
+			if _, err := conn.Write(append(append(binary.BigEndian.AppendUint16(nil, uint16(len(buf))), buf...),
+				0x00, 0x00)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// runs will return the signatures of the statement and transaction messages, and the RUN messages.
+func (srv *neo4jServer) runs() ([]byte, []boltStruct) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	var (
+		signatures []byte
+		runs       []boltStruct
+	)
+
+	for _, msg := range srv.messages {
+		switch msg.signature {
+		case boltRun:
+			runs = append(runs, msg)
+
+			fallthrough
+		case boltBegin, boltCommit, boltRollback:
+			signatures = append(signatures, msg.signature)
+		}
+	}
+
+	return signatures, runs
+}
+
+func TestNeo4j(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	newNeo4j := func(t *testing.T, query string, results map[string]neo4jResult) (*Neo4j, *neo4jServer) {
+		t.Helper()
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+
+		t.Cleanup(func() { listener.Close() })
+
+		srv := &neo4jServer{listener: listener, results: results}
+		go srv.serve()
+
+		stg, err := NewNeo4j(ctx, "neo4j://neo4j:secret@"+listener.Addr().String()+"?database=graph&"+query)
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+
+		t.Cleanup(stg.Close)
+
+		return stg, srv
+	}
+
+	t.Run("upsert", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newNeo4j(t, "label.orders=Order&key.orders=id,region&rel.orders=customer_id:PLACED_BY:Customer"+
+			"&rel.orders=sku:CONTAINS:Product:code", nil)
+
+		records := []map[string]interface{}{
+			{"id": 1, "region": "eu", "customer_id": "c-1", "tags": []interface{}{"a", "b"},
+				"items": []interface{}{map[string]interface{}{"sku": "s-1"}}, "address": map[string]interface{}{"city": "x"}},
+		}
+
+		data, _ := json.Marshal(records)
+
+		rsp, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "orders", Data: data})
+		if err != nil || rsp.UpsertedCount != 1 {
+			t.Fatalf("failed to upsert: %v", err)
+		}
+
+		signatures, runs := srv.runs()
+		if string(signatures) != string([]byte{boltBegin, boltRun, boltCommit}) {
+			t.Fatalf("expected the records to be merged in a transaction of their own, got %x", signatures)
+		}
+
+		stmt, params := runs[0].fields[0], runs[0].fields[1].(map[string]interface{})
+
+		exp := "UNWIND $rows AS row MERGE (n:`Order` {`id`: row.keys.`id`, `region`: row.keys.`region`}) " +
+			"SET n += row.props " +
+			"FOREACH (_ IN CASE WHEN row.props.`customer_id` IS NULL THEN [] ELSE [1] END | " +
+			"MERGE (m0:`Customer` {`id`: row.props.`customer_id`}) MERGE (n)-[:`PLACED_BY`]->(m0)) " +
+			"FOREACH (_ IN CASE WHEN row.props.`sku` IS NULL THEN [] ELSE [1] END | " +
+			"MERGE (m1:`Product` {`code`: row.props.`sku`}) MERGE (n)-[:`CONTAINS`]->(m1))"
+		if stmt != exp {
+			t.Fatalf("expected statement %q, got %q", exp, stmt)
+		}
+
+		expRows := []interface{}{map[string]interface{}{
+			"keys": map[string]interface{}{"id": 1.0, "region": "eu"},
+			"props": map[string]interface{}{"id": 1.0, "region": "eu", "customer_id": "c-1",
+				"tags": []interface{}{"a", "b"}, "items": `[{"sku":"s-1"}]`, "address": `{"city":"x"}`},
+		}}
+		if !reflect.DeepEqual(params["rows"], expRows) {
+			t.Fatalf("expected rows %v, got %v", expRows, params["rows"])
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		t.Parallel()
+
+		stg, _ := newNeo4j(t, "", nil)
+
+		data, _ := json.Marshal([]map[string]interface{}{{"name": "a"}})
+		if _, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "products", Data: data}); !errors.Is(err, ErrNeo4jKey) {
+			t.Fatalf("expected error %v, got %v", ErrNeo4jKey, err)
+		}
+	})
+
+	t.Run("statement error", func(t *testing.T) {
+		t.Parallel()
+
+		stg, _ := newNeo4j(t, "", map[string]neo4jResult{
+			"UNWIND": {failure: "Neo.ClientError.Statement.SyntaxError"},
+		})
+
+		data, _ := json.Marshal([]map[string]interface{}{{"id": "a"}})
+		if _, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "products", Data: data}); !errors.Is(err, ErrNeo4j) ||
+			!strings.Contains(err.Error(), "SyntaxError") {
+			t.Fatalf("expected error %v, got %v", ErrNeo4j, err)
+		}
+	})
+
+	t.Run("read", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newNeo4j(t, "label.products=Product", map[string]neo4jResult{
+			"MATCH": {records: [][]interface{}{{map[string]interface{}{"id": "b", "price": 2}}}},
+		})
+
+		required, _ := structpb.NewStruct(map[string]interface{}{"kind": []interface{}{"x", "y"}, "deleted": nil})
+		options, _ := structpb.NewStruct(map[string]interface{}{
+			ReadOrderByOption: []interface{}{"price", "id"},
+			ReadAfterOption:   []interface{}{nil, "a"},
+			ReadLimitOption:   10,
+		})
+
+		rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "products", Required: required, Options: options})
+		if err != nil || len(rsp.Records) != 1 || rsp.Records[0].AsMap()["id"] != "b" {
+			t.Fatalf("failed to read: %v", err)
+		}
+
+		_, runs := srv.runs()
+		stmt, params := runs[0].fields[0], runs[0].fields[1]
+
+		exp := "MATCH (n:`Product`) WHERE n.`deleted` IS NULL AND n.`kind` IN $p0 AND " +
+			"((n.`price` IS NOT NULL) OR (n.`price` IS NULL AND n.`id` > $p1)) RETURN properties(n) " +
+			"ORDER BY n.`price` IS NOT NULL, n.`price`, n.`id` IS NOT NULL, n.`id` LIMIT 10"
+		if stmt != exp {
+			t.Fatalf("expected statement %q, got %q", exp, stmt)
+		}
+
+		if !reflect.DeepEqual(params, map[string]interface{}{"p0": []interface{}{"x", "y"}, "p1": "a"}) {
+			t.Fatalf("unexpected parameters %v", params)
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newNeo4j(t, "label.products=Product", map[string]neo4jResult{
+			"MATCH": {records: [][]interface{}{{42}}},
+		})
+
+		required, _ := structpb.NewStruct(map[string]interface{}{"kind": "x"})
+
+		rsp, err := stg.Count(ctx, &proto.CountRequest{Table: "products", Required: required})
+		if err != nil {
+			t.Fatalf("failed to count: %v", err)
+		}
+
+		_, runs := srv.runs()
+
+		exp := "MATCH (n:`Product`) WHERE n.`kind` = $p0 RETURN count(n)"
+		if rsp.GetCount() != 42 || runs[0].fields[0] != exp {
+			t.Fatalf("expected 42 from %q, got %d from %q", exp, rsp.GetCount(), runs[0].fields[0])
+		}
+	})
+
+	t.Run("tables", func(t *testing.T) {
+		t.Parallel()
+
+		stg, _ := newNeo4j(t, "label.products=Product&key.products=sku", map[string]neo4jResult{
+			"CALL":  {records: [][]interface{}{{"Product"}, {"Customer"}}},
+			"MATCH": {stats: map[string]interface{}{"nodes-deleted": 3}},
+		})
+
+		pks, err := stg.ListPrimaryKeys(ctx)
+		if err != nil {
+			t.Fatalf("failed to list primary keys: %v", err)
+		}
+
+		if len(pks.PKSet) != 2 || !reflect.DeepEqual(pks.PKSet["products"].List, []string{"sku"}) ||
+			!reflect.DeepEqual(pks.PKSet["Customer"].List, []string{"id"}) {
+			t.Fatalf("expected the tables of the labels, got %v", pks.PKSet)
+		}
+
+		rsp, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"products"}})
+		if err != nil || rsp.DeletedCount != 3 {
+			t.Fatalf("expected the nodes to be deleted, got %v: %v", rsp, err)
+		}
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		t.Parallel()
+
+		for _, commit := range []bool{true, false} {
+			stg, srv := newNeo4j(t, "", nil)
+
+			txn, err := stg.StartTx(ctx)
+			if err != nil {
+				t.Fatalf("failed to start transaction: %v", err)
+			}
+
+			txn.Send(func(ctx context.Context, stg Storage) error {
+				data, _ := json.Marshal([]map[string]interface{}{{"id": "a"}})
+				_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "products", Data: data})
+
+				return err
+			})
+
+			if commit {
+				err = txn.Commit()
+			} else {
+				err = txn.Rollback()
+			}
+
+			if err != nil {
+				t.Fatalf("failed to end transaction: %v", err)
+			}
+
+			exp := []byte{boltBegin, boltRun, boltCommit}
+			if !commit {
+				exp = []byte{boltBegin, boltRun, boltRollback}
+			}
+
+			if signatures, _ := srv.runs(); string(signatures) != string(exp) {
+				t.Fatalf("expected the upsert in the transaction, got %x", signatures)
+			}
+		}
+	})
+}
@@ -0,0 +1,388 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	// s3RegionParam is the object storage location parameter for the AWS region of the bucket. The default is the
+	// "AWS_REGION" environment variable.
+	s3RegionParam = "region"
+
+	// s3EndpointParam is the object storage location parameter for an S3-compatible endpoint, e.g.
+	// "http://minio:9000". Buckets on a custom endpoint are addressed with path-style URLs.
+	s3EndpointParam = "endpoint"
+
+	// cleanupTimeout is how long the clean up of staged objects, and other requests made after the context of an
+	// operation is done, can take.
+	cleanupTimeout = 15 * time.Minute
+
+	// s3PartSizeParam is the object storage location parameter for the size in bytes of the parts of multipart
+	// uploads, e.g. "partSize=16777216". Objects larger than a part are uploaded in parts.
+	s3PartSizeParam = "partSize"
+
+	// s3ConcurrencyParam is the object storage location parameter for the number of parts of a multipart upload that
+	// are uploaded at the same time, e.g. "concurrency=8".
+	s3ConcurrencyParam = "concurrency"
+
+	// s3MinPartSize is the smallest part that S3 allows, except for the last part of an upload.
+	s3MinPartSize = 5 << 20
+
+	s3DefaultPartSize    = 8 << 20
+	s3DefaultConcurrency = 4
+)
+
+var (
+	ErrUnsupportedObjectStore   = fmt.Errorf("unsupported object storage location")
+	ErrObjectStore              = fmt.Errorf("object storage request failed")
+	ErrInvalidObjectStoreOption = fmt.Errorf("invalid object storage option")
+)
+
+// UnsupportedObjectStoreError is returned when the scheme of an object storage location is not supported.
+func UnsupportedObjectStoreError(location string) error {
+	return fmt.Errorf("%w: %q, expected a \"file\", \"s3\", \"gs\", or \"azblob\" URL", ErrUnsupportedObjectStore,
+		location)
+}
+
+// InvalidObjectStoreOptionError is returned when a parameter of an object storage location is invalid.
+func InvalidObjectStoreOptionError(param, value, reason string) error {
+	return fmt.Errorf("%w: %s=%q %s", ErrInvalidObjectStoreOption, param, value, reason)
+}
+
+// ObjectStoreError is returned when an object storage request fails.
+func ObjectStoreError(method, key string, err error) error {
+	return fmt.Errorf("%w: %s %s: %v", ErrObjectStore, method, key, err)
+}
+
+// ObjectStore is a flat store of objects by key, e.g. a local directory, an S3 or a GCS bucket, or an Azure Blob
+// Storage container.
+type ObjectStore interface {
+	// Put will write the object to the key, replacing any object already at the key.
+	Put(ctx context.Context, key string, data []byte) error
+
+	// Upload will write the object read from the reader to the key, replacing any object already at the key, without
+	// holding the whole object in memory.
+	Upload(ctx context.Context, key string, r io.Reader) error
+
+	// Get will return the object at the key.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// List will return the keys of every object in the store, sorted.
+	List(ctx context.Context) ([]string, error)
+
+	// Delete will remove the object at the key. Deleting a key without an object is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// NewObjectStore will return the object store for the location, either a local directory (e.g.
+// "file:///var/lib/gidari/archive"), an S3 bucket and prefix (e.g. "s3://bucket/archive?region=us-east-1"), or a GCS
+// bucket and prefix (e.g. "gs://bucket/archive"). S3 requests are signed with the credentials of the default AWS
+// credential chain, and objects larger than the "partSize" parameter are uploaded in parts, "concurrency" parts
+// at a time. GCS requests are authorized with the access token in the "GCS_ACCESS_TOKEN" environment variable, or
+// Application Default Credentials, and objects larger than the "chunkSize" parameter are uploaded in chunks,
+// "concurrency" chunks at a time with a parallel composite upload. Azure Blob Storage containers are addressed by
+// account, container, and prefix (e.g. "azblob://account/container/archive"), with requests authorized by the "sas"
+// parameter, the "AZURE_STORAGE_SAS_TOKEN" environment variable, the managed identity of the "clientID" parameter,
+// or the default Azure credential, and objects larger than the "blockSize" parameter are uploaded in blocks,
+// "concurrency" blocks at a time.
+func NewObjectStore(location string) (ObjectStore, error) {
+	uri, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse object storage location: %w", err)
+	}
+
+	switch uri.Scheme {
+	case "file":
+		return &fileObjectStore{dir: filepath.FromSlash(uri.Path)}, nil
+	case "s3":
+		return newS3ObjectStore(uri)
+	case gcsScheme:
+		return newGCSObjectStore(uri)
+	case azblobScheme:
+		return newAzblobObjectStore(uri)
+	default:
+		return nil, UnsupportedObjectStoreError(location)
+	}
+}
+
+// fileObjectStore is an object store on a local directory, where each key is a file path relative to the directory.
+type fileObjectStore struct {
+	dir string
+}
+
+// Put will write the object to the file for the key, creating the parent directories as needed. The object is
+// written atomically, see "Upload".
+func (store *fileObjectStore) Put(ctx context.Context, key string, data []byte) error {
+	return store.Upload(ctx, key, bytes.NewReader(data))
+}
+
+// Upload will write the object to a temporary file next to the file for the key, and rename it to the file once it
+// is written, so that a failed upload does not leave a partial object.
+func (store *fileObjectStore) Upload(_ context.Context, key string, r io.Reader) error {
+	name := filepath.Join(store.dir, filepath.FromSlash(key))
+
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return ObjectStoreError(http.MethodPut, key, err)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return ObjectStoreError(http.MethodPut, key, err)
+	}
+
+	defer os.Remove(file.Name())
+
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), name)
+	}
+
+	if err != nil {
+		return ObjectStoreError(http.MethodPut, key, err)
+	}
+
+	return nil
+}
+
+// Get will return the contents of the file for the key.
+func (store *fileObjectStore) Get(_ context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(store.dir, filepath.FromSlash(key)))
+	if err != nil {
+		return nil, ObjectStoreError(http.MethodGet, key, err)
+	}
+
+	return data, nil
+}
+
+// Delete will remove the file for the key.
+func (store *fileObjectStore) Delete(_ context.Context, key string) error {
+	err := os.Remove(filepath.Join(store.dir, filepath.FromSlash(key)))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return ObjectStoreError(http.MethodDelete, key, err)
+	}
+
+	return nil
+}
+
+// List will return the paths of the files under the directory, relative to the directory.
+func (store *fileObjectStore) List(_ context.Context) ([]string, error) {
+	var keys []string
+
+	err := filepath.WalkDir(store.dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(store.dir, name)
+		if err != nil {
+			return fmt.Errorf("unable to get relative path: %w", err)
+		}
+
+		keys = append(keys, filepath.ToSlash(rel))
+
+		return nil
+	})
+	if err != nil {
+		return nil, ObjectStoreError(http.MethodGet, store.dir, err)
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// s3ObjectStore is an object store on an S3 bucket, where each key is prefixed with the path of the location.
+type s3ObjectStore struct {
+	bucket string
+	prefix string
+	client *s3.Client
+
+	// partSize is the size of the parts of multipart uploads, and concurrency is the number of parts uploaded at the
+	// same time.
+	partSize    int
+	concurrency int
+}
+
+// newS3ObjectStore will return the object store for the S3 location, with the credentials and region of the default
+// AWS configuration, see "awsCredentialChain".
+func newS3ObjectStore(uri *url.URL) (*s3ObjectStore, error) {
+	cfg, err := loadAWSConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return newS3ObjectStoreFromConfig(uri, cfg)
+}
+
+// newS3ObjectStoreFromConfig will return the object store for the S3 location, with the AWS configuration.
+func newS3ObjectStoreFromConfig(uri *url.URL, cfg aws.Config) (*s3ObjectStore, error) {
+	store := &s3ObjectStore{
+		bucket: uri.Host,
+		prefix: strings.Trim(uri.Path, "/"),
+
+		partSize:    s3DefaultPartSize,
+		concurrency: s3DefaultConcurrency,
+	}
+
+	if partSize := uri.Query().Get(s3PartSizeParam); partSize != "" {
+		size, err := strconv.Atoi(partSize)
+		if err != nil || size < s3MinPartSize {
+			return nil, InvalidObjectStoreOptionError(s3PartSizeParam, partSize,
+				fmt.Sprintf("must be at least %d bytes", s3MinPartSize))
+		}
+
+		store.partSize = size
+	}
+
+	if concurrency := uri.Query().Get(s3ConcurrencyParam); concurrency != "" {
+		count, err := parseUploadConcurrency(concurrency)
+		if err != nil {
+			return nil, err
+		}
+
+		store.concurrency = count
+	}
+
+	if region := uri.Query().Get(s3RegionParam); region != "" {
+		cfg.Region = region
+	}
+
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("%w: set the %q parameter or AWS_REGION", ErrMissingAWSRegion, s3RegionParam)
+	}
+
+	endpoint := uri.Query().Get(s3EndpointParam)
+
+	store.client = s3.NewFromConfig(cfg, func(opts *s3.Options) {
+		if endpoint != "" {
+			opts.BaseEndpoint = aws.String(endpoint)
+			opts.UsePathStyle = true
+		}
+	})
+
+	return store, nil
+}
+
+// objectKey will return the key of the object in the bucket.
+func (store *s3ObjectStore) objectKey(key string) string {
+	return path.Join(store.prefix, key)
+}
+
+// Put will upload the object to the key, in parts if it is larger than the part size.
+func (store *s3ObjectStore) Put(ctx context.Context, key string, data []byte) error {
+	return store.Upload(ctx, key, bytes.NewReader(data))
+}
+
+// Upload will upload the object read from the reader to the key. An object that fits in a single part is uploaded
+// with a single request, and larger objects are uploaded with a multipart upload, reading one part at a time and
+// uploading up to "concurrency" parts at the same time. A multipart upload that fails is aborted, so that its parts are
+// not stored.
+func (store *s3ObjectStore) Upload(ctx context.Context, key string, r io.Reader) error {
+	uploader := manager.NewUploader(store.client, func(uploader *manager.Uploader) {
+		uploader.PartSize = int64(store.partSize)
+		uploader.Concurrency = store.concurrency
+	})
+
+	_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(store.objectKey(key)),
+		Body:   r,
+	})
+	if err != nil {
+		return ObjectStoreError(http.MethodPut, key, err)
+	}
+
+	return nil
+}
+
+// Get will download the object at the key.
+func (store *s3ObjectStore) Get(ctx context.Context, key string) ([]byte, error) {
+	out, err := store.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(store.objectKey(key)),
+	})
+	if err != nil {
+		return nil, ObjectStoreError(http.MethodGet, key, err)
+	}
+
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, ObjectStoreError(http.MethodGet, key, err)
+	}
+
+	return data, nil
+}
+
+// Delete will delete the object at the key.
+func (store *s3ObjectStore) Delete(ctx context.Context, key string) error {
+	_, err := store.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(store.objectKey(key)),
+	})
+	if err != nil {
+		return ObjectStoreError(http.MethodDelete, key, err)
+	}
+
+	return nil
+}
+
+// List will return the keys of the objects under the prefix of the location, relative to the prefix.
+func (store *s3ObjectStore) List(ctx context.Context) ([]string, error) {
+	var keys []string
+
+	prefix := store.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(store.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(store.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, ObjectStoreError(http.MethodGet, prefix, err)
+		}
+
+		for _, object := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.ToString(object.Key), prefix))
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
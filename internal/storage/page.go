@@ -0,0 +1,89 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"fmt"
+
+	"github.com/alpine-hodler/gidari/proto"
+)
+
+const (
+	// ReadOrderByOption is the read request option with the list of columns that the records are sorted by, in
+	// ascending order.
+	ReadOrderByOption = "orderBy"
+
+	// ReadAfterOption is the read request option with the list of values of the "orderBy" columns that the records
+	// must sort after, i.e. the values of the last record of the previous page.
+	ReadAfterOption = "after"
+
+	// ReadLimitOption is the read request option with the maximum number of records to return.
+	ReadLimitOption = "limit"
+)
+
+var ErrInvalidReadOptions = fmt.Errorf("invalid read options")
+
+// InvalidReadOptionsError is returned when the options of a read request are not valid.
+func InvalidReadOptionsError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidReadOptions, reason)
+}
+
+// readPage is the page of records requested by the options of a read request. The records of a page are sorted by
+// the "orderBy" columns and start after the "after" values, so that paging through a table with a unique sort key is
+// consistent while records are being upserted.
+type readPage struct {
+	orderBy []string
+	after   []interface{}
+	limit   int
+}
+
+// parseReadPage will parse the page from the options of the read request, or return nil if no page is requested.
+func parseReadPage(req *proto.ReadRequest) (*readPage, error) {
+	opts := req.GetOptions().AsMap()
+	if len(opts) == 0 {
+		return nil, nil
+	}
+
+	page := new(readPage)
+
+	if orderBy, ok := opts[ReadOrderByOption]; ok {
+		columns, ok := orderBy.([]interface{})
+		if !ok {
+			return nil, InvalidReadOptionsError("orderBy must be a list of columns")
+		}
+
+		for _, column := range columns {
+			name, ok := column.(string)
+			if !ok || name == "" {
+				return nil, InvalidReadOptionsError("orderBy must be a list of columns")
+			}
+
+			page.orderBy = append(page.orderBy, name)
+		}
+	}
+
+	if after, ok := opts[ReadAfterOption]; ok {
+		values, ok := after.([]interface{})
+		if !ok || len(values) != len(page.orderBy) {
+			return nil, InvalidReadOptionsError("after must have a value for each orderBy column")
+		}
+
+		page.after = values
+	}
+
+	if limit, ok := opts[ReadLimitOption]; ok {
+		size, ok := limit.(float64)
+		if !ok || size < 1 || size != float64(int(size)) {
+			return nil, InvalidReadOptionsError("limit must be a positive integer")
+		}
+
+		page.limit = int(size)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestReadPage(t *testing.T) {
+	t.Parallel()
+
+	newReq := func(t *testing.T, opts map[string]interface{}) *proto.ReadRequest {
+		t.Helper()
+
+		pbopts, err := structpb.NewStruct(opts)
+		if err != nil {
+			t.Fatalf("failed to create options: %v", err)
+		}
+
+		return &proto.ReadRequest{Table: "trades", Options: pbopts}
+	}
+
+	t.Run("postgres clauses", func(t *testing.T) {
+		t.Parallel()
+
+		page, err := parseReadPage(newReq(t, map[string]interface{}{
+			ReadOrderByOption: []interface{}{"product_id", "id"},
+			ReadAfterOption:   []interface{}{"BTC-USD", 7},
+			ReadLimitOption:   10,
+		}))
+		if err != nil {
+			t.Fatalf("failed to parse page: %v", err)
+		}
+
+		conditions, args, clauses := PostgresDialect.pageClauses(page, []string{`"side" = $1`}, []interface{}{"buy"})
+
+		expConditions := []string{`"side" = $1`, `("product_id", "id") > ($2, $3)`}
+		if !reflect.DeepEqual(conditions, expConditions) {
+			t.Fatalf("expected conditions %v, got %v", expConditions, conditions)
+		}
+
+		if expArgs := []interface{}{"buy", "BTC-USD", 7.0}; !reflect.DeepEqual(args, expArgs) {
+			t.Fatalf("expected args %v, got %v", expArgs, args)
+		}
+
+		if exp := ` ORDER BY "product_id", "id" LIMIT 10`; clauses != exp {
+			t.Fatalf("expected clauses %q, got %q", exp, clauses)
+		}
+	})
+
+	t.Run("mongo filter", func(t *testing.T) {
+		t.Parallel()
+
+		page, err := parseReadPage(newReq(t, map[string]interface{}{
+			ReadOrderByOption: []interface{}{"a", "b"},
+			ReadAfterOption:   []interface{}{1, 2},
+		}))
+		if err != nil {
+			t.Fatalf("failed to parse page: %v", err)
+		}
+
+		exp := bson.M{"$or": bson.A{
+			bson.M{"a": bson.M{"$gt": 1.0}},
+			bson.M{"a": 1.0, "b": bson.M{"$gt": 2.0}},
+		}}
+
+		if filter := pageFilter(page, bson.M{}); !reflect.DeepEqual(filter, exp) {
+			t.Fatalf("expected filter %v, got %v", exp, filter)
+		}
+	})
+
+	t.Run("no options", func(t *testing.T) {
+		t.Parallel()
+
+		page, err := parseReadPage(&proto.ReadRequest{Table: "trades"})
+		if err != nil || page != nil {
+			t.Fatalf("expected no page, got %+v, %v", page, err)
+		}
+	})
+
+	for _, opts := range []map[string]interface{}{
+		{ReadOrderByOption: "id"},
+		{ReadOrderByOption: []interface{}{"id"}, ReadAfterOption: []interface{}{1, 2}},
+		{ReadLimitOption: 0},
+		{ReadLimitOption: 1.5},
+	} {
+		opts := opts
+
+		t.Run("invalid", func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := parseReadPage(newReq(t, opts)); !errors.Is(err, ErrInvalidReadOptions) {
+				t.Fatalf("expected invalid read options for %v, got %v", opts, err)
+			}
+		})
+	}
+}
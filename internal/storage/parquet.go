@@ -0,0 +1,692 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	parquetScheme = "s3"
+
+	// parquetPartitionByParam is the connection string parameter for the comma separated fields that the files of a
+	// table are partitioned by, e.g. "partitionBy=date,region".
+	parquetPartitionByParam = "partitionBy"
+
+	// parquetCompressionParam is the connection string parameter for the compression codec of the files, "gzip" (the
+	// default), "zstd", or "none".
+	parquetCompressionParam = "compression"
+
+	// parquetFormatParam is the connection string parameter for the format of the files, "parquet" (the default) or
+	// "jsonl" for newline-delimited JSON. On a "file://" URL, "jsonl" appends to files instead, see "NewFilesystem".
+	parquetFormatParam = "format"
+
+	// parquetNameParam is the connection string parameter for the template of the name of the files in the directory
+	// of their partition, e.g. "name=dt={date}/run-{run}". This parameter defaults to "part-{hash}".
+	parquetNameParam = "name"
+
+	// parquetBatchParam is the connection string parameter for how the records of Parquet files are encoded, "rows"
+	// (the default) or "arrow" for Arrow record batches, see "writeArrowParquet".
+	parquetBatchParam = "batch"
+
+	parquetFormat = "parquet"
+	jsonlFormat   = "jsonl"
+
+	rowsBatch  = "rows"
+	arrowBatch = "arrow"
+
+	parquetDefaultName = "part-{hash}"
+
+	parquetExt = ".parquet"
+
+	// parquetDefaultPartition is the partition of records with a null or missing partition field, as named by Hive.
+	parquetDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+)
+
+type parquetTxType uint8
+
+const (
+	basicParquetTxID parquetTxType = iota
+)
+
+// parquetPlaceholders are the placeholders of the name template of the files.
+var parquetPlaceholders = []string{"{hash}", "{run}", "{date}", "{time}"}
+
+// parquetTx are the records of a transaction by partition directory, written when the transaction commits.
+type parquetTx struct {
+	mtx        sync.Mutex
+	partitions map[string][]*structpb.Struct
+}
+
+// Parquet is a storage device that appends records to Parquet files in object storage, e.g. an S3 or a GCS bucket,
+// so that runs can feed a data lake. Each upsert writes a file for each partition of its records, at
+// "<table>/<field>=<value>/part-<hash>.parquet" with a Hive-style directory for each field that the table is
+// partitioned by. Within a transaction, i.e. a run, the records of each partition are written to a single file when
+// the transaction commits. The files can be gzip or zstd compressed newline-delimited JSON instead, at
+// "part-<hash>.jsonl.gz" or "part-<hash>.jsonl.zst", and their names can be set with a template. Parquet files can be
+// encoded from Arrow record batches instead of rows.
+type Parquet struct {
+	store       ObjectStore
+	partitionBy []string
+	codec       int32
+	format      string
+	arrow       bool
+
+	// name is the template of the name of the files, and run is the value of its "{run}" placeholder.
+	name string
+	run  string
+
+	// activeTx are the transactions that are currently active, keyed by the transaction ID that is added to the
+	// context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewParquet will return a Parquet storage device for the connection string, i.e. "s3://<bucket>/<prefix>
+// [?partitionBy=<fields>&compression=<codec>&format=<format>&name=<template>&batch=<batch>]", or
+// "gs://<bucket>/<prefix>" for GCS. The other parameters of the connection string are the parameters of the object
+// store, see "NewObjectStore", so a "file://" URL writes the files to a local directory.
+func NewParquet(_ context.Context, connectionURL string) (*Parquet, error) {
+	uri, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	params := uri.Query()
+	stg := &Parquet{codec: parquetGzip, format: parquetFormat, name: parquetDefaultName, run: uuid.New().String()}
+
+	for _, field := range strings.Split(params.Get(parquetPartitionByParam), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			stg.partitionBy = append(stg.partitionBy, field)
+		}
+	}
+
+	switch compression := params.Get(parquetCompressionParam); compression {
+	case "", "gzip":
+	case "zstd":
+		stg.codec = parquetZstd
+	case "none":
+		stg.codec = parquetUncompressed
+	default:
+		return nil, fmt.Errorf("%w: %s=%q must be \"gzip\", \"zstd\", or \"none\"", ErrDNSNotSupported,
+			parquetCompressionParam, compression)
+	}
+
+	switch format := params.Get(parquetFormatParam); format {
+	case "", parquetFormat:
+	case jsonlFormat:
+		stg.format = jsonlFormat
+	default:
+		return nil, fmt.Errorf("%w: %s=%q must be %q or %q", ErrDNSNotSupported, parquetFormatParam, format,
+			parquetFormat, jsonlFormat)
+	}
+
+	switch batch := params.Get(parquetBatchParam); {
+	case batch == "" || batch == rowsBatch:
+	case batch == arrowBatch && stg.format == parquetFormat:
+		stg.arrow = true
+	default:
+		return nil, fmt.Errorf("%w: %s=%q must be %q, or %q for %q files", ErrDNSNotSupported, parquetBatchParam,
+			batch, rowsBatch, arrowBatch, parquetFormat)
+	}
+
+	if name := params.Get(parquetNameParam); name != "" {
+		if err := validateParquetName(name); err != nil {
+			return nil, err
+		}
+
+		stg.name = name
+	}
+
+	params.Del(parquetPartitionByParam)
+	params.Del(parquetCompressionParam)
+	params.Del(parquetFormatParam)
+	params.Del(parquetNameParam)
+	params.Del(parquetBatchParam)
+	uri.RawQuery = params.Encode()
+
+	if stg.store, err = NewObjectStore(uri.String()); err != nil {
+		return nil, fmt.Errorf("invalid parquet location: %w", err)
+	}
+
+	return stg, nil
+}
+
+// validateParquetName will return an error if the name template does not vary between runs, has an unknown
+// placeholder, or has a segment that is not a file name.
+func validateParquetName(name string) error {
+	rendered := name
+	for _, placeholder := range parquetPlaceholders {
+		rendered = strings.ReplaceAll(rendered, placeholder, "x")
+	}
+
+	invalid := strings.ContainsAny(rendered, "{}")
+	for _, segment := range strings.Split(rendered, "/") {
+		invalid = invalid || segment == "" || segment == "." || segment == ".."
+	}
+
+	if invalid || (!strings.Contains(name, "{hash}") && !strings.Contains(name, "{run}")) {
+		return fmt.Errorf("%w: %s=%q must be a relative path with \"{hash}\" or \"{run}\", and the placeholders %s",
+			ErrDNSNotSupported, parquetNameParam, name, strings.Join(parquetPlaceholders, ", "))
+	}
+
+	return nil
+}
+
+// Close implements the storage interface. The object store does not hold a connection open.
+func (stg *Parquet) Close() {}
+
+// IsNoSQL returns "true" to indicate that "Parquet" appends records without updating them by primary key.
+func (stg *Parquet) IsNoSQL() bool { return true }
+
+// Type implements the storage interface.
+func (stg *Parquet) Type() uint8 { return ParquetType }
+
+// partitionValue will return the directory value of a partition field: strings as they are, other values as JSON,
+// and the default partition for null values.
+func partitionValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return parquetDefaultPartition
+	case string:
+		return url.PathEscape(value)
+	default:
+		data, _ := json.Marshal(value)
+
+		return url.PathEscape(string(data))
+	}
+}
+
+// partitionDir will return the directory of the partition of the record in the table, and remove the partition
+// fields from the record, since they are stored in the directory.
+func (stg *Parquet) partitionDir(table string, record *structpb.Struct) string {
+	dir := url.PathEscape(table)
+
+	for _, field := range stg.partitionBy {
+		dir += "/" + url.PathEscape(field) + "=" + partitionValue(record.GetFields()[field].AsInterface())
+		delete(record.GetFields(), field)
+	}
+
+	return dir
+}
+
+// Upsert will append the records to the table, with a file for each partition of the records. Upserting the same
+// records to a partition again replaces their file. Within a transaction, the records are buffered, and written with
+// a file for each partition of the records of the transaction when it commits.
+func (stg *Parquet) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	partitions := make(map[string][]*structpb.Struct)
+
+	for _, record := range records {
+		dir := stg.partitionDir(req.GetTable(), record)
+		partitions[dir] = append(partitions[dir], record)
+	}
+
+	if tx := stg.tx(ctx); tx != nil {
+		tx.mtx.Lock()
+		defer tx.mtx.Unlock()
+
+		for dir, recs := range partitions {
+			tx.partitions[dir] = append(tx.partitions[dir], recs...)
+		}
+
+		return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+	}
+
+	files, err := stg.encodeFiles(partitions, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := stg.put(ctx, files); err != nil {
+		return nil, err
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+}
+
+// encodeFiles will encode the records of each partition directory as a file, keyed by the path of the file.
+func (stg *Parquet) encodeFiles(partitions map[string][]*structpb.Struct,
+	now time.Time,
+) (map[string][]byte, error) {
+	files := make(map[string][]byte, len(partitions))
+
+	for dir, records := range partitions {
+		data, err := stg.encode(records)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode records of %s: %w", dir, err)
+		}
+
+		files[stg.fileKey(dir, data, now)] = data
+	}
+
+	return files, nil
+}
+
+// fileKey will return the path of the file in the directory of its partition, named by the template. The "{hash}"
+// placeholder is the hash of the file, so that a retried upsert replaces the file of the first try instead of
+// appending the records again.
+func (stg *Parquet) fileKey(dir string, data []byte, now time.Time) string {
+	digest := sha256.Sum256(data)
+	now = now.UTC()
+
+	name := strings.NewReplacer(
+		"{hash}", hex.EncodeToString(digest[:16]),
+		"{run}", stg.run,
+		"{date}", now.Format("2006-01-02"),
+		"{time}", now.Format("20060102T150405Z"),
+	).Replace(stg.name)
+
+	return dir + "/" + name + stg.ext()
+}
+
+// ext will return the extension of the files, for their format and compression.
+func (stg *Parquet) ext() string {
+	switch {
+	case stg.format == parquetFormat:
+		return parquetExt
+	case stg.codec == parquetUncompressed:
+		return ".jsonl"
+	case stg.codec == parquetZstd:
+		return ".jsonl.zst"
+	default:
+		return ".jsonl.gz"
+	}
+}
+
+// encode will encode the records as a file in the format of the storage.
+func (stg *Parquet) encode(records []*structpb.Struct) ([]byte, error) {
+	if stg.arrow {
+		return writeArrowParquet(records, stg.codec)
+	}
+
+	maps := make([]map[string]interface{}, len(records))
+	for idx, record := range records {
+		maps[idx] = record.AsMap()
+	}
+
+	if stg.format == parquetFormat {
+		return writeParquet(maps, stg.codec)
+	}
+
+	data, err := encodeJSONL(maps)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err = parquetCompress(stg.codec, data); err != nil {
+		return nil, fmt.Errorf("unable to compress records: %w", err)
+	}
+
+	return data, nil
+}
+
+// decode will return the records of a file in the format of the storage.
+func (stg *Parquet) decode(data []byte) ([]map[string]interface{}, error) {
+	if stg.format == parquetFormat {
+		return readParquet(data)
+	}
+
+	data, err := parquetDecompress(stg.codec, data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress records: %w", err)
+	}
+
+	var records []map[string]interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var record map[string]interface{}
+		if err := dec.Decode(&record); err != nil {
+			return nil, fmt.Errorf("%w: %v", tools.ErrFailedToUnmarshalJSON, err)
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// put will write the files to the object store. If a file fails to be written, the files already written are
+// deleted, so that the records are written all or nothing.
+func (stg *Parquet) put(ctx context.Context, files map[string][]byte) error {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for idx, key := range keys {
+		if err := stg.store.Put(ctx, key, files[key]); err != nil {
+			for _, written := range keys[:idx] {
+				_ = stg.store.Delete(ctx, written)
+			}
+
+			return fmt.Errorf("unable to write %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *Parquet) tx(ctx context.Context) *parquetTx {
+	txID, ok := ctx.Value(basicParquetTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	parquetTx, _ := tx.(*parquetTx)
+
+	return parquetTx
+}
+
+// files will return the keys of the files of the tables, or of every table if there are none.
+func (stg *Parquet) files(ctx context.Context, tables ...string) ([]string, error) {
+	keys, err := stg.store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list files: %w", err)
+	}
+
+	var files []string
+
+	for _, key := range keys {
+		if !strings.HasSuffix(key, stg.ext()) || !strings.Contains(key, "/") {
+			continue
+		}
+
+		dir, _, _ := strings.Cut(key, "/")
+
+		matched := len(tables) == 0
+		for _, table := range tables {
+			matched = matched || dir == url.PathEscape(table)
+		}
+
+		if matched {
+			files = append(files, key)
+		}
+	}
+
+	return files, nil
+}
+
+// filePartition will return the values of the partition fields in the directories of the key, and whether they
+// match the required values of those fields. Partition values are read as strings.
+func filePartition(key string, required map[string]*structpb.Value) (map[string]interface{}, bool) {
+	segments := strings.Split(path.Dir(key), "/")
+	partition := make(map[string]interface{})
+
+	for _, segment := range segments[1:] {
+		escapedField, escapedValue, ok := strings.Cut(segment, "=")
+		if !ok {
+			continue
+		}
+
+		field, _ := url.PathUnescape(escapedField)
+		value, _ := url.PathUnescape(escapedValue)
+
+		partition[field] = value
+		if escapedValue == parquetDefaultPartition {
+			partition[field] = nil
+		}
+
+		want, ok := required[field]
+		if !ok {
+			continue
+		}
+
+		values := []*structpb.Value{want}
+		if list := want.GetListValue(); list != nil {
+			values = list.GetValues()
+		}
+
+		matched := false
+		for _, value := range values {
+			matched = matched || partitionValue(value.AsInterface()) == escapedValue
+		}
+
+		if !matched {
+			return nil, false
+		}
+	}
+
+	return partition, true
+}
+
+// parquetMatches will return true if the record has the required values, other than the values of the partition
+// fields, which are matched by their directories. A required list matches any of its values.
+func parquetMatches(record, partition map[string]interface{}, required map[string]*structpb.Value) bool {
+	for name, want := range required {
+		if _, ok := partition[name]; ok {
+			continue
+		}
+
+		got, ok := record[name]
+		if !ok {
+			return false
+		}
+
+		values := []*structpb.Value{want}
+		if list := want.GetListValue(); list != nil {
+			values = list.GetValues()
+		}
+
+		matched := false
+		for _, value := range values {
+			matched = matched || compareRedisValues(got, value.AsInterface()) == 0
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Read will return the records of the table that match the required fields on the request, in the page requested by
+// the options of the request, if any. Only the files of the partitions that match the required partition fields are
+// read, and the partition fields are added to the records as strings.
+func (stg *Parquet) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := stg.files(ctx, req.GetTable())
+	if err != nil {
+		return nil, err
+	}
+
+	required := req.GetRequired().GetFields()
+
+	var records []map[string]interface{}
+
+	for _, key := range keys {
+		partition, ok := filePartition(key, required)
+		if !ok {
+			continue
+		}
+
+		data, err := stg.store.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", key, err)
+		}
+
+		recs, err := stg.decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode %s: %w", key, err)
+		}
+
+		for _, rec := range recs {
+			for field, value := range partition {
+				if value != nil {
+					rec[field] = value
+				}
+			}
+
+			if parquetMatches(rec, partition, required) {
+				records = append(records, rec)
+			}
+		}
+	}
+
+	return redisPage(records, page)
+}
+
+// Count will return the number of rows in the objects of the table that match the required fields, by reading them.
+func (stg *Parquet) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	return readCount(ctx, stg, req)
+}
+
+// Truncate will delete the files of the tables, and count the records deleted from the footers of the Parquet files,
+// or from the lines of the JSON files.
+func (stg *Parquet) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	if len(req.GetTables()) == 0 {
+		return &proto.TruncateResponse{}, nil
+	}
+
+	keys, err := stg.files(ctx, req.GetTables()...)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted int32
+
+	for _, key := range keys {
+		data, err := stg.store.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", key, err)
+		}
+
+		rows, err := stg.numRows(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode %s: %w", key, err)
+		}
+
+		if err := stg.store.Delete(ctx, key); err != nil {
+			return nil, fmt.Errorf("error truncating %s: %w", key, err)
+		}
+
+		deleted += int32(rows)
+	}
+
+	return &proto.TruncateResponse{DeletedCount: deleted}, nil
+}
+
+// numRows will return the number of records in a file.
+func (stg *Parquet) numRows(data []byte) (int64, error) {
+	if stg.format == parquetFormat {
+		return parquetNumRows(data)
+	}
+
+	records, err := stg.decode(data)
+
+	return int64(len(records)), err
+}
+
+// ListTables will return the tables with at least one file. The size of every table is zero.
+func (stg *Parquet) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	keys, err := stg.files(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+
+	for _, key := range keys {
+		dir, _, _ := strings.Cut(key, "/")
+		if table, err := url.PathUnescape(dir); err == nil {
+			rsp.TableSet[table] = &proto.Table{}
+		}
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will return no primary keys, since the records of Parquet files are appended without keys.
+func (stg *Parquet) ListPrimaryKeys(_ context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	return &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}, nil
+}
+
+// StartTx will start a transaction. The records of the functions sent to the transaction are buffered, and written
+// with a file for each partition when the transaction commits. If a file fails to be written, the files of the
+// transaction already written are deleted. Reads in the transaction do not see its buffered records.
+func (stg *Parquet) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+	tx := &parquetTx{partitions: make(map[string][]*structpb.Struct)}
+
+	stg.activeTx.Store(txnID, tx)
+
+	parquetCtx := context.WithValue(ctx, basicParquetTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+
+		var err error
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(parquetCtx, stg)
+		}
+
+		if err != nil {
+			<-txn.commit
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit {
+			files, err := stg.encodeFiles(tx.partitions, time.Now())
+			if err == nil {
+				err = stg.put(ctx, files)
+			}
+
+			txn.done <- err
+		} else {
+			txn.done <- nil
+		}
+	}()
+
+	return txn, nil
+}
@@ -0,0 +1,296 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/internal/storage/storagetest"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/parquet-go/parquet-go"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func newParquet(t *testing.T, params string) (*storage.Service, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	stg, err := storage.New(context.Background(), "file://"+filepath.ToSlash(dir)+params)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	t.Cleanup(stg.Close)
+
+	return stg, dir
+}
+
+func readParquet(t *testing.T, stg storage.Storage, req *proto.ReadRequest) []map[string]interface{} {
+	t.Helper()
+
+	rsp, err := stg.Read(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+
+	records := make([]map[string]interface{}, 0, len(rsp.GetRecords()))
+	for _, record := range rsp.GetRecords() {
+		records = append(records, record.AsMap())
+	}
+
+	return records
+}
+
+func TestParquet(t *testing.T) {
+	t.Parallel()
+
+	t.Run("conformance", func(t *testing.T) {
+		t.Parallel()
+
+		for _, params := range []string{"", "?batch=arrow"} {
+			stg, _ := newParquet(t, params)
+			if stg.Type() != storage.ParquetType || !stg.IsNoSQL() {
+				t.Fatalf("expected a NoSQL parquet storage, got type %d", stg.Type())
+			}
+
+			storagetest.Run(t, stg, "conformance")
+		}
+	})
+
+	t.Run("column types", func(t *testing.T) {
+		t.Parallel()
+
+		for _, params := range []string{
+			"", "?compression=zstd", "?compression=none", "?batch=arrow", "?batch=arrow&compression=zstd",
+			"?batch=arrow&compression=none",
+		} {
+			stg, _ := newParquet(t, params)
+
+			// Enough records for the booleans to span several bytes, and enough columns for a wide schema.
+			var records []map[string]interface{}
+
+			for idx := 0; idx < 20; idx++ {
+				record := map[string]interface{}{
+					"id":    float64(idx),
+					"price": float64(idx) + 0.5,
+					"ok":    idx%3 == 0,
+					"name":  strings.Repeat("a", idx),
+					"tags":  []interface{}{"x", float64(idx)},
+					"meta":  map[string]interface{}{"n": float64(idx)},
+					"mixed": "1",
+				}
+
+				if idx%2 == 1 {
+					record["mixed"] = float64(idx)
+					record["note"] = "odd"
+				}
+
+				for col := 0; col < 10; col++ {
+					record["c"+string(rune('a'+col))] = float64(col)
+				}
+
+				records = append(records, record)
+			}
+
+			if err := upsertRedis(t, stg, "candles", records...); err != nil {
+				t.Fatalf("failed to upsert records: %v", err)
+			}
+
+			opts, err := structpb.NewStruct(map[string]interface{}{storage.ReadOrderByOption: []interface{}{"id"}})
+			if err != nil {
+				t.Fatalf("failed to create read options: %v", err)
+			}
+
+			got := readParquet(t, stg, &proto.ReadRequest{Table: "candles", Options: opts})
+			if !reflect.DeepEqual(got, records) {
+				t.Fatalf("expected records %v, got %v", records, got)
+			}
+		}
+	})
+
+	t.Run("interoperability", func(t *testing.T) {
+		t.Parallel()
+
+		// candle is a row of a file written by another Parquet writer, with types that gidari does not write.
+		type candle struct {
+			ID    int32   `parquet:"id"`
+			Price float32 `parquet:"price"`
+			Name  *string `parquet:"name,optional"`
+			Meta  string  `parquet:"meta,json"`
+		}
+
+		stg, dir := newParquet(t, "")
+		name := "a"
+
+		if err := os.MkdirAll(filepath.Join(dir, "candles"), 0o755); err != nil {
+			t.Fatalf("failed to create table: %v", err)
+		}
+
+		path := filepath.Join(dir, "candles", "part-0.parquet")
+		if err := parquet.WriteFile(path, []candle{
+			{ID: 1, Price: 1.5, Name: &name, Meta: `{"n":1}`},
+			{ID: 2, Price: 2.5, Meta: `[1]`},
+		}); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+
+		got := readParquet(t, stg, &proto.ReadRequest{Table: "candles"})
+		exp := []map[string]interface{}{
+			{"id": 1.0, "price": 1.5, "name": "a", "meta": map[string]interface{}{"n": 1.0}},
+			{"id": 2.0, "price": 2.5, "meta": []interface{}{1.0}},
+		}
+
+		if !reflect.DeepEqual(got, exp) {
+			t.Fatalf("expected records %v, got %v", exp, got)
+		}
+
+		// The files that gidari writes can be read by other Parquet readers.
+		if _, err := stg.Truncate(context.Background(), &proto.TruncateRequest{Tables: []string{"candles"}}); err != nil {
+			t.Fatalf("failed to truncate table: %v", err)
+		}
+
+		records := []map[string]interface{}{{"id": 3, "price": 0.25, "name": "b", "meta": map[string]interface{}{}}}
+		if err := upsertRedis(t, stg, "candles", records...); err != nil {
+			t.Fatalf("failed to upsert records: %v", err)
+		}
+
+		files, _ := filepath.Glob(filepath.Join(dir, "candles", "*.parquet"))
+		if len(files) != 1 {
+			t.Fatalf("expected a single file, got %v", files)
+		}
+
+		type written struct {
+			ID    *int64   `parquet:"id,optional"`
+			Price *float64 `parquet:"price,optional"`
+			Name  *string  `parquet:"name,optional"`
+			Meta  *string  `parquet:"meta,optional,json"`
+		}
+
+		rows, err := parquet.ReadFile[written](files[0])
+		if err != nil || len(rows) != 1 {
+			t.Fatalf("failed to read the written file: %v %v", rows, err)
+		}
+
+		if row := rows[0]; *row.ID != 3 || *row.Price != 0.25 || *row.Name != "b" || *row.Meta != "{}" {
+			t.Fatalf("unexpected row: %d %v %s %s", *row.ID, *row.Price, *row.Name, *row.Meta)
+		}
+	})
+
+	t.Run("partitions", func(t *testing.T) {
+		t.Parallel()
+
+		stg, dir := newParquet(t, "?partitionBy=region,day")
+		ctx := context.Background()
+
+		records := []map[string]interface{}{
+			{"id": 1, "region": "us/east", "day": 1, "price": 1.5},
+			{"id": 2, "region": "eu", "day": 1},
+			{"id": 3, "region": "us/east", "day": 2},
+			{"id": 4, "day": 1},
+		}
+
+		if err := upsertRedis(t, stg, "candles", records...); err != nil {
+			t.Fatalf("failed to upsert records: %v", err)
+		}
+
+		var files []string
+
+		_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				rel, _ := filepath.Rel(dir, filepath.Dir(path))
+				files = append(files, filepath.ToSlash(rel))
+			}
+
+			return err
+		})
+
+		exp := []string{
+			"candles/region=__HIVE_DEFAULT_PARTITION__/day=1",
+			"candles/region=eu/day=1",
+			"candles/region=us%2Feast/day=1",
+			"candles/region=us%2Feast/day=2",
+		}
+
+		if !reflect.DeepEqual(files, exp) {
+			t.Fatalf("expected a file in each partition %v, got %v", exp, files)
+		}
+
+		// The partition fields are read from the directories of the files that match them, as strings.
+		req := &proto.ReadRequest{Table: "candles"}
+		if err := tools.AssignReadRequired(req, "region", "us/east"); err != nil {
+			t.Fatalf("failed to assign required fields: %v", err)
+		}
+
+		if err := tools.AssignReadRequired(req, "day", 1); err != nil {
+			t.Fatalf("failed to assign required fields: %v", err)
+		}
+
+		got := readParquet(t, stg, req)
+		if record := map[string]interface{}{"id": 1.0, "region": "us/east", "day": "1", "price": 1.5}; len(got) != 1 ||
+			!reflect.DeepEqual(got[0], record) {
+			t.Fatalf("expected record %v, got %v", record, got)
+		}
+
+		tables, err := stg.ListTables(ctx)
+		if err != nil {
+			t.Fatalf("failed to list tables: %v", err)
+		}
+
+		if _, ok := tables.GetTableSet()["candles"]; !ok || len(tables.GetTableSet()) != 1 {
+			t.Fatalf("expected table candles, got %v", tables.GetTableSet())
+		}
+
+		truncated, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"candles"}})
+		if err != nil {
+			t.Fatalf("failed to truncate tables: %v", err)
+		}
+
+		if truncated.GetDeletedCount() != 4 {
+			t.Fatalf("expected 4 deleted records, got %d", truncated.GetDeletedCount())
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		for _, params := range []string{"?compression=lz4", "?batch=columns"} {
+			_, err := storage.New(context.Background(), "file:///tmp/lake"+params)
+			if !errors.Is(err, storage.ErrDNSNotSupported) {
+				t.Fatalf("expected dns not supported error for %s, got %v", params, err)
+			}
+		}
+
+		dir := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(dir, "candles"), 0o755); err != nil {
+			t.Fatalf("failed to create table: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, "candles", "part-0.parquet"), []byte("PAR1"), 0o600); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+
+		stg, err := storage.New(context.Background(), "file://"+filepath.ToSlash(dir))
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+
+		if _, err := stg.Read(context.Background(), &proto.ReadRequest{Table: "candles"}); !errors.Is(err,
+			storage.ErrInvalidParquet) {
+			t.Fatalf("expected invalid parquet error, got %v", err)
+		}
+	})
+}
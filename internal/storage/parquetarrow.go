@@ -0,0 +1,188 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/extensions"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	arrowparquet "github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// arrowKind will return the kind of column that a record value is written to, like "parquetKind", or "" for null
+// values.
+func arrowKind(value *structpb.Value) string {
+	switch kind := value.GetKind().(type) {
+	case nil, *structpb.Value_NullValue:
+		return ""
+	case *structpb.Value_StringValue:
+		return "string"
+	case *structpb.Value_BoolValue:
+		return "bool"
+	case *structpb.Value_NumberValue:
+		if number := kind.NumberValue; number == math.Trunc(number) && math.Abs(number) <= parquetMaxSafeInteger {
+			return "int"
+		}
+
+		return "float"
+	default:
+		return "json"
+	}
+}
+
+// arrowColumns will infer the columns of the records, sorted by name, like "parquetColumns".
+func arrowColumns(records []*structpb.Struct) []parquetColumn {
+	kinds := make(map[string]string)
+
+	for _, record := range records {
+		for name, value := range record.GetFields() {
+			kinds[name] = mergeParquetKind(kinds[name], arrowKind(value))
+		}
+	}
+
+	columns := make([]parquetColumn, 0, len(kinds))
+	for name, kind := range kinds {
+		columns = append(columns, parquetColumn{name: name, kind: kind})
+	}
+
+	sort.Slice(columns, func(i, j int) bool { return columns[i].name < columns[j].name })
+
+	return columns
+}
+
+// arrowType will return the Arrow type of the column, which is written to the same Parquet type as the node of the
+// column. Columns that are only null are string columns.
+func (column parquetColumn) arrowType() arrow.DataType {
+	switch column.kind {
+	case "bool":
+		return arrow.FixedWidthTypes.Boolean
+	case "int":
+		return arrow.PrimitiveTypes.Int64
+	case "float":
+		return arrow.PrimitiveTypes.Float64
+	case "json":
+		jsonType, _ := extensions.NewJSONType(arrow.BinaryTypes.String)
+
+		return jsonType
+	default:
+		return arrow.BinaryTypes.String
+	}
+}
+
+// appendArrow will append the values of the records in the column to the builder of the column.
+func (column parquetColumn) appendArrow(builder array.Builder, records []*structpb.Struct) error {
+	if ext, ok := builder.(*array.ExtensionBuilder); ok {
+		builder = ext.StorageBuilder()
+	}
+
+	builder.Reserve(len(records))
+
+	for _, record := range records {
+		value := record.GetFields()[column.name]
+		if arrowKind(value) == "" {
+			builder.AppendNull()
+
+			continue
+		}
+
+		switch builder := builder.(type) {
+		case *array.BooleanBuilder:
+			builder.Append(value.GetBoolValue())
+		case *array.Int64Builder:
+			builder.Append(int64(value.GetNumberValue()))
+		case *array.Float64Builder:
+			builder.Append(value.GetNumberValue())
+		case *array.StringBuilder:
+			if column.kind != "json" {
+				builder.Append(value.GetStringValue())
+
+				continue
+			}
+
+			data, err := json.Marshal(value.AsInterface())
+			if err != nil {
+				return fmt.Errorf("unable to encode %s: %w", column.name, err)
+			}
+
+			builder.BinaryBuilder.Append(data)
+		}
+	}
+
+	return nil
+}
+
+// arrowCompression will return the Arrow compression of the files written with the codec.
+func arrowCompression(codec int32) compress.Compression {
+	switch codec {
+	case parquetGzip:
+		return compress.Codecs.Gzip
+	case parquetZstd:
+		return compress.Codecs.Zstd
+	default:
+		return compress.Codecs.Uncompressed
+	}
+}
+
+// writeArrowParquet will encode the records as a Parquet file with a single row group, compressed with the codec,
+// like "writeParquet". The values of the records are appended to an Arrow record batch a column at a time, without
+// converting each record to a map or a row, and the batch is written a column at a time.
+func writeArrowParquet(records []*structpb.Struct, codec int32) ([]byte, error) {
+	columns := arrowColumns(records)
+
+	fields := make([]arrow.Field, len(columns))
+	for idx, column := range columns {
+		fields[idx] = arrow.Field{Name: column.name, Type: column.arrowType(), Nullable: true}
+	}
+
+	schema := arrow.NewSchema(fields, nil)
+
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+
+	for idx, column := range columns {
+		if err := column.appendArrow(builder.Field(idx), records); err != nil {
+			return nil, err
+		}
+	}
+
+	batch := builder.NewRecord()
+	defer batch.Release()
+
+	var buf bytes.Buffer
+
+	// The root of the schema is required instead of repeated, as Arrow writes it for legacy readers, so that other
+	// readers do not read the columns as nested in a list.
+	props := arrowparquet.NewWriterProperties(arrowparquet.WithCompression(arrowCompression(codec)),
+		arrowparquet.WithCreatedBy("gidari"), arrowparquet.WithMaxRowGroupLength(int64(len(records))+1),
+		arrowparquet.WithRootRepetition(arrowparquet.Repetitions.Required))
+
+	writer, err := pqarrow.NewFileWriter(schema, &buf, props, pqarrow.DefaultWriterProps())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create parquet writer: %w", err)
+	}
+
+	if err := writer.Write(batch); err != nil {
+		return nil, fmt.Errorf("unable to write parquet record batch: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("unable to write parquet file: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,381 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+	parquetgzip "github.com/parquet-go/parquet-go/compress/gzip"
+	"github.com/parquet-go/parquet-go/compress/uncompressed"
+	parquetzstd "github.com/parquet-go/parquet-go/compress/zstd"
+)
+
+const (
+	// The compression codecs of Parquet files, which are also used for the whole of newline-delimited JSON files.
+	parquetUncompressed int32 = 0
+	parquetGzip         int32 = 2
+	parquetZstd         int32 = 6
+
+	// parquetMaxSafeInteger is the largest integer that a record number can hold exactly, and so be written to an
+	// "INT64" column.
+	parquetMaxSafeInteger = 1 << 53
+
+	// parquetReadRows is the number of rows read from a file at a time.
+	parquetReadRows = 1024
+)
+
+var ErrInvalidParquet = fmt.Errorf("invalid parquet file")
+
+// InvalidParquetError is returned when a Parquet file cannot be read, either because it is corrupt or because it uses
+// features of the format that are not supported, e.g. nested columns.
+func InvalidParquetError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidParquet, reason)
+}
+
+// parquetColumn is a column of a Parquet file, with the kind of the record values written to it.
+type parquetColumn struct {
+	name string
+	kind string
+}
+
+// parquetKind will return the kind of column that a record value is written to: "string", "bool", "int", "float", or
+// "json" for objects, lists, and integers that a record number does not hold exactly.
+func parquetKind(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) <= parquetMaxSafeInteger {
+			return "int"
+		}
+
+		return "float"
+	default:
+		return "json"
+	}
+}
+
+// parquetColumns will infer the columns of the records, sorted by name. Strings, booleans, and numbers are written to
+// "BYTE_ARRAY" (STRING), "BOOLEAN", and "INT64" or "DOUBLE" columns, and objects, lists, and fields with values of
+// different types are written to "BYTE_ARRAY" (JSON) columns. Every column is optional.
+func parquetColumns(records []map[string]interface{}) []parquetColumn {
+	kinds := make(map[string]string)
+
+	for _, record := range records {
+		for name, value := range record {
+			kind := ""
+			if value != nil {
+				kind = parquetKind(value)
+			}
+
+			kinds[name] = mergeParquetKind(kinds[name], kind)
+		}
+	}
+
+	columns := make([]parquetColumn, 0, len(kinds))
+	for name, kind := range kinds {
+		columns = append(columns, parquetColumn{name: name, kind: kind})
+	}
+
+	sort.Slice(columns, func(i, j int) bool { return columns[i].name < columns[j].name })
+
+	return columns
+}
+
+// mergeParquetKind will return the kind of a column with values of the known kind that a value of the kind is
+// written to. Null values have no kind, and do not change the kind of the column.
+func mergeParquetKind(known, kind string) string {
+	switch {
+	case known == "" || known == kind:
+		return kind
+	case kind == "":
+		return known
+	case (known == "int" && kind == "float") || (known == "float" && kind == "int"):
+		return "float"
+	default:
+		return "json"
+	}
+}
+
+// node will return the optional schema node of the column. Columns that are only null are string columns.
+func (column parquetColumn) node() parquet.Node {
+	switch column.kind {
+	case "bool":
+		return parquet.Optional(parquet.Leaf(parquet.BooleanType))
+	case "int":
+		return parquet.Optional(parquet.Int(64))
+	case "float":
+		return parquet.Optional(parquet.Leaf(parquet.DoubleType))
+	case "json":
+		return parquet.Optional(parquet.JSON())
+	default:
+		return parquet.Optional(parquet.String())
+	}
+}
+
+// value will return the value of the record in the column, at the column index of the row.
+func (column parquetColumn) value(record map[string]interface{}, idx int) (parquet.Value, error) {
+	value := record[column.name]
+	if value == nil {
+		return parquet.NullValue().Level(0, 0, idx), nil
+	}
+
+	switch column.kind {
+	case "int":
+		value = int64(value.(float64))
+	case "json":
+		data, err := json.Marshal(value)
+		if err != nil {
+			return parquet.Value{}, fmt.Errorf("unable to encode %s: %w", column.name, err)
+		}
+
+		value = data
+	}
+
+	return parquet.ValueOf(value).Level(0, 1, idx), nil
+}
+
+// parquetCodec will return the compression codec of the files written with the codec.
+func parquetCodec(codec int32) compress.Codec {
+	switch codec {
+	case parquetGzip:
+		return &parquetgzip.Codec{}
+	case parquetZstd:
+		return &parquetzstd.Codec{}
+	default:
+		return &uncompressed.Codec{}
+	}
+}
+
+// writeParquet will encode the records as a Parquet file with a single row group, compressed with the codec.
+func writeParquet(records []map[string]interface{}, codec int32) ([]byte, error) {
+	columns := parquetColumns(records)
+
+	group := make(parquet.Group, len(columns))
+	for _, column := range columns {
+		group[column.name] = column.node()
+	}
+
+	// The fields of a group are sorted by name, like the columns.
+	var buf bytes.Buffer
+
+	writer := parquet.NewWriter(&buf, parquet.NewSchema("schema", group), parquet.Compression(parquetCodec(codec)),
+		parquet.CreatedBy("gidari", "", ""))
+
+	rows := make([]parquet.Row, len(records))
+
+	for row, record := range records {
+		rows[row] = make(parquet.Row, len(columns))
+
+		for idx, column := range columns {
+			value, err := column.value(record, idx)
+			if err != nil {
+				return nil, err
+			}
+
+			rows[row][idx] = value
+		}
+	}
+
+	if _, err := writer.WriteRows(rows); err != nil {
+		return nil, fmt.Errorf("unable to write parquet rows: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("unable to write parquet file: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// openParquet will open the Parquet file.
+func openParquet(data []byte) (*parquet.File, error) {
+	file, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, InvalidParquetError(err.Error())
+	}
+
+	return file, nil
+}
+
+// parquetNumRows will return the number of rows of a Parquet file from its footer.
+func parquetNumRows(data []byte) (int64, error) {
+	file, err := openParquet(data)
+	if err != nil {
+		return 0, err
+	}
+
+	return file.NumRows(), nil
+}
+
+// readParquet will decode the records of a Parquet file with flat columns. Integers and floating point numbers are
+// read as numbers, byte arrays as strings or, for JSON columns, the values that they encode, and null values are left
+// out of the records.
+func readParquet(data []byte) ([]map[string]interface{}, error) {
+	file, err := openParquet(data)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := file.Schema().Fields()
+	for _, field := range fields {
+		if !field.Leaf() {
+			return nil, InvalidParquetError(fmt.Sprintf("nested column %q is not supported", field.Name()))
+		}
+
+		if field.Repeated() {
+			return nil, InvalidParquetError(fmt.Sprintf("repeated column %q is not supported", field.Name()))
+		}
+	}
+
+	reader := parquet.NewReader(file)
+	defer reader.Close()
+
+	records := make([]map[string]interface{}, 0, file.NumRows())
+	rows := make([]parquet.Row, parquetReadRows)
+
+	for {
+		count, err := reader.ReadRows(rows)
+
+		for _, row := range rows[:count] {
+			record := make(map[string]interface{}, len(row))
+
+			for _, value := range row {
+				if value.IsNull() {
+					continue
+				}
+
+				field := fields[value.Column()]
+
+				decoded, err := parquetValue(field, value)
+				if err != nil {
+					return nil, err
+				}
+
+				record[field.Name()] = decoded
+			}
+
+			records = append(records, record)
+		}
+
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+
+		if err != nil {
+			return nil, InvalidParquetError(err.Error())
+		}
+	}
+}
+
+// parquetValue will decode the value of the column.
+func parquetValue(field parquet.Field, value parquet.Value) (interface{}, error) {
+	switch value.Kind() {
+	case parquet.Boolean:
+		return value.Boolean(), nil
+	case parquet.Int32:
+		return float64(value.Int32()), nil
+	case parquet.Int64:
+		return float64(value.Int64()), nil
+	case parquet.Float:
+		return float64(value.Float()), nil
+	case parquet.Double:
+		return value.Double(), nil
+	case parquet.ByteArray, parquet.FixedLenByteArray:
+		if logical := field.Type().LogicalType(); logical == nil || logical.Json == nil {
+			return string(value.ByteArray()), nil
+		}
+
+		var decoded interface{}
+		if err := json.Unmarshal(value.ByteArray(), &decoded); err != nil {
+			return nil, InvalidParquetError(fmt.Sprintf("column %q is not JSON: %v", field.Name(), err))
+		}
+
+		return decoded, nil
+	default:
+		return nil, InvalidParquetError(fmt.Sprintf("column %q has unsupported type %s", field.Name(), value.Kind()))
+	}
+}
+
+// parquetCompress will compress the data with the codec, which is also used for the whole of newline-delimited JSON
+// files.
+func parquetCompress(codec int32, data []byte) ([]byte, error) {
+	switch codec {
+	case parquetGzip:
+		var buf bytes.Buffer
+
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(data)
+
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case parquetZstd:
+		zw, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+
+		defer zw.Close()
+
+		return zw.EncodeAll(data, nil), nil
+	default:
+		return data, nil
+	}
+}
+
+func parquetDecompress(codec int32, body []byte) ([]byte, error) {
+	switch codec {
+	case parquetUncompressed:
+		return body, nil
+	case parquetGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, InvalidParquetError(err.Error())
+		}
+
+		defer zr.Close()
+
+		page, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, InvalidParquetError(err.Error())
+		}
+
+		return page, nil
+	case parquetZstd:
+		zr, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, InvalidParquetError(err.Error())
+		}
+
+		defer zr.Close()
+
+		page, err := zr.DecodeAll(body, nil)
+		if err != nil {
+			return nil, InvalidParquetError(err.Error())
+		}
+
+		return page, nil
+	default:
+		return nil, InvalidParquetError(fmt.Sprintf("compression codec %d is not supported", codec))
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// pgLoadMaintenanceParam is the connection string parameter that enables pre-load maintenance, e.g.
+	// "load_maintenance=true". The parameter is removed from the connection string before connecting.
+	pgLoadMaintenanceParam = "load_maintenance"
+
+	// pgAnalyzeMinRowsParam is the connection string parameter that enables analyzing the tables of a load once it
+	// is committed, e.g. "analyze_min_rows=10000" to analyze every table with at least 10000 upserted rows. The
+	// parameter is removed from the connection string before connecting.
+	pgAnalyzeMinRowsParam = "analyze_min_rows"
+)
+
+// pgLoad is the tables written in a transaction, with the pre-load maintenance made on the tables that is undone
+// before the transaction commits.
+type pgLoad struct {
+	// rows are the number of records upserted into each table, and order is the order the tables were first written
+	// in.
+	rows  map[string]int
+	order []string
+
+	// indexes are the definitions of the secondary indexes dropped before the load.
+	indexes []string
+}
+
+// parseLoadMaintenance will remove the load maintenance parameter from the connection URL, returning true if pre-load
+// maintenance is enabled.
+func parseLoadMaintenance(connectionURL string) (string, bool, error) {
+	if !strings.Contains(connectionURL, "://") || !strings.Contains(connectionURL, pgLoadMaintenanceParam+"=") {
+		return connectionURL, false, nil
+	}
+
+	dnsURL, err := url.Parse(connectionURL)
+	if err != nil {
+		return "", false, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	query := dnsURL.Query()
+
+	enabled, err := strconv.ParseBool(query.Get(pgLoadMaintenanceParam))
+	if err != nil {
+		return "", false, fmt.Errorf("invalid %s: %w", pgLoadMaintenanceParam, err)
+	}
+
+	query.Del(pgLoadMaintenanceParam)
+	dnsURL.RawQuery = query.Encode()
+
+	return dnsURL.String(), enabled, nil
+}
+
+// parseAnalyzeMinRows will remove the analyze parameter from the connection URL, returning the minimum number of
+// upserted rows for a table to be analyzed after a load, or -1 if tables are not analyzed.
+func parseAnalyzeMinRows(connectionURL string) (string, int, error) {
+	if !strings.Contains(connectionURL, "://") || !strings.Contains(connectionURL, pgAnalyzeMinRowsParam+"=") {
+		return connectionURL, -1, nil
+	}
+
+	dnsURL, err := url.Parse(connectionURL)
+	if err != nil {
+		return "", -1, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	query := dnsURL.Query()
+
+	minRows, err := strconv.Atoi(query.Get(pgAnalyzeMinRowsParam))
+	if err != nil || minRows < 0 {
+		return "", -1, fmt.Errorf("invalid %s: expected a non-negative number of rows", pgAnalyzeMinRowsParam)
+	}
+
+	query.Del(pgAnalyzeMinRowsParam)
+	dnsURL.RawQuery = query.Encode()
+
+	return dnsURL.String(), minRows, nil
+}
+
+// trackLoad will count the rows upserted into the table in the transaction of the context, and prepare the table for
+// the load the first time it is written. Nothing is tracked outside of a transaction, or if neither pre-load
+// maintenance nor analyzing is enabled.
+func (pg *Postgres) trackLoad(ctx context.Context, table string, rows int) error {
+	txID, ok := ctx.Value(basicPostgressTxID).(string)
+	if !ok || (!pg.loadMaintenance && pg.analyzeMinRows < 0) {
+		return nil
+	}
+
+	val, _ := pg.loads.LoadOrStore(txID, &pgLoad{rows: make(map[string]int)})
+
+	load, ok := val.(*pgLoad)
+	if !ok {
+		return nil
+	}
+
+	if _, written := load.rows[table]; !written {
+		if err := pg.prepareLoad(ctx, load, table); err != nil {
+			return err
+		}
+
+		load.order = append(load.order, table)
+	}
+
+	load.rows[table] += rows
+
+	return nil
+}
+
+// prepareLoad will disable the user triggers and drop the secondary indexes of the table, if pre-load maintenance is
+// enabled, so that bulk loads do not maintain them row by row. Unique indexes and indexes backing a constraint, e.g.
+// the primary key, are kept, since upserts can conflict on them.
+func (pg *Postgres) prepareLoad(ctx context.Context, load *pgLoad, table string) error {
+	if !pg.loadMaintenance {
+		return nil
+	}
+
+	queryer, err := pg.getQueryer(ctx)
+	if err != nil {
+		return err
+	}
+
+	var names, defs []string
+
+	err = pg.query(ctx, queryer, func(rows *sql.Rows) error {
+		for rows.Next() {
+			var name, def string
+			if err := rows.Scan(&name, &def); err != nil {
+				return fmt.Errorf("unable to scan index: %w", err)
+			}
+
+			names = append(names, name)
+			defs = append(defs, def)
+		}
+
+		return rows.Err()
+	}, string(pgSecondaryIndexes), table)
+	if err != nil {
+		return fmt.Errorf("unable to list indexes of %s: %w", table, err)
+	}
+
+	for _, name := range names {
+		if err := pg.exec(ctx, queryer, "DROP INDEX "+pq.QuoteIdentifier(name)); err != nil {
+			return fmt.Errorf("unable to drop index %s: %w", name, err)
+		}
+	}
+
+	if err := pg.exec(ctx, queryer, fmt.Sprintf("ALTER TABLE %s DISABLE TRIGGER USER",
+		pq.QuoteIdentifier(table))); err != nil {
+		return fmt.Errorf("unable to disable triggers on %s: %w", table, err)
+	}
+
+	load.indexes = append(load.indexes, defs...)
+
+	return nil
+}
+
+// finishLoad will re-enable the triggers and rebuild the indexes of the tables prepared in the transaction, before
+// the transaction commits. The load of the transaction is returned, or nil if nothing was tracked.
+func (pg *Postgres) finishLoad(ctx context.Context, txID string, tx *sql.Tx) (*pgLoad, error) {
+	val, ok := pg.loads.LoadAndDelete(txID)
+	if !ok {
+		return nil, nil
+	}
+
+	load, ok := val.(*pgLoad)
+	if !ok || !pg.loadMaintenance {
+		return load, nil
+	}
+
+	for _, table := range load.order {
+		if err := pg.exec(ctx, tx, fmt.Sprintf("ALTER TABLE %s ENABLE TRIGGER USER",
+			pq.QuoteIdentifier(table))); err != nil {
+			return nil, fmt.Errorf("unable to enable triggers on %s: %w", table, err)
+		}
+	}
+
+	for _, def := range load.indexes {
+		if err := pg.exec(ctx, tx, def); err != nil {
+			return nil, fmt.Errorf("unable to rebuild index: %w", err)
+		}
+	}
+
+	return load, nil
+}
+
+// analyzeLoad will refresh the planner statistics of the tables with at least "analyze_min_rows" upserted rows, once
+// the load is committed, so that the query plans of downstream readers do not degrade after large loads.
+func (pg *Postgres) analyzeLoad(ctx context.Context, load *pgLoad) error {
+	if load == nil || pg.analyzeMinRows < 0 {
+		return nil
+	}
+
+	for _, table := range load.order {
+		if load.rows[table] < pg.analyzeMinRows {
+			continue
+		}
+
+		if err := pg.exec(ctx, pg.DB, "ANALYZE "+pq.QuoteIdentifier(table)); err != nil {
+			return fmt.Errorf("unable to analyze %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
@@ -13,21 +13,35 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"net/url"
 	"runtime"
 	"strings"
 	"sync"
 
 	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/record"
 	"github.com/alpine-hodler/gidari/tools"
 	"github.com/google/uuid"
 	"github.com/lib/pq" // postgres driver
 )
 
 const (
-	pgPartitionSize = 1000
-	pgGCRetryLimit  = 10
+	pgGCRetryLimit = 10
+
+	// pgPoolModeParam is the connection string parameter for the pool mode of a connection pooler in front of the
+	// database, e.g. "pool_mode=transaction" for PgBouncer in transaction pooling mode. The parameter is removed from
+	// the connection string before connecting.
+	pgPoolModeParam       = "pool_mode"
+	pgTransactionPoolMode = "transaction"
 )
 
+// pgQueryer can execute queries on either the database or a transaction.
+type pgQueryer interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	PrepareContext(context.Context, string) (*sql.Stmt, error)
+}
+
 // postgresTxType is a type alias for the postgres transaction type.
 type postgresTxType uint8
 
@@ -46,65 +60,82 @@ type pgmeta struct {
 	bytes map[string]int64
 }
 
-func (meta *pgmeta) isPK(table, name string) bool {
-	for _, pk := range meta.pks[table] {
-		if pk == name {
-			return true
+// exec will execute the query. Unless transaction pooling is enabled, the query is executed as a prepared statement.
+func (pg *Postgres) exec(ctx context.Context, queryer pgQueryer, query string, args ...interface{}) error {
+	if pg.transactionPooling {
+		if _, err := queryer.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("unable to execute statement: %w", err)
 		}
-	}
 
-	return false
-}
+		return nil
+	}
 
-// exclusionConstraints will return a string of non-primary key columns to "exclude" if they are not changed in the
-// context of a Postgres insert. That is, if a column is not changed, it will not be updated. All columns beside primary
-// keys must be included in the "excluded" clause.
-func (meta *pgmeta) exclusionConstraints(table string) []string {
-	var constraints []string
+	stmt, err := queryer.PrepareContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("unable to prepare statement: %w", err)
+	}
+	defer stmt.Close()
 
-	for _, column := range meta.cols[table] {
-		if !meta.isPK(table, column) {
-			constraints = append(constraints, fmt.Sprintf("\"%s\" = EXCLUDED.\"%s\"", column, column))
-		}
+	if _, err := stmt.ExecContext(ctx, args...); err != nil {
+		return fmt.Errorf("unable to execute statement: %w", err)
 	}
 
-	return constraints
+	return nil
 }
 
-// upsertStatement will return a postgres upsert statement for the meta object.
-func (meta *pgmeta) upsertStmt(ctx context.Context, table string, pcf sqlPrepareContextFn, vol int) (*sql.Stmt, error) {
-	query := fmt.Sprintf(`INSERT INTO %s(%s) VALUES %s ON CONFLICT (%s) DO UPDATE SET %s`, table,
-		strings.Join(meta.cols[table], ","),
-		tools.SQLIterativePlaceholders(len(meta.cols[table]), vol, "$"),
-		strings.Join(meta.pks[table], ","),
-		strings.Join(meta.exclusionConstraints(table), ","))
+// query will run the query and pass the resulting rows to "scan". Unless transaction pooling is enabled, the query is
+// run as a prepared statement.
+func (pg *Postgres) query(ctx context.Context, queryer pgQueryer, scan func(*sql.Rows) error, query string,
+	args ...interface{},
+) error {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+
+	if pg.transactionPooling {
+		rows, err = queryer.QueryContext(ctx, query, args...)
+	} else {
+		var stmt *sql.Stmt
+		if stmt, err = queryer.PrepareContext(ctx, query); err != nil {
+			return fmt.Errorf("unable to prepare statement: %w", err)
+		}
+		defer stmt.Close()
+
+		rows, err = stmt.QueryContext(ctx, args...)
+	}
 
-	stmt, err := pcf(ctx, query)
 	if err != nil {
-		return nil, fmt.Errorf("unable to prepare statement: %w", err)
+		return fmt.Errorf("unable to query: %w", err)
 	}
+	defer rows.Close()
 
-	return stmt, nil
+	return scan(rows)
 }
 
 // garbageCollect will garbage collect the database. This will return disk space to the OS by running `VACUUM FULL`.
 // For more information, see: https://www.postgresql.org/docs/current/sql-vacuum.html
 func (pg *Postgres) garbageCollect(ctx context.Context, retryCount uint8) error {
-	stmt, err := pg.DB.PrepareContext(ctx, string(pgGarbageCollect))
-	if err != nil {
-		return fmt.Errorf("unable to prepare statement: %w", err)
+	// CockroachDB does not support "VACUUM", and garbage collects its storage on its own.
+	if pg.cockroach {
+		return nil
 	}
 
 	// Execute the garbage collection query.
-	if _, err := stmt.ExecContext(ctx); err != nil {
+	if err := pg.exec(ctx, pg.DB, string(pgGarbageCollect)); err != nil {
 		// If the garbage collection fails due to a deadlock, we will retry the operation. We should not
-		// retry more than a deterministic number of times, defined by "pgGCRetryLimit".
+		// retry more than a deterministic number of times, defined by "pgGCRetryLimit", or than the retry
+		// budget of the run allows.
 		var pqErr *pq.Error
 		if retryCount <= pgGCRetryLimit && errors.As(err, &pqErr) && pqErr.Code == "40P01" {
+			if budgetErr := tools.RetryBudgetFromContext(ctx).Spend(0, err); budgetErr != nil {
+				return budgetErr
+			}
+
 			return pg.garbageCollect(ctx, retryCount+1)
 		}
 
-		return fmt.Errorf("unable to execute statement: %w", err)
+		return err
 	}
 
 	return nil
@@ -120,21 +151,20 @@ func (pg *Postgres) loadMeta(ctx context.Context) error {
 		return fmt.Errorf("unable to garbage collect postgres database: %w", err)
 	}
 
-	stmt, err := pg.DB.PrepareContext(ctx, string(pgColumns))
-	if err != nil {
-		return fmt.Errorf("unable to prepare statement: %w", err)
-	}
-
-	rows, err := stmt.QueryContext(ctx)
-	if err != nil {
-		return fmt.Errorf("unable to query: %w", err)
-	}
-	defer rows.Close()
-
 	pg.meta.cols = make(map[string][]string)
 	pg.meta.pks = make(map[string][]string)
 	pg.meta.bytes = make(map[string]int64)
 
+	columns := pgColumns
+	if pg.cockroach {
+		columns = crdbColumns
+	}
+
+	return pg.query(ctx, pg.DB, pg.scanMeta, string(columns))
+}
+
+// scanMeta will scan the columns of the database into the metadata.
+func (pg *Postgres) scanMeta(rows *sql.Rows) error {
 	for rows.Next() {
 		var (
 			table      string
@@ -163,6 +193,8 @@ func (pg *Postgres) Close() {
 	if pg.DB != nil {
 		pg.DB.Close()
 	}
+
+	pg.tunnel.Close()
 }
 
 // ListColumns will set a complete list of available columns per table on the response.
@@ -214,6 +246,64 @@ func (pg *Postgres) ListTables(ctx context.Context) (*proto.ListTablesResponse,
 	return rsp, nil
 }
 
+// Read will return the records from the table that match the required fields on the request, in the page requested
+// by the options of the request, if any.
+func (pg *Postgres) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	query, args := PostgresDialect.selectQuery(req.GetTable(), req.GetRequired().AsMap(), page)
+
+	queryer, err := pg.getQueryer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get queryer: %w", err)
+	}
+
+	rsp := new(proto.ReadResponse)
+
+	err = pg.query(ctx, queryer, func(rows *sql.Rows) error {
+		records, err := record.FromSQLRows(rows, nil)
+		if err != nil {
+			return fmt.Errorf("unable to assign records: %w", err)
+		}
+
+		rsp.Records = records
+
+		return nil
+	}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+// Count will return the number of rows of the table that match the required fields.
+func (pg *Postgres) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	query, args := PostgresDialect.countQuery(req.GetTable(), req.GetRequired().AsMap())
+
+	queryer, err := pg.getQueryer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get queryer: %w", err)
+	}
+
+	var rsp *proto.CountResponse
+
+	err = pg.query(ctx, queryer, func(rows *sql.Rows) error {
+		var err error
+		rsp, err = scanCount(rows)
+
+		return err
+	}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
 // Truncate will truncate a table.
 func (pg *Postgres) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
 	// If the table is not specified, return an error.
@@ -226,22 +316,15 @@ func (pg *Postgres) Truncate(ctx context.Context, req *proto.TruncateRequest) (*
 		return nil, ErrNoTables
 	}
 
-	stmt, err := pg.DB.PrepareContext(ctx, fmt.Sprintf(string(pgTruncatedTables), strings.Join(tables, ",")))
-	if err != nil {
-		return nil, fmt.Errorf("unable to prepare statement: %w", err)
+	if err := pg.exec(ctx, pg.DB, fmt.Sprintf(string(pgTruncatedTables), strings.Join(tables, ","))); err != nil {
+		return nil, err
 	}
 
-	rows, err := stmt.QueryContext(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("unable to query: %w", err)
-	}
-	defer rows.Close()
-
 	return &proto.TruncateResponse{}, nil
 }
 
-// getPrepareContextFn will return a function that can prepare an upsert statement for a given table.
-func (pg *Postgres) getPrepareContextFn(ctx context.Context) (sqlPrepareContextFn, error) {
+// getQueryer will return the transaction assigned to the context, or the database if there is none.
+func (pg *Postgres) getQueryer(ctx context.Context) (pgQueryer, error) {
 	// First check to see if a transaction has been assigned to the context. If it has, use the transaction.
 	// Otherwise, use the database.
 	txID, ok := ctx.Value(basicPostgressTxID).(string)
@@ -252,11 +335,11 @@ func (pg *Postgres) getPrepareContextFn(ctx context.Context) (sqlPrepareContextF
 				return nil, ErrTransactionNotFound
 			}
 
-			return tx.PrepareContext, nil
+			return tx, nil
 		}
 	}
 
-	return pg.DB.PrepareContext, nil
+	return pg.DB, nil
 }
 
 // Upsert will insert the records on the request if they do not exist in the database. On conflict, it will use the
@@ -276,9 +359,9 @@ func (pg *Postgres) Upsert(ctx context.Context, req *proto.UpsertRequest) (*prot
 		return &proto.UpsertResponse{}, nil
 	}
 
-	prepareContextFn, err := pg.getPrepareContextFn(ctx)
+	queryer, err := pg.getQueryer(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get preparer: %w", err)
+		return nil, fmt.Errorf("unable to get queryer: %w", err)
 	}
 
 	if err := pg.loadMeta(ctx); err != nil {
@@ -287,17 +370,25 @@ func (pg *Postgres) Upsert(ctx context.Context, req *proto.UpsertRequest) (*prot
 
 	table := req.GetTable()
 
-	// Upsert 1000 records at a time, the maximum number of records that can be inserted in a single statement on a
-	// postgres database.
-	for _, partition := range tools.PartitionStructs(pgPartitionSize, records) {
-		stmt, err := pg.meta.upsertStmt(ctx, table, prepareContextFn, len(partition))
+	if err := pg.ensureHypertable(ctx, queryer, table); err != nil {
+		return nil, err
+	}
+
+	if err := pg.trackLoad(ctx, table, len(records)); err != nil {
+		return nil, fmt.Errorf("unable to prepare load: %w", err)
+	}
+
+	// Upsert as many records at a time as fit within the parameter limit of a single statement.
+	columns := pg.meta.cols[table]
+	for _, partition := range tools.PartitionStructs(PostgresDialect.BatchRows(len(columns)), records) {
+		query := PostgresDialect.Upsert(table, columns, pg.meta.pks[table], len(partition))
+
+		arguments, err := record.ToSQLArgs(columns, partition, nil)
 		if err != nil {
-			return nil, fmt.Errorf("unable to prepare statement: %w", err)
+			return nil, fmt.Errorf("unable to convert records: %w", err)
 		}
 
-		// Execute upsert.
-		arguments := tools.SQLFlattenPartition(pg.meta.cols[table], partition)
-		if _, err := stmt.ExecContext(ctx, arguments...); err != nil {
+		if err := pg.exec(ctx, queryer, query, arguments...); err != nil {
 			return nil, fmt.Errorf("unable to execute upsert: %w", err)
 		}
 	}
@@ -312,6 +403,36 @@ type Postgres struct {
 	// meta hold metdata about the database.
 	meta *pgmeta
 
+	// transactionPooling is set when the database is behind a connection pooler in transaction pooling mode, e.g.
+	// PgBouncer. Session-level prepared statements do not work through such poolers, so queries are executed
+	// directly, with their parameters sent in the same round trip.
+	transactionPooling bool
+
+	// loadMaintenance is set when the secondary indexes and user triggers of the tables written in a transaction are
+	// dropped and disabled for the load, and restored before the transaction commits.
+	loadMaintenance bool
+
+	// cockroach is set when the database is CockroachDB. Transactions are restarted from a savepoint when they fail
+	// with a serialization error.
+	cockroach bool
+
+	// replayLimit is the maximum number of operations of a CockroachDB transaction that are kept to be replayed.
+	replayLimit int
+
+	// analyzeMinRows is the minimum number of rows upserted into a table in a transaction for the table to be
+	// analyzed once the transaction commits, or -1 if tables are not analyzed.
+	analyzeMinRows int
+
+	// hypertables are the tables written as TimescaleDB hypertables, or nil if no hypertable is configured on the
+	// connection URL.
+	hypertables *pgHypertables
+
+	// loads are the tables written in each active transaction, keyed by transaction ID.
+	loads sync.Map
+
+	// tunnel is the SSH tunnel the connections are dialed through, if one is configured on the connection URL.
+	tunnel *sshTunnel
+
 	metaMutex   sync.Mutex
 	writeMutext sync.Mutex
 
@@ -325,14 +446,96 @@ type Postgres struct {
 }
 
 // NewPostgres will return a new Postgres option for querying data through a Postgres DB.
+//
+// A PostgreSQL database behind a connection pooler in transaction pooling mode (e.g. PgBouncer) is supported by
+// adding "pool_mode=transaction" to the connection URL. IAM database authentication is supported by adding
+// "iam=aws" (AWS RDS/Aurora) or "iam=gcp" (GCP Cloud SQL) to the connection URL, in which case a fresh IAM token is
+// used as the password for every new connection. Connections are dialed through an SSH tunnel by adding "ssh_host"
+// to the connection URL. Adding "load_maintenance=true" drops the secondary indexes and disables the user triggers of
+// each table written in a transaction, and rebuilds and re-enables them before the transaction commits. Adding
+// "analyze_min_rows" analyzes the tables with at least that many upserted rows once the transaction commits. Adding
+// "hypertable.<table>=<time column>" converts the table into a TimescaleDB hypertable before it is first written,
+// with chunks covering "chunk_interval".
+//
+// A CockroachDB database is supported with the "cockroachdb" scheme, e.g. "cockroachdb://root@crdb1:26257/defaultdb".
+// The operations of a CockroachDB transaction that fails with a serialization error are replayed from the start of
+// the transaction, see "retryCockroachTx", for transactions of up to "crdb_replay_limit" operations. Load maintenance
+// and hypertables are not supported on CockroachDB.
 func NewPostgres(ctx context.Context, connectionURL string) (*Postgres, error) {
 	postgres := new(Postgres)
 
-	var err error
+	connectionURL, postgres.cockroach = parseCockroach(connectionURL)
+
+	connectionURL, transactionPooling, err := parsePoolMode(connectionURL)
+	if err != nil {
+		return nil, err
+	}
+
+	postgres.transactionPooling = transactionPooling
+
+	connectionURL, postgres.loadMaintenance, err = parseLoadMaintenance(connectionURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if postgres.cockroach && postgres.loadMaintenance {
+		return nil, ErrCockroachLoadMaintenance
+	}
+
+	if postgres.cockroach {
+		connectionURL, postgres.replayLimit, err = parseCockroachReplayLimit(connectionURL)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	postgres.DB, err = sql.Open("postgres", connectionURL)
+	connectionURL, postgres.analyzeMinRows, err = parseAnalyzeMinRows(connectionURL)
 	if err != nil {
-		return nil, fmt.Errorf("unable to connect to postgres: %w", err)
+		return nil, err
+	}
+
+	connectionURL, postgres.hypertables, err = parseHypertables(connectionURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if postgres.cockroach && postgres.hypertables != nil {
+		return nil, ErrCockroachHypertable
+	}
+
+	connectionURL, postgres.tunnel, err = parseTunnel(connectionURL)
+	if err != nil {
+		return nil, err
+	}
+
+	iamConnector, err := parseIAM(connectionURL)
+	if err != nil {
+		postgres.tunnel.Close()
+
+		return nil, err
+	}
+
+	switch {
+	case iamConnector != nil:
+		if postgres.tunnel != nil {
+			iamConnector.setDialer(postgres.tunnel)
+		}
+
+		postgres.DB = sql.OpenDB(iamConnector)
+	case postgres.tunnel != nil:
+		connector, err := pq.NewConnector(connectionURL)
+		if err != nil {
+			postgres.tunnel.Close()
+
+			return nil, fmt.Errorf("unable to connect to postgres: %w", err)
+		}
+
+		connector.Dialer(postgres.tunnel)
+		postgres.DB = sql.OpenDB(connector)
+	default:
+		if postgres.DB, err = sql.Open("postgres", connectionURL); err != nil {
+			return nil, fmt.Errorf("unable to connect to postgres: %w", err)
+		}
 	}
 
 	postgres.setMaxOpenConns()
@@ -344,6 +547,33 @@ func NewPostgres(ctx context.Context, connectionURL string) (*Postgres, error) {
 	return postgres, nil
 }
 
+// parsePoolMode will remove the pool mode parameter from the connection URL, returning true if the pool mode is
+// "transaction". In transaction pooling mode, "binary_parameters" is enabled so that query parameters are sent in the
+// same round trip as the query, which a transaction pooler can route to a single server connection.
+func parsePoolMode(connectionURL string) (string, bool, error) {
+	if !strings.Contains(connectionURL, "://") || !strings.Contains(connectionURL, pgPoolModeParam+"=") {
+		return connectionURL, false, nil
+	}
+
+	dnsURL, err := url.Parse(connectionURL)
+	if err != nil {
+		return "", false, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	query := dnsURL.Query()
+	poolMode := query.Get(pgPoolModeParam)
+	query.Del(pgPoolModeParam)
+
+	transactionPooling := poolMode == pgTransactionPoolMode
+	if transactionPooling {
+		query.Set("binary_parameters", "yes")
+	}
+
+	dnsURL.RawQuery = query.Encode()
+
+	return dnsURL.String(), transactionPooling, nil
+}
+
 // IsNoSQL returns "false" to indicate that "Postgres" is not a NoSQL database.
 func (pg *Postgres) IsNoSQL() bool { return false }
 
@@ -408,6 +638,14 @@ func (pg *Postgres) StartTx(ctx context.Context) (*Txn, error) {
 		return txn, fmt.Errorf("failed to start transaction: %w", err)
 	}
 
+	if pg.cockroach {
+		if err := beginCockroachTx(ctx, pgtx); err != nil {
+			_ = pgtx.Rollback()
+
+			return txn, err
+		}
+	}
+
 	pg.activeTx.Store(txnID, pgtx)
 
 	// Add the transaction ID to the context.
@@ -417,14 +655,24 @@ func (pg *Postgres) StartTx(ctx context.Context) (*Txn, error) {
 		defer func() {
 			// Remove the transaction from the activeTx map.
 			pg.activeTx.Delete(txnID)
+			pg.loads.Delete(txnID)
+			pg.releaseHypertables(txnID)
 		}()
 
+		// replay are the functions applied to a CockroachDB transaction, replayed if the transaction restarts.
+		replay := &crdbReplay{limit: pg.replayLimit}
+
 		for fn := range txn.ch {
 			if err != nil {
 				continue
 			}
 
 			err = fn(pgCtx, pg)
+
+			if pg.cockroach {
+				replay.record(fn)
+				err = pg.retryCockroachTx(pgCtx, pgtx, replay, false, err)
+			}
 		}
 
 		if err != nil {
@@ -434,7 +682,36 @@ func (pg *Postgres) StartTx(ctx context.Context) (*Txn, error) {
 		}
 
 		if <-txn.commit {
-			txn.done <- pgtx.Commit()
+			if pg.cockroach {
+				if err := pg.retryCockroachTx(pgCtx, pgtx, replay, true, nil); err != nil {
+					_ = pgtx.Rollback()
+					txn.done <- err
+
+					return
+				}
+			}
+
+			load, err := pg.finishLoad(pgCtx, txnID, pgtx)
+			if err != nil {
+				_ = pgtx.Rollback()
+				txn.done <- err
+
+				return
+			}
+
+			if err := pgtx.Commit(); err != nil {
+				txn.done <- err
+
+				return
+			}
+
+			// The load is committed, so a failed refresh of the statistics is logged rather than reported as a
+			// failed commit.
+			if err := pg.analyzeLoad(ctx, load); err != nil {
+				contextLogger(ctx).WithError(err).Warn("unable to refresh planner statistics after commit")
+			}
+
+			txn.done <- nil
 		} else {
 			txn.done <- pgtx.Rollback()
 		}
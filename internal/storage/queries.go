@@ -19,3 +19,27 @@ var pgTruncatedTables []byte
 
 //go:embed queries/pg_garbage_collect.sql
 var pgGarbageCollect []byte
+
+//go:embed queries/pg_secondary_indexes.sql
+var pgSecondaryIndexes []byte
+
+//go:embed queries/sqlite_columns.sql
+var sqliteColumns []byte
+
+//go:embed queries/crdb_columns.sql
+var crdbColumns []byte
+
+//go:embed queries/duckdb_columns.sql
+var duckDBColumns []byte
+
+//go:embed queries/sqlserver_columns.sql
+var sqlServerColumns []byte
+
+//go:embed queries/oracle_columns.sql
+var oracleColumns []byte
+
+//go:embed queries/oracle_column_types.sql
+var oracleColumnTypes []byte
+
+//go:embed queries/redshift_columns.sql
+var redshiftColumns []byte
@@ -0,0 +1,18 @@
+SELECT
+	c.table_name,
+	c.column_name,
+	COALESCE(list_position(k.constraint_column_names, c.column_name), 0) AS primary_key
+FROM
+	duckdb_columns() c
+	LEFT JOIN duckdb_constraints() k
+		ON k.database_name = c.database_name
+		AND k.schema_name = c.schema_name
+		AND k.table_name = c.table_name
+		AND k.constraint_type = 'PRIMARY KEY'
+WHERE
+	c.database_name = current_database()
+	AND c.schema_name = current_schema()
+	AND NOT c.internal
+ORDER BY
+	c.table_name,
+	c.column_index
@@ -0,0 +1,9 @@
+SELECT
+	c.TABLE_NAME AS table_name,
+	c.COLUMN_NAME AS column_name,
+	c.DATA_TYPE AS data_type
+FROM
+	USER_TAB_COLUMNS c
+WHERE
+	c.DATA_TYPE IN ('DATE', 'NUMBER')
+	OR c.DATA_TYPE LIKE 'TIMESTAMP%'
@@ -0,0 +1,19 @@
+SELECT
+	c.TABLE_NAME AS table_name,
+	c.COLUMN_NAME AS column_name,
+	COALESCE(k.POSITION, 0) AS primary_key
+FROM
+	USER_TAB_COLUMNS c
+	JOIN USER_TABLES t
+		ON t.TABLE_NAME = c.TABLE_NAME
+		AND t.DROPPED = 'NO'
+	LEFT JOIN USER_CONSTRAINTS p
+		ON p.TABLE_NAME = c.TABLE_NAME
+		AND p.CONSTRAINT_TYPE = 'P'
+	LEFT JOIN USER_CONS_COLUMNS k
+		ON k.CONSTRAINT_NAME = p.CONSTRAINT_NAME
+		AND k.TABLE_NAME = c.TABLE_NAME
+		AND k.COLUMN_NAME = c.COLUMN_NAME
+ORDER BY
+	c.TABLE_NAME,
+	c.COLUMN_ID
@@ -18,3 +18,4 @@ FROM information_schema.columns c
         ON t.table_name = c.table_name
 WHERE t.table_type = 'BASE TABLE'
       AND c.table_schema = 'public'
+      AND c.is_generated = 'NEVER'
@@ -0,0 +1,13 @@
+SELECT i.indexname,
+       i.indexdef
+FROM pg_indexes i
+         JOIN pg_index x ON x.indexrelid = (quote_ident(i.schemaname) || '.' || quote_ident(i.indexname))::regclass
+WHERE i.schemaname = 'public'
+      AND i.tablename = $1
+      AND NOT x.indisunique
+      AND NOT EXISTS
+          (
+              SELECT 1
+              FROM pg_constraint k
+              WHERE k.conindid = x.indexrelid
+          )
@@ -0,0 +1,13 @@
+SELECT
+	m.name AS table_name,
+	p.name AS column_name,
+	p.pk AS primary_key
+FROM
+	sqlite_master m
+	JOIN pragma_table_info(m.name) p
+WHERE
+	m.type = 'table'
+	AND m.name NOT LIKE 'sqlite_%'
+ORDER BY
+	m.name,
+	p.cid
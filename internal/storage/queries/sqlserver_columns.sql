@@ -0,0 +1,24 @@
+SELECT
+	c.TABLE_NAME AS table_name,
+	c.COLUMN_NAME AS column_name,
+	COALESCE(k.ORDINAL_POSITION, 0) AS primary_key
+FROM
+	INFORMATION_SCHEMA.COLUMNS c
+	JOIN INFORMATION_SCHEMA.TABLES t
+		ON t.TABLE_SCHEMA = c.TABLE_SCHEMA
+		AND t.TABLE_NAME = c.TABLE_NAME
+		AND t.TABLE_TYPE = 'BASE TABLE'
+	LEFT JOIN INFORMATION_SCHEMA.TABLE_CONSTRAINTS p
+		ON p.TABLE_SCHEMA = c.TABLE_SCHEMA
+		AND p.TABLE_NAME = c.TABLE_NAME
+		AND p.CONSTRAINT_TYPE = 'PRIMARY KEY'
+	LEFT JOIN INFORMATION_SCHEMA.KEY_COLUMN_USAGE k
+		ON k.CONSTRAINT_SCHEMA = p.CONSTRAINT_SCHEMA
+		AND k.CONSTRAINT_NAME = p.CONSTRAINT_NAME
+		AND k.TABLE_NAME = c.TABLE_NAME
+		AND k.COLUMN_NAME = c.COLUMN_NAME
+WHERE
+	c.TABLE_SCHEMA = SCHEMA_NAME()
+ORDER BY
+	c.TABLE_NAME,
+	c.ORDINAL_POSITION
@@ -0,0 +1,719 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	qdb "github.com/questdb/go-questdb-client/v3"
+)
+
+const (
+	questDBScheme = "questdb"
+
+	// questDBTLSParam is the connection string parameter that connects to the server with HTTPS, e.g. "tls=true".
+	questDBTLSParam = "tls"
+
+	// questDBSymbolsParam is the connection string parameter for the comma separated fields of the records that are
+	// written as symbol columns, e.g. "symbols=exchange,product_id". Symbols and the designated timestamp are the
+	// upsert keys of the table. The symbols of a single table are set with "symbols.<table>".
+	questDBSymbolsParam = "symbols"
+
+	// questDBColumnsParam is the connection string parameter for the comma separated fields of the records that are
+	// written as columns, e.g. "columns=open,close". By default, every field of a record that is not a symbol or the
+	// designated timestamp is written. The columns of a single table are set with "columns.<table>".
+	questDBColumnsParam = "columns"
+
+	// questDBTimestampParam is the connection string parameter for the field of the records that is the designated
+	// timestamp of the table, e.g. "timestamp=start". The designated timestamp of a single table is set with
+	// "timestamp.<table>".
+	questDBTimestampParam = "timestamp"
+
+	// questDBPrecisionParam is the connection string parameter for the unit of numeric timestamps: "s" (the default),
+	// "ms", "us", or "ns".
+	questDBPrecisionParam = "precision"
+
+	// questDBPartitionByParam is the connection string parameter for the partitioning of the tables that are
+	// created: "HOUR", "DAY" (the default), "WEEK", "MONTH", or "YEAR".
+	questDBPartitionByParam = "partitionBy"
+
+	// questDBTokenEnv is the environment variable with the bearer token to authorize requests with, if the connection
+	// string has no user.
+	questDBTokenEnv = "QUESTDB_TOKEN"
+
+	questDBDefaultPort        = "9000"
+	questDBDefaultTimestamp   = "timestamp"
+	questDBDefaultPartitionBy = "DAY"
+
+	// questDBWriteLines is the number of rows written in each ILP request.
+	questDBWriteLines = 10000
+)
+
+var (
+	ErrQuestDB    = fmt.Errorf("questdb request failed")
+	ErrQuestDBRow = fmt.Errorf("invalid questdb row")
+)
+
+// QuestDBError is returned when a QuestDB HTTP request fails.
+func QuestDBError(method, path string, err error) error {
+	return fmt.Errorf("%w: %s %s: %v", ErrQuestDB, method, path, err)
+}
+
+// QuestDBRowError is returned when a record cannot be written as a row of its table with the InfluxDB Line Protocol.
+func QuestDBRowError(table, reason string) error {
+	return fmt.Errorf("%w: records of %q: %s", ErrQuestDBRow, table, reason)
+}
+
+// questDBPartitions are the partitionings of the tables that are created, which must be partitioned to deduplicate.
+var questDBPartitions = map[string]bool{"HOUR": true, "DAY": true, "WEEK": true, "MONTH": true, "YEAR": true}
+
+// questDBTxType is the type of the context key of QuestDB transactions.
+type questDBTxType uint8
+
+const (
+	basicQuestDBTxID questDBTxType = iota
+)
+
+// questDBColumn is a symbol or a column of a row, with its value.
+type questDBColumn struct {
+	name  string
+	value interface{}
+}
+
+// questDBRow is a record as a row of its table, written with the ILP sender. A row without a timestamp is written at
+// the time of the server.
+type questDBRow struct {
+	table   string
+	symbols []questDBColumn
+	columns []questDBColumn
+	ts      time.Time
+}
+
+// questDBTx are the rows of a transaction, written when the transaction commits.
+type questDBTx struct {
+	mtx  sync.Mutex
+	rows []questDBRow
+}
+
+// QuestDB is a storage device that writes records as the rows of QuestDB tables with the InfluxDB Line Protocol (ILP)
+// over HTTP, sent by the QuestDB Go client, for high-throughput loads of time-series web API data such as candles and
+// ticks. Each table is created on the first write with the designated timestamp and symbols of its mapping, and
+// deduplicates the rows with the same timestamp and symbols, so upserting a record again updates its row.
+type QuestDB struct {
+	endpoint    string
+	client      *http.Client
+	user        *url.Userinfo
+	token       string
+	precision   float64
+	partitionBy string
+
+	// mapping is the mapping of every table, where the tags are the symbols and the fields are the columns.
+	mapping  influxDBMapping
+	mappings map[string]*influxDBMapping
+
+	// created are the tables that exist, keyed by name, so each table is only created once.
+	created sync.Map
+
+	// activeTx are the transactions that are currently active, keyed by the transaction ID that is added to the
+	// context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewQuestDB will return a QuestDB storage device for the connection string, i.e.
+// "questdb://[user:password@]host[:port][?tls=true]", with the port of the HTTP server (default 9000). Requests are
+// authorized with the user and password of the connection string, or with the bearer token in the "QUESTDB_TOKEN"
+// environment variable. The symbols, columns, and designated timestamp of the tables are set with the "symbols",
+// "columns", and "timestamp" parameters, or "symbols.<table>", "columns.<table>", and "timestamp.<table>" for a single
+// table.
+func NewQuestDB(_ context.Context, connectionURL string) (*QuestDB, error) {
+	uri, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	if uri.Hostname() == "" || strings.Trim(uri.Path, "/") != "" {
+		return nil, DNSNotSupportedError(connectionURL)
+	}
+
+	host := uri.Host
+	if uri.Port() == "" {
+		host += ":" + questDBDefaultPort
+	}
+
+	stg := &QuestDB{
+		endpoint:    "http://" + host,
+		client:      compliance.HTTPClient(),
+		user:        uri.User,
+		token:       os.Getenv(questDBTokenEnv),
+		precision:   influxDBPrecisions[influxDBDefaultPrecision],
+		partitionBy: questDBDefaultPartitionBy,
+		mapping:     influxDBMapping{time: questDBDefaultTimestamp},
+		mappings:    make(map[string]*influxDBMapping),
+	}
+
+	// The parameters of a single table override the parameters of every table, so they are set last.
+	var tableParams []string
+
+	for key, values := range uri.Query() {
+		switch key {
+		case questDBTLSParam:
+			if tls, err := strconv.ParseBool(values[0]); err != nil {
+				return nil, fmt.Errorf("%w: %s=%q must be a boolean", ErrDNSNotSupported, key, values[0])
+			} else if tls {
+				stg.endpoint = "https://" + host
+			}
+		case questDBPrecisionParam:
+			precision, ok := influxDBPrecisions[values[0]]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s=%q must be s, ms, us, or ns", ErrDNSNotSupported, key, values[0])
+			}
+
+			stg.precision = precision
+		case questDBPartitionByParam:
+			partitionBy := strings.ToUpper(values[0])
+			if !questDBPartitions[partitionBy] {
+				return nil, fmt.Errorf("%w: %s=%q must be HOUR, DAY, WEEK, MONTH, or YEAR", ErrDNSNotSupported, key,
+					values[0])
+			}
+
+			stg.partitionBy = partitionBy
+		case questDBSymbolsParam, questDBColumnsParam, questDBTimestampParam:
+			stg.mapping.set(questDBMappingParam(key), values[0])
+		default:
+			tableParams = append(tableParams, key)
+		}
+	}
+
+	for _, key := range tableParams {
+		param, table, ok := strings.Cut(key, ".")
+		if !ok || (param != questDBSymbolsParam && param != questDBColumnsParam && param != questDBTimestampParam) {
+			continue
+		}
+
+		mapping, ok := stg.mappings[table]
+		if !ok {
+			copied := stg.mapping
+			mapping = &copied
+			stg.mappings[table] = mapping
+		}
+
+		mapping.set(questDBMappingParam(param), uri.Query().Get(key))
+	}
+
+	return stg, nil
+}
+
+// questDBMappingParam will return the line protocol mapping parameter of a QuestDB connection string parameter.
+func questDBMappingParam(param string) string {
+	switch param {
+	case questDBSymbolsParam:
+		return influxDBTagsParam
+	case questDBColumnsParam:
+		return influxDBFieldsParam
+	default:
+		return influxDBTimeParam
+	}
+}
+
+// Close implements the storage interface. The requests to the server do not hold a connection open.
+func (stg *QuestDB) Close() {}
+
+// IsNoSQL returns "false" to indicate that "QuestDB" is a SQL database.
+func (stg *QuestDB) IsNoSQL() bool { return false }
+
+// Type implements the storage interface.
+func (stg *QuestDB) Type() uint8 { return QuestDBType }
+
+// mappingOf will return the mapping of the table.
+func (stg *QuestDB) mappingOf(table string) *influxDBMapping {
+	if mapping, ok := stg.mappings[table]; ok {
+		return mapping
+	}
+
+	return &stg.mapping
+}
+
+// questDBQuote will quote the name as a QuestDB identifier.
+func questDBQuote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// call will make a request to the server and return the body of the response, with the message of the error of an
+// unsuccessful request.
+func (stg *QuestDB) call(ctx context.Context, method, path string, query url.Values, body []byte) ([]byte, error) {
+	target := stg.endpoint + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, QuestDBError(method, path, err)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	if password, ok := stg.user.Password(); ok || stg.user.Username() != "" {
+		req.SetBasicAuth(stg.user.Username(), password)
+	} else if stg.token != "" {
+		req.Header.Set("Authorization", "Bearer "+stg.token)
+	}
+
+	rsp, err := stg.client.Do(req)
+	if err != nil {
+		return nil, QuestDBError(method, path, err)
+	}
+
+	defer rsp.Body.Close()
+
+	data, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, QuestDBError(method, path, fmt.Errorf("unable to read response: %w", err))
+	}
+
+	if rsp.StatusCode/100 != 2 {
+		// ILP errors have a "message", and SQL errors an "error".
+		var apiErr struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}
+
+		msg := data
+		if len(msg) > 1<<10 {
+			msg = msg[:1<<10]
+		}
+
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Message+apiErr.Error != "" {
+			msg = []byte(apiErr.Message + apiErr.Error)
+		}
+
+		return nil, QuestDBError(method, path, fmt.Errorf("unexpected status %q: %s", rsp.Status,
+			bytes.TrimSpace(msg)))
+	}
+
+	return data, nil
+}
+
+// exec will run the SQL statement and return the rows of its result, keyed by column name. Null values are not set
+// on the rows, and timestamps are RFC 3339 strings.
+func (stg *QuestDB) exec(ctx context.Context, statement string) ([]map[string]interface{}, error) {
+	data, err := stg.call(ctx, http.MethodGet, "/exec", url.Values{"query": {statement}}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Columns []struct {
+			Name string `json:"name"`
+		} `json:"columns"`
+		Dataset [][]interface{} `json:"dataset"`
+	}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, QuestDBError(http.MethodGet, "/exec", fmt.Errorf("invalid response: %w", err))
+	}
+
+	rows := make([]map[string]interface{}, 0, len(result.Dataset))
+
+	for _, values := range result.Dataset {
+		row := make(map[string]interface{}, len(values))
+
+		for idx, value := range values {
+			if idx < len(result.Columns) && value != nil {
+				row[result.Columns[idx].Name] = value
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// createTable will create the table if it does not exist, with the designated timestamp and symbols of its mapping
+// as the upsert keys of a WAL table. The other columns are added by the server as they are written.
+func (stg *QuestDB) createTable(ctx context.Context, table string) error {
+	if _, ok := stg.created.Load(table); ok {
+		return nil
+	}
+
+	mapping := stg.mappingOf(table)
+
+	columns := []string{questDBQuote(mapping.time) + " TIMESTAMP"}
+	keys := []string{questDBQuote(mapping.time)}
+
+	for _, symbol := range mapping.tags {
+		columns = append(columns, questDBQuote(symbol)+" SYMBOL")
+		keys = append(keys, questDBQuote(symbol))
+	}
+
+	statement := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s) TIMESTAMP(%s) PARTITION BY %s WAL "+
+		"DEDUP UPSERT KEYS(%s)", questDBQuote(table), strings.Join(columns, ", "), questDBQuote(mapping.time),
+		stg.partitionBy, strings.Join(keys, ", "))
+
+	if _, err := stg.exec(ctx, statement); err != nil {
+		return fmt.Errorf("unable to create table %s: %w", table, err)
+	}
+
+	stg.created.Store(table, true)
+
+	return nil
+}
+
+// questDBRowOf will return the record as a row of the table, with the symbols, columns, and designated timestamp of
+// the mapping. Numbers are written as doubles, and objects and lists as JSON strings.
+func questDBRowOf(table string, record map[string]interface{}, mapping *influxDBMapping, precision float64,
+) (questDBRow, error) {
+	row := questDBRow{table: table}
+
+	symbols := append([]string(nil), mapping.tags...)
+	sort.Strings(symbols)
+
+	for _, symbol := range symbols {
+		if value, ok := influxDBTagValue(record[symbol]); ok {
+			row.symbols = append(row.symbols, questDBColumn{name: symbol, value: value})
+		}
+	}
+
+	for _, column := range lineFields(record, mapping) {
+		switch value := record[column].(type) {
+		case nil:
+		case bool, float64, string:
+			row.columns = append(row.columns, questDBColumn{name: column, value: value})
+		default:
+			data, _ := json.Marshal(value)
+			row.columns = append(row.columns, questDBColumn{name: column, value: string(data)})
+		}
+	}
+
+	if len(row.columns) == 0 {
+		return row, QuestDBRowError(table, "a row must have at least one non-null column")
+	}
+
+	if value, ok := record[mapping.time]; ok && value != nil {
+		ts, err := lineTimestamp(table, value, precision, QuestDBRowError)
+		if err != nil {
+			return row, err
+		}
+
+		row.ts = time.Unix(0, ts)
+	}
+
+	return row, nil
+}
+
+// send will add the row to the buffer of the sender.
+func (row questDBRow) send(ctx context.Context, sender qdb.LineSender) error {
+	sender.Table(row.table)
+
+	for _, symbol := range row.symbols {
+		sender.Symbol(symbol.name, symbol.value.(string))
+	}
+
+	for _, column := range row.columns {
+		switch value := column.value.(type) {
+		case bool:
+			sender.BoolColumn(column.name, value)
+		case float64:
+			sender.Float64Column(column.name, value)
+		case string:
+			sender.StringColumn(column.name, value)
+		}
+	}
+
+	if row.ts.IsZero() {
+		return sender.AtNow(ctx)
+	}
+
+	return sender.At(ctx, row.ts)
+}
+
+// lineSender will return an ILP sender of the server, authorized like the SQL requests. Auto-flushing is disabled,
+// so that the rows are flushed by "write".
+func (stg *QuestDB) lineSender(ctx context.Context) (qdb.LineSender, error) {
+	scheme, address, _ := strings.Cut(stg.endpoint, "://")
+
+	opts := []qdb.LineSenderOption{qdb.WithHttp(), qdb.WithAddress(address), qdb.WithAutoFlushDisabled()}
+	if scheme == "https" {
+		opts = append(opts, qdb.WithTls())
+	}
+
+	if transport, ok := compliance.Transport().(*http.Transport); ok {
+		opts = append(opts, qdb.WithHttpTransport(transport))
+	}
+
+	if password, ok := stg.user.Password(); ok || stg.user.Username() != "" {
+		opts = append(opts, qdb.WithBasicAuth(stg.user.Username(), password))
+	} else if stg.token != "" {
+		opts = append(opts, qdb.WithBearerToken(stg.token))
+	}
+
+	return qdb.NewLineSender(ctx, opts...)
+}
+
+// write will write the rows with ILP, in requests of up to "questDBWriteLines" rows.
+func (stg *QuestDB) write(ctx context.Context, rows []questDBRow) error {
+	sender, err := stg.lineSender(ctx)
+	if err != nil {
+		return QuestDBError(http.MethodPost, "/write", err)
+	}
+
+	defer func() { _ = sender.Close(ctx) }()
+
+	for idx, row := range rows {
+		if err := row.send(ctx, sender); err != nil {
+			return QuestDBError(http.MethodPost, "/write", err)
+		}
+
+		if (idx+1)%questDBWriteLines != 0 && idx != len(rows)-1 {
+			continue
+		}
+
+		if err := sender.Flush(ctx); err != nil {
+			return QuestDBError(http.MethodPost, "/write", err)
+		}
+	}
+
+	return nil
+}
+
+// Upsert will write each record as a row of the table, which is created on the first write. Within a transaction,
+// the rows are written when the transaction commits.
+func (stg *QuestDB) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	table := req.GetTable()
+	rows := make([]questDBRow, 0, len(records))
+
+	for _, record := range records {
+		row, err := questDBRowOf(table, record.AsMap(), stg.mappingOf(table), stg.precision)
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 {
+		return &proto.UpsertResponse{}, nil
+	}
+
+	if err := stg.createTable(ctx, table); err != nil {
+		return nil, err
+	}
+
+	if tx := stg.tx(ctx); tx != nil {
+		tx.mtx.Lock()
+		defer tx.mtx.Unlock()
+
+		tx.rows = append(tx.rows, rows...)
+
+		return &proto.UpsertResponse{UpsertedCount: int64(len(rows))}, nil
+	}
+
+	if err := stg.write(ctx, rows); err != nil {
+		return nil, fmt.Errorf("unable to upsert records: %w", err)
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(rows))}, nil
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *QuestDB) tx(ctx context.Context) *questDBTx {
+	txID, ok := ctx.Value(basicQuestDBTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	questTx, _ := tx.(*questDBTx)
+
+	return questTx
+}
+
+// Read will return the rows of the table as records that match the required fields on the request, in the page
+// requested by the options of the request, if any. Timestamps are read as RFC 3339 strings.
+func (stg *QuestDB) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stg.exec(ctx, "SELECT * FROM "+questDBQuote(req.GetTable()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read records: %w", err)
+	}
+
+	records := make([]map[string]interface{}, 0, len(rows))
+
+	for _, row := range rows {
+		if parquetMatches(row, nil, req.GetRequired().GetFields()) {
+			records = append(records, row)
+		}
+	}
+
+	return redisPage(records, page)
+}
+
+// Count will return the number of rows of the table that match the required fields. Without required fields the rows
+// are counted with "SELECT count()", and otherwise they are read and filtered like "Read".
+func (stg *QuestDB) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	if len(req.GetRequired().GetFields()) > 0 {
+		return readCount(ctx, stg, req)
+	}
+
+	rows, err := stg.exec(ctx, "SELECT count() FROM "+questDBQuote(req.GetTable()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to count records: %w", err)
+	}
+
+	rsp := new(proto.CountResponse)
+
+	if len(rows) > 0 {
+		if count, ok := rows[0]["count"].(float64); ok {
+			rsp.Count = int64(count)
+		}
+	}
+
+	return rsp, nil
+}
+
+// Truncate will delete every row of the tables that exist. The server does not report the number of deleted rows, so
+// the deleted count is zero.
+func (stg *QuestDB) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	tables, err := stg.ListTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	for _, table := range req.GetTables() {
+		if _, ok := tables.GetTableSet()[table]; !ok {
+			continue
+		}
+
+		if _, err := stg.exec(ctx, "TRUNCATE TABLE "+questDBQuote(table)); err != nil {
+			return nil, fmt.Errorf("error truncating table %s: %w", table, err)
+		}
+	}
+
+	return &proto.TruncateResponse{}, nil
+}
+
+// ListTables will return the tables of the database. Table sizes are reported as zero.
+func (stg *QuestDB) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	rows, err := stg.exec(ctx, "SHOW TABLES")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tables: %w", err)
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+
+	for _, row := range rows {
+		// The column of the table names is "table" before QuestDB 8.0, and "table_name" after.
+		for _, column := range []string{"table_name", "table"} {
+			if name, ok := row[column].(string); ok {
+				rsp.TableSet[name] = &proto.Table{}
+
+				break
+			}
+		}
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will return the symbols and the designated timestamp of each table, which are its upsert keys.
+func (stg *QuestDB) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	tables, err := stg.ListTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+
+	for table := range tables.GetTableSet() {
+		mapping := stg.mappingOf(table)
+		rsp.PKSet[table] = &proto.PrimaryKeys{List: append(append([]string(nil), mapping.tags...), mapping.time)}
+	}
+
+	return rsp, nil
+}
+
+// StartTx will start a transaction. The rows of the functions sent to the transaction are buffered, and written when
+// the transaction commits. Each ILP request is committed by the server on its own, so a commit that fails may have
+// written some of the rows. Reads in the transaction do not see its buffered rows.
+func (stg *QuestDB) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+	tx := new(questDBTx)
+
+	stg.activeTx.Store(txnID, tx)
+
+	questCtx := context.WithValue(ctx, basicQuestDBTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+
+		var err error
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(questCtx, stg)
+		}
+
+		if err != nil {
+			<-txn.commit
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit {
+			if err = stg.write(ctx, tx.rows); err != nil {
+				err = fmt.Errorf("unable to commit transaction: %w", err)
+			}
+		}
+
+		txn.done <- err
+	}()
+
+	return txn, nil
+}
@@ -0,0 +1,286 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// questDBServer is a QuestDB server that records the bodies of ILP requests and the SQL statements, and answers
+// every "SELECT" with its rows and every "SHOW TABLES" with its tables.
+type questDBServer struct {
+	mtx        sync.Mutex
+	rows       string
+	tables     []string
+	writes     []string
+	statements []string
+}
+
+func (srv *questDBServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != "quest" {
+		http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+
+		return
+	}
+
+	switch r.URL.Path {
+	case "/write":
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "bad") {
+			http.Error(w, `{"code":"invalid","message":"failed to parse line protocol"}`, http.StatusBadRequest)
+
+			return
+		}
+
+		srv.writes = append(srv.writes, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	case "/exec":
+		statement := r.URL.Query().Get("query")
+		srv.statements = append(srv.statements, statement)
+
+		switch {
+		case statement == "SHOW TABLES":
+			dataset := make([]string, 0, len(srv.tables))
+			for _, table := range srv.tables {
+				dataset = append(dataset, `[1,"`+table+`"]`)
+			}
+
+			_, _ = io.WriteString(w, `{"columns":[{"name":"id","type":"INT"},{"name":"table_name","type":"STRING"}],`+
+				`"dataset":[`+strings.Join(dataset, ",")+`]}`)
+		case strings.HasPrefix(statement, "SELECT"):
+			_, _ = io.WriteString(w, srv.rows)
+		default:
+			_, _ = io.WriteString(w, `{"ddl":"OK"}`)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestQuestDB(t *testing.T, params string) (*QuestDB, *questDBServer) {
+	t.Helper()
+
+	srv := new(questDBServer)
+
+	server := httptest.NewServer(srv)
+	t.Cleanup(server.Close)
+
+	svc, err := New(context.Background(), "questdb://admin:quest@"+strings.TrimPrefix(server.URL, "http://")+params)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	stg, ok := svc.Storage.(*QuestDB)
+	if !ok {
+		t.Fatalf("expected questdb storage, got %T", svc.Storage)
+	}
+
+	return stg, srv
+}
+
+func TestQuestDB(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("dsn", func(t *testing.T) {
+		t.Parallel()
+
+		for _, dns := range []string{
+			"questdb://quest1:9000/qdb",
+			"questdb://quest1?tls=maybe",
+			"questdb://quest1?precision=m",
+			"questdb://quest1?partitionBy=MINUTE",
+		} {
+			if _, err := New(ctx, dns); !errors.Is(err, ErrDNSNotSupported) {
+				t.Fatalf("expected error %v for %q, got %v", ErrDNSNotSupported, dns, err)
+			}
+		}
+
+		svc, err := New(ctx, "questdb://quest1?tls=true&partitionBy=month&symbols=exchange"+
+			"&symbols.candles=exchange,product_id&columns.candles=open,close&timestamp.candles=start")
+		if err != nil {
+			t.Fatalf("failed to create storage: %v", err)
+		}
+
+		stg, _ := svc.Storage.(*QuestDB)
+		if stg.Type() != QuestDBType || stg.endpoint != "https://quest1:9000" || stg.partitionBy != "MONTH" {
+			t.Fatalf("unexpected storage %+v", stg)
+		}
+
+		exp := &influxDBMapping{tags: []string{"exchange", "product_id"}, fields: []string{"open", "close"}, time: "start"}
+		if mapping := stg.mappingOf("candles"); !reflect.DeepEqual(mapping, exp) {
+			t.Fatalf("expected mapping %+v, got %+v", exp, mapping)
+		}
+
+		if mapping := stg.mappingOf("trades"); !reflect.DeepEqual(mapping.tags, []string{"exchange"}) ||
+			mapping.fields != nil || mapping.time != "timestamp" {
+			t.Fatalf("expected the mapping of every table, got %+v", mapping)
+		}
+	})
+
+	t.Run("upsert", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestQuestDB(t, "?symbols.candles=product_id&timestamp.candles=start&precision=ms")
+
+		for i := 0; i < 2; i++ {
+			_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(`[
+				{"start": 1500, "product_id": "BTC-USD", "open": 1.5},
+				{"start": "2022-01-02T03:04:05.5Z", "product_id": "ETH-USD", "open": 2}
+			]`)})
+			if err != nil {
+				t.Fatalf("failed to upsert records: %v", err)
+			}
+		}
+
+		exp := "candles,product_id=BTC-USD open=1.5 1500000000\n" +
+			"candles,product_id=ETH-USD open=2 1641092645500000000\n"
+		if len(srv.writes) != 2 || srv.writes[0] != exp {
+			t.Fatalf("expected write %q, got %q", exp, srv.writes)
+		}
+
+		create := `CREATE TABLE IF NOT EXISTS "candles" ("start" TIMESTAMP, "product_id" SYMBOL) TIMESTAMP("start") ` +
+			`PARTITION BY DAY WAL DEDUP UPSERT KEYS("start", "product_id")`
+		if !reflect.DeepEqual(srv.statements, []string{create}) {
+			t.Fatalf("expected the table to be created once with %q, got %q", create, srv.statements)
+		}
+	})
+
+	t.Run("read", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestQuestDB(t, "?symbols=product_id&timestamp=start")
+		srv.tables = []string{"candles", "trades"}
+		srv.rows = `{"columns":[{"name":"product_id"},{"name":"open"},{"name":"start"}],"dataset":[` +
+			`["BTC-USD",1.5,"2022-01-02T00:00:00.000000Z"],` +
+			`["ETH-USD",null,"2022-01-01T00:00:00.000000Z"],` +
+			`["BTC-USD",2.5,"2022-01-01T00:00:00.000000Z"]]}`
+
+		opts, err := structpb.NewStruct(map[string]interface{}{ReadOrderByOption: []interface{}{"start"}, ReadLimitOption: 1})
+		if err != nil {
+			t.Fatalf("failed to create read options: %v", err)
+		}
+
+		required, err := structpb.NewStruct(map[string]interface{}{"product_id": "BTC-USD"})
+		if err != nil {
+			t.Fatalf("failed to create required fields: %v", err)
+		}
+
+		rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: "candles", Required: required, Options: opts})
+		if err != nil {
+			t.Fatalf("failed to read records: %v", err)
+		}
+
+		var records []map[string]interface{}
+		for _, record := range rsp.GetRecords() {
+			records = append(records, record.AsMap())
+		}
+
+		exp := []map[string]interface{}{{"product_id": "BTC-USD", "open": 2.5, "start": "2022-01-01T00:00:00.000000Z"}}
+		if !reflect.DeepEqual(records, exp) {
+			t.Fatalf("expected records %v, got %v", exp, records)
+		}
+
+		pks, err := stg.ListPrimaryKeys(ctx)
+		if err != nil || !reflect.DeepEqual(pks.GetPKSet()["candles"].GetList(), []string{"product_id", "start"}) ||
+			len(pks.GetPKSet()) != 2 {
+			t.Fatalf("expected the symbols and timestamp of each table as primary keys, got %v: %v", pks, err)
+		}
+
+		if _, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"candles", "missing"}}); err != nil {
+			t.Fatalf("failed to truncate tables: %v", err)
+		}
+
+		if last := srv.statements[len(srv.statements)-1]; last != `TRUNCATE TABLE "candles"` {
+			t.Fatalf("expected only the existing table to be truncated, got %q", srv.statements)
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestQuestDB(t, "")
+		srv.rows = `{"columns":[{"name":"count","type":"LONG"}],"dataset":[[3]]}`
+
+		rsp, err := stg.Count(ctx, &proto.CountRequest{Table: "candles"})
+		if err != nil || rsp.GetCount() != 3 || srv.statements[0] != `SELECT count() FROM "candles"` {
+			t.Fatalf("expected 3 rows counted by the server, got %v from %q: %v", rsp, srv.statements, err)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		stg, _ := newTestQuestDB(t, "")
+
+		for _, data := range []string{`[{"timestamp": 1}]`, `[{"timestamp": "yesterday", "open": 1}]`} {
+			_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(data)})
+			if !errors.Is(err, ErrQuestDBRow) {
+				t.Fatalf("expected row error for %s, got %v", data, err)
+			}
+		}
+
+		_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(`[{"note": "bad"}]`)})
+		if !errors.Is(err, ErrQuestDB) || !strings.Contains(err.Error(), "failed to parse line protocol") {
+			t.Fatalf("expected the error of the server, got %v", err)
+		}
+
+		stg.user = nil
+		if _, err := stg.ListTables(ctx); !errors.Is(err, ErrQuestDB) || !strings.Contains(err.Error(), "unauthorized") {
+			t.Fatalf("expected an unauthorized error, got %v", err)
+		}
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newTestQuestDB(t, "")
+
+		for _, commit := range []bool{false, true} {
+			txn, err := stg.StartTx(ctx)
+			if err != nil {
+				t.Fatalf("failed to start transaction: %v", err)
+			}
+
+			txn.Send(func(ctx context.Context, stg Storage) error {
+				_, err := stg.Upsert(ctx, &proto.UpsertRequest{Table: "candles", Data: []byte(`[{"open": 1}]`)})
+
+				return err
+			})
+
+			if commit {
+				err = txn.Commit()
+			} else {
+				err = txn.Rollback()
+			}
+
+			if err != nil {
+				t.Fatalf("failed to end transaction: %v", err)
+			}
+		}
+
+		if len(srv.writes) != 1 || srv.writes[0] != "candles open=1\n" {
+			t.Fatalf("expected the committed rows to be written, got %q", srv.writes)
+		}
+	})
+}
@@ -0,0 +1,729 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// redisPrefixParam is the connection string parameter for the prefix of the keys of the records, e.g.
+	// "prefix=cache". The records of a table are stored under "<prefix>:<table>:<primary key>".
+	redisPrefixParam = "prefix"
+
+	// redisPrimaryKeyParam is the connection string parameter for the field of the records that keys them in every
+	// table, e.g. "primaryKey=id". The field for a single table is set with "primaryKey.<table>", e.g.
+	// "primaryKey.candles=time".
+	redisPrimaryKeyParam = "primaryKey"
+
+	redisDefaultPrefix     = "gidari"
+	redisDefaultPrimaryKey = "id"
+
+	// redisScanCount is the number of keys that each SCAN of a table is asked to return, and the number of keys
+	// deleted or read in each round trip.
+	redisScanCount = 1000
+)
+
+var (
+	ErrRedisPrimaryKey = fmt.Errorf("invalid redis primary key")
+	ErrRedisTableName  = fmt.Errorf("invalid redis table name")
+)
+
+// RedisPrimaryKeyError is returned when a record does not have a primary key that can key a Redis hash.
+func RedisPrimaryKeyError(table, field string) error {
+	return fmt.Errorf("%w: records of %q must have a string, number, or boolean %q field", ErrRedisPrimaryKey, table,
+		field)
+}
+
+// RedisTableNameError is returned for a table whose name contains the ":" separator of the keys, since the keys of
+// the table "a" would then also match the keys of the table "a:b".
+func RedisTableNameError(table string) error {
+	return fmt.Errorf("%w: %q must not contain \":\"", ErrRedisTableName, table)
+}
+
+// checkRedisTable will return an error if the table name can not be separated from the primary keys of its records.
+func checkRedisTable(table string) error {
+	if strings.Contains(table, ":") {
+		return RedisTableNameError(table)
+	}
+
+	return nil
+}
+
+// redisTxType is the type of the context key of Redis transactions.
+type redisTxType uint8
+
+const (
+	basicRedisTxID redisTxType = iota
+)
+
+// redisHash is the key of the hash of a record, and the names and values of the fields of the record to set on it.
+type redisHash struct {
+	key    string
+	fields []interface{}
+}
+
+// redisTx are the writes of a transaction, queued until the transaction commits.
+type redisTx struct {
+	mtx    sync.Mutex
+	hashes []redisHash
+}
+
+// Redis is a key/value storage device that stores each record as a hash, keyed by a primary key field of the record,
+// e.g. for caching hot web API data alongside a relational copy. The fields of the hash are the fields of the record:
+// strings are stored as they are, and other values as JSON.
+type Redis struct {
+	client *redis.Client
+
+	prefix      string
+	primaryKey  string
+	primaryKeys map[string]string
+
+	// activeTx are the transactions that are currently active on the connection, keyed by the transaction ID that is
+	// added to the context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewRedis will return a Redis storage device for the connection string, i.e.
+// "redis://[[user]:password@]host[:port][/db]", or "rediss://" to connect with TLS. The records of a table are stored
+// under "<prefix>:<table>:<primary key>", with the "prefix" parameter (default "gidari") and the "primaryKey"
+// parameter (default "id", or "primaryKey.<table>" for a single table) of the connection string.
+func NewRedis(_ context.Context, connectionURL string) (*Redis, error) {
+	dnsURL, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	stg := &Redis{
+		prefix:      redisDefaultPrefix,
+		primaryKey:  redisDefaultPrimaryKey,
+		primaryKeys: make(map[string]string),
+	}
+
+	// The parameters of the storage are removed before the URL is parsed for the options of the client.
+	params := dnsURL.Query()
+	for key, values := range params {
+		switch table := strings.TrimPrefix(key, redisPrimaryKeyParam+"."); {
+		case key == redisPrefixParam:
+			stg.prefix = values[0]
+		case key == redisPrimaryKeyParam:
+			stg.primaryKey = values[0]
+		case table != key:
+			stg.primaryKeys[table] = values[0]
+		default:
+			continue
+		}
+
+		params.Del(key)
+	}
+
+	dnsURL.RawQuery = params.Encode()
+
+	opts, err := redis.ParseURL(dnsURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	if opts.TLSConfig != nil {
+		opts.TLSConfig = compliance.TLSConfig(opts.TLSConfig.ServerName)
+	}
+
+	stg.client = redis.NewClient(opts)
+
+	return stg, nil
+}
+
+// Close will close the connection to the Redis server.
+func (stg *Redis) Close() {
+	stg.client.Close()
+}
+
+// IsNoSQL returns "true" to indicate that "Redis" is a NoSQL database.
+func (stg *Redis) IsNoSQL() bool { return true }
+
+// Type implements the storage interface.
+func (stg *Redis) Type() uint8 { return RedisType }
+
+// tablePrimaryKey will return the field of the records of the table that keys them.
+func (stg *Redis) tablePrimaryKey(table string) string {
+	if field, ok := stg.primaryKeys[table]; ok {
+		return field
+	}
+
+	return stg.primaryKey
+}
+
+// key will return the key of the hash of the record of the table with the primary key value.
+func (stg *Redis) key(table, id string) string {
+	return stg.prefix + ":" + table + ":" + id
+}
+
+// tablePattern will return the SCAN pattern for the keys of the table, or for the keys of every table if the table is
+// empty.
+func (stg *Redis) tablePattern(table string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	if table == "" {
+		return escape.Replace(stg.prefix+":") + "*"
+	}
+
+	return escape.Replace(stg.prefix+":"+table+":") + "*"
+}
+
+// scan will return the keys that match the pattern, sorted.
+func (stg *Redis) scan(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+
+	iter := stg.client.Scan(ctx, 0, pattern, redisScanCount).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("unable to scan keys: %w", err)
+	}
+
+	// A key may be returned more than once by a scan.
+	sort.Strings(keys)
+
+	unique := keys[:0]
+	for idx, key := range keys {
+		if idx == 0 || key != keys[idx-1] {
+			unique = append(unique, key)
+		}
+	}
+
+	return unique, nil
+}
+
+// ListTables will return the tables with at least one record. Redis does not report the size of a table, so the size
+// of every table is zero.
+func (stg *Redis) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	keys, err := stg.scan(ctx, stg.tablePattern(""))
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+
+	for _, key := range keys {
+		table := strings.TrimPrefix(key, stg.prefix+":")
+		if idx := strings.Index(table, ":"); idx > 0 {
+			rsp.TableSet[table[:idx]] = &proto.Table{}
+		}
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will return the primary key field of each table with at least one record.
+func (stg *Redis) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	tables, err := stg.ListTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+
+	for table := range tables.GetTableSet() {
+		rsp.PKSet[table] = &proto.PrimaryKeys{List: []string{stg.tablePrimaryKey(table)}}
+	}
+
+	return rsp, nil
+}
+
+// encodeRedisValue will encode a field of a record as the value of a hash field: strings as they are, and other
+// values as JSON. Strings that are valid JSON, e.g. "1", are encoded as JSON strings so that they are not read back
+// as numbers. Null values are not stored.
+func encodeRedisValue(value *structpb.Value) (string, bool, error) {
+	switch kind := value.GetKind().(type) {
+	case *structpb.Value_NullValue, nil:
+		return "", false, nil
+	case *structpb.Value_StringValue:
+		if !json.Valid([]byte(kind.StringValue)) {
+			return kind.StringValue, true, nil
+		}
+	}
+
+	data, err := value.MarshalJSON()
+	if err != nil {
+		return "", false, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+	}
+
+	return string(data), true, nil
+}
+
+// redisPrimaryKey will encode the primary key of a record for the key of its hash, if it is a string, number, or
+// boolean. Strings are used as they are.
+func redisPrimaryKey(value *structpb.Value) (string, bool) {
+	switch kind := value.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		return kind.StringValue, true
+	case *structpb.Value_NumberValue, *structpb.Value_BoolValue:
+		id, ok, err := encodeRedisValue(value)
+
+		return id, ok && err == nil
+	}
+
+	return "", false
+}
+
+// decodeRedisValue will decode the value of a hash field: JSON values are decoded, and other values are strings.
+func decodeRedisValue(value string) interface{} {
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		return value
+	}
+
+	return decoded
+}
+
+// Upsert will write each record as a hash keyed by its primary key, setting the fields of the record on the hash.
+// Fields of an existing hash that are not on the record are kept. Within a transaction, the writes are queued until
+// the transaction commits.
+func (stg *Redis) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	if len(records) == 0 {
+		return &proto.UpsertResponse{}, nil
+	}
+
+	table := req.GetTable()
+	if err := checkRedisTable(table); err != nil {
+		return nil, err
+	}
+
+	field := stg.tablePrimaryKey(table)
+
+	hashes := make([]redisHash, 0, len(records))
+
+	for _, rec := range records {
+		id, ok := redisPrimaryKey(rec.GetFields()[field])
+		if !ok {
+			return nil, RedisPrimaryKeyError(table, field)
+		}
+
+		hash := redisHash{key: stg.key(table, id), fields: make([]interface{}, 0, 2*len(rec.GetFields()))}
+
+		names := make([]string, 0, len(rec.GetFields()))
+		for name := range rec.GetFields() {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			value, ok, err := encodeRedisValue(rec.GetFields()[name])
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				hash.fields = append(hash.fields, name, value)
+			}
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	if tx := stg.tx(ctx); tx != nil {
+		tx.mtx.Lock()
+		tx.hashes = append(tx.hashes, hashes...)
+		tx.mtx.Unlock()
+	} else if err := stg.exec(ctx, hashes); err != nil {
+		return nil, fmt.Errorf("unable to upsert records: %w", err)
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+}
+
+// exec will set the fields of the hashes atomically, in a MULTI/EXEC transaction.
+func (stg *Redis) exec(ctx context.Context, hashes []redisHash) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	_, err := stg.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, hash := range hashes {
+			pipe.HSet(ctx, hash.key, hash.fields...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to execute transaction: %w", err)
+	}
+
+	return nil
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *Redis) tx(ctx context.Context) *redisTx {
+	txID, ok := ctx.Value(basicRedisTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	redisTx, _ := tx.(*redisTx)
+
+	return redisTx
+}
+
+// Read will return the records of the table that match the required fields on the request, in the page requested by
+// the options of the request, if any. If the only required field is the primary key, the records are read by key,
+// and otherwise every record of the table is read and filtered.
+func (stg *Redis) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	table := req.GetTable()
+	if err := checkRedisTable(table); err != nil {
+		return nil, err
+	}
+
+	required := req.GetRequired().GetFields()
+
+	var keys []string
+
+	if ids, ok := required[stg.tablePrimaryKey(table)]; ok && len(required) == 1 {
+		values := []*structpb.Value{ids}
+		if list := ids.GetListValue(); list != nil {
+			values = list.GetValues()
+		}
+
+		for _, value := range values {
+			if id, ok := redisPrimaryKey(value); ok {
+				keys = append(keys, stg.key(table, id))
+			}
+		}
+	} else if keys, err = stg.scan(ctx, stg.tablePattern(table)); err != nil {
+		return nil, err
+	}
+
+	var records []map[string]interface{}
+
+	for start := 0; start < len(keys); start += redisScanCount {
+		end := start + redisScanCount
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		cmds := make([]*redis.MapStringStringCmd, 0, end-start)
+
+		_, err := stg.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys[start:end] {
+				cmds = append(cmds, pipe.HGetAll(ctx, key))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to read records: %w", err)
+		}
+
+		for _, cmd := range cmds {
+			if hash := cmd.Val(); len(hash) > 0 && redisMatches(hash, required) {
+				records = append(records, redisRecord(hash))
+			}
+		}
+	}
+
+	return redisPage(records, page)
+}
+
+// Count will return the number of records of the table that match the required fields. Without required fields the
+// keys of the table are counted by a scan, and if the only required field is the primary key the keys are counted
+// with "EXISTS". Otherwise every record of the table is read and filtered.
+func (stg *Redis) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	table := req.GetTable()
+	if err := checkRedisTable(table); err != nil {
+		return nil, err
+	}
+
+	required := req.GetRequired().GetFields()
+
+	if len(required) == 0 {
+		keys, err := stg.scan(ctx, stg.tablePattern(table))
+		if err != nil {
+			return nil, err
+		}
+
+		return &proto.CountResponse{Count: int64(len(keys))}, nil
+	}
+
+	ids, ok := required[stg.tablePrimaryKey(table)]
+	if !ok || len(required) != 1 {
+		return readCount(ctx, stg, req)
+	}
+
+	values := []*structpb.Value{ids}
+	if list := ids.GetListValue(); list != nil {
+		values = list.GetValues()
+	}
+
+	var keys []string
+
+	for _, value := range values {
+		if id, ok := redisPrimaryKey(value); ok {
+			keys = append(keys, stg.key(table, id))
+		}
+	}
+
+	if len(keys) == 0 {
+		return &proto.CountResponse{}, nil
+	}
+
+	count, err := stg.client.Exists(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("unable to count records: %w", err)
+	}
+
+	return &proto.CountResponse{Count: count}, nil
+}
+
+// redisMatches will return true if the fields of the hash have the required values. A required list matches any of
+// its values.
+func redisMatches(hash map[string]string, required map[string]*structpb.Value) bool {
+	for name, want := range required {
+		got, ok := hash[name]
+		if !ok {
+			return false
+		}
+
+		values := []*structpb.Value{want}
+		if list := want.GetListValue(); list != nil {
+			values = list.GetValues()
+		}
+
+		matched := false
+
+		for _, value := range values {
+			if encoded, ok, _ := encodeRedisValue(value); ok && encoded == got {
+				matched = true
+
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// redisRecord will decode the fields of a hash into a record.
+func redisRecord(hash map[string]string) map[string]interface{} {
+	rec := make(map[string]interface{}, len(hash))
+	for name, value := range hash {
+		rec[name] = decodeRedisValue(value)
+	}
+
+	return rec
+}
+
+// redisPage will sort the records by the "orderBy" fields of the page, and return the records after the "after"
+// values, up to the limit.
+func redisPage(records []map[string]interface{}, page *readPage) (*proto.ReadResponse, error) {
+	if page != nil && len(page.orderBy) > 0 {
+		sort.SliceStable(records, func(i, j int) bool {
+			for _, field := range page.orderBy {
+				if cmp := compareRedisValues(records[i][field], records[j][field]); cmp != 0 {
+					return cmp < 0
+				}
+			}
+
+			return false
+		})
+	}
+
+	rsp := new(proto.ReadResponse)
+
+	for _, rec := range records {
+		if page != nil && len(page.after) > 0 && !redisAfter(rec, page) {
+			continue
+		}
+
+		if page != nil && page.limit > 0 && len(rsp.Records) == page.limit {
+			break
+		}
+
+		record, err := structpb.NewStruct(rec)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert record: %w", err)
+		}
+
+		rsp.Records = append(rsp.Records, record)
+	}
+
+	return rsp, nil
+}
+
+// redisAfter will return true if the record sorts after the "after" values of the page.
+func redisAfter(rec map[string]interface{}, page *readPage) bool {
+	for idx, field := range page.orderBy {
+		if cmp := compareRedisValues(rec[field], page.after[idx]); cmp != 0 {
+			return cmp > 0
+		}
+	}
+
+	return false
+}
+
+// compareRedisValues will compare two decoded values: missing values sort first, then booleans, numbers, and strings,
+// with values of the same type compared by value and other values compared as JSON.
+func compareRedisValues(left, right interface{}) int {
+	rank := func(value interface{}) int {
+		switch value.(type) {
+		case nil:
+			return 0
+		case bool:
+			return 1
+		case float64:
+			return 2
+		case string:
+			return 3
+		default:
+			return 4
+		}
+	}
+
+	if rl, rr := rank(left), rank(right); rl != rr {
+		return rl - rr
+	}
+
+	switch left := left.(type) {
+	case bool:
+		if left == right.(bool) {
+			return 0
+		} else if !left {
+			return -1
+		}
+
+		return 1
+	case float64:
+		if right := right.(float64); left < right {
+			return -1
+		} else if left > right {
+			return 1
+		}
+
+		return 0
+	case string:
+		return strings.Compare(left, right.(string))
+	case nil:
+		return 0
+	}
+
+	leftJSON, _ := json.Marshal(left)
+	rightJSON, _ := json.Marshal(right)
+
+	return strings.Compare(string(leftJSON), string(rightJSON))
+}
+
+// Truncate will delete every record of the tables.
+func (stg *Redis) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	var deleted int32
+
+	for _, table := range req.GetTables() {
+		if err := checkRedisTable(table); err != nil {
+			return nil, err
+		}
+
+		keys, err := stg.scan(ctx, stg.tablePattern(table))
+		if err != nil {
+			return nil, err
+		}
+
+		for start := 0; start < len(keys); start += redisScanCount {
+			end := start + redisScanCount
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			count, err := stg.client.Del(ctx, keys[start:end]...).Result()
+			if err != nil {
+				return nil, fmt.Errorf("error truncating table %s: %w", table, err)
+			}
+
+			deleted += int32(count)
+		}
+	}
+
+	return &proto.TruncateResponse{DeletedCount: deleted}, nil
+}
+
+// StartTx will start a transaction. The writes of the functions sent to the transaction are queued, and written
+// atomically in a MULTI/EXEC transaction when the transaction commits. Reads in the transaction do not see its
+// queued writes.
+func (stg *Redis) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+	tx := new(redisTx)
+
+	stg.activeTx.Store(txnID, tx)
+
+	redisCtx := context.WithValue(ctx, basicRedisTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+
+		var err error
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(redisCtx, stg)
+		}
+
+		if err != nil {
+			<-txn.commit
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit {
+			txn.done <- stg.exec(ctx, tx.hashes)
+		} else {
+			txn.done <- nil
+		}
+	}()
+
+	return txn, nil
+}
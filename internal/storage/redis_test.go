@@ -0,0 +1,219 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/internal/storage/storagetest"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func newRedis(t *testing.T, suffix string) (*storage.Service, *miniredis.Miniredis) {
+	t.Helper()
+
+	srv := miniredis.RunT(t)
+
+	stg, err := storage.New(context.Background(), "redis://"+srv.Addr()+suffix)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	t.Cleanup(stg.Close)
+
+	return stg, srv
+}
+
+// redisHash will return the fields of the hash in the database of the server, or nil if there is no hash.
+func redisHash(srv *miniredis.Miniredis, db int, key string) map[string]string {
+	names, err := srv.DB(db).HKeys(key)
+	if err != nil {
+		return nil
+	}
+
+	hash := make(map[string]string, len(names))
+	for _, name := range names {
+		hash[name] = srv.DB(db).HGet(key, name)
+	}
+
+	return hash
+}
+
+func upsertRedis(t *testing.T, stg storage.Storage, table string, records ...map[string]interface{}) error {
+	t.Helper()
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		t.Fatalf("failed to marshal records: %v", err)
+	}
+
+	_, err = stg.Upsert(context.Background(), &proto.UpsertRequest{Table: table, Data: data})
+
+	return err
+}
+
+func TestRedis(t *testing.T) {
+	t.Parallel()
+
+	t.Run("conformance", func(t *testing.T) {
+		t.Parallel()
+
+		stg, _ := newRedis(t, "")
+		if stg.Type() != storage.RedisType || !stg.IsNoSQL() {
+			t.Fatalf("expected a NoSQL redis storage, got type %d", stg.Type())
+		}
+
+		storagetest.Run(t, stg, "conformance")
+	})
+
+	t.Run("keys", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newRedis(t, "/1?prefix=cache&primaryKey.candles=time")
+		ctx := context.Background()
+
+		candle := map[string]interface{}{"time": 1, "open": "1.5", "note": nil}
+		if err := upsertRedis(t, stg, "candles", candle); err != nil {
+			t.Fatalf("failed to upsert records: %v", err)
+		}
+
+		account := map[string]interface{}{"id": "abc", "tags": []string{"x"}}
+		if err := upsertRedis(t, stg, "accounts", account); err != nil {
+			t.Fatalf("failed to upsert records: %v", err)
+		}
+
+		// Strings that are valid JSON are stored as JSON strings, and null fields are not stored.
+		exp := map[string]string{"time": "1", "open": `"1.5"`}
+		if got := redisHash(srv, 1, "cache:candles:1"); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("expected hash %v, got %v", exp, got)
+		}
+
+		exp = map[string]string{"id": "abc", "tags": `["x"]`}
+		if got := redisHash(srv, 1, "cache:accounts:abc"); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("expected hash %v, got %v", exp, got)
+		}
+
+		pks, err := stg.ListPrimaryKeys(ctx)
+		if err != nil {
+			t.Fatalf("failed to list primary keys: %v", err)
+		}
+
+		if got := pks.GetPKSet()["candles"].GetList(); !reflect.DeepEqual(got, []string{"time"}) {
+			t.Fatalf("expected primary key [time], got %v", got)
+		}
+
+		if got := pks.GetPKSet()["accounts"].GetList(); !reflect.DeepEqual(got, []string{"id"}) {
+			t.Fatalf("expected primary key [id], got %v", got)
+		}
+
+		req := &proto.ReadRequest{Table: "candles"}
+		if err := tools.AssignReadRequired(req, "time", 1); err != nil {
+			t.Fatalf("failed to assign required fields: %v", err)
+		}
+
+		before := srv.CommandCount()
+
+		rsp, err := stg.Read(ctx, req)
+		if err != nil {
+			t.Fatalf("failed to read records: %v", err)
+		}
+
+		record := map[string]interface{}{"time": 1.0, "open": "1.5"}
+		if len(rsp.GetRecords()) != 1 || !reflect.DeepEqual(rsp.GetRecords()[0].AsMap(), record) {
+			t.Fatalf("expected record %v, got %v", record, rsp.GetRecords())
+		}
+
+		// Reading by primary key does not scan the table, and only reads the hash of the key.
+		if cmds := srv.CommandCount() - before; cmds != 1 {
+			t.Fatalf("expected the hash to be read by key, got %d commands", cmds)
+		}
+
+		count, err := stg.Count(ctx, &proto.CountRequest{Table: "candles"})
+		if err != nil || count.GetCount() != 1 {
+			t.Fatalf("expected 1 candle counted, got %v: %v", count, err)
+		}
+
+		required, err := structpb.NewStruct(map[string]interface{}{"time": []interface{}{1, 2}})
+		if err != nil {
+			t.Fatalf("failed to create required fields: %v", err)
+		}
+
+		before = srv.CommandCount()
+
+		count, err = stg.Count(ctx, &proto.CountRequest{Table: "candles", Required: required})
+		if err != nil || count.GetCount() != 1 {
+			t.Fatalf("expected 1 candle counted by primary key, got %v: %v", count, err)
+		}
+
+		if cmds := srv.CommandCount() - before; cmds != 1 {
+			t.Fatalf("expected the keys to be counted with EXISTS, got %d commands", cmds)
+		}
+
+		truncated, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"candles", "accounts"}})
+		if err != nil {
+			t.Fatalf("failed to truncate tables: %v", err)
+		}
+
+		if truncated.GetDeletedCount() != 2 {
+			t.Fatalf("expected 2 deleted records, got %d", truncated.GetDeletedCount())
+		}
+	})
+
+	t.Run("missing primary key", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newRedis(t, "")
+
+		err := upsertRedis(t, stg, "accounts", map[string]interface{}{"id": "1"}, map[string]interface{}{"name": "a"})
+		if !errors.Is(err, storage.ErrRedisPrimaryKey) {
+			t.Fatalf("expected error %v, got %v", storage.ErrRedisPrimaryKey, err)
+		}
+
+		// A batch with an invalid record is not written.
+		if srv.Exists("gidari:accounts:1") {
+			t.Fatalf("expected no records to be written")
+		}
+	})
+	t.Run("table names", func(t *testing.T) {
+		t.Parallel()
+
+		stg, srv := newRedis(t, "")
+		ctx := context.Background()
+
+		if err := upsertRedis(t, stg, "orders", map[string]interface{}{"id": "1"}); err != nil {
+			t.Fatalf("failed to upsert records: %v", err)
+		}
+
+		// The keys of "orders:fills" would match the pattern of the keys of "orders".
+		err := upsertRedis(t, stg, "orders:fills", map[string]interface{}{"id": "2"})
+		if !errors.Is(err, storage.ErrRedisTableName) {
+			t.Fatalf("expected error %v, got %v", storage.ErrRedisTableName, err)
+		}
+
+		if _, err := stg.Read(ctx, &proto.ReadRequest{Table: "orders:fills"}); !errors.Is(err, storage.ErrRedisTableName) {
+			t.Fatalf("expected error %v, got %v", storage.ErrRedisTableName, err)
+		}
+
+		_, err = stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"orders:fills"}})
+		if !errors.Is(err, storage.ErrRedisTableName) {
+			t.Fatalf("expected error %v, got %v", storage.ErrRedisTableName, err)
+		}
+
+		if !srv.Exists("gidari:orders:1") {
+			t.Fatalf("expected the records of orders to be kept")
+		}
+	})
+}
@@ -0,0 +1,1094 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	"github.com/snowflakedb/gosnowflake"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	snowflakeScheme = "snowflake"
+
+	// snowflakeEndpointParam is the connection string parameter for the URL of the Snowflake endpoint. The default is
+	// "https://<account>.snowflakecomputing.com".
+	snowflakeEndpointParam = "endpoint"
+
+	// snowflakeWarehouseParam and snowflakeRoleParam are the connection string parameters for the warehouse that
+	// statements run in, and the role that they run as.
+	snowflakeWarehouseParam = "warehouse"
+	snowflakeRoleParam      = "role"
+
+	// snowflakePrivateKeyFileParam is the connection string parameter for the path of the unencrypted PEM encoded RSA
+	// private key that the user authenticates with by key pair.
+	snowflakePrivateKeyFileParam = "privateKeyFile"
+
+	// snowflakeStageParam is the connection string parameter for the external stage that large upserts are bulk
+	// loaded from, e.g. "raw.gidari_stage", and snowflakeStageLocationParam is the object storage location of the
+	// stage, e.g. "s3://bucket/stage", that gidari writes the records to.
+	snowflakeStageParam         = "stage"
+	snowflakeStageLocationParam = "stageLocation"
+
+	// snowflakeStageThresholdParam is the connection string parameter for the size in bytes of the records of an
+	// upsert above which they are bulk loaded from the stage instead of sent with the statement.
+	snowflakeStageThresholdParam = "stageThreshold"
+
+	// snowflakeTokenEnv is the environment variable with the OAuth token that the user authenticates with.
+	snowflakeTokenEnv = "SNOWFLAKE_TOKEN"
+
+	// snowflakeDefaultStageThreshold is well under the limit on the size of a statement.
+	snowflakeDefaultStageThreshold = 1 << 20
+
+	// snowflakeMaxSafeInteger is the largest integer that a record number can hold exactly, and so be inferred as a
+	// "NUMBER(38,0)" column.
+	snowflakeMaxSafeInteger = 1 << 53
+)
+
+var ErrSnowflake = fmt.Errorf("snowflake statement failed")
+
+// SnowflakeError is returned when a Snowflake statement fails.
+func SnowflakeError(err error) error {
+	return fmt.Errorf("%w: %v", ErrSnowflake, err)
+}
+
+// snowflakeValue will decode the value of a column of the database type, which the driver scans as a string for
+// numbers and semi-structured types.
+func snowflakeValue(columnType string, value *string) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	switch strings.ToLower(columnType) {
+	case "fixed", "real":
+		if num, err := strconv.ParseFloat(*value, 64); err == nil {
+			return num
+		}
+	case "boolean":
+		return *value == "true"
+	case "variant", "object", "array":
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(*value), &decoded); err == nil {
+			return decoded
+		}
+	}
+
+	return *value
+}
+
+// snowflakeQuery will run the query and return its rows by column name, decoded by the database type of each column.
+func snowflakeQuery(ctx context.Context, queryer pgQueryer, query string,
+	args ...interface{},
+) ([]map[string]interface{}, error) {
+	rows, err := queryer.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, SnowflakeError(err)
+	}
+
+	defer rows.Close()
+
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, SnowflakeError(err)
+	}
+
+	var records []map[string]interface{}
+
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+
+		for idx := range values {
+			dest[idx] = &values[idx]
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return nil, SnowflakeError(err)
+		}
+
+		record := make(map[string]interface{}, len(columns))
+
+		for idx, column := range columns {
+			var value *string
+			if values[idx].Valid {
+				value = &values[idx].String
+			}
+
+			record[column.Name()] = snowflakeValue(column.DatabaseTypeName(), value)
+		}
+
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, SnowflakeError(err)
+	}
+
+	return records, nil
+}
+
+// snowflakeTable is the columns and primary key of a table that has been written to.
+type snowflakeTable struct {
+	columns    map[string]string
+	primaryKey []string
+}
+
+// snowflakeTxType is the type of the context key of Snowflake transactions.
+type snowflakeTxType uint8
+
+const (
+	basicSnowflakeTxID snowflakeTxType = iota
+)
+
+// snowflakeTx are the upserts of a transaction, executed when the transaction commits.
+type snowflakeTx struct {
+	mtx     sync.Mutex
+	upserts []*snowflakeUpsert
+}
+
+// Snowflake is a storage device that writes records to the tables of a Snowflake schema with the gosnowflake driver.
+// The table of an upsert request is a table of the schema of the connection string, or "<schema>.<table>" for a table
+// of another schema of the database.
+//
+// Tables that do not exist are created with columns inferred from the records of the first upsert, and columns are
+// added for new fields. Records are merged into tables with a primary key, and inserted into tables without one.
+type Snowflake struct {
+	*sql.DB
+
+	database       string
+	schema         string
+	stage          string
+	stageStore     ObjectStore
+	stageThreshold int
+
+	// tables are the tables that have been written to, keyed by "<schema>.<table>".
+	mtx    sync.Mutex
+	tables map[string]*snowflakeTable
+
+	// activeTx are the transactions that are currently active, keyed by the transaction ID that is added to the
+	// context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// snowflakeConfig will return the driver configuration for the connection string. The user authenticates with the
+// password of the connection string, the OAuth token in the "SNOWFLAKE_TOKEN" environment variable, or the private
+// key at "privateKeyFile".
+func snowflakeConfig(uri *url.URL) (*gosnowflake.Config, error) {
+	database, schema, _ := strings.Cut(strings.Trim(uri.Path, "/"), "/")
+	if uri.Host == "" || database == "" || schema == "" || strings.Contains(schema, "/") {
+		return nil, DNSNotSupportedError(tools.RedactURL(uri))
+	}
+
+	params := uri.Query()
+
+	cfg := &gosnowflake.Config{
+		Account:   uri.Host,
+		User:      uri.User.Username(),
+		Database:  database,
+		Schema:    schema,
+		Warehouse: params.Get(snowflakeWarehouseParam),
+		Role:      params.Get(snowflakeRoleParam),
+	}
+
+	cfg.Password, _ = uri.User.Password()
+
+	if endpoint := params.Get(snowflakeEndpointParam); endpoint != "" {
+		endpointURL, err := url.Parse(endpoint)
+		if err != nil || endpointURL.Hostname() == "" {
+			return nil, fmt.Errorf("%w: %s=%q must be a URL", ErrDNSNotSupported, snowflakeEndpointParam, endpoint)
+		}
+
+		cfg.Protocol = endpointURL.Scheme
+		cfg.Host = endpointURL.Hostname()
+
+		if port := endpointURL.Port(); port != "" {
+			cfg.Port, _ = strconv.Atoi(port)
+		}
+	}
+
+	if token := os.Getenv(snowflakeTokenEnv); token != "" {
+		cfg.Authenticator = gosnowflake.AuthTypeOAuth
+		cfg.Token = token
+	}
+
+	if path := params.Get(snowflakePrivateKeyFileParam); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read snowflake private key: %w", err)
+		}
+
+		if cfg.PrivateKey, err = parseSnowflakePrivateKey(data); err != nil {
+			return nil, fmt.Errorf("%w: %s=%q must be an unencrypted RSA key: %v", ErrDNSNotSupported,
+				snowflakePrivateKeyFileParam, path, err)
+		}
+
+		cfg.Authenticator = gosnowflake.AuthTypeJwt
+	}
+
+	return cfg, nil
+}
+
+// parseSnowflakePrivateKey will parse the PEM encoded RSA private key of key pair authentication, in PKCS #8 or
+// PKCS #1.
+func parseSnowflakePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key: %w", err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+// NewSnowflake will return a Snowflake storage device for the connection string, i.e.
+// "snowflake://[<user>[:<password>]@]<account>/<database>/<schema>[?warehouse=<warehouse>&role=<role>]". Upserts
+// larger than "stageThreshold" bytes are bulk loaded from the external "stage" at "stageLocation", if both are set.
+func NewSnowflake(_ context.Context, connectionURL string) (*Snowflake, error) {
+	uri, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	cfg, err := snowflakeConfig(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	params := uri.Query()
+
+	stg := &Snowflake{
+		database:       cfg.Database,
+		schema:         cfg.Schema,
+		stage:          strings.TrimPrefix(params.Get(snowflakeStageParam), "@"),
+		stageThreshold: snowflakeDefaultStageThreshold,
+		tables:         make(map[string]*snowflakeTable),
+	}
+
+	if location := params.Get(snowflakeStageLocationParam); location != "" {
+		if stg.stageStore, err = NewObjectStore(location); err != nil {
+			return nil, fmt.Errorf("invalid snowflake stage location: %w", err)
+		}
+	}
+
+	if (stg.stage == "") != (stg.stageStore == nil) {
+		return nil, fmt.Errorf("%w: set both %q and %q to bulk load from a stage", ErrDNSNotSupported,
+			snowflakeStageParam, snowflakeStageLocationParam)
+	}
+
+	if threshold := params.Get(snowflakeStageThresholdParam); threshold != "" {
+		if stg.stageThreshold, err = strconv.Atoi(threshold); err != nil || stg.stageThreshold < 0 {
+			return nil, fmt.Errorf("%w: %s=%q must be a number of bytes", ErrDNSNotSupported,
+				snowflakeStageThresholdParam, threshold)
+		}
+	}
+
+	stg.DB = sql.OpenDB(gosnowflake.NewConnector(gosnowflake.SnowflakeDriver{}, *cfg))
+
+	return stg, nil
+}
+
+// Close will close the database.
+func (stg *Snowflake) Close() {
+	if stg.DB != nil {
+		stg.DB.Close()
+	}
+}
+
+// IsNoSQL returns "false" to indicate that "Snowflake" updates records by primary key.
+func (stg *Snowflake) IsNoSQL() bool { return false }
+
+// Type implements the storage interface.
+func (stg *Snowflake) Type() uint8 { return SnowflakeType }
+
+// tableRef will return the schema and table of the table of a request.
+func (stg *Snowflake) tableRef(table string) (string, string) {
+	if schema, name, ok := strings.Cut(table, "."); ok {
+		return schema, name
+	}
+
+	return stg.schema, table
+}
+
+// tableName will return the quoted name of the table in statements.
+func (stg *Snowflake) tableName(schema, table string) string {
+	return snowflakeQuote(stg.database) + "." + snowflakeQuote(schema) + "." + snowflakeQuote(table)
+}
+
+// snowflakeQuote will quote the identifier for a statement, which keeps its case.
+func snowflakeQuote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// snowflakeLiteral will quote the string as a string literal for a statement.
+func snowflakeLiteral(str string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(str) + "'"
+}
+
+// snowflakeColumnType will return the column type for the value of a record, or an empty string for null values.
+func snowflakeColumnType(value *structpb.Value) string {
+	switch kind := value.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		return "VARCHAR"
+	case *structpb.Value_BoolValue:
+		return "BOOLEAN"
+	case *structpb.Value_NumberValue:
+		if num := kind.NumberValue; num == math.Trunc(num) && math.Abs(num) <= snowflakeMaxSafeInteger {
+			return "NUMBER(38,0)"
+		}
+
+		return "FLOAT"
+	case *structpb.Value_StructValue, *structpb.Value_ListValue:
+		return "VARIANT"
+	}
+
+	return ""
+}
+
+// inferSnowflakeColumns will return the types of the columns for the fields of the records that are not already
+// columns of the table. Numbers that are not all integers are "FLOAT" columns, fields with values of different types
+// are "VARIANT" columns, and fields that are only null are "VARCHAR" columns.
+func inferSnowflakeColumns(known map[string]string, records []*structpb.Struct) map[string]string {
+	types := make(map[string]string)
+
+	for _, record := range records {
+		for name, value := range record.GetFields() {
+			if _, ok := known[name]; ok {
+				continue
+			}
+
+			switch columnType := snowflakeColumnType(value); {
+			case types[name] == "" || types[name] == columnType:
+				types[name] = columnType
+			case columnType == "":
+			case columnType == "FLOAT" && types[name] == "NUMBER(38,0)":
+				types[name] = "FLOAT"
+			case columnType == "NUMBER(38,0)" && types[name] == "FLOAT":
+			default:
+				types[name] = "VARIANT"
+			}
+		}
+	}
+
+	for name, columnType := range types {
+		if columnType == "" {
+			types[name] = "VARCHAR"
+		}
+	}
+
+	return types
+}
+
+// sortedColumns will return the names of the columns, sorted.
+func sortedColumns(columns map[string]string) []string {
+	names := make([]string, 0, len(columns))
+	for name := range columns {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// describe will return the columns and primary key of the table, or nil if the table does not exist.
+func (stg *Snowflake) describe(ctx context.Context, schema, table string) (*snowflakeTable, error) {
+	records, err := snowflakeQuery(ctx, stg.DB, "SELECT column_name, data_type, numeric_precision, numeric_scale FROM "+
+		snowflakeQuote(stg.database)+".information_schema.columns WHERE table_schema = ? AND table_name = ?", schema, table)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	described := &snowflakeTable{columns: make(map[string]string, len(records))}
+
+	for _, record := range records {
+		name, _ := record["COLUMN_NAME"].(string)
+		columnType, _ := record["DATA_TYPE"].(string)
+
+		switch columnType {
+		case "TEXT":
+			columnType = "VARCHAR"
+		case "NUMBER":
+			precision, _ := record["NUMERIC_PRECISION"].(float64)
+			scale, _ := record["NUMERIC_SCALE"].(float64)
+			columnType = fmt.Sprintf("NUMBER(%d,%d)", int(precision), int(scale))
+		}
+
+		described.columns[name] = columnType
+	}
+
+	keys, err := snowflakeQuery(ctx, stg.DB, "SHOW PRIMARY KEYS IN TABLE "+stg.tableName(schema, table))
+	if err != nil {
+		return nil, err
+	}
+
+	described.primaryKey = snowflakePrimaryKeys(keys)[table]
+
+	return described, nil
+}
+
+// snowflakePrimaryKeys will return the primary key columns by table from the results of "SHOW PRIMARY KEYS".
+func snowflakePrimaryKeys(records []map[string]interface{}) map[string][]string {
+	sort.SliceStable(records, func(i, j int) bool {
+		left, _ := records[i]["key_sequence"].(float64)
+		right, _ := records[j]["key_sequence"].(float64)
+
+		return left < right
+	})
+
+	keys := make(map[string][]string)
+
+	for _, record := range records {
+		table, _ := record["table_name"].(string)
+		column, _ := record["column_name"].(string)
+		keys[table] = append(keys[table], column)
+	}
+
+	return keys
+}
+
+// ensureTable will return the columns and primary key of the table, creating the table or adding columns to it so
+// that it has a column for every field of the records. Tables are created with "id" as the primary key if every
+// record has one.
+func (stg *Snowflake) ensureTable(ctx context.Context, schema, table string,
+	records []*structpb.Struct,
+) (*snowflakeTable, error) {
+	stg.mtx.Lock()
+	defer stg.mtx.Unlock()
+
+	key := schema + "." + table
+	described := stg.tables[key]
+
+	if described == nil {
+		var err error
+		if described, err = stg.describe(ctx, schema, table); err != nil {
+			return nil, err
+		}
+	}
+
+	if described == nil {
+		described = &snowflakeTable{columns: inferSnowflakeColumns(nil, records)}
+
+		definitions := make([]string, 0, len(described.columns)+1)
+		for _, name := range sortedColumns(described.columns) {
+			definitions = append(definitions, snowflakeQuote(name)+" "+described.columns[name])
+		}
+
+		if hasIDs(records) {
+			described.primaryKey = []string{"id"}
+			definitions = append(definitions, "PRIMARY KEY ("+snowflakeQuote("id")+")")
+		}
+
+		statement := "CREATE TABLE IF NOT EXISTS " + stg.tableName(schema, table) + " (" +
+			strings.Join(definitions, ", ") + ")"
+		if _, err := stg.DB.ExecContext(ctx, statement); err != nil {
+			return nil, SnowflakeError(err)
+		}
+
+		stg.tables[key] = described
+
+		return described, nil
+	}
+
+	if columns := inferSnowflakeColumns(described.columns, records); len(columns) > 0 {
+		added := make([]string, 0, len(columns))
+		for _, name := range sortedColumns(columns) {
+			added = append(added, snowflakeQuote(name)+" "+columns[name])
+		}
+
+		statement := "ALTER TABLE " + stg.tableName(schema, table) + " ADD COLUMN " + strings.Join(added, ", ")
+		if _, err := stg.DB.ExecContext(ctx, statement); err != nil {
+			return nil, SnowflakeError(err)
+		}
+
+		for name, columnType := range columns {
+			described.columns[name] = columnType
+		}
+	}
+
+	stg.tables[key] = described
+
+	return described, nil
+}
+
+// writeStatement will return the statement that merges the records selected as the "r" VARIANT column of the source
+// query into the table, or inserts them if the table has no primary key.
+func (stg *Snowflake) writeStatement(schema, table string, described *snowflakeTable, fields []string,
+	source string,
+) string {
+	selected := make([]string, len(fields))
+	quoted := make([]string, len(fields))
+	values := make([]string, len(fields))
+
+	for idx, name := range fields {
+		expr := "r[" + snowflakeLiteral(name) + "]"
+		if columnType := described.columns[name]; columnType != "VARIANT" {
+			expr += "::" + columnType
+		}
+
+		quoted[idx] = snowflakeQuote(name)
+		selected[idx] = expr + " AS " + quoted[idx]
+		values[idx] = "source." + quoted[idx]
+	}
+
+	selectSource := "SELECT " + strings.Join(selected, ", ") + " FROM (" + source + ")"
+
+	if len(described.primaryKey) == 0 {
+		return "INSERT INTO " + stg.tableName(schema, table) + " (" + strings.Join(quoted, ", ") + ") " + selectSource
+	}
+
+	isKey := make(map[string]bool, len(described.primaryKey))
+	conditions := make([]string, len(described.primaryKey))
+
+	for idx, column := range described.primaryKey {
+		isKey[column] = true
+		conditions[idx] = "target." + snowflakeQuote(column) + " = source." + snowflakeQuote(column)
+	}
+
+	var updates []string
+
+	for idx, name := range fields {
+		if !isKey[name] {
+			updates = append(updates, "target."+quoted[idx]+" = "+values[idx])
+		}
+	}
+
+	statement := "MERGE INTO " + stg.tableName(schema, table) + " AS target USING (" + selectSource + ") AS source ON " +
+		strings.Join(conditions, " AND ")
+	if len(updates) > 0 {
+		statement += " WHEN MATCHED THEN UPDATE SET " + strings.Join(updates, ", ")
+	}
+
+	return statement + " WHEN NOT MATCHED THEN INSERT (" + strings.Join(quoted, ", ") + ") VALUES (" +
+		strings.Join(values, ", ") + ")"
+}
+
+// snowflakeUpsert are the statements that write the records of an upsert. Records that are bulk loaded from the
+// stage are copied into a temporary table by the "load" statements, which are executed before a transaction begins
+// since DDL statements commit the open transaction, and the temporary table is dropped by the "drop" statements.
+// Records that are sent with the statement are the "args" of the "write" statement.
+type snowflakeUpsert struct {
+	load   []string
+	write  string
+	args   []interface{}
+	drop   []string
+	staged string
+}
+
+// upsertStatements will return the statements that write the records to the table. Records that are larger than the
+// stage threshold are written to the stage as newline-delimited JSON and loaded from it through a temporary table,
+// and the key of the staged object is returned so that it can be deleted once the statements have run. Smaller
+// records are sent with the statement.
+func (stg *Snowflake) upsertStatements(ctx context.Context, schema, table string, described *snowflakeTable,
+	records []*structpb.Struct,
+) (*snowflakeUpsert, error) {
+	columns := make(map[string]string)
+	rows := make([]interface{}, 0, len(records))
+
+	for _, record := range records {
+		for name := range record.GetFields() {
+			columns[name] = described.columns[name]
+		}
+
+		rows = append(rows, record.AsMap())
+	}
+
+	encoded, err := json.Marshal(rows)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+	}
+
+	fields := sortedColumns(columns)
+
+	if stg.stageStore == nil || len(encoded) <= stg.stageThreshold {
+		return &snowflakeUpsert{
+			write: stg.writeStatement(schema, table, described, fields,
+				"SELECT value AS r FROM TABLE(FLATTEN(INPUT => PARSE_JSON(?)))"),
+			args: []interface{}{string(encoded)},
+		}, nil
+	}
+
+	var data bytes.Buffer
+
+	encoder := json.NewEncoder(&data)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			return nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+		}
+	}
+
+	id := strings.ReplaceAll(uuid.New().String(), "-", "")
+	key := "gidari-" + id + ".json"
+
+	if err := stg.stageStore.Upload(ctx, key, &data); err != nil {
+		return nil, fmt.Errorf("unable to stage records: %w", err)
+	}
+
+	load := snowflakeQuote("gidari_load_" + id)
+
+	return &snowflakeUpsert{
+		load: []string{
+			"CREATE TEMPORARY TABLE " + load + " (r VARIANT)",
+			"COPY INTO " + load + " FROM @" + stg.stage + "/" + key + " FILE_FORMAT = (TYPE = JSON)",
+		},
+		write:  stg.writeStatement(schema, table, described, fields, "SELECT r FROM "+load),
+		drop:   []string{"DROP TABLE " + load},
+		staged: key,
+	}, nil
+}
+
+// Upsert will merge the records into the table by its primary key, or insert them if it has none, creating the table
+// or adding columns to it as needed. Within a transaction, the records are written when the transaction commits.
+func (stg *Snowflake) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	if len(records) == 0 {
+		return &proto.UpsertResponse{}, nil
+	}
+
+	schema, table := stg.tableRef(req.GetTable())
+
+	described, err := stg.ensureTable(ctx, schema, table, records)
+	if err != nil {
+		return nil, fmt.Errorf("unable to update the columns of %s: %w", req.GetTable(), err)
+	}
+
+	upsert, err := stg.upsertStatements(ctx, schema, table, described, lastByKeys(records, described.primaryKey))
+	if err != nil {
+		return nil, err
+	}
+
+	if tx := stg.tx(ctx); tx != nil {
+		tx.mtx.Lock()
+		defer tx.mtx.Unlock()
+
+		tx.upserts = append(tx.upserts, upsert)
+
+		return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+	}
+
+	err = stg.write(ctx, false, upsert)
+	stg.unstage(upsert)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to upsert records: %w", err)
+	}
+
+	return &proto.UpsertResponse{UpsertedCount: int64(len(records))}, nil
+}
+
+// write will execute the statements of the upserts on a single connection, since temporary tables belong to the
+// session that created them: the staged records are loaded, then written in a transaction if "inTx" is true, and
+// the temporary tables are dropped whether or not the writes succeed.
+func (stg *Snowflake) write(ctx context.Context, inTx bool, upserts ...*snowflakeUpsert) error {
+	conn, err := stg.DB.Conn(ctx)
+	if err != nil {
+		return SnowflakeError(err)
+	}
+
+	defer conn.Close()
+
+	defer func() {
+		for _, upsert := range upserts {
+			for _, statement := range upsert.drop {
+				_, _ = conn.ExecContext(ctx, statement)
+			}
+		}
+	}()
+
+	for _, upsert := range upserts {
+		for _, statement := range upsert.load {
+			if _, err := conn.ExecContext(ctx, statement); err != nil {
+				return SnowflakeError(err)
+			}
+		}
+	}
+
+	var queryer pgQueryer = conn
+
+	var tx *sql.Tx
+
+	if inTx {
+		if tx, err = conn.BeginTx(ctx, nil); err != nil {
+			return SnowflakeError(err)
+		}
+
+		defer func() { _ = tx.Rollback() }()
+
+		queryer = tx
+	}
+
+	for _, upsert := range upserts {
+		if _, err := queryer.ExecContext(ctx, upsert.write, upsert.args...); err != nil {
+			return SnowflakeError(err)
+		}
+	}
+
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return SnowflakeError(err)
+		}
+	}
+
+	return nil
+}
+
+// unstage will delete the objects staged for the upserts once they have been loaded, or have failed to load. The
+// objects are deleted even if the context of the upserts is done.
+func (stg *Snowflake) unstage(upserts ...*snowflakeUpsert) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	for _, upsert := range upserts {
+		if upsert.staged != "" {
+			_ = stg.stageStore.Delete(ctx, upsert.staged)
+		}
+	}
+}
+
+// tx will return the transaction of the context, or nil if there is none.
+func (stg *Snowflake) tx(ctx context.Context) *snowflakeTx {
+	txID, ok := ctx.Value(basicSnowflakeTxID).(string)
+	if !ok {
+		return nil
+	}
+
+	tx, ok := stg.activeTx.Load(txID)
+	if !ok {
+		return nil
+	}
+
+	snowflakeTx, _ := tx.(*snowflakeTx)
+
+	return snowflakeTx
+}
+
+// snowflakeArg will return the argument for the value of a required field or page, binding integers as integers
+// and lists and objects as JSON.
+func snowflakeArg(value interface{}) interface{} {
+	switch value := value.(type) {
+	case nil, string, bool:
+		return value
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) <= snowflakeMaxSafeInteger {
+			return int64(value)
+		}
+
+		return value
+	}
+
+	data, _ := json.Marshal(value)
+
+	return string(data)
+}
+
+// snowflakeRequiredConditions will return the conditions and arguments that match the required fields.
+func snowflakeRequiredConditions(required map[string]interface{}) ([]string, []interface{}) {
+	columns := make([]string, 0, len(required))
+	for column := range required {
+		columns = append(columns, column)
+	}
+
+	sort.Strings(columns)
+
+	var conditions []string
+
+	var args []interface{}
+
+	bind := func(value interface{}) string {
+		args = append(args, snowflakeArg(value))
+
+		return "?"
+	}
+
+	for _, column := range columns {
+		switch values := required[column].(type) {
+		case nil:
+			conditions = append(conditions, snowflakeQuote(column)+" IS NULL")
+		case []interface{}:
+			if len(values) == 0 {
+				conditions = append(conditions, "FALSE")
+
+				continue
+			}
+
+			placeholders := make([]string, len(values))
+			for idx, value := range values {
+				placeholders[idx] = bind(value)
+			}
+
+			conditions = append(conditions, snowflakeQuote(column)+" IN ("+strings.Join(placeholders, ", ")+")")
+		default:
+			conditions = append(conditions, snowflakeQuote(column)+" = "+bind(values))
+		}
+	}
+
+	return conditions, args
+}
+
+// selectStatement will return the statement and arguments that select the records of the table that match the
+// required fields, in the page if it is not nil.
+func (stg *Snowflake) selectStatement(schema, table string, required map[string]interface{},
+	page *readPage,
+) (string, []interface{}) {
+	conditions, args := snowflakeRequiredConditions(required)
+
+	bind := func(value interface{}) string {
+		args = append(args, snowflakeArg(value))
+
+		return "?"
+	}
+
+	var clauses string
+
+	if page != nil {
+		if len(page.after) > 0 {
+			var after []string
+
+			for idx := range page.orderBy {
+				terms := make([]string, 0, idx+1)
+
+				for prev := 0; prev < idx; prev++ {
+					terms = append(terms, snowflakeQuote(page.orderBy[prev])+" = "+bind(page.after[prev]))
+				}
+
+				terms = append(terms, snowflakeQuote(page.orderBy[idx])+" > "+bind(page.after[idx]))
+				after = append(after, "("+strings.Join(terms, " AND ")+")")
+			}
+
+			conditions = append(conditions, "("+strings.Join(after, " OR ")+")")
+		}
+
+		if len(page.orderBy) > 0 {
+			quoted := make([]string, len(page.orderBy))
+			for idx, column := range page.orderBy {
+				quoted[idx] = snowflakeQuote(column)
+			}
+
+			clauses = " ORDER BY " + strings.Join(quoted, ", ")
+		}
+
+		if page.limit > 0 {
+			clauses += fmt.Sprintf(" LIMIT %d", page.limit)
+		}
+	}
+
+	statement := "SELECT * FROM " + stg.tableName(schema, table)
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	return statement + clauses, args
+}
+
+// countStatement will return the statement and arguments that count the records of the table that match the required
+// fields.
+func (stg *Snowflake) countStatement(schema, table string, required map[string]interface{}) (string, []interface{}) {
+	conditions, args := snowflakeRequiredConditions(required)
+
+	statement := "SELECT COUNT(*) FROM " + stg.tableName(schema, table)
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	return statement, args
+}
+
+// Read will query the records of the table that match the required fields on the request, in the page requested by
+// the options of the request, if any.
+func (stg *Snowflake) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	schema, table := stg.tableRef(req.GetTable())
+	statement, args := stg.selectStatement(schema, table, req.GetRequired().AsMap(), page)
+
+	records, err := snowflakeQuery(ctx, stg.DB, statement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read records: %w", err)
+	}
+
+	rsp := new(proto.ReadResponse)
+
+	for _, rec := range records {
+		record, err := structpb.NewStruct(rec)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert record: %w", err)
+		}
+
+		rsp.Records = append(rsp.Records, record)
+	}
+
+	return rsp, nil
+}
+
+// Count will return the number of rows of the table that match the required fields, with a "SELECT COUNT(*)" query.
+func (stg *Snowflake) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	schema, table := stg.tableRef(req.GetTable())
+	statement, args := stg.countStatement(schema, table, req.GetRequired().AsMap())
+
+	rows, err := stg.DB.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to count records: %w", err)
+	}
+
+	return scanCount(rows)
+}
+
+// Truncate will delete every row of the tables.
+func (stg *Snowflake) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	var deleted int32
+
+	for _, name := range req.GetTables() {
+		schema, table := stg.tableRef(name)
+
+		result, err := stg.DB.ExecContext(ctx, "DELETE FROM "+stg.tableName(schema, table))
+		if err != nil {
+			return nil, fmt.Errorf("error truncating table %s: %w", name, SnowflakeError(err))
+		}
+
+		if rows, err := result.RowsAffected(); err == nil {
+			deleted += int32(rows)
+		}
+	}
+
+	return &proto.TruncateResponse{DeletedCount: deleted}, nil
+}
+
+// ListTables will return the tables of the schema of the connection string, with their size in bytes.
+func (stg *Snowflake) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	records, err := snowflakeQuery(ctx, stg.DB, "SELECT table_name, bytes FROM "+snowflakeQuote(stg.database)+
+		".information_schema.tables WHERE table_schema = ? AND table_type = 'BASE TABLE'", stg.schema)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tables: %w", err)
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+
+	for _, record := range records {
+		name, _ := record["TABLE_NAME"].(string)
+		size, _ := record["BYTES"].(float64)
+		rsp.TableSet[name] = &proto.Table{Size: int64(size)}
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will return the primary key columns of the tables of the schema of the connection string.
+// Snowflake does not enforce primary keys, but upserts merge records into tables by them.
+func (stg *Snowflake) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	records, err := snowflakeQuery(ctx, stg.DB, "SHOW PRIMARY KEYS IN SCHEMA "+snowflakeQuote(stg.database)+"."+
+		snowflakeQuote(stg.schema))
+	if err != nil {
+		return nil, fmt.Errorf("error listing primary keys: %w", err)
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+
+	for table, columns := range snowflakePrimaryKeys(records) {
+		rsp.PKSet[table] = &proto.PrimaryKeys{List: columns}
+	}
+
+	return rsp, nil
+}
+
+// StartTx will start a transaction. The statements of the functions sent to the transaction are buffered, and the
+// writes are executed in a database transaction when the transaction commits. Tables and columns are created when the
+// functions run, and staged records are loaded before the transaction begins, since DDL statements commit the open
+// transaction in Snowflake.
+func (stg *Snowflake) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+	tx := new(snowflakeTx)
+
+	stg.activeTx.Store(txnID, tx)
+
+	sfCtx := context.WithValue(ctx, basicSnowflakeTxID, txnID)
+
+	go func() {
+		defer stg.activeTx.Delete(txnID)
+
+		var err error
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(sfCtx, stg)
+		}
+
+		defer stg.unstage(tx.upserts...)
+
+		if err != nil {
+			<-txn.commit
+			txn.done <- err
+
+			return
+		}
+
+		if !<-txn.commit || len(tx.upserts) == 0 {
+			txn.done <- nil
+
+			return
+		}
+
+		if err = stg.write(ctx, true, tx.upserts...); err != nil {
+			err = fmt.Errorf("unable to commit transaction: %w", err)
+		}
+
+		txn.done <- err
+	}()
+
+	return txn, nil
+}
@@ -0,0 +1,498 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/record"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// sqliteBusyTimeout is how long a connection waits for the lock of the database file held by another connection,
+// e.g. a read made while a transaction is writing, before failing with "database is locked".
+const sqliteBusyTimeout = 5 * time.Second
+
+// sqliteDrivers are the names that the supported "database/sql" drivers for SQLite register, i.e.
+// "github.com/mattn/go-sqlite3" and "modernc.org/sqlite", in order of preference.
+var sqliteDrivers = []string{"sqlite3", "sqlite"}
+
+// ErrSQLiteDriverNotRegistered is returned when no SQLite driver is registered with "database/sql".
+var ErrSQLiteDriverNotRegistered = fmt.Errorf("no sqlite driver is registered, import " +
+	"\"github.com/mattn/go-sqlite3\" or \"modernc.org/sqlite\" to register one")
+
+// sqliteTxType is the type of the context key of SQLite transactions.
+type sqliteTxType uint8
+
+const (
+	basicSQLiteTxID sqliteTxType = iota
+)
+
+// sqlitemeta are the columns and primary keys of the tables of a SQLite database.
+type sqlitemeta struct {
+	cols map[string][]string
+	pks  map[string][]string
+}
+
+// SQLite is a file-based storage device, for running transports locally or embedded in an application without a
+// database server. SQLite 3.24 or later is required.
+type SQLite struct {
+	*sql.DB
+
+	writeMutex sync.Mutex
+
+	// activeTx are the transactions that are currently active on the database, keyed by the transaction ID that is
+	// added to the context of the functions sent to the transaction.
+	activeTx sync.Map
+}
+
+// NewSQLite will return a SQLite storage device for the database file of the connection string, e.g.
+// "sqlite://path/to/file.db" for a path relative to the working directory or "sqlite:///var/lib/gidari.db" for an
+// absolute path. The file is created if it does not exist. The query parameters of the connection string are passed
+// to the driver, e.g. "_journal_mode=WAL" for "github.com/mattn/go-sqlite3".
+//
+// SQLite has no driver in the standard library. The gidari CLI registers "modernc.org/sqlite", and applications that
+// embed gidari must import it or "github.com/mattn/go-sqlite3".
+func NewSQLite(_ context.Context, connectionURL string) (*SQLite, error) {
+	driver := sqliteDriver()
+	if driver == "" {
+		return nil, ErrSQLiteDriverNotRegistered
+	}
+
+	dsn, err := sqliteDSN(driver, connectionURL)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open sqlite database: %w", err)
+	}
+
+	return &SQLite{DB: db}, nil
+}
+
+// sqliteDriver will return the name of the registered SQLite driver, or an empty string if there is none.
+func sqliteDriver() string {
+	registered := make(map[string]bool)
+	for _, driver := range sql.Drivers() {
+		registered[driver] = true
+	}
+
+	for _, driver := range sqliteDrivers {
+		if registered[driver] {
+			return driver
+		}
+	}
+
+	return ""
+}
+
+// sqliteDSN will return the data source name of the database file of the connection string for the driver, with the
+// busy timeout set unless the connection string sets it.
+func sqliteDSN(driver, connectionURL string) (string, error) {
+	dsnURL, err := url.Parse(connectionURL)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	path := dsnURL.Host + dsnURL.Path
+	if path == "" {
+		return "", fmt.Errorf("%w: %s has no database file", ErrDNSNotSupported, connectionURL)
+	}
+
+	query := dsnURL.Query()
+
+	timeout := sqliteBusyTimeout.Milliseconds()
+	if driver == "sqlite3" && query.Get("_busy_timeout") == "" {
+		query.Set("_busy_timeout", fmt.Sprint(timeout))
+	}
+
+	if driver == "sqlite" && !strings.Contains(strings.Join(query["_pragma"], ","), "busy_timeout") {
+		query.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", timeout))
+	}
+
+	return fmt.Sprintf("file:%s?%s", path, query.Encode()), nil
+}
+
+// Close will close the database.
+func (sqlite *SQLite) Close() {
+	if sqlite.DB != nil {
+		sqlite.DB.Close()
+	}
+}
+
+// IsNoSQL returns "false" to indicate that "SQLite" is not a NoSQL database.
+func (sqlite *SQLite) IsNoSQL() bool { return false }
+
+// Type implements the storage interface.
+func (sqlite *SQLite) Type() uint8 { return SQLiteType }
+
+// getQueryer will return the transaction assigned to the context, or the database if there is none.
+func (sqlite *SQLite) getQueryer(ctx context.Context) (pgQueryer, error) {
+	txID, ok := ctx.Value(basicSQLiteTxID).(string)
+	if !ok {
+		return sqlite.DB, nil
+	}
+
+	tx, ok := sqlite.activeTx.Load(txID)
+	if !ok {
+		return sqlite.DB, nil
+	}
+
+	sqlTx, ok := tx.(*sql.Tx)
+	if !ok {
+		return nil, ErrTransactionNotFound
+	}
+
+	return sqlTx, nil
+}
+
+// loadMeta will load the columns and primary keys of the tables in the database, using the queryer so that tables
+// created in a transaction are included.
+func (sqlite *SQLite) loadMeta(ctx context.Context, queryer pgQueryer) (*sqlitemeta, error) {
+	return loadKeyedColumns(ctx, queryer, string(sqliteColumns))
+}
+
+// loadKeyedColumns will load the columns and primary keys of the tables with the query, which returns the table, the
+// column, and the 1-based position of the column in the primary key, or zero, for each column in order.
+func loadKeyedColumns(ctx context.Context, queryer pgQueryer, query string) (*sqlitemeta, error) {
+	rows, err := queryer.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query columns: %w", err)
+	}
+	defer rows.Close()
+
+	meta := &sqlitemeta{cols: make(map[string][]string), pks: make(map[string][]string)}
+	keyOrder := make(map[string]map[string]int)
+
+	for rows.Next() {
+		var (
+			table, column string
+			primaryKey    int
+		)
+
+		if err := rows.Scan(&table, &column, &primaryKey); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+
+		meta.cols[table] = append(meta.cols[table], column)
+
+		// The primary key column is the 1-based index of the column in the primary key, or zero.
+		if primaryKey > 0 {
+			if keyOrder[table] == nil {
+				keyOrder[table] = make(map[string]int)
+			}
+
+			keyOrder[table][column] = primaryKey
+			meta.pks[table] = append(meta.pks[table], column)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to scan columns: %w", err)
+	}
+
+	for table, pks := range meta.pks {
+		order := keyOrder[table]
+		sort.Slice(pks, func(i, j int) bool { return order[pks[i]] < order[pks[j]] })
+	}
+
+	return meta, nil
+}
+
+// ListPrimaryKeys will list the primary keys of the tables in the database.
+func (sqlite *SQLite) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	meta, err := sqlite.loadMeta(ctx, sqlite.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &proto.ListPrimaryKeysResponse{PKSet: make(map[string]*proto.PrimaryKeys)}
+	for table := range meta.cols {
+		rsp.PKSet[table] = &proto.PrimaryKeys{List: meta.pks[table]}
+	}
+
+	return rsp, nil
+}
+
+// ListTables will list the tables in the database. SQLite does not report the size of a table, so the sizes are
+// zero.
+func (sqlite *SQLite) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	meta, err := sqlite.loadMeta(ctx, sqlite.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &proto.ListTablesResponse{TableSet: make(map[string]*proto.Table)}
+	for table := range meta.cols {
+		rsp.TableSet[table] = &proto.Table{}
+	}
+
+	return rsp, nil
+}
+
+// Read will return the records from the table that match the required fields on the request, in the page requested
+// by the options of the request, if any.
+func (sqlite *SQLite) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	page, err := parseReadPage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	queryer, err := sqlite.getQueryer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get queryer: %w", err)
+	}
+
+	query, args := SQLiteDialect.selectQuery(req.GetTable(), req.GetRequired().AsMap(), page)
+
+	rows, err := queryer.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query: %w", err)
+	}
+
+	records, err := scanSQLiteRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.ReadResponse{Records: records}, nil
+}
+
+// Count will return the number of rows of the table that match the required fields.
+func (sqlite *SQLite) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	queryer, err := sqlite.getQueryer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get queryer: %w", err)
+	}
+
+	return sqlCount(ctx, queryer, SQLiteDialect, req.GetTable(), req.GetRequired().AsMap())
+}
+
+// scanSQLiteRows will convert the rows to records and close the rows. Unlike PostgreSQL, SQLite drivers may return
+// text as byte slices, so byte slices are converted to strings rather than numbers. SQLite stores booleans as
+// integers, and drivers that do not convert them by the declared type of the column, e.g. "modernc.org/sqlite",
+// return them as numbers, so the numbers of "BOOLEAN" columns are converted back to booleans.
+func scanSQLiteRows(rows *sql.Rows) ([]*structpb.Struct, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		rows.Close()
+
+		return nil, fmt.Errorf("unable to get column types: %w", err)
+	}
+
+	records, err := scanSQLRows(rows, func(value interface{}) interface{} {
+		switch value := value.(type) {
+		case []byte:
+			return string(value)
+		case time.Time:
+			return value.UTC().Format(time.RFC3339Nano)
+		default:
+			return value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, typ := range types {
+		if name := strings.ToUpper(typ.DatabaseTypeName()); name != "BOOLEAN" && name != "BOOL" {
+			continue
+		}
+
+		for _, rec := range records {
+			if num, ok := rec.GetFields()[typ.Name()].GetKind().(*structpb.Value_NumberValue); ok {
+				rec.Fields[typ.Name()] = structpb.NewBoolValue(num.NumberValue != 0)
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// scanSQLRows will convert the rows to records with the value function, which converts the values scanned by the
+// driver to the values of a record, and close the rows.
+func scanSQLRows(rows *sql.Rows, value func(interface{}) interface{}) ([]*structpb.Struct, error) {
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get columns: %w", err)
+	}
+
+	var records []*structpb.Struct
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+
+		for idx := range values {
+			pointers[idx] = &values[idx]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+
+		fields := make(map[string]interface{}, len(columns))
+
+		for idx, column := range columns {
+			fields[column] = value(values[idx])
+		}
+
+		rec, err := structpb.NewStruct(fields)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert row: %w", err)
+		}
+
+		records = append(records, rec)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to scan rows: %w", err)
+	}
+
+	return records, nil
+}
+
+// Truncate will delete every row of the tables. SQLite has no "TRUNCATE" statement, but deleting every row without a
+// condition uses the truncate optimization.
+func (sqlite *SQLite) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	queryer, err := sqlite.getQueryer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get queryer: %w", err)
+	}
+
+	rsp := new(proto.TruncateResponse)
+
+	for _, table := range req.GetTables() {
+		result, err := queryer.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s", SQLiteDialect.Quote(table)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to truncate table %s: %w", table, err)
+		}
+
+		if deleted, err := result.RowsAffected(); err == nil {
+			rsp.DeletedCount += int32(deleted)
+		}
+	}
+
+	return rsp, nil
+}
+
+// Upsert will insert the records on the request, updating the records with the same primary key. Nested objects and
+// arrays are written as JSON text, since SQLite has no composite types.
+func (sqlite *SQLite) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	sqlite.writeMutex.Lock()
+	defer sqlite.writeMutex.Unlock()
+
+	records, err := tools.DecodeUpsertRecords(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode records: %w", err)
+	}
+
+	if len(records) == 0 {
+		return &proto.UpsertResponse{}, nil
+	}
+
+	queryer, err := sqlite.getQueryer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get queryer: %w", err)
+	}
+
+	meta, err := sqlite.loadMeta(ctx, queryer)
+	if err != nil {
+		return nil, err
+	}
+
+	table := req.GetTable()
+	columns := meta.cols[table]
+
+	opts := &record.Options{Nested: record.NestedJSON}
+
+	rsp := new(proto.UpsertResponse)
+
+	for _, partition := range tools.PartitionStructs(SQLiteDialect.BatchRows(len(columns)), records) {
+		query := SQLiteDialect.Upsert(table, columns, meta.pks[table], len(partition))
+
+		arguments, err := record.ToSQLArgs(columns, partition, opts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert records: %w", err)
+		}
+
+		result, err := queryer.ExecContext(ctx, query, arguments...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to execute upsert: %w", err)
+		}
+
+		// The rows affected by an upsert are the rows inserted or updated.
+		if upserted, err := result.RowsAffected(); err == nil {
+			rsp.UpsertedCount += upserted
+		}
+	}
+
+	return rsp, nil
+}
+
+// StartTx will start a transaction on the database. SQLite allows a single writer at a time, so writes made outside
+// of the transaction wait for it to commit or roll back.
+func (sqlite *SQLite) StartTx(ctx context.Context) (*Txn, error) {
+	txn := &Txn{
+		make(chan TxnChanFn),
+		make(chan error, 1),
+		make(chan bool, 1),
+	}
+
+	txnID := uuid.New().String()
+
+	sqlTx, err := sqlite.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return txn, fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	sqlite.activeTx.Store(txnID, sqlTx)
+
+	txCtx := context.WithValue(ctx, basicSQLiteTxID, txnID)
+
+	go func() {
+		defer sqlite.activeTx.Delete(txnID)
+
+		for fn := range txn.ch {
+			if err != nil {
+				continue
+			}
+
+			err = fn(txCtx, sqlite)
+		}
+
+		if err != nil {
+			_ = sqlTx.Rollback()
+			txn.done <- err
+
+			return
+		}
+
+		if <-txn.commit {
+			txn.done <- sqlTx.Commit()
+		} else {
+			txn.done <- sqlTx.Rollback()
+		}
+	}()
+
+	return txn, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSQLite(t *testing.T) {
+	t.Parallel()
+
+	t.Run("dsn", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tcase := range []struct {
+			driver, url, exp string
+		}{
+			{"sqlite3", "sqlite://data/gidari.db", "file:data/gidari.db?_busy_timeout=5000"},
+			{"sqlite3", "sqlite:///var/lib/gidari.db?_busy_timeout=100", "file:/var/lib/gidari.db?_busy_timeout=100"},
+			{
+				"sqlite3", "sqlite://gidari.db?_journal_mode=WAL",
+				"file:gidari.db?_busy_timeout=5000&_journal_mode=WAL",
+			},
+			{"sqlite", "sqlite://gidari.db", "file:gidari.db?_pragma=busy_timeout%285000%29"},
+		} {
+			dsn, err := sqliteDSN(tcase.driver, tcase.url)
+			if err != nil {
+				t.Fatalf("failed to parse %s: %v", tcase.url, err)
+			}
+
+			if dsn != tcase.exp {
+				t.Fatalf("expected %q, got %q", tcase.exp, dsn)
+			}
+		}
+
+		if _, err := sqliteDSN("sqlite3", "sqlite://"); !errors.Is(err, ErrDNSNotSupported) {
+			t.Fatalf("expected error %v, got %v", ErrDNSNotSupported, err)
+		}
+	})
+
+	t.Run("driver not registered", func(t *testing.T) {
+		t.Parallel()
+
+		// The path contains the scheme of another storage device, which must not be used.
+		_, err := New(context.Background(), "sqlite://mongodb.db")
+		if !errors.Is(err, ErrSQLiteDriverNotRegistered) {
+			t.Fatalf("expected error %v, got %v", ErrSQLiteDriverNotRegistered, err)
+		}
+	})
+
+	t.Run("upsert without primary key", func(t *testing.T) {
+		t.Parallel()
+
+		exp := `INSERT INTO "t"("a","b") VALUES (?1,?2)`
+		if got := SQLiteDialect.Upsert("t", []string{"a", "b"}, nil, 1); got != exp {
+			t.Fatalf("expected %q, got %q", exp, got)
+		}
+	})
+}
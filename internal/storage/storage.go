@@ -9,11 +9,11 @@ package storage
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
 	"strings"
 
 	"github.com/alpine-hodler/gidari/proto"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -22,6 +22,63 @@ const (
 
 	// PostgresType is the byte representation of a postgres database.
 	PostgresType
+
+	// SQLiteType is the byte representation of a sqlite database.
+	SQLiteType
+
+	// RedisType is the byte representation of a redis database.
+	RedisType
+
+	// BigQueryType is the byte representation of a bigquery dataset.
+	BigQueryType
+
+	// SnowflakeType is the byte representation of a snowflake schema.
+	SnowflakeType
+
+	// ParquetType is the byte representation of Parquet files in object storage.
+	ParquetType
+
+	// ElasticsearchType is the byte representation of an Elasticsearch or OpenSearch cluster.
+	ElasticsearchType
+
+	// InfluxDBType is the byte representation of an InfluxDB bucket.
+	InfluxDBType
+
+	// DuckDBType is the byte representation of a duckdb database.
+	DuckDBType
+
+	// KafkaType is the byte representation of a Kafka cluster.
+	KafkaType
+
+	// FilesystemType is the byte representation of a local directory of JSONL or CSV files.
+	FilesystemType
+
+	// SQLServerType is the byte representation of a SQL Server database.
+	SQLServerType
+
+	// Neo4jType is the byte representation of a Neo4j graph database.
+	Neo4jType
+
+	// CouchDBType is the byte representation of a CouchDB document database.
+	CouchDBType
+
+	// KVType is the byte representation of an embedded key-value file.
+	KVType
+
+	// FirestoreType is the byte representation of a Firestore document database.
+	FirestoreType
+
+	// ArangoDBType is the byte representation of an ArangoDB multi-model database.
+	ArangoDBType
+
+	// OracleType is the byte representation of an Oracle database.
+	OracleType
+
+	// RedshiftType is the byte representation of an Amazon Redshift database.
+	RedshiftType
+
+	// QuestDBType is the byte representation of a QuestDB time-series database.
+	QuestDBType
 )
 
 var (
@@ -36,11 +93,34 @@ func DNSNotSupportedError(dns string) error {
 	return fmt.Errorf("%w: %s", ErrDNSNotSupported, dns)
 }
 
+// loggerKey is the context key of the logger that storage devices log non-fatal errors to.
+type loggerKey struct{}
+
+// WithLogger will return a context with the logger that the transactions started with the context log non-fatal
+// errors to, e.g. a failed refresh of the planner statistics after a load has committed.
+func WithLogger(ctx context.Context, logger logrus.FieldLogger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// contextLogger will return the logger of the context, or the standard logger if there is none.
+func contextLogger(ctx context.Context) logrus.FieldLogger {
+	if logger, ok := ctx.Value(loggerKey{}).(logrus.FieldLogger); ok {
+		return logger
+	}
+
+	return logrus.StandardLogger()
+}
+
 // Storage is an interface that defines the methods that a storage device should implement.
 type Storage interface {
 	// Close will disconnect the storage device.
 	Close()
 
+	// Count will return the number of records of a table that match the required fields on the request, like "Read"
+	// without returning the records. Storage devices that can not count records without reading them count the
+	// records of a read.
+	Count(context.Context, *proto.CountRequest) (*proto.CountResponse, error)
+
 	// ListPrimaryKeys will return a list of primary keys for all tables in the database.
 	ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error)
 
@@ -50,6 +130,11 @@ type Storage interface {
 	// IsNoSQL will return true if the storage device is a NoSQL database.
 	IsNoSQL() bool
 
+	// Read will return the records from a table that match the required fields on the request. A required field with
+	// a list value will match any of the values in the list. The "orderBy", "after", and "limit" options of the
+	// request select a page of the records, see "ReadOrderByOption".
+	Read(context.Context, *proto.ReadRequest) (*proto.ReadResponse, error)
+
 	// StartTx will start a transaction and return a "Tx" object that can be used to put operations on a channel,
 	// commit the result of all operations sent to the transaction, or rollback the result of all operations sent
 	// to the transaction.
@@ -65,9 +150,6 @@ type Storage interface {
 	Upsert(context.Context, *proto.UpsertRequest) (*proto.UpsertResponse, error)
 }
 
-// sqlPrepareContextFn can be used to prepare a statement and return the result.
-type sqlPrepareContextFn func(context.Context, string) (*sql.Stmt, error)
-
 // Scheme takes a byte and returns the associated DNS root database resource.
 func Scheme(t uint8) string {
 	switch t {
@@ -75,6 +157,44 @@ func Scheme(t uint8) string {
 		return "mongodb"
 	case PostgresType:
 		return "postgresql"
+	case SQLiteType:
+		return "sqlite"
+	case RedisType:
+		return "redis"
+	case BigQueryType:
+		return bigQueryScheme
+	case SnowflakeType:
+		return snowflakeScheme
+	case ParquetType:
+		return parquetScheme
+	case ElasticsearchType:
+		return elasticsearchScheme
+	case InfluxDBType:
+		return influxDBScheme
+	case DuckDBType:
+		return duckDBScheme
+	case KafkaType:
+		return kafkaScheme
+	case FilesystemType:
+		return filesystemScheme
+	case SQLServerType:
+		return sqlServerScheme
+	case Neo4jType:
+		return neo4jScheme
+	case CouchDBType:
+		return couchDBScheme
+	case KVType:
+		return kvScheme
+	case FirestoreType:
+		return firestoreScheme
+	case ArangoDBType:
+		return arangoDBScheme
+	case OracleType:
+		return oracleScheme
+	case RedshiftType:
+		return redshiftScheme
+	case QuestDBType:
+		return questDBScheme
 	default:
 		return "unknown"
 	}
@@ -87,6 +207,183 @@ type Service struct {
 
 // New will attempt to return a generic storage object given a DNS.
 func New(ctx context.Context, dns string) (*Service, error) {
+	// The path of a database file may contain the scheme of another storage device, e.g. "sqlite://mongodb.db", so
+	// the file-based storage devices are matched first.
+	if strings.HasPrefix(dns, Scheme(SQLiteType)+"://") {
+		svc, err := NewSQLite(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct sqlite storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(DuckDBType)+"://") {
+		svc, err := NewDuckDB(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct duckdb storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(BigQueryType)+"://") {
+		svc, err := NewBigQuery(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct bigquery storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(SnowflakeType)+"://") {
+		svc, err := NewSnowflake(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct snowflake storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(SQLServerType)+"://") {
+		svc, err := NewSQLServer(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct sqlserver storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(OracleType)+"://") {
+		svc, err := NewOracle(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct oracle storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(RedshiftType)+"://") {
+		svc, err := NewRedshift(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct redshift storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	// JSONL and CSV files are written to a local directory with a "file://" URL that has a format.
+	if isFilesystemDNS(dns) {
+		svc, err := NewFilesystem(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct filesystem storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	// Parquet files are written to an S3 or a GCS bucket, an Azure Blob Storage container, or to a local directory
+	// with a "file://" URL.
+	if strings.HasPrefix(dns, Scheme(ParquetType)+"://") || strings.HasPrefix(dns, gcsScheme+"://") ||
+		strings.HasPrefix(dns, azblobScheme+"://") || strings.HasPrefix(dns, "file://") {
+		svc, err := NewParquet(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct parquet storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(ElasticsearchType)+"://") || strings.HasPrefix(dns, opensearchScheme+"://") {
+		svc, err := NewElasticsearch(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct elasticsearch storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(InfluxDBType)+"://") {
+		svc, err := NewInfluxDB(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct influxdb storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(QuestDBType)+"://") {
+		svc, err := NewQuestDB(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct questdb storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(KafkaType)+"://") {
+		svc, err := NewKafka(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct kafka storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(Neo4jType)+"://") || strings.HasPrefix(dns, neo4jTLSScheme+"://") {
+		svc, err := NewNeo4j(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct neo4j storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(CouchDBType)+"://") {
+		svc, err := NewCouchDB(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct couchdb storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(KVType)+"://") {
+		svc, err := NewKV(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct kv storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(FirestoreType)+"://") {
+		svc, err := NewFirestore(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct firestore storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(ArangoDBType)+"://") {
+		svc, err := NewArangoDB(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct arangodb storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
+	if strings.HasPrefix(dns, Scheme(RedisType)+"://") || strings.HasPrefix(dns, "rediss://") {
+		svc, err := NewRedis(ctx, dns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct redis storage: %w", err)
+		}
+
+		return &Service{svc}, nil
+	}
+
 	if strings.Contains(dns, Scheme(MongoType)) {
 		svc, err := NewMongo(ctx, dns)
 		if err != nil {
@@ -96,7 +393,8 @@ func New(ctx context.Context, dns string) (*Service, error) {
 		return &Service{svc}, nil
 	}
 
-	if strings.Contains(dns, Scheme(PostgresType)) {
+	if strings.Contains(dns, Scheme(PostgresType)) || strings.HasPrefix(dns, "postgres://") ||
+		strings.HasPrefix(dns, cockroachScheme+"://") {
 		svc, err := NewPostgres(ctx, dns)
 		if err != nil {
 			return nil, fmt.Errorf("failed to construct postgres storage: %w", err)
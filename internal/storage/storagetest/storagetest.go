@@ -0,0 +1,377 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+
+// Package storagetest is a conformance suite for "storage.Storage" implementations. The suite covers upsert
+// idempotency, transactions, truncates, reads, counts, the fidelity of column types, and large batches, and compares
+// the records read back with golden files, so that new backends and refactors are validated the same way.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// largeBatch is the number of records in the large batch case, which is more than a single statement can write on
+// the SQL backends.
+const largeBatch = 2500
+
+var update = flag.Bool("update", false, "update the golden files of the storage conformance suite")
+
+// conformanceCase is a case of the suite. The records returned by "run" are compared with the golden file of the
+// case, if it has one.
+type conformanceCase struct {
+	name   string
+	golden string
+
+	// keyed is set for cases that require upserts to update the record with the same primary key, which NoSQL
+	// backends without a primary key do not do.
+	keyed bool
+
+	run func(ctx context.Context, t *testing.T, stg storage.Storage, table string) []*structpb.Struct
+}
+
+var cases = []conformanceCase{
+	{
+		name:   "upsert is idempotent",
+		golden: "upsert_idempotent.golden",
+		run: func(ctx context.Context, t *testing.T, stg storage.Storage, table string) []*structpb.Struct {
+			t.Helper()
+
+			records := []map[string]interface{}{{"id": "1", "name": "a"}, {"id": "2", "name": "b"}}
+
+			upsert(ctx, t, stg, table, records...)
+			upsert(ctx, t, stg, table, records...)
+
+			return read(ctx, t, stg, &proto.ReadRequest{Table: table})
+		},
+	},
+	{
+		name:   "upsert updates by primary key",
+		golden: "upsert_update.golden",
+		keyed:  true,
+		run: func(ctx context.Context, t *testing.T, stg storage.Storage, table string) []*structpb.Struct {
+			t.Helper()
+
+			upsert(ctx, t, stg, table, map[string]interface{}{"id": "1", "name": "a"})
+			upsert(ctx, t, stg, table, map[string]interface{}{"id": "1", "name": "b"})
+
+			return read(ctx, t, stg, &proto.ReadRequest{Table: table})
+		},
+	},
+	{
+		name:   "transactions commit",
+		golden: "transaction_commit.golden",
+		run: func(ctx context.Context, t *testing.T, stg storage.Storage, table string) []*structpb.Struct {
+			t.Helper()
+
+			transact(ctx, t, stg, table, true, map[string]interface{}{"id": "1", "name": "a"})
+
+			return read(ctx, t, stg, &proto.ReadRequest{Table: table})
+		},
+	},
+	{
+		name:   "transactions roll back",
+		golden: "empty.golden",
+		run: func(ctx context.Context, t *testing.T, stg storage.Storage, table string) []*structpb.Struct {
+			t.Helper()
+
+			transact(ctx, t, stg, table, false, map[string]interface{}{"id": "1", "name": "a"})
+
+			return read(ctx, t, stg, &proto.ReadRequest{Table: table})
+		},
+	},
+	{
+		name:   "truncate removes every record",
+		golden: "empty.golden",
+		run: func(ctx context.Context, t *testing.T, stg storage.Storage, table string) []*structpb.Struct {
+			t.Helper()
+
+			upsert(ctx, t, stg, table, map[string]interface{}{"id": "1", "name": "a"})
+			truncate(ctx, t, stg, table)
+
+			return read(ctx, t, stg, &proto.ReadRequest{Table: table})
+		},
+	},
+	{
+		name:   "reads match required fields",
+		golden: "read_required.golden",
+		run: func(ctx context.Context, t *testing.T, stg storage.Storage, table string) []*structpb.Struct {
+			t.Helper()
+
+			upsert(ctx, t, stg, table,
+				map[string]interface{}{"id": "1", "name": "a"},
+				map[string]interface{}{"id": "2", "name": "b"},
+				map[string]interface{}{"id": "3", "name": "c"})
+
+			req := &proto.ReadRequest{Table: table}
+			if err := tools.AssignReadRequired(req, "name", []interface{}{"a", "c"}); err != nil {
+				t.Fatalf("failed to assign required fields: %v", err)
+			}
+
+			return read(ctx, t, stg, req)
+		},
+	},
+	{
+		name:   "reads page by sort keys",
+		golden: "read_page.golden",
+		run: func(ctx context.Context, t *testing.T, stg storage.Storage, table string) []*structpb.Struct {
+			t.Helper()
+
+			upsert(ctx, t, stg, table,
+				map[string]interface{}{"id": "1", "name": "a"},
+				map[string]interface{}{"id": "2", "name": "b"},
+				map[string]interface{}{"id": "3", "name": "c"},
+				map[string]interface{}{"id": "4", "name": "d"})
+
+			opts, err := structpb.NewStruct(map[string]interface{}{
+				storage.ReadOrderByOption: []interface{}{"id"},
+				storage.ReadAfterOption:   []interface{}{"1"},
+				storage.ReadLimitOption:   2,
+			})
+			if err != nil {
+				t.Fatalf("failed to create read options: %v", err)
+			}
+
+			return read(ctx, t, stg, &proto.ReadRequest{Table: table, Options: opts})
+		},
+	},
+	{
+		name: "counts match required fields",
+		run: func(ctx context.Context, t *testing.T, stg storage.Storage, table string) []*structpb.Struct {
+			t.Helper()
+
+			upsert(ctx, t, stg, table,
+				map[string]interface{}{"id": "1", "name": "a"},
+				map[string]interface{}{"id": "2", "name": "b"},
+				map[string]interface{}{"id": "3", "name": "c"})
+
+			required, err := structpb.NewStruct(map[string]interface{}{"name": []interface{}{"a", "c"}})
+			if err != nil {
+				t.Fatalf("failed to create required fields: %v", err)
+			}
+
+			for _, tcase := range []struct {
+				req *proto.CountRequest
+				exp int64
+			}{
+				{&proto.CountRequest{Table: table}, 3},
+				{&proto.CountRequest{Table: table, Required: required}, 2},
+			} {
+				rsp, err := stg.Count(ctx, tcase.req)
+				if err != nil {
+					t.Fatalf("failed to count records: %v", err)
+				}
+
+				if rsp.GetCount() != tcase.exp {
+					t.Fatalf("expected %d records, got %d", tcase.exp, rsp.GetCount())
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		name:   "column types are preserved",
+		golden: "type_fidelity.golden",
+		run: func(ctx context.Context, t *testing.T, stg storage.Storage, table string) []*structpb.Struct {
+			t.Helper()
+
+			upsert(ctx, t, stg, table, map[string]interface{}{
+				"id": "1", "flag": true, "count": 9007199254740991, "price": 0.1, "name": "ünïcødé \"quoted\"",
+			})
+
+			return read(ctx, t, stg, &proto.ReadRequest{Table: table})
+		},
+	},
+	{
+		name: "large batches are written",
+		run: func(ctx context.Context, t *testing.T, stg storage.Storage, table string) []*structpb.Struct {
+			t.Helper()
+
+			records := make([]map[string]interface{}, largeBatch)
+			for idx := range records {
+				records[idx] = map[string]interface{}{"id": fmt.Sprintf("%05d", idx), "name": "a"}
+			}
+
+			upsert(ctx, t, stg, table, records...)
+
+			if got := len(read(ctx, t, stg, &proto.ReadRequest{Table: table})); got != largeBatch {
+				t.Fatalf("expected %d records, got %d", largeBatch, got)
+			}
+
+			return nil
+		},
+	},
+}
+
+// Run will run the conformance suite against the storage. The table is truncated before each case, and must have
+// the columns "id" (text, the primary key), "flag" (bool), "count" (int), "price" (float), and "name" (text). Run the
+// tests with "-update" to rewrite the golden files from the records read back.
+func Run(t *testing.T, stg storage.Storage, table string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	for _, tcase := range cases {
+		tcase := tcase
+
+		t.Run(tcase.name, func(t *testing.T) {
+			if tcase.keyed && stg.IsNoSQL() {
+				t.Skip("upserts do not update by primary key on NoSQL storage")
+			}
+
+			truncate(ctx, t, stg, table)
+			t.Cleanup(func() { truncate(ctx, t, stg, table) })
+
+			records := tcase.run(ctx, t, stg, table)
+			if tcase.golden != "" {
+				compareGolden(t, tcase.golden, records)
+			}
+		})
+	}
+}
+
+func upsert(ctx context.Context, t *testing.T, stg storage.Storage, table string, records ...map[string]interface{}) {
+	t.Helper()
+
+	if _, err := stg.Upsert(ctx, upsertRequest(t, table, records)); err != nil {
+		t.Fatalf("failed to upsert records: %v", err)
+	}
+}
+
+func upsertRequest(t *testing.T, table string, records []map[string]interface{}) *proto.UpsertRequest {
+	t.Helper()
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		t.Fatalf("failed to marshal records: %v", err)
+	}
+
+	return &proto.UpsertRequest{Table: table, Data: data, DataType: int32(tools.UpsertDataJSON)}
+}
+
+// transact will upsert the records in a transaction, and commit or roll back the transaction.
+func transact(ctx context.Context, t *testing.T, stg storage.Storage, table string, commit bool,
+	records ...map[string]interface{},
+) {
+	t.Helper()
+
+	txn, err := stg.StartTx(ctx)
+	if err != nil {
+		t.Fatalf("failed to start transaction: %v", err)
+	}
+
+	req := upsertRequest(t, table, records)
+
+	txn.Send(func(ctx context.Context, stg storage.Storage) error {
+		if _, err := stg.Upsert(ctx, req); err != nil {
+			return fmt.Errorf("failed to upsert records: %w", err)
+		}
+
+		return nil
+	})
+
+	if commit {
+		err = txn.Commit()
+	} else {
+		err = txn.Rollback()
+	}
+
+	if err != nil {
+		t.Fatalf("failed to end transaction: %v", err)
+	}
+}
+
+func truncate(ctx context.Context, t *testing.T, stg storage.Storage, table string) {
+	t.Helper()
+
+	if _, err := stg.Truncate(ctx, &proto.TruncateRequest{Tables: []string{table}}); err != nil {
+		t.Fatalf("failed to truncate table: %v", err)
+	}
+}
+
+func read(ctx context.Context, t *testing.T, stg storage.Storage, req *proto.ReadRequest) []*structpb.Struct {
+	t.Helper()
+
+	rsp, err := stg.Read(ctx, req)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+
+	return rsp.GetRecords()
+}
+
+// normalize will encode the records as indented JSON, sorted by "id" and without the fields that differ by backend,
+// i.e. the "_id" of MongoDB documents and the columns that the records did not set.
+func normalize(t *testing.T, records []*structpb.Struct) []byte {
+	t.Helper()
+
+	out := make([]map[string]interface{}, 0, len(records))
+
+	for _, record := range records {
+		fields := record.AsMap()
+		delete(fields, "_id")
+
+		for name, value := range fields {
+			if value == nil {
+				delete(fields, name)
+			}
+		}
+
+		out = append(out, fields)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return fmt.Sprint(out[i]["id"]) < fmt.Sprint(out[j]["id"]) })
+
+	data, err := json.MarshalIndent(out, "", "\t")
+	if err != nil {
+		t.Fatalf("failed to marshal records: %v", err)
+	}
+
+	return append(data, '\n')
+}
+
+// compareGolden will compare the records with the golden file, or rewrite the golden file with "-update".
+func compareGolden(t *testing.T, name string, records []*structpb.Struct) {
+	t.Helper()
+
+	_, file, _, _ := runtime.Caller(0)
+	path := filepath.Join(filepath.Dir(file), "testdata", name)
+
+	got := normalize(t, records)
+
+	if *update {
+		if err := os.WriteFile(path, got, 0o600); err != nil {
+			t.Fatalf("failed to update golden file: %v", err)
+		}
+
+		return
+	}
+
+	exp, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+
+	if !bytes.Equal(got, exp) {
+		t.Fatalf("records do not match %s:\nexpected:\n%s\ngot:\n%s", name, exp, got)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storagetest
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestCompareGolden(t *testing.T) {
+	t.Parallel()
+
+	newRecords := func(t *testing.T, records ...map[string]interface{}) []*structpb.Struct {
+		t.Helper()
+
+		out := make([]*structpb.Struct, len(records))
+
+		for idx, record := range records {
+			var err error
+			if out[idx], err = structpb.NewStruct(record); err != nil {
+				t.Fatalf("failed to create record: %v", err)
+			}
+		}
+
+		return out
+	}
+
+	// Records read back are sorted by "id", and backend specific fields and unset columns are left out.
+	compareGolden(t, "read_required.golden", newRecords(t,
+		map[string]interface{}{"id": "3", "name": "c", "_id": map[string]interface{}{"$oid": "6359"}},
+		map[string]interface{}{"id": "1", "name": "a", "flag": nil},
+	))
+
+	compareGolden(t, "type_fidelity.golden", newRecords(t, map[string]interface{}{
+		"id": "1", "flag": true, "count": 9007199254740991.0, "price": 0.1, "name": "ünïcødé \"quoted\"",
+	}))
+
+	compareGolden(t, "empty.golden", nil)
+}
@@ -0,0 +1,171 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// pgHypertableParam is the prefix of the connection string parameters that turn tables into TimescaleDB
+	// hypertables, e.g. "hypertable.candles=time" to partition the "candles" table by its "time" column. The
+	// parameters are removed from the connection string before connecting.
+	pgHypertableParam = "hypertable."
+
+	// pgChunkIntervalParam is the connection string parameter for the interval covered by each chunk of the
+	// hypertables, e.g. "chunk_interval=1 day", or a number for hypertables partitioned by an integer column. The
+	// parameter is removed from the connection string before connecting.
+	pgChunkIntervalParam = "chunk_interval"
+
+	// pgDefaultChunkInterval is the chunk interval of the hypertables when "chunk_interval" is not set, which is the
+	// default of TimescaleDB.
+	pgDefaultChunkInterval = "7 days"
+)
+
+var (
+	ErrCockroachHypertable = fmt.Errorf("hypertables are not supported on cockroachdb")
+	ErrInvalidHypertable   = fmt.Errorf("invalid hypertable")
+)
+
+// InvalidHypertableError is returned when a hypertable parameter of the connection string has no table or no time
+// column.
+func InvalidHypertableError(param string) error {
+	return fmt.Errorf("%w: %q expects %s<table>=<time column>", ErrInvalidHypertable, param, pgHypertableParam)
+}
+
+// pgHypertables are the tables written as TimescaleDB hypertables.
+type pgHypertables struct {
+	// timeColumns are the time columns of the hypertables, keyed by table.
+	timeColumns map[string]string
+
+	// chunkInterval is the interval covered by each chunk of the hypertables.
+	chunkInterval string
+
+	// created are the tables that have been converted into hypertables in each active transaction, keyed by
+	// transaction ID, or by the empty string for the upserts made outside of a transaction.
+	created map[string]map[string]bool
+}
+
+// parseHypertables will remove the hypertable and chunk interval parameters from the connection URL, returning the
+// hypertables to write, or nil if no hypertable is configured.
+func parseHypertables(connectionURL string) (string, *pgHypertables, error) {
+	if !strings.Contains(connectionURL, "://") || (!strings.Contains(connectionURL, pgHypertableParam) &&
+		!strings.Contains(connectionURL, pgChunkIntervalParam+"=")) {
+		return connectionURL, nil, nil
+	}
+
+	dnsURL, err := url.Parse(connectionURL)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	query := dnsURL.Query()
+	hypertables := &pgHypertables{
+		timeColumns:   make(map[string]string),
+		chunkInterval: pgDefaultChunkInterval,
+		created:       make(map[string]map[string]bool),
+	}
+
+	for param := range query {
+		table := strings.TrimPrefix(param, pgHypertableParam)
+		if table == param {
+			continue
+		}
+
+		column := query.Get(param)
+		if table == "" || column == "" {
+			return "", nil, InvalidHypertableError(param)
+		}
+
+		hypertables.timeColumns[table] = column
+
+		query.Del(param)
+	}
+
+	if query.Has(pgChunkIntervalParam) {
+		hypertables.chunkInterval = strings.TrimSpace(query.Get(pgChunkIntervalParam))
+		if hypertables.chunkInterval == "" {
+			return "", nil, fmt.Errorf("%w: %s is empty", ErrInvalidHypertable, pgChunkIntervalParam)
+		}
+
+		query.Del(pgChunkIntervalParam)
+	}
+
+	dnsURL.RawQuery = query.Encode()
+
+	if len(hypertables.timeColumns) == 0 {
+		return dnsURL.String(), nil, nil
+	}
+
+	return dnsURL.String(), hypertables, nil
+}
+
+// createHypertableQuery will return the statement that converts the table into a hypertable partitioned by its time
+// column, migrating the rows already in the table. A chunk interval that is a number is for an integer time column.
+func (hypertables *pgHypertables) createHypertableQuery() string {
+	intervalType := "interval"
+	if _, err := strconv.ParseInt(hypertables.chunkInterval, 10, 64); err == nil {
+		intervalType = "bigint"
+	}
+
+	return fmt.Sprintf("SELECT create_hypertable($1::regclass, $2::name, chunk_time_interval => $3::%s, "+
+		"if_not_exists => TRUE, migrate_data => TRUE)", intervalType)
+}
+
+// ensureHypertable will convert the table into a hypertable the first time it is written in the transaction of the
+// context, if the table has a time column configured. The conversion runs in the transaction, so that it is rolled
+// back with the transaction and does not wait on the locks the transaction already holds, e.g. after a truncate.
+func (pg *Postgres) ensureHypertable(ctx context.Context, queryer pgQueryer, table string) error {
+	if pg.hypertables == nil {
+		return nil
+	}
+
+	column, ok := pg.hypertables.timeColumns[table]
+	if !ok {
+		return nil
+	}
+
+	txID, _ := ctx.Value(basicPostgressTxID).(string)
+
+	created := pg.hypertables.created[txID]
+	if created == nil {
+		created = make(map[string]bool)
+		pg.hypertables.created[txID] = created
+	}
+
+	if created[table] {
+		return nil
+	}
+
+	if err := pg.exec(ctx, queryer, pg.hypertables.createHypertableQuery(), pq.QuoteIdentifier(table), column,
+		pg.hypertables.chunkInterval); err != nil {
+		return fmt.Errorf("unable to create hypertable %s: %w", table, err)
+	}
+
+	created[table] = true
+
+	return nil
+}
+
+// releaseHypertables will forget the tables converted in the transaction, once it is committed or rolled back.
+func (pg *Postgres) releaseHypertables(txID string) {
+	if pg.hypertables == nil {
+		return
+	}
+
+	pg.writeMutext.Lock()
+	defer pg.writeMutext.Unlock()
+
+	delete(pg.hypertables.created, txID)
+}
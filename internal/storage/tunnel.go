@@ -0,0 +1,252 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// sshHostParam is the connection string parameter for the SSH server to tunnel the storage connections through,
+	// e.g. "ssh_host=bastion.example.com:22". The SSH parameters are removed from the connection string before
+	// connecting.
+	sshHostParam = "ssh_host"
+
+	// sshUserParam is the SSH user. The default is the current user.
+	sshUserParam = "ssh_user"
+
+	// sshKeyParam is the path to the private key file. The default is "~/.ssh/id_ed25519", or "~/.ssh/id_rsa".
+	sshKeyParam = "ssh_key"
+
+	// sshJumpParam is the jump host to reach the SSH server through, with the same user and key.
+	sshJumpParam = "ssh_jump"
+
+	// sshKnownHostsParam is the path to the known hosts file used to verify the host keys of the SSH servers. The
+	// default is "~/.ssh/known_hosts".
+	sshKnownHostsParam = "ssh_known_hosts"
+
+	sshDefaultPort = "22"
+	sshDialTimeout = 30 * time.Second
+)
+
+var sshParams = []string{sshHostParam, sshUserParam, sshKeyParam, sshJumpParam, sshKnownHostsParam}
+
+// sshTunnel is an SSH connection, optionally through a jump host, that storage connections are dialed through.
+type sshTunnel struct {
+	client *ssh.Client
+	jump   *ssh.Client
+}
+
+// Dial will dial the address through the tunnel.
+func (tun *sshTunnel) Dial(network, address string) (net.Conn, error) {
+	return tun.DialContext(context.Background(), network, address)
+}
+
+// DialTimeout will dial the address through the tunnel, giving up once the timeout has passed.
+func (tun *sshTunnel) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return tun.DialContext(ctx, network, address)
+}
+
+// DialContext will dial the address through the tunnel, giving up if the context is done before the connection is
+// established.
+func (tun *sshTunnel) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := tun.client.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial %s through ssh tunnel: %w", address, err)
+	}
+
+	return conn, nil
+}
+
+// Close will close the SSH connections.
+func (tun *sshTunnel) Close() {
+	if tun == nil {
+		return
+	}
+
+	tun.client.Close()
+
+	if tun.jump != nil {
+		tun.jump.Close()
+	}
+}
+
+// withDefaultPort will add the default SSH port to the address if it does not have one.
+func withDefaultPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, sshDefaultPort)
+	}
+
+	return address
+}
+
+// expandHome will replace a leading "~" in the path with the home directory of the current user.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
+
+// sshClientConfig will return the SSH client configuration for the tunnel parameters.
+func sshClientConfig(query url.Values) (*ssh.ClientConfig, error) {
+	username := query.Get(sshUserParam)
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get current user: %w", err)
+		}
+
+		username = current.Username
+	}
+
+	keyPaths := []string{"~/.ssh/id_ed25519", "~/.ssh/id_rsa"}
+	if keyPath := query.Get(sshKeyParam); keyPath != "" {
+		keyPaths = []string{keyPath}
+	}
+
+	var (
+		key []byte
+		err error
+	)
+
+	for _, keyPath := range keyPaths {
+		if key, err = os.ReadFile(expandHome(keyPath)); err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ssh key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse ssh key: %w", err)
+	}
+
+	knownHostsPath := "~/.ssh/known_hosts"
+	if path := query.Get(sshKnownHostsParam); path != "" {
+		knownHostsPath = path
+	}
+
+	hostKeyCallback, err := knownhosts.New(expandHome(knownHostsPath))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ssh known hosts: %w", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshDialTimeout,
+	}, nil
+}
+
+// openTunnel will open the SSH connection, dialing the SSH server through the jump host if one is set.
+func openTunnel(query url.Values) (*sshTunnel, error) {
+	config, err := sshClientConfig(query)
+	if err != nil {
+		return nil, err
+	}
+
+	host := withDefaultPort(query.Get(sshHostParam))
+
+	jumpHost := query.Get(sshJumpParam)
+	if jumpHost == "" {
+		client, err := ssh.Dial("tcp", host, config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to ssh server %s: %w", host, err)
+		}
+
+		return &sshTunnel{client: client}, nil
+	}
+
+	jump, err := ssh.Dial("tcp", withDefaultPort(jumpHost), config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to ssh jump host %s: %w", jumpHost, err)
+	}
+
+	conn, err := jump.Dial("tcp", host)
+	if err != nil {
+		jump.Close()
+
+		return nil, fmt.Errorf("unable to dial ssh server %s through jump host: %w", host, err)
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, host, config)
+	if err != nil {
+		jump.Close()
+
+		return nil, fmt.Errorf("unable to connect to ssh server %s: %w", host, err)
+	}
+
+	return &sshTunnel{client: ssh.NewClient(sshConn, chans, reqs), jump: jump}, nil
+}
+
+// removeTunnelParams will remove the SSH parameters from the connection URL, returning the parameters.
+func removeTunnelParams(connectionURL string) (string, url.Values, error) {
+	if !strings.Contains(connectionURL, "://") || !strings.Contains(connectionURL, sshHostParam+"=") {
+		return connectionURL, nil, nil
+	}
+
+	dsn, err := url.Parse(connectionURL)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to parse connection URL: %w", err)
+	}
+
+	query := dsn.Query()
+	params := url.Values{}
+
+	for _, param := range sshParams {
+		if query.Has(param) {
+			params.Set(param, query.Get(param))
+			query.Del(param)
+		}
+	}
+
+	dsn.RawQuery = query.Encode()
+
+	return dsn.String(), params, nil
+}
+
+// parseTunnel will remove the SSH parameters from the connection URL and open the tunnel. If the connection URL does
+// not have an SSH host, the tunnel is nil.
+func parseTunnel(connectionURL string) (string, *sshTunnel, error) {
+	connectionURL, params, err := removeTunnelParams(connectionURL)
+	if err != nil || params.Get(sshHostParam) == "" {
+		return connectionURL, nil, err
+	}
+
+	tunnel, err := openTunnel(params)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return connectionURL, tunnel, nil
+}
@@ -0,0 +1,484 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+const (
+	// archiveExt is the extension of the archived payload objects, which are gzip compressed JSON.
+	archiveExt = ".json.gz"
+
+	// archiveManifestName is the name of the manifest object of a run, which is written under the run ID after every
+	// payload of the run has been archived.
+	archiveManifestName = "_manifest.json"
+
+	// archiveManifestsDir is the directory of the manifests of partitioned archives. Query engines such as Athena
+	// ignore the objects under a directory that starts with an underscore.
+	archiveManifestsDir = "_manifests"
+
+	// archiveDefaultConcurrency is the default number of payloads that are written to the archive location at the
+	// same time.
+	archiveDefaultConcurrency = 4
+)
+
+// Archive partitions are the "key=value" directories that payloads can be partitioned by.
+const (
+	ArchivePartitionTable = "table"
+	ArchivePartitionDate  = "date"
+	ArchivePartitionHour  = "hour"
+	ArchivePartitionRun   = "run"
+)
+
+var (
+	ErrArchiving                 = fmt.Errorf("failed to archive payload")
+	ErrInvalidArchivePartition   = fmt.Errorf("invalid archive partition")
+	ErrInvalidArchiveConcurrency = fmt.Errorf("invalid archive concurrency")
+)
+
+// ArchivingError is returned when the raw payload of a batch can not be archived.
+func ArchivingError(batch int, err error) error {
+	return fmt.Errorf("%w for batch %d: %v", ErrArchiving, batch, err)
+}
+
+// InvalidArchiveConcurrencyError is returned when the number of payloads written at the same time is negative.
+func InvalidArchiveConcurrencyError(concurrency int) error {
+	return fmt.Errorf("%w: %d, expected a positive number", ErrInvalidArchiveConcurrency, concurrency)
+}
+
+// InvalidArchivePartitionError is returned when an archive partition is unknown or repeated.
+func InvalidArchivePartitionError(partition string) error {
+	return fmt.Errorf("%w: %q, expected each of %q, %q, %q, or %q at most once", ErrInvalidArchivePartition, partition,
+		ArchivePartitionTable, ArchivePartitionDate, ArchivePartitionHour, ArchivePartitionRun)
+}
+
+// Archive is the configuration for archiving the raw web API responses, so that they can be reprocessed later with
+// different transformations without calling the web API again.
+type Archive struct {
+	// Location is the object storage location to archive the payloads to, either a local directory (e.g.
+	// "file:///var/lib/gidari/archive") or an S3 bucket and prefix (e.g. "s3://bucket/archive?region=us-east-1").
+	// Each payload is written to "<run ID>/<batch>-<table>.json.gz" under the location, and a manifest of the
+	// payloads is written to "<run ID>/_manifest.json" once every payload of the run has been archived.
+	Location string `yaml:"location"`
+
+	// PartitionBy is the Hive-style "key=value" directory layout of the payloads, e.g. ["table", "date"] writes each
+	// payload to "table=<table>/date=<YYYY-MM-DD>/<run ID>-<batch>-<table>.json.gz" under the location. The
+	// partitions are "table", "date" and "hour" (the UTC time the payload was fetched), and "run". The manifest of a
+	// partitioned run is written to "_manifests/<run ID>/_manifest.json".
+	PartitionBy []string `yaml:"partitionBy"`
+
+	// Rotation is the policy for appending the payloads to segments that are rotated by size, record count, or
+	// interval, instead of writing an object for each payload.
+	Rotation *ArchiveRotation `yaml:"rotation"`
+
+	// Concurrency is the number of payloads that are written to the location at the same time, 4 by default. The web
+	// workers wait to archive a payload while as many payloads are being written.
+	Concurrency int `yaml:"concurrency"`
+}
+
+func (arc *Archive) validate() error {
+	if arc.Location == "" {
+		return MissingConfigFieldError("archive.location")
+	}
+
+	if arc.Concurrency < 0 {
+		return InvalidArchiveConcurrencyError(arc.Concurrency)
+	}
+
+	seen := make(map[string]bool, len(arc.PartitionBy))
+
+	for _, partition := range arc.PartitionBy {
+		switch partition {
+		case ArchivePartitionTable, ArchivePartitionDate, ArchivePartitionHour, ArchivePartitionRun:
+		default:
+			return InvalidArchivePartitionError(partition)
+		}
+
+		if seen[partition] {
+			return InvalidArchivePartitionError(partition)
+		}
+
+		seen[partition] = true
+	}
+
+	if arc.Rotation != nil {
+		if err := arc.Rotation.validate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := storage.NewObjectStore(arc.Location); err != nil {
+		return fmt.Errorf("invalid archive: %w", err)
+	}
+
+	return nil
+}
+
+// archivedPayload is the raw body of a web API response, with the metadata of the request.
+type archivedPayload struct {
+	RunID     string      `json:"runId"`
+	Batch     int         `json:"batch"`
+	Table     string      `json:"table"`
+	Request   string      `json:"request,omitempty"`
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Header    http.Header `json:"header"`
+	FetchedAt time.Time   `json:"fetchedAt"`
+	Body      []byte      `json:"body"`
+}
+
+// key will return the object key of the payload under the archive location, in the directories of the partitions.
+func (payload *archivedPayload) key(partitionBy []string) string {
+	if len(partitionBy) == 0 {
+		return fmt.Sprintf("%s/%06d-%s%s", payload.RunID, payload.Batch, payload.Table, archiveExt)
+	}
+
+	dirs := make([]string, 0, len(partitionBy))
+
+	for _, partition := range partitionBy {
+		var value string
+
+		switch partition {
+		case ArchivePartitionTable:
+			value = payload.Table
+		case ArchivePartitionDate:
+			value = payload.FetchedAt.UTC().Format("2006-01-02")
+		case ArchivePartitionHour:
+			value = payload.FetchedAt.UTC().Format("15")
+		case ArchivePartitionRun:
+			value = payload.RunID
+		}
+
+		dirs = append(dirs, partition+"="+url.PathEscape(value))
+	}
+
+	// The run ID keeps the names of payloads of different runs in the same partition apart.
+	return fmt.Sprintf("%s/%s-%06d-%s%s", strings.Join(dirs, "/"), payload.RunID, payload.Batch, payload.Table,
+		archiveExt)
+}
+
+// manifestKey will return the object key of the manifest of the run under the archive location.
+func manifestKey(runID string, partitionBy []string) string {
+	if len(partitionBy) == 0 {
+		return runID + "/" + archiveManifestName
+	}
+
+	return archiveManifestsDir + "/" + runID + "/" + archiveManifestName
+}
+
+// encode will return the gzip compressed JSON of the payload.
+func (payload *archivedPayload) encode() ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(payload); err != nil {
+		return nil, fmt.Errorf("unable to encode payload: %w", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("unable to compress payload: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// archiveManifest lists the payloads archived by a run. The manifest is written last, so downstream jobs can treat
+// its presence as the marker that the payloads of the run are complete, and verify each payload against it.
+type archiveManifest struct {
+	RunID     string                `json:"runId"`
+	CreatedAt time.Time             `json:"createdAt"`
+	Records   int                   `json:"records"`
+	Files     []archiveManifestFile `json:"files"`
+
+	// Schema is the JSON type of each field of the records of each table, e.g. "string" or "number", or "mixed" for
+	// fields with values of different types.
+	Schema map[string]map[string]string `json:"schema"`
+}
+
+// archiveManifestFile is an archived payload in the manifest of a run.
+type archiveManifestFile struct {
+	Key     string `json:"key"`
+	Table   string `json:"table"`
+	Batch   int    `json:"batch"`
+	Records int    `json:"records"`
+	Bytes   int    `json:"bytes"`
+	SHA256  string `json:"sha256"`
+
+	// Payloads is the number of payloads in a segment, see "ArchiveRotation".
+	Payloads int `json:"payloads,omitempty"`
+}
+
+// jsonType will return the JSON type of the decoded value.
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+
+	return ""
+}
+
+// records will return the number of records in the body of the payload, and the JSON type of each of their fields.
+// A body that is a JSON array has a record for each object in the array, and a body that is a JSON object is a
+// single record.
+func (payload *archivedPayload) records() (int, map[string]string) {
+	var body interface{}
+	if err := json.Unmarshal(payload.Body, &body); err != nil {
+		return 0, nil
+	}
+
+	records, ok := body.([]interface{})
+	if !ok {
+		records = []interface{}{body}
+	}
+
+	count := 0
+	schema := make(map[string]string)
+
+	for _, record := range records {
+		fields, ok := record.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		count++
+
+		for name, value := range fields {
+			switch fieldType := jsonType(value); {
+			case fieldType == "":
+			case schema[name] == "":
+				schema[name] = fieldType
+			case schema[name] != fieldType:
+				schema[name] = "mixed"
+			}
+		}
+	}
+
+	return count, schema
+}
+
+// archiver writes the raw payloads of a run to object storage in the background, alongside the repository workers.
+type archiver struct {
+	store       storage.ObjectStore
+	runID       string
+	partitionBy []string
+	rotation    *ArchiveRotation
+	wg          sync.WaitGroup
+
+	// writes has a slot for each payload that is being written to the archive location, so that at most
+	// "Archive.Concurrency" payloads, and their bodies, are held by the archiver.
+	writes chan struct{}
+
+	// uploads are the segments being written to the archive location.
+	uploads sync.WaitGroup
+
+	mtx      sync.Mutex
+	err      error
+	manifest archiveManifest
+
+	// segments are the open segments by partition directory, and rotated are the segments that are written when the
+	// run finishes. Once closed, segments are no longer rotated by their timers.
+	segments   map[string]*segment
+	rotated    []*segment
+	segmentSeq int
+	closed     bool
+}
+
+// newArchiver will return the archiver for the run, or nil if archiving is not configured.
+func newArchiver(cfg *Config) (*archiver, error) {
+	if cfg.Archive == nil {
+		return nil, nil
+	}
+
+	store, err := storage.NewObjectStore(cfg.Archive.Location)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create archive store: %w", err)
+	}
+
+	concurrency := cfg.Archive.Concurrency
+	if concurrency == 0 {
+		concurrency = archiveDefaultConcurrency
+	}
+
+	return &archiver{
+		store:       store,
+		runID:       cfg.RunID,
+		partitionBy: cfg.Archive.PartitionBy,
+		rotation:    cfg.Archive.Rotation,
+		writes:      make(chan struct{}, concurrency),
+	}, nil
+}
+
+// archive will write the response body for the request of the job to object storage in the background, and call
+// "done" once it is written, or fails. A nil archiver does not call "done". The URL and headers of the request are
+// archived with secrets redacted. If as many payloads as the concurrency of the archive are being written, archive
+// waits for one of them to be written first.
+func (arc *archiver) archive(ctx context.Context, jc jobContext, req *http.Request, body []byte, done func()) {
+	if arc == nil {
+		return
+	}
+
+	payload := &archivedPayload{
+		RunID:     jc.runID,
+		Batch:     jc.batch,
+		Table:     jc.table,
+		Request:   jc.request,
+		Method:    req.Method,
+		URL:       tools.RedactURL(req.URL),
+		Header:    tools.RedactHeader(req.Header),
+		FetchedAt: time.Now().UTC(),
+		Body:      body,
+	}
+
+	key := payload.key(arc.partitionBy)
+
+	select {
+	case arc.writes <- struct{}{}:
+	case <-ctx.Done():
+		arc.fail(payload.Batch, ctx.Err())
+		done()
+
+		return
+	}
+
+	arc.wg.Add(1)
+
+	go func() {
+		defer arc.wg.Done()
+		defer func() { <-arc.writes }()
+		defer done()
+
+		data, err := payload.encode()
+
+		if err == nil && arc.rotation != nil {
+			arc.mtx.Lock()
+			defer arc.mtx.Unlock()
+
+			if err = arc.appendSegment(ctx, payload, key, data); err != nil && arc.err == nil {
+				arc.err = ArchivingError(payload.Batch, err)
+			}
+
+			return
+		}
+
+		if err == nil {
+			err = arc.store.Put(ctx, key, data)
+		}
+
+		arc.mtx.Lock()
+		defer arc.mtx.Unlock()
+
+		if err != nil {
+			if arc.err == nil {
+				arc.err = ArchivingError(payload.Batch, err)
+			}
+
+			return
+		}
+
+		records, schema := payload.records()
+		digest := sha256.Sum256(data)
+
+		arc.addManifestFile(archiveManifestFile{
+			Key:     key,
+			Table:   payload.Table,
+			Batch:   payload.Batch,
+			Records: records,
+			Bytes:   len(data),
+			SHA256:  hex.EncodeToString(digest[:]),
+		}, map[string]map[string]string{payload.Table: schema})
+	}()
+}
+
+// fail will record the error of archiving the payload of the batch, unless an error was already recorded.
+func (arc *archiver) fail(batch int, err error) {
+	arc.mtx.Lock()
+	defer arc.mtx.Unlock()
+
+	if arc.err == nil {
+		arc.err = ArchivingError(batch, err)
+	}
+}
+
+// addManifestFile will add the archived object to the manifest of the run, with the JSON types of the fields of its
+// records by table. The archiver must be locked.
+func (arc *archiver) addManifestFile(file archiveManifestFile, schemas map[string]map[string]string) {
+	arc.manifest.Files = append(arc.manifest.Files, file)
+	arc.manifest.Records += file.Records
+
+	if arc.manifest.Schema == nil {
+		arc.manifest.Schema = make(map[string]map[string]string)
+	}
+
+	for table, schema := range schemas {
+		arc.manifest.Schema[table] = mergeSchema(arc.manifest.Schema[table], schema)
+	}
+}
+
+// wait will wait for every payload to be archived, and return the first error. Once every payload has been archived,
+// the manifest of the run is written as the marker that the archived payloads are complete.
+func (arc *archiver) wait(ctx context.Context) error {
+	if arc == nil {
+		return nil
+	}
+
+	arc.wg.Wait()
+
+	if arc.rotation != nil {
+		arc.flushSegments()
+	}
+
+	if arc.err != nil {
+		return arc.err
+	}
+
+	manifest := arc.manifest
+	manifest.RunID = arc.runID
+	manifest.CreatedAt = time.Now().UTC()
+
+	if manifest.Files == nil {
+		manifest.Files = []archiveManifestFile{}
+	}
+
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Key < manifest.Files[j].Key })
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w: unable to encode manifest: %v", ErrArchiving, err)
+	}
+
+	if err := arc.store.Put(ctx, manifestKey(arc.runID, arc.partitionBy), data); err != nil {
+		return fmt.Errorf("%w: unable to write manifest: %v", ErrArchiving, err)
+	}
+
+	return nil
+}
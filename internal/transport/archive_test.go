@@ -0,0 +1,251 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+)
+
+// failingObjectStore is an object store that fails every write.
+type failingObjectStore struct {
+	storage.ObjectStore
+}
+
+func (failingObjectStore) Put(context.Context, string, []byte) error {
+	return fmt.Errorf("bucket not found")
+}
+
+// blockingObjectStore is an object store whose writes wait until it is released.
+type blockingObjectStore struct {
+	storage.ObjectStore
+	release chan struct{}
+}
+
+func (store blockingObjectStore) Put(context.Context, string, []byte) error {
+	<-store.release
+
+	return nil
+}
+
+func TestArchive(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	jc := jobContext{runID: "run-1", batch: 3, table: "candles"}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.test.com/candles?api_key=abc", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer abc")
+
+	t.Run("file", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+
+		arc, err := newArchiver(&Config{RunID: "run-1", Archive: &Archive{Location: "file://" + filepath.ToSlash(dir)}})
+		if err != nil {
+			t.Fatalf("failed to create archiver: %v", err)
+		}
+
+		body := `[{"id":1},{"id":2,"name":"a"},{"name":true}]`
+		arc.archive(ctx, jc, req, []byte(body), func() {})
+
+		if err := arc.wait(ctx); err != nil {
+			t.Fatalf("failed to archive payload: %v", err)
+		}
+
+		file, err := os.Open(filepath.Join(dir, "run-1", "000003-candles.json.gz"))
+		if err != nil {
+			t.Fatalf("failed to open archived payload: %v", err)
+		}
+		defer file.Close()
+
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("failed to decompress archived payload: %v", err)
+		}
+
+		payload := new(archivedPayload)
+		if err := json.NewDecoder(zr).Decode(payload); err != nil {
+			t.Fatalf("failed to decode archived payload: %v", err)
+		}
+
+		if string(payload.Body) != body || payload.Table != "candles" || payload.Batch != 3 {
+			t.Fatalf("unexpected archived payload: %+v", payload)
+		}
+
+		if payload.URL != "https://api.test.com/candles?api_key=xxxxx" || payload.Header.Get("Authorization") != "xxxxx" {
+			t.Fatalf("expected the request secrets to be redacted: %+v", payload)
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, "run-1", archiveManifestName))
+		if err != nil {
+			t.Fatalf("failed to read manifest: %v", err)
+		}
+
+		var manifest archiveManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			t.Fatalf("failed to decode manifest: %v", err)
+		}
+
+		archived, err := os.ReadFile(filepath.Join(dir, "run-1", "000003-candles.json.gz"))
+		if err != nil {
+			t.Fatalf("failed to read archived payload: %v", err)
+		}
+
+		digest := sha256.Sum256(archived)
+		exp := []archiveManifestFile{{
+			Key: "run-1/000003-candles.json.gz", Table: "candles", Batch: 3, Records: 3, Bytes: len(archived),
+			SHA256: hex.EncodeToString(digest[:]),
+		}}
+
+		if manifest.RunID != "run-1" || manifest.Records != 3 || !reflect.DeepEqual(manifest.Files, exp) {
+			t.Fatalf("unexpected manifest: %+v", manifest)
+		}
+
+		schema := map[string]string{"id": "number", "name": "mixed"}
+		if !reflect.DeepEqual(manifest.Schema["candles"], schema) {
+			t.Fatalf("expected schema %v, got %v", schema, manifest.Schema)
+		}
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		t.Parallel()
+
+		store := blockingObjectStore{release: make(chan struct{})}
+		arc := &archiver{store: store, runID: "run-1", writes: make(chan struct{}, 1)}
+
+		var done int32
+
+		arc.archive(ctx, jc, req, []byte(`[]`), func() { atomic.AddInt32(&done, 1) })
+
+		second := make(chan struct{})
+
+		go func() {
+			defer close(second)
+
+			arc.archive(ctx, jobContext{runID: "run-1", batch: 4, table: "candles"}, req, []byte(`[]`),
+				func() { atomic.AddInt32(&done, 1) })
+		}()
+
+		select {
+		case <-second:
+			t.Fatalf("expected the second payload to wait for the first to be written")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if atomic.LoadInt32(&done) != 0 {
+			t.Fatalf("expected the payload to be held until it is written")
+		}
+
+		close(store.release)
+		<-second
+
+		if err := arc.wait(ctx); err != nil || atomic.LoadInt32(&done) != 2 {
+			t.Fatalf("expected both payloads to be written and released, got %d: %v", done, err)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+
+		arc := &archiver{store: failingObjectStore{}, writes: make(chan struct{}, 1)}
+		arc.archive(ctx, jc, req, []byte(`[]`), func() {})
+
+		if err := arc.wait(ctx); !errors.Is(err, ErrArchiving) {
+			t.Fatalf("expected archiving error, got %v", err)
+		}
+	})
+
+	t.Run("partitioned", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+		archive := &Archive{Location: "file://" + filepath.ToSlash(dir), PartitionBy: []string{"table", "date"}}
+
+		arc, err := newArchiver(&Config{RunID: "run-1", Archive: archive})
+		if err != nil {
+			t.Fatalf("failed to create archiver: %v", err)
+		}
+
+		arc.archive(ctx, jc, req, []byte(`[]`), func() {})
+
+		if err := arc.wait(ctx); err != nil {
+			t.Fatalf("failed to archive payload: %v", err)
+		}
+
+		store, err := storage.NewObjectStore(archive.Location)
+		if err != nil {
+			t.Fatalf("failed to create object store: %v", err)
+		}
+
+		keys, err := store.List(ctx)
+		if err != nil {
+			t.Fatalf("failed to list archive: %v", err)
+		}
+
+		payloadKey := regexp.MustCompile(`^table=candles/date=\d{4}-\d{2}-\d{2}/run-1-000003-candles\.json\.gz$`)
+		if len(keys) != 2 || keys[0] != "_manifests/run-1/_manifest.json" || !payloadKey.MatchString(keys[1]) {
+			t.Fatalf("expected the manifest and the partitioned payload, got %v", keys)
+		}
+	})
+
+	t.Run("invalid partition", func(t *testing.T) {
+		t.Parallel()
+
+		for _, partitionBy := range [][]string{{"month"}, {"table", "table"}} {
+			archive := &Archive{Location: "file:///tmp/archive", PartitionBy: partitionBy}
+			if err := archive.validate(); !errors.Is(err, ErrInvalidArchivePartition) {
+				t.Fatalf("expected invalid archive partition error for %v, got %v", partitionBy, err)
+			}
+		}
+	})
+
+	t.Run("invalid concurrency", func(t *testing.T) {
+		t.Parallel()
+
+		archive := &Archive{Location: "file:///tmp/archive", Concurrency: -1}
+		if err := archive.validate(); !errors.Is(err, ErrInvalidArchiveConcurrency) {
+			t.Fatalf("expected invalid archive concurrency error, got %v", err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+
+		arc, err := newArchiver(&Config{})
+		if err != nil || arc != nil {
+			t.Fatalf("expected no archiver, got %v: %v", arc, err)
+		}
+
+		arc.archive(ctx, jc, req, nil, func() {})
+
+		if err := arc.wait(ctx); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,206 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// windowSeparator separates the start and end of a window, e.g. "2023-01-01..2023-02-01".
+const windowSeparator = ".."
+
+var (
+	ErrInvalidAsOf   = fmt.Errorf("invalid as-of time")
+	ErrInvalidWindow = fmt.Errorf("invalid window")
+)
+
+// InvalidWindowError is returned when a window can not be parsed.
+func InvalidWindowError(window string) error {
+	return fmt.Errorf("%w: %q, expected <start>..<end>", ErrInvalidWindow, window)
+}
+
+// runTimeLayouts are the layouts accepted for the "--as-of" and "--window" flags.
+var runTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"}
+
+// Window is a historical time range for a run.
+type Window struct {
+	Start time.Time
+	End   time.Time
+}
+
+// ParseRunTime will parse a date or RFC3339 timestamp given on the command line.
+func ParseRunTime(str string) (time.Time, error) {
+	for _, layout := range runTimeLayouts {
+		if tme, err := time.Parse(layout, str); err == nil {
+			return tme.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%w: %q", ErrInvalidAsOf, str)
+}
+
+// ParseWindow will parse a window of the form "<start>..<end>", e.g. "2023-01-01..2023-02-01".
+func ParseWindow(str string) (*Window, error) {
+	parts := strings.Split(str, windowSeparator)
+	if len(parts) != 2 {
+		return nil, InvalidWindowError(str)
+	}
+
+	start, err := ParseRunTime(parts[0])
+	if err != nil {
+		return nil, InvalidWindowError(str)
+	}
+
+	end, err := ParseRunTime(parts[1])
+	if err != nil {
+		return nil, InvalidWindowError(str)
+	}
+
+	if !start.Before(end) {
+		return nil, InvalidWindowError(str)
+	}
+
+	return &Window{Start: start, End: end}, nil
+}
+
+// runTimeData is the data exposed to the request endpoint and query templates.
+type runTimeData struct {
+	// AsOf is the as-of time of the run, which defaults to the current time.
+	AsOf time.Time
+
+	// WindowStart and WindowEnd are the window of the run. If no window is set, they are both the as-of time.
+	WindowStart time.Time
+	WindowEnd   time.Time
+
+	// Start and End are the range of a timeseries chunk, for the query values of timeseries requests that are
+	// rendered for each chunk, e.g. to filter on the range in a query language such as JQL.
+	Start time.Time
+	End   time.Time
+}
+
+// chunkTemplatePattern matches the template fields of the range of a timeseries chunk.
+var chunkTemplatePattern = regexp.MustCompile(`\.(Start|End)\b`)
+
+// isChunkTemplate will return true if the string is a template that references the range of a timeseries chunk.
+func isChunkTemplate(str string) bool {
+	return strings.Contains(str, "{{") && chunkTemplatePattern.MatchString(str)
+}
+
+// runTimeData will return the template data for the configuration.
+func (cfg *Config) runTimeData() runTimeData {
+	asOf := time.Now().UTC()
+	if cfg.AsOf != nil {
+		asOf = *cfg.AsOf
+	}
+
+	data := runTimeData{AsOf: asOf, WindowStart: asOf, WindowEnd: asOf}
+	if cfg.Window != nil {
+		data.WindowStart, data.WindowEnd = cfg.Window.Start, cfg.Window.End
+	}
+
+	return data
+}
+
+// renderTemplate will execute the string as a template if it contains template actions.
+func renderTemplate(name, str string, data runTimeData) (string, error) {
+	if !strings.Contains(str, "{{") {
+		return str, nil
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(str)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse %s template: %w", name, err)
+	}
+
+	var bldr strings.Builder
+	if err := tmpl.Execute(&bldr, data); err != nil {
+		return "", fmt.Errorf("unable to execute %s template: %w", name, err)
+	}
+
+	return bldr.String(), nil
+}
+
+// applyRunTime will return a copy of the request with the endpoint and query templates rendered and the as-of time and
+// window of the run applied to the timeseries range. A window replaces the timeseries range, and the end of the range
+// is never after the as-of time. The templates of the request are left as configured, so that they are rendered again
+// by the next run, and so that the request is identified by its templates rather than its rendered values. The copy
+// has its own timeseries, which holds the state of the run, so that the configured timeseries is not changed.
+func (req *Request) applyRunTime(cfg *Config) (*Request, error) {
+	data := cfg.runTimeData()
+
+	rendered := *req
+	rendered.Query = make(map[string]string, len(req.Query))
+	rendered.id = req.requestID()
+
+	var err error
+	if rendered.Endpoint, err = renderTemplate("endpoint", req.Endpoint, data); err != nil {
+		return nil, err
+	}
+
+	ts := req.Timeseries
+	if ts != nil {
+		runTS := *ts
+		runTS.templates = nil
+		ts, rendered.Timeseries = &runTS, &runTS
+	}
+
+	for key, value := range req.Query {
+		// The query values that reference the range of a chunk are rendered when the request is chunked.
+		if ts != nil && isChunkTemplate(value) {
+			if ts.templates == nil {
+				ts.templates = make(map[string]string)
+			}
+
+			ts.templates[key] = value
+			rendered.Query[key] = value
+
+			continue
+		}
+
+		if rendered.Query[key], err = renderTemplate(key, value, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if ts == nil {
+		if req.Query == nil {
+			rendered.Query = nil
+		}
+
+		return &rendered, nil
+	}
+
+	ts.runTime = data
+
+	if ts.Layout == nil {
+		str := time.RFC3339
+		ts.Layout = &str
+	}
+
+	if cfg.Window != nil {
+		rendered.Query[ts.StartName] = cfg.Window.Start.Format(*ts.Layout)
+		if ts.EndName != "" {
+			rendered.Query[ts.EndName] = cfg.Window.End.Format(*ts.Layout)
+		}
+
+		ts.backfill = true
+	}
+
+	if cfg.AsOf != nil && ts.EndName != "" {
+		end, err := time.Parse(*ts.Layout, rendered.Query[ts.EndName])
+		if err != nil || end.After(*cfg.AsOf) {
+			rendered.Query[ts.EndName] = cfg.AsOf.Format(*ts.Layout)
+		}
+	}
+
+	return &rendered, nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestAsOf(t *testing.T) {
+	t.Parallel()
+
+	t.Run("parse window", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tcase := range []struct {
+			window string
+			err    error
+			start  time.Time
+			end    time.Time
+		}{
+			{
+				window: "2023-01-01..2023-02-01",
+				start:  time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+				end:    time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC),
+			},
+			{
+				window: "2023-01-01T12:00:00Z..2023-01-02",
+				start:  time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC),
+				end:    time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC),
+			},
+			{window: "2023-01-01", err: ErrInvalidWindow},
+			{window: "2023-02-01..2023-01-01", err: ErrInvalidWindow},
+			{window: "2023-01-01..tomorrow", err: ErrInvalidWindow},
+		} {
+			window, err := ParseWindow(tcase.window)
+			if !errors.Is(err, tcase.err) {
+				t.Fatalf("expected error %v, got %v", tcase.err, err)
+			}
+
+			if tcase.err != nil {
+				continue
+			}
+
+			if !window.Start.Equal(tcase.start) || !window.End.Equal(tcase.end) {
+				t.Fatalf("unexpected window for %q: %v..%v", tcase.window, window.Start, window.End)
+			}
+		}
+	})
+
+	t.Run("window replaces the timeseries range", func(t *testing.T) {
+		t.Parallel()
+
+		window, err := ParseWindow("2023-01-01..2023-02-01")
+		if err != nil {
+			t.Fatalf("error parsing window: %v", err)
+		}
+
+		lookback := int32(3600)
+		req := &Request{
+			Endpoint: "/candles",
+			Query: map[string]string{
+				"start": "2022-05-10T00:00:00Z",
+				"end":   "2022-05-11T00:00:00Z",
+				"label": `{{ .WindowStart.Format "2006-01" }}`,
+			},
+			Timeseries: &timeseries{StartName: "start", EndName: "end", Lookback: &lookback},
+		}
+
+		watermarkID := req.watermarkID()
+
+		rendered, err := req.applyRunTime(&Config{Window: window})
+		if err != nil {
+			t.Fatalf("error applying window: %v", err)
+		}
+
+		if rendered.Query["start"] != "2023-01-01T00:00:00Z" || rendered.Query["end"] != "2023-02-01T00:00:00Z" {
+			t.Fatalf("unexpected range: %v", rendered.Query)
+		}
+
+		if rendered.Query["label"] != "2023-01" {
+			t.Fatalf("unexpected template value: %q", rendered.Query["label"])
+		}
+
+		if req.Query["label"] != `{{ .WindowStart.Format "2006-01" }}` || req.Query["start"] != "2022-05-10T00:00:00Z" {
+			t.Fatalf("expected the request templates to be unchanged, got %v", req.Query)
+		}
+
+		if req.watermarkID() != watermarkID {
+			t.Fatalf("expected the watermark id to be unchanged, got %q", req.watermarkID())
+		}
+
+		if !rendered.Timeseries.backfill || req.Timeseries.backfill {
+			t.Fatalf("expected only the timeseries of the run to be a backfill")
+		}
+	})
+
+	t.Run("as-of caps the end of the timeseries range", func(t *testing.T) {
+		t.Parallel()
+
+		asOf := time.Date(2022, 5, 10, 12, 0, 0, 0, time.UTC)
+		req := &Request{
+			Endpoint: `/history/{{ .AsOf.Format "2006-01-02" }}`,
+			Query: map[string]string{
+				"start": "2022-05-10T00:00:00Z",
+				"end":   "2022-05-11T00:00:00Z",
+			},
+			Timeseries: &timeseries{StartName: "start", EndName: "end"},
+		}
+
+		rendered, err := req.applyRunTime(&Config{AsOf: &asOf})
+		if err != nil {
+			t.Fatalf("error applying as-of: %v", err)
+		}
+
+		if rendered.Endpoint != "/history/2022-05-10" {
+			t.Fatalf("unexpected endpoint: %q", rendered.Endpoint)
+		}
+
+		if rendered.Query["start"] != "2022-05-10T00:00:00Z" || rendered.Query["end"] != "2022-05-10T12:00:00Z" {
+			t.Fatalf("unexpected range: %v", rendered.Query)
+		}
+
+		if req.Endpoint != `/history/{{ .AsOf.Format "2006-01-02" }}` || req.Query["end"] != "2022-05-11T00:00:00Z" {
+			t.Fatalf("expected the request templates to be unchanged, got %q %v", req.Endpoint, req.Query)
+		}
+	})
+
+	t.Run("invalid template", func(t *testing.T) {
+		t.Parallel()
+
+		req := &Request{Endpoint: "/candles", Query: map[string]string{"date": "{{ .Tomorrow }}"}}
+		if _, err := req.applyRunTime(&Config{}); err == nil {
+			t.Fatalf("expected template error")
+		}
+	})
+	t.Run("a configuration runs again with a different as-of time", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			mtx  sync.Mutex
+			ends []string
+		)
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			mtx.Lock()
+			ends = append(ends, req.URL.Query().Get("end"))
+			mtx.Unlock()
+
+			_, _ = rw.Write([]byte(`[{"id": 1}]`))
+		}))
+		t.Cleanup(server.Close)
+
+		cfg, err := NewConfig([]byte(`
+url: ` + server.URL + `
+connectionStrings:
+  - file://` + filepath.ToSlash(t.TempDir()) + `?format=jsonl
+rateLimit:
+  burst: 5
+  period: 1
+requests:
+  - endpoint: /candles
+    table: candles
+    query:
+      start: "2022-05-10T00:00:00Z"
+      end: "2022-05-11T00:00:00Z"
+      day: '{{ .Start.Format "2006-01-02" }}'
+    timeseries:
+      startName: start
+      endName: end
+      period: 86400
+`))
+		if err != nil {
+			t.Fatalf("error creating config: %v", err)
+		}
+
+		cfg.Logger = logrus.New()
+		cfg.Logger.SetLevel(logrus.FatalLevel)
+
+		configured := *cfg.Requests[0].Timeseries
+
+		for _, hour := range []int{6, 12} {
+			asOf := time.Date(2022, 5, 10, hour, 0, 0, 0, time.UTC)
+			cfg.AsOf = &asOf
+
+			if _, err := Upsert(context.Background(), cfg); err != nil {
+				t.Fatalf("error upserting: %v", err)
+			}
+		}
+
+		exp := []string{"2022-05-10T06:00:00Z", "2022-05-10T12:00:00Z"}
+		if !reflect.DeepEqual(ends, exp) {
+			t.Fatalf("expected the ends %v, got %v", exp, ends)
+		}
+
+		if !reflect.DeepEqual(*cfg.Requests[0].Timeseries, configured) {
+			t.Fatalf("expected the configured timeseries to be unchanged, got %+v", *cfg.Requests[0].Timeseries)
+		}
+	})
+}
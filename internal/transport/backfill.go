@@ -0,0 +1,324 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/repository"
+	"github.com/alpine-hodler/gidari/tools"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var (
+	ErrBackfillTruncate = fmt.Errorf("backfill can not truncate tables")
+	ErrSharedCoverage   = fmt.Errorf("backfill coverage can not tell apart the requests of the table")
+)
+
+// SharedCoverageError is returned when the backfill requests of a table have no query parameters that are fields of
+// the records, so the coverage of each request can not be read.
+func SharedCoverageError(table string) error {
+	return fmt.Errorf("%w: %s", ErrSharedCoverage, table)
+}
+
+// coverage is the existing time coverage of a request in storage, i.e. the sorted times of the sampled records on the
+// configured time column.
+type coverage struct {
+	times []time.Time
+}
+
+// parseRecordTime will parse the timestamp of a record. Numbers are unix seconds, and strings are parsed using the
+// layout or RFC3339, which is how storage encodes timestamp columns.
+func parseRecordTime(val interface{}, layout string) (time.Time, bool) {
+	switch val := val.(type) {
+	case float64:
+		return time.Unix(int64(val), 0).UTC(), true
+	case string:
+		for _, layout := range []string{layout, time.RFC3339Nano} {
+			if tme, err := time.Parse(layout, val); err == nil {
+				return tme.UTC(), true
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// newCoverage will return the coverage of the records on the time field.
+func newCoverage(records []map[string]interface{}, timeField, layout string) *coverage {
+	cov := &coverage{times: make([]time.Time, 0, len(records))}
+
+	for _, record := range records {
+		if tme, ok := parseRecordTime(record[timeField], layout); ok {
+			cov.times = append(cov.times, tme)
+		}
+	}
+
+	sort.Slice(cov.times, func(i, j int) bool { return cov.times[i].Before(cov.times[j]) })
+
+	return cov
+}
+
+// covers will return true if there is a record in the time range [start, end).
+func (cov *coverage) covers(start, end time.Time) bool {
+	idx := sort.Search(len(cov.times), func(i int) bool { return !cov.times[i].Before(start) })
+
+	return idx < len(cov.times) && cov.times[idx].Before(end)
+}
+
+// String will return the minimum and maximum time of the coverage.
+func (cov *coverage) String() string {
+	if len(cov.times) == 0 {
+		return "no records"
+	}
+
+	return fmt.Sprintf("%s..%s", cov.times[0].Format(time.RFC3339), cov.times[len(cov.times)-1].Format(time.RFC3339))
+}
+
+// gaps will return the chunks that do not contain any records in storage.
+func (ts *timeseries) gaps() [][2]time.Time {
+	var gaps [][2]time.Time
+
+	for _, chunk := range ts.chunks {
+		if !ts.coverage.covers(chunk[0], chunk[1]) {
+			gaps = append(gaps, chunk)
+		}
+	}
+
+	return gaps
+}
+
+// coverageRead will read the first record of the request table after the time on the time field, or the first
+// record of the table if "after" is nil, with the required fields.
+func coverageRead(ctx context.Context, stg storage.Storage, req *Request, required map[string]interface{},
+	after interface{},
+) (map[string]interface{}, error) {
+	opts := map[string]interface{}{
+		storage.ReadOrderByOption: []interface{}{req.Timeseries.TimeField},
+		storage.ReadLimitOption:   1,
+	}
+
+	if after != nil {
+		opts[storage.ReadAfterOption] = []interface{}{after}
+	}
+
+	readReq := &proto.ReadRequest{Table: req.Table}
+
+	var err error
+	if readReq.Options, err = structpb.NewStruct(opts); err != nil {
+		return nil, fmt.Errorf("unable to build coverage request: %w", err)
+	}
+
+	if len(required) > 0 {
+		if readReq.Required, err = structpb.NewStruct(required); err != nil {
+			return nil, fmt.Errorf("unable to build coverage request: %w", err)
+		}
+	}
+
+	rsp, err := stg.Read(ctx, readReq)
+	if err != nil {
+		return nil, WrapRepositoryError(fmt.Errorf("unable to read coverage for %q: %w", req.Table, err))
+	}
+
+	if len(rsp.GetRecords()) == 0 {
+		return nil, nil
+	}
+
+	return rsp.GetRecords()[0].AsMap(), nil
+}
+
+// coverageFields will return the query parameters of the request that are fields of the record, other than the
+// timeseries range, with the type of the field on the record. These tell apart the records of the requests that
+// share a table, e.g. a "product_id" parameter.
+func coverageFields(req *Request, record map[string]interface{}) map[string]interface{} {
+	required := make(map[string]interface{})
+
+	for key, value := range req.Query {
+		field, ok := record[key]
+		if !ok || key == req.Timeseries.StartName || key == req.Timeseries.EndName || strings.Contains(value, "{{") {
+			continue
+		}
+
+		required[key] = value
+
+		switch field.(type) {
+		case float64:
+			if flt, err := strconv.ParseFloat(value, 64); err == nil {
+				required[key] = flt
+			}
+		case bool:
+			if bln, err := strconv.ParseBool(value); err == nil {
+				required[key] = bln
+			}
+		}
+	}
+
+	return required
+}
+
+// coverageCursor will return the value of the time field that sorts just before the time, in the representation of
+// the stored value: unix seconds for numbers, and the layout, or RFC3339, for strings.
+func coverageCursor(stored interface{}, tme time.Time, layout string) interface{} {
+	if _, ok := stored.(float64); ok {
+		return float64(tme.Unix())
+	}
+
+	if str, ok := stored.(string); ok {
+		if _, err := time.Parse(layout, str); err == nil {
+			return tme.Format(layout)
+		}
+	}
+
+	return tme.Format(time.RFC3339)
+}
+
+// readCoverage will read the coverage of the request without reading every record of the table. The records are
+// sampled in time order, skipping ahead by the timeseries period after each sample, so there is a read for each
+// period with records, and a chunk is covered if it has a sample. Records of requests that share the table are told
+// apart by "coverageFields". A chunk that is not sampled is fetched again, which upserts the same records.
+func readCoverage(ctx context.Context, stg storage.Storage, req *Request, shared bool) (*coverage, error) {
+	ts := req.Timeseries
+	cov := new(coverage)
+
+	first, err := coverageRead(ctx, stg, req, nil, nil)
+	if err != nil || first == nil {
+		return cov, err
+	}
+
+	required := coverageFields(req, first)
+	if shared && len(required) == 0 {
+		return nil, SharedCoverageError(req.Table)
+	}
+
+	step := time.Duration(ts.Period) * time.Second
+	if step < time.Second {
+		step = time.Second
+	}
+
+	var after interface{}
+
+	for {
+		record, err := coverageRead(ctx, stg, req, required, after)
+		if err != nil {
+			return nil, err
+		}
+
+		if record == nil {
+			return cov, nil
+		}
+
+		tme, ok := parseRecordTime(record[ts.TimeField], *ts.Layout)
+
+		// Sampling stops if the time is not moving forward, e.g. for values that do not sort by time, and the rest
+		// of the range is fetched.
+		if !ok || (len(cov.times) > 0 && !tme.After(cov.times[len(cov.times)-1])) {
+			return cov, nil
+		}
+
+		cov.times = append(cov.times, tme)
+		after = coverageCursor(record[ts.TimeField], tme.Add(step-time.Second), *ts.Layout)
+	}
+}
+
+// loadCoverage will read the existing time coverage of every backfill request from the read replica, or the first
+// connection string.
+func loadCoverage(ctx context.Context, cfg *Config) error {
+	if cfg.readDNS() == "" {
+		return nil
+	}
+
+	repo, err := repository.New(ctx, cfg.readDNS())
+	if err != nil {
+		return WrapRepositoryError(repository.FailedToCreateRepositoryError(err))
+	}
+
+	defer repo.Close()
+
+	tables := make(map[string]int)
+	for _, req := range cfg.Requests {
+		tables[req.Table]++
+	}
+
+	for _, req := range cfg.Requests {
+		ts := req.Timeseries
+		if ts.Layout == nil {
+			str := time.RFC3339
+			ts.Layout = &str
+		}
+
+		if ts.coverage, err = readCoverage(ctx, cfg.Timeouts.wrap(repo), req, tables[req.Table] > 1); err != nil {
+			return err
+		}
+
+		ts.backfill = true
+
+		msg := fmt.Sprintf("coverage for %s: %s", req.watermarkID(), ts.coverage)
+		cfg.Logger.Info(tools.LogFormatter{Msg: msg}.String())
+	}
+
+	return nil
+}
+
+// Backfill will upsert only the timeseries chunks that are missing from storage. The existing coverage of each
+// timeseries request is read from the read replica, or the first connection string, using "timeseries.timeField",
+// and chunks without any records in storage are fetched. Requests that are not timeseries are skipped.
+func Backfill(ctx context.Context, cfg *Config) (*RunSummary, error) {
+	if cfg.Truncate {
+		return nil, ErrBackfillTruncate
+	}
+
+	bcfg := *cfg
+	bcfg.Requests = nil
+
+	for _, req := range cfg.Requests {
+		if req.Timeseries == nil {
+			continue
+		}
+
+		if req.Timeseries.TimeField == "" {
+			return nil, MissingTimeseriesFieldError("timeField")
+		}
+
+		// The request and its timeseries are copied, so that the coverage and the backfill flag are not kept on the
+		// configuration, which can be run again.
+		breq := *req
+		bts := *req.Timeseries
+		breq.Timeseries = &bts
+
+		bcfg.Requests = append(bcfg.Requests, &breq)
+	}
+
+	if len(bcfg.Requests) == 0 {
+		return nil, ErrNoRequests
+	}
+
+	if err := loadCoverage(ctx, &bcfg); err != nil {
+		return nil, cfg.useRedactor().RedactError(err)
+	}
+
+	summary, err := Upsert(ctx, &bcfg)
+	if errors.Is(err, ErrNoRequests) {
+		cfg.Logger.Info(tools.LogFormatter{Msg: "no gaps to backfill"}.String())
+
+		if summary != nil {
+			summary.Error = ""
+		}
+
+		return summary, nil
+	}
+
+	return summary, err
+}
@@ -0,0 +1,271 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// countingStorage is a storage device that counts its reads.
+type countingStorage struct {
+	storage.Storage
+
+	reads int
+}
+
+func (stg *countingStorage) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	stg.reads++
+
+	return stg.Storage.Read(ctx, req)
+}
+
+func TestBackfill(t *testing.T) {
+	t.Parallel()
+
+	t.Run("coverage", func(t *testing.T) {
+		t.Parallel()
+
+		cov := newCoverage([]map[string]interface{}{
+			{"time": "2022-05-10T05:00:00.5Z"},
+			{"time": "2022-05-10T01:00:00Z"},
+			{"time": float64(time.Date(2022, 5, 10, 3, 0, 0, 0, time.UTC).Unix())},
+			{"time": "yesterday"},
+			{"other": "2022-05-10T02:00:00Z"},
+		}, "time", time.RFC3339)
+
+		if len(cov.times) != 3 {
+			t.Fatalf("expected 3 times, got %d", len(cov.times))
+		}
+
+		if exp := "2022-05-10T01:00:00Z..2022-05-10T05:00:00Z"; cov.String() != exp {
+			t.Fatalf("expected coverage %q, got %q", exp, cov.String())
+		}
+
+		for _, tcase := range []struct {
+			start, end int
+			covers     bool
+		}{
+			{0, 1, false},
+			{0, 2, true},
+			{1, 2, true},
+			{2, 3, false},
+			{3, 4, true},
+			{6, 8, false},
+		} {
+			start := time.Date(2022, 5, 10, tcase.start, 0, 0, 0, time.UTC)
+			end := time.Date(2022, 5, 10, tcase.end, 0, 0, 0, time.UTC)
+
+			if covers := cov.covers(start, end); covers != tcase.covers {
+				t.Fatalf("expected %v for %d..%d, got %v", tcase.covers, tcase.start, tcase.end, covers)
+			}
+		}
+	})
+
+	t.Run("only gaps are chunked", func(t *testing.T) {
+		t.Parallel()
+
+		timeseries := &timeseries{
+			StartName: "start",
+			EndName:   "end",
+			Period:    3600,
+			TimeField: "time",
+			coverage: newCoverage([]map[string]interface{}{
+				{"time": "2022-05-10T00:30:00Z"},
+				{"time": "2022-05-10T02:00:00Z"},
+			}, "time", time.RFC3339),
+		}
+
+		testURL, err := url.Parse("https//api.test.com/")
+		if err != nil {
+			t.Fatalf("error parsing url: %v", err)
+		}
+
+		query := testURL.Query()
+		query.Set("start", "2022-05-10T00:00:00Z")
+		query.Set("end", "2022-05-10T04:00:00Z")
+		testURL.RawQuery = query.Encode()
+
+		if err := timeseries.chunk(*testURL); err != nil {
+			t.Fatalf("error setting chunks: %v", err)
+		}
+
+		expChunks := [][2]time.Time{
+			{
+				time.Date(2022, 5, 10, 1, 0, 0, 0, time.UTC),
+				time.Date(2022, 5, 10, 2, 0, 0, 0, time.UTC),
+			},
+			{
+				time.Date(2022, 5, 10, 3, 0, 0, 0, time.UTC),
+				time.Date(2022, 5, 10, 4, 0, 0, 0, time.UTC),
+			},
+		}
+
+		if !reflect.DeepEqual(expChunks, timeseries.chunks) {
+			t.Fatalf("unexpected chunks: %v", timeseries.chunks)
+		}
+	})
+	t.Run("coverage is sampled for each request", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+
+		var lines []string
+		for minute := 0; minute < 4*60; minute += 10 {
+			tme := time.Date(2022, 5, 10, 0, minute, 0, 0, time.UTC).Format(time.RFC3339)
+			lines = append(lines, `{"product_id":"BTC-USD","time":"`+tme+`"}`)
+		}
+
+		lines = append(lines, `{"product_id":"ETH-USD","time":"2022-05-10T06:00:00Z"}`)
+
+		data := []byte(strings.Join(lines, "\n") + "\n")
+		if err := os.WriteFile(filepath.Join(dir, "candles.jsonl"), data, 0o600); err != nil {
+			t.Fatalf("failed to write candles: %v", err)
+		}
+
+		ctx := context.Background()
+
+		repo, err := repository.New(ctx, "file://"+filepath.ToSlash(dir)+"?format=jsonl")
+		if err != nil {
+			t.Fatalf("failed to create repository: %v", err)
+		}
+
+		defer repo.Close()
+
+		layout := time.RFC3339
+		newRequest := func(query map[string]string) *Request {
+			return &Request{Table: "candles", Query: query, Timeseries: &timeseries{
+				StartName: "start", EndName: "end", Period: 3600, TimeField: "time", Layout: &layout,
+			}}
+		}
+
+		stg := &countingStorage{Storage: repo}
+
+		cov, err := readCoverage(ctx, stg, newRequest(map[string]string{"product_id": "ETH-USD", "start": "x"}), true)
+		if err != nil {
+			t.Fatalf("failed to read coverage: %v", err)
+		}
+
+		if exp := "2022-05-10T06:00:00Z..2022-05-10T06:00:00Z"; cov.String() != exp {
+			t.Fatalf("expected coverage %q, got %q", exp, cov.String())
+		}
+
+		stg.reads = 0
+
+		cov, err = readCoverage(ctx, stg, newRequest(map[string]string{"product_id": "BTC-USD"}), true)
+		if err != nil {
+			t.Fatalf("failed to read coverage: %v", err)
+		}
+
+		// The first record, a sample for each hour, and the read past the last sample.
+		if len(cov.times) != 4 || stg.reads != 6 {
+			t.Fatalf("expected 4 samples in 6 reads, got %v in %d reads", cov.times, stg.reads)
+		}
+
+		for hour := 0; hour < 3; hour++ {
+			start := time.Date(2022, 5, 10, hour, 30, 0, 0, time.UTC)
+			if !cov.covers(start, start.Add(time.Hour)) {
+				t.Fatalf("expected the hour from %s to be covered", start)
+			}
+		}
+
+		if _, err := readCoverage(ctx, stg, newRequest(nil), true); !errors.Is(err, ErrSharedCoverage) {
+			t.Fatalf("expected error %v, got %v", ErrSharedCoverage, err)
+		}
+	})
+	t.Run("upsert after backfill fetches the whole range", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			mtx    sync.Mutex
+			starts []string
+		)
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			start := req.URL.Query().Get("start")
+
+			mtx.Lock()
+			starts = append(starts, start)
+			mtx.Unlock()
+
+			_, _ = rw.Write([]byte(`[{"id": "` + start + `", "time": "` + start + `"}]`))
+		}))
+		t.Cleanup(server.Close)
+
+		dir := t.TempDir()
+
+		data := []byte(`{"id":"2022-05-10T00:00:00Z","time":"2022-05-10T00:00:00Z"}` + "\n")
+		if err := os.WriteFile(filepath.Join(dir, "candles.jsonl"), data, 0o600); err != nil {
+			t.Fatalf("failed to write candles: %v", err)
+		}
+
+		cfg, err := NewConfig([]byte(`
+url: ` + server.URL + `
+connectionStrings:
+  - file://` + filepath.ToSlash(dir) + `?format=jsonl
+rateLimit:
+  burst: 5
+  period: 1
+requests:
+  - endpoint: /candles
+    table: candles
+    query:
+      start: "2022-05-10T00:00:00Z"
+      end: "2022-05-10T03:00:00Z"
+    timeseries:
+      startName: start
+      endName: end
+      period: 3600
+      timeField: time
+`))
+		if err != nil {
+			t.Fatalf("error creating config: %v", err)
+		}
+
+		cfg.Logger = logrus.New()
+		cfg.Logger.SetLevel(logrus.FatalLevel)
+
+		ctx := context.Background()
+
+		if _, err := Backfill(ctx, cfg); err != nil {
+			t.Fatalf("failed to backfill: %v", err)
+		}
+
+		expStarts := []string{"2022-05-10T01:00:00Z", "2022-05-10T02:00:00Z"}
+		if sort.Strings(starts); !reflect.DeepEqual(starts, expStarts) {
+			t.Fatalf("expected the backfill to fetch %v, got %v", expStarts, starts)
+		}
+
+		starts = nil
+
+		if _, err := Upsert(ctx, cfg); err != nil {
+			t.Fatalf("failed to upsert: %v", err)
+		}
+
+		expStarts = []string{"2022-05-10T00:00:00Z", "2022-05-10T01:00:00Z", "2022-05-10T02:00:00Z"}
+		if sort.Strings(starts); !reflect.DeepEqual(starts, expStarts) {
+			t.Fatalf("expected the upsert to fetch %v, got %v", expStarts, starts)
+		}
+	})
+}
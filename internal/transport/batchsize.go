@@ -0,0 +1,136 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+var ErrInvalidBatchSize = fmt.Errorf("invalid batch size")
+
+// InvalidBatchSizeError is returned when the batch size is not valid.
+func InvalidBatchSizeError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidBatchSize, reason)
+}
+
+// BatchSize is the maximum size of the upsert batches written to storage. By default, the records of each web
+// response are written to a table in a single batch, which behaves badly when the size of records varies widely, e.g.
+// a batch of large records can exceed the maximum message size of the storage. With a batch size, the records are
+// split into consecutive batches that are within both limits.
+type BatchSize struct {
+	// Records is the maximum number of records in a batch.
+	Records int `yaml:"records"`
+
+	// Bytes is the maximum size of a batch in bytes, measured as the size of the records serialized as a JSON array.
+	// A single record larger than the limit is written in a batch of its own.
+	Bytes int `yaml:"bytes"`
+}
+
+func (bs *BatchSize) validate() error {
+	if bs.Records == 0 && bs.Bytes == 0 {
+		return InvalidBatchSizeError("one of records or bytes is required")
+	}
+
+	if bs.Records < 0 {
+		return InvalidBatchSizeError("records must be positive")
+	}
+
+	if bs.Bytes < 0 {
+		return InvalidBatchSizeError("bytes must be positive")
+	}
+
+	return nil
+}
+
+// full will return true if a batch with the number of records and bytes can not take a record of the size.
+func (bs *BatchSize) full(records, size, recordSize int) bool {
+	if records == 0 {
+		return false
+	}
+
+	if bs.Records > 0 && records+1 > bs.Records {
+		return true
+	}
+
+	// The record is preceded by a comma in the JSON array.
+	return bs.Bytes > 0 && size+1+recordSize > bs.Bytes
+}
+
+// split will split the JSON upsert requests into batches that are within the batch size. The requests are returned
+// unchanged if the batch size is nil.
+func (bs *BatchSize) split(reqs []*proto.UpsertRequest) ([]*proto.UpsertRequest, error) {
+	if bs == nil {
+		return reqs, nil
+	}
+
+	var out []*proto.UpsertRequest
+
+	for _, req := range reqs {
+		if tools.UpsertDataType(req.GetDataType()) != tools.UpsertDataJSON {
+			out = append(out, req)
+
+			continue
+		}
+
+		records, err := decodeJSONRecords(req.GetData())
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			batch bytes.Buffer
+			count int
+		)
+
+		flush := func() {
+			if count == 0 {
+				return
+			}
+
+			batch.WriteByte(']')
+			out = append(out, &proto.UpsertRequest{
+				Table:    req.GetTable(),
+				Data:     append([]byte(nil), batch.Bytes()...),
+				DataType: req.GetDataType(),
+			})
+
+			batch.Reset()
+			count = 0
+		}
+
+		for _, record := range records {
+			data, err := json.Marshal(record)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+			}
+
+			// The size of the batch includes its closing bracket.
+			if bs.full(count, batch.Len()+1, len(data)) {
+				flush()
+			}
+
+			if count == 0 {
+				batch.WriteByte('[')
+			} else {
+				batch.WriteByte(',')
+			}
+
+			batch.Write(data)
+			count++
+		}
+
+		flush()
+	}
+
+	return out, nil
+}
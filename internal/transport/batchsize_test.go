@@ -0,0 +1,94 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+func TestBatchSize(t *testing.T) {
+	t.Parallel()
+
+	data := []byte(`[{"id":1},{"id":2,"note":"a much longer record than the others"},{"id":3},{"id":4}]`)
+
+	for _, tcase := range []struct {
+		name string
+		bs   *BatchSize
+		want []string
+	}{
+		{
+			name: "nil",
+			want: []string{string(data)},
+		},
+		{
+			name: "records",
+			bs:   &BatchSize{Records: 3},
+			want: []string{
+				`[{"id":1},{"id":2,"note":"a much longer record than the others"},{"id":3}]`,
+				`[{"id":4}]`,
+			},
+		},
+		{
+			name: "bytes",
+			bs:   &BatchSize{Bytes: 20},
+			want: []string{
+				`[{"id":1}]`,
+				`[{"id":2,"note":"a much longer record than the others"}]`,
+				`[{"id":3},{"id":4}]`,
+			},
+		},
+		{
+			name: "records and bytes",
+			bs:   &BatchSize{Records: 1, Bytes: 1000},
+			want: []string{
+				`[{"id":1}]`, `[{"id":2,"note":"a much longer record than the others"}]`, `[{"id":3}]`, `[{"id":4}]`,
+			},
+		},
+	} {
+		tcase := tcase
+
+		t.Run(tcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := &proto.UpsertRequest{Table: "notes", Data: data, DataType: int32(tools.UpsertDataJSON)}
+
+			reqs, err := tcase.bs.split([]*proto.UpsertRequest{req})
+			if err != nil {
+				t.Fatalf("failed to split: %v", err)
+			}
+
+			if len(reqs) != len(tcase.want) {
+				t.Fatalf("expected %d batches, got %d", len(tcase.want), len(reqs))
+			}
+
+			for idx, req := range reqs {
+				if string(req.Data) != tcase.want[idx] || req.Table != "notes" {
+					t.Fatalf("expected batch %d to be %s, got %s", idx, tcase.want[idx], req.Data)
+				}
+
+				if tcase.bs != nil && tcase.bs.Bytes > 0 && len(req.Data) > tcase.bs.Bytes && idx != 1 {
+					t.Fatalf("batch %d exceeds %d bytes: %s", idx, tcase.bs.Bytes, req.Data)
+				}
+			}
+		})
+	}
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		for _, bs := range []*BatchSize{{}, {Records: -1}, {Bytes: -1}} {
+			if err := bs.validate(); !errors.Is(err, ErrInvalidBatchSize) {
+				t.Fatalf("expected invalid batch size error for %+v, got %v", bs, err)
+			}
+		}
+	})
+}
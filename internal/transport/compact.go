@@ -0,0 +1,159 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+)
+
+const (
+	// DefaultCompactionTargetSize is the default size in bytes of the objects written by a compaction.
+	DefaultCompactionTargetSize = 128 << 20
+
+	// compactedPrefix is the prefix of the names of the objects written by a compaction.
+	compactedPrefix = "compacted-"
+)
+
+var ErrInvalidCompactionTargetSize = fmt.Errorf("invalid compaction target size")
+
+// InvalidCompactionTargetSizeError is returned when the target size of a compaction is not positive.
+func InvalidCompactionTargetSizeError(size int64) error {
+	return fmt.Errorf("%w: %d, expected a positive number of bytes", ErrInvalidCompactionTargetSize, size)
+}
+
+// Compaction is the merge of archived objects in a partition into a single object.
+type Compaction struct {
+	// Partition is the directory of the objects under the archive location, e.g. "table=candles/date=2023-06-01".
+	Partition string `json:"partition"`
+
+	// Sources are the keys of the merged objects, which are deleted once the compacted object is written.
+	Sources []string `json:"sources"`
+
+	// Key is the key of the compacted object.
+	Key   string `json:"key"`
+	Bytes int    `json:"bytes"`
+}
+
+// compactionGroup is the objects of a partition that are merged into the same compacted object.
+type compactionGroup struct {
+	partition string
+	sources   []string
+	data      []byte
+}
+
+// key will return the key of the compacted object, which is derived from the keys of its sources so that a
+// compaction that is retried after a failure overwrites the object instead of duplicating it.
+func (group *compactionGroup) key() string {
+	digest := sha256.Sum256([]byte(strings.Join(group.sources, "\n")))
+
+	return path.Join(group.partition, compactedPrefix+hex.EncodeToString(digest[:8])+archiveExt)
+}
+
+// Compact will merge the small archived objects within each partition of the archive location into objects of up to
+// the target size, to avoid the small files problem of query engines such as Athena. Objects in the same directory
+// are merged in key order, which is the order they were fetched within a run, by concatenating their gzip streams,
+// so the compacted objects are read by "Reprocess" as the payloads of their sources.
+//
+// Each source is verified against the manifest of its run before it is merged. The compacted object is written
+// before its sources are deleted, so an interrupted compaction can leave both, and the payloads of both are read by a
+// reprocess until the compaction is run again. Manifests are not changed, and list the objects as archived by the
+// run.
+func Compact(ctx context.Context, location string, targetSize int64) ([]*Compaction, error) {
+	if targetSize <= 0 {
+		return nil, InvalidCompactionTargetSizeError(targetSize)
+	}
+
+	store, err := storage.NewObjectStore(location)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create archive store: %w", err)
+	}
+
+	keys, checksums, _, err := archivedKeys(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		compactions []*Compaction
+		group       *compactionGroup
+	)
+
+	// A group of a single object, e.g. an object that is already at the target size, is left as it is.
+	flush := func() error {
+		if group == nil || len(group.sources) < 2 {
+			return nil
+		}
+
+		compaction, err := compact(ctx, store, group)
+		if err != nil {
+			return err
+		}
+
+		compactions = append(compactions, compaction)
+
+		return nil
+	}
+
+	for _, key := range keys {
+		data, err := store.Get(ctx, key)
+		if err != nil {
+			return compactions, fmt.Errorf("unable to read archived payload: %w", err)
+		}
+
+		if err := checksums.verify(key, data); err != nil {
+			return compactions, err
+		}
+
+		partition := path.Dir(key)
+
+		if group == nil || group.partition != partition || int64(len(group.data)+len(data)) > targetSize {
+			if err := flush(); err != nil {
+				return compactions, err
+			}
+
+			group = &compactionGroup{partition: partition}
+		}
+
+		group.sources = append(group.sources, key)
+		group.data = append(group.data, data...)
+	}
+
+	if err := flush(); err != nil {
+		return compactions, err
+	}
+
+	return compactions, nil
+}
+
+// compact will write the compacted object of the group, and then delete its sources.
+func compact(ctx context.Context, store storage.ObjectStore, group *compactionGroup) (*Compaction, error) {
+	key := group.key()
+
+	if err := store.Put(ctx, key, group.data); err != nil {
+		return nil, fmt.Errorf("unable to write compacted object: %w", err)
+	}
+
+	for _, source := range group.sources {
+		if source == key {
+			continue
+		}
+
+		if err := store.Delete(ctx, source); err != nil {
+			return nil, fmt.Errorf("unable to delete compacted object: %w", err)
+		}
+	}
+
+	return &Compaction{Partition: group.partition, Sources: group.sources, Key: key, Bytes: len(group.data)}, nil
+}
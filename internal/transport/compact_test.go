@@ -0,0 +1,125 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCompact(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("merges the payloads of each partition", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+		location := "file://" + filepath.ToSlash(dir)
+
+		archive := &Archive{Location: location, PartitionBy: []string{"table"}}
+
+		arc, err := newArchiver(&Config{RunID: "run-1", Archive: archive})
+		if err != nil {
+			t.Fatalf("failed to create archiver: %v", err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.test.com/candles", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		arc.archive(ctx, jobContext{runID: "run-1", batch: 1, table: "candles"}, req, []byte(`[{"id": 1}]`), func() {})
+		arc.archive(ctx, jobContext{runID: "run-1", batch: 2, table: "candles"}, req, []byte(`[{"id": 2}]`), func() {})
+		arc.archive(ctx, jobContext{runID: "run-1", batch: 3, table: "orders"}, req, []byte(`[{"id": 3}]`), func() {})
+
+		if err := arc.wait(ctx); err != nil {
+			t.Fatalf("failed to archive payloads: %v", err)
+		}
+
+		compactions, err := Compact(ctx, location, DefaultCompactionTargetSize)
+		if err != nil {
+			t.Fatalf("failed to compact: %v", err)
+		}
+
+		sources := []string{"table=candles/run-1-000001-candles.json.gz", "table=candles/run-1-000002-candles.json.gz"}
+		if len(compactions) != 1 || !reflect.DeepEqual(compactions[0].Sources, sources) {
+			t.Fatalf("expected the candles partition to be compacted, got %+v", compactions)
+		}
+
+		store, err := storage.NewObjectStore(location)
+		if err != nil {
+			t.Fatalf("failed to create object store: %v", err)
+		}
+
+		keys, err := store.List(ctx)
+		if err != nil {
+			t.Fatalf("failed to list archive: %v", err)
+		}
+
+		exp := []string{"_manifests/run-1/_manifest.json", compactions[0].Key, "table=orders/run-1-000003-orders.json.gz"}
+		if !reflect.DeepEqual(keys, exp) {
+			t.Fatalf("expected keys %v, got %v", exp, keys)
+		}
+
+		data, err := store.Get(ctx, compactions[0].Key)
+		if err != nil {
+			t.Fatalf("failed to read compacted object: %v", err)
+		}
+
+		payloads, err := decodeArchivedPayloads(data)
+		if err != nil {
+			t.Fatalf("failed to decode compacted object: %v", err)
+		}
+
+		if len(payloads) != 2 || string(payloads[0].Body) != `[{"id": 1}]` || string(payloads[1].Body) != `[{"id": 2}]` {
+			t.Fatalf("expected the payloads of the sources in order, got %+v", payloads)
+		}
+
+		// The compacted payloads are reprocessed like the payloads of their sources.
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+
+		cfg := &Config{
+			Logger:        logger,
+			Requests:      []*Request{{Table: "candles"}, {Table: "orders"}},
+			ReprocessFrom: location,
+		}
+
+		if _, err := Reprocess(ctx, cfg); err != nil {
+			t.Fatalf("failed to reprocess compacted archive: %v", err)
+		}
+	})
+
+	t.Run("objects over the target size are not merged", func(t *testing.T) {
+		t.Parallel()
+
+		location := archivePayloads(t, "candles", `[]`, `[]`)
+
+		compactions, err := Compact(ctx, location, 1)
+		if err != nil || len(compactions) != 0 {
+			t.Fatalf("expected no compactions, got %+v: %v", compactions, err)
+		}
+	})
+
+	t.Run("invalid target size", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := Compact(ctx, "file:///tmp/archive", 0); !errors.Is(err, ErrInvalidCompactionTargetSize) {
+			t.Fatalf("expected invalid compaction target size error, got %v", err)
+		}
+	})
+}
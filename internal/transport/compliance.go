@@ -0,0 +1,59 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"fmt"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+)
+
+var (
+	// ErrInvalidCompliance is returned when the compliance mode is not supported.
+	ErrInvalidCompliance = fmt.Errorf("invalid compliance mode")
+
+	// ErrComplianceConflict is returned when a run starts while runs with a different compliance mode are in
+	// progress in the process.
+	ErrComplianceConflict = compliance.ErrConflict
+)
+
+// InvalidComplianceError is returned when the compliance mode of the configuration is not supported.
+func InvalidComplianceError(mode string) error {
+	return fmt.Errorf("%w: %q, expected %q", ErrInvalidCompliance, mode, compliance.ModeFIPS)
+}
+
+// complianceModules will return the validated cryptographic modules in use, which tests may replace.
+var complianceModules = compliance.Modules
+
+// validateCompliance will return an error unless the compliance mode of the configuration is supported.
+func (cfg *Config) validateCompliance() error {
+	if cfg.Compliance != "" && cfg.Compliance != compliance.ModeFIPS {
+		return InvalidComplianceError(cfg.Compliance)
+	}
+
+	return nil
+}
+
+// applyCompliance will turn the compliance mode of the configuration on or off for a run when it starts, before any
+// connection is opened, and return the function that ends the run. The TLS of database drivers, e.g. PostgreSQL and
+// MongoDB, can not be restricted by gidari, so the mode is refused unless a validated cryptographic module restricts
+// it. Binaries built with the "fips" tag are always in compliance mode.
+func (cfg *Config) applyCompliance() (func(), error) {
+	enable := cfg.Compliance == compliance.ModeFIPS
+	if enable && len(complianceModules()) == 0 {
+		return nil, fmt.Errorf("%w: %q requires a validated cryptographic module, i.e. a build with "+
+			"GOEXPERIMENT=boringcrypto or GODEBUG=fips140=on", ErrInvalidCompliance, cfg.Compliance)
+	}
+
+	release, err := compliance.Acquire(enable)
+	if err != nil {
+		return nil, fmt.Errorf("unable to apply compliance mode: %w", err)
+	}
+
+	return release, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCompliance(t *testing.T) {
+	t.Parallel()
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		modes := map[string]error{"": nil, "fips": nil, "FIPS": ErrInvalidCompliance, "hipaa": ErrInvalidCompliance}
+		for mode, exp := range modes {
+			if err := (&Config{Compliance: mode}).validateCompliance(); !errors.Is(err, exp) {
+				t.Fatalf("expected error %v for mode %q, got %v", exp, mode, err)
+			}
+		}
+	})
+
+	// The "fips" mode is only applied when the test binary has no validated cryptographic module, since it would
+	// restrict the connections of every test in the package.
+	t.Run("refused without a module", func(t *testing.T) {
+		t.Parallel()
+
+		if len(complianceModules()) > 0 {
+			t.Skip("the test binary uses a validated cryptographic module")
+		}
+
+		if _, err := (&Config{Compliance: "fips"}).applyCompliance(); !errors.Is(err, ErrInvalidCompliance) {
+			t.Fatalf("expected error %v, got %v", ErrInvalidCompliance, err)
+		}
+	})
+}
@@ -0,0 +1,240 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/repository"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+const (
+	// DataTestFail is the data test policy that fails the run when an assertion fails.
+	DataTestFail = "fail"
+
+	// DataTestWarn is the data test policy that logs a warning when an assertion fails.
+	DataTestWarn = "warn"
+)
+
+var (
+	ErrInvalidDataTest = fmt.Errorf("invalid data test")
+	ErrDataTest        = fmt.Errorf("data test failed")
+)
+
+// InvalidDataTestError is returned when the data test for a table is not valid.
+func InvalidDataTestError(table, reason string) error {
+	return fmt.Errorf("%w for %q: %s", ErrInvalidDataTest, table, reason)
+}
+
+// DataTestError is returned when the assertions of the data tests with the "fail" policy do not hold.
+func DataTestError(failures []string) error {
+	return fmt.Errorf("%w: %s", ErrDataTest, strings.Join(failures, "; "))
+}
+
+// DataTest is the assertions on a table that are checked against every connection string once the run is committed.
+type DataTest struct {
+	// MinRows is the minimum number of rows of the table, e.g. 1 to assert that the table is not empty.
+	MinRows *int64 `yaml:"minRows"`
+
+	// NotNull are the columns that must not be null. A record without the column is null.
+	NotNull []string `yaml:"notNull"`
+
+	// Unique are the key columns whose values must be unique together.
+	Unique []string `yaml:"unique"`
+
+	// OnFailure is the policy when an assertion does not hold: "fail" (the default) fails the run, and "warn" logs a
+	// warning. Either way, the records of the run are already committed.
+	OnFailure string `yaml:"onFailure"`
+}
+
+func (dt *DataTest) validate(table string) error {
+	if dt.MinRows == nil && len(dt.NotNull) == 0 && len(dt.Unique) == 0 {
+		return InvalidDataTestError(table, "one of minRows, notNull, or unique is required")
+	}
+
+	if dt.MinRows != nil && *dt.MinRows < 0 {
+		return InvalidDataTestError(table, "minRows must not be negative")
+	}
+
+	for _, column := range append(append([]string(nil), dt.NotNull...), dt.Unique...) {
+		if column == "" {
+			return InvalidDataTestError(table, "empty column")
+		}
+	}
+
+	if dt.OnFailure != "" && dt.OnFailure != DataTestFail && dt.OnFailure != DataTestWarn {
+		return InvalidDataTestError(table, fmt.Sprintf("onFailure must be %q or %q, got %q", DataTestFail,
+			DataTestWarn, dt.OnFailure))
+	}
+
+	return nil
+}
+
+func (dt *DataTest) setDefaults() {
+	if dt.OnFailure == "" {
+		dt.OnFailure = DataTestFail
+	}
+}
+
+// DataTestResult is the result of the data test for a table on a connection string.
+type DataTestResult struct {
+	Table string `json:"table"`
+
+	// Destination is the index of the connection string in "Config.ConnectionStrings", and Backend its scheme, e.g.
+	// "postgresql".
+	Destination int    `json:"destination"`
+	Backend     string `json:"backend"`
+
+	// Rows is the number of rows of the table, and Checksum the SHA-256 of the records of the table, encoded as JSON
+	// and sorted, so that tables can be compared between runs.
+	Rows     int64  `json:"rows"`
+	Checksum string `json:"checksum"`
+
+	// Failures are the assertions that do not hold, and OnFailure the policy of the data test.
+	Failures  []string `json:"failures,omitempty"`
+	OnFailure string   `json:"onFailure"`
+}
+
+// check will count and read the records of the table from the storage and return the result of its assertions. The
+// number of rows is counted by the storage, so "minRows" holds for the table even if the storage limits its reads.
+func (dt *DataTest) check(ctx context.Context, stg storage.Storage, table string) (*DataTestResult, error) {
+	count, err := stg.Count(ctx, &proto.CountRequest{Table: table})
+	if err != nil {
+		return nil, fmt.Errorf("unable to count %q: %w", table, err)
+	}
+
+	rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: table})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %q: %w", table, err)
+	}
+
+	result := &DataTestResult{Table: table, Rows: count.GetCount(), OnFailure: dt.OnFailure}
+
+	if dt.MinRows != nil && result.Rows < *dt.MinRows {
+		result.Failures = append(result.Failures, fmt.Sprintf("%d rows, expected at least %d", result.Rows,
+			*dt.MinRows))
+	}
+
+	nulls := make(map[string]int, len(dt.NotNull))
+	keys := make(map[string]int)
+	encoded := make([]string, 0, len(rsp.GetRecords()))
+
+	for _, pbrecord := range rsp.GetRecords() {
+		record := pbrecord.AsMap()
+
+		for _, column := range dt.NotNull {
+			if record[column] == nil {
+				nulls[column]++
+			}
+		}
+
+		if len(dt.Unique) > 0 {
+			key := make([]interface{}, 0, len(dt.Unique))
+			for _, column := range dt.Unique {
+				key = append(key, record[column])
+			}
+
+			data, err := json.Marshal(key)
+			if err != nil {
+				return nil, fmt.Errorf("unable to encode key of %q: %w", table, err)
+			}
+
+			keys[string(data)]++
+		}
+
+		// Maps are encoded with sorted keys, so equal records have the same encoding.
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode record of %q: %w", table, err)
+		}
+
+		encoded = append(encoded, string(data))
+	}
+
+	for _, column := range dt.NotNull {
+		if nulls[column] > 0 {
+			result.Failures = append(result.Failures, fmt.Sprintf("%d null values of %q", nulls[column], column))
+		}
+	}
+
+	duplicates := 0
+
+	for _, count := range keys {
+		if count > 1 {
+			duplicates += count - 1
+		}
+	}
+
+	if duplicates > 0 {
+		result.Failures = append(result.Failures, fmt.Sprintf("%d duplicate values of %v", duplicates, dt.Unique))
+	}
+
+	sort.Strings(encoded)
+
+	digest := sha256.Sum256([]byte(strings.Join(encoded, "\n")))
+	result.Checksum = hex.EncodeToString(digest[:])
+
+	return result, nil
+}
+
+// runDataTests will check the data tests of the configuration against each repository, in the order of the
+// connection strings, and add their results to the summary of the run. Failures of data tests with the "warn" policy
+// are logged, and failures of data tests with the "fail" policy are returned together as an error.
+func (cfg *Config) runDataTests(ctx context.Context, run *runState, repos []repository.Generic) error {
+	if len(cfg.DataTests) == 0 {
+		return nil
+	}
+
+	tables := make([]string, 0, len(cfg.DataTests))
+	for table := range cfg.DataTests {
+		tables = append(tables, table)
+	}
+
+	sort.Strings(tables)
+
+	var failures []string
+
+	for idx, repo := range repos {
+		for _, table := range tables {
+			result, err := cfg.DataTests[table].check(ctx, cfg.Timeouts.wrap(repo), table)
+			if err != nil {
+				return WrapRepositoryError(fmt.Errorf("unable to run data test: %w", err))
+			}
+
+			result.Destination = idx
+			result.Backend = storage.Scheme(repo.Type())
+			run.dataTests = append(run.dataTests, result)
+
+			for _, failure := range result.Failures {
+				msg := fmt.Sprintf("data test of %s on %s (%d): %s", table, result.Backend, idx, failure)
+				if result.OnFailure == DataTestWarn {
+					cfg.Logger.Warn(tools.LogFormatter{Msg: msg}.String())
+
+					continue
+				}
+
+				failures = append(failures, msg)
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return DataTestError(failures)
+	}
+
+	return nil
+}
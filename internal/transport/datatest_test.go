@@ -0,0 +1,136 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// dataTestStorage is a lookup storage device of a type, for the results of data tests.
+type dataTestStorage struct {
+	lookupStorage
+
+	typ uint8
+}
+
+func (stg *dataTestStorage) Type() uint8 { return stg.typ }
+
+func TestDataTest(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	minRows := int64(3)
+
+	candles := []map[string]interface{}{
+		{"product_id": "BTC-USD", "start": "2022-01-01", "open": 1.5},
+		{"product_id": "BTC-USD", "start": "2022-01-01", "open": nil},
+		{"product_id": "ETH-USD", "start": "2022-01-01"},
+	}
+
+	t.Run("check", func(t *testing.T) {
+		t.Parallel()
+
+		dt := &DataTest{MinRows: &minRows, NotNull: []string{"product_id", "open"}, Unique: []string{"product_id", "start"}}
+
+		stg := &lookupStorage{records: candles}
+
+		result, err := dt.check(ctx, stg, "candles")
+		if err != nil {
+			t.Fatalf("failed to check data test: %v", err)
+		}
+
+		if stg.counts != 1 {
+			t.Fatalf("expected the rows to be counted by the storage, got %d counts", stg.counts)
+		}
+
+		exp := []string{`2 null values of "open"`, "1 duplicate values of [product_id start]"}
+		if result.Rows != 3 || !reflect.DeepEqual(result.Failures, exp) {
+			t.Fatalf("expected failures %q for 3 rows, got %q for %d rows", exp, result.Failures, result.Rows)
+		}
+
+		// The checksum does not depend on the order that the records are read in.
+		reversed := []map[string]interface{}{candles[2], candles[1], candles[0]}
+
+		again, err := (&DataTest{MinRows: &minRows}).check(ctx, &lookupStorage{records: reversed}, "candles")
+		if err != nil || again.Checksum != result.Checksum || len(again.Failures) != 0 {
+			t.Fatalf("expected checksum %s without failures, got %+v: %v", result.Checksum, again, err)
+		}
+
+		empty, _ := dt.check(ctx, &lookupStorage{}, "candles")
+		if len(empty.Failures) != 1 || empty.Failures[0] != "0 rows, expected at least 3" {
+			t.Fatalf("expected only the row count to fail, got %q", empty.Failures)
+		}
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		t.Parallel()
+
+		// The storage reads the same records for every table.
+		moreRows := minRows + 1
+
+		cfg := &Config{Logger: logrus.New(), DataTests: map[string]*DataTest{
+			"candles": {NotNull: []string{"open"}, OnFailure: DataTestWarn},
+			"trades":  {MinRows: &moreRows, OnFailure: DataTestFail},
+		}}
+
+		run := &runState{}
+		repos := []repository.Generic{
+			&repository.GenericService{Storage: &dataTestStorage{lookupStorage{records: candles}, storage.SQLiteType}},
+		}
+
+		err := cfg.runDataTests(ctx, run, repos)
+		if !errors.Is(err, ErrDataTest) || strings.Contains(err.Error(), "open") ||
+			!strings.Contains(err.Error(), "data test of trades on sqlite (0): 3 rows, expected at least 4") {
+			t.Fatalf("expected only the failure of the trades data test, got %v", err)
+		}
+
+		if len(run.dataTests) != 2 || run.dataTests[0].Table != "candles" || run.dataTests[0].Backend != "sqlite" ||
+			len(run.dataTests[0].Failures) != 1 {
+			t.Fatalf("expected the results of both data tests, got %+v", run.dataTests)
+		}
+
+		cfg.DataTests["trades"].OnFailure = DataTestWarn
+		if err := cfg.runDataTests(ctx, run, repos); err != nil {
+			t.Fatalf("expected warnings only, got %v", err)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		negative := int64(-1)
+
+		for _, dt := range []*DataTest{
+			{},
+			{MinRows: &negative},
+			{NotNull: []string{""}},
+			{Unique: []string{"id"}, OnFailure: "ignore"},
+		} {
+			if err := dt.validate("candles"); !errors.Is(err, ErrInvalidDataTest) {
+				t.Fatalf("expected error %v for %+v, got %v", ErrInvalidDataTest, dt, err)
+			}
+		}
+
+		dt := &DataTest{Unique: []string{"id"}}
+		if err := dt.validate("candles"); err != nil {
+			t.Fatalf("failed to validate data test: %v", err)
+		}
+
+		if dt.setDefaults(); dt.OnFailure != DataTestFail {
+			t.Fatalf("expected the fail policy by default, got %q", dt.OnFailure)
+		}
+	})
+}
@@ -0,0 +1,451 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+const (
+	// DBTLocal is the mode of dbt runs with a local dbt installation.
+	DBTLocal = "local"
+
+	// DBTCloud is the mode of dbt runs triggered as dbt Cloud jobs.
+	DBTCloud = "cloud"
+
+	// DefaultDBTCommand is the default executable of local dbt runs.
+	DefaultDBTCommand = "dbt"
+
+	// DefaultDBTCloudURL is the default URL of the dbt Cloud API.
+	DefaultDBTCloudURL = "https://cloud.getdbt.com"
+
+	// DefaultDBTTimeout is the default maximum duration of a dbt run.
+	DefaultDBTTimeout = time.Hour
+
+	// DefaultDBTPollInterval is the default interval between the requests for the status of a dbt Cloud run.
+	DefaultDBTPollInterval = 10 * time.Second
+
+	// dbtCloudTokenEnv is the environment variable with the dbt Cloud API token, if the configuration has none.
+	dbtCloudTokenEnv = "DBT_CLOUD_API_TOKEN"
+
+	// dbtRunResults is the path of the results of a local dbt run, relative to the project directory.
+	dbtRunResults = "target/run_results.json"
+
+	// dbtOutputTail is the maximum number of bytes of the output of a failed local dbt run in its error.
+	dbtOutputTail = 2 << 10
+)
+
+// dbtCloudStatus are the statuses of dbt Cloud runs, by their code.
+var dbtCloudStatus = map[int]string{
+	1: "queued", 2: "starting", 3: "running", 10: "success", 20: "error", 30: "cancelled",
+}
+
+var (
+	ErrInvalidDBT = fmt.Errorf("invalid dbt configuration")
+	ErrDBT        = fmt.Errorf("dbt run failed")
+)
+
+// InvalidDBTError is returned when the dbt configuration is invalid.
+func InvalidDBTError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidDBT, reason)
+}
+
+// DBTError is returned when the dbt run after a load fails.
+func DBTError(err error) error {
+	return fmt.Errorf("%w: %v", ErrDBT, err)
+}
+
+// DBT is the configuration for running the dbt models of the loaded tables after each successful run, either with a
+// local dbt installation or as a dbt Cloud job.
+type DBT struct {
+	// Models are the dbt node selectors to run, keyed by table name, e.g. "candles: [stg_candles+]". The models of
+	// the tables that were written by the run are selected together in a single dbt run.
+	Models map[string][]string `yaml:"models"`
+
+	// ProjectDir is the directory of the dbt project of local runs, which run "dbt run --select <models>".
+	ProjectDir string `yaml:"projectDir"`
+
+	// ProfilesDir and Target are the "--profiles-dir" and "--target" of local runs, if set.
+	ProfilesDir string `yaml:"profilesDir"`
+	Target      string `yaml:"target"`
+
+	// Command is the dbt executable of local runs. This field defaults to "dbt".
+	Command string `yaml:"command"`
+
+	// Cloud is the dbt Cloud job to trigger instead of a local run.
+	Cloud *DBTCloudJob `yaml:"cloud"`
+
+	// Timeout is the maximum duration of the dbt run. This field defaults to one hour.
+	Timeout *time.Duration `yaml:"timeout"`
+}
+
+// DBTCloudJob is a dbt Cloud job, which is triggered with the selected models as the override of its steps.
+type DBTCloudJob struct {
+	// URL is the URL of the dbt Cloud API, e.g. of a single tenant instance. This field defaults to
+	// "https://cloud.getdbt.com".
+	URL string `yaml:"url"`
+
+	AccountID int64 `yaml:"accountId"`
+	JobID     int64 `yaml:"jobId"`
+
+	// Token is the API token of the requests, or the token in the "DBT_CLOUD_API_TOKEN" environment variable if
+	// empty.
+	Token string `yaml:"token"`
+
+	// PollInterval is the interval between the requests for the status of the run. This field defaults to ten
+	// seconds.
+	PollInterval *time.Duration `yaml:"pollInterval"`
+}
+
+func (dbt *DBT) validate() error {
+	if len(dbt.Models) == 0 {
+		return MissingConfigFieldError("dbt.models")
+	}
+
+	for table, models := range dbt.Models {
+		for _, model := range models {
+			if strings.TrimSpace(model) == "" {
+				return InvalidDBTError(fmt.Sprintf("empty model for table %q", table))
+			}
+		}
+	}
+
+	if (dbt.ProjectDir == "") == (dbt.Cloud == nil) {
+		return InvalidDBTError("exactly one of projectDir or cloud is required")
+	}
+
+	if dbt.Timeout != nil && *dbt.Timeout <= 0 {
+		return InvalidDBTError("timeout must be positive")
+	}
+
+	if cloud := dbt.Cloud; cloud != nil {
+		if cloud.AccountID <= 0 || cloud.JobID <= 0 {
+			return InvalidDBTError("cloud.accountId and cloud.jobId are required")
+		}
+
+		if cloud.PollInterval != nil && *cloud.PollInterval <= 0 {
+			return InvalidDBTError("cloud.pollInterval must be positive")
+		}
+	}
+
+	return nil
+}
+
+func (dbt *DBT) setDefaults() {
+	if dbt.Command == "" {
+		dbt.Command = DefaultDBTCommand
+	}
+
+	if dbt.Timeout == nil {
+		timeout := DefaultDBTTimeout
+		dbt.Timeout = &timeout
+	}
+
+	if cloud := dbt.Cloud; cloud != nil {
+		if cloud.URL == "" {
+			cloud.URL = DefaultDBTCloudURL
+		}
+
+		if cloud.Token == "" {
+			cloud.Token = os.Getenv(dbtCloudTokenEnv)
+		}
+
+		if cloud.PollInterval == nil {
+			interval := DefaultDBTPollInterval
+			cloud.PollInterval = &interval
+		}
+	}
+}
+
+// selectors will return the selectors of the models of the tables, without duplicates and in order.
+func (dbt *DBT) selectors(tables []string) []string {
+	seen := make(map[string]bool)
+
+	var selectors []string
+
+	for _, table := range tables {
+		for _, model := range dbt.Models[table] {
+			if !seen[model] {
+				seen[model] = true
+				selectors = append(selectors, model)
+			}
+		}
+	}
+
+	sort.Strings(selectors)
+
+	return selectors
+}
+
+// DBTResult is the result of the dbt run after a load.
+type DBTResult struct {
+	// Mode is "local" or "cloud", and Select the selectors of the models that were run.
+	Mode   string   `json:"mode"`
+	Select []string `json:"select"`
+
+	// Status is the status of the run, e.g. "success" or "error".
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+
+	// CloudRunID and CloudRunURL are the ID and the page of dbt Cloud runs.
+	CloudRunID  int64  `json:"cloudRunId,omitempty"`
+	CloudRunURL string `json:"cloudRunUrl,omitempty"`
+
+	// Nodes are the results of the models of local runs, from the "run_results.json" of the project.
+	Nodes []*DBTNodeResult `json:"nodes,omitempty"`
+}
+
+// DBTNodeResult is the result of a node of a local dbt run.
+type DBTNodeResult struct {
+	UniqueID      string  `json:"uniqueId"`
+	Status        string  `json:"status"`
+	ExecutionTime float64 `json:"executionTime"`
+	Message       string  `json:"message,omitempty"`
+}
+
+// loadedTables will return the names of the tables that records were written to, in order.
+func (cfg *repoConfig) loadedTables() []string {
+	var tables []string
+
+	cfg.loaded.Range(func(table, _ interface{}) bool {
+		if name, ok := table.(string); ok {
+			tables = append(tables, name)
+		}
+
+		return true
+	})
+
+	sort.Strings(tables)
+
+	return tables
+}
+
+// runDBT will run the dbt models of the loaded tables and add the result to the summary of the run. If none of the
+// loaded tables have models, dbt is not run.
+func (cfg *Config) runDBT(ctx context.Context, run *runState, tables []string) error {
+	if cfg.DBT == nil {
+		return nil
+	}
+
+	selectors := cfg.DBT.selectors(tables)
+	if len(selectors) == 0 {
+		cfg.Logger.Info(tools.LogFormatter{Msg: "no dbt models for the loaded tables"}.String())
+
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *cfg.DBT.Timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	var (
+		result *DBTResult
+		err    error
+	)
+
+	if cfg.DBT.Cloud != nil {
+		result, err = cfg.DBT.Cloud.run(ctx, cfg.RunID, selectors)
+	} else {
+		result, err = cfg.DBT.runLocal(ctx, selectors)
+	}
+
+	result.Duration = time.Since(start)
+	run.dbt = result
+
+	if err != nil {
+		result.Error = err.Error()
+
+		return DBTError(err)
+	}
+
+	msg := fmt.Sprintf("dbt %s run of %v completed: %s", result.Mode, selectors, result.Status)
+	cfg.Logger.Info(tools.LogFormatter{Duration: result.Duration, Msg: msg}.String())
+
+	return nil
+}
+
+// runLocal will run "dbt run" for the selectors in the project directory, and read the results of its nodes.
+func (dbt *DBT) runLocal(ctx context.Context, selectors []string) (*DBTResult, error) {
+	result := &DBTResult{Mode: DBTLocal, Select: selectors}
+
+	args := append([]string{"run", "--select"}, selectors...)
+	args = append(args, "--project-dir", dbt.ProjectDir)
+
+	if dbt.ProfilesDir != "" {
+		args = append(args, "--profiles-dir", dbt.ProfilesDir)
+	}
+
+	if dbt.Target != "" {
+		args = append(args, "--target", dbt.Target)
+	}
+
+	var output bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, dbt.Command, args...)
+	cmd.Dir = dbt.ProjectDir
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	runErr := cmd.Run()
+
+	// The results are written for runs with failed models too, so they are read regardless of the exit status.
+	if data, err := os.ReadFile(filepath.Join(dbt.ProjectDir, dbtRunResults)); err == nil {
+		var results struct {
+			Results []struct {
+				UniqueID      string  `json:"unique_id"`
+				Status        string  `json:"status"`
+				ExecutionTime float64 `json:"execution_time"`
+				Message       string  `json:"message"`
+			} `json:"results"`
+		}
+
+		if err := json.Unmarshal(data, &results); err == nil {
+			for _, node := range results.Results {
+				result.Nodes = append(result.Nodes, &DBTNodeResult{
+					UniqueID:      node.UniqueID,
+					Status:        node.Status,
+					ExecutionTime: node.ExecutionTime,
+					Message:       node.Message,
+				})
+			}
+		}
+	}
+
+	if runErr != nil {
+		result.Status = "error"
+
+		tail := bytes.TrimSpace(output.Bytes())
+		if len(tail) > dbtOutputTail {
+			tail = tail[len(tail)-dbtOutputTail:]
+		}
+
+		return result, fmt.Errorf("%s %s: %w: %s", dbt.Command, strings.Join(args, " "), runErr, tail)
+	}
+
+	result.Status = "success"
+
+	return result, nil
+}
+
+// dbtCloudRun is the run of a dbt Cloud job in the responses of the API.
+type dbtCloudRun struct {
+	Data struct {
+		ID         int64  `json:"id"`
+		Status     int    `json:"status"`
+		IsComplete bool   `json:"is_complete"`
+		Href       string `json:"href"`
+	} `json:"data"`
+}
+
+// run will trigger the job with a "dbt run" of the selectors as its steps, and wait for the run to complete.
+func (job *DBTCloudJob) run(ctx context.Context, runID string, selectors []string) (*DBTResult, error) {
+	result := &DBTResult{Mode: DBTCloud, Select: selectors}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"cause":          "gidari run " + runID,
+		"steps_override": []string{"dbt run --select " + strings.Join(selectors, " ")},
+	})
+	if err != nil {
+		return result, fmt.Errorf("unable to encode job request: %w", err)
+	}
+
+	var run dbtCloudRun
+
+	path := fmt.Sprintf("/api/v2/accounts/%d/jobs/%d/run/", job.AccountID, job.JobID)
+	if err := job.call(ctx, http.MethodPost, path, body, &run); err != nil {
+		return result, err
+	}
+
+	result.CloudRunID = run.Data.ID
+
+	path = fmt.Sprintf("/api/v2/accounts/%d/runs/%d/", job.AccountID, run.Data.ID)
+
+	for !run.Data.IsComplete {
+		select {
+		case <-ctx.Done():
+			return result, fmt.Errorf("dbt cloud run %d did not complete: %w", run.Data.ID, ctx.Err())
+		case <-time.After(*job.PollInterval):
+		}
+
+		if err := job.call(ctx, http.MethodGet, path, nil, &run); err != nil {
+			return result, err
+		}
+	}
+
+	result.CloudRunURL = run.Data.Href
+
+	result.Status = dbtCloudStatus[run.Data.Status]
+	if result.Status == "" {
+		result.Status = fmt.Sprintf("status %d", run.Data.Status)
+	}
+
+	if run.Data.Status != 10 {
+		return result, fmt.Errorf("dbt cloud run %d completed with %s: %s", run.Data.ID, result.Status,
+			run.Data.Href)
+	}
+
+	return result, nil
+}
+
+// call will make a request to the dbt Cloud API and decode the body of the response into the value.
+func (job *DBTCloudJob) call(ctx context.Context, method, path string, body []byte, value interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(job.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create dbt cloud request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Token "+job.Token)
+	req.Header.Set("Accept", "application/json")
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rsp, err := compliance.HTTPClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("dbt cloud request failed: %w", err)
+	}
+
+	defer rsp.Body.Close()
+
+	data, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read dbt cloud response: %w", err)
+	}
+
+	if rsp.StatusCode/100 != 2 {
+		if len(data) > 1<<10 {
+			data = data[:1<<10]
+		}
+
+		return fmt.Errorf("dbt cloud %s %s: unexpected status %q: %s", method, path, rsp.Status,
+			bytes.TrimSpace(data))
+	}
+
+	if err := json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("invalid dbt cloud response: %w", err)
+	}
+
+	return nil
+}
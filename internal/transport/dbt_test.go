@@ -0,0 +1,198 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestDBT(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	models := map[string][]string{"candles": {"stg_candles+"}, "trades": {"stg_trades", "stg_candles+"}}
+
+	t.Run("selectors", func(t *testing.T) {
+		t.Parallel()
+
+		dbt := &DBT{Models: models}
+
+		if got := dbt.selectors([]string{"trades", "candles", "orders"}); !reflect.DeepEqual(got,
+			[]string{"stg_candles+", "stg_trades"}) {
+			t.Fatalf("expected the models of the loaded tables, got %v", got)
+		}
+
+		cfg := &Config{Logger: logrus.New(), DBT: dbt}
+		run := &runState{}
+		if err := cfg.runDBT(ctx, run, []string{"orders"}); err != nil || run.dbt != nil {
+			t.Fatalf("expected dbt not to run without models, got %+v: %v", run.dbt, err)
+		}
+	})
+
+	t.Run("local", func(t *testing.T) {
+		t.Parallel()
+
+		if runtime.GOOS == "windows" {
+			t.Skip("the fake dbt executable is a shell script")
+		}
+
+		dir := t.TempDir()
+
+		// The fake dbt writes its arguments and the results of its nodes, and fails for the "broken" model.
+		script := "#!/bin/sh\n" +
+			"echo \"$@\" > args.txt\n" +
+			"mkdir -p target\n" +
+			`echo '{"results":[{"unique_id":"model.market.stg_candles","status":"success",` +
+			`"execution_time":1.5,"message":"OK"}]}' > target/run_results.json` + "\n" +
+			"case \"$*\" in *broken*) echo 'Compilation Error in model broken'; exit 1;; esac\n"
+
+		command := filepath.Join(dir, "dbt")
+		if err := os.WriteFile(command, []byte(script), 0o700); err != nil {
+			t.Fatalf("failed to write fake dbt: %v", err)
+		}
+
+		dbt := &DBT{Models: models, ProjectDir: dir, Target: "prod", Command: command}
+		dbt.setDefaults()
+
+		cfg := &Config{Logger: logrus.New(), DBT: dbt}
+		run := &runState{}
+		if err := cfg.runDBT(ctx, run, []string{"candles"}); err != nil {
+			t.Fatalf("failed to run dbt: %v", err)
+		}
+
+		args, _ := os.ReadFile(filepath.Join(dir, "args.txt"))
+		if exp := "run --select stg_candles+ --project-dir " + dir + " --target prod\n"; string(args) != exp {
+			t.Fatalf("expected arguments %q, got %q", exp, args)
+		}
+
+		exp := []*DBTNodeResult{{UniqueID: "model.market.stg_candles", Status: "success", ExecutionTime: 1.5,
+			Message: "OK"}}
+		if run.dbt.Mode != DBTLocal || run.dbt.Status != "success" || !reflect.DeepEqual(run.dbt.Nodes, exp) {
+			t.Fatalf("unexpected result %+v", run.dbt)
+		}
+
+		dbt.Models["orders"] = []string{"broken"}
+
+		err := cfg.runDBT(ctx, run, []string{"orders"})
+		if !errors.Is(err, ErrDBT) || !strings.Contains(err.Error(), "Compilation Error in model broken") ||
+			run.dbt.Status != "error" || run.dbt.Error == "" {
+			t.Fatalf("expected the output of the failed run, got %v with %+v", err, run.dbt)
+		}
+	})
+
+	t.Run("cloud", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			mtx   sync.Mutex
+			steps []string
+			polls int
+		)
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			if req.Header.Get("Authorization") != "Token secret" {
+				http.Error(rw, `{"status":{"is_success":false}}`, http.StatusUnauthorized)
+
+				return
+			}
+
+			run := map[string]interface{}{"id": 7, "status": 1, "is_complete": false, "href": "https://dbt/runs/7"}
+
+			switch req.URL.Path {
+			case "/api/v2/accounts/1/jobs/2/run/":
+				var body struct {
+					Cause string   `json:"cause"`
+					Steps []string `json:"steps_override"`
+				}
+
+				_ = json.NewDecoder(req.Body).Decode(&body)
+				steps = append([]string{body.Cause}, body.Steps...)
+			case "/api/v2/accounts/1/runs/7/":
+				if polls++; polls > 1 {
+					run["status"], run["is_complete"] = 10, true
+				}
+			default:
+				http.NotFound(rw, req)
+
+				return
+			}
+
+			_ = json.NewEncoder(rw).Encode(map[string]interface{}{"data": run})
+		}))
+		t.Cleanup(server.Close)
+
+		interval := time.Millisecond
+		dbt := &DBT{Models: models, Cloud: &DBTCloudJob{
+			URL: server.URL, AccountID: 1, JobID: 2, Token: "secret", PollInterval: &interval,
+		}}
+		dbt.setDefaults()
+
+		cfg := &Config{Logger: logrus.New(), DBT: dbt, RunID: "run-1"}
+		run := &runState{}
+		if err := cfg.runDBT(ctx, run, []string{"candles", "trades"}); err != nil {
+			t.Fatalf("failed to run dbt: %v", err)
+		}
+
+		if exp := []string{"gidari run run-1", "dbt run --select stg_candles+ stg_trades"}; !reflect.DeepEqual(steps,
+			exp) {
+			t.Fatalf("expected the job to be triggered with %q, got %q", exp, steps)
+		}
+
+		if run.dbt.Status != "success" || run.dbt.CloudRunID != 7 || run.dbt.CloudRunURL != "https://dbt/runs/7" ||
+			polls != 2 {
+			t.Fatalf("unexpected result %+v after %d polls", run.dbt, polls)
+		}
+
+		dbt.Cloud.Token = "expired"
+		if err := cfg.runDBT(ctx, run, []string{"candles"}); !errors.Is(err, ErrDBT) || !strings.Contains(err.Error(),
+			"401") {
+			t.Fatalf("expected an unauthorized error, got %v", err)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		zero := time.Duration(0)
+		cloud := &DBTCloudJob{AccountID: 1, JobID: 2}
+
+		for _, tc := range []struct {
+			dbt *DBT
+			err error
+		}{
+			{&DBT{ProjectDir: "."}, ErrMissingConfigField},
+			{&DBT{Models: map[string][]string{"candles": {" "}}, ProjectDir: "."}, ErrInvalidDBT},
+			{&DBT{Models: models}, ErrInvalidDBT},
+			{&DBT{Models: models, ProjectDir: ".", Cloud: cloud}, ErrInvalidDBT},
+			{&DBT{Models: models, ProjectDir: ".", Timeout: &zero}, ErrInvalidDBT},
+			{&DBT{Models: models, Cloud: &DBTCloudJob{AccountID: 1}}, ErrInvalidDBT},
+			{&DBT{Models: models, Cloud: cloud}, nil},
+		} {
+			if err := tc.dbt.validate(); !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v for %+v, got %v", tc.err, tc.dbt, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,309 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/proto"
+)
+
+var (
+	ErrInvalidDownsampleValue  = fmt.Errorf("invalid downsample value")
+	ErrInvalidDownsamplePeriod = fmt.Errorf("downsample period must be greater than zero")
+)
+
+// InvalidDownsampleValueError is returned when a record field can not be used to downsample the record.
+func InvalidDownsampleValueError(field string, val interface{}) error {
+	return fmt.Errorf("%w: %s=%v", ErrInvalidDownsampleValue, field, val)
+}
+
+// Downsample is the configuration for aggregating tick or candle records into coarser OHLCV candles. The raw records
+// are still written to the request table, and the aggregated candles are written to "Table" at the end of the
+// transport, once every record for the run has been aggregated. For timeseries requests, the candles of the periods
+// that are not fully within the fetched time range are not written, so that a run over part of a period does not
+// overwrite its stored candle.
+type Downsample struct {
+	// Table is the name of the table/collection to write the aggregated candles to.
+	Table string `yaml:"table"`
+
+	// TimeField is the name of the timestamp field on the records. Numeric timestamps are assumed to be unix seconds
+	// and string timestamps are parsed using "Layout".
+	TimeField string `yaml:"timeField"`
+
+	// Layout is the time layout for parsing string timestamps. The default is RFC3339.
+	Layout *string `yaml:"layout"`
+
+	// Period is the size of each candle in seconds, e.g. 3600 for hourly candles.
+	Period int32 `yaml:"period"`
+
+	// GroupBy are the fields to aggregate candles by, e.g. "product_id".
+	GroupBy []string `yaml:"groupBy"`
+
+	// Price is the name of the price field for tick records. If set, it is used in place of the open, high, low, and
+	// close fields.
+	Price string `yaml:"price"`
+
+	// Open, High, Low, Close, and Volume are the names of the OHLCV fields on candle records. They default to "open",
+	// "high", "low", "close", and "volume", and the same names are used for the aggregated candles.
+	Open   string `yaml:"open"`
+	High   string `yaml:"high"`
+	Low    string `yaml:"low"`
+	Close  string `yaml:"close"`
+	Volume string `yaml:"volume"`
+}
+
+// downsampler aggregates the records of a run into the candles of a downsample configuration.
+type downsampler struct {
+	*Downsample
+
+	mutex   sync.Mutex
+	candles map[string]*candle
+	keys    []string
+}
+
+// candle is an aggregated OHLCV candle.
+type candle struct {
+	group   map[string]interface{}
+	start   time.Time
+	unix    bool
+	openAt  time.Time
+	closeAt time.Time
+	open    float64
+	high    float64
+	low     float64
+	close   float64
+	volume  float64
+}
+
+func (ds *Downsample) validate() error {
+	if ds.Table == "" {
+		return MissingConfigFieldError("downsample.table")
+	}
+
+	if ds.TimeField == "" {
+		return MissingConfigFieldError("downsample.timeField")
+	}
+
+	if ds.Period <= 0 {
+		return ErrInvalidDownsamplePeriod
+	}
+
+	return nil
+}
+
+func (ds *Downsample) setDefaults() {
+	if ds.Layout == nil {
+		str := time.RFC3339
+		ds.Layout = &str
+	}
+
+	defaults := []struct {
+		field *string
+		name  string
+	}{
+		{&ds.Open, "open"}, {&ds.High, "high"}, {&ds.Low, "low"}, {&ds.Close, "close"}, {&ds.Volume, "volume"},
+	}
+
+	for _, def := range defaults {
+		if *def.field == "" {
+			*def.field = def.name
+		}
+	}
+}
+
+// newDownsampler will return a downsampler for the configuration with no aggregated candles.
+func newDownsampler(ds *Downsample) *downsampler {
+	return &downsampler{Downsample: ds, candles: make(map[string]*candle)}
+}
+
+// newDownsamplers will return a downsampler for every downsample configuration of the requests.
+func newDownsamplers(reqs []*Request) map[*Downsample]*downsampler {
+	downsamplers := make(map[*Downsample]*downsampler)
+
+	for _, req := range reqs {
+		for _, ds := range req.Downsample {
+			downsamplers[ds] = newDownsampler(ds)
+		}
+	}
+
+	return downsamplers
+}
+
+// parseFloat will parse a numeric record field, which web APIs commonly encode as strings.
+func parseFloat(field string, val interface{}) (float64, error) {
+	switch val := val.(type) {
+	case float64:
+		return val, nil
+	case string:
+		flt, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return 0, InvalidDownsampleValueError(field, val)
+		}
+
+		return flt, nil
+	default:
+		return 0, InvalidDownsampleValueError(field, val)
+	}
+}
+
+// parseTime will parse the timestamp on the record, returning true if it is a unix timestamp.
+func (ds *Downsample) parseTime(record map[string]interface{}) (time.Time, bool, error) {
+	switch val := record[ds.TimeField].(type) {
+	case float64:
+		return time.Unix(int64(val), 0).UTC(), true, nil
+	case string:
+		tme, err := time.Parse(*ds.Layout, val)
+		if err != nil {
+			return time.Time{}, false, InvalidDownsampleValueError(ds.TimeField, val)
+		}
+
+		return tme.UTC(), false, nil
+	default:
+		return time.Time{}, false, InvalidDownsampleValueError(ds.TimeField, val)
+	}
+}
+
+// ohlcv will return the open, high, low, close, and volume values for the record.
+func (ds *Downsample) ohlcv(record map[string]interface{}) ([5]float64, error) {
+	var values [5]float64
+
+	fields := [5]string{ds.Open, ds.High, ds.Low, ds.Close, ds.Volume}
+	if ds.Price != "" {
+		fields = [5]string{ds.Price, ds.Price, ds.Price, ds.Price, ds.Volume}
+	}
+
+	for idx, field := range fields {
+		// Volume is optional, e.g. for price-only ticks.
+		if _, ok := record[field]; !ok && field == ds.Volume {
+			continue
+		}
+
+		val, err := parseFloat(field, record[field])
+		if err != nil {
+			return values, err
+		}
+
+		values[idx] = val
+	}
+
+	return values, nil
+}
+
+// add will aggregate the record into its candle.
+func (ds *downsampler) add(record map[string]interface{}) error {
+	tme, unix, err := ds.parseTime(record)
+	if err != nil {
+		return err
+	}
+
+	values, err := ds.ohlcv(record)
+	if err != nil {
+		return err
+	}
+
+	start := tme.Truncate(time.Duration(ds.Period) * time.Second)
+
+	group := make(map[string]interface{}, len(ds.GroupBy))
+	keyParts := []string{start.String()}
+
+	for _, field := range ds.GroupBy {
+		group[field] = record[field]
+		keyParts = append(keyParts, fmt.Sprint(record[field]))
+	}
+
+	key := strings.Join(keyParts, "|")
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	cdl, ok := ds.candles[key]
+	if !ok {
+		ds.candles[key] = &candle{
+			group:   group,
+			start:   start,
+			unix:    unix,
+			openAt:  tme,
+			closeAt: tme,
+			open:    values[0],
+			high:    values[1],
+			low:     values[2],
+			close:   values[3],
+			volume:  values[4],
+		}
+		ds.keys = append(ds.keys, key)
+
+		return nil
+	}
+
+	if tme.Before(cdl.openAt) {
+		cdl.openAt, cdl.open = tme, values[0]
+	}
+
+	if !tme.Before(cdl.closeAt) {
+		cdl.closeAt, cdl.close = tme, values[3]
+	}
+
+	if values[1] > cdl.high {
+		cdl.high = values[1]
+	}
+
+	if values[2] < cdl.low {
+		cdl.low = values[2]
+	}
+
+	cdl.volume += values[4]
+
+	return nil
+}
+
+// upsertRequest will return an upsert request for the aggregated candles, or nil if there are none. If the
+// timeseries is set, the candles of the periods that are not fully within its fetched time range are skipped.
+func (ds *downsampler) upsertRequest(ts *timeseries) (*proto.UpsertRequest, error) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	records := make([]map[string]interface{}, 0, len(ds.keys))
+	period := time.Duration(ds.Period) * time.Second
+
+	for _, key := range ds.keys {
+		cdl := ds.candles[key]
+		if !ts.covers(cdl.start, cdl.start.Add(period)) {
+			continue
+		}
+
+		record := make(map[string]interface{}, len(cdl.group)+6)
+		for field, val := range cdl.group {
+			record[field] = val
+		}
+
+		if cdl.unix {
+			record[ds.TimeField] = cdl.start.Unix()
+		} else {
+			record[ds.TimeField] = cdl.start.Format(*ds.Layout)
+		}
+
+		record[ds.Open] = cdl.open
+		record[ds.High] = cdl.high
+		record[ds.Low] = cdl.low
+		record[ds.Close] = cdl.close
+		record[ds.Volume] = cdl.volume
+
+		records = append(records, record)
+	}
+
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	return newJSONUpsertRequest(ds.Table, records)
+}
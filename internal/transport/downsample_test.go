@@ -0,0 +1,142 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDownsample(t *testing.T) {
+	t.Parallel()
+
+	t.Run("candles are rolled up with ohlcv semantics", func(t *testing.T) {
+		t.Parallel()
+
+		ds := &Downsample{Table: "candle_hours", TimeField: "unix", Period: 3600, GroupBy: []string{"product_id"}}
+		if err := ds.validate(); err != nil {
+			t.Fatalf("failed to validate downsample: %v", err)
+		}
+
+		ds.setDefaults()
+
+		dsr := newDownsampler(ds)
+
+		// Records are intentionally out of order to mimic concurrent timeseries chunks.
+		records := []map[string]interface{}{
+			{"product_id": "BTC-USD", "unix": 3660.0, "open": "2", "high": "5", "low": "2", "close": "4", "volume": "1"},
+			{"product_id": "BTC-USD", "unix": 3600.0, "open": "1", "high": "3", "low": "1", "close": "2", "volume": "2"},
+			{"product_id": "BTC-USD", "unix": 7200.0, "open": "4", "high": "4", "low": "3", "close": "3", "volume": "1"},
+			{"product_id": "ETH-USD", "unix": 3600.0, "open": "9", "high": "9", "low": "9", "close": "9", "volume": "1"},
+		}
+
+		for _, record := range records {
+			if err := dsr.add(record); err != nil {
+				t.Fatalf("failed to add record: %v", err)
+			}
+		}
+
+		req, err := dsr.upsertRequest(nil)
+		if err != nil {
+			t.Fatalf("failed to build upsert request: %v", err)
+		}
+
+		var candles []map[string]interface{}
+		if err := json.Unmarshal(req.Data, &candles); err != nil {
+			t.Fatalf("failed to unmarshal candles: %v", err)
+		}
+
+		expected := []map[string]interface{}{
+			{"product_id": "BTC-USD", "unix": 3600.0, "open": 1.0, "high": 5.0, "low": 1.0, "close": 4.0, "volume": 3.0},
+			{"product_id": "BTC-USD", "unix": 7200.0, "open": 4.0, "high": 4.0, "low": 3.0, "close": 3.0, "volume": 1.0},
+			{"product_id": "ETH-USD", "unix": 3600.0, "open": 9.0, "high": 9.0, "low": 9.0, "close": 9.0, "volume": 1.0},
+		}
+
+		if !reflect.DeepEqual(candles, expected) {
+			t.Fatalf("expected %v, got %v", expected, candles)
+		}
+	})
+
+	t.Run("ticks are rolled up using the price field", func(t *testing.T) {
+		t.Parallel()
+
+		ds := &Downsample{Table: "trade_minutes", TimeField: "time", Period: 60, Price: "price", Volume: "size"}
+		ds.setDefaults()
+
+		dsr := newDownsampler(ds)
+
+		for _, record := range []map[string]interface{}{
+			{"time": "2022-05-10T00:00:30Z", "price": "10", "size": "1"},
+			{"time": "2022-05-10T00:00:10Z", "price": "12", "size": "1"},
+			{"time": "2022-05-10T00:00:50Z", "price": "8", "size": "1"},
+		} {
+			if err := dsr.add(record); err != nil {
+				t.Fatalf("failed to add record: %v", err)
+			}
+		}
+
+		req, err := dsr.upsertRequest(nil)
+		if err != nil {
+			t.Fatalf("failed to build upsert request: %v", err)
+		}
+
+		var candles []map[string]interface{}
+		if err := json.Unmarshal(req.Data, &candles); err != nil {
+			t.Fatalf("failed to unmarshal candles: %v", err)
+		}
+
+		expected := []map[string]interface{}{
+			{"time": "2022-05-10T00:00:00Z", "open": 12.0, "high": 12.0, "low": 8.0, "close": 8.0, "size": 3.0},
+		}
+
+		if !reflect.DeepEqual(candles, expected) {
+			t.Fatalf("expected %v, got %v", expected, candles)
+		}
+	})
+	t.Run("periods outside the fetched range are skipped", func(t *testing.T) {
+		t.Parallel()
+
+		ds := &Downsample{Table: "candle_hours", TimeField: "unix", Period: 3600}
+		ds.setDefaults()
+
+		dsr := newDownsampler(ds)
+
+		for _, unix := range []float64{3600, 7200, 9000, 10800} {
+			if err := dsr.add(map[string]interface{}{"unix": unix, "open": 1.0, "high": 1.0, "low": 1.0,
+				"close": 1.0}); err != nil {
+				t.Fatalf("failed to add record: %v", err)
+			}
+		}
+
+		// The run fetched from 01:30 to 03:30 in two chunks, so only the 02:00 candle is complete.
+		ts := &timeseries{chunks: [][2]time.Time{
+			{time.Unix(9000, 0), time.Unix(12600, 0)},
+			{time.Unix(5400, 0), time.Unix(9000, 0)},
+		}}
+
+		req, err := dsr.upsertRequest(ts)
+		if err != nil {
+			t.Fatalf("failed to build upsert request: %v", err)
+		}
+
+		var candles []map[string]interface{}
+		if err := json.Unmarshal(req.Data, &candles); err != nil {
+			t.Fatalf("failed to unmarshal candles: %v", err)
+		}
+
+		if len(candles) != 1 || candles[0]["unix"] != 7200.0 {
+			t.Fatalf("expected only the complete candle, got %v", candles)
+		}
+
+		if req, err := newDownsampler(ds).upsertRequest(ts); req != nil || err != nil {
+			t.Fatalf("expected no request without candles, got %v, %v", req, err)
+		}
+	})
+}
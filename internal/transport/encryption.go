@@ -0,0 +1,354 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/repository"
+	"github.com/google/uuid"
+)
+
+const (
+	// EncryptionKeyTable is the name of the table/collection that stores the wrapped data key of every run that
+	// encrypted columns, so that the values can be decrypted by whoever may use the key encryption key.
+	EncryptionKeyTable = "gidari_encryption_keys"
+
+	// EncryptedValuePrefix is the prefix of encrypted values, which are "gidari:enc:v1:<key ID>:<base64 of the nonce
+	// and the AES-256-GCM ciphertext of the JSON encoded value>". The key ID is the ID of the row of the data key in
+	// the "gidari_encryption_keys" table.
+	EncryptedValuePrefix = "gidari:enc:v1:"
+
+	// EncryptionAlgorithm is the algorithm of the data keys.
+	EncryptionAlgorithm = "AES-256-GCM"
+
+	encryptionKeyIDField      = "id"
+	encryptionRunIDField      = "run_id"
+	encryptionKMSField        = "kms"
+	encryptionKMSKeyField     = "kms_key"
+	encryptionWrappedKeyField = "wrapped_key"
+	encryptionAlgorithmField  = "algorithm"
+	encryptionCreatedAtField  = "created_at"
+
+	// encryptionKeySize is the size of the AES-256 data keys in bytes.
+	encryptionKeySize = 32
+)
+
+var (
+	ErrInvalidEncryption = fmt.Errorf("invalid encryption")
+	ErrEncryption        = fmt.Errorf("failed to encrypt")
+)
+
+// InvalidEncryptionError is returned when the encryption configuration is invalid.
+func InvalidEncryptionError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidEncryption, reason)
+}
+
+// EncryptionError is returned when the records of a table can not be encrypted.
+func EncryptionError(table string, err error) error {
+	return fmt.Errorf("%w %s: %v", ErrEncryption, table, err)
+}
+
+// Encryption is the configuration for the envelope encryption of sensitive columns before they are written to
+// destinations operated by third parties. Every run encrypts with a new AES-256-GCM data key, which is encrypted
+// ("wrapped") by a key management service and stored in the "gidari_encryption_keys" table of the destinations, in
+// the same transaction as the records.
+type Encryption struct {
+	// KMS is the key encryption key that wraps the data keys, either an AWS KMS key (e.g.
+	// "awskms://arn:aws:kms:us-east-1:111122223333:key/<id>" or "awskms://alias/gidari?region=us-east-1") or a GCP
+	// Cloud KMS key (e.g. "gcpkms://projects/<p>/locations/<l>/keyRings/<r>/cryptoKeys/<k>").
+	KMS string `yaml:"kms"`
+
+	// Columns are the top-level fields to encrypt, keyed by table name. Encrypted values are randomized, so columns
+	// of the primary key of their table can not be encrypted.
+	Columns map[string][]string `yaml:"columns"`
+
+	// Destinations are the prefixes of the connection strings to encrypt the columns for, e.g.
+	// "snowflake://partner". If empty, the columns are encrypted for every connection string.
+	Destinations []string `yaml:"destinations"`
+}
+
+// validate will check the configuration against the requests, which declare the primary keys of their tables.
+func (enc *Encryption) validate(requests []*Request) error {
+	if enc.KMS == "" {
+		return MissingConfigFieldError("encryption.kms")
+	}
+
+	if len(enc.Columns) == 0 {
+		return MissingConfigFieldError("encryption.columns")
+	}
+
+	keys := encryptionKeyColumns(requests)
+
+	for table, columns := range enc.Columns {
+		if table == EncryptionKeyTable || table == WatermarkTable {
+			return InvalidEncryptionError(fmt.Sprintf("the columns of %q can not be encrypted", table))
+		}
+
+		tableKeys, ok := keys[table]
+		if !ok {
+			tableKeys = []string{schemaKeyField}
+		}
+
+		for _, column := range columns {
+			if column == "" {
+				return InvalidEncryptionError(fmt.Sprintf("empty column for table %q", table))
+			}
+
+			for _, key := range tableKeys {
+				if column == key {
+					return InvalidEncryptionError(fmt.Sprintf("column %q is in the primary key of table %q", column,
+						table))
+				}
+			}
+		}
+	}
+
+	for _, dest := range enc.Destinations {
+		if dest == "" {
+			return InvalidEncryptionError("empty destination")
+		}
+	}
+
+	if _, err := storage.NewKeyEncrypter(enc.KMS); err != nil {
+		return InvalidEncryptionError(err.Error())
+	}
+
+	return nil
+}
+
+// encryptionKeyColumns will return the primary key of the tables whose key is declared by the requests: the keys of
+// passthrough tables, and the groupBy and timeField of downsampled tables. The key of any other table is "id", as
+// inferred by the schema.
+func encryptionKeyColumns(requests []*Request) map[string][]string {
+	keys := make(map[string][]string)
+
+	for _, req := range requests {
+		if pt := req.Passthrough; pt != nil {
+			keys[req.Table] = pt.Keys
+		}
+
+		for _, ds := range req.Downsample {
+			keys[ds.Table] = append(append([]string(nil), ds.GroupBy...), ds.TimeField)
+		}
+	}
+
+	return keys
+}
+
+// encrypts will return true if the columns are encrypted for the connection string.
+func (enc *Encryption) encrypts(dns string) bool {
+	if len(enc.Destinations) == 0 {
+		return true
+	}
+
+	for _, dest := range enc.Destinations {
+		if strings.HasPrefix(dns, dest) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// encrypted will return true if the column of the table is encrypted.
+func (enc *Encryption) encrypted(table, column string) bool {
+	for _, col := range enc.Columns[table] {
+		if col == column {
+			return true
+		}
+	}
+
+	return false
+}
+
+// recordEncrypter encrypts the configured columns of records with the data key of a run.
+type recordEncrypter struct {
+	cfg   *Encryption
+	keyID string
+	aead  cipher.AEAD
+
+	// key is the record of the wrapped data key, for the "gidari_encryption_keys" table.
+	key map[string]interface{}
+}
+
+// newRecordEncrypter will generate the data key of the run and wrap it with the key encryption key. If the
+// configuration does not encrypt columns, it returns nil.
+func newRecordEncrypter(ctx context.Context, cfg *Config) (*recordEncrypter, error) {
+	if cfg.Encryption == nil {
+		return nil, nil
+	}
+
+	kek, err := storage.NewKeyEncrypter(cfg.Encryption.KMS)
+	if err != nil {
+		return nil, InvalidEncryptionError(err.Error())
+	}
+
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("unable to generate data key: %w", err)
+	}
+
+	wrapped, kmsKey, err := kek.EncryptKey(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to wrap data key: %w", err)
+	}
+
+	enc, err := newRecordEncrypterWithKey(cfg.Encryption, uuid.New().String(), dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	enc.key = map[string]interface{}{
+		encryptionKeyIDField:      enc.keyID,
+		encryptionRunIDField:      cfg.RunID,
+		encryptionKMSField:        cfg.Encryption.KMS,
+		encryptionKMSKeyField:     kmsKey,
+		encryptionWrappedKeyField: base64.StdEncoding.EncodeToString(wrapped),
+		encryptionAlgorithmField:  EncryptionAlgorithm,
+		encryptionCreatedAtField:  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	return enc, nil
+}
+
+// newRecordEncrypterWithKey will return the record encrypter for the unwrapped data key with the ID.
+func newRecordEncrypterWithKey(cfg *Encryption, keyID string, dataKey []byte) (*recordEncrypter, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cipher: %w", err)
+	}
+
+	return &recordEncrypter{cfg: cfg, keyID: keyID, aead: aead}, nil
+}
+
+// additionalData will return the additional authenticated data of the values of the column, which binds each value
+// to its table and column.
+func additionalData(table, column string) []byte {
+	return []byte(table + "\x00" + column)
+}
+
+// encrypt will return the encrypted value of the column of the table.
+func (enc *recordEncrypter) encrypt(table, column string, value interface{}) (string, error) {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, enc.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := enc.aead.Seal(nonce, nonce, plaintext, additionalData(table, column))
+
+	return EncryptedValuePrefix + enc.keyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// apply will return the requests with the configured columns of their records encrypted. Requests for tables
+// without encrypted columns are returned as they are, and null values are not encrypted.
+func (enc *recordEncrypter) apply(reqs []*proto.UpsertRequest) ([]*proto.UpsertRequest, error) {
+	encrypted := make([]*proto.UpsertRequest, 0, len(reqs))
+
+	for _, req := range reqs {
+		columns := enc.cfg.Columns[req.Table]
+		if len(columns) == 0 {
+			encrypted = append(encrypted, req)
+
+			continue
+		}
+
+		records, err := decodeJSONRecords(req.Data)
+		if err != nil {
+			return nil, EncryptionError(req.Table, err)
+		}
+
+		for _, record := range records {
+			for _, column := range columns {
+				value, ok := record[column]
+				if !ok || value == nil {
+					continue
+				}
+
+				if record[column], err = enc.encrypt(req.Table, column, value); err != nil {
+					return nil, EncryptionError(req.Table, err)
+				}
+			}
+		}
+
+		encReq, err := newJSONUpsertRequest(req.Table, records)
+		if err != nil {
+			return nil, EncryptionError(req.Table, err)
+		}
+
+		encrypted = append(encrypted, encReq)
+	}
+
+	return encrypted, nil
+}
+
+// upsertEncryptionKey will write the wrapped data key of the run to the repositories that columns are encrypted for,
+// as the first write of their transactions, so that the key is committed with the first encrypted record.
+func upsertEncryptionKey(rcfg *repoConfig) error {
+	if rcfg.encrypter == nil {
+		return nil
+	}
+
+	upsertReq, err := newJSONUpsertRequest(EncryptionKeyTable, []map[string]interface{}{rcfg.encrypter.key})
+	if err != nil {
+		return fmt.Errorf("unable to build encryption key request: %w", err)
+	}
+
+	for idx, repo := range rcfg.repos {
+		if !rcfg.encrypted[idx] {
+			continue
+		}
+
+		repo.Transact(func(sctx context.Context, repo repository.Generic) error {
+			if _, err := rcfg.timeouts.wrap(repo).Upsert(sctx, upsertReq); err != nil {
+				return fmt.Errorf("error upserting encryption key: %w", err)
+			}
+
+			return nil
+		})
+	}
+
+	return nil
+}
+
+// encryptionKeySchema will return the declared schema of the encryption key table.
+func encryptionKeySchema() *tableSchema {
+	ts := newTableSchema(EncryptionKeyTable)
+	ts.primaryKey = []string{encryptionKeyIDField}
+	ts.columns = []*schemaColumn{
+		{name: encryptionKeyIDField, typ: columnText, notNull: true},
+		{name: encryptionRunIDField, typ: columnText, notNull: true},
+		{name: encryptionKMSField, typ: columnText, notNull: true},
+		{name: encryptionKMSKeyField, typ: columnText, notNull: true},
+		{name: encryptionWrappedKeyField, typ: columnText, notNull: true},
+		{name: encryptionAlgorithmField, typ: columnText, notNull: true},
+		{name: encryptionCreatedAtField, typ: columnText, notNull: true},
+	}
+
+	return ts
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/proto"
+)
+
+// decryptTestValue will decrypt the value as documented for consumers: split the key ID from the base64 of the
+// nonce and ciphertext, and open it with the data key and "<table>\x00<column>" as the additional data.
+func decryptTestValue(t *testing.T, dataKey []byte, keyID, table, column string, value interface{}) interface{} {
+	t.Helper()
+
+	str, ok := value.(string)
+	if !ok || !strings.HasPrefix(str, EncryptedValuePrefix+keyID+":") {
+		t.Fatalf("expected a value encrypted with key %q, got %v", keyID, value)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(str, EncryptedValuePrefix+keyID+":"))
+	if err != nil {
+		t.Fatalf("failed to decode %q: %v", str, err)
+	}
+
+	block, _ := aes.NewCipher(dataKey)
+	aead, _ := cipher.NewGCM(block)
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():],
+		[]byte(table+"\x00"+column))
+	if err != nil {
+		t.Fatalf("failed to open %q: %v", str, err)
+	}
+
+	var decrypted interface{}
+	if err := json.Unmarshal(plaintext, &decrypted); err != nil {
+		t.Fatalf("failed to decode plaintext %q: %v", plaintext, err)
+	}
+
+	return decrypted
+}
+
+func TestEncryption(t *testing.T) {
+	t.Parallel()
+
+	t.Run("apply", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &Encryption{Columns: map[string][]string{"customers": {"email", "address", "missing"}}}
+		dataKey := bytes.Repeat([]byte{7}, encryptionKeySize)
+
+		enc, err := newRecordEncrypterWithKey(cfg, "key-1", dataKey)
+		if err != nil {
+			t.Fatalf("failed to create encrypter: %v", err)
+		}
+
+		customers, _ := newJSONUpsertRequest("customers", []map[string]interface{}{
+			{"id": "c1", "email": "a@example.com", "address": map[string]interface{}{"city": "Oslo"}},
+			{"id": "c2", "email": nil},
+		})
+		orders, _ := newJSONUpsertRequest("orders", []map[string]interface{}{{"id": "o1", "email": "a@example.com"}})
+
+		reqs, err := enc.apply([]*proto.UpsertRequest{customers, orders})
+		if err != nil {
+			t.Fatalf("failed to encrypt: %v", err)
+		}
+
+		if reqs[1] != orders {
+			t.Fatalf("expected the request without encrypted columns to be unchanged, got %s", reqs[1].Data)
+		}
+
+		records, _ := decodeJSONRecords(reqs[0].Data)
+		if records[0]["id"] != "c1" || records[1]["email"] != nil || len(records[1]) != 2 {
+			t.Fatalf("expected only non-null configured columns to be encrypted, got %v", records)
+		}
+
+		if email := decryptTestValue(t, dataKey, "key-1", "customers", "email", records[0]["email"]); email !=
+			"a@example.com" {
+			t.Fatalf("expected the email to decrypt, got %v", email)
+		}
+
+		address := decryptTestValue(t, dataKey, "key-1", "customers", "address", records[0]["address"])
+		if !reflect.DeepEqual(address, map[string]interface{}{"city": "Oslo"}) {
+			t.Fatalf("expected the address to decrypt, got %v", address)
+		}
+
+		// The same value encrypts differently every time, and is bound to its column.
+		again, _ := enc.encrypt("customers", "email", "a@example.com")
+		if again == records[0]["email"] {
+			t.Fatalf("expected a randomized encryption, got %q twice", again)
+		}
+
+		encoded := strings.TrimPrefix(again, EncryptedValuePrefix+"key-1:")
+		sealed, _ := base64.StdEncoding.DecodeString(encoded)
+		block, _ := aes.NewCipher(dataKey)
+		aead, _ := cipher.NewGCM(block)
+
+		if _, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():],
+			[]byte("customers\x00address")); err == nil {
+			t.Fatalf("expected the value not to decrypt as another column")
+		}
+	})
+
+	t.Run("destinations", func(t *testing.T) {
+		t.Parallel()
+
+		enc := &Encryption{Destinations: []string{"snowflake://partner", "s3://"}}
+
+		for dns, exp := range map[string]bool{
+			"snowflake://partner@acme/db/public": true,
+			"s3://bucket/export":                 true,
+			"postgresql://localhost:5432/gidari": false,
+		} {
+			if got := enc.encrypts(dns); got != exp {
+				t.Fatalf("expected %v for %q, got %v", exp, dns, got)
+			}
+		}
+
+		if !(&Encryption{}).encrypts("postgresql://localhost:5432/gidari") {
+			t.Fatalf("expected every destination to be encrypted without destinations")
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		kms := "awskms://arn:aws:kms:us-east-1:111122223333:key/1234"
+		columns := map[string][]string{"customers": {"email"}}
+
+		requests := []*Request{
+			{Table: "events", Passthrough: &Passthrough{Keys: []string{"event_id"}}},
+			{Table: "trades", Downsample: []*Downsample{
+				{Table: "candles", TimeField: "time", GroupBy: []string{"product"}},
+			}},
+		}
+
+		for _, tc := range []struct {
+			enc *Encryption
+			err error
+		}{
+			{&Encryption{Columns: columns}, ErrMissingConfigField},
+			{&Encryption{KMS: kms, Columns: map[string][]string{"customers": {"id"}}}, ErrInvalidEncryption},
+			{&Encryption{KMS: kms, Columns: map[string][]string{"events": {"event_id"}}}, ErrInvalidEncryption},
+			{&Encryption{KMS: kms, Columns: map[string][]string{"events": {"id"}}}, nil},
+			{&Encryption{KMS: kms, Columns: map[string][]string{"candles": {"product"}}}, ErrInvalidEncryption},
+			{&Encryption{KMS: kms}, ErrMissingConfigField},
+			{&Encryption{KMS: kms, Columns: map[string][]string{"customers": {""}}}, ErrInvalidEncryption},
+			{&Encryption{KMS: kms, Columns: map[string][]string{WatermarkTable: {"time"}}}, ErrInvalidEncryption},
+			{&Encryption{KMS: kms, Columns: columns, Destinations: []string{""}}, ErrInvalidEncryption},
+			{&Encryption{KMS: "vault://transit/keys/gidari", Columns: columns}, ErrInvalidEncryption},
+			{&Encryption{KMS: kms, Columns: columns, Destinations: []string{"snowflake://"}}, nil},
+		} {
+			if err := tc.enc.validate(requests); !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v for %+v, got %v", tc.err, tc.enc, err)
+			}
+		}
+	})
+
+	t.Run("repository requests", func(t *testing.T) {
+		t.Parallel()
+
+		enc, _ := newRecordEncrypterWithKey(&Encryption{Columns: map[string][]string{"customers": {"email"}}}, "key-1",
+			bytes.Repeat([]byte{1}, encryptionKeySize))
+
+		rcfg := &repoConfig{encrypter: enc, encrypted: []bool{false, true}}
+
+		req, _ := newJSONUpsertRequest("customers", []map[string]interface{}{{"id": "c1", "email": "a@example.com"}})
+		reqs := []*proto.UpsertRequest{req}
+
+		encrypted, err := rcfg.encrypt(reqs)
+		if err != nil {
+			t.Fatalf("failed to encrypt: %v", err)
+		}
+
+		if rcfg.repoRequests(0, reqs, encrypted)[0] != req || rcfg.repoRequests(1, reqs, encrypted)[0] == req {
+			t.Fatalf("expected only the second repository to be written the encrypted requests")
+		}
+
+		if plain, _ := (&repoConfig{}).encrypt(reqs); plain[0] != req {
+			t.Fatalf("expected the requests to be unchanged without encryption")
+		}
+	})
+}
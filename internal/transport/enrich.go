@@ -0,0 +1,184 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+// Enrich is the configuration for looking up values from an existing table in storage and merging them into the
+// records of a request before they are written. For example, internal product IDs can be attached to the symbols
+// returned by a web API.
+type Enrich struct {
+	// Table is the name of the table/collection in storage to look values up from.
+	Table string `yaml:"table"`
+
+	// Field is the name of the field on the incoming records used for the lookup.
+	Field string `yaml:"field"`
+
+	// Key is the name of the column on the lookup table that is matched against "Field". The default is "Field".
+	Key string `yaml:"key"`
+
+	// Fields are the columns on the lookup table to merge into the incoming records. If empty, every column other than
+	// "Key" is merged. Fields already set on an incoming record are never overwritten.
+	Fields []string `yaml:"fields"`
+}
+
+// enrichLookupKeys is the maximum number of lookup values read in a single request, which keeps the lookup within
+// the bind parameter limits of the SQL dialects and Oracle's limit of 1000 expressions in an IN list.
+const enrichLookupKeys = 1000
+
+// enricher makes the enrichment lookups of a run against the lookup storage. The looked up records are cached for
+// the run, so that a "Config" can be reused without serving the records of a previous run.
+type enricher struct {
+	stg storage.Storage
+
+	// cache holds the looked up records keyed by the enrich configuration and the string representation of the
+	// lookup value. Values that do not exist in the lookup table are cached as nil, so they are only queried once per
+	// run.
+	cache sync.Map
+}
+
+// enrichKey is the key of a looked up record in the cache of an "enricher".
+type enrichKey struct {
+	enr *Enrich
+	val string
+}
+
+func newEnricher(stg storage.Storage) *enricher {
+	return &enricher{stg: stg}
+}
+
+func (enr *Enrich) validate() error {
+	if enr.Table == "" {
+		return MissingConfigFieldError("enrich.table")
+	}
+
+	if enr.Field == "" {
+		return MissingConfigFieldError("enrich.field")
+	}
+
+	return nil
+}
+
+func (enr *Enrich) setDefaults() {
+	if enr.Key == "" {
+		enr.Key = enr.Field
+	}
+}
+
+// lookup will query storage for every lookup value of the enrich configuration in the records that is not yet
+// cached, in reads of at most "enrichLookupKeys" values.
+func (en *enricher) lookup(ctx context.Context, enr *Enrich, records []map[string]interface{}) error {
+	var missing []interface{}
+
+	seen := make(map[string]bool)
+
+	for _, record := range records {
+		val, ok := record[enr.Field]
+		if !ok || val == nil {
+			continue
+		}
+
+		key := fmt.Sprint(val)
+		if _, cached := en.cache.Load(enrichKey{enr, key}); cached || seen[key] {
+			continue
+		}
+
+		seen[key] = true
+
+		missing = append(missing, val)
+	}
+
+	for start := 0; start < len(missing); start += enrichLookupKeys {
+		end := start + enrichLookupKeys
+		if end > len(missing) {
+			end = len(missing)
+		}
+
+		req := &proto.ReadRequest{Table: enr.Table}
+		if err := tools.AssignReadRequired(req, enr.Key, missing[start:end]); err != nil {
+			return fmt.Errorf("unable to build lookup request: %w", err)
+		}
+
+		rsp, err := en.stg.Read(ctx, req)
+		if err != nil {
+			return fmt.Errorf("unable to read lookup table %q: %w", enr.Table, err)
+		}
+
+		for _, record := range rsp.GetRecords() {
+			found := record.AsMap()
+			key := fmt.Sprint(found[enr.Key])
+
+			en.cache.Store(enrichKey{enr, key}, found)
+			delete(seen, key)
+		}
+	}
+
+	// Cache the values that were not found.
+	for key := range seen {
+		en.cache.Store(enrichKey{enr, key}, nil)
+	}
+
+	return nil
+}
+
+// merge will merge the cached lookup record of the enrich configuration into the incoming record.
+func (en *enricher) merge(enr *Enrich, record map[string]interface{}) {
+	val, ok := record[enr.Field]
+	if !ok || val == nil {
+		return
+	}
+
+	cached, _ := en.cache.Load(enrichKey{enr, fmt.Sprint(val)})
+
+	found, ok := cached.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	fields := enr.Fields
+	if len(fields) == 0 {
+		for field := range found {
+			if field != enr.Key {
+				fields = append(fields, field)
+			}
+		}
+	}
+
+	for _, field := range fields {
+		if _, ok := record[field]; ok {
+			continue
+		}
+
+		if fval, ok := found[field]; ok {
+			record[field] = fval
+		}
+	}
+}
+
+// enrich will merge the looked up values for each of the enrich configurations into the records.
+func (en *enricher) enrich(ctx context.Context, enrich []*Enrich, records []map[string]interface{}) error {
+	for _, enr := range enrich {
+		if err := en.lookup(ctx, enr, records); err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			en.merge(enr, record)
+		}
+	}
+
+	return nil
+}
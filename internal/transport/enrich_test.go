@@ -0,0 +1,131 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// lookupStorage is a storage device that only implements "Read" and "Count", over a static set of records.
+type lookupStorage struct {
+	storage.Storage
+
+	records []map[string]interface{}
+	reads   int
+	counts  int
+}
+
+func (stg *lookupStorage) Count(_ context.Context, _ *proto.CountRequest) (*proto.CountResponse, error) {
+	stg.counts++
+
+	return &proto.CountResponse{Count: int64(len(stg.records))}, nil
+}
+
+func (stg *lookupStorage) Read(_ context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	stg.reads++
+
+	rsp := new(proto.ReadResponse)
+
+	for _, record := range stg.records {
+		pbrecord, err := structpb.NewStruct(record)
+		if err != nil {
+			return nil, err
+		}
+
+		rsp.Records = append(rsp.Records, pbrecord)
+	}
+
+	return rsp, nil
+}
+
+func TestEnrich(t *testing.T) {
+	t.Parallel()
+
+	t.Run("lookup values are merged and cached", func(t *testing.T) {
+		t.Parallel()
+
+		stg := &lookupStorage{records: []map[string]interface{}{
+			{"symbol": "BTC-USD", "product_id": 1.0, "name": "bitcoin"},
+		}}
+
+		enr := &Enrich{Table: "products", Field: "symbol", Fields: []string{"product_id"}}
+		enr.setDefaults()
+
+		records := []map[string]interface{}{
+			{"symbol": "BTC-USD", "price": 1.0},
+			{"symbol": "BTC-USD", "price": 2.0},
+			{"symbol": "ETH-USD", "price": 3.0},
+		}
+
+		ctx := context.Background()
+		enricher := newEnricher(stg)
+
+		if err := enricher.enrich(ctx, []*Enrich{enr}, records); err != nil {
+			t.Fatalf("failed to enrich records: %v", err)
+		}
+
+		for _, record := range records[:2] {
+			if record["product_id"] != 1.0 {
+				t.Fatalf("expected product_id to be merged, got %v", record)
+			}
+
+			if _, ok := record["name"]; ok {
+				t.Fatalf("expected only configured fields to be merged, got %v", record)
+			}
+		}
+
+		if _, ok := records[2]["product_id"]; ok {
+			t.Fatalf("expected record without a lookup match to be unchanged, got %v", records[2])
+		}
+
+		// A second batch with the same values should be served from the cache.
+		if err := enricher.enrich(ctx, []*Enrich{enr}, records); err != nil {
+			t.Fatalf("failed to enrich records: %v", err)
+		}
+
+		if stg.reads != 1 {
+			t.Fatalf("expected 1 read, got %d", stg.reads)
+		}
+
+		// A new run should not be served from the cache of a previous run.
+		if err := newEnricher(stg).enrich(ctx, []*Enrich{enr}, records); err != nil {
+			t.Fatalf("failed to enrich records: %v", err)
+		}
+
+		if stg.reads != 2 {
+			t.Fatalf("expected 2 reads, got %d", stg.reads)
+		}
+	})
+
+	t.Run("lookup values are read in chunks", func(t *testing.T) {
+		t.Parallel()
+
+		stg := &lookupStorage{}
+
+		enr := &Enrich{Table: "products", Field: "symbol"}
+		enr.setDefaults()
+
+		records := make([]map[string]interface{}, enrichLookupKeys+1)
+		for idx := range records {
+			records[idx] = map[string]interface{}{"symbol": float64(idx)}
+		}
+
+		if err := newEnricher(stg).enrich(context.Background(), []*Enrich{enr}, records); err != nil {
+			t.Fatalf("failed to enrich records: %v", err)
+		}
+
+		if stg.reads != 2 {
+			t.Fatalf("expected 2 reads, got %d", stg.reads)
+		}
+	})
+}
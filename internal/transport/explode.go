@@ -0,0 +1,113 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// explodeDefaultParentKey is the default field on the parent record referenced by the child table.
+	explodeDefaultParentKey = "id"
+
+	// explodeScalarField is the field used to store array elements that are not objects.
+	explodeScalarField = "value"
+
+	// explodeChildKey is the primary key of the child records, inferred for every table.
+	explodeChildKey = "id"
+)
+
+var ErrMissingParentKey = fmt.Errorf("record is missing explode parent key")
+
+// Explode is the configuration for writing an array of sub-objects on a record into a child table. For example, an
+// order record with a list of fills can write each fill into a "fills" table with a foreign key back to the order.
+type Explode struct {
+	// Field is the name of the array field on the parent record.
+	Field string `yaml:"field"`
+
+	// Table is the name of the child table/collection to write the array elements to.
+	Table string `yaml:"table"`
+
+	// ForeignKey is the name of the field on the child records that references the parent record. The default is
+	// "<parent table>_<parent key>".
+	ForeignKey string `yaml:"foreignKey"`
+
+	// ParentKey is the field on the parent record that the foreign key references. The default is "id". A parent
+	// record without a value for this field fails the batch, since its children could not be written again to the
+	// same rows.
+	ParentKey string `yaml:"parentKey"`
+}
+
+// setDefaults will set the default values on the explode configuration for the given parent table.
+func (exp *Explode) setDefaults(parentTable string) {
+	if exp.ParentKey == "" {
+		exp.ParentKey = explodeDefaultParentKey
+	}
+
+	if exp.ForeignKey == "" {
+		exp.ForeignKey = fmt.Sprintf("%s_%s", parentTable, exp.ParentKey)
+	}
+}
+
+func (exp *Explode) validate() error {
+	if exp.Field == "" {
+		return MissingConfigFieldError("explode.field")
+	}
+
+	if exp.Table == "" {
+		return MissingConfigFieldError("explode.table")
+	}
+
+	return nil
+}
+
+// explodeRecord will remove the array field from the parent record and return the array elements as child records
+// referencing the parent. Children without an "id" are keyed by the parent key and their index in the array, e.g.
+// "o1:0", so that writing the parent again updates the same child records.
+func (exp *Explode) explodeRecord(parent map[string]interface{}) ([]map[string]interface{}, error) {
+	elems, ok := parent[exp.Field].([]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	parentID, ok := parent[exp.ParentKey]
+	if !ok || parentID == nil {
+		return nil, fmt.Errorf("%w: %q", ErrMissingParentKey, exp.ParentKey)
+	}
+
+	delete(parent, exp.Field)
+
+	children := make([]map[string]interface{}, 0, len(elems))
+
+	for idx, elem := range elems {
+		child, ok := elem.(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{explodeScalarField: elem}
+		}
+
+		if child[explodeChildKey] == nil {
+			child[explodeChildKey] = fmt.Sprintf("%s:%d", formatValue(parentID), idx)
+		}
+
+		child[exp.ForeignKey] = parentID
+		children = append(children, child)
+	}
+
+	return children, nil
+}
+
+// formatValue will return the string representation of a decoded JSON value. Numbers are formatted without an
+// exponent, so that a large id like 12345678 is "12345678" and not "1.2345678e+07".
+func formatValue(val interface{}) string {
+	if num, ok := val.(float64); ok {
+		return strconv.FormatFloat(num, 'f', -1, 64)
+	}
+
+	return fmt.Sprint(val)
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExplode(t *testing.T) {
+	t.Parallel()
+
+	t.Run("child records reference the parent", func(t *testing.T) {
+		t.Parallel()
+
+		exp := &Explode{Field: "fills", Table: "fills"}
+		exp.setDefaults("orders")
+
+		data := []byte(`[{"id":"o1","fills":[{"size":1},{"size":2}]},{"id":"o2","fills":[]}]`)
+
+		job := &repoJob{table: "orders", b: data, transforms: &transforms{explode: []*Explode{exp}}}
+
+		reqs, err := job.upsertRequests(context.Background(), new(repoConfig))
+		if err != nil {
+			t.Fatalf("failed to explode records: %v", err)
+		}
+
+		if len(reqs) != 2 {
+			t.Fatalf("expected 2 requests, got %d", len(reqs))
+		}
+
+		if reqs[0].Table != "orders" || reqs[1].Table != "fills" {
+			t.Fatalf("unexpected tables: %q, %q", reqs[0].Table, reqs[1].Table)
+		}
+
+		var parents []map[string]interface{}
+		if err := json.Unmarshal(reqs[0].Data, &parents); err != nil {
+			t.Fatalf("failed to unmarshal parents: %v", err)
+		}
+
+		expParents := []map[string]interface{}{{"id": "o1"}, {"id": "o2"}}
+		if !reflect.DeepEqual(parents, expParents) {
+			t.Fatalf("expected %v, got %v", expParents, parents)
+		}
+
+		var children []map[string]interface{}
+		if err := json.Unmarshal(reqs[1].Data, &children); err != nil {
+			t.Fatalf("failed to unmarshal children: %v", err)
+		}
+
+		expChildren := []map[string]interface{}{
+			{"id": "o1:0", "size": 1.0, "orders_id": "o1"},
+			{"id": "o1:1", "size": 2.0, "orders_id": "o1"},
+		}
+		if !reflect.DeepEqual(children, expChildren) {
+			t.Fatalf("expected %v, got %v", expChildren, children)
+		}
+	})
+
+	t.Run("children keep their own keys", func(t *testing.T) {
+		t.Parallel()
+
+		exp := &Explode{Field: "tags", Table: "tags", ForeignKey: "book", ParentKey: "isbn"}
+		exp.setDefaults("books")
+
+		children, err := exp.explodeRecord(map[string]interface{}{
+			"isbn": "978", "tags": []interface{}{"a", map[string]interface{}{"id": "t2"}},
+		})
+		if err != nil {
+			t.Fatalf("failed to explode record: %v", err)
+		}
+
+		expChildren := []map[string]interface{}{
+			{"id": "978:0", "value": "a", "book": "978"},
+			{"id": "t2", "book": "978"},
+		}
+		if !reflect.DeepEqual(children, expChildren) {
+			t.Fatalf("expected %v, got %v", expChildren, children)
+		}
+	})
+
+	t.Run("numeric parent keys are not formatted with an exponent", func(t *testing.T) {
+		t.Parallel()
+
+		exp := &Explode{Field: "fills", Table: "fills"}
+		exp.setDefaults("orders")
+
+		var parent map[string]interface{}
+		if err := json.Unmarshal([]byte(`{"id":12345678,"fills":[{"size":1}]}`), &parent); err != nil {
+			t.Fatalf("failed to unmarshal parent: %v", err)
+		}
+
+		children, err := exp.explodeRecord(parent)
+		if err != nil {
+			t.Fatalf("failed to explode record: %v", err)
+		}
+
+		expChildren := []map[string]interface{}{{"id": "12345678:0", "size": 1.0, "orders_id": 12345678.0}}
+		if !reflect.DeepEqual(children, expChildren) {
+			t.Fatalf("expected %v, got %v", expChildren, children)
+		}
+	})
+
+	t.Run("parent key is required", func(t *testing.T) {
+		t.Parallel()
+
+		exp := &Explode{Field: "tags", Table: "tags"}
+		exp.setDefaults("books")
+
+		data := []byte(`[{"id":"b1","tags":["a"]},{"tags":["b"]}]`)
+		job := &repoJob{table: "books", b: data, transforms: &transforms{explode: []*Explode{exp}}}
+
+		_, err := job.upsertRequests(context.Background(), new(repoConfig))
+		if !errors.Is(err, ErrMissingParentKey) {
+			t.Fatalf("expected error %v, got %v", ErrMissingParentKey, err)
+		}
+
+		var rerr *recordError
+		if !errors.As(err, &rerr) || rerr.index != 1 {
+			t.Fatalf("expected the error of the second record, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestExplore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("openapi", func(t *testing.T) {
+		t.Parallel()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/openapi.yaml", func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte(`openapi: 3.0.0
+servers:
+  - url: /v1
+paths:
+  /products:
+    get:
+      summary: List products
+      parameters:
+        - {name: currency, in: query, required: true, schema: {default: USD}}
+        - {name: limit, in: query}
+  /products/{id}:
+    get:
+      operationId: getProduct
+  /orders:
+    post:
+      summary: Create an order
+`))
+		})
+		mux.HandleFunc("/v1/products", func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodGet && (req.URL.Query().Get("currency") != "USD" ||
+				req.Header.Get("Authorization") != "Bearer token") {
+				w.WriteHeader(http.StatusBadRequest)
+
+				return
+			}
+
+			_, _ = w.Write([]byte(`[{"id":1,"name":"a","price":1.5},{"id":2,"name":"b","price":2}]`))
+		})
+		mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodOptions {
+				w.Header().Set("Allow", "GET, OPTIONS")
+			}
+
+			w.WriteHeader(http.StatusNotFound)
+		})
+
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		exploration, err := Explore(ctx, server.Client(), server.URL, http.Header{"Authorization": {"Bearer token"}})
+		if err != nil {
+			t.Fatalf("failed to explore: %v", err)
+		}
+
+		if !reflect.DeepEqual(exploration.Methods, []string{"GET", "OPTIONS"}) {
+			t.Fatalf("expected the allowed methods, got %v", exploration.Methods)
+		}
+
+		if exploration.Document != server.URL+"/openapi.yaml" || len(exploration.Endpoints) != 3 {
+			t.Fatalf("expected the document to be found, got %q with %v", exploration.Document, exploration.Endpoints)
+		}
+
+		if ep := exploration.Endpoints[1]; ep.Path != "/products" || ep.Summary != "List products" ||
+			!reflect.DeepEqual(ep.Query, map[string]string{"currency": "USD"}) {
+			t.Fatalf("expected the endpoint with its required query, got %+v", ep)
+		}
+
+		if exploration.Sample != server.URL+"/v1/products?currency=USD" || exploration.SampleRecords != 2 ||
+			!reflect.DeepEqual(exploration.Fields, map[string]string{"id": "int", "name": "text", "price": "float"}) {
+			t.Fatalf("expected the products to be sampled, got %+v", exploration)
+		}
+
+		var stanza exploreStanza
+		if err := yaml.Unmarshal(exploration.Config, &stanza); err != nil {
+			t.Fatalf("failed to decode configuration: %v", err)
+		}
+
+		if stanza.URL != server.URL+"/v1" || len(stanza.Requests) != 1 || stanza.Requests[0].Table != "products" ||
+			stanza.Requests[0].Query["currency"] != "USD" {
+			t.Fatalf("expected a request for the products, got %s", exploration.Config)
+		}
+
+		if !strings.Contains(exploration.String(), "GET /products/{id} - getProduct") {
+			t.Fatalf("expected the endpoints to be reported, got %s", exploration)
+		}
+	})
+
+	t.Run("without document", func(t *testing.T) {
+		t.Parallel()
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/api/trades" {
+				w.WriteHeader(http.StatusNotFound)
+
+				return
+			}
+
+			_, _ = w.Write([]byte(`{"id":"t-1","time":"2023-01-04T15:30:00Z"}`))
+		}))
+		defer server.Close()
+
+		exploration, err := Explore(ctx, server.Client(), server.URL+"/api/trades?symbol=BTC", nil)
+		if err != nil {
+			t.Fatalf("failed to explore: %v", err)
+		}
+
+		if exploration.Document != "" || exploration.SampleRecords != 1 || exploration.Fields["time"] != "timestamp" {
+			t.Fatalf("expected the URL to be sampled, got %+v", exploration)
+		}
+
+		var stanza exploreStanza
+		if err := yaml.Unmarshal(exploration.Config, &stanza); err != nil {
+			t.Fatalf("failed to decode configuration: %v", err)
+		}
+
+		if stanza.URL != server.URL || len(stanza.Requests) != 1 || stanza.Requests[0].Endpoint != "/api/trades" ||
+			stanza.Requests[0].Table != "trades" || stanza.Requests[0].Query["symbol"] != "BTC" {
+			t.Fatalf("expected a request for the URL, got %s", exploration.Config)
+		}
+	})
+
+	t.Run("unsupported source", func(t *testing.T) {
+		t.Parallel()
+
+		for _, source := range []string{"grpc:///health", "ftp://example.com", "/api"} {
+			if _, err := Explore(ctx, http.DefaultClient, source, nil); !errors.Is(err, ErrUnsupportedExploreSource) {
+				t.Fatalf("expected error %v for %q, got %v", ErrUnsupportedExploreSource, source, err)
+			}
+		}
+	})
+}
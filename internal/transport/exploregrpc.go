@@ -0,0 +1,342 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// exploreRPCUnary and exploreRPCStream are the methods of the explored endpoints of a gRPC server.
+	exploreRPCUnary  = "RPC"
+	exploreRPCStream = "STREAM"
+
+	// grpcReflectionPrefix is the package of the reflection services, which are not listed.
+	grpcReflectionPrefix = "grpc.reflection."
+)
+
+var ErrGRPCReflection = fmt.Errorf("grpc server reflection failed")
+
+// GRPCReflectionError is returned when the services of a gRPC server can not be listed with server reflection.
+func GRPCReflectionError(err error) error {
+	return fmt.Errorf("%w: %v", ErrGRPCReflection, err)
+}
+
+// grpcMethod is a method of a service listed by server reflection.
+type grpcMethod struct {
+	desc protoreflect.MethodDescriptor
+
+	// path is the full path of the method, i.e. "/<package>.<service>/<method>", and get is the path of its HTTP GET
+	// binding, if it has one.
+	path string
+	get  string
+}
+
+// unary will return true if the method is neither client nor server streaming.
+func (method *grpcMethod) unary() bool {
+	return !method.desc.IsStreamingClient() && !method.desc.IsStreamingServer()
+}
+
+// exploreGRPC will probe the gRPC server at the URL with server reflection: the services of the server and their
+// methods are listed from the file descriptors that declare them, and the first unary method with an HTTP GET binding,
+// or else with a request message without fields, is sampled with an empty request. The "grpcs" scheme connects with
+// TLS. The header is sent as the metadata of every call, e.g. to authenticate.
+func exploreGRPC(ctx context.Context, client *http.Client, source *url.URL,
+	header http.Header,
+) (*Exploration, error) {
+	if client != nil && client.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, client.Timeout)
+		defer cancel()
+	}
+
+	creds := insecure.NewCredentials()
+	if source.Scheme == "grpcs" {
+		creds = credentials.NewTLS(compliance.TLSConfig(source.Hostname()))
+	}
+
+	conn, err := grpc.NewClient(source.Host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", source.Host, err)
+	}
+
+	defer conn.Close()
+
+	md := make(metadata.MD, len(header))
+	for key, values := range header {
+		md.Append(key, values...)
+	}
+
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	services, files, err := grpcReflect(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	methods, err := grpcMethods(services, files)
+	if err != nil {
+		return nil, err
+	}
+
+	exploration := &Exploration{URL: source.String(), Services: services, rpc: true}
+
+	for _, method := range methods {
+		ep := &ExploredEndpoint{Method: exploreRPCStream, Path: method.path}
+		if method.unary() {
+			ep.Method = exploreRPCUnary
+		}
+
+		ep.Summary = fmt.Sprintf("%s -> %s", method.desc.Input().FullName(), method.desc.Output().FullName())
+		if method.get != "" {
+			ep.Summary += fmt.Sprintf(" (GET %s)", method.get)
+		}
+
+		exploration.Endpoints = append(exploration.Endpoints, ep)
+	}
+
+	if sample := grpcSampleMethod(methods); sample != nil {
+		if err := grpcSample(ctx, conn, exploration, sample); err != nil {
+			return nil, err
+		}
+	}
+
+	if exploration.Config, err = grpcConfig(source, methods); err != nil {
+		return nil, err
+	}
+
+	return exploration, nil
+}
+
+// grpcReflectionRequest will send the request on the reflection stream and return its response.
+func grpcReflectionRequest(stream reflectionpb.ServerReflection_ServerReflectionInfoClient,
+	req *reflectionpb.ServerReflectionRequest,
+) (*reflectionpb.ServerReflectionResponse, error) {
+	if err := stream.Send(req); err != nil {
+		return nil, GRPCReflectionError(err)
+	}
+
+	rsp, err := stream.Recv()
+	if err != nil {
+		return nil, GRPCReflectionError(err)
+	}
+
+	if rerr := rsp.GetErrorResponse(); rerr != nil {
+		return nil, GRPCReflectionError(fmt.Errorf("%s (code %d)", rerr.GetErrorMessage(), rerr.GetErrorCode()))
+	}
+
+	return rsp, nil
+}
+
+// grpcReflect will list the services of the server, other than the reflection services, and return them with the
+// files that declare them and their dependencies.
+func grpcReflect(ctx context.Context, conn grpc.ClientConnInterface) ([]string, *protoregistry.Files, error) {
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, nil, GRPCReflectionError(err)
+	}
+
+	defer func() { _ = stream.CloseSend() }()
+
+	rsp, err := grpcReflectionRequest(stream, &reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var services []string
+
+	for _, svc := range rsp.GetListServicesResponse().GetService() {
+		if !strings.HasPrefix(svc.GetName(), grpcReflectionPrefix) {
+			services = append(services, svc.GetName())
+		}
+	}
+
+	sort.Strings(services)
+
+	// The server only sends the files that were not sent on the stream before, so the files of every service are
+	// collected before they are resolved.
+	set := new(descriptorpb.FileDescriptorSet)
+
+	for _, svc := range services {
+		rsp, err := grpcReflectionRequest(stream, &reflectionpb.ServerReflectionRequest{
+			MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: svc},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, raw := range rsp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			file := new(descriptorpb.FileDescriptorProto)
+			if err := proto.Unmarshal(raw, file); err != nil {
+				return nil, nil, GRPCReflectionError(err)
+			}
+
+			set.File = append(set.File, file)
+		}
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, nil, GRPCReflectionError(err)
+	}
+
+	return services, files, nil
+}
+
+// grpcMethods will return the methods of the services, in the order they are declared.
+func grpcMethods(services []string, files *protoregistry.Files) ([]*grpcMethod, error) {
+	var methods []*grpcMethod
+
+	for _, name := range services {
+		desc, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			return nil, GRPCReflectionError(err)
+		}
+
+		svc, ok := desc.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return nil, GRPCReflectionError(fmt.Errorf("%s is not a service", name))
+		}
+
+		for idx := 0; idx < svc.Methods().Len(); idx++ {
+			desc := svc.Methods().Get(idx)
+
+			method := &grpcMethod{desc: desc, path: fmt.Sprintf("/%s/%s", svc.FullName(), desc.Name())}
+			if rule, ok := proto.GetExtension(desc.Options(), annotations.E_Http).(*annotations.HttpRule); ok {
+				method.get = rule.GetGet()
+			}
+
+			methods = append(methods, method)
+		}
+	}
+
+	return methods, nil
+}
+
+// grpcSampleMethod will return the first unary method with an HTTP GET binding without path parameters, or else the
+// first unary method with a request message without fields, which can both be called with an empty request. It
+// returns nil if there is no such method.
+func grpcSampleMethod(methods []*grpcMethod) *grpcMethod {
+	var empty *grpcMethod
+
+	for _, method := range methods {
+		if !method.unary() {
+			continue
+		}
+
+		if method.get != "" && !strings.Contains(method.get, "{") {
+			return method
+		}
+
+		if empty == nil && method.desc.Input().Fields().Len() == 0 {
+			empty = method
+		}
+	}
+
+	return empty
+}
+
+// grpcSample will call the method with an empty request, and record the status of the call and the types of the
+// fields of the records of its response.
+func grpcSample(ctx context.Context, conn grpc.ClientConnInterface, exploration *Exploration,
+	method *grpcMethod,
+) error {
+	req := dynamicpb.NewMessage(method.desc.Input())
+	rsp := dynamicpb.NewMessage(method.desc.Output())
+
+	exploration.Sample = method.path
+
+	if err := conn.Invoke(ctx, method.path, req, rsp); err != nil {
+		exploration.SampleStatus = int(status.Code(err))
+
+		return nil
+	}
+
+	body, err := protojson.Marshal(rsp)
+	if err != nil {
+		return fmt.Errorf("unable to encode response of %s: %w", method.path, err)
+	}
+
+	// List responses hold their records in a repeated field, e.g. "books".
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err == nil && len(fields) == 1 {
+		for _, value := range fields {
+			if strings.HasPrefix(string(value), "[") {
+				body = value
+			}
+		}
+	}
+
+	exploration.sampleFields(body)
+
+	return nil
+}
+
+// grpcConfig will return the suggested configuration for the gRPC server: a request for every unary method with an
+// HTTP GET binding without path parameters, which is fetched through a proxy that serves the bindings, e.g.
+// grpc-gateway.
+func grpcConfig(source *url.URL, methods []*grpcMethod) ([]byte, error) {
+	scheme := "http"
+	if source.Scheme == "grpcs" {
+		scheme = "https"
+	}
+
+	stanza := &exploreStanza{
+		URL:               (&url.URL{Scheme: scheme, Host: source.Host}).String(),
+		RateLimit:         &exploreRateLimit{Burst: 1, Period: "1s"},
+		ConnectionStrings: []string{exploreConnectionString},
+		Requests:          []*exploreRequest{},
+	}
+
+	for _, method := range methods {
+		if !method.unary() || method.get == "" || strings.Contains(method.get, "{") {
+			continue
+		}
+
+		stanza.Requests = append(stanza.Requests, &exploreRequest{
+			Endpoint: method.get,
+			Table:    exploreTableName(method.get),
+		})
+	}
+
+	comments := []string{
+		"gRPC methods are fetched through their HTTP bindings (google.api.http), e.g. served by grpc-gateway.",
+		"Replace the URL with the address of the proxy, and the connection string.",
+	}
+
+	if len(stanza.Requests) == 0 {
+		comments = append(comments, "No unary method has an HTTP GET binding without path parameters.")
+	}
+
+	return encodeExploreStanza(stanza, comments...)
+}
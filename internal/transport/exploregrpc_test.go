@@ -0,0 +1,219 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"gopkg.in/yaml.v2"
+)
+
+// newTestGRPCServer will start a gRPC server with the health service and server reflection, and return its address
+// and the authorization metadata of the calls to the health service.
+func newTestGRPCServer(t *testing.T) (string, func() []string) {
+	t.Helper()
+
+	var (
+		mtx  sync.Mutex
+		auth []string
+	)
+
+	srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
+		info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+
+		mtx.Lock()
+		auth = append(auth, md.Get("authorization")...)
+		mtx.Unlock()
+
+		return handler(ctx, req)
+	}))
+
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	reflection.Register(srv)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	go func() { _ = srv.Serve(lis) }()
+
+	t.Cleanup(srv.Stop)
+
+	return lis.Addr().String(), func() []string {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		return append([]string(nil), auth...)
+	}
+}
+
+func TestExploreGRPC(t *testing.T) {
+	t.Parallel()
+
+	t.Run("reflection", func(t *testing.T) {
+		t.Parallel()
+
+		addr, auth := newTestGRPCServer(t)
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		header := http.Header{"Authorization": {"Bearer token"}}
+
+		exploration, err := Explore(context.Background(), client, "grpc://"+addr, header)
+		if err != nil {
+			t.Fatalf("failed to explore: %v", err)
+		}
+
+		if !reflect.DeepEqual(exploration.Services, []string{"grpc.health.v1.Health"}) {
+			t.Fatalf("expected the health service, got %v", exploration.Services)
+		}
+
+		methods := make(map[string]string)
+		for _, ep := range exploration.Endpoints {
+			methods[ep.Path] = ep.Method
+		}
+
+		expMethods := map[string]string{
+			"/grpc.health.v1.Health/Check": exploreRPCUnary,
+			"/grpc.health.v1.Health/List":  exploreRPCUnary,
+			"/grpc.health.v1.Health/Watch": exploreRPCStream,
+		}
+		if !reflect.DeepEqual(methods, expMethods) {
+			t.Fatalf("expected the methods %v, got %v", expMethods, methods)
+		}
+
+		// List is the first unary method with a request message without fields.
+		if exploration.Sample != "/grpc.health.v1.Health/List" || exploration.SampleStatus != 0 ||
+			exploration.SampleRecords != 1 || exploration.Fields["statuses"] != "json" {
+			t.Fatalf("expected the health statuses to be sampled, got %+v", exploration)
+		}
+
+		if got := auth(); !reflect.DeepEqual(got, []string{"Bearer token"}) {
+			t.Fatalf("expected the header to be sent as metadata, got %v", got)
+		}
+
+		report := exploration.String()
+		if !strings.Contains(report, "services: grpc.health.v1.Health") ||
+			!strings.Contains(report, "sample: RPC /grpc.health.v1.Health/List -> OK, 1 records") {
+			t.Fatalf("expected the services and the sample to be reported, got %s", report)
+		}
+
+		var stanza exploreStanza
+		if err := yaml.Unmarshal(exploration.Config, &stanza); err != nil {
+			t.Fatalf("failed to decode configuration: %v", err)
+		}
+
+		if stanza.URL != "http://"+addr || len(stanza.Requests) != 0 {
+			t.Fatalf("expected a configuration without requests, got %s", exploration.Config)
+		}
+	})
+
+	t.Run("http bindings", func(t *testing.T) {
+		t.Parallel()
+
+		methodOptions := func(get string) *descriptorpb.MethodOptions {
+			opts := new(descriptorpb.MethodOptions)
+			proto.SetExtension(opts, annotations.E_Http, &annotations.HttpRule{
+				Pattern: &annotations.HttpRule_Get{Get: get},
+			})
+
+			return opts
+		}
+
+		file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+			Name:    proto.String("books.proto"),
+			Package: proto.String("books.v1"),
+			Syntax:  proto.String("proto3"),
+			MessageType: []*descriptorpb.DescriptorProto{
+				{Name: proto.String("ListBooksRequest")},
+				{Name: proto.String("GetBookRequest"), Field: []*descriptorpb.FieldDescriptorProto{{
+					Name:     proto.String("id"),
+					JsonName: proto.String("id"),
+					Number:   proto.Int32(1),
+					Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+					Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				}}},
+				{Name: proto.String("Book")},
+			},
+			Service: []*descriptorpb.ServiceDescriptorProto{{
+				Name: proto.String("Books"),
+				Method: []*descriptorpb.MethodDescriptorProto{
+					{
+						Name:       proto.String("GetBook"),
+						InputType:  proto.String(".books.v1.GetBookRequest"),
+						OutputType: proto.String(".books.v1.Book"),
+						Options:    methodOptions("/v1/books/{id}"),
+					},
+					{
+						Name:       proto.String("ListBooks"),
+						InputType:  proto.String(".books.v1.ListBooksRequest"),
+						OutputType: proto.String(".books.v1.Book"),
+						Options:    methodOptions("/v1/books"),
+					},
+				},
+			}},
+		}, nil)
+		if err != nil {
+			t.Fatalf("failed to build file: %v", err)
+		}
+
+		files := new(protoregistry.Files)
+		if err := files.RegisterFile(file); err != nil {
+			t.Fatalf("failed to register file: %v", err)
+		}
+
+		methods, err := grpcMethods([]string{"books.v1.Books"}, files)
+		if err != nil {
+			t.Fatalf("failed to list methods: %v", err)
+		}
+
+		if sample := grpcSampleMethod(methods); sample == nil || sample.path != "/books.v1.Books/ListBooks" {
+			t.Fatalf("expected the books to be sampled, got %+v", sample)
+		}
+
+		source, err := url.Parse("grpcs://books.test:443")
+		if err != nil {
+			t.Fatalf("failed to parse source: %v", err)
+		}
+
+		config, err := grpcConfig(source, methods)
+		if err != nil {
+			t.Fatalf("failed to build configuration: %v", err)
+		}
+
+		var stanza exploreStanza
+		if err := yaml.Unmarshal(config, &stanza); err != nil {
+			t.Fatalf("failed to decode configuration: %v", err)
+		}
+
+		if stanza.URL != "https://books.test:443" || len(stanza.Requests) != 1 ||
+			stanza.Requests[0].Endpoint != "/v1/books" || stanza.Requests[0].Table != "books" {
+			t.Fatalf("expected a request for the books binding, got %s", config)
+		}
+	})
+}
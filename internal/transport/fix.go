@@ -0,0 +1,554 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+	"github.com/quickfixgo/quickfix"
+)
+
+const (
+	// fixDefaultBeginString is the default version of the FIX protocol.
+	fixDefaultBeginString = "FIX.4.4"
+
+	// fixDefaultHeartbeat is the default heartbeat interval of the session.
+	fixDefaultHeartbeat = 30 * time.Second
+
+	// fixBuffer is the number of messages buffered from the session.
+	fixBuffer = 1024
+
+	// fixRequestMethod is the method of the request written for a FIX source, e.g. to the archive.
+	fixRequestMethod = "FIX"
+
+	fixTagSymbol         = 55
+	fixTagMDReqID        = 262
+	fixTagSubscription   = 263
+	fixTagMarketDepth    = 264
+	fixTagMDUpdateType   = 265
+	fixTagNoMDEntryTypes = 267
+	fixTagNoMDEntries    = 268
+	fixTagMDEntryType    = 269
+	fixTagNoRelatedSym   = 146
+	fixTagUsername       = 553
+	fixTagPassword       = 554
+
+	fixMsgTypeMarketDataReject = "Y"
+	fixMsgTypeBusinessReject   = "j"
+)
+
+var (
+	ErrInvalidFIX = fmt.Errorf("invalid fix source")
+	ErrFIXMessage = fmt.Errorf("unable to convert fix message")
+	ErrFIXSession = fmt.Errorf("fix session failed")
+)
+
+// InvalidFIXError is returned when the FIX configuration of a request is not valid.
+func InvalidFIXError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidFIX, reason)
+}
+
+// FIXMessageError is returned when a FIX message can not be converted to a record.
+func FIXMessageError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrFIXMessage, reason)
+}
+
+// FIXSessionError is returned when the FIX session can not be opened or read, or the counterparty rejects the market
+// data request.
+func FIXSessionError(err error) error {
+	return fmt.Errorf("%w: %v", ErrFIXSession, err)
+}
+
+// fixKind is how the value of a FIX field is written to a record.
+type fixKind int
+
+const (
+	fixString fixKind = iota
+	fixInt
+	fixFloat
+	fixTime
+)
+
+// fixField is the name of a FIX field on a record, and how its value is written.
+type fixField struct {
+	name string
+	kind fixKind
+}
+
+// fixFields are the names of the fields of execution reports and market data messages. Fields that are not in the
+// dictionary are written as "tag" and the number of the tag, e.g. "tag9001".
+var fixFields = map[int]fixField{
+	1:   {"account", fixString},
+	6:   {"avgPx", fixFloat},
+	11:  {"clOrdID", fixString},
+	12:  {"commission", fixFloat},
+	13:  {"commType", fixString},
+	14:  {"cumQty", fixFloat},
+	15:  {"currency", fixString},
+	17:  {"execID", fixString},
+	20:  {"execTransType", fixString},
+	30:  {"lastMkt", fixString},
+	31:  {"lastPx", fixFloat},
+	32:  {"lastQty", fixFloat},
+	34:  {"msgSeqNum", fixInt},
+	35:  {"msgType", fixString},
+	37:  {"orderID", fixString},
+	38:  {"orderQty", fixFloat},
+	39:  {"ordStatus", fixString},
+	40:  {"ordType", fixString},
+	41:  {"origClOrdID", fixString},
+	44:  {"price", fixFloat},
+	48:  {"securityID", fixString},
+	49:  {"senderCompID", fixString},
+	52:  {"sendingTime", fixTime},
+	54:  {"side", fixString},
+	55:  {"symbol", fixString},
+	56:  {"targetCompID", fixString},
+	58:  {"text", fixString},
+	59:  {"timeInForce", fixString},
+	60:  {"transactTime", fixTime},
+	64:  {"settlDate", fixString},
+	75:  {"tradeDate", fixString},
+	99:  {"stopPx", fixFloat},
+	103: {"ordRejReason", fixString},
+	150: {"execType", fixString},
+	151: {"leavesQty", fixFloat},
+	167: {"securityType", fixString},
+	207: {"securityExchange", fixString},
+	262: {"mdReqID", fixString},
+	269: {"mdEntryType", fixString},
+	270: {"mdEntryPx", fixFloat},
+	271: {"mdEntrySize", fixFloat},
+	272: {"mdEntryDate", fixString},
+	273: {"mdEntryTime", fixString},
+	278: {"mdEntryID", fixString},
+	279: {"mdUpdateAction", fixString},
+	280: {"mdEntryRefID", fixString},
+	290: {"mdEntryPositionNo", fixInt},
+	346: {"numberOfOrders", fixInt},
+	527: {"secondaryExecID", fixString},
+	851: {"lastLiquidityInd", fixString},
+}
+
+// fixSkipped are the fields of the header and the trailer that are not written to records.
+var fixSkipped = map[int]bool{
+	web.FIXTagBeginString:  true,
+	web.FIXTagBodyLength:   true,
+	web.FIXTagCheckSum:     true,
+	web.FIXTagTargetCompID: true,
+	fixTagNoMDEntries:      true,
+}
+
+// FIX is the configuration for capturing the messages of a FIX session, for data providers that only offer FIX. The
+// session is an initiator that logs on to the counterparty at "Address", subscribes to the market data of
+// "Symbols", and writes the messages of "MsgTypes" it receives for "Duration" as records.
+//
+// Every field of a message is written to the record by name, with the message type in "msgType". Each entry of a
+// market data message is written as a record of its own, with the fields of the message. Repeating groups other than
+// the market data entries are flattened to their first entry.
+type FIX struct {
+	// Address is the "host:port" of the counterparty.
+	Address string `yaml:"address"`
+
+	// TLS connects to the counterparty over TLS.
+	TLS bool `yaml:"tls"`
+
+	// BeginString is the version of the protocol, "FIX.4.4" by default.
+	BeginString string `yaml:"beginString"`
+
+	// SenderCompID and TargetCompID identify the session.
+	SenderCompID string `yaml:"senderCompID"`
+	TargetCompID string `yaml:"targetCompID"`
+
+	// Username and Password are sent on the logon, if the counterparty requires them.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Heartbeat is the heartbeat interval of the session, 30 seconds by default.
+	Heartbeat time.Duration `yaml:"heartbeat"`
+
+	// Symbols are the instruments of the market data request sent after the logon. If empty, no market data is
+	// requested, e.g. for a drop copy session of execution reports.
+	Symbols []string `yaml:"symbols"`
+
+	// EntryTypes are the MDEntryType values of the market data request, bids, offers, and trades by default.
+	EntryTypes []string `yaml:"entryTypes"`
+
+	// Depth is the MarketDepth of the market data request, the full book by default.
+	Depth int `yaml:"depth"`
+
+	// MsgTypes are the types of the messages written as records, execution reports and market data by default.
+	MsgTypes []string `yaml:"msgTypes"`
+
+	// Duration is how long the session is captured for each run.
+	Duration time.Duration `yaml:"duration"`
+
+	// dial opens the session, a FIX initiator unless it is set by tests.
+	dial func(ctx context.Context, addr string, cfg web.FIXSessionConfig) (fixStream, error)
+
+	// firstOnly writes the records of the first message written, to sample the schema.
+	firstOnly bool
+}
+
+// fixStream is the stream of the application messages of the session.
+type fixStream interface {
+	ReadMessage() (web.FIXMessage, error)
+	WriteMessage(msg *quickfix.Message) error
+	Close() error
+}
+
+// dialFIXStream will open the FIX session.
+func dialFIXStream(ctx context.Context, addr string, cfg web.FIXSessionConfig) (fixStream, error) {
+	return web.DialFIX(ctx, addr, cfg)
+}
+
+func (fx *FIX) validate(req *Request) error {
+	if fx.Address == "" {
+		return MissingConfigFieldError("fix.address")
+	}
+
+	if _, _, err := net.SplitHostPort(fx.Address); err != nil {
+		return InvalidFIXError(fmt.Sprintf("address %q must be host:port", fx.Address))
+	}
+
+	if fx.SenderCompID == "" {
+		return MissingConfigFieldError("fix.senderCompID")
+	}
+
+	if fx.TargetCompID == "" {
+		return MissingConfigFieldError("fix.targetCompID")
+	}
+
+	if fx.Duration <= 0 {
+		return MissingConfigFieldError("fix.duration")
+	}
+
+	if fx.Depth < 0 {
+		return InvalidFIXError("fix.depth can not be negative")
+	}
+
+	if fx.Heartbeat != 0 && fx.Heartbeat < time.Second {
+		return InvalidFIXError("fix.heartbeat must be at least one second")
+	}
+
+	if req.Timeseries != nil || req.Paginate != nil || req.Prometheus != nil || req.OrderBook != nil {
+		return InvalidFIXError("fix can not be combined with timeseries, paginate, prometheus, or orderBook")
+	}
+
+	return nil
+}
+
+func (fx *FIX) setDefaults() {
+	if fx.BeginString == "" {
+		fx.BeginString = fixDefaultBeginString
+	}
+
+	if fx.Heartbeat == 0 {
+		fx.Heartbeat = fixDefaultHeartbeat
+	}
+
+	if len(fx.EntryTypes) == 0 {
+		fx.EntryTypes = []string{"0", "1", "2"}
+	}
+
+	if len(fx.MsgTypes) == 0 {
+		fx.MsgTypes = []string{web.FIXMsgTypeExecutionRpt, web.FIXMsgTypeMarketDataFull, web.FIXMsgTypeMarketDataIncr}
+	}
+}
+
+// sessionConfig will return the configuration of the session, with the credentials on the logon.
+func (fx *FIX) sessionConfig() web.FIXSessionConfig {
+	cfg := web.FIXSessionConfig{
+		BeginString:  fx.BeginString,
+		SenderCompID: fx.SenderCompID,
+		TargetCompID: fx.TargetCompID,
+		Heartbeat:    fx.Heartbeat,
+		TLS:          fx.TLS,
+	}
+
+	if fx.Username != "" {
+		cfg.Logon = append(cfg.Logon, web.FIXField{Tag: fixTagUsername, Value: fx.Username})
+	}
+
+	if fx.Password != "" {
+		cfg.Logon = append(cfg.Logon, web.FIXField{Tag: fixTagPassword, Value: fx.Password})
+	}
+
+	return cfg
+}
+
+// marketDataRequest will return the request for snapshots and incremental updates of the symbols.
+func (fx *FIX) marketDataRequest() *quickfix.Message {
+	msg := quickfix.NewMessage()
+	msg.Header.SetString(web.FIXTagMsgType, web.FIXMsgTypeMarketDataReq)
+	msg.Body.SetString(fixTagMDReqID, uuid.New().String())
+	msg.Body.SetString(fixTagSubscription, "1")
+	msg.Body.SetInt(fixTagMarketDepth, fx.Depth)
+	msg.Body.SetString(fixTagMDUpdateType, "1")
+
+	entryTypes := quickfix.NewRepeatingGroup(fixTagNoMDEntryTypes,
+		quickfix.GroupTemplate{quickfix.GroupElement(fixTagMDEntryType)})
+	for _, entryType := range fx.EntryTypes {
+		entryTypes.Add().SetString(fixTagMDEntryType, entryType)
+	}
+
+	symbols := quickfix.NewRepeatingGroup(fixTagNoRelatedSym,
+		quickfix.GroupTemplate{quickfix.GroupElement(fixTagSymbol)})
+	for _, symbol := range fx.Symbols {
+		symbols.Add().SetString(fixTagSymbol, symbol)
+	}
+
+	msg.Body.SetGroup(entryTypes)
+	msg.Body.SetGroup(symbols)
+
+	return msg
+}
+
+// capture will log on to the session, request the market data of the symbols, and return the records of the
+// messages received for "Duration" as a JSON array. The request returned stands for the session, with the "FIX"
+// method and a "fix://" URL of the address and the TargetCompID. The size of each message is counted as downloaded
+// by the usage tracker.
+func (fx *FIX) capture(ctx context.Context, usage *usageTracker) (*http.Request, []byte, error) {
+	captureCtx, cancel := context.WithTimeout(ctx, fx.Duration)
+	defer cancel()
+
+	dial := fx.dial
+	if dial == nil {
+		dial = dialFIXStream
+	}
+
+	stream, err := dial(captureCtx, fx.Address, fx.sessionConfig())
+	if err != nil {
+		return nil, nil, FIXSessionError(err)
+	}
+
+	// Closing the stream at the end of the capture logs out and unblocks the reader.
+	go func() {
+		<-captureCtx.Done()
+		stream.Close()
+	}()
+
+	messages := make(chan web.FIXMessage, fixBuffer)
+	streamErr := make(chan error, 1)
+
+	go func() {
+		defer close(messages)
+
+		for {
+			msg, err := stream.ReadMessage()
+			if err != nil {
+				streamErr <- err
+
+				return
+			}
+
+			usage.download(msg.Len())
+
+			select {
+			case messages <- msg:
+			case <-captureCtx.Done():
+				return
+			}
+		}
+	}()
+
+	if len(fx.Symbols) > 0 {
+		if err := stream.WriteMessage(fx.marketDataRequest()); err != nil {
+			return nil, nil, FIXSessionError(err)
+		}
+	}
+
+	msgTypes := make(map[string]bool, len(fx.MsgTypes))
+	for _, msgType := range fx.MsgTypes {
+		msgTypes[msgType] = true
+	}
+
+	records := []map[string]interface{}{}
+
+	// finish will return the records, unless the capture was canceled rather than completed.
+	finish := func() (*http.Request, []byte, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		return fx.marshal(ctx, records)
+	}
+
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				if captureCtx.Err() != nil {
+					return finish()
+				}
+
+				return nil, nil, FIXSessionError(<-streamErr)
+			}
+
+			switch msg.Type() {
+			case fixMsgTypeMarketDataReject, fixMsgTypeBusinessReject:
+				text, _ := msg.Get(web.FIXTagText)
+
+				return nil, nil, FIXSessionError(fmt.Errorf("market data request rejected: %s", text))
+			}
+
+			if !msgTypes[msg.Type()] {
+				continue
+			}
+
+			converted, err := fixRecords(msg)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			records = append(records, converted...)
+
+			if fx.firstOnly {
+				return fx.marshal(ctx, records)
+			}
+		case <-captureCtx.Done():
+			return finish()
+		}
+	}
+}
+
+// marshal will return the request of the session and the records as a JSON array.
+func (fx *FIX) marshal(ctx context.Context, records []map[string]interface{}) (*http.Request, []byte, error) {
+	uri := &url.URL{Scheme: "fix", Host: fx.Address, Path: "/" + fx.TargetCompID}
+
+	req, err := http.NewRequestWithContext(ctx, fixRequestMethod, uri.String(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create request: %w", err)
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+	}
+
+	return req, data, nil
+}
+
+// fixRecords will convert a message to records. A message with market data entries is converted to a record for
+// each entry, and other messages to a single record.
+func fixRecords(msg web.FIXMessage) ([]map[string]interface{}, error) {
+	record := make(map[string]interface{})
+	fields := msg
+
+	for idx, field := range msg {
+		if field.Tag == fixTagNoMDEntries {
+			fields = msg[:idx]
+
+			break
+		}
+	}
+
+	if err := setFIXFields(record, fields); err != nil {
+		return nil, err
+	}
+
+	if len(fields) == len(msg) {
+		return []map[string]interface{}{record}, nil
+	}
+
+	// The entries of the group start with the first field after its count, which every entry repeats.
+	entries := msg[len(fields)+1:]
+	if value, _ := msg.Get(fixTagNoMDEntries); value == "0" || len(entries) == 0 {
+		return nil, nil
+	}
+
+	records := []map[string]interface{}{}
+
+	for start := 0; start < len(entries); {
+		end := start + 1
+		for end < len(entries) && entries[end].Tag != entries[start].Tag {
+			end++
+		}
+
+		entry := make(map[string]interface{}, len(record))
+		for key, value := range record {
+			entry[key] = value
+		}
+
+		if err := setFIXFields(entry, entries[start:end]); err != nil {
+			return nil, err
+		}
+
+		records = append(records, entry)
+		start = end
+	}
+
+	return records, nil
+}
+
+// setFIXFields will set the fields on the record by name, keeping the first value of a repeated field.
+func setFIXFields(record map[string]interface{}, fields []web.FIXField) error {
+	set := make(map[int]bool, len(fields))
+
+	for _, field := range fields {
+		if fixSkipped[field.Tag] || set[field.Tag] {
+			continue
+		}
+
+		set[field.Tag] = true
+
+		def, ok := fixFields[field.Tag]
+		if !ok {
+			def = fixField{name: "tag" + strconv.Itoa(field.Tag), kind: fixString}
+		}
+
+		value, err := fixValue(def, field.Value)
+		if err != nil {
+			return err
+		}
+
+		record[def.name] = value
+	}
+
+	return nil
+}
+
+// fixValue will convert the value of a field to the kind of the field. Timestamps are written as RFC 3339.
+func fixValue(def fixField, value string) (interface{}, error) {
+	switch def.kind {
+	case fixInt:
+		num, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, FIXMessageError(fmt.Sprintf("invalid integer %q in field %q", value, def.name))
+		}
+
+		return num, nil
+	case fixFloat:
+		num, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, FIXMessageError(fmt.Sprintf("invalid number %q in field %q", value, def.name))
+		}
+
+		return num, nil
+	case fixTime:
+		// Fractional seconds are parsed even though the layout has none.
+		ts, err := time.Parse("20060102-15:04:05", value)
+		if err != nil {
+			return nil, FIXMessageError(fmt.Sprintf("invalid timestamp %q in field %q", value, def.name))
+		}
+
+		return ts.UTC().Format(time.RFC3339Nano), nil
+	default:
+		return value, nil
+	}
+}
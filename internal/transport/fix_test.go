@@ -0,0 +1,237 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+	"github.com/quickfixgo/quickfix"
+)
+
+// fakeFIXStream is a session that sends its messages, and then blocks until it is closed.
+type fakeFIXStream struct {
+	messages chan web.FIXMessage
+	closed   chan struct{}
+	once     sync.Once
+
+	mtx     sync.Mutex
+	written []*quickfix.Message
+}
+
+// newFakeFIXStream will return a session of the messages, each as "tag=value" pairs separated by "|".
+func newFakeFIXStream(messages ...string) *fakeFIXStream {
+	stream := &fakeFIXStream{messages: make(chan web.FIXMessage, len(messages)), closed: make(chan struct{})}
+
+	for _, raw := range messages {
+		var msg web.FIXMessage
+
+		for _, pair := range strings.Split(raw, "|") {
+			tag, value, _ := strings.Cut(pair, "=")
+			num, _ := strconv.Atoi(tag)
+			msg = append(msg, web.FIXField{Tag: num, Value: value})
+		}
+
+		stream.messages <- msg
+	}
+
+	return stream
+}
+
+func (stream *fakeFIXStream) ReadMessage() (web.FIXMessage, error) {
+	select {
+	case msg := <-stream.messages:
+		return msg, nil
+	case <-stream.closed:
+		return nil, errors.New("closed")
+	}
+}
+
+func (stream *fakeFIXStream) WriteMessage(msg *quickfix.Message) error {
+	stream.mtx.Lock()
+	defer stream.mtx.Unlock()
+
+	stream.written = append(stream.written, msg)
+
+	return nil
+}
+
+func (stream *fakeFIXStream) Close() error {
+	stream.once.Do(func() { close(stream.closed) })
+
+	return nil
+}
+
+func TestFIX(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	newFIX := func(stream fixStream) *FIX {
+		fx := &FIX{
+			Address:      "fix.venue.example:9878",
+			SenderCompID: "GIDARI",
+			TargetCompID: "VENUE",
+			Username:     "user",
+			Symbols:      []string{"BTC-USD"},
+			Duration:     200 * time.Millisecond,
+			dial: func(_ context.Context, _ string, cfg web.FIXSessionConfig) (fixStream, error) {
+				if len(cfg.Logon) != 1 || cfg.Logon[0].Value != "user" || cfg.BeginString != "FIX.4.4" {
+					return nil, errors.New("unexpected session config")
+				}
+
+				return stream, nil
+			},
+		}
+		fx.setDefaults()
+
+		return fx
+	}
+
+	t.Run("capture", func(t *testing.T) {
+		t.Parallel()
+
+		stream := newFakeFIXStream(
+			"35=8|34=2|49=VENUE|52=20230104-15:30:00.125|37=order-1|17=exec-1|150=F|39=2|55=BTC-USD|54=1|"+
+				"31=16800.5|32=0.25|453=2|448=broker|448=desk|9001=custom",
+			"35=W|34=3|49=VENUE|52=20230104-15:30:01|262=req|55=BTC-USD|268=2|269=0|270=16800|271=1.5|"+
+				"269=1|270=16801|271=2",
+			"35=h|34=4|49=VENUE|336=open",
+			"35=X|34=5|49=VENUE|52=20230104-15:30:02|268=1|279=2|269=0|55=BTC-USD|270=16800|271=0",
+		)
+
+		req, body, err := newFIX(stream).capture(ctx, nil)
+		if err != nil {
+			t.Fatalf("failed to capture session: %v", err)
+		}
+
+		if req.Method != fixRequestMethod || req.URL.String() != "fix://fix.venue.example:9878/VENUE" {
+			t.Fatalf("expected the request of the session, got %s %s", req.Method, req.URL)
+		}
+
+		var records []map[string]interface{}
+		if err := json.Unmarshal(body, &records); err != nil {
+			t.Fatalf("failed to decode records: %v", err)
+		}
+
+		exp := []map[string]interface{}{
+			{
+				"msgType": "8", "msgSeqNum": 2.0, "senderCompID": "VENUE", "sendingTime": "2023-01-04T15:30:00.125Z",
+				"orderID": "order-1", "execID": "exec-1", "execType": "F", "ordStatus": "2", "symbol": "BTC-USD",
+				"side": "1", "lastPx": 16800.5, "lastQty": 0.25, "tag453": "2", "tag448": "broker", "tag9001": "custom",
+			},
+			{
+				"msgType": "W", "msgSeqNum": 3.0, "senderCompID": "VENUE", "sendingTime": "2023-01-04T15:30:01Z",
+				"mdReqID": "req", "symbol": "BTC-USD", "mdEntryType": "0", "mdEntryPx": 16800.0, "mdEntrySize": 1.5,
+			},
+			{
+				"msgType": "W", "msgSeqNum": 3.0, "senderCompID": "VENUE", "sendingTime": "2023-01-04T15:30:01Z",
+				"mdReqID": "req", "symbol": "BTC-USD", "mdEntryType": "1", "mdEntryPx": 16801.0, "mdEntrySize": 2.0,
+			},
+			{
+				"msgType": "X", "msgSeqNum": 5.0, "senderCompID": "VENUE", "sendingTime": "2023-01-04T15:30:02Z",
+				"mdUpdateAction": "2", "mdEntryType": "0", "symbol": "BTC-USD", "mdEntryPx": 16800.0, "mdEntrySize": 0.0,
+			},
+		}
+
+		if !reflect.DeepEqual(records, exp) {
+			t.Fatalf("expected records %v, got %v", exp, records)
+		}
+
+		if len(stream.written) != 1 || !stream.written[0].IsMsgTypeOf(web.FIXMsgTypeMarketDataReq) {
+			t.Fatalf("expected the market data request to be sent, got %v", stream.written)
+		}
+
+		symbols := quickfix.NewRepeatingGroup(fixTagNoRelatedSym,
+			quickfix.GroupTemplate{quickfix.GroupElement(fixTagSymbol)})
+		if err := stream.written[0].Body.GetGroup(symbols); err != nil || symbols.Len() != 1 {
+			t.Fatalf("expected the market data of the symbol to be requested, got %v", stream.written[0])
+		}
+
+		if symbol, _ := symbols.Get(0).GetString(fixTagSymbol); symbol != "BTC-USD" {
+			t.Fatalf("expected the market data of the symbol to be requested, got %v", stream.written[0])
+		}
+	})
+
+	t.Run("sample", func(t *testing.T) {
+		t.Parallel()
+
+		fx := newFIX(newFakeFIXStream("35=0|34=2", "35=8|34=3|17=exec-1", "35=8|34=4|17=exec-2"))
+		fx.Duration = time.Hour
+		fx.firstOnly = true
+
+		_, body, err := fx.capture(ctx, nil)
+		if err != nil {
+			t.Fatalf("failed to sample session: %v", err)
+		}
+
+		var records []map[string]interface{}
+		if err := json.Unmarshal(body, &records); err != nil || len(records) != 1 || records[0]["execID"] != "exec-1" {
+			t.Fatalf("expected the record of the first message, got %s: %v", body, err)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		t.Parallel()
+
+		stream := newFakeFIXStream("35=Y|34=2|262=req|58=unknown symbol")
+		if _, _, err := newFIX(stream).capture(ctx, nil); !errors.Is(err, ErrFIXSession) ||
+			!strings.Contains(err.Error(), "unknown symbol") {
+			t.Fatalf("expected error %v, got %v", ErrFIXSession, err)
+		}
+	})
+
+	t.Run("invalid message", func(t *testing.T) {
+		t.Parallel()
+
+		stream := newFakeFIXStream("35=8|34=2|31=abc")
+		if _, _, err := newFIX(stream).capture(ctx, nil); !errors.Is(err, ErrFIXMessage) {
+			t.Fatalf("expected error %v, got %v", ErrFIXMessage, err)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		valid := FIX{Address: "fix.venue.example:9878", SenderCompID: "GIDARI", TargetCompID: "VENUE",
+			Duration: time.Minute}
+
+		noTarget := valid
+		noTarget.TargetCompID = ""
+
+		noPort := valid
+		noPort.Address = "fix.venue.example"
+
+		shortHeartbeat := valid
+		shortHeartbeat.Heartbeat = time.Millisecond
+
+		for _, tc := range []struct {
+			fx  FIX
+			req *Request
+			err error
+		}{
+			{noTarget, new(Request), ErrMissingConfigField},
+			{noPort, new(Request), ErrInvalidFIX},
+			{shortHeartbeat, new(Request), ErrInvalidFIX},
+			{valid, &Request{OrderBook: &OrderBook{}}, ErrInvalidFIX},
+			{valid, new(Request), nil},
+		} {
+			if err := tc.fx.validate(tc.req); !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v for %+v, got %v", tc.err, tc.fx, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,603 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+)
+
+const (
+	// imapRequestMethod is the method of the request written for an IMAP source, e.g. to the archive.
+	imapRequestMethod = "IMAP"
+
+	// imapDefaultMailbox is the default mailbox searched for messages.
+	imapDefaultMailbox = "INBOX"
+
+	// imapDefaultProcessedFlag is the default flag of the messages that have been processed.
+	imapDefaultProcessedFlag = `\Seen`
+
+	// IMAPFormatCSV, IMAPFormatJSONL, and IMAPFormatJSON are the formats of the attachments: CSV with a header row,
+	// newline-delimited JSON objects, and a JSON object or array of objects.
+	IMAPFormatCSV   = "csv"
+	IMAPFormatJSONL = "jsonl"
+	IMAPFormatJSON  = "json"
+
+	// imapMessageIDField, imapFromField, imapSubjectField, imapDateField, imapAttachmentField, and imapRowField are
+	// the fields of the message and the attachment of each record, and of the position of the record in the
+	// attachment, starting at 1.
+	imapMessageIDField  = "_messageId"
+	imapFromField       = "_from"
+	imapSubjectField    = "_subject"
+	imapDateField       = "_date"
+	imapAttachmentField = "_attachment"
+	imapRowField        = "_row"
+)
+
+var (
+	ErrInvalidIMAP = fmt.Errorf("invalid imap source")
+	ErrIMAPFetch   = fmt.Errorf("imap fetch failed")
+	ErrIMAPMark    = fmt.Errorf("unable to mark imap messages processed")
+)
+
+// InvalidIMAPError is returned when the IMAP source of a request is not valid.
+func InvalidIMAPError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidIMAP, reason)
+}
+
+// IMAPFetchError is returned when the messages of an IMAP source can not be fetched or parsed.
+func IMAPFetchError(err error) error {
+	return fmt.Errorf("%w: %v", ErrIMAPFetch, err)
+}
+
+// IMAPMarkError is returned when the messages of an IMAP source can not be marked processed after the run commits.
+func IMAPMarkError(err error) error {
+	return fmt.Errorf("%w: %v", ErrIMAPMark, err)
+}
+
+// imapFormats are the formats of the attachments, by file extension.
+var imapFormats = map[string]string{
+	".csv":    IMAPFormatCSV,
+	".tsv":    IMAPFormatCSV,
+	".jsonl":  IMAPFormatJSONL,
+	".ndjson": IMAPFormatJSONL,
+	".json":   IMAPFormatJSON,
+}
+
+// IMAP is the configuration for ingesting the attachments of the messages of a mailbox instead of requesting the
+// endpoint, e.g. the daily CSV reports that partners email. Each row of each attachment is a record, with the fields of
+// its message and attachment. Once the run commits, the messages are marked processed, so that the next run skips
+// them.
+type IMAP struct {
+	// Address is the "host:port" of the server, e.g. "imap.gmail.com:993".
+	Address string `yaml:"address"`
+
+	// TLS connects to the server over TLS, i.e. IMAPS.
+	TLS bool `yaml:"tls"`
+
+	// Username and Password are the credentials of the login, e.g. an app password.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Mailbox is the mailbox searched for messages, "INBOX" by default.
+	Mailbox string `yaml:"mailbox"`
+
+	// From are the senders of the messages, any of which matches a substring of the "From" header, e.g. a domain.
+	From []string `yaml:"from"`
+
+	// Subject matches a substring of the subject of the messages.
+	Subject string `yaml:"subject"`
+
+	// Since is how far back messages are searched, e.g. "168h". By default, every message is searched.
+	Since time.Duration `yaml:"since"`
+
+	// Attachments is the pattern of the file names of the attachments ingested, e.g. "report_*.csv". By default,
+	// every attachment is ingested.
+	Attachments string `yaml:"attachments"`
+
+	// Format is the format of the attachments, "csv", "jsonl", or "json". By default, the format is determined by the
+	// extension of each attachment, and attachments with another extension are skipped.
+	Format string `yaml:"format"`
+
+	// Delimiter is the delimiter of the fields of CSV attachments, "," by default, or a tab for ".tsv" files.
+	Delimiter string `yaml:"delimiter"`
+
+	// ProcessedFlag is the flag of the messages that have been processed, "\Seen" by default. A keyword, e.g.
+	// "$GidariProcessed", keeps the messages unread for people sharing the mailbox.
+	ProcessedFlag string `yaml:"processedFlag"`
+
+	// dial connects and logs in to the server, "web.DialIMAP" unless it is set by tests.
+	dial func(ctx context.Context, addr string, cfg web.IMAPConfig) (imapMailbox, error)
+
+	// firstOnly writes the first record of the first message with one, to sample the schema.
+	firstOnly bool
+
+	// processed are the messages fetched by the run, which are marked processed once it commits.
+	processed *imapProcessed
+}
+
+// imapProcessed are the UIDs of the messages fetched from a mailbox, with the UIDVALIDITY of the mailbox.
+type imapProcessed struct {
+	mtx      sync.Mutex
+	validity uint32
+	uids     []uint32
+}
+
+// imapMailbox is a connection that reads and flags the messages of a mailbox.
+type imapMailbox interface {
+	Select(ctx context.Context, mailbox string, readOnly bool) (uint32, error)
+	Search(ctx context.Context, search web.IMAPSearch) ([]uint32, error)
+	Fetch(ctx context.Context, uid uint32) ([]byte, error)
+	Store(ctx context.Context, uids []uint32, flag string) error
+	Close() error
+}
+
+// dialIMAPMailbox will connect and log in to the server.
+func dialIMAPMailbox(ctx context.Context, addr string, cfg web.IMAPConfig) (imapMailbox, error) {
+	return web.DialIMAP(ctx, addr, cfg)
+}
+
+func (src *IMAP) validate(req *Request) error {
+	if src.Address == "" {
+		return MissingConfigFieldError("imap.address")
+	}
+
+	if _, _, err := net.SplitHostPort(src.Address); err != nil {
+		return InvalidIMAPError(fmt.Sprintf("address %q must be host:port", src.Address))
+	}
+
+	if src.Username == "" {
+		return MissingConfigFieldError("imap.username")
+	}
+
+	if req.Table == "" {
+		return MissingConfigFieldError("table")
+	}
+
+	if src.Format != "" && src.Format != IMAPFormatCSV && src.Format != IMAPFormatJSONL &&
+		src.Format != IMAPFormatJSON {
+		return InvalidIMAPError(fmt.Sprintf("imap.format %q must be csv, jsonl, or json", src.Format))
+	}
+
+	if _, err := path.Match(src.Attachments, ""); err != nil {
+		return InvalidIMAPError(fmt.Sprintf("imap.attachments %q is not a valid pattern", src.Attachments))
+	}
+
+	if len([]rune(src.Delimiter)) > 1 {
+		return InvalidIMAPError("imap.delimiter must be a single character")
+	}
+
+	if strings.ContainsAny(src.ProcessedFlag, " ()\r\n") {
+		return InvalidIMAPError(fmt.Sprintf("imap.processedFlag %q must be a single flag", src.ProcessedFlag))
+	}
+
+	if src.Since < 0 {
+		return InvalidIMAPError("imap.since can not be negative")
+	}
+
+	if req.Timeseries != nil || req.Paginate != nil || req.Prometheus != nil || req.OrderBook != nil ||
+		req.FIX != nil || req.SQL != nil || req.LDAP != nil || req.SNMP != nil {
+		return InvalidIMAPError("imap can not be combined with timeseries, paginate, prometheus, orderBook, fix, " +
+			"sql, ldap, or snmp")
+	}
+
+	return nil
+}
+
+func (src *IMAP) setDefaults() {
+	if src.Mailbox == "" {
+		src.Mailbox = imapDefaultMailbox
+	}
+
+	if src.ProcessedFlag == "" {
+		src.ProcessedFlag = imapDefaultProcessedFlag
+	}
+
+	src.processed = &imapProcessed{}
+}
+
+// url will return the RFC 5092 URL of the mailbox, e.g. "imaps://reports@imap.example.com:993/INBOX", without the
+// password.
+func (src *IMAP) url() string {
+	scheme := "imap"
+	if src.TLS {
+		scheme = "imaps"
+	}
+
+	return (&url.URL{Scheme: scheme, User: url.User(src.Username), Host: src.Address, Path: "/" + src.Mailbox}).String()
+}
+
+// dialMailbox will connect and log in to the server.
+func (src *IMAP) dialMailbox(ctx context.Context) (imapMailbox, error) {
+	dial := src.dial
+	if dial == nil {
+		dial = dialIMAPMailbox
+	}
+
+	return dial(ctx, src.Address, web.IMAPConfig{TLS: src.TLS, Username: src.Username, Password: src.Password})
+}
+
+// fetch will return the records of the attachments of the messages that match the source and are not processed, as a
+// JSON array. The mailbox is examined, so that no message is flagged until the run commits. The request returned
+// stands for the mailbox, with the "IMAP" method and its RFC 5092 URL. The size of the records is counted as
+// downloaded by the usage tracker.
+func (src *IMAP) fetch(ctx context.Context, usage *usageTracker) (*http.Request, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, imapRequestMethod, src.url(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create request: %w", err)
+	}
+
+	conn, err := src.dialMailbox(ctx)
+	if err != nil {
+		return nil, nil, IMAPFetchError(err)
+	}
+
+	defer conn.Close()
+
+	validity, err := conn.Select(ctx, src.Mailbox, true)
+	if err != nil {
+		return nil, nil, IMAPFetchError(err)
+	}
+
+	search := web.IMAPSearch{From: src.From, Subject: src.Subject, Without: src.ProcessedFlag}
+	if src.Since > 0 {
+		search.Since = time.Now().Add(-src.Since)
+	}
+
+	uids, err := conn.Search(ctx, search)
+	if err != nil {
+		return nil, nil, IMAPFetchError(err)
+	}
+
+	var (
+		buf   bytes.Buffer
+		count int
+	)
+
+	buf.WriteByte('[')
+
+	for _, uid := range uids {
+		if src.firstOnly && count > 0 {
+			break
+		}
+
+		raw, err := conn.Fetch(ctx, uid)
+		if err != nil {
+			return nil, nil, IMAPFetchError(err)
+		}
+
+		records, err := src.records(raw)
+		if err != nil {
+			return nil, nil, IMAPFetchError(fmt.Errorf("message %d: %w", uid, err))
+		}
+
+		for _, record := range records {
+			if src.firstOnly && count > 0 {
+				break
+			}
+
+			data, err := json.Marshal(record)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to encode record of message %d: %w", uid, err)
+			}
+
+			if count > 0 {
+				buf.WriteByte(',')
+			}
+
+			buf.Write(data)
+			count++
+		}
+	}
+
+	buf.WriteByte(']')
+
+	if !src.firstOnly && src.processed != nil {
+		src.processed.mtx.Lock()
+		src.processed.validity = validity
+		src.processed.uids = append(src.processed.uids, uids...)
+		src.processed.mtx.Unlock()
+	}
+
+	usage.download(buf.Len())
+
+	return req, buf.Bytes(), nil
+}
+
+// markProcessed will flag the messages fetched by the run as processed. The messages are not flagged if the
+// UIDVALIDITY of the mailbox changed since they were fetched, since their UIDs may then be of other messages.
+func (src *IMAP) markProcessed(ctx context.Context) error {
+	if src.processed == nil {
+		return nil
+	}
+
+	src.processed.mtx.Lock()
+	defer src.processed.mtx.Unlock()
+
+	if len(src.processed.uids) == 0 {
+		return nil
+	}
+
+	conn, err := src.dialMailbox(ctx)
+	if err != nil {
+		return IMAPMarkError(err)
+	}
+
+	defer conn.Close()
+
+	validity, err := conn.Select(ctx, src.Mailbox, false)
+	if err != nil {
+		return IMAPMarkError(err)
+	}
+
+	if validity != src.processed.validity {
+		return IMAPMarkError(fmt.Errorf("UIDVALIDITY of %s changed from %d to %d", src.Mailbox,
+			src.processed.validity, validity))
+	}
+
+	if err := conn.Store(ctx, src.processed.uids, src.ProcessedFlag); err != nil {
+		return IMAPMarkError(err)
+	}
+
+	src.processed.uids = nil
+
+	return nil
+}
+
+// markIMAPMessages will mark the messages fetched by every IMAP source of the run as processed, once the run commits.
+func markIMAPMessages(ctx context.Context, cfg *Config) error {
+	for _, req := range cfg.Requests {
+		if req.IMAP == nil {
+			continue
+		}
+
+		if err := req.IMAP.markProcessed(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// imapHeader is the header of a message or of a part of a message.
+type imapHeader interface {
+	Get(key string) string
+}
+
+// imapAttachment is an attachment of a message, with its file name and decoded contents.
+type imapAttachment struct {
+	name string
+	data []byte
+}
+
+// records will return the records of the attachments of the raw message.
+func (src *IMAP) records(raw []byte) ([]map[string]interface{}, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse message: %w", err)
+	}
+
+	var attachments []imapAttachment
+	if err := imapWalk(msg.Header, msg.Body, &attachments); err != nil {
+		return nil, err
+	}
+
+	decoder := new(mime.WordDecoder)
+
+	subject, err := decoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+
+	from := msg.Header.Get("From")
+	if addr, err := mail.ParseAddress(from); err == nil {
+		from = addr.Address
+	}
+
+	date := msg.Header.Get("Date")
+	if parsed, err := msg.Header.Date(); err == nil {
+		date = parsed.UTC().Format(time.RFC3339)
+	}
+
+	var records []map[string]interface{}
+
+	for _, attachment := range attachments {
+		if src.Attachments != "" {
+			if ok, _ := path.Match(src.Attachments, attachment.name); !ok {
+				continue
+			}
+		}
+
+		rows, err := src.decodeAttachment(attachment)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %q: %w", attachment.name, err)
+		}
+
+		for idx, row := range rows {
+			row[imapMessageIDField] = strings.Trim(msg.Header.Get("Message-Id"), "<>")
+			row[imapFromField] = from
+			row[imapSubjectField] = subject
+			row[imapDateField] = date
+			row[imapAttachmentField] = attachment.name
+			row[imapRowField] = idx + 1
+
+			records = append(records, row)
+		}
+	}
+
+	return records, nil
+}
+
+// imapWalk will append the attachments of the part, and of every part it contains, to "attachments". A part is an
+// attachment if it has a file name.
+func imapWalk(header imapHeader, body io.Reader, attachments *[]imapAttachment) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		rd := multipart.NewReader(body, params["boundary"])
+
+		for {
+			part, err := rd.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+
+			if err != nil {
+				return fmt.Errorf("unable to read part: %w", err)
+			}
+
+			if err := imapWalk(part.Header, part, attachments); err != nil {
+				return err
+			}
+		}
+	}
+
+	name := params["name"]
+	if _, dispParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil &&
+		dispParams["filename"] != "" {
+		name = dispParams["filename"]
+	}
+
+	if name == "" {
+		return nil
+	}
+
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("unable to decode attachment %q: %w", name, err)
+	}
+
+	*attachments = append(*attachments, imapAttachment{name: path.Base(name), data: data})
+
+	return nil
+}
+
+// decodeAttachment will decode the rows of the attachment, which is gunzipped if its name ends with ".gz". An
+// attachment whose format is not set and can not be determined from its extension has no rows.
+func (src *IMAP) decodeAttachment(attachment imapAttachment) ([]map[string]interface{}, error) {
+	name, data := strings.ToLower(attachment.name), attachment.data
+
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("unable to gunzip: %w", err)
+		}
+
+		if data, err = io.ReadAll(gz); err != nil {
+			return nil, fmt.Errorf("unable to gunzip: %w", err)
+		}
+
+		name = strings.TrimSuffix(name, ".gz")
+	}
+
+	format := src.Format
+	if format == "" {
+		format = imapFormats[path.Ext(name)]
+	}
+
+	switch format {
+	case IMAPFormatCSV:
+		delimiter := ','
+		if src.Delimiter != "" {
+			delimiter = []rune(src.Delimiter)[0]
+		} else if path.Ext(name) == ".tsv" {
+			delimiter = '\t'
+		}
+
+		return decodeCSVRecords(data, delimiter)
+	case IMAPFormatJSONL:
+		var records []map[string]interface{}
+
+		for idx, line := range bytes.Split(data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+
+			var record map[string]interface{}
+			if err := json.Unmarshal(line, &record); err != nil {
+				return nil, fmt.Errorf("line %d: %w", idx+1, err)
+			}
+
+			records = append(records, record)
+		}
+
+		return records, nil
+	case IMAPFormatJSON:
+		return decodeJSONRecords(data)
+	default:
+		return nil, nil
+	}
+}
+
+// decodeCSVRecords will decode the rows of a CSV file with a header row as records of strings, by column.
+func decodeCSVRecords(data []byte, delimiter rune) ([]map[string]interface{}, error) {
+	rd := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	rd.Comma = delimiter
+
+	header, err := rd.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read header: %w", err)
+	}
+
+	var records []map[string]interface{}
+
+	for {
+		row, err := rd.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to read row: %w", err)
+		}
+
+		record := make(map[string]interface{}, len(header))
+		for idx, column := range header {
+			record[column] = row[idx]
+		}
+
+		records = append(records, record)
+	}
+}
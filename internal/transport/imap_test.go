@@ -0,0 +1,251 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+)
+
+// imapTestMailbox answers every search with the UIDs of its messages, and records the flags stored.
+type imapTestMailbox struct {
+	validity uint32
+	messages map[uint32][]byte
+	uids     []uint32
+	search   web.IMAPSearch
+	readOnly bool
+	stored   []uint32
+	flag     string
+}
+
+func (conn *imapTestMailbox) Select(_ context.Context, mailbox string, readOnly bool) (uint32, error) {
+	conn.readOnly = readOnly
+
+	return conn.validity, nil
+}
+
+func (conn *imapTestMailbox) Search(_ context.Context, search web.IMAPSearch) ([]uint32, error) {
+	conn.search = search
+
+	return conn.uids, nil
+}
+
+func (conn *imapTestMailbox) Fetch(_ context.Context, uid uint32) ([]byte, error) {
+	return conn.messages[uid], nil
+}
+
+func (conn *imapTestMailbox) Store(_ context.Context, uids []uint32, flag string) error {
+	conn.stored, conn.flag = append(conn.stored, uids...), flag
+
+	return nil
+}
+
+func (conn *imapTestMailbox) Close() error {
+	return nil
+}
+
+// imapTestMessage will return a message with a CSV attachment, a gzipped JSONL attachment, and an image.
+func imapTestMessage(t *testing.T) []byte {
+	t.Helper()
+
+	var gz bytes.Buffer
+
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte("{\"sku\":\"a1\",\"qty\":3}\n\n{\"sku\":\"b2\",\"qty\":1}\n"))
+	zw.Close()
+
+	return []byte("From: Partner Reports <reports@partner.example>\r\n" +
+		"Subject: =?UTF-8?Q?Daily_report_=E2=80=93_2023-02-01?=\r\n" +
+		"Date: Wed, 01 Feb 2023 06:00:00 +0100\r\n" +
+		"Message-ID: <abc123@partner.example>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/csv; name=\"sales.csv\"\r\n" +
+		"Content-Disposition: attachment; filename=\"sales.csv\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString([]byte("\xef\xbb\xbfstore,total\r\nfra1,10.5\r\nams1,\"1,200\"\r\n")) +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/gzip\r\n" +
+		"Content-Disposition: attachment; filename*=UTF-8''stock%20levels.jsonl.gz\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(gz.Bytes()) + "\r\n" +
+		"--outer\r\n" +
+		"Content-Type: image/png; name=\"logo.png\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw0K\r\n" +
+		"--outer--\r\n")
+}
+
+func TestIMAP(t *testing.T) {
+	t.Parallel()
+
+	t.Run("fetch", func(t *testing.T) {
+		t.Parallel()
+
+		conn := &imapTestMailbox{validity: 7, messages: map[uint32][]byte{4: imapTestMessage(t)}, uids: []uint32{4}}
+
+		src := &IMAP{
+			Address:  "imap.example.com:993",
+			TLS:      true,
+			Username: "reports@example.com",
+			Password: "secret",
+			From:     []string{"partner.example"},
+			Subject:  "Daily report",
+			dial: func(_ context.Context, addr string, cfg web.IMAPConfig) (imapMailbox, error) {
+				if addr != "imap.example.com:993" || !cfg.TLS || cfg.Username != "reports@example.com" ||
+					cfg.Password != "secret" {
+					t.Fatalf("unexpected address %s and configuration %+v", addr, cfg)
+				}
+
+				return conn, nil
+			},
+		}
+		src.setDefaults()
+
+		req, body, err := src.fetch(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("failed to fetch: %v", err)
+		}
+
+		if req.Method != imapRequestMethod || req.URL.String() != "imaps://reports%40example.com@imap.example.com:993/INBOX" {
+			t.Fatalf("expected the request to stand for the mailbox, got %s %s", req.Method, req.URL)
+		}
+
+		if !conn.readOnly || conn.search.Without != `\Seen` || conn.search.Subject != "Daily report" ||
+			len(conn.stored) != 0 {
+			t.Fatalf("expected a read-only search for unseen messages, got %+v", conn.search)
+		}
+
+		var records []map[string]interface{}
+		if err := json.Unmarshal(body, &records); err != nil {
+			t.Fatalf("failed to decode records: %v", err)
+		}
+
+		message := map[string]interface{}{
+			"_messageId": "abc123@partner.example",
+			"_from":      "reports@partner.example",
+			"_subject":   "Daily report – 2023-02-01",
+			"_date":      "2023-02-01T05:00:00Z",
+		}
+
+		exp := []map[string]interface{}{
+			{"store": "fra1", "total": "10.5", "_attachment": "sales.csv", "_row": float64(1)},
+			{"store": "ams1", "total": "1,200", "_attachment": "sales.csv", "_row": float64(2)},
+			{"sku": "a1", "qty": float64(3), "_attachment": "stock levels.jsonl.gz", "_row": float64(1)},
+			{"sku": "b2", "qty": float64(1), "_attachment": "stock levels.jsonl.gz", "_row": float64(2)},
+		}
+
+		for _, record := range exp {
+			for key, value := range message {
+				record[key] = value
+			}
+		}
+
+		if !reflect.DeepEqual(records, exp) {
+			t.Fatalf("expected records %v, got %v", exp, records)
+		}
+
+		if err := src.markProcessed(context.Background()); err != nil {
+			t.Fatalf("failed to mark messages: %v", err)
+		}
+
+		if conn.readOnly || !reflect.DeepEqual(conn.stored, []uint32{4}) || conn.flag != `\Seen` {
+			t.Fatalf("expected message 4 to be marked seen, got %v %s", conn.stored, conn.flag)
+		}
+
+		src.Attachments = "sales*"
+		src.firstOnly = true
+
+		if _, body, err = src.fetch(context.Background(), nil); err != nil {
+			t.Fatalf("failed to sample: %v", err)
+		}
+
+		if err := json.Unmarshal(body, &records); err != nil || len(records) != 1 || records[0]["store"] != "fra1" {
+			t.Fatalf("expected the sample to be the first row of sales.csv, got %s: %v", body, err)
+		}
+
+		if err := src.markProcessed(context.Background()); err != nil || len(conn.stored) != 1 {
+			t.Fatalf("expected the sample not to mark messages, got %v: %v", conn.stored, err)
+		}
+	})
+
+	t.Run("uidvalidity", func(t *testing.T) {
+		t.Parallel()
+
+		conn := &imapTestMailbox{validity: 7, messages: map[uint32][]byte{4: imapTestMessage(t)}, uids: []uint32{4}}
+
+		src := &IMAP{
+			Address:  "imap.example.com:143",
+			Username: "reports",
+			dial: func(context.Context, string, web.IMAPConfig) (imapMailbox, error) {
+				return conn, nil
+			},
+		}
+		src.setDefaults()
+
+		if _, _, err := src.fetch(context.Background(), nil); err != nil {
+			t.Fatalf("failed to fetch: %v", err)
+		}
+
+		conn.validity = 8
+
+		if err := src.markProcessed(context.Background()); !errors.Is(err, ErrIMAPMark) || len(conn.stored) != 0 {
+			t.Fatalf("expected error %v without marking messages, got %v", ErrIMAPMark, err)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tc := range []struct {
+			req *Request
+			err error
+		}{
+			{&Request{Table: "sales", IMAP: &IMAP{Username: "reports"}}, ErrMissingConfigField},
+			{&Request{Table: "sales", IMAP: &IMAP{Address: "imap.example.com", Username: "reports"}}, ErrInvalidIMAP},
+			{&Request{Table: "sales", IMAP: &IMAP{Address: "imap.example.com:993"}}, ErrMissingConfigField},
+			{&Request{IMAP: &IMAP{Address: "imap.example.com:993", Username: "reports"}}, ErrMissingConfigField},
+			{&Request{Table: "sales", IMAP: &IMAP{Address: "imap.example.com:993", Username: "reports",
+				Format: "xlsx"}}, ErrInvalidIMAP},
+			{&Request{Table: "sales", IMAP: &IMAP{Address: "imap.example.com:993", Username: "reports",
+				Attachments: "[a"}}, ErrInvalidIMAP},
+			{&Request{Table: "sales", IMAP: &IMAP{Address: "imap.example.com:993", Username: "reports",
+				ProcessedFlag: `\Seen \Flagged`}}, ErrInvalidIMAP},
+			{&Request{Table: "sales", SNMP: &SNMP{}, IMAP: &IMAP{Address: "imap.example.com:993",
+				Username: "reports"}}, ErrInvalidIMAP},
+			{&Request{Table: "sales", IMAP: &IMAP{Address: "imap.example.com:993", Username: "reports",
+				Format: "csv", Delimiter: ";", ProcessedFlag: "$GidariProcessed"}}, nil},
+		} {
+			if err := tc.req.IMAP.validate(tc.req); !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v for %+v, got %v", tc.err, tc.req.IMAP, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,344 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+)
+
+const (
+	// ldapRequestMethod is the method of the request written for an LDAP source, e.g. to the archive.
+	ldapRequestMethod = "LDAP"
+
+	// ldapDefaultPageSize is the default number of entries of each page of a search, below the 1000 entries that
+	// Active Directory allows by default.
+	ldapDefaultPageSize = 500
+
+	// ldapDNField is the field of the distinguished name of each entry.
+	ldapDNField = "dn"
+)
+
+var (
+	ErrInvalidLDAP = fmt.Errorf("invalid ldap source")
+	ErrLDAPSearch  = fmt.Errorf("ldap search failed")
+)
+
+// InvalidLDAPError is returned when the LDAP source of a request is not valid.
+func InvalidLDAPError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidLDAP, reason)
+}
+
+// LDAPSearchError is returned when the search of an LDAP source fails.
+func LDAPSearchError(err error) error {
+	return fmt.Errorf("%w: %v", ErrLDAPSearch, err)
+}
+
+// ldapScopes are the scopes of a search, by name.
+var ldapScopes = map[string]int{
+	"base": web.LDAPScopeBase,
+	"one":  web.LDAPScopeOne,
+	"sub":  web.LDAPScopeSub,
+}
+
+// ldapBinaryAttributes are the Active Directory attributes with binary values that are written as their string
+// forms, e.g. "S-1-5-21-..." for a security identifier.
+var ldapBinaryAttributes = map[string]func([]byte) (string, bool){
+	"objectguid": ldapGUID,
+	"objectsid":  ldapSID,
+	"sidhistory": ldapSID,
+}
+
+// LDAP is the configuration for searching the entries of an LDAP directory, such as Active Directory, instead of
+// requesting the endpoint, e.g. for exports of users and groups. Each entry of the search is a record with its
+// distinguished name in "dn" and a field for each attribute.
+type LDAP struct {
+	// Address is the "host:port" of the server, e.g. "dc1.corp.example:636".
+	Address string `yaml:"address"`
+
+	// TLS connects to the server over TLS, i.e. LDAPS.
+	TLS bool `yaml:"tls"`
+
+	// BindDN and Password are the credentials of the simple bind, which is anonymous if they are empty.
+	BindDN   string `yaml:"bindDN"`
+	Password string `yaml:"password"`
+
+	// BaseDN is the entry that the search starts at, e.g. "dc=corp,dc=example,dc=com".
+	BaseDN string `yaml:"baseDN"`
+
+	// Scope is the scope of the search, "base", "one", or "sub" (the default).
+	Scope string `yaml:"scope"`
+
+	// Filter is the RFC 4515 filter of the entries, every entry by default.
+	Filter string `yaml:"filter"`
+
+	// Attributes are the attributes written for each entry, every user attribute by default.
+	Attributes []string `yaml:"attributes"`
+
+	// Lists are the attributes that are always written as lists, e.g. "memberOf". Other attributes are written as
+	// a string if they have a single value, and a list if they have more.
+	Lists []string `yaml:"lists"`
+
+	// PageSize is the number of entries of each page of the search, 500 by default.
+	PageSize int `yaml:"pageSize"`
+
+	// dial connects and binds to the server, "web.DialLDAP" unless it is set by tests.
+	dial func(ctx context.Context, addr string, cfg web.LDAPConfig) (ldapSearcher, error)
+
+	// firstOnly writes the record of the first entry, to sample the schema.
+	firstOnly bool
+}
+
+// ldapSearcher is a connection that searches the directory.
+type ldapSearcher interface {
+	Search(ctx context.Context, search web.LDAPSearch, entryFn func(web.LDAPEntry) error) error
+	Close() error
+}
+
+// dialLDAPSearcher will connect and bind to the server.
+func dialLDAPSearcher(ctx context.Context, addr string, cfg web.LDAPConfig) (ldapSearcher, error) {
+	return web.DialLDAP(ctx, addr, cfg)
+}
+
+func (src *LDAP) validate(req *Request) error {
+	if src.Address == "" {
+		return MissingConfigFieldError("ldap.address")
+	}
+
+	if _, _, err := net.SplitHostPort(src.Address); err != nil {
+		return InvalidLDAPError(fmt.Sprintf("address %q must be host:port", src.Address))
+	}
+
+	if src.BaseDN == "" {
+		return MissingConfigFieldError("ldap.baseDN")
+	}
+
+	if req.Table == "" {
+		return MissingConfigFieldError("table")
+	}
+
+	if _, ok := ldapScopes[src.Scope]; src.Scope != "" && !ok {
+		return InvalidLDAPError(fmt.Sprintf("ldap.scope %q must be base, one, or sub", src.Scope))
+	}
+
+	if _, err := web.ParseLDAPFilter(src.Filter); err != nil {
+		return InvalidLDAPError(err.Error())
+	}
+
+	if src.PageSize < 0 {
+		return InvalidLDAPError("ldap.pageSize can not be negative")
+	}
+
+	if src.Password != "" && src.BindDN == "" {
+		return InvalidLDAPError("ldap.password requires ldap.bindDN")
+	}
+
+	if req.Timeseries != nil || req.Paginate != nil || req.Prometheus != nil || req.OrderBook != nil ||
+		req.FIX != nil || req.SQL != nil {
+		return InvalidLDAPError("ldap can not be combined with timeseries, paginate, prometheus, orderBook, fix, or " +
+			"sql")
+	}
+
+	return nil
+}
+
+func (src *LDAP) setDefaults() {
+	if src.Scope == "" {
+		src.Scope = "sub"
+	}
+
+	if src.PageSize == 0 {
+		src.PageSize = ldapDefaultPageSize
+	}
+}
+
+// url will return the RFC 4516 URL of the search, e.g. "ldaps://dc1:636/dc=corp?cn,mail?sub?(objectClass=user)",
+// without the credentials.
+func (src *LDAP) url() string {
+	scheme := "ldap"
+	if src.TLS {
+		scheme = "ldaps"
+	}
+
+	return (&url.URL{
+		Scheme:   scheme,
+		Host:     src.Address,
+		Path:     "/" + src.BaseDN,
+		RawQuery: strings.Join([]string{strings.Join(src.Attributes, ","), src.Scope, url.PathEscape(src.Filter)}, "?"),
+	}).String()
+}
+
+// search will bind to the server and return the records of the entries of the search as a JSON array. The request
+// returned stands for the search, with the "LDAP" method and its RFC 4516 URL. The size of the records is counted as
+// downloaded by the usage tracker.
+func (src *LDAP) search(ctx context.Context, usage *usageTracker) (*http.Request, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, ldapRequestMethod, src.url(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create request: %w", err)
+	}
+
+	dial := src.dial
+	if dial == nil {
+		dial = dialLDAPSearcher
+	}
+
+	conn, err := dial(ctx, src.Address, web.LDAPConfig{TLS: src.TLS, BindDN: src.BindDN, Password: src.Password})
+	if err != nil {
+		return nil, nil, LDAPSearchError(err)
+	}
+
+	defer conn.Close()
+
+	search := web.LDAPSearch{
+		BaseDN:     src.BaseDN,
+		Scope:      ldapScopes[src.Scope],
+		Filter:     src.Filter,
+		Attributes: src.Attributes,
+		PageSize:   src.PageSize,
+	}
+
+	if src.firstOnly {
+		search.PageSize, search.SizeLimit = 0, 1
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteByte('[')
+
+	count := 0
+
+	err = conn.Search(ctx, search, func(entry web.LDAPEntry) error {
+		if src.firstOnly && count > 0 {
+			return nil
+		}
+
+		data, err := json.Marshal(src.record(entry))
+		if err != nil {
+			return fmt.Errorf("unable to encode entry %q: %w", entry.DN, err)
+		}
+
+		if count > 0 {
+			buf.WriteByte(',')
+		}
+
+		buf.Write(data)
+		count++
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, LDAPSearchError(err)
+	}
+
+	buf.WriteByte(']')
+
+	usage.download(buf.Len())
+
+	return req, buf.Bytes(), nil
+}
+
+// record will return the record of the entry. Attributes are written with the names of "Attributes" when they are
+// set, since servers may return them in another case.
+func (src *LDAP) record(entry web.LDAPEntry) map[string]interface{} {
+	record := map[string]interface{}{ldapDNField: entry.DN}
+
+	for _, attr := range entry.Attributes {
+		name := attr.Name
+		for _, configured := range src.Attributes {
+			if strings.EqualFold(configured, name) {
+				name = configured
+
+				break
+			}
+		}
+
+		values := make([]interface{}, 0, len(attr.Values))
+		for _, value := range attr.Values {
+			values = append(values, ldapValue(name, value))
+		}
+
+		if len(values) == 1 && !src.isList(name) {
+			record[name] = values[0]
+
+			continue
+		}
+
+		record[name] = values
+	}
+
+	return record
+}
+
+// isList will return true if the attribute is always written as a list.
+func (src *LDAP) isList(name string) bool {
+	for _, list := range src.Lists {
+		if strings.EqualFold(list, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ldapValue will return the value of an attribute as a string. The GUIDs and security identifiers of Active
+// Directory are written as their string forms, and other binary values as base64.
+func ldapValue(name string, value []byte) string {
+	if format, ok := ldapBinaryAttributes[strings.ToLower(name)]; ok {
+		if formatted, ok := format(value); ok {
+			return formatted
+		}
+	}
+
+	if !utf8.Valid(value) {
+		return base64.StdEncoding.EncodeToString(value)
+	}
+
+	return string(value)
+}
+
+// ldapGUID will format a 16 byte Active Directory GUID, whose first three groups are little-endian, e.g.
+// "f9d2d5b2-6a3e-4b1c-9c3b-8f2e6b1a0d4c".
+func ldapGUID(value []byte) (string, bool) {
+	if len(value) != 16 {
+		return "", false
+	}
+
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x", binary.LittleEndian.Uint32(value[0:4]),
+		binary.LittleEndian.Uint16(value[4:6]), binary.LittleEndian.Uint16(value[6:8]), value[8:10], value[10:16]), true
+}
+
+// ldapSID will format a binary security identifier, e.g. "S-1-5-21-3623811015-3361044348-30300820-1013".
+func ldapSID(value []byte) (string, bool) {
+	if len(value) < 8 || len(value) != 8+4*int(value[1]) {
+		return "", false
+	}
+
+	var authority uint64
+	for _, b := range value[2:8] {
+		authority = authority<<8 | uint64(b)
+	}
+
+	sid := "S-" + strconv.Itoa(int(value[0])) + "-" + strconv.FormatUint(authority, 10)
+	for idx := 8; idx < len(value); idx += 4 {
+		sid += "-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(value[idx:idx+4])), 10)
+	}
+
+	return sid, true
+}
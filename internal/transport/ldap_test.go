@@ -0,0 +1,163 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+)
+
+// ldapTestSearcher answers every search with its entries, and records the search.
+type ldapTestSearcher struct {
+	entries []web.LDAPEntry
+	search  web.LDAPSearch
+	closed  bool
+}
+
+func (conn *ldapTestSearcher) Search(_ context.Context, search web.LDAPSearch,
+	entryFn func(web.LDAPEntry) error,
+) error {
+	conn.search = search
+
+	for _, entry := range conn.entries {
+		if err := entryFn(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (conn *ldapTestSearcher) Close() error {
+	conn.closed = true
+
+	return nil
+}
+
+func TestLDAP(t *testing.T) {
+	t.Parallel()
+
+	t.Run("search", func(t *testing.T) {
+		t.Parallel()
+
+		conn := &ldapTestSearcher{entries: []web.LDAPEntry{
+			{DN: "CN=Ada,OU=Staff,DC=corp", Attributes: []web.LDAPAttribute{
+				{Name: "samaccountname", Values: [][]byte{[]byte("ada")}},
+				{Name: "memberOf", Values: [][]byte{[]byte("CN=Admins,DC=corp")}},
+				{Name: "proxyAddresses", Values: [][]byte{[]byte("smtp:a@corp"), []byte("SMTP:ada@corp")}},
+				{Name: "objectGUID", Values: [][]byte{{
+					0xb2, 0xd5, 0xd2, 0xf9, 0x3e, 0x6a, 0x1c, 0x4b, 0x9c, 0x3b, 0x8f, 0x2e, 0x6b, 0x1a, 0x0d, 0x4c,
+				}}},
+				{Name: "objectSid", Values: [][]byte{{
+					1, 5, 0, 0, 0, 0, 0, 5, 21, 0, 0, 0, 0xc7, 0xf7, 0xfe, 0xd7, 0x7c, 0x77, 0x55, 0xc8, 0x94, 0x5a,
+					0xce, 0x01, 0xf5, 0x03, 0x00, 0x00,
+				}}},
+				{Name: "thumbnailPhoto", Values: [][]byte{{0xff, 0xd8}}},
+			}},
+			{DN: "CN=Bob,OU=Staff,DC=corp"},
+		}}
+
+		src := &LDAP{
+			Address:    "dc1.corp:636",
+			TLS:        true,
+			BindDN:     "CN=reader,DC=corp",
+			Password:   "secret",
+			BaseDN:     "OU=Staff,DC=corp",
+			Filter:     "(&(objectClass=user)(!(userAccountControl:1.2.840.113556.1.4.803:=2)))",
+			Attributes: []string{"sAMAccountName", "memberOf", "proxyAddresses", "objectGUID", "objectSid"},
+			Lists:      []string{"memberof"},
+			dial: func(_ context.Context, addr string, cfg web.LDAPConfig) (ldapSearcher, error) {
+				if addr != "dc1.corp:636" || !cfg.TLS || cfg.BindDN != "CN=reader,DC=corp" || cfg.Password != "secret" {
+					t.Fatalf("unexpected address %s and configuration %+v", addr, cfg)
+				}
+
+				return conn, nil
+			},
+		}
+		src.setDefaults()
+
+		req, body, err := src.search(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("failed to search: %v", err)
+		}
+
+		url := "ldaps://dc1.corp:636/OU=Staff,DC=corp?sAMAccountName,memberOf,proxyAddresses,objectGUID,objectSid?" +
+			"sub?%28&%28objectClass=user%29%28%21%28userAccountControl:1.2.840.113556.1.4.803:=2%29%29%29"
+		if req.Method != ldapRequestMethod || req.URL.String() != url {
+			t.Fatalf("expected the request to stand for the search %s, got %s %s", url, req.Method, req.URL)
+		}
+
+		if conn.search.Scope != web.LDAPScopeSub || conn.search.PageSize != ldapDefaultPageSize || !conn.closed {
+			t.Fatalf("expected a paged subtree search on a closed connection, got %+v", conn.search)
+		}
+
+		var records []map[string]interface{}
+		if err := json.Unmarshal(body, &records); err != nil {
+			t.Fatalf("failed to decode records: %v", err)
+		}
+
+		exp := []map[string]interface{}{
+			{
+				"dn":             "CN=Ada,OU=Staff,DC=corp",
+				"sAMAccountName": "ada",
+				"memberOf":       []interface{}{"CN=Admins,DC=corp"},
+				"proxyAddresses": []interface{}{"smtp:a@corp", "SMTP:ada@corp"},
+				"objectGUID":     "f9d2d5b2-6a3e-4b1c-9c3b-8f2e6b1a0d4c",
+				"objectSid":      "S-1-5-21-3623811015-3361044348-30300820-1013",
+				"thumbnailPhoto": "/9g=",
+			},
+			{"dn": "CN=Bob,OU=Staff,DC=corp"},
+		}
+		if !reflect.DeepEqual(records, exp) {
+			t.Fatalf("expected records %v, got %v", exp, records)
+		}
+
+		src.firstOnly = true
+
+		if _, body, err = src.search(context.Background(), nil); err != nil || len(body) == 0 {
+			t.Fatalf("failed to sample: %v", err)
+		}
+
+		if err := json.Unmarshal(body, &records); err != nil || len(records) != 1 || conn.search.SizeLimit != 1 {
+			t.Fatalf("expected the sample to be the first entry, got %s: %v", body, err)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tc := range []struct {
+			req *Request
+			err error
+		}{
+			{&Request{Table: "users", LDAP: &LDAP{BaseDN: "dc=corp"}}, ErrMissingConfigField},
+			{&Request{Table: "users", LDAP: &LDAP{Address: "dc1", BaseDN: "dc=corp"}}, ErrInvalidLDAP},
+			{&Request{Table: "users", LDAP: &LDAP{Address: "dc1:389"}}, ErrMissingConfigField},
+			{&Request{LDAP: &LDAP{Address: "dc1:389", BaseDN: "dc=corp"}}, ErrMissingConfigField},
+			{&Request{Table: "users", LDAP: &LDAP{Address: "dc1:389", BaseDN: "dc=corp", Scope: "tree"}},
+				ErrInvalidLDAP},
+			{&Request{Table: "users", LDAP: &LDAP{Address: "dc1:389", BaseDN: "dc=corp", Filter: "(cn=a"}},
+				ErrInvalidLDAP},
+			{&Request{Table: "users", LDAP: &LDAP{Address: "dc1:389", BaseDN: "dc=corp", Password: "secret"}},
+				ErrInvalidLDAP},
+			{&Request{Table: "users", SQL: &SQLSource{}, LDAP: &LDAP{Address: "dc1:389", BaseDN: "dc=corp"}},
+				ErrInvalidLDAP},
+			{&Request{Table: "users", LDAP: &LDAP{Address: "dc1:389", BaseDN: "dc=corp", Scope: "one",
+				Filter: "objectClass=group"}}, nil},
+		} {
+			if err := tc.req.LDAP.validate(tc.req); !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v for %+v, got %v", tc.err, tc.req.LDAP, err)
+			}
+		}
+	})
+}
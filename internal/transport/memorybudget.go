@@ -0,0 +1,121 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+var ErrInvalidMemoryBudget = fmt.Errorf("invalid memory budget")
+
+// InvalidMemoryBudgetError is returned when the memory budget is negative.
+func InvalidMemoryBudgetError(size int64) error {
+	return fmt.Errorf("%w: %d bytes, expected a positive size", ErrInvalidMemoryBudget, size)
+}
+
+// memoryBudget bounds the size of the web API responses that are buffered between the fetch stage and the repository
+// workers. A web worker waits for the budget after reading a response, so it does not fetch the next response until
+// the repository workers have written enough of the buffered responses. The size of a response is estimated by its
+// serialized size, i.e. the length of the response body.
+type memoryBudget struct {
+	sem  *semaphore.Weighted
+	size int64
+
+	// blocked is the total time in nanoseconds that the fetch stage of the run spent waiting for the budget.
+	blocked int64
+}
+
+// newMemoryBudget will return the memory budget of the size in bytes, or nil if the size is not positive.
+func newMemoryBudget(size int64) *memoryBudget {
+	if size <= 0 {
+		return nil
+	}
+
+	return &memoryBudget{sem: semaphore.NewWeighted(size), size: size}
+}
+
+// acquire will wait until the response of the size fits in the budget, and return the weight to release once the
+// response is written. A response larger than the budget waits for the whole budget.
+func (mb *memoryBudget) acquire(ctx context.Context, size int) (int64, error) {
+	if mb == nil {
+		return 0, nil
+	}
+
+	weight := int64(size)
+	if weight > mb.size {
+		weight = mb.size
+	}
+
+	if mb.sem.TryAcquire(weight) {
+		return weight, nil
+	}
+
+	start := time.Now()
+
+	if err := mb.sem.Acquire(ctx, weight); err != nil {
+		return 0, fmt.Errorf("unable to wait for memory budget: %w", err)
+	}
+
+	blocked := time.Since(start)
+
+	atomic.AddInt64(&mb.blocked, int64(blocked))
+	usageFromContext(ctx).memoryWait(blocked)
+
+	return weight, nil
+}
+
+// release will return the weight of a written response to the budget.
+func (mb *memoryBudget) release(weight int64) {
+	if mb == nil || weight == 0 {
+		return
+	}
+
+	mb.sem.Release(weight)
+}
+
+// budgetLease is the weight of a response in the memory budget, which is returned to the budget once every holder of
+// the response is done with it, e.g. the repository worker that writes it and the archiver.
+type budgetLease struct {
+	budget  *memoryBudget
+	weight  int64
+	holders int32
+}
+
+// lease will return the lease of the weight for the number of holders of the response.
+func (mb *memoryBudget) lease(weight int64, holders int) *budgetLease {
+	if mb == nil {
+		return nil
+	}
+
+	return &budgetLease{budget: mb, weight: weight, holders: int32(holders)}
+}
+
+// release will return the weight to the budget once it is called by the last holder.
+func (lease *budgetLease) release() {
+	if lease == nil {
+		return
+	}
+
+	if atomic.AddInt32(&lease.holders, -1) == 0 {
+		lease.budget.release(lease.weight)
+	}
+}
+
+// blockedTime will return the total time that the fetch stage of the run spent waiting for the budget.
+func (mb *memoryBudget) blockedTime() time.Duration {
+	if mb == nil {
+		return 0
+	}
+
+	return time.Duration(atomic.LoadInt64(&mb.blocked))
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("nil budgets never wait", func(t *testing.T) {
+		t.Parallel()
+
+		var mb *memoryBudget
+		if weight, err := mb.acquire(ctx, 1<<30); err != nil || weight != 0 {
+			t.Fatalf("expected no weight, got %d: %v", weight, err)
+		}
+
+		mb.release(0)
+
+		if mb.blockedTime() != 0 {
+			t.Fatalf("expected no blocked time")
+		}
+	})
+
+	t.Run("responses wait until the budget is released", func(t *testing.T) {
+		t.Parallel()
+
+		mb := newMemoryBudget(100)
+
+		usage := newUsageTracker()
+		ctx := contextWithUsage(ctx, usage)
+
+		first, err := mb.acquire(ctx, 80)
+		if err != nil {
+			t.Fatalf("failed to acquire: %v", err)
+		}
+
+		acquired := make(chan int64)
+
+		go func() {
+			// Responses larger than the budget wait for the whole budget.
+			weight, err := mb.acquire(ctx, 500)
+			if err != nil {
+				t.Errorf("failed to acquire: %v", err)
+			}
+
+			acquired <- weight
+		}()
+
+		select {
+		case <-acquired:
+			t.Fatalf("expected the second response to wait for the budget")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		mb.release(first)
+
+		if weight := <-acquired; weight != 100 {
+			t.Fatalf("expected a weight of 100, got %d", weight)
+		}
+
+		if mb.blockedTime() < 20*time.Millisecond {
+			t.Fatalf("expected the blocked time to be recorded, got %s", mb.blockedTime())
+		}
+
+		if rsc := usage.report(); rsc.MemoryWaits != 1 || rsc.MemoryBlocked != mb.blockedTime() {
+			t.Fatalf("expected the wait to be in the usage of the run, got %d waits of %s", rsc.MemoryWaits,
+				rsc.MemoryBlocked)
+		}
+	})
+
+	t.Run("canceled waits", func(t *testing.T) {
+		t.Parallel()
+
+		mb := newMemoryBudget(10)
+		if _, err := mb.acquire(ctx, 10); err != nil {
+			t.Fatalf("failed to acquire: %v", err)
+		}
+
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		if _, err := mb.acquire(cctx, 1); err == nil {
+			t.Fatalf("expected an error for a canceled wait")
+		}
+	})
+}
@@ -0,0 +1,715 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/repository"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// MigrationsTable is the name of the table/collection that golang-migrate records the applied migration version
+	// in.
+	MigrationsTable = "schema_migrations"
+
+	migrationVersionField = "version"
+	migrationDirtyField   = "dirty"
+
+	// migrationDefaultName is the name of generated migration files, if none is given.
+	migrationDefaultName = "gidari_schema"
+)
+
+// migrationFilePattern matches the names of golang-migrate migration files, e.g. "000001_create_orders.up.sql".
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// migrationNameReplacer matches the characters that are not allowed in the name of generated migration files.
+var migrationNameReplacer = regexp.MustCompile(`[^a-z0-9]+`)
+
+var (
+	ErrPendingMigrations = fmt.Errorf("pending migrations")
+	ErrDirtyMigration    = fmt.Errorf("dirty migration")
+	ErrUnparsableSQL     = fmt.Errorf("unable to parse migration")
+)
+
+// PendingMigrationsError is returned when the migration version applied to the storage is behind the latest
+// migration in the migrations directory.
+func PendingMigrationsError(scheme string, applied, latest uint64) error {
+	return fmt.Errorf("%w: %s is at version %d, expected version %d", ErrPendingMigrations, scheme, applied, latest)
+}
+
+// DirtyMigrationError is returned when the last migration applied to the storage failed part way through.
+func DirtyMigrationError(scheme string, version uint64) error {
+	return fmt.Errorf("%w: %s failed at version %d and must be fixed before running", ErrDirtyMigration, scheme,
+		version)
+}
+
+// UnparsableSQLError is returned when a statement of a previous migration creates or alters a table in a way that
+// the columns of the table can not be found, since the migration written from it could not be trusted.
+func UnparsableSQLError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrUnparsableSQL, reason)
+}
+
+// migrationFile is a golang-migrate migration file.
+type migrationFile struct {
+	version uint64
+	up      bool
+	path    string
+}
+
+// readMigrations will return the migration files in the directory, ordered by version. Files that are not migrations
+// are ignored, as they are by golang-migrate.
+func readMigrations(dir string) ([]migrationFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read migrations directory: %w", err)
+	}
+
+	var files []migrationFile
+
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return nil, UnableToParseError("migration version")
+		}
+
+		files = append(files, migrationFile{version: version, up: match[3] == "up", path: filepath.Join(dir, entry.Name())})
+	}
+
+	sort.SliceStable(files, func(i, j int) bool { return files[i].version < files[j].version })
+
+	return files, nil
+}
+
+// latestMigration will return the latest version of the migration files, or zero if there are none.
+func latestMigration(files []migrationFile) uint64 {
+	if len(files) == 0 {
+		return 0
+	}
+
+	return files[len(files)-1].version
+}
+
+// appliedMigration will return the version recorded by golang-migrate, and whether the migration is dirty.
+func appliedMigration(records []*structpb.Struct) (uint64, bool) {
+	for _, record := range records {
+		fields := record.AsMap()
+
+		// Numbers are decoded as floats, and golang-migrate versions are often timestamps, e.g. 20230601120000.
+		val := fields[migrationVersionField]
+		if num, ok := val.(float64); ok {
+			val = strconv.FormatFloat(num, 'f', 0, 64)
+		}
+
+		version, err := strconv.ParseUint(fmt.Sprint(val), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		dirty, _ := fields[migrationDirtyField].(bool)
+
+		return version, dirty
+	}
+
+	return 0, false
+}
+
+// checkMigrations will return an error if any storage has not applied the latest migration in the migrations
+// directory, so that data is never written to tables that are behind their migrations.
+func checkMigrations(ctx context.Context, cfg *Config) error {
+	if cfg.MigrationsDir == "" {
+		return nil
+	}
+
+	files, err := readMigrations(cfg.MigrationsDir)
+	if err != nil {
+		return err
+	}
+
+	latest := latestMigration(files)
+	if latest == 0 {
+		return nil
+	}
+
+	for _, dns := range cfg.ConnectionStrings {
+		if err := checkMigration(ctx, cfg, dns, latest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkMigration will return an error if the storage has not applied the latest migration.
+func checkMigration(ctx context.Context, cfg *Config, dns string, latest uint64) error {
+	repo, err := repository.New(ctx, dns)
+	if err != nil {
+		return WrapRepositoryError(repository.FailedToCreateRepositoryError(err))
+	}
+
+	defer repo.Close()
+
+	scheme := storage.Scheme(repo.Type())
+
+	rsp, err := cfg.Timeouts.wrap(repo).Read(ctx, &proto.ReadRequest{Table: MigrationsTable})
+	if err != nil {
+		return WrapRepositoryError(fmt.Errorf("unable to read applied migrations for %s: %w", scheme, err))
+	}
+
+	applied, dirty := appliedMigration(rsp.GetRecords())
+	if dirty {
+		return DirtyMigrationError(scheme, applied)
+	}
+
+	if applied < latest {
+		return PendingMigrationsError(scheme, applied, latest)
+	}
+
+	return nil
+}
+
+// migration will return the up and down statements that migrate the schemas from the statements of the previous
+// migrations. Tables that were not created by a previous migration are created, and columns that were not created
+// or added by a previous migration are added. Columns are never changed or dropped, since that can lose data.
+func (dialect *sqlDialect) migration(schemas []*tableSchema, statements []*tableStatement) (string, string) {
+	var up, down strings.Builder
+
+	downs := []string{}
+
+	for _, ts := range schemas {
+		columns, ok := migratedColumns(statements, ts.name)
+		if !ok {
+			up.WriteString(dialect.ddl(ts))
+			downs = append(downs, fmt.Sprintf("DROP TABLE IF EXISTS %s;\n", dialect.quote(ts.name)))
+
+			continue
+		}
+
+		for _, col := range ts.columns {
+			exists := false
+
+			for _, column := range columns {
+				if column.names(col.name) {
+					exists = true
+
+					break
+				}
+			}
+
+			def := dialect.columnDef(ts, col)
+			if exists || def == "" {
+				continue
+			}
+
+			fmt.Fprintf(&up, "ALTER TABLE %s ADD COLUMN %s;\n", dialect.quote(ts.name), def)
+
+			if col.generated != "" {
+				up.WriteString(dialect.index(ts, col))
+			}
+
+			downs = append(downs, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s;\n", dialect.quote(ts.name),
+				dialect.quote(col.name)))
+		}
+	}
+
+	// Changes are undone in the reverse order they are made.
+	for idx := len(downs) - 1; idx >= 0; idx-- {
+		down.WriteString(downs[idx])
+	}
+
+	return up.String(), down.String()
+}
+
+// WriteMigration will write the schema changes for the tables that the configuration writes to as the next numbered
+// migration in the directory, e.g. "000002_gidari_schema.up.sql" and "000002_gidari_schema.down.sql", in a layout
+// that golang-migrate and atlas can apply. The changes are found by comparing the exported schema (see "ExportSchema")
+// with the statements of the "up" migrations already in the directory. The paths of the written files are returned,
+// and no files are written if there are no changes.
+func WriteMigration(ctx context.Context, cfg *Config, dialectName, dir, name string) ([]string, error) {
+	dialect, err := newSQLDialect(dialectName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("unable to create migrations directory: %w", err)
+	}
+
+	files, err := readMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []*tableStatement
+
+	for _, file := range files {
+		if !file.up {
+			continue
+		}
+
+		data, err := os.ReadFile(file.path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read migration: %w", err)
+		}
+
+		stmts, err := parseTableStatements(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(file.path), err)
+		}
+
+		statements = append(statements, stmts...)
+	}
+
+	schemas, err := cfg.schemas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	up, down := dialect.migration(schemas, statements)
+	if up == "" {
+		return nil, nil
+	}
+
+	name = strings.Trim(migrationNameReplacer.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if name == "" {
+		name = migrationDefaultName
+	}
+
+	prefix := filepath.Join(dir, fmt.Sprintf("%06d_%s", latestMigration(files)+1, name))
+	paths := []string{prefix + ".up.sql", prefix + ".down.sql"}
+
+	for idx, data := range []string{up, down} {
+		if err := os.WriteFile(paths[idx], []byte(data), 0o600); err != nil {
+			return nil, fmt.Errorf("unable to write migration: %w", err)
+		}
+	}
+
+	return paths, nil
+}
+
+// sqlToken is a token of a migration statement: a keyword or identifier, a quoted identifier, a string literal, or
+// a single punctuation character.
+type sqlToken struct {
+	text    string
+	quoted  bool
+	literal bool
+}
+
+// keyword reports whether the token is the unquoted keyword, which is compared case-insensitively.
+func (tok sqlToken) keyword(kw string) bool {
+	return !tok.quoted && !tok.literal && strings.EqualFold(tok.text, kw)
+}
+
+// ident reports whether the token can be an identifier.
+func (tok sqlToken) ident() bool {
+	return tok.quoted || (!tok.literal && tok.text != "" && isSQLWordByte(tok.text[0]))
+}
+
+// names reports whether the token is an identifier of the name. Quoted identifiers must match exactly, and unquoted
+// identifiers are compared case-insensitively.
+func (tok sqlToken) names(name string) bool {
+	if tok.quoted {
+		return tok.text == name
+	}
+
+	return tok.ident() && strings.EqualFold(tok.text, name)
+}
+
+// isSQLWordByte reports whether the byte can be part of an unquoted keyword or identifier.
+func isSQLWordByte(char byte) bool {
+	return char == '_' || char == '$' || char >= 0x80 || ('a' <= char && char <= 'z') ||
+		('A' <= char && char <= 'Z') || ('0' <= char && char <= '9')
+}
+
+// sqlQuoteEnd will return the index after the closing quote of a quoted token that starts at "start", where a doubled
+// quote escapes the quote, or -1 if the quote is not closed.
+func sqlQuoteEnd(src string, start int, quote byte) int {
+	for idx := start + 1; idx < len(src); idx++ {
+		if src[idx] != quote {
+			continue
+		}
+
+		if idx+1 < len(src) && src[idx+1] == quote {
+			idx++
+
+			continue
+		}
+
+		return idx + 1
+	}
+
+	return -1
+}
+
+// tokenizeSQL will split the source of a migration into the tokens of its statements. Comments are dropped, and the
+// bodies of dollar-quoted strings are kept as single literals so that their semicolons do not end a statement.
+func tokenizeSQL(src string) ([][]sqlToken, error) {
+	var (
+		statements [][]sqlToken
+		stmt       []sqlToken
+	)
+
+	for idx := 0; idx < len(src); {
+		char := src[idx]
+
+		switch {
+		case char == ' ' || char == '\t' || char == '\n' || char == '\r':
+			idx++
+		case strings.HasPrefix(src[idx:], "--"):
+			end := strings.IndexByte(src[idx:], '\n')
+			if end < 0 {
+				end = len(src) - idx
+			}
+
+			idx += end
+		case strings.HasPrefix(src[idx:], "/*"):
+			end := strings.Index(src[idx+2:], "*/")
+			if end < 0 {
+				return nil, UnparsableSQLError("unterminated comment")
+			}
+
+			idx += end + 4
+		case char == '\'' || char == '"' || char == '`':
+			end := sqlQuoteEnd(src, idx, char)
+			if end < 0 {
+				return nil, UnparsableSQLError(fmt.Sprintf("unterminated quote %c", char))
+			}
+
+			text := src[idx+1 : end-1]
+			text = strings.ReplaceAll(text, string(char)+string(char), string(char))
+			stmt = append(stmt, sqlToken{text: text, quoted: char != '\'', literal: char == '\''})
+			idx = end
+		case char == '$' && dollarQuoteTag(src[idx:]) != "":
+			tag := dollarQuoteTag(src[idx:])
+
+			end := strings.Index(src[idx+len(tag):], tag)
+			if end < 0 {
+				return nil, UnparsableSQLError("unterminated dollar quote " + tag)
+			}
+
+			stmt = append(stmt, sqlToken{text: src[idx+len(tag) : idx+len(tag)+end], literal: true})
+			idx += len(tag) + end + len(tag)
+		case isSQLWordByte(char):
+			end := idx
+			for end < len(src) && isSQLWordByte(src[end]) {
+				end++
+			}
+
+			stmt = append(stmt, sqlToken{text: src[idx:end]})
+			idx = end
+		case char == ';':
+			if len(stmt) > 0 {
+				statements = append(statements, stmt)
+			}
+
+			stmt = nil
+			idx++
+		default:
+			stmt = append(stmt, sqlToken{text: string(char)})
+			idx++
+		}
+	}
+
+	if len(stmt) > 0 {
+		statements = append(statements, stmt)
+	}
+
+	return statements, nil
+}
+
+// dollarQuoteTag will return the opening tag of a PostgreSQL dollar-quoted string at the start of the source, e.g.
+// "$$" or "$body$", or empty if the source does not start with one.
+func dollarQuoteTag(src string) string {
+	for idx := 1; idx < len(src); idx++ {
+		switch {
+		case src[idx] == '$':
+			return src[:idx+1]
+		case src[idx] == '_' || src[idx] >= 0x80 || ('a' <= src[idx] && src[idx] <= 'z') ||
+			('A' <= src[idx] && src[idx] <= 'Z') || (idx > 1 && '0' <= src[idx] && src[idx] <= '9'):
+			continue
+		default:
+			return ""
+		}
+	}
+
+	return ""
+}
+
+// sqlTableModifiers are the keywords that may come between "CREATE" and "TABLE".
+var sqlTableModifiers = map[string]bool{
+	"GLOBAL": true, "LOCAL": true, "TEMP": true, "TEMPORARY": true, "UNLOGGED": true, "OR": true, "REPLACE": true,
+}
+
+// sqlConstraintKeywords are the keywords that start a table constraint instead of a column definition.
+var sqlConstraintKeywords = map[string]bool{
+	"CONSTRAINT": true, "PRIMARY": true, "UNIQUE": true, "FOREIGN": true, "CHECK": true, "EXCLUDE": true,
+	"KEY": true, "INDEX": true, "FULLTEXT": true, "SPATIAL": true, "LIKE": true, "PROJECTION": true,
+}
+
+// isSQLConstraint reports whether the token starts a table constraint.
+func isSQLConstraint(tok sqlToken) bool {
+	return !tok.quoted && !tok.literal && sqlConstraintKeywords[strings.ToUpper(tok.text)]
+}
+
+// tableStatement is a statement of a previous migration that creates or alters a table, with the columns that it
+// creates, adds, or renames to.
+type tableStatement struct {
+	table   sqlToken
+	columns []sqlToken
+}
+
+// parseTableStatements will return the statements of the migration that create or alter tables. Other statements
+// are ignored, and an error is returned for a table statement whose table or columns can not be found.
+func parseTableStatements(src string) ([]*tableStatement, error) {
+	statements, err := tokenizeSQL(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []*tableStatement
+
+	for _, tokens := range statements {
+		var stmt *tableStatement
+
+		switch {
+		case tokens[0].keyword("CREATE"):
+			stmt, err = parseCreateTable(tokens)
+		case tokens[0].keyword("ALTER"):
+			stmt, err = parseAlterTable(tokens)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if stmt != nil {
+			tables = append(tables, stmt)
+		}
+	}
+
+	return tables, nil
+}
+
+// sqlParser reads the tokens of a statement in order.
+type sqlParser struct {
+	tokens []sqlToken
+	pos    int
+}
+
+// peek will return the next token, or an empty token at the end of the statement.
+func (parser *sqlParser) peek() sqlToken {
+	if parser.pos >= len(parser.tokens) {
+		return sqlToken{}
+	}
+
+	return parser.tokens[parser.pos]
+}
+
+// next will return the next token and move past it.
+func (parser *sqlParser) next() sqlToken {
+	tok := parser.peek()
+	parser.pos++
+
+	return tok
+}
+
+// accept will move past the keywords if they are next, and report whether they were.
+func (parser *sqlParser) accept(keywords ...string) bool {
+	for idx, kw := range keywords {
+		if parser.pos+idx >= len(parser.tokens) || !parser.tokens[parser.pos+idx].keyword(kw) {
+			return false
+		}
+	}
+
+	parser.pos += len(keywords)
+
+	return true
+}
+
+// name will return the last part of a possibly schema-qualified name, e.g. "orders" of public."orders".
+func (parser *sqlParser) name(what string) (sqlToken, error) {
+	tok := parser.next()
+	if !tok.ident() {
+		return sqlToken{}, UnparsableSQLError(fmt.Sprintf("expected %s name, got %q", what, tok.text))
+	}
+
+	for parser.peek().text == "." && !parser.peek().quoted {
+		parser.next()
+
+		if tok = parser.next(); !tok.ident() {
+			return sqlToken{}, UnparsableSQLError(fmt.Sprintf("expected %s name, got %q", what, tok.text))
+		}
+	}
+
+	return tok, nil
+}
+
+// parseCreateTable will parse a "CREATE TABLE" statement, or return nil if the statement creates something else.
+func parseCreateTable(tokens []sqlToken) (*tableStatement, error) {
+	parser := &sqlParser{tokens: tokens, pos: 1}
+	for sqlTableModifiers[strings.ToUpper(parser.peek().text)] && !parser.peek().quoted {
+		parser.next()
+	}
+
+	if !parser.accept("TABLE") {
+		return nil, nil
+	}
+
+	parser.accept("IF", "NOT", "EXISTS")
+
+	table, err := parser.name("table")
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := parser.next(); tok.text != "(" || tok.quoted || tok.literal {
+		return nil, UnparsableSQLError(fmt.Sprintf("expected the columns of table %s", table.text))
+	}
+
+	stmt := &tableStatement{table: table}
+
+	// Each definition at the top level of the parentheses starts with a column name or a constraint keyword.
+	for depth, start := 1, true; depth > 0; {
+		tok := parser.next()
+		if parser.pos > len(tokens) {
+			return nil, UnparsableSQLError(fmt.Sprintf("unterminated columns of table %s", table.text))
+		}
+
+		plain := !tok.quoted && !tok.literal
+
+		switch {
+		case plain && tok.text == "(":
+			depth++
+		case plain && tok.text == ")":
+			depth--
+		case plain && tok.text == "," && depth == 1:
+			start = true
+
+			continue
+		case start && !isSQLConstraint(tok):
+			if !tok.ident() {
+				return nil, UnparsableSQLError(fmt.Sprintf("expected a column of table %s, got %q", table.text,
+					tok.text))
+			}
+
+			stmt.columns = append(stmt.columns, tok)
+		}
+
+		start = false
+	}
+
+	return stmt, nil
+}
+
+// parseAlterTable will parse an "ALTER TABLE" statement, or return nil if the statement alters something else.
+// Columns that are added or renamed to are recorded, and the other actions are ignored.
+func parseAlterTable(tokens []sqlToken) (*tableStatement, error) {
+	parser := &sqlParser{tokens: tokens, pos: 1}
+	if !parser.accept("TABLE") {
+		return nil, nil
+	}
+
+	parser.accept("IF", "EXISTS")
+	parser.accept("ONLY")
+
+	table, err := parser.name("table")
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := &tableStatement{table: table}
+
+	for parser.pos < len(tokens) {
+		switch {
+		case parser.accept("ADD"):
+			if isSQLConstraint(parser.peek()) {
+				break
+			}
+
+			parser.accept("COLUMN")
+			parser.accept("IF", "NOT", "EXISTS")
+
+			column, err := parser.name("column")
+			if err != nil {
+				return nil, err
+			}
+
+			stmt.columns = append(stmt.columns, column)
+		case parser.accept("RENAME"):
+			if parser.accept("TO") || isSQLConstraint(parser.peek()) {
+				break
+			}
+
+			parser.accept("COLUMN")
+
+			if _, err := parser.name("column"); err != nil {
+				return nil, err
+			}
+
+			if !parser.accept("TO") {
+				return nil, UnparsableSQLError(fmt.Sprintf("expected the new column name of table %s", table.text))
+			}
+
+			column, err := parser.name("column")
+			if err != nil {
+				return nil, err
+			}
+
+			stmt.columns = append(stmt.columns, column)
+		}
+
+		// Skip to the next action, past any parentheses of the current one.
+		for depth := 0; parser.pos < len(tokens); {
+			tok := parser.next()
+			plain := !tok.quoted && !tok.literal
+
+			if plain && tok.text == "(" {
+				depth++
+			} else if plain && tok.text == ")" {
+				depth--
+			} else if plain && tok.text == "," && depth == 0 {
+				break
+			}
+		}
+	}
+
+	return stmt, nil
+}
+
+// migratedColumns will return the columns that the statements of the previous migrations create or add to the table,
+// and whether any statement creates or alters the table.
+func migratedColumns(statements []*tableStatement, table string) ([]sqlToken, bool) {
+	var (
+		columns []sqlToken
+		found   bool
+	)
+
+	for _, stmt := range statements {
+		if stmt.table.names(table) {
+			columns = append(columns, stmt.columns...)
+			found = true
+		}
+	}
+
+	return columns, found
+}
@@ -0,0 +1,208 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestWriteMigration(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	passthroughConfig := func(generated map[string]string) *Config {
+		pt := &Passthrough{Keys: []string{"id"}, Generated: generated}
+		pt.setDefaults()
+
+		return &Config{Requests: []*Request{{Table: "orders", Passthrough: pt}}}
+	}
+
+	paths, err := WriteMigration(ctx, passthroughConfig(nil), DialectPostgres, dir, "Create Orders")
+	if err != nil {
+		t.Fatalf("failed to write migration: %v", err)
+	}
+
+	if len(paths) != 2 || filepath.Base(paths[0]) != "000001_create_orders.up.sql" ||
+		filepath.Base(paths[1]) != "000001_create_orders.down.sql" {
+		t.Fatalf("unexpected migration files: %v", paths)
+	}
+
+	down, err := os.ReadFile(paths[1])
+	if err != nil {
+		t.Fatalf("failed to read migration: %v", err)
+	}
+
+	if string(down) != "DROP TABLE IF EXISTS \"orders\";\n" {
+		t.Fatalf("unexpected down migration: %q", down)
+	}
+
+	// The same schema has no changes.
+	if paths, err = WriteMigration(ctx, passthroughConfig(nil), DialectPostgres, dir, ""); err != nil || paths != nil {
+		t.Fatalf("expected no migration, got %v: %v", paths, err)
+	}
+
+	paths, err = WriteMigration(ctx, passthroughConfig(map[string]string{"product_id": "product.id"}), DialectPostgres,
+		dir, "")
+	if err != nil {
+		t.Fatalf("failed to write migration: %v", err)
+	}
+
+	if len(paths) != 2 || filepath.Base(paths[0]) != "000002_gidari_schema.up.sql" {
+		t.Fatalf("unexpected migration files: %v", paths)
+	}
+
+	up, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatalf("failed to read migration: %v", err)
+	}
+
+	if !strings.HasPrefix(string(up), `ALTER TABLE "orders" ADD COLUMN "product_id" TEXT GENERATED ALWAYS AS`) ||
+		strings.Contains(string(up), "CREATE TABLE") {
+		t.Fatalf("expected only the new column to be added, got:\n%s", up)
+	}
+
+	files, err := readMigrations(dir)
+	if err != nil {
+		t.Fatalf("failed to read migrations: %v", err)
+	}
+
+	if latest := latestMigration(files); latest != 2 {
+		t.Fatalf("expected latest migration 2, got %d", latest)
+	}
+}
+
+func TestAppliedMigration(t *testing.T) {
+	t.Parallel()
+
+	record, err := structpb.NewStruct(map[string]interface{}{"version": 20230601120000.0, "dirty": true})
+	if err != nil {
+		t.Fatalf("failed to create record: %v", err)
+	}
+
+	version, dirty := appliedMigration([]*structpb.Struct{record})
+	if version != 20230601120000 || !dirty {
+		t.Fatalf("unexpected applied migration: %d, %t", version, dirty)
+	}
+
+	if version, _ := appliedMigration(nil); version != 0 {
+		t.Fatalf("expected no applied migration, got %d", version)
+	}
+}
+
+func TestCheckMigrations(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("no migrations directory", func(t *testing.T) {
+		t.Parallel()
+
+		if err := checkMigrations(ctx, &Config{ConnectionStrings: []string{"unused://"}}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	})
+
+	t.Run("no migrations", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &Config{ConnectionStrings: []string{"unused://"}, MigrationsDir: t.TempDir()}
+		if err := checkMigrations(ctx, cfg); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	})
+}
+
+func TestParseTableStatements(t *testing.T) {
+	t.Parallel()
+
+	for _, tcase := range []struct {
+		name    string
+		src     string
+		table   string
+		columns []string
+		found   bool
+	}{
+		{
+			name:    "generated",
+			src:     "CREATE TABLE IF NOT EXISTS \"orders\" (\n\t\"id\" TEXT,\n\tPRIMARY KEY (\"id\")\n);\n",
+			table:   "orders",
+			columns: []string{"id"},
+			found:   true,
+		},
+		{
+			name:    "unquoted and schema-qualified",
+			src:     "create table public.Orders (ID text primary key, \"Price\" numeric(10, 2) not null);",
+			table:   "orders",
+			columns: []string{"id", "Price"},
+			found:   true,
+		},
+		{
+			name:  "quoted names are exact",
+			src:   `CREATE TABLE "Orders" (id TEXT);`,
+			table: "orders",
+		},
+		{
+			name:    "altered",
+			src:     "-- add columns\nALTER TABLE ONLY orders ADD COLUMN IF NOT EXISTS size TEXT, RENAME COLUMN px TO price;",
+			table:   "ORDERS",
+			columns: []string{"size", "price"},
+			found:   true,
+		},
+		{
+			name: "constraints and bodies are skipped",
+			src: "CREATE TABLE `orders` (`id` TEXT, CONSTRAINT pk PRIMARY KEY (`id`), KEY idx (`id`));\n" +
+				"CREATE FUNCTION f() RETURNS void AS $$ BEGIN; ALTER TABLE orders ADD x INT; END $$ LANGUAGE plpgsql;\n" +
+				"CREATE INDEX orders_idx ON orders (id);",
+			table:   "orders",
+			columns: []string{"id"},
+			found:   true,
+		},
+	} {
+		tcase := tcase
+
+		t.Run(tcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			stmts, err := parseTableStatements(tcase.src)
+			if err != nil {
+				t.Fatalf("failed to parse statements: %v", err)
+			}
+
+			columns, found := migratedColumns(stmts, tcase.table)
+			if found != tcase.found || len(columns) != len(tcase.columns) {
+				t.Fatalf("expected columns %v (%t), got %v (%t)", tcase.columns, tcase.found, columns, found)
+			}
+
+			for idx, col := range tcase.columns {
+				if !columns[idx].names(col) {
+					t.Fatalf("expected column %q, got %q", col, columns[idx].text)
+				}
+			}
+		})
+	}
+
+	for _, src := range []string{
+		"CREATE TABLE orders AS SELECT * FROM trades;",
+		"CREATE TABLE orders (id TEXT",
+		"ALTER TABLE orders ADD COLUMN (size TEXT);",
+		`CREATE TABLE "orders (id TEXT);`,
+	} {
+		if _, err := parseTableStatements(src); !errors.Is(err, ErrUnparsableSQL) {
+			t.Fatalf("expected an unparsable migration error for %q, got %v", src, err)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+)
+
+const (
+	// mqttDefaultKeepAlive is the default keep alive interval of the connection to the broker.
+	mqttDefaultKeepAlive = 30 * time.Second
+
+	// mqttRequestMethod is the method of the request written for an MQTT source, e.g. to the archive.
+	mqttRequestMethod = "MQTT"
+)
+
+var ErrInvalidMQTT = fmt.Errorf("invalid mqtt source")
+
+// InvalidMQTTError is returned when the MQTT configuration of a request is not valid.
+func InvalidMQTTError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidMQTT, reason)
+}
+
+// mqttSchemes are the schemes of the URL of the broker.
+var mqttSchemes = map[string]bool{"tcp": true, "mqtt": true, "ssl": true, "tls": true, "mqtts": true, "ws": true,
+	"wss": true}
+
+// MQTTTopic is a topic filter subscribed to, with the QoS of the subscription.
+type MQTTTopic struct {
+	// Filter is the topic filter, which may include the single level "+" and multi level "#" wildcards, e.g.
+	// "sensors/+/temperature" or "plant/line1/#".
+	Filter string `yaml:"filter"`
+
+	// QoS is the maximum QoS of the messages delivered for the filter, 0, 1, or 2.
+	QoS int `yaml:"qos"`
+}
+
+// MQTT is the configuration for capturing the messages published to the topics of an MQTT broker, e.g. sensor or
+// telemetry data. The subscriber connects to "Broker", subscribes to "Topics", and writes the messages it receives for
+// "Duration" as records.
+//
+// Unless "CleanSession" is set, the broker keeps the session of the "ClientID" between runs, and delivers the QoS 1 and
+// 2 messages published while gidari was not subscribed on the next run. The subscriber reconnects and resumes the
+// session when the connection is lost during a capture.
+type MQTT struct {
+	// Broker is the URL of the broker, e.g. "tcp://broker.example:1883" or "ssl://broker.example:8883".
+	Broker string `yaml:"broker"`
+
+	// ClientID identifies the session on the broker. It is required unless "CleanSession" is set.
+	ClientID string `yaml:"clientID"`
+
+	// Username and Password are sent on the connect, if the broker requires them.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// CleanSession discards the session on the broker on each run, so only the messages published during the capture
+	// are written.
+	CleanSession bool `yaml:"cleanSession"`
+
+	// KeepAlive is the keep alive interval of the connection, 30 seconds by default.
+	KeepAlive time.Duration `yaml:"keepAlive"`
+
+	// Topics are the topic filters subscribed to.
+	Topics []MQTTTopic `yaml:"topics"`
+
+	// Duration is how long the topics are captured for each run.
+	Duration time.Duration `yaml:"duration"`
+
+	// dial connects to the broker and subscribes to the topics, an MQTT subscriber unless it is set by tests.
+	dial func(ctx context.Context, broker string, cfg web.MQTTSubscriberConfig) (mqttStream, error)
+
+	// firstOnly writes the record of the first message received, to sample the schema.
+	firstOnly bool
+}
+
+// mqttStream is the stream of the messages published to the topics of the subscriber.
+type mqttStream interface {
+	ReadMessage() (web.MQTTMessage, error)
+	Close() error
+}
+
+// dialMQTTStream will connect to the broker and subscribe to the topics.
+func dialMQTTStream(ctx context.Context, broker string, cfg web.MQTTSubscriberConfig) (mqttStream, error) {
+	return web.DialMQTT(ctx, broker, cfg)
+}
+
+func (src *MQTT) validate(req *Request) error {
+	if src.Broker == "" {
+		return MissingConfigFieldError("mqtt.broker")
+	}
+
+	uri, err := url.Parse(src.Broker)
+	if err != nil || !mqttSchemes[uri.Scheme] || uri.Host == "" {
+		return InvalidMQTTError(fmt.Sprintf("broker %q must be a tcp, mqtt, ssl, tls, mqtts, ws, or wss URL",
+			src.Broker))
+	}
+
+	if src.ClientID == "" && !src.CleanSession {
+		return MissingConfigFieldError("mqtt.clientID")
+	}
+
+	if len(src.Topics) == 0 {
+		return MissingConfigFieldError("mqtt.topics")
+	}
+
+	for _, topic := range src.Topics {
+		if err := validateMQTTFilter(topic.Filter); err != nil {
+			return err
+		}
+
+		if topic.QoS < 0 || topic.QoS > 2 {
+			return InvalidMQTTError(fmt.Sprintf("qos %d of topic %q must be 0, 1, or 2", topic.QoS, topic.Filter))
+		}
+	}
+
+	if src.Duration <= 0 {
+		return MissingConfigFieldError("mqtt.duration")
+	}
+
+	if src.KeepAlive != 0 && src.KeepAlive < time.Second {
+		return InvalidMQTTError("mqtt.keepAlive must be at least one second")
+	}
+
+	if req.Timeseries != nil || req.Paginate != nil || req.Prometheus != nil || req.OrderBook != nil ||
+		req.FIX != nil || req.SQL != nil || req.LDAP != nil || req.SNMP != nil || req.IMAP != nil {
+		return InvalidMQTTError("mqtt can not be combined with timeseries, paginate, prometheus, orderBook, fix, " +
+			"sql, ldap, snmp, or imap")
+	}
+
+	return nil
+}
+
+// validateMQTTFilter will return an error unless the wildcards of the topic filter each occupy a whole level, and the
+// multi level wildcard is the last level.
+func validateMQTTFilter(filter string) error {
+	if filter == "" {
+		return MissingConfigFieldError("mqtt.topics.filter")
+	}
+
+	levels := strings.Split(filter, "/")
+	for idx, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || idx != len(levels)-1) {
+			return InvalidMQTTError(fmt.Sprintf("topic %q must only use # as its last level", filter))
+		}
+
+		if strings.Contains(level, "+") && level != "+" {
+			return InvalidMQTTError(fmt.Sprintf("topic %q must only use + as a whole level", filter))
+		}
+	}
+
+	return nil
+}
+
+func (src *MQTT) setDefaults() {
+	if src.KeepAlive == 0 {
+		src.KeepAlive = mqttDefaultKeepAlive
+	}
+}
+
+// subscriberConfig will return the configuration of the subscriber. A clean session without a ClientID connects with
+// a random one.
+func (src *MQTT) subscriberConfig() web.MQTTSubscriberConfig {
+	cfg := web.MQTTSubscriberConfig{
+		ClientID:     src.ClientID,
+		Username:     src.Username,
+		Password:     src.Password,
+		CleanSession: src.CleanSession,
+		KeepAlive:    src.KeepAlive,
+		Topics:       make(map[string]byte, len(src.Topics)),
+	}
+
+	if cfg.ClientID == "" {
+		cfg.ClientID = "gidari-" + uuid.New().String()
+	}
+
+	for _, topic := range src.Topics {
+		cfg.Topics[topic.Filter] = byte(topic.QoS)
+	}
+
+	return cfg
+}
+
+// capture will subscribe to the topics, and return the records of the messages received for "Duration" as a JSON
+// array. The request returned stands for the subscription, with the "MQTT" method and an "mqtt://" URL of the broker
+// and the topic filters. The size of each payload is counted as downloaded by the usage tracker.
+func (src *MQTT) capture(ctx context.Context, usage *usageTracker) (*http.Request, []byte, error) {
+	captureCtx, cancel := context.WithTimeout(ctx, src.Duration)
+	defer cancel()
+
+	dial := src.dial
+	if dial == nil {
+		dial = dialMQTTStream
+	}
+
+	stream, err := dial(captureCtx, src.Broker, src.subscriberConfig())
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+
+		return nil, nil, err
+	}
+
+	// Closing the stream at the end of the capture disconnects and unblocks the reader.
+	go func() {
+		<-captureCtx.Done()
+		stream.Close()
+	}()
+
+	records := []map[string]interface{}{}
+
+	for {
+		msg, err := stream.ReadMessage()
+		if err != nil {
+			// The stream is only closed at the end of the capture, which returns the records unless the capture was
+			// canceled rather than completed.
+			if err := ctx.Err(); err != nil {
+				return nil, nil, err
+			}
+
+			return src.marshal(ctx, records)
+		}
+
+		usage.download(len(msg.Payload))
+
+		records = append(records, mqttRecord(msg, time.Now()))
+
+		if src.firstOnly {
+			return src.marshal(ctx, records)
+		}
+	}
+}
+
+// marshal will return the request of the subscription and the records as a JSON array.
+func (src *MQTT) marshal(ctx context.Context, records []map[string]interface{}) (*http.Request, []byte, error) {
+	filters := make([]string, 0, len(src.Topics))
+	for _, topic := range src.Topics {
+		filters = append(filters, topic.Filter)
+	}
+
+	uri := &url.URL{Scheme: "mqtt", Path: "/" + strings.Join(filters, ",")}
+	if broker, err := url.Parse(src.Broker); err == nil {
+		uri.Host = broker.Host
+	}
+
+	req, err := http.NewRequestWithContext(ctx, mqttRequestMethod, uri.String(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create request: %w", err)
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+	}
+
+	return req, data, nil
+}
+
+// mqttRecord will convert a message to a record. The fields of a JSON object payload are written to the record, and
+// any other payload is written to "payload", decoded if it is JSON. The record also has the fields "_topic", "_qos",
+// "_retained", and "_receivedAt".
+func mqttRecord(msg web.MQTTMessage, receivedAt time.Time) map[string]interface{} {
+	var payload interface{}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		payload = string(msg.Payload)
+	}
+
+	record, ok := payload.(map[string]interface{})
+	if !ok {
+		record = map[string]interface{}{"payload": payload}
+	}
+
+	record["_topic"] = msg.Topic
+	record["_qos"] = int(msg.QoS)
+	record["_retained"] = msg.Retained
+	record["_receivedAt"] = receivedAt.UTC().Format(time.RFC3339Nano)
+
+	return record
+}
@@ -0,0 +1,197 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+)
+
+// fakeMQTTStream is a subscriber that receives its messages, and then blocks until it is closed.
+type fakeMQTTStream struct {
+	messages chan web.MQTTMessage
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newFakeMQTTStream(messages ...web.MQTTMessage) *fakeMQTTStream {
+	stream := &fakeMQTTStream{messages: make(chan web.MQTTMessage, len(messages)), closed: make(chan struct{})}
+
+	for _, msg := range messages {
+		stream.messages <- msg
+	}
+
+	return stream
+}
+
+func (stream *fakeMQTTStream) ReadMessage() (web.MQTTMessage, error) {
+	select {
+	case msg := <-stream.messages:
+		return msg, nil
+	case <-stream.closed:
+		return web.MQTTMessage{}, web.ErrMQTTClosed
+	}
+}
+
+func (stream *fakeMQTTStream) Close() error {
+	stream.once.Do(func() { close(stream.closed) })
+
+	return nil
+}
+
+func TestMQTT(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	newMQTT := func(stream mqttStream) *MQTT {
+		src := &MQTT{
+			Broker:   "ssl://broker.example:8883",
+			ClientID: "gidari-sensors",
+			Topics:   []MQTTTopic{{Filter: "sensors/+/temperature", QoS: 1}, {Filter: "plant/#"}},
+			Duration: 200 * time.Millisecond,
+			dial: func(_ context.Context, _ string, cfg web.MQTTSubscriberConfig) (mqttStream, error) {
+				exp := map[string]byte{"sensors/+/temperature": 1, "plant/#": 0}
+				if cfg.ClientID != "gidari-sensors" || cfg.CleanSession || !reflect.DeepEqual(cfg.Topics, exp) {
+					return nil, errors.New("unexpected subscriber config")
+				}
+
+				return stream, nil
+			},
+		}
+		src.setDefaults()
+
+		return src
+	}
+
+	t.Run("capture", func(t *testing.T) {
+		t.Parallel()
+
+		stream := newFakeMQTTStream(
+			web.MQTTMessage{Topic: "sensors/kitchen/temperature", Payload: []byte(`{"celsius":21.5}`), QoS: 1},
+			web.MQTTMessage{Topic: "plant/line1/count", Payload: []byte("42"), Retained: true},
+			web.MQTTMessage{Topic: "plant/line1/state", Payload: []byte("running")},
+		)
+
+		req, body, err := newMQTT(stream).capture(ctx, nil)
+		if err != nil {
+			t.Fatalf("failed to capture topics: %v", err)
+		}
+
+		if req.Method != mqttRequestMethod ||
+			req.URL.String() != "mqtt://broker.example:8883/sensors/+/temperature,plant/%23" {
+			t.Fatalf("expected the request of the subscription, got %s %s", req.Method, req.URL)
+		}
+
+		var records []map[string]interface{}
+		if err := json.Unmarshal(body, &records); err != nil {
+			t.Fatalf("failed to decode records: %v", err)
+		}
+
+		for _, record := range records {
+			if _, err := time.Parse(time.RFC3339Nano, record["_receivedAt"].(string)); err != nil {
+				t.Fatalf("expected the time the message was received, got %v", record["_receivedAt"])
+			}
+
+			delete(record, "_receivedAt")
+		}
+
+		exp := []map[string]interface{}{
+			{"celsius": 21.5, "_topic": "sensors/kitchen/temperature", "_qos": 1.0, "_retained": false},
+			{"payload": 42.0, "_topic": "plant/line1/count", "_qos": 0.0, "_retained": true},
+			{"payload": "running", "_topic": "plant/line1/state", "_qos": 0.0, "_retained": false},
+		}
+
+		if !reflect.DeepEqual(records, exp) {
+			t.Fatalf("expected records %v, got %v", exp, records)
+		}
+	})
+
+	t.Run("sample", func(t *testing.T) {
+		t.Parallel()
+
+		src := newMQTT(newFakeMQTTStream(
+			web.MQTTMessage{Topic: "plant/line1/count", Payload: []byte(`{"count":1}`)},
+			web.MQTTMessage{Topic: "plant/line1/count", Payload: []byte(`{"count":2}`)},
+		))
+		src.Duration = time.Hour
+		src.firstOnly = true
+
+		_, body, err := src.capture(ctx, nil)
+		if err != nil {
+			t.Fatalf("failed to sample topics: %v", err)
+		}
+
+		var records []map[string]interface{}
+		if err := json.Unmarshal(body, &records); err != nil || len(records) != 1 || records[0]["count"] != 1.0 {
+			t.Fatalf("expected the record of the first message, got %s: %v", body, err)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		if _, _, err := newMQTT(newFakeMQTTStream()).capture(canceled, nil); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected error %v, got %v", context.Canceled, err)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		valid := MQTT{Broker: "tcp://broker.example:1883", ClientID: "gidari", Duration: time.Minute,
+			Topics: []MQTTTopic{{Filter: "sensors/+/temperature", QoS: 1}}}
+
+		noClientID := valid
+		noClientID.ClientID = ""
+
+		clean := noClientID
+		clean.CleanSession = true
+
+		badScheme := valid
+		badScheme.Broker = "http://broker.example"
+
+		badWildcard := valid
+		badWildcard.Topics = []MQTTTopic{{Filter: "sensors/#/temperature"}}
+
+		partialLevel := valid
+		partialLevel.Topics = []MQTTTopic{{Filter: "sensors/room+"}}
+
+		badQoS := valid
+		badQoS.Topics = []MQTTTopic{{Filter: "sensors/#", QoS: 3}}
+
+		for _, tc := range []struct {
+			src MQTT
+			req *Request
+			err error
+		}{
+			{noClientID, new(Request), ErrMissingConfigField},
+			{clean, new(Request), nil},
+			{badScheme, new(Request), ErrInvalidMQTT},
+			{badWildcard, new(Request), ErrInvalidMQTT},
+			{partialLevel, new(Request), ErrInvalidMQTT},
+			{badQoS, new(Request), ErrInvalidMQTT},
+			{valid, &Request{FIX: &FIX{}}, ErrInvalidMQTT},
+			{valid, new(Request), nil},
+		} {
+			if err := tc.src.validate(tc.req); !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v for %+v, got %v", tc.err, tc.src, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,437 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// openAPIMaxRefs is the number of references that are followed to resolve a schema, which stops reference
+	// cycles.
+	openAPIMaxRefs = 16
+
+	// openAPIDefaultPageSize is the page size of the suggested offset pagination, if the size parameter has no
+	// default.
+	openAPIDefaultPageSize = 100
+)
+
+var (
+	// openAPIOffsetParams and openAPISizeParams are the names of the query parameters of the offset of the first
+	// record of a page, and of the page size, that pagination is suggested for.
+	openAPIOffsetParams = []string{"offset", "startAt", "start", "skip"}
+	openAPISizeParams   = []string{"limit", "per_page", "perPage", "page_size", "pageSize", "maxResults", "size"}
+)
+
+var ErrInvalidOpenAPI = fmt.Errorf("invalid openapi document")
+
+// InvalidOpenAPIError is returned when an OpenAPI document can not be imported.
+func InvalidOpenAPIError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidOpenAPI, reason)
+}
+
+// ImportOpenAPI will generate a configuration from an OpenAPI 3 or Swagger 2 document, in JSON or YAML, for users to
+// prune and fill in. Every "GET" operation without path parameters is a request, with its required query parameters
+// set to their example or default values, and a table named after the last segment of its path:
+//
+//   - The first security scheme that the document requires, or that it defines, is configured with placeholder
+//     credentials. Bearer and OAuth2 schemes are "auth2", basic schemes are "basic", and API keys are set as headers
+//     or query parameters.
+//   - Responses that wrap the records in an object, e.g. "{"data": [...]}", are unwrapped with the "records" field of
+//     link pagination, and operations with offset and page size query parameters, e.g. "offset" and "limit", are
+//     paginated by offset.
+//   - The array of objects fields of the records are exploded to child tables.
+//
+// The operations that require path parameters are listed in a comment. The URL overrides the server of the document,
+// and is required if the document does not have an absolute server URL.
+func ImportOpenAPI(data []byte, rawURL string) ([]byte, error) {
+	document := parseExploreDocument(data)
+	if document == nil {
+		return nil, InvalidOpenAPIError("expected an OpenAPI or Swagger document with paths")
+	}
+
+	var baseURL *url.URL
+
+	if rawURL != "" {
+		var err error
+		if baseURL, err = url.Parse(rawURL); err != nil {
+			return nil, fmt.Errorf("unable to parse URL: %w", err)
+		}
+
+		baseURL.Path = strings.TrimSuffix(baseURL.Path, "/")
+	} else {
+		baseURL = exploreBaseURL(document, new(url.URL))
+	}
+
+	if baseURL.Scheme == "" || baseURL.Host == "" {
+		return nil, InvalidOpenAPIError("the document has no absolute server URL")
+	}
+
+	return openAPIConfig(document, exploreEndpoints(document), baseURL)
+}
+
+// openAPIResolve will follow the "$ref" of the value to the value it references in the document, e.g.
+// "#/components/schemas/Product". Values without a reference, and references that can not be resolved, are returned
+// as is.
+func openAPIResolve(document map[string]interface{}, val interface{}) interface{} {
+	for depth := 0; depth < openAPIMaxRefs; depth++ {
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return val
+		}
+
+		ref, ok := obj["$ref"].(string)
+		if !ok || !strings.HasPrefix(ref, "#/") {
+			return val
+		}
+
+		var target interface{} = document
+
+		for _, token := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+
+			parent, ok := target.(map[string]interface{})
+			if !ok {
+				return val
+			}
+
+			target = parent[token]
+		}
+
+		if target == nil {
+			return val
+		}
+
+		val = target
+	}
+
+	return val
+}
+
+// openAPIConfig will return the configuration imported from the operations of the document.
+func openAPIConfig(document map[string]interface{}, endpoints []*ExploredEndpoint, baseURL *url.URL) ([]byte, error) {
+	stanza := &exploreStanza{
+		URL:               baseURL.String(),
+		RateLimit:         &exploreRateLimit{Burst: 1, Period: "1s"},
+		ConnectionStrings: []string{exploreConnectionString},
+	}
+
+	comments := []string{"Imported from " + openAPITitle(document) + ". Prune the requests that are not needed, " +
+		"replace the connection string and credentials,", "and create the tables with \"gidari schema export\"."}
+
+	queryAuth, securityComments := openAPISecurity(document, stanza)
+	comments = append(comments, securityComments...)
+
+	var skipped []string
+
+	tables := make(map[string]int)
+
+	for _, ep := range endpoints {
+		if ep.Method != http.MethodGet {
+			continue
+		}
+
+		if !ep.fetchable() {
+			skipped = append(skipped, ep.Path)
+
+			continue
+		}
+
+		table := exploreTableName(ep.Path)
+		if tables[table]++; tables[table] > 1 {
+			table += "_" + strconv.Itoa(tables[table])
+		}
+
+		req := &exploreRequest{Endpoint: ep.Path, Table: table}
+
+		for key, val := range ep.Query {
+			openAPISetQuery(req, key, val)
+		}
+
+		for key, val := range queryAuth {
+			openAPISetQuery(req, key, val)
+		}
+
+		openAPIRecords(document, ep, req)
+		stanza.Requests = append(stanza.Requests, req)
+	}
+
+	if len(skipped) > 0 {
+		comments = append(comments, "", "The GET operations that require path parameters are not imported:")
+
+		for _, path := range skipped {
+			comments = append(comments, "  "+path)
+		}
+	}
+
+	return encodeExploreStanza(stanza, comments...)
+}
+
+// openAPISetQuery will set the query parameter of the request.
+func openAPISetQuery(req *exploreRequest, key, val string) {
+	if req.Query == nil {
+		req.Query = make(map[string]string)
+	}
+
+	req.Query[key] = val
+}
+
+// openAPITitle will return the title and version of the document.
+func openAPITitle(document map[string]interface{}) string {
+	info, _ := document["info"].(map[string]interface{})
+
+	title, _ := info["title"].(string)
+	if title == "" {
+		title = "an OpenAPI document"
+	}
+
+	if version, ok := info["version"]; ok {
+		title += " " + fmt.Sprint(version)
+	}
+
+	return title
+}
+
+// openAPISecurity will configure the first security scheme that the document requires, or that it defines, on the
+// configuration with placeholder credentials, and return the query parameters of API keys that are sent in the query,
+// with comments that describe the security schemes of the document.
+func openAPISecurity(document map[string]interface{}, stanza *exploreStanza) (map[string]string, []string) {
+	schemes, _ := document["securityDefinitions"].(map[string]interface{})
+	if components, ok := document["components"].(map[string]interface{}); ok {
+		schemes, _ = components["securitySchemes"].(map[string]interface{})
+	}
+
+	if len(schemes) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(schemes))
+	for name := range schemes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	chosen := names[0]
+
+	if security, ok := document["security"].([]interface{}); ok && len(security) > 0 {
+		requirement, _ := security[0].(map[string]interface{})
+
+		for _, name := range names {
+			if _, ok := requirement[name]; ok {
+				chosen = name
+
+				break
+			}
+		}
+	}
+
+	comments := []string{"", "Security schemes:"}
+
+	var query map[string]string
+
+	for _, name := range names {
+		scheme, _ := openAPIResolve(document, schemes[name]).(map[string]interface{})
+		typ, _ := scheme["type"].(string)
+		httpScheme, _ := scheme["scheme"].(string)
+		in, _ := scheme["in"].(string)
+		param, _ := scheme["name"].(string)
+
+		desc := typ
+		if httpScheme != "" {
+			desc += " " + httpScheme
+		} else if in != "" {
+			desc += " in " + in + " " + param
+		}
+
+		configured := name == chosen
+
+		switch {
+		case !configured:
+		case typ == "oauth2" || typ == "openIdConnect" || (typ == "http" && strings.EqualFold(httpScheme, "bearer")):
+			stanza.Authentication = &exploreAuthentication{Auth2: &Auth2{Bearer: "<token>"}}
+		case typ == "basic" || (typ == "http" && strings.EqualFold(httpScheme, "basic")):
+			stanza.Authentication = &exploreAuthentication{Basic: &Basic{Email: "<user>", Password: "<password>"}}
+		case typ == "apiKey" && in == "header":
+			stanza.Headers = map[string]string{param: "<api key>"}
+		case typ == "apiKey" && in == "query":
+			query = map[string]string{param: "<api key>"}
+		default:
+			configured = false
+		}
+
+		if configured {
+			desc += " (configured)"
+		}
+
+		comments = append(comments, "  "+name+": "+desc)
+	}
+
+	return query, comments
+}
+
+// openAPIResponseSchema will return the schema of the successful JSON response of the operation.
+func openAPIResponseSchema(document map[string]interface{}, operation map[string]interface{}) map[string]interface{} {
+	responses, _ := operation["responses"].(map[string]interface{})
+
+	codes := make([]string, 0, len(responses))
+	for code := range responses {
+		if strings.HasPrefix(code, "2") {
+			codes = append(codes, code)
+		}
+	}
+
+	if len(codes) == 0 {
+		return nil
+	}
+
+	sort.Strings(codes)
+
+	response, _ := openAPIResolve(document, responses[codes[0]]).(map[string]interface{})
+
+	// The response of a Swagger document has a schema, and the response of an OpenAPI document has a schema for each
+	// media type.
+	schema := response["schema"]
+
+	content, _ := response["content"].(map[string]interface{})
+	for mediaType, media := range content {
+		if media, ok := media.(map[string]interface{}); ok && strings.Contains(mediaType, "json") {
+			schema = media["schema"]
+
+			break
+		}
+	}
+
+	resolved, _ := openAPIResolve(document, schema).(map[string]interface{})
+
+	return resolved
+}
+
+// openAPIArrayItems will return the schema of the objects of an array schema, or nil if the schema is not an array of
+// objects.
+func openAPIArrayItems(document map[string]interface{}, schema map[string]interface{}) map[string]interface{} {
+	items, ok := openAPIResolve(document, schema["items"]).(map[string]interface{})
+	if !ok || (schema["type"] != nil && schema["type"] != "array") {
+		return nil
+	}
+
+	if items["type"] != "object" && items["properties"] == nil {
+		return nil
+	}
+
+	return items
+}
+
+// openAPIRecords will set the pagination and explodes of the request from the response schema and the parameters of
+// its operation.
+func openAPIRecords(document map[string]interface{}, ep *ExploredEndpoint, req *exploreRequest) {
+	schema := openAPIResponseSchema(document, ep.operation)
+	if schema == nil {
+		return
+	}
+
+	var records string
+
+	item := openAPIArrayItems(document, schema)
+	if item == nil {
+		item = schema
+
+		// An object with a single array of objects field wraps the records in the field.
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, prop := range properties {
+			prop, _ := openAPIResolve(document, prop).(map[string]interface{})
+			if wrapped := openAPIArrayItems(document, prop); wrapped != nil {
+				if records != "" {
+					records, item = "", schema
+
+					break
+				}
+
+				records, item = name, wrapped
+			}
+		}
+	}
+
+	if records != "" {
+		req.Paginate = &explorePaginate{Type: PaginateLink, Records: records}
+	}
+
+	openAPIPaginate(ep, req, records)
+
+	properties, _ := item["properties"].(map[string]interface{})
+
+	fields := make([]string, 0, len(properties))
+	for name := range properties {
+		fields = append(fields, name)
+	}
+
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		prop, _ := openAPIResolve(document, properties[field]).(map[string]interface{})
+		if openAPIArrayItems(document, prop) != nil {
+			req.Explode = append(req.Explode, &exploreExplode{Field: field, Table: req.Table + "_" + field})
+		}
+	}
+}
+
+// openAPIPaginate will set offset pagination on the request if the operation has offset and page size query
+// parameters.
+func openAPIPaginate(ep *ExploredEndpoint, req *exploreRequest, records string) {
+	var offset, size map[string]interface{}
+
+	for _, param := range ep.params {
+		if param["in"] != "query" {
+			continue
+		}
+
+		name, _ := param["name"].(string)
+
+		for _, candidate := range openAPIOffsetParams {
+			if name == candidate && offset == nil {
+				offset = param
+			}
+		}
+
+		for _, candidate := range openAPISizeParams {
+			if name == candidate && size == nil {
+				size = param
+			}
+		}
+	}
+
+	if offset == nil || size == nil {
+		return
+	}
+
+	pageSize, err := strconv.Atoi(exploreParamValue(size))
+	if err != nil || pageSize <= 0 {
+		pageSize = openAPIDefaultPageSize
+	}
+
+	req.Paginate = &explorePaginate{
+		Type:      PaginateOffset,
+		Records:   records,
+		Param:     fmt.Sprint(offset["name"]),
+		SizeParam: fmt.Sprint(size["name"]),
+		Size:      pageSize,
+	}
+
+	// The offset and the page size are sent by the pagination.
+	delete(req.Query, req.Paginate.Param)
+	delete(req.Query, req.Paginate.SizeParam)
+
+	if len(req.Query) == 0 {
+		req.Query = nil
+	}
+}
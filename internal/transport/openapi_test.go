@@ -0,0 +1,178 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestImportOpenAPI(t *testing.T) {
+	t.Parallel()
+
+	t.Run("openapi", func(t *testing.T) {
+		t.Parallel()
+
+		document := `openapi: 3.0.3
+info: {title: Shop, version: 2.1.0}
+servers:
+  - url: https://{region}.shop.example/api
+    variables:
+      region: {default: eu}
+security:
+  - apiKey: []
+components:
+  securitySchemes:
+    apiKey: {type: apiKey, in: header, name: X-API-Key}
+    bearer: {type: http, scheme: bearer}
+  parameters:
+    limit: {name: limit, in: query, schema: {type: integer, default: 50}}
+  schemas:
+    Order:
+      type: object
+      properties:
+        id: {type: string}
+        lines: {type: array, items: {$ref: '#/components/schemas/Line'}}
+        tags: {type: array, items: {type: string}}
+    Line:
+      type: object
+      properties:
+        sku: {type: string}
+paths:
+  /orders:
+    get:
+      parameters:
+        - {name: offset, in: query, schema: {type: integer}}
+        - $ref: '#/components/parameters/limit'
+        - {name: status, in: query, required: true, schema: {enum: [open, closed]}}
+      responses:
+        '200':
+          content:
+            application/json:
+              schema:
+                type: object
+                properties:
+                  data: {type: array, items: {$ref: '#/components/schemas/Order'}}
+                  total: {type: integer}
+  /orders/{id}:
+    get:
+      responses: {'200': {description: ok}}
+  /products:
+    get:
+      responses:
+        '200':
+          content:
+            application/json:
+              schema: {type: array, items: {type: object, properties: {id: {type: integer}}}}
+    post:
+      responses: {'201': {description: created}}
+`
+
+		out, err := ImportOpenAPI([]byte(document), "")
+		if err != nil {
+			t.Fatalf("failed to import: %v", err)
+		}
+
+		var stanza exploreStanza
+		if err := yaml.Unmarshal(out, &stanza); err != nil {
+			t.Fatalf("failed to decode configuration: %v", err)
+		}
+
+		exp := exploreStanza{
+			URL:               "https://eu.shop.example/api",
+			RateLimit:         &exploreRateLimit{Burst: 1, Period: "1s"},
+			Headers:           map[string]string{"X-API-Key": "<api key>"},
+			ConnectionStrings: []string{exploreConnectionString},
+			Requests: []*exploreRequest{
+				{
+					Endpoint: "/orders",
+					Table:    "orders",
+					Query:    map[string]string{"status": "open"},
+					Paginate: &explorePaginate{Type: PaginateOffset, Records: "data", Param: "offset",
+						SizeParam: "limit", Size: 50},
+					Explode: []*exploreExplode{{Field: "lines", Table: "orders_lines"}},
+				},
+				{Endpoint: "/products", Table: "products"},
+			},
+		}
+
+		if !reflect.DeepEqual(stanza, exp) {
+			t.Fatalf("expected configuration %+v, got:\n%s", exp, out)
+		}
+
+		for _, comment := range []string{"# Imported from Shop 2.1.0.", "#   apiKey: apiKey in header X-API-Key " +
+			"(configured)", "#   bearer: http bearer\n", "#   /orders/{id}\n"} {
+			if !strings.Contains(string(out), comment) {
+				t.Fatalf("expected comment %q, got:\n%s", comment, out)
+			}
+		}
+
+		if _, err := NewConfig(out); err != nil {
+			t.Fatalf("expected a valid configuration: %v", err)
+		}
+	})
+
+	t.Run("swagger", func(t *testing.T) {
+		t.Parallel()
+
+		document := `{
+			"swagger": "2.0",
+			"host": "legacy.example",
+			"basePath": "/v1",
+			"schemes": ["https"],
+			"securityDefinitions": {"basic": {"type": "basic"}},
+			"paths": {"/users": {"get": {"responses": {"200": {"schema": {"type": "object",
+				"properties": {"users": {"type": "array", "items": {"$ref": "#/definitions/User"}}}}}}}}},
+			"definitions": {"User": {"type": "object", "properties": {"id": {"type": "integer"}}}}
+		}`
+
+		out, err := ImportOpenAPI([]byte(document), "")
+		if err != nil {
+			t.Fatalf("failed to import: %v", err)
+		}
+
+		var stanza exploreStanza
+		if err := yaml.Unmarshal(out, &stanza); err != nil {
+			t.Fatalf("failed to decode configuration: %v", err)
+		}
+
+		if stanza.URL != "https://legacy.example/v1" || stanza.Authentication == nil ||
+			stanza.Authentication.Basic == nil || len(stanza.Requests) != 1 ||
+			!reflect.DeepEqual(stanza.Requests[0].Paginate, &explorePaginate{Type: PaginateLink, Records: "users"}) {
+			t.Fatalf("expected the users to be imported, got:\n%s", out)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		relative := `{"openapi": "3.0.0", "servers": [{"url": "/api"}], "paths": {}}`
+
+		for _, tc := range []struct {
+			document, url string
+			err           error
+		}{
+			{`{"title": "not a document"}`, "", ErrInvalidOpenAPI},
+			{relative, "", ErrInvalidOpenAPI},
+			{relative, "https://api.example/v2/", nil},
+		} {
+			out, err := ImportOpenAPI([]byte(tc.document), tc.url)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v for %s, got %v", tc.err, tc.document, err)
+			}
+
+			if err == nil && !strings.Contains(string(out), "url: https://api.example/v2\n") {
+				t.Fatalf("expected the URL to override the server, got:\n%s", out)
+			}
+		}
+	})
+}
@@ -0,0 +1,577 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+const (
+	// orderBookDefaultDepth is the default number of price levels written for each side of the book.
+	orderBookDefaultDepth = 50
+
+	// orderBookDefaultInterval is the default interval between the snapshots written of the book.
+	orderBookDefaultInterval = time.Second
+
+	// orderBookBuffer is the number of stream messages buffered while the REST snapshot is fetched.
+	orderBookBuffer = 1024
+)
+
+var (
+	ErrInvalidOrderBook = fmt.Errorf("invalid order book")
+	ErrOrderBookMessage = fmt.Errorf("unable to decode order book message")
+	ErrOrderBookStream  = fmt.Errorf("order book stream failed")
+)
+
+// InvalidOrderBookError is returned when the order book configuration of a request is not valid.
+func InvalidOrderBookError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidOrderBook, reason)
+}
+
+// OrderBookMessageError is returned when a snapshot or a delta of the order book can not be decoded.
+func OrderBookMessageError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrOrderBookMessage, reason)
+}
+
+// OrderBookStreamError is returned when the delta stream of the order book can not be opened or read.
+func OrderBookStreamError(err error) error {
+	return fmt.Errorf("%w: %v", ErrOrderBookStream, err)
+}
+
+// OrderBookFields are the fields of the order book messages, as dot-separated paths into the message, e.g.
+// "data.u" for the combined streams of Binance. Levels are arrays of a price and a size, as strings or numbers.
+type OrderBookFields struct {
+	// Sequence is the field of the sequence number of the message, i.e. the last update in the message.
+	Sequence string `yaml:"sequence"`
+
+	// FirstSequence is the field of the sequence number of the first update in a delta, e.g. "U" for Binance. If
+	// empty, each delta holds a single update.
+	FirstSequence string `yaml:"firstSequence"`
+
+	// Bids is the field of the bid levels, "bids" by default.
+	Bids string `yaml:"bids"`
+
+	// Asks is the field of the ask levels, "asks" by default.
+	Asks string `yaml:"asks"`
+}
+
+// OrderBook is the configuration for capturing the order book of an exchange. The endpoint of the request is the
+// REST snapshot of the book, which is kept consistent with the deltas of a WebSocket stream for "Duration". A
+// snapshot of the book is written every "Interval", with the best "Depth" levels of each side.
+//
+// Deltas with a sequence number at or before the book are dropped, and a delta that skips a sequence number
+// refetches the REST snapshot, so that every record is a consistent state of the book.
+type OrderBook struct {
+	// Stream is the "ws://" or "wss://" URL of the delta stream.
+	Stream string `yaml:"stream"`
+
+	// Subscribe is the message sent on the stream after connecting, if the stream requires a subscription.
+	Subscribe string `yaml:"subscribe"`
+
+	// Product is the name of the product written on each record, e.g. "BTC-USD".
+	Product string `yaml:"product"`
+
+	// Snapshot are the fields of the REST snapshot, "sequence", "bids", and "asks" by default.
+	Snapshot OrderBookFields `yaml:"snapshot"`
+
+	// Delta are the fields of the stream messages. The sequence field is required, and messages without it, such as
+	// subscription acknowledgements and heartbeats, are ignored.
+	Delta OrderBookFields `yaml:"delta"`
+
+	// Depth is the number of price levels written for each side of the book, 50 by default.
+	Depth int `yaml:"depth"`
+
+	// Interval is the interval between the snapshots written of the book, one second by default.
+	Interval time.Duration `yaml:"interval"`
+
+	// Duration is how long the book is captured for each run.
+	Duration time.Duration `yaml:"duration"`
+
+	// dial opens the delta stream, a WebSocket unless it is set by tests.
+	dial func(ctx context.Context, url string) (orderBookStream, error)
+
+	// snapshotOnly writes a single record from the REST snapshot without opening the stream, to sample the schema.
+	snapshotOnly bool
+}
+
+// orderBookStream is the stream of the order book deltas.
+type orderBookStream interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage(message []byte) error
+	Close() error
+}
+
+// dialOrderBookStream will open the WebSocket of the delta stream.
+func dialOrderBookStream(ctx context.Context, url string) (orderBookStream, error) {
+	return web.DialWebSocket(ctx, url, nil)
+}
+
+func (ob *OrderBook) validate(req *Request) error {
+	if ob.Stream == "" {
+		return MissingConfigFieldError("orderBook.stream")
+	}
+
+	if !strings.HasPrefix(ob.Stream, "ws://") && !strings.HasPrefix(ob.Stream, "wss://") {
+		return InvalidOrderBookError(fmt.Sprintf("stream %q must be a ws:// or wss:// url", ob.Stream))
+	}
+
+	if ob.Delta.Sequence == "" {
+		return MissingConfigFieldError("orderBook.delta.sequence")
+	}
+
+	if ob.Duration <= 0 {
+		return MissingConfigFieldError("orderBook.duration")
+	}
+
+	if ob.Depth < 0 || ob.Interval < 0 {
+		return InvalidOrderBookError("orderBook.depth and orderBook.interval can not be negative")
+	}
+
+	if req.Timeseries != nil || req.Paginate != nil || req.Prometheus != nil {
+		return InvalidOrderBookError("orderBook can not be combined with timeseries, paginate, or prometheus")
+	}
+
+	return nil
+}
+
+func (ob *OrderBook) setDefaults() {
+	for _, fields := range []*OrderBookFields{&ob.Snapshot, &ob.Delta} {
+		if fields.Sequence == "" {
+			fields.Sequence = "sequence"
+		}
+
+		if fields.Bids == "" {
+			fields.Bids = "bids"
+		}
+
+		if fields.Asks == "" {
+			fields.Asks = "asks"
+		}
+	}
+
+	if ob.Depth == 0 {
+		ob.Depth = orderBookDefaultDepth
+	}
+
+	if ob.Interval == 0 {
+		ob.Interval = orderBookDefaultInterval
+	}
+}
+
+// orderBookState is the state of the book at a sequence number, with the size of each price level.
+type orderBookState struct {
+	sequence int64
+	bids     map[float64]float64
+	asks     map[float64]float64
+}
+
+// capture will fetch the REST snapshot, apply the stream deltas to it for "Duration", and return the request of the
+// first snapshot and the snapshots of the book as a JSON array. The size of each message is counted as downloaded by
+// the usage tracker.
+func (ob *OrderBook) capture(ctx context.Context, fetchConfig *web.FetchConfig, usage *usageTracker) (*http.Request,
+	[]byte, error,
+) {
+	if ob.snapshotOnly {
+		req, book, err := ob.snapshot(ctx, fetchConfig, usage)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return ob.marshal(req, []map[string]interface{}{ob.record(book, time.Now())})
+	}
+
+	captureCtx, cancel := context.WithTimeout(ctx, ob.Duration)
+	defer cancel()
+
+	dial := ob.dial
+	if dial == nil {
+		dial = dialOrderBookStream
+	}
+
+	stream, err := dial(captureCtx, ob.Stream)
+	if err != nil {
+		return nil, nil, OrderBookStreamError(err)
+	}
+
+	// Closing the stream at the end of the capture unblocks the reader.
+	go func() {
+		<-captureCtx.Done()
+		stream.Close()
+	}()
+
+	messages := make(chan []byte, orderBookBuffer)
+	streamErr := make(chan error, 1)
+
+	go func() {
+		defer close(messages)
+
+		for {
+			msg, err := stream.ReadMessage()
+			if err != nil {
+				streamErr <- err
+
+				return
+			}
+
+			usage.download(len(msg))
+
+			select {
+			case messages <- msg:
+			case <-captureCtx.Done():
+				return
+			}
+		}
+	}()
+
+	if ob.Subscribe != "" {
+		if err := stream.WriteMessage([]byte(ob.Subscribe)); err != nil {
+			return nil, nil, OrderBookStreamError(err)
+		}
+	}
+
+	// The snapshot is fetched after subscribing, so that the deltas buffered in the meantime bridge the snapshot and
+	// the stream.
+	req, book, err := ob.snapshot(captureCtx, fetchConfig, usage)
+	if err != nil {
+		if ctx.Err() == nil && captureCtx.Err() != nil {
+			return nil, nil, InvalidOrderBookError("the capture ended before the snapshot was fetched")
+		}
+
+		return nil, nil, err
+	}
+
+	ticker := time.NewTicker(ob.Interval)
+	defer ticker.Stop()
+
+	records := []map[string]interface{}{}
+
+	// finish will write the last snapshot of the book, unless the capture was canceled rather than completed.
+	finish := func() (*http.Request, []byte, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		if book != nil {
+			records = append(records, ob.record(book, time.Now()))
+		}
+
+		return ob.marshal(req, records)
+	}
+
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				if captureCtx.Err() != nil {
+					return finish()
+				}
+
+				return nil, nil, OrderBookStreamError(<-streamErr)
+			}
+
+			gap, err := ob.apply(book, msg)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if !gap {
+				continue
+			}
+
+			// A missed delta leaves the book inconsistent, so it is rebuilt from a new snapshot. Buffered deltas
+			// before the new snapshot are dropped as stale.
+			if _, book, err = ob.snapshot(captureCtx, fetchConfig, usage); err != nil {
+				if captureCtx.Err() != nil {
+					return finish()
+				}
+
+				return nil, nil, err
+			}
+		case now := <-ticker.C:
+			records = append(records, ob.record(book, now))
+		case <-captureCtx.Done():
+			return finish()
+		}
+	}
+}
+
+// snapshot will fetch the REST snapshot of the book.
+func (ob *OrderBook) snapshot(ctx context.Context, fetchConfig *web.FetchConfig, usage *usageTracker) (*http.Request,
+	*orderBookState, error,
+) {
+	rsp, err := web.Fetch(ctx, fetchConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rsp.Body.Close()
+
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read response body: %w", err)
+	}
+
+	usage.download(len(body))
+
+	msg, err := decodeOrderBookMessage(body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seq, ok, err := orderBookSequence(msg, ob.Snapshot.Sequence)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !ok {
+		return nil, nil, OrderBookMessageError(fmt.Sprintf("snapshot is missing field %q", ob.Snapshot.Sequence))
+	}
+
+	book := &orderBookState{
+		sequence: seq,
+		bids:     make(map[float64]float64),
+		asks:     make(map[float64]float64),
+	}
+
+	if err := book.update(msg, ob.Snapshot); err != nil {
+		return nil, nil, err
+	}
+
+	return rsp.Request, book, nil
+}
+
+// apply will apply a delta message to the book, returning true if the delta skips a sequence number of the book.
+// Messages without a sequence number and stale deltas are ignored.
+func (ob *OrderBook) apply(book *orderBookState, data []byte) (bool, error) {
+	msg, err := decodeOrderBookMessage(data)
+	if err != nil {
+		return false, err
+	}
+
+	seq, ok, err := orderBookSequence(msg, ob.Delta.Sequence)
+	if err != nil || !ok || seq <= book.sequence {
+		return false, err
+	}
+
+	first := seq
+
+	if ob.Delta.FirstSequence != "" {
+		firstSeq, ok, err := orderBookSequence(msg, ob.Delta.FirstSequence)
+		if err != nil {
+			return false, err
+		}
+
+		if ok {
+			first = firstSeq
+		}
+	}
+
+	if first > book.sequence+1 {
+		return true, nil
+	}
+
+	if err := book.update(msg, ob.Delta); err != nil {
+		return false, err
+	}
+
+	book.sequence = seq
+
+	return false, nil
+}
+
+// update will set the size of the levels in the message, deleting the levels with a size of zero.
+func (book *orderBookState) update(msg map[string]interface{}, fields OrderBookFields) error {
+	for _, side := range []struct {
+		field  string
+		levels map[float64]float64
+	}{{fields.Bids, book.bids}, {fields.Asks, book.asks}} {
+		value, ok := lookupOrderBookField(msg, side.field)
+		if !ok || value == nil {
+			continue
+		}
+
+		levels, ok := value.([]interface{})
+		if !ok {
+			return OrderBookMessageError(fmt.Sprintf("field %q is not an array of levels", side.field))
+		}
+
+		for _, level := range levels {
+			pair, ok := level.([]interface{})
+			if !ok || len(pair) < 2 {
+				return OrderBookMessageError(fmt.Sprintf("invalid level %v in field %q", level, side.field))
+			}
+
+			price, err := orderBookNumber(pair[0])
+			if err != nil {
+				return err
+			}
+
+			size, err := orderBookNumber(pair[1])
+			if err != nil {
+				return err
+			}
+
+			if size == 0 {
+				delete(side.levels, price)
+			} else {
+				side.levels[price] = size
+			}
+		}
+	}
+
+	return nil
+}
+
+// record will return the snapshot of the book written to storage, with the best "Depth" levels of each side.
+func (ob *OrderBook) record(book *orderBookState, now time.Time) map[string]interface{} {
+	record := map[string]interface{}{
+		"time":     now.UTC().Format(time.RFC3339Nano),
+		"sequence": book.sequence,
+		"bids":     topLevels(book.bids, ob.Depth, true),
+		"asks":     topLevels(book.asks, ob.Depth, false),
+	}
+
+	if ob.Product != "" {
+		record["product"] = ob.Product
+	}
+
+	return record
+}
+
+// marshal will return the request and the records as a JSON array.
+func (ob *OrderBook) marshal(req *http.Request, records []map[string]interface{}) (*http.Request, []byte, error) {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+	}
+
+	return req, data, nil
+}
+
+// topLevels will return the best levels of a side of the book as price and size pairs, the highest prices first for
+// bids and the lowest prices first for asks.
+func topLevels(levels map[float64]float64, depth int, descending bool) [][2]float64 {
+	prices := make([]float64, 0, len(levels))
+	for price := range levels {
+		prices = append(prices, price)
+	}
+
+	if descending {
+		sort.Sort(sort.Reverse(sort.Float64Slice(prices)))
+	} else {
+		sort.Float64s(prices)
+	}
+
+	if len(prices) > depth {
+		prices = prices[:depth]
+	}
+
+	top := make([][2]float64, len(prices))
+	for idx, price := range prices {
+		top[idx] = [2]float64{price, levels[price]}
+	}
+
+	return top
+}
+
+// decodeOrderBookMessage will decode a JSON message, keeping numbers exact for sequence numbers. Messages that are not
+// objects, such as the heartbeats of some exchanges, are returned empty.
+func decodeOrderBookMessage(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var msg interface{}
+	if err := dec.Decode(&msg); err != nil {
+		return nil, OrderBookMessageError(err.Error())
+	}
+
+	obj, _ := msg.(map[string]interface{})
+
+	return obj, nil
+}
+
+// lookupOrderBookField will return the value at the dot-separated path of the message.
+func lookupOrderBookField(msg map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = msg
+
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if value, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// orderBookSequence will return the sequence number at the path of the message, and false if the message does not have
+// one.
+func orderBookSequence(msg map[string]interface{}, path string) (int64, bool, error) {
+	value, ok := lookupOrderBookField(msg, path)
+	if !ok || value == nil {
+		return 0, false, nil
+	}
+
+	var (
+		seq int64
+		err error
+	)
+
+	switch value := value.(type) {
+	case json.Number:
+		seq, err = value.Int64()
+	case string:
+		seq, err = strconv.ParseInt(value, 10, 64)
+	default:
+		err = errors.New("not an integer")
+	}
+
+	if err != nil {
+		return 0, false, OrderBookMessageError(fmt.Sprintf("invalid sequence %v in field %q", value, path))
+	}
+
+	return seq, true, nil
+}
+
+// orderBookNumber will parse the price or size of a level, which exchanges commonly encode as strings.
+func orderBookNumber(value interface{}) (float64, error) {
+	var str string
+
+	switch value := value.(type) {
+	case json.Number:
+		str = value.String()
+	case string:
+		str = value
+	default:
+		return 0, OrderBookMessageError(fmt.Sprintf("invalid number %v", value))
+	}
+
+	num, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, OrderBookMessageError(fmt.Sprintf("invalid number %q", str))
+	}
+
+	return num, nil
+}
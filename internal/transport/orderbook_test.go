@@ -0,0 +1,264 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+	"golang.org/x/time/rate"
+)
+
+// fakeOrderBookStream is a delta stream that sends its messages, and then blocks until it is closed.
+type fakeOrderBookStream struct {
+	messages chan string
+	closed   chan struct{}
+	once     sync.Once
+
+	mtx     sync.Mutex
+	written []string
+}
+
+func newFakeOrderBookStream(messages ...string) *fakeOrderBookStream {
+	stream := &fakeOrderBookStream{messages: make(chan string, len(messages)), closed: make(chan struct{})}
+	for _, msg := range messages {
+		stream.messages <- msg
+	}
+
+	return stream
+}
+
+func (stream *fakeOrderBookStream) ReadMessage() ([]byte, error) {
+	select {
+	case msg := <-stream.messages:
+		return []byte(msg), nil
+	case <-stream.closed:
+		return nil, errors.New("closed")
+	}
+}
+
+func (stream *fakeOrderBookStream) WriteMessage(message []byte) error {
+	stream.mtx.Lock()
+	defer stream.mtx.Unlock()
+
+	stream.written = append(stream.written, string(message))
+
+	return nil
+}
+
+func (stream *fakeOrderBookStream) Close() error {
+	stream.once.Do(func() { close(stream.closed) })
+
+	return nil
+}
+
+// newOrderBookFetchConfig will return the fetch config of a server with the REST snapshots, in order, and the
+// number of snapshots fetched.
+func newOrderBookFetchConfig(t *testing.T, snapshots ...string) (*web.FetchConfig, *int32) {
+	t.Helper()
+
+	var fetched int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idx := int(atomic.AddInt32(&fetched, 1)) - 1
+		if idx >= len(snapshots) {
+			idx = len(snapshots) - 1
+		}
+
+		_, _ = w.Write([]byte(snapshots[idx]))
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := web.NewClient(context.Background(), http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	rurl, _ := url.Parse(server.URL + "/api/v3/depth?symbol=BTCUSDT")
+
+	return &web.FetchConfig{
+		C:           client,
+		Method:      http.MethodGet,
+		URL:         rurl,
+		RateLimiter: rate.NewLimiter(rate.Inf, 1),
+	}, &fetched
+}
+
+type orderBookRecord struct {
+	Product  string       `json:"product"`
+	Time     string       `json:"time"`
+	Sequence int64        `json:"sequence"`
+	Bids     [][2]float64 `json:"bids"`
+	Asks     [][2]float64 `json:"asks"`
+}
+
+func TestOrderBook(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	newOrderBook := func(stream orderBookStream) *OrderBook {
+		ob := &OrderBook{
+			Stream:    "wss://stream.binance.com:9443/ws/btcusdt@depth",
+			Subscribe: `{"method":"SUBSCRIBE","id":1}`,
+			Product:   "BTCUSDT",
+			Snapshot:  OrderBookFields{Sequence: "lastUpdateId"},
+			Delta:     OrderBookFields{Sequence: "u", FirstSequence: "U", Bids: "b", Asks: "a"},
+			Interval:  time.Hour,
+			Duration:  300 * time.Millisecond,
+			dial: func(context.Context, string) (orderBookStream, error) {
+				return stream, nil
+			},
+		}
+		ob.setDefaults()
+
+		return ob
+	}
+
+	t.Run("capture", func(t *testing.T) {
+		t.Parallel()
+
+		stream := newFakeOrderBookStream(
+			`{"result":null,"id":1}`,
+			`{"U":5,"u":9,"b":[["100","7"]],"a":[]}`,
+			`{"U":9,"u":12,"b":[["100","0"],["98","3"]],"a":[["102","4"]]}`,
+			`{"U":14,"u":15,"b":[["90","1"]],"a":[]}`,
+			`{"U":18,"u":19,"b":[["90","1"]],"a":[]}`,
+			`{"U":20,"u":21,"b":[],"a":[["103","0"],["104","5"]]}`,
+		)
+
+		fetchConfig, fetched := newOrderBookFetchConfig(t,
+			`{"lastUpdateId":10,"bids":[["100","1"],["99","2"]],"asks":[["101","1"]]}`,
+			`{"lastUpdateId":19,"bids":[["97","1"]],"asks":[["103","2"]]}`)
+
+		req, body, err := newOrderBook(stream).capture(ctx, fetchConfig, nil)
+		if err != nil {
+			t.Fatalf("failed to capture order book: %v", err)
+		}
+
+		if req.URL.Path != "/api/v3/depth" {
+			t.Fatalf("expected the request of the snapshot, got %s", req.URL)
+		}
+
+		// The delta that skips sequence 13 is resolved by the second snapshot.
+		if count := atomic.LoadInt32(fetched); count != 2 {
+			t.Fatalf("expected 2 snapshots to be fetched, got %d", count)
+		}
+
+		var records []orderBookRecord
+		if err := json.Unmarshal(body, &records); err != nil {
+			t.Fatalf("failed to decode records: %v", err)
+		}
+
+		exp := orderBookRecord{
+			Product:  "BTCUSDT",
+			Sequence: 21,
+			Bids:     [][2]float64{{97, 1}},
+			Asks:     [][2]float64{{104, 5}},
+		}
+
+		if len(records) != 1 {
+			t.Fatalf("expected the final snapshot of the book, got %s", body)
+		}
+
+		if records[0].Time = ""; !reflect.DeepEqual(records[0], exp) {
+			t.Fatalf("expected record %+v, got %+v", exp, records[0])
+		}
+
+		if !reflect.DeepEqual(stream.written, []string{`{"method":"SUBSCRIBE","id":1}`}) {
+			t.Fatalf("expected the subscription to be sent, got %q", stream.written)
+		}
+	})
+
+	t.Run("sample", func(t *testing.T) {
+		t.Parallel()
+
+		fetchConfig, _ := newOrderBookFetchConfig(t,
+			`{"lastUpdateId":10,"bids":[["100","1"],["99.5","2"],["101","0"]],"asks":[["102","1"],["101.5","3"]]}`)
+
+		ob := newOrderBook(nil)
+		ob.Depth = 1
+		ob.snapshotOnly = true
+		ob.dial = func(context.Context, string) (orderBookStream, error) {
+			return nil, errors.New("unexpected dial")
+		}
+
+		_, body, err := ob.capture(ctx, fetchConfig, nil)
+		if err != nil {
+			t.Fatalf("failed to sample order book: %v", err)
+		}
+
+		var records []orderBookRecord
+		if err := json.Unmarshal(body, &records); err != nil || len(records) != 1 {
+			t.Fatalf("expected a single record, got %s: %v", body, err)
+		}
+
+		if !reflect.DeepEqual(records[0].Bids, [][2]float64{{100, 1}}) ||
+			!reflect.DeepEqual(records[0].Asks, [][2]float64{{101.5, 3}}) {
+			t.Fatalf("expected the best level of each side, got %+v", records[0])
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+
+		fetchConfig, _ := newOrderBookFetchConfig(t, `{"lastUpdateId":10,"bids":[],"asks":[]}`)
+
+		cancelCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		if _, _, err := newOrderBook(newFakeOrderBookStream()).capture(cancelCtx, fetchConfig, nil); err == nil {
+			t.Fatal("expected the canceled capture to fail")
+		}
+	})
+
+	t.Run("invalid message", func(t *testing.T) {
+		t.Parallel()
+
+		fetchConfig, _ := newOrderBookFetchConfig(t, `{"lastUpdateId":10,"bids":[],"asks":[]}`)
+
+		stream := newFakeOrderBookStream(`{"U":11,"u":11,"b":[["100"]]}`)
+		if _, _, err := newOrderBook(stream).capture(ctx, fetchConfig, nil); !errors.Is(err, ErrOrderBookMessage) {
+			t.Fatalf("expected error %v, got %v", ErrOrderBookMessage, err)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		valid := OrderBook{Stream: "wss://ws-feed.exchange.coinbase.com", Delta: OrderBookFields{Sequence: "sequence"},
+			Duration: time.Minute}
+
+		for _, tc := range []struct {
+			ob  OrderBook
+			req *Request
+			err error
+		}{
+			{OrderBook{Stream: valid.Stream, Duration: time.Minute}, new(Request), ErrMissingConfigField},
+			{OrderBook{Stream: valid.Stream, Delta: valid.Delta}, new(Request), ErrMissingConfigField},
+			{OrderBook{Stream: "https://api.exchange.coinbase.com", Delta: valid.Delta}, new(Request),
+				ErrInvalidOrderBook},
+			{valid, &Request{Paginate: &Paginate{Type: PaginateLink}}, ErrInvalidOrderBook},
+			{valid, new(Request), nil},
+		} {
+			if err := tc.ob.validate(tc.req); !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v for %+v, got %v", tc.err, tc.ob, err)
+			}
+		}
+	})
+}
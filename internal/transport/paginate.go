@@ -0,0 +1,338 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+const (
+	// PaginateLink follows the "next" link of the "Link" header of each response, e.g. for the GitHub API.
+	PaginateLink = "link"
+
+	// PaginateOffset moves the offset query parameter by the number of records on each page, until a page has fewer
+	// records than the page size, e.g. "startAt" for the Jira API.
+	PaginateOffset = "offset"
+
+	// PaginateCursor sets the cursor query parameter to the cursor field of the last record of each page, while the
+	// "hasMore" field of the response is true, e.g. "starting_after" for the Stripe API.
+	PaginateCursor = "cursor"
+
+	// defaultPaginateCursor is the default cursor field of the records of cursor pagination.
+	defaultPaginateCursor = "id"
+
+	// linkHeader is the header of the links to the other pages of a response, see RFC 8288.
+	linkHeader = "Link"
+)
+
+var (
+	ErrInvalidPaginate = fmt.Errorf("invalid paginate")
+	ErrPageRecords     = fmt.Errorf("unable to decode page records")
+)
+
+// InvalidPaginateError is returned when the paginate configuration of a request is not valid.
+func InvalidPaginateError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidPaginate, reason)
+}
+
+// PageRecordsError is returned when the records of a page can not be decoded.
+func PageRecordsError(page int, err error) error {
+	return fmt.Errorf("%w: page %d: %v", ErrPageRecords, page, err)
+}
+
+// Paginate is the configuration for fetching every page of a web API response. The records of every page are written
+// to storage as a single batch, and are archived as a single JSON array.
+type Paginate struct {
+	// Type is how the next page is requested, "link", "offset", or "cursor".
+	Type string `yaml:"type"`
+
+	// Records is the field of the response object that holds the records of a page, e.g. "issues". If empty, the
+	// response is the records.
+	Records string `yaml:"records"`
+
+	// Param is the query parameter of the offset of the first record of a page, e.g. "startAt", or of the cursor of
+	// the last record of the previous page, e.g. "starting_after". It is required for offset and cursor pagination.
+	Param string `yaml:"param"`
+
+	// Cursor is the field of the records that is sent as the cursor of the next page. The default is "id".
+	Cursor string `yaml:"cursor"`
+
+	// HasMore is the boolean field of the response object that is true while there are more pages, e.g. "has_more".
+	// If empty, cursor pagination stops at the first page with fewer records than the page size.
+	HasMore string `yaml:"hasMore"`
+
+	// SizeParam is the query parameter of the page size, e.g. "per_page" or "maxResults". If set, it is sent with
+	// "Size" unless the query of the request already sets it.
+	SizeParam string `yaml:"sizeParam"`
+
+	// Size is the number of records on a full page. Offset pagination stops at the first page with fewer records.
+	Size int `yaml:"size"`
+
+	// MaxPages is the maximum number of pages fetched for each request. If zero, every page is fetched.
+	MaxPages int `yaml:"maxPages"`
+}
+
+func (pg *Paginate) validate(req *Request) error {
+	switch pg.Type {
+	case PaginateLink:
+	case PaginateOffset:
+		if pg.Param == "" {
+			return MissingConfigFieldError("paginate.param")
+		}
+
+		if pg.Size <= 0 {
+			return InvalidPaginateError("offset pagination requires a positive paginate.size")
+		}
+	case PaginateCursor:
+		if pg.Param == "" {
+			return MissingConfigFieldError("paginate.param")
+		}
+
+		if pg.HasMore == "" && pg.Size <= 0 {
+			return InvalidPaginateError("cursor pagination requires paginate.hasMore or a positive paginate.size")
+		}
+
+		if pg.Cursor == "" {
+			pg.Cursor = defaultPaginateCursor
+		}
+	default:
+		return InvalidPaginateError(fmt.Sprintf("unknown type %q, expected %q, %q, or %q", pg.Type, PaginateLink,
+			PaginateOffset, PaginateCursor))
+	}
+
+	if pg.Size < 0 || pg.MaxPages < 0 {
+		return InvalidPaginateError("paginate.size and paginate.maxPages can not be negative")
+	}
+
+	if req.Prometheus != nil {
+		return InvalidPaginateError("paginate can not be combined with prometheus")
+	}
+
+	return nil
+}
+
+// fetch will fetch every page of the request, returning the request of the first page and the records of every page
+// as a JSON array. The size of each page is counted as downloaded by the usage tracker.
+func (pg *Paginate) fetch(ctx context.Context, fetchConfig *web.FetchConfig, usage *usageTracker) (*http.Request,
+	[]byte, error,
+) {
+	pageConfig := *fetchConfig
+	pageConfig.URL = pg.firstURL(*fetchConfig.URL)
+
+	var first *http.Request
+
+	records := []json.RawMessage{}
+
+	for page := 1; ; page++ {
+		rsp, err := web.Fetch(ctx, &pageConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		body, err := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read response body: %w", err)
+		}
+
+		usage.download(len(body))
+
+		if first == nil {
+			first = rsp.Request
+		}
+
+		pageRecords, err := pg.records(body)
+		if err != nil {
+			return nil, nil, PageRecordsError(page, err)
+		}
+
+		records = append(records, pageRecords...)
+
+		next := pg.next(pageConfig.URL, rsp.Header, body, pageRecords)
+		if next == nil || (pg.MaxPages > 0 && page >= pg.MaxPages) {
+			break
+		}
+
+		pageConfig.URL = next
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+	}
+
+	return first, data, nil
+}
+
+// firstURL will return the URL of the first page, with the page size if it is not set by the query of the request.
+func (pg *Paginate) firstURL(rurl url.URL) *url.URL {
+	if pg.SizeParam == "" || pg.Size == 0 {
+		return &rurl
+	}
+
+	query := rurl.Query()
+	if !query.Has(pg.SizeParam) {
+		query.Set(pg.SizeParam, strconv.Itoa(pg.Size))
+		rurl.RawQuery = query.Encode()
+	}
+
+	return &rurl
+}
+
+// records will return the records of the page. A response object without a "Records" field is a single record.
+func (pg *Paginate) records(body []byte) ([]json.RawMessage, error) {
+	if pg.Records != "" {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(body, &obj); err != nil {
+			return nil, fmt.Errorf("%w: %v", tools.ErrFailedToUnmarshalJSON, err)
+		}
+
+		field, ok := obj[pg.Records]
+		if !ok {
+			return nil, fmt.Errorf("missing field %q", pg.Records)
+		}
+
+		body = field
+	}
+
+	var records []json.RawMessage
+	if err := json.Unmarshal(body, &records); err == nil {
+		return records, nil
+	}
+
+	var record map[string]json.RawMessage
+	if err := json.Unmarshal(body, &record); err != nil {
+		return nil, fmt.Errorf("%w: %v", tools.ErrFailedToUnmarshalJSON, err)
+	}
+
+	return []json.RawMessage{body}, nil
+}
+
+// next will return the URL of the page after the page of the URL, or nil if it is the last page.
+func (pg *Paginate) next(rurl *url.URL, header http.Header, body []byte, records []json.RawMessage) *url.URL {
+	count := len(records)
+
+	switch pg.Type {
+	case PaginateLink:
+		next, ok := nextLink(header)
+		if !ok {
+			return nil
+		}
+
+		nextURL, err := rurl.Parse(next)
+		if err != nil {
+			return nil
+		}
+
+		return nextURL
+	case PaginateOffset:
+		if count == 0 || count < pg.Size {
+			return nil
+		}
+
+		query := rurl.Query()
+
+		offset, _ := strconv.Atoi(query.Get(pg.Param))
+		query.Set(pg.Param, strconv.Itoa(offset+count))
+
+		nextURL := *rurl
+		nextURL.RawQuery = query.Encode()
+
+		return &nextURL
+	case PaginateCursor:
+		if count == 0 || !pg.hasMore(body, count) {
+			return nil
+		}
+
+		var last map[string]json.RawMessage
+		if err := json.Unmarshal(records[count-1], &last); err != nil {
+			return nil
+		}
+
+		cursor, ok := last[pg.Cursor]
+		if !ok || string(cursor) == "null" {
+			return nil
+		}
+
+		// String cursors are sent unquoted, and numeric cursors as they are written in the response.
+		value := string(cursor)
+		if err := json.Unmarshal(cursor, &value); err != nil && strings.HasPrefix(value, `"`) {
+			return nil
+		}
+
+		query := rurl.Query()
+		query.Set(pg.Param, value)
+
+		nextURL := *rurl
+		nextURL.RawQuery = query.Encode()
+
+		return &nextURL
+	}
+
+	return nil
+}
+
+// hasMore will return true if there are more pages after the cursor page with the body and number of records.
+func (pg *Paginate) hasMore(body []byte, count int) bool {
+	if pg.HasMore == "" {
+		return count >= pg.Size
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return false
+	}
+
+	more, _ := obj[pg.HasMore].(bool)
+
+	return more
+}
+
+// nextLink will return the target of the "next" link of the "Link" header, e.g.
+// `<https://api.github.com/repositories/1/issues?page=2>; rel="next"`.
+func nextLink(header http.Header) (string, bool) {
+	for _, value := range header.Values(linkHeader) {
+		for _, link := range strings.Split(value, ",") {
+			target, params, ok := strings.Cut(link, ";")
+			if !ok {
+				continue
+			}
+
+			target = strings.TrimSpace(target)
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+
+			for _, param := range strings.Split(params, ";") {
+				name, rels, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if !strings.EqualFold(name, "rel") {
+					continue
+				}
+
+				for _, rel := range strings.Fields(strings.Trim(rels, `"`)) {
+					if strings.EqualFold(rel, "next") {
+						return strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">"), true
+					}
+				}
+			}
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,198 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+	"golang.org/x/time/rate"
+)
+
+// newPaginatedFetchConfig will return the fetch config for the endpoint of a server with three pages of records.
+// Link pages are requested with "page" and offset pages with "startAt", and each page has at most "size" records.
+func newPaginatedFetchConfig(t *testing.T, endpoint string) *web.FetchConfig {
+	t.Helper()
+
+	const total = 5
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("startAt"))
+
+		if r.URL.Path == "/link" {
+			offset = page * size
+			if offset+size < total {
+				next := *r.URL
+				query := next.Query()
+				query.Set("page", strconv.Itoa(page+1))
+				next.RawQuery = query.Encode()
+				w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", <%s?page=9>; rel="last"`, next.String(),
+					r.URL.Path))
+			}
+		}
+
+		var records []string
+		for idx := offset; idx < offset+size && idx < total; idx++ {
+			records = append(records, fmt.Sprintf(`{"id":%d}`, idx))
+		}
+
+		body := "[" + strings.Join(records, ",") + "]"
+		if r.URL.Path == "/offset" {
+			body = `{"total":5,"issues":` + body + `}`
+		}
+
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := web.NewClient(context.Background(), http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	rurl, _ := url.Parse(server.URL + endpoint)
+
+	return &web.FetchConfig{
+		C:           client,
+		Method:      http.MethodGet,
+		URL:         rurl,
+		RateLimiter: rate.NewLimiter(rate.Inf, 1),
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("link", func(t *testing.T) {
+		t.Parallel()
+
+		pg := &Paginate{Type: PaginateLink, SizeParam: "size", Size: 2}
+
+		req, body, err := pg.fetch(ctx, newPaginatedFetchConfig(t, "/link"), nil)
+		if err != nil {
+			t.Fatalf("failed to fetch pages: %v", err)
+		}
+
+		if string(body) != `[{"id":0},{"id":1},{"id":2},{"id":3},{"id":4}]` {
+			t.Fatalf("expected the records of every page, got %s", body)
+		}
+
+		if req.URL.Query().Get("size") != "2" || req.URL.Query().Has("page") {
+			t.Fatalf("expected the request of the first page, got %s", req.URL)
+		}
+
+		pg.MaxPages = 2
+
+		if _, body, err = pg.fetch(ctx, newPaginatedFetchConfig(t, "/link"), nil); err != nil ||
+			string(body) != `[{"id":0},{"id":1},{"id":2},{"id":3}]` {
+			t.Fatalf("expected the records of the first two pages, got %s: %v", body, err)
+		}
+	})
+
+	t.Run("offset", func(t *testing.T) {
+		t.Parallel()
+
+		pg := &Paginate{Type: PaginateOffset, Records: "issues", Param: "startAt", SizeParam: "size", Size: 2}
+
+		_, body, err := pg.fetch(ctx, newPaginatedFetchConfig(t, "/offset"), nil)
+		if err != nil {
+			t.Fatalf("failed to fetch pages: %v", err)
+		}
+
+		if string(body) != `[{"id":0},{"id":1},{"id":2},{"id":3},{"id":4}]` {
+			t.Fatalf("expected the records of every page, got %s", body)
+		}
+
+		pg.Records = "values"
+
+		if _, _, err := pg.fetch(ctx, newPaginatedFetchConfig(t, "/offset"), nil); !errors.Is(err, ErrPageRecords) {
+			t.Fatalf("expected error %v, got %v", ErrPageRecords, err)
+		}
+	})
+
+	t.Run("cursor", func(t *testing.T) {
+		t.Parallel()
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Query().Get("starting_after") {
+			case "":
+				_, _ = w.Write([]byte(`{"data":[{"id":"cus_1"},{"id":"cus_2"}],"has_more":true}`))
+			case "cus_2":
+				_, _ = w.Write([]byte(`{"data":[{"id":"cus_3"}],"has_more":false}`))
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}))
+		t.Cleanup(server.Close)
+
+		fetchConfig := newPaginatedFetchConfig(t, "/cursor")
+		fetchConfig.URL, _ = url.Parse(server.URL + "/v1/customers")
+
+		pg := &Paginate{Type: PaginateCursor, Records: "data", Param: "starting_after", HasMore: "has_more",
+			SizeParam: "limit", Size: 2}
+		if err := pg.validate(new(Request)); err != nil {
+			t.Fatalf("failed to validate: %v", err)
+		}
+
+		_, body, err := pg.fetch(ctx, fetchConfig, nil)
+		if err != nil {
+			t.Fatalf("failed to fetch pages: %v", err)
+		}
+
+		if string(body) != `[{"id":"cus_1"},{"id":"cus_2"},{"id":"cus_3"}]` {
+			t.Fatalf("expected the records of every page, got %s", body)
+		}
+	})
+
+	t.Run("next link", func(t *testing.T) {
+		t.Parallel()
+
+		header := http.Header{}
+		header.Add("Link", `<https://api.github.com/repositories/1/issues?page=1>; rel="prev first"`)
+		header.Add("Link", `<https://api.github.com/repositories/1/issues?page=3>; rel="next"`)
+
+		if next, ok := nextLink(header); !ok || next != "https://api.github.com/repositories/1/issues?page=3" {
+			t.Fatalf("unexpected next link %q", next)
+		}
+
+		if _, ok := nextLink(http.Header{"Link": {`<https://api.github.com>; rel="last"`}}); ok {
+			t.Fatal("expected no next link")
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		for _, pg := range []*Paginate{
+			{Type: "page"},
+			{Type: PaginateCursor, Param: "starting_after"},
+			{Type: PaginateOffset, Param: "startAt"},
+			{Type: PaginateLink, MaxPages: -1},
+		} {
+			if err := pg.validate(new(Request)); !errors.Is(err, ErrInvalidPaginate) {
+				t.Fatalf("expected error %v for %+v, got %v", ErrInvalidPaginate, pg, err)
+			}
+		}
+
+		if err := (&Paginate{Type: PaginateOffset}).validate(new(Request)); !errors.Is(err, ErrMissingConfigField) {
+			t.Fatalf("expected error %v, got %v", ErrMissingConfigField, err)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+const (
+	// passthroughDefaultColumn is the default column that the records are written to.
+	passthroughDefaultColumn = "data"
+
+	// passthroughIngestedAtColumn and passthroughRunIDColumn are the ingestion metadata columns written with every
+	// record. They are ignored by tables that do not have them.
+	passthroughIngestedAtColumn = "ingested_at"
+	passthroughRunIDColumn      = "run_id"
+)
+
+var (
+	ErrInvalidPassthrough = fmt.Errorf("invalid passthrough configuration")
+	ErrMissingPassthrough = fmt.Errorf("record is missing passthrough key")
+)
+
+// InvalidPassthroughError is returned when the passthrough configuration of a request is not valid.
+func InvalidPassthroughError(table, reason string) error {
+	return fmt.Errorf("%w for %q: %s", ErrInvalidPassthrough, table, reason)
+}
+
+// Passthrough is the configuration for writing each record into a single JSONB column, with the key fields extracted
+// into their own columns and the ingestion metadata ("ingested_at" and "run_id") alongside, instead of flattening
+// the record into a column per field. Changes to the shape of the records never break the writes.
+type Passthrough struct {
+	// Column is the name of the JSONB column the records are written to. The default is "data".
+	Column string `yaml:"column"`
+
+	// Keys are the fields on the records that are extracted into their own columns and make up the primary key.
+	Keys []string `yaml:"keys"`
+
+	// Generated are the columns generated from fields in the JSONB column for indexing, keyed by column name. Each
+	// value is a dot separated path to the field, e.g. "product.id". Generated columns are only used by the DDL, see
+	// "Passthrough.DDL", since the database computes them on write.
+	Generated map[string]string `yaml:"generated"`
+}
+
+func (pt *Passthrough) validate(req *Request) error {
+	if len(pt.Keys) == 0 {
+		return MissingConfigFieldError("passthrough.keys")
+	}
+
+	if len(req.Explode) > 0 || len(req.Routes) > 0 {
+		return InvalidPassthroughError(req.Table, "passthrough can not be combined with explode or routes")
+	}
+
+	for column, path := range pt.Generated {
+		if path == "" {
+			return InvalidPassthroughError(req.Table, fmt.Sprintf("generated column %q has no path", column))
+		}
+	}
+
+	return nil
+}
+
+func (pt *Passthrough) setDefaults() {
+	if pt.Column == "" {
+		pt.Column = passthroughDefaultColumn
+	}
+}
+
+// wrap will return the records wrapped for writing to the passthrough table: the key fields, the JSON of the record
+// in the passthrough column, and the ingestion metadata.
+func (pt *Passthrough) wrap(runID string, ingestedAt time.Time, records []map[string]interface{},
+) ([]map[string]interface{}, error) {
+	wrapped := make([]map[string]interface{}, 0, len(records))
+
+	for idx, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, &recordError{index: idx, err: fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)}
+		}
+
+		row := map[string]interface{}{
+			pt.Column:                   string(data),
+			passthroughIngestedAtColumn: ingestedAt.UTC().Format(time.RFC3339Nano),
+			passthroughRunIDColumn:      runID,
+		}
+
+		for _, key := range pt.Keys {
+			val, ok := record[key]
+			if !ok || val == nil {
+				return nil, &recordError{index: idx, err: fmt.Errorf("%w: %q", ErrMissingPassthrough, key)}
+			}
+
+			row[key] = val
+		}
+
+		wrapped = append(wrapped, row)
+	}
+
+	return wrapped, nil
+}
+
+// DDL will return the PostgreSQL statements that create the passthrough table, with the generated columns and an
+// index on each of them. Generated columns require PostgreSQL 12 or later.
+func (pt *Passthrough) DDL(table string) string {
+	return pgDialect.ddl(pt.schema(table))
+}
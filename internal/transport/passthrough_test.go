@@ -0,0 +1,97 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPassthrough(t *testing.T) {
+	t.Parallel()
+
+	t.Run("records are wrapped", func(t *testing.T) {
+		t.Parallel()
+
+		pt := &Passthrough{Keys: []string{"id"}}
+		pt.setDefaults()
+
+		ingestedAt := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+		records := []map[string]interface{}{{"id": "1", "product": map[string]interface{}{"id": "BTC-USD"}}}
+
+		wrapped, err := pt.wrap("run-1", ingestedAt, records)
+		if err != nil {
+			t.Fatalf("failed to wrap records: %v", err)
+		}
+
+		row := wrapped[0]
+		if row["id"] != "1" || row["run_id"] != "run-1" || row["ingested_at"] != "2022-05-10T00:00:00Z" {
+			t.Fatalf("unexpected passthrough row: %v", row)
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(row["data"].(string)), &data); err != nil {
+			t.Fatalf("failed to unmarshal passthrough data: %v", err)
+		}
+
+		if data["product"].(map[string]interface{})["id"] != "BTC-USD" {
+			t.Fatalf("expected the full record in the passthrough column, got %v", data)
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		t.Parallel()
+
+		pt := &Passthrough{Keys: []string{"id"}}
+		pt.setDefaults()
+
+		_, err := pt.wrap("run-1", time.Now(), []map[string]interface{}{{"id": "1"}, {"name": "no id"}})
+
+		var rerr *recordError
+		if !errors.Is(err, ErrMissingPassthrough) || !errors.As(err, &rerr) || rerr.index != 1 {
+			t.Fatalf("expected missing passthrough key error for record 1, got %v", err)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		req := &Request{Table: "orders", Explode: []*Explode{{Field: "fills", Table: "fills"}}}
+		if err := (&Passthrough{Keys: []string{"id"}}).validate(req); !errors.Is(err, ErrInvalidPassthrough) {
+			t.Fatalf("expected invalid passthrough error, got %v", err)
+		}
+
+		if err := new(Passthrough).validate(&Request{}); !errors.Is(err, ErrMissingConfigField) {
+			t.Fatalf("expected missing config field error, got %v", err)
+		}
+	})
+
+	t.Run("ddl", func(t *testing.T) {
+		t.Parallel()
+
+		pt := &Passthrough{Keys: []string{"id"}, Generated: map[string]string{"product_id": "product.id"}}
+		pt.setDefaults()
+
+		ddl := pt.DDL("orders")
+
+		for _, exp := range []string{
+			`CREATE TABLE IF NOT EXISTS "orders"`,
+			`"data" JSONB NOT NULL`,
+			`"product_id" TEXT GENERATED ALWAYS AS ("data" #>> '{product,id}') STORED`,
+			`PRIMARY KEY ("id")`,
+			`CREATE INDEX IF NOT EXISTS "orders_product_id_idx" ON "orders" ("product_id");`,
+		} {
+			if !strings.Contains(ddl, exp) {
+				t.Fatalf("expected %q in ddl:\n%s", exp, ddl)
+			}
+		}
+	})
+}
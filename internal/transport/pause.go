@@ -0,0 +1,85 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// PauseGate pauses the fetch stage of a run, e.g. while a destination is under maintenance. While the gate is paused,
+// the web workers do not start fetching their next request, and the responses that were already fetched are still
+// written. The transactions of the run stay open until the run is resumed and completes. The methods of a nil gate
+// never pause.
+type PauseGate struct {
+	mtx sync.Mutex
+
+	// resumed is closed when the gate is resumed, or nil if the gate is not paused.
+	resumed chan struct{}
+}
+
+// NewPauseGate will return a gate that is not paused.
+func NewPauseGate() *PauseGate {
+	return &PauseGate{}
+}
+
+// Pause will pause the gate, if it is not already paused.
+func (gate *PauseGate) Pause() {
+	gate.mtx.Lock()
+	defer gate.mtx.Unlock()
+
+	if gate.resumed == nil {
+		gate.resumed = make(chan struct{})
+	}
+}
+
+// Resume will resume the gate, if it is paused.
+func (gate *PauseGate) Resume() {
+	gate.mtx.Lock()
+	defer gate.mtx.Unlock()
+
+	if gate.resumed != nil {
+		close(gate.resumed)
+		gate.resumed = nil
+	}
+}
+
+// Paused will return true if the gate is paused.
+func (gate *PauseGate) Paused() bool {
+	if gate == nil {
+		return false
+	}
+
+	gate.mtx.Lock()
+	defer gate.mtx.Unlock()
+
+	return gate.resumed != nil
+}
+
+// wait will wait until the gate is not paused, or the context is done.
+func (gate *PauseGate) wait(ctx context.Context) error {
+	if gate == nil {
+		return nil
+	}
+
+	gate.mtx.Lock()
+	resumed := gate.resumed
+	gate.mtx.Unlock()
+
+	if resumed == nil {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("run canceled while paused: %w", ctx.Err())
+	}
+}
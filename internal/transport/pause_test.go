@@ -0,0 +1,70 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPauseGate(t *testing.T) {
+	t.Parallel()
+
+	t.Run("nil gates never pause", func(t *testing.T) {
+		t.Parallel()
+
+		var gate *PauseGate
+		if gate.Paused() || gate.wait(context.Background()) != nil {
+			t.Fatalf("expected a nil gate not to pause")
+		}
+	})
+
+	t.Run("waits until resumed", func(t *testing.T) {
+		t.Parallel()
+
+		gate := NewPauseGate()
+		gate.Pause()
+		gate.Pause()
+
+		if !gate.Paused() {
+			t.Fatalf("expected the gate to be paused")
+		}
+
+		resumed := make(chan error)
+
+		go func() { resumed <- gate.wait(context.Background()) }()
+
+		select {
+		case <-resumed:
+			t.Fatalf("expected the wait to block while the gate is paused")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		gate.Resume()
+
+		if err := <-resumed; err != nil || gate.Paused() {
+			t.Fatalf("expected the gate to be resumed, got %v", err)
+		}
+	})
+
+	t.Run("canceled waits", func(t *testing.T) {
+		t.Parallel()
+
+		gate := NewPauseGate()
+		gate.Pause()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := gate.wait(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected error %v, got %v", context.Canceled, err)
+		}
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	stageWeb        = "web"
+	stageRepository = "repository"
+)
+
+// PipelineError is an error leaving the upsert pipeline, with the context needed to debug the failure without
+// reproducing the run. Fields that are not known for the error are zero, and "Record" is -1.
+type PipelineError struct {
+	// RunID is the ID of the run, see "Config.RunID".
+	RunID string
+
+	// Stage is the stage of the pipeline the error occurred in, i.e. "web" or "repository".
+	Stage string
+
+	// Batch is the number of the web request in the run the error occurred for, starting at 1. Every web request is
+	// written to storage as one batch.
+	Batch int
+
+	// Endpoint is the URL of the web request, with secrets redacted.
+	Endpoint string
+
+	// Table is the table the batch is written to.
+	Table string
+
+	// Record is the index of the record in the batch the error occurred for.
+	Record int
+
+	Err error
+}
+
+// Error will return the error message prefixed with the context of the error.
+func (perr *PipelineError) Error() string {
+	var parts []string
+
+	if perr.Stage != "" {
+		parts = append(parts, "stage: "+perr.Stage)
+	}
+
+	if perr.Batch > 0 {
+		parts = append(parts, fmt.Sprintf("batch: %d", perr.Batch))
+	}
+
+	if perr.Table != "" {
+		parts = append(parts, "table: "+perr.Table)
+	}
+
+	if perr.Endpoint != "" {
+		parts = append(parts, "endpoint: "+perr.Endpoint)
+	}
+
+	if perr.Record >= 0 {
+		parts = append(parts, fmt.Sprintf("record: %d", perr.Record))
+	}
+
+	if len(parts) == 0 {
+		return fmt.Sprintf("run %s: %v", perr.RunID, perr.Err)
+	}
+
+	return fmt.Sprintf("run %s (%s): %v", perr.RunID, strings.Join(parts, ", "), perr.Err)
+}
+
+// Unwrap will return the underlying error.
+func (perr *PipelineError) Unwrap() error {
+	return perr.Err
+}
+
+// recordError is an error for a single record in a batch.
+type recordError struct {
+	index int
+	err   error
+}
+
+func (rerr *recordError) Error() string {
+	return rerr.err.Error()
+}
+
+func (rerr *recordError) Unwrap() error {
+	return rerr.err
+}
+
+// jobContext identifies a web request in the run, and the batch it is written to storage as.
+type jobContext struct {
+	runID    string
+	batch    int
+	endpoint string
+	table    string
+
+	// request is the "requestID" of the request of the job, which is archived with its payload.
+	request string
+}
+
+// wrap will wrap the error with the context of the job. If the error is for a single record, the index of the record
+// is included.
+func (jc jobContext) wrap(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	perr := &PipelineError{
+		RunID:    jc.runID,
+		Stage:    stage,
+		Batch:    jc.batch,
+		Endpoint: jc.endpoint,
+		Table:    jc.table,
+		Record:   -1,
+		Err:      err,
+	}
+
+	var rerr *recordError
+	if errors.As(err, &rerr) {
+		perr.Record = rerr.index
+	}
+
+	return perr
+}
+
+// wrapRunError will wrap an error that is not specific to a job with the run ID. Errors that already have the context
+// of a job are returned as is.
+func wrapRunError(runID string, err error) error {
+	var perr *PipelineError
+	if err == nil || errors.As(err, &perr) {
+		return err
+	}
+
+	return &PipelineError{RunID: runID, Record: -1, Err: err}
+}
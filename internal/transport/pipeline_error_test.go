@@ -0,0 +1,72 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+func TestPipelineError(t *testing.T) {
+	t.Parallel()
+
+	jc := jobContext{
+		runID:    "run1",
+		batch:    3,
+		endpoint: "https://api.test.com/v1/candles?api_key=xxxxx",
+		table:    "candles",
+	}
+
+	t.Run("record index", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := decodeJSONRecords([]byte(`[{"id":1},{"id":2},3]`))
+
+		err = jc.wrap(stageRepository, err)
+		if !errors.Is(err, tools.ErrUnsupportedDataType) {
+			t.Fatalf("expected unsupported data type error, got %v", err)
+		}
+
+		var perr *PipelineError
+		if !errors.As(err, &perr) {
+			t.Fatalf("expected pipeline error, got %T", err)
+		}
+
+		if perr.Record != 2 || perr.Batch != 3 || perr.Table != "candles" {
+			t.Fatalf("unexpected error context: %+v", perr)
+		}
+
+		exp := "run run1 (stage: repository, batch: 3, table: candles, " +
+			"endpoint: https://api.test.com/v1/candles?api_key=xxxxx, record: 2): " + tools.ErrUnsupportedDataType.Error() +
+			": float64"
+		if err.Error() != exp {
+			t.Fatalf("expected %q, got %q", exp, err.Error())
+		}
+	})
+
+	t.Run("run errors", func(t *testing.T) {
+		t.Parallel()
+
+		err := wrapRunError("run1", ErrNoRequests)
+		if !errors.Is(err, ErrNoRequests) || err.Error() != "run run1: "+ErrNoRequests.Error() {
+			t.Fatalf("unexpected run error: %v", err)
+		}
+
+		// Errors with the context of a job are not wrapped again.
+		jobErr := jc.wrap(stageWeb, ErrNoRequests)
+		if wrapped := wrapRunError("run1", jobErr); wrapped != jobErr {
+			t.Fatalf("expected job error to be returned as is, got %v", wrapped)
+		}
+
+		if wrapRunError("run1", nil) != nil {
+			t.Fatal("expected nil error")
+		}
+	})
+}
@@ -0,0 +1,335 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// PresetGitHub syncs the issues, pull requests, and comments of GitHub repositories.
+	PresetGitHub = "github"
+
+	// PresetJira syncs the issues of Jira projects.
+	PresetJira = "jira"
+
+	// PresetStripe backfills Stripe objects from their list endpoints, and receives their webhook events.
+	PresetStripe = "stripe"
+
+	// githubURL is the URL of the GitHub REST API, used when the configuration has no URL.
+	githubURL = "https://api.github.com"
+
+	// githubTokenEnv is the environment variable of the GitHub token used when the configuration has no
+	// authentication.
+	githubTokenEnv = "GITHUB_TOKEN"
+
+	// jiraEmailEnv and jiraTokenEnv are the environment variables of the email and API token used when the
+	// configuration has no authentication.
+	jiraEmailEnv = "JIRA_EMAIL"
+	jiraTokenEnv = "JIRA_API_TOKEN"
+
+	// jiraSinceParam is the query parameter of the start of the range of the Jira requests. Jira ignores it, and
+	// the range is sent in the JQL of the request.
+	jiraSinceParam = "updatedSince"
+
+	// stripeURL is the URL of the Stripe API, used when the configuration has no URL.
+	stripeURL = "https://api.stripe.com"
+
+	// stripeKeyEnv and stripeWebhookSecretEnv are the environment variables of the secret API key used when the
+	// configuration has no authentication, and of the signing secret used when the webhook has no secret.
+	stripeKeyEnv           = "STRIPE_API_KEY"
+	stripeWebhookSecretEnv = "STRIPE_WEBHOOK_SECRET"
+
+	// presetDefaultSince is the start of the range of the first run, when "since" is not set.
+	presetDefaultSince = "2000-01-01T00:00:00Z"
+
+	// presetPageSize is the page size of the preset requests, the maximum of both web APIs.
+	presetPageSize = 100
+)
+
+var (
+	// githubDefaultLookback is the default lookback of the GitHub requests, in seconds.
+	githubDefaultLookback int32 = 300
+
+	// jiraDefaultLookback is the default lookback of the Jira requests, in seconds. JQL dates are in the time zone
+	// of the Jira user, so the lookback covers any offset from UTC.
+	jiraDefaultLookback int32 = 86400
+)
+
+var ErrInvalidPreset = fmt.Errorf("invalid preset")
+
+// InvalidPresetError is returned when the preset of the configuration is not valid.
+func InvalidPresetError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidPreset, reason)
+}
+
+// Preset is a ready-made configuration of the authentication, pagination, incremental sync, and tables for a
+// well-known web API. The requests of the preset are added to the requests of the configuration.
+type Preset struct {
+	// Name is the web API of the preset, "github", "jira", or "stripe".
+	Name string `yaml:"name"`
+
+	// Repositories are the GitHub repositories to sync, e.g. "alpine-hodler/gidari".
+	Repositories []string `yaml:"repositories"`
+
+	// Projects are the keys of the Jira projects to sync, e.g. "GID".
+	Projects []string `yaml:"projects"`
+
+	// Objects are the types of the Stripe objects to sync, e.g. "customer" or "checkout.session".
+	Objects []string `yaml:"objects"`
+
+	// Since is the RFC3339 time to sync updates from on the first run. Later runs sync the updates since the
+	// stored watermark, minus the lookback.
+	Since string `yaml:"since"`
+
+	// Lookback is the number of seconds before the stored watermark to sync again on each run.
+	Lookback *int32 `yaml:"lookback"`
+}
+
+// apply will set the defaults of the preset on the configuration, and add the requests of the preset.
+func (preset *Preset) apply(cfg *Config) error {
+	if preset.Since == "" {
+		preset.Since = presetDefaultSince
+	}
+
+	if _, err := time.Parse(time.RFC3339, preset.Since); err != nil {
+		return InvalidPresetError(fmt.Sprintf("since %q is not an RFC3339 time", preset.Since))
+	}
+
+	switch preset.Name {
+	case PresetGitHub:
+		return preset.applyGitHub(cfg)
+	case PresetJira:
+		return preset.applyJira(cfg)
+	case PresetStripe:
+		return preset.applyStripe(cfg)
+	default:
+		return InvalidPresetError(fmt.Sprintf("unknown preset %q, expected %q, %q, or %q", preset.Name, PresetGitHub,
+			PresetJira, PresetStripe))
+	}
+}
+
+// lookback will return the configured lookback, or the default lookback of the preset.
+func (preset *Preset) lookback(defaultLookback int32) *int32 {
+	if preset.Lookback != nil {
+		return preset.Lookback
+	}
+
+	lookback := defaultLookback
+
+	return &lookback
+}
+
+// setRateLimit will set the rate limit of the configuration, unless it is configured.
+func setRateLimit(cfg *Config, burst int, period time.Duration) {
+	if cfg.RateLimitConfig == nil {
+		cfg.RateLimitConfig = &RateLimitConfig{Burst: &burst, Period: &period}
+	}
+}
+
+// setHeader will set the header on every request, unless it is configured.
+func setHeader(cfg *Config, name, value string) {
+	if cfg.Headers == nil {
+		cfg.Headers = make(map[string]string)
+	}
+
+	for configured := range cfg.Headers {
+		if strings.EqualFold(configured, name) {
+			return
+		}
+	}
+
+	cfg.Headers[name] = value
+}
+
+// hasAuthentication will return true if the configuration has authentication.
+func hasAuthentication(cfg *Config) bool {
+	return cfg.Authentication.APIKey != nil || cfg.Authentication.Auth2 != nil || cfg.Authentication.Basic != nil
+}
+
+// applyGitHub will add the requests for the issues, pull requests, issue comments, and review comments of each
+// repository. Pull requests can not be filtered by update time on the GitHub API, so they are synced in full on
+// every run.
+func (preset *Preset) applyGitHub(cfg *Config) error {
+	if len(preset.Repositories) == 0 {
+		return MissingConfigFieldError("preset.repositories")
+	}
+
+	if cfg.RawURL == "" {
+		cfg.RawURL = githubURL
+	}
+
+	if token := os.Getenv(githubTokenEnv); token != "" && !hasAuthentication(cfg) {
+		cfg.Authentication.Auth2 = &Auth2{Bearer: token}
+	}
+
+	setHeader(cfg, "Accept", "application/vnd.github+json")
+	setRateLimit(cfg, 1, 750*time.Millisecond)
+
+	lookback := preset.lookback(githubDefaultLookback)
+
+	for _, repo := range preset.Repositories {
+		if strings.Count(repo, "/") != 1 || strings.HasPrefix(repo, "/") || strings.HasSuffix(repo, "/") {
+			return InvalidPresetError(fmt.Sprintf("repository %q is not <owner>/<repository>", repo))
+		}
+
+		incremental := func(endpoint, table string, query map[string]string) *Request {
+			query["since"] = preset.Since
+			query["sort"] = "updated"
+			query["direction"] = "asc"
+
+			return &Request{
+				Endpoint: endpoint,
+				Table:    table,
+				Query:    query,
+				Timeseries: &timeseries{
+					StartName: "since",
+					Lookback:  lookback,
+				},
+				Paginate: githubPaginate(),
+			}
+		}
+
+		cfg.Requests = append(cfg.Requests,
+			incremental("/repos/"+repo+"/issues", "issues", map[string]string{"state": "all"}),
+			&Request{
+				Endpoint: "/repos/" + repo + "/pulls",
+				Table:    "pull_requests",
+				Query:    map[string]string{"state": "all", "sort": "updated", "direction": "desc"},
+				Paginate: githubPaginate(),
+			},
+			incremental("/repos/"+repo+"/issues/comments", "issue_comments", map[string]string{}),
+			incremental("/repos/"+repo+"/pulls/comments", "review_comments", map[string]string{}))
+	}
+
+	return nil
+}
+
+// githubPaginate will return the pagination of the GitHub requests, which follows the "Link" header.
+func githubPaginate() *Paginate {
+	return &Paginate{Type: PaginateLink, SizeParam: "per_page", Size: presetPageSize}
+}
+
+// applyJira will add the request for the issues of each project, with every field of the issues. The comments of an
+// issue are in its "fields.comment" field.
+func (preset *Preset) applyJira(cfg *Config) error {
+	if len(preset.Projects) == 0 {
+		return MissingConfigFieldError("preset.projects")
+	}
+
+	if cfg.RawURL == "" {
+		return MissingConfigFieldError("url")
+	}
+
+	email, token := os.Getenv(jiraEmailEnv), os.Getenv(jiraTokenEnv)
+	if email != "" && token != "" && !hasAuthentication(cfg) {
+		cfg.Authentication.Basic = &Basic{Email: email, Password: token}
+	}
+
+	setRateLimit(cfg, 5, time.Second)
+
+	lookback := preset.lookback(jiraDefaultLookback)
+
+	for _, project := range preset.Projects {
+		if project == "" || strings.ContainsAny(project, `"\`) {
+			return InvalidPresetError(fmt.Sprintf("project key %q is not valid", project))
+		}
+
+		// Issues are ordered by creation, so that issues updated while the pages are fetched do not move between
+		// pages.
+		jql := fmt.Sprintf(`project = "%s" AND updated >= "{{ .Start.Format "2006/01/02 15:04" }}" `+
+			`ORDER BY created ASC`, project)
+
+		cfg.Requests = append(cfg.Requests, &Request{
+			Endpoint: "/rest/api/2/search",
+			Table:    "issues",
+			Query:    map[string]string{"jql": jql, "fields": "*all", jiraSinceParam: preset.Since},
+			Timeseries: &timeseries{
+				StartName: jiraSinceParam,
+				Lookback:  lookback,
+			},
+			Paginate: &Paginate{
+				Type:      PaginateOffset,
+				Records:   "issues",
+				Param:     "startAt",
+				SizeParam: "maxResults",
+				Size:      presetPageSize,
+			},
+		})
+	}
+
+	return nil
+}
+
+// applyStripe will add the request that backfills each object from its list endpoint, e.g. "/v1/customers" for the
+// "customer" object, and the table of the object to the webhook. The list endpoints can not be filtered by update
+// time, so the objects are backfilled in full on every run, and reconciled with the objects of the webhook events.
+// The webhook is added if it is configured, or if the signing secret is in the environment.
+func (preset *Preset) applyStripe(cfg *Config) error {
+	if len(preset.Objects) == 0 {
+		return MissingConfigFieldError("preset.objects")
+	}
+
+	if cfg.RawURL == "" {
+		cfg.RawURL = stripeURL
+	}
+
+	if key := os.Getenv(stripeKeyEnv); key != "" && !hasAuthentication(cfg) {
+		cfg.Authentication.Auth2 = &Auth2{Bearer: key}
+	}
+
+	setRateLimit(cfg, 25, time.Second)
+
+	secret := os.Getenv(stripeWebhookSecretEnv)
+	if cfg.Webhook == nil && secret != "" {
+		cfg.Webhook = new(Webhook)
+	}
+
+	if cfg.Webhook != nil {
+		if cfg.Webhook.Secret == "" {
+			cfg.Webhook.Secret = secret
+		}
+
+		if cfg.Webhook.Tables == nil {
+			cfg.Webhook.Tables = make(map[string]string)
+		}
+	}
+
+	for _, object := range preset.Objects {
+		if object == "" || strings.Trim(object, "abcdefghijklmnopqrstuvwxyz_.") != "" {
+			return InvalidPresetError(fmt.Sprintf("object %q is not a Stripe object type", object))
+		}
+
+		table := strings.ReplaceAll(object, ".", "_") + "s"
+
+		cfg.Requests = append(cfg.Requests, &Request{
+			Endpoint: "/v1/" + strings.ReplaceAll(object, ".", "/") + "s",
+			Table:    table,
+			Paginate: &Paginate{
+				Type:      PaginateCursor,
+				Records:   "data",
+				Param:     "starting_after",
+				HasMore:   "has_more",
+				SizeParam: "limit",
+				Size:      presetPageSize,
+			},
+			Reconcile: new(Reconcile),
+		})
+
+		if cfg.Webhook != nil {
+			if _, ok := cfg.Webhook.Tables[object]; !ok {
+				cfg.Webhook.Tables[object] = table
+			}
+		}
+	}
+
+	return nil
+}
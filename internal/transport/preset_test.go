@@ -0,0 +1,160 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPreset(t *testing.T) {
+	t.Parallel()
+
+	t.Run("github", func(t *testing.T) {
+		t.Parallel()
+
+		cfg, err := NewConfig([]byte(`
+connectionStrings: ["mongodb://localhost:27017/github"]
+authentication:
+  auth2:
+    bearer: token
+preset:
+  name: github
+  repositories: [alpine-hodler/gidari]
+  since: 2022-05-01T00:00:00Z
+`))
+		if err != nil {
+			t.Fatalf("failed to create config: %v", err)
+		}
+
+		if cfg.RawURL != githubURL || cfg.Authentication.Auth2.Bearer != "token" || cfg.RateLimitConfig == nil ||
+			cfg.Headers["Accept"] != "application/vnd.github+json" {
+			t.Fatalf("unexpected preset config %+v", cfg)
+		}
+
+		tables := []string{"issues", "pull_requests", "issue_comments", "review_comments"}
+		if len(cfg.Requests) != len(tables) {
+			t.Fatalf("expected %d requests, got %d", len(tables), len(cfg.Requests))
+		}
+
+		for idx, req := range cfg.Requests {
+			if req.Table != tables[idx] || req.Paginate == nil || req.Paginate.Type != PaginateLink ||
+				req.Method != "GET" {
+				t.Fatalf("unexpected request for %s: %+v", tables[idx], req)
+			}
+
+			if req.Table != "pull_requests" && (!req.incremental() || req.Query["since"] != "2022-05-01T00:00:00Z") {
+				t.Fatalf("expected %s to be synced since the watermark, got %+v", req.Table, req)
+			}
+		}
+
+		if cfg.Requests[0].Endpoint != "/repos/alpine-hodler/gidari/issues" {
+			t.Fatalf("unexpected endpoint %q", cfg.Requests[0].Endpoint)
+		}
+	})
+
+	t.Run("jira", func(t *testing.T) {
+		t.Parallel()
+
+		cfg, err := NewConfig([]byte(`
+url: https://acme.atlassian.net
+connectionStrings: ["mongodb://localhost:27017/jira"]
+preset:
+  name: jira
+  projects: [GID]
+  since: 2022-05-01T00:00:00Z
+`))
+		if err != nil {
+			t.Fatalf("failed to create config: %v", err)
+		}
+
+		asOf := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+
+		req, err := cfg.Requests[0].applyRunTime(&Config{AsOf: &asOf})
+		if err != nil {
+			t.Fatalf("failed to apply run time: %v", err)
+		}
+
+		rurl, _ := url.Parse(cfg.RawURL)
+
+		flatReqs, err := req.flattenTimeseries(*rurl, nil)
+		if err != nil {
+			t.Fatalf("failed to flatten request: %v", err)
+		}
+
+		if len(flatReqs) != 1 || flatReqs[0].paginate.Records != "issues" {
+			t.Fatalf("expected a single paginated request, got %+v", flatReqs)
+		}
+
+		query := flatReqs[0].fetchConfig.URL.Query()
+		if exp := `project = "GID" AND updated >= "2022/05/01 00:00" ORDER BY created ASC`; query.Get("jql") != exp {
+			t.Fatalf("expected jql %q, got %q", exp, query.Get("jql"))
+		}
+
+		if req.Timeseries.end != asOf {
+			t.Fatalf("expected the range to end at the as-of time, got %v", req.Timeseries.end)
+		}
+	})
+
+	t.Run("stripe", func(t *testing.T) {
+		t.Parallel()
+
+		cfg, err := NewConfig([]byte(`
+connectionStrings: ["mongodb://localhost:27017/stripe"]
+webhook:
+  secret: whsec_test
+  tables:
+    customer: stripe_customers
+preset:
+  name: stripe
+  objects: [customer, checkout.session]
+`))
+		if err != nil {
+			t.Fatalf("failed to create config: %v", err)
+		}
+
+		if cfg.RawURL != stripeURL || len(cfg.Requests) != 2 {
+			t.Fatalf("unexpected preset config %+v", cfg)
+		}
+
+		sessions := cfg.Requests[1]
+		if sessions.Endpoint != "/v1/checkout/sessions" || sessions.Table != "checkout_sessions" ||
+			sessions.Paginate.Type != PaginateCursor || sessions.Paginate.Cursor != "id" ||
+			sessions.Reconcile.Key != "id" {
+			t.Fatalf("unexpected request %+v", sessions)
+		}
+
+		if cfg.Webhook.Tables["customer"] != "stripe_customers" ||
+			cfg.Webhook.Tables["checkout.session"] != "checkout_sessions" || cfg.Webhook.Tolerance != 300 {
+			t.Fatalf("unexpected webhook %+v", cfg.Webhook)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		for _, preset := range []string{
+			"{name: stripe, objects: [Customers]}",
+			"{name: gitlab}",
+			"{name: github, repositories: [gidari]}",
+			"{name: github, repositories: [a/b], since: yesterday}",
+			`{name: jira, projects: ['G"ID']}`,
+		} {
+			_, err := NewConfig([]byte("url: https://acme.atlassian.net\npreset: " + preset))
+			if !errors.Is(err, ErrInvalidPreset) {
+				t.Fatalf("expected error %v for %s, got %v", ErrInvalidPreset, preset, err)
+			}
+		}
+
+		if _, err := NewConfig([]byte("preset: {name: jira, projects: [GID]}")); !errors.Is(err, ErrMissingConfigField) {
+			t.Fatalf("expected error %v, got %v", ErrMissingConfigField, err)
+		}
+	})
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+const (
+	// prometheusIDField, prometheusMetricField, prometheusTimeField, and prometheusValueField are the fields of the
+	// records of samples: a hash of the series and timestamp of the sample, the metric name, the RFC 3339 timestamp,
+	// and the value.
+	prometheusIDField     = "id"
+	prometheusMetricField = "metric"
+	prometheusTimeField   = "timestamp"
+	prometheusValueField  = "value"
+
+	// prometheusNameLabel is the label of the metric name of a series.
+	prometheusNameLabel = "__name__"
+)
+
+var ErrPrometheusResponse = fmt.Errorf("invalid prometheus response")
+
+// PrometheusResponseError is returned when the response of a request with "prometheus" is not the successful response
+// of a Prometheus query.
+func PrometheusResponseError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrPrometheusResponse, reason)
+}
+
+// Prometheus is the configuration for decoding the responses of the Prometheus HTTP API, i.e. instant queries
+// ("/api/v1/query") and range queries ("/api/v1/query_range"), into a record per sample. The labels of the series of
+// a sample are flattened into the fields of its record.
+type Prometheus struct {
+	// LabelPrefix is prepended to the labels of the series when they are flattened into fields, e.g. "label_", so
+	// that labels do not collide with the fields of the sample.
+	LabelPrefix string `yaml:"labelPrefix"`
+}
+
+// prometheusResponse is the envelope of the responses of the Prometheus HTTP API.
+type prometheusResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// prometheusSeries is a series of a vector or matrix result, with the sample of a vector or the samples of a matrix.
+// Samples are a unix timestamp in seconds and the value as a string.
+type prometheusSeries struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value"`
+	Values [][]interface{}   `json:"values"`
+}
+
+// decode will return a record for each sample of the Prometheus response. Scalar and string results are a single
+// record without a metric. Samples of native histograms are not decoded.
+func (pm *Prometheus) decode(data []byte) ([]map[string]interface{}, error) {
+	var rsp prometheusResponse
+	if err := json.Unmarshal(data, &rsp); err != nil {
+		return nil, fmt.Errorf("%w: %v", tools.ErrFailedToUnmarshalJSON, err)
+	}
+
+	if rsp.Status != "success" {
+		return nil, PrometheusResponseError(fmt.Sprintf("status %q: %s: %s", rsp.Status, rsp.ErrorType, rsp.Error))
+	}
+
+	var series []prometheusSeries
+
+	switch rsp.Data.ResultType {
+	case "vector", "matrix":
+		if err := json.Unmarshal(rsp.Data.Result, &series); err != nil {
+			return nil, PrometheusResponseError(fmt.Sprintf("%s result: %v", rsp.Data.ResultType, err))
+		}
+	case "scalar", "string":
+		var sample []interface{}
+		if err := json.Unmarshal(rsp.Data.Result, &sample); err != nil {
+			return nil, PrometheusResponseError(fmt.Sprintf("%s result: %v", rsp.Data.ResultType, err))
+		}
+
+		series = []prometheusSeries{{Value: sample}}
+	default:
+		return nil, PrometheusResponseError(fmt.Sprintf("unknown result type %q", rsp.Data.ResultType))
+	}
+
+	var records []map[string]interface{}
+
+	for _, srs := range series {
+		samples := srs.Values
+		if srs.Value != nil {
+			samples = append(samples, srs.Value)
+		}
+
+		for _, sample := range samples {
+			record, err := pm.record(srs.Metric, sample, rsp.Data.ResultType == "string")
+			if err != nil {
+				return nil, &recordError{index: len(records), err: err}
+			}
+
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+// record will return the record of a sample of the series with the labels. The value of a sample is a number, or
+// null if it is not finite, unless the sample is of a string result.
+func (pm *Prometheus) record(labels map[string]string, sample []interface{}, isString bool) (map[string]interface{},
+	error,
+) {
+	if len(sample) != 2 {
+		return nil, PrometheusResponseError(fmt.Sprintf("sample %v is not a timestamp and a value", sample))
+	}
+
+	seconds, ok := sample[0].(float64)
+	if !ok {
+		return nil, PrometheusResponseError(fmt.Sprintf("sample timestamp %v is not a number", sample[0]))
+	}
+
+	raw, ok := sample[1].(string)
+	if !ok {
+		return nil, PrometheusResponseError(fmt.Sprintf("sample value %v is not a string", sample[1]))
+	}
+
+	timestamp := time.UnixMilli(int64(math.Round(seconds * 1e3))).UTC().Format(time.RFC3339Nano)
+
+	record := map[string]interface{}{
+		prometheusIDField:     prometheusSampleID(labels, timestamp),
+		prometheusMetricField: nil,
+		prometheusTimeField:   timestamp,
+		prometheusValueField:  raw,
+	}
+
+	if !isString {
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, PrometheusResponseError(fmt.Sprintf("sample value %q is not a number", raw))
+		}
+
+		record[prometheusValueField] = value
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			record[prometheusValueField] = nil
+		}
+	}
+
+	for label, value := range labels {
+		if label == prometheusNameLabel {
+			record[prometheusMetricField] = value
+
+			continue
+		}
+
+		record[pm.LabelPrefix+label] = value
+	}
+
+	return record, nil
+}
+
+// prometheusSampleID will return the ID of the sample of the series with the labels at the timestamp, so that
+// writing a sample again updates its record.
+func prometheusSampleID(labels map[string]string, timestamp string) string {
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+
+	sort.Strings(names)
+
+	var series strings.Builder
+
+	for _, label := range names {
+		series.WriteString(strconv.Quote(label) + "=" + strconv.Quote(labels[label]) + ",")
+	}
+
+	digest := sha256.Sum256([]byte(series.String() + "@" + timestamp))
+
+	return hex.EncodeToString(digest[:16])
+}
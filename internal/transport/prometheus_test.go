@@ -0,0 +1,113 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestPrometheus(t *testing.T) {
+	t.Parallel()
+
+	t.Run("vector", func(t *testing.T) {
+		t.Parallel()
+
+		pm := &Prometheus{LabelPrefix: "label_"}
+
+		records, err := pm.decode([]byte(`{"status":"success","data":{"resultType":"vector","result":[
+			{"metric":{"__name__":"up","job":"api","instance":"a:9090"},"value":[1652140800.5,"1"]},
+			{"metric":{"__name__":"up","job":"api","instance":"b:9090"},"value":[1652140800.5,"NaN"]}
+		]}}`))
+		if err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		if len(records) != 2 {
+			t.Fatalf("expected a record per sample, got %v", records)
+		}
+
+		record := records[0]
+		if record["metric"] != "up" || record["label_job"] != "api" || record["label_instance"] != "a:9090" ||
+			record["timestamp"] != "2022-05-10T00:00:00.5Z" || record["value"] != 1.0 {
+			t.Fatalf("unexpected sample record: %v", record)
+		}
+
+		if _, ok := record["__name__"]; ok {
+			t.Fatalf("expected the metric name not to be flattened as a label, got %v", record)
+		}
+
+		if records[1]["value"] != nil {
+			t.Fatalf("expected a NaN sample to have a null value, got %v", records[1])
+		}
+
+		if records[0]["id"] == records[1]["id"] {
+			t.Fatalf("expected samples of different series to have different ids, got %v", records)
+		}
+	})
+
+	t.Run("matrix", func(t *testing.T) {
+		t.Parallel()
+
+		tfs := &transforms{prometheus: new(Prometheus)}
+
+		records, err := tfs.decode([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"__name__":"rate","job":"api"},"values":[[1652140800,"0.5"],[1652140860,"0.25"]]}
+		]}}`))
+		if err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		if len(records) != 2 || records[0]["job"] != "api" || records[1]["timestamp"] != "2022-05-10T00:01:00Z" ||
+			records[1]["value"] != 0.25 {
+			t.Fatalf("unexpected sample records: %v", records)
+		}
+
+		again, err := tfs.decode([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"job":"api","__name__":"rate"},"values":[[1652140860,"0.3"]]}
+		]}}`))
+		if err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		if again[0]["id"] != records[1]["id"] {
+			t.Fatalf("expected the sample of a series at a timestamp to keep its id, got %v and %v", again, records)
+		}
+	})
+
+	t.Run("scalar", func(t *testing.T) {
+		t.Parallel()
+
+		records, err := new(Prometheus).decode([]byte(`{"status":"success","data":{"resultType":"scalar",` +
+			`"result":[1652140800,"42"]}}`))
+		if err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		data, _ := json.Marshal(records)
+		if len(records) != 1 || records[0]["metric"] != nil || records[0]["value"] != 42.0 {
+			t.Fatalf("unexpected scalar record: %s", data)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		for _, body := range []string{
+			`{"status":"error","errorType":"bad_data","error":"parse error"}`,
+			`{"status":"success","data":{"resultType":"histogram","result":[]}}`,
+			`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"x"]}]}}`,
+			`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1]}]}}`,
+		} {
+			if _, err := new(Prometheus).decode([]byte(body)); !errors.Is(err, ErrPrometheusResponse) {
+				t.Fatalf("expected error %v for %s, got %v", ErrPrometheusResponse, body, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,144 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+const (
+	// defaultReconcileKey is the default field that identifies the objects of reconciled records.
+	defaultReconcileKey = "id"
+
+	// defaultReconcileVersion is the default column of the version of reconciled records.
+	defaultReconcileVersion = "gidari_version"
+)
+
+// Reconcile is the configuration for reconciling the records of a table that is written by more than one stream, e.g.
+// by the webhook events of its objects and by the backfills of a list endpoint. Each record is stamped with the time
+// its object was observed, as its version: the time the response was fetched for a request, or the time the event was
+// created for a webhook. A record is not written if the stored record of the same object has a later version, so a
+// backfill that fetched an object before an event changed it does not overwrite the change, and neither does an event
+// that is delivered late.
+//
+// The versions are read from the lookup storage, i.e. the read replica if one is configured and the first connection
+// string otherwise. SQL tables need a column for the version.
+type Reconcile struct {
+	// Key is the field that identifies the objects of the records. The default is "id".
+	Key string `yaml:"key"`
+
+	// Version is the column that the version of each record is written to, in Unix milliseconds. The default is
+	// "gidari_version".
+	Version string `yaml:"version"`
+}
+
+func (rec *Reconcile) setDefaults() {
+	if rec.Key == "" {
+		rec.Key = defaultReconcileKey
+	}
+
+	if rec.Version == "" {
+		rec.Version = defaultReconcileVersion
+	}
+}
+
+// reconcile will stamp the records with the version, and return the records whose object does not have a later
+// version stored in the table. Records without a key are always written.
+func (rec *Reconcile) reconcile(ctx context.Context, stg storage.Storage, table string, version int64,
+	records []map[string]interface{},
+) ([]map[string]interface{}, error) {
+	var keys []interface{}
+
+	seen := make(map[string]bool)
+
+	for _, record := range records {
+		record[rec.Version] = version
+
+		key, ok := record[rec.Key]
+		if !ok || key == nil || seen[fmt.Sprint(key)] {
+			continue
+		}
+
+		seen[fmt.Sprint(key)] = true
+
+		keys = append(keys, key)
+	}
+
+	if stg == nil || len(keys) == 0 {
+		return records, nil
+	}
+
+	// The latest version of each object, since append-only storage keeps every version of an object.
+	stored := make(map[string]int64)
+
+	for start := 0; start < len(keys); start += enrichLookupKeys {
+		end := start + enrichLookupKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		req := &proto.ReadRequest{Table: table}
+		if err := tools.AssignReadRequired(req, rec.Key, keys[start:end]); err != nil {
+			return nil, fmt.Errorf("unable to build reconcile request: %w", err)
+		}
+
+		rsp, err := stg.Read(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read versions of table %q: %w", table, err)
+		}
+
+		for _, found := range rsp.GetRecords() {
+			fields := found.AsMap()
+
+			stamped, ok := reconcileVersion(fields[rec.Version])
+			if !ok {
+				continue
+			}
+
+			key := fmt.Sprint(fields[rec.Key])
+			if stamped > stored[key] {
+				stored[key] = stamped
+			}
+		}
+	}
+
+	reconciled := records[:0]
+
+	for _, record := range records {
+		key, ok := record[rec.Key]
+		if ok && key != nil && stored[fmt.Sprint(key)] > version {
+			continue
+		}
+
+		reconciled = append(reconciled, record)
+	}
+
+	return reconciled, nil
+}
+
+// reconcileVersion will return the version of a stored record, which storage can return as a number or as text.
+func reconcileVersion(val interface{}) (int64, bool) {
+	switch val := val.(type) {
+	case float64:
+		return int64(val), true
+	case int64:
+		return val, true
+	case string:
+		version, err := strconv.ParseInt(val, 10, 64)
+
+		return version, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/repository"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+const (
+	// SchemaRegistryTable is the name of the table/collection that the registered schema of each table is versioned
+	// in.
+	SchemaRegistryTable = "gidari_schemas"
+
+	registryIDField           = "id"
+	registryTableField        = "table_name"
+	registryVersionField      = "version"
+	registryColumnsField      = "columns"
+	registryRegisteredAtField = "registered_at"
+)
+
+// String will return the dialect independent name of the column type, as it is registered in the schema registry.
+func (typ columnType) String() string {
+	switch typ {
+	case columnBool:
+		return "bool"
+	case columnInt:
+		return "int"
+	case columnFloat:
+		return "float"
+	case columnTimestamp:
+		return "timestamp"
+	case columnText:
+		return "text"
+	case columnJSON:
+		return "json"
+	default:
+		return "unknown"
+	}
+}
+
+// contract will return the column types of the table, keyed by column name.
+func (ts *tableSchema) contract() map[string]string {
+	columns := make(map[string]string, len(ts.columns))
+	for _, col := range ts.columns {
+		columns[col.name] = col.typ.String()
+	}
+
+	return columns
+}
+
+// registeredSchema is a version of the schema of a table in the schema registry.
+type registeredSchema struct {
+	table   string
+	version int
+	columns map[string]string
+}
+
+// SchemaDiff is the difference between the shape of the latest web API responses for a table and the latest schema
+// registered for the table.
+type SchemaDiff struct {
+	// Table is the name of the table.
+	Table string
+
+	// Version is the latest registered version of the schema, or zero if the table has no registered schema.
+	Version int
+
+	// Added and Removed are the columns that are in the responses and not in the registered schema, and the other
+	// way around.
+	Added, Removed []string
+
+	// Changed are the columns whose type changed, e.g. "price: int -> float".
+	Changed []string
+
+	columns map[string]string
+}
+
+// Drifted will return true if the responses do not match the registered schema, including when the table has no
+// registered schema.
+func (diff *SchemaDiff) Drifted() bool {
+	return diff.Version == 0 || len(diff.Added) > 0 || len(diff.Removed) > 0 || len(diff.Changed) > 0
+}
+
+// String will return the diff in a format similar to a unified diff, e.g. "+ size int".
+func (diff *SchemaDiff) String() string {
+	var out strings.Builder
+
+	if diff.Version == 0 {
+		fmt.Fprintf(&out, "%s: not registered\n", diff.Table)
+	} else {
+		fmt.Fprintf(&out, "%s: version %d\n", diff.Table, diff.Version)
+	}
+
+	for _, col := range diff.Added {
+		fmt.Fprintf(&out, "+ %s %s\n", col, diff.columns[col])
+	}
+
+	for _, col := range diff.Removed {
+		fmt.Fprintf(&out, "- %s\n", col)
+	}
+
+	for _, col := range diff.Changed {
+		fmt.Fprintf(&out, "~ %s\n", col)
+	}
+
+	return out.String()
+}
+
+// diffSchema will compare the column types of the table with the registered schema, which is nil if the table has no
+// registered schema.
+func diffSchema(table string, columns map[string]string, registered *registeredSchema) *SchemaDiff {
+	diff := &SchemaDiff{Table: table, columns: columns}
+
+	registeredColumns := map[string]string{}
+	if registered != nil {
+		diff.Version = registered.version
+		registeredColumns = registered.columns
+	}
+
+	for col, typ := range columns {
+		regTyp, ok := registeredColumns[col]
+
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, col)
+		case regTyp != typ:
+			diff.Changed = append(diff.Changed, fmt.Sprintf("%s: %s -> %s", col, regTyp, typ))
+		}
+	}
+
+	for col := range registeredColumns {
+		if _, ok := columns[col]; !ok {
+			diff.Removed = append(diff.Removed, col)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+
+	return diff
+}
+
+// readRegisteredSchemas will read the latest registered schema of every table from the repository.
+func readRegisteredSchemas(
+	ctx context.Context, cfg *Config, repo storage.Storage,
+) (map[string]*registeredSchema, error) {
+	rsp, err := cfg.Timeouts.wrap(repo).Read(ctx, &proto.ReadRequest{Table: SchemaRegistryTable})
+	if err != nil {
+		return nil, WrapRepositoryError(fmt.Errorf("unable to read schema registry: %w", err))
+	}
+
+	latest := make(map[string]*registeredSchema)
+
+	for _, record := range rsp.GetRecords() {
+		fields := record.AsMap()
+
+		table, _ := fields[registryTableField].(string)
+
+		version, err := strconv.Atoi(fmt.Sprint(fields[registryVersionField]))
+		if err != nil {
+			return nil, UnableToParseError("schema registry version")
+		}
+
+		if prev, ok := latest[table]; ok && prev.version >= version {
+			continue
+		}
+
+		var columns map[string]string
+
+		encoded, _ := fields[registryColumnsField].(string)
+		if err := json.Unmarshal([]byte(encoded), &columns); err != nil {
+			return nil, fmt.Errorf("%w: %v", tools.ErrFailedToUnmarshalJSON, err)
+		}
+
+		latest[table] = &registeredSchema{table: table, version: version, columns: columns}
+	}
+
+	return latest, nil
+}
+
+// DiffSchemas will compare the shape of the first response for each request, see "ExportSchema", with the latest
+// schema registered for each table in the schema registry of the "readReplica", or the first connection string.
+func DiffSchemas(ctx context.Context, cfg *Config) ([]*SchemaDiff, error) {
+	if cfg.readDNS() == "" {
+		return nil, MissingConfigFieldError("connectionStrings")
+	}
+
+	schemas, err := cfg.schemas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := repository.New(ctx, cfg.readDNS())
+	if err != nil {
+		return nil, WrapRepositoryError(repository.FailedToCreateRepositoryError(err))
+	}
+
+	defer repo.Close()
+
+	registered, err := readRegisteredSchemas(ctx, cfg, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := make([]*SchemaDiff, 0, len(schemas))
+	for _, ts := range schemas {
+		diffs = append(diffs, diffSchema(ts.name, ts.contract(), registered[ts.name]))
+	}
+
+	return diffs, nil
+}
+
+// AcceptSchemas will register the drifted schemas of the diffs as the next version of the schema of each table, on
+// every connection string.
+func AcceptSchemas(ctx context.Context, cfg *Config, diffs []*SchemaDiff) error {
+	release, err := cfg.applyCompliance()
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	var records []map[string]interface{}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	for _, diff := range diffs {
+		if !diff.Drifted() {
+			continue
+		}
+
+		columns, err := json.Marshal(diff.columns)
+		if err != nil {
+			return fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+		}
+
+		version := diff.Version + 1
+
+		records = append(records, map[string]interface{}{
+			registryIDField:           fmt.Sprintf("%s/%d", diff.Table, version),
+			registryTableField:        diff.Table,
+			registryVersionField:      version,
+			registryColumnsField:      string(columns),
+			registryRegisteredAtField: now,
+		})
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	upsertReq, err := newJSONUpsertRequest(SchemaRegistryTable, records)
+	if err != nil {
+		return err
+	}
+
+	for _, dns := range cfg.ConnectionStrings {
+		repo, err := repository.New(ctx, dns)
+		if err != nil {
+			return WrapRepositoryError(repository.FailedToCreateRepositoryError(err))
+		}
+
+		_, err = cfg.Timeouts.wrap(repo).Upsert(ctx, upsertReq)
+		repo.Close()
+
+		if err != nil {
+			return WrapRepositoryError(fmt.Errorf("unable to register schemas: %w", err))
+		}
+	}
+
+	return nil
+}
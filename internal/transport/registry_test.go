@@ -0,0 +1,73 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSchemaRegistry(t *testing.T) {
+	t.Parallel()
+
+	t.Run("latest registered versions are diffed", func(t *testing.T) {
+		t.Parallel()
+
+		stg := &lookupStorage{records: []map[string]interface{}{
+			{"table_name": "trades", "version": 1.0, "columns": `{"id": "int", "price": "int"}`},
+			{"table_name": "trades", "version": 2.0, "columns": `{"id": "int", "price": "int", "side": "text"}`},
+		}}
+
+		registered, err := readRegisteredSchemas(context.Background(), &Config{}, stg)
+		if err != nil {
+			t.Fatalf("failed to read registered schemas: %v", err)
+		}
+
+		ts := newTableSchema("trades")
+		ts.observe(map[string]interface{}{"id": 1.0, "price": 1.5, "size": 2.0})
+		ts.finalize()
+
+		diff := diffSchema("trades", ts.contract(), registered["trades"])
+
+		want := &SchemaDiff{
+			Table:   "trades",
+			Version: 2,
+			Added:   []string{"size"},
+			Removed: []string{"side"},
+			Changed: []string{"price: int -> float"},
+			columns: ts.contract(),
+		}
+
+		if !reflect.DeepEqual(diff, want) {
+			t.Fatalf("expected diff %+v, got %+v", want, diff)
+		}
+
+		if exp := "trades: version 2\n+ size int\n- side\n~ price: int -> float\n"; diff.String() != exp {
+			t.Fatalf("expected diff output %q, got %q", exp, diff.String())
+		}
+	})
+
+	t.Run("unregistered tables have drifted", func(t *testing.T) {
+		t.Parallel()
+
+		diff := diffSchema("trades", map[string]string{"id": "int"}, nil)
+		if !diff.Drifted() || diff.Version != 0 || !reflect.DeepEqual(diff.Added, []string{"id"}) {
+			t.Fatalf("expected an unregistered diff, got %+v", diff)
+		}
+	})
+
+	t.Run("matching schemas have not drifted", func(t *testing.T) {
+		t.Parallel()
+
+		registered := &registeredSchema{table: "trades", version: 1, columns: map[string]string{"id": "int"}}
+		if diff := diffSchema("trades", map[string]string{"id": "int"}, registered); diff.Drifted() {
+			t.Fatalf("expected no drift, got %+v", diff)
+		}
+	})
+}
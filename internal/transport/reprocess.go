@@ -0,0 +1,395 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+var (
+	ErrNoArchivedPayloads    = fmt.Errorf("no archived payloads found")
+	ErrUnknownArchiveTable   = fmt.Errorf("archived table is not configured")
+	ErrAmbiguousArchiveTable = fmt.Errorf("archived table is configured for more than one request")
+	ErrArchiveChecksum       = fmt.Errorf("archived payload does not match its manifest")
+	ErrMultipleArchiveRuns   = fmt.Errorf("archive location has the payloads of more than one run")
+)
+
+// AmbiguousArchiveTableError is returned when an archived payload does not identify its request, e.g. a payload
+// archived by an older version, and more than one request is configured for its table.
+func AmbiguousArchiveTableError(key, table string) error {
+	return fmt.Errorf("%w: %s is for table %q", ErrAmbiguousArchiveTable, key, table)
+}
+
+// MultipleArchiveRunsError is returned when the location of a reprocess has the payloads of more than one run, which
+// can not be replayed in the order they were fetched.
+func MultipleArchiveRunsError(runs ...string) error {
+	return fmt.Errorf("%w: %s, expected the location of a single run", ErrMultipleArchiveRuns,
+		strings.Join(runs, ", "))
+}
+
+// ArchiveChecksumError is returned when an archived payload does not match the checksum in the manifest of its run.
+func ArchiveChecksumError(key string) error {
+	return fmt.Errorf("%w: %s", ErrArchiveChecksum, key)
+}
+
+// UnknownArchiveTableError is returned when an archived payload is for a table that no request is configured for.
+func UnknownArchiveTableError(key, table string) error {
+	return fmt.Errorf("%w: %s is for table %q", ErrUnknownArchiveTable, key, table)
+}
+
+// decodeArchivedPayloads will decode the gzip compressed JSON of the archived payloads in the object. An object is
+// a single payload as archived by a run, or the payloads of many objects concatenated by a compaction.
+func decodeArchivedPayloads(data []byte) ([]*archivedPayload, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress payload: %w", err)
+	}
+
+	var payloads []*archivedPayload
+
+	decoder := json.NewDecoder(zr)
+
+	for {
+		payload := new(archivedPayload)
+
+		err := decoder.Decode(payload)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode payload: %w", err)
+		}
+
+		payloads = append(payloads, payload)
+	}
+
+	return payloads, nil
+}
+
+// archiveChecksums are the SHA-256 checksums of the archived payloads listed in manifests, by the base name and then
+// the key of the payload relative to the archive location.
+type archiveChecksums map[string]map[string]string
+
+// lookup will return the checksum of the payload at the key in the store. The store may be a subdirectory of the
+// archive location, e.g. the directory of a run, so the key matches the manifest key that it is a suffix of.
+func (checksums archiveChecksums) lookup(key string) (string, bool) {
+	for manifestKey, checksum := range checksums[path.Base(key)] {
+		if manifestKey == key || strings.HasSuffix(manifestKey, "/"+key) {
+			return checksum, true
+		}
+	}
+
+	return "", false
+}
+
+// verify will return an error if the object at the key does not match the checksum in the manifest of its run.
+// Objects that are not listed in a manifest, e.g. the objects written by a compaction, are not verified.
+func (checksums archiveChecksums) verify(key string, data []byte) error {
+	checksum, ok := checksums.lookup(key)
+	if !ok {
+		return nil
+	}
+
+	if digest := sha256.Sum256(data); hex.EncodeToString(digest[:]) != checksum {
+		return ArchiveChecksumError(key)
+	}
+
+	return nil
+}
+
+// archivedChecksums will return the checksums of the archived payloads listed in the manifests in the store, and the
+// IDs of the runs of the manifests.
+func archivedChecksums(ctx context.Context, store storage.ObjectStore, keys []string) (archiveChecksums, []string,
+	error,
+) {
+	checksums := make(archiveChecksums)
+
+	var runs []string
+
+	for _, key := range keys {
+		if path.Base(key) != archiveManifestName {
+			continue
+		}
+
+		data, err := store.Get(ctx, key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read archive manifest: %w", err)
+		}
+
+		var manifest archiveManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, nil, fmt.Errorf("unable to decode archive manifest %s: %w", key, err)
+		}
+
+		runs = append(runs, manifest.RunID)
+
+		for _, file := range manifest.Files {
+			name := path.Base(file.Key)
+			if checksums[name] == nil {
+				checksums[name] = make(map[string]string)
+			}
+
+			checksums[name][file.Key] = file.SHA256
+		}
+	}
+
+	return checksums, runs, nil
+}
+
+// archivedKeys will return the keys of the archived payloads in the store, in the order they were fetched within each
+// run and partition, the checksums of the payloads of runs with a manifest, and the IDs of those runs.
+func archivedKeys(ctx context.Context, store storage.ObjectStore) ([]string, archiveChecksums, []string, error) {
+	keys, err := store.List(ctx)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to list archived payloads: %w", err)
+	}
+
+	checksums, runs, err := archivedChecksums(ctx, store, keys)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	payloadKeys := keys[:0]
+
+	for _, key := range keys {
+		if strings.HasSuffix(key, archiveExt) {
+			payloadKeys = append(payloadKeys, key)
+		}
+	}
+
+	if len(payloadKeys) == 0 {
+		return nil, nil, nil, ErrNoArchivedPayloads
+	}
+
+	return payloadKeys, checksums, runs, nil
+}
+
+// archivedRequests are the requests of the configuration keyed by "requestID", and by table for the payloads that do
+// not identify their request.
+type archivedRequests struct {
+	byID    map[string]*Request
+	byTable map[string][]*Request
+}
+
+func newArchivedRequests(reqs []*Request) *archivedRequests {
+	requests := &archivedRequests{byID: make(map[string]*Request), byTable: make(map[string][]*Request)}
+
+	for _, req := range reqs {
+		requests.byID[req.requestID()] = req
+		requests.byTable[req.Table] = append(requests.byTable[req.Table], req)
+	}
+
+	return requests
+}
+
+// lookup will return the request of the payload at the key.
+func (requests *archivedRequests) lookup(key string, payload *archivedPayload) (*Request, error) {
+	if req, ok := requests.byID[payload.Request]; ok && req.Table == payload.Table {
+		return req, nil
+	}
+
+	switch reqs := requests.byTable[payload.Table]; {
+	case len(reqs) == 0:
+		return nil, UnknownArchiveTableError(key, payload.Table)
+	case len(reqs) > 1:
+		return nil, AmbiguousArchiveTableError(key, payload.Table)
+	default:
+		return reqs[0], nil
+	}
+}
+
+// Reprocess will run the decode, transform, and write stages of the pipeline against the raw payloads archived under
+// "Config.ReprocessFrom", instead of fetching them from the web API. This writes the archived data with the current
+// transformations (e.g. explodes, routes, enrichments, and downsamples) of the request that fetched each payload. The
+// payloads are written in the order they were fetched, so the location must hold the payloads of a single run.
+//
+// Watermarks are neither loaded nor stored, since reprocessing does not change how far the web API has been read.
+func Reprocess(ctx context.Context, cfg *Config) (*RunSummary, error) {
+	redactor := cfg.useRedactor()
+	cfg = cfg.withRunID()
+
+	msg := fmt.Sprintf("run %s started, reprocessing %s", cfg.RunID, cfg.ReprocessFrom)
+	cfg.Logger.Info(tools.LogFormatter{Msg: msg}.String())
+
+	ctx, run := cfg.startRun(ctx)
+	err := redactor.RedactError(wrapRunError(cfg.RunID, reprocess(ctx, cfg, run)))
+
+	summary, summaryErr := cfg.summarize(run, err)
+	if err == nil && summaryErr != nil {
+		return summary, redactor.RedactError(wrapRunError(cfg.RunID, summaryErr))
+	}
+
+	return summary, err
+}
+
+func reprocess(ctx context.Context, cfg *Config, run *runState) error {
+	start := time.Now()
+
+	if cfg.ReprocessFrom == "" {
+		return MissingConfigFieldError("reprocessFrom")
+	}
+
+	store, err := storage.NewObjectStore(cfg.ReprocessFrom)
+	if err != nil {
+		return fmt.Errorf("unable to create archive store: %w", err)
+	}
+
+	keys, checksums, runs, err := archivedKeys(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	// The payloads are replayed in key order, which is the order they were fetched within a run, so that a record
+	// fetched more than once is written as it was last fetched.
+	if len(runs) > 1 {
+		return MultipleArchiveRunsError(runs...)
+	}
+
+	requests := newArchivedRequests(cfg.Requests)
+
+	if err := checkMigrations(ctx, cfg); err != nil {
+		return err
+	}
+
+	if err := Truncate(ctx, cfg); err != nil {
+		return err
+	}
+
+	txCtx, cancelTx := context.WithCancel(ctx)
+	defer cancelTx()
+
+	repoConfig, err := newRepoConfig(txCtx, cfg, run, len(keys))
+	if err != nil {
+		return err
+	}
+
+	defer repoConfig.closeRepos()
+
+	for id := 1; id <= runtime.NumCPU(); id++ {
+		go repositoryWorker(ctx, id, repoConfig)
+	}
+
+	// A compacted object holds many payloads, so the jobs are counted as they are sent, and completed jobs are
+	// received while sending so that the workers never block on a full done channel.
+	jobs, completed := 0, 0
+
+	// runID is the run of the payloads, which is only known from the payloads for runs without a manifest.
+	var runID string
+
+	send := func(job *repoJob) {
+		for {
+			select {
+			case repoConfig.jobs <- job:
+				return
+			case <-repoConfig.done:
+				completed++
+			}
+		}
+	}
+
+	for _, key := range keys {
+		data, err := store.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("unable to read archived payload: %w", err)
+		}
+
+		repoConfig.usage.download(len(data))
+
+		if err := checksums.verify(key, data); err != nil {
+			return err
+		}
+
+		payloads, err := decodeArchivedPayloads(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+
+		for _, payload := range payloads {
+			if runID == "" {
+				runID = payload.RunID
+			}
+
+			if payload.RunID != runID {
+				return MultipleArchiveRunsError(runID, payload.RunID)
+			}
+
+			req, err := requests.lookup(key, payload)
+			if err != nil {
+				return err
+			}
+
+			weight, err := repoConfig.memory.acquire(ctx, len(payload.Body))
+			if err != nil {
+				return err
+			}
+
+			jobs++
+
+			send(&repoJob{
+				b:          payload.Body,
+				table:      req.Table,
+				transforms: req.transforms(),
+				jobContext: jobContext{
+					runID:    cfg.RunID,
+					batch:    jobs,
+					endpoint: payload.URL,
+					table:    req.Table,
+				},
+				fetched: payload.FetchedAt,
+				lease:   repoConfig.memory.lease(weight, 1),
+			})
+		}
+	}
+
+	for ; completed < jobs; completed++ {
+		select {
+		case <-repoConfig.done:
+		case <-ctx.Done():
+			return fmt.Errorf("reprocess canceled: %w", ctx.Err())
+		}
+	}
+
+	if err := upsertDownsamples(ctx, cfg.Requests, repoConfig); err != nil {
+		return err
+	}
+
+	for _, repo := range repoConfig.repos {
+		if err := cfg.Timeouts.commit(ctx, repo, cancelTx); err != nil {
+			return fmt.Errorf("unable to commit transaction: %w", err)
+		}
+	}
+
+	if err := cfg.runDataTests(ctx, run, repoConfig.repos); err != nil {
+		return err
+	}
+
+	if err := cfg.runDBT(ctx, run, repoConfig.loadedTables()); err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("reprocess completed: %d archived payloads", jobs)
+	cfg.Logger.Info(tools.LogFormatter{Duration: time.Since(start), Msg: msg}.String())
+
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// archivePayloads will archive the bodies for the table as batches of a run to a temporary directory, and return the
+// location of the run.
+func archivePayloads(t *testing.T, table string, bodies ...string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	arc, err := newArchiver(&Config{RunID: "run-1", Archive: &Archive{Location: "file://" + filepath.ToSlash(dir)}})
+	if err != nil {
+		t.Fatalf("failed to create archiver: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "https://api.test.com/candles", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	for idx, body := range bodies {
+		jc := jobContext{runID: "run-1", batch: idx + 1, table: table}
+		arc.archive(context.Background(), jc, req, []byte(body), func() {})
+	}
+
+	if err := arc.wait(context.Background()); err != nil {
+		t.Fatalf("failed to archive payloads: %v", err)
+	}
+
+	return "file://" + filepath.ToSlash(filepath.Join(dir, "run-1"))
+}
+
+func TestReprocess(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("transforms are applied to archived payloads", func(t *testing.T) {
+		t.Parallel()
+
+		ds := &Downsample{Table: "candle_hours", TimeField: "unix", Period: 3600}
+		ds.setDefaults()
+
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+
+		dir := t.TempDir()
+
+		cfg := &Config{
+			Logger:            logger,
+			ConnectionStrings: []string{"file://" + filepath.ToSlash(dir) + "?format=jsonl"},
+			Requests:          []*Request{{Table: "candles", Downsample: []*Downsample{ds}}},
+			ReprocessFrom: archivePayloads(t, "candles",
+				`[{"unix": 3600, "open": "1", "high": "3", "low": "1", "close": "2", "volume": "2"}]`,
+				`[{"unix": 3660, "open": "2", "high": "5", "low": "2", "close": "4", "volume": "1"}]`),
+		}
+
+		if _, err := Reprocess(ctx, cfg); err != nil {
+			t.Fatalf("failed to reprocess: %v", err)
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, "candle_hours.jsonl"))
+		if err != nil {
+			t.Fatalf("failed to read candles: %v", err)
+		}
+
+		var candles []map[string]interface{}
+
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var candle map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &candle); err != nil {
+				t.Fatalf("failed to unmarshal candle: %v", err)
+			}
+
+			candles = append(candles, candle)
+		}
+
+		if len(candles) != 1 || candles[0]["volume"] != 3.0 || candles[0]["high"] != 5.0 {
+			t.Fatalf("expected every archived record to be downsampled, got %v", candles)
+		}
+	})
+
+	t.Run("unknown table", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &Config{
+			Logger:        logrus.New(),
+			Requests:      []*Request{{Table: "candles"}},
+			ReprocessFrom: archivePayloads(t, "orders", `[]`),
+		}
+
+		if _, err := Reprocess(ctx, cfg); !errors.Is(err, ErrUnknownArchiveTable) {
+			t.Fatalf("expected unknown archive table error, got %v", err)
+		}
+	})
+
+	t.Run("corrupted payload", func(t *testing.T) {
+		t.Parallel()
+
+		location := archivePayloads(t, "candles", `[]`)
+
+		// The payload no longer matches the checksum in the manifest of the run.
+		name := filepath.Join(strings.TrimPrefix(location, "file://"), "000001-candles.json.gz")
+		if err := os.WriteFile(name, []byte("corrupted"), 0o600); err != nil {
+			t.Fatalf("failed to corrupt payload: %v", err)
+		}
+
+		cfg := &Config{Logger: logrus.New(), Requests: []*Request{{Table: "candles"}}, ReprocessFrom: location}
+
+		if _, err := Reprocess(ctx, cfg); !errors.Is(err, ErrArchiveChecksum) {
+			t.Fatalf("expected archive checksum error, got %v", err)
+		}
+	})
+
+	t.Run("empty archive", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &Config{Logger: logrus.New(), ReprocessFrom: "file://" + filepath.ToSlash(t.TempDir())}
+
+		if _, err := Reprocess(ctx, cfg); !errors.Is(err, ErrNoArchivedPayloads) {
+			t.Fatalf("expected no archived payloads error, got %v", err)
+		}
+	})
+	t.Run("multiple runs", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.test.com/candles", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		for _, runID := range []string{"run-1", "run-2"} {
+			arc, err := newArchiver(&Config{RunID: runID, Archive: &Archive{Location: "file://" + filepath.ToSlash(dir)}})
+			if err != nil {
+				t.Fatalf("failed to create archiver: %v", err)
+			}
+
+			arc.archive(ctx, jobContext{runID: runID, batch: 1, table: "candles"}, req, []byte(`[]`), func() {})
+
+			if err := arc.wait(ctx); err != nil {
+				t.Fatalf("failed to archive payloads: %v", err)
+			}
+		}
+
+		cfg := &Config{
+			Logger:        logrus.New(),
+			Requests:      []*Request{{Table: "candles"}},
+			ReprocessFrom: "file://" + filepath.ToSlash(dir),
+		}
+
+		if _, err := Reprocess(ctx, cfg); !errors.Is(err, ErrMultipleArchiveRuns) {
+			t.Fatalf("expected multiple archive runs error, got %v", err)
+		}
+	})
+
+	t.Run("payloads are matched to their request", func(t *testing.T) {
+		t.Parallel()
+
+		spot := &Request{Table: "candles", Endpoint: "/spot"}
+		futures := &Request{Table: "candles", Endpoint: "/futures"}
+		requests := newArchivedRequests([]*Request{spot, futures})
+
+		req, err := requests.lookup("key", &archivedPayload{Table: "candles", Request: futures.requestID()})
+		if err != nil || req != futures {
+			t.Fatalf("expected the futures request, got %v: %v", req, err)
+		}
+
+		if _, err := requests.lookup("key", &archivedPayload{Table: "candles"}); !errors.Is(err,
+			ErrAmbiguousArchiveTable) {
+			t.Fatalf("expected ambiguous archive table error, got %v", err)
+		}
+	})
+}
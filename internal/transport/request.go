@@ -11,6 +11,8 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"sort"
+	"strings"
 
 	"github.com/alpine-hodler/gidari/internal/web"
 	"golang.org/x/time/rate"
@@ -36,6 +38,107 @@ type Request struct {
 
 	//
 	RateLimitConfig *RateLimitConfig `yaml:"rate_limit"`
+
+	// Explode are the array fields on the records that should be written to child tables.
+	Explode []*Explode `yaml:"explode"`
+
+	// Routes are the rules for writing records to different tables based on field values. Records that do not match
+	// any route are written to "Table".
+	Routes []*Route `yaml:"routes"`
+
+	// Enrich are the lookups against existing tables in storage used to merge values into the records before they
+	// are routed and written. Lookups are made against the read replica, or the first connection string.
+	Enrich []*Enrich `yaml:"enrich"`
+
+	// Downsample are the OHLCV aggregations of the records to write in addition to the raw records.
+	Downsample []*Downsample `yaml:"downsample"`
+
+	// Passthrough writes each record into a single JSONB column instead of a column per field.
+	Passthrough *Passthrough `yaml:"passthrough"`
+
+	// Prometheus decodes the responses of Prometheus instant and range queries into a record per sample.
+	Prometheus *Prometheus `yaml:"prometheus"`
+
+	// Paginate is the configuration for fetching every page of the response, written as a single batch.
+	Paginate *Paginate `yaml:"paginate"`
+
+	// Reconcile stamps the records with the time the response was fetched, and does not write the records of objects
+	// with a later version in storage, e.g. from the webhook events of the objects.
+	Reconcile *Reconcile `yaml:"reconcile"`
+
+	// OrderBook captures the order book of an exchange from the REST snapshot of the endpoint and the deltas of a
+	// WebSocket stream, writing periodic snapshots of the book.
+	OrderBook *OrderBook `yaml:"orderBook"`
+
+	// FIX captures the execution reports and market data of a FIX session instead of requesting the endpoint.
+	FIX *FIX `yaml:"fix"`
+
+	// SQL reads the rows of a query against an upstream database instead of requesting the endpoint.
+	SQL *SQLSource `yaml:"sql"`
+
+	// LDAP searches the entries of an LDAP directory instead of requesting the endpoint.
+	LDAP *LDAP `yaml:"ldap"`
+
+	// SNMP polls the OIDs of network devices instead of requesting the endpoint.
+	SNMP *SNMP `yaml:"snmp"`
+
+	// IMAP ingests the attachments of the messages of a mailbox instead of requesting the endpoint.
+	IMAP *IMAP `yaml:"imap"`
+
+	// MQTT captures the messages published to the topics of an MQTT broker instead of requesting the endpoint.
+	MQTT *MQTT `yaml:"mqtt"`
+
+	// id is the "requestID" of the configured request that a request with rendered templates was copied from.
+	id string
+}
+
+// requestID will return a key that identifies the configured request, using the table, endpoint, and query parameters
+// other than the timeseries range, before their templates are rendered.
+func (req *Request) requestID() string {
+	if req.id != "" {
+		return req.id
+	}
+
+	keys := make([]string, 0, len(req.Query))
+
+	for key := range req.Query {
+		if ts := req.Timeseries; ts == nil || (key != ts.StartName && key != ts.EndName) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	parts := []string{req.Table, req.Endpoint}
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%s", key, req.Query[key]))
+	}
+
+	return strings.Join(parts, "|")
+}
+
+// destinationTables will return every table that the request writes to: its table, the tables of its routes, the
+// child tables of its explodes and of the explodes of its routes, and the tables of its downsamples.
+func (req *Request) destinationTables() []string {
+	tables := []string{req.Table}
+
+	for _, exp := range req.Explode {
+		tables = append(tables, exp.Table)
+	}
+
+	for _, route := range req.Routes {
+		tables = append(tables, route.Table)
+
+		for _, exp := range route.Explode {
+			tables = append(tables, exp.Table)
+		}
+	}
+
+	for _, ds := range req.Downsample {
+		tables = append(tables, ds.Table)
+	}
+
+	return tables
 }
 
 // newFetchConfig will constrcut a new HTTP request from the transport request.
@@ -55,7 +158,10 @@ func (req *Request) newFetchConfig(rurl url.URL, client *web.Client) *web.FetchC
 	// create a rate limiter to pass to all "flattenedRequest". This has to be defined outside of the scope of
 	// individual "flattenedRequest"s so that they all share the same rate limiter, even concurrent requests to
 	// different endpoints could cause a rate limit error on a web API.
-	rateLimiter := rate.NewLimiter(rate.Every(*req.RateLimitConfig.Period), *req.RateLimitConfig.Burst)
+	var rateLimiter web.Limiter = rate.NewLimiter(rate.Every(*req.RateLimitConfig.Period), *req.RateLimitConfig.Burst)
+	if req.RateLimitConfig.Schedule == ScheduleWindow {
+		rateLimiter = web.NewWindowScheduler(*req.RateLimitConfig.Burst, *req.RateLimitConfig.Period)
+	}
 
 	return &web.FetchConfig{
 		Method:      req.Method,
@@ -69,7 +175,17 @@ func (req *Request) newFetchConfig(rurl url.URL, client *web.Client) *web.FetchC
 // operation should be 1-1 with the number of requests to the web API.
 type flattenedRequest struct {
 	fetchConfig *web.FetchConfig
+	request     string
 	table       string
+	transforms  *transforms
+	paginate    *Paginate
+	orderBook   *OrderBook
+	fix         *FIX
+	sql         *SQLSource
+	ldap        *LDAP
+	snmp        *SNMP
+	imap        *IMAP
+	mqtt        *MQTT
 }
 
 // flatten will compress the request information into a "web.FetchConfig" request and a "table" name for storage
@@ -79,7 +195,17 @@ func (req *Request) flatten(rurl url.URL, client *web.Client) *flattenedRequest
 
 	return &flattenedRequest{
 		fetchConfig: fetchConfig,
+		request:     req.requestID(),
 		table:       req.Table,
+		transforms:  req.transforms(),
+		paginate:    req.Paginate,
+		orderBook:   req.OrderBook,
+		fix:         req.FIX,
+		sql:         req.SQL,
+		ldap:        req.LDAP,
+		snmp:        req.SNMP,
+		imap:        req.IMAP,
+		mqtt:        req.MQTT,
 	}
 }
 
@@ -114,13 +240,31 @@ func (req *Request) flattenTimeseries(rurl url.URL, client *web.Client) ([]*flat
 		// copy the request and update it to reflect the partitioned timeseries
 		chunkReq := req
 		chunkReq.Query[timeseries.StartName] = chunk[0].Format(*timeseries.Layout)
-		chunkReq.Query[timeseries.EndName] = chunk[1].Format(*timeseries.Layout)
+
+		if timeseries.EndName != "" {
+			chunkReq.Query[timeseries.EndName] = chunk[1].Format(*timeseries.Layout)
+		}
+
+		data := timeseries.runTime
+		data.Start, data.End = chunk[0], chunk[1]
+
+		for key, tmpl := range timeseries.templates {
+			value, err := renderTemplate(key, tmpl, data)
+			if err != nil {
+				return nil, err
+			}
+
+			chunkReq.Query[key] = value
+		}
 
 		fetchConfig := chunkReq.newFetchConfig(rurl, client)
 
 		requests = append(requests, &flattenedRequest{
 			fetchConfig: fetchConfig,
+			request:     req.requestID(),
 			table:       req.Table,
+			transforms:  req.transforms(),
+			paginate:    req.Paginate,
 		})
 	}
 
@@ -0,0 +1,67 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+var ErrInvalidRetryBudget = fmt.Errorf("invalid retry budget")
+
+// InvalidRetryBudgetError is returned when the retry budget does not bound the retries of the run.
+func InvalidRetryBudgetError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidRetryBudget, reason)
+}
+
+// RetryBudget is the retry budget of a run, shared by the retries of the web requests and of the storage
+// transactions. Once either limit is reached, the next operation that would retry fails the run instead.
+type RetryBudget struct {
+	// Retries is the maximum number of retries of the run. If zero, the number of retries is not bounded.
+	Retries int64 `yaml:"retries"`
+
+	// Wait is the maximum total time that the run waits to retry, e.g. backing off a rate limited web API. If nil,
+	// the time is not bounded.
+	Wait *time.Duration `yaml:"wait"`
+}
+
+func (rb *RetryBudget) validate() error {
+	if rb.Retries < 0 {
+		return InvalidRetryBudgetError(fmt.Sprintf("retries must not be negative, got %d", rb.Retries))
+	}
+
+	if rb.Wait != nil && *rb.Wait <= 0 {
+		return InvalidRetryBudgetError(fmt.Sprintf("wait must be positive, got %v", *rb.Wait))
+	}
+
+	if rb.Retries == 0 && rb.Wait == nil {
+		return InvalidRetryBudgetError("expected retries or wait")
+	}
+
+	return nil
+}
+
+// start will return the budget for a run that starts now, and a copy of the context that carries it. Without a retry
+// budget, the web requests are not retried, and the storage transactions are retried up to their own limits.
+func (rb *RetryBudget) start(ctx context.Context) (context.Context, *tools.RetryBudget) {
+	if rb == nil {
+		return ctx, nil
+	}
+
+	var wait time.Duration
+	if rb.Wait != nil {
+		wait = *rb.Wait
+	}
+
+	budget := tools.NewRetryBudget(rb.Retries, wait)
+
+	return tools.ContextWithRetryBudget(ctx, budget), budget
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+func TestRetryBudget(t *testing.T) {
+	t.Parallel()
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		zero := time.Duration(0)
+		for _, rb := range []*RetryBudget{{}, {Retries: -1}, {Wait: &zero}} {
+			if err := rb.validate(); !errors.Is(err, ErrInvalidRetryBudget) {
+				t.Fatalf("expected invalid retry budget error for %+v, got %v", rb, err)
+			}
+		}
+
+		if err := (&RetryBudget{Retries: 10}).validate(); err != nil {
+			t.Fatalf("expected a valid retry budget, got %v", err)
+		}
+	})
+
+	t.Run("start", func(t *testing.T) {
+		t.Parallel()
+
+		var unset *RetryBudget
+		if ctx, budget := unset.start(context.Background()); budget != nil || tools.RetryBudgetFromContext(ctx) != nil {
+			t.Fatal("expected no budget without a retry budget")
+		}
+
+		wait := time.Minute
+		ctx, budget := (&RetryBudget{Wait: &wait}).start(context.Background())
+
+		if budget == nil || tools.RetryBudgetFromContext(ctx) != budget {
+			t.Fatal("expected the budget on the context")
+		}
+
+		if err := budget.Spend(2*time.Minute, errors.New("unavailable")); !errors.Is(err, tools.ErrRetryBudgetExhausted) {
+			t.Fatalf("expected the wait to be bounded, got %v", err)
+		}
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		t.Parallel()
+
+		yamlBytes := "url: https://api.test\nrateLimit:\n  burst: 5\n  period: 1s\nretryBudget:\n  retries: 50\n" +
+			"  wait: 10m\n"
+
+		cfg, err := NewConfig([]byte(yamlBytes))
+		if err != nil {
+			t.Fatalf("failed to create config: %v", err)
+		}
+
+		if cfg.RetryBudget.Retries != 50 || *cfg.RetryBudget.Wait != 10*time.Minute {
+			t.Fatalf("unexpected retry budget %+v", cfg.RetryBudget)
+		}
+	})
+}
@@ -0,0 +1,256 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrInvalidArchiveRotation = fmt.Errorf("invalid archive rotation")
+
+// InvalidArchiveRotationError is returned when an archive rotation policy is invalid.
+func InvalidArchiveRotationError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidArchiveRotation, reason)
+}
+
+// ArchiveRotation is the policy for appending the archived payloads of a run to segment objects, instead of writing
+// an object for each payload. A segment is rotated, i.e. closed and written to the archive location, once it reaches
+// any of the limits, so that continuously archived payloads become readable at predictable intervals.
+type ArchiveRotation struct {
+	// MaxBytes is the size in bytes of the compressed payloads of a segment at which it is rotated.
+	MaxBytes int64 `yaml:"maxBytes"`
+
+	// MaxRecords is the number of records of a segment at which it is rotated.
+	MaxRecords int `yaml:"maxRecords"`
+
+	// Interval is how long a segment is open before it is rotated, even if it has not reached the other limits.
+	Interval time.Duration `yaml:"interval"`
+
+	// Upload is a flag that writes each segment to the archive location as soon as it is rotated. Otherwise, rotated
+	// segments are kept in the temporary directory and written when the run finishes, before its manifest.
+	Upload bool `yaml:"upload"`
+}
+
+func (rot *ArchiveRotation) validate() error {
+	if rot.MaxBytes < 0 || rot.MaxRecords < 0 || rot.Interval < 0 {
+		return InvalidArchiveRotationError("limits must not be negative")
+	}
+
+	if rot.MaxBytes == 0 && rot.MaxRecords == 0 && rot.Interval == 0 {
+		return InvalidArchiveRotationError("set at least one of maxBytes, maxRecords, or interval")
+	}
+
+	return nil
+}
+
+// segment is an open segment of a partition, which is spooled to a temporary file until it is written to the archive
+// location.
+type segment struct {
+	ctx     context.Context
+	key     string
+	file    *os.File
+	digest  hash.Hash
+	timer   *time.Timer
+	tables  map[string]bool
+	entry   archiveManifestFile
+	schemas map[string]map[string]string
+}
+
+// segmentKey will return the key of the next segment in the directory of the payload key.
+func (arc *archiver) segmentKey(payloadKey string) string {
+	arc.segmentSeq++
+
+	dir := path.Dir(payloadKey)
+	if len(arc.partitionBy) == 0 {
+		return fmt.Sprintf("%s/segment-%06d%s", dir, arc.segmentSeq, archiveExt)
+	}
+
+	return fmt.Sprintf("%s/%s-segment-%06d%s", dir, arc.runID, arc.segmentSeq, archiveExt)
+}
+
+// appendSegment will append the encoded payload to the open segment of its partition, opening a segment if there is
+// none, and rotate the segment if it has reached the limits of the rotation policy. The archiver must be locked.
+func (arc *archiver) appendSegment(ctx context.Context, payload *archivedPayload, key string, data []byte) error {
+	dir := path.Dir(key)
+
+	seg := arc.segments[dir]
+	if seg == nil {
+		file, err := os.CreateTemp("", "gidari-segment-*")
+		if err != nil {
+			return fmt.Errorf("unable to create segment: %w", err)
+		}
+
+		seg = &segment{
+			ctx:     ctx,
+			key:     arc.segmentKey(key),
+			file:    file,
+			digest:  sha256.New(),
+			tables:  make(map[string]bool),
+			schemas: make(map[string]map[string]string),
+		}
+
+		if arc.segments == nil {
+			arc.segments = make(map[string]*segment)
+		}
+
+		arc.segments[dir] = seg
+
+		if interval := arc.rotation.Interval; interval > 0 {
+			seg.timer = time.AfterFunc(interval, func() {
+				arc.mtx.Lock()
+				defer arc.mtx.Unlock()
+
+				if !arc.closed && arc.segments[dir] == seg {
+					arc.rotate(dir, seg)
+				}
+			})
+		}
+	}
+
+	if _, err := seg.file.Write(data); err != nil {
+		return fmt.Errorf("unable to write segment: %w", err)
+	}
+
+	seg.digest.Write(data)
+
+	records, schema := payload.records()
+
+	seg.tables[payload.Table] = true
+	seg.entry.Records += records
+	seg.entry.Bytes += len(data)
+	seg.entry.Payloads++
+	seg.schemas[payload.Table] = mergeSchema(seg.schemas[payload.Table], schema)
+
+	rot := arc.rotation
+	if (rot.MaxBytes > 0 && int64(seg.entry.Bytes) >= rot.MaxBytes) ||
+		(rot.MaxRecords > 0 && seg.entry.Records >= rot.MaxRecords) {
+		arc.rotate(dir, seg)
+	}
+
+	return nil
+}
+
+// mergeSchema will merge the JSON types of the fields into the schema, marking fields with values of different types
+// as "mixed".
+func mergeSchema(schema, fields map[string]string) map[string]string {
+	if schema == nil {
+		schema = make(map[string]string)
+	}
+
+	for name, fieldType := range fields {
+		if schema[name] != "" && schema[name] != fieldType {
+			fieldType = "mixed"
+		}
+
+		schema[name] = fieldType
+	}
+
+	return schema
+}
+
+// rotate will close the segment of the directory, and write it to the archive location in the background if the
+// rotation policy uploads segments as soon as they are rotated. The archiver must be locked.
+func (arc *archiver) rotate(dir string, seg *segment) {
+	delete(arc.segments, dir)
+
+	if seg.timer != nil {
+		seg.timer.Stop()
+	}
+
+	if !arc.rotation.Upload && !arc.closed {
+		arc.rotated = append(arc.rotated, seg)
+
+		return
+	}
+
+	arc.uploads.Add(1)
+
+	go func() {
+		defer arc.uploads.Done()
+
+		arc.upload(seg)
+	}()
+}
+
+// upload will write the closed segment to the archive location, and add it to the manifest of the run. The spooled
+// segment is removed once it is written, or fails to be written.
+func (arc *archiver) upload(seg *segment) {
+	defer os.Remove(seg.file.Name())
+
+	_, err := seg.file.Seek(0, 0)
+	if err == nil {
+		err = arc.store.Upload(seg.ctx, seg.key, seg.file)
+	}
+
+	if closeErr := seg.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	arc.mtx.Lock()
+	defer arc.mtx.Unlock()
+
+	if err != nil {
+		if arc.err == nil {
+			arc.err = fmt.Errorf("%w: segment %s: %v", ErrArchiving, seg.key, err)
+		}
+
+		return
+	}
+
+	tables := make([]string, 0, len(seg.tables))
+	for table := range seg.tables {
+		tables = append(tables, table)
+	}
+
+	entry := seg.entry
+	entry.Key = seg.key
+	entry.SHA256 = hex.EncodeToString(seg.digest.Sum(nil))
+
+	// A segment of the payloads of several tables is listed with each of its tables.
+	sort.Strings(tables)
+	entry.Table = strings.Join(tables, ",")
+
+	arc.addManifestFile(entry, seg.schemas)
+}
+
+// flushSegments will rotate every open segment and write every rotated segment to the archive location, and wait
+// for them to be written. No segments are opened or rotated by timers once the segments are flushed.
+func (arc *archiver) flushSegments() {
+	arc.mtx.Lock()
+
+	arc.closed = true
+
+	for dir, seg := range arc.segments {
+		arc.rotate(dir, seg)
+	}
+
+	for _, seg := range arc.rotated {
+		arc.uploads.Add(1)
+
+		go func(seg *segment) {
+			defer arc.uploads.Done()
+
+			arc.upload(seg)
+		}(seg)
+	}
+
+	arc.rotated = nil
+
+	arc.mtx.Unlock()
+
+	arc.uploads.Wait()
+}
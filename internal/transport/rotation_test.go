@@ -0,0 +1,135 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestArchiveRotation(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.test.com/candles", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	t.Run("records", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+		archive := &Archive{Location: "file://" + filepath.ToSlash(dir), Rotation: &ArchiveRotation{MaxRecords: 2}}
+
+		arc, err := newArchiver(&Config{RunID: "run-1", Archive: archive})
+		if err != nil {
+			t.Fatalf("failed to create archiver: %v", err)
+		}
+
+		// Payloads are archived in the background, so each is archived before the next to keep the segments in order.
+		for batch, body := range []string{`[{"id": 1}, {"id": 2}]`, `[{"id": 3}]`, `[{"id": 4, "name": "a"}]`} {
+			arc.archive(ctx, jobContext{runID: "run-1", batch: batch + 1, table: "candles"}, req, []byte(body), func() {})
+			arc.wg.Wait()
+		}
+
+		if err := arc.wait(ctx); err != nil {
+			t.Fatalf("failed to archive payloads: %v", err)
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, "run-1", archiveManifestName))
+		if err != nil {
+			t.Fatalf("failed to read manifest: %v", err)
+		}
+
+		var manifest archiveManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			t.Fatalf("failed to decode manifest: %v", err)
+		}
+
+		files := make([][3]interface{}, len(manifest.Files))
+		for idx, file := range manifest.Files {
+			files[idx] = [3]interface{}{file.Key, file.Payloads, file.Records}
+		}
+
+		exp := [][3]interface{}{
+			{"run-1/segment-000001.json.gz", 1, 2},
+			{"run-1/segment-000002.json.gz", 2, 2},
+		}
+
+		if !reflect.DeepEqual(files, exp) || manifest.Schema["candles"]["name"] != "string" {
+			t.Fatalf("expected the payloads to be rotated into segments %v, got %+v", exp, manifest)
+		}
+
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+
+		cfg := &Config{
+			Logger:        logger,
+			Requests:      []*Request{{Table: "candles"}},
+			ReprocessFrom: "file://" + filepath.ToSlash(filepath.Join(dir, "run-1")),
+		}
+
+		if _, err := Reprocess(ctx, cfg); err != nil {
+			t.Fatalf("failed to reprocess segments: %v", err)
+		}
+	})
+
+	t.Run("interval upload", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+		rotation := &ArchiveRotation{Interval: 10 * time.Millisecond, Upload: true}
+		archive := &Archive{Location: "file://" + filepath.ToSlash(dir), Rotation: rotation}
+
+		arc, err := newArchiver(&Config{RunID: "run-1", Archive: archive})
+		if err != nil {
+			t.Fatalf("failed to create archiver: %v", err)
+		}
+
+		arc.archive(ctx, jobContext{runID: "run-1", batch: 1, table: "candles"}, req, []byte(`[{"id": 1}]`), func() {})
+
+		// The segment is written once it has been open for the interval, before the run finishes.
+		segment := filepath.Join(dir, "run-1", "segment-000001.json.gz")
+
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if _, err := os.Stat(segment); err == nil {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the segment to be written after the interval")
+			}
+		}
+
+		if err := arc.wait(ctx); err != nil {
+			t.Fatalf("failed to archive payloads: %v", err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		for _, rotation := range []*ArchiveRotation{{}, {MaxBytes: -1}} {
+			archive := &Archive{Location: "file:///tmp/archive", Rotation: rotation}
+			if err := archive.validate(); !errors.Is(err, ErrInvalidArchiveRotation) {
+				t.Fatalf("expected invalid archive rotation error for %+v, got %v", rotation, err)
+			}
+		}
+	})
+}
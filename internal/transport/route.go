@@ -0,0 +1,99 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import "fmt"
+
+const (
+	// RouteWriteModeUpsert writes the records of a route over the existing records with the same key.
+	RouteWriteModeUpsert = "upsert"
+
+	// RouteWriteModeReplace truncates the table of a route and its explode tables at the start of each run, so that
+	// they only hold the records of the latest run.
+	RouteWriteModeReplace = "replace"
+)
+
+// ErrInvalidRouteWriteMode is returned when the write mode of a route is not supported.
+var ErrInvalidRouteWriteMode = fmt.Errorf("invalid route write mode")
+
+// InvalidRouteWriteModeError is returned when the write mode of a route is not supported.
+func InvalidRouteWriteModeError(mode string) error {
+	return fmt.Errorf("%w: %q, expected %q or %q", ErrInvalidRouteWriteMode, mode, RouteWriteModeUpsert,
+		RouteWriteModeReplace)
+}
+
+// Route is a rule for writing records to a different table based on the value of a field on the record. For example,
+// records with `type == "trade"` can be written to a "trades" table and records with `type == "transfer"` to a
+// "transfers" table.
+type Route struct {
+	// Field is the name of the field on the record to match.
+	Field string `yaml:"field"`
+
+	// Value is the value the field must have for the record to be written to the route table. Non-string values are
+	// compared using their string representation, with numbers formatted without an exponent.
+	Value string `yaml:"value"`
+
+	// Table is the name of the table/collection to write matching records to.
+	Table string `yaml:"table"`
+
+	// WriteMode is how the matching records are written, either "upsert" or "replace". The default is "upsert".
+	WriteMode string `yaml:"writeMode"`
+
+	// Explode are the array fields on the matching records that should be written to child tables. Routes do not
+	// inherit the explode configuration of the request, since each branch can have an independent schema.
+	Explode []*Explode `yaml:"explode"`
+}
+
+func (route *Route) validate() error {
+	if route.Field == "" {
+		return MissingConfigFieldError("routes.field")
+	}
+
+	if route.Table == "" {
+		return MissingConfigFieldError("routes.table")
+	}
+
+	switch route.WriteMode {
+	case "":
+		route.WriteMode = RouteWriteModeUpsert
+	case RouteWriteModeUpsert, RouteWriteModeReplace:
+	default:
+		return InvalidRouteWriteModeError(route.WriteMode)
+	}
+
+	for _, exp := range route.Explode {
+		if err := exp.validate(); err != nil {
+			return err
+		}
+
+		exp.setDefaults(route.Table)
+	}
+
+	return nil
+}
+
+// matches will return true if the record should be written to the route table.
+func (route *Route) matches(record map[string]interface{}) bool {
+	val, ok := record[route.Field]
+	if !ok || val == nil {
+		return false
+	}
+
+	return formatValue(val) == route.Value
+}
+
+// matchRoute will return the first route that matches the record, or nil if no route matches.
+func matchRoute(routes []*Route, record map[string]interface{}) *Route {
+	for _, route := range routes {
+		if route.matches(record) {
+			return route
+		}
+	}
+
+	return nil
+}
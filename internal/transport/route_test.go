@@ -0,0 +1,124 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	t.Parallel()
+
+	t.Run("records are written to the matching route table", func(t *testing.T) {
+		t.Parallel()
+
+		fills := &Explode{Field: "fills", Table: "fills"}
+		routes := []*Route{
+			{Field: "type", Value: "trade", Table: "trades", Explode: []*Explode{fills}},
+			{Field: "type", Value: "transfer", Table: "transfers"},
+			{Field: "flagged", Value: "true", Table: "flagged"},
+		}
+
+		for _, route := range routes {
+			if err := route.validate(); err != nil {
+				t.Fatalf("failed to validate route: %v", err)
+			}
+		}
+
+		data := []byte(`[
+			{"id":1,"type":"trade","fills":[{"size":1}]},
+			{"id":2,"type":"transfer","fills":[{"size":2}]},
+			{"id":3,"type":"fee"},
+			{"id":4,"type":"other","flagged":true}
+		]`)
+
+		job := &repoJob{table: "activity", b: data, transforms: &transforms{routes: routes}}
+
+		reqs, err := job.upsertRequests(context.Background(), new(repoConfig))
+		if err != nil {
+			t.Fatalf("failed to route records: %v", err)
+		}
+
+		counts := make(map[string]int)
+		order := []string{}
+
+		for _, req := range reqs {
+			var records []map[string]interface{}
+			if err := json.Unmarshal(req.Data, &records); err != nil {
+				t.Fatalf("failed to unmarshal records: %v", err)
+			}
+
+			counts[req.Table] = len(records)
+			order = append(order, req.Table)
+		}
+
+		expCounts := map[string]int{"activity": 1, "trades": 1, "fills": 1, "transfers": 1, "flagged": 1}
+		for table, count := range expCounts {
+			if counts[table] != count {
+				t.Fatalf("expected %d records for %q, got %d", count, table, counts[table])
+			}
+		}
+
+		if order[0] != "activity" {
+			t.Fatalf("expected default table to be written first, got %v", order)
+		}
+	})
+	t.Run("numeric values match without an exponent", func(t *testing.T) {
+		t.Parallel()
+
+		route := &Route{Field: "size", Value: "1000000", Table: "block_trades"}
+
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(`{"size":1000000}`), &record); err != nil {
+			t.Fatalf("failed to unmarshal record: %v", err)
+		}
+
+		if !route.matches(record) {
+			t.Fatalf("expected record %v to match route value %q", record, route.Value)
+		}
+	})
+
+	t.Run("write mode", func(t *testing.T) {
+		t.Parallel()
+
+		route := &Route{Field: "type", Value: "trade", Table: "trades"}
+		if err := route.validate(); err != nil {
+			t.Fatalf("failed to validate route: %v", err)
+		}
+
+		if route.WriteMode != RouteWriteModeUpsert {
+			t.Fatalf("expected default write mode %q, got %q", RouteWriteModeUpsert, route.WriteMode)
+		}
+
+		route = &Route{Field: "type", Value: "trade", Table: "trades", WriteMode: "append"}
+		if err := route.validate(); !errors.Is(err, ErrInvalidRouteWriteMode) {
+			t.Fatalf("expected error %v, got %v", ErrInvalidRouteWriteMode, err)
+		}
+	})
+
+	t.Run("replace routes are truncated without truncate", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &Config{Requests: []*Request{{
+			Table: "activity",
+			Routes: []*Route{
+				{Table: "trades", WriteMode: RouteWriteModeUpsert},
+				{Table: "positions", WriteMode: RouteWriteModeReplace, Explode: []*Explode{{Table: "legs"}}},
+			},
+		}}}
+
+		exp := [][]string{{"positions", "legs"}}
+		if got := cfg.replaceGroups(); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("expected groups %v, got %v", exp, got)
+		}
+	})
+}
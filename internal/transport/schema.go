@@ -0,0 +1,707 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/internal/web"
+)
+
+const (
+	// DialectPostgres, DialectMySQL, DialectClickHouse, DialectSQLite, and DialectDuckDB are the SQL dialects that
+	// DDL can be exported for.
+	DialectPostgres   = "postgres"
+	DialectMySQL      = "mysql"
+	DialectClickHouse = "clickhouse"
+	DialectSQLite     = "sqlite"
+	DialectDuckDB     = "duckdb"
+
+	// schemaKeyField is the field used as the primary key of sampled tables, if every sampled record has it.
+	schemaKeyField = "id"
+)
+
+var ErrUnsupportedDialect = fmt.Errorf("unsupported dialect")
+
+// UnsupportedDialectError is returned when DDL is exported for a dialect that is not supported.
+func UnsupportedDialectError(dialect string) error {
+	return fmt.Errorf("%w: %q, expected %q, %q, %q, %q, or %q", ErrUnsupportedDialect, dialect, DialectPostgres,
+		DialectMySQL, DialectClickHouse, DialectSQLite, DialectDuckDB)
+}
+
+// columnType is the type of a column, independent of the dialect.
+type columnType uint8
+
+const (
+	columnUnknown columnType = iota
+	columnBool
+	columnInt
+	columnFloat
+	columnTimestamp
+	columnText
+	columnJSON
+)
+
+// inferColumnType will return the column type for a decoded JSON value.
+func inferColumnType(val interface{}) columnType {
+	switch val := val.(type) {
+	case nil:
+		return columnUnknown
+	case bool:
+		return columnBool
+	case float64:
+		if val == math.Trunc(val) && math.Abs(val) < 1<<53 {
+			return columnInt
+		}
+
+		return columnFloat
+	case string:
+		if _, err := time.Parse(time.RFC3339Nano, val); err == nil {
+			return columnTimestamp
+		}
+
+		return columnText
+	case map[string]interface{}, []interface{}:
+		return columnJSON
+	default:
+		return columnText
+	}
+}
+
+// widen will return the narrowest column type that can hold the values of both column types.
+func (typ columnType) widen(other columnType) columnType {
+	switch {
+	case typ == other || other == columnUnknown:
+		return typ
+	case typ == columnUnknown:
+		return other
+	case (typ == columnInt && other == columnFloat) || (typ == columnFloat && other == columnInt):
+		return columnFloat
+	case typ == columnJSON || other == columnJSON:
+		return columnJSON
+	default:
+		return columnText
+	}
+}
+
+// schemaColumn is a column of a table schema.
+type schemaColumn struct {
+	name string
+	typ  columnType
+
+	// notNull is set for columns that always have a value.
+	notNull bool
+
+	// generated is the dot separated path to the field in the "source" column of the table that the column is
+	// generated from, or empty if the column is written.
+	generated string
+}
+
+// tableSchema is the schema of a table, either sampled from records or declared by the configuration.
+type tableSchema struct {
+	name       string
+	columns    []*schemaColumn
+	primaryKey []string
+
+	// source is the JSON column that generated columns are extracted from.
+	source string
+
+	// records is the number of sampled records, and counts are the number of sampled records with a value for each
+	// column.
+	records int
+	counts  map[string]int
+}
+
+func newTableSchema(name string) *tableSchema {
+	return &tableSchema{name: name, counts: make(map[string]int)}
+}
+
+// column will return the column with the name, adding it if it does not exist.
+func (ts *tableSchema) column(name string) *schemaColumn {
+	for _, col := range ts.columns {
+		if col.name == name {
+			return col
+		}
+	}
+
+	col := &schemaColumn{name: name}
+	ts.columns = append(ts.columns, col)
+
+	return col
+}
+
+// observe will widen the columns of the table to hold the values of the record.
+func (ts *tableSchema) observe(record map[string]interface{}) {
+	ts.records++
+
+	for field, val := range record {
+		col := ts.column(field)
+		col.typ = col.typ.widen(inferColumnType(val))
+
+		if val != nil {
+			ts.counts[field]++
+		}
+	}
+}
+
+// finalize will sort the sampled columns, and use "id" as the primary key if every sampled record has one.
+func (ts *tableSchema) finalize() {
+	if ts.records > 0 && len(ts.primaryKey) == 0 && ts.counts[schemaKeyField] == ts.records {
+		ts.primaryKey = []string{schemaKeyField}
+	}
+
+	for _, col := range ts.columns {
+		if col.typ == columnUnknown {
+			col.typ = columnText
+		}
+	}
+
+	sort.SliceStable(ts.columns, func(i, j int) bool {
+		iKey, jKey := ts.isKey(ts.columns[i].name), ts.isKey(ts.columns[j].name)
+		if iKey != jKey {
+			return iKey
+		}
+
+		return ts.columns[i].name < ts.columns[j].name
+	})
+
+	for _, col := range ts.columns {
+		if ts.isKey(col.name) {
+			col.notNull = true
+		}
+	}
+}
+
+func (ts *tableSchema) isKey(name string) bool {
+	for _, key := range ts.primaryKey {
+		if key == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// schema will return the declared schema of the passthrough table.
+func (pt *Passthrough) schema(table string) *tableSchema {
+	ts := newTableSchema(table)
+	ts.primaryKey = pt.Keys
+	ts.source = pt.Column
+
+	for _, key := range pt.Keys {
+		ts.columns = append(ts.columns, &schemaColumn{name: key, typ: columnText, notNull: true})
+	}
+
+	ts.columns = append(ts.columns,
+		&schemaColumn{name: pt.Column, typ: columnJSON, notNull: true},
+		&schemaColumn{name: passthroughIngestedAtColumn, typ: columnTimestamp, notNull: true},
+		&schemaColumn{name: passthroughRunIDColumn, typ: columnText})
+
+	generated := make([]string, 0, len(pt.Generated))
+	for column := range pt.Generated {
+		generated = append(generated, column)
+	}
+
+	sort.Strings(generated)
+
+	for _, column := range generated {
+		ts.columns = append(ts.columns, &schemaColumn{name: column, typ: columnText, generated: pt.Generated[column]})
+	}
+
+	return ts
+}
+
+// watermarkSchema will return the declared schema of the watermark table.
+func watermarkSchema() *tableSchema {
+	ts := newTableSchema(WatermarkTable)
+	ts.primaryKey = []string{watermarkIDField}
+	ts.columns = []*schemaColumn{
+		{name: watermarkIDField, typ: columnText, notNull: true},
+		{name: watermarkTimeField, typ: columnText, notNull: true},
+	}
+
+	return ts
+}
+
+// sqlDialect renders table schemas as the DDL of a SQL dialect.
+type sqlDialect struct {
+	// sql is the dialect of the storage backend, which quotes identifiers and maps column types.
+	sql *storage.SQLDialect
+
+	// keyConstraint is set for dialects that declare the primary key as a table constraint.
+	keyConstraint bool
+
+	// column will return the definition of a column with the rendered type.
+	column func(ts *tableSchema, col *schemaColumn, typ string) string
+
+	// table will return the statement that creates the table with the column definitions.
+	table func(ts *tableSchema, defs []string) string
+
+	// index will return the statement that creates an index on the generated column, or empty if the dialect does not
+	// index generated columns.
+	index func(ts *tableSchema, col *schemaColumn) string
+}
+
+// sqlString will quote the string as a SQL string literal.
+func sqlString(str string) string {
+	return "'" + strings.ReplaceAll(str, "'", "''") + "'"
+}
+
+// pgDialect renders PostgreSQL DDL. Generated columns require PostgreSQL 12 or later.
+var pgDialect = &sqlDialect{
+	sql:           storage.PostgresDialect,
+	keyConstraint: true,
+	column: func(ts *tableSchema, col *schemaColumn, typ string) string {
+		quote := storage.PostgresDialect.Quote
+
+		if col.generated != "" {
+			path := "{" + strings.ReplaceAll(col.generated, ".", ",") + "}"
+
+			return fmt.Sprintf("%s %s GENERATED ALWAYS AS (%s #>> %s) STORED", quote(col.name), typ,
+				quote(ts.source), sqlString(path))
+		}
+
+		return notNullColumn(quote(col.name)+" "+typ, col)
+	},
+	table: func(ts *tableSchema, defs []string) string {
+		return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n);\n", storage.PostgresDialect.Quote(ts.name),
+			strings.Join(defs, ",\n\t"))
+	},
+	index: func(ts *tableSchema, col *schemaColumn) string {
+		quote := storage.PostgresDialect.Quote
+
+		return fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s);\n", quote(ts.name+"_"+col.name+"_idx"),
+			quote(ts.name), quote(col.name))
+	},
+}
+
+// mysqlDialect renders MySQL DDL.
+var mysqlDialect = &sqlDialect{
+	sql:           storage.MySQLDialect,
+	keyConstraint: true,
+	column: func(ts *tableSchema, col *schemaColumn, typ string) string {
+		quote := storage.MySQLDialect.Quote
+
+		if col.generated != "" {
+			return fmt.Sprintf("%s VARCHAR(255) GENERATED ALWAYS AS (JSON_UNQUOTE(JSON_EXTRACT(%s, %s))) STORED",
+				quote(col.name), quote(ts.source), sqlString("$."+col.generated))
+		}
+
+		return notNullColumn(quote(col.name)+" "+typ, col)
+	},
+	table: func(ts *tableSchema, defs []string) string {
+		return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n);\n", storage.MySQLDialect.Quote(ts.name),
+			strings.Join(defs, ",\n\t"))
+	},
+	index: func(ts *tableSchema, col *schemaColumn) string {
+		quote := storage.MySQLDialect.Quote
+
+		return fmt.Sprintf("CREATE INDEX %s ON %s (%s);\n", quote(ts.name+"_"+col.name+"_idx"), quote(ts.name),
+			quote(col.name))
+	},
+}
+
+// clickHouseDialect renders ClickHouse DDL. Tables use the "ReplacingMergeTree" engine ordered by the primary key, so
+// that upserted rows replace the rows with the same key when parts are merged.
+var clickHouseDialect = &sqlDialect{
+	sql: storage.ClickHouseDialect,
+	column: func(ts *tableSchema, col *schemaColumn, typ string) string {
+		quote := storage.ClickHouseDialect.Quote
+
+		if col.generated != "" {
+			args := []string{quote(ts.source)}
+			for _, field := range strings.Split(col.generated, ".") {
+				args = append(args, sqlString(field))
+			}
+
+			return fmt.Sprintf("%s String MATERIALIZED JSONExtractString(%s)", quote(col.name), strings.Join(args, ", "))
+		}
+
+		if !col.notNull {
+			typ = "Nullable(" + typ + ")"
+		}
+
+		return quote(col.name) + " " + typ
+	},
+	table: func(ts *tableSchema, defs []string) string {
+		quote := storage.ClickHouseDialect.Quote
+
+		orderBy := "tuple()"
+		if len(ts.primaryKey) > 0 {
+			keys := make([]string, 0, len(ts.primaryKey))
+			for _, key := range ts.primaryKey {
+				keys = append(keys, quote(key))
+			}
+
+			orderBy = "(" + strings.Join(keys, ", ") + ")"
+		}
+
+		return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n) ENGINE = ReplacingMergeTree ORDER BY %s;\n",
+			quote(ts.name), strings.Join(defs, ",\n\t"), orderBy)
+	},
+	index: func(*tableSchema, *schemaColumn) string { return "" },
+}
+
+// sqliteDialect renders SQLite DDL. Generated columns require SQLite 3.31 or later.
+var sqliteDialect = &sqlDialect{
+	sql:           storage.SQLiteDialect,
+	keyConstraint: true,
+	column: func(ts *tableSchema, col *schemaColumn, typ string) string {
+		quote := storage.SQLiteDialect.Quote
+
+		if col.generated != "" {
+			return fmt.Sprintf("%s TEXT GENERATED ALWAYS AS (json_extract(%s, %s)) STORED", quote(col.name),
+				quote(ts.source), sqlString("$."+col.generated))
+		}
+
+		return notNullColumn(quote(col.name)+" "+typ, col)
+	},
+	table: func(ts *tableSchema, defs []string) string {
+		return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n);\n", storage.SQLiteDialect.Quote(ts.name),
+			strings.Join(defs, ",\n\t"))
+	},
+	index: func(ts *tableSchema, col *schemaColumn) string {
+		quote := storage.SQLiteDialect.Quote
+
+		return fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s);\n", quote(ts.name+"_"+col.name+"_idx"),
+			quote(ts.name), quote(col.name))
+	},
+}
+
+// duckDBDialect renders DuckDB DDL. DuckDB can not store or index generated columns, so the generated columns of
+// passthrough tables are left out, and the JSON column is queried instead.
+var duckDBDialect = &sqlDialect{
+	sql:           storage.DuckDBDialect,
+	keyConstraint: true,
+	column: func(_ *tableSchema, col *schemaColumn, typ string) string {
+		if col.generated != "" {
+			return ""
+		}
+
+		return notNullColumn(storage.DuckDBDialect.Quote(col.name)+" "+typ, col)
+	},
+	table: func(ts *tableSchema, defs []string) string {
+		return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n);\n", storage.DuckDBDialect.Quote(ts.name),
+			strings.Join(defs, ",\n\t"))
+	},
+	index: func(*tableSchema, *schemaColumn) string { return "" },
+}
+
+// notNullColumn will add the "NOT NULL" constraint to the column definition, if the column always has a value.
+func notNullColumn(def string, col *schemaColumn) string {
+	if col.notNull {
+		return def + " NOT NULL"
+	}
+
+	return def
+}
+
+// newSQLDialect will return the SQL dialect with the name.
+func newSQLDialect(name string) (*sqlDialect, error) {
+	switch strings.ToLower(name) {
+	case DialectPostgres, "postgresql":
+		return pgDialect, nil
+	case DialectMySQL:
+		return mysqlDialect, nil
+	case DialectClickHouse:
+		return clickHouseDialect, nil
+	case DialectSQLite:
+		return sqliteDialect, nil
+	case DialectDuckDB:
+		return duckDBDialect, nil
+	default:
+		return nil, UnsupportedDialectError(name)
+	}
+}
+
+// columnDef will return the definition of the column of the table.
+func (dialect *sqlDialect) columnDef(ts *tableSchema, col *schemaColumn) string {
+	return dialect.column(ts, col, dialect.sql.Type(col.typ.String(), ts.isKey(col.name)))
+}
+
+// quote will quote the identifier.
+func (dialect *sqlDialect) quote(name string) string {
+	return dialect.sql.Quote(name)
+}
+
+// ddl will return the statements that create the table and the indexes on its generated columns.
+func (dialect *sqlDialect) ddl(ts *tableSchema) string {
+	defs := make([]string, 0, len(ts.columns)+1)
+	for _, col := range ts.columns {
+		if def := dialect.columnDef(ts, col); def != "" {
+			defs = append(defs, def)
+		}
+	}
+
+	var ddl strings.Builder
+
+	if len(ts.primaryKey) == 0 {
+		fmt.Fprintf(&ddl, "-- No primary key could be inferred for %s, add one before writing to the table.\n", ts.name)
+	} else if dialect.keyConstraint {
+		keys := make([]string, 0, len(ts.primaryKey))
+		for _, key := range ts.primaryKey {
+			keys = append(keys, dialect.quote(key))
+		}
+
+		defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(keys, ", ")))
+	}
+
+	ddl.WriteString(dialect.table(ts, defs))
+
+	for _, col := range ts.columns {
+		if col.generated != "" {
+			ddl.WriteString(dialect.index(ts, col))
+		}
+	}
+
+	return ddl.String()
+}
+
+// sampleRecords will fetch the first response for the request, and return the records written to each table with
+// the transformations of the request applied. Enrichments are not applied, since they read from storage.
+func sampleRecords(ctx context.Context, cfg *Config, req *Request, client *web.Client) (*tableRecords, error) {
+	rendered, err := req.applyRunTime(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	flatReqs, err := rendered.flattenTimeseries(*cfg.URL, client)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(flatReqs) == 0 {
+		return newTableRecords(), nil
+	}
+
+	// Only the first page of a paginated request is sampled.
+	sample := *flatReqs[0]
+	if pg := sample.paginate; pg != nil {
+		firstPage := *pg
+		firstPage.MaxPages = 1
+		sample.paginate = &firstPage
+	}
+
+	// The schema of an order book is sampled from its REST snapshot, without capturing the stream.
+	if ob := sample.orderBook; ob != nil {
+		snapshotOnly := *ob
+		snapshotOnly.snapshotOnly = true
+		sample.orderBook = &snapshotOnly
+	}
+
+	// The schema of a FIX source is sampled from the first message written, without capturing for its duration.
+	if fx := sample.fix; fx != nil {
+		firstOnly := *fx
+		firstOnly.firstOnly = true
+		sample.fix = &firstOnly
+	}
+
+	// The schema of a SQL source is sampled from the first row of its query.
+	if src := sample.sql; src != nil {
+		sampleOnly := *src
+		sampleOnly.sampleOnly = true
+		sample.sql = &sampleOnly
+	}
+
+	// The schema of an LDAP source is sampled from the first entry of its search.
+	if src := sample.ldap; src != nil {
+		firstOnly := *src
+		firstOnly.firstOnly = true
+		sample.ldap = &firstOnly
+	}
+
+	// The schema of an SNMP source is sampled from the first record of its first device.
+	if src := sample.snmp; src != nil {
+		firstOnly := *src
+		firstOnly.firstOnly = true
+		sample.snmp = &firstOnly
+	}
+
+	// The schema of an IMAP source is sampled from the first record of its messages, which are not marked processed.
+	if src := sample.imap; src != nil {
+		firstOnly := *src
+		firstOnly.firstOnly = true
+		sample.imap = &firstOnly
+	}
+
+	// The schema of an MQTT source is sampled from the first message received, without capturing for its duration.
+	if src := sample.mqtt; src != nil {
+		firstOnly := *src
+		firstOnly.firstOnly = true
+		sample.mqtt = &firstOnly
+	}
+
+	_, body, err := (&webJob{flattenedRequest: &sample}).fetch(ctx)
+	if err != nil {
+		return nil, WrapWebError(err)
+	}
+
+	records, err := flatReqs[0].transforms.decode(body)
+	if err != nil {
+		return nil, err
+	}
+
+	sampled, err := flatReqs[0].transforms.apply(req.Table, records)
+	if err != nil {
+		return nil, err
+	}
+
+	// Downsampled tables are sampled by aggregating the records of the response alone.
+	for _, ds := range req.Downsample {
+		sample := newDownsampler(ds)
+
+		for _, record := range records {
+			if err := sample.add(record); err != nil {
+				return nil, err
+			}
+		}
+
+		upsertReq, err := sample.upsertRequest(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if upsertReq == nil {
+			continue
+		}
+
+		candles, err := decodeJSONRecords(upsertReq.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		sampled.add(ds.Table, candles...)
+	}
+
+	return sampled, nil
+}
+
+// ExportSchema will write the DDL for the tables that the configuration writes to, in the SQL dialect (i.e.
+// "postgres", "mysql", or "clickhouse"), so that the tables can be reviewed and created with existing migration
+// tooling. The schema of passthrough tables and the watermark table is declared, and the schema of every other table
+// is inferred from the records of the first response for each request, with "id" as the primary key if every sampled
+// record has one.
+func ExportSchema(ctx context.Context, cfg *Config, dialectName string, out io.Writer) error {
+	dialect, err := newSQLDialect(dialectName)
+	if err != nil {
+		return err
+	}
+
+	schemas, err := cfg.schemas(ctx)
+	if err != nil {
+		return err
+	}
+
+	for idx, ts := range schemas {
+		if idx > 0 {
+			if _, err := io.WriteString(out, "\n"); err != nil {
+				return fmt.Errorf("unable to write schema: %w", err)
+			}
+		}
+
+		if _, err := io.WriteString(out, dialect.ddl(ts)); err != nil {
+			return fmt.Errorf("unable to write schema: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// schemas will return the schemas of the tables that the configuration writes to, in the order they are first
+// written.
+func (cfg *Config) schemas(ctx context.Context) ([]*tableSchema, error) {
+	release, err := cfg.applyCompliance()
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	transports := web.NewTransports()
+	defer transports.Close()
+
+	client, err := cfg.connect(ctx, transports)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to web API: %w", err)
+	}
+
+	var schemas []*tableSchema
+
+	byName := make(map[string]*tableSchema)
+
+	incremental := false
+
+	for _, req := range cfg.Requests {
+		if req.incremental() || (req.SQL != nil && req.SQL.incremental()) {
+			incremental = true
+		}
+
+		if req.Passthrough != nil {
+			if _, ok := byName[req.Table]; !ok {
+				byName[req.Table] = req.Passthrough.schema(req.Table)
+				schemas = append(schemas, byName[req.Table])
+			}
+
+			continue
+		}
+
+		sampled, err := sampleRecords(ctx, cfg, req, client)
+		if err != nil {
+			return nil, fmt.Errorf("unable to sample %s: %w", req.Table, err)
+		}
+
+		for _, table := range sampled.tables {
+			ts, ok := byName[table]
+			if !ok {
+				ts = newTableSchema(table)
+				byName[table] = ts
+				schemas = append(schemas, ts)
+			}
+
+			for _, record := range sampled.records[table] {
+				ts.observe(record)
+			}
+		}
+
+		for _, ds := range req.Downsample {
+			if ts := byName[ds.Table]; ts != nil && len(ts.primaryKey) == 0 {
+				ts.primaryKey = append(append([]string(nil), ds.GroupBy...), ds.TimeField)
+			}
+		}
+	}
+
+	for _, ts := range schemas {
+		if ts.source == "" {
+			ts.finalize()
+		}
+
+		// Encrypted values are strings, whatever the type of the value before it was encrypted.
+		for _, col := range ts.columns {
+			if cfg.Encryption != nil && cfg.Encryption.encrypted(ts.name, col.name) {
+				col.typ = columnText
+			}
+		}
+	}
+
+	if incremental {
+		schemas = append(schemas, watermarkSchema())
+	}
+
+	if cfg.Encryption != nil {
+		schemas = append(schemas, encryptionKeySchema())
+	}
+
+	return schemas, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestInferColumnType(t *testing.T) {
+	t.Parallel()
+
+	for _, tcase := range []struct {
+		name   string
+		values []interface{}
+		want   columnType
+	}{
+		{"integers", []interface{}{1.0, 2.0}, columnInt},
+		{"integers widen to floats", []interface{}{1.0, 1.5}, columnFloat},
+		{"timestamps", []interface{}{"2023-06-01T00:00:00Z"}, columnTimestamp},
+		{"timestamps widen to text", []interface{}{"2023-06-01T00:00:00Z", "BTC-USD"}, columnText},
+		{"nulls are ignored", []interface{}{nil, true}, columnBool},
+		{"objects", []interface{}{map[string]interface{}{"a": 1.0}, "x"}, columnJSON},
+	} {
+		tcase := tcase
+
+		t.Run(tcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			var typ columnType
+			for _, val := range tcase.values {
+				typ = typ.widen(inferColumnType(val))
+			}
+
+			if typ != tcase.want {
+				t.Fatalf("expected column type %d, got %d", tcase.want, typ)
+			}
+		})
+	}
+}
+
+func TestSQLDialectDDL(t *testing.T) {
+	t.Parallel()
+
+	sampled := func() *tableSchema {
+		ts := newTableSchema("trades")
+		ts.observe(map[string]interface{}{"id": 1.0, "price": "10.5", "time": "2023-06-01T00:00:00Z", "size": 1.5})
+		ts.observe(map[string]interface{}{"id": 2.0, "price": "11", "time": "2023-06-01T00:01:00Z", "size": nil})
+		ts.finalize()
+
+		return ts
+	}
+
+	for _, tcase := range []struct {
+		dialect string
+		want    []string
+	}{
+		{
+			dialect: DialectPostgres,
+			want: []string{
+				"CREATE TABLE IF NOT EXISTS \"trades\" (\n\t\"id\" BIGINT NOT NULL,\n\t\"price\" TEXT,",
+				`"size" DOUBLE PRECISION,`, `"time" TIMESTAMPTZ,`, `PRIMARY KEY ("id")`,
+			},
+		},
+		{
+			dialect: DialectMySQL,
+			want:    []string{"CREATE TABLE IF NOT EXISTS `trades`", "`id` BIGINT NOT NULL", "PRIMARY KEY (`id`)"},
+		},
+		{
+			dialect: DialectClickHouse,
+			want: []string{
+				"`id` Int64,", "`size` Nullable(Float64)", "`time` Nullable(DateTime64(6))",
+				") ENGINE = ReplacingMergeTree ORDER BY (`id`);",
+			},
+		},
+		{
+			dialect: DialectSQLite,
+			want:    []string{`"id" INTEGER NOT NULL`, `"size" REAL,`, `"time" TEXT,`, `PRIMARY KEY ("id")`},
+		},
+		{
+			dialect: DialectDuckDB,
+			want:    []string{`"id" BIGINT NOT NULL`, `"price" VARCHAR,`, `"time" TIMESTAMPTZ,`, `PRIMARY KEY ("id")`},
+		},
+	} {
+		tcase := tcase
+
+		t.Run(tcase.dialect, func(t *testing.T) {
+			t.Parallel()
+
+			dialect, err := newSQLDialect(tcase.dialect)
+			if err != nil {
+				t.Fatalf("failed to create dialect: %v", err)
+			}
+
+			ddl := dialect.ddl(sampled())
+			for _, exp := range tcase.want {
+				if !strings.Contains(ddl, exp) {
+					t.Fatalf("expected %q in ddl:\n%s", exp, ddl)
+				}
+			}
+		})
+	}
+
+	t.Run("tables without an id are flagged", func(t *testing.T) {
+		t.Parallel()
+
+		ts := newTableSchema("stats")
+		ts.observe(map[string]interface{}{"volume": 1.0})
+		ts.finalize()
+
+		if ddl := clickHouseDialect.ddl(ts); !strings.Contains(ddl, "-- No primary key") ||
+			!strings.Contains(ddl, "ORDER BY tuple()") {
+			t.Fatalf("expected a missing primary key comment and an unordered table:\n%s", ddl)
+		}
+	})
+
+	t.Run("passthrough generated columns", func(t *testing.T) {
+		t.Parallel()
+
+		pt := &Passthrough{Keys: []string{"id"}, Generated: map[string]string{"product_id": "product.id"}}
+		pt.setDefaults()
+
+		for dialect, exp := range map[*sqlDialect]string{
+			mysqlDialect: "`product_id` VARCHAR(255) GENERATED ALWAYS AS " +
+				"(JSON_UNQUOTE(JSON_EXTRACT(`data`, '$.product.id'))) STORED",
+			clickHouseDialect: "`product_id` String MATERIALIZED JSONExtractString(`data`, 'product', 'id')",
+			sqliteDialect:     `"product_id" TEXT GENERATED ALWAYS AS (json_extract("data", '$.product.id')) STORED`,
+		} {
+			if ddl := dialect.ddl(pt.schema("orders")); !strings.Contains(ddl, exp) {
+				t.Fatalf("expected %q in ddl:\n%s", exp, ddl)
+			}
+		}
+
+		// DuckDB can not store generated columns, so they are left out.
+		if ddl := duckDBDialect.ddl(pt.schema("orders")); strings.Contains(ddl, "product_id") ||
+			!strings.Contains(ddl, `"data" JSON`) {
+			t.Fatalf("expected the json column without generated columns in ddl:\n%s", ddl)
+		}
+	})
+}
+
+func TestExportSchema(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("declared tables", func(t *testing.T) {
+		t.Parallel()
+
+		pt := &Passthrough{Keys: []string{"id"}}
+		pt.setDefaults()
+
+		cfg := &Config{Requests: []*Request{{Table: "orders", Passthrough: pt}}}
+
+		var out bytes.Buffer
+		if err := ExportSchema(ctx, cfg, DialectPostgres, &out); err != nil {
+			t.Fatalf("failed to export schema: %v", err)
+		}
+
+		if out.String() != pt.DDL("orders") {
+			t.Fatalf("expected the passthrough ddl, got:\n%s", out.String())
+		}
+	})
+
+	t.Run("unsupported dialect", func(t *testing.T) {
+		t.Parallel()
+
+		err := ExportSchema(ctx, &Config{}, "oracle", &bytes.Buffer{})
+		if !errors.Is(err, ErrUnsupportedDialect) {
+			t.Fatalf("expected unsupported dialect error, got %v", err)
+		}
+	})
+}
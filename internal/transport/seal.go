@@ -0,0 +1,260 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// sealedPrefix marks a sealed configuration section. The rest of the value is the base64 encoded age ciphertext
+	// of the YAML section.
+	sealedPrefix = "sealed:"
+
+	// AgeKeyFileEnv is the environment variable for the path to the age identity file used to unseal configuration
+	// files.
+	AgeKeyFileEnv = "GIDARI_AGE_KEY_FILE"
+
+	// AgeKeyEnv is the environment variable for the age identity used to unseal configuration files, e.g.
+	// "AGE-SECRET-KEY-1...". It is only used if "GIDARI_AGE_KEY_FILE" is not set.
+	AgeKeyEnv = "GIDARI_AGE_KEY"
+)
+
+// sensitiveSections are the top-level configuration sections that contain credentials, and are sealed.
+var sensitiveSections = []string{"authentication", "connectionStrings", "readReplica"}
+
+var (
+	ErrSealedConfig  = fmt.Errorf("configuration is sealed")
+	ErrMissingAgeKey = fmt.Errorf("missing age key")
+	ErrSealing       = fmt.Errorf("failed to seal configuration")
+	ErrUnsealing     = fmt.Errorf("failed to unseal configuration")
+)
+
+// SealedConfigError is returned when a sealed configuration file is loaded without an age key to unseal it.
+func SealedConfigError() error {
+	return fmt.Errorf("%w: %v, set %s or %s", ErrSealedConfig, ErrMissingAgeKey, AgeKeyFileEnv, AgeKeyEnv)
+}
+
+// SealingError is returned when a configuration section can not be sealed.
+func SealingError(section string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrSealing, section, err)
+}
+
+// UnsealingError is returned when a configuration section can not be unsealed.
+func UnsealingError(section string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrUnsealing, section, err)
+}
+
+// isSensitiveSection will return true if the configuration section is sealed.
+func isSensitiveSection(key interface{}) bool {
+	for _, section := range sensitiveSections {
+		if key == section {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sealedValue will return the ciphertext of a sealed section value, and false if the value is not sealed.
+func sealedValue(val interface{}) (string, bool) {
+	str, ok := val.(string)
+	if !ok || !strings.HasPrefix(str, sealedPrefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(str, sealedPrefix), true
+}
+
+// SealConfig will encrypt the sensitive sections of the YAML configuration ("authentication", "connectionStrings", and
+// "readReplica") to the age recipients, e.g. "age1...", so that the configuration file can be committed to source
+// control. The rest of the configuration is left as is, but comments are not preserved. Sections that are already
+// sealed are not changed.
+func SealConfig(yamlBytes []byte, recipients []string) ([]byte, error) {
+	ageRecipients := make([]age.Recipient, 0, len(recipients))
+
+	for _, recipient := range recipients {
+		parsed, err := age.ParseRecipients(strings.NewReader(recipient))
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid recipient: %v", ErrSealing, err)
+		}
+
+		ageRecipients = append(ageRecipients, parsed...)
+	}
+
+	if len(ageRecipients) == 0 {
+		return nil, fmt.Errorf("%w: no recipients", ErrSealing)
+	}
+
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(yamlBytes, &doc); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal YAML: %w", err)
+	}
+
+	for idx, item := range doc {
+		if _, sealed := sealedValue(item.Value); sealed || !isSensitiveSection(item.Key) {
+			continue
+		}
+
+		section, err := yaml.Marshal(item.Value)
+		if err != nil {
+			return nil, SealingError(fmt.Sprint(item.Key), err)
+		}
+
+		var ciphertext bytes.Buffer
+
+		writer, err := age.Encrypt(&ciphertext, ageRecipients...)
+		if err != nil {
+			return nil, SealingError(fmt.Sprint(item.Key), err)
+		}
+
+		if _, err := writer.Write(section); err != nil {
+			return nil, SealingError(fmt.Sprint(item.Key), err)
+		}
+
+		if err := writer.Close(); err != nil {
+			return nil, SealingError(fmt.Sprint(item.Key), err)
+		}
+
+		doc[idx].Value = sealedPrefix + base64.StdEncoding.EncodeToString(ciphertext.Bytes())
+	}
+
+	sealed, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal YAML: %w", err)
+	}
+
+	return sealed, nil
+}
+
+// unseal will decrypt the sealed sections of the YAML configuration using the age identities.
+func unseal(yamlBytes []byte, identities []age.Identity) ([]byte, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(yamlBytes, &doc); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal YAML: %w", err)
+	}
+
+	for idx, item := range doc {
+		ciphertext, sealed := sealedValue(item.Value)
+		if !sealed {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(ciphertext)
+		if err != nil {
+			return nil, UnsealingError(fmt.Sprint(item.Key), err)
+		}
+
+		reader, err := age.Decrypt(bytes.NewReader(decoded), identities...)
+		if err != nil {
+			return nil, UnsealingError(fmt.Sprint(item.Key), err)
+		}
+
+		section, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, UnsealingError(fmt.Sprint(item.Key), err)
+		}
+
+		// Decode maps into a "yaml.MapSlice" to preserve the order of the keys in the section.
+		var mapSection yaml.MapSlice
+		if err := yaml.Unmarshal(section, &mapSection); err == nil {
+			doc[idx].Value = mapSection
+
+			continue
+		}
+
+		var value interface{}
+		if err := yaml.Unmarshal(section, &value); err != nil {
+			return nil, UnsealingError(fmt.Sprint(item.Key), err)
+		}
+
+		doc[idx].Value = value
+	}
+
+	unsealed, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal YAML: %w", err)
+	}
+
+	return unsealed, nil
+}
+
+// ageIdentities will return the age identities from the "GIDARI_AGE_KEY_FILE" or "GIDARI_AGE_KEY" environment
+// variables, or nil if neither is set.
+func ageIdentities() ([]age.Identity, error) {
+	var keys io.Reader
+
+	if path := os.Getenv(AgeKeyFileEnv); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open age key file: %w", err)
+		}
+		defer file.Close()
+
+		keys = file
+	} else if key := os.Getenv(AgeKeyEnv); key != "" {
+		keys = strings.NewReader(key)
+	} else {
+		return nil, nil
+	}
+
+	identities, err := age.ParseIdentities(keys)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse age key: %w", err)
+	}
+
+	return identities, nil
+}
+
+// isSealed will return true if the YAML configuration has a sealed section.
+func isSealed(yamlBytes []byte) bool {
+	if !bytes.Contains(yamlBytes, []byte(sealedPrefix)) {
+		return false
+	}
+
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(yamlBytes, &doc); err != nil {
+		return false
+	}
+
+	for _, item := range doc {
+		if _, sealed := sealedValue(item.Value); sealed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UnsealConfig will decrypt the sealed sections of the YAML configuration using the age key from the
+// "GIDARI_AGE_KEY_FILE" or "GIDARI_AGE_KEY" environment variables. Configuration without sealed sections is returned
+// as is.
+func UnsealConfig(yamlBytes []byte) ([]byte, error) {
+	if !isSealed(yamlBytes) {
+		return yamlBytes, nil
+	}
+
+	identities, err := ageIdentities()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(identities) == 0 {
+		return nil, SealedConfigError()
+	}
+
+	return unseal(yamlBytes, identities)
+}
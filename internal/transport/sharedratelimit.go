@@ -0,0 +1,91 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+)
+
+// sharedRateLimitKeyPrefix is the prefix of the default Redis key of a shared rate limit, followed by the host of the
+// web API.
+const sharedRateLimitKeyPrefix = "gidari:ratelimit:"
+
+var ErrInvalidSharedRateLimit = fmt.Errorf("invalid shared rate limit")
+
+// InvalidSharedRateLimitError is returned when the shared rate limit is missing a field or cannot be constructed.
+func InvalidSharedRateLimitError(err error) error {
+	return fmt.Errorf("%w: %v", ErrInvalidSharedRateLimit, err)
+}
+
+// SharedRateLimit is a rate limit shared by every gidari process that uses the same key on a Redis server, e.g. a
+// fleet of instances pulling from a web API with a single quota. Every request waits for both the rate limit of the
+// request and the shared rate limit.
+type SharedRateLimit struct {
+	// RateLimitConfig is the combined rate limit of the processes, i.e. a burst of requests refilled at one request
+	// every period.
+	RateLimitConfig `yaml:",inline"`
+
+	// Redis is the URL of the Redis server that stores the token bucket, e.g. "redis://:password@redis1:6379/0", or
+	// "rediss://" to connect with TLS.
+	Redis string `yaml:"redis"`
+
+	// Key is the Redis key of the token bucket. Processes that share a quota must use the same key. If empty, the key
+	// is "gidari:ratelimit:" followed by the host of the web API.
+	Key string `yaml:"key"`
+}
+
+func (srl *SharedRateLimit) validate() error {
+	if err := srl.RateLimitConfig.validate(); err != nil {
+		return InvalidSharedRateLimitError(err)
+	}
+
+	if srl.Redis == "" {
+		return InvalidSharedRateLimitError(fmt.Errorf("missing redis"))
+	}
+
+	_, err := srl.limiter(&url.URL{Host: "api.example.com"})
+
+	return err
+}
+
+// limiter will return the rate limiter shared through Redis, or nil if there is no shared rate limit.
+func (srl *SharedRateLimit) limiter(apiURL *url.URL) (*web.RedisLimiter, error) {
+	if srl == nil {
+		return nil, nil
+	}
+
+	key := srl.Key
+	if key == "" {
+		key = sharedRateLimitKeyPrefix + apiURL.Host
+	}
+
+	limiter, err := web.NewRedisLimiter(srl.Redis, key, *srl.Period, *srl.Burst)
+	if err != nil {
+		return nil, InvalidSharedRateLimitError(err)
+	}
+
+	return limiter, nil
+}
+
+// shareRateLimit will make the requests wait for the shared rate limit, in addition to their own rate limit. The
+// returned function closes the connection to the Redis server once the requests are done.
+func (cfg *Config) shareRateLimit(reqs []*flattenedRequest) (func(), error) {
+	limiter, err := cfg.SharedRateLimit.limiter(cfg.URL)
+	if err != nil || limiter == nil {
+		return func() {}, err
+	}
+
+	for _, req := range reqs {
+		req.fetchConfig.RateLimiter = web.ChainLimiters(req.fetchConfig.RateLimiter, limiter)
+	}
+
+	return limiter.Close, nil
+}
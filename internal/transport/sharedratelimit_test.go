@@ -0,0 +1,67 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+	"golang.org/x/time/rate"
+)
+
+func TestSharedRateLimit(t *testing.T) {
+	t.Parallel()
+
+	burst, period := 5, time.Second
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		for _, srl := range []*SharedRateLimit{
+			{Redis: "redis://redis1:6379"},
+			{RateLimitConfig: RateLimitConfig{Burst: &burst, Period: &period}},
+			{RateLimitConfig: RateLimitConfig{Burst: &burst, Period: &period}, Redis: "http://redis1"},
+		} {
+			if err := srl.validate(); !errors.Is(err, ErrInvalidSharedRateLimit) {
+				t.Fatalf("expected invalid shared rate limit error for %+v, got %v", srl, err)
+			}
+		}
+	})
+
+	t.Run("share", func(t *testing.T) {
+		t.Parallel()
+
+		local := rate.NewLimiter(rate.Every(period), burst)
+		reqs := []*flattenedRequest{{fetchConfig: &web.FetchConfig{RateLimiter: local}}}
+
+		cfg := &Config{URL: &url.URL{Host: "api.test"}}
+		if closeFn, err := cfg.shareRateLimit(reqs); err != nil || reqs[0].fetchConfig.RateLimiter != local {
+			t.Fatalf("expected the rate limiter to be unchanged without a shared rate limit, got %v", err)
+		} else {
+			closeFn()
+		}
+
+		cfg.SharedRateLimit = &SharedRateLimit{
+			RateLimitConfig: RateLimitConfig{Burst: &burst, Period: &period},
+			Redis:           "redis://redis1:6379",
+		}
+
+		closeFn, err := cfg.shareRateLimit(reqs)
+		if err != nil {
+			t.Fatalf("failed to share rate limit: %v", err)
+		}
+		defer closeFn()
+
+		if reqs[0].fetchConfig.RateLimiter == local {
+			t.Fatal("expected the requests to wait for the shared rate limit")
+		}
+	})
+}
@@ -0,0 +1,544 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// snmpRequestMethod is the method of the request written for an SNMP source, e.g. to the archive.
+	snmpRequestMethod = "SNMP"
+
+	// snmpDefaultPort is the port of the agents whose address has none.
+	snmpDefaultPort = "161"
+
+	// snmpDefaultCommunity is the default community string of the agents.
+	snmpDefaultCommunity = "public"
+
+	// snmpDefaultTimeout is the default time waited for each response of an agent.
+	snmpDefaultTimeout = 5 * time.Second
+
+	// snmpDefaultRetries is the default number of times a request is sent again when an agent does not respond.
+	snmpDefaultRetries = 1
+
+	// snmpDefaultMaxRepetitions is the default number of rows of each get bulk request of a table walk.
+	snmpDefaultMaxRepetitions = 25
+
+	// snmpDefaultConcurrency is the default number of devices polled at once.
+	snmpDefaultConcurrency = 16
+
+	// snmpDeviceField, snmpPolledAtField, and snmpIndexField are the fields of the address of the device, the time
+	// it was polled, and the index of the row of a table.
+	snmpDeviceField   = "device"
+	snmpPolledAtField = "polledAt"
+	snmpIndexField    = "index"
+
+	// snmpAddressColumn and snmpCommunityColumn are the columns of an inventory with the address and the community
+	// string of each device. The other columns are the labels of the device.
+	snmpAddressColumn   = "address"
+	snmpCommunityColumn = "community"
+)
+
+var (
+	ErrInvalidSNMP = fmt.Errorf("invalid snmp source")
+	ErrSNMPPoll    = fmt.Errorf("snmp poll failed")
+)
+
+// InvalidSNMPError is returned when the SNMP source of a request is not valid.
+func InvalidSNMPError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidSNMP, reason)
+}
+
+// SNMPPollError is returned when the devices of an SNMP source can not be polled.
+func SNMPPollError(err error) error {
+	return fmt.Errorf("%w: %v", ErrSNMPPoll, err)
+}
+
+// snmpVersions are the versions of the messages, by name.
+var snmpVersions = map[string]int{
+	"1":  web.SNMPVersion1,
+	"2c": web.SNMPVersion2c,
+}
+
+// SNMP is the configuration for polling the OIDs of network devices over SNMP instead of requesting the endpoint, e.g.
+// for interface counters. Each run polls every device once, so the devices are polled on a schedule by running
+// gidari on that schedule, e.g. with cron. Each record has the address of the device in "device", its labels, the
+// time it was polled in "polledAt", and a field for each OID.
+type SNMP struct {
+	// Devices are the devices polled.
+	Devices []SNMPDevice `yaml:"devices"`
+
+	// Inventory is the path of a CSV file of more devices, with a header row. The "address" column is the address of
+	// each device, the optional "community" column is its community string, and the other columns are its labels.
+	Inventory string `yaml:"inventory"`
+
+	// Version is the version of SNMP, "1" or "2c" (the default).
+	Version string `yaml:"version"`
+
+	// Community is the community string of the devices that do not set their own, "public" by default.
+	Community string `yaml:"community"`
+
+	// OIDs are the scalar OIDs polled from each device, by field, e.g. {"uptime": "1.3.6.1.2.1.1.3.0"}.
+	OIDs map[string]string `yaml:"oids"`
+
+	// Columns are the columns of a table walked on each device, by field, e.g. {"inOctets": "1.3.6.1.2.1.2.2.1.10"}.
+	// Each row of the table is a record, with the OID suffix of the row in "index" and the scalar "OIDs" of the
+	// device.
+	Columns map[string]string `yaml:"columns"`
+
+	// Timeout is the time waited for each response of a device, five seconds by default.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Retries is the number of times a request is sent again when a device does not respond, one by default.
+	Retries *int `yaml:"retries"`
+
+	// MaxRepetitions is the number of rows of each get bulk request of a table walk, 25 by default. SNMPv1 walks a
+	// row at a time.
+	MaxRepetitions int `yaml:"maxRepetitions"`
+
+	// Concurrency is the number of devices polled at once, 16 by default.
+	Concurrency int `yaml:"concurrency"`
+
+	// dial connects to a device, "web.DialSNMP" unless it is set by tests.
+	dial func(ctx context.Context, addr string, cfg web.SNMPConfig) (snmpPoller, error)
+
+	// firstOnly polls the first device and writes its first record, to sample the schema.
+	firstOnly bool
+}
+
+// SNMPDevice is a device polled by an SNMP source.
+type SNMPDevice struct {
+	// Address is the "host:port" of the agent of the device, where the port is 161 by default.
+	Address string `yaml:"address"`
+
+	// Community is the community string of the device, the community string of the source by default.
+	Community string `yaml:"community"`
+
+	// Labels are written as fields of each record of the device, e.g. {"site": "fra1", "role": "spine"}.
+	Labels map[string]string `yaml:"labels"`
+}
+
+// snmpPoller is a connection that polls a device.
+type snmpPoller interface {
+	Get(ctx context.Context, oids []string) ([]web.SNMPVarbind, error)
+	Walk(ctx context.Context, root string, varbindFn func(web.SNMPVarbind) error) error
+	Close() error
+}
+
+// dialSNMPPoller will connect to a device.
+func dialSNMPPoller(ctx context.Context, addr string, cfg web.SNMPConfig) (snmpPoller, error) {
+	return web.DialSNMP(ctx, addr, cfg)
+}
+
+func (src *SNMP) validate(req *Request) error {
+	if len(src.Devices) == 0 && src.Inventory == "" {
+		return MissingConfigFieldError("snmp.devices")
+	}
+
+	for _, device := range src.Devices {
+		if device.Address == "" {
+			return MissingConfigFieldError("snmp.devices.address")
+		}
+	}
+
+	if len(src.OIDs) == 0 && len(src.Columns) == 0 {
+		return MissingConfigFieldError("snmp.oids")
+	}
+
+	if req.Table == "" {
+		return MissingConfigFieldError("table")
+	}
+
+	if _, ok := snmpVersions[src.Version]; src.Version != "" && !ok {
+		return InvalidSNMPError(fmt.Sprintf("snmp.version %q must be 1 or 2c", src.Version))
+	}
+
+	for _, oids := range []map[string]string{src.OIDs, src.Columns} {
+		for field, oid := range oids {
+			if field == snmpDeviceField || field == snmpPolledAtField || field == snmpIndexField {
+				return InvalidSNMPError(fmt.Sprintf("field %q is written by gidari", field))
+			}
+
+			if _, err := web.ParseSNMPOID(oid); err != nil {
+				return InvalidSNMPError(err.Error())
+			}
+		}
+	}
+
+	for field := range src.OIDs {
+		if _, ok := src.Columns[field]; ok {
+			return InvalidSNMPError(fmt.Sprintf("field %q is both an OID and a column", field))
+		}
+	}
+
+	if src.Timeout < 0 || src.MaxRepetitions < 0 || src.Concurrency < 0 || (src.Retries != nil && *src.Retries < 0) {
+		return InvalidSNMPError("snmp.timeout, snmp.retries, snmp.maxRepetitions, and snmp.concurrency can not be " +
+			"negative")
+	}
+
+	if req.Timeseries != nil || req.Paginate != nil || req.Prometheus != nil || req.OrderBook != nil ||
+		req.FIX != nil || req.SQL != nil || req.LDAP != nil {
+		return InvalidSNMPError("snmp can not be combined with timeseries, paginate, prometheus, orderBook, fix, " +
+			"sql, or ldap")
+	}
+
+	return nil
+}
+
+func (src *SNMP) setDefaults() {
+	if src.Version == "" {
+		src.Version = "2c"
+	}
+
+	if src.Community == "" {
+		src.Community = snmpDefaultCommunity
+	}
+
+	if src.Timeout == 0 {
+		src.Timeout = snmpDefaultTimeout
+	}
+
+	if src.Retries == nil {
+		retries := snmpDefaultRetries
+		src.Retries = &retries
+	}
+
+	if src.MaxRepetitions == 0 {
+		src.MaxRepetitions = snmpDefaultMaxRepetitions
+	}
+
+	if src.Concurrency == 0 {
+		src.Concurrency = snmpDefaultConcurrency
+	}
+}
+
+// url will return the URL that stands for the poll, e.g. "snmp:?inventory=devices.csv&version=2c", without the
+// community strings.
+func (src *SNMP) url() string {
+	query := url.Values{"version": {src.Version}}
+
+	if src.Inventory != "" {
+		query.Set("inventory", src.Inventory)
+	}
+
+	for _, device := range src.Devices {
+		query.Add("device", device.Address)
+	}
+
+	return (&url.URL{Scheme: "snmp", RawQuery: query.Encode()}).String()
+}
+
+// devices will return the devices of the source, followed by the devices of its inventory.
+func (src *SNMP) devices() ([]SNMPDevice, error) {
+	devices := append([]SNMPDevice{}, src.Devices...)
+
+	if src.Inventory == "" {
+		return devices, nil
+	}
+
+	file, err := os.Open(src.Inventory)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open inventory: %w", err)
+	}
+
+	defer file.Close()
+
+	rd := csv.NewReader(file)
+	rd.TrimLeadingSpace = true
+
+	header, err := rd.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the header of the inventory: %w", err)
+	}
+
+	address := -1
+
+	for idx, column := range header {
+		header[idx] = strings.TrimSpace(column)
+		if header[idx] == snmpAddressColumn {
+			address = idx
+		}
+	}
+
+	if address < 0 {
+		return nil, fmt.Errorf("inventory %s has no %q column", src.Inventory, snmpAddressColumn)
+	}
+
+	for {
+		row, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to read inventory: %w", err)
+		}
+
+		device := SNMPDevice{Labels: make(map[string]string)}
+
+		for idx, value := range row {
+			switch header[idx] {
+			case snmpAddressColumn:
+				device.Address = value
+			case snmpCommunityColumn:
+				device.Community = value
+			default:
+				device.Labels[header[idx]] = value
+			}
+		}
+
+		if device.Address == "" {
+			continue
+		}
+
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
+// poll will poll every device and return the records of the devices as a JSON array. A device that can not be polled
+// is logged and skipped, unless no device can be polled. The request returned stands for the poll, with the "SNMP"
+// method. The size of the records is counted as downloaded by the usage tracker.
+func (src *SNMP) poll(ctx context.Context, usage *usageTracker, logger *logrus.Logger) (*http.Request, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, snmpRequestMethod, src.url(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create request: %w", err)
+	}
+
+	devices, err := src.devices()
+	if err != nil {
+		return nil, nil, SNMPPollError(err)
+	}
+
+	if len(devices) == 0 {
+		return nil, nil, SNMPPollError(fmt.Errorf("no devices"))
+	}
+
+	if src.firstOnly {
+		devices = devices[:1]
+	}
+
+	records := make([][]map[string]interface{}, len(devices))
+	errs := make([]error, len(devices))
+
+	var wg sync.WaitGroup
+
+	sem := make(chan struct{}, src.Concurrency)
+
+	for idx, device := range devices {
+		idx, device := idx, device
+
+		wg.Add(1)
+
+		sem <- struct{}{}
+
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+
+			records[idx], errs[idx] = src.pollDevice(ctx, device)
+		}()
+	}
+
+	wg.Wait()
+
+	var (
+		buf    bytes.Buffer
+		count  int
+		failed int
+		last   error
+	)
+
+	buf.WriteByte('[')
+
+	for idx, device := range devices {
+		if err := errs[idx]; err != nil {
+			failed++
+			last = fmt.Errorf("%s: %w", device.Address, err)
+
+			if logger != nil {
+				logger.Warn(tools.LogFormatter{Msg: fmt.Sprintf("skipping snmp device %v", last)}.String())
+			}
+
+			continue
+		}
+
+		for _, record := range records[idx] {
+			if src.firstOnly && count > 0 {
+				break
+			}
+
+			data, err := json.Marshal(record)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to encode record of %s: %w", device.Address, err)
+			}
+
+			if count > 0 {
+				buf.WriteByte(',')
+			}
+
+			buf.Write(data)
+			count++
+		}
+	}
+
+	if failed == len(devices) {
+		return nil, nil, SNMPPollError(last)
+	}
+
+	buf.WriteByte(']')
+
+	usage.download(buf.Len())
+
+	return req, buf.Bytes(), nil
+}
+
+// pollDevice will return the records of the device: a record of its scalar OIDs, or a record of each row of its
+// table with the scalar OIDs on every row.
+func (src *SNMP) pollDevice(ctx context.Context, device SNMPDevice) ([]map[string]interface{}, error) {
+	addr := device.Address
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, snmpDefaultPort)
+	}
+
+	community := device.Community
+	if community == "" {
+		community = src.Community
+	}
+
+	dial := src.dial
+	if dial == nil {
+		dial = dialSNMPPoller
+	}
+
+	conn, err := dial(ctx, addr, web.SNMPConfig{
+		Version:        snmpVersions[src.Version],
+		Community:      community,
+		Timeout:        src.Timeout,
+		Retries:        *src.Retries,
+		MaxRepetitions: src.MaxRepetitions,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	base := make(map[string]interface{}, len(device.Labels)+len(src.OIDs)+2)
+	for label, value := range device.Labels {
+		base[label] = value
+	}
+
+	base[snmpDeviceField] = device.Address
+	base[snmpPolledAtField] = time.Now().UTC().Format(time.RFC3339)
+
+	if err := src.getScalars(ctx, conn, base); err != nil {
+		return nil, err
+	}
+
+	if len(src.Columns) == 0 {
+		return []map[string]interface{}{base}, nil
+	}
+
+	return src.walkColumns(ctx, conn, base)
+}
+
+// getScalars will set the fields of the scalar OIDs on the record.
+func (src *SNMP) getScalars(ctx context.Context, conn snmpPoller, record map[string]interface{}) error {
+	if len(src.OIDs) == 0 {
+		return nil
+	}
+
+	fields := snmpFields(src.OIDs)
+
+	oids := make([]string, len(fields))
+	for idx, field := range fields {
+		oids[idx] = src.OIDs[field]
+	}
+
+	varbinds, err := conn.Get(ctx, oids)
+	if err != nil {
+		return err
+	}
+
+	for idx, vb := range varbinds {
+		record[fields[idx]] = vb.Value
+	}
+
+	return nil
+}
+
+// walkColumns will walk the columns of the table, and return a record of each row with the fields of the base
+// record. The rows are in the order that they are walked.
+func (src *SNMP) walkColumns(ctx context.Context, conn snmpPoller,
+	base map[string]interface{},
+) ([]map[string]interface{}, error) {
+	var (
+		rows  []map[string]interface{}
+		index = make(map[string]map[string]interface{})
+	)
+
+	for _, field := range snmpFields(src.Columns) {
+		column := strings.TrimPrefix(src.Columns[field], ".")
+
+		err := conn.Walk(ctx, column, func(vb web.SNMPVarbind) error {
+			suffix := strings.TrimPrefix(vb.OID, column+".")
+
+			row, ok := index[suffix]
+			if !ok {
+				row = make(map[string]interface{}, len(base)+len(src.Columns)+1)
+				for key, value := range base {
+					row[key] = value
+				}
+
+				row[snmpIndexField] = suffix
+				index[suffix] = row
+				rows = append(rows, row)
+			}
+
+			row[field] = vb.Value
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rows, nil
+}
+
+// snmpFields will return the fields of the OIDs in order.
+func snmpFields(oids map[string]string) []string {
+	fields := make([]string, 0, len(oids))
+	for field := range oids {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+
+	return fields
+}
@@ -0,0 +1,205 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/internal/web"
+)
+
+// snmpTestPoller answers every get and walk from its MIB, by OID.
+type snmpTestPoller struct {
+	mib []web.SNMPVarbind
+}
+
+func (conn *snmpTestPoller) Get(_ context.Context, oids []string) ([]web.SNMPVarbind, error) {
+	varbinds := make([]web.SNMPVarbind, len(oids))
+
+	for idx, oid := range oids {
+		varbinds[idx].OID = oid
+
+		for _, vb := range conn.mib {
+			if vb.OID == oid {
+				varbinds[idx].Value = vb.Value
+			}
+		}
+	}
+
+	return varbinds, nil
+}
+
+func (conn *snmpTestPoller) Walk(_ context.Context, root string, varbindFn func(web.SNMPVarbind) error) error {
+	for _, vb := range conn.mib {
+		if strings.HasPrefix(vb.OID, root+".") {
+			if err := varbindFn(vb); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (conn *snmpTestPoller) Close() error {
+	return nil
+}
+
+func TestSNMP(t *testing.T) {
+	t.Parallel()
+
+	mib := []web.SNMPVarbind{
+		{OID: "1.3.6.1.2.1.1.5.0", Value: "sw1"},
+		{OID: "1.3.6.1.2.1.2.2.1.2.1", Value: "eth0"},
+		{OID: "1.3.6.1.2.1.2.2.1.2.2", Value: "eth1"},
+		{OID: "1.3.6.1.2.1.2.2.1.10.1", Value: uint64(100)},
+		{OID: "1.3.6.1.2.1.2.2.1.10.2", Value: uint64(200)},
+	}
+
+	t.Run("poll", func(t *testing.T) {
+		t.Parallel()
+
+		inventory := filepath.Join(t.TempDir(), "devices.csv")
+		if err := os.WriteFile(inventory, []byte("address,community,site\n10.0.0.2,secret,ams1\n10.0.0.3,,fra1\n"),
+			0o600); err != nil {
+			t.Fatalf("failed to write inventory: %v", err)
+		}
+
+		var (
+			mtx   sync.Mutex
+			dials = make(map[string]web.SNMPConfig)
+		)
+
+		src := &SNMP{
+			Devices:   []SNMPDevice{{Address: "10.0.0.1:1161", Labels: map[string]string{"site": "fra1"}}},
+			Inventory: inventory,
+			OIDs:      map[string]string{"sysName": "1.3.6.1.2.1.1.5.0"},
+			Columns:   map[string]string{"ifDescr": "1.3.6.1.2.1.2.2.1.2", "ifInOctets": ".1.3.6.1.2.1.2.2.1.10"},
+			dial: func(_ context.Context, addr string, cfg web.SNMPConfig) (snmpPoller, error) {
+				mtx.Lock()
+				defer mtx.Unlock()
+
+				dials[addr] = cfg
+
+				if addr == "10.0.0.3:161" {
+					return nil, web.SNMPError("no response after 2 attempts of 5s")
+				}
+
+				return &snmpTestPoller{mib: mib}, nil
+			},
+		}
+		src.setDefaults()
+
+		req, body, err := src.poll(context.Background(), nil, nil)
+		if err != nil {
+			t.Fatalf("failed to poll: %v", err)
+		}
+
+		if req.Method != snmpRequestMethod || req.URL.String() != "snmp:?device=10.0.0.1%3A1161&inventory="+
+			strings.ReplaceAll(inventory, "/", "%2F")+"&version=2c" {
+			t.Fatalf("expected the request to stand for the poll, got %s %s", req.Method, req.URL)
+		}
+
+		if len(dials) != 3 || dials["10.0.0.2:161"].Community != "secret" ||
+			dials["10.0.0.1:1161"].Community != "public" || dials["10.0.0.1:1161"].Version != web.SNMPVersion2c {
+			t.Fatalf("expected every device to be dialed with its community, got %v", dials)
+		}
+
+		var records []map[string]interface{}
+		if err := json.Unmarshal(body, &records); err != nil {
+			t.Fatalf("failed to decode records: %v", err)
+		}
+
+		for _, record := range records {
+			if _, ok := record[snmpPolledAtField]; !ok {
+				t.Fatalf("expected the poll time on %v", record)
+			}
+
+			delete(record, snmpPolledAtField)
+		}
+
+		exp := []map[string]interface{}{
+			{"device": "10.0.0.1:1161", "site": "fra1", "sysName": "sw1", "index": "1", "ifDescr": "eth0",
+				"ifInOctets": float64(100)},
+			{"device": "10.0.0.1:1161", "site": "fra1", "sysName": "sw1", "index": "2", "ifDescr": "eth1",
+				"ifInOctets": float64(200)},
+			{"device": "10.0.0.2", "site": "ams1", "sysName": "sw1", "index": "1", "ifDescr": "eth0",
+				"ifInOctets": float64(100)},
+			{"device": "10.0.0.2", "site": "ams1", "sysName": "sw1", "index": "2", "ifDescr": "eth1",
+				"ifInOctets": float64(200)},
+		}
+		if !reflect.DeepEqual(records, exp) {
+			t.Fatalf("expected records %v, got %v", exp, records)
+		}
+
+		src.firstOnly = true
+
+		if _, body, err = src.poll(context.Background(), nil, nil); err != nil {
+			t.Fatalf("failed to sample: %v", err)
+		}
+
+		if err := json.Unmarshal(body, &records); err != nil || len(records) != 1 {
+			t.Fatalf("expected the sample to be the first record, got %s: %v", body, err)
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		t.Parallel()
+
+		src := &SNMP{
+			Devices: []SNMPDevice{{Address: "10.0.0.1"}, {Address: "10.0.0.2"}},
+			OIDs:    map[string]string{"sysName": "1.3.6.1.2.1.1.5.0"},
+			dial: func(_ context.Context, addr string, _ web.SNMPConfig) (snmpPoller, error) {
+				return nil, web.SNMPError("no response")
+			},
+		}
+		src.setDefaults()
+
+		if _, _, err := src.poll(context.Background(), nil, nil); !errors.Is(err, ErrSNMPPoll) {
+			t.Fatalf("expected error %v, got %v", ErrSNMPPoll, err)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		devices := []SNMPDevice{{Address: "10.0.0.1"}}
+		oids := map[string]string{"uptime": "1.3.6.1.2.1.1.3.0"}
+
+		for _, tc := range []struct {
+			req *Request
+			err error
+		}{
+			{&Request{Table: "polls", SNMP: &SNMP{OIDs: oids}}, ErrMissingConfigField},
+			{&Request{Table: "polls", SNMP: &SNMP{Devices: devices}}, ErrMissingConfigField},
+			{&Request{SNMP: &SNMP{Devices: devices, OIDs: oids}}, ErrMissingConfigField},
+			{&Request{Table: "polls", SNMP: &SNMP{Devices: []SNMPDevice{{}}, OIDs: oids}}, ErrMissingConfigField},
+			{&Request{Table: "polls", SNMP: &SNMP{Devices: devices, OIDs: oids, Version: "3"}}, ErrInvalidSNMP},
+			{&Request{Table: "polls", SNMP: &SNMP{Devices: devices, OIDs: map[string]string{"a": "sysUpTime"}}},
+				ErrInvalidSNMP},
+			{&Request{Table: "polls", SNMP: &SNMP{Devices: devices, OIDs: map[string]string{"device": "1.3.6"}}},
+				ErrInvalidSNMP},
+			{&Request{Table: "polls", SNMP: &SNMP{Devices: devices, OIDs: oids, Columns: oids}}, ErrInvalidSNMP},
+			{&Request{Table: "polls", SNMP: &SNMP{Devices: devices, OIDs: oids, Concurrency: -1}}, ErrInvalidSNMP},
+			{&Request{Table: "polls", LDAP: &LDAP{}, SNMP: &SNMP{Devices: devices, OIDs: oids}}, ErrInvalidSNMP},
+			{&Request{Table: "polls", SNMP: &SNMP{Inventory: "devices.csv", Columns: oids, Version: "1"}}, nil},
+		} {
+			if err := tc.req.SNMP.validate(tc.req); !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v for %+v, got %v", tc.err, tc.req.SNMP, err)
+			}
+		}
+	})
+}
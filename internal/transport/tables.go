@@ -0,0 +1,87 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/repository"
+)
+
+// DestinationTables are the tables of a connection string of a configuration, see "ListTables".
+type DestinationTables struct {
+	// Destination is the index of the connection string in "Config.ConnectionStrings", and Backend its scheme, e.g.
+	// "postgresql".
+	Destination int    `json:"destination"`
+	Backend     string `json:"backend"`
+
+	// Tables are the names of the tables, sorted, and Sizes the size of each table in bytes as reported by the
+	// storage device, which is 0 for devices that do not report sizes.
+	Tables []string         `json:"tables"`
+	Sizes  map[string]int64 `json:"sizes"`
+}
+
+// ListTables will list the tables of every connection string of the configuration, e.g. with "SHOW TABLES" for
+// MySQL or "ListCollectionNames" for MongoDB, to discover what gidari has populated.
+func ListTables(ctx context.Context, cfg *Config) ([]*DestinationTables, error) {
+	if len(cfg.ConnectionStrings) == 0 {
+		return nil, MissingConfigFieldError("connectionStrings")
+	}
+
+	release, err := cfg.applyCompliance()
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	listings := make([]*DestinationTables, 0, len(cfg.ConnectionStrings))
+
+	for idx, dns := range cfg.ConnectionStrings {
+		listing, err := listTables(ctx, cfg, dns)
+		if err != nil {
+			return nil, err
+		}
+
+		listing.Destination = idx
+		listings = append(listings, listing)
+	}
+
+	return listings, nil
+}
+
+// listTables will list the tables of the connection string.
+func listTables(ctx context.Context, cfg *Config, dns string) (*DestinationTables, error) {
+	repo, err := repository.New(ctx, dns)
+	if err != nil {
+		return nil, WrapRepositoryError(repository.FailedToCreateRepositoryError(err))
+	}
+
+	defer repo.Close()
+
+	scheme := storage.Scheme(repo.Type())
+
+	rsp, err := cfg.Timeouts.wrap(repo).ListTables(ctx)
+	if err != nil {
+		return nil, WrapRepositoryError(fmt.Errorf("unable to list tables of %s: %w", scheme, err))
+	}
+
+	listing := &DestinationTables{Backend: scheme, Tables: []string{}, Sizes: make(map[string]int64)}
+
+	for table, info := range rsp.GetTableSet() {
+		listing.Tables = append(listing.Tables, table)
+		listing.Sizes[table] = info.GetSize()
+	}
+
+	sort.Strings(listing.Tables)
+
+	return listing, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestListTables(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("filesystem", func(t *testing.T) {
+		t.Parallel()
+
+		dirs := []string{t.TempDir(), t.TempDir()}
+
+		for name, data := range map[string]string{
+			"trades.jsonl":  `{"id":1}` + "\n",
+			"candles.jsonl": `{"id":1}` + "\n" + `{"id":2}` + "\n",
+		} {
+			if err := os.WriteFile(filepath.Join(dirs[0], name), []byte(data), 0o600); err != nil {
+				t.Fatalf("failed to write %s: %v", name, err)
+			}
+		}
+
+		cfg := &Config{ConnectionStrings: []string{
+			"file://" + filepath.ToSlash(dirs[0]) + "?format=jsonl",
+			"file://" + filepath.ToSlash(dirs[1]) + "?format=jsonl",
+		}}
+
+		listings, err := ListTables(ctx, cfg)
+		if err != nil {
+			t.Fatalf("failed to list tables: %v", err)
+		}
+
+		if len(listings) != 2 || listings[0].Backend != "file" || listings[1].Destination != 1 {
+			t.Fatalf("expected a listing for each connection string, got %+v", listings)
+		}
+
+		if exp := []string{"candles", "trades"}; !reflect.DeepEqual(listings[0].Tables, exp) ||
+			listings[0].Sizes["candles"] != 18 {
+			t.Fatalf("expected tables %q with their sizes, got %+v", exp, listings[0])
+		}
+
+		if len(listings[1].Tables) != 0 {
+			t.Fatalf("expected no tables for the empty directory, got %q", listings[1].Tables)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := ListTables(ctx, &Config{}); !errors.Is(err, ErrMissingConfigField) {
+			t.Fatalf("expected error %v, got %v", ErrMissingConfigField, err)
+		}
+	})
+}
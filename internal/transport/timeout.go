@@ -0,0 +1,220 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+)
+
+const (
+	opUpsert   = "upsert"
+	opRead     = "read"
+	opTruncate = "truncate"
+	opCommit   = "commit"
+)
+
+var (
+	ErrInvalidTimeout = fmt.Errorf("invalid timeout")
+	ErrStorageTimeout = fmt.Errorf("storage operation timed out")
+)
+
+// InvalidTimeoutError is returned when the timeout for a storage operation is not positive.
+func InvalidTimeoutError(op string) error {
+	return fmt.Errorf("%w: %s timeout must be positive", ErrInvalidTimeout, op)
+}
+
+// StorageTimeoutError is returned when a storage operation is canceled for exceeding its timeout.
+func StorageTimeoutError(op string, timeout time.Duration, err error) error {
+	return fmt.Errorf("%w: %s exceeded %v: %v", ErrStorageTimeout, op, timeout, err)
+}
+
+// Timeouts are the maximum durations of storage operations. Operations that exceed their timeout are canceled and
+// fail the run, rather than hanging on a failing cluster. Operations without a timeout are not bounded.
+type Timeouts struct {
+	// Upsert is the timeout for writing a single upsert batch.
+	Upsert *time.Duration `yaml:"upsert"`
+
+	// Read is the timeout for a single read request, e.g. an enrichment lookup or loading watermarks.
+	Read *time.Duration `yaml:"read"`
+
+	// Truncate is the timeout for truncating the tables on a connection string.
+	Truncate *time.Duration `yaml:"truncate"`
+
+	// Commit is the timeout for committing the transaction on a connection string. A commit that exceeds the
+	// timeout is canceled, which rolls back the transaction.
+	Commit *time.Duration `yaml:"commit"`
+}
+
+func (to *Timeouts) validate() error {
+	for op, timeout := range map[string]*time.Duration{
+		opUpsert:   to.Upsert,
+		opRead:     to.Read,
+		opTruncate: to.Truncate,
+		opCommit:   to.Commit,
+	} {
+		if timeout != nil && *timeout <= 0 {
+			return InvalidTimeoutError(op)
+		}
+	}
+
+	return nil
+}
+
+// timeout will return the timeout for the operation, or zero if the operation is not bounded.
+func (to *Timeouts) timeout(op string) time.Duration {
+	if to == nil {
+		return 0
+	}
+
+	var timeout *time.Duration
+
+	switch op {
+	case opUpsert:
+		timeout = to.Upsert
+	case opRead:
+		timeout = to.Read
+	case opTruncate:
+		timeout = to.Truncate
+	case opCommit:
+		timeout = to.Commit
+	}
+
+	if timeout == nil {
+		return 0
+	}
+
+	return *timeout
+}
+
+// run will run the operation with a context that is canceled after the operation timeout. If the operation fails
+// because the timeout was exceeded, it is counted in the usage of the run that the context carries.
+func (to *Timeouts) run(ctx context.Context, op string, fn func(context.Context) error) error {
+	timeout := to.timeout(op)
+	if timeout == 0 {
+		return fn(ctx)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := fn(tctx)
+	if err != nil && errors.Is(tctx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		usageFromContext(ctx).timeout(op)
+
+		return StorageTimeoutError(op, timeout, err)
+	}
+
+	return err
+}
+
+// commit will commit the transaction. If the commit exceeds the timeout, "cancelTx" is called to cancel the context
+// the transaction was started with, rolling it back, and the timeout is counted in the usage of the run that the
+// context carries.
+func (to *Timeouts) commit(ctx context.Context, txn storage.Transactor, cancelTx context.CancelFunc) error {
+	timeout := to.timeout(opCommit)
+	if timeout == 0 {
+		return txn.Commit()
+	}
+
+	done := make(chan error, 1)
+
+	go func() { done <- txn.Commit() }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		cancelTx()
+		usageFromContext(ctx).timeout(opCommit)
+
+		return StorageTimeoutError(opCommit, timeout, context.DeadlineExceeded)
+	}
+}
+
+// timeoutStorage is a storage whose operations are bounded by the timeouts.
+type timeoutStorage struct {
+	storage.Storage
+	timeouts *Timeouts
+}
+
+// wrap will return the storage with its operations bounded by the timeouts. If there are no timeouts, the storage is
+// returned as is.
+func (to *Timeouts) wrap(stg storage.Storage) storage.Storage {
+	if to == nil || stg == nil {
+		return stg
+	}
+
+	return &timeoutStorage{Storage: stg, timeouts: to}
+}
+
+// Read will read from storage, bounded by the read timeout.
+func (stg *timeoutStorage) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	var rsp *proto.ReadResponse
+
+	err := stg.timeouts.run(ctx, opRead, func(ctx context.Context) error {
+		var err error
+		rsp, err = stg.Storage.Read(ctx, req)
+
+		return err
+	})
+
+	return rsp, err
+}
+
+// Count will count the records of the table, bounded by the read timeout.
+func (stg *timeoutStorage) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	var rsp *proto.CountResponse
+
+	err := stg.timeouts.run(ctx, opRead, func(ctx context.Context) error {
+		var err error
+		rsp, err = stg.Storage.Count(ctx, req)
+
+		return err
+	})
+
+	return rsp, err
+}
+
+// Truncate will truncate the tables, bounded by the truncate timeout.
+func (stg *timeoutStorage) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse,
+	error,
+) {
+	var rsp *proto.TruncateResponse
+
+	err := stg.timeouts.run(ctx, opTruncate, func(ctx context.Context) error {
+		var err error
+		rsp, err = stg.Storage.Truncate(ctx, req)
+
+		return err
+	})
+
+	return rsp, err
+}
+
+// Upsert will write the batch to storage, bounded by the upsert timeout.
+func (stg *timeoutStorage) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	var rsp *proto.UpsertResponse
+
+	err := stg.timeouts.run(ctx, opUpsert, func(ctx context.Context) error {
+		var err error
+		rsp, err = stg.Storage.Upsert(ctx, req)
+
+		return err
+	})
+
+	return rsp, err
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+)
+
+// hangingStorage is a storage device whose operations block until the context is done, like a failing cluster.
+type hangingStorage struct {
+	storage.Storage
+}
+
+func (stg *hangingStorage) Read(ctx context.Context, _ *proto.ReadRequest) (*proto.ReadResponse, error) {
+	<-ctx.Done()
+
+	return nil, ctx.Err()
+}
+
+func (stg *hangingStorage) Upsert(ctx context.Context, _ *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	<-ctx.Done()
+
+	return nil, ctx.Err()
+}
+
+// hangingTxn is a transaction whose commit blocks until its context is canceled.
+type hangingTxn struct {
+	storage.Transactor
+
+	ctx context.Context
+}
+
+func (txn *hangingTxn) Commit() error {
+	<-txn.ctx.Done()
+
+	return txn.ctx.Err()
+}
+
+func TestTimeouts(t *testing.T) {
+	t.Parallel()
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		zero := time.Duration(0)
+		if err := (&Timeouts{Read: &zero}).validate(); !errors.Is(err, ErrInvalidTimeout) {
+			t.Fatalf("expected invalid timeout error, got %v", err)
+		}
+	})
+
+	t.Run("operations are canceled", func(t *testing.T) {
+		t.Parallel()
+
+		timeout := 10 * time.Millisecond
+		timeouts := &Timeouts{Read: &timeout, Upsert: &timeout}
+		stg := timeouts.wrap(&hangingStorage{})
+
+		usage := newUsageTracker()
+		ctx := contextWithUsage(context.Background(), usage)
+
+		if _, err := stg.Read(ctx, &proto.ReadRequest{}); !errors.Is(err, ErrStorageTimeout) {
+			t.Fatalf("expected storage timeout error, got %v", err)
+		}
+
+		if _, err := stg.Upsert(ctx, &proto.UpsertRequest{}); !errors.Is(err, ErrStorageTimeout) {
+			t.Fatalf("expected storage timeout error, got %v", err)
+		}
+
+		exp := map[string]int64{opRead: 1, opUpsert: 1}
+		if got := usage.report().StorageTimeouts; !reflect.DeepEqual(got, exp) {
+			t.Fatalf("expected the timeouts of the run to be %v, got %v", exp, got)
+		}
+	})
+
+	t.Run("canceled parent is not a timeout", func(t *testing.T) {
+		t.Parallel()
+
+		timeout := time.Hour
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := (&Timeouts{Read: &timeout}).wrap(&hangingStorage{}).Read(ctx, &proto.ReadRequest{})
+		if err == nil || errors.Is(err, ErrStorageTimeout) {
+			t.Fatalf("expected context error, got %v", err)
+		}
+	})
+
+	t.Run("commit is rolled back", func(t *testing.T) {
+		t.Parallel()
+
+		timeout := 10 * time.Millisecond
+		ctx, cancel := context.WithCancel(context.Background())
+
+		err := (&Timeouts{Commit: &timeout}).commit(context.Background(), &hangingTxn{ctx: ctx}, cancel)
+		if !errors.Is(err, ErrStorageTimeout) {
+			t.Fatalf("expected storage timeout error, got %v", err)
+		}
+
+		if ctx.Err() == nil {
+			t.Fatal("expected the transaction context to be canceled")
+		}
+	})
+
+	t.Run("no timeouts", func(t *testing.T) {
+		t.Parallel()
+
+		stg := &lookupStorage{}
+
+		var timeouts *Timeouts
+		if timeouts.wrap(stg) != storage.Storage(stg) {
+			t.Fatal("expected the storage to be returned as is")
+		}
+	})
+}
@@ -0,0 +1,179 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+// transforms are the record transformations applied to the response data of a request before it is written to
+// storage.
+type transforms struct {
+	explode     []*Explode
+	routes      []*Route
+	enrich      []*Enrich
+	downsample  []*Downsample
+	passthrough *Passthrough
+	prometheus  *Prometheus
+	reconcile   *Reconcile
+
+	// timeseries is set for incremental timeseries requests that report late records.
+	timeseries *timeseries
+}
+
+// transforms will return the record transformations configured on the request.
+func (req *Request) transforms() *transforms {
+	tfs := &transforms{
+		explode:     req.Explode,
+		routes:      req.Routes,
+		enrich:      req.Enrich,
+		downsample:  req.Downsample,
+		passthrough: req.Passthrough,
+		prometheus:  req.Prometheus,
+		reconcile:   req.Reconcile,
+	}
+
+	if req.incremental() && req.Timeseries.TimeField != "" {
+		tfs.timeseries = req.Timeseries
+	}
+
+	return tfs
+}
+
+// empty will return true if there are no transformations to apply.
+func (tfs *transforms) empty() bool {
+	return tfs == nil || (len(tfs.explode) == 0 && len(tfs.routes) == 0 && len(tfs.enrich) == 0 &&
+		len(tfs.downsample) == 0 && tfs.timeseries == nil && tfs.passthrough == nil && tfs.prometheus == nil &&
+		tfs.reconcile == nil)
+}
+
+// decode will decode the response body into records, as samples if the request queries Prometheus.
+func (tfs *transforms) decode(data []byte) ([]map[string]interface{}, error) {
+	if tfs != nil && tfs.prometheus != nil {
+		return tfs.prometheus.decode(data)
+	}
+
+	return decodeJSONRecords(data)
+}
+
+// tableRecords are decoded records grouped by the table they will be written to. The order in which tables are first
+// added is preserved, so that parent records are written before the records that reference them.
+type tableRecords struct {
+	tables  []string
+	records map[string][]map[string]interface{}
+}
+
+func newTableRecords() *tableRecords {
+	return &tableRecords{records: make(map[string][]map[string]interface{})}
+}
+
+// add will append records to the table.
+func (tr *tableRecords) add(table string, records ...map[string]interface{}) {
+	if _, ok := tr.records[table]; !ok {
+		tr.tables = append(tr.tables, table)
+	}
+
+	tr.records[table] = append(tr.records[table], records...)
+}
+
+// upsertRequests will encode the records for each table into JSON upsert requests. Tables without any records are
+// skipped.
+func (tr *tableRecords) upsertRequests() ([]*proto.UpsertRequest, error) {
+	reqs := make([]*proto.UpsertRequest, 0, len(tr.tables))
+
+	for _, table := range tr.tables {
+		if len(tr.records[table]) == 0 {
+			continue
+		}
+
+		req, err := newJSONUpsertRequest(table, tr.records[table])
+		if err != nil {
+			return nil, err
+		}
+
+		reqs = append(reqs, req)
+	}
+
+	return reqs, nil
+}
+
+// decodeJSONRecords will decode a JSON response body into a slice of records. The body can either be a JSON object or
+// a JSON array of objects.
+func decodeJSONRecords(data []byte) ([]map[string]interface{}, error) {
+	var body interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("%w: %v", tools.ErrFailedToUnmarshalJSON, err)
+	}
+
+	switch body := body.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{body}, nil
+	case []interface{}:
+		records := make([]map[string]interface{}, 0, len(body))
+
+		for idx, elem := range body {
+			record, ok := elem.(map[string]interface{})
+			if !ok {
+				return nil, &recordError{index: idx, err: fmt.Errorf("%w: %T", tools.ErrUnsupportedDataType, elem)}
+			}
+
+			records = append(records, record)
+		}
+
+		return records, nil
+	default:
+		return nil, fmt.Errorf("%w: %T", tools.ErrUnsupportedDataType, body)
+	}
+}
+
+// newJSONUpsertRequest will encode the records into a JSON upsert request for the table.
+func newJSONUpsertRequest(table string, records []map[string]interface{}) (*proto.UpsertRequest, error) {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", tools.ErrFailedToMarshalJSON, err)
+	}
+
+	return &proto.UpsertRequest{
+		Table:    table,
+		Data:     data,
+		DataType: int32(tools.UpsertDataJSON),
+	}, nil
+}
+
+// apply will route each record to its destination table and explode the configured array fields into child tables.
+func (tfs *transforms) apply(table string, records []map[string]interface{}) (*tableRecords, error) {
+	out := newTableRecords()
+
+	// Make sure the default table is written first.
+	out.add(table)
+
+	for idx, record := range records {
+		recordTable, recordExplode := table, tfs.explode
+
+		if route := matchRoute(tfs.routes, record); route != nil {
+			recordTable, recordExplode = route.Table, route.Explode
+		}
+
+		out.add(recordTable, record)
+
+		for _, exp := range recordExplode {
+			children, err := exp.explodeRecord(record)
+			if err != nil {
+				return nil, &recordError{index: idx, err: err}
+			}
+
+			out.add(exp.Table, children...)
+		}
+	}
+
+	return out, nil
+}
@@ -14,7 +14,9 @@ import (
 	"net/http"
 	"net/url"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/alpine-hodler/gidari/internal/storage"
@@ -23,7 +25,9 @@ import (
 	"github.com/alpine-hodler/gidari/proto"
 	"github.com/alpine-hodler/gidari/repository"
 	"github.com/alpine-hodler/gidari/tools"
+	"github.com/alpine-hodler/gidari/version"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v2"
 )
 
@@ -48,6 +52,26 @@ func MissingRateLimitFieldError(field string) error {
 	return fmt.Errorf("%w: %s", ErrMissingRateLimitField, field)
 }
 
+const (
+	userAgentHeader = "User-Agent"
+	requestIDHeader = "X-Request-ID"
+)
+
+const (
+	// ScheduleBurst is the rate limit schedule that allows a burst of requests, refilled at one request every period.
+	ScheduleBurst = "burst"
+
+	// ScheduleWindow is the rate limit schedule that spreads the burst of requests evenly across each period.
+	ScheduleWindow = "window"
+)
+
+var ErrInvalidRateLimitSchedule = fmt.Errorf("invalid rate limit schedule")
+
+// InvalidRateLimitScheduleError is returned when the schedule of a rate limit is not supported.
+func InvalidRateLimitScheduleError(schedule string) error {
+	return fmt.Errorf("%w: %q, expected %q or %q", ErrInvalidRateLimitSchedule, schedule, ScheduleBurst, ScheduleWindow)
+}
+
 // MissingTimeseriesFieldError is returned when the timeseries is missing from the configuration.
 func MissingTimeseriesFieldError(field string) error {
 	return fmt.Errorf("%w: %s", ErrMissingTimeseriesField, field)
@@ -58,6 +82,13 @@ func UnableToParseError(name string) error {
 	return fmt.Errorf("%s %w", name, ErrUnableToParse)
 }
 
+var ErrInvalidTruncateParallelism = fmt.Errorf("invalid truncate parallelism")
+
+// InvalidTruncateParallelismError is returned when the truncate parallelism is negative.
+func InvalidTruncateParallelismError(parallelism int) error {
+	return fmt.Errorf("%w: %d, expected a positive number of tables", ErrInvalidTruncateParallelism, parallelism)
+}
+
 // WrapRepositoryError will wrap an error from the repository with a message.
 func WrapRepositoryError(err error) error {
 	return fmt.Errorf("repository: %w", err)
@@ -80,16 +111,28 @@ type Auth2 struct {
 	Bearer string `yaml:"bearer"`
 }
 
+// Basic is a struct that contains the authentication data for a web API that uses HTTP basic authentication, e.g. an
+// email and an API token.
+type Basic struct {
+	Email    string `yaml:"email"`
+	Password string `yaml:"password"`
+}
+
 // Authentication is the credential information to be used to construct an HTTP(s) transport for accessing the API.
 type Authentication struct {
 	APIKey *APIKey `yaml:"apiKey"`
 	Auth2  *Auth2  `yaml:"auth2"`
+	Basic  *Basic  `yaml:"basic"`
 }
 
 // timeseries is a struct that contains the information needed to query a web API for timeseries data.
 type timeseries struct {
 	StartName string `yaml:"startName"`
-	EndName   string `yaml:"endName"`
+
+	// EndName is the name of the query parameter for the end of the range. If empty, the range is open-ended: it
+	// ends at the as-of time of the run, it is fetched in a single request, and only the start is sent, e.g. for web
+	// APIs with an "updated since" parameter.
+	EndName string `yaml:"endName"`
 
 	// Period is the size of each chunk in seconds for which we can query the API. Some API will not allow us to
 	// query all data within the start and end range.
@@ -99,9 +142,47 @@ type timeseries struct {
 	// to be RFC3339.
 	Layout *string `yaml:"layout"`
 
+	// Lookback is the number of seconds before the stored watermark to re-fetch on each run. Setting a lookback makes
+	// the timeseries incremental: the start of the range is moved up to the stored watermark minus the lookback, and
+	// the end of the range is stored as the new watermark once the run is committed. Re-fetching the lookback window
+	// ensures that late-arriving upstream corrections are upserted.
+	Lookback *int32 `yaml:"lookback"`
+
+	// TimeField is the name of the timestamp field on the records. If set on an incremental timeseries, records
+	// older than the stored watermark are reported at the end of the run.
+	TimeField string `yaml:"timeField"`
+
 	// chunks are the time ranges for which we can query the API. These are broken up into pieces for API requests
 	// that only return a limited number of results.
 	chunks [][2]time.Time
+
+	// end is the end of the queried time range.
+	end time.Time
+
+	// watermark is the stored watermark for incremental timeseries.
+	watermark *watermark
+
+	// backfill is set when the range is given by the window of the run, in which case the range is not moved up to
+	// the stored watermark.
+	backfill bool
+
+	// coverage is the existing time coverage of the table in storage. If set, only the chunks without any records
+	// in storage are fetched.
+	coverage *coverage
+
+	// runTime is the template data of the run, and templates are the query values that reference the range of a
+	// chunk, which are rendered for each chunk.
+	runTime   runTimeData
+	templates map[string]string
+}
+
+// openEnd will return the end of an open-ended range: the end of the window, or the as-of time of the run.
+func (ts *timeseries) openEnd() time.Time {
+	if ts.runTime.WindowEnd.IsZero() {
+		return time.Now().UTC()
+	}
+
+	return ts.runTime.WindowEnd
 }
 
 // chunk will attempt to use the query string of a URL to partition the timeseries into "chunks" of time for queying
@@ -125,17 +206,35 @@ func (ts *timeseries) chunk(rurl url.URL) error {
 		return UnableToParseError("startTime")
 	}
 
-	endSlice := query[ts.EndName]
-	if len(endSlice) != 1 {
-		return MissingTimeseriesFieldError("endName")
+	end := ts.openEnd()
+
+	if ts.EndName != "" {
+		endSlice := query[ts.EndName]
+		if len(endSlice) != 1 {
+			return MissingTimeseriesFieldError("endName")
+		}
+
+		if end, err = time.Parse(*ts.Layout, endSlice[0]); err != nil {
+			return UnableToParseError("endTime")
+		}
 	}
 
-	end, err := time.Parse(*ts.Layout, endSlice[0])
-	if err != nil {
-		return UnableToParseError("endTime")
+	ts.end = end
+	ts.chunks = nil
+
+	// Incremental timeseries only need to re-fetch the lookback window before the stored watermark.
+	if wm := ts.watermark; wm != nil && ts.Lookback != nil && !ts.backfill && !wm.time.IsZero() {
+		if from := wm.time.Add(-time.Second * time.Duration(*ts.Lookback)); from.After(start) {
+			start = from
+		}
 	}
 
-	for start.Before(end) {
+	// An open-ended range can not be split, since only its start is sent.
+	if ts.EndName == "" && start.Before(end) {
+		ts.chunks = append(ts.chunks, [2]time.Time{start, end})
+	}
+
+	for ts.EndName != "" && start.Before(end) {
 		next := start.Add(time.Second * time.Duration(ts.Period))
 		if next.Before(end) {
 			ts.chunks = append(ts.chunks, [2]time.Time{start, next})
@@ -146,9 +245,38 @@ func (ts *timeseries) chunk(rurl url.URL) error {
 		start = next
 	}
 
+	if ts.coverage != nil {
+		ts.chunks = ts.gaps()
+	}
+
 	return nil
 }
 
+// covers will return true if the time range from start to end is within the fetched chunks of the timeseries, or if
+// the timeseries is not set.
+func (ts *timeseries) covers(start, end time.Time) bool {
+	if ts == nil || len(ts.chunks) == 0 {
+		return true
+	}
+
+	chunks := make([][2]time.Time, len(ts.chunks))
+	copy(chunks, ts.chunks)
+
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i][0].Before(chunks[j][0]) })
+
+	for _, chunk := range chunks {
+		if chunk[0].After(start) {
+			break
+		}
+
+		if chunk[1].After(start) {
+			start = chunk[1]
+		}
+	}
+
+	return !start.Before(end)
+}
+
 // RateLimitConfig is the data needed for constructing a rate limit for the HTTP requests.
 type RateLimitConfig struct {
 	// Burst represents the number of requests that we limit over a period frequency.
@@ -156,6 +284,11 @@ type RateLimitConfig struct {
 
 	// Period is the number of times to allow a burst per second.
 	Period *time.Duration `yaml:"period"`
+
+	// Schedule is how the requests are scheduled within the rate limit: "burst" (the default) allows a burst of
+	// requests refilled at one request every period, and "window" spreads the burst of requests evenly across each
+	// period, for web APIs with fixed-window rate limits.
+	Schedule string `yaml:"schedule"`
 }
 
 func (rl RateLimitConfig) validate() error {
@@ -167,6 +300,10 @@ func (rl RateLimitConfig) validate() error {
 		return MissingRateLimitFieldError("period")
 	}
 
+	if rl.Schedule != "" && rl.Schedule != ScheduleBurst && rl.Schedule != ScheduleWindow {
+		return InvalidRateLimitScheduleError(rl.Schedule)
+	}
+
 	return nil
 }
 
@@ -181,6 +318,117 @@ type Config struct {
 	Logger            *logrus.Logger
 	Truncate          bool
 
+	// SharedRateLimit is a rate limit shared through Redis by every process that pulls from the web API with the same
+	// key, in addition to the rate limit of each request.
+	SharedRateLimit *SharedRateLimit `yaml:"sharedRateLimit"`
+
+	// HTTP is the tuning for the HTTP transport shared by every web worker.
+	HTTP *web.TransportConfig `yaml:"http"`
+
+	// UserAgent is the User-Agent header of every request to the web API. If empty, it is "gidari/<version>".
+	UserAgent string `yaml:"userAgent"`
+
+	// Headers are set on every request to the web API, e.g. a partner ID that the web API requires for allowlisting.
+	// Every request also has an "X-Request-ID" header with the ID of the run, unless it is set here.
+	Headers map[string]string `yaml:"headers"`
+
+	// Wire is the configuration for the network protocol of the storage connections, e.g. wire compression.
+	Wire *Wire `yaml:"wire"`
+
+	// ReadReplica is the connection string of a replica of the first connection string, e.g. a PostgreSQL hot
+	// standby or a MongoDB connection string with "readPreference=secondary". If set, every read (enrichment
+	// lookups, watermarks, and backfill coverage) is made against the replica, and writes still go to the primary.
+	ReadReplica string `yaml:"readReplica"`
+
+	// WriteLimits are the maximum write rates for tables in storage, keyed by table name. Tables without a write
+	// limit are written as fast as the repository workers allow.
+	WriteLimits map[string]*WriteLimit `yaml:"writeLimits"`
+
+	// BatchSize is the maximum size of the upsert batches written to storage, in records and serialized bytes. If
+	// nil, the records of each web response are written to a table in a single batch.
+	BatchSize *BatchSize `yaml:"batchSize"`
+
+	// TruncateParallelism is the maximum number of tables truncated concurrently on each connection string. A table
+	// and the explode tables that reference it are truncated together in one request. If zero or one, the tables are
+	// truncated in a single request.
+	TruncateParallelism int `yaml:"truncateParallelism"`
+
+	// MemoryBudget is the maximum size in bytes of the web API responses buffered between the fetch stage and the
+	// repository workers. When the budget is used up, the web workers wait before fetching the next response. If
+	// zero, the buffered responses are not bounded.
+	MemoryBudget int64 `yaml:"memoryBudget"`
+
+	// Timeouts are the maximum durations of the upsert, read, truncate, and commit storage operations.
+	Timeouts *Timeouts `yaml:"timeouts"`
+
+	// RetryBudget is the maximum number of retries, and time spent waiting to retry, shared by the web requests and
+	// the storage transactions of a run. Web requests are only retried with a retry budget.
+	RetryBudget *RetryBudget `yaml:"retryBudget"`
+
+	// Archive is the configuration for archiving the raw web API responses to object storage.
+	Archive *Archive `yaml:"archive"`
+
+	// Compliance is the compliance mode of the process, i.e. "fips" to restrict TLS and hash functions to algorithms
+	// approved by FIPS 140 and to attest to the restrictions in the summary of every run. The mode is turned on when a
+	// run starts, applies to the connections that gidari opens from then on, and requires a validated cryptographic
+	// module.
+	Compliance string `yaml:"compliance"`
+
+	// Encryption is the configuration for encrypting sensitive columns with a KMS-wrapped data key before they are
+	// written to storage.
+	Encryption *Encryption `yaml:"encryption"`
+
+	// DataTests are the assertions on the tables, keyed by table name, that are checked against every connection
+	// string once the run is committed.
+	DataTests map[string]*DataTest `yaml:"dataTests"`
+
+	// DBT runs the dbt models of the tables that were written, once the run is committed and its data tests pass.
+	DBT *DBT `yaml:"dbt"`
+
+	// Preset is a ready-made configuration for a well-known web API, e.g. the issues of GitHub repositories, which
+	// adds its requests to "Requests".
+	Preset *Preset `yaml:"preset"`
+
+	// Webhook is the configuration of the webhook receiver that writes the objects of the events of the web API to
+	// the tables that the requests backfill, see "NewWebhookHandler".
+	Webhook *Webhook `yaml:"webhook"`
+
+	// RunID is the ID of the run, included in the context of every error leaving the pipeline. If empty, a random ID
+	// is generated for each run, without changing the configuration.
+	RunID string `yaml:"-"`
+
+	// AsOf is the time the run is evaluated as of. The end of every timeseries range is capped at this time, and it
+	// is exposed to the endpoint and query templates as "{{ .AsOf }}".
+	AsOf *time.Time `yaml:"-"`
+
+	// Window is the historical range for a backfill run. It replaces the range of every timeseries request, and it is
+	// exposed to the endpoint and query templates as "{{ .WindowStart }}" and "{{ .WindowEnd }}".
+	Window *Window `yaml:"-"`
+
+	// ReprocessFrom is the archive location, see "Archive.Location", to read the raw payloads from when reprocessing
+	// a run. It is usually the location of a single run, e.g. "s3://bucket/archive/<run ID>".
+	ReprocessFrom string `yaml:"-"`
+
+	// MigrationsDir is a directory of golang-migrate migration files. If set, a run fails before writing anything
+	// unless every connection string has applied the latest migration in the directory.
+	MigrationsDir string `yaml:"-"`
+
+	// Summary is where the JSON summary of the run, including its resource usage, is written when the run
+	// completes. If nil, the resource usage is only logged.
+	Summary io.Writer `yaml:"-"`
+
+	// Concurrency is the maximum number of concurrent web API requests of the run, i.e. the number of web workers.
+	// If zero, it is the number of CPUs.
+	Concurrency int `yaml:"-"`
+
+	// Priority is the priority of the run in the scheduler that started it, and QueueWait is how long the run waited
+	// for the scheduler to start it. Both are only reported in the summary of the run.
+	Priority  string        `yaml:"-"`
+	QueueWait time.Duration `yaml:"-"`
+
+	// Pause is the gate that pauses the fetch stage of the run. If nil, the run is not paused.
+	Pause *PauseGate `yaml:"-"`
+
 	URL *url.URL `yaml:"-"`
 }
 
@@ -191,22 +439,133 @@ type Config struct {
 func NewConfig(yamlBytes []byte) (*Config, error) {
 	var cfg Config
 
+	yamlBytes, err := UnsealConfig(yamlBytes)
+	if err != nil {
+		return nil, err
+	}
+
 	if err := yaml.Unmarshal(yamlBytes, &cfg); err != nil {
 		return nil, fmt.Errorf("unable to unmarshal YAML: %w", err)
 	}
 
+	if cfg.Preset != nil {
+		if err := cfg.Preset.apply(&cfg); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := cfg.validate(); err != nil {
 		return nil, err
 	}
 
 	// Parse the raw URL
-	var err error
-
 	cfg.URL, err = url.Parse(cfg.RawURL)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse URL: %w", err)
 	}
 
+	if cfg.Wire != nil {
+		if err := cfg.Wire.validate(); err != nil {
+			return nil, err
+		}
+
+		for idx, dns := range cfg.ConnectionStrings {
+			if cfg.ConnectionStrings[idx], err = cfg.Wire.apply(dns); err != nil {
+				return nil, err
+			}
+		}
+
+		if cfg.ReadReplica != "" {
+			if cfg.ReadReplica, err = cfg.Wire.apply(cfg.ReadReplica); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if cfg.Timeouts != nil {
+		if err := cfg.Timeouts.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Webhook != nil {
+		if err := cfg.Webhook.validate(&cfg); err != nil {
+			return nil, err
+		}
+
+		cfg.Webhook.setDefaults()
+	}
+
+	for name, value := range cfg.Headers {
+		if err := web.ValidateHeader(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := web.ValidateHeader(userAgentHeader, cfg.UserAgent); err != nil {
+		return nil, err
+	}
+
+	if cfg.SharedRateLimit != nil {
+		if err := cfg.SharedRateLimit.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.RetryBudget != nil {
+		if err := cfg.RetryBudget.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Archive != nil {
+		if err := cfg.Archive.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Encryption != nil {
+		if err := cfg.Encryption.validate(cfg.Requests); err != nil {
+			return nil, err
+		}
+	}
+
+	for table, wl := range cfg.WriteLimits {
+		if err := wl.validate(table); err != nil {
+			return nil, err
+		}
+	}
+
+	for table, dt := range cfg.DataTests {
+		if err := dt.validate(table); err != nil {
+			return nil, err
+		}
+
+		dt.setDefaults()
+	}
+
+	if cfg.DBT != nil {
+		if err := cfg.DBT.validate(); err != nil {
+			return nil, err
+		}
+
+		cfg.DBT.setDefaults()
+	}
+
+	if cfg.TruncateParallelism < 0 {
+		return nil, InvalidTruncateParallelismError(cfg.TruncateParallelism)
+	}
+
+	if cfg.MemoryBudget < 0 {
+		return nil, InvalidMemoryBudgetError(cfg.MemoryBudget)
+	}
+
+	if cfg.BatchSize != nil {
+		if err := cfg.BatchSize.validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	// Update default request data.
 	for _, req := range cfg.Requests {
 		if req.Method == "" {
@@ -221,6 +580,108 @@ func NewConfig(yamlBytes []byte) (*Config, error) {
 			endpointParts := strings.Split(req.Endpoint, "/")
 			req.Table = endpointParts[len(endpointParts)-1]
 		}
+
+		for _, exp := range req.Explode {
+			if err := exp.validate(); err != nil {
+				return nil, err
+			}
+
+			exp.setDefaults(req.Table)
+		}
+
+		for _, route := range req.Routes {
+			if err := route.validate(); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, enr := range req.Enrich {
+			if err := enr.validate(); err != nil {
+				return nil, err
+			}
+
+			enr.setDefaults()
+		}
+
+		for _, ds := range req.Downsample {
+			if err := ds.validate(); err != nil {
+				return nil, err
+			}
+
+			ds.setDefaults()
+		}
+
+		if pt := req.Passthrough; pt != nil {
+			if err := pt.validate(req); err != nil {
+				return nil, err
+			}
+
+			pt.setDefaults()
+		}
+
+		if pg := req.Paginate; pg != nil {
+			if err := pg.validate(req); err != nil {
+				return nil, err
+			}
+		}
+
+		if rec := req.Reconcile; rec != nil {
+			rec.setDefaults()
+		}
+
+		if ob := req.OrderBook; ob != nil {
+			if err := ob.validate(req); err != nil {
+				return nil, err
+			}
+
+			ob.setDefaults()
+		}
+
+		if fx := req.FIX; fx != nil {
+			if err := fx.validate(req); err != nil {
+				return nil, err
+			}
+
+			fx.setDefaults()
+		}
+
+		if src := req.SQL; src != nil {
+			if err := src.validate(req); err != nil {
+				return nil, err
+			}
+		}
+
+		if src := req.LDAP; src != nil {
+			if err := src.validate(req); err != nil {
+				return nil, err
+			}
+
+			src.setDefaults()
+		}
+
+		if src := req.SNMP; src != nil {
+			if err := src.validate(req); err != nil {
+				return nil, err
+			}
+
+			src.setDefaults()
+		}
+
+		if src := req.IMAP; src != nil {
+			if err := src.validate(req); err != nil {
+				return nil, err
+			}
+
+			src.setDefaults()
+		}
+
+		if src := req.MQTT; src != nil {
+			if err := src.validate(req); err != nil {
+				return nil, err
+			}
+
+			src.setDefaults()
+		}
 	}
 
 	return &cfg, nil
@@ -228,13 +689,22 @@ func NewConfig(yamlBytes []byte) (*Config, error) {
 
 // connect will attempt to connect to the web API client. Since there are multiple ways to build a transport given the
 // authentication data, this method will exhaust every transport option in the "Authentication" struct.
-func (cfg *Config) connect(ctx context.Context) (*web.Client, error) {
+func (cfg *Config) connect(ctx context.Context, transports *web.Transports) (*web.Client, error) {
+	// Every web worker of the run shares the same transport, and so the same connection pool, for the host.
+	var host string
+	if cfg.URL != nil {
+		host = cfg.URL.Host
+	}
+
+	base := web.WithHeaders(transports.Transport(host, cfg.HTTP), cfg.requestHeader())
+
 	if apiKey := cfg.Authentication.APIKey; apiKey != nil {
 		client, err := web.NewClient(ctx, auth.NewAPIKey().
 			SetURL(cfg.RawURL).
 			SetKey(apiKey.Key).
 			SetPassphrase(apiKey.Passphrase).
-			SetSecret(apiKey.Secret))
+			SetSecret(apiKey.Secret).
+			SetTransport(base))
 		if err != nil {
 			return nil, WrapWebError(web.FailedToCreateClientError(err))
 		}
@@ -243,7 +713,20 @@ func (cfg *Config) connect(ctx context.Context) (*web.Client, error) {
 	}
 
 	if apiKey := cfg.Authentication.Auth2; apiKey != nil {
-		client, err := web.NewClient(ctx, auth.NewAuth2().SetBearer(apiKey.Bearer).SetURL(cfg.RawURL))
+		client, err := web.NewClient(ctx, auth.NewAuth2().SetBearer(apiKey.Bearer).SetURL(cfg.RawURL).SetTransport(base))
+		if err != nil {
+			return nil, WrapWebError(web.FailedToCreateClientError(err))
+		}
+
+		return client, nil
+	}
+
+	if basic := cfg.Authentication.Basic; basic != nil {
+		client, err := web.NewClient(ctx, auth.NewBasic().
+			SetEmail(basic.Email).
+			SetPassword(basic.Password).
+			SetURL(cfg.RawURL).
+			SetTransport(base))
 		if err != nil {
 			return nil, WrapWebError(web.FailedToCreateClientError(err))
 		}
@@ -252,7 +735,7 @@ func (cfg *Config) connect(ctx context.Context) (*web.Client, error) {
 	}
 
 	// In the case of no authentication, create a client without an auth transport.
-	client, err := web.NewClient(ctx, nil)
+	client, err := web.NewClient(ctx, base)
 	if err != nil {
 		return nil, WrapWebError(web.FailedToCreateClientError(err))
 	}
@@ -260,12 +743,52 @@ func (cfg *Config) connect(ctx context.Context) (*web.Client, error) {
 	return client, nil
 }
 
+// requestHeader will return the headers set on every request to the web API: the User-Agent, the ID of the run, and
+// the configured headers.
+func (cfg *Config) requestHeader() http.Header {
+	header := make(http.Header)
+
+	header.Set(userAgentHeader, "gidari/"+version.Gidari)
+	if cfg.UserAgent != "" {
+		header.Set(userAgentHeader, cfg.UserAgent)
+	}
+
+	if cfg.RunID != "" {
+		header.Set(requestIDHeader, cfg.RunID)
+	}
+
+	for name, value := range cfg.Headers {
+		header.Set(name, value)
+	}
+
+	return header
+}
+
 type repoCloser func()
 
+// readDNS will return the connection string used for reads, which is the read replica if one is configured and the
+// first connection string otherwise.
+func (cfg *Config) readDNS() string {
+	if cfg.ReadReplica != "" {
+		return cfg.ReadReplica
+	}
+
+	if len(cfg.ConnectionStrings) == 0 {
+		return ""
+	}
+
+	return cfg.ConnectionStrings[0]
+}
+
 // repos will return a slice of generic repositories along with associated transaction instances.
 func (cfg *Config) repos(ctx context.Context) ([]repository.Generic, repoCloser, error) {
 	repos := []repository.Generic{}
 
+	// Errors that do not fail a transaction, e.g. after it has committed, are logged with the run.
+	if cfg.Logger != nil {
+		ctx = storage.WithLogger(ctx, cfg.Logger)
+	}
+
 	for _, dns := range cfg.ConnectionStrings {
 		repo, err := repository.NewTx(ctx, dns)
 		if err != nil {
@@ -292,6 +815,61 @@ func (cfg *Config) repos(ctx context.Context) ([]repository.Generic, repoCloser,
 	}, nil
 }
 
+// redactor will return the redactor for the secrets in the configuration, i.e. the web API credentials and the
+// passwords on the connection strings.
+func (cfg *Config) redactor() *tools.Redactor {
+	var secrets []string
+
+	if apiKey := cfg.Authentication.APIKey; apiKey != nil {
+		secrets = append(secrets, apiKey.Key, apiKey.Secret, apiKey.Passphrase)
+	}
+
+	if auth2 := cfg.Authentication.Auth2; auth2 != nil {
+		secrets = append(secrets, auth2.Bearer)
+	}
+
+	if basic := cfg.Authentication.Basic; basic != nil {
+		secrets = append(secrets, basic.Password)
+	}
+
+	if cfg.DBT != nil && cfg.DBT.Cloud != nil {
+		secrets = append(secrets, cfg.DBT.Cloud.Token)
+	}
+
+	dnss := append([]string{cfg.ReadReplica}, cfg.ConnectionStrings...)
+	if cfg.SharedRateLimit != nil {
+		dnss = append(dnss, cfg.SharedRateLimit.Redis)
+	}
+
+	for _, dns := range dnss {
+		uri, err := url.Parse(dns)
+		if err != nil || uri.User == nil {
+			continue
+		}
+
+		if password, ok := uri.User.Password(); ok {
+			secrets = append(secrets, password)
+		}
+	}
+
+	return tools.NewRedactor(secrets...)
+}
+
+// useRedactor will add the redactor for the configuration to the logger as a hook, so that secrets are scrubbed from
+// every log entry. If the logger already has a redactor, it is returned instead.
+func (cfg *Config) useRedactor() *tools.Redactor {
+	for _, hook := range cfg.Logger.Hooks[logrus.FatalLevel] {
+		if redactor, ok := hook.(*tools.Redactor); ok {
+			return redactor
+		}
+	}
+
+	redactor := cfg.redactor()
+	cfg.Logger.AddHook(redactor)
+
+	return redactor
+}
+
 // validate will ensure that the configuration is valid for querying the web API.
 func (cfg *Config) validate() error {
 	if cfg.RateLimitConfig == nil {
@@ -302,19 +880,21 @@ func (cfg *Config) validate() error {
 		return ErrInvalidRateLimit
 	}
 
-	return nil
+	return cfg.validateCompliance()
 }
 
-// flattenRequests will flatten the requests into a single slice for HTTP requests.
-func (cfg *Config) flattenRequests(ctx context.Context) ([]*flattenedRequest, error) {
-	client, err := cfg.connect(ctx)
+// flattenRequests will flatten the rendered requests of the run into a single slice for HTTP requests.
+func (cfg *Config) flattenRequests(ctx context.Context, run *runState,
+	reqs []*Request,
+) ([]*flattenedRequest, error) {
+	client, err := cfg.connect(ctx, run.transports)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to web API: %w", err)
 	}
 
 	var flattenedRequests []*flattenedRequest
 
-	for _, req := range cfg.Requests {
+	for _, req := range reqs {
 		flatReqs, err := req.flattenTimeseries(*cfg.URL, client)
 		if err != nil {
 			return nil, err
@@ -331,9 +911,74 @@ func (cfg *Config) flattenRequests(ctx context.Context) ([]*flattenedRequest, er
 }
 
 type repoJob struct {
-	req   http.Request
-	b     []byte
-	table string
+	req        http.Request
+	b          []byte
+	table      string
+	transforms *transforms
+	jobContext jobContext
+
+	// fetched is the time the response was requested, which is the version of reconciled records.
+	fetched time.Time
+
+	// lease is the size of the job in the memory budget, released once the job is written.
+	lease *budgetLease
+}
+
+// upsertRequests will return the upsert requests for the job. If the job has no transformations, this is a single
+// request for the job table. Enrichment lookups and downsampling are made with the state of the run.
+func (job *repoJob) upsertRequests(ctx context.Context, rcfg *repoConfig) ([]*proto.UpsertRequest, error) {
+	if !job.transforms.empty() {
+		records, err := job.transforms.decode(job.b)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := rcfg.enricher.enrich(ctx, job.transforms.enrich, records); err != nil {
+			return nil, err
+		}
+
+		if rec := job.transforms.reconcile; rec != nil {
+			records, err = rec.reconcile(ctx, rcfg.lookup, job.table, job.fetched.UnixMilli(), records)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if ts := job.transforms.timeseries; ts != nil && ts.watermark != nil {
+			for _, record := range records {
+				ts.watermark.observe(ts, record)
+			}
+		}
+
+		for _, ds := range job.transforms.downsample {
+			for idx, record := range records {
+				if err := rcfg.downsamplers[ds].add(record); err != nil {
+					return nil, &recordError{index: idx, err: err}
+				}
+			}
+		}
+
+		if pt := job.transforms.passthrough; pt != nil {
+			if records, err = pt.wrap(job.jobContext.runID, time.Now(), records); err != nil {
+				return nil, err
+			}
+		}
+
+		tableRecords, err := job.transforms.apply(job.table, records)
+		if err != nil {
+			return nil, err
+		}
+
+		return tableRecords.upsertRequests()
+	}
+
+	return []*proto.UpsertRequest{
+		{
+			Table:    job.table,
+			Data:     job.b,
+			DataType: int32(tools.UpsertDataJSON),
+		},
+	}, nil
 }
 
 type repoConfig struct {
@@ -342,102 +987,366 @@ type repoConfig struct {
 	jobs       chan *repoJob
 	done       chan bool
 	logger     *logrus.Logger
+
+	// lookup is the storage used for the reads made while building upsert requests, i.e. the read replica if one is
+	// configured and the first repository otherwise.
+	lookup storage.Storage
+
+	// enricher makes the enrichment lookups of the run against the "lookup" storage.
+	enricher *enricher
+
+	// downsamplers aggregate the records of the run into the candles of each downsample configuration.
+	downsamplers map[*Downsample]*downsampler
+
+	// writeLimits are the rate limiters for the tables with a write limit, shared by every repository worker.
+	writeLimits writeLimiters
+
+	// timeouts bound the duration of the storage operations made by the repository workers.
+	timeouts *Timeouts
+
+	// batchSize is the maximum size of the upsert batches, or nil if each response is written in a single batch.
+	batchSize *BatchSize
+
+	// memory is the budget for the responses buffered for the repository workers, or nil if there is no budget.
+	memory *memoryBudget
+
+	// usage tracks the bytes written to each backend, or nil if the usage is not tracked.
+	usage *usageTracker
+
+	// encrypter encrypts the configured columns with the data key of the run, or nil if no columns are encrypted.
+	encrypter *recordEncrypter
+
+	// encrypted is set for the repositories, by index, that the columns are encrypted for.
+	encrypted []bool
+
+	// loaded are the tables that records are written to, keyed by name.
+	loaded sync.Map
 }
 
-func newRepoConfig(ctx context.Context, cfg *Config, volume int) (*repoConfig, error) {
+func newRepoConfig(ctx context.Context, cfg *Config, run *runState, volume int) (*repoConfig, error) {
+	// The data key is wrapped before connecting, so that a run that can not encrypt fails without writing.
+	encrypter, err := newRecordEncrypter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	repos, closeRepos, err := cfg.repos(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return &repoConfig{
-		repos:      repos,
-		closeRepos: closeRepos,
-		jobs:       make(chan *repoJob, volume*len(repos)),
-		done:       make(chan bool, volume),
-		logger:     cfg.Logger,
-	}, nil
+	var lookup storage.Storage
+	if len(repos) > 0 {
+		lookup = repos[0]
+	}
+
+	if cfg.ReadReplica != "" {
+		replica, err := repository.New(ctx, cfg.ReadReplica)
+		if err != nil {
+			closeRepos()
+
+			return nil, WrapRepositoryError(repository.FailedToCreateRepositoryError(err))
+		}
+
+		lookup = replica
+		closePrimaries := closeRepos
+		closeRepos = func() {
+			closePrimaries()
+			replica.Close()
+		}
+	}
+
+	rcfg := &repoConfig{
+		repos:       repos,
+		closeRepos:  closeRepos,
+		lookup:      cfg.Timeouts.wrap(lookup),
+		timeouts:    cfg.Timeouts,
+		writeLimits: newWriteLimiters(cfg.WriteLimits),
+		batchSize:   cfg.BatchSize,
+		memory:      newMemoryBudget(cfg.MemoryBudget),
+		usage:       run.usage,
+		encrypter:   encrypter,
+		encrypted:   make([]bool, len(repos)),
+		jobs:        make(chan *repoJob, volume*len(repos)),
+		done:        make(chan bool, volume),
+		logger:      cfg.Logger,
+	}
+
+	rcfg.enricher = newEnricher(rcfg.lookup)
+	rcfg.downsamplers = newDownsamplers(cfg.Requests)
+
+	if encrypter != nil {
+		for idx, dns := range cfg.ConnectionStrings {
+			rcfg.encrypted[idx] = cfg.Encryption.encrypts(dns)
+		}
+	}
+
+	if err := upsertEncryptionKey(rcfg); err != nil {
+		closeRepos()
+
+		return nil, err
+	}
+
+	return rcfg, nil
+}
+
+// encrypt will return the requests with the configured columns encrypted, for the repositories that the columns
+// are encrypted for. If no columns are encrypted, it returns the requests.
+func (cfg *repoConfig) encrypt(reqs []*proto.UpsertRequest) ([]*proto.UpsertRequest, error) {
+	if cfg.encrypter == nil {
+		return reqs, nil
+	}
+
+	return cfg.encrypter.apply(reqs)
 }
 
-func repositoryWorker(_ context.Context, workerID int, cfg *repoConfig) {
-	for job := range cfg.jobs {
-		reqs := []*proto.UpsertRequest{
-			{
-				Table:    job.table,
-				Data:     job.b,
-				DataType: int32(tools.UpsertDataJSON),
-			},
+// repoRequests will return the requests for the repository at the index: the encrypted requests if the columns are
+// encrypted for the repository, and the requests otherwise.
+func (cfg *repoConfig) repoRequests(idx int, reqs, encrypted []*proto.UpsertRequest) []*proto.UpsertRequest {
+	if cfg.encrypted[idx] {
+		return encrypted
+	}
+
+	return reqs
+}
+
+// repositoryWorker will write the jobs to the repositories until the context is done, so that the workers of an
+// application that embeds gidari stop with the run.
+func repositoryWorker(ctx context.Context, workerID int, cfg *repoConfig) {
+	for {
+		select {
+		case job := <-cfg.jobs:
+			writeRepositoryJob(ctx, workerID, cfg, job)
+		case <-ctx.Done():
+			return
 		}
+	}
+}
 
-		for _, req := range reqs {
-			for _, repo := range cfg.repos {
-				txfn := func(sctx context.Context, repo repository.Generic) error {
-					start := time.Now()
+// writeRepositoryJob will write the job to the repositories. The memory of the job is released and the job is
+// reported done however it ends, so that the run does not wait on a job that failed.
+func writeRepositoryJob(ctx context.Context, workerID int, cfg *repoConfig, job *repoJob) {
+	defer func() {
+		job.lease.release()
+		cfg.done <- true
+	}()
 
-					rsp, err := repo.Upsert(sctx, req)
-					if err != nil {
-						cfg.logger.Fatalf("error upserting data: %v", err)
+	reqs, err := job.upsertRequests(ctx, cfg)
+	if err == nil {
+		reqs, err = cfg.batchSize.split(reqs)
+	}
 
-						return fmt.Errorf("error upserting data: %w", err)
-					}
+	// The logger of an application that embeds gidari may not exit on fatal errors, in which case the job is
+	// skipped and the run is canceled by the application.
+	if err != nil {
+		err = fmt.Errorf("error building upsert requests: %w", err)
+		cfg.logger.Fatal(job.jobContext.wrap(stageRepository, err))
 
-					rt := repo.Type()
+		return
+	}
 
-					msg := fmt.Sprintf("partial upsert completed: %s.%s", storage.Scheme(rt), req.Table)
-					logInfo := tools.LogFormatter{
-						WorkerID:      workerID,
-						WorkerName:    "repository",
-						Duration:      time.Since(start),
-						Msg:           msg,
-						UpsertedCount: rsp.UpsertedCount,
-						MatchedCount:  rsp.MatchedCount,
-					}
+	encrypted, err := cfg.encrypt(reqs)
+	if err != nil {
+		cfg.logger.Fatal(job.jobContext.wrap(stageRepository, err))
 
-					cfg.logger.Infof(logInfo.String())
+		return
+	}
 
-					return nil
-				}
-				// Put the data onto the transaction channel for storage.
-				repo.Transact(txfn)
+	// Wait for the write limits once for every repository, since each repository is written at the same rate. A job
+	// that can not wait, e.g. because the run is canceled, is skipped rather than written past the limit.
+	for _, req := range reqs {
+		if err := cfg.writeLimits.wait(ctx, req); err != nil {
+			if ctx.Err() == nil {
+				err = fmt.Errorf("error waiting for write limit: %w", err)
+				cfg.logger.Fatal(job.jobContext.wrap(stageRepository, err))
 			}
+
+			return
 		}
 
-		cfg.done <- true
+		cfg.loaded.Store(req.Table, true)
+	}
+
+	for idx, repo := range cfg.repos {
+		repoReqs := cfg.repoRequests(idx, reqs, encrypted)
+
+		// All of the requests for a job are sent in the same transaction function so that related records
+		// (e.g. exploded child records) are written in order.
+		txfn := func(sctx context.Context, repo repository.Generic) error {
+			for _, req := range repoReqs {
+				start := time.Now()
+
+				rsp, err := cfg.timeouts.wrap(repo).Upsert(sctx, req)
+				if err != nil {
+					jc := job.jobContext
+					jc.table = req.Table
+					err = jc.wrap(stageRepository, fmt.Errorf("error upserting data: %w", err))
+					cfg.logger.Fatal(err)
+
+					return err
+				}
+
+				rt := repo.Type()
+				cfg.usage.write(storage.Scheme(rt), len(req.Data))
+
+				msg := fmt.Sprintf("partial upsert completed: %s.%s", storage.Scheme(rt), req.Table)
+				logInfo := tools.LogFormatter{
+					WorkerID:      workerID,
+					WorkerName:    "repository",
+					Duration:      time.Since(start),
+					Msg:           msg,
+					UpsertedCount: rsp.UpsertedCount,
+					MatchedCount:  rsp.MatchedCount,
+				}
+
+				cfg.logger.Info(logInfo.String())
+			}
+
+			return nil
+		}
+		// Put the data onto the transaction channel for storage.
+		repo.Transact(txfn)
 	}
 }
 
 type webJob struct {
 	*flattenedRequest
-	repoJobs chan<- *repoJob
-	logger   *logrus.Logger
+	repoJobs   chan<- *repoJob
+	memory     *memoryBudget
+	archiver   *archiver
+	usage      *usageTracker
+	pause      *PauseGate
+	logger     *logrus.Logger
+	jobContext jobContext
 }
 
-func newWebJob(cfg *Config, req *flattenedRequest, repoJobs chan<- *repoJob) *webJob {
+// newWebJob will return the web job for the flattened request, which is written to storage as batch number "batch"
+// of the run by the repository workers of "rcfg". If the archiver is not nil, the raw response is also archived.
+func newWebJob(cfg *Config, batch int, req *flattenedRequest, rcfg *repoConfig, arc *archiver) *webJob {
 	return &webJob{
 		flattenedRequest: req,
-		repoJobs:         repoJobs,
+		repoJobs:         rcfg.jobs,
+		memory:           rcfg.memory,
+		archiver:         arc,
+		usage:            rcfg.usage,
+		pause:            cfg.Pause,
 		logger:           cfg.Logger,
+		jobContext: jobContext{
+			runID:    cfg.RunID,
+			batch:    batch,
+			endpoint: tools.RedactURL(req.fetchConfig.URL),
+			table:    req.table,
+			request:  req.request,
+		},
+	}
+}
+
+// fetch will return the request and the body of the response for the job. The body of a paginated request is the
+// records of every page, and the request is the request of the first page. The body of an order book is the snapshots
+// of the book captured from its stream, the body of a FIX source is the records of the messages of its session, and
+// the body of a SQL source is the records of the rows of its query, the body of an LDAP source is the records of the
+// entries of its search, the body of an SNMP source is the records polled from its devices, the body of an IMAP source
+// is the records of the attachments of its messages, and the body of an MQTT source is the records of the messages
+// published to its topics.
+func (job *webJob) fetch(ctx context.Context) (*http.Request, []byte, error) {
+	if job.paginate != nil {
+		return job.paginate.fetch(ctx, job.fetchConfig, job.usage)
+	}
+
+	if job.orderBook != nil {
+		return job.orderBook.capture(ctx, job.fetchConfig, job.usage)
+	}
+
+	if job.fix != nil {
+		return job.fix.capture(ctx, job.usage)
+	}
+
+	if job.sql != nil {
+		return job.sql.read(ctx, job.usage)
+	}
+
+	if job.ldap != nil {
+		return job.ldap.search(ctx, job.usage)
+	}
+
+	if job.snmp != nil {
+		return job.snmp.poll(ctx, job.usage, job.logger)
+	}
+
+	if job.imap != nil {
+		return job.imap.fetch(ctx, job.usage)
+	}
+
+	if job.mqtt != nil {
+		return job.mqtt.capture(ctx, job.usage)
+	}
+
+	rsp, err := web.Fetch(ctx, job.fetchConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rsp.Body.Close()
+
+	bytes, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read response body: %w", err)
 	}
+
+	job.usage.download(len(bytes))
+
+	return rsp.Request, bytes, nil
 }
 
 func webWorker(ctx context.Context, workerID int, jobs <-chan *webJob) {
 	for job := range jobs {
+		// As for the repository workers, the job is skipped if the logger does not exit on fatal errors.
+		if err := job.pause.wait(ctx); err != nil {
+			job.logger.Fatal(job.jobContext.wrap(stageWeb, err))
+
+			continue
+		}
+
 		start := time.Now()
 
-		rsp, err := web.Fetch(ctx, job.fetchConfig)
+		req, bytes, err := job.fetch(ctx)
 		if err != nil {
-			job.logger.Fatal(err)
+			job.logger.Fatal(job.jobContext.wrap(stageWeb, err))
+
+			continue
 		}
 
-		bytes, err := io.ReadAll(rsp.Body)
+		// Wait for the memory budget before handing the response to the repository workers and the archiver, so
+		// that the worker does not fetch another response while the budget is used up. The response is held in the
+		// budget until both have written it.
+		weight, err := job.memory.acquire(ctx, len(bytes))
 		if err != nil {
-			job.logger.Fatal(err)
+			job.logger.Fatal(job.jobContext.wrap(stageWeb, err))
+
+			continue
+		}
+
+		holders := 1
+		if job.archiver != nil {
+			holders++
 		}
 
-		job.repoJobs <- &repoJob{b: bytes, req: *rsp.Request, table: job.table}
+		lease := job.memory.lease(weight, holders)
+
+		job.archiver.archive(ctx, job.jobContext, req, bytes, lease.release)
+
+		job.repoJobs <- &repoJob{
+			b:          bytes,
+			req:        *req,
+			table:      job.table,
+			transforms: job.transforms,
+			jobContext: job.jobContext,
+			fetched:    start,
+			lease:      lease,
+		}
 
 		// strings.Replace is used to ensure no line endings are present in the user input.
-		escapedPath := strings.ReplaceAll(rsp.Request.URL.Path, "\n", "")
+		escapedPath := strings.ReplaceAll(req.URL.Path, "\n", "")
 		escapedPath = strings.ReplaceAll(escapedPath, "\r", "")
 
 		logInfo := tools.LogFormatter{
@@ -446,13 +1355,265 @@ func webWorker(ctx context.Context, workerID int, jobs <-chan *webJob) {
 			Duration:   time.Since(start),
 			Msg:        fmt.Sprintf("web request completed: %s", escapedPath),
 		}
-		job.logger.Infof(logInfo.String())
+		job.logger.Info(logInfo.String())
+	}
+}
+
+// upsertDownsamples will write the aggregated candles for every request to the repositories. This must be called
+// after all of the repository jobs are done, so that each candle includes every record in the run.
+func upsertDownsamples(ctx context.Context, reqs []*Request, rcfg *repoConfig) error {
+	for _, req := range reqs {
+		for _, ds := range req.Downsample {
+			upsertReq, err := rcfg.downsamplers[ds].upsertRequest(req.Timeseries)
+			if err != nil {
+				return fmt.Errorf("unable to build downsample request: %w", err)
+			}
+
+			if upsertReq == nil {
+				continue
+			}
+
+			upsertReqs, err := rcfg.batchSize.split([]*proto.UpsertRequest{upsertReq})
+			if err != nil {
+				return fmt.Errorf("unable to split downsample request: %w", err)
+			}
+
+			for _, upsertReq := range upsertReqs {
+				if err := upsertDownsample(ctx, rcfg, upsertReq); err != nil {
+					return err
+				}
+			}
+		}
 	}
+
+	return nil
 }
 
-// Truncate will truncate the defined tables in the configuration.
+// upsertDownsample will write the batch of downsampled candles to every repository.
+func upsertDownsample(ctx context.Context, rcfg *repoConfig, upsertReq *proto.UpsertRequest) error {
+	if err := rcfg.writeLimits.wait(ctx, upsertReq); err != nil {
+		return err
+	}
+
+	rcfg.loaded.Store(upsertReq.Table, true)
+
+	reqs := []*proto.UpsertRequest{upsertReq}
+
+	encrypted, err := rcfg.encrypt(reqs)
+	if err != nil {
+		return err
+	}
+
+	for idx, repo := range rcfg.repos {
+		upsertReq := rcfg.repoRequests(idx, reqs, encrypted)[0]
+
+		repo.Transact(func(sctx context.Context, repo repository.Generic) error {
+			start := time.Now()
+
+			rsp, err := rcfg.timeouts.wrap(repo).Upsert(sctx, upsertReq)
+			if err != nil {
+				return fmt.Errorf("error upserting downsampled data: %w", err)
+			}
+
+			rcfg.usage.write(storage.Scheme(repo.Type()), len(upsertReq.Data))
+
+			msg := fmt.Sprintf("downsample upsert completed: %s.%s", storage.Scheme(repo.Type()), upsertReq.Table)
+			logInfo := tools.LogFormatter{
+				Duration:      time.Since(start),
+				Msg:           msg,
+				UpsertedCount: rsp.UpsertedCount,
+				MatchedCount:  rsp.MatchedCount,
+			}
+
+			rcfg.logger.Info(logInfo.String())
+
+			return nil
+		})
+	}
+
+	return nil
+}
+
+// truncateRepo will truncate the groups of tables on the repository, with up to "TruncateParallelism" groups
+// truncated concurrently. The tables of a group are always truncated in a single request, so that a table is never
+// truncated apart from the tables that reference it with a foreign key.
+func truncateRepo(ctx context.Context, cfg *Config, repo storage.Storage, groups [][]string) error {
+	if cfg.TruncateParallelism <= 1 || len(groups) <= 1 {
+		req := new(proto.TruncateRequest)
+		for _, tables := range groups {
+			req.Tables = append(req.Tables, tables...)
+		}
+
+		if _, err := cfg.Timeouts.wrap(repo).Truncate(ctx, req); err != nil {
+			return fmt.Errorf("unable to truncate tables: %w", err)
+		}
+
+		return nil
+	}
+
+	group, gctx := errgroup.WithContext(ctx)
+	group.SetLimit(cfg.TruncateParallelism)
+
+	for _, tables := range groups {
+		groupReq := &proto.TruncateRequest{Tables: tables}
+
+		group.Go(func() error {
+			if _, err := cfg.Timeouts.wrap(repo).Truncate(gctx, groupReq); err != nil {
+				return fmt.Errorf("unable to truncate tables %s: %w", strings.Join(groupReq.Tables, ", "), err)
+			}
+
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("unable to truncate tables: %w", err)
+	}
+
+	return nil
+}
+
+// truncateGroups will return the destination tables of every request, grouped so that a table and the explode tables
+// that reference it are truncated together. Groups that share a table are merged.
+func (cfg *Config) truncateGroups() [][]string {
+	var linked [][]string
+
+	for _, req := range cfg.Requests {
+		linked = append(linked, explodeTables(req.Table, req.Explode))
+
+		for _, route := range req.Routes {
+			linked = append(linked, explodeTables(route.Table, route.Explode))
+		}
+
+		for _, ds := range req.Downsample {
+			linked = append(linked, []string{ds.Table})
+		}
+	}
+
+	return groupTables(linked)
+}
+
+// replaceGroups will return the tables of the routes with the "replace" write mode, grouped with their explode tables
+// like the groups of "truncateGroups".
+func (cfg *Config) replaceGroups() [][]string {
+	var linked [][]string
+
+	for _, req := range cfg.Requests {
+		for _, route := range req.Routes {
+			if route.WriteMode == RouteWriteModeReplace {
+				linked = append(linked, explodeTables(route.Table, route.Explode))
+			}
+		}
+	}
+
+	return groupTables(linked)
+}
+
+// explodeTables will return the table followed by the child tables of its explodes.
+func explodeTables(table string, explodes []*Explode) []string {
+	tables := []string{table}
+	for _, exp := range explodes {
+		tables = append(tables, exp.Table)
+	}
+
+	return tables
+}
+
+// groupTables will group the linked sets of tables, merging the groups that share a table.
+func groupTables(linked [][]string) [][]string {
+	var groups [][]string
+
+	groupOf := make(map[string]int)
+
+	link := func(tables []string) {
+		id := -1
+
+		for _, table := range tables {
+			grp, ok := groupOf[table]
+			if !ok || grp == id {
+				continue
+			}
+
+			if id < 0 {
+				id = grp
+
+				continue
+			}
+
+			for _, member := range groups[grp] {
+				groupOf[member] = id
+			}
+
+			groups[id] = append(groups[id], groups[grp]...)
+			groups[grp] = nil
+		}
+
+		if id < 0 {
+			id = len(groups)
+			groups = append(groups, nil)
+		}
+
+		for _, table := range tables {
+			if _, ok := groupOf[table]; !ok {
+				groupOf[table] = id
+				groups[id] = append(groups[id], table)
+			}
+		}
+	}
+
+	for _, tables := range linked {
+		link(tables)
+	}
+
+	merged := groups[:0]
+
+	for _, tables := range groups {
+		if tables != nil {
+			merged = append(merged, tables)
+		}
+	}
+
+	return merged
+}
+
+// truncateTables will return the destination tables of every request, without duplicates, in the order of the
+// requests. Tables that several requests write to are truncated once.
+func (cfg *Config) truncateTables() []string {
+	var tables []string
+
+	seen := make(map[string]bool)
+
+	for _, req := range cfg.Requests {
+		for _, table := range req.destinationTables() {
+			if !seen[table] {
+				seen[table] = true
+				tables = append(tables, table)
+			}
+		}
+	}
+
+	return tables
+}
+
+// Truncate will truncate the destination tables of the requests in the configuration, including the tables of their
+// routes, explodes, and downsamples. Without "Truncate", only the tables of the routes with the "replace" write mode
+// are truncated.
 func Truncate(ctx context.Context, cfg *Config) error {
-	if !cfg.Truncate {
+	var (
+		groups [][]string
+		tables []string
+	)
+
+	if cfg.Truncate {
+		groups, tables = cfg.truncateGroups(), cfg.truncateTables()
+	} else {
+		groups = cfg.replaceGroups()
+		for _, group := range groups {
+			tables = append(tables, group...)
+		}
+	}
+
+	if len(groups) == 0 {
 		return nil
 	}
 
@@ -465,31 +1626,22 @@ func Truncate(ctx context.Context, cfg *Config) error {
 
 	defer closeRepos()
 
-	// truncateRequest is a special request that will truncate the table before upserting data.
-	truncateRequest := new(proto.TruncateRequest)
-
-	for _, req := range cfg.Requests {
-		// Add the table to the list of tables to truncate.
-		truncateRequest.Tables = append(truncateRequest.Tables, req.Table)
-	}
-
+	// The tables are truncated before upserting data, in groups that keep foreign keys intact.
 	for _, repo := range repos {
 		start := time.Now()
 
-		_, err := repo.Truncate(ctx, truncateRequest)
-		if err != nil {
-			return fmt.Errorf("unable to truncate tables: %w", err)
+		if err := truncateRepo(ctx, cfg, repo, groups); err != nil {
+			return err
 		}
 
 		rt := repo.Type()
-		tables := strings.Join(truncateRequest.Tables, ", ")
-		msg := fmt.Sprintf("truncated tables on %q: %v", storage.Scheme(rt), tables)
+		msg := fmt.Sprintf("truncated tables on %q: %v", storage.Scheme(rt), strings.Join(tables, ", "))
 
 		logInfo := tools.LogFormatter{
 			Duration: time.Since(start),
 			Msg:      msg,
 		}
-		cfg.Logger.Infof(logInfo.String())
+		cfg.Logger.Info(logInfo.String())
 	}
 
 	logInfo := tools.LogFormatter{
@@ -507,20 +1659,93 @@ func Truncate(ctx context.Context, cfg *Config) error {
 // repository, a transaction will be created and used to upsert data. The transaction will be committed at the end
 // of the upsert operation. If the transaction fails, the transaction will be rolled back. Note that it is possible
 // for some repository transactions to succeed and others to fail.
-func Upsert(ctx context.Context, cfg *Config) error {
+//
+// Every error returned by Upsert unwraps to a "*PipelineError" with the ID of the run. Secrets, e.g. the web API
+// credentials and database passwords, are scrubbed from the logs and the returned errors. The resource usage of the
+// run is logged, and written with the summary of the run to "Config.Summary" if it is set. The summary is also
+// returned, with the error of a run that fails after it starts. The web requests and the storage transactions of the
+// run spend their retries from "Config.RetryBudget", if it is set.
+//
+// The state of the run is kept apart from the configuration, so a configuration can be run again, and every run
+// without a "Config.RunID" gets its own ID.
+func Upsert(ctx context.Context, cfg *Config) (*RunSummary, error) {
+	redactor := cfg.useRedactor()
+	cfg = cfg.withRunID()
+
+	cfg.Logger.Info(tools.LogFormatter{Msg: fmt.Sprintf("run %s started", cfg.RunID)}.String())
+
+	release, err := cfg.applyCompliance()
+	if err != nil {
+		return nil, redactor.RedactError(wrapRunError(cfg.RunID, err))
+	}
+
+	defer release()
+
+	ctx, run := cfg.startRun(ctx)
+	run.transports = web.NewTransports()
+
+	defer run.transports.Close()
+
+	err = redactor.RedactError(wrapRunError(cfg.RunID, upsert(ctx, cfg, run)))
+
+	summary, summaryErr := cfg.summarize(run, err)
+	if err == nil && summaryErr != nil {
+		return summary, redactor.RedactError(wrapRunError(cfg.RunID, summaryErr))
+	}
+
+	return summary, err
+}
+
+func upsert(ctx context.Context, cfg *Config, run *runState) error {
 	start := time.Now()
 	threads := runtime.NumCPU()
 
+	if err := checkMigrations(ctx, cfg); err != nil {
+		return err
+	}
+
 	if err := Truncate(ctx, cfg); err != nil {
 		return err
 	}
 
-	flattenedRequests, err := cfg.flattenRequests(ctx)
+	run.requests = make([]*Request, 0, len(cfg.Requests))
+
+	for _, req := range cfg.Requests {
+		renderedReq, err := req.applyRunTime(cfg)
+		if err != nil {
+			return err
+		}
+
+		run.requests = append(run.requests, renderedReq)
+	}
+
+	if err := loadWatermarks(ctx, cfg, run); err != nil {
+		return err
+	}
+
+	flattenedRequests, err := cfg.flattenRequests(ctx, run, run.requests)
+	if err != nil {
+		return err
+	}
+
+	closeRateLimit, err := cfg.shareRateLimit(flattenedRequests)
+	if err != nil {
+		return err
+	}
+
+	defer closeRateLimit()
+
+	// The transactions are started with a context that is canceled if a commit exceeds its timeout, which rolls back
+	// the transaction.
+	txCtx, cancelTx := context.WithCancel(ctx)
+	defer cancelTx()
+
+	arc, err := newArchiver(cfg)
 	if err != nil {
 		return err
 	}
 
-	repoConfig, err := newRepoConfig(ctx, cfg, len(flattenedRequests))
+	repoConfig, err := newRepoConfig(txCtx, cfg, run, len(flattenedRequests))
 	if err != nil {
 		return err
 	}
@@ -536,32 +1761,75 @@ func Upsert(ctx context.Context, cfg *Config) error {
 
 	webWorkerJobs := make(chan *webJob, len(cfg.Requests))
 
-	// Start the same number of web workers as the cores on the machine.
-	for id := 1; id <= threads; id++ {
+	// Start the same number of web workers as the cores on the machine, unless the concurrency of the run is set.
+	webThreads := threads
+	if cfg.Concurrency > 0 {
+		webThreads = cfg.Concurrency
+	}
+
+	for id := 1; id <= webThreads; id++ {
 		go webWorker(ctx, id, webWorkerJobs)
 	}
 
 	cfg.Logger.Info(tools.LogFormatter{Msg: "web workers started"}.String())
 
-	// Enqueue the worker jobs
-	for _, req := range flattenedRequests {
-		webWorkerJobs <- newWebJob(cfg, req, repoConfig.jobs)
+	// Enqueue the worker jobs, and stop the web workers once they are done.
+	for idx, req := range flattenedRequests {
+		webWorkerJobs <- newWebJob(cfg, idx+1, req, repoConfig, arc)
 	}
 
+	close(webWorkerJobs)
+
 	cfg.Logger.Info(tools.LogFormatter{Msg: "web worker jobs enqueued"}.String())
 
-	// Wait for all of the data to flush.
+	// Wait for all of the data to flush, or for the run to be canceled.
 	for a := 1; a <= len(flattenedRequests); a++ {
-		<-repoConfig.done
+		select {
+		case <-repoConfig.done:
+		case <-ctx.Done():
+			return fmt.Errorf("run canceled: %w", ctx.Err())
+		}
+	}
+
+	// The raw payloads must be archived before the run is committed, so that every committed batch can be
+	// reprocessed.
+	if err := arc.wait(ctx); err != nil {
+		return err
+	}
+
+	if err := upsertDownsamples(ctx, run.requests, repoConfig); err != nil {
+		return err
+	}
+
+	if err := upsertWatermarks(cfg, run, repoConfig); err != nil {
+		return err
 	}
 
 	// Commit the transactions and check for errors.
 	for _, repo := range repoConfig.repos {
-		if err := repo.Commit(); err != nil {
+		if err := cfg.Timeouts.commit(ctx, repo, cancelTx); err != nil {
 			return fmt.Errorf("unable to commit transaction: %w", err)
 		}
 	}
 
+	// Messages are only marked processed once their records are committed, so that a failed run fetches them again.
+	if err := markIMAPMessages(ctx, cfg); err != nil {
+		return err
+	}
+
+	if err := cfg.runDataTests(ctx, run, repoConfig.repos); err != nil {
+		return err
+	}
+
+	if err := cfg.runDBT(ctx, run, repoConfig.loadedTables()); err != nil {
+		return err
+	}
+
+	if blocked := repoConfig.memory.blockedTime(); blocked > 0 {
+		msg := fmt.Sprintf("web workers waited %s for the memory budget", blocked)
+		cfg.Logger.Info(tools.LogFormatter{Msg: msg}.String())
+	}
+
 	logInfo := tools.LogFormatter{Duration: time.Since(start), Msg: "upsert completed"}
 	cfg.Logger.Info(logInfo.String())
 
@@ -9,16 +9,56 @@ package transport
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/internal/web"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/version"
 	"github.com/sirupsen/logrus"
 )
 
+// truncateStorage records the truncated tables and the most truncate requests in flight at once.
+type truncateStorage struct {
+	storage.Storage
+
+	mtx      sync.Mutex
+	tables   []string
+	requests [][]string
+	inFlight int
+	maxSeen  int
+}
+
+func (stg *truncateStorage) Truncate(_ context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	stg.mtx.Lock()
+	stg.inFlight++
+
+	if stg.inFlight > stg.maxSeen {
+		stg.maxSeen = stg.inFlight
+	}
+
+	stg.tables = append(stg.tables, req.GetTables()...)
+	stg.requests = append(stg.requests, req.GetTables())
+	stg.mtx.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	stg.mtx.Lock()
+	stg.inFlight--
+	stg.mtx.Unlock()
+
+	return &proto.TruncateResponse{}, nil
+}
+
 func TestTimeseries(t *testing.T) {
 	t.Parallel()
 	t.Run("chunks where end date is before last iteration", func(t *testing.T) {
@@ -236,9 +276,198 @@ func TestUpsert(t *testing.T) {
 			}
 
 			// Upsert the fixture.
-			if err := Upsert(context.Background(), cfg); err != nil {
+			if _, err := Upsert(context.Background(), cfg); err != nil {
 				t.Fatalf("error upserting: %v", err)
 			}
 		})
 	}
 }
+
+func TestTruncateRepo(t *testing.T) {
+	t.Parallel()
+
+	tables := []string{"a", "b", "c", "d", "e"}
+	groups := [][]string{{"a", "b"}, {"c"}, {"d"}, {"e"}}
+
+	for _, tcase := range []struct {
+		name        string
+		parallelism int
+		maxInFlight int
+		requests    int
+	}{
+		{name: "single request", parallelism: 0, maxInFlight: 1, requests: 1},
+		{name: "bounded parallelism", parallelism: 2, maxInFlight: 2, requests: 4},
+	} {
+		tcase := tcase
+
+		t.Run(tcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			stg := &truncateStorage{}
+			cfg := &Config{TruncateParallelism: tcase.parallelism}
+
+			if err := truncateRepo(context.Background(), cfg, stg, groups); err != nil {
+				t.Fatalf("failed to truncate: %v", err)
+			}
+
+			sort.Strings(stg.tables)
+
+			if !reflect.DeepEqual(stg.tables, tables) {
+				t.Fatalf("expected tables %v to be truncated, got %v", tables, stg.tables)
+			}
+
+			if stg.maxSeen != tcase.maxInFlight {
+				t.Fatalf("expected at most %d truncates in flight, got %d", tcase.maxInFlight, stg.maxSeen)
+			}
+
+			if len(stg.requests) != tcase.requests {
+				t.Fatalf("expected %d truncate requests, got %v", tcase.requests, stg.requests)
+			}
+
+			// The tables of a group are truncated in the same request.
+			for _, req := range stg.requests {
+				if len(req) == 1 && (req[0] == "a" || req[0] == "b") {
+					t.Fatalf("expected a and b to be truncated together, got %v", stg.requests)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncateTables(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{Requests: []*Request{
+		{
+			Table:      "orders",
+			Explode:    []*Explode{{Table: "fills"}},
+			Routes:     []*Route{{Table: "liquidations", Explode: []*Explode{{Table: "liquidation_fills"}}}},
+			Downsample: []*Downsample{{Table: "orders_1h"}},
+		},
+		{Table: "fills", Routes: []*Route{{Table: "orders"}}},
+	}}
+
+	exp := []string{"orders", "fills", "liquidations", "liquidation_fills", "orders_1h"}
+	if got := cfg.truncateTables(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected tables %v, got %v", exp, got)
+	}
+
+	// The second request links fills to orders, which merges the groups of both requests.
+	expGroups := [][]string{{"orders", "fills"}, {"liquidations", "liquidation_fills"}, {"orders_1h"}}
+	if got := cfg.truncateGroups(); !reflect.DeepEqual(got, expGroups) {
+		t.Fatalf("expected groups %v, got %v", expGroups, got)
+	}
+
+	cfg.Requests = append(cfg.Requests, &Request{Table: "trades", Explode: []*Explode{{Table: "liquidations"}}},
+		&Request{Table: "trades_1h"})
+
+	expGroups = [][]string{{"orders", "fills"}, {"liquidations", "liquidation_fills", "trades"}, {"orders_1h"},
+		{"trades_1h"}}
+	if got := cfg.truncateGroups(); !reflect.DeepEqual(got, expGroups) {
+		t.Fatalf("expected groups %v, got %v", expGroups, got)
+	}
+}
+
+func TestRateLimitSchedule(t *testing.T) {
+	t.Parallel()
+
+	burst, period := 100, time.Minute
+
+	rlc := RateLimitConfig{Burst: &burst, Period: &period, Schedule: "fixed"}
+	if err := rlc.validate(); !errors.Is(err, ErrInvalidRateLimitSchedule) {
+		t.Fatalf("expected invalid rate limit schedule error, got %v", err)
+	}
+
+	rlc.Schedule = ScheduleWindow
+
+	req := &Request{Endpoint: "/candles", RateLimitConfig: &rlc}
+	if _, ok := req.newFetchConfig(url.URL{}, nil).RateLimiter.(*web.WindowScheduler); !ok {
+		t.Fatal("expected the requests to be scheduled across the window")
+	}
+}
+
+func TestRequestHeader(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{RunID: "run-1"}
+	if header := cfg.requestHeader(); header.Get("User-Agent") != "gidari/"+version.Gidari ||
+		header.Get("X-Request-ID") != "run-1" {
+		t.Fatalf("unexpected default headers %v", header)
+	}
+
+	cfg.UserAgent = "acme-ingest/2.1"
+	cfg.Headers = map[string]string{"X-Partner-ID": "acme", "X-Request-ID": "custom"}
+
+	header := cfg.requestHeader()
+	if header.Get("User-Agent") != "acme-ingest/2.1" || header.Get("X-Partner-ID") != "acme" ||
+		header.Get("X-Request-ID") != "custom" {
+		t.Fatalf("unexpected headers %v", header)
+	}
+}
+
+func TestWriteRepositoryJob(t *testing.T) {
+	t.Parallel()
+
+	t.Run("failed jobs are released and done", func(t *testing.T) {
+		t.Parallel()
+
+		// The logger of an embedding application may not exit on fatal errors.
+		logger := logrus.New()
+		logger.Out = io.Discard
+		logger.ExitFunc = func(int) {}
+
+		memory := newMemoryBudget(10)
+		if _, err := memory.acquire(context.Background(), 10); err != nil {
+			t.Fatalf("failed to acquire memory budget: %v", err)
+		}
+
+		rcfg := &repoConfig{
+			done:      make(chan bool, 1),
+			logger:    logger,
+			batchSize: &BatchSize{Records: 1},
+			memory:    memory,
+		}
+
+		job := &repoJob{table: "candles", b: []byte(`[1]`), lease: memory.lease(10, 1)}
+		writeRepositoryJob(context.Background(), 1, rcfg, job)
+
+		select {
+		case <-rcfg.done:
+		default:
+			t.Fatal("expected the failed job to be done")
+		}
+
+		if !memory.sem.TryAcquire(10) {
+			t.Fatal("expected the memory of the failed job to be released")
+		}
+	})
+
+	t.Run("jobs past the write limit are skipped", func(t *testing.T) {
+		t.Parallel()
+
+		batches := 0.1
+		rcfg := &repoConfig{
+			done:        make(chan bool, 1),
+			logger:      logrus.New(),
+			writeLimits: newWriteLimiters(map[string]*WriteLimit{"candles": {Batches: &batches}}),
+		}
+
+		req := &proto.UpsertRequest{Table: "candles", Data: []byte(`[]`)}
+		if err := rcfg.writeLimits.wait(context.Background(), req); err != nil {
+			t.Fatalf("failed to wait for write limit: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		writeRepositoryJob(ctx, 1, rcfg, &repoJob{table: "candles", b: []byte(`[{"id":1}]`)})
+
+		if _, ok := rcfg.loaded.Load("candles"); ok {
+			t.Fatal("expected the job past the write limit to be skipped")
+		}
+
+		if len(rcfg.done) != 1 {
+			t.Fatal("expected the skipped job to be done")
+		}
+	})
+}
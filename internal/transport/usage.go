@@ -0,0 +1,310 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/internal/web"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/google/uuid"
+)
+
+// ResourceUsage is the resources used by a run, e.g. to charge the run back to the team that owns the configuration.
+type ResourceUsage struct {
+	// CPUTime is the user and system CPU time of the process during the run.
+	CPUTime time.Duration `json:"cpuTime"`
+
+	// PeakRSSBytes is an estimate of the peak resident set size of the process, i.e. the larger of the maximum RSS
+	// reported by the operating system and the memory obtained by the Go runtime. The operating system reports the
+	// maximum for the lifetime of the process, which includes earlier runs of a long-lived process.
+	PeakRSSBytes uint64 `json:"peakRSSBytes"`
+
+	// BytesDownloaded is the size of the web API response bodies, or of the archived payloads when reprocessing.
+	BytesDownloaded int64 `json:"bytesDownloaded"`
+
+	// BytesWritten is the serialized size of the records upserted to each backend, keyed by the scheme of the
+	// backend, e.g. "postgresql".
+	BytesWritten map[string]int64 `json:"bytesWritten"`
+
+	// GCPauses is the total time that the garbage collector stopped the world during the run, in GCCycles cycles.
+	GCPauses time.Duration `json:"gcPauses"`
+	GCCycles uint32        `json:"gcCycles"`
+
+	// Retries is the number of retries spent from the retry budget of the run, and RetryWait the time spent waiting
+	// to retry. Both are zero if the run does not have a retry budget.
+	Retries   int64         `json:"retries"`
+	RetryWait time.Duration `json:"retryWait"`
+
+	// RetryBudgetExhausted is true if the run used up its retry budget.
+	RetryBudgetExhausted bool `json:"retryBudgetExhausted,omitempty"`
+
+	// StorageTimeouts is the number of storage operations canceled for exceeding their timeout, keyed by operation,
+	// e.g. "upsert".
+	StorageTimeouts map[string]int64 `json:"storageTimeouts,omitempty"`
+
+	// MemoryWaits is the number of times the fetch stage waited for the memory budget, and MemoryBlocked the total
+	// time spent waiting. Both are zero if the run does not have a memory budget.
+	MemoryWaits   int64         `json:"memoryWaits"`
+	MemoryBlocked time.Duration `json:"memoryBlocked"`
+}
+
+// RunSummary is the summary of a run, written as JSON to "Config.Summary" when the run completes.
+type RunSummary struct {
+	RunID     string         `json:"runId"`
+	StartedAt time.Time      `json:"startedAt"`
+	Duration  time.Duration  `json:"duration"`
+	Error     string         `json:"error,omitempty"`
+	Usage     *ResourceUsage `json:"usage"`
+
+	// Priority is the priority of the run in the scheduler that started it, and QueueWait is how long the run waited
+	// to be started, if the run was started by a scheduler.
+	Priority  string        `json:"priority,omitempty"`
+	QueueWait time.Duration `json:"queueWait,omitempty"`
+
+	// Compliance is the attestation of the compliance mode of the run, or nil if the mode is not turned on.
+	Compliance *compliance.Attestation `json:"compliance,omitempty"`
+
+	// DataTests are the results of the data tests that were checked before the run completed.
+	DataTests []*DataTestResult `json:"dataTests,omitempty"`
+
+	// DBT is the result of the dbt run after the load, or nil if dbt was not run.
+	DBT *DBTResult `json:"dbt,omitempty"`
+}
+
+// usageTracker tracks the resources used by a run. The methods of a nil tracker do nothing.
+type usageTracker struct {
+	start      time.Time
+	cpuStart   time.Duration
+	pauseStart uint64
+	gcStart    uint32
+
+	downloaded    int64
+	memoryWaits   int64
+	memoryBlocked int64
+
+	mtx      sync.Mutex
+	written  map[string]int64
+	timeouts map[string]int64
+}
+
+// usageKey is the key of the usage tracker of a run in the context of the run.
+type usageKey struct{}
+
+// contextWithUsage will return a copy of the context that carries the usage tracker.
+func contextWithUsage(ctx context.Context, usage *usageTracker) context.Context {
+	return context.WithValue(ctx, usageKey{}, usage)
+}
+
+// usageFromContext will return the usage tracker carried by the context, or nil if there is none, e.g. outside of a
+// run.
+func usageFromContext(ctx context.Context) *usageTracker {
+	usage, _ := ctx.Value(usageKey{}).(*usageTracker)
+
+	return usage
+}
+
+// newUsageTracker will return a tracker for a run that starts now.
+func newUsageTracker() *usageTracker {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	return &usageTracker{
+		start:      time.Now(),
+		cpuStart:   processCPUTime(),
+		pauseStart: stats.PauseTotalNs,
+		gcStart:    stats.NumGC,
+		written:    make(map[string]int64),
+		timeouts:   make(map[string]int64),
+	}
+}
+
+// download will add the size of a downloaded response body to the usage.
+func (usage *usageTracker) download(size int) {
+	if usage == nil {
+		return
+	}
+
+	atomic.AddInt64(&usage.downloaded, int64(size))
+}
+
+// write will add the size of the records written to the backend to the usage.
+func (usage *usageTracker) write(backend string, size int) {
+	if usage == nil {
+		return
+	}
+
+	usage.mtx.Lock()
+	defer usage.mtx.Unlock()
+
+	usage.written[backend] += int64(size)
+}
+
+// timeout will count a storage operation that was canceled for exceeding its timeout.
+func (usage *usageTracker) timeout(op string) {
+	if usage == nil {
+		return
+	}
+
+	usage.mtx.Lock()
+	defer usage.mtx.Unlock()
+
+	usage.timeouts[op]++
+}
+
+// memoryWait will count a wait of the fetch stage for the memory budget.
+func (usage *usageTracker) memoryWait(blocked time.Duration) {
+	if usage == nil {
+		return
+	}
+
+	atomic.AddInt64(&usage.memoryWaits, 1)
+	atomic.AddInt64(&usage.memoryBlocked, int64(blocked))
+}
+
+// report will return the resources used by the run so far.
+func (usage *usageTracker) report() *ResourceUsage {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	peak := processPeakRSS()
+	if stats.Sys > peak {
+		peak = stats.Sys
+	}
+
+	usage.mtx.Lock()
+	defer usage.mtx.Unlock()
+
+	written := make(map[string]int64, len(usage.written))
+	for backend, size := range usage.written {
+		written[backend] = size
+	}
+
+	var timeouts map[string]int64
+	if len(usage.timeouts) > 0 {
+		timeouts = make(map[string]int64, len(usage.timeouts))
+		for op, count := range usage.timeouts {
+			timeouts[op] = count
+		}
+	}
+
+	return &ResourceUsage{
+		CPUTime:         processCPUTime() - usage.cpuStart,
+		PeakRSSBytes:    peak,
+		BytesDownloaded: atomic.LoadInt64(&usage.downloaded),
+		BytesWritten:    written,
+		GCPauses:        time.Duration(stats.PauseTotalNs - usage.pauseStart),
+		GCCycles:        stats.NumGC - usage.gcStart,
+		StorageTimeouts: timeouts,
+		MemoryWaits:     atomic.LoadInt64(&usage.memoryWaits),
+		MemoryBlocked:   time.Duration(atomic.LoadInt64(&usage.memoryBlocked)),
+	}
+}
+
+// runState is the state of a single run of a configuration, which is created when the run starts, so that the
+// configuration can be run again without the state of its earlier runs.
+type runState struct {
+	// usage tracks the resources used by the run.
+	usage *usageTracker
+
+	// retries is the retry budget of the run, or nil if the retries are not budgeted.
+	retries *tools.RetryBudget
+
+	// transports are the HTTP transports of the web API shared by the workers of the run, which are closed when the
+	// run ends, or nil if the run does not call the web API.
+	transports *web.Transports
+
+	// dataTests are the results of the data tests of the run.
+	dataTests []*DataTestResult
+
+	// dbt is the result of the dbt run of the run, or nil if dbt was not run.
+	dbt *DBTResult
+
+	// requests are the requests of the run, with their templates rendered. Each has its own copy of the timeseries,
+	// which holds the chunks and watermark of the run.
+	requests []*Request
+}
+
+// startRun will start the state of a run of the configuration, and return the context of the run, which carries the
+// usage tracker and the retry budget of the run.
+func (cfg *Config) startRun(ctx context.Context) (context.Context, *runState) {
+	run := &runState{usage: newUsageTracker()}
+	ctx, run.retries = cfg.RetryBudget.start(contextWithUsage(ctx, run.usage))
+
+	return ctx, run
+}
+
+// withRunID will return the configuration if it has a run ID, or else a copy of the configuration with a random run
+// ID, so that the next run of the configuration gets its own ID.
+func (cfg *Config) withRunID() *Config {
+	if cfg.RunID != "" {
+		return cfg
+	}
+
+	run := *cfg
+	run.RunID = uuid.New().String()
+
+	return &run
+}
+
+// summarize will log the resources used by the run and write the summary of the run to "Config.Summary", if set. The
+// summary is returned even if it can not be written.
+func (cfg *Config) summarize(run *runState, runErr error) (*RunSummary, error) {
+	summary := &RunSummary{
+		RunID:      cfg.RunID,
+		StartedAt:  run.usage.start.UTC(),
+		Duration:   time.Since(run.usage.start),
+		Usage:      run.usage.report(),
+		Priority:   cfg.Priority,
+		QueueWait:  cfg.QueueWait,
+		Compliance: compliance.Attest(),
+		DataTests:  run.dataTests,
+		DBT:        run.dbt,
+	}
+
+	summary.Usage.Retries, summary.Usage.RetryWait = run.retries.Spent()
+	summary.Usage.RetryBudgetExhausted = run.retries.Exhausted()
+
+	if runErr != nil {
+		summary.Error = runErr.Error()
+	}
+
+	msg := fmt.Sprintf("resource usage: cpu %s, peak rss %d bytes, downloaded %d bytes, written %v bytes, "+
+		"gc pauses %s, %d retries waiting %s", summary.Usage.CPUTime, summary.Usage.PeakRSSBytes,
+		summary.Usage.BytesDownloaded, summary.Usage.BytesWritten, summary.Usage.GCPauses, summary.Usage.Retries,
+		summary.Usage.RetryWait)
+	cfg.Logger.Info(tools.LogFormatter{Msg: msg}.String())
+
+	if att := summary.Compliance; att != nil {
+		msg := fmt.Sprintf("compliance mode %s (%s): tls %v with %v, crypto modules %v", att.Mode, att.Source,
+			att.TLSVersions, att.CipherSuites, att.CryptoModules)
+		cfg.Logger.Info(tools.LogFormatter{Msg: msg}.String())
+	}
+
+	if cfg.Summary == nil {
+		return summary, nil
+	}
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return summary, fmt.Errorf("unable to marshal run summary: %w", err)
+	}
+
+	if _, err := cfg.Summary.Write(append(data, '\n')); err != nil {
+		return summary, fmt.Errorf("unable to write run summary: %w", err)
+	}
+
+	return summary, nil
+}
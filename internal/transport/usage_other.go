@@ -0,0 +1,24 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+
+//go:build !unix
+
+package transport
+
+import "time"
+
+// processCPUTime will return zero, since the CPU time of the process is not available on this platform.
+func processCPUTime() time.Duration {
+	return 0
+}
+
+// processPeakRSS will return zero, since the maximum RSS of the process is not available on this platform, so the
+// peak RSS is estimated from the memory obtained by the Go runtime.
+func processPeakRSS() uint64 {
+	return 0
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestUsageTracker(t *testing.T) {
+	t.Parallel()
+
+	t.Run("nil trackers do nothing", func(t *testing.T) {
+		t.Parallel()
+
+		var usage *usageTracker
+
+		usage.download(10)
+		usage.write("postgresql", 10)
+	})
+
+	t.Run("run IDs", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &Config{}
+
+		first, second := cfg.withRunID(), cfg.withRunID()
+		if cfg.RunID != "" || first.RunID == "" || first.RunID == second.RunID {
+			t.Fatalf("expected each run to get its own ID, got %q and %q", first.RunID, second.RunID)
+		}
+
+		cfg.RunID = "run"
+		if run := cfg.withRunID(); run != cfg {
+			t.Fatalf("expected the run ID of the configuration to be kept, got %q", run.RunID)
+		}
+	})
+
+	t.Run("summary", func(t *testing.T) {
+		t.Parallel()
+
+		var buf bytes.Buffer
+
+		cfg := &Config{RunID: "run", Logger: logrus.New(), Summary: &buf}
+		cfg.Logger.SetLevel(logrus.FatalLevel)
+
+		_, run := cfg.startRun(context.Background())
+		run.usage.download(100)
+		run.usage.download(50)
+		run.usage.write("postgresql", 30)
+		run.usage.write("postgresql", 20)
+		run.usage.write("mongodb", 10)
+
+		returned, err := cfg.summarize(run, fmt.Errorf("web API unavailable"))
+		if err != nil {
+			t.Fatalf("failed to summarize run: %v", err)
+		}
+
+		summary := new(RunSummary)
+		if err := json.Unmarshal(buf.Bytes(), summary); err != nil {
+			t.Fatalf("failed to unmarshal run summary: %v", err)
+		}
+
+		if returned.RunID != summary.RunID || returned.Usage.BytesDownloaded != summary.Usage.BytesDownloaded {
+			t.Fatalf("expected the written summary to be returned, got %+v", returned)
+		}
+
+		if summary.RunID != "run" || summary.Error != "web API unavailable" || summary.Duration <= 0 {
+			t.Fatalf("unexpected run summary %+v", summary)
+		}
+
+		if summary.Usage.BytesDownloaded != 150 {
+			t.Fatalf("expected 150 bytes downloaded, got %d", summary.Usage.BytesDownloaded)
+		}
+
+		if written := summary.Usage.BytesWritten; written["postgresql"] != 50 || written["mongodb"] != 10 {
+			t.Fatalf("unexpected bytes written %v", written)
+		}
+
+		if summary.Usage.PeakRSSBytes == 0 {
+			t.Fatal("expected a peak RSS estimate")
+		}
+	})
+}
@@ -0,0 +1,231 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/repository"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+const (
+	// WatermarkTable is the name of the table/collection used to store the watermarks of incremental timeseries
+	// requests.
+	WatermarkTable = "gidari_watermarks"
+
+	watermarkIDField   = "id"
+	watermarkTimeField = "watermark"
+)
+
+// watermark is the latest time that has been synced for an incremental timeseries request.
+type watermark struct {
+	// id uniquely identifies the request the watermark belongs to.
+	id string
+
+	// time is the stored watermark, or the zero time if the request has not been synced before.
+	time time.Time
+
+	// late is the number of records fetched in this run that are older than the stored watermark.
+	late int64
+}
+
+// watermarkID will return a key that identifies the request, see "requestID".
+func (req *Request) watermarkID() string {
+	return req.requestID()
+}
+
+// incremental will return true if the request should be synced incrementally using a stored watermark.
+func (req *Request) incremental() bool {
+	return req.Timeseries != nil && req.Timeseries.Lookback != nil
+}
+
+// observe will count the record as late if it is older than the stored watermark.
+func (wm *watermark) observe(ts *timeseries, record map[string]interface{}) {
+	if wm.time.IsZero() || ts.TimeField == "" {
+		return
+	}
+
+	recordTime, ok := parseRecordTime(record[ts.TimeField], *ts.Layout)
+	if !ok {
+		return
+	}
+
+	if recordTime.Before(wm.time) {
+		atomic.AddInt64(&wm.late, 1)
+	}
+}
+
+// loadWatermarks will read the stored watermarks for every incremental request of the run, and every incremental SQL
+// source, from the read replica, or the first connection string. The watermarks are kept on the requests of the run,
+// so that the configuration can be run again.
+func loadWatermarks(ctx context.Context, cfg *Config, run *runState) error {
+	ids := []interface{}{}
+	incremental := make(map[string][]*Request)
+	sources := make(map[string][]*SQLSource)
+
+	for _, req := range run.requests {
+		// The requests of the run share their SQL source with the configuration, so the source is copied before
+		// its watermark is set.
+		if src := req.SQL; src != nil && src.incremental() {
+			id := src.watermarkID(req.Table)
+
+			runSrc := *src
+			runSrc.watermark = &sqlWatermark{id: id}
+			req.SQL = &runSrc
+
+			ids = append(ids, id)
+			sources[id] = append(sources[id], &runSrc)
+		}
+
+		if !req.incremental() {
+			continue
+		}
+
+		id := req.watermarkID()
+		req.Timeseries.watermark = &watermark{id: id}
+
+		ids = append(ids, id)
+		incremental[id] = append(incremental[id], req)
+	}
+
+	if len(ids) == 0 || cfg.readDNS() == "" {
+		return nil
+	}
+
+	repo, err := repository.New(ctx, cfg.readDNS())
+	if err != nil {
+		return WrapRepositoryError(repository.FailedToCreateRepositoryError(err))
+	}
+
+	defer repo.Close()
+
+	readReq := &proto.ReadRequest{Table: WatermarkTable}
+	if err := tools.AssignReadRequired(readReq, watermarkIDField, ids); err != nil {
+		return fmt.Errorf("unable to build watermark request: %w", err)
+	}
+
+	rsp, err := cfg.Timeouts.wrap(repo).Read(ctx, readReq)
+	if err != nil {
+		return WrapRepositoryError(fmt.Errorf("unable to read watermarks: %w", err))
+	}
+
+	for _, record := range rsp.GetRecords() {
+		fields := record.AsMap()
+
+		stored, ok := fields[watermarkTimeField].(string)
+		if !ok {
+			continue
+		}
+
+		// The watermarks of SQL sources are the text of their cursor values, rather than times.
+		id := fmt.Sprint(fields[watermarkIDField])
+		for _, src := range sources[id] {
+			src.watermark.value = stored
+		}
+
+		if len(incremental[id]) == 0 {
+			continue
+		}
+
+		wmTime, err := time.Parse(time.RFC3339, stored)
+		if err != nil {
+			return UnableToParseError("watermark")
+		}
+
+		for _, req := range incremental[id] {
+			req.Timeseries.watermark.time = wmTime
+		}
+	}
+
+	return nil
+}
+
+// upsertWatermarks will write the new watermark for every incremental request in the same transaction as the data
+// and report the records that arrived after their watermark. The watermark of an incremental SQL source is the cursor
+// value of the last row it read, and is not changed by a run that read no rows.
+func upsertWatermarks(cfg *Config, run *runState, rcfg *repoConfig) error {
+	var records []map[string]interface{}
+
+	// Requests can share a watermark, in which case the latest end time is stored.
+	ends := make(map[string]time.Time)
+	ids := []string{}
+
+	for _, req := range run.requests {
+		if !req.incremental() || req.Timeseries.watermark == nil {
+			continue
+		}
+
+		wm := req.Timeseries.watermark
+		if late := atomic.LoadInt64(&wm.late); late > 0 {
+			msg := fmt.Sprintf("%d records older than the watermark %s: %s", late, wm.time.Format(time.RFC3339),
+				req.Table)
+			cfg.Logger.Warn(tools.LogFormatter{Msg: msg}.String())
+		}
+
+		// The watermark never moves backwards, e.g. when backfilling a historical window.
+		end, ok := ends[wm.id]
+		if !ok {
+			ids = append(ids, wm.id)
+			end = wm.time
+			ends[wm.id] = end
+		}
+
+		if req.Timeseries.end.After(end) {
+			ends[wm.id] = req.Timeseries.end
+		}
+	}
+
+	for _, id := range ids {
+		records = append(records, map[string]interface{}{
+			watermarkIDField:   id,
+			watermarkTimeField: ends[id].UTC().Format(time.RFC3339),
+		})
+	}
+
+	for _, req := range run.requests {
+		if req.SQL == nil || req.SQL.watermark == nil {
+			continue
+		}
+
+		wm := req.SQL.watermark
+
+		wm.mtx.Lock()
+		next := wm.next
+		wm.mtx.Unlock()
+
+		if next != "" {
+			records = append(records, map[string]interface{}{watermarkIDField: wm.id, watermarkTimeField: next})
+		}
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	upsertReq, err := newJSONUpsertRequest(WatermarkTable, records)
+	if err != nil {
+		return fmt.Errorf("unable to build watermark request: %w", err)
+	}
+
+	for _, repo := range rcfg.repos {
+		repo.Transact(func(sctx context.Context, repo repository.Generic) error {
+			if _, err := rcfg.timeouts.wrap(repo).Upsert(sctx, upsertReq); err != nil {
+				return fmt.Errorf("error upserting watermarks: %w", err)
+			}
+
+			return nil
+		})
+	}
+
+	return nil
+}
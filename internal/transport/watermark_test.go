@@ -0,0 +1,122 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatermark(t *testing.T) {
+	t.Parallel()
+
+	t.Run("incremental timeseries start at the lookback window", func(t *testing.T) {
+		t.Parallel()
+
+		lookback := int32(3600)
+		timeseries := &timeseries{
+			StartName: "start",
+			EndName:   "end",
+			Period:    18000,
+			Lookback:  &lookback,
+			TimeField: "time",
+			watermark: &watermark{time: time.Date(2022, 0o5, 10, 20, 0, 0, 0, time.UTC)},
+		}
+
+		testURL, err := url.Parse("https//api.test.com/")
+		if err != nil {
+			t.Fatalf("error parsing url: %v", err)
+		}
+
+		query := testURL.Query()
+		query.Set("start", "2022-05-10T00:00:00Z")
+		query.Set("end", "2022-05-11T00:00:00Z")
+		testURL.RawQuery = query.Encode()
+
+		if err := timeseries.chunk(*testURL); err != nil {
+			t.Fatalf("error setting chunks: %v", err)
+		}
+
+		expChunks := [][2]time.Time{
+			{
+				time.Date(2022, 0o5, 10, 19, 0, 0, 0, time.UTC),
+				time.Date(2022, 0o5, 11, 0, 0, 0, 0, time.UTC),
+			},
+		}
+
+		if !reflect.DeepEqual(expChunks, timeseries.chunks) {
+			t.Fatalf("unexpected chunks: %v", timeseries.chunks)
+		}
+
+		for _, record := range []map[string]interface{}{
+			{"time": "2022-05-10T19:30:00Z"},
+			{"time": "2022-05-10T20:30:00Z"},
+			{"time": float64(time.Date(2022, 0o5, 10, 19, 0, 0, 0, time.UTC).Unix())},
+		} {
+			timeseries.watermark.observe(timeseries, record)
+		}
+
+		if timeseries.watermark.late != 2 {
+			t.Fatalf("expected 2 late records, got %d", timeseries.watermark.late)
+		}
+	})
+
+	t.Run("watermark id ignores the timeseries range", func(t *testing.T) {
+		t.Parallel()
+
+		req := &Request{
+			Endpoint:   "/candles",
+			Table:      "candles",
+			Query:      map[string]string{"start": "a", "end": "b", "product": "BTC-USD"},
+			Timeseries: &timeseries{StartName: "start", EndName: "end"},
+		}
+
+		if id := req.watermarkID(); id != "candles|/candles|product=BTC-USD" {
+			t.Fatalf("unexpected watermark id: %q", id)
+		}
+	})
+	t.Run("watermarks are kept on the requests of the run", func(t *testing.T) {
+		t.Parallel()
+
+		lookback := int32(3600)
+		cfg := &Config{Requests: []*Request{
+			{
+				Table:      "candles",
+				Query:      map[string]string{"start": "2022-05-10T00:00:00Z", "end": "2022-05-11T00:00:00Z"},
+				Timeseries: &timeseries{StartName: "start", EndName: "end", Lookback: &lookback},
+			},
+			{Table: "orders", SQL: &SQLSource{DSN: "postgres://db/shop", Query: "SELECT 1", Cursor: "id"}},
+		}}
+
+		run := new(runState)
+
+		for _, req := range cfg.Requests {
+			rendered, err := req.applyRunTime(cfg)
+			if err != nil {
+				t.Fatalf("error applying run time: %v", err)
+			}
+
+			run.requests = append(run.requests, rendered)
+		}
+
+		if err := loadWatermarks(context.Background(), cfg, run); err != nil {
+			t.Fatalf("error loading watermarks: %v", err)
+		}
+
+		if run.requests[0].Timeseries.watermark == nil || run.requests[1].SQL.watermark == nil {
+			t.Fatalf("expected the requests of the run to have watermarks")
+		}
+
+		if cfg.Requests[0].Timeseries.watermark != nil || cfg.Requests[1].SQL.watermark != nil {
+			t.Fatalf("expected the configured requests to have no watermarks")
+		}
+	})
+}
@@ -0,0 +1,335 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/repository"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// webhookSignatureHeader is the header of the signature of a webhook event, e.g.
+	// "Stripe-Signature: t=1492774577,v1=5257a869...".
+	webhookSignatureHeader = "Stripe-Signature"
+
+	// defaultWebhookTolerance is the default maximum age of the timestamp of a signature, in seconds.
+	defaultWebhookTolerance = 300
+
+	// webhookMaxBody is the maximum size of the body of a webhook event.
+	webhookMaxBody = 1 << 20
+)
+
+var (
+	ErrInvalidWebhook          = fmt.Errorf("invalid webhook")
+	ErrInvalidWebhookSignature = fmt.Errorf("invalid webhook signature")
+	ErrInvalidWebhookEvent     = fmt.Errorf("invalid webhook event")
+)
+
+// InvalidWebhookError is returned when the webhook configuration is not valid.
+func InvalidWebhookError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidWebhook, reason)
+}
+
+// InvalidWebhookSignatureError is returned when the signature of a webhook event does not verify.
+func InvalidWebhookSignatureError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidWebhookSignature, reason)
+}
+
+// InvalidWebhookEventError is returned when the body of a webhook event can not be decoded.
+func InvalidWebhookEventError(err error) error {
+	return fmt.Errorf("%w: %v", ErrInvalidWebhookEvent, err)
+}
+
+// Webhook is the configuration of the webhook receiver of "NewWebhookHandler", which writes the objects of the events
+// of a web API to their tables as the events arrive, while the requests of the configuration backfill the same tables
+// from the list endpoints of the web API. The objects of the two streams are reconciled by their key and version, see
+// "Reconcile".
+//
+// Events are signed and shaped like Stripe events: the "Stripe-Signature" header is the HMAC-SHA256 of the timestamp
+// and the body, and the body is `{"id": ..., "type": ..., "created": ..., "data": {"object": {...}}}`, where the
+// "object" field of the object is its type.
+type Webhook struct {
+	// Secret is the signing secret of the webhook endpoint.
+	Secret string `yaml:"secret"`
+
+	// Tolerance is the maximum age of the timestamp of a signature, in seconds, which bounds the replay of an event.
+	// The default is 300.
+	Tolerance int `yaml:"tolerance"`
+
+	// Tables are the tables that the objects of the events are written to, keyed by the type of the objects, e.g.
+	// "customer: customers". The events of other objects are acknowledged without being written.
+	Tables map[string]string `yaml:"tables"`
+
+	// Reconcile is the reconciliation of the objects with the records of their tables, with the time the event was
+	// created as the version. The default key is "id" and the default version column is "gidari_version", which
+	// should match the reconciliation of the requests that backfill the tables.
+	Reconcile *Reconcile `yaml:"reconcile"`
+}
+
+func (wh *Webhook) validate(cfg *Config) error {
+	if wh.Secret == "" {
+		return MissingConfigFieldError("webhook.secret")
+	}
+
+	if len(wh.Tables) == 0 {
+		return MissingConfigFieldError("webhook.tables")
+	}
+
+	if wh.Tolerance < 0 {
+		return InvalidWebhookError("webhook.tolerance can not be negative")
+	}
+
+	// The data key of the encrypted columns is wrapped for each run, so the receiver would write them in plain text.
+	if cfg.Encryption != nil {
+		return InvalidWebhookError("webhook can not be combined with encryption")
+	}
+
+	return nil
+}
+
+func (wh *Webhook) setDefaults() {
+	if wh.Tolerance == 0 {
+		wh.Tolerance = defaultWebhookTolerance
+	}
+
+	if wh.Reconcile == nil {
+		wh.Reconcile = new(Reconcile)
+	}
+
+	wh.Reconcile.setDefaults()
+}
+
+// verify will verify the signature header of the body, which is signed at a time within the tolerance of now.
+func (wh *Webhook) verify(header string, body []byte, now time.Time) error {
+	var (
+		timestamp  string
+		signatures []string
+	)
+
+	for _, part := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+
+		switch name {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	signed, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return InvalidWebhookSignatureError("missing timestamp")
+	}
+
+	if age := now.Sub(time.Unix(signed, 0)); age > time.Duration(wh.Tolerance)*time.Second ||
+		age < -time.Duration(wh.Tolerance)*time.Second {
+		return InvalidWebhookSignatureError("timestamp outside of the tolerance")
+	}
+
+	mac := hmac.New(sha256.New, []byte(wh.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	expected := mac.Sum(nil)
+
+	for _, signature := range signatures {
+		if decoded, err := hex.DecodeString(signature); err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+
+	return InvalidWebhookSignatureError("no matching signature")
+}
+
+// webhookEvent is the body of a webhook event.
+type webhookEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object map[string]interface{} `json:"object"`
+	} `json:"data"`
+}
+
+// WebhookHandler receives the webhook events of a configuration and writes their objects to every connection string
+// of the configuration, see "Webhook". Each event is written when it is received, outside of the transactions of the
+// runs of the configuration. An event that can not be written is answered with "500 Internal Server Error", so that
+// the web API delivers it again.
+type WebhookHandler struct {
+	webhook *Webhook
+	repos   []storage.Storage
+	lookup  storage.Storage
+	logger  *logrus.Logger
+	release func()
+	now     func() time.Time
+}
+
+// NewWebhookHandler will return the webhook receiver of the configuration, with a connection to every connection
+// string, and to the read replica if one is configured. The connections are closed by "Close". The events that fail
+// are logged to "Config.Logger", if it is set, with the secrets of the configuration scrubbed.
+func NewWebhookHandler(ctx context.Context, cfg *Config) (*WebhookHandler, error) {
+	if cfg.Webhook == nil {
+		return nil, MissingConfigFieldError("webhook")
+	}
+
+	redactor := cfg.redactor()
+	if cfg.Logger != nil {
+		redactor = cfg.useRedactor()
+	}
+
+	release, err := cfg.applyCompliance()
+	if err != nil {
+		return nil, err
+	}
+
+	handler := &WebhookHandler{webhook: cfg.Webhook, logger: cfg.Logger, release: release, now: time.Now}
+
+	for _, dns := range cfg.ConnectionStrings {
+		repo, err := repository.New(ctx, dns)
+		if err != nil {
+			handler.Close()
+
+			return nil, redactor.RedactError(WrapRepositoryError(repository.FailedToCreateRepositoryError(err)))
+		}
+
+		handler.repos = append(handler.repos, cfg.Timeouts.wrap(repo))
+	}
+
+	if len(handler.repos) > 0 {
+		handler.lookup = handler.repos[0]
+	}
+
+	if cfg.ReadReplica != "" {
+		replica, err := repository.New(ctx, cfg.ReadReplica)
+		if err != nil {
+			handler.Close()
+
+			return nil, redactor.RedactError(WrapRepositoryError(repository.FailedToCreateRepositoryError(err)))
+		}
+
+		handler.lookup = cfg.Timeouts.wrap(replica)
+	}
+
+	return handler, nil
+}
+
+// Close will close the connections of the receiver.
+func (handler *WebhookHandler) Close() {
+	closed := make(map[storage.Storage]bool)
+
+	for _, stg := range append(handler.repos, handler.lookup) {
+		if stg != nil && !closed[stg] {
+			closed[stg] = true
+
+			stg.Close()
+		}
+	}
+
+	handler.release()
+}
+
+// ServeHTTP will verify the signature of the event, and write its object to the table of the object.
+func (handler *WebhookHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, webhookMaxBody))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(rw, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+
+			return
+		}
+
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+
+		return
+	}
+
+	if err := handler.webhook.verify(req.Header.Get(webhookSignatureHeader), body, handler.now()); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	var event webhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		http.Error(rw, InvalidWebhookEventError(err).Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if err := handler.write(req.Context(), &event); err != nil {
+		if handler.logger != nil {
+			handler.logger.Error(tools.LogFormatter{Msg: fmt.Sprintf("webhook event %s failed: %v", event.ID, err)}.
+				String())
+		}
+
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+// write will write the object of the event to its table, unless its table has a later version of the object.
+func (handler *WebhookHandler) write(ctx context.Context, event *webhookEvent) error {
+	object := event.Data.Object
+	if object == nil {
+		return nil
+	}
+
+	objectType, _ := object["object"].(string)
+
+	table, ok := handler.webhook.Tables[objectType]
+	if !ok {
+		return nil
+	}
+
+	version := time.Unix(event.Created, 0).UnixMilli()
+
+	records, err := handler.webhook.Reconcile.reconcile(ctx, handler.lookup, table, version,
+		[]map[string]interface{}{object})
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	upsertReq, err := newJSONUpsertRequest(table, records)
+	if err != nil {
+		return err
+	}
+
+	for _, repo := range handler.repos {
+		if _, err := repo.Upsert(ctx, upsertReq); err != nil {
+			return fmt.Errorf("unable to upsert to %s: %w", storage.Scheme(repo.Type()), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/proto"
+)
+
+// signWebhook will return the signature header of the body, signed with the secret at the time.
+func signWebhook(secret string, signed time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(signed.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// newWebhookTestHandler will return the webhook handler of a configuration that writes customers to JSONL files in
+// the directory, with the time of the handler fixed to "now".
+func newWebhookTestHandler(t *testing.T, dir string, now time.Time) *WebhookHandler {
+	t.Helper()
+
+	cfg, err := NewConfig([]byte(`
+url: https://api.stripe.com
+connectionStrings:
+  - file://` + filepath.ToSlash(dir) + `?format=jsonl
+rateLimit:
+  burst: 1
+  period: 1
+webhook:
+  secret: whsec_test
+  tables:
+    customer: customers
+`))
+	if err != nil {
+		t.Fatalf("failed to create config: %v", err)
+	}
+
+	handler, err := NewWebhookHandler(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+
+	t.Cleanup(handler.Close)
+
+	handler.now = func() time.Time { return now }
+
+	return handler
+}
+
+// postWebhook will post the event of the object to the handler, signed at "now", and return the status code.
+func postWebhook(handler http.Handler, created time.Time, object string, now time.Time) int {
+	body := []byte(fmt.Sprintf(`{"id":"evt_1","type":"customer.updated","created":%d,"data":{"object":%s}}`,
+		created.Unix(), object))
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	req.Header.Set(webhookSignatureHeader, signWebhook("whsec_test", now, body))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	return rec.Code
+}
+
+func TestWebhookHandler(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+
+	t.Run("events are reconciled with backfills", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+		handler := newWebhookTestHandler(t, dir, now)
+
+		if code := postWebhook(handler, now, `{"object":"customer","id":"cus_1","name":"new"}`, now); code != 200 {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		// An event that is delivered late does not overwrite the later version.
+		late := now.Add(-time.Minute)
+		if code := postWebhook(handler, late, `{"object":"customer","id":"cus_1","name":"old"}`, now); code != 200 {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		// Events of objects without a table are acknowledged without being written.
+		if code := postWebhook(handler, now, `{"object":"charge","id":"ch_1"}`, now); code != 200 {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		rsp, err := handler.lookup.Read(context.Background(), &proto.ReadRequest{Table: "customers"})
+		if err != nil {
+			t.Fatalf("failed to read customers: %v", err)
+		}
+
+		if len(rsp.GetRecords()) != 1 || rsp.GetRecords()[0].AsMap()["name"] != "new" {
+			t.Fatalf("expected only the latest event to be written, got %v", rsp.GetRecords())
+		}
+
+		// A backfill that fetched the customers before the event does not overwrite the customer of the event.
+		job := &repoJob{
+			table:      "customers",
+			b:          []byte(`[{"id":"cus_1","name":"stale"},{"id":"cus_2","name":"backfilled"}]`),
+			transforms: &transforms{reconcile: handler.webhook.Reconcile},
+			fetched:    late,
+		}
+
+		reqs, err := job.upsertRequests(context.Background(), &repoConfig{lookup: handler.lookup})
+		if err != nil {
+			t.Fatalf("failed to build upsert requests: %v", err)
+		}
+
+		var records []map[string]interface{}
+		if err := json.Unmarshal(reqs[0].Data, &records); err != nil {
+			t.Fatalf("failed to decode records: %v", err)
+		}
+
+		if len(records) != 1 || records[0]["id"] != "cus_2" ||
+			records[0][defaultReconcileVersion] != float64(late.UnixMilli()) {
+			t.Fatalf("expected only the backfilled customer with its version, got %v", records)
+		}
+	})
+
+	t.Run("rejected events", func(t *testing.T) {
+		t.Parallel()
+
+		handler := newWebhookTestHandler(t, t.TempDir(), now)
+
+		stale := now.Add(-10 * time.Minute)
+		if code := postWebhook(handler, now, `{"object":"customer","id":"cus_1"}`, stale); code != 400 {
+			t.Fatalf("expected status 400 for a stale signature, got %d", code)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(`{}`)))
+		req.Header.Set(webhookSignatureHeader, signWebhook("whsec_other", now, []byte(`{}`)))
+
+		rec := httptest.NewRecorder()
+		if handler.ServeHTTP(rec, req); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for a signature of another secret, got %d", rec.Code)
+		}
+
+		rec = httptest.NewRecorder()
+		if handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != 405 {
+			t.Fatalf("expected status 405, got %d", rec.Code)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		for _, webhook := range []string{"{tables: {customer: customers}}", "{secret: whsec_test}"} {
+			_, err := NewConfig([]byte("url: https://api.stripe.com\nrateLimit: {burst: 1, period: 1}\nwebhook: " +
+				webhook))
+			if !errors.Is(err, ErrMissingConfigField) {
+				t.Fatalf("expected error %v for %s, got %v", ErrMissingConfigField, webhook, err)
+			}
+		}
+
+		if _, err := NewWebhookHandler(context.Background(), &Config{}); !errors.Is(err, ErrMissingConfigField) {
+			t.Fatalf("expected error %v, got %v", ErrMissingConfigField, err)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnsupportedCompressor = fmt.Errorf("unsupported compressor")
+	ErrInvalidSSLMode        = fmt.Errorf("invalid sslmode")
+)
+
+// UnsupportedCompressorError is returned when a wire compressor is not supported by the storage drivers.
+func UnsupportedCompressorError(compressor string) error {
+	return fmt.Errorf("%w: %q, expected one of %v", ErrUnsupportedCompressor, compressor, wireCompressors)
+}
+
+// wireCompressors are the wire compressors supported by the MongoDB driver.
+var wireCompressors = []string{"zstd", "snappy", "zlib"}
+
+// sslModes are the sslmode values supported by the PostgreSQL driver.
+var sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// Wire is the configuration for the network protocol of the storage connections. Options that are already set on a
+// connection string take precedence over the options set here.
+type Wire struct {
+	// Compressors are the wire compressors offered to MongoDB, in order of preference. The server uses the first
+	// compressor it supports. PostgreSQL does not support wire compression, so this field only applies to MongoDB.
+	Compressors []string `yaml:"compressors"`
+
+	// ZlibLevel and ZstdLevel are the compression levels for the zlib and zstd MongoDB compressors.
+	ZlibLevel *int `yaml:"zlibLevel"`
+	ZstdLevel *int `yaml:"zstdLevel"`
+
+	// SSLMode is the PostgreSQL sslmode, e.g. "require" for cross-region connections.
+	SSLMode string `yaml:"sslmode"`
+
+	// PgBouncer will set "pool_mode=transaction" on PostgreSQL connections, for connecting through PgBouncer in
+	// transaction pooling mode.
+	PgBouncer bool `yaml:"pgbouncer"`
+}
+
+func (wire *Wire) validate() error {
+	for _, compressor := range wire.Compressors {
+		if !containsString(wireCompressors, compressor) {
+			return UnsupportedCompressorError(compressor)
+		}
+	}
+
+	if wire.SSLMode != "" && !containsString(sslModes, wire.SSLMode) {
+		return fmt.Errorf("%w: %q", ErrInvalidSSLMode, wire.SSLMode)
+	}
+
+	return nil
+}
+
+// containsString will return true if the slice contains the string.
+func containsString(slice []string, str string) bool {
+	for _, elem := range slice {
+		if elem == str {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply will set the wire options on the query of the connection string. Connection strings that are not URLs are
+// returned unchanged.
+func (wire *Wire) apply(dns string) (string, error) {
+	var params map[string]string
+
+	switch {
+	case strings.HasPrefix(dns, "mongodb://"), strings.HasPrefix(dns, "mongodb+srv://"):
+		params = make(map[string]string)
+
+		if len(wire.Compressors) > 0 {
+			params["compressors"] = strings.Join(wire.Compressors, ",")
+		}
+
+		if wire.ZlibLevel != nil {
+			params["zlibCompressionLevel"] = strconv.Itoa(*wire.ZlibLevel)
+		}
+
+		if wire.ZstdLevel != nil {
+			params["zstdCompressionLevel"] = strconv.Itoa(*wire.ZstdLevel)
+		}
+	case strings.HasPrefix(dns, "postgres://"), strings.HasPrefix(dns, "postgresql://"):
+		params = make(map[string]string)
+
+		if wire.SSLMode != "" {
+			params["sslmode"] = wire.SSLMode
+		}
+
+		if wire.PgBouncer {
+			params["pool_mode"] = "transaction"
+		}
+	}
+
+	if len(params) == 0 {
+		return dns, nil
+	}
+
+	dnsURL, err := url.Parse(dns)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse connection string: %w", err)
+	}
+
+	query := dnsURL.Query()
+	for key, val := range params {
+		if !query.Has(key) {
+			query.Set(key, val)
+		}
+	}
+
+	dnsURL.RawQuery = query.Encode()
+
+	return dnsURL.String(), nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"golang.org/x/time/rate"
+)
+
+var ErrInvalidWriteLimit = fmt.Errorf("invalid write limit")
+
+// InvalidWriteLimitError is returned when the write limit for a table is not valid.
+func InvalidWriteLimitError(table, reason string) error {
+	return fmt.Errorf("%w for %q: %s", ErrInvalidWriteLimit, table, reason)
+}
+
+// WriteLimit is the maximum rate that data is written to a table, so that loads into shared databases can run
+// alongside production traffic. The limit applies to each connection string.
+type WriteLimit struct {
+	// Rows is the maximum number of rows written to the table per second.
+	Rows *float64 `yaml:"rows"`
+
+	// Batches is the maximum number of upsert batches written to the table per second. Each web response is
+	// written to a table in a single batch, unless "Config.BatchSize" is set.
+	Batches *float64 `yaml:"batches"`
+}
+
+func (wl *WriteLimit) validate(table string) error {
+	if wl.Rows == nil && wl.Batches == nil {
+		return InvalidWriteLimitError(table, "one of rows or batches is required")
+	}
+
+	if wl.Rows != nil && *wl.Rows <= 0 {
+		return InvalidWriteLimitError(table, "rows must be positive")
+	}
+
+	if wl.Batches != nil && *wl.Batches <= 0 {
+		return InvalidWriteLimitError(table, "batches must be positive")
+	}
+
+	return nil
+}
+
+// writeLimiter is the rate limiter for the writes to a table.
+type writeLimiter struct {
+	rows    *rate.Limiter
+	batches *rate.Limiter
+}
+
+// newWriteLimiter will return the rate limiter for the write limit. The burst of each limiter is one second of
+// writes, so that an idle table does not allow more than a second of writes at once.
+func newWriteLimiter(wl *WriteLimit) *writeLimiter {
+	limiter := new(writeLimiter)
+
+	if wl.Rows != nil {
+		limiter.rows = rate.NewLimiter(rate.Limit(*wl.Rows), int(math.Ceil(*wl.Rows)))
+	}
+
+	if wl.Batches != nil {
+		limiter.batches = rate.NewLimiter(rate.Limit(*wl.Batches), int(math.Ceil(*wl.Batches)))
+	}
+
+	return limiter
+}
+
+// countJSONRecords will return the number of records in the JSON data of an upsert request, which is either a JSON
+// array of records or a single record.
+func countJSONRecords(data []byte) int {
+	var records []json.RawMessage
+	if err := json.Unmarshal(data, &records); err != nil {
+		return 1
+	}
+
+	return len(records)
+}
+
+// wait will block until the upsert request can be written to storage without exceeding the write limit.
+func (limiter *writeLimiter) wait(ctx context.Context, req *proto.UpsertRequest) error {
+	if limiter.batches != nil {
+		if err := limiter.batches.Wait(ctx); err != nil {
+			return fmt.Errorf("unable to wait for batch write limit: %w", err)
+		}
+	}
+
+	if limiter.rows == nil {
+		return nil
+	}
+
+	// Batches larger than the burst are reserved in bursts, since a limiter can not wait for more than its burst.
+	for rows := countJSONRecords(req.Data); rows > 0; rows -= limiter.rows.Burst() {
+		n := rows
+		if n > limiter.rows.Burst() {
+			n = limiter.rows.Burst()
+		}
+
+		if err := limiter.rows.WaitN(ctx, n); err != nil {
+			return fmt.Errorf("unable to wait for row write limit: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// writeLimiters are the rate limiters for the tables with a write limit.
+type writeLimiters map[string]*writeLimiter
+
+func newWriteLimiters(limits map[string]*WriteLimit) writeLimiters {
+	limiters := make(writeLimiters, len(limits))
+	for table, wl := range limits {
+		limiters[table] = newWriteLimiter(wl)
+	}
+
+	return limiters
+}
+
+// wait will block until the upsert request can be written to its table without exceeding the write limit. Tables
+// without a write limit are not blocked.
+func (limiters writeLimiters) wait(ctx context.Context, req *proto.UpsertRequest) error {
+	limiter, ok := limiters[req.Table]
+	if !ok {
+		return nil
+	}
+
+	return limiter.wait(ctx, req)
+}
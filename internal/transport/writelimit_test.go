@@ -0,0 +1,114 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package transport
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/proto"
+)
+
+func TestWriteLimit(t *testing.T) {
+	t.Parallel()
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		zero := 0.0
+		rows := 100.0
+
+		for _, tcase := range []struct {
+			limit *WriteLimit
+			err   error
+		}{
+			{limit: &WriteLimit{Rows: &rows}},
+			{limit: &WriteLimit{Batches: &rows}},
+			{limit: &WriteLimit{}, err: ErrInvalidWriteLimit},
+			{limit: &WriteLimit{Rows: &zero}, err: ErrInvalidWriteLimit},
+			{limit: &WriteLimit{Rows: &rows, Batches: &zero}, err: ErrInvalidWriteLimit},
+		} {
+			if err := tcase.limit.validate("candles"); !errors.Is(err, tcase.err) {
+				t.Fatalf("expected error %v, got %v", tcase.err, err)
+			}
+		}
+	})
+
+	t.Run("count records", func(t *testing.T) {
+		t.Parallel()
+
+		for data, exp := range map[string]int{
+			`[{"id":1},{"id":2},{"id":3}]`: 3,
+			`[]`:                           0,
+			`{"id":1}`:                     1,
+		} {
+			if got := countJSONRecords([]byte(data)); got != exp {
+				t.Fatalf("expected %d records for %s, got %d", exp, data, got)
+			}
+		}
+	})
+
+	t.Run("rows", func(t *testing.T) {
+		t.Parallel()
+
+		rows := 20.0
+		limiters := newWriteLimiters(map[string]*WriteLimit{"candles": {Rows: &rows}})
+
+		// The first second of rows is the burst, so 30 rows should wait for the remaining 10 rows at 20 rows/sec.
+		req := &proto.UpsertRequest{Table: "candles", Data: []byte(`[` + repeatRecord(30) + `]`)}
+
+		start := time.Now()
+		if err := limiters.wait(context.Background(), req); err != nil {
+			t.Fatalf("failed to wait for write limit: %v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+			t.Fatalf("expected write to be limited, waited %v", elapsed)
+		}
+
+		// Tables without a write limit are not blocked.
+		start = time.Now()
+		if err := limiters.wait(context.Background(), &proto.UpsertRequest{Table: "accounts"}); err != nil {
+			t.Fatalf("failed to wait for write limit: %v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Fatalf("expected write not to be limited, waited %v", elapsed)
+		}
+	})
+
+	t.Run("batches are canceled with the context", func(t *testing.T) {
+		t.Parallel()
+
+		batches := 0.1
+		limiters := newWriteLimiters(map[string]*WriteLimit{"candles": {Batches: &batches}})
+		req := &proto.UpsertRequest{Table: "candles", Data: []byte(`[]`)}
+
+		if err := limiters.wait(context.Background(), req); err != nil {
+			t.Fatalf("failed to wait for write limit: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		if err := limiters.wait(ctx, req); err == nil {
+			t.Fatal("expected the second batch to exceed the context deadline")
+		}
+	})
+}
+
+func repeatRecord(n int) string {
+	str := `{"id":1}`
+	for i := 1; i < n; i++ {
+		str += `,{"id":1}`
+	}
+
+	return str
+}
@@ -35,6 +35,9 @@ type APIKey struct {
 	passphrase string
 	secret     string
 	url        *url.URL
+
+	// base is the transport used to make the authorized request. The default is "compliance.Transport()".
+	base http.RoundTripper
 }
 
 // NewAPIKey will return an APIKey authentication transport.
@@ -112,6 +115,13 @@ func (auth *APIKey) generageMsg(req *http.Request, timestamp string) string {
 	return fmt.Sprintf("%s%s%s%s", timestamp, req.Method, postAuthority, string(parsebytes(req)))
 }
 
+// SetTransport will set the base transport field on APIKey.
+func (auth *APIKey) SetTransport(base http.RoundTripper) *APIKey {
+	auth.base = base
+
+	return auth
+}
+
 // RoundTrip authorizes the request with a signed API Key Authorization header.
 func (auth *APIKey) RoundTrip(req *http.Request) (*http.Response, error) {
 	if auth.url == nil {
@@ -137,7 +147,7 @@ func (auth *APIKey) RoundTrip(req *http.Request) (*http.Response, error) {
 	req.Header.Add("cb-access-sign", sig)
 	req.Header.Add("cb-access-timestamp", timestamp)
 
-	rsp, err := http.DefaultTransport.RoundTrip(req)
+	rsp, err := roundTrip(auth.base, req)
 	if err != nil {
 		return nil, fmt.Errorf("error making request: %w", err)
 	}
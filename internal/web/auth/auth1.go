@@ -77,6 +77,9 @@ type Auth1 struct {
 	consumerKey       string
 	consumerSecret    string
 	url               *url.URL
+
+	// base is the transport used to make the authorized request. The default is "compliance.Transport()".
+	base http.RoundTripper
 }
 
 // NewAuth1 will return an OAuth1 http transpoauth.
@@ -84,6 +87,13 @@ func NewAuth1() *Auth1 {
 	return new(Auth1)
 }
 
+// SetTransport will set the base transport field on Auth1.
+func (auth *Auth1) SetTransport(base http.RoundTripper) *Auth1 {
+	auth.base = base
+
+	return auth
+}
+
 // RoundTrip authorizes the request with a signed OAuth1 Authorization header.
 func (auth *Auth1) RoundTrip(req *http.Request) (*http.Response, error) {
 	if auth.url == nil {
@@ -98,7 +108,7 @@ func (auth *Auth1) RoundTrip(req *http.Request) (*http.Response, error) {
 		return nil, err
 	}
 
-	rsp, err := http.DefaultTransport.RoundTrip(req)
+	rsp, err := roundTrip(auth.base, req)
 	if err != nil {
 		return nil, fmt.Errorf("%v: %w", err, ErrRequestFailed)
 	}
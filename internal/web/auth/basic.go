@@ -16,6 +16,9 @@ import (
 type Basic struct {
 	email, password string
 	url             *url.URL
+
+	// base is the transport used to make the authorized request. The default is "compliance.Transport()".
+	base http.RoundTripper
 }
 
 // NewBasic will return an Basic http transport.
@@ -44,6 +47,13 @@ func (auth *Basic) SetURL(val string) *Basic {
 	return auth
 }
 
+// SetTransport will set the base transport field on Basic.
+func (auth *Basic) SetTransport(base http.RoundTripper) *Basic {
+	auth.base = base
+
+	return auth
+}
+
 // RoundTrip authorizes the request with a signed OAuth1 Authorization header using the author and TokenSource.
 func (auth *Basic) RoundTrip(req *http.Request) (*http.Response, error) {
 	if auth.url == nil {
@@ -54,7 +64,7 @@ func (auth *Basic) RoundTrip(req *http.Request) (*http.Response, error) {
 	req.URL.Host = auth.url.Host
 	req.SetBasicAuth(auth.email, auth.password)
 
-	rsp, err := http.DefaultTransport.RoundTrip(req)
+	rsp, err := roundTrip(auth.base, req)
 	if err != nil {
 		return nil, fmt.Errorf("%v: %w", ErrRequestFailed, err)
 	}
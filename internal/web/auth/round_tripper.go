@@ -10,6 +10,8 @@ package auth
 import (
 	"fmt"
 	"net/http"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
 )
 
 var (
@@ -20,3 +22,17 @@ var (
 type Transport interface {
 	http.RoundTripper
 }
+
+// roundTrip will make the request using the base transport, or "compliance.Transport()" if the base is nil.
+func roundTrip(base http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if base == nil {
+		base = compliance.Transport()
+	}
+
+	rsp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("round trip: %w", err)
+	}
+
+	return rsp, nil
+}
@@ -16,7 +16,7 @@ import (
 	"net/url"
 
 	"github.com/alpine-hodler/gidari/internal/web/auth"
-	"golang.org/x/time/rate"
+	"github.com/alpine-hodler/gidari/tools"
 )
 
 var (
@@ -101,11 +101,57 @@ func validateResponse(res *http.Response) error {
 	return nil
 }
 
+// Limiter is a rate limiter that requests wait for before they are made, e.g. a "*rate.Limiter".
+type Limiter interface {
+	Wait(ctx context.Context) error
+}
+
+// limiterChain is a rate limiter that waits for each of its rate limiters in turn.
+type limiterChain []Limiter
+
+// ChainLimiters will return a rate limiter that waits for each of the non-nil rate limiters in turn, e.g. the rate
+// limit of the process and the rate limit shared by every process.
+func ChainLimiters(limiters ...Limiter) Limiter {
+	var chain limiterChain
+
+	for _, limiter := range limiters {
+		if limiter != nil {
+			chain = append(chain, limiter)
+		}
+	}
+
+	if len(chain) == 1 {
+		return chain[0]
+	}
+
+	return chain
+}
+
+// Wait will wait for each of the rate limiters.
+func (chain limiterChain) Wait(ctx context.Context) error {
+	for _, limiter := range chain {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ObserveResponse will pass the response to each of the rate limiters that adjust to responses.
+func (chain limiterChain) ObserveResponse(rsp *http.Response) {
+	for _, limiter := range chain {
+		if observer, ok := limiter.(ResponseObserver); ok {
+			observer.ObserveResponse(rsp)
+		}
+	}
+}
+
 type FetchConfig struct {
 	C           *Client
 	Method      string
 	URL         *url.URL
-	RateLimiter *rate.Limiter
+	RateLimiter Limiter
 }
 
 func (cfg *FetchConfig) validate() error {
@@ -135,45 +181,78 @@ type FetchResponse struct {
 
 	// Body is the response body from the server.
 	Body io.ReadCloser
+
+	// Header is the response header from the server, e.g. the "Link" header of a paginated response.
+	Header http.Header
 }
 
-func newFetchResponse(req *http.Request, body io.ReadCloser) *FetchResponse {
+func newFetchResponse(req *http.Request, rsp *http.Response) *FetchResponse {
 	return &FetchResponse{
 		Request: req,
-		Body:    body,
+		Body:    rsp.Body,
+		Header:  rsp.Header,
 	}
 }
 
 // Fetch will make an HTTP request using the underlying client and endpoint.
+//
+// If the context carries a retry budget, see "tools.ContextWithRetryBudget", requests that fail with a transport
+// error or with a 429, 500, 502, 503, or 504 response are retried with an exponential backoff, or after the
+// "Retry-After" of the response, until the request succeeds or the budget is used up. Without a retry budget, requests
+// are not retried.
 func Fetch(ctx context.Context, cfg *FetchConfig) (*FetchResponse, error) {
 	if err := cfg.validate(); err != nil {
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
 
-	// If the rate limiter is not set, set it with defaults.
-	if err := cfg.RateLimiter.Wait(ctx); err != nil {
-		return nil, fmt.Errorf("rate limiter error: %w", err)
-	}
+	budget := tools.RetryBudgetFromContext(ctx)
 
-	req, err := newHTTPRequest(ctx, cfg.Method, cfg.URL)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
-	}
+	for attempt := 0; ; attempt++ {
+		// If the rate limiter is not set, set it with defaults.
+		if err := cfg.RateLimiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("rate limiter error: %w", err)
+		}
 
-	if err != nil {
-		return nil, fmt.Errorf("rate limiter timeout: %w", err)
-	}
+		req, err := newHTTPRequest(ctx, cfg.Method, cfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %w", err)
+		}
 
-	rsp, err := cfg.C.Client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to make request: %w", err)
-	}
+		rsp, err := cfg.C.Client.Do(req)
 
-	if err := validateResponse(rsp); err != nil {
-		rsp.Body.Close()
+		if observer, ok := cfg.RateLimiter.(ResponseObserver); ok && err == nil {
+			observer.ObserveResponse(rsp)
+		}
 
-		return nil, fmt.Errorf("error validating response: %w", err)
-	}
+		if cause := retryCause(ctx, rsp, err); budget != nil && cause != nil {
+			wait := retryWait(attempt, rsp)
+
+			if rsp != nil {
+				_, _ = io.Copy(io.Discard, rsp.Body)
+				rsp.Body.Close()
+			}
+
+			if err := budget.Spend(wait, cause); err != nil {
+				return nil, fmt.Errorf("failed to make request: %w", err)
+			}
+
+			if err := sleep(ctx, wait); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
 
-	return newFetchResponse(req, rsp.Body), nil
+		if err != nil {
+			return nil, fmt.Errorf("failed to make request: %w", err)
+		}
+
+		if err := validateResponse(rsp); err != nil {
+			rsp.Body.Close()
+
+			return nil, fmt.Errorf("error validating response: %w", err)
+		}
+
+		return newFetchResponse(req, rsp), nil
+	}
 }
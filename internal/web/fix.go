@@ -0,0 +1,472 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quickfixgo/quickfix"
+	"github.com/quickfixgo/quickfix/config"
+)
+
+const (
+	// fixLogonTimeout is the maximum duration of the logon, unless the context ends earlier.
+	fixLogonTimeout = 30 * time.Second
+
+	// fixSOH is the delimiter of the fields of a FIX message.
+	fixSOH = 0x01
+
+	FIXTagBeginSeqNo      = 7
+	FIXTagBeginString     = 8
+	FIXTagBodyLength      = 9
+	FIXTagCheckSum        = 10
+	FIXTagEndSeqNo        = 16
+	FIXTagMsgSeqNum       = 34
+	FIXTagMsgType         = 35
+	FIXTagNewSeqNo        = 36
+	FIXTagPossDupFlag     = 43
+	FIXTagSenderCompID    = 49
+	FIXTagSendingTime     = 52
+	FIXTagTargetCompID    = 56
+	FIXTagText            = 58
+	FIXTagEncryptMethod   = 98
+	FIXTagHeartBtInt      = 108
+	FIXTagTestReqID       = 112
+	FIXTagOrigSendingTime = 122
+	FIXTagGapFillFlag     = 123
+	FIXTagResetSeqNumFlag = 141
+
+	FIXMsgTypeHeartbeat      = "0"
+	FIXMsgTypeTestRequest    = "1"
+	FIXMsgTypeResendRequest  = "2"
+	FIXMsgTypeReject         = "3"
+	FIXMsgTypeSequenceReset  = "4"
+	FIXMsgTypeLogout         = "5"
+	FIXMsgTypeLogon          = "A"
+	FIXMsgTypeExecutionRpt   = "8"
+	FIXMsgTypeMarketDataReq  = "V"
+	FIXMsgTypeMarketDataFull = "W"
+	FIXMsgTypeMarketDataIncr = "X"
+)
+
+var (
+	// ErrFIX is returned when a FIX session fails, or the counterparty breaks the protocol.
+	ErrFIX = errors.New("fix session failed")
+
+	// ErrFIXLogout is returned when the counterparty logs out of the FIX session.
+	ErrFIXLogout = errors.New("fix session logged out")
+)
+
+// FIXError is returned when a FIX session fails, or the counterparty breaks the protocol.
+func FIXError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrFIX, reason)
+}
+
+// FIXLogoutError is returned when the counterparty logs out of the FIX session, with the text of the logout.
+func FIXLogoutError(text string) error {
+	return fmt.Errorf("%w: %s", ErrFIXLogout, text)
+}
+
+// FIXField is a tag and value pair of a FIX message.
+type FIXField struct {
+	Tag   int
+	Value string
+}
+
+// FIXMessage are the fields of a FIX message, in the order of the message.
+type FIXMessage []FIXField
+
+// Get will return the value of the first field of the message with the tag.
+func (msg FIXMessage) Get(tag int) (string, bool) {
+	for _, field := range msg {
+		if field.Tag == tag {
+			return field.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// Type will return the MsgType of the message.
+func (msg FIXMessage) Type() string {
+	msgType, _ := msg.Get(FIXTagMsgType)
+
+	return msgType
+}
+
+// Len will return the size of the message on the wire.
+func (msg FIXMessage) Len() int {
+	size := 0
+	for _, field := range msg {
+		size += len(strconv.Itoa(field.Tag)) + len(field.Value) + 2
+	}
+
+	return size
+}
+
+// FIXSessionConfig is the configuration of the initiator side of a FIX session.
+type FIXSessionConfig struct {
+	// BeginString is the version of the protocol, e.g. "FIX.4.4".
+	BeginString string
+
+	// SenderCompID and TargetCompID identify the session.
+	SenderCompID string
+	TargetCompID string
+
+	// Heartbeat is the heartbeat interval of the session.
+	Heartbeat time.Duration
+
+	// Logon are the fields added to the logon message, such as the Username and Password of the counterparty.
+	Logon []FIXField
+
+	// TLS connects to the counterparty over TLS.
+	TLS bool
+}
+
+// fixQualifier makes the SessionID of every session unique, since quickfix registers its sessions by their
+// SessionID and the same session may be opened by more than one request at a time.
+var fixQualifier atomic.Uint64
+
+// FIXSession is the initiator side of a FIX session, for the execution reports and market data of counterparties
+// that only offer FIX. The session is run by a quickfix initiator with a memory store, so every logon resets the
+// sequence numbers.
+//
+// The administrative messages of the session are handled by quickfix: test requests are answered, resend requests
+// are answered from the memory store, and a gap in the messages of the counterparty is requested again. The
+// application messages are read by a single reader, and may be written concurrently.
+type FIXSession struct {
+	id        quickfix.SessionID
+	initiator *quickfix.Initiator
+	logon     []FIXField
+
+	// messages are the application messages of the counterparty, in sequence.
+	messages chan FIXMessage
+
+	// loggedOn is closed on the logon of the counterparty, done when the session ends, and closed when it is closed.
+	loggedOn chan struct{}
+	done     chan struct{}
+	closed   chan struct{}
+
+	loggedOnOnce sync.Once
+	doneOnce     sync.Once
+	closeOnce    sync.Once
+
+	// mtx guards the reason the session ended, the text of the last logout of the counterparty, and the last event
+	// of the session.
+	mtx    sync.Mutex
+	err    error
+	logout *string
+	event  string
+}
+
+// DialFIX will connect to the FIX counterparty at the "host:port" address and log on.
+func DialFIX(ctx context.Context, addr string, cfg FIXSessionConfig) (*FIXSession, error) {
+	if cfg.Heartbeat < time.Second {
+		return nil, FIXError(fmt.Sprintf("heartbeat interval %v must be at least one second", cfg.Heartbeat))
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, FIXError(fmt.Sprintf("invalid address %q: %v", addr, err))
+	}
+
+	sessionSettings := quickfix.NewSessionSettings()
+	sessionSettings.Set(config.BeginString, cfg.BeginString)
+	sessionSettings.Set(config.SenderCompID, cfg.SenderCompID)
+	sessionSettings.Set(config.TargetCompID, cfg.TargetCompID)
+	sessionSettings.Set(config.SessionQualifier, strconv.FormatUint(fixQualifier.Add(1), 10))
+	sessionSettings.Set(config.SocketConnectHost, host)
+	sessionSettings.Set(config.SocketConnectPort, port)
+	sessionSettings.Set(config.HeartBtInt, strconv.Itoa(int(cfg.Heartbeat/time.Second)))
+	sessionSettings.Set(config.ResetOnLogon, "Y")
+
+	if cfg.TLS {
+		sessionSettings.Set(config.SocketUseSSL, "Y")
+		sessionSettings.Set(config.SocketServerName, host)
+	}
+
+	settings := quickfix.NewSettings()
+
+	id, err := settings.AddSession(sessionSettings)
+	if err != nil {
+		return nil, FIXError(err.Error())
+	}
+
+	session := &FIXSession{
+		id:       id,
+		logon:    cfg.Logon,
+		messages: make(chan FIXMessage),
+		loggedOn: make(chan struct{}),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+
+	session.initiator, err = quickfix.NewInitiator(&fixApplication{session}, quickfix.NewMemoryStoreFactory(),
+		settings, &fixLogFactory{session})
+	if err != nil {
+		return nil, FIXError(err.Error())
+	}
+
+	if err := session.initiator.Start(); err != nil {
+		session.initiator.Stop()
+
+		return nil, FIXError(err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fixLogonTimeout)
+	defer cancel()
+
+	select {
+	case <-session.loggedOn:
+		return session, nil
+	case <-session.done:
+		session.Close()
+
+		return nil, session.reason()
+	case <-ctx.Done():
+		session.Close()
+
+		return nil, FIXError(fmt.Sprintf("logon to %s: %v (%s)", addr, ctx.Err(), session.lastEvent()))
+	}
+}
+
+// end will end the session with the error, unless it has already ended.
+func (session *FIXSession) end(err error) {
+	session.mtx.Lock()
+	if session.err == nil {
+		session.err = err
+	}
+	session.mtx.Unlock()
+
+	session.doneOnce.Do(func() { close(session.done) })
+}
+
+// reason will return the reason the session ended.
+func (session *FIXSession) reason() error {
+	session.mtx.Lock()
+	defer session.mtx.Unlock()
+
+	return session.err
+}
+
+// lastEvent will return the last event of the session.
+func (session *FIXSession) lastEvent() string {
+	session.mtx.Lock()
+	defer session.mtx.Unlock()
+
+	return session.event
+}
+
+// disconnected will end the session when it disconnects: with the text of the logout of the counterparty if it
+// logged out, or else with the last event of the session, such as a test request that was not answered.
+func (session *FIXSession) disconnected() {
+	session.mtx.Lock()
+	err := FIXError(session.event)
+	if session.logout != nil {
+		err = FIXLogoutError(*session.logout)
+	}
+	session.mtx.Unlock()
+
+	session.end(err)
+}
+
+// WriteMessage will send the application message. The header of the session is set on the message.
+func (session *FIXSession) WriteMessage(msg *quickfix.Message) error {
+	if err := quickfix.SendToTarget(msg, session.id); err != nil {
+		return FIXError(fmt.Sprintf("unable to write message: %v", err))
+	}
+
+	return nil
+}
+
+// ReadMessage will return the next application message of the counterparty. If the counterparty logs out, the error
+// wraps "ErrFIXLogout".
+func (session *FIXSession) ReadMessage() (FIXMessage, error) {
+	select {
+	case msg := <-session.messages:
+		return msg, nil
+	case <-session.done:
+	}
+
+	// A message received before the end of the session is still read.
+	select {
+	case msg := <-session.messages:
+		return msg, nil
+	default:
+		return nil, session.reason()
+	}
+}
+
+// Close will log out of the session and stop the initiator, which waits for the logout of the counterparty for up
+// to two seconds.
+func (session *FIXSession) Close() error {
+	session.closeOnce.Do(func() {
+		close(session.closed)
+		session.initiator.Stop()
+		session.end(FIXError("session closed"))
+	})
+
+	return nil
+}
+
+// fixApplication is the quickfix application of a session.
+type fixApplication struct {
+	session *FIXSession
+}
+
+func (app *fixApplication) OnCreate(quickfix.SessionID) {}
+
+func (app *fixApplication) OnLogon(quickfix.SessionID) {
+	app.session.loggedOnOnce.Do(func() { close(app.session.loggedOn) })
+}
+
+func (app *fixApplication) OnLogout(quickfix.SessionID) {
+	app.session.disconnected()
+}
+
+// ToAdmin will add the fields of the configuration to the logon.
+func (app *fixApplication) ToAdmin(msg *quickfix.Message, _ quickfix.SessionID) {
+	if !msg.IsMsgTypeOf(FIXMsgTypeLogon) {
+		return
+	}
+
+	for _, field := range app.session.logon {
+		msg.Body.SetString(quickfix.Tag(field.Tag), field.Value)
+	}
+}
+
+func (app *fixApplication) ToApp(*quickfix.Message, quickfix.SessionID) error {
+	return nil
+}
+
+// FromAdmin will end the session on a reject of the counterparty, since the initiator only sends messages that the
+// counterparty is expected to accept.
+func (app *fixApplication) FromAdmin(msg *quickfix.Message, _ quickfix.SessionID) quickfix.MessageRejectError {
+	if msg.IsMsgTypeOf(FIXMsgTypeReject) {
+		text, _ := msg.Body.GetString(FIXTagText)
+		app.session.end(FIXError(fmt.Sprintf("session rejected message: %s", text)))
+	}
+
+	return nil
+}
+
+// FromApp will hand the message to the reader, until the session is closed.
+func (app *fixApplication) FromApp(msg *quickfix.Message, _ quickfix.SessionID) quickfix.MessageRejectError {
+	fields, err := parseFIXMessage(msg.Bytes())
+	if err != nil {
+		app.session.end(err)
+
+		return nil
+	}
+
+	select {
+	case app.session.messages <- fields:
+	case <-app.session.closed:
+	}
+
+	return nil
+}
+
+// fixLogFactory creates the log of a session, which keeps the events that end the session.
+type fixLogFactory struct {
+	session *FIXSession
+}
+
+func (factory *fixLogFactory) Create() (quickfix.Log, error) {
+	return &fixLog{}, nil
+}
+
+func (factory *fixLogFactory) CreateSessionLog(quickfix.SessionID) (quickfix.Log, error) {
+	return &fixLog{session: factory.session}, nil
+}
+
+// fixLog records the last event of a session and the text of the logouts of the counterparty, and ends the session
+// when it disconnects. quickfix does not hand a logout that answers the logon to the application, nor notify it of a
+// disconnect before the logon, and only logs connection failures, which it retries.
+type fixLog struct {
+	session *FIXSession
+}
+
+func (log *fixLog) OnIncoming(raw []byte) {
+	if log.session == nil || !bytes.Contains(raw, []byte("\x0135=5\x01")) {
+		return
+	}
+
+	msg, err := parseFIXMessage(raw)
+	if err != nil || msg.Type() != FIXMsgTypeLogout {
+		return
+	}
+
+	text, _ := msg.Get(FIXTagText)
+
+	log.session.mtx.Lock()
+	log.session.logout = &text
+	log.session.mtx.Unlock()
+}
+
+func (log *fixLog) OnOutgoing([]byte) {}
+
+func (log *fixLog) OnEvent(event string) {
+	if log.session == nil {
+		return
+	}
+
+	// The disconnect is the last event of every session that ends, rather than its reason.
+	if event == "Disconnected" {
+		log.session.disconnected()
+
+		return
+	}
+
+	log.session.mtx.Lock()
+	log.session.event = event
+	log.session.mtx.Unlock()
+
+	if strings.HasPrefix(event, "Failed to connect") || strings.HasPrefix(event, "Failed handshake") {
+		log.session.end(FIXError(event))
+	}
+}
+
+func (log *fixLog) OnEventf(format string, args ...interface{}) {
+	log.OnEvent(fmt.Sprintf(format, args...))
+}
+
+// parseFIXMessage will split a message into its fields.
+func parseFIXMessage(raw []byte) (FIXMessage, error) {
+	fields := bytes.Split(bytes.TrimSuffix(raw, []byte{fixSOH}), []byte{fixSOH})
+	msg := make(FIXMessage, 0, len(fields))
+
+	for _, field := range fields {
+		eq := bytes.IndexByte(field, '=')
+		if eq <= 0 {
+			return nil, FIXError(fmt.Sprintf("invalid field %q", field))
+		}
+
+		tag, err := strconv.Atoi(string(field[:eq]))
+		if err != nil || tag <= 0 {
+			return nil, FIXError(fmt.Sprintf("invalid tag %q", field[:eq]))
+		}
+
+		msg = append(msg, FIXField{Tag: tag, Value: string(field[eq+1:])})
+	}
+
+	if msg.Type() == "" {
+		return nil, FIXError("message is missing MsgType")
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,340 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixCounterparty is the acceptor side of a session in the tests, which writes its messages with any MsgSeqNum.
+type fixCounterparty struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// read will read the next message of the initiator.
+func (counterparty *fixCounterparty) read() (FIXMessage, error) {
+	var raw []byte
+
+	for {
+		field, err := counterparty.rd.ReadSlice(fixSOH)
+		if err != nil {
+			return nil, err
+		}
+
+		raw = append(raw, field...)
+
+		if bytes.HasPrefix(field, []byte("10=")) {
+			return parseFIXMessage(raw)
+		}
+	}
+}
+
+// readUntil will read the messages of the initiator until one of the type, and return them.
+func (counterparty *fixCounterparty) readUntil(msgType string) ([]FIXMessage, error) {
+	var msgs []FIXMessage
+
+	for {
+		msg, err := counterparty.read()
+		if err != nil {
+			return msgs, err
+		}
+
+		msgs = append(msgs, msg)
+
+		if msg.Type() == msgType {
+			return msgs, nil
+		}
+	}
+}
+
+// writeAt will write the message with the MsgSeqNum.
+func (counterparty *fixCounterparty) writeAt(seq int, msgType string, body ...FIXField) {
+	var buf bytes.Buffer
+
+	for _, field := range append([]FIXField{
+		{FIXTagMsgType, msgType},
+		{FIXTagSenderCompID, "VENUE"},
+		{FIXTagTargetCompID, "GIDARI"},
+		{FIXTagMsgSeqNum, strconv.Itoa(seq)},
+		{FIXTagSendingTime, time.Now().UTC().Format("20060102-15:04:05.000")},
+	}, body...) {
+		fmt.Fprintf(&buf, "%d=%s\x01", field.Tag, field.Value)
+	}
+
+	msg := []byte(fmt.Sprintf("8=FIX.4.4\x019=%d\x01", buf.Len()))
+	msg = append(msg, buf.Bytes()...)
+
+	sum := 0
+	for _, b := range msg {
+		sum += int(b)
+	}
+
+	msg = append(msg, fmt.Sprintf("10=%03d\x01", sum%256)...)
+
+	_, _ = counterparty.conn.Write(msg)
+}
+
+// logonAt will answer the logon with the MsgSeqNum.
+func (counterparty *fixCounterparty) logonAt(seq int) {
+	counterparty.writeAt(seq, FIXMsgTypeLogon, FIXField{FIXTagEncryptMethod, "0"}, FIXField{FIXTagHeartBtInt, "1"},
+		FIXField{FIXTagResetSeqNumFlag, "Y"})
+}
+
+// resendAt will write a message that is resent, with the MsgSeqNum.
+func (counterparty *fixCounterparty) resendAt(seq int, msgType string, body ...FIXField) {
+	counterparty.writeAt(seq, msgType, append([]FIXField{
+		{FIXTagPossDupFlag, "Y"},
+		{FIXTagOrigSendingTime, time.Now().UTC().Format("20060102-15:04:05.000")},
+	}, body...)...)
+}
+
+// fixAcceptor will return the address of a counterparty that accepts a single session and hands it to serve, after
+// reading the logon of the initiator.
+func fixAcceptor(t *testing.T, serve func(t *testing.T, counterparty *fixCounterparty, logon FIXMessage)) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		counterparty := &fixCounterparty{conn: conn, rd: bufio.NewReader(conn)}
+
+		logon, err := counterparty.read()
+		if err != nil {
+			t.Errorf("failed to read logon: %v", err)
+
+			return
+		}
+
+		serve(t, counterparty, logon)
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestFIXSession(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cfg := FIXSessionConfig{
+		BeginString:  "FIX.4.4",
+		SenderCompID: "GIDARI",
+		TargetCompID: "VENUE",
+		Heartbeat:    time.Second,
+		Logon:        []FIXField{{553, "user"}},
+	}
+
+	t.Run("session", func(t *testing.T) {
+		t.Parallel()
+
+		written := make(chan []FIXMessage, 1)
+
+		addr := fixAcceptor(t, func(t *testing.T, counterparty *fixCounterparty, logon FIXMessage) {
+			user, _ := logon.Get(553)
+			reset, _ := logon.Get(FIXTagResetSeqNumFlag)
+
+			if logon.Type() != FIXMsgTypeLogon || user != "user" || reset != "Y" {
+				t.Errorf("expected the logon with the username and the reset, got %v", logon)
+			}
+
+			counterparty.logonAt(1)
+			counterparty.writeAt(2, FIXMsgTypeTestRequest, FIXField{FIXTagTestReqID, "ping"})
+			counterparty.writeAt(3, FIXMsgTypeResendRequest, FIXField{FIXTagBeginSeqNo, "1"},
+				FIXField{FIXTagEndSeqNo, "0"})
+
+			// The gap of message 5 is requested again, and the messages after it wait until it is resent.
+			counterparty.writeAt(4, FIXMsgTypeExecutionRpt, FIXField{17, "exec-1"})
+			counterparty.writeAt(6, FIXMsgTypeExecutionRpt, FIXField{17, "exec-3"})
+
+			msgs, err := counterparty.readUntil(FIXMsgTypeResendRequest)
+			written <- msgs
+
+			if err != nil {
+				return
+			}
+
+			counterparty.resendAt(5, FIXMsgTypeExecutionRpt, FIXField{17, "exec-2"})
+			counterparty.resendAt(6, FIXMsgTypeExecutionRpt, FIXField{17, "exec-3"})
+			counterparty.writeAt(7, FIXMsgTypeLogout, FIXField{FIXTagText, "end of day"})
+
+			_, _ = counterparty.readUntil(FIXMsgTypeLogout)
+		})
+
+		session, err := DialFIX(ctx, addr, cfg)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+
+		defer session.Close()
+
+		var execIDs []string
+
+		for {
+			msg, err := session.ReadMessage()
+			if errors.Is(err, ErrFIXLogout) {
+				if !strings.Contains(err.Error(), "end of day") {
+					t.Fatalf("expected the text of the logout, got %v", err)
+				}
+
+				break
+			}
+
+			if err != nil {
+				t.Fatalf("failed to read message: %v", err)
+			}
+
+			execID, _ := msg.Get(17)
+			execIDs = append(execIDs, execID)
+		}
+
+		if strings.Join(execIDs, ",") != "exec-1,exec-2,exec-3" {
+			t.Fatalf("expected the messages in sequence, got %q", execIDs)
+		}
+
+		var answered, gapFilled, resent bool
+
+		for _, msg := range <-written {
+			testReqID, _ := msg.Get(FIXTagTestReqID)
+			gapFill, _ := msg.Get(FIXTagGapFillFlag)
+			begin, _ := msg.Get(FIXTagBeginSeqNo)
+
+			answered = answered || msg.Type() == FIXMsgTypeHeartbeat && testReqID == "ping"
+			gapFilled = gapFilled || msg.Type() == FIXMsgTypeSequenceReset && gapFill == "Y"
+			resent = resent || msg.Type() == FIXMsgTypeResendRequest && begin == "5"
+		}
+
+		if !answered || !gapFilled || !resent {
+			t.Fatalf("expected the test request to be answered (%t), the resend request to be gap filled (%t), and "+
+				"the gap to be requested again (%t)", answered, gapFilled, resent)
+		}
+	})
+
+	t.Run("rejected logon", func(t *testing.T) {
+		t.Parallel()
+
+		addr := fixAcceptor(t, func(t *testing.T, counterparty *fixCounterparty, logon FIXMessage) {
+			counterparty.writeAt(1, FIXMsgTypeLogout, FIXField{FIXTagText, "invalid password"})
+		})
+
+		if _, err := DialFIX(ctx, addr, cfg); !errors.Is(err, ErrFIXLogout) ||
+			!strings.Contains(err.Error(), "invalid password") {
+			t.Fatalf("expected error %v, got %v", ErrFIXLogout, err)
+		}
+	})
+
+	t.Run("logon sequence", func(t *testing.T) {
+		t.Parallel()
+
+		addr := fixAcceptor(t, func(t *testing.T, counterparty *fixCounterparty, logon FIXMessage) {
+			counterparty.logonAt(0)
+			_, _ = counterparty.readUntil(FIXMsgTypeLogout)
+		})
+
+		if _, err := DialFIX(ctx, addr, cfg); !errors.Is(err, ErrFIX) {
+			t.Fatalf("expected error %v, got %v", ErrFIX, err)
+		}
+
+		requests := make(chan FIXMessage, 1)
+
+		addr = fixAcceptor(t, func(t *testing.T, counterparty *fixCounterparty, logon FIXMessage) {
+			counterparty.logonAt(3)
+
+			msgs, err := counterparty.readUntil(FIXMsgTypeResendRequest)
+			if err != nil {
+				return
+			}
+
+			requests <- msgs[len(msgs)-1]
+
+			counterparty.resendAt(1, FIXMsgTypeSequenceReset, FIXField{FIXTagGapFillFlag, "Y"},
+				FIXField{FIXTagNewSeqNo, "4"})
+			counterparty.writeAt(4, FIXMsgTypeLogout, FIXField{FIXTagText, "end of day"})
+
+			_, _ = counterparty.readUntil(FIXMsgTypeLogout)
+		})
+
+		session, err := DialFIX(ctx, addr, cfg)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+
+		defer session.Close()
+
+		resend := <-requests
+		if begin, _ := resend.Get(FIXTagBeginSeqNo); begin != "1" {
+			t.Fatalf("expected the messages before the logon to be requested, got %v", resend)
+		}
+
+		if _, err := session.ReadMessage(); !errors.Is(err, ErrFIXLogout) {
+			t.Fatalf("expected error %v, got %v", ErrFIXLogout, err)
+		}
+	})
+
+	t.Run("silent counterparty", func(t *testing.T) {
+		t.Parallel()
+
+		addr := fixAcceptor(t, func(t *testing.T, counterparty *fixCounterparty, logon FIXMessage) {
+			counterparty.logonAt(1)
+
+			// The test request is read, but never answered.
+			_, _ = counterparty.readUntil("")
+		})
+
+		session, err := DialFIX(ctx, addr, cfg)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+
+		defer session.Close()
+
+		if _, err := session.ReadMessage(); !errors.Is(err, ErrFIX) {
+			t.Fatalf("expected error %v, got %v", ErrFIX, err)
+		}
+	})
+
+	t.Run("invalid messages", func(t *testing.T) {
+		t.Parallel()
+
+		for _, raw := range []string{
+			"8=FIX.4.4\x019=5\x0135=A\x0110=000\x01",
+			"8=FIX.4.4\x019=abc\x0135=A\x0110=000\x01",
+		} {
+			raw := raw
+
+			addr := fixAcceptor(t, func(t *testing.T, counterparty *fixCounterparty, logon FIXMessage) {
+				_, _ = counterparty.conn.Write([]byte(raw))
+				_, _ = counterparty.readUntil("")
+			})
+
+			if _, err := DialFIX(ctx, addr, cfg); !errors.Is(err, ErrFIX) {
+				t.Fatalf("expected error %v for %q, got %v", ErrFIX, raw, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+)
+
+// ErrInvalidHeader is returned when a header set on every request is not a valid HTTP header.
+var ErrInvalidHeader = errors.New("invalid header")
+
+// InvalidHeaderError is returned when a header set on every request is not a valid HTTP header.
+func InvalidHeaderError(name, reason string) error {
+	return fmt.Errorf("%w: %q %s", ErrInvalidHeader, name, reason)
+}
+
+// ValidateHeader will return an error if the name or the value of the header is not valid, e.g. a value with a line
+// break that would inject another header.
+func ValidateHeader(name, value string) error {
+	if name == "" {
+		return InvalidHeaderError(name, "has an empty name")
+	}
+
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return InvalidHeaderError(name, "has an invalid name")
+		}
+	}
+
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return InvalidHeaderError(name, "has a line break in its value")
+	}
+
+	return nil
+}
+
+// headerTransport is a round tripper that sets headers on every request.
+type headerTransport struct {
+	base   http.RoundTripper
+	header http.Header
+}
+
+// WithHeaders will return a round tripper that sets the headers on every request before making the request with the
+// base round tripper. If there are no headers, the base round tripper is returned.
+func WithHeaders(base http.RoundTripper, header http.Header) http.RoundTripper {
+	if len(header) == 0 {
+		return base
+	}
+
+	return &headerTransport{base: base, header: header}
+}
+
+// RoundTrip will make the request with the headers set, without modifying the request of the caller.
+func (transport *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+
+	for name, values := range transport.header {
+		req.Header[name] = values
+	}
+
+	base := transport.base
+	if base == nil {
+		base = compliance.Transport()
+	}
+
+	rsp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("round trip: %w", err)
+	}
+
+	return rsp, nil
+}
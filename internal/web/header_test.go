@@ -0,0 +1,74 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithHeaders(t *testing.T) {
+	t.Parallel()
+
+	t.Run("headers are set", func(t *testing.T) {
+		t.Parallel()
+
+		var got http.Header
+
+		srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+			got = req.Header.Clone()
+		}))
+		defer srv.Close()
+
+		header := http.Header{}
+		header.Set("User-Agent", "gidari-test/1.0")
+		header.Set("X-Request-ID", "run-1")
+
+		client := &http.Client{Transport: WithHeaders(srv.Client().Transport, header)}
+
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+
+		rsp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		rsp.Body.Close()
+
+		if got.Get("User-Agent") != "gidari-test/1.0" || got.Get("X-Request-ID") != "run-1" {
+			t.Fatalf("expected the headers on the request, got %v", got)
+		}
+
+		if len(req.Header) != 0 {
+			t.Fatalf("expected the request of the caller to be unchanged, got %v", req.Header)
+		}
+	})
+
+	t.Run("no headers", func(t *testing.T) {
+		t.Parallel()
+
+		if transport := WithHeaders(http.DefaultTransport, nil); transport != http.DefaultTransport {
+			t.Fatal("expected the base transport without headers")
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+
+		for name, value := range map[string]string{"": "value", "X Partner": "value", "X-Partner": "a\r\nX-Admin: 1"} {
+			if err := ValidateHeader(name, value); !errors.Is(err, ErrInvalidHeader) {
+				t.Fatalf("expected invalid header error for %q: %q, got %v", name, value, err)
+			}
+		}
+
+		if err := ValidateHeader("X-Partner-ID", "acme"); err != nil {
+			t.Fatalf("expected a valid header, got %v", err)
+		}
+	})
+}
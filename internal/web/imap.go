@@ -0,0 +1,293 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	goimap "github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+)
+
+const (
+	// imapTimeout is the maximum duration of each command, e.g. the fetch of a message, unless the context ends
+	// earlier.
+	imapTimeout = 2 * time.Minute
+
+	// IMAPMaxLiteral is the largest message read from an IMAP server, to bound the memory of a corrupted length.
+	IMAPMaxLiteral = 64 << 20
+)
+
+// ErrIMAP is returned when an IMAP command fails, or the server breaks the protocol.
+var ErrIMAP = errors.New("imap request failed")
+
+// IMAPError is returned when an IMAP command fails, or the server breaks the protocol.
+func IMAPError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrIMAP, reason)
+}
+
+// imapSystemFlags are the system flags, which are matched without regard to case. Other flags are keywords.
+var imapSystemFlags = []goimap.Flag{
+	goimap.FlagSeen, goimap.FlagAnswered, goimap.FlagFlagged, goimap.FlagDeleted, goimap.FlagDraft,
+}
+
+// IMAPConfig is the configuration of a connection to an IMAP server.
+type IMAPConfig struct {
+	// TLS connects to the server over TLS, i.e. IMAPS.
+	TLS bool
+
+	// Username and Password are the credentials of the login.
+	Username string
+	Password string
+}
+
+// IMAPSearch is a search of the messages of the selected mailbox. Every criterion that is set must match.
+type IMAPSearch struct {
+	// From are the senders of the messages, any of which matches a substring of the "From" header, e.g. a domain.
+	From []string
+
+	// Subject matches a substring of the "Subject" header.
+	Subject string
+
+	// Since matches the messages received on or after the date.
+	Since time.Time
+
+	// Without matches the messages without the flag, e.g. "\Seen" or a keyword.
+	Without string
+}
+
+// IMAPConn is a connection to an IMAP server that is logged in, with the go-imap client.
+type IMAPConn struct {
+	client *imapclient.Client
+}
+
+// DialIMAP will connect to the IMAP server at "addr", e.g. "imap.example.com:993", and log in.
+func DialIMAP(ctx context.Context, addr string, cfg IMAPConfig) (*IMAPConn, error) {
+	conn, err := (&net.Dialer{Timeout: imapTimeout}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, IMAPError(fmt.Sprintf("unable to connect to %s: %v", addr, err))
+	}
+
+	if cfg.TLS {
+		host, _, _ := net.SplitHostPort(addr)
+
+		tlsConn := tls.Client(conn, compliance.TLSConfig(host))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+
+			return nil, IMAPError(fmt.Sprintf("tls handshake with %s: %v", addr, err))
+		}
+
+		conn = tlsConn
+	}
+
+	imap := &IMAPConn{client: imapclient.New(conn, nil)}
+
+	if err := imap.wait(ctx, "greeting", imap.client.WaitGreeting); err != nil {
+		imap.client.Close()
+
+		return nil, err
+	}
+
+	if err := imap.wait(ctx, "LOGIN", imap.client.Login(cfg.Username, cfg.Password).Wait); err != nil {
+		imap.client.Close()
+
+		return nil, err
+	}
+
+	return imap, nil
+}
+
+// Close will log out and close the connection.
+func (imap *IMAPConn) Close() error {
+	_ = imap.wait(context.Background(), "LOGOUT", imap.client.Logout().Wait)
+
+	return imap.client.Close()
+}
+
+// Select will select the mailbox, and return its UIDVALIDITY. The UIDs of the mailbox are only valid for the same
+// UIDVALIDITY. A mailbox selected with "readOnly" is examined, so that no flag of its messages is changed.
+func (imap *IMAPConn) Select(ctx context.Context, mailbox string, readOnly bool) (uint32, error) {
+	var data *goimap.SelectData
+
+	err := imap.wait(ctx, "SELECT", func() error {
+		var err error
+
+		data, err = imap.client.Select(mailbox, &goimap.SelectOptions{ReadOnly: readOnly}).Wait()
+
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if data.UIDValidity == 0 {
+		return 0, IMAPError("no UIDVALIDITY for mailbox " + mailbox)
+	}
+
+	return data.UIDValidity, nil
+}
+
+// Search will return the UIDs of the messages of the selected mailbox that match the search, in ascending order.
+func (imap *IMAPConn) Search(ctx context.Context, search IMAPSearch) ([]uint32, error) {
+	criteria := &goimap.SearchCriteria{Since: search.Since}
+
+	if search.Without != "" {
+		criteria.NotFlag = append(criteria.NotFlag, imapFlag(search.Without))
+	}
+
+	// "OR" takes two keys, so the senders are a chain of "OR"s.
+	if len(search.From) > 0 {
+		from := goimap.SearchCriteria{Header: []goimap.SearchCriteriaHeaderField{
+			{Key: "From", Value: search.From[len(search.From)-1]},
+		}}
+
+		for idx := len(search.From) - 2; idx >= 0; idx-- {
+			from = goimap.SearchCriteria{Or: [][2]goimap.SearchCriteria{{
+				{Header: []goimap.SearchCriteriaHeaderField{{Key: "From", Value: search.From[idx]}}},
+				from,
+			}}}
+		}
+
+		criteria.And(&from)
+	}
+
+	if search.Subject != "" {
+		criteria.Header = append(criteria.Header, goimap.SearchCriteriaHeaderField{
+			Key: "Subject", Value: search.Subject,
+		})
+	}
+
+	var data *goimap.SearchData
+
+	err := imap.wait(ctx, "UID SEARCH", func() error {
+		var err error
+
+		data, err = imap.client.UIDSearch(criteria, nil).Wait()
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	all := data.AllUIDs()
+
+	uids := make([]uint32, len(all))
+	for idx, uid := range all {
+		uids[idx] = uint32(uid)
+	}
+
+	// Servers may answer in any order.
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	return uids, nil
+}
+
+// Fetch will return the raw RFC 5322 message with the UID, without setting its "\Seen" flag.
+func (imap *IMAPConn) Fetch(ctx context.Context, uid uint32) ([]byte, error) {
+	var raw []byte
+
+	err := imap.wait(ctx, "UID FETCH", func() error {
+		cmd := imap.client.Fetch(goimap.UIDSetNum(goimap.UID(uid)), &goimap.FetchOptions{
+			BodySection: []*goimap.FetchItemBodySection{{Peek: true}},
+		})
+
+		for msg := cmd.Next(); msg != nil; msg = cmd.Next() {
+			for item := msg.Next(); item != nil; item = msg.Next() {
+				body, ok := item.(imapclient.FetchItemDataBodySection)
+				if !ok || body.Literal == nil || raw != nil {
+					continue
+				}
+
+				data, err := io.ReadAll(io.LimitReader(body.Literal, IMAPMaxLiteral+1))
+				if err != nil {
+					cmd.Close()
+
+					return err
+				}
+
+				if len(data) > IMAPMaxLiteral {
+					cmd.Close()
+
+					return fmt.Errorf("message %d is larger than %d bytes", uid, IMAPMaxLiteral)
+				}
+
+				raw = data
+			}
+		}
+
+		return cmd.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if raw == nil {
+		return nil, IMAPError(fmt.Sprintf("message %d not found", uid))
+	}
+
+	return raw, nil
+}
+
+// Store will add the flag to the messages with the UIDs, e.g. "\Seen" or a keyword.
+func (imap *IMAPConn) Store(ctx context.Context, uids []uint32, flag string) error {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	set := make([]goimap.UID, len(uids))
+	for idx, uid := range uids {
+		set[idx] = goimap.UID(uid)
+	}
+
+	return imap.wait(ctx, "UID STORE", imap.client.Store(goimap.UIDSetNum(set...), &goimap.StoreFlags{
+		Op: goimap.StoreFlagsAdd, Silent: true, Flags: []goimap.Flag{imapFlag(flag)},
+	}, nil).Close)
+}
+
+// wait will wait for the command to complete. The connection is closed when the context ends, or the command takes
+// longer than "imapTimeout", since the client does not take a context.
+func (imap *IMAPConn) wait(ctx context.Context, name string, cmdFn func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, imapTimeout)
+	defer cancel()
+
+	stop := context.AfterFunc(ctx, func() { imap.client.Close() })
+	defer stop()
+
+	if err := cmdFn(); err != nil {
+		if ctx.Err() != nil {
+			return IMAPError(fmt.Sprintf("%s interrupted: %v", name, ctx.Err()))
+		}
+
+		return IMAPError(fmt.Sprintf("%s failed: %v", name, err))
+	}
+
+	return nil
+}
+
+// imapFlag will return the flag, with the case of the system flag if it is one, e.g. "\Seen" for "\seen".
+func imapFlag(flag string) goimap.Flag {
+	for _, system := range imapSystemFlags {
+		if strings.EqualFold(flag, string(system)) {
+			return system
+		}
+	}
+
+	return goimap.Flag(flag)
+}
@@ -0,0 +1,191 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// imapServer will return the address of an IMAP server that accepts a single connection, logs in "reports" with the
+// password `p"ss`, and answers commands from the messages of its INBOX, by UID. The commands are sent on commands.
+func imapServer(t *testing.T, messages map[uint32]string, commands chan<- string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		rd := bufio.NewReader(conn)
+		write := func(format string, args ...interface{}) { fmt.Fprintf(conn, format+"\r\n", args...) }
+
+		write("* OK [CAPABILITY IMAP4rev1] ready")
+
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			line = strings.TrimRight(line, "\r\n")
+
+			// Accept the literals of the command.
+			for strings.HasSuffix(line, "}") {
+				start := strings.LastIndexByte(line, '{')
+				size, _ := strconv.Atoi(line[start+1 : len(line)-1])
+
+				write("+ go ahead")
+
+				literal := make([]byte, size)
+				if _, err := io.ReadFull(rd, literal); err != nil {
+					return
+				}
+
+				rest, _ := rd.ReadString('\n')
+				line = line[:start] + "<" + string(literal) + ">" + strings.TrimRight(rest, "\r\n")
+			}
+
+			commands <- line
+
+			tag, cmd, _ := strings.Cut(line, " ")
+
+			switch {
+			case strings.HasPrefix(cmd, "LOGIN"):
+				if cmd != `LOGIN "reports" "p\"ss"` {
+					write("%s NO [AUTHENTICATIONFAILED] Invalid credentials", tag)
+
+					continue
+				}
+
+				write("%s OK [CAPABILITY IMAP4rev1] LOGIN completed", tag)
+			case strings.HasPrefix(cmd, "SELECT"), strings.HasPrefix(cmd, "EXAMINE"):
+				write("* 2 EXISTS")
+				write("* OK [UIDVALIDITY 7] UIDs valid")
+				write("%s OK [READ-WRITE] completed", tag)
+			case strings.HasPrefix(cmd, "UID SEARCH"):
+				write("* SEARCH 12 3")
+				write("%s OK SEARCH completed", tag)
+			case strings.HasPrefix(cmd, "UID FETCH"):
+				uid, _ := strconv.ParseUint(strings.Fields(cmd)[2], 10, 32)
+				msg := messages[uint32(uid)]
+
+				write("* 1 FETCH (UID %d BODY[] {%d}\r\n%s)", uid, len(msg), msg)
+				write("%s OK FETCH completed", tag)
+			case strings.HasPrefix(cmd, "LOGOUT"):
+				write("* BYE")
+				write("%s OK LOGOUT completed", tag)
+
+				return
+			default:
+				write("%s OK completed", tag)
+			}
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestIMAP(t *testing.T) {
+	t.Parallel()
+
+	t.Run("fetch", func(t *testing.T) {
+		t.Parallel()
+
+		msg := "From: a@partner.example\r\nSubject: report\r\n\r\nline {1}\r\n"
+		commands := make(chan string, 20)
+
+		conn, err := DialIMAP(context.Background(), imapServer(t, map[uint32]string{3: msg}, commands), IMAPConfig{
+			Username: "reports", Password: `p"ss`,
+		})
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+
+		validity, err := conn.Select(context.Background(), "INBOX", true)
+		if err != nil || validity != 7 {
+			t.Fatalf("expected UIDVALIDITY 7, got %d: %v", validity, err)
+		}
+
+		uids, err := conn.Search(context.Background(), IMAPSearch{
+			From:    []string{"partner.example", "other.example"},
+			Subject: "Daily report",
+			Since:   time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC),
+			Without: "$Processed",
+		})
+		if err != nil || !reflect.DeepEqual(uids, []uint32{3, 12}) {
+			t.Fatalf("expected the UIDs in order, got %v: %v", uids, err)
+		}
+
+		got, err := conn.Fetch(context.Background(), 3)
+		if err != nil || string(got) != msg {
+			t.Fatalf("expected message %q, got %q: %v", msg, got, err)
+		}
+
+		if err := conn.Store(context.Background(), []uint32{3, 12}, `\Seen`); err != nil {
+			t.Fatalf("failed to store: %v", err)
+		}
+
+		if _, err := conn.Search(context.Background(), IMAPSearch{Subject: "Büro", Without: `\Seen`}); err != nil {
+			t.Fatalf("failed to search: %v", err)
+		}
+
+		conn.Close()
+		close(commands)
+
+		var sent []string
+		for cmd := range commands {
+			_, cmd, _ = strings.Cut(cmd, " ")
+			sent = append(sent, cmd)
+		}
+
+		exp := []string{
+			`LOGIN "reports" "p\"ss"`,
+			`EXAMINE INBOX`,
+			`UID SEARCH SINCE "1-Feb-2023" SUBJECT "Daily report" UNKEYWORD $Processed ` +
+				`OR (FROM "partner.example") (FROM "other.example")`,
+			`UID FETCH 3 (UID BODY.PEEK[])`,
+			`UID STORE 3,12 +FLAGS.SILENT (\Seen)`,
+			`UID SEARCH CHARSET UTF-8 SUBJECT <Büro> UNSEEN`,
+			`LOGOUT`,
+		}
+		if !reflect.DeepEqual(sent, exp) {
+			t.Fatalf("expected commands %q, got %q", exp, sent)
+		}
+	})
+
+	t.Run("login", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := DialIMAP(context.Background(), imapServer(t, nil, make(chan string, 10)), IMAPConfig{
+			Username: "reports", Password: "wrong",
+		})
+		if !errors.Is(err, ErrIMAP) || !strings.Contains(err.Error(), "AUTHENTICATIONFAILED") {
+			t.Fatalf("expected error %v with the response of the server, got %v", ErrIMAP, err)
+		}
+	})
+}
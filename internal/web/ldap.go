@@ -0,0 +1,255 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+const (
+	// ldapTimeout is the maximum duration of each operation, e.g. the bind or a page of a search, unless the context
+	// ends earlier.
+	ldapTimeout = 2 * time.Minute
+
+	// LDAPScopeBase, LDAPScopeOne, and LDAPScopeSub are the scopes of a search: the base object, its children, or
+	// its whole subtree.
+	LDAPScopeBase = goldap.ScopeBaseObject
+	LDAPScopeOne  = goldap.ScopeSingleLevel
+	LDAPScopeSub  = goldap.ScopeWholeSubtree
+)
+
+var (
+	// ErrLDAP is returned when an LDAP operation fails, or the server breaks the protocol.
+	ErrLDAP = errors.New("ldap request failed")
+
+	// ErrLDAPFilter is returned when a search filter is not a valid RFC 4515 filter.
+	ErrLDAPFilter = errors.New("invalid ldap filter")
+)
+
+// LDAPError is returned when an LDAP operation fails, or the server breaks the protocol.
+func LDAPError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrLDAP, reason)
+}
+
+// LDAPFilterError is returned when a search filter is not a valid RFC 4515 filter.
+func LDAPFilterError(filter, reason string) error {
+	return fmt.Errorf("%w %q: %s", ErrLDAPFilter, filter, reason)
+}
+
+// LDAPConfig is the configuration of the connection to an LDAP server.
+type LDAPConfig struct {
+	// TLS connects to the server over TLS, i.e. LDAPS.
+	TLS bool
+
+	// BindDN and Password are the credentials of the simple bind, which is anonymous if they are empty.
+	BindDN   string
+	Password string
+}
+
+// LDAPSearch is a search of the entries of a directory.
+type LDAPSearch struct {
+	// BaseDN is the entry that the search starts at, e.g. "dc=corp,dc=example,dc=com".
+	BaseDN string
+
+	// Scope is the scope of the search, e.g. "LDAPScopeSub".
+	Scope int
+
+	// Filter is the RFC 4515 filter of the entries, e.g. "(&(objectClass=user)(!(cn=krbtgt)))".
+	Filter string
+
+	// Attributes are the attributes returned for each entry, or every user attribute if it is empty.
+	Attributes []string
+
+	// PageSize is the number of entries of each page of a paged search, or zero to search without paging.
+	PageSize int
+
+	// SizeLimit is the number of entries returned by the server, or zero for the limit of the server.
+	SizeLimit int
+}
+
+// LDAPEntry is an entry of the results of a search, with the values of its attributes.
+type LDAPEntry struct {
+	DN         string
+	Attributes []LDAPAttribute
+}
+
+// LDAPAttribute is an attribute of an entry, with its values.
+type LDAPAttribute struct {
+	Name   string
+	Values [][]byte
+}
+
+// LDAPConn is a connection to an LDAP (v3) server, for the searches of directory sources such as Active Directory.
+// Operations are not concurrent: each waits for the response of the server before the next is sent.
+type LDAPConn struct {
+	conn *goldap.Conn
+}
+
+// DialLDAP will connect to the LDAP server at the "host:port" address and bind with the credentials of the
+// configuration.
+func DialLDAP(ctx context.Context, addr string, cfg LDAPConfig) (*LDAPConn, error) {
+	conn, err := (&net.Dialer{Timeout: ldapTimeout}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, LDAPError(fmt.Sprintf("unable to connect to %s: %v", addr, err))
+	}
+
+	if cfg.TLS {
+		host, _, _ := net.SplitHostPort(addr)
+
+		tlsConn := tls.Client(conn, compliance.TLSConfig(host))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+
+			return nil, LDAPError(fmt.Sprintf("tls handshake with %s: %v", addr, err))
+		}
+
+		conn = tlsConn
+	}
+
+	ldap := &LDAPConn{conn: goldap.NewConn(conn, cfg.TLS)}
+	ldap.conn.Start()
+	ldap.conn.SetTimeout(ldapTimeout)
+
+	if err := ldap.bind(cfg.BindDN, cfg.Password); err != nil {
+		ldap.conn.Close()
+
+		return nil, err
+	}
+
+	return ldap, nil
+}
+
+// Close will unbind and close the connection.
+func (ldap *LDAPConn) Close() error {
+	_ = ldap.conn.Unbind()
+
+	return ldap.conn.Close()
+}
+
+// bind will authenticate the connection with a simple bind, which is unauthenticated without a password.
+func (ldap *LDAPConn) bind(dn, password string) error {
+	var err error
+	if password == "" {
+		err = ldap.conn.UnauthenticatedBind(dn)
+	} else {
+		err = ldap.conn.Bind(dn, password)
+	}
+
+	if err != nil {
+		return LDAPError(fmt.Sprintf("unable to bind as %q: %v", dn, err))
+	}
+
+	return nil
+}
+
+// Search will send the search and call the function with each entry of its results, in the order that they are
+// returned. A paged search requests the next page with the cookie of the last, until the server returns no cookie.
+// Search result references, i.e. referrals to other servers, are not followed. A search that exceeds the size limit
+// is not an error, since its results are complete up to the limit.
+func (ldap *LDAPConn) Search(ctx context.Context, search LDAPSearch, entryFn func(LDAPEntry) error) error {
+	filter, err := ParseLDAPFilter(search.Filter)
+	if err != nil {
+		return err
+	}
+
+	req := goldap.NewSearchRequest(search.BaseDN, search.Scope, goldap.NeverDerefAliases, search.SizeLimit, 0, false,
+		filter, search.Attributes, nil)
+
+	var paging *goldap.ControlPaging
+	if search.PageSize > 0 {
+		paging = goldap.NewControlPaging(uint32(search.PageSize))
+		req.Controls = []goldap.Control{paging}
+	}
+
+	for {
+		cookie, err := ldap.page(ctx, req, entryFn)
+		if err != nil {
+			return err
+		}
+
+		if paging == nil || len(cookie) == 0 {
+			return nil
+		}
+
+		paging.SetCookie(cookie)
+	}
+}
+
+// page will read the results of a page of a search until it is done, and return the cookie of the next page, if any.
+func (ldap *LDAPConn) page(ctx context.Context, req *goldap.SearchRequest, entryFn func(LDAPEntry) error) ([]byte,
+	error,
+) {
+	// The search is canceled once the page is read, or if the function fails, so that it does not wait on results
+	// that are not read.
+	ctx, cancel := context.WithTimeout(ctx, ldapTimeout)
+	defer cancel()
+
+	var cookie []byte
+
+	rsp := ldap.conn.SearchAsync(ctx, req, 0)
+	for rsp.Next() {
+		if entry := rsp.Entry(); entry != nil {
+			if err := entryFn(ldapEntry(entry)); err != nil {
+				return nil, err
+			}
+		}
+
+		if control, ok := goldap.FindControl(rsp.Controls(), goldap.ControlTypePaging).(*goldap.ControlPaging); ok {
+			cookie = control.Cookie
+		}
+	}
+
+	if err := rsp.Err(); err != nil && !goldap.IsErrorWithCode(err, goldap.LDAPResultSizeLimitExceeded) {
+		return nil, LDAPError(fmt.Sprintf("unable to search %q: %v", req.BaseDN, err))
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, LDAPError(fmt.Sprintf("unable to search %q: %v", req.BaseDN, err))
+	}
+
+	return cookie, nil
+}
+
+// ldapEntry will return the entry of a search result entry, with the raw values of its attributes.
+func ldapEntry(entry *goldap.Entry) LDAPEntry {
+	result := LDAPEntry{DN: entry.DN, Attributes: make([]LDAPAttribute, 0, len(entry.Attributes))}
+	for _, attr := range entry.Attributes {
+		result.Attributes = append(result.Attributes, LDAPAttribute{Name: attr.Name, Values: attr.ByteValues})
+	}
+
+	return result
+}
+
+// ParseLDAPFilter will validate an RFC 4515 filter string, e.g. "(&(objectClass=user)(mail=*))", and return the
+// filter of a search. A filter that is not enclosed in parentheses is enclosed, e.g. "objectClass=user", and an empty
+// filter matches every entry.
+func ParseLDAPFilter(filter string) (string, error) {
+	text := strings.TrimSpace(filter)
+
+	switch {
+	case text == "":
+		text = "(objectClass=*)"
+	case !strings.HasPrefix(text, "("):
+		text = "(" + text + ")"
+	}
+
+	if _, err := goldap.CompileFilter(text); err != nil {
+		return "", LDAPFilterError(filter, err.Error())
+	}
+
+	return text, nil
+}
@@ -0,0 +1,220 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// ldapResult will return the LDAPResult response of the operation with the result code and diagnostic message.
+func ldapResult(tag ber.Tag, code int64, msg string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, msg, ""))
+
+	return op
+}
+
+// ldapServer will return the address of an LDAP server that accepts a single connection, binds "cn=reader" with the
+// password "secret", and answers paged searches with the entries. The page sizes of the searches are sent on pages.
+func ldapServer(t *testing.T, entries []LDAPEntry, pages chan<- uint32) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		for {
+			msg, err := ber.ReadPacket(conn)
+			if err != nil || len(msg.Children) < 2 {
+				return
+			}
+
+			id, _ := msg.Children[0].Value.(int64)
+
+			reply := func(op *ber.Packet, controls ...goldap.Control) {
+				rsp := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				rsp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+				rsp.AppendChild(op)
+
+				if len(controls) > 0 {
+					packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "")
+					for _, control := range controls {
+						packet.AppendChild(control.Encode())
+					}
+
+					rsp.AppendChild(packet)
+				}
+
+				_, _ = conn.Write(rsp.Bytes())
+			}
+
+			switch op := msg.Children[1]; op.Tag {
+			case goldap.ApplicationBindRequest:
+				code := int64(goldap.LDAPResultSuccess)
+				if op.Children[1].Value != "cn=reader" || op.Children[2].Data.String() != "secret" {
+					code = goldap.LDAPResultInvalidCredentials
+				}
+
+				reply(ldapResult(goldap.ApplicationBindResponse, code, "80090308: LdapErr: DSID-0C09044E, data 52e"))
+			case goldap.ApplicationSearchRequest:
+				control, _ := goldap.DecodeControl(msg.Children[2].Children[0])
+				paging, _ := control.(*goldap.ControlPaging)
+
+				start, _ := strconv.Atoi(string(paging.Cookie))
+				pages <- paging.PagingSize
+
+				end := min(start+int(paging.PagingSize), len(entries))
+
+				for _, entry := range entries[start:end] {
+					attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+
+					for _, attr := range entry.Attributes {
+						values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+						for _, value := range attr.Values {
+							values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString,
+								string(value), ""))
+						}
+
+						packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+						packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString,
+							attr.Name, ""))
+						packet.AppendChild(values)
+						attrs.AppendChild(packet)
+					}
+
+					result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationSearchResultEntry,
+						nil, "")
+					result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString,
+						entry.DN, ""))
+					result.AppendChild(attrs)
+					reply(result)
+
+					ref := ber.Encode(ber.ClassApplication, ber.TypeConstructed,
+						goldap.ApplicationSearchResultReference, nil, "")
+					ref.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString,
+						"ldap://dc2.corp.example/dc=corp", ""))
+					reply(ref)
+				}
+
+				next := goldap.NewControlPaging(0)
+				if end < len(entries) {
+					next.SetCookie([]byte(strconv.Itoa(end)))
+				}
+
+				reply(ldapResult(goldap.ApplicationSearchResultDone, goldap.LDAPResultSuccess, ""), next)
+			case goldap.ApplicationUnbindRequest:
+				return
+			}
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestLDAP(t *testing.T) {
+	t.Parallel()
+
+	t.Run("search", func(t *testing.T) {
+		t.Parallel()
+
+		var entries []LDAPEntry
+		for idx := 0; idx < 5; idx++ {
+			entries = append(entries, LDAPEntry{
+				DN: "cn=user" + strconv.Itoa(idx) + ",dc=corp",
+				Attributes: []LDAPAttribute{
+					{Name: "cn", Values: [][]byte{[]byte("user" + strconv.Itoa(idx))}},
+					{Name: "memberOf", Values: [][]byte{[]byte("cn=a,dc=corp"), []byte("cn=b,dc=corp")}},
+				},
+			})
+		}
+
+		pages := make(chan uint32, 10)
+
+		conn, err := DialLDAP(context.Background(), ldapServer(t, entries, pages), LDAPConfig{
+			BindDN: "cn=reader", Password: "secret",
+		})
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+
+		defer conn.Close()
+
+		var got []LDAPEntry
+
+		err = conn.Search(context.Background(), LDAPSearch{
+			BaseDN: "dc=corp", Scope: LDAPScopeSub, Filter: "(objectClass=user)", PageSize: 2,
+		}, func(entry LDAPEntry) error {
+			got = append(got, entry)
+
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to search: %v", err)
+		}
+
+		if !reflect.DeepEqual(got, entries) {
+			t.Fatalf("expected entries %v, got %v", entries, got)
+		}
+
+		if len(pages) != 3 {
+			t.Fatalf("expected 3 pages of 2 entries, got %d", len(pages))
+		}
+	})
+
+	t.Run("bind", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := DialLDAP(context.Background(), ldapServer(t, nil, nil), LDAPConfig{BindDN: "cn=reader"})
+		if !errors.Is(err, ErrLDAP) || !strings.Contains(err.Error(), "80090308") {
+			t.Fatalf("expected error %v with the diagnostic message, got %v", ErrLDAP, err)
+		}
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		t.Parallel()
+
+		for filter, exp := range map[string]string{
+			"objectClass=user":          "(objectClass=user)",
+			"":                          "(objectClass=*)",
+			"(&(mail=*)(!(cn=a\\2ab)))": "(&(mail=*)(!(cn=a\\2ab)))",
+			"(userAccountControl:1.2.840.113556.1.4.803:=2)": "(userAccountControl:1.2.840.113556.1.4.803:=2)",
+		} {
+			if got, err := ParseLDAPFilter(filter); err != nil || got != exp {
+				t.Fatalf("expected %q for %q, got %q: %v", exp, filter, got, err)
+			}
+		}
+
+		for _, filter := range []string{"(cn=a", "(&(cn=a)", "(cn=a)(sn=b)", `(cn=\zz)`, `(cn=a\2)`} {
+			if _, err := ParseLDAPFilter(filter); !errors.Is(err, ErrLDAPFilter) {
+				t.Fatalf("expected error %v for %q, got %v", ErrLDAPFilter, filter, err)
+			}
+		}
+	})
+}
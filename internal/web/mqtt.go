@@ -0,0 +1,221 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// mqttConnectTimeout is how long the connection to the broker and each subscription are waited for.
+	mqttConnectTimeout = 30 * time.Second
+
+	// mqttMaxReconnectInterval is the longest interval between the attempts to reconnect to the broker.
+	mqttMaxReconnectInterval = 10 * time.Second
+
+	// mqttDisconnectQuiesce is how long the work in flight is waited for when the subscriber is closed, in
+	// milliseconds.
+	mqttDisconnectQuiesce = 250
+
+	// mqttSubscribeFailure is the return code of a subscription refused by the broker.
+	mqttSubscribeFailure = 0x80
+)
+
+var (
+	// ErrMQTT is returned when an MQTT subscriber can not connect or subscribe to the broker.
+	ErrMQTT = errors.New("mqtt subscriber failed")
+
+	// ErrMQTTClosed is returned when the messages of a closed MQTT subscriber are read.
+	ErrMQTTClosed = errors.New("mqtt subscriber closed")
+)
+
+// MQTTError is returned when an MQTT subscriber can not connect or subscribe to the broker.
+func MQTTError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrMQTT, reason)
+}
+
+// MQTTSubscriberConfig is the configuration of an MQTT subscriber.
+type MQTTSubscriberConfig struct {
+	// ClientID identifies the session of the subscriber on the broker.
+	ClientID string
+
+	// Username and Password are sent on the connect, if the broker requires them.
+	Username string
+	Password string
+
+	// CleanSession discards the session on the broker when the subscriber connects. Otherwise the broker resumes
+	// the session of the ClientID, with its subscriptions and the QoS 1 and 2 messages queued while disconnected.
+	CleanSession bool
+
+	// KeepAlive is the keep alive interval of the connection.
+	KeepAlive time.Duration
+
+	// Topics are the QoS of each topic filter subscribed to, which may include the "+" and "#" wildcards.
+	Topics map[string]byte
+}
+
+// MQTTMessage is a message published to a topic that the subscriber is subscribed to.
+type MQTTMessage struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retained bool
+}
+
+// MQTTSubscriber is an MQTT client subscribed to the topics of its configuration. The subscriber reconnects when the
+// connection to the broker is lost, subscribing to the topics again. Messages are handed to a single reader one at a
+// time, and each is acknowledged once it is read. When the subscriber is closed, the message waiting for the reader is
+// dropped, but the QoS 1 and 2 messages after it are delivered again when the session is resumed.
+type MQTTSubscriber struct {
+	client     mqtt.Client
+	topics     map[string]byte
+	messages   chan MQTTMessage
+	subscribed chan error
+
+	done chan struct{}
+	once sync.Once
+}
+
+// DialMQTT will connect to the MQTT broker and subscribe to the topics of the configuration. The broker is a URL of
+// the "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", or "wss" scheme, e.g. "tcp://broker.example:1883".
+func DialMQTT(ctx context.Context, broker string, cfg MQTTSubscriberConfig) (*MQTTSubscriber, error) {
+	uri, err := url.Parse(broker)
+	if err != nil {
+		return nil, MQTTError(fmt.Sprintf("invalid broker %q: %v", broker, err))
+	}
+
+	sub := &MQTTSubscriber{
+		topics:     cfg.Topics,
+		messages:   make(chan MQTTMessage),
+		subscribed: make(chan error, 1),
+		done:       make(chan struct{}),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetCleanSession(cfg.CleanSession).
+		SetKeepAlive(cfg.KeepAlive).
+		SetConnectTimeout(mqttConnectTimeout).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(mqttMaxReconnectInterval).
+		SetResumeSubs(true).
+		SetTLSConfig(compliance.TLSConfig(uri.Hostname())).
+		SetDefaultPublishHandler(sub.receive).
+		SetOnConnectHandler(sub.subscribe)
+
+	sub.client = mqtt.NewClient(opts)
+
+	if err := sub.wait(ctx, sub.client.Connect()); err != nil {
+		sub.client.Disconnect(0)
+
+		return nil, MQTTError(fmt.Sprintf("unable to connect to %s: %v", uri.Redacted(), err))
+	}
+
+	select {
+	case err := <-sub.subscribed:
+		if err != nil {
+			sub.client.Disconnect(0)
+
+			return nil, err
+		}
+	case <-ctx.Done():
+		sub.client.Disconnect(0)
+
+		return nil, ctx.Err()
+	}
+
+	return sub, nil
+}
+
+// wait will wait for the token to complete, or the context to be done.
+func (sub *MQTTSubscriber) wait(ctx context.Context, token mqtt.Token) error {
+	timer := time.NewTimer(mqttConnectTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-timer.C:
+		return fmt.Errorf("timed out after %v", mqttConnectTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// subscribe will subscribe to the topics each time the subscriber connects to the broker. A broker that resumed the
+// session already has the subscriptions, but subscribing again is harmless and covers a session that expired. The
+// result of the first subscription is returned by DialMQTT.
+func (sub *MQTTSubscriber) subscribe(client mqtt.Client) {
+	token := client.SubscribeMultiple(sub.topics, sub.receive)
+
+	err := sub.wait(context.Background(), token)
+	if err == nil {
+		for filter, code := range token.(*mqtt.SubscribeToken).Result() {
+			if code == mqttSubscribeFailure {
+				err = fmt.Errorf("subscription to %q refused", filter)
+
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		err = MQTTError(err.Error())
+	}
+
+	select {
+	case sub.subscribed <- err:
+	default:
+	}
+}
+
+// receive will hand a message to the reader. The client acknowledges the message once it returns, so it blocks until
+// the message is read or the subscriber is closed.
+func (sub *MQTTSubscriber) receive(_ mqtt.Client, msg mqtt.Message) {
+	select {
+	case sub.messages <- MQTTMessage{
+		Topic:    msg.Topic(),
+		Payload:  msg.Payload(),
+		QoS:      msg.Qos(),
+		Retained: msg.Retained(),
+	}:
+	case <-sub.done:
+	}
+}
+
+// ReadMessage will return the next message published to the topics of the subscriber.
+func (sub *MQTTSubscriber) ReadMessage() (MQTTMessage, error) {
+	select {
+	case msg := <-sub.messages:
+		return msg, nil
+	case <-sub.done:
+		return MQTTMessage{}, ErrMQTTClosed
+	}
+}
+
+// Close will disconnect from the broker. Unless the session is clean, the broker keeps the subscriptions of the
+// session, and queues the QoS 1 and 2 messages published until the ClientID connects again.
+func (sub *MQTTSubscriber) Close() error {
+	sub.once.Do(func() {
+		close(sub.done)
+		sub.client.Disconnect(mqttDisconnectQuiesce)
+	})
+
+	return nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// mqttBroker will return the URL of a broker that serves a connection for each of the sessions, publishing the
+// messages of the session once the subscriber subscribes. Every connection but the last is dropped after its
+// messages are published. The connect of each connection is sent to connects, and the id of each acknowledged message
+// to acks. Subscriptions to "refused/#" are refused.
+func mqttBroker(t *testing.T, connects chan<- *packets.ConnectPacket, acks chan<- uint16,
+	sessions ...[]*packets.PublishPacket,
+) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for idx, messages := range sessions {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			serveMQTT(conn, connects, acks, idx > 0, messages, idx < len(sessions)-1)
+		}
+	}()
+
+	return "tcp://" + listener.Addr().String()
+}
+
+// serveMQTT will serve the connection of a subscriber, as the broker.
+func serveMQTT(conn net.Conn, connects chan<- *packets.ConnectPacket, acks chan<- uint16, resumed bool,
+	messages []*packets.PublishPacket, drop bool,
+) {
+	defer conn.Close()
+
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		switch packet := packet.(type) {
+		case *packets.ConnectPacket:
+			connects <- packet
+
+			connack, _ := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			connack.SessionPresent = resumed && !packet.CleanSession
+			_ = connack.Write(conn)
+		case *packets.SubscribePacket:
+			suback, _ := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = packet.MessageID
+
+			for idx, topic := range packet.Topics {
+				code := packet.Qoss[idx]
+				if topic == "refused/#" {
+					code = mqttSubscribeFailure
+				}
+
+				suback.ReturnCodes = append(suback.ReturnCodes, code)
+			}
+
+			_ = suback.Write(conn)
+
+			for _, msg := range messages {
+				_ = msg.Write(conn)
+			}
+
+			if drop {
+				return
+			}
+		case *packets.PubackPacket:
+			acks <- packet.MessageID
+		case *packets.PingreqPacket:
+			_ = packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// mqttPublish will return a QoS 1 message published to the topic.
+func mqttPublish(id uint16, topic, payload string) *packets.PublishPacket {
+	msg, _ := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	msg.MessageID = id
+	msg.Qos = 1
+	msg.TopicName = topic
+	msg.Payload = []byte(payload)
+
+	return msg
+}
+
+func TestMQTTSubscriber(t *testing.T) {
+	t.Parallel()
+
+	cfg := MQTTSubscriberConfig{
+		ClientID:  "gidari-sensors",
+		KeepAlive: time.Minute,
+		Topics:    map[string]byte{"sensors/+/temperature": 1},
+	}
+
+	t.Run("subscribe", func(t *testing.T) {
+		t.Parallel()
+
+		connects := make(chan *packets.ConnectPacket, 1)
+		acks := make(chan uint16, 1)
+		broker := mqttBroker(t, connects, acks, []*packets.PublishPacket{
+			mqttPublish(7, "sensors/kitchen/temperature", `{"celsius":21.5}`),
+		})
+
+		sub, err := DialMQTT(context.Background(), broker, cfg)
+		if err != nil {
+			t.Fatalf("failed to dial broker: %v", err)
+		}
+
+		defer sub.Close()
+
+		if connect := <-connects; connect.ClientIdentifier != cfg.ClientID || connect.CleanSession {
+			t.Fatalf("expected a persistent session of %q, got %v", cfg.ClientID, connect)
+		}
+
+		msg, err := sub.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+
+		exp := MQTTMessage{Topic: "sensors/kitchen/temperature", Payload: []byte(`{"celsius":21.5}`), QoS: 1}
+		if !reflect.DeepEqual(msg, exp) {
+			t.Fatalf("expected message %v, got %v", exp, msg)
+		}
+
+		select {
+		case id := <-acks:
+			if id != 7 {
+				t.Fatalf("expected message 7 to be acknowledged, got %d", id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the message to be acknowledged once read")
+		}
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		t.Parallel()
+
+		connects := make(chan *packets.ConnectPacket, 2)
+		acks := make(chan uint16, 2)
+		broker := mqttBroker(t, connects, acks,
+			[]*packets.PublishPacket{mqttPublish(1, "sensors/kitchen/temperature", "21.5")},
+			[]*packets.PublishPacket{mqttPublish(2, "sensors/garage/temperature", "12.25")},
+		)
+
+		sub, err := DialMQTT(context.Background(), broker, cfg)
+		if err != nil {
+			t.Fatalf("failed to dial broker: %v", err)
+		}
+
+		defer sub.Close()
+
+		var topics []string
+
+		for len(topics) < 2 {
+			msg, err := sub.ReadMessage()
+			if err != nil {
+				t.Fatalf("failed to read message: %v", err)
+			}
+
+			topics = append(topics, msg.Topic)
+		}
+
+		if exp := []string{"sensors/kitchen/temperature", "sensors/garage/temperature"}; !reflect.DeepEqual(topics, exp) {
+			t.Fatalf("expected the messages of both connections %v, got %v", exp, topics)
+		}
+
+		<-connects
+
+		if connect := <-connects; connect.ClientIdentifier != cfg.ClientID || connect.CleanSession {
+			t.Fatalf("expected the session of %q to be resumed, got %v", cfg.ClientID, connect)
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		t.Parallel()
+
+		connects := make(chan *packets.ConnectPacket, 1)
+		broker := mqttBroker(t, connects, nil, nil)
+
+		refused := cfg
+		refused.Topics = map[string]byte{"refused/#": 0}
+
+		if _, err := DialMQTT(context.Background(), broker, refused); !errors.Is(err, ErrMQTT) {
+			t.Fatalf("expected error %v, got %v", ErrMQTT, err)
+		}
+	})
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrInvalidRedisURL is returned when the URL of the Redis server of a shared rate limit is invalid.
+	ErrInvalidRedisURL = errors.New("invalid redis url")
+
+	// ErrSharedRateLimit is returned when a request fails to reserve a token from the shared rate limit.
+	ErrSharedRateLimit = errors.New("failed to reserve shared rate limit")
+)
+
+// InvalidRedisURLError is returned when the URL of the Redis server of a shared rate limit is invalid.
+func InvalidRedisURLError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidRedisURL, reason)
+}
+
+// SharedRateLimitError is returned when a request fails to reserve a token from the shared rate limit.
+func SharedRateLimitError(err error) error {
+	return fmt.Errorf("%w: %v", ErrSharedRateLimit, err)
+}
+
+// redisTokenBucket is the Lua script that reserves a token from the token bucket stored in the hash KEYS[1], with a
+// capacity of ARGV[1] tokens refilled at one token every ARGV[2] microseconds. The bucket is refilled by the time of
+// the Redis server, so the clocks of the processes sharing the bucket do not need to agree. The script returns the
+// number of microseconds to wait before the reserved token can be used.
+var redisTokenBucket = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) / interval)
+	ts = now
+end
+tokens = tokens - 1
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', ts)
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) * interval / 1000) + 1000)
+if tokens >= 0 then
+	return 0
+end
+return math.ceil(-tokens * interval)
+`)
+
+// RedisLimiter is a rate limiter whose token bucket is stored in Redis, so that every process that uses the same
+// bucket respects a single rate limit, e.g. a fleet of gidari instances sharing the quota of a web API. Tokens are
+// reserved atomically by a Lua script, and a request waits until its reserved token is available.
+type RedisLimiter struct {
+	client *redis.Client
+
+	key      string
+	burst    int
+	interval time.Duration
+}
+
+// NewRedisLimiter will return a rate limiter that allows a burst of requests, refilled at one request every
+// interval, shared by every process that uses the same key on the Redis server. The Redis server is set by a URL,
+// i.e. "redis://[[user]:password@]host[:port][/db]", or "rediss://" to connect with TLS. The server is not connected
+// to until the first request.
+func NewRedisLimiter(redisURL, key string, interval time.Duration, burst int) (*RedisLimiter, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, InvalidRedisURLError(err.Error())
+	}
+
+	if opts.TLSConfig != nil {
+		opts.TLSConfig = compliance.TLSConfig(opts.TLSConfig.ServerName)
+	}
+
+	if key == "" {
+		return nil, InvalidRedisURLError("missing key")
+	}
+
+	if interval <= 0 || burst <= 0 {
+		return nil, InvalidRedisURLError("the interval and burst must be positive")
+	}
+
+	return &RedisLimiter{client: redis.NewClient(opts), key: key, burst: burst, interval: interval}, nil
+}
+
+// Wait will reserve a token from the shared token bucket, and wait until the token is available or the context is
+// done.
+func (limiter *RedisLimiter) Wait(ctx context.Context) error {
+	wait, err := limiter.reserve(ctx)
+	if err != nil {
+		return SharedRateLimitError(err)
+	}
+
+	return sleep(ctx, wait)
+}
+
+// Close will close the connection to the Redis server.
+func (limiter *RedisLimiter) Close() {
+	if limiter == nil {
+		return
+	}
+
+	limiter.client.Close()
+}
+
+// reserve will reserve a token from the token bucket and return how long to wait before using it. The script is run
+// by its digest, and only sent when the server does not have it cached yet.
+func (limiter *RedisLimiter) reserve(ctx context.Context) (time.Duration, error) {
+	micros, err := redisTokenBucket.Run(ctx, limiter.client, []string{limiter.key}, limiter.burst,
+		limiter.interval.Microseconds()).Int64()
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(micros) * time.Microsecond, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisLimiter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tcase := range []struct{ url, key string }{{"http://redis1", "key"}, {"redis://redis1", ""}} {
+			if _, err := NewRedisLimiter(tcase.url, tcase.key, time.Second, 5); !errors.Is(err, ErrInvalidRedisURL) {
+				t.Fatalf("expected invalid redis url error for %+v, got %v", tcase, err)
+			}
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		t.Parallel()
+
+		srv := miniredis.RunT(t)
+		srv.RequireAuth("secret")
+
+		limiter, err := NewRedisLimiter("redis://:secret@"+srv.Addr()+"/1", "gidari:test", 50*time.Millisecond, 1)
+		if err != nil {
+			t.Fatalf("failed to create limiter: %v", err)
+		}
+		defer limiter.Close()
+
+		start := time.Now()
+
+		for i := 0; i < 2; i++ {
+			if err := limiter.Wait(context.Background()); err != nil {
+				t.Fatalf("failed to wait: %v", err)
+			}
+		}
+
+		if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+			t.Fatalf("expected to wait for the reserved token, waited %v", elapsed)
+		}
+
+		srv.Select(1)
+
+		if !srv.Exists("gidari:test") {
+			t.Fatalf("expected the token bucket in the selected database, got keys %v", srv.Keys())
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+
+		srv := miniredis.RunT(t)
+		srv.SetError("ERR unavailable")
+
+		limiter, err := NewRedisLimiter("redis://"+srv.Addr(), "gidari:test", time.Second, 1)
+		if err != nil {
+			t.Fatalf("failed to create limiter: %v", err)
+		}
+		defer limiter.Close()
+
+		if err := limiter.Wait(context.Background()); !errors.Is(err, ErrSharedRateLimit) {
+			t.Fatalf("expected shared rate limit error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// retryBaseWait is the wait before the first retry of a request, doubled for every later retry.
+	retryBaseWait = time.Second
+
+	// retryMaxWait is the maximum wait before retrying a request, unless the server asks for longer.
+	retryMaxWait = 30 * time.Second
+)
+
+// retryCause will return the error to retry the request for, or nil if the request should not be retried. Requests
+// are retried for transport errors, e.g. a reset connection, and for responses that the server is overloaded or
+// temporarily unavailable.
+func retryCause(ctx context.Context, rsp *http.Response, err error) error {
+	if err != nil {
+		// A canceled run is not retried.
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		return err
+	}
+
+	switch rsp.StatusCode {
+	case
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return fmt.Errorf("%w: %v", ErrGettingResponse, rsp.Status)
+	}
+
+	return nil
+}
+
+// retryWait will return how long to wait before the retry of the attempt, i.e. the "Retry-After" header of the
+// response if the server sent one, or an exponential backoff otherwise.
+func retryWait(attempt int, rsp *http.Response) time.Duration {
+	if rsp != nil {
+		if after := rsp.Header.Get("Retry-After"); after != "" {
+			if seconds, err := strconv.Atoi(after); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second
+			}
+
+			if date, err := http.ParseTime(after); err == nil {
+				if wait := time.Until(date); wait > 0 {
+					return wait
+				}
+
+				return 0
+			}
+		}
+	}
+
+	wait := retryBaseWait
+	for i := 0; i < attempt && wait < retryMaxWait; i++ {
+		wait *= 2
+	}
+
+	if wait > retryMaxWait {
+		wait = retryMaxWait
+	}
+
+	return wait
+}
+
+// sleep will wait for the duration, or until the context is done.
+func sleep(ctx context.Context, wait time.Duration) error {
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("retry canceled: %w", ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/tools"
+	"golang.org/x/time/rate"
+)
+
+// flakyServer will return a server that responds with 503 to the first "failures" requests, asking to be retried
+// immediately, and the number of requests it has received.
+func flakyServer(t *testing.T, failures int32) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var requests int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &requests
+}
+
+func TestFetchRetry(t *testing.T) {
+	t.Parallel()
+
+	fetch := func(ctx context.Context, srv *httptest.Server) (*FetchResponse, error) {
+		uri, _ := url.Parse(srv.URL)
+
+		return Fetch(ctx, &FetchConfig{
+			C:           &Client{Client: *srv.Client()},
+			Method:      http.MethodGet,
+			URL:         uri,
+			RateLimiter: rate.NewLimiter(rate.Inf, 1),
+		})
+	}
+
+	t.Run("no budget", func(t *testing.T) {
+		t.Parallel()
+
+		srv, requests := flakyServer(t, 1)
+
+		rsp, err := fetch(context.Background(), srv)
+		if err != nil {
+			t.Fatalf("failed to fetch: %v", err)
+		}
+		rsp.Body.Close()
+
+		if *requests != 1 {
+			t.Fatalf("expected the request not to be retried without a budget, got %d requests", *requests)
+		}
+	})
+
+	t.Run("retried within budget", func(t *testing.T) {
+		t.Parallel()
+
+		srv, requests := flakyServer(t, 2)
+		budget := tools.NewRetryBudget(5, 0)
+
+		rsp, err := fetch(tools.ContextWithRetryBudget(context.Background(), budget), srv)
+		if err != nil {
+			t.Fatalf("failed to fetch: %v", err)
+		}
+		defer rsp.Body.Close()
+
+		if body, _ := io.ReadAll(rsp.Body); string(body) != `{"ok":true}` {
+			t.Fatalf("unexpected body %q", body)
+		}
+
+		if retries, _ := budget.Spent(); *requests != 3 || retries != 2 {
+			t.Fatalf("expected 3 requests and 2 retries, got %d requests and %d retries", *requests, retries)
+		}
+	})
+
+	t.Run("budget exhausted", func(t *testing.T) {
+		t.Parallel()
+
+		srv, requests := flakyServer(t, 100)
+		budget := tools.NewRetryBudget(3, 0)
+
+		if _, err := fetch(tools.ContextWithRetryBudget(context.Background(), budget), srv); !errors.Is(err,
+			tools.ErrRetryBudgetExhausted) {
+			t.Fatalf("expected the retry budget to be exhausted, got %v", err)
+		}
+
+		if *requests != 4 {
+			t.Fatalf("expected 4 requests, got %d", *requests)
+		}
+	})
+}
+
+func TestRetryWait(t *testing.T) {
+	t.Parallel()
+
+	for _, tcase := range []struct {
+		attempt int
+		after   string
+		want    time.Duration
+	}{
+		{attempt: 0, want: time.Second},
+		{attempt: 3, want: 8 * time.Second},
+		{attempt: 10, want: retryMaxWait},
+		{attempt: 10, after: "2", want: 2 * time.Second},
+		{attempt: 0, after: "Wed, 21 Oct 2015 07:28:00 GMT", want: 0},
+	} {
+		rsp := &http.Response{Header: http.Header{}}
+		if tcase.after != "" {
+			rsp.Header.Set("Retry-After", tcase.after)
+		}
+
+		if got := retryWait(tcase.attempt, rsp); got != tcase.want {
+			t.Errorf("attempt %d after %q: expected %v, got %v", tcase.attempt, tcase.after, tcase.want, got)
+		}
+	}
+}
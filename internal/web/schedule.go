@@ -0,0 +1,170 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// resetEpochThreshold is the smallest rate limit reset that is a Unix time, rather than a number of seconds until the
+// reset, e.g. GitHub sends "X-RateLimit-Reset" as a Unix time and the IETF "RateLimit-Reset" is a number of seconds.
+const resetEpochThreshold = 1_000_000_000
+
+// ResponseObserver is a rate limiter that adjusts to the rate limit headers of the responses of the web API.
+type ResponseObserver interface {
+	ObserveResponse(rsp *http.Response)
+}
+
+// WindowScheduler is a rate limiter for web APIs with fixed-window rate limits, e.g. 100 requests per minute that
+// reset at the start of every minute. Instead of bursting through the limit and sleeping until the window resets,
+// the scheduler spreads the requests of each window evenly across it, one every window divided by the limit.
+//
+// Windows are aligned to the clock, e.g. a one minute window starts at the start of every minute. If the web API
+// reports when its window resets, with the "X-RateLimit-Reset" or "RateLimit-Reset" header, the windows are aligned
+// to the reset instead. A response with no remaining requests, i.e. "X-RateLimit-Remaining: 0" or
+// "RateLimit-Remaining: 0", ends the current window early.
+type WindowScheduler struct {
+	limit    int
+	window   time.Duration
+	interval time.Duration
+
+	mtx sync.Mutex
+
+	// start is the start of the current window, and next is the index of the next slot in the window.
+	start time.Time
+	next  int
+
+	// now is the clock of the scheduler.
+	now func() time.Time
+}
+
+// NewWindowScheduler will return a scheduler for a web API that allows "limit" requests per window.
+func NewWindowScheduler(limit int, window time.Duration) *WindowScheduler {
+	if limit < 1 {
+		limit = 1
+	}
+
+	return &WindowScheduler{
+		limit:    limit,
+		window:   window,
+		interval: window / time.Duration(limit),
+		now:      time.Now,
+	}
+}
+
+// Wait will wait until the next slot of the schedule, or until the context is done.
+func (sched *WindowScheduler) Wait(ctx context.Context) error {
+	at := sched.reserve()
+
+	return sleep(ctx, time.Until(at))
+}
+
+// ObserveResponse will align the windows of the schedule to the rate limit headers of the response.
+func (sched *WindowScheduler) ObserveResponse(rsp *http.Response) {
+	if rsp == nil {
+		return
+	}
+
+	sched.mtx.Lock()
+	defer sched.mtx.Unlock()
+
+	now := sched.now()
+
+	if reset, ok := parseRateLimitReset(rsp.Header, now); ok && reset.After(now) {
+		// The current window ends at the reset.
+		sched.start = reset.Add(-sched.window)
+		sched.next = sched.slot(now)
+	}
+
+	if remaining := firstHeader(rsp.Header, "X-RateLimit-Remaining", "RateLimit-Remaining"); remaining == "0" {
+		sched.next = sched.limit
+	}
+}
+
+// reserve will reserve the next slot of the schedule and return its time.
+func (sched *WindowScheduler) reserve() time.Time {
+	sched.mtx.Lock()
+	defer sched.mtx.Unlock()
+
+	now := sched.now()
+
+	if sched.start.IsZero() {
+		sched.start = now.Truncate(sched.window)
+		sched.next = sched.slot(now)
+	}
+
+	// Move to the window that contains the current time, skipping the slots of the window that have passed.
+	if elapsed := now.Sub(sched.start); elapsed >= sched.window {
+		sched.start = sched.start.Add(elapsed / sched.window * sched.window)
+		sched.next = sched.slot(now)
+	}
+
+	// If the current window is full, the request waits for the start of the next window.
+	if sched.next >= sched.limit {
+		sched.start = sched.start.Add(sched.window)
+		sched.next = 0
+	}
+
+	at := sched.start.Add(time.Duration(sched.next) * sched.interval)
+	sched.next++
+
+	if at.Before(now) {
+		return now
+	}
+
+	return at
+}
+
+// slot will return the index of the first slot of the current window at or after the time.
+func (sched *WindowScheduler) slot(at time.Time) int {
+	elapsed := at.Sub(sched.start)
+	if elapsed <= 0 {
+		return 0
+	}
+
+	slot := int((elapsed + sched.interval - 1) / sched.interval)
+	if slot > sched.limit {
+		return sched.limit
+	}
+
+	return slot
+}
+
+// parseRateLimitReset will return the time that the rate limit window of the web API resets, if the headers have it.
+func parseRateLimitReset(header http.Header, now time.Time) (time.Time, bool) {
+	value := firstHeader(header, "X-RateLimit-Reset", "RateLimit-Reset")
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	reset, err := strconv.ParseFloat(value, 64)
+	if err != nil || reset < 0 {
+		return time.Time{}, false
+	}
+
+	if reset >= resetEpochThreshold {
+		return time.Unix(0, int64(reset*float64(time.Second))), true
+	}
+
+	return now.Add(time.Duration(reset * float64(time.Second))), true
+}
+
+// firstHeader will return the value of the first of the headers that is set.
+func firstHeader(header http.Header, keys ...string) string {
+	for _, key := range keys {
+		if value := header.Get(key); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWindowScheduler(t *testing.T) {
+	t.Parallel()
+
+	// minute is the start of a one minute window.
+	minute := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	newScheduler := func(now *time.Time) *WindowScheduler {
+		sched := NewWindowScheduler(4, time.Minute)
+		sched.now = func() time.Time { return *now }
+
+		return sched
+	}
+
+	t.Run("spread across window", func(t *testing.T) {
+		t.Parallel()
+
+		now := minute
+		sched := newScheduler(&now)
+
+		for idx, exp := range []time.Duration{0, 15 * time.Second, 30 * time.Second, 45 * time.Second, time.Minute,
+			75 * time.Second} {
+			if at := sched.reserve(); !at.Equal(minute.Add(exp)) {
+				t.Fatalf("expected slot %d at %v, got %v", idx, exp, at.Sub(minute))
+			}
+		}
+	})
+
+	t.Run("aligned to the clock", func(t *testing.T) {
+		t.Parallel()
+
+		now := minute.Add(20 * time.Second)
+		sched := newScheduler(&now)
+
+		// The slots of the window that have passed are skipped, rather than burst.
+		for _, exp := range []time.Duration{30 * time.Second, 45 * time.Second, time.Minute} {
+			if at := sched.reserve(); !at.Equal(minute.Add(exp)) {
+				t.Fatalf("expected slot at %v, got %v", exp, at.Sub(minute))
+			}
+		}
+	})
+
+	t.Run("late requests are not delayed", func(t *testing.T) {
+		t.Parallel()
+
+		now := minute
+		sched := newScheduler(&now)
+		sched.reserve()
+
+		now = minute.Add(20 * time.Second)
+		if at := sched.reserve(); !at.Equal(now) {
+			t.Fatalf("expected the late slot now, got %v", at.Sub(minute))
+		}
+	})
+
+	t.Run("aligned to the reset", func(t *testing.T) {
+		t.Parallel()
+
+		now := minute
+		sched := newScheduler(&now)
+
+		rsp := &http.Response{Header: http.Header{}}
+		rsp.Header.Set("X-RateLimit-Reset", strconv.FormatInt(minute.Add(30*time.Second).Unix(), 10))
+		sched.ObserveResponse(rsp)
+
+		// The window started 30 seconds ago, so its first two slots have passed.
+		for _, exp := range []time.Duration{0, 15 * time.Second, 30 * time.Second} {
+			if at := sched.reserve(); !at.Equal(minute.Add(exp)) {
+				t.Fatalf("expected slot at %v, got %v", exp, at.Sub(minute))
+			}
+		}
+
+		rsp.Header.Del("X-RateLimit-Reset")
+		rsp.Header.Set("RateLimit-Remaining", "0")
+		sched.ObserveResponse(rsp)
+
+		if at := sched.reserve(); !at.Equal(minute.Add(90 * time.Second)) {
+			t.Fatalf("expected the next window after no remaining requests, got %v", at.Sub(minute))
+		}
+	})
+
+	t.Run("reset seconds", func(t *testing.T) {
+		t.Parallel()
+
+		header := http.Header{}
+		header.Set("RateLimit-Reset", "12")
+
+		if reset, ok := parseRateLimitReset(header, minute); !ok || !reset.Equal(minute.Add(12*time.Second)) {
+			t.Fatalf("expected the reset in 12 seconds, got %v", reset)
+		}
+	})
+}
@@ -0,0 +1,328 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	// SNMPVersion1 and SNMPVersion2c are the versions of the SNMP messages, as they are encoded on the wire.
+	SNMPVersion1  = int(gosnmp.Version1)
+	SNMPVersion2c = int(gosnmp.Version2c)
+
+	// snmpDefaultTimeout is the timeout of each request when the configuration has none.
+	snmpDefaultTimeout = 5 * time.Second
+
+	// snmpMaxGetOIDs is the number of OIDs of each get request, to keep the responses within a datagram.
+	snmpMaxGetOIDs = 16
+)
+
+// ErrSNMP is returned when an SNMP request fails, or the agent breaks the protocol.
+var ErrSNMP = errors.New("snmp request failed")
+
+// SNMPError is returned when an SNMP request fails, or the agent breaks the protocol.
+func SNMPError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrSNMP, reason)
+}
+
+// SNMPConfig is the configuration of the requests to an SNMP agent.
+type SNMPConfig struct {
+	// Version is the version of the messages, "SNMPVersion1" or "SNMPVersion2c".
+	Version int
+
+	// Community is the community string of the agent, e.g. "public".
+	Community string
+
+	// Timeout is the time waited for each response, five seconds by default.
+	Timeout time.Duration
+
+	// Retries is the number of times a request is sent again when the agent does not respond.
+	Retries int
+
+	// MaxRepetitions is the number of rows requested by each get bulk request of a walk. Walks use get next requests
+	// when it is zero, or the version is "SNMPVersion1".
+	MaxRepetitions int
+}
+
+// SNMPVarbind is a variable binding of a response, with the OID of the variable and its value. The value is an int64
+// for an INTEGER, a uint64 for a Counter32, Gauge32, TimeTicks, UInteger32, or Counter64, and a string for an OCTET
+// STRING, an OBJECT IDENTIFIER, or an IpAddress. An OCTET STRING that is not printable, e.g. a MAC address, is
+// written as hex with colons, e.g. "00:1a:2b:3c:4d:5e". The value is nil for a NULL, or a variable the agent does
+// not have.
+type SNMPVarbind struct {
+	OID   string
+	Value interface{}
+}
+
+// SNMPConn is a connection to an SNMP agent over UDP, with the gosnmp client. Requests are not concurrent: each
+// waits for the response of the agent before the next is sent.
+type SNMPConn struct {
+	client *gosnmp.GoSNMP
+}
+
+// DialSNMP will return a connection to the SNMP agent at "addr", e.g. "10.0.0.1:161".
+func DialSNMP(ctx context.Context, addr string, cfg SNMPConfig) (*SNMPConn, error) {
+	if cfg.Version != SNMPVersion1 && cfg.Version != SNMPVersion2c {
+		return nil, SNMPError(fmt.Sprintf("unsupported version %d", cfg.Version))
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = snmpDefaultTimeout
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, SNMPError(err.Error())
+	}
+
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, SNMPError(fmt.Sprintf("invalid port %q", port))
+	}
+
+	client := &gosnmp.GoSNMP{
+		Context:        ctx,
+		Target:         host,
+		Port:           uint16(portNumber),
+		Transport:      "udp",
+		Community:      cfg.Community,
+		Version:        gosnmp.SnmpVersion(cfg.Version),
+		Timeout:        cfg.Timeout,
+		Retries:        cfg.Retries,
+		MaxOids:        snmpMaxGetOIDs,
+		MaxRepetitions: uint32(max(cfg.MaxRepetitions, 0)),
+	}
+
+	if err := client.Connect(); err != nil {
+		return nil, SNMPError(err.Error())
+	}
+
+	return &SNMPConn{client: client}, nil
+}
+
+// Close will close the connection.
+func (snmp *SNMPConn) Close() error {
+	return snmp.client.Conn.Close()
+}
+
+// Get will return the varbinds of the OIDs, in the order of the OIDs. The value of an OID that the agent does not
+// have is nil.
+func (snmp *SNMPConn) Get(ctx context.Context, oids []string) ([]SNMPVarbind, error) {
+	snmp.client.Context = ctx
+
+	varbinds := make([]SNMPVarbind, 0, len(oids))
+
+	for start := 0; start < len(oids); start += snmpMaxGetOIDs {
+		chunk, err := snmp.get(oids[start:min(start+snmpMaxGetOIDs, len(oids))])
+		if err != nil {
+			return nil, err
+		}
+
+		varbinds = append(varbinds, chunk...)
+	}
+
+	return varbinds, nil
+}
+
+// get will return the varbinds of the OIDs of a single get request. An SNMPv1 agent fails the whole request for an
+// OID it does not have, so the OID is dropped from the request and it is sent again.
+func (snmp *SNMPConn) get(oids []string) ([]SNMPVarbind, error) {
+	varbinds := make([]SNMPVarbind, len(oids))
+	pending := make([]int, len(oids))
+
+	for idx, oid := range oids {
+		if _, err := ParseSNMPOID(oid); err != nil {
+			return nil, err
+		}
+
+		varbinds[idx].OID = oid
+		pending[idx] = idx
+	}
+
+	for len(pending) > 0 {
+		request := make([]string, len(pending))
+		for idx, pos := range pending {
+			request[idx] = oids[pos]
+		}
+
+		rsp, err := snmp.client.Get(request)
+		if err != nil {
+			return nil, SNMPError(err.Error())
+		}
+
+		index := int(rsp.ErrorIndex)
+		if rsp.Error == gosnmp.NoSuchName && index > 0 && index <= len(pending) {
+			pending = append(pending[:index-1], pending[index:]...)
+
+			continue
+		}
+
+		if rsp.Error != gosnmp.NoError {
+			return nil, snmpStatusError(rsp.Error, index, request)
+		}
+
+		if len(rsp.Variables) != len(pending) {
+			return nil, SNMPError(fmt.Sprintf("expected %d varbinds in the response, got %d", len(pending),
+				len(rsp.Variables)))
+		}
+
+		for idx, pos := range pending {
+			varbinds[pos].Value = snmpValue(rsp.Variables[idx])
+		}
+
+		break
+	}
+
+	return varbinds, nil
+}
+
+// Walk will call "varbindFn" with each varbind of the subtree of the OID, e.g. each row of a column of a table, in
+// the order of their OIDs. Walks use get bulk requests of "MaxRepetitions" rows for version 2c, and get next requests
+// otherwise.
+func (snmp *SNMPConn) Walk(ctx context.Context, root string, varbindFn func(SNMPVarbind) error) error {
+	if _, err := ParseSNMPOID(root); err != nil {
+		return err
+	}
+
+	snmp.client.Context = ctx
+
+	walk := snmp.client.Walk
+	if snmp.client.Version == gosnmp.Version2c && snmp.client.MaxRepetitions > 0 {
+		walk = snmp.client.BulkWalk
+	}
+
+	var fnErr error
+
+	err := walk(root, func(pdu gosnmp.SnmpPDU) error {
+		fnErr = varbindFn(SNMPVarbind{OID: strings.TrimPrefix(pdu.Name, "."), Value: snmpValue(pdu)})
+
+		return fnErr
+	})
+
+	switch {
+	case fnErr != nil:
+		return fnErr
+	case err != nil:
+		return SNMPError(err.Error())
+	default:
+		return nil
+	}
+}
+
+// snmpStatusError will return the error of a response with an error status, e.g. "noAccess".
+func snmpStatusError(status gosnmp.SNMPError, index int, oids []string) error {
+	name := status.String()
+	if name != "" {
+		name = strings.ToLower(name[:1]) + name[1:]
+	}
+
+	if index > 0 && index <= len(oids) {
+		return SNMPError(fmt.Sprintf("error status %s for %s", name, oids[index-1]))
+	}
+
+	return SNMPError("error status " + name)
+}
+
+// snmpValue will decode the value of a varbind.
+func snmpValue(pdu gosnmp.SnmpPDU) interface{} {
+	switch pdu.Type {
+	case gosnmp.Integer:
+		return gosnmp.ToBigInt(pdu.Value).Int64()
+	case gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Uinteger32, gosnmp.Counter64:
+		return gosnmp.ToBigInt(pdu.Value).Uint64()
+	case gosnmp.OctetString:
+		data, _ := pdu.Value.([]byte)
+		if snmpPrintable(data) {
+			return string(data)
+		}
+
+		return snmpHex(data)
+	case gosnmp.Opaque:
+		if data, ok := pdu.Value.([]byte); ok {
+			return snmpHex(data)
+		}
+
+		return pdu.Value
+	case gosnmp.OpaqueFloat, gosnmp.OpaqueDouble:
+		return pdu.Value
+	case gosnmp.ObjectIdentifier:
+		oid, _ := pdu.Value.(string)
+
+		return strings.TrimPrefix(oid, ".")
+	case gosnmp.IPAddress:
+		return pdu.Value
+	default:
+		// NULL, and the exceptions for variables that the agent does not have.
+		return nil
+	}
+}
+
+// snmpPrintable will return true if the octet string is printable text, e.g. an interface description, rather than
+// binary data such as a MAC address.
+func snmpPrintable(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+
+	// Agents often pad strings with a trailing NUL.
+	text := strings.TrimRight(string(data), "\x00")
+
+	for _, r := range text {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// snmpHex will format the bytes as hex separated by colons, e.g. "00:1a:2b:3c:4d:5e".
+func snmpHex(data []byte) string {
+	parts := make([]string, len(data))
+	for idx, b := range data {
+		parts[idx] = fmt.Sprintf("%02x", b)
+	}
+
+	return strings.Join(parts, ":")
+}
+
+// ParseSNMPOID will parse a dotted OID, e.g. "1.3.6.1.2.1.1.3.0". A leading dot is allowed.
+func ParseSNMPOID(oid string) ([]uint32, error) {
+	parts := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(parts) < 2 {
+		return nil, SNMPError(fmt.Sprintf("OID %q must have at least two arcs", oid))
+	}
+
+	arcs := make([]uint32, len(parts))
+
+	for idx, part := range parts {
+		arc, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, SNMPError(fmt.Sprintf("OID %q is not dotted numbers", oid))
+		}
+
+		arcs[idx] = uint32(arc)
+	}
+
+	if arcs[0] > 2 || (arcs[0] < 2 && arcs[1] >= 40) {
+		return nil, SNMPError(fmt.Sprintf("OID %q has invalid first arcs", oid))
+	}
+
+	return arcs, nil
+}
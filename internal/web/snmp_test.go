@@ -0,0 +1,296 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// compareSNMPOIDs will compare the arcs of two OIDs in lexicographic order.
+func compareSNMPOIDs(a, b []uint32) int {
+	for idx := 0; idx < len(a) && idx < len(b); idx++ {
+		if a[idx] != b[idx] {
+			if a[idx] < b[idx] {
+				return -1
+			}
+
+			return 1
+		}
+	}
+
+	return len(a) - len(b)
+}
+
+// snmpAgent will return the address of an SNMP agent with the community "public" that answers requests from the
+// variables of its MIB, by OID. The first request is dropped, so that it is retried. A version 1 agent answers a
+// missing variable with "noSuchName". The types of the requests are sent on ops.
+func snmpAgent(t *testing.T, mib map[string]gosnmp.SnmpPDU, ops chan<- gosnmp.PDUType) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	oids := make([]string, 0, len(mib))
+	for oid := range mib {
+		oids = append(oids, oid)
+	}
+
+	arcs := func(oid string) []uint32 {
+		parsed, _ := ParseSNMPOID(oid)
+
+		return parsed
+	}
+
+	sort.Slice(oids, func(i, j int) bool { return compareSNMPOIDs(arcs(oids[i]), arcs(oids[j])) < 0 })
+
+	varbind := func(oid string) gosnmp.SnmpPDU {
+		pdu := mib[oid]
+		pdu.Name = "." + oid
+
+		return pdu
+	}
+
+	next := func(oid string) string {
+		for _, candidate := range oids {
+			if compareSNMPOIDs(arcs(candidate), arcs(oid)) > 0 {
+				return candidate
+			}
+		}
+
+		return ""
+	}
+
+	go func() {
+		buf := make([]byte, 65535)
+
+		for count := 0; ; count++ {
+			size, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if count == 0 {
+				continue
+			}
+
+			req, err := (&gosnmp.GoSNMP{Logger: gosnmp.NewLogger(nil)}).SnmpDecodePacket(buf[:size])
+			if err != nil || req.Community != "public" {
+				continue
+			}
+
+			ops <- req.PDUType
+
+			rsp := gosnmp.SnmpPacket{
+				Version:   req.Version,
+				Community: req.Community,
+				PDUType:   gosnmp.GetResponse,
+				RequestID: req.RequestID,
+			}
+
+			for idx, variable := range req.Variables {
+				oid := strings.TrimPrefix(variable.Name, ".")
+
+				switch req.PDUType {
+				case gosnmp.GetRequest:
+					if _, ok := mib[oid]; ok {
+						rsp.Variables = append(rsp.Variables, varbind(oid))
+
+						continue
+					}
+
+					if req.Version == gosnmp.Version1 {
+						rsp.Error, rsp.ErrorIndex = gosnmp.NoSuchName, uint8(idx+1)
+					}
+
+					rsp.Variables = append(rsp.Variables, gosnmp.SnmpPDU{
+						Name: variable.Name, Type: gosnmp.NoSuchInstance,
+					})
+				case gosnmp.GetNextRequest, gosnmp.GetBulkRequest:
+					repetitions := 1
+					if req.PDUType == gosnmp.GetBulkRequest {
+						repetitions = int(req.MaxRepetitions)
+					}
+
+					for rep := 0; rep < repetitions; rep++ {
+						if oid = next(oid); oid == "" {
+							if req.Version == gosnmp.Version1 {
+								rsp.Error, rsp.ErrorIndex = gosnmp.NoSuchName, uint8(idx+1)
+							}
+
+							rsp.Variables = append(rsp.Variables, gosnmp.SnmpPDU{
+								Name: variable.Name, Type: gosnmp.EndOfMibView,
+							})
+
+							break
+						}
+
+						rsp.Variables = append(rsp.Variables, varbind(oid))
+					}
+				default:
+				}
+			}
+
+			msg, err := rsp.MarshalMsg()
+			if err != nil {
+				t.Errorf("failed to marshal response: %v", err)
+
+				return
+			}
+
+			_, _ = conn.WriteTo(msg, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestSNMP(t *testing.T) {
+	t.Parallel()
+
+	octets := func(value string) gosnmp.SnmpPDU { return gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: value} }
+
+	mib := map[string]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.1.3.0":      {Type: gosnmp.TimeTicks, Value: uint32(65536)},
+		"1.3.6.1.2.1.1.5.0":      octets("core-sw1"),
+		"1.3.6.1.2.1.2.2.1.2.1":  octets("eth0\x00"),
+		"1.3.6.1.2.1.2.2.1.2.2":  octets("eth1"),
+		"1.3.6.1.2.1.2.2.1.2.10": octets("lo"),
+		"1.3.6.1.2.1.2.2.1.6.1":  {Type: gosnmp.OctetString, Value: []byte{0x00, 0x1a, 0x2b, 0x3c, 0x4d, 0x5e}},
+		"1.3.6.1.2.1.4.20.1.1.1": {Type: gosnmp.IPAddress, Value: "10.0.0.1"},
+		"1.3.6.1.2.1.31.1.1.1.6": {Type: gosnmp.Counter64, Value: uint64(1<<40 - 1)},
+		"1.3.6.1.2.1.1.2.0":      {Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.1207"},
+		"1.3.6.1.2.1.1.7.0":      {Type: gosnmp.Integer, Value: -2},
+	}
+
+	for _, version := range []int{SNMPVersion1, SNMPVersion2c} {
+		version := version
+
+		t.Run("version "+[]string{"1", "2c"}[version], func(t *testing.T) {
+			t.Parallel()
+
+			ops := make(chan gosnmp.PDUType, 100)
+
+			conn, err := DialSNMP(context.Background(), snmpAgent(t, mib, ops), SNMPConfig{
+				Version: version, Community: "public", Timeout: 200 * time.Millisecond, Retries: 1, MaxRepetitions: 2,
+			})
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+
+			defer conn.Close()
+
+			got, err := conn.Get(context.Background(), []string{
+				"1.3.6.1.2.1.1.3.0", ".1.3.6.1.2.1.1.5.0", "1.3.6.1.2.1.1.9.0", "1.3.6.1.2.1.4.20.1.1.1",
+				"1.3.6.1.2.1.31.1.1.1.6", "1.3.6.1.2.1.1.2.0", "1.3.6.1.2.1.1.7.0",
+			})
+			if err != nil {
+				t.Fatalf("failed to get: %v", err)
+			}
+
+			exp := []SNMPVarbind{
+				{OID: "1.3.6.1.2.1.1.3.0", Value: uint64(65536)},
+				{OID: ".1.3.6.1.2.1.1.5.0", Value: "core-sw1"},
+				{OID: "1.3.6.1.2.1.1.9.0", Value: nil},
+				{OID: "1.3.6.1.2.1.4.20.1.1.1", Value: "10.0.0.1"},
+				{OID: "1.3.6.1.2.1.31.1.1.1.6", Value: uint64(1<<40 - 1)},
+				{OID: "1.3.6.1.2.1.1.2.0", Value: "1.3.6.1.4.1.1207"},
+				{OID: "1.3.6.1.2.1.1.7.0", Value: int64(-2)},
+			}
+			if !reflect.DeepEqual(got, exp) {
+				t.Fatalf("expected varbinds %v, got %v", exp, got)
+			}
+
+			var walked []SNMPVarbind
+
+			err = conn.Walk(context.Background(), "1.3.6.1.2.1.2.2.1.2", func(vb SNMPVarbind) error {
+				walked = append(walked, vb)
+
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("failed to walk: %v", err)
+			}
+
+			exp = []SNMPVarbind{
+				{OID: "1.3.6.1.2.1.2.2.1.2.1", Value: "eth0\x00"},
+				{OID: "1.3.6.1.2.1.2.2.1.2.2", Value: "eth1"},
+				{OID: "1.3.6.1.2.1.2.2.1.2.10", Value: "lo"},
+			}
+			if !reflect.DeepEqual(walked, exp) {
+				t.Fatalf("expected walk %v, got %v", exp, walked)
+			}
+
+			walked = nil
+
+			err = conn.Walk(context.Background(), "1.3.6.1.2.1.31", func(vb SNMPVarbind) error {
+				walked = append(walked, vb)
+
+				return nil
+			})
+			if err != nil || len(walked) != 1 {
+				t.Fatalf("expected a walk to the end of the MIB, got %v: %v", walked, err)
+			}
+
+			close(ops)
+
+			bulk := false
+			for op := range ops {
+				bulk = bulk || op == gosnmp.GetBulkRequest
+			}
+
+			if bulk != (version == SNMPVersion2c) {
+				t.Fatalf("expected get bulk requests only for version 2c")
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+
+		conn, err := DialSNMP(context.Background(), snmpAgent(t, mib, make(chan gosnmp.PDUType, 10)), SNMPConfig{
+			Version: SNMPVersion2c, Community: "private", Timeout: 50 * time.Millisecond, Retries: 1,
+		})
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+
+		defer conn.Close()
+
+		if _, err := conn.Get(context.Background(), []string{"1.3.6.1.2.1.1.3.0"}); !errors.Is(err, ErrSNMP) {
+			t.Fatalf("expected error %v, got %v", ErrSNMP, err)
+		}
+	})
+
+	t.Run("oids", func(t *testing.T) {
+		t.Parallel()
+
+		for _, oid := range []string{"1", "1.3.a", "3.1", "1.40", "1..3"} {
+			if _, err := ParseSNMPOID(oid); !errors.Is(err, ErrSNMP) {
+				t.Fatalf("expected error %v for %q, got %v", ErrSNMP, oid, err)
+			}
+		}
+
+		value := snmpValue(gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte{0x00, 0x1a, 0xff}})
+		if value != "00:1a:ff" {
+			t.Fatalf("expected a binary octet string to be hex, got %v", value)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+)
+
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// TransportConfig is the tuning for the HTTP transport shared by every request of a run to a host. The zero value uses
+// the defaults of "http.DefaultTransport", except that the number of idle connections kept per host is the number of
+// web workers, so that concurrent workers reuse TLS connections instead of re-negotiating them.
+type TransportConfig struct {
+	// MaxIdleConnsPerHost is the maximum number of idle connections to keep per host. The default is the number of
+	// CPUs on the machine, which is the number of web workers.
+	MaxIdleConnsPerHost int `yaml:"maxIdleConnsPerHost"`
+
+	// DisableHTTP2 will disable HTTP/2, which some APIs handle poorly under many concurrent streams.
+	DisableHTTP2 bool `yaml:"disableHTTP2"`
+
+	// KeepAlive is the TCP keep-alive period in seconds. The default is 30 seconds, and a negative value disables
+	// keep-alive probes.
+	KeepAlive int `yaml:"keepAlive"`
+
+	// DisableKeepAlives will disable HTTP keep-alives, using a new connection for every request.
+	DisableKeepAlives bool `yaml:"disableKeepAlives"`
+
+	// IdleConnTimeout is the number of seconds an idle connection is kept open. The default is 90 seconds.
+	IdleConnTimeout int `yaml:"idleConnTimeout"`
+
+	// DisableCompression will prevent the transport from requesting gzip compressed responses.
+	DisableCompression bool `yaml:"disableCompression"`
+}
+
+// Transports are the HTTP transports of a run, keyed by host and transport configuration, so that the workers of the
+// run share a connection pool per host. The transports are not shared between runs, and are evicted when the run
+// closes them.
+type Transports struct {
+	mtx        sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// NewTransports will return an empty set of transports.
+func NewTransports() *Transports {
+	return &Transports{transports: make(map[string]*http.Transport)}
+}
+
+// Transport will return the HTTP transport for the host. Every call with the same host and configuration returns the
+// same transport until the transports are closed, so that its connection pool is shared by all workers. A nil
+// configuration uses the defaults.
+func (pool *Transports) Transport(host string, cfg *TransportConfig) *http.Transport {
+	if cfg == nil {
+		cfg = &TransportConfig{}
+	}
+
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	key := fmt.Sprintf("%s|%+v", host, *cfg)
+	if transport, ok := pool.transports[key]; ok {
+		return transport
+	}
+
+	transport := newTransport(cfg)
+	pool.transports[key] = transport
+
+	return transport
+}
+
+// Close will close the idle connections of every transport and evict them, so the next call to "Transport" returns
+// a new transport. Requests in flight on a transport are not interrupted.
+func (pool *Transports) Close() {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	for key, transport := range pool.transports {
+		transport.CloseIdleConnections()
+		delete(pool.transports, key)
+	}
+}
+
+// newTransport will return a new HTTP transport using the configuration.
+func newTransport(cfg *TransportConfig) *http.Transport {
+	keepAlive := defaultKeepAlive
+	if cfg.KeepAlive != 0 {
+		keepAlive = time.Duration(cfg.KeepAlive) * time.Second
+	}
+
+	idleConnTimeout := defaultIdleConnTimeout
+	if cfg.IdleConnTimeout > 0 {
+		idleConnTimeout = time.Duration(cfg.IdleConnTimeout) * time.Second
+	}
+
+	maxIdleConnsPerHost := runtime.NumCPU()
+	if cfg.MaxIdleConnsPerHost > 0 {
+		maxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+
+	dialer := &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: keepAlive}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     !cfg.DisableHTTP2,
+		MaxIdleConns:          maxIdleConnsPerHost,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+		DisableKeepAlives:     cfg.DisableKeepAlives,
+		DisableCompression:    cfg.DisableCompression,
+	}
+
+	if compliance.Enabled() {
+		transport.TLSClientConfig = compliance.TLSConfig("")
+	}
+
+	// A non-nil, empty map disables the HTTP/2 upgrade.
+	if cfg.DisableHTTP2 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return transport
+}
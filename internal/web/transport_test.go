@@ -0,0 +1,80 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestTransports(t *testing.T) {
+	t.Parallel()
+
+	t.Run("same host and config share a transport", func(t *testing.T) {
+		t.Parallel()
+
+		pool := NewTransports()
+
+		first := pool.Transport("api.shared.test", nil)
+		if second := pool.Transport("api.shared.test", &TransportConfig{}); first != second {
+			t.Fatalf("expected the transport to be shared")
+		}
+
+		if other := pool.Transport("api.other.test", nil); first == other {
+			t.Fatalf("expected a different transport for a different host")
+		}
+
+		if tuned := pool.Transport("api.shared.test", &TransportConfig{DisableCompression: true}); first == tuned {
+			t.Fatalf("expected a different transport for a different config")
+		}
+
+		if first.MaxIdleConnsPerHost != runtime.NumCPU() {
+			t.Fatalf("expected %d idle connections per host, got %d", runtime.NumCPU(), first.MaxIdleConnsPerHost)
+		}
+
+		if other := NewTransports().Transport("api.shared.test", nil); first == other {
+			t.Fatalf("expected the transports of another run not to be shared")
+		}
+	})
+
+	t.Run("closed transports are evicted", func(t *testing.T) {
+		t.Parallel()
+
+		pool := NewTransports()
+		first := pool.Transport("api.closed.test", nil)
+
+		pool.Close()
+
+		if second := pool.Transport("api.closed.test", nil); first == second {
+			t.Fatalf("expected a new transport after the transports are closed")
+		}
+	})
+
+	t.Run("tuning", func(t *testing.T) {
+		t.Parallel()
+
+		transport := NewTransports().Transport("api.tuned.test", &TransportConfig{
+			MaxIdleConnsPerHost: 64,
+			DisableHTTP2:        true,
+			DisableKeepAlives:   true,
+			DisableCompression:  true,
+		})
+
+		if transport.MaxIdleConnsPerHost != 64 {
+			t.Fatalf("expected 64 idle connections per host, got %d", transport.MaxIdleConnsPerHost)
+		}
+
+		if transport.ForceAttemptHTTP2 || transport.TLSNextProto == nil {
+			t.Fatalf("expected HTTP/2 to be disabled")
+		}
+
+		if !transport.DisableKeepAlives || !transport.DisableCompression {
+			t.Fatalf("expected keep-alives and compression to be disabled")
+		}
+	})
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+)
+
+const (
+	// webSocketHandshakeTimeout is the maximum duration of the handshake, unless the context ends earlier.
+	webSocketHandshakeTimeout = 30 * time.Second
+
+	// WebSocketMaxMessage is the largest message read from a WebSocket, to bound the memory of a corrupted length.
+	WebSocketMaxMessage = 32 << 20
+)
+
+var (
+	// ErrWebSocket is returned when a WebSocket connection fails, or the server breaks the protocol.
+	ErrWebSocket = errors.New("websocket failed")
+
+	// ErrWebSocketClosed is returned when the server closes the WebSocket.
+	ErrWebSocketClosed = errors.New("websocket closed")
+)
+
+// WebSocketError is returned when a WebSocket connection fails, or the server breaks the protocol.
+func WebSocketError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrWebSocket, reason)
+}
+
+// WebSocket is the client side of a WebSocket connection, with the gorilla/websocket client, for streaming web APIs
+// such as the market data feeds of exchanges. Messages are read by a single reader, and may be written concurrently.
+type WebSocket struct {
+	conn *websocket.Conn
+
+	// wmtx serializes the messages written, since the connection supports a single writer.
+	wmtx sync.Mutex
+}
+
+// DialWebSocket will open a WebSocket connection to the "ws://" or "wss://" URL, with the header on the handshake
+// request.
+func DialWebSocket(ctx context.Context, rawURL string, header http.Header) (*WebSocket, error) {
+	uri, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, WebSocketError(fmt.Sprintf("unable to parse url: %v", err))
+	}
+
+	if uri.Scheme != "ws" && uri.Scheme != "wss" {
+		return nil, WebSocketError(fmt.Sprintf("url %q must be ws:// or wss://", rawURL))
+	}
+
+	dialer := &websocket.Dialer{
+		NetDialContext:   (&net.Dialer{}).DialContext,
+		Proxy:            http.ProxyFromEnvironment,
+		TLSClientConfig:  compliance.TLSConfig(uri.Hostname()),
+		HandshakeTimeout: webSocketHandshakeTimeout,
+	}
+
+	conn, rsp, err := dialer.DialContext(ctx, rawURL, header)
+	if err != nil {
+		if rsp != nil {
+			return nil, WebSocketError(fmt.Sprintf("handshake failed: %s", rsp.Status))
+		}
+
+		return nil, WebSocketError(fmt.Sprintf("unable to connect to %s: %v", uri.Host, err))
+	}
+
+	rsp.Body.Close()
+
+	conn.SetReadLimit(WebSocketMaxMessage)
+
+	return &WebSocket{conn: conn}, nil
+}
+
+// ReadMessage will return the next text or binary message. Pings are answered while reading. If the server closes
+// the connection, the error wraps "ErrWebSocketClosed".
+func (ws *WebSocket) ReadMessage() ([]byte, error) {
+	_, message, err := ws.conn.ReadMessage()
+	if err != nil {
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			return nil, fmt.Errorf("%w: status %d", ErrWebSocketClosed, closeErr.Code)
+		}
+
+		return nil, WebSocketError(fmt.Sprintf("unable to read message: %v", err))
+	}
+
+	return message, nil
+}
+
+// WriteMessage will write the message as a text frame.
+func (ws *WebSocket) WriteMessage(message []byte) error {
+	ws.wmtx.Lock()
+	defer ws.wmtx.Unlock()
+
+	if err := ws.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		return WebSocketError(fmt.Sprintf("unable to write message: %v", err))
+	}
+
+	return nil
+}
+
+// Close will send a close frame to the server and close the connection, which ends a blocked "ReadMessage".
+func (ws *WebSocket) Close() error {
+	// The close frame is best effort, since the connection may already be broken or the server may not be reading.
+	_ = ws.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+
+	if err := ws.conn.Close(); err != nil {
+		return WebSocketError(err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// webSocketServer will return the "ws://" URL of a server that upgrades the requests with the "X-Feed" header and
+// hands the connection to serve.
+func webSocketServer(t *testing.T, serve func(*websocket.Conn)) string {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Feed") != "book" {
+			http.Error(w, "bad handshake", http.StatusBadRequest)
+
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		serve(conn)
+	}))
+	t.Cleanup(server.Close)
+
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/feed?depth=10"
+}
+
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("messages", func(t *testing.T) {
+		t.Parallel()
+
+		pong := make(chan string, 1)
+
+		url := webSocketServer(t, func(server *websocket.Conn) {
+			server.SetPongHandler(func(payload string) error {
+				pong <- payload
+
+				return nil
+			})
+
+			_ = server.WriteControl(websocket.PingMessage, []byte("hb"), time.Now().Add(time.Second))
+			_ = server.WriteMessage(websocket.TextMessage, []byte(`{"bids":[]}`))
+
+			// The subscription of the client is echoed back.
+			_, msg, _ := server.ReadMessage()
+			_ = server.WriteMessage(websocket.TextMessage, msg)
+			_ = server.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure,
+				""))
+
+			_, _, _ = server.ReadMessage()
+		})
+
+		ws, err := DialWebSocket(ctx, url, http.Header{"X-Feed": {"book"}})
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+
+		defer ws.Close()
+
+		if msg, err := ws.ReadMessage(); err != nil || string(msg) != `{"bids":[]}` {
+			t.Fatalf("expected the message, got %q: %v", msg, err)
+		}
+
+		if err := ws.WriteMessage([]byte(`{"type":"subscribe"}`)); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+
+		if payload := <-pong; payload != "hb" {
+			t.Fatalf("expected the ping to be answered, got %q", payload)
+		}
+
+		if msg, err := ws.ReadMessage(); err != nil || string(msg) != `{"type":"subscribe"}` {
+			t.Fatalf("expected the echoed message, got %q: %v", msg, err)
+		}
+
+		if _, err := ws.ReadMessage(); !errors.Is(err, ErrWebSocketClosed) {
+			t.Fatalf("expected error %v, got %v", ErrWebSocketClosed, err)
+		}
+	})
+
+	t.Run("handshake", func(t *testing.T) {
+		t.Parallel()
+
+		url := webSocketServer(t, func(*websocket.Conn) {})
+
+		if _, err := DialWebSocket(ctx, url, nil); !errors.Is(err, ErrWebSocket) {
+			t.Fatalf("expected error %v, got %v", ErrWebSocket, err)
+		}
+
+		if _, err := DialWebSocket(ctx, "https://example.com/feed", nil); !errors.Is(err, ErrWebSocket) {
+			t.Fatalf("expected error %v, got %v", ErrWebSocket, err)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidari
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/transport"
+)
+
+var (
+	ErrInvalidQuota  = fmt.Errorf("invalid quota")
+	ErrQuotaExceeded = fmt.Errorf("quota exceeded")
+)
+
+// InvalidQuotaError is returned when a limit of the quota is negative.
+func InvalidQuotaError(limit string) error {
+	return fmt.Errorf("%w: %s must not be negative", ErrInvalidQuota, limit)
+}
+
+// QuotaExceededError is returned when a run is canceled for exceeding the maximum duration of its quota.
+func QuotaExceededError(maxDuration time.Duration, err error) error {
+	return fmt.Errorf("%w: run exceeded its maximum duration of %v: %v", ErrQuotaExceeded, maxDuration, err)
+}
+
+// Quota bounds the resources of a run, e.g. of each job of a daemon that runs many configurations, so that one
+// misbehaving job can not starve the others. Limits that are zero are not bounded by the quota.
+type Quota struct {
+	// MaxConcurrentRequests is the maximum number of concurrent web API requests of the run. Without it, the run
+	// makes as many concurrent requests as the number of CPUs.
+	MaxConcurrentRequests int
+
+	// MaxMemory is the maximum size in bytes of the web API responses buffered by the run, i.e. its memory budget,
+	// see "memoryBudget" in the configuration. It replaces the memory budget of the configuration if that is larger.
+	MaxMemory int64
+
+	// MaxDuration is the maximum duration of the run. A run that exceeds it is canceled, which rolls back the
+	// transactions that are not yet committed, and fails with an error wrapping "ErrQuotaExceeded".
+	MaxDuration time.Duration
+}
+
+// WithQuota will bound the resources of the run by the quota.
+func WithQuota(quota Quota) Option {
+	return func(rnr *runner) { rnr.quota = &quota }
+}
+
+func (quota *Quota) validate() error {
+	switch {
+	case quota.MaxConcurrentRequests < 0:
+		return InvalidQuotaError("maxConcurrentRequests")
+	case quota.MaxMemory < 0:
+		return InvalidQuotaError("maxMemory")
+	case quota.MaxDuration < 0:
+		return InvalidQuotaError("maxDuration")
+	}
+
+	return nil
+}
+
+// apply will bound the configuration by the quota, and return the context of the run, which is canceled once the
+// run exceeds its maximum duration.
+func (quota *Quota) apply(ctx context.Context, cfg *transport.Config) (context.Context, context.CancelFunc) {
+	if quota == nil {
+		return ctx, func() {}
+	}
+
+	if quota.MaxConcurrentRequests > 0 {
+		cfg.Concurrency = quota.MaxConcurrentRequests
+	}
+
+	if quota.MaxMemory > 0 && (cfg.MemoryBudget == 0 || cfg.MemoryBudget > quota.MaxMemory) {
+		cfg.MemoryBudget = quota.MaxMemory
+	}
+
+	if quota.MaxDuration == 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, quota.MaxDuration)
+}
+
+// exceeded will return the error of a run that was canceled for exceeding the maximum duration of the quota, or the
+// error of the run as is.
+func (quota *Quota) exceeded(ctx, parent context.Context, err error) error {
+	if quota == nil || err == nil || parent.Err() != nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+
+	return QuotaExceededError(quota.MaxDuration, err)
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidari
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+	t.Parallel()
+
+	t.Run("concurrent requests", func(t *testing.T) {
+		t.Parallel()
+
+		var inflight, peak int32
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			current := atomic.AddInt32(&inflight, 1)
+			defer atomic.AddInt32(&inflight, -1)
+
+			for {
+				seen := atomic.LoadInt32(&peak)
+				if current <= seen || atomic.CompareAndSwapInt32(&peak, seen, current) {
+					break
+				}
+			}
+
+			time.Sleep(5 * time.Millisecond)
+
+			_, _ = rw.Write([]byte(`[{"id": 1, "open": 1.5}]`))
+		}))
+		t.Cleanup(server.Close)
+
+		cfg := []byte(`
+url: ` + server.URL + `
+connectionStrings:
+  - file://` + filepath.ToSlash(t.TempDir()) + `?format=jsonl
+rateLimit:
+  burst: 10
+  period: 1
+requests:
+  - endpoint: /a
+  - endpoint: /b
+  - endpoint: /c
+  - endpoint: /d
+`)
+
+		if _, err := RunConfig(context.Background(), cfg, WithQuota(Quota{MaxConcurrentRequests: 1})); err != nil {
+			t.Fatalf("failed to run configuration: %v", err)
+		}
+
+		if peak := atomic.LoadInt32(&peak); peak != 1 {
+			t.Fatalf("expected at most one concurrent request, got %d", peak)
+		}
+	})
+
+	t.Run("max duration", func(t *testing.T) {
+		t.Parallel()
+
+		server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+			<-req.Context().Done()
+		}))
+		t.Cleanup(server.Close)
+
+		report, err := RunConfig(context.Background(), runConfig(server.URL, t.TempDir()),
+			WithQuota(Quota{MaxDuration: 50 * time.Millisecond}))
+		if !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("expected error %v, got %v", ErrQuotaExceeded, err)
+		}
+
+		if report == nil || report.Error == "" {
+			t.Fatalf("expected the error in the report, got %+v", report)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := RunConfig(context.Background(), runConfig("https://api.test", t.TempDir()),
+			WithQuota(Quota{MaxMemory: -1}))
+		if !errors.Is(err, ErrInvalidQuota) {
+			t.Fatalf("expected error %v, got %v", ErrInvalidQuota, err)
+		}
+	})
+}
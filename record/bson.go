@@ -0,0 +1,86 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package record
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ToBSON will convert the record to a BSON document. The fields of the document and of its nested documents are
+// sorted by key, so that the same record always converts to the same document, e.g. when it is used as an upsert
+// filter.
+func ToBSON(rec *structpb.Struct, opts *Options) (bson.D, error) {
+	fields, err := Map(rec, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return toDocument(fields)
+}
+
+func toDocument(fields map[string]interface{}) (bson.D, error) {
+	doc := make(bson.D, 0, len(fields))
+
+	for _, key := range sortedKeys(fields) {
+		// BSON keys are null terminated strings.
+		if strings.ContainsRune(key, 0) {
+			return nil, fmt.Errorf("%w: %q contains a null byte", ErrInvalidKey, key)
+		}
+
+		value, err := toBSONValue(fields[key])
+		if err != nil {
+			return nil, err
+		}
+
+		doc = append(doc, primitive.E{Key: key, Value: value})
+	}
+
+	return doc, nil
+}
+
+func toBSONValue(value interface{}) (interface{}, error) {
+	switch val := value.(type) {
+	case map[string]interface{}:
+		return toDocument(val)
+	case []interface{}:
+		arr := make(bson.A, len(val))
+
+		for idx, elem := range val {
+			var err error
+			if arr[idx], err = toBSONValue(elem); err != nil {
+				return nil, err
+			}
+		}
+
+		return arr, nil
+	default:
+		return value, nil
+	}
+}
+
+// FromBSON will convert the BSON document, e.g. a "bson.Raw" document read from a cursor, to a record. The document
+// is converted as relaxed extended JSON, so BSON types without a JSON equivalent are objects such as
+// {"$oid": "..."} and {"$date": "..."}.
+func FromBSON(doc interface{}) (*structpb.Struct, error) {
+	data, err := bson.MarshalExtJSON(doc, false, false)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFailedToDecode, err)
+	}
+
+	rec := new(structpb.Struct)
+	if err := rec.UnmarshalJSON(data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFailedToDecode, err)
+	}
+
+	return rec, nil
+}
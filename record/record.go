@@ -0,0 +1,332 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+
+// Package record converts records, i.e. "structpb.Struct" values decoded from web API responses, to and from BSON
+// documents and SQL rows. This is the conversion that gidari uses to write records to MongoDB and PostgreSQL, so it
+// can be used to write or read the same records outside of a gidari run.
+//
+// By default, records are converted as they are: keys are unchanged, nested objects and arrays are nested documents
+// and arrays, and values keep the types they were decoded with. "Options" change the key casing, the handling of
+// nested values, and the types of individual fields.
+package record
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var (
+	ErrInvalidKey       = fmt.Errorf("invalid key")
+	ErrInvalidTypeHint  = fmt.Errorf("invalid type hint")
+	ErrFailedToEncode   = fmt.Errorf("failed to encode record")
+	ErrFailedToDecode   = fmt.Errorf("failed to decode record")
+	ErrFailedToScanRows = fmt.Errorf("failed to scan rows")
+)
+
+// InvalidTypeHintError is returned when the value of a field can not be converted to the type of its type hint.
+func InvalidTypeHintError(field string, typ Type, value interface{}) error {
+	return fmt.Errorf("%w: field %q can not be converted from %v to %s", ErrInvalidTypeHint, field, value, typ)
+}
+
+// KeyCase is the casing of the keys of converted records.
+type KeyCase uint8
+
+const (
+	// KeyCasePreserve leaves the keys unchanged. This is the default.
+	KeyCasePreserve KeyCase = iota
+
+	// KeyCaseSnake converts the keys to snake case, e.g. "productId" and "product-id" become "product_id".
+	KeyCaseSnake
+
+	// KeyCaseCamel converts the keys to camel case, e.g. "product_id" becomes "productId".
+	KeyCaseCamel
+)
+
+// Nested is how nested objects and arrays are converted.
+type Nested uint8
+
+const (
+	// NestedNative converts nested objects and arrays to nested documents and arrays. This is the default. SQL
+	// backends receive nested values as maps and slices.
+	NestedNative Nested = iota
+
+	// NestedJSON converts nested objects and arrays to JSON strings, so that every record has a flat shape.
+	NestedJSON
+
+	// NestedFlatten converts the fields of nested objects to top-level fields joined with a ".", e.g. {"a": {"b": 1}}
+	// becomes {"a.b": 1}. Arrays are converted to JSON strings.
+	NestedFlatten
+)
+
+// Type is the type that a field is converted to with a type hint.
+type Type uint8
+
+const (
+	// TypeString converts the value to a string. Numbers are formatted without an exponent where possible, and
+	// byte slices are converted as text.
+	TypeString Type = iota + 1
+
+	// TypeInt converts the value to an int64, truncating floats and parsing strings.
+	TypeInt
+
+	// TypeFloat converts the value to a float64, parsing strings and byte slices.
+	TypeFloat
+
+	// TypeBool converts the value to a bool, parsing strings, e.g. "true" or "1".
+	TypeBool
+
+	// TypeTime converts the value to a "time.Time", parsing RFC 3339 strings or Unix seconds.
+	TypeTime
+)
+
+// String will return the name of the type.
+func (typ Type) String() string {
+	switch typ {
+	case TypeString:
+		return "string"
+	case TypeInt:
+		return "int"
+	case TypeFloat:
+		return "float"
+	case TypeBool:
+		return "bool"
+	case TypeTime:
+		return "time"
+	default:
+		return "unknown"
+	}
+}
+
+// Options are the options for converting records. The zero value converts records as they are.
+type Options struct {
+	// KeyCase is the casing of the keys of the converted records.
+	KeyCase KeyCase
+
+	// Nested is how nested objects and arrays are converted.
+	Nested Nested
+
+	// TypeHints are the types that fields are converted to, keyed by the converted key, i.e. after the key casing
+	// and flattening are applied.
+	TypeHints map[string]Type
+}
+
+// Map will return the fields of the record with the options applied.
+func Map(rec *structpb.Struct, opts *Options) (map[string]interface{}, error) {
+	fields := rec.AsMap()
+	if opts == nil {
+		return fields, nil
+	}
+
+	out := make(map[string]interface{}, len(fields))
+
+	for key, value := range fields {
+		if err := nest(out, opts, key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	for key, typ := range opts.TypeHints {
+		value, ok := out[key]
+		if !ok || value == nil {
+			continue
+		}
+
+		converted, err := convert(key, typ, value)
+		if err != nil {
+			return nil, err
+		}
+
+		out[key] = converted
+	}
+
+	return out, nil
+}
+
+// nest will set the value of the key on the fields, applying the key casing and the nested option.
+func nest(fields map[string]interface{}, opts *Options, key string, value interface{}) error {
+	key = opts.KeyCase.apply(key)
+
+	switch nested := value.(type) {
+	case map[string]interface{}:
+		switch opts.Nested {
+		case NestedJSON:
+			return setJSON(fields, key, value)
+		case NestedFlatten:
+			for child, childValue := range nested {
+				if err := nest(fields, opts, key+"."+child, childValue); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		case NestedNative:
+			out := make(map[string]interface{}, len(nested))
+			for child, childValue := range nested {
+				if err := nest(out, opts, child, childValue); err != nil {
+					return err
+				}
+			}
+
+			fields[key] = out
+
+			return nil
+		}
+	case []interface{}:
+		if opts.Nested != NestedNative {
+			return setJSON(fields, key, value)
+		}
+	}
+
+	fields[key] = value
+
+	return nil
+}
+
+func setJSON(fields map[string]interface{}, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFailedToEncode, err)
+	}
+
+	fields[key] = string(data)
+
+	return nil
+}
+
+// apply will return the key in the casing.
+func (keyCase KeyCase) apply(key string) string {
+	switch keyCase {
+	case KeyCaseSnake:
+		return snakeCase(key)
+	case KeyCaseCamel:
+		return camelCase(key)
+	default:
+		return key
+	}
+}
+
+func snakeCase(key string) string {
+	var out strings.Builder
+
+	runes := []rune(key)
+	for idx, r := range runes {
+		switch {
+		case r == '-' || r == ' ':
+			out.WriteRune('_')
+		case unicode.IsUpper(r):
+			// Start a new word at an uppercase letter that follows a lowercase letter or digit, or that starts a word
+			// after an acronym, e.g. "HTTPServer" becomes "http_server".
+			if idx > 0 && (unicode.IsLower(runes[idx-1]) || unicode.IsDigit(runes[idx-1]) ||
+				(unicode.IsUpper(runes[idx-1]) && idx+1 < len(runes) && unicode.IsLower(runes[idx+1]))) {
+				out.WriteRune('_')
+			}
+
+			out.WriteRune(unicode.ToLower(r))
+		default:
+			out.WriteRune(r)
+		}
+	}
+
+	return out.String()
+}
+
+func camelCase(key string) string {
+	words := strings.FieldsFunc(key, func(r rune) bool { return r == '_' || r == '-' || r == ' ' })
+	if len(words) == 0 {
+		return key
+	}
+
+	for idx := 1; idx < len(words); idx++ {
+		runes := []rune(words[idx])
+		runes[0] = unicode.ToUpper(runes[0])
+		words[idx] = string(runes)
+	}
+
+	return strings.Join(words, "")
+}
+
+// convert will convert the value of the field to the type.
+func convert(field string, typ Type, value interface{}) (interface{}, error) {
+	if data, ok := value.([]byte); ok {
+		value = string(data)
+	}
+
+	switch typ {
+	case TypeString:
+		if num, ok := value.(float64); ok {
+			return strconv.FormatFloat(num, 'f', -1, 64), nil
+		}
+
+		return fmt.Sprint(value), nil
+	case TypeInt:
+		switch val := value.(type) {
+		case float64:
+			return int64(val), nil
+		case int64:
+			return val, nil
+		case string:
+			if num, err := strconv.ParseFloat(val, 64); err == nil {
+				return int64(num), nil
+			}
+		}
+	case TypeFloat:
+		switch val := value.(type) {
+		case float64:
+			return val, nil
+		case int64:
+			return float64(val), nil
+		case string:
+			if num, err := strconv.ParseFloat(val, 64); err == nil {
+				return num, nil
+			}
+		}
+	case TypeBool:
+		switch val := value.(type) {
+		case bool:
+			return val, nil
+		case string:
+			if b, err := strconv.ParseBool(val); err == nil {
+				return b, nil
+			}
+		case float64:
+			return val != 0, nil
+		}
+	case TypeTime:
+		switch val := value.(type) {
+		case time.Time:
+			return val, nil
+		case string:
+			if tme, err := time.Parse(time.RFC3339Nano, val); err == nil {
+				return tme, nil
+			}
+		case float64:
+			return time.Unix(0, int64(val*float64(time.Second))).UTC(), nil
+		}
+	}
+
+	return nil, InvalidTypeHintError(field, typ, value)
+}
+
+// sortedKeys will return the keys of the fields in order, so that conversions are deterministic.
+func sortedKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
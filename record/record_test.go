@@ -0,0 +1,194 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package record
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func newRecord(t *testing.T, fields map[string]interface{}) *structpb.Struct {
+	t.Helper()
+
+	rec, err := structpb.NewStruct(fields)
+	if err != nil {
+		t.Fatalf("failed to create record: %v", err)
+	}
+
+	return rec
+}
+
+func TestMap(t *testing.T) {
+	t.Parallel()
+
+	for _, tcase := range []struct {
+		name   string
+		fields map[string]interface{}
+		opts   *Options
+		want   map[string]interface{}
+		err    error
+	}{
+		{
+			name:   "nil options",
+			fields: map[string]interface{}{"productId": "a", "nested": map[string]interface{}{"x": 1.0}},
+			want:   map[string]interface{}{"productId": "a", "nested": map[string]interface{}{"x": 1.0}},
+		},
+		{
+			name: "snake case",
+			fields: map[string]interface{}{
+				"productId": "a", "HTTPServer": "b", "trade-id": "c", "nested": map[string]interface{}{"innerKey": 1.0},
+			},
+			opts: &Options{KeyCase: KeyCaseSnake},
+			want: map[string]interface{}{
+				"product_id": "a", "http_server": "b", "trade_id": "c", "nested": map[string]interface{}{"inner_key": 1.0},
+			},
+		},
+		{
+			name:   "camel case",
+			fields: map[string]interface{}{"product_id": "a", "id": "b"},
+			opts:   &Options{KeyCase: KeyCaseCamel},
+			want:   map[string]interface{}{"productId": "a", "id": "b"},
+		},
+		{
+			name:   "nested json",
+			fields: map[string]interface{}{"a": map[string]interface{}{"b": 1.0}, "c": []interface{}{"d"}},
+			opts:   &Options{Nested: NestedJSON},
+			want:   map[string]interface{}{"a": `{"b":1}`, "c": `["d"]`},
+		},
+		{
+			name: "nested flatten",
+			fields: map[string]interface{}{
+				"a": map[string]interface{}{"b": map[string]interface{}{"c": 1.0}}, "d": []interface{}{1.0},
+			},
+			opts: &Options{Nested: NestedFlatten},
+			want: map[string]interface{}{"a.b.c": 1.0, "d": "[1]"},
+		},
+		{
+			name:   "type hints",
+			fields: map[string]interface{}{"size": "1.5", "id": 12345678901.0, "count": "3", "ok": "true", "at": 0.0},
+			opts: &Options{TypeHints: map[string]Type{
+				"size": TypeFloat, "id": TypeString, "count": TypeInt, "ok": TypeBool, "at": TypeTime,
+			}},
+			want: map[string]interface{}{
+				"size": 1.5, "id": "12345678901", "count": int64(3), "ok": true, "at": time.Unix(0, 0).UTC(),
+			},
+		},
+		{
+			name:   "type hints after key casing",
+			fields: map[string]interface{}{"tradeSize": "2"},
+			opts:   &Options{KeyCase: KeyCaseSnake, TypeHints: map[string]Type{"trade_size": TypeFloat}},
+			want:   map[string]interface{}{"trade_size": 2.0},
+		},
+		{
+			name:   "invalid type hint",
+			fields: map[string]interface{}{"size": "large"},
+			opts:   &Options{TypeHints: map[string]Type{"size": TypeFloat}},
+			err:    ErrInvalidTypeHint,
+		},
+	} {
+		tcase := tcase
+
+		t.Run(tcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := Map(newRecord(t, tcase.fields), tcase.opts)
+			if !errors.Is(err, tcase.err) {
+				t.Fatalf("expected error %v, got %v", tcase.err, err)
+			}
+
+			if tcase.err == nil && !reflect.DeepEqual(got, tcase.want) {
+				t.Fatalf("expected %v, got %v", tcase.want, got)
+			}
+		})
+	}
+}
+
+func TestToBSON(t *testing.T) {
+	t.Parallel()
+
+	t.Run("sorted keys", func(t *testing.T) {
+		t.Parallel()
+
+		rec := newRecord(t, map[string]interface{}{
+			"b": 1.0, "a": map[string]interface{}{"d": true, "c": []interface{}{map[string]interface{}{"f": 1.0, "e": 2.0}}},
+		})
+
+		got, err := ToBSON(rec, nil)
+		if err != nil {
+			t.Fatalf("failed to convert record: %v", err)
+		}
+
+		want := bson.D{
+			{Key: "a", Value: bson.D{
+				{Key: "c", Value: bson.A{bson.D{{Key: "e", Value: 2.0}, {Key: "f", Value: 1.0}}}},
+				{Key: "d", Value: true},
+			}},
+			{Key: "b", Value: 1.0},
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("null byte keys", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := ToBSON(newRecord(t, map[string]interface{}{"a\x00b": 1.0}), nil); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("expected error %v, got %v", ErrInvalidKey, err)
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		t.Parallel()
+
+		oid := primitive.NewObjectID()
+
+		data, err := bson.Marshal(bson.D{{Key: "_id", Value: oid}, {Key: "price", Value: 1.5}})
+		if err != nil {
+			t.Fatalf("failed to marshal document: %v", err)
+		}
+
+		rec, err := FromBSON(bson.Raw(data))
+		if err != nil {
+			t.Fatalf("failed to convert document: %v", err)
+		}
+
+		want := map[string]interface{}{"_id": map[string]interface{}{"$oid": oid.Hex()}, "price": 1.5}
+		if got := rec.AsMap(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	})
+}
+
+func TestToSQLArgs(t *testing.T) {
+	t.Parallel()
+
+	recs := []*structpb.Struct{
+		newRecord(t, map[string]interface{}{"productId": "a", "price": "1.5"}),
+		newRecord(t, map[string]interface{}{"productId": "b"}),
+	}
+
+	opts := &Options{KeyCase: KeyCaseSnake, TypeHints: map[string]Type{"price": TypeFloat}}
+
+	got, err := ToSQLArgs([]string{"product_id", "price"}, recs, opts)
+	if err != nil {
+		t.Fatalf("failed to convert records: %v", err)
+	}
+
+	want := []interface{}{"a", 1.5, "b", nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
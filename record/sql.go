@@ -0,0 +1,130 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package record
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ToSQLArgs will convert the records to the arguments of a multi-row SQL statement, i.e. the value of each column of
+// each record in order. Columns that a record does not have are NULL.
+func ToSQLArgs(columns []string, recs []*structpb.Struct, opts *Options) ([]interface{}, error) {
+	args := make([]interface{}, 0, len(columns)*len(recs))
+
+	for _, rec := range recs {
+		fields, err := Map(rec, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, column := range columns {
+			args = append(args, fields[column])
+		}
+	}
+
+	return args, nil
+}
+
+// FromSQLRows will convert the rows to records, keyed by column name, and close the rows. Drivers such as
+// "github.com/lib/pq" return numeric and decimal columns as byte slices, which are converted to numbers. Use a type
+// hint to convert other columns returned as byte slices, e.g. "TypeString" for a JSON column.
+func FromSQLRows(rows *sql.Rows, opts *Options) ([]*structpb.Struct, error) {
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFailedToScanRows, err)
+	}
+
+	var recs []*structpb.Struct
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+
+		for idx := range values {
+			pointers[idx] = &values[idx]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrFailedToScanRows, err)
+		}
+
+		fields := make(map[string]interface{}, len(columns))
+
+		for idx, column := range columns {
+			value := values[idx]
+
+			if data, ok := value.([]byte); ok {
+				if _, hinted := opts.typeHint(column); hinted {
+					value = string(data)
+				} else if value, err = strconv.ParseFloat(string(data), 64); err != nil {
+					return nil, fmt.Errorf("%w: column %q: %v", ErrFailedToDecode, column, err)
+				}
+			}
+
+			fields[column] = value
+		}
+
+		rec, err := fromFields(fields, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		recs = append(recs, rec)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFailedToScanRows, err)
+	}
+
+	return recs, nil
+}
+
+// typeHint will return the type hint of the key, after the key casing is applied, if any.
+func (opts *Options) typeHint(key string) (Type, bool) {
+	if opts == nil {
+		return 0, false
+	}
+
+	typ, ok := opts.TypeHints[opts.KeyCase.apply(key)]
+
+	return typ, ok
+}
+
+// fromFields will convert the fields of a row to a record, applying the options. Values are encoded as JSON, so that
+// e.g. timestamps are RFC 3339 strings.
+func fromFields(fields map[string]interface{}, opts *Options) (*structpb.Struct, error) {
+	if opts != nil {
+		rec, err := fromFields(fields, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if fields, err = Map(rec, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFailedToDecode, err)
+	}
+
+	rec := new(structpb.Struct)
+	if err := rec.UnmarshalJSON(data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFailedToDecode, err)
+	}
+
+	return rec, nil
+}
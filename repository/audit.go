@@ -0,0 +1,221 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+// ErrAudit is returned when an audit record can not be written to the audit sink.
+var ErrAudit = fmt.Errorf("failed to write audit record")
+
+// AuditError is returned when an audit record for the operation can not be written to the audit sink.
+func AuditError(operation string, err error) error {
+	return fmt.Errorf("%w for %s: %v", ErrAudit, operation, err)
+}
+
+const (
+	// AuditOutcomeOK is the outcome of an operation that succeeded.
+	AuditOutcomeOK = "ok"
+
+	// AuditOutcomeDenied is the outcome of an operation that was not allowed by the capabilities of the client.
+	AuditOutcomeDenied = "denied"
+
+	// AuditOutcomeError is the outcome of an operation that failed.
+	AuditOutcomeError = "error"
+)
+
+// AuditRecord is the audit log entry for a single repository operation.
+type AuditRecord struct {
+	Time      time.Time     `json:"time"`
+	Client    string        `json:"client"`
+	Operation string        `json:"operation"`
+	Table     string        `json:"table,omitempty"`
+	Records   int64         `json:"records"`
+	Latency   time.Duration `json:"latency"`
+	Outcome   string        `json:"outcome"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// AuditSink is the destination of audit records.
+type AuditSink interface {
+	WriteAudit(ctx context.Context, record *AuditRecord) error
+}
+
+// fileAuditSink writes audit records as JSON lines.
+type fileAuditSink struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+// NewFileAuditSink will return an audit sink that writes each audit record as a line of JSON, e.g. to a log file.
+func NewFileAuditSink(w io.Writer) AuditSink {
+	return &fileAuditSink{w: w}
+}
+
+// WriteAudit will write the audit record as a line of JSON.
+func (sink *fileAuditSink) WriteAudit(_ context.Context, record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error marshaling audit record: %w", err)
+	}
+
+	sink.mtx.Lock()
+	defer sink.mtx.Unlock()
+
+	if _, err := sink.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing audit record: %w", err)
+	}
+
+	return nil
+}
+
+// tableAuditSink upserts audit records into a storage table.
+type tableAuditSink struct {
+	repo  Generic
+	table string
+}
+
+// NewTableAuditSink will return an audit sink that upserts each audit record into the table of the repository. The
+// table must already exist, with columns for the JSON fields of "AuditRecord".
+func NewTableAuditSink(repo Generic, table string) AuditSink {
+	return &tableAuditSink{repo: repo, table: table}
+}
+
+// WriteAudit will upsert the audit record into the table.
+func (sink *tableAuditSink) WriteAudit(ctx context.Context, record *AuditRecord) error {
+	data, err := json.Marshal([]*AuditRecord{record})
+	if err != nil {
+		return fmt.Errorf("error marshaling audit record: %w", err)
+	}
+
+	req := &proto.UpsertRequest{Table: sink.table, Data: data, DataType: int32(tools.UpsertDataJSON)}
+	if _, err := sink.repo.Upsert(ctx, req); err != nil {
+		return fmt.Errorf("error upserting audit record: %w", err)
+	}
+
+	return nil
+}
+
+// audited is a repository that writes an audit record for every operation of a client.
+type audited struct {
+	Generic
+	client string
+	sink   AuditSink
+}
+
+// Audit will return the repository with an audit record written to the sink for every read, count, upsert, and
+// truncate made by the client, with the table, the number of records, the latency, and the outcome of the operation.
+// If the audit record can not be written, the operation returns an error wrapping "ErrAudit".
+//
+// To audit denied operations, restrict the repository before auditing it:
+//
+//	repo = repository.Audit(repository.Restrict(repo, caps), caps.Client, sink)
+func Audit(repo Generic, client string, sink AuditSink) Generic {
+	return &audited{Generic: repo, client: client, sink: sink}
+}
+
+// audit will write the audit record for the operation to the sink.
+func (repo *audited) audit(ctx context.Context, start time.Time, operation, table string, records int64,
+	opErr error,
+) error {
+	record := &AuditRecord{
+		Time:      start.UTC(),
+		Client:    repo.client,
+		Operation: operation,
+		Table:     table,
+		Records:   records,
+		Latency:   time.Since(start),
+		Outcome:   AuditOutcomeOK,
+	}
+
+	if opErr != nil {
+		record.Outcome = AuditOutcomeError
+		record.Error = opErr.Error()
+
+		if errors.Is(opErr, ErrPermissionDenied) {
+			record.Outcome = AuditOutcomeDenied
+		}
+	}
+
+	if err := repo.sink.WriteAudit(ctx, record); err != nil {
+		return AuditError(operation, err)
+	}
+
+	return opErr
+}
+
+// Read will read the records from the table and audit the read.
+func (repo *audited) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	start := time.Now()
+
+	rsp, err := repo.Generic.Read(ctx, req)
+	if err := repo.audit(ctx, start, "read", req.GetTable(), int64(len(rsp.GetRecords())), err); err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+// Count will count the records of the table and audit the count.
+func (repo *audited) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	start := time.Now()
+
+	rsp, err := repo.Generic.Count(ctx, req)
+	if err := repo.audit(ctx, start, "count", req.GetTable(), rsp.GetCount(), err); err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+// Upsert will upsert the records into the table and audit the upsert.
+func (repo *audited) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	start := time.Now()
+
+	rsp, err := repo.Generic.Upsert(ctx, req)
+	records := rsp.GetUpsertedCount() + rsp.GetMatchedCount()
+
+	if err := repo.audit(ctx, start, "upsert", req.GetTable(), records, err); err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+// Truncate will truncate the tables and audit the truncate.
+func (repo *audited) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	start := time.Now()
+
+	rsp, err := repo.Generic.Truncate(ctx, req)
+	table := strings.Join(req.GetTables(), ",")
+
+	if err := repo.audit(ctx, start, "truncate", table, int64(rsp.GetDeletedCount()), err); err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+// Transact will send the function to the transaction, with the operations of the repository passed to the function
+// audited by the same sink.
+func (repo *audited) Transact(fn func(ctx context.Context, repo Generic) error) {
+	repo.Generic.Transact(func(ctx context.Context, txRepo Generic) error {
+		return fn(ctx, &audited{Generic: txRepo, client: repo.client, sink: repo.sink})
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/proto"
+)
+
+// failingSink is an audit sink that fails to write every audit record.
+type failingSink struct{}
+
+func (failingSink) WriteAudit(context.Context, *AuditRecord) error {
+	return fmt.Errorf("disk full")
+}
+
+func TestAudit(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("file sink", func(t *testing.T) {
+		t.Parallel()
+
+		var buf bytes.Buffer
+
+		caps := Capabilities{Client: "analytics", ReadOnly: true}
+		repo := Audit(Restrict(new(recordingRepo), caps), caps.Client, NewFileAuditSink(&buf))
+
+		if _, err := repo.Read(ctx, &proto.ReadRequest{Table: "candles"}); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+
+		if _, err := repo.Upsert(ctx, &proto.UpsertRequest{Table: "candles"}); !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("expected upsert to be denied, got %v", err)
+		}
+
+		var records []*AuditRecord
+
+		scanner := bufio.NewScanner(&buf)
+		for scanner.Scan() {
+			record := new(AuditRecord)
+			if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+				t.Fatalf("failed to unmarshal audit record: %v", err)
+			}
+
+			records = append(records, record)
+		}
+
+		if len(records) != 2 {
+			t.Fatalf("expected 2 audit records, got %d", len(records))
+		}
+
+		for idx, exp := range []AuditRecord{
+			{Client: "analytics", Operation: "read", Table: "candles", Outcome: AuditOutcomeOK},
+			{Client: "analytics", Operation: "upsert", Table: "candles", Outcome: AuditOutcomeDenied},
+		} {
+			got := records[idx]
+			if got.Client != exp.Client || got.Operation != exp.Operation || got.Table != exp.Table ||
+				got.Outcome != exp.Outcome {
+				t.Fatalf("expected audit record %+v, got %+v", exp, got)
+			}
+		}
+
+		if records[1].Error == "" {
+			t.Fatal("expected the denied operation to record the error")
+		}
+	})
+
+	t.Run("table sink", func(t *testing.T) {
+		t.Parallel()
+
+		auditRepo := new(recordingRepo)
+		repo := Audit(new(recordingRepo), "ingest", NewTableAuditSink(auditRepo, "audit_log"))
+
+		if _, err := repo.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"candles"}}); err != nil {
+			t.Fatalf("failed to truncate: %v", err)
+		}
+
+		if len(auditRepo.ops) != 1 || auditRepo.ops[0] != "upsert audit_log" {
+			t.Fatalf("expected the audit record to be upserted, got %v", auditRepo.ops)
+		}
+	})
+
+	t.Run("sink failure", func(t *testing.T) {
+		t.Parallel()
+
+		repo := Audit(new(recordingRepo), "ingest", failingSink{})
+
+		if _, err := repo.Read(ctx, &proto.ReadRequest{Table: "candles"}); !errors.Is(err, ErrAudit) {
+			t.Fatalf("expected audit error, got %v", err)
+		}
+	})
+}
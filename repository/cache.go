@@ -0,0 +1,290 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package repository
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/proto"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// CacheOptions are the options for the read cache of a repository.
+type CacheOptions struct {
+	// Size is the maximum number of read responses in the cache. The least recently used response is evicted when
+	// the cache is full. The default is 1024.
+	Size int `yaml:"size"`
+
+	// TTL is how long a read response is served from the cache. If zero, responses are cached until they are evicted
+	// or the table is written.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// cacheEntry is a read response in the cache.
+type cacheEntry struct {
+	key     string
+	table   string
+	rsp     *proto.ReadResponse
+	expires time.Time
+}
+
+// readCache is an LRU cache of read responses keyed by the normalized read request.
+type readCache struct {
+	mtx     sync.Mutex
+	opts    CacheOptions
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+// get will return the cached response for the key, or nil if it is not cached or has expired.
+func (cache *readCache) get(key string) *proto.ReadResponse {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	elem, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry, _ := elem.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && !cache.now().Before(entry.expires) {
+		cache.remove(elem)
+
+		return nil
+	}
+
+	cache.lru.MoveToFront(elem)
+
+	return entry.rsp
+}
+
+// put will cache the response for the key, evicting the least recently used response if the cache is full.
+func (cache *readCache) put(key, table string, rsp *proto.ReadResponse) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	if elem, ok := cache.entries[key]; ok {
+		cache.remove(elem)
+	}
+
+	entry := &cacheEntry{key: key, table: table, rsp: rsp}
+	if cache.opts.TTL > 0 {
+		entry.expires = cache.now().Add(cache.opts.TTL)
+	}
+
+	cache.entries[key] = cache.lru.PushFront(entry)
+
+	for cache.lru.Len() > cache.opts.Size {
+		cache.remove(cache.lru.Back())
+	}
+}
+
+// invalidate will remove the cached responses for the tables.
+func (cache *readCache) invalidate(tables ...string) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	invalid := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		invalid[table] = true
+	}
+
+	for elem := cache.lru.Front(); elem != nil; {
+		next := elem.Next()
+
+		if entry, _ := elem.Value.(*cacheEntry); invalid[entry.table] {
+			cache.remove(elem)
+		}
+
+		elem = next
+	}
+}
+
+func (cache *readCache) remove(elem *list.Element) {
+	entry, _ := cache.lru.Remove(elem).(*cacheEntry)
+	delete(cache.entries, entry.key)
+}
+
+// cached is a repository whose reads are served from a read cache.
+type cached struct {
+	Generic
+	cache *readCache
+
+	// tx is set for the repository of a transaction, whose reads can see uncommitted writes and so are not cached.
+	tx bool
+
+	// written are the tables written in the transaction, shared by the repository and the repositories passed to
+	// "Transact".
+	written *writtenTables
+}
+
+// writtenTables are the tables written in a transaction. Their cached reads are invalidated again when the transaction
+// commits or rolls back, since other readers may have cached the previous records while it was open.
+type writtenTables struct {
+	mtx    sync.Mutex
+	tables map[string]bool
+}
+
+// add will record the tables as written.
+func (written *writtenTables) add(tables ...string) {
+	written.mtx.Lock()
+	defer written.mtx.Unlock()
+
+	for _, table := range tables {
+		written.tables[table] = true
+	}
+}
+
+// drain will return the written tables and forget them.
+func (written *writtenTables) drain() []string {
+	written.mtx.Lock()
+	defer written.mtx.Unlock()
+
+	tables := make([]string, 0, len(written.tables))
+	for table := range written.tables {
+		tables = append(tables, table)
+	}
+
+	written.tables = make(map[string]bool)
+
+	return tables
+}
+
+// Cache will return the repository with a read-through cache in front of "Read", so that identical repeated reads
+// are not made against the storage. Requests are identical if they have the same table and required fields, in any
+// order. Upserts and truncates through the returned repository invalidate the cached reads of their tables, but
+// writes made to the storage by other clients are only seen once the cached responses expire.
+func Cache(repo Generic, opts CacheOptions) Generic {
+	if opts.Size <= 0 {
+		opts.Size = 1024
+	}
+
+	return &cached{Generic: repo, cache: &readCache{
+		opts:    opts,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}, written: &writtenTables{tables: make(map[string]bool)}}
+}
+
+// readCacheKey will return the normalized key of the read request.
+func readCacheKey(req *proto.ReadRequest) (string, error) {
+	key, err := protobuf.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling read request: %w", err)
+	}
+
+	return string(key), nil
+}
+
+// Read will return the cached response for the request, or read the records from the table and cache the response.
+// Callers receive a copy of the cached response.
+func (repo *cached) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	if repo.tx {
+		rsp, err := repo.Generic.Read(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("error reading table: %w", err)
+		}
+
+		return rsp, nil
+	}
+
+	key, err := readCacheKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp := repo.cache.get(key); rsp != nil {
+		return cloneReadResponse(rsp), nil
+	}
+
+	rsp, err := repo.Generic.Read(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("error reading table: %w", err)
+	}
+
+	repo.cache.put(key, req.GetTable(), cloneReadResponse(rsp))
+
+	return rsp, nil
+}
+
+func cloneReadResponse(rsp *proto.ReadResponse) *proto.ReadResponse {
+	clone, _ := protobuf.Clone(rsp).(*proto.ReadResponse)
+
+	return clone
+}
+
+// invalidate will remove the cached reads of the tables, and record them as written if the repository is of a
+// transaction.
+func (repo *cached) invalidate(tables ...string) {
+	repo.cache.invalidate(tables...)
+
+	if repo.tx {
+		repo.written.add(tables...)
+	}
+}
+
+// Upsert will upsert the records into the table, and invalidate the cached reads of the table.
+func (repo *cached) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	defer repo.invalidate(req.GetTable())
+
+	rsp, err := repo.Generic.Upsert(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("error upserting records: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// Truncate will truncate the tables, and invalidate the cached reads of the tables.
+func (repo *cached) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	defer repo.invalidate(req.GetTables()...)
+
+	rsp, err := repo.Generic.Truncate(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("error truncating tables: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// Transact will send the function to the transaction, with the writes made through the repository passed to the
+// function also invalidating the cache, both when they are made and when the transaction commits or rolls back. Reads
+// in the transaction are not cached.
+func (repo *cached) Transact(fn func(ctx context.Context, repo Generic) error) {
+	repo.Generic.Transact(func(ctx context.Context, txRepo Generic) error {
+		return fn(ctx, &cached{Generic: txRepo, cache: repo.cache, tx: true, written: repo.written})
+	})
+}
+
+// Commit will commit the transaction, and invalidate the cached reads of the tables written in it.
+func (repo *cached) Commit() error {
+	defer func() { repo.cache.invalidate(repo.written.drain()...) }()
+
+	if err := repo.Generic.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// Rollback will roll back the transaction, and invalidate the cached reads of the tables written in it.
+func (repo *cached) Rollback() error {
+	defer func() { repo.cache.invalidate(repo.written.drain()...) }()
+
+	if err := repo.Generic.Rollback(); err != nil {
+		return fmt.Errorf("error rolling back transaction: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package repository
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	readReq := func(t *testing.T, required map[string]interface{}) *proto.ReadRequest {
+		t.Helper()
+
+		pbreq, err := structpb.NewStruct(required)
+		if err != nil {
+			t.Fatalf("failed to create required fields: %v", err)
+		}
+
+		return &proto.ReadRequest{Table: "candles", Required: pbreq}
+	}
+
+	t.Run("identical reads are cached", func(t *testing.T) {
+		t.Parallel()
+
+		inner := &recordingRepo{}
+		repo := Cache(inner, CacheOptions{})
+
+		for _, required := range []map[string]interface{}{
+			{"product_id": "BTC-USD", "granularity": 60.0},
+			{"granularity": 60.0, "product_id": "BTC-USD"},
+		} {
+			if _, err := repo.Read(ctx, readReq(t, required)); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+		}
+
+		if _, err := repo.Read(ctx, readReq(t, map[string]interface{}{"product_id": "ETH-USD"})); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+
+		if exp := []string{"read candles", "read candles"}; !reflect.DeepEqual(inner.ops, exp) {
+			t.Fatalf("expected operations %v, got %v", exp, inner.ops)
+		}
+	})
+
+	t.Run("writes invalidate the table", func(t *testing.T) {
+		t.Parallel()
+
+		inner := &recordingRepo{}
+		repo := Cache(inner, CacheOptions{})
+		req := readReq(t, map[string]interface{}{"product_id": "BTC-USD"})
+
+		read := func() {
+			if _, err := repo.Read(ctx, req); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+		}
+
+		read()
+
+		repo.Transact(func(ctx context.Context, txRepo Generic) error {
+			_, err := txRepo.Upsert(ctx, &proto.UpsertRequest{Table: "candles"})
+
+			return err
+		})
+
+		read()
+
+		if _, err := repo.Truncate(ctx, &proto.TruncateRequest{Tables: []string{"candles"}}); err != nil {
+			t.Fatalf("failed to truncate: %v", err)
+		}
+
+		read()
+		read()
+
+		exp := []string{"read candles", "upsert candles", "read candles", "truncate", "read candles"}
+		if !reflect.DeepEqual(inner.ops, exp) {
+			t.Fatalf("expected operations %v, got %v", exp, inner.ops)
+		}
+	})
+
+	t.Run("transactions invalidate the table when they end", func(t *testing.T) {
+		t.Parallel()
+
+		inner := &recordingRepo{}
+		repo := Cache(inner, CacheOptions{})
+		req := readReq(t, map[string]interface{}{"product_id": "BTC-USD"})
+
+		read := func() {
+			if _, err := repo.Read(ctx, req); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+		}
+
+		for _, end := range []func() error{repo.Commit, repo.Rollback} {
+			repo.Transact(func(ctx context.Context, txRepo Generic) error {
+				_, err := txRepo.Upsert(ctx, &proto.UpsertRequest{Table: "candles"})
+
+				return err
+			})
+
+			// A read before the transaction ends caches the records from before the upsert.
+			read()
+			read()
+
+			if err := end(); err != nil {
+				t.Fatalf("failed to end transaction: %v", err)
+			}
+
+			read()
+		}
+
+		exp := []string{
+			"upsert candles", "read candles", "commit", "read candles",
+			"upsert candles", "read candles", "rollback", "read candles",
+		}
+		if !reflect.DeepEqual(inner.ops, exp) {
+			t.Fatalf("expected operations %v, got %v", exp, inner.ops)
+		}
+	})
+
+	t.Run("expired and evicted reads are not served", func(t *testing.T) {
+		t.Parallel()
+
+		inner := &recordingRepo{}
+
+		repo, ok := Cache(inner, CacheOptions{Size: 1, TTL: time.Minute}).(*cached)
+		if !ok {
+			t.Fatalf("expected a cached repository")
+		}
+
+		now := time.Now()
+		repo.cache.now = func() time.Time { return now }
+
+		btc := readReq(t, map[string]interface{}{"product_id": "BTC-USD"})
+		eth := readReq(t, map[string]interface{}{"product_id": "ETH-USD"})
+
+		for _, step := range []struct {
+			req     *proto.ReadRequest
+			advance time.Duration
+		}{
+			{btc, 0},
+			{btc, 0},           // cached
+			{btc, time.Minute}, // expired
+			{eth, 0},           // evicts btc
+			{btc, 0},
+		} {
+			now = now.Add(step.advance)
+
+			if _, err := repo.Read(ctx, step.req); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+		}
+
+		if len(inner.ops) != 4 {
+			t.Fatalf("expected 4 reads to reach the repository, got %v", inner.ops)
+		}
+	})
+}
@@ -0,0 +1,259 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ErrPermissionDenied is returned when a repository operation is not allowed by the capabilities of the client.
+var ErrPermissionDenied = fmt.Errorf("permission denied")
+
+// PermissionDeniedError is returned when the client is not allowed to perform the operation on the table.
+func PermissionDeniedError(client, operation, table string) error {
+	return fmt.Errorf("%w: client %q can not %s %q", ErrPermissionDenied, client, operation, table)
+}
+
+// Capabilities are the operations that a client of a shared repository, e.g. a team using gidari as a storage
+// gateway, is allowed to perform.
+type Capabilities struct {
+	// Client is the name of the client, used in permission errors.
+	Client string `yaml:"client"`
+
+	// ReadOnly denies every write, i.e. upserts and truncates.
+	ReadOnly bool `yaml:"readOnly"`
+
+	// DenyTruncate denies truncating tables, while still allowing upserts.
+	DenyTruncate bool `yaml:"denyTruncate"`
+
+	// Tables are the tables that the client is allowed to access. If empty, every table is allowed. Tables that are
+	// not allowed are also left out of the table and primary key listings.
+	Tables []string `yaml:"tables"`
+
+	// Columns are the columns of each table that the client is allowed to read, keyed by table. Columns that are not
+	// allowed are removed from the records of read responses, e.g. to hide PII columns from analytics clients.
+	Columns map[string]ColumnAccess `yaml:"columns"`
+}
+
+// ColumnAccess is the list of columns of a table that a client is allowed, or not allowed, to read.
+type ColumnAccess struct {
+	// Allow are the columns that the client is allowed to read. If empty, every column that is not denied is allowed.
+	Allow []string `yaml:"allow"`
+
+	// Deny are the columns that the client is not allowed to read, even if they are allowed.
+	Deny []string `yaml:"deny"`
+}
+
+// allowsColumn will return true if the client is allowed to read the column of the table.
+func (caps *Capabilities) allowsColumn(table, column string) bool {
+	access, ok := caps.Columns[table]
+	if !ok {
+		return true
+	}
+
+	for _, denied := range access.Deny {
+		if denied == column {
+			return false
+		}
+	}
+
+	if len(access.Allow) == 0 {
+		return true
+	}
+
+	for _, allowed := range access.Allow {
+		if allowed == column {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hiddenColumn will return a column of the table that the read request filters or sorts by, and that the client is
+// not allowed to read. Filtering or sorting by a hidden column would reveal its values.
+func (caps *Capabilities) hiddenColumn(req *proto.ReadRequest) (string, bool) {
+	if _, ok := caps.Columns[req.GetTable()]; !ok {
+		return "", false
+	}
+
+	columns := make([]string, 0, len(req.GetRequired().GetFields()))
+	for column := range req.GetRequired().GetFields() {
+		columns = append(columns, column)
+	}
+
+	for _, value := range req.GetOptions().GetFields()[storage.ReadOrderByOption].GetListValue().GetValues() {
+		columns = append(columns, value.GetStringValue())
+	}
+
+	for _, column := range columns {
+		if !caps.allowsColumn(req.GetTable(), column) {
+			return column, true
+		}
+	}
+
+	return "", false
+}
+
+// filterColumns will remove the columns that the client is not allowed to read from the records of the table.
+func (caps *Capabilities) filterColumns(table string, records []*structpb.Struct) {
+	if _, ok := caps.Columns[table]; !ok {
+		return
+	}
+
+	for _, record := range records {
+		for column := range record.GetFields() {
+			if !caps.allowsColumn(table, column) {
+				delete(record.Fields, column)
+			}
+		}
+	}
+}
+
+// allowsTable will return true if the client is allowed to access the table.
+func (caps *Capabilities) allowsTable(table string) bool {
+	if len(caps.Tables) == 0 {
+		return true
+	}
+
+	for _, allowed := range caps.Tables {
+		if allowed == table {
+			return true
+		}
+	}
+
+	return false
+}
+
+// restricted is a repository whose operations are limited by the capabilities of a client.
+type restricted struct {
+	Generic
+	caps *Capabilities
+}
+
+// Restrict will return the repository with its operations limited by the capabilities of the client. Operations
+// that are not allowed return an error wrapping "ErrPermissionDenied" without reaching storage.
+func Restrict(repo Generic, caps Capabilities) Generic {
+	return &restricted{Generic: repo, caps: &caps}
+}
+
+// Read will read the records from the table, if the client is allowed to access the table, with the columns that the
+// client is not allowed to read removed from the records. Reads that filter or sort by such a column are denied.
+func (repo *restricted) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	if !repo.caps.allowsTable(req.GetTable()) {
+		return nil, PermissionDeniedError(repo.caps.Client, "read", req.GetTable())
+	}
+
+	if column, ok := repo.caps.hiddenColumn(req); ok {
+		return nil, PermissionDeniedError(repo.caps.Client, "read", req.GetTable()+"."+column)
+	}
+
+	rsp, err := repo.Generic.Read(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("error reading table: %w", err)
+	}
+
+	repo.caps.filterColumns(req.GetTable(), rsp.GetRecords())
+
+	return rsp, nil
+}
+
+// Count will count the records of the table, if the client is allowed to access the table. Counts that filter by a
+// column that the client is not allowed to read are denied, like reads.
+func (repo *restricted) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	if !repo.caps.allowsTable(req.GetTable()) {
+		return nil, PermissionDeniedError(repo.caps.Client, "count", req.GetTable())
+	}
+
+	read := &proto.ReadRequest{Table: req.GetTable(), Required: req.GetRequired()}
+	if column, ok := repo.caps.hiddenColumn(read); ok {
+		return nil, PermissionDeniedError(repo.caps.Client, "count", req.GetTable()+"."+column)
+	}
+
+	rsp, err := repo.Generic.Count(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("error counting records: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// Upsert will upsert the records into the table, if the client is allowed to write to the table.
+func (repo *restricted) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	if repo.caps.ReadOnly || !repo.caps.allowsTable(req.GetTable()) {
+		return nil, PermissionDeniedError(repo.caps.Client, "upsert", req.GetTable())
+	}
+
+	rsp, err := repo.Generic.Upsert(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("error upserting records: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// Truncate will truncate the tables, if the client is allowed to truncate every table on the request.
+func (repo *restricted) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	for _, table := range req.GetTables() {
+		if repo.caps.ReadOnly || repo.caps.DenyTruncate || !repo.caps.allowsTable(table) {
+			return nil, PermissionDeniedError(repo.caps.Client, "truncate", table)
+		}
+	}
+
+	rsp, err := repo.Generic.Truncate(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("error truncating tables: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// ListTables will list the tables that the client is allowed to access.
+func (repo *restricted) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	rsp, err := repo.Generic.ListTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	for table := range rsp.GetTableSet() {
+		if !repo.caps.allowsTable(table) {
+			delete(rsp.TableSet, table)
+		}
+	}
+
+	return rsp, nil
+}
+
+// ListPrimaryKeys will list the primary keys of the tables that the client is allowed to access.
+func (repo *restricted) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	rsp, err := repo.Generic.ListPrimaryKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing primary keys: %w", err)
+	}
+
+	for table := range rsp.GetPKSet() {
+		if !repo.caps.allowsTable(table) {
+			delete(rsp.PKSet, table)
+		}
+	}
+
+	return rsp, nil
+}
+
+// Transact will send the function to the transaction, with the repository passed to the function limited by the same
+// capabilities.
+func (repo *restricted) Transact(fn func(ctx context.Context, repo Generic) error) {
+	repo.Generic.Transact(func(ctx context.Context, txRepo Generic) error {
+		return fn(ctx, &restricted{Generic: txRepo, caps: repo.caps})
+	})
+}
@@ -0,0 +1,228 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// recordingRepo is a repository that records the operations that reach it.
+type recordingRepo struct {
+	Generic
+	ops []string
+}
+
+func (repo *recordingRepo) Read(_ context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	repo.ops = append(repo.ops, "read "+req.GetTable())
+
+	record, err := structpb.NewStruct(map[string]interface{}{"id": 1})
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.ReadResponse{Records: []*structpb.Struct{record}}, nil
+}
+
+func (repo *recordingRepo) Count(_ context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	repo.ops = append(repo.ops, "count "+req.GetTable())
+
+	return &proto.CountResponse{Count: 2}, nil
+}
+
+func (repo *recordingRepo) Upsert(_ context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	repo.ops = append(repo.ops, "upsert "+req.GetTable())
+
+	return &proto.UpsertResponse{}, nil
+}
+
+func (repo *recordingRepo) Truncate(_ context.Context, _ *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	repo.ops = append(repo.ops, "truncate")
+
+	return &proto.TruncateResponse{}, nil
+}
+
+func (repo *recordingRepo) ListTables(context.Context) (*proto.ListTablesResponse, error) {
+	return &proto.ListTablesResponse{TableSet: map[string]*proto.Table{"candles": {}, "orders": {}}}, nil
+}
+
+func (repo *recordingRepo) ListPrimaryKeys(context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	return &proto.ListPrimaryKeysResponse{PKSet: map[string]*proto.PrimaryKeys{"candles": {}, "orders": {}}}, nil
+}
+
+func (repo *recordingRepo) Transact(fn func(ctx context.Context, repo Generic) error) {
+	_ = fn(context.Background(), repo)
+}
+
+func (repo *recordingRepo) Commit() error {
+	repo.ops = append(repo.ops, "commit")
+
+	return nil
+}
+
+func (repo *recordingRepo) Rollback() error {
+	repo.ops = append(repo.ops, "rollback")
+
+	return nil
+}
+
+func TestRestrict(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("read only", func(t *testing.T) {
+		t.Parallel()
+
+		inner := new(recordingRepo)
+		repo := Restrict(inner, Capabilities{Client: "analytics", ReadOnly: true})
+
+		if _, err := repo.Read(ctx, &proto.ReadRequest{Table: "candles"}); err != nil {
+			t.Fatalf("expected read to be allowed, got %v", err)
+		}
+
+		if _, err := repo.Upsert(ctx, &proto.UpsertRequest{Table: "candles"}); !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("expected upsert to be denied, got %v", err)
+		}
+
+		req := &proto.TruncateRequest{Tables: []string{"candles"}}
+		if _, err := repo.Truncate(ctx, req); !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("expected truncate to be denied, got %v", err)
+		}
+
+		if len(inner.ops) != 1 {
+			t.Fatalf("expected only the read to reach the repository, got %v", inner.ops)
+		}
+	})
+
+	t.Run("deny truncate", func(t *testing.T) {
+		t.Parallel()
+
+		inner := new(recordingRepo)
+		repo := Restrict(inner, Capabilities{DenyTruncate: true})
+
+		if _, err := repo.Upsert(ctx, &proto.UpsertRequest{Table: "candles"}); err != nil {
+			t.Fatalf("expected upsert to be allowed, got %v", err)
+		}
+
+		req := &proto.TruncateRequest{Tables: []string{"candles"}}
+		if _, err := repo.Truncate(ctx, req); !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("expected truncate to be denied, got %v", err)
+		}
+	})
+
+	t.Run("tables", func(t *testing.T) {
+		t.Parallel()
+
+		inner := new(recordingRepo)
+		repo := Restrict(inner, Capabilities{Tables: []string{"candles"}})
+
+		if _, err := repo.Read(ctx, &proto.ReadRequest{Table: "orders"}); !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("expected read to be denied, got %v", err)
+		}
+
+		if _, err := repo.Count(ctx, &proto.CountRequest{Table: "orders"}); !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("expected count to be denied, got %v", err)
+		}
+
+		if ok, err := Exists(ctx, repo, &proto.CountRequest{Table: "candles"}); err != nil || !ok {
+			t.Fatalf("expected records to exist in the allowed table, got %v: %v", ok, err)
+		}
+
+		req := &proto.TruncateRequest{Tables: []string{"candles", "orders"}}
+		if _, err := repo.Truncate(ctx, req); !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("expected truncate to be denied, got %v", err)
+		}
+
+		tables, err := repo.ListTables(ctx)
+		if err != nil {
+			t.Fatalf("failed to list tables: %v", err)
+		}
+
+		if _, ok := tables.GetTableSet()["orders"]; ok || len(tables.GetTableSet()) != 1 {
+			t.Fatalf("expected only the allowed tables, got %v", tables.GetTableSet())
+		}
+
+		pks, err := repo.ListPrimaryKeys(ctx)
+		if err != nil {
+			t.Fatalf("failed to list primary keys: %v", err)
+		}
+
+		if _, ok := pks.GetPKSet()["orders"]; ok || len(pks.GetPKSet()) != 1 {
+			t.Fatalf("expected only the allowed primary keys, got %v", pks.GetPKSet())
+		}
+	})
+
+	t.Run("columns", func(t *testing.T) {
+		t.Parallel()
+
+		repo := Restrict(&pagedRepo{ids: []float64{1}}, Capabilities{Columns: map[string]ColumnAccess{
+			"trades": {Deny: []string{"id"}},
+		}})
+
+		limit, _ := structpb.NewStruct(map[string]interface{}{storage.ReadLimitOption: 1})
+
+		rsp, err := repo.Read(ctx, &proto.ReadRequest{Table: "trades", Options: limit})
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+
+		if len(rsp.GetRecords()) != 1 || len(rsp.GetRecords()[0].GetFields()) != 0 {
+			t.Fatalf("expected the denied column to be removed, got %v", rsp.GetRecords())
+		}
+
+		required, _ := structpb.NewStruct(map[string]interface{}{"id": 1})
+
+		_, err = repo.Read(ctx, &proto.ReadRequest{Table: "trades", Required: required, Options: limit})
+		if !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("expected a read filtered by a denied column to be denied, got %v", err)
+		}
+
+		if _, err := repo.Count(ctx, &proto.CountRequest{Table: "trades", Required: required}); !errors.Is(err,
+			ErrPermissionDenied) {
+			t.Fatalf("expected a count filtered by a denied column to be denied, got %v", err)
+		}
+
+		caps := &Capabilities{Columns: map[string]ColumnAccess{
+			"users": {Allow: []string{"id", "email"}, Deny: []string{"email"}},
+		}}
+		for column, exp := range map[string]bool{"id": true, "email": false, "name": false} {
+			if caps.allowsColumn("users", column) != exp {
+				t.Fatalf("expected column %q to be allowed: %v", column, exp)
+			}
+		}
+
+		if !caps.allowsColumn("trades", "email") {
+			t.Fatalf("expected the columns of other tables to be allowed")
+		}
+	})
+
+	t.Run("transact", func(t *testing.T) {
+		t.Parallel()
+
+		inner := new(recordingRepo)
+		repo := Restrict(inner, Capabilities{ReadOnly: true})
+
+		var err error
+
+		repo.Transact(func(ctx context.Context, txRepo Generic) error {
+			_, err = txRepo.Upsert(ctx, &proto.UpsertRequest{Table: "candles"})
+
+			return err
+		})
+
+		if !errors.Is(err, ErrPermissionDenied) || len(inner.ops) != 0 {
+			t.Fatalf("expected upsert in transaction to be denied, got %v", err)
+		}
+	})
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/alpine-hodler/gidari/internal/storage"
 	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 // ErrFailedToCreateRepository is returned when the repository layer fails to create a new repository.
@@ -38,19 +39,20 @@ type GenericService struct {
 	*storage.Txn
 }
 
-// New returns a new Generic service.
-func New(ctx context.Context, dns string) (*GenericService, error) {
+// New returns a new Generic service. The options inject the logger, metrics, and tracer of the application that
+// embeds gidari, which the storage operations of the service are reported to.
+func New(ctx context.Context, dns string, opts ...Option) (*GenericService, error) {
 	stg, err := storage.New(ctx, dns)
 	if err != nil {
 		return nil, fmt.Errorf("failed to construct storage: %w", err)
 	}
 
-	return &GenericService{stg, nil}, nil
+	return &GenericService{observe(stg, opts), nil}, nil
 }
 
 // NewTx returns a new Generic service with an initialized transaction object that can be used to commit or rollback
-// storage operations made by the repository layer.
-func NewTx(ctx context.Context, dns string) (*GenericService, error) {
+// storage operations made by the repository layer. The options are the same as for "New".
+func NewTx(ctx context.Context, dns string, opts ...Option) (*GenericService, error) {
 	stg, err := storage.New(ctx, dns)
 	if err != nil {
 		return nil, fmt.Errorf("failed to construct storage: %w", err)
@@ -61,7 +63,7 @@ func NewTx(ctx context.Context, dns string) (*GenericService, error) {
 		return nil, fmt.Errorf("failed to start transaction: %w", err)
 	}
 
-	return &GenericService{stg, tx}, nil
+	return &GenericService{observe(stg, opts), tx}, nil
 }
 
 // Transact is a helper function that wraps a function in a transaction and commits or rolls back the transaction. If
@@ -86,3 +88,19 @@ func (svc *GenericService) Truncate(ctx context.Context, req *proto.TruncateRequ
 
 	return rsp, nil
 }
+
+// Exists will return true if at least one record of the table matches the required fields of the request. The
+// records are read with a limit of one, so that storage devices stop at the first match.
+func Exists(ctx context.Context, stg storage.Storage, req *proto.CountRequest) (bool, error) {
+	opts, err := structpb.NewStruct(map[string]interface{}{storage.ReadLimitOption: 1})
+	if err != nil {
+		return false, fmt.Errorf("error building read options: %w", err)
+	}
+
+	rsp, err := stg.Read(ctx, &proto.ReadRequest{Table: req.GetTable(), Required: req.GetRequired(), Options: opts})
+	if err != nil {
+		return false, fmt.Errorf("error reading records: %w", err)
+	}
+
+	return len(rsp.GetRecords()) > 0, nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package repository
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/sirupsen/logrus"
+)
+
+// Operation is a storage operation of a repository, reported to the logger, metrics, and tracer of the application
+// that embeds gidari.
+type Operation struct {
+	// Name is the name of the operation, i.e. "read", "count", "upsert", "truncate", "listTables", or
+	// "listPrimaryKeys".
+	Name string
+
+	// Table is the table of the operation, or the comma separated tables of a truncate. It is empty for listings.
+	Table string
+
+	// Records is the number of records read, counted, upserted, or deleted.
+	Records int64
+
+	// Latency is how long the operation took.
+	Latency time.Duration
+
+	// Err is the error of the operation, if it failed.
+	Err error
+}
+
+// Logger is the logger that the operations of a repository are logged to.
+type Logger interface {
+	LogOperation(ctx context.Context, op *Operation)
+}
+
+// Metrics is the metrics registry that the operations of a repository are recorded in, e.g. an adapter that observes
+// the latency of each operation in a histogram labeled by the name and the table of the operation.
+type Metrics interface {
+	ObserveOperation(ctx context.Context, op *Operation)
+}
+
+// Tracer is the tracer that the operations of a repository are traced with, e.g. an adapter for a tracer of the
+// tracer provider of the application.
+type Tracer interface {
+	// StartOperation will start a span for the operation and return the context of the span, which is passed to the
+	// storage, and the function that ends the span once the operation completes.
+	StartOperation(ctx context.Context, name, table string) (context.Context, func(op *Operation))
+}
+
+// Option is an option of the repositories returned by "New" and "NewTx".
+type Option func(*observer)
+
+// WithLogger will log the operations of the repository to the logger.
+func WithLogger(logger Logger) Option {
+	return func(obs *observer) { obs.logger = logger }
+}
+
+// WithLogrus will log the operations of the repository to the logrus logger, with successful operations logged at
+// the debug level and failed operations at the error level.
+func WithLogrus(logger logrus.FieldLogger) Option {
+	return WithLogger(&logrusLogger{logger: logger})
+}
+
+// WithMetrics will record the operations of the repository in the metrics registry.
+func WithMetrics(metrics Metrics) Option {
+	return func(obs *observer) { obs.metrics = metrics }
+}
+
+// WithTracer will trace the operations of the repository with the tracer.
+func WithTracer(tracer Tracer) Option {
+	return func(obs *observer) { obs.tracer = tracer }
+}
+
+// logrusLogger is a logger that logs operations to a logrus logger.
+type logrusLogger struct {
+	logger logrus.FieldLogger
+}
+
+// LogOperation will log the operation with its table, records, and latency as fields.
+func (logger *logrusLogger) LogOperation(_ context.Context, op *Operation) {
+	entry := logger.logger.WithFields(logrus.Fields{
+		"operation": op.Name,
+		"table":     op.Table,
+		"records":   op.Records,
+		"latency":   op.Latency,
+	})
+
+	if op.Err != nil {
+		entry.WithError(op.Err).Error("repository operation failed")
+
+		return
+	}
+
+	entry.Debug("repository operation")
+}
+
+// observer reports the operations of a repository to the observability stack of the application.
+type observer struct {
+	logger  Logger
+	metrics Metrics
+	tracer  Tracer
+}
+
+// start will start the span of the operation, if there is a tracer, and return the context of the span and the
+// function that reports the completed operation.
+func (obs *observer) start(ctx context.Context, name, table string) (context.Context, func(records int64, err error)) {
+	begin := time.Now()
+
+	end := func(*Operation) {}
+	if obs.tracer != nil {
+		ctx, end = obs.tracer.StartOperation(ctx, name, table)
+	}
+
+	return ctx, func(records int64, err error) {
+		op := &Operation{Name: name, Table: table, Records: records, Latency: time.Since(begin), Err: err}
+
+		end(op)
+
+		if obs.metrics != nil {
+			obs.metrics.ObserveOperation(ctx, op)
+		}
+
+		if obs.logger != nil {
+			obs.logger.LogOperation(ctx, op)
+		}
+	}
+}
+
+// observedStorage is a storage whose operations are reported to an observer.
+type observedStorage struct {
+	storage.Storage
+	obs *observer
+}
+
+// observe will return the storage with its operations reported to the observer of the options, or the storage if
+// there are no options.
+func observe(stg storage.Storage, opts []Option) storage.Storage {
+	if len(opts) == 0 {
+		return stg
+	}
+
+	obs := new(observer)
+	for _, opt := range opts {
+		opt(obs)
+	}
+
+	return &observedStorage{Storage: stg, obs: obs}
+}
+
+// ListPrimaryKeys will list the primary keys of the tables and report the operation.
+func (stg *observedStorage) ListPrimaryKeys(ctx context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	ctx, done := stg.obs.start(ctx, "listPrimaryKeys", "")
+
+	rsp, err := stg.Storage.ListPrimaryKeys(ctx)
+	done(0, err)
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing primary keys: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// ListTables will list the tables and report the operation.
+func (stg *observedStorage) ListTables(ctx context.Context) (*proto.ListTablesResponse, error) {
+	ctx, done := stg.obs.start(ctx, "listTables", "")
+
+	rsp, err := stg.Storage.ListTables(ctx)
+	done(0, err)
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// Read will read the records from the table and report the operation.
+func (stg *observedStorage) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	ctx, done := stg.obs.start(ctx, "read", req.GetTable())
+
+	rsp, err := stg.Storage.Read(ctx, req)
+	done(int64(len(rsp.GetRecords())), err)
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading table: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// Count will count the records of the table and report the operation.
+func (stg *observedStorage) Count(ctx context.Context, req *proto.CountRequest) (*proto.CountResponse, error) {
+	ctx, done := stg.obs.start(ctx, "count", req.GetTable())
+
+	rsp, err := stg.Storage.Count(ctx, req)
+	done(rsp.GetCount(), err)
+
+	if err != nil {
+		return nil, fmt.Errorf("error counting records: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// Upsert will upsert the records into the table and report the operation.
+func (stg *observedStorage) Upsert(ctx context.Context, req *proto.UpsertRequest) (*proto.UpsertResponse, error) {
+	ctx, done := stg.obs.start(ctx, "upsert", req.GetTable())
+
+	rsp, err := stg.Storage.Upsert(ctx, req)
+	done(rsp.GetUpsertedCount()+rsp.GetMatchedCount(), err)
+
+	if err != nil {
+		return nil, fmt.Errorf("error upserting records: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// Truncate will truncate the tables and report the operation.
+func (stg *observedStorage) Truncate(ctx context.Context, req *proto.TruncateRequest) (*proto.TruncateResponse, error) {
+	ctx, done := stg.obs.start(ctx, "truncate", strings.Join(req.GetTables(), ","))
+
+	rsp, err := stg.Storage.Truncate(ctx, req)
+	done(int64(rsp.GetDeletedCount()), err)
+
+	if err != nil {
+		return nil, fmt.Errorf("error truncating tables: %w", err)
+	}
+
+	return rsp, nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+
+//go:build go1.21
+
+package repository
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// WithSlogHandler will log the operations of the repository to the "slog.Handler", with successful operations logged
+// at the debug level and failed operations at the error level. The context of the operation is passed to the
+// handler, so that handlers can correlate the records with the trace of the operation.
+func WithSlogHandler(handler slog.Handler) Option {
+	return WithLogger(&slogLogger{handler: handler})
+}
+
+// slogLogger is a logger that logs operations to a "slog.Handler".
+type slogLogger struct {
+	handler slog.Handler
+}
+
+// LogOperation will log the operation with its table, records, and latency as attributes.
+func (logger *slogLogger) LogOperation(ctx context.Context, op *Operation) {
+	level, msg := slog.LevelDebug, "repository operation"
+	if op.Err != nil {
+		level, msg = slog.LevelError, "repository operation failed"
+	}
+
+	if !logger.handler.Enabled(ctx, level) {
+		return
+	}
+
+	record := slog.NewRecord(time.Now(), level, msg, 0)
+	record.AddAttrs(
+		slog.String("operation", op.Name),
+		slog.String("table", op.Table),
+		slog.Int64("records", op.Records),
+		slog.Duration("latency", op.Latency),
+	)
+
+	if op.Err != nil {
+		record.AddAttrs(slog.String("error", op.Err.Error()))
+	}
+
+	// Errors of the handler are not errors of the operation.
+	_ = logger.handler.Handle(ctx, record)
+}
@@ -0,0 +1,52 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+
+//go:build go1.21
+
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/proto"
+)
+
+func TestWithSlogHandler(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelError})
+	stg := observe(new(spanRepo), []Option{WithSlogHandler(handler)})
+
+	if _, err := stg.Read(context.Background(), &proto.ReadRequest{Table: "candles"}); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+
+	if buf.Len() != 0 {
+		t.Fatalf("expected successful operations to be logged below the level of the handler, got %s", buf.String())
+	}
+
+	if _, err := stg.Read(context.Background(), &proto.ReadRequest{Table: "missing"}); err == nil {
+		t.Fatal("expected the read to fail")
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to unmarshal log entry: %v", err)
+	}
+
+	if entry["level"] != "ERROR" || entry["operation"] != "read" || entry["table"] != "missing" ||
+		entry["error"] == nil {
+		t.Fatalf("unexpected log entry %v", entry)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package repository
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+type spanKey struct{}
+
+// spanRepo is a repository that records the span of the context of its reads, and fails to read the table "missing".
+type spanRepo struct {
+	recordingRepo
+	spans []interface{}
+}
+
+func (repo *spanRepo) Read(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	repo.spans = append(repo.spans, ctx.Value(spanKey{}))
+
+	if req.GetTable() == "missing" {
+		return nil, fmt.Errorf("relation does not exist")
+	}
+
+	return &proto.ReadResponse{}, nil
+}
+
+// operationRecorder is a logger, metrics registry, and tracer that records the operations reported to it.
+type operationRecorder struct {
+	logged, observed, ended []*Operation
+}
+
+func (rec *operationRecorder) LogOperation(_ context.Context, op *Operation) {
+	rec.logged = append(rec.logged, op)
+}
+
+func (rec *operationRecorder) ObserveOperation(ctx context.Context, op *Operation) {
+	if ctx.Value(spanKey{}) == nil {
+		panic("metrics observed without the span context")
+	}
+
+	rec.observed = append(rec.observed, op)
+}
+
+func (rec *operationRecorder) StartOperation(ctx context.Context, name, table string) (context.Context,
+	func(op *Operation),
+) {
+	return context.WithValue(ctx, spanKey{}, name+" "+table), func(op *Operation) {
+		rec.ended = append(rec.ended, op)
+	}
+}
+
+func TestObserve(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("no options", func(t *testing.T) {
+		t.Parallel()
+
+		inner := new(spanRepo)
+		if stg := observe(inner, nil); stg != inner {
+			t.Fatal("expected the storage to be returned without options")
+		}
+	})
+
+	t.Run("logger metrics and tracer", func(t *testing.T) {
+		t.Parallel()
+
+		inner := new(spanRepo)
+		rec := new(operationRecorder)
+		stg := observe(inner, []Option{WithLogger(rec), WithMetrics(rec), WithTracer(rec)})
+
+		if _, err := stg.Read(ctx, &proto.ReadRequest{Table: "candles"}); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+
+		if _, err := stg.Read(ctx, &proto.ReadRequest{Table: "missing"}); err == nil {
+			t.Fatal("expected the read to fail")
+		}
+
+		if len(inner.spans) != 2 || inner.spans[0] != "read candles" || inner.spans[1] != "read missing" {
+			t.Fatalf("expected the span contexts to reach the storage, got %v", inner.spans)
+		}
+
+		for _, ops := range [][]*Operation{rec.logged, rec.observed, rec.ended} {
+			if len(ops) != 2 {
+				t.Fatalf("expected 2 operations, got %d", len(ops))
+			}
+
+			if ops[0].Name != "read" || ops[0].Table != "candles" || ops[0].Err != nil {
+				t.Fatalf("unexpected operation %+v", ops[0])
+			}
+
+			if ops[1].Err == nil {
+				t.Fatalf("expected the error of the operation, got %+v", ops[1])
+			}
+		}
+	})
+
+	t.Run("logrus", func(t *testing.T) {
+		t.Parallel()
+
+		logger, hook := test.NewNullLogger()
+		logger.SetLevel(logrus.DebugLevel)
+
+		stg := observe(new(spanRepo), []Option{WithLogrus(logger)})
+
+		if _, err := stg.Read(ctx, &proto.ReadRequest{Table: "missing"}); err == nil {
+			t.Fatal("expected the read to fail")
+		}
+
+		entry := hook.LastEntry()
+		if entry == nil || entry.Level != logrus.ErrorLevel || entry.Data["table"] != "missing" {
+			t.Fatalf("expected an error entry for the table, got %+v", entry)
+		}
+
+		if entry.Data[logrus.ErrorKey] == nil {
+			t.Fatalf("expected the error of the operation, got %v", entry.Data)
+		}
+	})
+}
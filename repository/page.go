@@ -0,0 +1,201 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// defaultPageSize is the number of records in a page if the page size is not set.
+const defaultPageSize = 100
+
+// ErrInvalidCursor is returned when a page cursor can not be decoded or was issued for a different read.
+var ErrInvalidCursor = fmt.Errorf("invalid cursor")
+
+// InvalidCursorError is returned when the cursor is not valid for the read request.
+func InvalidCursorError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidCursor, reason)
+}
+
+// PageOptions are the options for reading a page of the records of a table.
+type PageOptions struct {
+	// Size is the maximum number of records in the page. The default is 100.
+	Size int
+
+	// OrderBy are the columns that the records are sorted by. The columns must uniquely identify a record for paging
+	// to be consistent. The default is the primary key of the table.
+	OrderBy []string
+
+	// Cursor is the "Next" cursor of the previous page, or empty for the first page.
+	Cursor string
+}
+
+// Page is a page of the records of a table.
+type Page struct {
+	// Records are the records in the page.
+	Records []*structpb.Struct
+
+	// Next is the cursor of the next page, or empty if this is the last page.
+	Next string
+}
+
+// pageCursor is the decoded form of a cursor: the sort keys of the read and the values of the sort keys of the last
+// record of the page.
+type pageCursor struct {
+	Table   string        `json:"table"`
+	OrderBy []string      `json:"orderBy"`
+	After   []interface{} `json:"after"`
+}
+
+func (cur *pageCursor) encode() (string, error) {
+	data, err := json.Marshal(cur)
+	if err != nil {
+		return "", fmt.Errorf("error encoding cursor: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodePageCursor(cursor string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, InvalidCursorError("malformed cursor")
+	}
+
+	cur := new(pageCursor)
+	if err := json.Unmarshal(data, cur); err != nil {
+		return nil, InvalidCursorError("malformed cursor")
+	}
+
+	return cur, nil
+}
+
+// pageOrder will return the columns to sort the page by: the columns of the cursor, the options, or the primary key
+// of the table, in that order.
+func pageOrder(ctx context.Context, repo Generic, table string, opts PageOptions,
+	cur *pageCursor,
+) ([]string, error) {
+	if cur != nil {
+		if cur.Table != table {
+			return nil, InvalidCursorError(fmt.Sprintf("cursor is for table %q", cur.Table))
+		}
+
+		if len(opts.OrderBy) > 0 && fmt.Sprint(opts.OrderBy) != fmt.Sprint(cur.OrderBy) {
+			return nil, InvalidCursorError(fmt.Sprintf("cursor is ordered by %v", cur.OrderBy))
+		}
+
+		return cur.OrderBy, nil
+	}
+
+	if len(opts.OrderBy) > 0 {
+		return opts.OrderBy, nil
+	}
+
+	pks, err := repo.ListPrimaryKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing primary keys: %w", err)
+	}
+
+	orderBy := pks.GetPKSet()[table].GetList()
+	if len(orderBy) == 0 {
+		return nil, fmt.Errorf("%w: table %q has no primary key to page by", ErrInvalidCursor, table)
+	}
+
+	return orderBy, nil
+}
+
+// ReadPage will read a page of the records from the table that match the required fields on the request. The records
+// are sorted by the sort keys of the page, and the "Next" cursor of a page encodes the sort keys and the values of
+// the last record of the page, so the next page starts after that record even if records are upserted in between.
+// Records upserted before the cursor position are not returned, and records upserted after it are returned once.
+func ReadPage(ctx context.Context, repo Generic, req *proto.ReadRequest, opts PageOptions) (*Page, error) {
+	if opts.Size <= 0 {
+		opts.Size = defaultPageSize
+	}
+
+	var cur *pageCursor
+
+	if opts.Cursor != "" {
+		var err error
+		if cur, err = decodePageCursor(opts.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	orderBy, err := pageOrder(ctx, repo, req.GetTable(), opts, cur)
+	if err != nil {
+		return nil, err
+	}
+
+	pageOpts := map[string]interface{}{
+		storage.ReadOrderByOption: stringsToInterfaces(orderBy),
+
+		// Read one record more than the page size to know if there is a next page.
+		storage.ReadLimitOption: opts.Size + 1,
+	}
+
+	if cur != nil {
+		if len(cur.After) != len(orderBy) {
+			return nil, InvalidCursorError("cursor does not have a value for each sort key")
+		}
+
+		pageOpts[storage.ReadAfterOption] = cur.After
+	}
+
+	pageReq, _ := protobuf.Clone(req).(*proto.ReadRequest)
+	if pageReq.Options, err = structpb.NewStruct(pageOpts); err != nil {
+		return nil, fmt.Errorf("error building page options: %w", err)
+	}
+
+	rsp, err := repo.Read(ctx, pageReq)
+	if err != nil {
+		return nil, fmt.Errorf("error reading page: %w", err)
+	}
+
+	page := &Page{Records: rsp.GetRecords()}
+	if len(page.Records) <= opts.Size {
+		return page, nil
+	}
+
+	page.Records = page.Records[:opts.Size]
+
+	last := page.Records[len(page.Records)-1].AsMap()
+	next := &pageCursor{Table: req.GetTable(), OrderBy: orderBy, After: make([]interface{}, len(orderBy))}
+
+	for idx, column := range orderBy {
+		value, ok := last[column]
+		if !ok {
+			return nil, fmt.Errorf("%w: record has no value for sort key %q", ErrInvalidCursor, column)
+		}
+
+		next.After[idx] = value
+	}
+
+	if page.Next, err = next.encode(); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	out := make([]interface{}, len(values))
+	for idx, value := range values {
+		out[idx] = value
+	}
+
+	return out
+}
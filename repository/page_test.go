@@ -0,0 +1,125 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package repository
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/alpine-hodler/gidari/internal/storage"
+	"github.com/alpine-hodler/gidari/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// pagedRepo is a repository with a table of records keyed by "id", that serves the page options of reads.
+type pagedRepo struct {
+	Generic
+	ids []float64
+}
+
+func (repo *pagedRepo) ListPrimaryKeys(context.Context) (*proto.ListPrimaryKeysResponse, error) {
+	return &proto.ListPrimaryKeysResponse{PKSet: map[string]*proto.PrimaryKeys{"trades": {List: []string{"id"}}}}, nil
+}
+
+func (repo *pagedRepo) Read(_ context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	opts := req.GetOptions().AsMap()
+
+	ids := append([]float64(nil), repo.ids...)
+	sort.Float64s(ids)
+
+	rsp := new(proto.ReadResponse)
+
+	for _, id := range ids {
+		if after, ok := opts[storage.ReadAfterOption].([]interface{}); ok && id <= after[0].(float64) {
+			continue
+		}
+
+		if len(rsp.Records) == int(opts[storage.ReadLimitOption].(float64)) {
+			break
+		}
+
+		record, _ := structpb.NewStruct(map[string]interface{}{"id": id})
+		rsp.Records = append(rsp.Records, record)
+	}
+
+	return rsp, nil
+}
+
+func TestReadPage(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("pages are consistent while records are upserted", func(t *testing.T) {
+		t.Parallel()
+
+		repo := &pagedRepo{ids: []float64{1, 2, 3, 4, 5}}
+		req := &proto.ReadRequest{Table: "trades"}
+
+		var (
+			got    []float64
+			cursor string
+		)
+
+		for pages := 0; ; pages++ {
+			page, err := ReadPage(ctx, repo, req, PageOptions{Size: 2, Cursor: cursor})
+			if err != nil {
+				t.Fatalf("failed to read page: %v", err)
+			}
+
+			for _, record := range page.Records {
+				got = append(got, record.AsMap()["id"].(float64))
+			}
+
+			// Upsert a record before and after the cursor of the first page.
+			if pages == 0 {
+				repo.ids = append(repo.ids, 0, 6)
+			}
+
+			if cursor = page.Next; cursor == "" {
+				break
+			}
+		}
+
+		if exp := []float64{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(got, exp) {
+			t.Fatalf("expected records %v, got %v", exp, got)
+		}
+
+		if req.GetOptions() != nil {
+			t.Fatalf("expected the request not to be modified")
+		}
+	})
+
+	t.Run("cursors are bound to the read", func(t *testing.T) {
+		t.Parallel()
+
+		repo := &pagedRepo{ids: []float64{1, 2, 3}}
+
+		page, err := ReadPage(ctx, repo, &proto.ReadRequest{Table: "trades"}, PageOptions{Size: 1})
+		if err != nil {
+			t.Fatalf("failed to read page: %v", err)
+		}
+
+		for _, tcase := range []struct {
+			table string
+			opts  PageOptions
+		}{
+			{"orders", PageOptions{Cursor: page.Next}},
+			{"trades", PageOptions{Cursor: page.Next, OrderBy: []string{"price"}}},
+			{"trades", PageOptions{Cursor: "not a cursor"}},
+		} {
+			_, err := ReadPage(ctx, repo, &proto.ReadRequest{Table: tcase.table}, tcase.opts)
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Fatalf("expected an invalid cursor error for %+v, got %v", tcase, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidari
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Priority is the priority of a run in a scheduler.
+type Priority int
+
+// Priorities of runs, e.g. "PriorityHigh" for latency-sensitive incremental syncs and "PriorityLow" for long
+// backfills.
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+// String will return the name of the priority, i.e. "low", "normal", or "high".
+func (priority Priority) String() string {
+	switch priority {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("priority(%d)", int(priority))
+	}
+}
+
+// ErrInvalidScheduler is returned when the scheduler can not start any run.
+var ErrInvalidScheduler = fmt.Errorf("invalid scheduler")
+
+// InvalidSchedulerError is returned when the number of slots of the scheduler is not positive.
+func InvalidSchedulerError(slots int) error {
+	return fmt.Errorf("%w: %d slots, expected a positive number", ErrInvalidScheduler, slots)
+}
+
+// Scheduler limits the number of runs of a process that are in progress at the same time, e.g. the jobs of a daemon
+// that contend for the same rate limits and workers. A run that is started while every slot is taken waits for a
+// slot, and the waiting run with the highest priority is started first, so incremental syncs jump ahead of queued
+// backfills. Runs that are in progress are not preempted.
+//
+// For fairness, a waiting run is raised one priority level for every "aging" that it waits, so runs of a low priority
+// are not starved by a steady stream of runs of a higher priority. Runs of the same priority are started in the order
+// they were queued.
+type Scheduler struct {
+	slots int
+	aging time.Duration
+
+	mtx     sync.Mutex
+	running int
+	queue   []*queuedRun
+
+	// now is the clock of the scheduler.
+	now func() time.Time
+}
+
+// queuedRun is a run that waits for a slot of the scheduler.
+type queuedRun struct {
+	priority Priority
+	queued   time.Time
+
+	// started is closed once the run is given a slot.
+	started chan struct{}
+}
+
+// NewScheduler will return a scheduler with the number of slots, i.e. runs that can be in progress at the same time,
+// that raises waiting runs one priority level every "aging". If aging is zero, waiting runs keep their priority.
+func NewScheduler(slots int, aging time.Duration) (*Scheduler, error) {
+	if slots < 1 {
+		return nil, InvalidSchedulerError(slots)
+	}
+
+	return &Scheduler{slots: slots, aging: aging, now: time.Now}, nil
+}
+
+// WithScheduler will wait for a slot of the scheduler before starting the run, with the priority. The priority and
+// the time that the run waited for a slot are in the report of the run.
+func WithScheduler(sched *Scheduler, priority Priority) Option {
+	return func(rnr *runner) {
+		rnr.scheduler = sched
+		rnr.priority = priority
+	}
+}
+
+// effective will return the priority of the queued run, raised for the time that it has waited.
+func (sched *Scheduler) effective(run *queuedRun, now time.Time) Priority {
+	if sched.aging <= 0 {
+		return run.priority
+	}
+
+	return run.priority + Priority(now.Sub(run.queued)/sched.aging)
+}
+
+// next will give the free slots to the queued runs with the highest effective priority. The caller must hold the
+// lock of the scheduler.
+func (sched *Scheduler) next() {
+	now := sched.now()
+
+	for sched.running < sched.slots && len(sched.queue) > 0 {
+		best := 0
+
+		for idx, run := range sched.queue[1:] {
+			if sched.effective(run, now) > sched.effective(sched.queue[best], now) {
+				best = idx + 1
+			}
+		}
+
+		run := sched.queue[best]
+		sched.queue = append(sched.queue[:best], sched.queue[best+1:]...)
+		sched.running++
+
+		close(run.started)
+	}
+}
+
+// acquire will wait for a slot for a run of the priority, and return the function that releases the slot once the
+// run ends, and how long the run waited.
+func (sched *Scheduler) acquire(ctx context.Context, priority Priority) (func(), time.Duration, error) {
+	sched.mtx.Lock()
+
+	run := &queuedRun{priority: priority, queued: sched.now(), started: make(chan struct{})}
+	sched.queue = append(sched.queue, run)
+	sched.next()
+
+	sched.mtx.Unlock()
+
+	release := func() {
+		sched.mtx.Lock()
+		defer sched.mtx.Unlock()
+
+		sched.running--
+		sched.next()
+	}
+
+	select {
+	case <-run.started:
+		return release, sched.now().Sub(run.queued), nil
+	case <-ctx.Done():
+	}
+
+	sched.mtx.Lock()
+	defer sched.mtx.Unlock()
+
+	for idx, queued := range sched.queue {
+		if queued == run {
+			sched.queue = append(sched.queue[:idx], sched.queue[idx+1:]...)
+
+			return nil, 0, fmt.Errorf("run canceled while waiting for the scheduler: %w", ctx.Err())
+		}
+	}
+
+	// The run was given a slot as it was canceled, so the slot is given to the next run.
+	sched.running--
+	sched.next()
+
+	return nil, 0, fmt.Errorf("run canceled while waiting for the scheduler: %w", ctx.Err())
+}
@@ -0,0 +1,177 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidari
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queue will queue a run of the priority on the scheduler in the background, which sends its priority to "started"
+// once it is started.
+func queue(t *testing.T, sched *Scheduler, priority Priority, started chan<- Priority) {
+	t.Helper()
+
+	sched.mtx.Lock()
+	queued := len(sched.queue)
+	sched.mtx.Unlock()
+
+	go func() {
+		release, _, err := sched.acquire(context.Background(), priority)
+		if err != nil {
+			t.Errorf("failed to acquire: %v", err)
+
+			return
+		}
+
+		started <- priority
+
+		release()
+	}()
+
+	// Wait for the run to be queued, so the runs are queued in order.
+	for {
+		sched.mtx.Lock()
+		n := len(sched.queue)
+		sched.mtx.Unlock()
+
+		if n > queued {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	t.Parallel()
+
+	t.Run("priorities jump ahead", func(t *testing.T) {
+		t.Parallel()
+
+		sched, _ := NewScheduler(1, 0)
+
+		release, _, err := sched.acquire(context.Background(), PriorityNormal)
+		if err != nil {
+			t.Fatalf("failed to acquire: %v", err)
+		}
+
+		started := make(chan Priority, 3)
+
+		queue(t, sched, PriorityLow, started)
+		queue(t, sched, PriorityNormal, started)
+		queue(t, sched, PriorityHigh, started)
+
+		release()
+
+		for _, exp := range []Priority{PriorityHigh, PriorityNormal, PriorityLow} {
+			if got := <-started; got != exp {
+				t.Fatalf("expected the %s priority run to start, got %s", exp, got)
+			}
+		}
+	})
+
+	t.Run("waiting runs age", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			mtx sync.Mutex
+			now = time.Unix(0, 0)
+		)
+
+		sched, _ := NewScheduler(1, time.Minute)
+		sched.now = func() time.Time {
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			return now
+		}
+
+		release, _, err := sched.acquire(context.Background(), PriorityHigh)
+		if err != nil {
+			t.Fatalf("failed to acquire: %v", err)
+		}
+
+		started := make(chan Priority, 2)
+
+		queue(t, sched, PriorityLow, started)
+
+		// The low priority run has waited long enough to be raised above a high priority run queued now.
+		mtx.Lock()
+		now = now.Add(3 * time.Minute)
+		mtx.Unlock()
+
+		queue(t, sched, PriorityHigh, started)
+
+		release()
+
+		if got := <-started; got != PriorityLow {
+			t.Fatalf("expected the aged low priority run to start first, got %s", got)
+		}
+
+		<-started
+	})
+
+	t.Run("canceled while waiting", func(t *testing.T) {
+		t.Parallel()
+
+		sched, _ := NewScheduler(1, 0)
+
+		release, _, err := sched.acquire(context.Background(), PriorityNormal)
+		if err != nil {
+			t.Fatalf("failed to acquire: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		if _, _, err := sched.acquire(ctx, PriorityHigh); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected error %v, got %v", context.DeadlineExceeded, err)
+		}
+
+		release()
+
+		if _, _, err := sched.acquire(context.Background(), PriorityLow); err != nil {
+			t.Fatalf("expected the slot to be free, got %v", err)
+		}
+	})
+
+	t.Run("report", func(t *testing.T) {
+		t.Parallel()
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			_, _ = rw.Write([]byte(`[{"id": 1, "open": 1.5}, {"id": 2, "open": 2.5}]`))
+		}))
+		t.Cleanup(server.Close)
+
+		sched, _ := NewScheduler(2, time.Minute)
+
+		report, err := RunConfig(context.Background(), runConfig(server.URL, t.TempDir()),
+			WithScheduler(sched, PriorityHigh))
+		if err != nil {
+			t.Fatalf("failed to run configuration: %v", err)
+		}
+
+		if report.Priority != "high" {
+			t.Fatalf("expected the priority in the report, got %q", report.Priority)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := NewScheduler(0, 0); !errors.Is(err, ErrInvalidScheduler) {
+			t.Fatalf("expected error %v, got %v", ErrInvalidScheduler, err)
+		}
+	})
+}
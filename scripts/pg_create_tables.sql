@@ -29,6 +29,12 @@ CREATE TABLE tests5 (
 	PRIMARY KEY (id)
 );
 
+CREATE TABLE tests6 (
+	id VARCHAR(255) NOT NULL,
+	test_string VARCHAR(255) NOT NULL,
+	PRIMARY KEY (id)
+);
+
 CREATE TABLE accounts (
 	available DECIMAL(20, 8) NOT NULL,
 	balance DECIMAL(20, 8) NOT NULL,
@@ -60,3 +66,20 @@ CREATE TABLE candle_minutes (
 	volume DECIMAL(20, 8) NOT NULL,
 	PRIMARY KEY (unix, product_id)
 );
+
+-- gidari_watermarks stores the watermarks for incremental timeseries requests.
+CREATE TABLE gidari_watermarks (
+	id VARCHAR(255) NOT NULL,
+	watermark VARCHAR(255) NOT NULL,
+	PRIMARY KEY (id)
+);
+
+-- conformance is the table that the storage conformance suite writes to.
+CREATE TABLE conformance (
+	id VARCHAR(255) NOT NULL,
+	flag BOOLEAN,
+	count BIGINT,
+	price DOUBLE PRECISION,
+	name TEXT,
+	PRIMARY KEY (id)
+);
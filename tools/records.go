@@ -14,9 +14,9 @@ import (
 	"io"
 	"net/http"
 	"reflect"
-	"strconv"
 
 	"github.com/alpine-hodler/gidari/proto"
+	"github.com/alpine-hodler/gidari/record"
 	"go.mongodb.org/mongo-driver/bson"
 	"google.golang.org/protobuf/types/known/structpb"
 )
@@ -40,16 +40,16 @@ type Encoder interface {
 	EncodeQuery(*http.Request)
 }
 
+// AssingRecordBSONDocument will assign the record to the BSON document.
+//
+// Deprecated: Use "record.ToBSON" instead.
 func AssingRecordBSONDocument(req *structpb.Struct, doc *bson.D) error {
-	data, err := bson.Marshal(req.AsMap())
+	converted, err := record.ToBSON(req, nil)
 	if err != nil {
 		return fmt.Errorf("%v: %w", ErrFailedToMarshalBSON, err)
 	}
 
-	err = bson.Unmarshal(data, doc)
-	if err != nil {
-		return fmt.Errorf("%v: %w", ErrFailedToUnmarshalBSON, err)
-	}
+	*doc = converted
 
 	return nil
 }
@@ -137,88 +137,17 @@ func AssignReadRequired(req *proto.ReadRequest, key string, val interface{}) err
 	return nil
 }
 
-// scanColumnPointers will scan a row into a slice of pointers, returning the slice.
-func scanColumnPointers(rows *sql.Rows, columns []string) ([]interface{}, error) {
-	// Create a slice of interface{}'s to represent each column,
-	// and a second slice to contain pointers to each item in the columns slice.
-	columnReps := make([]interface{}, len(columns))
-	columnPointers := make([]interface{}, len(columns))
-
-	for i := range columns {
-		columnPointers[i] = &columnReps[i]
-	}
-
-	// Scan the result into the column pointers...
-	if err := rows.Scan(columnPointers...); err != nil {
-		return nil, fmt.Errorf("%v: %w", ErrFailedToScanRow, err)
-	}
-
-	return columnPointers, nil
-}
-
-// sortColumnValues will sort the values of a row into a map of column name to value.
-func sortColumnValues(rows *sql.Rows, columns []string) (map[string]interface{}, error) {
-	columnPointers, err := scanColumnPointers(rows, columns)
-	if err != nil {
-		return nil, err
-	}
-
-	// Create our map, and retrieve the value for each column from the pointers slice,
-	// storing it in the map with the name of the column as the key.
-	colVal := make(map[string]interface{})
-
-	for i, colName := range columns {
-		val, ok := columnPointers[i].(*interface{})
-		if !ok {
-			return nil, ErrFailedToAssertInterface
-		}
-
-		if reflect.TypeOf(*val) == reflect.TypeOf([]byte{}) {
-			// The postgres driver treats numbers & decimal columns as []uint8. We chose to parse
-			// these values into strings.
-			f, err := strconv.ParseFloat(string((*val).([]byte)), strconv.IntSize)
-			if err != nil {
-				return nil, fmt.Errorf("%v: %w", ErrFailedToParseFloat, err)
-			}
-
-			*val = f
-		}
-
-		colVal[colName] = *val
-	}
-
-	return colVal, nil
-}
-
 // AssignStructs will convert SQL rows into structpb.Struct value and append the slice passed into the function,
 // genreralizing the process of createing JSON objects from SQL rows.
+//
+// Deprecated: Use "record.FromSQLRows" instead.
 func AssignStructs(rows *sql.Rows, val *[]*structpb.Struct) error {
-	cols, err := rows.Columns()
+	recs, err := record.FromSQLRows(rows, nil)
 	if err != nil {
-		return fmt.Errorf("%v: %w", ErrFailedToGetColumns, err)
+		return fmt.Errorf("unable to convert rows: %w", err)
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		// Scan the rows into a slice of pointers, then sort them by column name.
-		colVal, err := sortColumnValues(rows, cols)
-		if err != nil {
-			return err
-		}
-
-		// Encoded the data and append it to the response tables.
-		encodedData, err := json.Marshal(colVal)
-		if err != nil {
-			return fmt.Errorf("%w: %v", ErrFailedToMarshalJSON, err)
-		}
-
-		pbstruct := &structpb.Struct{}
-		if err = pbstruct.UnmarshalJSON(encodedData); err != nil {
-			return fmt.Errorf("%w: %v", ErrFailedToUnmarshalJSON, err)
-		}
-
-		*val = append(*val, pbstruct)
-	}
+	*val = append(*val, recs...)
 
 	return nil
 }
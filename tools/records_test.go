@@ -12,6 +12,8 @@ import (
 	"testing"
 
 	"github.com/alpine-hodler/gidari/proto"
+	"go.mongodb.org/mongo-driver/bson"
+	protobuf "google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
@@ -71,3 +73,66 @@ func TestAssignReadResponseRecords(t *testing.T) {
 		}
 	})
 }
+
+// recordSeeds are the seed corpus of the record conversion fuzz targets.
+var recordSeeds = []string{
+	`{}`,
+	`{"id": "1", "price": 1.5, "size": 100, "buy": true, "note": null}`,
+	`{"nested": {"a": [1, "b", {"c": null}]}, "empty": {}, "list": []}`,
+	`{"$oid": "62f9b5f0c2a1b2c3d4e5f6a7", "unicode": "\u00fc\u2603", "big": 1e300, "small": -5e-324}`,
+	`{"a.b": 1, "": "empty key", "neg": -0}`,
+}
+
+func FuzzAssingRecordBSONDocument(f *testing.F) {
+	for _, seed := range recordSeeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		record := new(structpb.Struct)
+		if err := record.UnmarshalJSON(data); err != nil {
+			return
+		}
+
+		var doc bson.D
+		if err := AssingRecordBSONDocument(record, &doc); err != nil {
+			// Records that can not be represented as BSON, e.g. keys with null bytes, must fail cleanly.
+			return
+		}
+
+		// Documents are read back as relaxed extended JSON, see "storage.Mongo.Read".
+		ext, err := bson.MarshalExtJSON(doc, false, false)
+		if err != nil {
+			t.Fatalf("failed to marshal document %v: %v", doc, err)
+		}
+
+		roundTrip := new(structpb.Struct)
+		if err := roundTrip.UnmarshalJSON(ext); err != nil {
+			t.Fatalf("failed to unmarshal %s: %v", ext, err)
+		}
+
+		if !protobuf.Equal(record, roundTrip) {
+			t.Fatalf("expected %v to round trip, got %v", record, roundTrip)
+		}
+	})
+}
+
+func FuzzDecodeUpsertRecords(f *testing.F) {
+	for _, seed := range recordSeeds {
+		f.Add([]byte(seed), int32(UpsertDataJSON))
+		f.Add([]byte("["+seed+","+seed+"]"), int32(UpsertDataJSON))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, dataType int32) {
+		records, err := DecodeUpsertRecords(&proto.UpsertRequest{Table: "fuzz", Data: data, DataType: dataType})
+		if err != nil {
+			return
+		}
+
+		for _, record := range records {
+			if record == nil {
+				t.Fatalf("expected no nil records decoding %q", data)
+			}
+		}
+	})
+}
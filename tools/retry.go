@@ -0,0 +1,114 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package tools
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrRetryBudgetExhausted is returned when an operation would retry, but the retry budget of the run is used up.
+var ErrRetryBudgetExhausted = fmt.Errorf("retry budget exhausted")
+
+// RetryBudgetExhaustedError is returned when the retry budget is used up, wrapping the error that would have been
+// retried.
+func RetryBudgetExhaustedError(budget *RetryBudget, err error) error {
+	retries, wait := budget.Spent()
+
+	return fmt.Errorf("%w after %d retries waiting %v: %v", ErrRetryBudgetExhausted, retries, wait, err)
+}
+
+// RetryBudget is the number of retries, and the time spent waiting to retry, shared by every retrying operation of a
+// run, e.g. web requests and storage transactions. Once the budget is used up, failing operations fail instead of
+// retrying, so that a run that keeps failing terminates instead of multiplying the retries of each layer.
+//
+// A nil budget is unlimited. The budget is safe for concurrent use.
+type RetryBudget struct {
+	maxRetries int64
+	maxWait    time.Duration
+
+	mtx       sync.Mutex
+	retries   int64
+	wait      time.Duration
+	exhausted bool
+}
+
+// NewRetryBudget will return a budget of the number of retries and the time spent waiting to retry. A non-positive
+// limit is not bounded.
+func NewRetryBudget(retries int64, wait time.Duration) *RetryBudget {
+	return &RetryBudget{maxRetries: retries, maxWait: wait}
+}
+
+// Spend will spend a retry that waits for "wait" before retrying from the budget, and return an error wrapping the
+// cause of the retry if the budget is used up. Once the budget is used up, every later retry fails.
+func (budget *RetryBudget) Spend(wait time.Duration, cause error) error {
+	if budget == nil {
+		return nil
+	}
+
+	budget.mtx.Lock()
+
+	if !budget.exhausted {
+		budget.exhausted = (budget.maxRetries > 0 && budget.retries >= budget.maxRetries) ||
+			(budget.maxWait > 0 && budget.wait+wait > budget.maxWait)
+	}
+
+	if !budget.exhausted {
+		budget.retries++
+		budget.wait += wait
+	}
+
+	exhausted := budget.exhausted
+	budget.mtx.Unlock()
+
+	if exhausted {
+		return RetryBudgetExhaustedError(budget, cause)
+	}
+
+	return nil
+}
+
+// Spent will return the number of retries, and the time spent waiting to retry, spent from the budget.
+func (budget *RetryBudget) Spent() (int64, time.Duration) {
+	if budget == nil {
+		return 0, 0
+	}
+
+	budget.mtx.Lock()
+	defer budget.mtx.Unlock()
+
+	return budget.retries, budget.wait
+}
+
+// Exhausted will return true if a retry has failed because the budget is used up.
+func (budget *RetryBudget) Exhausted() bool {
+	if budget == nil {
+		return false
+	}
+
+	budget.mtx.Lock()
+	defer budget.mtx.Unlock()
+
+	return budget.exhausted
+}
+
+type retryBudgetKey struct{}
+
+// ContextWithRetryBudget will return a copy of the context that carries the retry budget.
+func ContextWithRetryBudget(ctx context.Context, budget *RetryBudget) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, budget)
+}
+
+// RetryBudgetFromContext will return the retry budget carried by the context, or nil if there is none.
+func RetryBudgetFromContext(ctx context.Context) *RetryBudget {
+	budget, _ := ctx.Value(retryBudgetKey{}).(*RetryBudget)
+
+	return budget
+}
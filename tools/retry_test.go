@@ -0,0 +1,86 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	t.Parallel()
+
+	cause := fmt.Errorf("deadlock detected")
+
+	t.Run("nil budget is unlimited", func(t *testing.T) {
+		t.Parallel()
+
+		var budget *RetryBudget
+		if err := budget.Spend(time.Hour, cause); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if budget.Exhausted() {
+			t.Fatal("expected a nil budget not to be exhausted")
+		}
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		t.Parallel()
+
+		budget := NewRetryBudget(2, 0)
+		for i := 0; i < 2; i++ {
+			if err := budget.Spend(time.Second, cause); err != nil {
+				t.Fatalf("expected retry %d to be in the budget, got %v", i, err)
+			}
+		}
+
+		err := budget.Spend(0, cause)
+		if !errors.Is(err, ErrRetryBudgetExhausted) {
+			t.Fatalf("expected the budget to be exhausted, got %v", err)
+		}
+
+		if retries, wait := budget.Spent(); retries != 2 || wait != 2*time.Second || !budget.Exhausted() {
+			t.Fatalf("expected 2 retries waiting 2s, got %d retries waiting %v", retries, wait)
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		t.Parallel()
+
+		budget := NewRetryBudget(0, 10*time.Second)
+		if err := budget.Spend(8*time.Second, cause); err != nil {
+			t.Fatalf("expected the retry to be in the budget, got %v", err)
+		}
+
+		if err := budget.Spend(8*time.Second, cause); !errors.Is(err, ErrRetryBudgetExhausted) {
+			t.Fatalf("expected the budget to be exhausted, got %v", err)
+		}
+
+		// Once exhausted, a retry that would fit in the rest of the budget fails too.
+		if err := budget.Spend(0, cause); !errors.Is(err, ErrRetryBudgetExhausted) {
+			t.Fatalf("expected the budget to stay exhausted, got %v", err)
+		}
+	})
+
+	t.Run("context", func(t *testing.T) {
+		t.Parallel()
+
+		if budget := RetryBudgetFromContext(context.Background()); budget != nil {
+			t.Fatalf("expected no budget, got %v", budget)
+		}
+
+		budget := NewRetryBudget(1, 0)
+		if got := RetryBudgetFromContext(ContextWithRetryBudget(context.Background(), budget)); got != budget {
+			t.Fatalf("expected the budget of the context, got %v", got)
+		}
+	})
+}
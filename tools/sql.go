@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/alpine-hodler/gidari/record"
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
@@ -52,15 +53,10 @@ func SQLIterativePlaceholders(numCols int, numRows int, symbol string) string {
 
 // SQLFlattenPartition will take a slice of structures, extract data from their fields, and append it to a slice.
 // This will "flatten" the data to be used in conjunctino with placeholders in a SQL query.
+//
+// Deprecated: Use "record.ToSQLArgs" instead.
 func SQLFlattenPartition(columns []string, partition []*structpb.Struct) []interface{} {
-	var args []interface{}
-
-	for _, record := range partition {
-		hash := record.AsMap()
-		for _, column := range columns {
-			args = append(args, hash[column])
-		}
-	}
+	args, _ := record.ToSQLArgs(columns, partition, nil)
 
 	return args
 }
@@ -9,8 +9,11 @@ package tools
 
 import (
 	"reflect"
+	"sort"
 	"testing"
 
+	"github.com/alpine-hodler/gidari/proto"
+
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
@@ -101,3 +104,46 @@ func TestSqlFlattenPartition(t *testing.T) {
 		})
 	}
 }
+
+func FuzzSQLFlattenPartition(f *testing.F) {
+	for _, seed := range recordSeeds {
+		f.Add([]byte("[" + seed + "," + seed + "]"))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		partition, err := DecodeUpsertRecords(&proto.UpsertRequest{Data: data, DataType: int32(UpsertDataJSON)})
+		if err != nil {
+			return
+		}
+
+		columnSet := make(map[string]bool)
+		for _, record := range partition {
+			for column := range record.GetFields() {
+				columnSet[column] = true
+			}
+		}
+
+		columns := make([]string, 0, len(columnSet))
+		for column := range columnSet {
+			columns = append(columns, column)
+		}
+
+		sort.Strings(columns)
+
+		args := SQLFlattenPartition(columns, partition)
+		if len(args) != len(partition)*len(columns) {
+			t.Fatalf("expected %d arguments, got %d", len(partition)*len(columns), len(args))
+		}
+
+		// Every argument is the value of its column in its record, with missing columns as NULL.
+		for idx, record := range partition {
+			fields := record.AsMap()
+
+			for col, column := range columns {
+				if arg := args[idx*len(columns)+col]; !reflect.DeepEqual(arg, fields[column]) {
+					t.Fatalf("expected %v for column %q of record %d, got %v", fields[column], column, idx, arg)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,188 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidari
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpine-hodler/gidari/internal/compliance"
+	"github.com/alpine-hodler/gidari/internal/transport"
+	"github.com/alpine-hodler/gidari/tools"
+)
+
+var (
+	ErrInvalidReload = fmt.Errorf("invalid configuration reload")
+	ErrInvalidWatch  = fmt.Errorf("invalid configuration watch")
+)
+
+// InvalidReloadError is returned when the changed configuration of the source can not be loaded. The last valid
+// configuration is kept.
+func InvalidReloadError(source string, err error) error {
+	return fmt.Errorf("%w from %s: %v", ErrInvalidReload, source, tools.NewRedactor().RedactError(err))
+}
+
+// InvalidWatchError is returned when the watch of the configuration can not be started.
+func InvalidWatchError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidWatch, reason)
+}
+
+// Watcher watches the configuration of a daemon that embeds gidari, i.e. a file or a configuration endpoint, so the
+// daemon can apply changes to the configuration, e.g. new requests or rate limits, without restarting. Changes are
+// only applied once they load, so a broken edit does not take down the runs of the daemon, which keep the last valid
+// configuration:
+//
+//	watcher, err := gidari.NewWatcher(ctx, "config.yml", time.Minute)
+//	go watcher.Watch(ctx, nil, func(err error) { logger.Error(err) })
+//
+//	report, err := gidari.RunConfig(ctx, watcher.Config())
+type Watcher struct {
+	source   string
+	interval time.Duration
+
+	mtx sync.RWMutex
+	cfg []byte
+}
+
+// NewWatcher will load the configuration of the source, i.e. the path of a file or the "http://" or "https://" URL
+// of a configuration endpoint, and return the watcher that checks it for changes every interval.
+func NewWatcher(ctx context.Context, source string, interval time.Duration) (*Watcher, error) {
+	if interval <= 0 {
+		return nil, InvalidWatchError(fmt.Sprintf("interval must be positive, got %v", interval))
+	}
+
+	watcher := &Watcher{source: source, interval: interval}
+
+	cfg, err := watcher.load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load configuration: %w", tools.NewRedactor().RedactError(err))
+	}
+
+	watcher.cfg = cfg
+
+	return watcher, nil
+}
+
+// Config will return the last valid configuration of the source, to run with "RunConfig".
+func (watcher *Watcher) Config() []byte {
+	watcher.mtx.RLock()
+	defer watcher.mtx.RUnlock()
+
+	return watcher.cfg
+}
+
+// Watch will check the source for changes every interval until the context is done. A change that loads replaces the
+// configuration, and is passed to "onReload". A change that does not load, or a source that can not be read, is passed
+// to "onError" as an error wrapping "ErrInvalidReload", and is checked again on the next interval. The same failure is
+// only passed to "onError" once. Either function may be nil.
+func (watcher *Watcher) Watch(ctx context.Context, onReload func(cfgBytes []byte), onError func(err error)) {
+	ticker := time.NewTicker(watcher.interval)
+	defer ticker.Stop()
+
+	// failedCfg and failedErr are the content and the error of the last failure, i.e. a change that did not load or a
+	// source that could not be read, so that a failure is only reported once, until the source changes again.
+	var (
+		failedCfg []byte
+		failedErr string
+	)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cfg, err := watcher.read(ctx)
+		if err == nil && bytes.Equal(cfg, watcher.Config()) {
+			failedCfg, failedErr = nil, ""
+
+			continue
+		}
+
+		if err == nil {
+			_, err = transport.NewConfig(cfg)
+		}
+
+		if err != nil {
+			if onError != nil && (err.Error() != failedErr || !bytes.Equal(cfg, failedCfg)) {
+				onError(InvalidReloadError(watcher.source, err))
+			}
+
+			failedCfg, failedErr = cfg, err.Error()
+
+			continue
+		}
+
+		failedCfg, failedErr = nil, ""
+
+		watcher.mtx.Lock()
+		watcher.cfg = cfg
+		watcher.mtx.Unlock()
+
+		if onReload != nil {
+			onReload(cfg)
+		}
+	}
+}
+
+// load will read the configuration of the source and check that it loads.
+func (watcher *Watcher) load(ctx context.Context) ([]byte, error) {
+	cfg, err := watcher.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := transport.NewConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// read will read the configuration of the source.
+func (watcher *Watcher) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(watcher.source, "http://") && !strings.HasPrefix(watcher.source, "https://") {
+		cfg, err := os.ReadFile(watcher.source)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read configuration file: %w", err)
+		}
+
+		return cfg, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, watcher.source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create configuration request: %w", err)
+	}
+
+	rsp, err := compliance.HTTPClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to request configuration: %w", err)
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to request configuration: %s", rsp.Status)
+	}
+
+	cfg, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read configuration response: %w", err)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidari
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	t.Parallel()
+
+	t.Run("reloads", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "config.yml")
+		first := runConfig("https://api.test", t.TempDir())
+
+		if err := os.WriteFile(path, first, 0o600); err != nil {
+			t.Fatalf("failed to write configuration: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		watcher, err := NewWatcher(ctx, path, 5*time.Millisecond)
+		if err != nil {
+			t.Fatalf("failed to watch configuration: %v", err)
+		}
+
+		reloads := make(chan []byte, 1)
+		errs := make(chan error, 1)
+
+		go watcher.Watch(ctx, func(cfg []byte) { reloads <- cfg }, func(err error) { errs <- err })
+
+		// A broken edit is reported, and the last valid configuration is kept.
+		if err := os.WriteFile(path, []byte("url: [\n"), 0o600); err != nil {
+			t.Fatalf("failed to write configuration: %v", err)
+		}
+
+		if err := <-errs; !errors.Is(err, ErrInvalidReload) {
+			t.Fatalf("expected error %v, got %v", ErrInvalidReload, err)
+		}
+
+		if !bytes.Equal(watcher.Config(), first) {
+			t.Fatalf("expected the last valid configuration to be kept")
+		}
+
+		second := runConfig("https://api2.test", t.TempDir())
+		if err := os.WriteFile(path, second, 0o600); err != nil {
+			t.Fatalf("failed to write configuration: %v", err)
+		}
+
+		if cfg := <-reloads; !bytes.Equal(cfg, second) || !bytes.Equal(watcher.Config(), second) {
+			t.Fatalf("expected the changed configuration to be reloaded, got %q", cfg)
+		}
+	})
+
+	t.Run("endpoint", func(t *testing.T) {
+		t.Parallel()
+
+		var version int32
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			if atomic.LoadInt32(&version) == 0 {
+				_, _ = rw.Write(runConfig("https://api.test", "/tmp"))
+
+				return
+			}
+
+			_, _ = rw.Write(runConfig("https://api2.test", "/tmp"))
+		}))
+		t.Cleanup(server.Close)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		watcher, err := NewWatcher(ctx, server.URL, 5*time.Millisecond)
+		if err != nil {
+			t.Fatalf("failed to watch configuration: %v", err)
+		}
+
+		reloads := make(chan []byte, 1)
+
+		go watcher.Watch(ctx, func(cfg []byte) { reloads <- cfg }, nil)
+
+		atomic.StoreInt32(&version, 1)
+
+		if cfg := <-reloads; !bytes.Contains(cfg, []byte("https://api2.test")) {
+			t.Fatalf("expected the changed configuration to be reloaded, got %q", cfg)
+		}
+	})
+
+	t.Run("failures are reported once", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "config.yml")
+		first := runConfig("https://api.test", t.TempDir())
+
+		if err := os.WriteFile(path, first, 0o600); err != nil {
+			t.Fatalf("failed to write configuration: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		watcher, err := NewWatcher(ctx, path, 5*time.Millisecond)
+		if err != nil {
+			t.Fatalf("failed to watch configuration: %v", err)
+		}
+
+		var failures int32
+
+		reloads := make(chan []byte, 1)
+
+		go watcher.Watch(ctx, func(cfg []byte) { reloads <- cfg }, func(error) { atomic.AddInt32(&failures, 1) })
+
+		// A source that can not be read fails on every interval, but is only reported once.
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("failed to remove configuration: %v", err)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+
+		if got := atomic.LoadInt32(&failures); got != 1 {
+			t.Fatalf("expected the read failure to be reported once, got %d reports", got)
+		}
+
+		// A broken edit is a different failure.
+		if err := os.WriteFile(path, []byte("url: [\n"), 0o600); err != nil {
+			t.Fatalf("failed to write configuration: %v", err)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+
+		if got := atomic.LoadInt32(&failures); got != 2 {
+			t.Fatalf("expected the broken edit to be reported once, got %d reports", got)
+		}
+
+		second := runConfig("https://api2.test", t.TempDir())
+		if err := os.WriteFile(path, second, 0o600); err != nil {
+			t.Fatalf("failed to write configuration: %v", err)
+		}
+
+		if cfg := <-reloads; !bytes.Equal(cfg, second) {
+			t.Fatalf("expected the changed configuration to be reloaded, got %q", cfg)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "config.yml")
+		if err := os.WriteFile(path, []byte("url: [\n"), 0o600); err != nil {
+			t.Fatalf("failed to write configuration: %v", err)
+		}
+
+		if _, err := NewWatcher(context.Background(), path, time.Second); err == nil {
+			t.Fatalf("expected an error for a configuration that does not load")
+		}
+
+		if _, err := NewWatcher(context.Background(), path, 0); !errors.Is(err, ErrInvalidWatch) {
+			t.Fatalf("expected error %v, got %v", ErrInvalidWatch, err)
+		}
+	})
+}
@@ -0,0 +1,58 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidari
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/alpine-hodler/gidari/internal/transport"
+	"github.com/alpine-hodler/gidari/tools"
+	"github.com/sirupsen/logrus"
+)
+
+// WebhookHandler is the "http.Handler" that receives the webhook events of a configuration, e.g. of the "stripe"
+// preset, and writes their objects to the tables that the runs of the configuration backfill. "Close" closes its
+// connections to storage.
+type WebhookHandler = transport.WebhookHandler
+
+// NewWebhookHandler will load the YAML configuration and return the receiver of the webhook events of its "webhook",
+// to serve next to the runs of the same configuration, e.g. on a schedule:
+//
+//	handler, err := gidari.NewWebhookHandler(ctx, cfgBytes, gidari.WithLogger(logger))
+//	...
+//	defer handler.Close()
+//
+//	http.Handle("/stripe/events", handler)
+//
+// The objects of the events and of the backfills are reconciled on their IDs, so that neither stream overwrites a
+// later version of an object that the other wrote. Of the options, only "WithLogger" applies to the receiver, which
+// logs the events that it fails to write.
+func NewWebhookHandler(ctx context.Context, cfgBytes []byte, opts ...Option) (*WebhookHandler, error) {
+	rnr := &runner{logger: logrus.New()}
+	rnr.logger.SetOutput(io.Discard)
+
+	for _, opt := range opts {
+		opt(rnr)
+	}
+
+	cfg, err := transport.NewConfig(cfgBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load configuration: %w", tools.NewRedactor().RedactError(err))
+	}
+
+	cfg.Logger = rnr.logger
+
+	handler, err := transport.NewWebhookHandler(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create webhook handler: %w", err)
+	}
+
+	return handler, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 The Gidari Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+package gidari
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewWebhookHandler(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("starting_after") == "cus_1" {
+			_, _ = rw.Write([]byte(`{"data": [{"id": "cus_2"}], "has_more": false}`))
+
+			return
+		}
+
+		_, _ = rw.Write([]byte(`{"data": [{"id": "cus_1"}], "has_more": true}`))
+	}))
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	cfgBytes := []byte(`
+url: ` + server.URL + `
+connectionStrings:
+  - file://` + filepath.ToSlash(dir) + `?format=jsonl
+webhook:
+  secret: whsec_test
+preset:
+  name: stripe
+  objects: [customer]
+`)
+
+	if _, err := RunConfig(context.Background(), cfgBytes); err != nil {
+		t.Fatalf("failed to backfill: %v", err)
+	}
+
+	handler, err := NewWebhookHandler(context.Background(), cfgBytes)
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+
+	t.Cleanup(handler.Close)
+
+	// The event is created after the backfill, so it is written over the backfilled customer.
+	created := time.Now().Add(time.Second)
+	body := []byte(fmt.Sprintf(`{"id": "evt_1", "type": "customer.updated", "created": %d, `+
+		`"data": {"object": {"object": "customer", "id": "cus_1", "name": "Jenny"}}}`, created.Unix()))
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte(timestamp + "." + string(body)))
+
+	req := httptest.NewRequest(http.MethodPost, "/stripe/events", bytes.NewReader(body))
+	req.Header.Set("Stripe-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	rec := httptest.NewRecorder()
+	if handler.ServeHTTP(rec, req); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "customers*"))
+
+	var lines []string
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", file, err)
+		}
+
+		lines = append(lines, strings.Split(strings.TrimSpace(string(data)), "\n")...)
+	}
+
+	if len(lines) != 3 || !strings.Contains(strings.Join(lines, "\n"), "Jenny") {
+		t.Fatalf("expected the backfilled customers and the event, got %v", lines)
+	}
+}